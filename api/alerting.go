@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/batch"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/stats"
+	opentracing "github.com/opentracing/opentracing-go"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// how many targets of an /alerting/eval request are evaluated concurrently
+const alertEvalConcurrency = 10
+
+var (
+	// metric api.request.alerting.targets is the number of targets an /alerting/eval request is handling
+	reqAlertTargetCount = stats.NewMeter32("api.request.alerting.targets", false)
+
+	// metric api.request.alerting.errors is the number of targets of /alerting/eval requests that could not be evaluated
+	reqAlertTargetErrors = stats.NewCounter32("api.request.alerting.errors")
+)
+
+// alertEval evaluates many targets over a recent window, and returns only one aggregated value per series.
+// it's meant for alerting engines that poll many rules: the response is small and cheap to encode,
+// and a target that fails doesn't fail the others.
+func (s *Server) alertEval(ctx *middleware.Context, request models.AlertEval) {
+	span := opentracing.SpanFromContext(ctx.Req.Context())
+	span.SetTag("from", request.FromTo.From)
+	span.SetTag("until", request.FromTo.Until)
+	span.SetTag("to", request.FromTo.To)
+	span.SetTag("targets", request.Targets)
+	span.SetTag("aggregation", request.Aggregation)
+
+	consolidator := consolidation.FromConsolidateBy(request.Aggregation)
+	if consolidator == consolidation.None {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid aggregation "+request.Aggregation))
+		return
+	}
+
+	now := time.Now()
+	defaultFrom := uint32(now.Add(-5 * time.Minute).Unix())
+	defaultTo := uint32(now.Unix())
+	fromUnix, toUnix, err := getFromTo(request.FromTo, now, defaultFrom, defaultTo)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if fromUnix >= toUnix {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, InvalidTimeRangeErr.Error()))
+		return
+	}
+	reqAlertTargetCount.Value(len(request.Targets))
+
+	reqCtx := ctx.Req.Context()
+	resp := s.alertEvalTargets(reqCtx, ctx.OrgId, request.Targets, fromUnix, toUnix, consolidation.GetAggFunc(consolidator))
+
+	if err := reqCtx.Err(); err != nil {
+		//request canceled or timed out
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	response.Write(ctx, response.NewFastJson(200, resp))
+}
+
+// alertEvalTargets evaluates the targets concurrently, and aggregates the points of each resulting series into one value
+func (s *Server) alertEvalTargets(ctx context.Context, orgId uint32, targets []string, from, to uint32, aggFunc batch.AggFunc) models.AlertEvalResp {
+	resp := make(models.AlertEvalResp, len(targets))
+	limiter := make(chan struct{}, alertEvalConcurrency)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(i int, target string) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			resp[i] = models.AlertEvalResult{Target: target}
+			plan, series, err := s.evaluate(ctx, orgId, target, from, to)
+			if err != nil {
+				reqAlertTargetErrors.Inc()
+				resp[i].Error = err.Error()
+				return
+			}
+			resp[i].Series = alertValues(series, aggFunc)
+			plan.Clean()
+		}(i, target)
+	}
+	wg.Wait()
+	return resp
+}
+
+// alertValues aggregates the points of each series into one value
+func alertValues(series []models.Series, aggFunc batch.AggFunc) []models.AlertValue {
+	values := make([]models.AlertValue, len(series))
+	for i, serie := range series {
+		values[i] = models.AlertValue{
+			Name:  serie.Target,
+			Value: aggFunc(serie.Datapoints),
+			Ts:    lastTs(serie.Datapoints),
+		}
+	}
+	return values
+}
+
+// lastTs returns the timestamp of the last non-null point, or of the last point if they're all null
+func lastTs(points []schema.Point) uint32 {
+	for i := len(points) - 1; i >= 0; i-- {
+		if !math.IsNaN(points[i].Val) {
+			return points[i].Ts
+		}
+	}
+	if len(points) == 0 {
+		return 0
+	}
+	return points[len(points)-1].Ts
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/batch"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestAlertValues(t *testing.T) {
+	series := []models.Series{
+		{Target: "a", Datapoints: []schema.Point{{Val: 1, Ts: 10}, {Val: 3, Ts: 20}, {Val: math.NaN(), Ts: 30}}},
+		{Target: "b", Datapoints: []schema.Point{{Val: math.NaN(), Ts: 10}, {Val: math.NaN(), Ts: 20}}},
+		{Target: "c"},
+	}
+	values := alertValues(series, batch.Avg)
+	if len(values) != 3 {
+		t.Fatalf("expected 3 values, got %v", values)
+	}
+	if values[0].Name != "a" || values[0].Value != 2 || values[0].Ts != 20 {
+		t.Fatalf("expected a = 2 at the last non-null point 20, got %+v", values[0])
+	}
+	if values[1].Name != "b" || !math.IsNaN(values[1].Value) || values[1].Ts != 20 {
+		t.Fatalf("expected b = null at the last point 20, got %+v", values[1])
+	}
+	if values[2].Name != "c" || !math.IsNaN(values[2].Value) || values[2].Ts != 0 {
+		t.Fatalf("expected c = null without points, got %+v", values[2])
+	}
+}
+
+func TestAlertEvalTargetsErrors(t *testing.T) {
+	s := &Server{}
+	targets := []string{"sumSeries(a.*", "noSuchFunction(a.*)"}
+	resp := s.alertEvalTargets(context.Background(), 1, targets, 100, 200, batch.Lst)
+	if len(resp) != 2 {
+		t.Fatalf("expected a result per target, got %v", resp)
+	}
+	for i, r := range resp {
+		if r.Target != targets[i] || r.Error == "" || len(r.Series) != 0 {
+			t.Fatalf("expected an error for target %q, got %+v", targets[i], r)
+		}
+	}
+}
@@ -11,16 +11,25 @@ import (
 
 	_ "net/http/pprof"
 
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/backfill"
+	"github.com/grafana/metrictank/compact"
+	"github.com/grafana/metrictank/events"
+	"github.com/grafana/metrictank/health"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/pin"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/util"
+	"github.com/grafana/metrictank/verify"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/raintank/worldping-api/pkg/log"
 	"gopkg.in/macaron.v1"
 )
 
-var LogLevel int
+var LogLevel util.LogLevel
 
 var (
 	// metric api.get_target is how long it takes to get a target
@@ -34,6 +43,9 @@ var (
 
 	// metric api.requests_span.mem is the timerange of requests hitting only the ringbuffer
 	reqSpanMem = stats.NewMeter32("api.requests_span.mem", false)
+
+	// metric api.request.abandoned_fetches is the number of series fetches that were skipped or cut short, because their request was canceled or timed out
+	abandonedFetches = stats.NewCounter32("api.request.abandoned_fetches")
 )
 
 type Server struct {
@@ -47,9 +59,20 @@ type Server struct {
 	BackendStore    mdata.Store
 	PromQueryEngine *promql.Engine
 	Cache           cache.Cache
+	Pins            *pin.Pins
 	shutdown        chan struct{}
 	Tracer          opentracing.Tracer
+	TraceSampling   *tracing.Sampling
+	EventStore      events.Store
+	RollupVerifier  *verify.Verifier
+	Backfiller      *backfill.Backfiller
+	Compactor       *compact.Compactor
 	prioritySetters []PrioritySetter
+	healthReporters []namedReporter
+
+	progressReporters []namedProgressReporter
+	queueReporters    []namedQueueReporter
+	lagReporters      []namedLagReporter
 }
 
 func (s *Server) BindMetricIndex(i idx.MetricIndex) {
@@ -66,10 +89,36 @@ func (s *Server) BindCache(cache cache.Cache) {
 	s.Cache = cache
 }
 
+func (s *Server) BindPins(pins *pin.Pins) {
+	s.Pins = pins
+}
+
 func (s *Server) BindTracer(tracer opentracing.Tracer) {
 	s.Tracer = tracer
 }
 
+// BindTraceSampling sets which requests are traced. without it, all requests are
+func (s *Server) BindTraceSampling(sampling *tracing.Sampling) {
+	s.TraceSampling = sampling
+}
+
+// BindEventStore enables the /events api. nil to disable it
+func (s *Server) BindEventStore(store events.Store) {
+	s.EventStore = store
+}
+
+func (s *Server) BindRollupVerifier(v *verify.Verifier) {
+	s.RollupVerifier = v
+}
+
+func (s *Server) BindRollupBackfiller(b *backfill.Backfiller) {
+	s.Backfiller = b
+}
+
+func (s *Server) BindCompactor(c *compact.Compactor) {
+	s.Compactor = c
+}
+
 func (s *Server) BindPromQueryEngine() {
 	s.PromQueryEngine = promql.NewEngine(s, nil)
 }
@@ -82,11 +131,21 @@ func (s *Server) BindPrioritySetter(p PrioritySetter) {
 	s.prioritySetters = append(s.prioritySetters, p)
 }
 
+type namedReporter struct {
+	name string
+	health.Reporter
+}
+
+// BindHealthReporter adds the reporter as a subsystem of the /health endpoint
+func (s *Server) BindHealthReporter(name string, r health.Reporter) {
+	s.healthReporters = append(s.healthReporters, namedReporter{name, r})
+}
+
 func NewServer() (*Server, error) {
 
 	m := macaron.New()
 	m.Use(macaron.Logger())
-	m.Use(macaron.Recovery())
+	m.Use(middleware.Recovery())
 	// route pprof to where it belongs, except for our own extensions
 	m.Use(func(ctx *macaron.Context) {
 		if strings.HasPrefix(ctx.Req.URL.Path, "/debug/") &&
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/audit"
+	"github.com/grafana/metrictank/logger"
+)
+
+// auditRecord records an operation done for the request in the audit log
+func auditRecord(ctx *middleware.Context, org uint32, action, target string, count int, err error) {
+	e := audit.Entry{
+		RequestID:  logger.RequestID(ctx.Req.Context()),
+		Org:        org,
+		RemoteAddr: ctx.RemoteAddr(),
+		Action:     action,
+		Target:     target,
+		Count:      count,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	audit.Record(e)
+}
+
+func (s *Server) getAudit(ctx *middleware.Context, req models.Audit) {
+	if !audit.Enabled {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "the audit log is not enabled"))
+		return
+	}
+	f := audit.Filter{
+		Org:    req.Org,
+		Action: req.Action,
+		Target: req.Target,
+		Limit:  req.Limit,
+	}
+	if req.From > 0 {
+		f.Since = time.Unix(req.From, 0)
+	}
+	entries, err := audit.Query(f)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, entries, ""))
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/backfill"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func (s *Server) getRollupBackfill(ctx *middleware.Context) {
+	status, ok := s.Backfiller.Status()
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no backfill has been started"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, status, ""))
+}
+
+func (s *Server) startRollupBackfill(ctx *middleware.Context, req models.BackfillRollups) {
+	opts := backfill.Options{
+		Span:      req.Span,
+		From:      uint32(req.From),
+		Until:     uint32(time.Now().Unix()),
+		Overwrite: req.Overwrite,
+	}
+	if req.Until > 0 {
+		opts.Until = uint32(req.Until)
+	}
+	org := ctx.OrgId
+	target := fmt.Sprintf("span=%d from=%d until=%d overwrite=%t", opts.Span, opts.From, opts.Until, opts.Overwrite)
+	if len(req.Patterns) > 0 || len(req.Expr) > 0 {
+		if req.OrgId == 0 {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, "orgId is required to select series"))
+			return
+		}
+		if !orgAllowed(ctx, req.OrgId) {
+			return
+		}
+		org = req.OrgId
+		target += fmt.Sprintf(" patterns=%v expr=%v", req.Patterns, req.Expr)
+		keys, err := s.seriesKeys(req.OrgId, req.Patterns, req.Expr)
+		if err != nil {
+			response.Write(ctx, response.NewError(http.StatusInternalServerError, err.Error()))
+			return
+		}
+		if keys == nil {
+			// no matching series, rather than all of them
+			keys = []schema.MKey{}
+		}
+		opts.Keys = keys
+	}
+	status, err := s.Backfiller.Start(opts)
+	count := 0
+	if err == nil {
+		count = status.Series
+	}
+	auditRecord(ctx, org, "backfill.rollups", target, count, err)
+	switch err {
+	case nil:
+		response.Write(ctx, response.NewJson(200, status, ""))
+	case backfill.ErrRunning:
+		response.Write(ctx, response.NewError(http.StatusConflict, err.Error()))
+	case backfill.ErrNotPrimary:
+		response.Write(ctx, response.NewError(http.StatusServiceUnavailable, err.Error()))
+	default:
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+	}
+}
+
+func (s *Server) stopRollupBackfill(ctx *middleware.Context) {
+	if !s.Backfiller.Stop() {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no backfill is running"))
+		return
+	}
+	status, _ := s.Backfiller.Status()
+	response.Write(ctx, response.NewJson(200, status, ""))
+}
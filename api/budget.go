@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/stats"
+)
+
+var (
+	// metric api.request.render.budget.series is how many render requests were rejected because they selected more series than their budget allows
+	budgetSeriesExceeded = stats.NewCounter32("api.request.render.budget.series")
+	// metric api.request.render.budget.points is how many render requests were rejected because they needed to fetch more points than their budget allows
+	budgetPointsExceeded = stats.NewCounter32("api.request.render.budget.points")
+	// metric api.request.render.budget.chunks is how many render requests were aborted because they fetched more chunks from the store than their budget allows, on a node
+	budgetChunksExceeded = stats.NewCounter32("api.request.render.budget.chunks")
+
+	defaultBudget      queryBudget
+	budgetOverridesStr string
+	budgetOverrides    map[uint32]queryBudget
+)
+
+// queryBudget limits how much a single render request may fetch, so that a runaway query can't take down a node.
+// 0 means no limit
+type queryBudget struct {
+	maxSeries int
+	maxPoints int
+	maxChunks int
+}
+
+// getBudget returns the budget of render requests of the given org
+func getBudget(orgId uint32) queryBudget {
+	if b, ok := budgetOverrides[orgId]; ok {
+		return b
+	}
+	return defaultBudget
+}
+
+func (b queryBudget) checkSeries(series int) error {
+	if b.maxSeries > 0 && series > b.maxSeries {
+		budgetSeriesExceeded.Inc()
+		return response.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request selects more than %d series, the max-series-per-req limit. Use more specific patterns or ask your admin to increase the limit.", b.maxSeries))
+	}
+	return nil
+}
+
+func (b queryBudget) checkPoints(points uint32) error {
+	if b.maxPoints > 0 && int(points) > b.maxPoints {
+		budgetPointsExceeded.Inc()
+		return response.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request needs to fetch %d points, more than the max-points-fetched-per-req limit of %d. Reduce the time range or number of targets or ask your admin to increase the limit.", points, b.maxPoints))
+	}
+	return nil
+}
+
+// parseBudgetOverrides parses the budgets of specific orgs, as a comma separated list of
+// org:max-series:max-points-fetched:max-chunks
+func parseBudgetOverrides(s string) (map[uint32]queryBudget, error) {
+	overrides := make(map[uint32]queryBudget)
+	for _, override := range strings.Split(s, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.Split(override, ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid override %q: must be org:max-series:max-points-fetched:max-chunks", override)
+		}
+		org, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org in override %q: %s", override, err)
+		}
+		var b queryBudget
+		if b.maxSeries, err = strconv.Atoi(parts[1]); err != nil || b.maxSeries < 0 {
+			return nil, fmt.Errorf("invalid max-series in override %q", override)
+		}
+		if b.maxPoints, err = strconv.Atoi(parts[2]); err != nil || b.maxPoints < 0 {
+			return nil, fmt.Errorf("invalid max-points-fetched in override %q", override)
+		}
+		if b.maxChunks, err = strconv.Atoi(parts[3]); err != nil || b.maxChunks < 0 {
+			return nil, fmt.Errorf("invalid max-chunks in override %q", override)
+		}
+		if _, ok := overrides[uint32(org)]; ok {
+			return nil, fmt.Errorf("org %d is given more than once", org)
+		}
+		overrides[uint32(org)] = b
+	}
+	return overrides, nil
+}
+
+type chunkBudgetKey struct{}
+
+// chunkBudget counts the chunks that a request fetched from the store on this node
+type chunkBudget struct {
+	max     int64
+	fetched int64
+}
+
+// withChunkBudget returns a context that limits the chunks fetched from the store to max. 0 means no limit.
+// the budget applies per node: peers get the same budget for their part of the request.
+func withChunkBudget(ctx context.Context, max int) context.Context {
+	return context.WithValue(ctx, chunkBudgetKey{}, &chunkBudget{max: int64(max)})
+}
+
+// chunkBudgetMax returns the max chunks of the budget of the context, 0 if none
+func chunkBudgetMax(ctx context.Context) int {
+	b, ok := ctx.Value(chunkBudgetKey{}).(*chunkBudget)
+	if !ok {
+		return 0
+	}
+	return int(b.max)
+}
+
+// fetchChunks accounts for num chunks fetched from the store, and returns an error if that exceeds
+// the budget of the context
+func fetchChunks(ctx context.Context, num int) error {
+	b, ok := ctx.Value(chunkBudgetKey{}).(*chunkBudget)
+	if !ok || b.max == 0 {
+		return nil
+	}
+	fetched := atomic.AddInt64(&b.fetched, int64(num))
+	if fetched > b.max {
+		// only count the request once
+		if fetched-int64(num) <= b.max {
+			budgetChunksExceeded.Inc()
+		}
+		return response.NewError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request fetches more than %d chunks from the store, the max-chunks-per-req limit. Reduce the time range or number of targets or ask your admin to increase the limit.", b.max))
+	}
+	return nil
+}
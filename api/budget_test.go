@@ -0,0 +1,62 @@
+package api
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestParseBudgetOverrides(t *testing.T) {
+	overrides, err := parseBudgetOverrides(" 1:0:0:0, 2:1000:1000000:10000")
+	exp := map[uint32]queryBudget{
+		1: {},
+		2: {maxSeries: 1000, maxPoints: 1000000, maxChunks: 10000},
+	}
+	if err != nil || !reflect.DeepEqual(overrides, exp) {
+		t.Fatalf("expected %v, got %v, %v", exp, overrides, err)
+	}
+	for _, s := range []string{"1:0:0", "x:0:0:0", "1:-1:0:0", "1:0:x:0", "1:0:0:0,1:1:1:1"} {
+		if _, err := parseBudgetOverrides(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	defaultBudget = queryBudget{maxSeries: 10, maxPoints: 100}
+	budgetOverrides = map[uint32]queryBudget{2: {}}
+	defer func() {
+		defaultBudget = queryBudget{}
+		budgetOverrides = nil
+	}()
+
+	b := getBudget(1)
+	if b.checkSeries(10) != nil || b.checkSeries(11) == nil {
+		t.Fatalf("expected requests with more than 10 series to be rejected")
+	}
+	if b.checkPoints(100) != nil || b.checkPoints(101) == nil {
+		t.Fatalf("expected requests with more than 100 points to be rejected")
+	}
+	b = getBudget(2)
+	if b.checkSeries(11) != nil || b.checkPoints(101) != nil {
+		t.Fatalf("expected org 2 to have no limits")
+	}
+
+	ctx := withChunkBudget(context.Background(), 5)
+	if chunkBudgetMax(ctx) != 5 {
+		t.Fatalf("expected a max of 5 chunks, got %d", chunkBudgetMax(ctx))
+	}
+	exceeded := budgetChunksExceeded.Peek()
+	if err := fetchChunks(ctx, 5); err != nil {
+		t.Fatalf("expected 5 chunks to be within the budget, got %s", err)
+	}
+	if fetchChunks(ctx, 1) == nil || fetchChunks(ctx, 1) == nil {
+		t.Fatalf("expected chunks beyond the budget to be rejected")
+	}
+	if budgetChunksExceeded.Peek() != exceeded+1 {
+		t.Fatalf("expected the request to be counted once")
+	}
+	if err := fetchChunks(context.Background(), 1000); err != nil {
+		t.Fatalf("expected no limit without a budget, got %s", err)
+	}
+}
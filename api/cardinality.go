@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/raintank/dur"
+)
+
+// indexCardinality reports the number of series per org in the index of this node, and the top-level nodes
+// and tag keys that contribute the most to it, so that operators can find what makes the cardinality explode
+// without dumping the index.
+func (s *Server) indexCardinality(ctx *middleware.Context, req models.IndexCardinality) {
+	window, err := dur.ParseDuration(req.Window)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid window: "+err.Error()))
+		return
+	}
+	if req.Limit < 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "limit can't be negative"))
+		return
+	}
+	filter := func(uint32) bool { return true }
+	if req.OrgId >= 0 {
+		org := uint32(req.OrgId)
+		if !orgAllowed(ctx, org) {
+			return
+		}
+		filter = func(orgId uint32) bool { return orgId == org }
+	} else if StrictMultiTenant && ctx.OrgId != uint32(adminOrg) {
+		// the report of all orgs also covers the other orgs
+		middleware.Denied(ctx.OrgId)
+		response.Write(ctx, response.NewError(http.StatusForbidden, "only the admin org can get the cardinality of all orgs"))
+		return
+	}
+	var from int64
+	if window != 0 {
+		from = time.Now().Unix() - int64(window)
+	}
+	response.Write(ctx, response.NewJson(200, s.MetricIndex.Cardinality(filter, from, req.Limit), ""))
+}
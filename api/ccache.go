@@ -3,6 +3,9 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
 	"sync"
 
 	"github.com/grafana/metrictank/api/middleware"
@@ -10,10 +13,27 @@ import (
 	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
 	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/logger"
 	"github.com/raintank/worldping-api/pkg/log"
 )
 
 func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	fullFlush := false
+	for _, pattern := range req.Patterns {
+		if pattern == "**" {
+			fullFlush = true
+		}
+	}
+	// a full flush also clears the cache of all other orgs
+	if fullFlush && StrictMultiTenant && ctx.OrgId != uint32(adminOrg) {
+		middleware.Denied(ctx.OrgId)
+		response.Write(ctx, response.NewError(http.StatusForbidden, "only the admin org can flush the whole cache"))
+		return
+	}
+
 	res := models.CCacheDeleteResp{}
 	code := 200
 
@@ -26,13 +46,6 @@ func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete)
 		}
 	}
 
-	fullFlush := false
-	for _, pattern := range req.Patterns {
-		if pattern == "**" {
-			fullFlush = true
-		}
-	}
-
 	if fullFlush {
 		delSeries, delArchives := s.Cache.Reset()
 		res.DeletedSeries += delSeries
@@ -77,6 +90,11 @@ func (s *Server) ccacheDelete(ctx *middleware.Context, req models.CCacheDelete)
 			}
 		}
 	}
+	var err error
+	if res.Errors > 0 {
+		err = errors.New(res.FirstError)
+	}
+	auditRecord(ctx, req.OrgId, "ccache.delete", strings.Join(append(req.Patterns, req.Expr...), ","), res.DeletedSeries, err)
 	response.Write(ctx, response.NewJson(code, res, ""))
 }
 
@@ -108,10 +126,12 @@ func (s *Server) ccacheDeletePropagate(ctx context.Context, req *models.CCacheDe
 func (s *Server) ccacheDeleteRemote(ctx context.Context, req *models.CCacheDelete, peer cluster.Node) models.CCacheDeleteResp {
 	var res models.CCacheDeleteResp
 
-	log.Debug("HTTP metricDelete calling %s/ccache/delete", peer.GetName())
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP metricDelete calling %s/ccache/delete", peer.GetName())
+	}
 	buf, err := peer.Post(ctx, "ccacheDeleteRemote", "/ccache/delete", *req)
 	if err != nil {
-		log.Error(4, "HTTP ccacheDelete error querying %s/ccache/delete: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP ccacheDelete error querying %s/ccache/delete: %q", peer.GetName(), err)
 		res.FirstError = err.Error()
 		res.Errors++
 		return res
@@ -119,7 +139,7 @@ func (s *Server) ccacheDeleteRemote(ctx context.Context, req *models.CCacheDelet
 
 	err = json.Unmarshal(buf, &res)
 	if err != nil {
-		log.Error(4, "HTTP ccacheDelete error unmarshaling body from %s/ccache/delete: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP ccacheDelete error unmarshaling body from %s/ccache/delete: %q", peer.GetName(), err)
 		res.FirstError = err.Error()
 		res.Errors++
 	}
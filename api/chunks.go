@@ -0,0 +1,174 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// chunksPersist saves the current chunks of the selected series, without closing them,
+// so that the data they have so far is in the store, e.g. before a risky operation.
+// only primaries save chunks, so the request should be propagated to reach the primaries of all shards.
+func (s *Server) chunksPersist(ctx *middleware.Context, req models.ChunksPersist) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	recovery, ok := s.MemoryStore.(mdata.MetricsRecovery)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotImplemented, "the memory store does not support persisting chunks"))
+		return
+	}
+	if len(req.Patterns) == 0 && len(req.Expr) == 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "at least one pattern or tag expression must be specified"))
+		return
+	}
+
+	res := models.ChunksResp{}
+	code := 200
+	if req.Propagate {
+		res.Peers = s.chunksPropagate(ctx.Req.Context(), "/chunks/persist", &req, &req.Propagate)
+		code = chunksPeersCode(res.Peers)
+	}
+
+	keys, err := s.seriesKeys(req.OrgId, req.Patterns, req.Expr)
+	if err != nil {
+		res.Errors++
+		res.FirstError = err.Error()
+		code = 500
+	}
+	res.Series = len(keys)
+	res.NotPrimary = !cluster.Manager.IsPrimary()
+	for _, key := range keys {
+		if res.NotPrimary {
+			if _, ok := s.MemoryStore.Get(key); ok {
+				res.InMemory++
+			}
+			continue
+		}
+		persisted, ok := recovery.PersistCurrent(key)
+		if ok {
+			res.InMemory++
+			res.Persisted += persisted
+		}
+	}
+	auditRecord(ctx, req.OrgId, "chunks.persist", strings.Join(append(req.Patterns, req.Expr...), ","), res.Persisted, err)
+	response.Write(ctx, response.NewJson(code, res, ""))
+}
+
+// chunksDrop removes the selected series from memory and from the chunk cache, including the data that was not saved yet,
+// so that their data is read from the store instead, e.g. when the data in memory is corrupt.
+func (s *Server) chunksDrop(ctx *middleware.Context, req models.ChunksDrop) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	recovery, ok := s.MemoryStore.(mdata.MetricsRecovery)
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotImplemented, "the memory store does not support dropping series"))
+		return
+	}
+	if len(req.Patterns) == 0 && len(req.Expr) == 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "at least one pattern or tag expression must be specified"))
+		return
+	}
+
+	res := models.ChunksResp{}
+	code := 200
+	if req.Propagate {
+		res.Peers = s.chunksPropagate(ctx.Req.Context(), "/chunks/drop", &req, &req.Propagate)
+		code = chunksPeersCode(res.Peers)
+	}
+
+	keys, err := s.seriesKeys(req.OrgId, req.Patterns, req.Expr)
+	if err != nil {
+		res.Errors++
+		res.FirstError = err.Error()
+		code = 500
+	}
+	res.Series = len(keys)
+	for _, key := range keys {
+		if recovery.Drop(key) {
+			res.InMemory++
+		}
+		if s.Cache != nil {
+			deleted, _ := s.Cache.DelMetric(key)
+			res.DeletedSeries += deleted
+		}
+	}
+	auditRecord(ctx, req.OrgId, "chunks.drop", strings.Join(append(req.Patterns, req.Expr...), ","), res.InMemory, err)
+	response.Write(ctx, response.NewJson(code, res, ""))
+}
+
+func chunksPeersCode(peers map[string]models.ChunksResp) int {
+	for _, peer := range peers {
+		if peer.Errors > 0 {
+			return 500
+		}
+	}
+	return 200
+}
+
+// chunksPropagate sends the request to all peers, after disabling its propagation to avoid loops
+func (s *Server) chunksPropagate(ctx context.Context, path string, req cluster.Traceable, propagate *bool) map[string]models.ChunksResp {
+	*propagate = false
+
+	peers := cluster.Manager.MemberList()
+	peerResults := make(map[string]models.ChunksResp)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		if peer.IsLocal() {
+			continue
+		}
+		wg.Add(1)
+		go func(peer cluster.Node) {
+			defer wg.Done()
+			res := chunksRemote(ctx, path, req, peer)
+			mu.Lock()
+			peerResults[peer.GetName()] = res
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	return peerResults
+}
+
+func chunksRemote(ctx context.Context, path string, req cluster.Traceable, peer cluster.Node) models.ChunksResp {
+	var res models.ChunksResp
+
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP chunks calling %s%s", peer.GetName(), path)
+	}
+	buf, err := peer.Post(ctx, "chunksRemote", path, req)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 4, "HTTP chunks error querying %s%s: %q", peer.GetName(), path, err)
+		res.FirstError = err.Error()
+		res.Errors++
+		return res
+	}
+
+	err = json.Unmarshal(buf, &res)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 4, "HTTP chunks error unmarshaling body from %s%s: %q", peer.GetName(), path, err)
+		res.FirstError = err.Error()
+		res.Errors++
+	}
+	return res
+}
+
+// standbyChunks merges the chunks sent by a primary into our chunks in memory, as a secondary of their partitions.
+// see the standby package
+func (s *Server) standbyChunks(ctx *middleware.Context, req models.StandbyChunks) {
+	merged := mdata.MergeStandbyChunks(s.MemoryStore, req.Chunks)
+	response.Write(ctx, response.NewJson(200, models.StandbyChunksResp{Merged: merged}, ""))
+}
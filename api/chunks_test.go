@@ -0,0 +1,70 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/test"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestChunksPersistAndDrop(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+
+	srv, cache := newSrv(1, 3)
+	store := srv.BackendStore.(*mdata.MockStore)
+	store.Drop = false
+	testId := test.GetMKey(1)
+	srv.MetricIndex.AddOrUpdate(testId, &schema.MetricData{Id: testId.String(), OrgId: 1, Name: "broken.series", Interval: 10}, 0)
+	m := srv.MemoryStore.GetOrCreate(testId, 0, 0, 0)
+	for ts := uint32(10); ts < 300; ts += 10 {
+		m.Add(ts, 1)
+	}
+
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	post := func(path string, req interface{}) (int, models.ChunksResp) {
+		body, _ := json.Marshal(req)
+		res, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("There was an error in the request: %s", err)
+		}
+		defer res.Body.Close()
+		var resp models.ChunksResp
+		json.NewDecoder(res.Body).Decode(&resp)
+		return res.StatusCode, resp
+	}
+
+	code, resp := post("/chunks/persist", models.ChunksPersist{Patterns: []string{"broken.*"}, OrgId: 1})
+	if code != 200 || resp.Series != 1 || resp.InMemory != 1 || resp.Persisted != 1 {
+		t.Fatalf("expected the open chunk to be persisted, got %d: %+v", code, resp)
+	}
+	if store.Items() != 1 {
+		t.Fatalf("expected 1 chunk in the store, got %d", store.Items())
+	}
+	// the chunk stays open
+	m.Add(300, 1)
+	if res, err := m.Get(0, 400); err != nil || len(res.Iters) != 1 || res.Iters[0].Next() == false {
+		t.Fatalf("expected the open chunk to still be in memory, got %+v, %v", res, err)
+	}
+
+	code, resp = post("/chunks/drop", models.ChunksDrop{Patterns: []string{"broken.*"}, OrgId: 1})
+	if code != 200 || resp.InMemory != 1 || resp.DeletedSeries != 1 {
+		t.Fatalf("expected the series to be dropped, got %d: %+v", code, resp)
+	}
+	if _, ok := srv.MemoryStore.Get(testId); ok {
+		t.Fatalf("expected the series to no longer be in memory")
+	}
+	if len(cache.DelMetricKeys) != 1 || cache.DelMetricKeys[0] != testId {
+		t.Fatalf("expected the series to be deleted from the cache, got %v", cache.DelMetricKeys)
+	}
+}
@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/grafana/metrictank/api/middleware"
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/logger"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/tinylib/msgp/msgp"
 )
@@ -40,10 +43,42 @@ func (s *Server) setNodeStatus(ctx *middleware.Context, status models.NodeStatus
 		return
 	}
 	cluster.Manager.SetPrimary(primary)
+	auditRecord(ctx, ctx.OrgId, "node.primary", strconv.FormatBool(primary), 1, nil)
 	ctx.PlainText(200, []byte("OK"))
 }
 
+// setNodeReadyOverride forces the node (not) ready, e.g. to drain it, or to serve queries while lagging
+func (s *Server) setNodeReadyOverride(ctx *middleware.Context, req models.NodeReadyOverride) {
+	override, err := cluster.ReadyOverrideFromString(req.Override)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	cluster.Manager.SetReadyOverride(override)
+	auditRecord(ctx, ctx.OrgId, "node.ready", override.String(), 1, nil)
+	response.Write(ctx, response.NewJson(200, cluster.Manager.ThisNode(), ""))
+}
+
+// setNodeMaintenance toggles maintenance mode, in which the node keeps ingesting but refuses queries
+func (s *Server) setNodeMaintenance(ctx *middleware.Context, req models.NodeMaintenance) {
+	maintenance, err := strconv.ParseBool(req.Maintenance)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf(
+			"could not parse maintenance to bool. %s",
+			err.Error())),
+		)
+		return
+	}
+	cluster.Manager.SetMaintenance(maintenance)
+	auditRecord(ctx, ctx.OrgId, "node.maintenance", strconv.FormatBool(maintenance), 1, nil)
+	response.Write(ctx, response.NewJson(200, cluster.Manager.ThisNode(), ""))
+}
+
 func (s *Server) appStatus(ctx *middleware.Context) {
+	if cluster.Manager.IsMaintenance() {
+		response.Write(ctx, response.NewError(http.StatusServiceUnavailable, "node in maintenance mode"))
+		return
+	}
 	if cluster.Manager.IsReady() {
 		ctx.PlainText(200, []byte("OK"))
 		return
@@ -86,6 +121,7 @@ func (s *Server) postClusterMembers(ctx *middleware.Context, req models.ClusterM
 	}
 
 	n, err := cluster.Manager.Join(toJoin)
+	auditRecord(ctx, ctx.OrgId, "cluster.join", strings.Join(toJoin, ","), n, err)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf(
 			"error when joining cluster members: %s", err.Error())),
@@ -98,6 +134,9 @@ func (s *Server) postClusterMembers(ctx *middleware.Context, req models.ClusterM
 
 // IndexFind returns a sequence of msgp encoded idx.Node's
 func (s *Server) indexFind(ctx *middleware.Context, req models.IndexFind) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	resp := models.NewIndexFindResp()
 
 	for _, pattern := range req.Patterns {
@@ -112,6 +151,9 @@ func (s *Server) indexFind(ctx *middleware.Context, req models.IndexFind) {
 }
 
 func (s *Server) indexTagDetails(ctx *middleware.Context, req models.IndexTagDetails) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	values, err := s.MetricIndex.TagDetails(req.OrgId, req.Tag, req.Filter, req.From)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
@@ -121,6 +163,9 @@ func (s *Server) indexTagDetails(ctx *middleware.Context, req models.IndexTagDet
 }
 
 func (s *Server) indexTags(ctx *middleware.Context, req models.IndexTags) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	tags, err := s.MetricIndex.Tags(req.OrgId, req.Filter, req.From)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
@@ -130,7 +175,10 @@ func (s *Server) indexTags(ctx *middleware.Context, req models.IndexTags) {
 }
 
 func (s *Server) indexAutoCompleteTags(ctx *middleware.Context, req models.IndexAutoCompleteTags) {
-	tags, err := s.MetricIndex.FindTags(req.OrgId, req.Prefix, req.Expr, req.From, req.Limit)
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	tags, err := s.MetricIndex.FindTags(req.OrgId, req.Prefix, req.Expr, req.From, req.After, req.Limit)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
 		return
@@ -139,7 +187,10 @@ func (s *Server) indexAutoCompleteTags(ctx *middleware.Context, req models.Index
 }
 
 func (s *Server) indexAutoCompleteTagValues(ctx *middleware.Context, req models.IndexAutoCompleteTagValues) {
-	tags, err := s.MetricIndex.FindTagValues(req.OrgId, req.Tag, req.Prefix, req.Expr, req.From, req.Limit)
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	tags, err := s.MetricIndex.FindTagValues(req.OrgId, req.Tag, req.Prefix, req.Expr, req.From, req.After, req.Limit)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
 		return
@@ -148,7 +199,11 @@ func (s *Server) indexAutoCompleteTagValues(ctx *middleware.Context, req models.
 }
 
 func (s *Server) indexTagDelSeries(ctx *middleware.Context, request models.IndexTagDelSeries) {
+	if !orgAllowed(ctx, request.OrgId) {
+		return
+	}
 	deleted, err := s.MetricIndex.DeleteTagged(request.OrgId, request.Paths)
+	auditRecord(ctx, request.OrgId, "index.tags.delSeries", strings.Join(request.Paths, ","), len(deleted), err)
 	if err != nil {
 		response.Write(ctx, response.WrapErrorForTagDB(err))
 		return
@@ -161,6 +216,9 @@ func (s *Server) indexTagDelSeries(ctx *middleware.Context, request models.Index
 }
 
 func (s *Server) indexFindByTag(ctx *middleware.Context, req models.IndexFindByTag) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	metrics, err := s.MetricIndex.FindByTag(req.OrgId, req.Expr, req.From)
 	if err != nil {
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
@@ -171,6 +229,9 @@ func (s *Server) indexFindByTag(ctx *middleware.Context, req models.IndexFindByT
 
 // IndexGet returns a msgp encoded schema.MetricDefinition
 func (s *Server) indexGet(ctx *middleware.Context, req models.IndexGet) {
+	if !orgAllowed(ctx, req.MKey.Org) {
+		return
+	}
 	def, ok := s.MetricIndex.Get(req.MKey)
 	if !ok {
 		response.Write(ctx, response.NewError(http.StatusNotFound, "Not Found"))
@@ -182,6 +243,9 @@ func (s *Server) indexGet(ctx *middleware.Context, req models.IndexGet) {
 
 // IndexList returns msgp encoded schema.MetricDefinition's
 func (s *Server) indexList(ctx *middleware.Context, req models.IndexList) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	defs := s.MetricIndex.List(req.OrgId)
 	resp := make([]msgp.Marshaler, len(defs))
 	for i := range defs {
@@ -192,11 +256,19 @@ func (s *Server) indexList(ctx *middleware.Context, req models.IndexList) {
 }
 
 func (s *Server) getData(ctx *middleware.Context, request models.GetData) {
-	series, err := s.getTargetsLocal(ctx.Req.Context(), request.Requests)
+	for _, req := range request.Requests {
+		if s.sharedWith(ctx.OrgId, req.MKey) {
+			continue
+		}
+		if !orgAllowed(ctx, req.MKey.Org) {
+			return
+		}
+	}
+	series, err := s.getTargetsLocal(withChunkBudget(ctx.Req.Context(), request.MaxChunks), request.Requests)
 	if err != nil {
 		// the only errors returned are from us catching panics, so we should treat them
 		// all as internalServerErrors
-		log.Error(3, "HTTP getData() %s", err.Error())
+		logger.Error(logger.FromContext(ctx.Req.Context()), 3, "HTTP getData() %s", err.Error())
 		response.Write(ctx, response.WrapError(err))
 		return
 	}
@@ -204,7 +276,11 @@ func (s *Server) getData(ctx *middleware.Context, request models.GetData) {
 }
 
 func (s *Server) indexDelete(ctx *middleware.Context, req models.IndexDelete) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
 	defs, err := s.MetricIndex.Delete(req.OrgId, req.Query)
+	auditRecord(ctx, req.OrgId, "index.delete", req.Query, len(defs), err)
 	if err != nil {
 		// errors can only be caused by bad request.
 		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
@@ -238,11 +314,13 @@ func (s *Server) peerQuery(ctx context.Context, data cluster.Traceable, name, pa
 	} else {
 		peers, err = cluster.MembersForQuery()
 		if err != nil {
-			log.Error(3, "HTTP peerQuery unable to get peers, %s", err)
+			logger.Error(logger.FromContext(ctx), 3, "HTTP peerQuery unable to get peers, %s", err)
 			return nil, err
 		}
 	}
-	log.Debug("HTTP %s across %d instances", name, len(peers)-1)
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP %s across %d instances", name, len(peers)-1)
+	}
 
 	reqCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -259,11 +337,13 @@ func (s *Server) peerQuery(ctx context.Context, data cluster.Traceable, name, pa
 		wg.Add(1)
 		go func(peer cluster.Node) {
 			defer wg.Done()
-			log.Debug("HTTP Render querying %s%s", peer.GetName(), path)
+			if LogLevel.Get() < 2 {
+				log.Debug("HTTP Render querying %s%s", peer.GetName(), path)
+			}
 			buf, err := peer.Post(reqCtx, name, path, data)
 			if err != nil {
 				cancel()
-				log.Error(4, "HTTP Render error querying %s%s: %q", peer.GetName(), path, err)
+				logger.Error(logger.FromContext(ctx), 4, "HTTP Render error querying %s%s: %q", peer.GetName(), path, err)
 			}
 			responses <- struct {
 				data PeerResponse
@@ -287,3 +367,31 @@ func (s *Server) peerQuery(ctx context.Context, data cluster.Traceable, name, pa
 
 	return result, nil
 }
+
+// addPeerHeaders passes on the id of the request that requests to peers are made for, so they can be correlated in the logs.
+// in strict multi-tenant mode, they also carry the org of the request, and the org auth token.
+func addPeerHeaders(ctx context.Context, header http.Header) {
+	if id := logger.RequestID(ctx); id != "" {
+		header.Set("X-Request-Id", id)
+	}
+	// pass on the time we have left, so the peer doesn't keep working on our behalf after we gave up
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left > 0 {
+			header.Set("X-Request-Timeout", left.String())
+		}
+	}
+	if !StrictMultiTenant {
+		return
+	}
+	org, ok := middleware.OrgFromContext(ctx)
+	if !ok && adminOrg != 0 {
+		// requests the node makes on its own behalf, such as those of the standby replication, act as the admin org
+		org, ok = uint32(adminOrg), true
+	}
+	if ok {
+		header.Set("x-org-id", strconv.FormatUint(uint64(org), 10))
+	}
+	if orgAuthToken != nil {
+		header.Set("Authorization", "Bearer "+orgAuthToken.Get())
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/compact"
+)
+
+func (s *Server) getChunkCompaction(ctx *middleware.Context) {
+	status, ok := s.Compactor.Status()
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no compaction has been started"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, status, ""))
+}
+
+func (s *Server) startChunkCompaction(ctx *middleware.Context, req models.CompactChunks) {
+	until := uint32(time.Now().Unix())
+	if req.Until > 0 {
+		until = uint32(req.Until)
+	}
+	status, err := s.Compactor.Start(until)
+	count := 0
+	if err == nil {
+		count = status.Series
+	}
+	auditRecord(ctx, ctx.OrgId, "compact.chunks", fmt.Sprintf("until=%d", until), count, err)
+	switch err {
+	case nil:
+		response.Write(ctx, response.NewJson(200, status, ""))
+	case compact.ErrRunning:
+		response.Write(ctx, response.NewError(http.StatusConflict, err.Error()))
+	case compact.ErrNotPrimary:
+		response.Write(ctx, response.NewError(http.StatusServiceUnavailable, err.Error()))
+	case compact.ErrNotSupported:
+		response.Write(ctx, response.NewError(http.StatusNotImplemented, err.Error()))
+	default:
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+	}
+}
+
+func (s *Server) stopChunkCompaction(ctx *middleware.Context) {
+	if !s.Compactor.Stop() {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "no compaction is running"))
+		return
+	}
+	status, _ := s.Compactor.Status()
+	response.Write(ctx, response.NewJson(200, status, ""))
+}
@@ -3,10 +3,16 @@ package api
 import (
 	"flag"
 	"net"
+	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"time"
 
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/secrets"
 	"github.com/raintank/dur"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
@@ -27,8 +33,25 @@ var (
 	fallbackGraphite string
 	timeZoneStr      string
 
+	shadowGraphite      string
+	shadowSampleRate    float64
+	shadowMaxConcurrent int
+	shadowTimeout       time.Duration
+	shadowTolerance     float64
+
+	StrictMultiTenant bool
+	orgAuthTokenRef   string
+	orgAuthToken      *secrets.Secret
+	adminOrg          uint
+	apiTokensFile     string
+	apiTokens         middleware.Tokens
+
 	getTargetsConcurrency int
 	tagdbDefaultLimit     uint
+	tagdbMaxLimit         uint
+	maxExecutionTime      time.Duration
+	pinMaxDuration        time.Duration
+	pinMaxSeries          int
 
 	graphiteProxy *httputil.ReverseProxy
 	timeZone      *time.Location
@@ -38,6 +61,13 @@ func ConfigSetup() {
 	apiCfg := flag.NewFlagSet("http", flag.ExitOnError)
 	apiCfg.IntVar(&maxPointsPerReqSoft, "max-points-per-req-soft", 1000000, "lower resolution rollups will be used to try and keep requests below this number of datapoints. (0 disables limit)")
 	apiCfg.IntVar(&maxPointsPerReqHard, "max-points-per-req-hard", 20000000, "limit of number of datapoints a request can return. Requests that exceed this limit will be rejected. (0 disables limit)")
+	apiCfg.IntVar(&defaultBudget.maxSeries, "max-series-per-req", 0, "max number of series a render request may select. Requests that select more are rejected. (0 disables limit)")
+	apiCfg.IntVar(&defaultBudget.maxPoints, "max-points-fetched-per-req", 0, "max number of points a render request may fetch, after choosing the archives. Requests that need more are rejected. (0 disables limit)")
+	apiCfg.IntVar(&defaultBudget.maxChunks, "max-chunks-per-req", 0, "max number of chunks a render request may fetch from the store, on every node involved. Requests that fetch more are aborted. (0 disables limit)")
+	apiCfg.StringVar(&budgetOverridesStr, "query-budget-overrides", "", "limits of render requests of specific orgs, as a comma separated list of org:max-series:max-points-fetched:max-chunks, e.g. 1:0:0:0,2:1000:1000000:10000. 0 disables a limit")
+	apiCfg.IntVar(&renderCacheMaxSize, "render-cache-size", 0, "max size in bytes of the cache of encoded render responses, which serves repeated requests such as dashboard refreshes without fetching the data again. 0 to disable")
+	apiCfg.DurationVar(&renderCacheMaxAge, "render-cache-max-age", time.Minute, "max age of the responses in the render cache. responses are also removed as soon as a chunk of one of their series is persisted, but only nodes that consume the partition of the series learn about that")
+	apiCfg.DurationVar(&renderCacheAlign, "render-cache-align", 10*time.Minute, "the from and to of render requests are aligned to this interval to find their response in the render cache, so that refreshes of a relative time range such as the last 6h share the response. 0 to not align")
 	apiCfg.StringVar(&logMinDurStr, "log-min-dur", "5min", "only log incoming requests if their timerange is at least this duration. Use 0 to disable")
 
 	apiCfg.StringVar(&Addr, "listen", ":6060", "http listener address.")
@@ -46,13 +76,115 @@ func ConfigSetup() {
 	apiCfg.StringVar(&certFile, "cert-file", "", "SSL certificate file")
 	apiCfg.StringVar(&keyFile, "key-file", "", "SSL key file")
 	apiCfg.BoolVar(&multiTenant, "multi-tenant", true, "require x-org-id authentication to auth as a specific org. otherwise orgId 1 is assumed")
+	apiCfg.BoolVar(&StrictMultiTenant, "strict-multi-tenant", false, "every request, except the status and health checks, must carry an org, which can only access its own data. node-wide admin endpoints are restricted to admin-org. requires multi-tenant and public-org 0")
+	apiCfg.StringVar(&orgAuthTokenRef, "org-auth-token", "", "in strict multi-tenant mode, token that must be sent as 'Authorization: Bearer <token>' along with the x-org-id header, to prove the org was set by the authenticating proxy. may be an env:, file: or vault: reference. empty to not require a token")
+	apiCfg.UintVar(&adminOrg, "admin-org", 0, "in strict multi-tenant mode, the org allowed to use the node-wide admin endpoints such as /node and /loglevel. 0 to allow no org")
+	apiCfg.StringVar(&apiTokensFile, "api-tokens-file", "", "path to a file defining org scoped api tokens, with scopes and optional metric prefix/tag restrictions, sent as 'Authorization: Bearer <token>'. empty to disable")
 	apiCfg.StringVar(&fallbackGraphite, "fallback-graphite-addr", "http://localhost:8080", "in case our /render endpoint does not support the requested processing, proxy the request to this graphite")
+	apiCfg.StringVar(&shadowGraphite, "shadow-graphite-addr", "", "graphite (or other graphite compatible cluster) to also send a sample of the render requests we handle ourselves to, to compare its responses to ours. mismatches are logged and counted. empty to disable")
+	apiCfg.Float64Var(&shadowSampleRate, "shadow-sample-rate", 0.01, "fraction of the render requests to compare against the shadow-graphite-addr, between 0 and 1")
+	apiCfg.IntVar(&shadowMaxConcurrent, "shadow-max-concurrent", 10, "max number of requests in flight to the shadow-graphite-addr. sampled requests beyond that are not compared")
+	apiCfg.DurationVar(&shadowTimeout, "shadow-timeout", 30*time.Second, "timeout of requests to the shadow-graphite-addr")
+	apiCfg.Float64Var(&shadowTolerance, "shadow-tolerance", 1e-9, "relative difference between our values and the ones of the shadow-graphite-addr that is not considered a mismatch, to allow for floating point rounding")
+	apiCfg.StringVar(&federationGroupsStr, "federation-groups", "", "independent metrictank clusters, such as the ones of other regions, to also send render and find requests to, merging their results with ours. comma separated list of name=url, where url is the graphite api of any query node of the cluster. several urls of the same cluster may be given as url|url, which are tried in order. empty to disable")
+	apiCfg.DurationVar(&federationTimeout, "federation-timeout", 10*time.Second, "timeout of requests to a federation group, across all its urls")
+	apiCfg.BoolVar(&federationPartial, "federation-partial", false, "when a federation group fails, respond with the results of the other clusters instead of failing the request")
+	apiCfg.StringVar(&federationAuthTokenRef, "federation-auth-token", "", "token to send as 'Authorization: Bearer <token>' to the federation groups, e.g. their org-auth-token. may be an env:, file: or vault: reference. empty to not send a token")
 	apiCfg.StringVar(&timeZoneStr, "time-zone", "local", "timezone for interpreting from/until values when needed, specified using [zoneinfo name](https://en.wikipedia.org/wiki/Tz_database#Names_of_time_zones) e.g. 'America/New_York', 'UTC' or 'local' to use local server timezone")
 	apiCfg.IntVar(&getTargetsConcurrency, "get-targets-concurrency", 20, "maximum number of concurrent threads for fetching data on the local node. Each thread handles a single series.")
 	apiCfg.UintVar(&tagdbDefaultLimit, "tagdb-default-limit", 100, "default limit for tagdb query results, can be overridden with query parameter \"limit\"")
+	apiCfg.UintVar(&tagdbMaxLimit, "tagdb-max-limit", 10000, "max limit for tagdb query results. requests for more get this many, and page through the rest with the returned cursor")
+	apiCfg.DurationVar(&maxExecutionTime, "max-execution-time", 0, "maximum time a request may take. requests that take longer are aborted with a 503. 0 to disable")
+	apiCfg.DurationVar(&pinMaxDuration, "pin-max-duration", 24*time.Hour, "max duration for which series can be pinned in memory with the /pins api")
+	apiCfg.IntVar(&pinMaxSeries, "pin-max-series", 100000, "max number of series a pin may select on this node. pins that select more are rejected. 0 to disable pinning")
 	globalconf.Register("http", apiCfg)
 }
 
+// ConfigValidate checks the settings without side effects, for the validate-config mode
+func ConfigValidate(publicOrg int) []conf.Finding {
+	var findings []conf.Finding
+	if _, err := net.ResolveTCPAddr("tcp", Addr); err != nil {
+		findings = append(findings, conf.NewError("http.listen", "not a valid TCP address: %s", err))
+	}
+	if maxExecutionTime < 0 {
+		findings = append(findings, conf.NewError("http.max-execution-time", "must not be negative"))
+	}
+	if pinMaxDuration < 0 {
+		findings = append(findings, conf.NewError("http.pin-max-duration", "must not be negative"))
+	}
+	if pinMaxSeries < 0 {
+		findings = append(findings, conf.NewError("http.pin-max-series", "must not be negative"))
+	}
+	if defaultBudget.maxSeries < 0 {
+		findings = append(findings, conf.NewError("http.max-series-per-req", "must not be negative"))
+	}
+	if defaultBudget.maxPoints < 0 {
+		findings = append(findings, conf.NewError("http.max-points-fetched-per-req", "must not be negative"))
+	}
+	if defaultBudget.maxChunks < 0 {
+		findings = append(findings, conf.NewError("http.max-chunks-per-req", "must not be negative"))
+	}
+	if _, err := parseBudgetOverrides(budgetOverridesStr); err != nil {
+		findings = append(findings, conf.NewError("http.query-budget-overrides", "%s", err))
+	}
+	if renderCacheMaxSize < 0 {
+		findings = append(findings, conf.NewError("http.render-cache-size", "must not be negative"))
+	}
+	if renderCacheMaxSize > 0 && renderCacheMaxAge <= 0 {
+		findings = append(findings, conf.NewError("http.render-cache-max-age", "must be positive when the render cache is enabled"))
+	}
+	if renderCacheAlign < 0 {
+		findings = append(findings, conf.NewError("http.render-cache-align", "must not be negative"))
+	}
+	if shadowGraphite != "" {
+		if _, err := url.Parse(shadowGraphite); err != nil {
+			findings = append(findings, conf.NewError("http.shadow-graphite-addr", "%s", err))
+		}
+		if shadowSampleRate < 0 || shadowSampleRate > 1 {
+			findings = append(findings, conf.NewError("http.shadow-sample-rate", "must be between 0 and 1"))
+		}
+		if shadowMaxConcurrent < 1 {
+			findings = append(findings, conf.NewError("http.shadow-max-concurrent", "must be at least 1"))
+		}
+		if shadowTolerance < 0 {
+			findings = append(findings, conf.NewError("http.shadow-tolerance", "must not be negative"))
+		}
+	}
+	if federationGroupsStr != "" {
+		if _, err := parseFederationGroups(federationGroupsStr); err != nil {
+			findings = append(findings, conf.NewError("http.federation-groups", "%s", err))
+		}
+		if federationTimeout <= 0 {
+			findings = append(findings, conf.NewError("http.federation-timeout", "must be positive"))
+		}
+	}
+	if tagdbMaxLimit == 0 {
+		findings = append(findings, conf.NewError("http.tagdb-max-limit", "must be at least 1"))
+	} else if tagdbDefaultLimit > tagdbMaxLimit {
+		findings = append(findings, conf.NewWarning("http.tagdb-default-limit", "is larger than tagdb-max-limit, which applies instead"))
+	}
+	if apiTokensFile != "" {
+		if !multiTenant {
+			findings = append(findings, conf.NewError("http.api-tokens-file", "requires multi-tenant"))
+		}
+		if _, err := middleware.ReadTokens(apiTokensFile); err != nil {
+			findings = append(findings, conf.NewError("http.api-tokens-file", "%s", err))
+		}
+	}
+	if StrictMultiTenant {
+		if !multiTenant {
+			findings = append(findings, conf.NewError("http.strict-multi-tenant", "requires multi-tenant"))
+		}
+		if publicOrg != 0 {
+			findings = append(findings, conf.NewError("http.strict-multi-tenant", "public-org must be 0: public data is visible to all orgs"))
+		}
+		if orgAuthTokenRef == "" {
+			findings = append(findings, conf.NewWarning("http.org-auth-token", "no token is required: any client that can reach metrictank can act as any org"))
+		}
+	}
+	return findings
+}
+
 func ConfigProcess() {
 	logMinDur = dur.MustParseDuration("log-min-dur", logMinDurStr)
 
@@ -68,6 +200,92 @@ func ConfigProcess() {
 	}
 	graphiteProxy = NewGraphiteProxy(u)
 
+	if shadowGraphite != "" {
+		shadowURL, err = url.Parse(shadowGraphite)
+		if err != nil {
+			log.Fatal(4, "API Cannot parse shadow-graphite-addr: %s", err)
+		}
+		if shadowSampleRate < 0 || shadowSampleRate > 1 {
+			log.Fatal(4, "API shadow-sample-rate must be between 0 and 1")
+		}
+		if shadowMaxConcurrent < 1 {
+			log.Fatal(4, "API shadow-max-concurrent must be at least 1")
+		}
+		shadowClient = &http.Client{Timeout: shadowTimeout}
+		shadowSem = make(chan struct{}, shadowMaxConcurrent)
+	}
+
+	if federationGroupsStr != "" {
+		federationGroups, err = parseFederationGroups(federationGroupsStr)
+		if err != nil {
+			log.Fatal(4, "API federation-groups: %s", err)
+		}
+		if federationTimeout <= 0 {
+			log.Fatal(4, "API federation-timeout must be positive")
+		}
+		if federationAuthTokenRef != "" {
+			federationAuthToken, err = secrets.New(federationAuthTokenRef)
+			if err != nil {
+				log.Fatal(4, "API federation-auth-token: %s", err)
+			}
+		}
+		for _, g := range federationGroups {
+			g.initStats()
+		}
+		federationClient = &http.Client{}
+	}
+
+	if StrictMultiTenant {
+		if !multiTenant {
+			log.Fatal(4, "API strict-multi-tenant requires multi-tenant")
+		}
+		if orgAuthTokenRef != "" {
+			orgAuthToken, err = secrets.New(orgAuthTokenRef)
+			if err != nil {
+				log.Fatal(4, "API org-auth-token: %s", err)
+			}
+		}
+	}
+	cluster.AddPeerHeaders = addPeerHeaders
+
+	if apiTokensFile != "" {
+		if !multiTenant {
+			log.Fatal(4, "API api-tokens-file requires multi-tenant")
+		}
+		apiTokens, err = middleware.ReadTokens(apiTokensFile)
+		if err != nil {
+			log.Fatal(4, "API Cannot read api-tokens-file %q: %s", apiTokensFile, err)
+		}
+	}
+
+	if maxExecutionTime < 0 {
+		log.Fatal(4, "API max-execution-time must not be negative")
+	}
+	if pinMaxDuration < 0 || pinMaxSeries < 0 {
+		log.Fatal(4, "API pin-max-duration and pin-max-series must not be negative")
+	}
+	if tagdbMaxLimit == 0 {
+		log.Fatal(4, "API tagdb-max-limit must be at least 1")
+	}
+	if defaultBudget.maxSeries < 0 || defaultBudget.maxPoints < 0 || defaultBudget.maxChunks < 0 {
+		log.Fatal(4, "API max-series-per-req, max-points-fetched-per-req and max-chunks-per-req must not be negative")
+	}
+	budgetOverrides, err = parseBudgetOverrides(budgetOverridesStr)
+	if err != nil {
+		log.Fatal(4, "API query-budget-overrides: %s", err)
+	}
+
+	if renderCacheMaxSize < 0 || renderCacheAlign < 0 {
+		log.Fatal(4, "API render-cache-size and render-cache-align must not be negative")
+	}
+	if renderCacheMaxSize > 0 {
+		if renderCacheMaxAge <= 0 {
+			log.Fatal(4, "API render-cache-max-age must be positive when the render cache is enabled")
+		}
+		renderResponses = newRenderCache(renderCacheMaxSize, renderCacheMaxAge)
+		mdata.AddPersistHook(renderResponses.Invalidate)
+	}
+
 	if timeZoneStr == "local" {
 		timeZone = time.Local
 	} else {
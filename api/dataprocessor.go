@@ -11,6 +11,7 @@ import (
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/tracing"
@@ -194,7 +195,9 @@ func (s *Server) getTargets(ctx context.Context, reqs []models.Req) ([]models.Se
 		}
 		out = append(out, resp.series...)
 	}
-	log.Debug("DP getTargets: %d series found on cluster", len(out))
+	if LogLevel.Get() < 2 {
+		log.Debug("DP getTargets: %d series found on cluster", len(out))
+	}
 	return out, nil
 }
 
@@ -207,11 +210,13 @@ func (s *Server) getTargetsRemote(ctx context.Context, remoteReqs map[string][]m
 	wg := sync.WaitGroup{}
 	wg.Add(len(remoteReqs))
 	for _, nodeReqs := range remoteReqs {
-		log.Debug("DP getTargetsRemote: handling %d reqs from %s", len(nodeReqs), nodeReqs[0].Node.GetName())
+		if LogLevel.Get() < 2 {
+			log.Debug("DP getTargetsRemote: handling %d reqs from %s", len(nodeReqs), nodeReqs[0].Node.GetName())
+		}
 		go func(reqs []models.Req) {
 			defer wg.Done()
 			node := reqs[0].Node
-			buf, err := node.Post(rCtx, "getTargetsRemote", "/getdata", models.GetData{Requests: reqs})
+			buf, err := node.Post(rCtx, "getTargetsRemote", "/getdata", models.GetData{Requests: reqs, MaxChunks: chunkBudgetMax(ctx)})
 			if err != nil {
 				cancel()
 				responses <- getTargetsResp{nil, err}
@@ -221,11 +226,13 @@ func (s *Server) getTargetsRemote(ctx context.Context, remoteReqs map[string][]m
 			_, err = resp.UnmarshalMsg(buf)
 			if err != nil {
 				cancel()
-				log.Error(3, "DP getTargetsRemote: error unmarshaling body from %s/getdata: %q", node.GetName(), err)
+				logger.Error(logger.FromContext(ctx), 3, "DP getTargetsRemote: error unmarshaling body from %s/getdata: %q", node.GetName(), err)
 				responses <- getTargetsResp{nil, err}
 				return
 			}
-			log.Debug("DP getTargetsRemote: %s returned %d series", node.GetName(), len(resp.Series))
+			if LogLevel.Get() < 2 {
+				log.Debug("DP getTargetsRemote: %s returned %d series", node.GetName(), len(resp.Series))
+			}
 			responses <- getTargetsResp{resp.Series, nil}
 		}(nodeReqs)
 	}
@@ -243,13 +250,17 @@ func (s *Server) getTargetsRemote(ctx context.Context, remoteReqs map[string][]m
 		}
 		out = append(out, resp.series...)
 	}
-	log.Debug("DP getTargetsRemote: total of %d series found on peers", len(out))
+	if LogLevel.Get() < 2 {
+		log.Debug("DP getTargetsRemote: total of %d series found on peers", len(out))
+	}
 	return out, nil
 }
 
 // error is the error of the first failing target request
 func (s *Server) getTargetsLocal(ctx context.Context, reqs []models.Req) ([]models.Series, error) {
-	log.Debug("DP getTargetsLocal: handling %d reqs locally", len(reqs))
+	if LogLevel.Get() < 2 {
+		log.Debug("DP getTargetsLocal: handling %d reqs locally", len(reqs))
+	}
 	responses := make(chan getTargetsResp, len(reqs))
 
 	var wg sync.WaitGroup
@@ -257,14 +268,11 @@ func (s *Server) getTargetsLocal(ctx context.Context, reqs []models.Req) ([]mode
 
 	rCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-LOOP:
-	for _, req := range reqs {
+	for i, req := range reqs {
 		// check to see if the request has been canceled, if so abort now.
-		select {
-		case <-rCtx.Done():
-			//request canceled
-			break LOOP
-		default:
+		if rCtx.Err() != nil {
+			abandonedFetches.Add(len(reqs) - i)
+			break
 		}
 		// if there are already getDataConcurrency goroutines running, then block
 		// until a slot becomes free.
@@ -276,6 +284,9 @@ LOOP:
 			pre := time.Now()
 			points, interval, err := s.getTarget(rCtx, req)
 			if err != nil {
+				if err == context.Canceled || err == context.DeadlineExceeded {
+					abandonedFetches.Inc()
+				}
 				tags.Error.Set(span, true)
 				cancel() // cancel all other requests.
 				responses <- getTargetsResp{nil, err}
@@ -309,7 +320,13 @@ LOOP:
 		}
 		out = append(out, resp.series...)
 	}
-	log.Debug("DP getTargetsLocal: %d series found locally", len(out))
+	// the fetches stopped early if the request was canceled, don't return partial data
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if LogLevel.Get() < 2 {
+		log.Debug("DP getTargetsLocal: %d series found locally", len(out))
+	}
 	return out, nil
 
 }
@@ -321,11 +338,15 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 	// normalize is runtime consolidation but only for the purpose of bringing high-res
 	// series to the same resolution of lower res series.
 
-	if LogLevel < 2 {
+	if LogLevel.Get() < 2 {
 		if normalize {
-			log.Debug("DP getTarget() %s normalize:true", req.DebugString())
+			if LogLevel.Get() < 2 {
+				log.Debug("DP getTarget() %s normalize:true", req.DebugString())
+			}
 		} else {
-			log.Debug("DP getTarget() %s normalize:false", req.DebugString())
+			if LogLevel.Get() < 2 {
+				log.Debug("DP getTarget() %s normalize:false", req.DebugString())
+			}
 		}
 	}
 
@@ -337,7 +358,7 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 		if err != nil {
 			return nil, req.OutInterval, err
 		}
-		return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator), req.OutInterval, nil
+		return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator, req.XFilesFactor), req.OutInterval, nil
 	} else if readRollup && !normalize {
 		if req.Consolidator == consolidation.Avg {
 			sumFixed, err := s.getSeriesFixed(ctx, req, consolidation.Sum)
@@ -370,7 +391,7 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 			}
 			return divideContext(
 				ctx,
-				consolidation.Consolidate(sumFixed, req.AggNum, consolidation.Sum),
+				consolidation.ConsolidateXFF(sumFixed, req.AggNum, consolidation.Sum, req.XFilesFactor),
 				consolidation.Consolidate(cntFixed, req.AggNum, consolidation.Sum),
 			), req.OutInterval, nil
 		} else {
@@ -378,13 +399,13 @@ func (s *Server) getTarget(ctx context.Context, req models.Req) (points []schema
 			if err != nil {
 				return nil, req.OutInterval, err
 			}
-			return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator), req.OutInterval, nil
+			return consolidation.ConsolidateContext(ctx, fixed, req.AggNum, req.Consolidator, req.XFilesFactor), req.OutInterval, nil
 		}
 	}
 }
 
 func logLoad(typ string, key schema.AMKey, from, to uint32) {
-	if LogLevel < 2 {
+	if LogLevel.Get() < 2 {
 		log.Debug("DP load from %-6s %20s %d - %d (%s - %s) span:%ds", typ, key, from, to, util.TS(from), util.TS(to), to-from-1)
 	}
 }
@@ -393,11 +414,9 @@ func logLoad(typ string, key schema.AMKey, from, to uint32) {
 // (needed because the raw chunks don't contain quantized data)
 // TODO: we can probably forego Fix if archive > 0
 func (s *Server) getSeriesFixed(ctx context.Context, req models.Req, consolidator consolidation.Consolidator) ([]schema.Point, error) {
-	select {
-	case <-ctx.Done():
-		//request canceled
-		return nil, nil
-	default:
+	if err := ctx.Err(); err != nil {
+		//request canceled or timed out
+		return nil, err
 	}
 	rctx := newRequestContext(ctx, &req, consolidator)
 	// see newRequestContext for a detailed explanation of this.
@@ -408,11 +427,9 @@ func (s *Server) getSeriesFixed(ctx context.Context, req models.Req, consolidato
 	if err != nil {
 		return nil, err
 	}
-	select {
-	case <-ctx.Done():
-		//request canceled
-		return nil, nil
-	default:
+	if err := ctx.Err(); err != nil {
+		//request canceled or timed out
+		return nil, err
 	}
 	res.Points = append(s.itersToPoints(rctx, res.Iters), res.Points...)
 	return Fix(res.Points, req.From, req.To, req.ArchInterval), nil
@@ -426,14 +443,14 @@ func (s *Server) getSeries(ctx *requestContext) (mdata.Result, error) {
 	if err != nil {
 		return res, err
 	}
-	select {
-	case <-ctx.ctx.Done():
-		//request canceled
-		return res, nil
-	default:
+	if err := ctx.ctx.Err(); err != nil {
+		//request canceled or timed out
+		return res, err
 	}
 
-	log.Debug("oldest from aggmetrics is %d", res.Oldest)
+	if LogLevel.Get() < 2 {
+		log.Debug("oldest from aggmetrics is %d", res.Oldest)
+	}
 	span := opentracing.SpanFromContext(ctx.ctx)
 	span.SetTag("oldest_in_ring", res.Oldest)
 
@@ -471,7 +488,7 @@ func (s *Server) itersToPoints(ctx *requestContext, iters []chunk.Iter) []schema
 				points = append(points, schema.Point{Val: val, Ts: ts})
 			}
 		}
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("DP getSeries: iter %d values good/total %d/%d", iter.T0, good, total)
 		}
 	}
@@ -511,19 +528,21 @@ func (s *Server) getSeriesCachedStore(ctx *requestContext, until uint32) ([]chun
 	reqSpanBoth.ValueUint32(ctx.To - ctx.From)
 	logLoad("cassan", ctx.AMKey, ctx.From, ctx.To)
 
-	log.Debug("cache: searching query key %s, from %d, until %d", ctx.AMKey, ctx.From, until)
+	if LogLevel.Get() < 2 {
+		log.Debug("cache: searching query key %s, from %d, until %d", ctx.AMKey, ctx.From, until)
+	}
 	cacheRes, err := s.Cache.Search(ctx.ctx, ctx.AMKey, ctx.From, until)
 	if err != nil {
 		return iters, err
 	}
-	log.Debug("cache: result start %d, end %d", len(cacheRes.Start), len(cacheRes.End))
+	if LogLevel.Get() < 2 {
+		log.Debug("cache: result start %d, end %d", len(cacheRes.Start), len(cacheRes.End))
+	}
 
 	// check to see if the request has been canceled, if so abort now.
-	select {
-	case <-ctx.ctx.Done():
-		//request canceled
-		return iters, nil
-	default:
+	if err := ctx.ctx.Err(); err != nil {
+		//request canceled or timed out
+		return iters, err
 	}
 
 	for _, itgen := range cacheRes.Start {
@@ -539,11 +558,9 @@ func (s *Server) getSeriesCachedStore(ctx *requestContext, until uint32) ([]chun
 	}
 
 	// check to see if the request has been canceled, if so abort now.
-	select {
-	case <-ctx.ctx.Done():
-		//request canceled
-		return iters, nil
-	default:
+	if err := ctx.ctx.Err(); err != nil {
+		//request canceled or timed out
+		return iters, err
 	}
 
 	// the request cannot completely be served from cache, it will require store involvement
@@ -553,12 +570,13 @@ func (s *Server) getSeriesCachedStore(ctx *requestContext, until uint32) ([]chun
 			if err != nil {
 				return iters, err
 			}
+			if err := fetchChunks(ctx.ctx, len(storeIterGens)); err != nil {
+				return iters, err
+			}
 			// check to see if the request has been canceled, if so abort now.
-			select {
-			case <-ctx.ctx.Done():
-				//request canceled
-				return iters, nil
-			default:
+			if err := ctx.ctx.Err(); err != nil {
+				//request canceled or timed out. don't fill the cache with chunks that aren't needed anymore
+				return iters, err
 			}
 
 			for _, itgen := range storeIterGens {
@@ -621,7 +639,9 @@ func mergeSeries(in []models.Series) []models.Series {
 			//we use the first series in the list as our result.  We check over every
 			// point and if it is null, we then check the other series for a non null
 			// value to use instead.
-			log.Debug("DP mergeSeries: %s has multiple series.", series[0].Target)
+			if LogLevel.Get() < 2 {
+				log.Debug("DP mergeSeries: %s has multiple series.", series[0].Target)
+			}
 			for i := range series[0].Datapoints {
 				for j := 0; j < len(series); j++ {
 					if !math.IsNaN(series[j].Datapoints[i].Val) {
@@ -346,7 +346,7 @@ func TestGetSeriesFixed(t *testing.T) {
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 100, 600, 10, true))
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0, nil)
 	srv, _ := NewServer()
 	srv.BindBackendStore(store)
 	srv.BindMemoryStore(metrics)
@@ -364,7 +364,7 @@ func TestGetSeriesFixed(t *testing.T) {
 				num += 1
 				id := test.GetMKey(num)
 
-				metric := metrics.GetOrCreate(id, 0, 0)
+				metric := metrics.GetOrCreate(id, 0, 0, 0)
 				metric.Add(offset, 10)    // this point will always be quantized to 10
 				metric.Add(10+offset, 20) // this point will always be quantized to 20, so it should be selected
 				metric.Add(20+offset, 30) // this point will always be quantized to 30, so it should be selected
@@ -501,7 +501,7 @@ func TestGetSeriesCachedStore(t *testing.T) {
 	store := mdata.NewMockStore()
 	srv.BindBackendStore(store)
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0, nil)
 	srv.BindMemoryStore(metrics)
 	metric := test.GetAMKey(1)
 
@@ -683,7 +683,7 @@ func TestGetSeriesAggMetrics(t *testing.T) {
 	cluster.Init("default", "test", time.Now(), "http", 6060)
 	store := mdata.NewMockStore()
 
-	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0)
+	metrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 0, 0, 0, nil)
 	srv, _ := NewServer()
 	srv.BindBackendStore(store)
 	srv.BindMemoryStore(metrics)
@@ -695,7 +695,7 @@ func TestGetSeriesAggMetrics(t *testing.T) {
 	req.ArchInterval = archInterval
 	ctx := newRequestContext(test.NewContext(), &req, consolidation.None)
 
-	metric := metrics.GetOrCreate(metricKey, 0, 0)
+	metric := metrics.GetOrCreate(metricKey, 0, 0, 0)
 	for i := uint32(50); i < 3000; i++ {
 		metric.Add(i, float64(i^2))
 	}
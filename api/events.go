@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/events"
+)
+
+var errEventsDisabled = response.NewError(http.StatusNotFound, "events are not enabled")
+
+func (s *Server) graphiteEvents(ctx *middleware.Context, request models.GraphiteEvents) {
+	if s.EventStore == nil {
+		response.Write(ctx, errEventsDisabled)
+		return
+	}
+	now := time.Now()
+	defaultFrom := uint32(now.Add(-24 * time.Hour).Unix())
+	defaultTo := uint32(now.Unix())
+	from, until, err := getFromTo(request.FromTo, now, defaultFrom, defaultTo)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if from > until {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid range: from must be before until"))
+		return
+	}
+	evs, err := s.EventStore.Get(ctx.OrgId, int64(from), int64(until), events.ParseTags(request.Tags...))
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if evs == nil {
+		evs = []events.Event{}
+	}
+	response.Write(ctx, response.NewJson(200, evs, ""))
+}
+
+func (s *Server) graphiteEventCreate(ctx *middleware.Context) {
+	if s.EventStore == nil {
+		response.Write(ctx, errEventsDisabled)
+		return
+	}
+	var req models.GraphiteEventCreate
+	if err := json.NewDecoder(ctx.Req.Request.Body).Decode(&req); err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid event: %s", err)))
+		return
+	}
+	if req.What == "" {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "what must be set"))
+		return
+	}
+	var tags []string
+	switch t := req.Tags.(type) {
+	case nil:
+		tags = []string{}
+	case string:
+		tags = events.ParseTags(t)
+	case []interface{}:
+		var list []string
+		for _, tag := range t {
+			str, ok := tag.(string)
+			if !ok {
+				response.Write(ctx, response.NewError(http.StatusBadRequest, "tags must be strings"))
+				return
+			}
+			list = append(list, str)
+		}
+		tags = events.ParseTags(list...)
+	default:
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "tags must be a list or a space separated string"))
+		return
+	}
+	when := time.Now().Unix()
+	if req.When != nil {
+		when = int64(*req.When)
+	}
+	e := events.Event{
+		ID:   events.NewID(when),
+		When: when,
+		What: req.What,
+		Tags: tags,
+		Data: req.Data,
+	}
+	if err := s.EventStore.Add(ctx.OrgId, e); err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, e, ""))
+}
+
+func (s *Server) graphiteEvent(ctx *middleware.Context) {
+	if s.EventStore == nil {
+		response.Write(ctx, errEventsDisabled)
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Params(":id"), 10, 64)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid event id"))
+		return
+	}
+	e, err := s.EventStore.GetByID(ctx.OrgId, id)
+	if err == events.ErrNotFound {
+		response.Write(ctx, response.NewError(http.StatusNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, e, ""))
+}
+
+func (s *Server) graphiteEventDelete(ctx *middleware.Context) {
+	if s.EventStore == nil {
+		response.Write(ctx, errEventsDisabled)
+		return
+	}
+	id, err := strconv.ParseInt(ctx.Params(":id"), 10, 64)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid event id"))
+		return
+	}
+	err = s.EventStore.Delete(ctx.OrgId, id)
+	auditRecord(ctx, ctx.OrgId, "events.delete", ctx.Params(":id"), 1, err)
+	if err == events.ErrNotFound {
+		response.Write(ctx, response.NewError(http.StatusNotFound, err.Error()))
+		return
+	}
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, map[string]bool{"success": true}, ""))
+}
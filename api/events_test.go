@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/events"
+)
+
+func TestEvents(t *testing.T) {
+	timeZone = time.UTC
+	srv, _ := NewServer()
+	srv.BindEventStore(events.NewMemory())
+	srv.RegisterRoutes()
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	posts := []string{
+		`{"what": "deploy api", "tags": ["deploy", "api"], "when": 1000, "data": "v1.2"}`,
+		`{"what": "deploy web", "tags": "deploy web", "when": 2000}`,
+		`{"what": "outage", "when": 3000}`,
+	}
+	for _, body := range posts {
+		res, err := http.Post(ts.URL+"/events/", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("expected status 200 for %s, got %d", body, res.StatusCode)
+		}
+	}
+	res, err := http.Post(ts.URL+"/events/", "application/json", strings.NewReader(`{"tags": "deploy"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 400 {
+		t.Fatalf("expected status 400 for event without what, got %d", res.StatusCode)
+	}
+
+	get := func(query string) []events.Event {
+		res, err := http.Get(ts.URL + "/events/get_data?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var evs []events.Event
+		if err := json.NewDecoder(res.Body).Decode(&evs); err != nil {
+			t.Fatal(err)
+		}
+		return evs
+	}
+	cases := []struct {
+		query string
+		what  []string
+	}{
+		{"from=0&until=5000", []string{"outage", "deploy web", "deploy api"}},
+		{"from=1500&until=5000", []string{"outage", "deploy web"}},
+		{"from=0&until=5000&tags=deploy", []string{"deploy web", "deploy api"}},
+		{"from=0&until=5000&tags=deploy+api", []string{"deploy api"}},
+		{"from=0&until=5000&tags=deploy&tags=web", []string{"deploy web"}},
+	}
+	for _, c := range cases {
+		evs := get(c.query)
+		var what []string
+		for _, e := range evs {
+			what = append(what, e.What)
+		}
+		if fmt.Sprint(what) != fmt.Sprint(c.what) {
+			t.Fatalf("%s: expected %v, got %v", c.query, c.what, what)
+		}
+	}
+
+	id := get("from=0&until=1000")[0].ID
+	req, _ := http.NewRequest("DELETE", fmt.Sprintf("%s/events/%d", ts.URL, id), nil)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("expected status 200 for delete, got %d", res.StatusCode)
+	}
+	res, err = http.Get(fmt.Sprintf("%s/events/%d", ts.URL, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 404 {
+		t.Fatalf("expected status 404 for deleted event, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/features"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// unstableFunctions lets orgs use the native processing functions that are not marked stable yet,
+// without having to request process=all.
+var unstableFunctions = features.Register("unstable-functions", "process render requests with process=stable using native functions that are not stable yet")
+
+func (s *Server) getFeatures(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, features.List(), ""))
+}
+
+func (s *Server) setFeature(ctx *middleware.Context, req models.FeatureFlag) {
+	state, err := features.ParseState(req.State)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if err := features.Set(req.Name, state); err != nil {
+		response.Write(ctx, response.NewError(http.StatusNotFound, err.Error()))
+		return
+	}
+	log.Info("API: feature flag %s set to %s", req.Name, state)
+	auditRecord(ctx, ctx.OrgId, "features", req.Name+"="+state.String(), 1, nil)
+	response.Write(ctx, response.NewJson(200, features.List(), ""))
+}
@@ -0,0 +1,373 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/secrets"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// federation fans render and find requests out to independent metrictank clusters, such as the ones of other regions,
+// through their graphite api, and merges their results with the ones of our own cluster.
+// the clusters are configured as groups: a group is a cluster, of which any node can answer for the whole cluster,
+// so its urls are tried in order until one responds.
+
+// federatedHeader marks requests of a federating node, so that the remote cluster doesn't federate them again
+const federatedHeader = "X-Metrictank-Federated"
+
+var (
+	federationGroupsStr    string
+	federationTimeout      time.Duration
+	federationPartial      bool
+	federationAuthTokenRef string
+
+	federationGroups    []*federationGroup
+	federationAuthToken *secrets.Secret
+	federationClient    *http.Client
+)
+
+var federationGroupName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type federationGroup struct {
+	name string
+	urls []*url.URL
+
+	// metric api.federation.%s.requests is how many requests were sent to the remote cluster
+	requests *stats.Counter32
+	// metric api.federation.%s.errors is how many requests to the remote cluster failed on all its urls
+	errors *stats.Counter32
+	// metric api.federation.%s.latency is the duration of requests to the remote cluster
+	latency *stats.LatencyHistogram15s32
+}
+
+// parseFederationGroups parses a comma separated list of name=url, where url may be several urls separated by |
+func parseFederationGroups(s string) ([]*federationGroup, error) {
+	var groups []*federationGroup
+	seen := make(map[string]struct{})
+	for _, g := range strings.Split(s, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		parts := strings.SplitN(g, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid group %q: must be name=url", g)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !federationGroupName.MatchString(name) {
+			return nil, fmt.Errorf("invalid group name %q: may only contain letters, digits, _ and -", name)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("group %q is given more than once", name)
+		}
+		seen[name] = struct{}{}
+		group := &federationGroup{name: name}
+		for _, u := range strings.Split(parts[1], "|") {
+			parsed, err := url.Parse(strings.TrimSpace(u))
+			if err != nil {
+				return nil, fmt.Errorf("invalid url for group %q: %s", name, err)
+			}
+			if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return nil, fmt.Errorf("invalid url %q for group %q: must be http(s)://host[:port][/path]", u, name)
+			}
+			parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+			group.urls = append(group.urls, parsed)
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+func (g *federationGroup) initStats() {
+	g.requests = stats.NewCounter32("api.federation." + g.name + ".requests")
+	g.errors = stats.NewCounter32("api.federation." + g.name + ".errors")
+	g.latency = stats.NewLatencyHistogram15s32("api.federation." + g.name + ".latency")
+}
+
+type federatedKey struct{}
+
+// withFederated marks the context of a request that a federating node sent us
+func withFederated(ctx context.Context) context.Context {
+	return context.WithValue(ctx, federatedKey{}, true)
+}
+
+// federatedReq returns whether the request was sent by a federating node
+func federatedReq(ctx *middleware.Context) bool {
+	return ctx.Req.Header.Get(federatedHeader) != ""
+}
+
+// federating returns whether the request should be federated to the remote clusters.
+// requests that were federated to us are not federated again, so clusters that federate to each other don't loop.
+func federating(ctx context.Context) bool {
+	if len(federationGroups) == 0 {
+		return false
+	}
+	federated, _ := ctx.Value(federatedKey{}).(bool)
+	return !federated
+}
+
+// get requests the path of the graphite api of the remote cluster, trying its urls in order.
+// a response with a 4xx status is returned as an error right away, since the other urls would respond the same.
+func (g *federationGroup) get(ctx context.Context, orgId uint32, path string, params url.Values) ([]byte, error) {
+	g.requests.Inc()
+	pre := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, federationTimeout)
+	defer cancel()
+	var err error
+	for _, base := range g.urls {
+		var body []byte
+		var retry bool
+		body, retry, err = g.getURL(ctx, base, orgId, path, params)
+		if err == nil {
+			g.latency.Value(time.Since(pre))
+			return body, nil
+		}
+		if !retry || ctx.Err() != nil {
+			break
+		}
+		log.Warn("API federation: request to %s of group %s failed, trying the next url: %s", base.Host, g.name, err)
+	}
+	g.errors.Inc()
+	return nil, fmt.Errorf("federation group %s: %s", g.name, err)
+}
+
+func (g *federationGroup) getURL(ctx context.Context, base *url.URL, orgId uint32, path string, params url.Values) ([]byte, bool, error) {
+	u := *base
+	u.Path += path
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Org-Id", strconv.FormatUint(uint64(orgId), 10))
+	req.Header.Set(federatedHeader, "true")
+	if id := logger.RequestID(ctx); id != "" {
+		req.Header.Set("X-Request-Id", id)
+	}
+	if federationAuthToken != nil {
+		req.Header.Set("Authorization", "Bearer "+federationAuthToken.Get())
+	}
+	resp, err := federationClient.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode >= 500, fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	return body, false, nil
+}
+
+// federationResult is the result of a group, or of a request of the plan to a group
+type federationResult struct {
+	series []models.Series
+	nodes  []idx.Node
+	err    error
+}
+
+// federatedRender requests the data of the requests of the plan from the remote clusters, in the background.
+// the returned function waits for it, and returns the series in the order of the groups.
+// the remote clusters consolidate the series to the max data points of the plan, like we do.
+// it returns nil if the request is not federated.
+func federatedRender(ctx context.Context, orgId uint32, plan expr.Plan) func() ([]models.Series, error) {
+	if !federating(ctx) || len(plan.Reqs) == 0 {
+		return nil
+	}
+	results := make([][]federationResult, len(federationGroups))
+	var wg sync.WaitGroup
+	for i, g := range federationGroups {
+		results[i] = make([]federationResult, len(plan.Reqs))
+		for j, r := range plan.Reqs {
+			wg.Add(1)
+			go func(g *federationGroup, r expr.Req, res *federationResult) {
+				defer wg.Done()
+				res.series, res.err = g.render(ctx, orgId, r, plan.MaxDataPoints)
+			}(g, r, &results[i][j])
+		}
+	}
+	return func() ([]models.Series, error) {
+		wg.Wait()
+		var out []models.Series
+		for i, g := range federationGroups {
+			for _, res := range results[i] {
+				if res.err != nil {
+					if !federationPartial {
+						return nil, res.err
+					}
+					logger.Warn(logger.FromContext(ctx), "API federation: leaving out the series of group %s: %s", g.name, res.err)
+					continue
+				}
+				out = append(out, res.series...)
+			}
+		}
+		// the remote clusters don't know the scoped api token of the request
+		return filterRendered(ctx, out), nil
+	}
+}
+
+// render fetches the series of the request from the remote cluster, ready to be processed by our plan
+func (g *federationGroup) render(ctx context.Context, orgId uint32, r expr.Req, maxDataPoints uint32) ([]models.Series, error) {
+	target := r.Query
+	var wrapper string
+	if r.Cons != 0 {
+		// the consolidation of the request comes from a consolidateBy around the query. the remote cluster adds its
+		// wrapper to the targets, which we remove again, so that the series are named like our own
+		by := consolidateByName(r.Cons)
+		target = fmt.Sprintf("consolidateBy(%s,\"%s\")", r.Query, by)
+		wrapper = fmt.Sprintf(",\"%s\")", by)
+	}
+	params := url.Values{}
+	params.Set("target", target)
+	// the graphite api's from is exclusive and its until inclusive, ours the other way around
+	params.Set("from", strconv.FormatUint(uint64(r.From-1), 10))
+	params.Set("until", strconv.FormatUint(uint64(r.To-1), 10))
+	params.Set("maxDataPoints", strconv.FormatUint(uint64(maxDataPoints), 10))
+	params.Set("format", "msgp")
+	body, err := g.get(ctx, orgId, "/render", params)
+	if err != nil {
+		return nil, err
+	}
+	var series models.SeriesByTarget
+	if _, err := series.UnmarshalMsg(body); err != nil {
+		return nil, fmt.Errorf("federation group %s: could not decode render response: %s", g.name, err)
+	}
+	for i := range series {
+		s := &series[i]
+		if wrapper != "" && strings.HasPrefix(s.Target, "consolidateBy(") && strings.HasSuffix(s.Target, wrapper) {
+			s.Target = s.Target[len("consolidateBy(") : len(s.Target)-len(wrapper)]
+		}
+		s.QueryPatt, s.QueryFrom, s.QueryTo, s.QueryCons = r.Query, r.From, r.To, r.Cons
+	}
+	return series, nil
+}
+
+// consolidateByName returns the name of the consolidator, as consolidateBy takes it
+func consolidateByName(c consolidation.Consolidator) string {
+	switch c {
+	case consolidation.Avg:
+		return "avg"
+	case consolidation.Cnt:
+		return "cnt"
+	case consolidation.Lst:
+		return "last"
+	case consolidation.Min:
+		return "min"
+	case consolidation.Max:
+		return "max"
+	case consolidation.Mult:
+		return "multiply"
+	case consolidation.Med:
+		return "median"
+	case consolidation.Diff:
+		return "diff"
+	case consolidation.StdDev:
+		return "stddev"
+	case consolidation.Range:
+		return "range"
+	case consolidation.Sum:
+		return "sum"
+	}
+	return "avg"
+}
+
+// appendFederated appends the series of the remote clusters to ours. when a series is in several clusters,
+// the one of our own cluster is used, or else the one of the group that comes first.
+func appendFederated(out, federated []models.Series) []models.Series {
+	type key struct {
+		target, query string
+		from, to      uint32
+		cons          consolidation.Consolidator
+	}
+	seen := make(map[key]struct{}, len(out))
+	for _, s := range out {
+		seen[key{s.Target, s.QueryPatt, s.QueryFrom, s.QueryTo, s.QueryCons}] = struct{}{}
+	}
+	for _, s := range federated {
+		k := key{s.Target, s.QueryPatt, s.QueryFrom, s.QueryTo, s.QueryCons}
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		out = append(out, s)
+	}
+	return out
+}
+
+// federatedFind finds the nodes that match the query in the remote clusters, in the order of the groups.
+// it returns nil if the request is not federated.
+func federatedFind(ctx context.Context, orgId uint32, query string, from uint32) ([]idx.Node, error) {
+	if !federating(ctx) {
+		return nil, nil
+	}
+	results := make([]federationResult, len(federationGroups))
+	var wg sync.WaitGroup
+	for i, g := range federationGroups {
+		wg.Add(1)
+		go func(g *federationGroup, res *federationResult) {
+			defer wg.Done()
+			res.nodes, res.err = g.find(ctx, orgId, query, from)
+		}(g, &results[i])
+	}
+	wg.Wait()
+	var nodes []idx.Node
+	for i, res := range results {
+		if res.err != nil {
+			if !federationPartial {
+				return nil, res.err
+			}
+			logger.Warn(logger.FromContext(ctx), "API federation: leaving out the nodes of group %s: %s", federationGroups[i].name, res.err)
+			continue
+		}
+		nodes = append(nodes, res.nodes...)
+	}
+	// the remote clusters don't know the scoped api token of the request
+	return filterNodes(ctx, nodes), nil
+}
+
+// find finds the nodes that match the query in the remote cluster.
+// the completer format has the full path of every node, but not whether a leaf also has children
+func (g *federationGroup) find(ctx context.Context, orgId uint32, query string, from uint32) ([]idx.Node, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	if from != 0 {
+		params.Set("from", strconv.FormatUint(uint64(from), 10))
+	}
+	params.Set("format", "completer")
+	body, err := g.get(ctx, orgId, "/metrics/find", params)
+	if err != nil {
+		return nil, err
+	}
+	var completer map[string][]models.SeriesCompleterItem
+	if err := json.Unmarshal(body, &completer); err != nil {
+		return nil, fmt.Errorf("federation group %s: could not decode find response: %s", g.name, err)
+	}
+	items := completer["metrics"]
+	nodes := make([]idx.Node, len(items))
+	for i, item := range items {
+		leaf := item.IsLeaf == "1"
+		nodes[i] = idx.Node{Path: item.Path, Leaf: leaf, HasChildren: !leaf}
+	}
+	return nodes, nil
+}
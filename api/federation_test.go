@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
+	"github.com/grafana/metrictank/idx"
+	"gopkg.in/macaron.v1"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestParseFederationGroups(t *testing.T) {
+	groups, err := parseFederationGroups("eu=http://a:6060|https://b/mt/, us = http://c:6060")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, g := range groups {
+		urls := []string{g.name}
+		for _, u := range g.urls {
+			urls = append(urls, u.String())
+		}
+		got = append(got, urls)
+	}
+	exp := [][]string{{"eu", "http://a:6060", "https://b/mt"}, {"us", "http://c:6060"}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected groups %v, got %v", exp, got)
+	}
+
+	for _, s := range []string{"eu", "eu=a:6060", "eu=http://a,eu=http://b", "e.u=http://a", "eu=http://a|"} {
+		if _, err := parseFederationGroups(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+// remoteCluster returns a remote cluster with the given series, that counts its requests
+func remoteCluster(series []models.Series, requests *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		if r.Header.Get(federatedHeader) == "" || r.Header.Get("X-Org-Id") != "1" || r.Header.Get("Authorization") != "" {
+			http.Error(w, "unexpected headers", http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Path {
+		case "/render":
+			q := r.URL.Query()
+			if q.Get("target") != `consolidateBy(a.*,"max")` || q.Get("from") != "99" || q.Get("until") != "199" || q.Get("maxDataPoints") != "800" || q.Get("format") != "msgp" {
+				http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+				return
+			}
+			out := make([]models.Series, len(series))
+			for i, s := range series {
+				out[i] = models.Series{Target: `consolidateBy(` + s.Target + `,"max")`, Datapoints: s.Datapoints, Interval: 10}
+			}
+			buf, _ := models.SeriesByTarget(out).MarshalMsg(nil)
+			w.Write(buf)
+		case "/metrics/find":
+			w.Write([]byte(`{"metrics":[{"path":"a.b","name":"b","is_leaf":"1"},{"path":"a.c","name":"c","is_leaf":"0"}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func setFederationGroups(t *testing.T, s string) {
+	var err error
+	federationGroups, err = parseFederationGroups(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range federationGroups {
+		g.initStats()
+	}
+	federationClient = &http.Client{}
+	federationTimeout = time.Second
+}
+
+func TestFederatedRender(t *testing.T) {
+	var eu, down int
+	euCluster := remoteCluster([]models.Series{
+		{Target: "a.b", Datapoints: []schema.Point{{Val: 1, Ts: 110}}},
+		{Target: "a.c", Datapoints: []schema.Point{{Val: 2, Ts: 110}}},
+	}, &eu)
+	defer euCluster.Close()
+	downNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		down++
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer downNode.Close()
+
+	setFederationGroups(t, "eu="+downNode.URL+"|"+euCluster.URL)
+	defer func() { federationGroups = nil }()
+
+	r := expr.NewReq("a.*", 100, 200, consolidation.Max)
+	plan := expr.Plan{Reqs: []expr.Req{r}, MaxDataPoints: 800}
+	wait := federatedRender(context.Background(), 1, plan)
+	if wait == nil {
+		t.Fatalf("expected the request to be federated")
+	}
+	federated, err := wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down != 1 || eu != 1 {
+		t.Fatalf("expected 1 request to each url, got %d and %d", down, eu)
+	}
+
+	// a.b is also in our cluster, which takes precedence
+	local := []models.Series{{Target: "a.b", QueryPatt: "a.*", QueryFrom: 100, QueryTo: 200, QueryCons: consolidation.Max}}
+	out := appendFederated(local, federated)
+	var got []string
+	for _, s := range out {
+		if s.QueryPatt != "a.*" || s.QueryFrom != 100 || s.QueryTo != 200 || s.QueryCons != consolidation.Max {
+			t.Fatalf("expected series of the request %v, got %v", r, s)
+		}
+		got = append(got, s.Target)
+	}
+	if exp := []string{"a.b", "a.c"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected targets %v, got %v", exp, got)
+	}
+	if out[0].Datapoints != nil || len(out[1].Datapoints) != 1 || out[1].Datapoints[0].Val != 2 {
+		t.Fatalf("expected the series of our cluster to win, got %v", out)
+	}
+
+	// requests of a federating node are not federated again
+	if federatedRender(withFederated(context.Background()), 1, plan) != nil {
+		t.Fatalf("expected a federated request not to be federated again")
+	}
+}
+
+func TestFederatedRenderPartial(t *testing.T) {
+	var eu int
+	euCluster := remoteCluster([]models.Series{{Target: "a.b", Datapoints: []schema.Point{{Val: 1, Ts: 110}}}}, &eu)
+	defer euCluster.Close()
+	downNode := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer downNode.Close()
+
+	setFederationGroups(t, "us="+downNode.URL+",eu="+euCluster.URL)
+	defer func() { federationGroups, federationPartial = nil, false }()
+	plan := expr.Plan{Reqs: []expr.Req{expr.NewReq("a.*", 100, 200, consolidation.Max)}, MaxDataPoints: 800}
+
+	if _, err := federatedRender(context.Background(), 1, plan)(); err == nil {
+		t.Fatalf("expected an error when a group fails")
+	}
+	errs := federationGroups[0].errors.Peek()
+
+	federationPartial = true
+	out, err := federatedRender(context.Background(), 1, plan)()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Target != "a.b" {
+		t.Fatalf("expected the series of the eu group, got %v", out)
+	}
+	if federationGroups[0].errors.Peek() != errs+1 {
+		t.Fatalf("expected an error of the us group to be counted")
+	}
+}
+
+func TestFederatedFind(t *testing.T) {
+	var eu int
+	euCluster := remoteCluster(nil, &eu)
+	defer euCluster.Close()
+
+	setFederationGroups(t, "eu="+euCluster.URL)
+	defer func() { federationGroups = nil }()
+
+	nodes, err := federatedFind(context.Background(), 1, "a.*", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []idx.Node{{Path: "a.b", Leaf: true}, {Path: "a.c", HasChildren: true}}
+	if !reflect.DeepEqual(nodes, exp) {
+		t.Fatalf("expected nodes %v, got %v", exp, nodes)
+	}
+}
+
+func TestFederatedScopedToken(t *testing.T) {
+	tokens, err := readTestTokens(t, `
+[ab]
+token = ab-0123456789abcdef
+org = 1
+scopes = read
+prefixes = a.b
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var eu int
+	euCluster := remoteCluster([]models.Series{
+		{Target: "a.b", Datapoints: []schema.Point{{Val: 1, Ts: 110}}},
+		{Target: "a.c", Datapoints: []schema.Point{{Val: 2, Ts: 110}}},
+	}, &eu)
+	defer euCluster.Close()
+
+	setFederationGroups(t, "eu="+euCluster.URL)
+	defer func() { federationGroups = nil }()
+
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	m.Use(middleware.OrgMiddleware(true))
+	m.Use(middleware.ScopedTokens(tokens))
+	var nodes []idx.Node
+	var series []models.Series
+	var findErr, renderErr error
+	m.Get("/render", func(ctx *middleware.Context) {
+		plan := expr.Plan{Reqs: []expr.Req{expr.NewReq("a.*", 100, 200, consolidation.Max)}, MaxDataPoints: 800}
+		nodes, findErr = federatedFind(ctx.Req.Context(), ctx.OrgId, "a.*", 0)
+		series, renderErr = federatedRender(ctx.Req.Context(), ctx.OrgId, plan)()
+	})
+	req, _ := http.NewRequest("GET", "/render", nil)
+	req.Header.Set("Authorization", "Bearer ab-0123456789abcdef")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	if findErr != nil || renderErr != nil {
+		t.Fatalf("unexpected errors %v and %v", findErr, renderErr)
+	}
+	if eu != 2 {
+		t.Fatalf("expected the request to be federated, got %d remote requests", eu)
+	}
+
+	// the token may only access a.b, also on the remote clusters
+	if exp := []idx.Node{{Path: "a.b", Leaf: true}}; !reflect.DeepEqual(nodes, exp) {
+		t.Fatalf("expected nodes %v, got %v", exp, nodes)
+	}
+	if len(series) != 1 || series[0].Target != "a.b" {
+		t.Fatalf("expected only series a.b, got %v", series)
+	}
+}
@@ -2,10 +2,13 @@ package api
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"math"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +23,7 @@ import (
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/expr"
 	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/tracing"
@@ -57,10 +61,12 @@ type Series struct {
 func (s *Server) findSeries(ctx context.Context, orgId uint32, patterns []string, seenAfter int64) ([]Series, error) {
 	peers, err := cluster.MembersForQuery()
 	if err != nil {
-		log.Error(3, "HTTP findSeries unable to get peers, %s", err)
+		logger.Error(logger.FromContext(ctx), 3, "HTTP findSeries unable to get peers, %s", err)
 		return nil, err
 	}
-	log.Debug("HTTP findSeries for %v across %d instances", patterns, len(peers))
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP findSeries for %v across %d instances", patterns, len(peers))
+	}
 	var wg sync.WaitGroup
 
 	responses := make(chan struct {
@@ -70,7 +76,9 @@ func (s *Server) findSeries(ctx context.Context, orgId uint32, patterns []string
 	findCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	for _, peer := range peers {
-		log.Debug("HTTP findSeries getting results from %s", peer.GetName())
+		if LogLevel.Get() < 2 {
+			log.Debug("HTTP findSeries getting results from %s", peer.GetName())
+		}
 		wg.Add(1)
 		if peer.IsLocal() {
 			go func() {
@@ -110,22 +118,20 @@ func (s *Server) findSeries(ctx context.Context, orgId uint32, patterns []string
 	series := make([]Series, 0)
 	for resp := range responses {
 		if resp.err != nil {
-			return nil, err
+			return nil, resp.err
 		}
 		series = append(series, resp.series...)
 	}
 
-	return series, nil
+	return filterSeries(ctx, series), nil
 }
 
 func (s *Server) findSeriesLocal(ctx context.Context, orgId uint32, patterns []string, seenAfter int64) ([]Series, error) {
 	result := make([]Series, 0)
 	for _, pattern := range patterns {
-		select {
-		case <-ctx.Done():
-			//request canceled
-			return nil, nil
-		default:
+		if err := ctx.Err(); err != nil {
+			//request canceled or timed out
+			return nil, err
 		}
 		_, span := tracing.NewSpan(ctx, s.Tracer, "findSeriesLocal")
 		span.SetTag("org", orgId)
@@ -144,14 +150,18 @@ func (s *Server) findSeriesLocal(ctx context.Context, orgId uint32, patterns []s
 			Node:    cluster.Manager.ThisNode(),
 			Series:  nodes,
 		})
-		log.Debug("HTTP findSeries %d matches for %s found locally", len(nodes), pattern)
+		if LogLevel.Get() < 2 {
+			log.Debug("HTTP findSeries %d matches for %s found locally", len(nodes), pattern)
+		}
 	}
 	return result, nil
 }
 
 // findSeriesRemote calls findSeriesLocal on a peer via http rpc
 func (s *Server) findSeriesRemote(ctx context.Context, orgId uint32, patterns []string, seenAfter int64, peer cluster.Node) ([]Series, error) {
-	log.Debug("HTTP Render querying %s/index/find for %d:%q", peer.GetName(), orgId, patterns)
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP Render querying %s/index/find for %d:%q", peer.GetName(), orgId, patterns)
+	}
 	data := models.IndexFind{
 		Patterns: patterns,
 		OrgId:    orgId,
@@ -159,19 +169,17 @@ func (s *Server) findSeriesRemote(ctx context.Context, orgId uint32, patterns []
 	}
 	buf, err := peer.Post(ctx, "findSeriesRemote", "/index/find", data)
 	if err != nil {
-		log.Error(4, "HTTP Render error querying %s/index/find: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP Render error querying %s/index/find: %q", peer.GetName(), err)
 		return nil, err
 	}
-	select {
-	case <-ctx.Done():
-		//request canceled
-		return nil, nil
-	default:
+	if err := ctx.Err(); err != nil {
+		//request canceled or timed out
+		return nil, err
 	}
 	resp := models.NewIndexFindResp()
 	_, err = resp.UnmarshalMsg(buf)
 	if err != nil {
-		log.Error(4, "HTTP Find() error unmarshaling body from %s/index/find: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP Find() error unmarshaling body from %s/index/find: %q", peer.GetName(), err)
 		return nil, err
 	}
 	result := make([]Series, 0)
@@ -181,7 +189,9 @@ func (s *Server) findSeriesRemote(ctx context.Context, orgId uint32, patterns []
 			Node:    peer,
 			Series:  nodes,
 		})
-		log.Debug("HTTP findSeries %d matches for %s found on %s", len(nodes), pattern, peer.GetName())
+		if LogLevel.Get() < 2 {
+			log.Debug("HTTP findSeries %d matches for %s found on %s", len(nodes), pattern, peer.GetName())
+		}
 	}
 	return result, nil
 }
@@ -193,6 +203,13 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	if len(request.Targets) == 0 {
 		request.Targets = request.TargetsRails
 	}
+	policy := s.orgPolicy(ctx.OrgId)
+	if request.MaxDataPoints == 0 {
+		request.MaxDataPoints = defaultMaxDataPoints
+		if policy.MaxDataPoints > 0 {
+			request.MaxDataPoints = policy.MaxDataPoints
+		}
+	}
 
 	span.SetTag("from", request.FromTo.From)
 	span.SetTag("until", request.FromTo.Until)
@@ -203,6 +220,8 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 	span.SetTag("format", request.Format)
 	span.SetTag("noproxy", request.NoProxy)
 	span.SetTag("process", request.Process)
+	span.SetTag("archive", request.Archive)
+	span.SetTag("xFilesFactor", request.XFilesFactor)
 
 	now := time.Now()
 	defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
@@ -216,11 +235,31 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		response.Write(ctx, response.NewError(http.StatusBadRequest, InvalidTimeRangeErr.Error()))
 		return
 	}
+	fromUnix, err = applyOrgPolicy(policy, defaultTo, fromUnix, toUnix)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
 
 	span.SetTag("fromUnix", fromUnix)
 	span.SetTag("toUnix", toUnix)
 	span.SetTag("span", toUnix-fromUnix)
 
+	archReq, err := models.ParseArchiveReq(request.Archive)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	// -1 means: use the xFilesFactor of the storage-aggregation rule of each series
+	xFilesFactor := float64(-1)
+	if request.XFilesFactor != "" {
+		xFilesFactor, err = strconv.ParseFloat(request.XFilesFactor, 64)
+		if err != nil || xFilesFactor < 0 || xFilesFactor > 1 {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid xFilesFactor %q. must be between 0 and 1", request.XFilesFactor)))
+			return
+		}
+	}
+
 	// render API is modeled after graphite, so from exclusive, to inclusive.
 	// in MT, from is inclusive, to is exclusive (which is akin to slice syntax)
 	// so we must adjust
@@ -242,13 +281,8 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		return
 	}
 
-	stable := request.Process == "stable"
-	mdp := request.MaxDataPoints
-	if request.NoProxy {
-		// if this request is coming from graphite, we should not do runtime consolidation
-		// as graphite needs high-res data to perform its processing.
-		mdp = 0
-	}
+	stable := request.Process == "stable" && !unstableFunctions.Enabled(ctx.OrgId)
+	mdp := runtimeMaxDataPoints(request)
 	plan, err := expr.NewPlan(exprs, fromUnix, toUnix, mdp, stable, nil)
 	if err != nil {
 		if fun, ok := err.(expr.ErrUnknownFunction); ok {
@@ -273,10 +307,36 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		return
 	}
 
+	if xFilesFactor > 0 {
+		plan.XFilesFactor = xFilesFactor
+	}
+
+	// streamed responses are not cached: they are meant for responses too big to keep in memory
+	var cacheKey string
+	if renderResponses != nil && !request.Stream {
+		cacheKey = renderCacheKey(ctx.OrgId, request, fromUnix, toUnix, mdp, stable)
+		if federatedReq(ctx) && len(federationGroups) != 0 {
+			// requests of federating nodes only get our own series, unlike the same request of a client
+			cacheKey = "federated|" + cacheKey
+		}
+		if resp, ok := renderResponses.Get(cacheKey, now); ok {
+			span.SetTag("cached", true)
+			response.Write(ctx, resp)
+			plan.Clean()
+			return
+		}
+	}
+
 	newctx, span := tracing.NewSpan(ctx.Req.Context(), s.Tracer, "executePlan")
 	defer span.Finish()
+	if cacheKey != "" {
+		newctx = withRenderSeries(newctx)
+	}
+	if federatedReq(ctx) {
+		newctx = withFederated(newctx)
+	}
 	ctx.Req = macaron.Request{ctx.Req.WithContext(newctx)}
-	out, err := s.executePlan(ctx.Req.Context(), ctx.OrgId, plan)
+	out, err := s.executePlan(ctx.Req.Context(), ctx.OrgId, plan, archReq, xFilesFactor)
 	if err != nil {
 		err := response.WrapError(err)
 		if err.Code() != http.StatusBadRequest {
@@ -287,13 +347,10 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		return
 	}
 
-	// check to see if the request has been canceled, if so abort now.
-	select {
-	case <-newctx.Done():
-		//request canceled
-		response.Write(ctx, response.RequestCanceledErr)
+	// check to see if the request has been canceled or timed out, if so abort now.
+	if err := newctx.Err(); err != nil {
+		response.Write(ctx, response.WrapError(err))
 		return
-	default:
 	}
 
 	noDataPoints := true
@@ -306,16 +363,49 @@ func (s *Server) renderMetrics(ctx *middleware.Context, request models.GraphiteR
 		span.SetTag("nodatapoints", true)
 	}
 
+	if shadowSample(request) {
+		// undo the adjustment to our from inclusive, to exclusive semantics
+		shadowRender(ctx.OrgId, request, fromUnix-1, toUnix-1, out)
+	}
+
+	span.SetTag("stream", request.Stream)
+	if request.Stream && request.Format != "pickle" {
+		// the encoding is written out as it goes, which keeps the memory needed for responses with many series bounded
+		stream := models.SeriesByTarget(out).Stream(request.Format)
+		switch request.Format {
+		case "msgp":
+			response.Write(ctx.Resp, response.NewMsgpStream(200, stream))
+		case "msgpack":
+			response.Write(ctx.Resp, response.NewMsgpackStream(200, stream))
+		default:
+			response.Write(ctx.Resp, response.NewJsonStream(200, stream))
+		}
+		plan.Clean()
+		return
+	}
+
+	var resp response.Response
 	switch request.Format {
 	case "msgp":
-		response.Write(ctx, response.NewMsgp(200, models.SeriesByTarget(out)))
+		resp = response.NewMsgp(200, models.SeriesByTarget(out))
 	case "msgpack":
-		response.Write(ctx, response.NewMsgpack(200, models.SeriesByTarget(out).ForGraphite("msgpack")))
+		resp = response.NewMsgpack(200, models.SeriesByTarget(out).ForGraphite("msgpack"))
 	case "pickle":
-		response.Write(ctx, response.NewPickle(200, models.SeriesByTarget(out)))
+		resp = response.NewPickle(200, models.SeriesByTarget(out))
 	default:
-		response.Write(ctx, response.NewFastJson(200, models.SeriesByTarget(out)))
+		resp = response.NewFastJson(200, models.SeriesByTarget(out))
 	}
+	if cacheKey != "" {
+		cached, err := newCachedResponse(resp)
+		if err != nil {
+			response.Write(ctx, response.WrapError(err))
+			plan.Clean()
+			return
+		}
+		renderResponses.Add(cacheKey, renderSeries(newctx), cached, now)
+		resp = cached
+	}
+	response.Write(ctx, resp)
 	plan.Clean()
 }
 
@@ -329,11 +419,19 @@ func (s *Server) metricsFind(ctx *middleware.Context, request models.GraphiteFin
 	}
 	nodes := make([]idx.Node, 0)
 	reqCtx := ctx.Req.Context()
+	if federatedReq(ctx) {
+		reqCtx = withFederated(reqCtx)
+	}
 	series, err := s.findSeries(reqCtx, ctx.OrgId, []string{request.Query}, int64(fromUnix))
 	if err != nil {
 		response.Write(ctx, response.WrapError(err))
 		return
 	}
+	federated, err := federatedFind(reqCtx, ctx.OrgId, request.Query, fromUnix)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
 
 	// check to see if the request has been canceled, if so abort now.
 	select {
@@ -358,6 +456,13 @@ func (s *Server) metricsFind(ctx *middleware.Context, request models.GraphiteFin
 			}
 		}
 	}
+	// the remote clusters come after ours, so our nodes win
+	for _, n := range federated {
+		if _, ok := seenPaths[n.Path]; !ok {
+			nodes = append(nodes, n)
+			seenPaths[n.Path] = struct{}{}
+		}
+	}
 
 	switch request.Format {
 	case "", "treejson", "json":
@@ -376,10 +481,12 @@ func (s *Server) listLocal(orgId uint32) []idx.Archive {
 }
 
 func (s *Server) listRemote(ctx context.Context, orgId uint32, peer cluster.Node) ([]idx.Archive, error) {
-	log.Debug("HTTP IndexJson() querying %s/index/list for %d", peer.GetName(), orgId)
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP IndexJson() querying %s/index/list for %d", peer.GetName(), orgId)
+	}
 	buf, err := peer.Post(ctx, "listRemote", "/index/list", models.IndexList{OrgId: orgId})
 	if err != nil {
-		log.Error(4, "HTTP IndexJson() error querying %s/index/list: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP IndexJson() error querying %s/index/list: %q", peer.GetName(), err)
 		return nil, err
 	}
 	select {
@@ -393,7 +500,7 @@ func (s *Server) listRemote(ctx context.Context, orgId uint32, peer cluster.Node
 		var def idx.Archive
 		buf, err = def.UnmarshalMsg(buf)
 		if err != nil {
-			log.Error(3, "HTTP IndexJson() error unmarshaling body from %s/index/list: %q", peer.GetName(), err)
+			logger.Error(logger.FromContext(ctx), 3, "HTTP IndexJson() error unmarshaling body from %s/index/list: %q", peer.GetName(), err)
 			return nil, err
 		}
 		result = append(result, def)
@@ -470,6 +577,7 @@ func (s *Server) metricsIndex(ctx *middleware.Context) {
 	default:
 	}
 
+	series = filterArchives(reqCtx, series)
 	response.Write(ctx, response.NewFastJson(200, models.MetricNames(series)))
 }
 
@@ -558,9 +666,16 @@ func findTreejson(query string, nodes []idx.Node) models.SeriesTree {
 }
 
 func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete) {
+	if !ctx.Token.AllowsPattern(req.Query) {
+		middleware.Denied(ctx.OrgId)
+		response.Write(ctx, response.NewError(http.StatusForbidden, "the token may not delete all series matching the query"))
+		return
+	}
 	peers := cluster.Manager.MemberList()
 	peers = append(peers, cluster.Manager.ThisNode())
-	log.Debug("HTTP metricsDelete for %v across %d instances", req.Query, len(peers))
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP metricsDelete for %v across %d instances", req.Query, len(peers))
+	}
 
 	reqCtx, cancel := context.WithCancel(ctx.Req.Context())
 	defer cancel()
@@ -571,7 +686,9 @@ func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete
 	}, len(peers))
 	var wg sync.WaitGroup
 	for _, peer := range peers {
-		log.Debug("HTTP metricsDelete getting results from %s", peer.GetName())
+		if LogLevel.Get() < 2 {
+			log.Debug("HTTP metricsDelete getting results from %s", peer.GetName())
+		}
 		wg.Add(1)
 		if peer.IsLocal() {
 			go func() {
@@ -614,11 +731,13 @@ func (s *Server) metricsDelete(ctx *middleware.Context, req models.MetricsDelete
 
 	for resp := range responses {
 		if resp.err != nil {
+			auditRecord(ctx, ctx.OrgId, "metrics.delete", req.Query, deleted, resp.err)
 			response.Write(ctx, response.WrapError(resp.err))
 			return
 		}
 		deleted += resp.deleted
 	}
+	auditRecord(ctx, ctx.OrgId, "metrics.delete", req.Query, deleted, nil)
 
 	// check to see if the request has been canceled, if so abort now.
 	select {
@@ -642,7 +761,9 @@ func (s *Server) metricsDeleteLocal(orgId uint32, query string) (int, error) {
 }
 
 func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query string, peer cluster.Node) (int, error) {
-	log.Debug("HTTP metricDelete calling %s/index/delete for %d:%q", peer.GetName(), orgId, query)
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP metricDelete calling %s/index/delete for %d:%q", peer.GetName(), orgId, query)
+	}
 
 	body := models.IndexDelete{
 		Query: query,
@@ -650,7 +771,7 @@ func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query st
 	}
 	buf, err := peer.Post(ctx, "metricsDeleteRemote", "/index/delete", body)
 	if err != nil {
-		log.Error(4, "HTTP metricDelete error querying %s/index/delete: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP metricDelete error querying %s/index/delete: %q", peer.GetName(), err)
 		return 0, err
 	}
 
@@ -664,7 +785,7 @@ func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query st
 	resp := models.MetricsDeleteResp{}
 	_, err = resp.UnmarshalMsg(buf)
 	if err != nil {
-		log.Error(4, "HTTP metricDelete error unmarshaling body from %s/index/delete: %q", peer.GetName(), err)
+		logger.Error(logger.FromContext(ctx), 4, "HTTP metricDelete error unmarshaling body from %s/index/delete: %q", peer.GetName(), err)
 		return 0, err
 	}
 
@@ -674,7 +795,13 @@ func (s *Server) metricsDeleteRemote(ctx context.Context, orgId uint32, query st
 // executePlan looks up the needed data, retrieves it, and then invokes the processing
 // note if you do something like sum(foo.*) and all of those metrics happen to be on another node,
 // we will collect all the indidividual series from the peer, and then sum here. that could be optimized
-func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan) ([]models.Series, error) {
+// archReq and xFilesFactor are passed on to the requests for data. see models.ArchiveReq and models.Req
+func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan, archReq models.ArchiveReq, xFilesFactor float64) ([]models.Series, error) {
+	budget := getBudget(orgId)
+	ctx = withChunkBudget(ctx, budget.maxChunks)
+	defaultCons := s.orgPolicy(orgId).Consolidator()
+	// the remote clusters fetch and consolidate their series while we find and fetch ours
+	remote := federatedRender(ctx, orgId, plan)
 
 	minFrom := uint32(math.MaxUint32)
 	var maxTo uint32
@@ -684,11 +811,9 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 	// e.g. target=movingAvg(foo.*, "1h")&target=foo.*
 	// note that in this case we fetch foo.* twice. can be optimized later
 	for _, r := range plan.Reqs {
-		select {
-		case <-ctx.Done():
-			//request canceled
-			return nil, nil
-		default:
+		if err := ctx.Err(); err != nil {
+			//request canceled or timed out
+			return nil, err
 		}
 		var err error
 		var series []Series
@@ -714,63 +839,43 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 		for _, s := range series {
 			for _, metric := range s.Series {
 				for _, archive := range metric.Defs {
-					cons := r.Cons
-					consReq := r.Cons
-					if consReq == 0 {
-						// unless the user overrode the consolidation to use via a consolidateBy
-						// we will use the primary method dictated by the storage-aggregations rules
-						// note:
-						// * we can't just let the expr library take care of normalization, as we may have to fetch targets
-						//   from cluster peers; it's more efficient to have them normalize the data at the source.
-						// * a pattern may expand to multiple series, each of which can have their own aggregation method.
-						fn := mdata.Aggregations.Get(archive.AggId).AggregationMethod[0]
-						cons = consolidation.Consolidator(fn) // we use the same number assignments so we can cast them
+					req := newArchiveReq(archive, s.Node, r.Query, r.From, r.To, plan.MaxDataPoints, r.Cons, xFilesFactor)
+					if r.Cons == 0 && defaultCons != 0 {
+						// the org's default takes precedence over the storage-aggregations rules
+						req.Consolidator = defaultCons
 					}
-
-					newReq := models.NewReq(
-						archive.Id, archive.NameWithTags(), r.Query, r.From, r.To, plan.MaxDataPoints, uint32(archive.Interval), cons, consReq, s.Node, archive.SchemaId, archive.AggId)
-					reqs = append(reqs, newReq)
+					addRenderSeries(ctx, req.MKey)
+					reqs = append(reqs, req)
 				}
 			}
 		}
+		if err := budget.checkSeries(len(reqs)); err != nil {
+			return nil, err
+		}
 	}
 
-	select {
-	case <-ctx.Done():
-		//request canceled
-		return nil, nil
-	default:
+	if err := ctx.Err(); err != nil {
+		//request canceled or timed out
+		return nil, err
 	}
 
 	reqRenderSeriesCount.Value(len(reqs))
-	if len(reqs) == 0 {
+	if len(reqs) == 0 && remote == nil {
 		return nil, nil
 	}
 
-	// note: if 1 series has a movingAvg that requires a long time range extension, it may push other reqs into another archive. can be optimized later
-	reqs, pointsFetch, pointsReturn, err := alignRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs)
+	out, err := s.fetchSeries(ctx, budget, reqs, minFrom, maxTo, archReq)
 	if err != nil {
-		log.Error(3, "HTTP Render alignReq error: %s", err)
 		return nil, err
 	}
-	span := opentracing.SpanFromContext(ctx)
-	span.SetTag("points_fetch", pointsFetch)
-	span.SetTag("points_return", pointsReturn)
-
-	if LogLevel < 2 {
-		for _, req := range reqs {
-			log.Debug("HTTP Render %s - arch:%d archI:%d outI:%d aggN: %d from %s", req, req.Archive, req.ArchInterval, req.OutInterval, req.AggNum, req.Node.GetName())
+	if remote != nil {
+		federated, err := remote()
+		if err != nil {
+			return nil, err
 		}
+		out = appendFederated(out, federated)
 	}
 
-	out, err := s.getTargets(ctx, reqs)
-	if err != nil {
-		log.Error(3, "HTTP Render %s", err.Error())
-		return nil, err
-	}
-
-	out = mergeSeries(out)
-
 	// instead of waiting for all data to come in and then start processing everything, we could consider starting processing earlier, at the risk of doing needless work
 	// if we need to cancel the request due to a fetch error
 
@@ -786,11 +891,105 @@ func (s *Server) executePlan(ctx context.Context, orgId uint32, plan expr.Plan)
 	}
 
 	preRun := time.Now()
-	out, err = plan.Run(data)
+	out, err = plan.RunContext(ctx, data)
 	planRunDuration.Value(time.Since(preRun))
 	return out, err
 }
 
+// fetchSeries fetches the data of the requests from the cluster, in the archives that best fit them
+func (s *Server) fetchSeries(ctx context.Context, budget queryBudget, reqs []models.Req, minFrom, maxTo uint32, archReq models.ArchiveReq) ([]models.Series, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	// note: if 1 series has a movingAvg that requires a long time range extension, it may push other reqs into another archive. can be optimized later
+	reqs, pointsFetch, pointsReturn, err := alignRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs, archReq)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 3, "HTTP Render alignReq error: %s", err)
+		return nil, err
+	}
+	span := opentracing.SpanFromContext(ctx)
+	span.SetTag("points_fetch", pointsFetch)
+	span.SetTag("points_return", pointsReturn)
+	if err := budget.checkPoints(pointsFetch); err != nil {
+		return nil, err
+	}
+
+	if LogLevel.Get() < 2 {
+		for _, req := range reqs {
+			if LogLevel.Get() < 2 {
+				log.Debug("HTTP Render %s - arch:%d archI:%d outI:%d aggN: %d from %s", req, req.Archive, req.ArchInterval, req.OutInterval, req.AggNum, req.Node.GetName())
+			}
+		}
+	}
+
+	out, err := s.getTargets(ctx, reqs)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 3, "HTTP Render %s", err.Error())
+		return nil, err
+	}
+
+	return mergeSeries(out), nil
+}
+
+// runtimeMaxDataPoints returns the number of points to consolidate the series of the render request to, or 0 to not consolidate them.
+// requests coming from graphite (noproxy) should not get runtime consolidation, as graphite needs high-res data to perform its processing.
+// graphite never asks for our msgp format though, so msgp requests always get consolidated, like any other render request.
+func runtimeMaxDataPoints(request models.GraphiteRender) uint32 {
+	if request.NoProxy && request.Format != "msgp" {
+		return 0
+	}
+	return request.MaxDataPoints
+}
+
+// newArchiveReq returns the request to fetch the data of the archive from node, for the query.
+// consReq is the consolidation the user asked for, 0 if none. xFilesFactor < 0 means the one of the storage-aggregation rule
+func newArchiveReq(archive idx.Archive, node cluster.Node, query string, from, to, maxDataPoints uint32, consReq consolidation.Consolidator, xFilesFactor float64) models.Req {
+	cons := consReq
+	if consReq == 0 {
+		// unless the user overrode the consolidation to use via a consolidateBy
+		// we will use the primary method dictated by the storage-aggregations rules
+		// note:
+		// * we can't just let the expr library take care of normalization, as we may have to fetch targets
+		//   from cluster peers; it's more efficient to have them normalize the data at the source.
+		// * a pattern may expand to multiple series, each of which can have their own aggregation method.
+		fn := mdata.GetAgg(archive.AggId).AggregationMethod[0]
+		cons = consolidation.Consolidator(fn) // we use the same number assignments so we can cast them
+	}
+
+	req := models.NewReq(
+		archive.Id, archive.NameWithTags(), query, from, to, maxDataPoints, uint32(archive.Interval), cons, consReq, node, archive.SchemaId, archive.AggId)
+	req.XFilesFactor = xFilesFactor
+	if xFilesFactor < 0 {
+		req.XFilesFactor = mdata.GetAgg(archive.AggId).XFilesFactor
+	}
+	return req
+}
+
+// Evaluate runs the expression for the org like a render request would, with from exclusive and to inclusive,
+// but without runtime consolidation and without proxying to graphite. it is used by the recording rules.
+// ctx must have a span.
+func (s *Server) Evaluate(ctx context.Context, orgId uint32, target string, from, to uint32) ([]models.Series, error) {
+	_, out, err := s.evaluate(ctx, orgId, target, from, to)
+	return out, err
+}
+
+// evaluate is like Evaluate, but also returns the plan, so the caller can clean it once it's done with the series
+func (s *Server) evaluate(ctx context.Context, orgId uint32, target string, from, to uint32) (expr.Plan, []models.Series, error) {
+	exprs, err := expr.ParseMany([]string{target})
+	if err != nil {
+		return expr.Plan{}, nil, err
+	}
+	plan, err := expr.NewPlan(exprs, from+1, to+1, 0, true, nil)
+	if err != nil {
+		return plan, nil, err
+	}
+	ctx, span := tracing.NewSpan(ctx, s.Tracer, "executePlan")
+	defer span.Finish()
+	out, err := s.executePlan(ctx, orgId, plan, models.ArchiveReq{}, -1)
+	return plan, out, err
+}
+
 func getFromTo(ft models.FromTo, now time.Time, defaultFrom, defaultTo uint32) (uint32, uint32, error) {
 	loc, err := getLocation(ft.Tz)
 	if err != nil {
@@ -975,7 +1174,7 @@ func (s *Server) clusterFindByTag(ctx context.Context, orgId uint32, expressions
 		}
 	}
 
-	return allSeries, nil
+	return filterSeries(ctx, allSeries), nil
 }
 
 func (s *Server) graphiteTags(ctx *middleware.Context, request models.GraphiteTags) {
@@ -1050,22 +1249,50 @@ func (s *Server) clusterTags(ctx context.Context, orgId uint32, filter string, f
 	return tags, nil
 }
 
+// autoCompletePage returns the number of results to return for an autocomplete request, and the result to continue after
+func autoCompletePage(limit uint, cursor string) (uint, string, error) {
+	if limit == 0 {
+		limit = tagdbDefaultLimit
+	}
+	if limit > tagdbMaxLimit {
+		limit = tagdbMaxLimit
+	}
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", response.NewError(http.StatusBadRequest, "invalid cursor")
+	}
+	return limit, string(after), nil
+}
+
+// writeAutoComplete writes the first limit results. if there are more, the cursor to get the next page is set
+// in the X-Next-Cursor header, so that the body stays compatible with graphite
+func writeAutoComplete(ctx *middleware.Context, results []string, limit uint) {
+	if uint(len(results)) > limit {
+		results = results[:limit]
+		ctx.Resp.Header().Set("X-Next-Cursor", base64.RawURLEncoding.EncodeToString([]byte(results[len(results)-1])))
+	}
+	response.Write(ctx, response.NewJson(200, results, ""))
+}
+
 func (s *Server) graphiteAutoCompleteTags(ctx *middleware.Context, request models.GraphiteAutoCompleteTags) {
-	if request.Limit == 0 {
-		request.Limit = tagdbDefaultLimit
+	limit, after, err := autoCompletePage(request.Limit, request.Cursor)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
 	}
 
-	tags, err := s.clusterAutoCompleteTags(ctx.Req.Context(), ctx.OrgId, request.Prefix, request.Expr, request.From, request.Limit)
+	// one more than the limit tells us whether there is a next page
+	tags, err := s.clusterAutoCompleteTags(ctx.Req.Context(), ctx.OrgId, request.Prefix, request.Expr, request.From, after, limit+1)
 	if err != nil {
 		response.Write(ctx, response.WrapErrorForTagDB(err))
 		return
 	}
 
-	response.Write(ctx, response.NewJson(200, tags, ""))
+	writeAutoComplete(ctx, tags, limit)
 }
 
-func (s *Server) clusterAutoCompleteTags(ctx context.Context, orgId uint32, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
-	result, err := s.MetricIndex.FindTags(orgId, prefix, expressions, from, limit)
+func (s *Server) clusterAutoCompleteTags(ctx context.Context, orgId uint32, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error) {
+	result, err := s.MetricIndex.FindTags(orgId, prefix, expressions, from, after, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -1075,7 +1302,7 @@ func (s *Server) clusterAutoCompleteTags(ctx context.Context, orgId uint32, pref
 		tagSet[tag] = struct{}{}
 	}
 
-	data := models.IndexAutoCompleteTags{OrgId: orgId, Prefix: prefix, Expr: expressions, From: from, Limit: limit}
+	data := models.IndexAutoCompleteTags{OrgId: orgId, Prefix: prefix, Expr: expressions, From: from, After: after, Limit: limit}
 	responses, err := s.peerQuery(ctx, data, "clusterAutoCompleteTags", "/index/tags/autoComplete/tags", false)
 	if err != nil {
 		return nil, err
@@ -1106,21 +1333,24 @@ func (s *Server) clusterAutoCompleteTags(ctx context.Context, orgId uint32, pref
 }
 
 func (s *Server) graphiteAutoCompleteTagValues(ctx *middleware.Context, request models.GraphiteAutoCompleteTagValues) {
-	if request.Limit == 0 {
-		request.Limit = tagdbDefaultLimit
+	limit, after, err := autoCompletePage(request.Limit, request.Cursor)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
 	}
 
-	resp, err := s.clusterAutoCompleteTagValues(ctx.Req.Context(), ctx.OrgId, request.Tag, request.Prefix, request.Expr, request.From, request.Limit)
+	// one more than the limit tells us whether there is a next page
+	resp, err := s.clusterAutoCompleteTagValues(ctx.Req.Context(), ctx.OrgId, request.Tag, request.Prefix, request.Expr, request.From, after, limit+1)
 	if err != nil {
 		response.Write(ctx, response.WrapErrorForTagDB(err))
 		return
 	}
 
-	response.Write(ctx, response.NewJson(200, resp, ""))
+	writeAutoComplete(ctx, resp, limit)
 }
 
-func (s *Server) clusterAutoCompleteTagValues(ctx context.Context, orgId uint32, tag, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
-	result, err := s.MetricIndex.FindTagValues(orgId, tag, prefix, expressions, from, limit)
+func (s *Server) clusterAutoCompleteTagValues(ctx context.Context, orgId uint32, tag, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error) {
+	result, err := s.MetricIndex.FindTagValues(orgId, tag, prefix, expressions, from, after, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -1130,7 +1360,7 @@ func (s *Server) clusterAutoCompleteTagValues(ctx context.Context, orgId uint32,
 		valSet[val] = struct{}{}
 	}
 
-	data := models.IndexAutoCompleteTagValues{OrgId: orgId, Tag: tag, Prefix: prefix, Expr: expressions, From: from, Limit: limit}
+	data := models.IndexAutoCompleteTagValues{OrgId: orgId, Tag: tag, Prefix: prefix, Expr: expressions, From: from, After: after, Limit: limit}
 	responses, err := s.peerQuery(ctx, data, "clusterAutoCompleteValues", "/index/tags/autoComplete/values", false)
 	if err != nil {
 		return nil, err
@@ -1160,13 +1390,40 @@ func (s *Server) clusterAutoCompleteTagValues(ctx context.Context, orgId uint32,
 	return vals, nil
 }
 
-func (s *Server) graphiteFunctions(ctx *middleware.Context) {
-	ctx.Req.Request.Body = ctx.Body
-	graphiteProxy.ServeHTTP(ctx.Resp, ctx.Req.Request)
+// graphiteFunctions proxies to graphite, which describes all the functions it has, for clients such as Grafana's function editor.
+// with native set, it describes the functions that we can process natively for the org instead, like graphite-web describes its functions.
+// with a function name, it describes just that function.
+func (s *Server) graphiteFunctions(ctx *middleware.Context, request models.GraphiteFunctions) {
+	if !request.Native {
+		ctx.Req.Request.Body = ctx.Body
+		graphiteProxy.ServeHTTP(ctx.Resp, ctx.Req.Request)
+		return
+	}
+	descs := expr.Describe(!unstableFunctions.Enabled(ctx.OrgId))
+	name := ctx.Params(":func")
+	if name == "" {
+		response.Write(ctx, response.NewJson(200, descs, ""))
+		return
+	}
+	desc, ok := descs[name]
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, fmt.Sprintf("function %q not found", name)))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, desc, ""))
 }
 
 func (s *Server) graphiteTagDelSeries(ctx *middleware.Context, request models.GraphiteTagDelSeries) {
+	for _, path := range request.Paths {
+		if !ctx.Token.AllowsSeries(path) {
+			middleware.Denied(ctx.OrgId)
+			response.Write(ctx, response.NewError(http.StatusForbidden, fmt.Sprintf("the token may not delete series %q", path)))
+			return
+		}
+	}
 	deleted, err := s.MetricIndex.DeleteTagged(ctx.OrgId, request.Paths)
+	// peers record their own deletions
+	auditRecord(ctx, ctx.OrgId, "tags.delSeries", strings.Join(request.Paths, ","), len(deleted), err)
 	if err != nil {
 		response.Write(ctx, response.WrapErrorForTagDB(err))
 		return
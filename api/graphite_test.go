@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/macaron.v1"
+)
+
+func TestAutoCompletePage(t *testing.T) {
+	tagdbDefaultLimit, tagdbMaxLimit = 100, 1000
+	cases := []struct {
+		limit    uint
+		cursor   string
+		expLimit uint
+		expAfter string
+		expErr   bool
+	}{
+		{0, "", 100, "", false},
+		{10, "", 10, "", false},
+		{5000, "", 1000, "", false},
+		{10, base64.RawURLEncoding.EncodeToString([]byte("host9")), 10, "host9", false},
+		{10, "not base64!", 0, "", true},
+	}
+	for _, c := range cases {
+		limit, after, err := autoCompletePage(c.limit, c.cursor)
+		if (err != nil) != c.expErr || limit != c.expLimit || after != c.expAfter {
+			t.Errorf("limit %d cursor %q: expected %d %q err %t, got %d %q %v", c.limit, c.cursor, c.expLimit, c.expAfter, c.expErr, limit, after, err)
+		}
+	}
+}
+
+func TestWriteAutoComplete(t *testing.T) {
+	write := func(results []string, limit uint) *httptest.ResponseRecorder {
+		m := macaron.New()
+		m.Use(macaron.Renderer())
+		m.Use(middleware.OrgMiddleware(false))
+		m.Get("/", func(ctx *middleware.Context) {
+			writeAutoComplete(ctx, results, limit)
+		})
+		req, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, req)
+		return w
+	}
+
+	w := write([]string{"a", "b"}, 2)
+	if w.Body.String() != `["a","b"]` || w.Header().Get("X-Next-Cursor") != "" {
+		t.Fatalf("expected the results without cursor, got %s %q", w.Body.String(), w.Header().Get("X-Next-Cursor"))
+	}
+
+	w = write([]string{"a", "b", "c"}, 2)
+	if w.Body.String() != `["a","b"]` {
+		t.Fatalf("expected the first page, got %s", w.Body.String())
+	}
+	_, after, err := autoCompletePage(2, w.Header().Get("X-Next-Cursor"))
+	if err != nil || after != "b" {
+		t.Fatalf("expected the cursor to continue after b, got %q %v", after, err)
+	}
+}
+
+func TestRuntimeMaxDataPoints(t *testing.T) {
+	cases := []struct {
+		format  string
+		noProxy bool
+		exp     uint32
+	}{
+		{"json", false, 800},
+		{"msgp", false, 800},
+		{"json", true, 0},
+		{"pickle", true, 0},
+		{"msgpack", true, 0},
+		// graphite never asks for msgp, so its clients get consolidated data
+		{"msgp", true, 800},
+	}
+	for _, c := range cases {
+		got := runtimeMaxDataPoints(models.GraphiteRender{MaxDataPoints: 800, Format: c.format, NoProxy: c.noProxy})
+		if got != c.exp {
+			t.Errorf("format %s local %t: expected %d, got %d", c.format, c.noProxy, c.exp, got)
+		}
+	}
+}
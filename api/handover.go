@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+const defaultHandoverTimeout = time.Minute
+
+func parseHandoverTimeout(s string) (time.Duration, error) {
+	if s == "" {
+		return defaultHandoverTimeout, nil
+	}
+	timeout, err := time.ParseDuration(s)
+	if err != nil || timeout <= 0 {
+		return 0, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid timeout %q: must be a positive duration like 30s", s))
+	}
+	return timeout, nil
+}
+
+// handoverTarget returns the peer to hand the primary role over to, if it can take over all our partitions
+func handoverTarget(name string) (cluster.Node, error) {
+	if name == cluster.Manager.ThisNode().GetName() {
+		return nil, response.NewError(http.StatusBadRequest, "can't hand over to ourselves")
+	}
+	for _, member := range cluster.Manager.MemberList() {
+		if member.GetName() != name {
+			continue
+		}
+		if n, ok := member.(cluster.HTTPNode); ok && n.Primary {
+			return nil, response.NewError(http.StatusBadRequest, fmt.Sprintf("%s is already a primary", name))
+		}
+		if !member.IsReady() {
+			return nil, response.NewError(http.StatusBadRequest, fmt.Sprintf("%s is not ready", name))
+		}
+		has := make(map[int32]struct{})
+		for _, p := range member.GetPartitions() {
+			has[p] = struct{}{}
+		}
+		for _, p := range cluster.Manager.GetPartitions() {
+			if _, ok := has[p]; !ok {
+				return nil, response.NewError(http.StatusBadRequest, fmt.Sprintf("%s does not consume partition %d", name, p))
+			}
+		}
+		return member, nil
+	}
+	return nil, response.NewError(http.StatusNotFound, fmt.Sprintf("unknown node %q", name))
+}
+
+// nodeHandover hands the primary role over to a secondary that consumes the same partitions, e.g. for a rolling restart.
+// we stop saving chunks, wait until the chunks we already sent to the store are saved and the persist messages about them
+// are sent, and then have the secondary promote itself once it processed them, so that no chunk is saved twice or not at all.
+// if any of that fails, we become primary again, unless we can't tell whether the secondary promoted itself.
+func (s *Server) nodeHandover(ctx *middleware.Context, req models.NodeHandover) {
+	timeout, err := parseHandoverTimeout(req.Timeout)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if !cluster.Manager.IsPrimary() {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "this node is not a primary"))
+		return
+	}
+	target, err := handoverTarget(req.Node)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	thisNode := cluster.Manager.ThisNode().GetName()
+	log.Info("API handing the primary role over to %s", target.GetName())
+	cluster.Manager.SetPrimary(false)
+	promoted, err := s.handover(ctx.Req.Context(), target, deadline)
+	if err != nil && !promoted {
+		log.Error(3, "API handover to %s failed, becoming primary again: %s", target.GetName(), err)
+		cluster.Manager.SetPrimary(true)
+	}
+	auditRecord(ctx, ctx.OrgId, "node.handover", target.GetName(), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, models.NodeHandoverResp{Demoted: thisNode, Promoted: target.GetName()}, ""))
+}
+
+// handover does the handover, once we are no longer primary. when it fails, it returns whether the target
+// may have promoted itself anyway, in which case we must not become primary again.
+func (s *Server) handover(ctx context.Context, target cluster.Node, deadline time.Time) (bool, error) {
+	if d, ok := s.BackendStore.(interface{ Drain(time.Duration) int }); ok {
+		if pending := d.Drain(time.Until(deadline)); pending > 0 {
+			return false, response.NewError(http.StatusServiceUnavailable, fmt.Sprintf("%d chunks were not saved in time", pending))
+		}
+	}
+	if err := mdata.FlushPersistNotifiers(time.Until(deadline)); err != nil {
+		return false, response.NewError(http.StatusServiceUnavailable, err.Error())
+	}
+	left := time.Until(deadline)
+	if left <= 0 {
+		return false, response.NewError(http.StatusServiceUnavailable, "timed out before promoting "+target.GetName())
+	}
+	_, err := target.Post(ctx, "nodePromote", "/node/promote", models.NodePromote{Timeout: left.String()})
+	if err != nil {
+		// the target refused, e.g. because it did not catch up in time. when we got no answer, it may still promote itself
+		if e, ok := err.(*cluster.Error); ok && e.Code() >= 400 && e.Code() < 500 {
+			return false, response.NewError(http.StatusServiceUnavailable, fmt.Sprintf("%s refused the promotion: %s", target.GetName(), err))
+		}
+		return true, response.NewError(http.StatusServiceUnavailable, fmt.Sprintf("no answer from %s, which may or may not have promoted itself. this node stays secondary: check the cluster status and promote a node manually if needed. %s", target.GetName(), err))
+	}
+	return true, nil
+}
+
+// nodePromote makes this node primary, once it processed all persist messages that any node sent so far.
+// otherwise it would save the chunks again that the previous primary already saved.
+func (s *Server) nodePromote(ctx *middleware.Context, req models.NodePromote) {
+	timeout, err := parseHandoverTimeout(req.Timeout)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if !cluster.Manager.IsPrimary() {
+		lag, err := waitPersistMessages(ctx.Req.Context(), time.Now().Add(timeout))
+		if err == mdata.ErrNotifierCantSync {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+			return
+		}
+		if err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		if lag > 0 {
+			response.Write(ctx, response.NewError(http.StatusConflict, fmt.Sprintf("not caught up: %d persist messages left to process", lag)))
+			return
+		}
+		cluster.Manager.SetPrimary(true)
+		auditRecord(ctx, ctx.OrgId, "node.primary", "true", 1, nil)
+		log.Info("API promoted to primary, after processing all persist messages")
+	}
+	response.Write(ctx, response.NewJson(200, cluster.Manager.ThisNode(), ""))
+}
+
+// waitPersistMessages waits until we processed all persist messages sent so far, or until the deadline.
+// it returns how many we have left to process.
+func waitPersistMessages(ctx context.Context, deadline time.Time) (int, error) {
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		lag, err := mdata.PersistNotifierLag()
+		if err != nil || lag == 0 || !time.Now().Before(deadline) {
+			return lag, err
+		}
+		select {
+		case <-ctx.Done():
+			return lag, ctx.Err()
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// fakeNotifier implements the notifier methods the handover needs
+type fakeNotifier struct {
+	flushed bool
+	lag     []int
+}
+
+func (f *fakeNotifier) Send(mdata.SavedChunk) {}
+
+func (f *fakeNotifier) Flush(timeout time.Duration) bool {
+	f.flushed = true
+	return true
+}
+
+func (f *fakeNotifier) Lag() (int, error) {
+	lag := f.lag[0]
+	if len(f.lag) > 1 {
+		f.lag = f.lag[1:]
+	}
+	return lag, nil
+}
+
+func TestParseHandoverTimeout(t *testing.T) {
+	if timeout, err := parseHandoverTimeout(""); err != nil || timeout != defaultHandoverTimeout {
+		t.Fatalf("expected the default timeout, got %s (err %v)", timeout, err)
+	}
+	if timeout, err := parseHandoverTimeout("30s"); err != nil || timeout != 30*time.Second {
+		t.Fatalf("expected 30s, got %s (err %v)", timeout, err)
+	}
+	for _, s := range []string{"30", "-1s", "0s"} {
+		if _, err := parseHandoverTimeout(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
+
+func TestWaitPersistMessages(t *testing.T) {
+	defer mdata.InitPersistNotifier()
+
+	mdata.InitPersistNotifier()
+	if _, err := waitPersistMessages(context.Background(), time.Now().Add(time.Second)); err != mdata.ErrNotifierCantSync {
+		t.Fatalf("expected an error without notifiers that can sync, got %v", err)
+	}
+
+	mdata.InitPersistNotifier(&fakeNotifier{lag: []int{5, 2, 0}})
+	if lag, err := waitPersistMessages(context.Background(), time.Now().Add(5*time.Second)); err != nil || lag != 0 {
+		t.Fatalf("expected to catch up, got lag %d (err %v)", lag, err)
+	}
+
+	mdata.InitPersistNotifier(&fakeNotifier{lag: []int{5}})
+	if lag, err := waitPersistMessages(context.Background(), time.Now().Add(200*time.Millisecond)); err != nil || lag != 5 {
+		t.Fatalf("expected a lag of 5 after the deadline, got %d (err %v)", lag, err)
+	}
+}
+
+func TestHandover(t *testing.T) {
+	defer mdata.InitPersistNotifier()
+	s := &Server{}
+	target := cluster.NewMockNode(false, "node2", []byte("{}"))
+
+	mdata.InitPersistNotifier()
+	if promoted, err := s.handover(context.Background(), target, time.Now().Add(time.Second)); err == nil || promoted {
+		t.Fatalf("expected the handover to fail without notifiers that can sync, got promoted %t (err %v)", promoted, err)
+	}
+
+	notifier := &fakeNotifier{lag: []int{0}}
+	mdata.InitPersistNotifier(notifier)
+	if promoted, err := s.handover(context.Background(), target, time.Now().Add(time.Second)); err != nil || !promoted {
+		t.Fatalf("expected the handover to succeed, got promoted %t (err %v)", promoted, err)
+	}
+	if !notifier.flushed {
+		t.Fatalf("expected the persist messages to be flushed before the promotion")
+	}
+}
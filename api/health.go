@@ -0,0 +1,41 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/health"
+)
+
+// healthResp is the overall state of the node, which is the worst state of any of its subsystems
+type healthResp struct {
+	State      health.State             `json:"state"`
+	Subsystems map[string]health.Status `json:"subsystems"`
+}
+
+func (s *Server) getHealth() healthResp {
+	resp := healthResp{
+		State:      health.OK,
+		Subsystems: make(map[string]health.Status, len(s.healthReporters)),
+	}
+	for _, r := range s.healthReporters {
+		status := r.Health()
+		if status.State > resp.State {
+			resp.State = status.State
+		}
+		resp.Subsystems[r.name] = status
+	}
+	return resp
+}
+
+// health reports the state of each subsystem. unlike the app status, which only reflects whether we're ready
+// to serve queries, it returns 503 only if a subsystem failed.
+func (s *Server) health(ctx *middleware.Context) {
+	resp := s.getHealth()
+	code := 200
+	if resp.State == health.Failed {
+		code = http.StatusServiceUnavailable
+	}
+	response.Write(ctx, response.NewJson(code, resp, ""))
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/health"
+)
+
+func reporter(state health.State) health.Reporter {
+	return health.ReporterFunc(func() health.Status {
+		return health.Status{State: state}
+	})
+}
+
+func TestGetHealth(t *testing.T) {
+	s := &Server{}
+	if resp := s.getHealth(); resp.State != health.OK || len(resp.Subsystems) != 0 {
+		t.Fatalf("expected ok without subsystems, got %+v", resp)
+	}
+
+	s.BindHealthReporter("store", reporter(health.OK))
+	s.BindHealthReporter("idx", reporter(health.Degraded))
+	resp := s.getHealth()
+	if resp.State != health.Degraded {
+		t.Fatalf("expected degraded, got %s", resp.State)
+	}
+	if resp.Subsystems["store"].State != health.OK || resp.Subsystems["idx"].State != health.Degraded {
+		t.Fatalf("unexpected subsystems %+v", resp.Subsystems)
+	}
+
+	s.BindHealthReporter("cluster", reporter(health.Failed))
+	if resp := s.getHealth(); resp.State != health.Failed {
+		t.Fatalf("expected failed, got %s", resp.State)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	"github.com/raintank/dur"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// metricsStale reports the series that stopped receiving data: their last point is older than staleAfter,
+// but not older than the window. it only consults the index, so it doesn't touch any data.
+func (s *Server) metricsStale(ctx *middleware.Context, request models.MetricsStale) {
+	if (len(request.Query) == 0) == (len(request.Expr) == 0) {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "exactly one of query or expr must be set"))
+		return
+	}
+	staleAfter, err := dur.ParseNDuration(request.StaleAfter)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid staleAfter: "+err.Error()))
+		return
+	}
+	window, err := dur.ParseDuration(request.Window)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid window: "+err.Error()))
+		return
+	}
+	if window != 0 && window <= staleAfter {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "window must be 0 or larger than staleAfter"))
+		return
+	}
+
+	now := time.Now().Unix()
+	// the index leaves out the series that were not updated since from
+	var from int64
+	if window != 0 {
+		from = now - int64(window)
+	}
+	reqCtx := ctx.Req.Context()
+	var series []Series
+	if len(request.Query) > 0 {
+		series, err = s.findSeries(reqCtx, ctx.OrgId, request.Query, from)
+	} else {
+		series, err = s.clusterFindByTag(reqCtx, ctx.OrgId, request.Expr, from)
+	}
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	select {
+	case <-reqCtx.Done():
+		//request canceled
+		response.Write(ctx, response.RequestCanceledErr)
+		return
+	default:
+	}
+
+	response.Write(ctx, response.NewJson(200, staleSeries(series, now-int64(staleAfter)), ""))
+}
+
+// staleSeries returns the series that were last updated before cutoff, the longest stale first.
+// a series may be in the index of several nodes, e.g. when it moved to another partition, so only its latest update counts.
+func staleSeries(series []Series, cutoff int64) []models.StaleSeries {
+	latest := make(map[schema.MKey]idx.Archive)
+	for _, s := range series {
+		for _, n := range s.Series {
+			for _, def := range n.Defs {
+				if cur, ok := latest[def.Id]; !ok || def.LastUpdate > cur.LastUpdate {
+					latest[def.Id] = def
+				}
+			}
+		}
+	}
+	stale := make([]models.StaleSeries, 0)
+	for _, def := range latest {
+		if def.LastUpdate < cutoff {
+			stale = append(stale, models.StaleSeries{
+				Path:       def.NameWithTags(),
+				Id:         def.Id.String(),
+				LastUpdate: def.LastUpdate,
+			})
+		}
+	}
+	sort.Sort(byLastUpdate(stale))
+	return stale
+}
+
+type byLastUpdate []models.StaleSeries
+
+func (s byLastUpdate) Len() int      { return len(s) }
+func (s byLastUpdate) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLastUpdate) Less(i, j int) bool {
+	if s[i].LastUpdate != s[j].LastUpdate {
+		return s[i].LastUpdate < s[j].LastUpdate
+	}
+	return s[i].Path < s[j].Path
+}
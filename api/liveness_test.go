@@ -0,0 +1,38 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/idx"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestStaleSeries(t *testing.T) {
+	def := func(name string, lastUpdate int64) idx.Archive {
+		a := idx.NewArchiveBare(name)
+		a.Id = schema.MKey{Org: 1, Key: schema.Key{byte(len(name))}}
+		a.OrgId = 1
+		a.LastUpdate = lastUpdate
+		return a
+	}
+	series := []Series{
+		{Series: []idx.Node{
+			{Path: "a", Leaf: true, Defs: []idx.Archive{def("a", 100)}},
+			{Path: "bb", Leaf: true, Defs: []idx.Archive{def("bb", 50)}},
+			{Path: "ccc", Leaf: true, Defs: []idx.Archive{def("ccc", 1000)}},
+		}},
+		// ccc moved to a partition of another node, which has an older update for it
+		// and bb is still at the same update there
+		{Series: []idx.Node{
+			{Path: "ccc", Leaf: true, Defs: []idx.Archive{def("ccc", 10)}},
+			{Path: "bb", Leaf: true, Defs: []idx.Archive{def("bb", 50)}},
+		}},
+	}
+	stale := staleSeries(series, 500)
+	if len(stale) != 2 {
+		t.Fatalf("expected 2 stale series, got %v", stale)
+	}
+	if stale[0].Path != "bb" || stale[0].LastUpdate != 50 || stale[1].Path != "a" || stale[1].LastUpdate != 100 {
+		t.Fatalf("expected bb and a, the longest stale first, got %v", stale)
+	}
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var logLevelNames = []string{"trace", "debug", "info", "warn", "error", "critical", "fatal"}
+
+// logLevels tracks the global log level and the levels of the modules that can be tuned at runtime.
+// each module is a set of LogLevel variables of the packages it consists of, which they read while we change them.
+// the packages only log debug messages when their LogLevel is below 2, but the logger itself also filters
+// messages below its level, so the logger level is always set to the lowest level in use.
+var logLevels = struct {
+	sync.Mutex
+	global  int
+	modules map[string][]*util.LogLevel
+	levels  map[string]int
+}{
+	modules: make(map[string][]*util.LogLevel),
+	levels:  make(map[string]int),
+}
+
+// RegisterLogModule makes the log level of the given package LogLevel variables
+// adjustable at runtime under the given module name
+func RegisterLogModule(name string, vars ...*util.LogLevel) {
+	logLevels.Lock()
+	logLevels.modules[name] = vars
+	logLevels.levels[name] = logLevels.global
+	for _, v := range vars {
+		v.Set(logLevels.global)
+	}
+	logLevels.Unlock()
+}
+
+// SetLogLevel sets the global log level and resets all modules to it.
+func SetLogLevel(level int) {
+	logLevels.Lock()
+	logLevels.global = level
+	for name, vars := range logLevels.modules {
+		logLevels.levels[name] = level
+		for _, v := range vars {
+			v.Set(level)
+		}
+	}
+	applyLogLevel()
+	logLevels.Unlock()
+}
+
+// setModuleLogLevel sets the log level of a single module, leaving the others untouched
+func setModuleLogLevel(name string, level int) error {
+	logLevels.Lock()
+	defer logLevels.Unlock()
+	vars, ok := logLevels.modules[name]
+	if !ok {
+		return fmt.Errorf("unknown module %q", name)
+	}
+	logLevels.levels[name] = level
+	for _, v := range vars {
+		v.Set(level)
+	}
+	applyLogLevel()
+	return nil
+}
+
+// applyLogLevel sets the logger to the lowest level in use. logLevels must be locked.
+func applyLogLevel() {
+	min := logLevels.global
+	for _, l := range logLevels.levels {
+		if l < min {
+			min = l
+		}
+	}
+	log.Level(log.LogLevel(min))
+}
+
+func getLogLevels() models.LogLevelResp {
+	logLevels.Lock()
+	resp := models.LogLevelResp{
+		Level:   logLevelNames[logLevels.global],
+		Modules: make(map[string]string, len(logLevels.levels)),
+	}
+	for name, l := range logLevels.levels {
+		resp.Modules[name] = logLevelNames[l]
+	}
+	logLevels.Unlock()
+	return resp
+}
+
+// parseLogLevel accepts a level either as a name or as the number used by the log-level setting
+func parseLogLevel(s string) (int, error) {
+	for i, name := range logLevelNames {
+		if strings.ToLower(s) == name {
+			return i, nil
+		}
+	}
+	l, err := strconv.Atoi(s)
+	if err != nil || l < 0 || l >= len(logLevelNames) {
+		return 0, fmt.Errorf("invalid log level %q. must be one of %s or 0-%d", s, strings.Join(logLevelNames, ", "), len(logLevelNames)-1)
+	}
+	return l, nil
+}
+
+func (s *Server) getLogLevel(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, getLogLevels(), ""))
+}
+
+func (s *Server) setLogLevel(ctx *middleware.Context, req models.LogLevel) {
+	level, err := parseLogLevel(req.Level)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, err.Error()))
+		return
+	}
+	if req.Module == "" {
+		SetLogLevel(level)
+		log.Info("API: log level set to %s", logLevelNames[level])
+		auditRecord(ctx, ctx.OrgId, "loglevel", logLevelNames[level], 1, nil)
+	} else {
+		if err := setModuleLogLevel(req.Module, level); err != nil {
+			logLevels.Lock()
+			names := make([]string, 0, len(logLevels.modules))
+			for name := range logLevels.modules {
+				names = append(names, name)
+			}
+			logLevels.Unlock()
+			sort.Strings(names)
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("%s. known modules: %s", err, strings.Join(names, ", "))))
+			return
+		}
+		log.Info("API: log level of module %s set to %s", req.Module, logLevelNames[level])
+		auditRecord(ctx, ctx.OrgId, "loglevel", req.Module+"="+logLevelNames[level], 1, nil)
+	}
+	response.Write(ctx, response.NewJson(200, getLogLevels(), ""))
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/util"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := []struct {
+		in     string
+		exp    int
+		expErr bool
+	}{
+		{"debug", 1, false},
+		{"WARN", 3, false},
+		{"0", 0, false},
+		{"6", 6, false},
+		{"7", 0, true},
+		{"-1", 0, true},
+		{"verbose", 0, true},
+	}
+	for _, c := range cases {
+		l, err := parseLogLevel(c.in)
+		if (err != nil) != c.expErr {
+			t.Fatalf("%q: expected error %t, got %v", c.in, c.expErr, err)
+		}
+		if err == nil && l != c.exp {
+			t.Fatalf("%q: expected level %d, got %d", c.in, c.exp, l)
+		}
+	}
+}
+
+func TestModuleLogLevel(t *testing.T) {
+	var a, b, c util.LogLevel
+	SetLogLevel(2)
+	RegisterLogModule("a", &a, &b)
+	RegisterLogModule("c", &c)
+	if a.Get() != 2 || b.Get() != 2 || c.Get() != 2 {
+		t.Fatalf("expected registered modules to get the global level, got %d %d %d", a.Get(), b.Get(), c.Get())
+	}
+
+	if err := setModuleLogLevel("a", 1); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if a.Get() != 1 || b.Get() != 1 || c.Get() != 2 {
+		t.Fatalf("expected only module a to be at debug, got %d %d %d", a.Get(), b.Get(), c.Get())
+	}
+	resp := getLogLevels()
+	if resp.Level != "info" || resp.Modules["a"] != "debug" || resp.Modules["c"] != "info" {
+		t.Fatalf("unexpected levels %+v", resp)
+	}
+
+	if err := setModuleLogLevel("unknown", 1); err == nil {
+		t.Fatalf("expected error for unknown module")
+	}
+
+	SetLogLevel(3)
+	if a.Get() != 3 || b.Get() != 3 || c.Get() != 3 {
+		t.Fatalf("expected global level to reset all modules, got %d %d %d", a.Get(), b.Get(), c.Get())
+	}
+}
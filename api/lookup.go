@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	"github.com/tinylib/msgp/msgp"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// metricsLookup returns the definitions of the requested series in one call, for tooling that would otherwise
+// need a find request per series. it also lists the requested ids and names that are not known.
+func (s *Server) metricsLookup(ctx *middleware.Context, request models.MetricsLookup) {
+	if len(request.Ids) == 0 && len(request.Names) == 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "ids or names must be set"))
+		return
+	}
+	for _, id := range request.Ids {
+		if _, err := schema.MKeyFromString(id); err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid id %q: %s", id, err)))
+			return
+		}
+	}
+
+	reqCtx := ctx.Req.Context()
+	defs, err := s.clusterLookup(reqCtx, ctx.OrgId, request.Ids, request.Names)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	select {
+	case <-reqCtx.Done():
+		//request canceled
+		response.Write(ctx, response.RequestCanceledErr)
+		return
+	default:
+	}
+
+	response.Write(ctx, response.NewJson(200, lookupResult(defs, request.Ids, request.Names), ""))
+}
+
+// clusterLookup looks up the series in the index of all nodes
+func (s *Server) clusterLookup(ctx context.Context, orgId uint32, ids, names []string) ([]idx.Archive, error) {
+	defs := s.lookupLocal(orgId, ids, names)
+
+	data := models.IndexLookup{OrgId: orgId, Ids: ids, Names: names}
+	resps, err := s.peerQuery(ctx, data, "clusterLookup", "/index/lookup", false)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		//request canceled
+		return nil, nil
+	default:
+	}
+
+	for _, r := range resps {
+		buf := r.buf
+		for len(buf) != 0 {
+			var def idx.Archive
+			buf, err = def.UnmarshalMsg(buf)
+			if err != nil {
+				return nil, err
+			}
+			defs = append(defs, def)
+		}
+	}
+	return filterArchives(ctx, defs), nil
+}
+
+// lookupLocal returns the series in the local index with the given ids or names.
+// ids that are invalid or of other orgs than orgId and the public org are ignored.
+func (s *Server) lookupLocal(orgId uint32, ids, names []string) []idx.Archive {
+	var defs []idx.Archive
+	for _, id := range ids {
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil || (mkey.Org != orgId && mkey.Org != idx.OrgIdPublic) {
+			continue
+		}
+		if def, ok := s.MetricIndex.Get(mkey); ok {
+			defs = append(defs, def)
+		}
+	}
+	for _, name := range names {
+		defs = append(defs, s.lookupName(orgId, name)...)
+	}
+	return defs
+}
+
+// lookupName returns the series in the local index with the given name, including tags
+func (s *Server) lookupName(orgId uint32, name string) []idx.Archive {
+	defs := s.MetricIndex.GetPath(orgId, name)
+	if len(defs) > 0 || !strings.Contains(name, ";") {
+		return defs
+	}
+	// with tag support, tagged series are only in the tag index
+	expressions := strings.Split(name, ";")
+	expressions[0] = "name=" + expressions[0]
+	nodes, err := s.MetricIndex.FindByTag(orgId, expressions, 0)
+	if err != nil {
+		// not a valid series name, so there's no series with it
+		return nil
+	}
+	for _, n := range nodes {
+		for _, def := range n.Defs {
+			if def.NameWithTags() == name {
+				defs = append(defs, def)
+			}
+		}
+	}
+	return defs
+}
+
+// indexLookup returns msgp encoded idx.Archive's of the series in the local index with the given ids or names
+func (s *Server) indexLookup(ctx *middleware.Context, req models.IndexLookup) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	defs := s.lookupLocal(req.OrgId, req.Ids, req.Names)
+	resp := make([]msgp.Marshaler, len(defs))
+	for i := range defs {
+		resp[i] = &defs[i]
+	}
+	response.Write(ctx, response.NewMsgpArray(200, resp))
+}
+
+// lookupResult returns the definitions of the found series ordered by path and id, and the ids and names that were not found.
+// a series may be in the index of several nodes, e.g. when it moved to another partition, so the latest update wins.
+func lookupResult(defs []idx.Archive, ids, names []string) models.MetricsLookupResp {
+	latest := make(map[schema.MKey]idx.Archive)
+	for _, def := range defs {
+		if cur, ok := latest[def.Id]; !ok || def.LastUpdate > cur.LastUpdate {
+			latest[def.Id] = def
+		}
+	}
+	resp := models.MetricsLookupResp{
+		Series:  make([]models.LookupSeries, 0, len(latest)),
+		Missing: make([]string, 0),
+	}
+	foundNames := make(map[string]struct{})
+	for _, def := range latest {
+		path := def.NameWithTags()
+		resp.Series = append(resp.Series, models.LookupSeries{
+			Path:       path,
+			Id:         def.Id.String(),
+			OrgId:      def.OrgId,
+			Name:       def.Name,
+			Tags:       def.Tags,
+			Interval:   def.Interval,
+			Unit:       def.Unit,
+			Mtype:      def.Mtype,
+			Partition:  def.Partition,
+			LastUpdate: def.LastUpdate,
+		})
+		foundNames[path] = struct{}{}
+	}
+	sort.Sort(byPathAndId(resp.Series))
+
+	for _, id := range ids {
+		mkey, _ := schema.MKeyFromString(id)
+		if _, ok := latest[mkey]; !ok {
+			resp.Missing = append(resp.Missing, id)
+		}
+	}
+	for _, name := range names {
+		if _, ok := foundNames[name]; !ok {
+			resp.Missing = append(resp.Missing, name)
+		}
+	}
+	return resp
+}
+
+type byPathAndId []models.LookupSeries
+
+func (s byPathAndId) Len() int      { return len(s) }
+func (s byPathAndId) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byPathAndId) Less(i, j int) bool {
+	if s[i].Path != s[j].Path {
+		return s[i].Path < s[j].Path
+	}
+	return s[i].Id < s[j].Id
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/memory"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestLookupLocal(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	memory.TagSupport = true
+	memory.TagQueryWorkers = 5
+	defer func() { memory.TagSupport = false }()
+
+	srv, _ := newSrv(0, 0)
+	add := func(org int, name string, tags ...string) string {
+		md := schema.MetricData{OrgId: org, Name: name, Interval: 10, Value: 1, Time: 100, Mtype: "gauge", Tags: tags}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		srv.MetricIndex.AddOrUpdate(mkey, &md, 3)
+		return md.Id
+	}
+	plain := add(1, "a.b.c")
+	tagged := add(1, "a.b.c", "dc=x", "env=prod")
+	other := add(2, "a.b.c")
+
+	defs := srv.lookupLocal(1, []string{plain, other, "not-an-id"}, []string{"a.b.c;dc=x;env=prod", "a.b", "a.b.c;dc=x"})
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 series, got %v", defs)
+	}
+	if defs[0].Id.String() != plain || defs[0].Partition != 3 || defs[0].Interval != 10 {
+		t.Fatalf("expected series %s by id, got %v", plain, defs[0])
+	}
+	if defs[1].Id.String() != tagged || len(defs[1].Tags) != 2 {
+		t.Fatalf("expected tagged series %s by name, got %v", tagged, defs[1])
+	}
+}
+
+func TestLookupResult(t *testing.T) {
+	def := func(name string, key byte, lastUpdate int64) idx.Archive {
+		a := idx.NewArchiveBare(name)
+		a.Id = schema.MKey{Org: 1, Key: schema.Key{key}}
+		a.OrgId = 1
+		a.LastUpdate = lastUpdate
+		return a
+	}
+	// b moved to a partition of another node, which has an older update for it
+	defs := []idx.Archive{def("b", 2, 100), def("a", 1, 50), def("b", 2, 10)}
+	missingId := schema.MKey{Org: 1, Key: schema.Key{3}}.String()
+	resp := lookupResult(defs, []string{defs[1].Id.String(), missingId}, []string{"b", "c"})
+
+	if len(resp.Series) != 2 || resp.Series[0].Name != "a" || resp.Series[1].Name != "b" || resp.Series[1].LastUpdate != 100 {
+		t.Fatalf("expected a and the latest b, got %v", resp.Series)
+	}
+	if len(resp.Missing) != 2 || resp.Missing[0] != missingId || resp.Missing[1] != "c" {
+		t.Fatalf("expected %s and c to be missing, got %v", missingId, resp.Missing)
+	}
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+)
+
+// metaTags returns the meta tag rules of the org. all nodes have the same rules, so the local ones are returned
+func (s *Server) metaTags(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, s.MetricIndex.MetaTagRules(ctx.OrgId), ""))
+}
+
+// metaTagUpsert adds, changes or removes a meta tag rule of the org, on this node and,
+// unless disabled, on all peers
+func (s *Server) metaTagUpsert(ctx *middleware.Context, request models.MetaTagUpsert) {
+	rule := idx.MetaTagRule{
+		Expressions: request.Expressions,
+		MetaTags:    request.MetaTags,
+	}
+	created, err := s.MetricIndex.UpsertMetaTagRule(ctx.OrgId, rule)
+	auditRecord(ctx, ctx.OrgId, "metaTags.upsert", strings.Join(request.Expressions, ";")+" -> "+strings.Join(request.MetaTags, ";"), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	res := models.MetaTagUpsertResp{
+		Created: created,
+	}
+	if !request.Propagate {
+		response.Write(ctx, response.NewJson(200, res, ""))
+		return
+	}
+
+	data := models.IndexMetaTagUpsert{
+		OrgId:       ctx.OrgId,
+		Expressions: request.Expressions,
+		MetaTags:    request.MetaTags,
+	}
+	responses, err := s.peerQuery(ctx.Req.Context(), data, "clusterMetaTagUpsert", "/index/metaTags/upsert", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	res.Peers = make(map[string]bool, len(responses))
+	for peer, resp := range responses {
+		var peerResp models.IndexMetaTagUpsertResp
+		if err := json.Unmarshal(resp.buf, &peerResp); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		res.Peers[peer] = peerResp.Created
+	}
+	response.Write(ctx, response.NewJson(200, res, ""))
+}
+
+func (s *Server) indexMetaTagUpsert(ctx *middleware.Context, request models.IndexMetaTagUpsert) {
+	if !orgAllowed(ctx, request.OrgId) {
+		return
+	}
+	rule := idx.MetaTagRule{
+		Expressions: request.Expressions,
+		MetaTags:    request.MetaTags,
+	}
+	created, err := s.MetricIndex.UpsertMetaTagRule(request.OrgId, rule)
+	auditRecord(ctx, request.OrgId, "index.metaTags.upsert", strings.Join(request.Expressions, ";")+" -> "+strings.Join(request.MetaTags, ";"), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, models.IndexMetaTagUpsertResp{Created: created}, ""))
+}
@@ -7,6 +7,10 @@ import (
 
 func NodeReady() macaron.Handler {
 	return func(c *Context) {
+		if cluster.Manager.IsMaintenance() {
+			c.Error(503, "node in maintenance mode")
+			return
+		}
 		if !cluster.Manager.IsReady() {
 			c.Error(503, "node not ready")
 		}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/macaron.v1"
+)
+
+var (
+	// metric api.request.canceled is the number of requests of which the client went away before the response was sent
+	requestsCanceled = stats.NewCounter32("api.request.canceled")
+
+	// metric api.request.timed_out is the number of requests that ran into their max execution time
+	requestsTimedOut = stats.NewCounter32("api.request.timed_out")
+)
+
+// Deadline returns a middleware that limits the time a request may take, by setting a deadline on its context.
+// the deadline is maxExecutionTime (0 means no limit), or the timeout in the X-Request-Timeout header if that is shorter.
+// peers set that header when they query us on behalf of a request that has a deadline.
+// the handlers must honor the context, the middleware does not interrupt them.
+func Deadline(maxExecutionTime time.Duration) macaron.Handler {
+	return func(c *macaron.Context) {
+		parent := c.Req.Context()
+		timeout := maxExecutionTime
+		if d, err := time.ParseDuration(c.Req.Header.Get("X-Request-Timeout")); err == nil && d > 0 && (timeout == 0 || d < timeout) {
+			timeout = d
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(parent, timeout)
+			defer cancel()
+			c.Req = macaron.Request{c.Req.WithContext(ctx)}
+		}
+		c.Next()
+
+		if parent.Err() == context.Canceled {
+			requestsCanceled.Inc()
+		} else if c.Req.Context().Err() == context.DeadlineExceeded {
+			requestsTimedOut.Inc()
+		}
+	}
+}
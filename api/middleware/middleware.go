@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -14,6 +15,7 @@ type Context struct {
 	*macaron.Context
 	OrgId uint32
 	Body  io.ReadCloser
+	Token *Token // the scoped api token the request authenticated with, if any
 }
 
 func OrgMiddleware(multiTenant bool) macaron.Handler {
@@ -23,6 +25,10 @@ func OrgMiddleware(multiTenant bool) macaron.Handler {
 			c.PlainText(400, []byte(err.Error()))
 			return
 		}
+		if org != 0 {
+			// so that requests to peers made on behalf of this request can pass on the org
+			c.Req = macaron.Request{c.Req.WithContext(context.WithValue(c.Req.Context(), orgKey{}, org))}
+		}
 		ctx := &Context{
 			Context: c,
 			OrgId:   org,
@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/logger"
+	"gopkg.in/macaron.v1"
+)
+
+// Recovery returns a middleware that recovers from panics in the handlers, records them with the request
+// they happened for, and responds with 500 Internal Server Error. it replaces macaron's recovery middleware.
+func Recovery() macaron.Handler {
+	return func(c *macaron.Context) {
+		state := func() interface{} {
+			return map[string]string{
+				"method":     c.Req.Method,
+				"url":        c.Req.URL.String(),
+				"orgId":      c.Req.Header.Get("X-Org-Id"),
+				"requestId":  logger.RequestID(c.Req.Context()),
+				"remoteAddr": c.RemoteAddr(),
+			}
+		}
+		if crash.Run("api", state, c.Next) {
+			http.Error(c.Resp, "internal server error", http.StatusInternalServerError)
+		}
+	}
+}
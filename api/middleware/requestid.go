@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/grafana/metrictank/logger"
+	"gopkg.in/macaron.v1"
+)
+
+// RequestID returns a middleware that assigns each request an id, which is logged with the messages about the request.
+// the id is taken from the X-Request-Id header if present (e.g. set by a proxy, or by a peer for the requests
+// it makes on behalf of a request), and is returned in the X-Request-Id response header.
+func RequestID() macaron.Handler {
+	return func(c *macaron.Context) {
+		id := c.Req.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Resp.Header().Set("X-Request-Id", id)
+		ctx := logger.WithFields(c.Req.Context(), logger.Fields{}.With("request_id", id))
+		c.Req = macaron.Request{c.Req.WithContext(ctx)}
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' || r == ']' || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,97 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/grafana/metrictank/secrets"
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/macaron.v1"
+)
+
+type orgKey struct{}
+
+// OrgFromContext returns the org of the request the context was derived from, if it has one
+func OrgFromContext(ctx context.Context) (uint32, bool) {
+	org, ok := ctx.Value(orgKey{}).(uint32)
+	return org, ok
+}
+
+// metric api.tenant.unauthenticated is how many requests were refused in strict multi-tenant mode because they did not carry an authenticated org
+var unauthenticated = stats.NewCounter32("api.tenant.unauthenticated")
+
+// tenantStats tracks, per org, the requests and denied accesses in strict multi-tenant mode,
+// and the denied accesses of scoped api tokens
+type tenantStats struct {
+	sync.Mutex
+	requests map[uint32]*stats.Counter32
+	denied   map[uint32]*stats.Counter32
+}
+
+var tenants = tenantStats{
+	requests: make(map[uint32]*stats.Counter32),
+	denied:   make(map[uint32]*stats.Counter32),
+}
+
+func (t *tenantStats) inc(counters map[uint32]*stats.Counter32, name string, org uint32) {
+	t.Lock()
+	c, ok := counters[org]
+	if !ok {
+		c = stats.NewCounter32(fmt.Sprintf("api.tenant.%d.%s", org, name))
+		counters[org] = c
+	}
+	t.Unlock()
+	c.Inc()
+}
+
+// Denied records that the org was refused access to an endpoint or to the data of another org
+func Denied(org uint32) {
+	tenants.inc(tenants.denied, "denied", org)
+}
+
+// adminPaths are the endpoints that expose or change the state of the whole node, rather than that of an org
+var adminPaths = []string{"/node", "/priority", "/storage-config", "/org-policies", "/loglevel", "/features", "/audit", "/verify/", "/backfill/", "/compact/", "/standby/", "/cluster", "/debug/"}
+
+func isAdminPath(path string) bool {
+	for _, p := range adminPaths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// StrictTenancy returns a middleware that enforces strict multi-tenancy:
+// all requests, except the status and health checks, must carry an org and, if a token is given,
+// the token the authenticating proxy sets to prove it set the org. The node-wide admin endpoints
+// are only available to adminOrg. It must be used after OrgMiddleware.
+func StrictTenancy(token *secrets.Secret, adminOrg uint32) macaron.Handler {
+	return func(c *Context) {
+		path := c.Req.URL.Path
+		if c.Req.Method == "OPTIONS" || path == "/" || path == "/health" {
+			return
+		}
+		// requests that authenticated with a scoped api token don't come through the proxy
+		if token != nil && c.Token == nil {
+			auth := c.Req.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token.Get())) != 1 {
+				unauthenticated.Inc()
+				c.PlainText(401, []byte("missing or invalid authorization token."))
+				return
+			}
+		}
+		if c.OrgId == 0 {
+			unauthenticated.Inc()
+			c.PlainText(401, []byte("x-org-id header missing."))
+			return
+		}
+		tenants.inc(tenants.requests, "requests", c.OrgId)
+		if isAdminPath(path) && c.OrgId != adminOrg {
+			Denied(c.OrgId)
+			c.PlainText(403, []byte("this endpoint is only available to the admin org."))
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package middleware
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alyu/configparser"
+	"github.com/grafana/metrictank/secrets"
+	"gopkg.in/macaron.v1"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// Scope is a set of permissions of a scoped api token
+type Scope uint8
+
+const (
+	ScopeRead   Scope = 1 << iota // query data and the index
+	ScopeWrite                    // add data, such as events
+	ScopeDelete                   // delete series and events
+	ScopeAdmin                    // the node-wide admin endpoints and the endpoints peers use
+)
+
+var scopeNames = []struct {
+	scope Scope
+	name  string
+}{
+	{ScopeRead, "read"},
+	{ScopeWrite, "write"},
+	{ScopeDelete, "delete"},
+	{ScopeAdmin, "admin"},
+}
+
+func (s Scope) String() string {
+	var names []string
+	for _, n := range scopeNames {
+		if s&n.scope != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseScopes parses a comma separated list of scopes
+func ParseScopes(s string) (Scope, error) {
+	var scopes Scope
+NAMES:
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, n := range scopeNames {
+			if name == n.name {
+				scopes |= n.scope
+				continue NAMES
+			}
+		}
+		return 0, fmt.Errorf("unknown scope %q", name)
+	}
+	return scopes, nil
+}
+
+// Token is an api token that authenticates as an org, with a limited set of permissions,
+// optionally restricted to the series of which the name starts with one of the prefixes, and that have all the tags.
+// A nil Token has no restrictions.
+type Token struct {
+	Name     string
+	Org      uint32
+	Scopes   Scope
+	Prefixes []string
+	Tags     []string // key=value
+	secret   *secrets.Secret
+}
+
+// Has returns whether the token has the scope
+func (t *Token) Has(scope Scope) bool {
+	return t == nil || t.Scopes&scope == scope
+}
+
+// Restricted returns whether the token can only access some of the series of its org
+func (t *Token) Restricted() bool {
+	return t != nil && (len(t.Prefixes) != 0 || len(t.Tags) != 0)
+}
+
+// AllowsSeries returns whether the token may access the series with the given name, including its tags if any
+func (t *Token) AllowsSeries(nameWithTags string) bool {
+	if !t.Restricted() {
+		return true
+	}
+	parts := strings.Split(nameWithTags, ";")
+	if !t.allowsName(parts[0]) {
+		return false
+	}
+TAGS:
+	for _, tag := range t.Tags {
+		for _, have := range parts[1:] {
+			if have == tag {
+				continue TAGS
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (t *Token) allowsName(name string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range t.Prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsBranch returns whether the token may see the branch of the metrics tree with the given path,
+// which is the case if it leads to series with a name it may access
+func (t *Token) AllowsBranch(path string) bool {
+	if t == nil || len(t.Prefixes) == 0 {
+		return true
+	}
+	for _, p := range t.Prefixes {
+		if strings.HasPrefix(path, p) || strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPattern returns whether the token may run a query that affects all series matching the graphite pattern,
+// which is only the case if all of those have a name it may access. Patterns can't be checked against tags,
+// so tokens restricted to tags never may.
+func (t *Token) AllowsPattern(pattern string) bool {
+	if !t.Restricted() {
+		return true
+	}
+	return len(t.Tags) == 0 && t.allowsName(pattern)
+}
+
+type tokenKey struct{}
+
+// TokenFromContext returns the scoped token of the request the context was derived from, nil if it has none
+func TokenFromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenKey{}).(*Token)
+	return t
+}
+
+// Tokens are the scoped api tokens
+type Tokens []*Token
+
+// find returns the token with the given secret, nil if there is none
+func (ts Tokens) find(secret string) *Token {
+	var found *Token
+	for _, t := range ts {
+		// compare with all tokens, to not leak which one matched through the timing
+		if subtle.ConstantTimeCompare([]byte(secret), []byte(t.secret.Get())) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// ReadTokens reads and parses a tokens file, in the same format as storage-schemas.conf:
+//
+//	[name]
+//	token = env:SOME_TOKEN
+//	org = 1
+//	scopes = read,write
+//	prefixes = some.prefix.,other.prefix.
+//	tags = env=prod;dc=x
+func ReadTokens(file string) (Tokens, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+	var tokens Tokens
+	secrets := make(map[string]string)
+	for _, sec := range sections {
+		name := strings.Trim(strings.SplitN(sec.String(), "\n", 2)[0], " []")
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		t, err := parseToken(name, sec.ValueOf)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %s", name, err)
+		}
+		if other, ok := secrets[t.secret.Get()]; ok {
+			return nil, fmt.Errorf("[%s]: has the same token as [%s]", name, other)
+		}
+		secrets[t.secret.Get()] = name
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// parseToken parses the settings of a token, which are looked up with get. unset settings are ""
+func parseToken(name string, get func(string) string) (*Token, error) {
+	t := &Token{
+		Name: name,
+	}
+	var err error
+	ref := strings.TrimSpace(get("token"))
+	if ref == "" {
+		return nil, fmt.Errorf("empty token")
+	}
+	t.secret, err = secrets.New(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(t.secret.Get()) < 16 {
+		return nil, fmt.Errorf("token must be at least 16 characters")
+	}
+
+	org, err := strconv.ParseUint(strings.TrimSpace(get("org")), 10, 32)
+	if err != nil || org == 0 {
+		return nil, fmt.Errorf("invalid org %q", get("org"))
+	}
+	t.Org = uint32(org)
+
+	if strings.TrimSpace(get("scopes")) == "" {
+		return nil, fmt.Errorf("no scopes")
+	}
+	t.Scopes, err = ParseScopes(get("scopes"))
+	if err != nil {
+		return nil, err
+	}
+
+	if s := strings.TrimSpace(get("prefixes")); s != "" {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				t.Prefixes = append(t.Prefixes, p)
+			}
+		}
+	}
+	if s := strings.TrimSpace(get("tags")); s != "" {
+		for _, tag := range strings.Split(s, ";") {
+			t.Tags = append(t.Tags, strings.TrimSpace(tag))
+		}
+		if !schema.ValidateTags(t.Tags) {
+			return nil, fmt.Errorf("invalid tags %q. must be key=value pairs, separated by ';'", s)
+		}
+		sort.Strings(t.Tags)
+	}
+	return t, nil
+}
+
+// requiredScope returns the scope needed for a request
+func requiredScope(method, path string) Scope {
+	switch {
+	case isAdminPath(path) || isPeerPath(path):
+		return ScopeAdmin
+	case path == "/metrics/delete" || path == "/tags/delSeries" || (method == "DELETE" && strings.HasPrefix(path, "/events/")):
+		return ScopeDelete
+	case method == "POST" && (path == "/events" || path == "/events/" || path == "/metaTags/upsert" || path == "/savedQueries/upsert"):
+		return ScopeWrite
+	}
+	return ScopeRead
+}
+
+// peerPaths are the endpoints that peers use to query each other
+var peerPaths = []string{"/getdata", "/index/", "/ccache/"}
+
+func isPeerPath(path string) bool {
+	for _, p := range peerPaths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listingPaths are the endpoints that list the tags and label values of an org, or manage the meta tags or saved queries of
+// all its series, which can't be restricted to the series a token may access, so tokens that are restricted to some series can't use them.
+// executing a saved query is restricted like any render request.
+var listingPaths = []string{"/tags", "/tags/autoComplete/tags", "/tags/autoComplete/values", "/prometheus/api/v1/label/", "/metaTags", "/savedQueries"}
+
+func isListingPath(path string) bool {
+	if path == "/tags/findSeries" || path == "/tags/delSeries" {
+		return false
+	}
+	if strings.HasPrefix(path, "/savedQueries/") && strings.HasSuffix(path, "/render") {
+		return false
+	}
+	for _, p := range listingPaths {
+		if path == p || strings.HasPrefix(path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ScopedTokens returns a middleware that authenticates the requests that carry one of the tokens
+// as 'Authorization: Bearer <token>' as the org of the token, and refuses them access to the endpoints
+// that need a scope the token doesn't have. The restrictions of the token to some series are enforced by the handlers,
+// see TokenFromContext. Requests without a scoped token are left alone.
+// It must be used after OrgMiddleware and before StrictTenancy.
+func ScopedTokens(tokens Tokens) macaron.Handler {
+	return func(c *Context) {
+		auth := c.Req.Header.Get("Authorization")
+		if len(tokens) == 0 || !strings.HasPrefix(auth, "Bearer ") {
+			return
+		}
+		t := tokens.find(strings.TrimPrefix(auth, "Bearer "))
+		if t == nil {
+			// it may be the token of the authenticating proxy, see StrictTenancy
+			return
+		}
+		path := c.Req.URL.Path
+		if c.Req.Method == "OPTIONS" || path == "/" || path == "/health" {
+			return
+		}
+		if org := c.Req.Header.Get("x-org-id"); org != "" && org != strconv.FormatUint(uint64(t.Org), 10) {
+			Denied(t.Org)
+			c.PlainText(403, []byte("x-org-id does not match the org of the token."))
+			return
+		}
+		c.OrgId = t.Org
+		c.Token = t
+		c.Req = macaron.Request{c.Req.WithContext(context.WithValue(context.WithValue(c.Req.Context(), orgKey{}, t.Org), tokenKey{}, t))}
+
+		if scope := requiredScope(c.Req.Method, path); !t.Has(scope) {
+			Denied(t.Org)
+			c.PlainText(403, []byte(fmt.Sprintf("this endpoint requires a token with the %s scope.", scope)))
+			return
+		}
+		if t.Restricted() && isListingPath(path) {
+			Denied(t.Org)
+			c.PlainText(403, []byte("this endpoint is not available to tokens that are restricted to some series."))
+		}
+	}
+}
@@ -3,6 +3,7 @@ package middleware
 import (
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/grafana/metrictank/tracing"
 	opentracing "github.com/opentracing/opentracing-go"
@@ -24,9 +25,12 @@ func (rw *TracingResponseWriter) Write(b []byte) (int, error) {
 	return rw.ResponseWriter.Write(b)
 }
 
-// Tracer returns a middleware that traces requests
-func Tracer(tracer opentracing.Tracer) macaron.Handler {
+// Tracer returns a middleware that traces requests.
+// requests from clients are traced according to the sampling policy. nil to trace them all.
+// requests from peers follow the decision made for the request they are part of.
+func Tracer(tracer opentracing.Tracer, sampling *tracing.Sampling) macaron.Handler {
 	return func(macCtx *macaron.Context) {
+		pre := time.Now()
 
 		path := pathSlug(macCtx.Req.URL.Path)
 		// graphite cluster requests use local=1
@@ -37,11 +41,16 @@ func Tracer(tracer opentracing.Tracer) macaron.Handler {
 		}
 
 		spanCtx, _ := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(macCtx.Req.Header))
-		span := tracer.StartSpan("HTTP "+macCtx.Req.Method+" "+path, ext.RPCServerOption(spanCtx))
-
-		ext.HTTPMethod.Set(span, macCtx.Req.Method)
-		ext.HTTPUrl.Set(span, macCtx.Req.URL.String())
-		ext.Component.Set(span, "metrictank/api")
+		opts := []opentracing.StartSpanOption{ext.RPCServerOption(spanCtx)}
+		sampled := true
+		if sampling != nil && spanCtx == nil {
+			sampled = sampling.Sample(macCtx.Req.URL.Path)
+			if !sampled {
+				opts = append(opts, opentracing.Tag{Key: string(ext.SamplingPriority), Value: uint16(0)})
+			}
+		}
+		span := tracer.StartSpan("HTTP "+macCtx.Req.Method+" "+path, opts...)
+		setRequestTags(span, macCtx)
 
 		macCtx.Req = macaron.Request{macCtx.Req.WithContext(opentracing.ContextWithSpan(macCtx.Req.Context(), span))}
 		macCtx.Resp = &TracingResponseWriter{
@@ -63,6 +72,14 @@ func Tracer(tracer opentracing.Tracer) macaron.Handler {
 		// have completed and the request has been sent.
 		macCtx.Next()
 		status := rw.Status()
+		if sampling != nil && spanCtx == nil {
+			// tags set while the span was not sampled are lost, so we set them again
+			if reason := sampling.Done(macCtx.Req.URL.Path, sampled, time.Since(pre), status >= 500); reason != "" {
+				ext.SamplingPriority.Set(span, 1)
+				setRequestTags(span, macCtx)
+				span.SetTag("sampling.forced", reason)
+			}
+		}
 		ext.HTTPStatusCode.Set(span, uint16(status))
 		if status >= 200 && status < 300 {
 			span.SetTag("http.size", rw.Size())
@@ -76,3 +93,9 @@ func Tracer(tracer opentracing.Tracer) macaron.Handler {
 		span.Finish()
 	}
 }
+
+func setRequestTags(span opentracing.Span, macCtx *macaron.Context) {
+	ext.HTTPMethod.Set(span, macCtx.Req.Method)
+	ext.HTTPUrl.Set(span, macCtx.Req.URL.String())
+	ext.Component.Set(span, "metrictank/api")
+}
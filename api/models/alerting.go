@@ -0,0 +1,71 @@
+package models
+
+import (
+	"math"
+	"strconv"
+)
+
+// AlertEval is a request to evaluate targets over a recent window, and return one value per series
+type AlertEval struct {
+	FromTo
+	Targets     []string `json:"target" form:"target" binding:"Required"`
+	Aggregation string   `json:"aggregation" form:"aggregation" binding:"Default(last)"` // how the points of the window are aggregated into one
+}
+
+// AlertEvalResp holds the results of the targets of an AlertEval request, in the order of the targets
+type AlertEvalResp []AlertEvalResult
+
+// AlertEvalResult is the result of one target. targets that could not be evaluated have an error, and no series
+type AlertEvalResult struct {
+	Target string
+	Series []AlertValue
+	Error  string
+}
+
+// AlertValue is the aggregated value of a series over the window. Value is NaN if the series has no non-null points in it,
+// and Ts is the timestamp of its last non-null point, or of its last point if there are none.
+type AlertValue struct {
+	Name  string
+	Value float64
+	Ts    uint32
+}
+
+func (resp AlertEvalResp) MarshalJSONFast(b []byte) ([]byte, error) {
+	b = append(b, '[')
+	for _, r := range resp {
+		b = append(b, `{"target":`...)
+		b = strconv.AppendQuoteToASCII(b, r.Target)
+		b = append(b, `,"series":[`...)
+		for _, v := range r.Series {
+			b = append(b, `{"name":`...)
+			b = strconv.AppendQuoteToASCII(b, v.Name)
+			b = append(b, `,"value":`...)
+			if math.IsNaN(v.Value) {
+				b = append(b, `null`...)
+			} else {
+				b = strconv.AppendFloat(b, v.Value, 'f', -1, 64)
+			}
+			b = append(b, `,"ts":`...)
+			b = strconv.AppendUint(b, uint64(v.Ts), 10)
+			b = append(b, `},`...)
+		}
+		if len(r.Series) != 0 {
+			b = b[:len(b)-1] // cut last comma
+		}
+		b = append(b, ']')
+		if r.Error != "" {
+			b = append(b, `,"error":`...)
+			b = strconv.AppendQuoteToASCII(b, r.Error)
+		}
+		b = append(b, `},`...)
+	}
+	if len(resp) != 0 {
+		b = b[:len(b)-1] // cut last comma
+	}
+	b = append(b, ']')
+	return b, nil
+}
+
+func (resp AlertEvalResp) MarshalJSON() ([]byte, error) {
+	return resp.MarshalJSONFast(nil)
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestAlertEvalRespJsonMarshal(t *testing.T) {
+	cases := []struct {
+		in  AlertEvalResp
+		out string
+	}{
+		{
+			in:  AlertEvalResp{},
+			out: `[]`,
+		},
+		{
+			in: AlertEvalResp{
+				{Target: "a.*", Series: []AlertValue{{Name: "a.b", Value: 1.5, Ts: 60}, {Name: `a."c"`, Value: math.NaN(), Ts: 120}}},
+				{Target: "sumSeries(b", Error: "parse error"},
+				{Target: "c"},
+			},
+			out: `[{"target":"a.*","series":[{"name":"a.b","value":1.5,"ts":60},{"name":"a.\"c\"","value":null,"ts":120}]},` +
+				`{"target":"sumSeries(b","series":[],"error":"parse error"},{"target":"c","series":[]}]`,
+		},
+	}
+	for i, c := range cases {
+		got, err := json.Marshal(c.in)
+		if err != nil {
+			t.Fatalf("case %d: failed to marshal: %s", i, err)
+		}
+		if string(got) != c.out {
+			t.Fatalf("case %d: expected\n%s\ngot\n%s", i, c.out, got)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package models
+
+import (
+	"github.com/grafana/metrictank/mdata"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// ChunksPersist selects the series of which to save the current chunks
+type ChunksPersist struct {
+	// patterns with name globbing
+	Patterns []string `json:"patterns" form:"patterns"`
+	// tag expressions to select series
+	Expr      []string `json:"expr" form:"expr"`
+	OrgId     uint32   `json:"orgId" form:"orgId" binding:"Required"`
+	Propagate bool     `json:"propagate" form:"propagate"`
+}
+
+func (c ChunksPersist) Trace(span opentracing.Span) {
+	span.SetTag("patterns", c.Patterns)
+	span.SetTag("expr", c.Expr)
+	span.SetTag("org", c.OrgId)
+	span.SetTag("propagate", c.Propagate)
+}
+
+func (c ChunksPersist) TraceDebug(span opentracing.Span) {
+}
+
+// ChunksDrop selects the series to drop from memory
+type ChunksDrop struct {
+	// patterns with name globbing
+	Patterns []string `json:"patterns" form:"patterns"`
+	// tag expressions to select series
+	Expr      []string `json:"expr" form:"expr"`
+	OrgId     uint32   `json:"orgId" form:"orgId" binding:"Required"`
+	Propagate bool     `json:"propagate" form:"propagate"`
+}
+
+func (c ChunksDrop) Trace(span opentracing.Span) {
+	span.SetTag("patterns", c.Patterns)
+	span.SetTag("expr", c.Expr)
+	span.SetTag("org", c.OrgId)
+	span.SetTag("propagate", c.Propagate)
+}
+
+func (c ChunksDrop) TraceDebug(span opentracing.Span) {
+}
+
+type ChunksResp struct {
+	Errors     int    `json:"errors"`
+	FirstError string `json:"firstError"`
+	// series that matched in the index
+	Series int `json:"series"`
+	// series that matched and were in memory
+	InMemory int `json:"inMemory"`
+	// chunks that were sent to the store
+	Persisted int `json:"persisted,omitempty"`
+	// whether the chunks were not persisted because this node is not a primary
+	NotPrimary bool `json:"notPrimary,omitempty"`
+	// series that were removed from the chunk cache
+	DeletedSeries int                   `json:"deletedSeries,omitempty"`
+	Peers         map[string]ChunksResp `json:"peers"`
+}
+
+// StandbyChunks are chunks sent by a primary to the secondaries of their partitions
+type StandbyChunks struct {
+	Chunks []mdata.StandbyChunk `json:"chunks"`
+}
+
+func (c StandbyChunks) Trace(span opentracing.Span) {
+	span.SetTag("chunks", len(c.Chunks))
+}
+
+func (c StandbyChunks) TraceDebug(span opentracing.Span) {
+}
+
+type StandbyChunksResp struct {
+	// chunks that added points to the chunks in memory
+	Merged int `json:"merged"`
+}
@@ -0,0 +1,16 @@
+package models
+
+// GraphiteEvents is a query for events, like graphite-web's /events/get_data
+type GraphiteEvents struct {
+	FromTo
+	Tags []string `json:"tags" form:"tags"` // each may hold several space separated tags
+}
+
+// GraphiteEventCreate is a new event, as posted to graphite-web's /events/.
+// tags may be given as a list or as a space separated string. when defaults to now
+type GraphiteEventCreate struct {
+	What string      `json:"what"`
+	Tags interface{} `json:"tags"`
+	When *float64    `json:"when"`
+	Data string      `json:"data"`
+}
@@ -17,6 +17,7 @@ import (
 //msgp:ignore GraphiteAutoCompleteTags
 //msgp:ignore GraphiteAutoCompleteTagValues
 //msgp:ignore GraphiteFind
+//msgp:ignore GraphiteFunctions
 //msgp:ignore GraphiteRender
 //msgp:ignore GraphiteTag
 //msgp:ignore GraphiteTagDetails
@@ -27,12 +28,24 @@ import (
 //msgp:ignore GraphiteTagResp
 //msgp:ignore GraphiteTags
 //msgp:ignore GraphiteTagsResp
+//msgp:ignore LookupSeries
+//msgp:ignore MetaTagUpsert
+//msgp:ignore MetaTagUpsertResp
 //msgp:ignore MetricNames
 //msgp:ignore MetricsDelete
+//msgp:ignore MetricsLookup
+//msgp:ignore MetricsLookupResp
+//msgp:ignore MetricsPreview
+//msgp:ignore MetricsPreviewResp
+//msgp:ignore MetricsStale
+//msgp:ignore SavedQueryRender
+//msgp:ignore SavedQueryUpsert
+//msgp:ignore SavedQueryUpsertResp
 //msgp:ignore SeriesCompleter
 //msgp:ignore SeriesCompleterItem
 //msgp:ignore SeriesTree
 //msgp:ignore SeriesTreeItem
+//msgp:ignore StaleSeries
 
 type FromTo struct {
 	From  string `json:"from" form:"from"`
@@ -43,12 +56,15 @@ type FromTo struct {
 
 type GraphiteRender struct {
 	FromTo
-	MaxDataPoints uint32   `json:"maxDataPoints" form:"maxDataPoints" binding:"Default(800)"`
+	MaxDataPoints uint32   `json:"maxDataPoints" form:"maxDataPoints"` // 0 means the default of the org policy, or 800
 	Targets       []string `json:"target" form:"target"`
 	TargetsRails  []string `form:"target[]"` // # Rails/PHP/jQuery common practice format: ?target[]=path.1&target[]=path.2 -> like graphite, we allow this.
 	Format        string   `json:"format" form:"format" binding:"In(,json,msgp,msgpack,pickle)"`
 	NoProxy       bool     `json:"local" form:"local"` //this is set to true by graphite-web when it passes request to cluster servers
 	Process       string   `json:"process" form:"process" binding:"In(,none,stable,any);Default(stable)"`
+	Archive       string   `json:"archive" form:"archive"`           // archive to read: raw, the interval of a rollup (e.g. 1h) or auto. see ParseArchiveReq
+	XFilesFactor  string   `json:"xFilesFactor" form:"xFilesFactor"` // overrides the xFilesFactor of the storage-aggregations for runtime consolidation
+	Stream        bool     `json:"stream" form:"stream"`             // write the series out one by one instead of encoding the full response first. not supported for pickle
 }
 
 func (gr GraphiteRender) Validate(ctx *macaron.Context, errs binding.Errors) binding.Errors {
@@ -75,6 +91,10 @@ func (gr GraphiteRender) Validate(ctx *macaron.Context, errs binding.Errors) bin
 	return errs
 }
 
+type GraphiteFunctions struct {
+	Native bool `json:"native" form:"native"`
+}
+
 type GraphiteTags struct {
 	Filter string `json:"filter" form:"filter"`
 	From   int64  `json:"from" form:"from"`
@@ -87,6 +107,7 @@ type GraphiteAutoCompleteTags struct {
 	Expr   []string `json:"expr" form:"expr"`
 	From   int64    `json:"from" form:"from"`
 	Limit  uint     `json:"limit" form:"limit"`
+	Cursor string   `json:"cursor" form:"cursor"` // to get the next page, as returned by the previous request
 }
 
 type GraphiteAutoCompleteTagValues struct {
@@ -95,6 +116,7 @@ type GraphiteAutoCompleteTagValues struct {
 	Expr   []string `json:"expr" form:"expr"`
 	From   int64    `json:"from" form:"from"`
 	Limit  uint     `json:"limit" form:"limit"`
+	Cursor string   `json:"cursor" form:"cursor"` // to get the next page, as returned by the previous request
 }
 
 type GraphiteTagResp struct {
@@ -144,6 +166,74 @@ type GraphiteTagDelSeriesResp struct {
 	Peers map[string]int `json:"peers"`
 }
 
+type MetaTagUpsert struct {
+	Expressions []string `json:"expressions" form:"expressions" binding:"Required"`
+	MetaTags    []string `json:"metaTags" form:"metaTags"` // empty to remove the rule with the expressions
+	Propagate   bool     `json:"propagate" form:"propagate" binding:"Default(true)"`
+}
+
+func (m MetaTagUpsert) Trace(span opentracing.Span) {
+	span.SetTag("expressions", m.Expressions)
+	span.SetTag("metaTags", m.MetaTags)
+	span.SetTag("propagate", m.Propagate)
+}
+
+func (m MetaTagUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type MetaTagUpsertResp struct {
+	Created bool            `json:"created"`
+	Peers   map[string]bool `json:"peers"` // whether the rule was created on each peer
+}
+
+// SavedQueryUpsert saves a render request under an id, or removes the query with the id if no target is given
+type SavedQueryUpsert struct {
+	Id            string   `json:"id" form:"id"` // empty to generate one
+	Targets       []string `json:"target" form:"target"`
+	From          string   `json:"from" form:"from"`
+	Until         string   `json:"until" form:"until"`
+	MaxDataPoints uint32   `json:"maxDataPoints" form:"maxDataPoints"`
+	Process       string   `json:"process" form:"process" binding:"In(,stable,any)"`
+	Archive       string   `json:"archive" form:"archive"`
+	XFilesFactor  string   `json:"xFilesFactor" form:"xFilesFactor"`
+	TTL           string   `json:"ttl" form:"ttl"` // how long to keep the query, e.g. 30d. empty to keep it
+	Propagate     bool     `json:"propagate" form:"propagate" binding:"Default(true)"`
+}
+
+func (s SavedQueryUpsert) Trace(span opentracing.Span) {
+	span.SetTag("id", s.Id)
+	span.SetTag("targets", s.Targets)
+	span.SetTag("ttl", s.TTL)
+	span.SetTag("propagate", s.Propagate)
+}
+
+func (s SavedQueryUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type SavedQueryUpsertResp struct {
+	Id      string          `json:"id"`
+	Created bool            `json:"created"`
+	Expires int64           `json:"expires,omitempty"`
+	Peers   map[string]bool `json:"peers,omitempty"` // whether the query was created on each peer
+}
+
+// SavedQueryRender executes a saved query. the parameters that are set override the ones of the query
+type SavedQueryRender struct {
+	FromTo
+	MaxDataPoints uint32 `json:"maxDataPoints" form:"maxDataPoints"`
+	Format        string `json:"format" form:"format" binding:"In(,json,msgp,msgpack,pickle)"`
+	Stream        bool   `json:"stream" form:"stream"`
+}
+
+func (s SavedQueryRender) Trace(span opentracing.Span) {
+	span.SetTag("from", s.From)
+	span.SetTag("until", s.Until)
+	span.SetTag("format", s.Format)
+}
+
+func (s SavedQueryRender) TraceDebug(span opentracing.Span) {
+}
+
 type GraphiteFind struct {
 	FromTo
 	Query  string `json:"query" form:"query" binding:"Required"`
@@ -155,6 +245,62 @@ type MetricsDelete struct {
 	Query string `json:"query" form:"query" binding:"Required"`
 }
 
+// MetricsStale selects the series that stopped receiving data, by graphite patterns or by tag expressions.
+// series without data for StaleAfter are stale, those without data for Window are left out as long dead.
+type MetricsStale struct {
+	Query      []string `json:"query" form:"query"`
+	Expr       []string `json:"expr" form:"expr"`
+	StaleAfter string   `json:"staleAfter" form:"staleAfter" binding:"Default(10min)"`
+	Window     string   `json:"window" form:"window" binding:"Default(1d)"`
+}
+
+type StaleSeries struct {
+	Path       string `json:"path"`
+	Id         string `json:"id"`
+	LastUpdate int64  `json:"lastUpdate"`
+}
+
+// MetricsLookup selects series by their ids and by their names. the names of tagged series include their tags.
+type MetricsLookup struct {
+	Ids   []string `json:"ids" form:"ids"`
+	Names []string `json:"names" form:"names"`
+}
+
+type MetricsLookupResp struct {
+	Series  []LookupSeries `json:"series"`
+	Missing []string       `json:"missing"`
+}
+
+// LookupSeries is the definition of a series
+type LookupSeries struct {
+	Path       string   `json:"path"`
+	Id         string   `json:"id"`
+	OrgId      uint32   `json:"orgId"`
+	Name       string   `json:"name"`
+	Tags       []string `json:"tags"`
+	Interval   int      `json:"interval"`
+	Unit       string   `json:"unit"`
+	Mtype      string   `json:"mtype"`
+	Partition  int32    `json:"partition"`
+	LastUpdate int64    `json:"lastUpdate"`
+}
+
+// MetricsPreview selects series by a graphite pattern or by tag expressions, for a preview of their recent data:
+// the last Window of data, consolidated to at most Points points. at most Limit series are returned.
+type MetricsPreview struct {
+	Query  string   `json:"query" form:"query"`
+	Expr   []string `json:"expr" form:"expr"`
+	Window string   `json:"window" form:"window" binding:"Default(1h)"`
+	Points uint32   `json:"points" form:"points" binding:"Default(20)"`
+	Limit  int      `json:"limit" form:"limit" binding:"Default(100)"`
+}
+
+type MetricsPreviewResp struct {
+	Series SeriesByTarget `json:"series"`
+	// whether more series matched than the limit
+	Truncated bool `json:"truncated"`
+}
+
 type MetricNames []idx.Archive
 
 func (defs MetricNames) MarshalJSONFast(b []byte) ([]byte, error) {
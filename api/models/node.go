@@ -2,6 +2,7 @@ package models
 
 import (
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
 	opentracing "github.com/opentracing/opentracing-go"
 	schema "gopkg.in/raintank/schema.v1"
 )
@@ -10,6 +11,52 @@ type NodeStatus struct {
 	Primary string `json:"primary" form:"primary" binding:"Required"`
 }
 
+// NodeReadyOverride forces the readiness of the node. see cluster.ReadyOverride for valid values
+type NodeReadyOverride struct {
+	Override string `json:"override" form:"override" binding:"Required"`
+}
+
+type NodeMaintenance struct {
+	Maintenance string `json:"maintenance" form:"maintenance" binding:"Required"`
+}
+
+// NodeHandover hands the primary role of the node over to a secondary
+type NodeHandover struct {
+	// the name of the secondary to promote
+	Node string `json:"node" form:"node" binding:"Required"`
+	// how long to wait for the chunk saves and for the secondary to catch up, e.g. 30s. defaults to 1min
+	Timeout string `json:"timeout" form:"timeout"`
+}
+
+type NodeHandoverResp struct {
+	Demoted  string `json:"demoted"`
+	Promoted string `json:"promoted"`
+}
+
+// NodePromote makes the node primary, once it processed all persist messages sent so far
+type NodePromote struct {
+	// how long to wait to catch up, e.g. 30s. defaults to 1min
+	Timeout string `json:"timeout" form:"timeout"`
+}
+
+func (n NodePromote) Trace(span opentracing.Span) {
+	span.SetTag("timeout", n.Timeout)
+}
+
+func (n NodePromote) TraceDebug(span opentracing.Span) {
+}
+
+// LogLevel sets the global log level, or the one of a single module if set
+type LogLevel struct {
+	Level  string `json:"level" form:"level" binding:"Required"`
+	Module string `json:"module" form:"module"`
+}
+
+type LogLevelResp struct {
+	Level   string            `json:"level"`
+	Modules map[string]string `json:"modules"`
+}
+
 type ClusterStatus struct {
 	ClusterName string         `json:"clusterName"`
 	NodeName    string         `json:"nodeName"`
@@ -36,6 +83,23 @@ func (i IndexList) Trace(span opentracing.Span) {
 func (i IndexList) TraceDebug(span opentracing.Span) {
 }
 
+type IndexLookup struct {
+	OrgId uint32   `json:"orgId" binding:"Required"`
+	Ids   []string `json:"ids"`
+	Names []string `json:"names"`
+}
+
+func (i IndexLookup) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("ids", len(i.Ids))
+	span.SetTag("names", len(i.Names))
+}
+
+func (i IndexLookup) TraceDebug(span opentracing.Span) {
+	span.SetTag("ids", i.Ids)
+	span.SetTag("names", i.Names)
+}
+
 type IndexFindByTag struct {
 	OrgId uint32   `json:"orgId" binding:"Required"`
 	Expr  []string `json:"expressions"`
@@ -88,6 +152,7 @@ type IndexAutoCompleteTags struct {
 	Prefix string   `json:"Prefix"`
 	Expr   []string `json:"expressions"`
 	From   int64    `json:"from"`
+	After  string   `json:"after"`
 	Limit  uint     `json:"limit"`
 }
 
@@ -96,6 +161,7 @@ func (t IndexAutoCompleteTags) Trace(span opentracing.Span) {
 	span.SetTag("Prefix", t.Prefix)
 	span.SetTag("expressions", t.Expr)
 	span.SetTag("from", t.From)
+	span.SetTag("after", t.After)
 	span.SetTag("limit", t.Limit)
 }
 
@@ -108,6 +174,7 @@ type IndexAutoCompleteTagValues struct {
 	Prefix string   `json:"prefix"`
 	Expr   []string `json:"expressions"`
 	From   int64    `json:"from"`
+	After  string   `json:"after"`
 	Limit  uint     `json:"limit"`
 }
 
@@ -117,6 +184,7 @@ func (t IndexAutoCompleteTagValues) Trace(span opentracing.Span) {
 	span.SetTag("tag", t.Tag)
 	span.SetTag("expressions", t.Expr)
 	span.SetTag("from", t.From)
+	span.SetTag("after", t.After)
 	span.SetTag("limit", t.Limit)
 }
 
@@ -136,6 +204,43 @@ func (t IndexTagDelSeries) Trace(span opentracing.Span) {
 func (i IndexTagDelSeries) TraceDebug(span opentracing.Span) {
 }
 
+type IndexMetaTagUpsert struct {
+	OrgId       uint32   `json:"orgId" binding:"Required"`
+	Expressions []string `json:"expressions" binding:"Required"`
+	MetaTags    []string `json:"metaTags"`
+}
+
+func (i IndexMetaTagUpsert) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("expressions", i.Expressions)
+	span.SetTag("metaTags", i.MetaTags)
+}
+
+func (i IndexMetaTagUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type IndexMetaTagUpsertResp struct {
+	Created bool `json:"created"`
+}
+
+type IndexSavedQueryUpsert struct {
+	OrgId uint32         `json:"orgId" binding:"Required"`
+	Query idx.SavedQuery `json:"query"`
+}
+
+func (i IndexSavedQueryUpsert) Trace(span opentracing.Span) {
+	span.SetTag("org", i.OrgId)
+	span.SetTag("id", i.Query.Id)
+	span.SetTag("targets", i.Query.Targets)
+}
+
+func (i IndexSavedQueryUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type IndexSavedQueryUpsertResp struct {
+	Created bool `json:"created"`
+}
+
 type IndexGet struct {
 	MKey schema.MKey `json:"id" form:"id" binding:"Required"`
 }
@@ -157,6 +262,8 @@ func (i IndexFind) TraceDebug(span opentracing.Span) {
 
 type GetData struct {
 	Requests []Req `json:"requests" binding:"Required"`
+	// max number of chunks the requests may fetch from the store, 0 for no limit
+	MaxChunks int `json:"maxChunks"`
 }
 
 func (g GetData) Trace(span opentracing.Span) {
@@ -187,3 +294,103 @@ func (i IndexDelete) Trace(span opentracing.Span) {
 
 func (i IndexDelete) TraceDebug(span opentracing.Span) {
 }
+
+// FeatureFlag sets the state of a feature flag. see features.ParseState for valid states
+type FeatureFlag struct {
+	Name  string `json:"name" form:"name" binding:"Required"`
+	State string `json:"state" form:"state" binding:"Required"`
+}
+
+// Audit selects entries from the audit log. see audit.Filter
+type Audit struct {
+	Org    uint32 `json:"org" form:"org"`
+	Action string `json:"action" form:"action"`
+	Target string `json:"target" form:"target"`
+	From   int64  `json:"from" form:"from"`
+	Limit  int    `json:"limit" form:"limit" binding:"Default(100)"`
+}
+
+type VerifyRollups struct {
+	Ids    []string `json:"id" form:"id"`
+	Series int      `json:"series" form:"series" binding:"Default(10)"`
+}
+
+type BackfillRollups struct {
+	Span      uint32 `json:"span" form:"span"`
+	From      int64  `json:"from" form:"from"`
+	Until     int64  `json:"until" form:"until"`
+	Overwrite bool   `json:"overwrite" form:"overwrite"`
+	// patterns with name globbing
+	Patterns []string `json:"patterns" form:"patterns"`
+	// tag expressions to select series
+	Expr  []string `json:"expr" form:"expr"`
+	OrgId uint32   `json:"orgId" form:"orgId"`
+}
+
+// StorageOverrideUpsert adds or changes a storage override, or removes it if neither
+// retentions nor aggregationMethod are set
+type StorageOverrideUpsert struct {
+	Name              string  `json:"name" form:"name" binding:"Required"`
+	Pattern           string  `json:"pattern" form:"pattern"`
+	Retentions        string  `json:"retentions" form:"retentions"`
+	XFilesFactor      float64 `json:"xFilesFactor" form:"xFilesFactor"`
+	AggregationMethod string  `json:"aggregationMethod" form:"aggregationMethod"`
+	Propagate         bool    `json:"propagate" form:"propagate"`
+}
+
+func (s StorageOverrideUpsert) Trace(span opentracing.Span) {
+	span.SetTag("name", s.Name)
+	span.SetTag("pattern", s.Pattern)
+	span.SetTag("retentions", s.Retentions)
+	span.SetTag("aggregationMethod", s.AggregationMethod)
+	span.SetTag("propagate", s.Propagate)
+}
+
+func (s StorageOverrideUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type StorageOverrideUpsertResp struct {
+	Created bool                                 `json:"created"`
+	Peers   map[string]StorageOverrideUpsertResp `json:"peers,omitempty"`
+}
+
+// OrgPolicyUpsert sets the policy of an org, or removes it if no setting is given
+type OrgPolicyUpsert struct {
+	OrgId          uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	ConsolidateBy  string `json:"consolidateBy" form:"consolidateBy"`
+	MaxQueryRange  string `json:"maxQueryRange" form:"maxQueryRange"`
+	MaxDataPoints  uint32 `json:"maxDataPoints" form:"maxDataPoints"`
+	RetentionClass string `json:"retentionClass" form:"retentionClass"`
+	Propagate      bool   `json:"propagate" form:"propagate"`
+}
+
+func (o OrgPolicyUpsert) Trace(span opentracing.Span) {
+	span.SetTag("org", o.OrgId)
+	span.SetTag("consolidateBy", o.ConsolidateBy)
+	span.SetTag("maxQueryRange", o.MaxQueryRange)
+	span.SetTag("maxDataPoints", o.MaxDataPoints)
+	span.SetTag("retentionClass", o.RetentionClass)
+	span.SetTag("propagate", o.Propagate)
+}
+
+func (o OrgPolicyUpsert) TraceDebug(span opentracing.Span) {
+}
+
+type OrgPolicyUpsertResp struct {
+	Created bool                           `json:"created"`
+	Peers   map[string]OrgPolicyUpsertResp `json:"peers,omitempty"`
+}
+
+type CompactChunks struct {
+	Until int64 `json:"until" form:"until"`
+}
+
+type Throughput struct {
+	Threshold float64 `json:"threshold" form:"threshold" binding:"Default(0.9)"`
+}
+
+type IndexCardinality struct {
+	OrgId  int64  `json:"orgId" form:"orgId" binding:"Default(-1)"` // -1 for all orgs
+	Window string `json:"window" form:"window" binding:"Default(0)"`
+	Limit  int    `json:"limit" form:"limit" binding:"Default(10)"`
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"github.com/grafana/metrictank/mdata/pin"
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+type PinAdd struct {
+	// id of the pin. adding a pin with the id of an existing one replaces it. generated if empty
+	Id string `json:"id" form:"id"`
+	// patterns with name globbing
+	Patterns []string `json:"patterns" form:"patterns"`
+	// tag expressions to select series
+	Expr []string `json:"expr" form:"expr"`
+	// how long to keep the series pinned, e.g. 2h
+	Duration  string `json:"duration" form:"duration" binding:"Required"`
+	OrgId     uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Propagate bool   `json:"propagate" form:"propagate"`
+}
+
+func (p PinAdd) Trace(span opentracing.Span) {
+	span.SetTag("id", p.Id)
+	span.SetTag("patterns", p.Patterns)
+	span.SetTag("expr", p.Expr)
+	span.SetTag("duration", p.Duration)
+	span.SetTag("org", p.OrgId)
+	span.SetTag("propagate", p.Propagate)
+}
+
+func (p PinAdd) TraceDebug(span opentracing.Span) {
+}
+
+type PinDelete struct {
+	Id        string `json:"id" form:"id" binding:"Required"`
+	OrgId     uint32 `json:"orgId" form:"orgId" binding:"Required"`
+	Propagate bool   `json:"propagate" form:"propagate"`
+}
+
+func (p PinDelete) Trace(span opentracing.Span) {
+	span.SetTag("id", p.Id)
+	span.SetTag("org", p.OrgId)
+	span.SetTag("propagate", p.Propagate)
+}
+
+func (p PinDelete) TraceDebug(span opentracing.Span) {
+}
+
+type PinList struct {
+	OrgId uint32 `json:"orgId" form:"orgId" binding:"Required"`
+}
+
+func (p PinList) Trace(span opentracing.Span) {
+	span.SetTag("org", p.OrgId)
+}
+
+func (p PinList) TraceDebug(span opentracing.Span) {
+}
+
+type PinResp struct {
+	Errors     int                `json:"errors"`
+	FirstError string             `json:"firstError"`
+	Pin        *pin.Pin           `json:"pin,omitempty"`
+	Deleted    bool               `json:"deleted,omitempty"`
+	Peers      map[string]PinResp `json:"peers"`
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/grafana/metrictank/util"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/opentracing/opentracing-go/log"
+	"github.com/raintank/dur"
 )
 
 // Req is a request for data by MKey and parameters such as consolidator, max points, etc
@@ -30,6 +31,9 @@ type Req struct {
 	Node     cluster.Node               `json:"-"`
 	SchemaId uint16                     `json:"schemaId"`
 	AggId    uint16                     `json:"aggId"`
+	// the fraction of points that must be non-null for runtime consolidation to produce a non-null point.
+	// 0 means a single non-null point suffices
+	XFilesFactor float64 `json:"xFilesFactor"`
 
 	// these fields need some more coordination and are typically set later
 	Archive      int    `json:"archive"`      // 0 means original data, 1 means first agg level, 2 means 2nd, etc.
@@ -53,6 +57,7 @@ func NewReq(key schema.MKey, target, patt string, from, to, maxPoints, rawInterv
 		node,
 		schemaId,
 		aggId,
+		0,
 		-1, // this is supposed to be updated still!
 		0,  // this is supposed to be updated still
 		0,  // this is supposed to be updated still
@@ -66,8 +71,8 @@ func (r Req) String() string {
 }
 
 func (r Req) DebugString() string {
-	return fmt.Sprintf("Req key=%q target=%q pattern=%q %d - %d (%s - %s) (span %d) maxPoints=%d rawInt=%d cons=%s consReq=%d schemaId=%d aggId=%d archive=%d archInt=%d ttl=%d outInt=%d aggNum=%d",
-		r.MKey, r.Target, r.Pattern, r.From, r.To, util.TS(r.From), util.TS(r.To), r.To-r.From-1, r.MaxPoints, r.RawInterval, r.Consolidator, r.ConsReq, r.SchemaId, r.AggId, r.Archive, r.ArchInterval, r.TTL, r.OutInterval, r.AggNum)
+	return fmt.Sprintf("Req key=%q target=%q pattern=%q %d - %d (%s - %s) (span %d) maxPoints=%d rawInt=%d cons=%s consReq=%d schemaId=%d aggId=%d xFilesFactor=%g archive=%d archInt=%d ttl=%d outInt=%d aggNum=%d",
+		r.MKey, r.Target, r.Pattern, r.From, r.To, util.TS(r.From), util.TS(r.To), r.To-r.From-1, r.MaxPoints, r.RawInterval, r.Consolidator, r.ConsReq, r.SchemaId, r.AggId, r.XFilesFactor, r.Archive, r.ArchInterval, r.TTL, r.OutInterval, r.AggNum)
 }
 
 // Trace puts all request properties as tags in a span
@@ -85,6 +90,7 @@ func (r Req) Trace(span opentracing.Span) {
 	span.SetTag("consReq", r.ConsReq)
 	span.SetTag("schemaId", r.SchemaId)
 	span.SetTag("aggId", r.AggId)
+	span.SetTag("xFilesFactor", r.XFilesFactor)
 	span.SetTag("archive", r.Archive)
 	span.SetTag("archInterval", r.ArchInterval)
 	span.SetTag("TTL", r.TTL)
@@ -110,6 +116,7 @@ func (r Req) TraceLog(span opentracing.Span) {
 		log.String("consReq", r.ConsReq.String()),
 		log.Int("schemaId", int(r.SchemaId)),
 		log.Int("aggId", int(r.AggId)),
+		log.Float64("xFilesFactor", r.XFilesFactor),
 		log.Int("archive", r.Archive),
 		log.Int("archInterval", int(r.ArchInterval)),
 		log.Int("TTL", int(r.TTL)),
@@ -163,6 +170,9 @@ func (a Req) Equals(b Req) bool {
 	if a.AggId != b.AggId {
 		return false
 	}
+	if a.XFilesFactor != b.XFilesFactor {
+		return false
+	}
 	if a.Archive != b.Archive {
 		return false
 	}
@@ -177,3 +187,40 @@ func (a Req) Equals(b Req) bool {
 	}
 	return true
 }
+
+// ArchiveReq is a request to read a specific archive, rather than the one AlignRequests would pick.
+// the zero value means no preference.
+type ArchiveReq struct {
+	Raw      bool   // read the raw data
+	Interval uint32 // read the rollup archive with this interval
+}
+
+// ParseArchiveReq parses "raw", the interval of a rollup archive such as "1h", or "" or "auto" for no preference
+func ParseArchiveReq(s string) (ArchiveReq, error) {
+	switch s {
+	case "", "auto":
+		return ArchiveReq{}, nil
+	case "raw":
+		return ArchiveReq{Raw: true}, nil
+	}
+	interval, err := dur.ParseNDuration(s)
+	if err != nil {
+		return ArchiveReq{}, fmt.Errorf("invalid archive %q. expected raw, auto or the interval of a rollup archive: %s", s, err)
+	}
+	return ArchiveReq{Interval: interval}, nil
+}
+
+// Auto returns whether the archive should be picked automatically
+func (a ArchiveReq) Auto() bool {
+	return !a.Raw && a.Interval == 0
+}
+
+func (a ArchiveReq) String() string {
+	switch {
+	case a.Raw:
+		return "raw"
+	case a.Interval != 0:
+		return fmt.Sprintf("%ds rollup", a.Interval)
+	}
+	return "auto"
+}
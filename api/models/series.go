@@ -8,10 +8,12 @@ import (
 
 	"github.com/grafana/metrictank/consolidation"
 	pickle "github.com/kisielk/og-rek"
+	"github.com/tinylib/msgp/msgp"
 	"gopkg.in/raintank/schema.v1"
 )
 
 //go:generate msgp
+//msgp:ignore SeriesStream
 
 type Series struct {
 	Target       string // for fetched data, set from models.Req.Target, i.e. the metric graphite key. for function output, whatever should be shown as target string (legend)
@@ -50,42 +52,47 @@ func (g SeriesByTarget) Less(i, j int) bool { return g[i].Target < g[j].Target }
 // regular graphite output
 func (series SeriesByTarget) MarshalJSONFast(b []byte) ([]byte, error) {
 	b = append(b, '[')
-	for _, s := range series {
-		b = append(b, `{"target":`...)
-		b = strconv.AppendQuoteToASCII(b, s.Target)
-		if len(s.Tags) != 0 {
-			b = append(b, `,"tags":{`...)
-			for name, value := range s.Tags {
-				b = strconv.AppendQuoteToASCII(b, name)
-				b = append(b, ':')
-				b = strconv.AppendQuoteToASCII(b, value)
-				b = append(b, ',')
-			}
-			// Replace trailing comma with a closing bracket
-			b[len(b)-1] = '}'
+	for i, s := range series {
+		if i > 0 {
+			b = append(b, ',')
 		}
-		b = append(b, `,"datapoints":[`...)
-		for _, p := range s.Datapoints {
-			b = append(b, '[')
-			if math.IsNaN(p.Val) {
-				b = append(b, `null,`...)
-			} else {
-				b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
-				b = append(b, ',')
-			}
-			b = strconv.AppendUint(b, uint64(p.Ts), 10)
-			b = append(b, `],`...)
+		b = appendSeriesJSON(b, s)
+	}
+	b = append(b, ']')
+	return b, nil
+}
+
+func appendSeriesJSON(b []byte, s Series) []byte {
+	b = append(b, `{"target":`...)
+	b = strconv.AppendQuoteToASCII(b, s.Target)
+	if len(s.Tags) != 0 {
+		b = append(b, `,"tags":{`...)
+		for name, value := range s.Tags {
+			b = strconv.AppendQuoteToASCII(b, name)
+			b = append(b, ':')
+			b = strconv.AppendQuoteToASCII(b, value)
+			b = append(b, ',')
 		}
-		if len(s.Datapoints) != 0 {
-			b = b[:len(b)-1] // cut last comma
+		// Replace trailing comma with a closing bracket
+		b[len(b)-1] = '}'
+	}
+	b = append(b, `,"datapoints":[`...)
+	for _, p := range s.Datapoints {
+		b = append(b, '[')
+		if math.IsNaN(p.Val) {
+			b = append(b, `null,`...)
+		} else {
+			b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
+			b = append(b, ',')
 		}
-		b = append(b, `]},`...)
+		b = strconv.AppendUint(b, uint64(p.Ts), 10)
+		b = append(b, `],`...)
 	}
-	if len(series) != 0 {
+	if len(s.Datapoints) != 0 {
 		b = b[:len(b)-1] // cut last comma
 	}
-	b = append(b, ']')
-	return b, nil
+	b = append(b, `]}`...)
+	return b
 }
 
 func (series SeriesByTarget) MarshalJSON() ([]byte, error) {
@@ -99,31 +106,83 @@ func (series SeriesByTarget) ForGraphite(format string) SeriesListForPickle {
 	}
 	data := make(SeriesListForPickle, len(series))
 	for i, s := range series {
-		datapoints := make([]interface{}, len(s.Datapoints))
-		for j, p := range s.Datapoints {
-			if math.IsNaN(p.Val) {
-				datapoints[j] = none
-			} else {
-				datapoints[j] = p.Val
-			}
-		}
-		data[i] = SeriesForPickle{
-			Name:           s.Target,
-			Step:           s.Interval,
-			Values:         datapoints,
-			PathExpression: s.QueryPatt,
-		}
-		if len(datapoints) > 0 {
-			data[i].Start = s.Datapoints[0].Ts
-			data[i].End = s.Datapoints[len(s.Datapoints)-1].Ts + s.Interval
+		data[i] = s.forGraphite(none)
+	}
+	return data
+}
+
+func (s Series) forGraphite(none interface{}) SeriesForPickle {
+	datapoints := make([]interface{}, len(s.Datapoints))
+	for j, p := range s.Datapoints {
+		if math.IsNaN(p.Val) {
+			datapoints[j] = none
 		} else {
-			data[i].Start = s.QueryFrom
-			data[i].End = s.QueryTo
+			datapoints[j] = p.Val
 		}
 	}
+	data := SeriesForPickle{
+		Name:           s.Target,
+		Step:           s.Interval,
+		Values:         datapoints,
+		PathExpression: s.QueryPatt,
+	}
+	if len(datapoints) > 0 {
+		data.Start = s.Datapoints[0].Ts
+		data.End = s.Datapoints[len(s.Datapoints)-1].Ts + s.Interval
+	} else {
+		data.Start = s.QueryFrom
+		data.End = s.QueryTo
+	}
 	return data
 }
 
+// SeriesStream encodes series one at a time, for streaming responses.
+// it supports the json, msgp and msgpack formats and produces the same output as
+// MarshalJSONFast, MarshalMsg and ForGraphite("msgpack").MarshalMsg respectively.
+type SeriesStream struct {
+	series SeriesByTarget
+	format string
+}
+
+func (series SeriesByTarget) Stream(format string) SeriesStream {
+	return SeriesStream{
+		series: series,
+		format: format,
+	}
+}
+
+func (s SeriesStream) Len() int {
+	return len(s.series)
+}
+
+func (s SeriesStream) AppendHeader(b []byte) []byte {
+	if s.format == "msgp" || s.format == "msgpack" {
+		return msgp.AppendArrayHeader(b, uint32(len(s.series)))
+	}
+	return append(b, '[')
+}
+
+func (s SeriesStream) AppendElement(b []byte, i int) ([]byte, error) {
+	switch s.format {
+	case "msgp":
+		return s.series[i].MarshalMsg(b)
+	case "msgpack":
+		data := s.series[i].forGraphite(nil)
+		return data.MarshalMsg(b)
+	}
+	if i > 0 {
+		b = append(b, ',')
+	}
+	return appendSeriesJSON(b, s.series[i]), nil
+}
+
+func (s SeriesStream) AppendFooter(b []byte) []byte {
+	if s.format == "msgp" || s.format == "msgpack" {
+		return b
+	}
+	return append(b, ']')
+}
+
 func (series SeriesByTarget) Pickle(buf []byte) ([]byte, error) {
 	buffer := bytes.NewBuffer(buf)
 	encoder := pickle.NewEncoder(buffer)
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// defaultMaxDataPoints is the maxDataPoints of render requests that don't specify it, unless their org policy sets one
+const defaultMaxDataPoints = 800
+
+// orgPolicy returns the policy of the org, the zero policy if it has none
+func (s *Server) orgPolicy(orgId uint32) idx.OrgPolicy {
+	if s.MetricIndex == nil {
+		return idx.OrgPolicy{}
+	}
+	p, _ := s.MetricIndex.OrgPolicy(orgId)
+	return p
+}
+
+// applyOrgPolicy applies the limits of the policy to the time range of a render request:
+// from is moved forward to the start of the retention of its retention class, after which the range
+// may not be longer than the max query range. returns the new from.
+func applyOrgPolicy(p idx.OrgPolicy, now, from, to uint32) (uint32, error) {
+	if p.RetentionClass != "" {
+		// a retention class that is not a storage schema (anymore) is ignored
+		if ttl, ok := mdata.SchemaTTL(p.RetentionClass); ok && ttl < now && from < now-ttl {
+			from = now - ttl
+			if from >= to {
+				return from, response.NewError(http.StatusBadRequest, fmt.Sprintf("the time range is older than the retention of your retention class %q", p.RetentionClass))
+			}
+		}
+	}
+	if max := p.QueryRange(); max > 0 && to-from > max {
+		return from, response.NewError(http.StatusBadRequest, fmt.Sprintf("the time range is longer than %s, the max query range of your org", p.MaxQueryRange))
+	}
+	return from, nil
+}
+
+func (s *Server) orgPolicies(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, s.MetricIndex.OrgPolicies(), ""))
+}
+
+// orgPolicyUpsert sets or removes the policy of an org, and saves it to the index.
+// nodes only load the policies from the index on startup, so the request should be propagated for the
+// peers to apply it right away.
+func (s *Server) orgPolicyUpsert(ctx *middleware.Context, req models.OrgPolicyUpsert) {
+	p := idx.OrgPolicy{
+		OrgId:          req.OrgId,
+		ConsolidateBy:  req.ConsolidateBy,
+		MaxQueryRange:  req.MaxQueryRange,
+		MaxDataPoints:  req.MaxDataPoints,
+		RetentionClass: req.RetentionClass,
+	}
+	created, err := s.MetricIndex.UpsertOrgPolicy(p)
+	auditRecord(ctx, ctx.OrgId, "org.policy", fmt.Sprintf("org=%d consolidateBy=%q maxQueryRange=%q maxDataPoints=%d retentionClass=%q", p.OrgId, p.ConsolidateBy, p.MaxQueryRange, p.MaxDataPoints, p.RetentionClass), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	res := models.OrgPolicyUpsertResp{
+		Created: created,
+	}
+	if !req.Propagate {
+		response.Write(ctx, response.NewJson(200, res, ""))
+		return
+	}
+
+	// we never want to propagate more than once to avoid loops
+	req.Propagate = false
+	responses, err := s.peerQuery(ctx.Req.Context(), req, "orgPolicyUpsert", "/org-policies", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	res.Peers = make(map[string]models.OrgPolicyUpsertResp, len(responses))
+	for peer, resp := range responses {
+		var peerResp models.OrgPolicyUpsertResp
+		if err := json.Unmarshal(resp.buf, &peerResp); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		res.Peers[peer] = peerResp
+	}
+	response.Write(ctx, response.NewJson(200, res, ""))
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+func TestApplyOrgPolicy(t *testing.T) {
+	// the default schema keeps data for a day
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 2, true))
+	now := uint32(10 * 86400)
+	cases := []struct {
+		policy   idx.OrgPolicy
+		from     uint32
+		expFrom  uint32
+		expError bool
+	}{
+		{idx.OrgPolicy{}, 0, 0, false},
+		{idx.OrgPolicy{MaxQueryRange: "1h"}, now - 3600, now - 3600, false},
+		{idx.OrgPolicy{MaxQueryRange: "1h"}, now - 3601, now - 3601, true},
+		{idx.OrgPolicy{RetentionClass: "default"}, now - 2*86400, now - 86400, false},
+		{idx.OrgPolicy{RetentionClass: "default"}, now - 3600, now - 3600, false},
+		{idx.OrgPolicy{RetentionClass: "unknown"}, 0, 0, false},
+		// the range is limited after moving from forward
+		{idx.OrgPolicy{RetentionClass: "default", MaxQueryRange: "1d"}, 0, now - 86400, false},
+		{idx.OrgPolicy{RetentionClass: "default", MaxQueryRange: "1h"}, 0, now - 86400, true},
+	}
+	for i, c := range cases {
+		from, err := applyOrgPolicy(c.policy, now, c.from, now)
+		if (err != nil) != c.expError {
+			t.Errorf("case %d: expected error %t, got %v", i, c.expError, err)
+		}
+		if !c.expError && from != c.expFrom {
+			t.Errorf("case %d: expected from %d, got %d", i, c.expFrom, from)
+		}
+	}
+	if _, err := applyOrgPolicy(idx.OrgPolicy{RetentionClass: "default"}, now, 0, now-2*86400); err == nil {
+		t.Errorf("expected an error for a time range before the retention")
+	}
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata/pin"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// pinAdd pins the series matching the patterns and tag expressions of the request, so that they
+// stay in memory for the requested duration. each node pins the series it has in its index,
+// so the request should be propagated to all nodes to pin the series of all partitions.
+func (s *Server) pinAdd(ctx *middleware.Context, req models.PinAdd) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	if pinMaxSeries == 0 {
+		response.Write(ctx, response.NewError(http.StatusForbidden, "pinning is disabled"))
+		return
+	}
+	if len(req.Patterns) == 0 && len(req.Expr) == 0 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "at least one pattern or tag expression must be specified"))
+		return
+	}
+	duration, err := dur.ParseNDuration(req.Duration)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid duration: %s", err)))
+		return
+	}
+	if time.Duration(duration)*time.Second > pinMaxDuration {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("duration must not exceed pin-max-duration %s", pinMaxDuration)))
+		return
+	}
+	if req.Id == "" {
+		// the id must be the same on all nodes, so we set it before propagating
+		req.Id = strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+
+	res := models.PinResp{}
+	code := 200
+
+	if req.Propagate {
+		res.Peers = s.pinPropagate(ctx.Req.Context(), "/pins", &req, &req.Propagate)
+		for _, peer := range res.Peers {
+			if peer.Errors > 0 {
+				code = 500
+			}
+		}
+	}
+
+	keys, err := s.seriesKeys(req.OrgId, req.Patterns, req.Expr)
+	if err == nil && len(keys) > pinMaxSeries {
+		err = fmt.Errorf("the pin selects %d series, more than pin-max-series %d", len(keys), pinMaxSeries)
+		code = http.StatusBadRequest
+	}
+	if err != nil {
+		res.Errors++
+		res.FirstError = err.Error()
+		if code == 200 {
+			code = 500
+		}
+	} else {
+		now := time.Now()
+		p := s.Pins.Add(pin.Pin{
+			Id:       req.Id,
+			OrgId:    req.OrgId,
+			Patterns: req.Patterns,
+			Expr:     req.Expr,
+			Created:  now.Unix(),
+			Expires:  now.Unix() + int64(duration),
+		}, keys)
+		res.Pin = &p
+	}
+	auditRecord(ctx, req.OrgId, "pin.add", req.Id+" "+strings.Join(append(req.Patterns, req.Expr...), ","), len(keys), err)
+	response.Write(ctx, response.NewJson(code, res, ""))
+}
+
+// seriesKeys returns the keys of the series matching any of the patterns, or all of the tag expressions
+func (s *Server) seriesKeys(org uint32, patterns, expr []string) ([]schema.MKey, error) {
+	seen := make(map[schema.MKey]struct{})
+	var keys []schema.MKey
+	add := func(nodes []idx.Node) {
+		for _, node := range nodes {
+			for _, def := range node.Defs {
+				if _, ok := seen[def.Id]; !ok {
+					seen[def.Id] = struct{}{}
+					keys = append(keys, def.Id)
+				}
+			}
+		}
+	}
+	for _, pattern := range patterns {
+		nodes, err := s.MetricIndex.Find(org, pattern, 0)
+		if err != nil {
+			return nil, err
+		}
+		add(nodes)
+	}
+	if len(expr) > 0 {
+		nodes, err := s.MetricIndex.FindByTag(org, expr, 0)
+		if err != nil {
+			return nil, err
+		}
+		add(nodes)
+	}
+	return keys, nil
+}
+
+func (s *Server) pinDelete(ctx *middleware.Context, req models.PinDelete) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	res := models.PinResp{}
+	code := 200
+
+	if req.Propagate {
+		res.Peers = s.pinPropagate(ctx.Req.Context(), "/pins/delete", &req, &req.Propagate)
+		for _, peer := range res.Peers {
+			if peer.Errors > 0 {
+				code = 500
+			}
+		}
+	}
+
+	// pins can only be deleted by their own org
+	if p, ok := s.Pins.Get(req.Id); ok && p.OrgId == req.OrgId {
+		res.Deleted = s.Pins.Del(req.Id)
+	}
+	auditRecord(ctx, req.OrgId, "pin.delete", req.Id, 0, nil)
+	response.Write(ctx, response.NewJson(code, res, ""))
+}
+
+// pinList lists the pins of the org on this node
+func (s *Server) pinList(ctx *middleware.Context, req models.PinList) {
+	if !orgAllowed(ctx, req.OrgId) {
+		return
+	}
+	pins := make([]pin.Pin, 0)
+	for _, p := range s.Pins.List() {
+		if p.OrgId == req.OrgId {
+			pins = append(pins, p)
+		}
+	}
+	response.Write(ctx, response.NewJson(200, pins, ""))
+}
+
+// pinPropagate sends the request to all peers, after disabling its propagation to avoid loops
+func (s *Server) pinPropagate(ctx context.Context, path string, req cluster.Traceable, propagate *bool) map[string]models.PinResp {
+	*propagate = false
+
+	peers := cluster.Manager.MemberList()
+	peerResults := make(map[string]models.PinResp)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		if peer.IsLocal() {
+			continue
+		}
+		wg.Add(1)
+		go func(peer cluster.Node) {
+			defer wg.Done()
+			res := pinRemote(ctx, path, req, peer)
+			mu.Lock()
+			peerResults[peer.GetName()] = res
+			mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	return peerResults
+}
+
+func pinRemote(ctx context.Context, path string, req cluster.Traceable, peer cluster.Node) models.PinResp {
+	var res models.PinResp
+
+	if LogLevel.Get() < 2 {
+		log.Debug("HTTP pin calling %s%s", peer.GetName(), path)
+	}
+	buf, err := peer.Post(ctx, "pinRemote", path, req)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 4, "HTTP pin error querying %s%s: %q", peer.GetName(), path, err)
+		res.FirstError = err.Error()
+		res.Errors++
+		return res
+	}
+
+	err = json.Unmarshal(buf, &res)
+	if err != nil {
+		logger.Error(logger.FromContext(ctx), 4, "HTTP pin error unmarshaling body from %s%s: %q", peer.GetName(), path, err)
+		res.FirstError = err.Error()
+		res.Errors++
+	}
+	return res
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata/pin"
+	"github.com/grafana/metrictank/test"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestPins(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	_pinMaxDuration, _pinMaxSeries := pinMaxDuration, pinMaxSeries
+	defer func() { pinMaxDuration, pinMaxSeries = _pinMaxDuration, _pinMaxSeries }()
+	pinMaxDuration = 24 * time.Hour
+	pinMaxSeries = 1
+
+	srv, _ := newSrv(0, 0)
+	srv.BindPins(pin.New())
+	testIds := []schema.MKey{test.GetMKey(1), test.GetMKey(2)}
+	for i, name := range []string{"slo.a", "slo.b"} {
+		srv.MetricIndex.AddOrUpdate(testIds[i], &schema.MetricData{Id: testIds[i].String(), OrgId: 1, Name: name, Interval: 10}, 0)
+	}
+
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	post := func(path string, req interface{}) (int, models.PinResp) {
+		body, _ := json.Marshal(req)
+		res, err := http.Post(ts.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("There was an error in the request: %s", err)
+		}
+		defer res.Body.Close()
+		var resp models.PinResp
+		json.NewDecoder(res.Body).Decode(&resp)
+		return res.StatusCode, resp
+	}
+
+	for _, tc := range []struct {
+		req  models.PinAdd
+		code int
+	}{
+		{models.PinAdd{Patterns: []string{"slo.*"}, Duration: "1h", OrgId: 1}, http.StatusBadRequest},
+		{models.PinAdd{Patterns: []string{"slo.a"}, Duration: "2d", OrgId: 1}, http.StatusBadRequest},
+		{models.PinAdd{Duration: "1h", OrgId: 1}, http.StatusBadRequest},
+	} {
+		if code, resp := post("/pins", tc.req); code != tc.code {
+			t.Errorf("expected status %d for %+v, got %d: %+v", tc.code, tc.req, code, resp)
+		}
+	}
+
+	code, resp := post("/pins", models.PinAdd{Id: "incident", Patterns: []string{"slo.a"}, Duration: "1h", OrgId: 1})
+	if code != 200 || resp.Pin == nil || resp.Pin.Series != 1 {
+		t.Fatalf("expected the pin to be added, got %d: %+v", code, resp)
+	}
+	if !srv.Pins.Pinned(testIds[0]) || srv.Pins.Pinned(testIds[1]) {
+		t.Fatalf("expected only %s to be pinned", testIds[0])
+	}
+
+	// another org can't delete the pin
+	if _, resp := post("/pins/delete", models.PinDelete{Id: "incident", OrgId: 2}); resp.Deleted {
+		t.Fatalf("expected the pin to not be deleted by another org")
+	}
+	if _, resp := post("/pins/delete", models.PinDelete{Id: "incident", OrgId: 1}); !resp.Deleted {
+		t.Fatalf("expected the pin to be deleted")
+	}
+	if srv.Pins.Pinned(testIds[0]) {
+		t.Fatalf("expected %s to no longer be pinned", testIds[0])
+	}
+}
@@ -0,0 +1,139 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/idx"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+const (
+	maxPreviewPoints = 1000
+	maxPreviewLimit  = 1000
+)
+
+// metricsPreview returns the series that match a pattern or tag expressions, each with its recent data
+// consolidated to a few points, so that metric browsers can show a sparkline for every series with a single request.
+// the series are fetched like for a render request, but all at once, without an expression to run.
+func (s *Server) metricsPreview(ctx *middleware.Context, request models.MetricsPreview) {
+	if (len(request.Query) == 0) == (len(request.Expr) == 0) {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "exactly one of query or expr must be set"))
+		return
+	}
+	window, err := dur.ParseNDuration(request.Window)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "invalid window: "+err.Error()))
+		return
+	}
+	if request.Points == 0 || request.Points > maxPreviewPoints {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "points must be between 1 and 1000"))
+		return
+	}
+	if request.Limit <= 0 || request.Limit > maxPreviewLimit {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "limit must be between 1 and 1000"))
+		return
+	}
+
+	reqCtx := ctx.Req.Context()
+	var series []Series
+	query := request.Query
+	if len(request.Query) > 0 {
+		series, err = s.findSeries(reqCtx, ctx.OrgId, []string{request.Query}, 0)
+	} else {
+		query = "seriesByTag('" + strings.Join(request.Expr, "','") + "')"
+		series, err = s.clusterFindByTag(reqCtx, ctx.OrgId, request.Expr, 0)
+	}
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if err := reqCtx.Err(); err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	// like for render requests, from is exclusive and to inclusive, so we must adjust
+	now := uint32(time.Now().Unix())
+	from := now - window + 1
+	to := now + 1
+
+	archives, truncated := previewArchives(series, request.Limit)
+	resp := models.MetricsPreviewResp{
+		Series:    make(models.SeriesByTarget, 0),
+		Truncated: truncated,
+	}
+	if len(archives) == 0 {
+		response.Write(ctx, response.NewJson(200, resp, ""))
+		return
+	}
+	reqs := make([]models.Req, 0, len(archives))
+	for _, a := range archives {
+		reqs = append(reqs, newArchiveReq(a.Archive, a.node, query, from, to, request.Points, 0, -1))
+	}
+	reqs, _, _, err = alignRequests(now, from, to, reqs, models.ArchiveReq{})
+	if err != nil {
+		log.Error(3, "HTTP metricsPreview alignReq error: %s", err)
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	out, err := s.getTargets(reqCtx, reqs)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	if err := reqCtx.Err(); err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	for _, serie := range mergeSeries(out) {
+		serie.Datapoints, serie.Interval = consolidation.ConsolidateStable(serie.Datapoints, serie.Interval, request.Points, serie.Consolidator, 0)
+		resp.Series = append(resp.Series, serie)
+	}
+	sort.Sort(resp.Series)
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
+
+type previewArchive struct {
+	idx.Archive
+	node cluster.Node
+}
+
+// previewArchives returns the archives of the first limit series of the find results, by path,
+// and whether there were more series than that
+func previewArchives(series []Series, limit int) ([]previewArchive, bool) {
+	byPath := make(map[string][]previewArchive)
+	for _, s := range series {
+		for _, n := range s.Series {
+			if !n.Leaf {
+				continue
+			}
+			for _, def := range n.Defs {
+				byPath[n.Path] = append(byPath[n.Path], previewArchive{def, s.Node})
+			}
+		}
+	}
+	paths := make([]string, 0, len(byPath))
+	for path := range byPath {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	truncated := len(paths) > limit
+	if truncated {
+		paths = paths[:limit]
+	}
+	var archives []previewArchive
+	for _, path := range paths {
+		archives = append(archives, byPath[path]...)
+	}
+	return archives, truncated
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/idx"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestPreviewArchives(t *testing.T) {
+	def := func(name string, interval int) idx.Archive {
+		a := idx.NewArchiveBare(name)
+		a.Id = schema.MKey{Org: 1, Key: schema.Key{byte(len(name)), byte(interval)}}
+		a.Interval = interval
+		return a
+	}
+	series := []Series{
+		{Series: []idx.Node{
+			{Path: "c", Leaf: true, Defs: []idx.Archive{def("c", 10)}},
+			{Path: "a", Leaf: true, Defs: []idx.Archive{def("a", 10), def("a", 60)}},
+			{Path: "branch", Leaf: false},
+		}},
+		// b is also on another node
+		{Series: []idx.Node{
+			{Path: "bb", Leaf: true, Defs: []idx.Archive{def("bb", 10)}},
+		}},
+	}
+
+	archives, truncated := previewArchives(series, 10)
+	if truncated || len(archives) != 4 {
+		t.Fatalf("expected all 4 archives, got %d, truncated %t", len(archives), truncated)
+	}
+
+	archives, truncated = previewArchives(series, 2)
+	if !truncated || len(archives) != 3 {
+		t.Fatalf("expected the 3 archives of the first 2 series, got %d, truncated %t", len(archives), truncated)
+	}
+	for i, exp := range []string{"a", "a", "bb"} {
+		if archives[i].Name != exp {
+			t.Fatalf("archive %d: expected %s, got %s", i, exp, archives[i].Name)
+		}
+	}
+}
@@ -2,20 +2,23 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math"
 	"time"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/util"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
-	"github.com/raintank/worldping-api/pkg/log"
 )
 
+var errNoSeriesFound = errors.New("no series found")
+
 // Querier creates a new querier that will operate on the subject server
 // it needs the org-id stored in a context value
 func (s *Server) Querier(ctx context.Context, min, max int64) (storage.Querier, error) {
@@ -79,7 +82,7 @@ func (q *querier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error)
 		for _, metric := range s.Series {
 			for _, archive := range metric.Defs {
 				consReq := consolidation.None
-				fn := mdata.Aggregations.Get(archive.AggId).AggregationMethod[0]
+				fn := mdata.GetAgg(archive.AggId).AggregationMethod[0]
 				cons := consolidation.Consolidator(fn)
 
 				newReq := models.NewReq(archive.Id, archive.NameWithTags(), target, q.from, q.to, math.MaxUint32, uint32(archive.Interval), cons, consReq, s.Node, archive.SchemaId, archive.AggId)
@@ -97,19 +100,19 @@ func (q *querier) Select(matchers ...*labels.Matcher) (storage.SeriesSet, error)
 
 	reqRenderSeriesCount.Value(len(reqs))
 	if len(reqs) == 0 {
-		return nil, fmt.Errorf("no series found")
+		return nil, errNoSeriesFound
 	}
 
 	// note: if 1 series has a movingAvg that requires a long time range extension, it may push other reqs into another archive. can be optimized later
-	reqs, _, _, err = alignRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs)
+	reqs, _, _, err = alignRequests(uint32(time.Now().Unix()), minFrom, maxTo, reqs, models.ArchiveReq{})
 	if err != nil {
-		log.Error(3, "HTTP Render alignReq error: %s", err)
+		logger.Error(logger.FromContext(q.ctx), 3, "HTTP Render alignReq error: %s", err)
 		return nil, err
 	}
 
 	out, err := q.getTargets(q.ctx, reqs)
 	if err != nil {
-		log.Error(3, "HTTP Render %s", err.Error())
+		logger.Error(logger.FromContext(q.ctx), 3, "HTTP Render %s", err.Error())
 		return nil, err
 	}
 
@@ -123,7 +126,7 @@ func (q *querier) LabelValues(name string) ([]string, error) {
 		name = "name"
 		expressions = append(expressions, "name=~[a-zA-Z_:][a-zA-Z0-9_:]*$")
 	}
-	return q.MetricIndex.FindTagValues(q.OrgID, name, "", expressions, 0, 100000)
+	return q.MetricIndex.FindTagValues(q.OrgID, name, "", expressions, 0, "", 100000)
 }
 
 // Close releases the resources of the Querier.
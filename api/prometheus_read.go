@@ -0,0 +1,128 @@
+package api
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/stats"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	// metric api.request.prometheus_read.series is the number of series returned by prometheus remote_read requests
+	promReadSeries = stats.NewMeter32("api.request.prometheus_read.series", false)
+)
+
+// prometheusRemoteRead implements the prometheus remote_read protocol: it takes a snappy compressed
+// protobuf ReadRequest and returns a snappy compressed protobuf ReadResponse, with a QueryResult per query.
+// the matchers of each query are resolved through the tag index and the samples are read like for any other query.
+func (s *Server) prometheusRemoteRead(ctx *middleware.Context) {
+	compressed, err := ioutil.ReadAll(ctx.Body)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("failed to read request: %s", err)))
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("failed to decode request: %s", err)))
+		return
+	}
+	var req prompb.ReadRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("failed to unmarshal request: %s", err)))
+		return
+	}
+
+	resp := prompb.ReadResponse{
+		Results: make([]*prompb.QueryResult, len(req.Queries)),
+	}
+	for i, query := range req.Queries {
+		result, err := s.prometheusReadQuery(ctx, query)
+		if err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		resp.Results[i] = result
+	}
+	response.Write(ctx, response.NewSnappyProtobuf(http.StatusOK, &resp))
+}
+
+func (s *Server) prometheusReadQuery(ctx *middleware.Context, query *prompb.Query) (*prompb.QueryResult, error) {
+	matchers, err := fromPrompbMatchers(query.Matchers)
+	if err != nil {
+		return nil, response.NewError(http.StatusBadRequest, err.Error())
+	}
+	if query.StartTimestampMs > query.EndTimestampMs {
+		return nil, response.NewError(http.StatusBadRequest, InvalidTimeRangeErr.Error())
+	}
+
+	// prometheus uses inclusive millisecond timestamps, our to is exclusive
+	from := uint32(query.StartTimestampMs / 1000)
+	to := uint32(query.EndTimestampMs/1000) + 1
+	q := NewQuerier(ctx.Req.Context(), s, from, to, ctx.OrgId, false)
+	defer q.Close()
+
+	result := &prompb.QueryResult{}
+	set, err := q.Select(matchers...)
+	if err == errNoSeriesFound {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for set.Next() {
+		series := set.At()
+		ts := &prompb.TimeSeries{}
+		for _, l := range series.Labels() {
+			ts.Labels = append(ts.Labels, &prompb.Label{Name: l.Name, Value: l.Value})
+		}
+		it := series.Iterator()
+		for it.Next() {
+			t, v := it.At()
+			if t < query.StartTimestampMs || t > query.EndTimestampMs {
+				continue
+			}
+			ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: t, Value: v})
+		}
+		if err := it.Err(); err != nil {
+			return nil, err
+		}
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+	if err := set.Err(); err != nil {
+		return nil, err
+	}
+	promReadSeries.Value(len(result.Timeseries))
+	return result, nil
+}
+
+func fromPrompbMatchers(in []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	out := make([]*labels.Matcher, 0, len(in))
+	for _, m := range in {
+		var t labels.MatchType
+		switch m.Type {
+		case prompb.LabelMatcher_EQ:
+			t = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			t = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			t = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			t = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type %d", m.Type)
+		}
+		matcher, err := labels.NewMatcher(t, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, matcher)
+	}
+	return out, nil
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+func TestFromPrompbMatchers(t *testing.T) {
+	in := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "a"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "b.*"},
+		{Type: prompb.LabelMatcher_NRE, Name: "dc", Value: "c|d"},
+	}
+	exp := []string{`__name__="up"`, `job!="a"`, `instance=~"b.*"`, `dc!~"c|d"`}
+	out, err := fromPrompbMatchers(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range out {
+		if m.String() != exp[i] {
+			t.Fatalf("matcher %d: expected %s, got %s", i, exp[i], m.String())
+		}
+	}
+
+	if _, err := fromPrompbMatchers([]*prompb.LabelMatcher{{Type: 10, Name: "a", Value: "b"}}); err == nil {
+		t.Fatalf("expected error for invalid matcher type")
+	}
+	if _, err := fromPrompbMatchers([]*prompb.LabelMatcher{{Type: prompb.LabelMatcher_RE, Name: "a", Value: "("}}); err == nil {
+		t.Fatalf("expected error for invalid regex")
+	}
+}
+
+func TestSnappyProtobufResponse(t *testing.T) {
+	resp := prompb.ReadResponse{
+		Results: []*prompb.QueryResult{
+			{
+				Timeseries: []*prompb.TimeSeries{
+					{
+						Labels:  []*prompb.Label{{Name: "__name__", Value: "up"}},
+						Samples: []*prompb.Sample{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+					},
+				},
+			},
+		},
+	}
+	w := httptest.NewRecorder()
+	response.Write(w, response.NewSnappyProtobuf(200, &resp))
+	if w.Header().Get("content-encoding") != "snappy" || w.Header().Get("content-type") != "application/x-protobuf" {
+		t.Fatalf("unexpected headers %v", w.Header())
+	}
+	buf, err := snappy.Decode(nil, w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got prompb.ReadResponse
+	if err := got.Unmarshal(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != resp.String() {
+		t.Fatalf("expected %s, got %s", resp.String(), got.String())
+	}
+}
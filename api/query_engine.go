@@ -1,10 +1,13 @@
 package api
 
 import (
+	"fmt"
 	"math"
+	"net/http"
 
 	"github.com/grafana/metrictank/api/models"
 	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/util"
@@ -24,10 +27,23 @@ var (
 )
 
 // alignRequests updates the requests with all details for fetching, making sure all metrics are in the same, optimal interval
-// note: it is assumed that all requests have the same from & to.
+// note: requests may have different from & to (e.g. when timeShift asks for older data), but they are assumed to span
+// about the same amount of time: archives are selected to retain the oldest requested data, and to not exceed
+// the max-points-per-req settings for the widest request. from must be the earliest from of all requests.
 // also takes a "now" value which we compare the TTL against
-func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint32, uint32, error) {
-	tsRange := to - from
+func alignRequests(now, from, to uint32, reqs []models.Req, archReq models.ArchiveReq) ([]models.Req, uint32, uint32, error) {
+	return AlignRequests(now, from, to, reqs, archReq, maxPointsPerReqSoft, maxPointsPerReqHard)
+}
+
+// AlignRequests is like alignRequests, but with explicit max-points-per-req-soft and -hard settings,
+// rather than the ones from the api config. This is useful for tools that want to explain requests offline.
+// unless archReq is auto, all requests read the requested archive, regardless of their ttl or max-points-per-req-soft,
+// and any normalization happens via runtime consolidation.
+func AlignRequests(now, from, to uint32, reqs []models.Req, archReq models.ArchiveReq, maxPointsPerReqSoft, maxPointsPerReqHard int) ([]models.Req, uint32, uint32, error) {
+	var tsRange uint32
+	for _, req := range reqs {
+		tsRange = util.Max(tsRange, req.To-req.From)
+	}
 
 	var listIntervals []uint32
 	var seenIntervals = make(map[uint32]struct{})
@@ -39,7 +55,7 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 		targets[req.Target] = struct{}{}
 	}
 	numTargets := uint32(len(targets))
-	minTTL := now - reqs[0].From
+	minTTL := now - from
 
 	minIntervalSoft := uint32(0)
 	minIntervalHard := uint32(0)
@@ -59,27 +75,33 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 	// fallback to lowest res option (which *should* have the longest TTL)
 	for i := range reqs {
 		req := &reqs[i]
-		retentions := mdata.Schemas.Get(req.SchemaId).Retentions
-		for i, ret := range retentions {
-			// skip non-ready option.
-			if !ret.Ready {
-				continue
-			}
-			req.Archive = i
-			req.TTL = uint32(ret.MaxRetention())
-			if i == 0 {
-				// The first retention is raw data, so use its native interval
-				req.ArchInterval = req.RawInterval
-			} else {
-				req.ArchInterval = uint32(ret.SecondsPerPoint)
+		retentions := mdata.GetSchema(req.SchemaId).Retentions
+		if !archReq.Auto() {
+			if err := forceArchive(req, retentions, archReq); err != nil {
+				return nil, 0, 0, err
 			}
+		} else {
+			for i, ret := range retentions {
+				// skip non-ready option.
+				if !ret.Ready {
+					continue
+				}
+				req.Archive = i
+				req.TTL = uint32(ret.MaxRetention())
+				if i == 0 {
+					// The first retention is raw data, so use its native interval
+					req.ArchInterval = req.RawInterval
+				} else {
+					req.ArchInterval = uint32(ret.SecondsPerPoint)
+				}
 
-			if req.TTL >= minTTL && req.ArchInterval >= minIntervalSoft {
-				break
+				if req.TTL >= minTTL && req.ArchInterval >= minIntervalSoft {
+					break
+				}
+			}
+			if req.Archive == -1 {
+				return nil, 0, 0, errUnSatisfiable
 			}
-		}
-		if req.Archive == -1 {
-			return nil, 0, 0, errUnSatisfiable
 		}
 
 		if _, ok := seenIntervals[req.ArchInterval]; !ok {
@@ -115,10 +137,11 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 			// we have to deliver an interval higher than what we originally came up with
 
 			// let's see first if we can deliver it via lower-res rollup archives, if we have any
-			retentions := mdata.Schemas.Get(req.SchemaId).Retentions
+			// (unless the archive was requested explicitly)
+			retentions := mdata.GetSchema(req.SchemaId).Retentions
 			for i, ret := range retentions[req.Archive+1:] {
 				archInterval := uint32(ret.SecondsPerPoint)
-				if interval == archInterval && ret.Ready {
+				if interval == archInterval && ret.Ready && archReq.Auto() {
 					// we're in luck. this will be more efficient than runtime consolidation
 					req.Archive = req.Archive + 1 + i
 					req.ArchInterval = archInterval
@@ -149,3 +172,24 @@ func alignRequests(now, from, to uint32, reqs []models.Req) ([]models.Req, uint3
 
 	return reqs, pointsFetch, pointsReturn, nil
 }
+
+// forceArchive makes the request read the requested archive
+func forceArchive(req *models.Req, retentions conf.Retentions, archReq models.ArchiveReq) error {
+	for i, ret := range retentions {
+		match := i == 0 && archReq.Raw || i > 0 && uint32(ret.SecondsPerPoint) == archReq.Interval
+		if !match {
+			continue
+		}
+		if !ret.Ready {
+			return response.NewError(http.StatusBadRequest, fmt.Sprintf("%s archive of %s is not ready yet", archReq, req.Target))
+		}
+		req.Archive = i
+		req.TTL = uint32(ret.MaxRetention())
+		req.ArchInterval = uint32(ret.SecondsPerPoint)
+		if i == 0 {
+			req.ArchInterval = req.RawInterval
+		}
+		return nil
+	}
+	return response.NewError(http.StatusBadRequest, fmt.Sprintf("%s does not have a %s archive", req.Target, archReq))
+}
@@ -9,10 +9,16 @@ import (
 	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/test"
+	"github.com/grafana/metrictank/util"
 )
 
 // testAlign verifies the aligment of the given requests, given the retentions (one or more patterns, one or more retentions each)
 func testAlign(reqs []models.Req, retentions [][]conf.Retention, outReqs []models.Req, outErr error, now uint32, t *testing.T) {
+	testAlignArchive(reqs, models.ArchiveReq{}, retentions, outReqs, outErr, now, t)
+}
+
+// testAlignArchive is like testAlign, for requests for a specific archive
+func testAlignArchive(reqs []models.Req, archReq models.ArchiveReq, retentions [][]conf.Retention, outReqs []models.Req, outErr error, now uint32, t *testing.T) {
 	var schemas []conf.Schema
 	oriMaxPointsPerReqSoft := maxPointsPerReqSoft
 
@@ -29,7 +35,12 @@ func testAlign(reqs []models.Req, retentions [][]conf.Retention, outReqs []model
 	}
 
 	mdata.Schemas = conf.NewSchemas(schemas)
-	out, _, _, err := alignRequests(now, reqs[0].From, reqs[0].To, reqs)
+	from, to := reqs[0].From, reqs[0].To
+	for _, r := range reqs {
+		from = util.Min(from, r.From)
+		to = util.Max(to, r.To)
+	}
+	out, _, _, err := alignRequests(now, from, to, reqs, archReq)
 	if err != outErr {
 		t.Errorf("different err value expected: %v, got: %v", outErr, err)
 	}
@@ -231,6 +242,29 @@ func TestAlignRequestsGoodRollup(t *testing.T) {
 	)
 }
 
+// the same series requested for now and for 10 minutes ago (e.g. with timeShift). req 600-630 and 0-30. now 1200.
+// raw retains the data of the first request, but only the rollup has the data of both.
+func TestAlignRequestsShifted(t *testing.T) {
+	testAlign([]models.Req{
+		reqRaw(test.GetMKey(1), 600, 630, 800, 60, consolidation.Avg, 0, 0),
+		reqRaw(test.GetMKey(1), 0, 30, 800, 60, consolidation.Avg, 0, 0),
+	},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(60, 1000, 0, 0, true),
+				conf.NewRetentionMT(120, 1200, 600, 2, true),
+			},
+		},
+		[]models.Req{
+			reqOut(test.GetMKey(1), 600, 630, 800, 60, consolidation.Avg, 0, 0, 1, 120, 1200, 120, 1),
+			reqOut(test.GetMKey(1), 0, 30, 800, 60, consolidation.Avg, 0, 0, 1, 120, 1200, 120, 1),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
 // 2 series requested with different raw intervals, and rollup intervals from different schemas. req 0-30. now 1200. both have short raw + good rollup
 func TestAlignRequestsDiffGoodRollup(t *testing.T) {
 	testAlign([]models.Req{
@@ -257,6 +291,63 @@ func TestAlignRequestsDiffGoodRollup(t *testing.T) {
 	)
 }
 
+// raw would do, but the rollup was requested
+func TestAlignRequestsForcedRollup(t *testing.T) {
+	testAlignArchive([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0),
+	},
+		models.ArchiveReq{Interval: 120},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 1200, 0, 0, true),
+				conf.NewRetentionMT(60, 1200, 600, 2, true),
+				conf.NewRetentionMT(120, 1200, 600, 2, true),
+			},
+		},
+		[]models.Req{
+			reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0, 2, 120, 1200, 120, 1),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
+// raw was requested. the 10s series is normalized at runtime, rather than read from the 60s rollup.
+func TestAlignRequestsForcedRaw(t *testing.T) {
+	testAlignArchive([]models.Req{
+		reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0),
+		reqRaw(test.GetMKey(2), 0, 30, 800, 60, consolidation.Avg, 0, 0),
+	},
+		models.ArchiveReq{Raw: true},
+		[][]conf.Retention{
+			{
+				conf.NewRetentionMT(10, 1200, 0, 0, true),
+				conf.NewRetentionMT(60, 1200, 600, 2, true),
+			},
+		},
+		[]models.Req{
+			reqOut(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0, 0, 10, 1200, 60, 6),
+			reqOut(test.GetMKey(2), 0, 30, 800, 60, consolidation.Avg, 0, 0, 0, 60, 1200, 60, 1),
+		},
+		nil,
+		1200,
+		t,
+	)
+}
+
+func TestAlignRequestsForcedMissingRollup(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas([]conf.Schema{{
+		Pattern:    regexp.MustCompile(".*"),
+		Retentions: conf.Retentions{conf.NewRetentionMT(10, 1200, 0, 0, true)},
+	}})
+	reqs := []models.Req{reqRaw(test.GetMKey(1), 0, 30, 800, 10, consolidation.Avg, 0, 0)}
+	_, _, _, err := alignRequests(1200, 0, 30, reqs, models.ArchiveReq{Interval: 3600})
+	if err == nil {
+		t.Fatal("expected an error for a rollup the schema does not have")
+	}
+}
+
 // now raw is short and we have a rollup we can use instead, at same interval as one of the raws
 func TestAlignRequestsWeird(t *testing.T) {
 	testAlign([]models.Req{
@@ -431,7 +522,7 @@ func testMaxPointsPerReq(maxPointsSoft, maxPointsHard int, reqs []models.Req, t
 		}),
 	}})
 
-	out, _, _, err := alignRequests(30*day, reqs[0].From, reqs[0].To, reqs)
+	out, _, _, err := alignRequests(30*day, reqs[0].From, reqs[0].To, reqs, models.ArchiveReq{})
 	maxPointsPerReqSoft = origMaxPointsPerReqSoft
 	maxPointsPerReqHard = origMaxPointsPerReqHard
 	return out, err
@@ -524,7 +615,7 @@ func BenchmarkAlignRequests(b *testing.B) {
 	})
 
 	for n := 0; n < b.N; n++ {
-		res, _, _, _ = alignRequests(14*24*3600, 0, 3600*24*7, reqs)
+		res, _, _, _ = alignRequests(14*24*3600, 0, 3600*24*7, reqs, models.ArchiveReq{})
 	}
 	result = res
 }
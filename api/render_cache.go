@@ -0,0 +1,222 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/stats"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric api.request.render.cache.hit is how many render requests were served from the render cache
+	renderCacheHit = stats.NewCounter32("api.request.render.cache.hit")
+	// metric api.request.render.cache.miss is how many cacheable render requests were not in the render cache
+	renderCacheMiss = stats.NewCounter32("api.request.render.cache.miss")
+	// metric api.request.render.cache.evicted is how many responses were evicted from the render cache to make room for new ones
+	renderCacheEvicted = stats.NewCounter32("api.request.render.cache.evicted")
+	// metric api.request.render.cache.invalidated is how many responses were removed from the render cache because a chunk of one of their series was persisted
+	renderCacheInvalidated = stats.NewCounter32("api.request.render.cache.invalidated")
+	// metric api.request.render.cache.size is the size in bytes of the responses in the render cache
+	renderCacheSize = stats.NewGauge64("api.request.render.cache.size")
+
+	renderCacheMaxSize int
+	renderCacheMaxAge  time.Duration
+	renderCacheAlign   time.Duration
+
+	// renderResponses is nil when the render cache is disabled
+	renderResponses *renderCache
+)
+
+// renderCache is an LRU cache of encoded render responses, so that dashboards that refresh the same
+// queries don't need to fetch the same chunks over and over.
+// The time range of the key is aligned to renderCacheAlign, so that refreshes within the same interval
+// share their response. Responses are dropped when a chunk of one of their series gets persisted,
+// and at the latest after maxAge.
+type renderCache struct {
+	sync.Mutex
+	maxSize int
+	maxAge  time.Duration
+	size    int
+	lru     *list.List // of *renderCacheEntry, most recently used at the front
+	entries map[string]*list.Element
+	// bySeries indexes the keys of the responses by the series they contain
+	bySeries map[schema.MKey]map[string]struct{}
+}
+
+type renderCacheEntry struct {
+	key     string
+	created time.Time
+	series  []schema.MKey
+	resp    *cachedResponse
+}
+
+func newRenderCache(maxSize int, maxAge time.Duration) *renderCache {
+	return &renderCache{
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		bySeries: make(map[schema.MKey]map[string]struct{}),
+	}
+}
+
+// renderCacheKey returns the key of the render request in the render cache
+func renderCacheKey(orgId uint32, request models.GraphiteRender, from, to, mdp uint32, stable bool) string {
+	if align := uint32(renderCacheAlign.Seconds()); align > 1 {
+		from -= from % align
+		to -= to % align
+	}
+	targets := make([]string, len(request.Targets))
+	for i, t := range request.Targets {
+		targets[i] = strings.TrimSpace(t)
+	}
+	return fmt.Sprintf("%d|%d|%d|%d|%s|%t|%s|%s|%t|%s", orgId, from, to, mdp, request.Format, stable, request.Archive, request.XFilesFactor, request.NoProxy, strings.Join(targets, "\x00"))
+}
+
+// Get returns the cached response for the key, if any and not expired
+func (c *renderCache) Get(key string, now time.Time) (*cachedResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		renderCacheMiss.Inc()
+		return nil, false
+	}
+	entry := e.Value.(*renderCacheEntry)
+	if now.Sub(entry.created) > c.maxAge {
+		c.remove(e)
+		renderCacheMiss.Inc()
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	renderCacheHit.Inc()
+	return entry.resp, true
+}
+
+// Add adds the response of the series to the cache, evicting the least recently used ones as needed.
+// responses bigger than a quarter of the cache are not cached.
+func (c *renderCache) Add(key string, series []schema.MKey, resp *cachedResponse, now time.Time) {
+	size := len(resp.body) + len(key)
+	if size > c.maxSize/4 {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	for c.size+size > c.maxSize {
+		c.remove(c.lru.Back())
+		renderCacheEvicted.Inc()
+	}
+	entry := &renderCacheEntry{
+		key:     key,
+		created: now,
+		series:  series,
+		resp:    resp,
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for _, s := range series {
+		keys, ok := c.bySeries[s]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.bySeries[s] = keys
+		}
+		keys[key] = struct{}{}
+	}
+	c.size += size
+	renderCacheSize.Set(c.size)
+}
+
+// Invalidate removes the responses that contain the series. it is called when one of its chunks got persisted
+func (c *renderCache) Invalidate(amkey schema.AMKey, t0 uint32) {
+	c.Lock()
+	defer c.Unlock()
+	for key := range c.bySeries[amkey.MKey] {
+		c.remove(c.entries[key])
+		renderCacheInvalidated.Inc()
+	}
+}
+
+func (c *renderCache) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*renderCacheEntry)
+	delete(c.entries, entry.key)
+	for _, s := range entry.series {
+		keys := c.bySeries[s]
+		delete(keys, entry.key)
+		if len(keys) == 0 {
+			delete(c.bySeries, s)
+		}
+	}
+	c.size -= len(entry.resp.body) + len(entry.key)
+	renderCacheSize.Set(c.size)
+}
+
+// cachedResponse is an encoded response that is kept around, so it can be written more than once
+type cachedResponse struct {
+	code    int
+	body    []byte
+	headers map[string]string
+}
+
+// newCachedResponse encodes the response into a cachedResponse, and closes it
+func newCachedResponse(resp response.Response) (*cachedResponse, error) {
+	defer resp.Close()
+	body, err := resp.Body()
+	if err != nil {
+		return nil, err
+	}
+	// the body of resp goes back to the buffer pool on close
+	c := &cachedResponse{
+		code:    resp.Code(),
+		body:    make([]byte, len(body)),
+		headers: resp.Headers(),
+	}
+	copy(c.body, body)
+	return c, nil
+}
+
+func (c *cachedResponse) Code() int {
+	return c.code
+}
+
+func (c *cachedResponse) Body() ([]byte, error) {
+	return c.body, nil
+}
+
+func (c *cachedResponse) Headers() map[string]string {
+	return c.headers
+}
+
+func (c *cachedResponse) Close() {
+}
+
+type renderSeriesKey struct{}
+
+// withRenderSeries returns a context in which executePlan records the series of the request,
+// for the render cache to know which responses to invalidate
+func withRenderSeries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, renderSeriesKey{}, &[]schema.MKey{})
+}
+
+// addRenderSeries records the series in the context, if it records them
+func addRenderSeries(ctx context.Context, mkey schema.MKey) {
+	if series, ok := ctx.Value(renderSeriesKey{}).(*[]schema.MKey); ok {
+		*series = append(*series, mkey)
+	}
+}
+
+// renderSeries returns the series recorded in the context
+func renderSeries(ctx context.Context) []schema.MKey {
+	if series, ok := ctx.Value(renderSeriesKey{}).(*[]schema.MKey); ok {
+		return *series
+	}
+	return nil
+}
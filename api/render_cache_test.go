@@ -0,0 +1,92 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestRenderCacheKey(t *testing.T) {
+	renderCacheAlign = 10 * time.Minute
+	defer func() {
+		renderCacheAlign = 0
+	}()
+	req := models.GraphiteRender{Targets: []string{"a.*", " sum(b.*)"}, Format: "json"}
+	key := renderCacheKey(1, req, 1200, 4800, 800, true)
+	if other := renderCacheKey(1, req, 1790, 5399, 800, true); other != key {
+		t.Fatalf("expected time ranges within the same interval to share the key, got %q and %q", key, other)
+	}
+	if other := renderCacheKey(1, req, 1800, 4800, 800, true); other == key {
+		t.Fatalf("expected time ranges of different intervals to have different keys, got %q for both", key)
+	}
+	if other := renderCacheKey(2, req, 1200, 4800, 800, true); other == key {
+		t.Fatalf("expected different orgs to have different keys, got %q for both", key)
+	}
+	req.Format = "msgp"
+	if other := renderCacheKey(1, req, 1200, 4800, 800, true); other == key {
+		t.Fatalf("expected different formats to have different keys, got %q for both", key)
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	now := time.Unix(1000, 0)
+	c := newRenderCache(400, time.Minute)
+	a, b := test.GetMKey(1), test.GetMKey(2)
+	resp := func(body string) *cachedResponse {
+		return &cachedResponse{code: 200, body: []byte(body)}
+	}
+	body := func(r *cachedResponse) string {
+		b, _ := r.Body()
+		return string(b)
+	}
+
+	c.Add("k1", []schema.MKey{a}, resp("first"), now)
+	c.Add("k2", []schema.MKey{a, b}, resp("second"), now)
+	if r, ok := c.Get("k1", now); !ok || body(r) != "first" {
+		t.Fatalf("expected k1 to be cached")
+	}
+	if _, ok := c.Get("k1", now.Add(2*time.Minute)); ok {
+		t.Fatalf("expected k1 to be expired")
+	}
+	if _, ok := c.Get("k2", now); !ok {
+		t.Fatalf("expected k2 to be cached")
+	}
+
+	// a persisted chunk of b invalidates the responses that contain b
+	c.Add("k3", []schema.MKey{a}, resp("third"), now)
+	c.Invalidate(schema.AMKey{MKey: b}, 1000)
+	if _, ok := c.Get("k2", now); ok {
+		t.Fatalf("expected k2 to be invalidated")
+	}
+	if _, ok := c.Get("k3", now); !ok {
+		t.Fatalf("expected k3 to stay cached")
+	}
+	if len(c.bySeries) != 1 || len(c.bySeries[a]) != 1 {
+		t.Fatalf("expected only k3 to be left in the series index, got %v", c.bySeries)
+	}
+
+	// the least recently used responses make room for new ones
+	c.Add("k4", nil, resp(string(make([]byte, 98))), now)
+	c.Add("k5", nil, resp(string(make([]byte, 98))), now)
+	c.Get("k3", now)
+	c.Add("k6", nil, resp(string(make([]byte, 98))), now)
+	c.Add("k7", nil, resp(string(make([]byte, 98))), now)
+	if _, ok := c.Get("k4", now); ok {
+		t.Fatalf("expected k4 to be evicted")
+	}
+	if _, ok := c.Get("k3", now); !ok {
+		t.Fatalf("expected k3 to stay cached")
+	}
+	if c.size > c.maxSize {
+		t.Fatalf("expected the cache to stay within its max size %d, got %d", c.maxSize, c.size)
+	}
+
+	// responses that would take up too much of the cache are not cached
+	c.Add("k8", nil, resp(string(make([]byte, 200))), now)
+	if _, ok := c.Get("k8", now); ok {
+		t.Fatalf("expected k8 not to be cached")
+	}
+}
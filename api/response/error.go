@@ -1,7 +1,9 @@
 package response
 
 import (
+	"context"
 	"encoding/json"
+	"net/http"
 )
 
 type Error interface {
@@ -18,6 +20,12 @@ func WrapError(e error) *ErrorResp {
 	if _, ok := e.(*ErrorResp); ok {
 		return e.(*ErrorResp)
 	}
+	switch e {
+	case context.Canceled:
+		return RequestCanceledErr
+	case context.DeadlineExceeded:
+		return RequestTimeoutErr
+	}
 	resp := &ErrorResp{
 		err:  e.Error(),
 		code: 500,
@@ -83,3 +91,4 @@ func (r *ErrorResp) Headers() (headers map[string]string) {
 }
 
 var RequestCanceledErr = NewError(499, "request canceled")
+var RequestTimeoutErr = NewError(http.StatusServiceUnavailable, "request exceeded the max execution time")
@@ -0,0 +1,50 @@
+package response
+
+import (
+	"github.com/golang/snappy"
+)
+
+// ProtoMarshaler is implemented by (gogo) protobuf messages
+type ProtoMarshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// SnappyProtobuf is a snappy compressed protobuf message, as used by the prometheus remote storage protocols
+type SnappyProtobuf struct {
+	code int
+	body ProtoMarshaler
+	buf  []byte
+}
+
+func NewSnappyProtobuf(code int, body ProtoMarshaler) *SnappyProtobuf {
+	return &SnappyProtobuf{
+		code: code,
+		body: body,
+		buf:  BufferPool.Get(),
+	}
+}
+
+func (r *SnappyProtobuf) Code() int {
+	return r.code
+}
+
+func (r *SnappyProtobuf) Close() {
+	BufferPool.Put(r.buf)
+}
+
+func (r *SnappyProtobuf) Body() ([]byte, error) {
+	data, err := r.body.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	r.buf = snappy.Encode(r.buf[:cap(r.buf)], data)
+	return r.buf, nil
+}
+
+func (r *SnappyProtobuf) Headers() (headers map[string]string) {
+	headers = map[string]string{
+		"content-type":     "application/x-protobuf",
+		"content-encoding": "snappy",
+	}
+	return headers
+}
@@ -13,6 +13,10 @@ var BufferPool = util.NewBufferPool() // used by pickle, fastjson and msgp respo
 
 func Write(w http.ResponseWriter, resp Response) {
 	defer resp.Close()
+	if s, ok := resp.(Streamer); ok {
+		s.WriteTo(w)
+		return
+	}
 	body, err := resp.Body()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
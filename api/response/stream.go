@@ -0,0 +1,119 @@
+package response
+
+import (
+	"net/http"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// streamFlushSize is how many bytes a Stream buffers before writing them out
+const streamFlushSize = 64 * 1024
+
+// StreamEncoder encodes a list of elements one by one
+type StreamEncoder interface {
+	Len() int
+	AppendHeader(b []byte) []byte
+	AppendElement(b []byte, i int) ([]byte, error)
+	AppendFooter(b []byte) []byte
+}
+
+// Streamer is a Response that can write its body incrementally
+type Streamer interface {
+	Response
+	WriteTo(w http.ResponseWriter)
+}
+
+// Stream is a response that is written out while it is being encoded,
+// so that the encoding of the full response never needs to be held in memory.
+// because the status code and headers are sent before the body is encoded,
+// an encoding error can't be reported to the client. instead the response is cut short.
+type Stream struct {
+	code        int
+	contentType string
+	body        StreamEncoder
+	buf         []byte
+}
+
+func NewStream(code int, contentType string, body StreamEncoder) *Stream {
+	return &Stream{
+		code:        code,
+		contentType: contentType,
+		body:        body,
+		buf:         BufferPool.Get(),
+	}
+}
+
+func NewJsonStream(code int, body StreamEncoder) *Stream {
+	return NewStream(code, "application/json", body)
+}
+
+func NewMsgpStream(code int, body StreamEncoder) *Stream {
+	return NewStream(code, "application/msgpack", body)
+}
+
+func NewMsgpackStream(code int, body StreamEncoder) *Stream {
+	return NewStream(code, "application/x-msgpack", body)
+}
+
+func (r *Stream) Code() int {
+	return r.code
+}
+
+func (r *Stream) Close() {
+	BufferPool.Put(r.buf)
+}
+
+// Body encodes the full response at once, for when it can't be streamed
+func (r *Stream) Body() ([]byte, error) {
+	var err error
+	r.buf = r.body.AppendHeader(r.buf)
+	for i := 0; i < r.body.Len(); i++ {
+		r.buf, err = r.body.AppendElement(r.buf, i)
+		if err != nil {
+			return r.buf, err
+		}
+	}
+	r.buf = r.body.AppendFooter(r.buf)
+	return r.buf, nil
+}
+
+func (r *Stream) Headers() (headers map[string]string) {
+	headers = map[string]string{"content-type": r.contentType}
+	return headers
+}
+
+func (r *Stream) WriteTo(w http.ResponseWriter) {
+	for k, v := range r.Headers() {
+		w.Header().Set(k, v)
+	}
+	w.WriteHeader(r.code)
+	flusher, _ := w.(http.Flusher)
+	flush := func() bool {
+		_, err := w.Write(r.buf)
+		r.buf = r.buf[:0]
+		if err != nil {
+			log.Debug("HTTP stream: failed to write response: %s", err)
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	var err error
+	r.buf = r.body.AppendHeader(r.buf)
+	for i := 0; i < r.body.Len(); i++ {
+		r.buf, err = r.body.AppendElement(r.buf, i)
+		if err != nil {
+			log.Error(3, "HTTP stream: failed to encode element %d of the response, cutting it short: %s", i, err)
+			flush()
+			return
+		}
+		if len(r.buf) >= streamFlushSize && !flush() {
+			return
+		}
+	}
+	r.buf = r.body.AppendFooter(r.buf)
+	flush()
+}
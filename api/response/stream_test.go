@@ -0,0 +1,110 @@
+package response
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestStream(t *testing.T) {
+	for _, c := range testSeries() {
+		data := models.SeriesByTarget(c.in)
+		w := httptest.NewRecorder()
+		Write(w, NewJsonStream(200, data.Stream("json")))
+		if got := w.Body.String(); c.out != got {
+			t.Fatalf("bad json output.\nexpected:%s\ngot:     %s\n", c.out, got)
+		}
+		if w.Header().Get("content-type") != "application/json" {
+			t.Fatalf("bad content-type %q", w.Header().Get("content-type"))
+		}
+
+		exp, _ := data.MarshalMsg(nil)
+		w = httptest.NewRecorder()
+		Write(w, NewMsgpStream(200, data.Stream("msgp")))
+		if !bytes.Equal(exp, w.Body.Bytes()) {
+			t.Fatalf("bad msgp output.\nexpected:%v\ngot:     %v\n", exp, w.Body.Bytes())
+		}
+
+		exp, _ = data.ForGraphite("msgpack").MarshalMsg(nil)
+		w = httptest.NewRecorder()
+		Write(w, NewMsgpackStream(200, data.Stream("msgpack")))
+		if !bytes.Equal(exp, w.Body.Bytes()) {
+			t.Fatalf("bad msgpack output.\nexpected:%v\ngot:     %v\n", exp, w.Body.Bytes())
+		}
+	}
+}
+
+func TestStreamFlushes(t *testing.T) {
+	data := make(models.SeriesByTarget, 100)
+	for i := range data {
+		data[i] = models.Series{
+			Target:     fmt.Sprintf("some.series.%d", i),
+			Datapoints: make([]schema.Point, 1000),
+			Interval:   10,
+		}
+	}
+	exp, _ := data.MarshalJSONFast(nil)
+
+	// the flushes must not show in the output
+	w := &countingRecorder{ResponseRecorder: httptest.NewRecorder()}
+	Write(w, NewJsonStream(200, data.Stream("json")))
+	if !bytes.Equal(exp, w.Body.Bytes()) {
+		t.Fatalf("streamed output does not match the regular output")
+	}
+	if w.writes < len(exp)/streamFlushSize {
+		t.Fatalf("expected the %d bytes to be written in at least %d parts, got %d", len(exp), len(exp)/streamFlushSize, w.writes)
+	}
+}
+
+type countingRecorder struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (c *countingRecorder) Write(b []byte) (int, error) {
+	c.writes++
+	return c.ResponseRecorder.Write(b)
+}
+
+// failingEncoder fails to encode its second element
+type failingEncoder struct{}
+
+func (failingEncoder) Len() int                     { return 3 }
+func (failingEncoder) AppendHeader(b []byte) []byte { return append(b, '[') }
+func (failingEncoder) AppendFooter(b []byte) []byte { return append(b, ']') }
+func (failingEncoder) AppendElement(b []byte, i int) ([]byte, error) {
+	if i == 1 {
+		return b, errors.New("can't encode")
+	}
+	return append(b, '1'), nil
+}
+
+func TestStreamError(t *testing.T) {
+	w := httptest.NewRecorder()
+	Write(w, NewJsonStream(200, failingEncoder{}))
+	// the status has already been sent, so the response is cut short
+	if w.Code != 200 || w.Body.String() != "[1" {
+		t.Fatalf("expected truncated response, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func BenchmarkHttpRespJsonStream(b *testing.B) {
+	data := make(models.SeriesByTarget, 1000)
+	for i := range data {
+		data[i] = models.Series{
+			Target:     fmt.Sprintf("some.series.%d", i),
+			Datapoints: make([]schema.Point, 1000),
+			Interval:   10,
+		}
+	}
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		w := httptest.NewRecorder()
+		Write(w, NewJsonStream(200, data.Stream("json")))
+	}
+}
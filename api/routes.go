@@ -14,9 +14,17 @@ func (s *Server) RegisterRoutes() {
 		r.Use(gziper.Gziper())
 	}
 	r.Use(middleware.RequestStats())
-	r.Use(middleware.Tracer(s.Tracer))
+	r.Use(middleware.Tracer(s.Tracer, s.TraceSampling))
+	r.Use(middleware.RequestID())
+	r.Use(middleware.Deadline(maxExecutionTime))
 	r.Use(macaron.Renderer())
 	r.Use(middleware.OrgMiddleware(multiTenant))
+	if len(apiTokens) != 0 {
+		r.Use(middleware.ScopedTokens(apiTokens))
+	}
+	if StrictMultiTenant {
+		r.Use(middleware.StrictTenancy(orgAuthToken, uint32(adminOrg)))
+	}
 	r.Use(middleware.CorsHandler())
 	form := binding.Form
 	bind := binding.Bind
@@ -25,9 +33,34 @@ func (s *Server) RegisterRoutes() {
 	ready := middleware.NodeReady()
 
 	r.Get("/", s.appStatus)
+	r.Get("/health", s.health)
+	r.Get("/startup", s.startup)
 	r.Get("/node", s.getNodeStatus)
 	r.Post("/node", bind(models.NodeStatus{}), s.setNodeStatus)
+	r.Post("/node/ready", bind(models.NodeReadyOverride{}), s.setNodeReadyOverride)
+	r.Post("/node/maintenance", bind(models.NodeMaintenance{}), s.setNodeMaintenance)
+	r.Post("/node/handover", bind(models.NodeHandover{}), s.nodeHandover)
+	r.Post("/node/promote", bind(models.NodePromote{}), s.nodePromote)
 	r.Get("/priority", s.explainPriority)
+	r.Get("/throughput", bind(models.Throughput{}), s.throughput)
+	r.Get("/storage-config", s.storageConfig)
+	r.Get("/storage-config/overrides", s.storageOverrides)
+	r.Post("/storage-config/overrides", bind(models.StorageOverrideUpsert{}), s.storageOverrideUpsert)
+	r.Get("/org-policies", s.orgPolicies)
+	r.Post("/org-policies", bind(models.OrgPolicyUpsert{}), s.orgPolicyUpsert)
+	r.Get("/loglevel", s.getLogLevel)
+	r.Post("/loglevel", bind(models.LogLevel{}), s.setLogLevel)
+	r.Get("/features", s.getFeatures)
+	r.Post("/features", bind(models.FeatureFlag{}), s.setFeature)
+	r.Get("/audit", bind(models.Audit{}), s.getAudit)
+	r.Get("/verify/rollups", s.getRollupVerification)
+	r.Post("/verify/rollups", bind(models.VerifyRollups{}), s.verifyRollups)
+	r.Get("/backfill/rollups", s.getRollupBackfill)
+	r.Post("/backfill/rollups", bind(models.BackfillRollups{}), s.startRollupBackfill)
+	r.Delete("/backfill/rollups", s.stopRollupBackfill)
+	r.Get("/compact/chunks", s.getChunkCompaction)
+	r.Post("/compact/chunks", bind(models.CompactChunks{}), s.startChunkCompaction)
+	r.Delete("/compact/chunks", s.stopChunkCompaction)
 	r.Get("/debug/pprof/block", blockHandler)
 	r.Get("/debug/pprof/mutex", mutexHandler)
 
@@ -40,14 +73,24 @@ func (s *Server) RegisterRoutes() {
 	r.Combo("/index/list", ready, bind(models.IndexList{})).Get(s.indexList).Post(s.indexList)
 	r.Combo("/index/delete", ready, bind(models.IndexDelete{})).Get(s.indexDelete).Post(s.indexDelete)
 	r.Combo("/index/get", ready, bind(models.IndexGet{})).Get(s.indexGet).Post(s.indexGet)
+	r.Combo("/index/lookup", ready, bind(models.IndexLookup{})).Get(s.indexLookup).Post(s.indexLookup)
 	r.Combo("/index/tags", ready, bind(models.IndexTags{})).Get(s.indexTags).Post(s.indexTags)
 	r.Combo("/index/find_by_tag", ready, bind(models.IndexFindByTag{})).Get(s.indexFindByTag).Post(s.indexFindByTag)
 	r.Combo("/index/tag_details", ready, bind(models.IndexTagDetails{})).Get(s.indexTagDetails).Post(s.indexTagDetails)
 	r.Combo("/index/tags/autoComplete/tags", ready, bind(models.IndexAutoCompleteTags{})).Get(s.indexAutoCompleteTags).Post(s.indexAutoCompleteTags)
 	r.Combo("/index/tags/autoComplete/values", ready, bind(models.IndexAutoCompleteTagValues{})).Get(s.indexAutoCompleteTagValues).Post(s.indexAutoCompleteTagValues)
 	r.Combo("/index/tags/delSeries", ready, bind(models.IndexTagDelSeries{})).Get(s.indexTagDelSeries).Post(s.indexTagDelSeries)
+	r.Post("/index/metaTags/upsert", ready, bind(models.IndexMetaTagUpsert{}), s.indexMetaTagUpsert)
+	r.Post("/index/savedQueries/upsert", bind(models.IndexSavedQueryUpsert{}), s.indexSavedQueryUpsert)
+	r.Get("/index/cardinality", ready, bind(models.IndexCardinality{}), s.indexCardinality)
 
 	r.Combo("/ccache/delete", bind(models.CCacheDelete{})).Post(s.ccacheDelete).Get(s.ccacheDelete)
+	r.Get("/pins", bind(models.PinList{}), s.pinList)
+	r.Post("/pins", bind(models.PinAdd{}), s.pinAdd)
+	r.Post("/pins/delete", bind(models.PinDelete{}), s.pinDelete)
+	r.Post("/chunks/persist", bind(models.ChunksPersist{}), s.chunksPersist)
+	r.Post("/chunks/drop", bind(models.ChunksDrop{}), s.chunksDrop)
+	r.Post("/standby/chunks", bind(models.StandbyChunks{}), s.standbyChunks)
 
 	r.Options("/*", func(ctx *macaron.Context) {
 		ctx.Write(nil)
@@ -55,21 +98,38 @@ func (s *Server) RegisterRoutes() {
 
 	// Graphite endpoints
 	r.Combo("/render", cBody, withOrg, ready, bind(models.GraphiteRender{})).Get(s.renderMetrics).Post(s.renderMetrics)
+	r.Combo("/alerting/eval", withOrg, ready, bind(models.AlertEval{})).Get(s.alertEval).Post(s.alertEval)
 	r.Combo("/metrics/find", withOrg, ready, bind(models.GraphiteFind{})).Get(s.metricsFind).Post(s.metricsFind)
 	r.Get("/metrics/index.json", withOrg, ready, s.metricsIndex)
 	r.Post("/metrics/delete", withOrg, ready, bind(models.MetricsDelete{}), s.metricsDelete)
+	r.Combo("/metrics/stale", withOrg, ready, bind(models.MetricsStale{})).Get(s.metricsStale).Post(s.metricsStale)
+	r.Combo("/metrics/preview", withOrg, ready, bind(models.MetricsPreview{})).Get(s.metricsPreview).Post(s.metricsPreview)
+	r.Combo("/metrics/lookup", withOrg, ready, bind(models.MetricsLookup{})).Get(s.metricsLookup).Post(s.metricsLookup)
 	r.Combo("/tags", withOrg, ready, bind(models.GraphiteTags{})).Get(s.graphiteTags).Post(s.graphiteTags)
 	r.Combo("/tags/:tag([0-9a-zA-Z]+)", withOrg, ready, bind(models.GraphiteTagDetails{})).Get(s.graphiteTagDetails).Post(s.graphiteTagDetails)
 	r.Combo("/tags/findSeries", withOrg, ready, bind(models.GraphiteTagFindSeries{})).Get(s.graphiteTagFindSeries).Post(s.graphiteTagFindSeries)
 	r.Combo("/tags/autoComplete/tags", withOrg, ready, bind(models.GraphiteAutoCompleteTags{})).Get(s.graphiteAutoCompleteTags).Post(s.graphiteAutoCompleteTags)
 	r.Combo("/tags/autoComplete/values", withOrg, ready, bind(models.GraphiteAutoCompleteTagValues{})).Get(s.graphiteAutoCompleteTagValues).Post(s.graphiteAutoCompleteTagValues)
 	r.Post("/tags/delSeries", withOrg, ready, bind(models.GraphiteTagDelSeries{}), s.graphiteTagDelSeries)
-	r.Combo("/functions", withOrg, ready).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
-	r.Combo("/functions/:func(.+)", withOrg, ready).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
+	r.Get("/metaTags", withOrg, ready, s.metaTags)
+	r.Post("/metaTags/upsert", withOrg, ready, bind(models.MetaTagUpsert{}), s.metaTagUpsert)
+	r.Get("/savedQueries", withOrg, s.savedQueries)
+	r.Post("/savedQueries/upsert", withOrg, bind(models.SavedQueryUpsert{}), s.savedQueryUpsert)
+	r.Combo("/savedQueries/:id([0-9a-zA-Z_-]+)/render", withOrg, ready, bind(models.SavedQueryRender{})).Get(s.savedQueryRender).Post(s.savedQueryRender)
+	r.Combo("/functions", cBody, withOrg, ready, bind(models.GraphiteFunctions{})).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
+	r.Combo("/functions/:func(.+)", cBody, withOrg, ready, bind(models.GraphiteFunctions{})).Get(s.graphiteFunctions).Post(s.graphiteFunctions)
+	r.Combo("/events/get_data", withOrg, bind(models.GraphiteEvents{})).Get(s.graphiteEvents).Post(s.graphiteEvents)
+	r.Get("/events", withOrg, bind(models.GraphiteEvents{}), s.graphiteEvents)
+	r.Get("/events/", withOrg, bind(models.GraphiteEvents{}), s.graphiteEvents)
+	r.Post("/events", withOrg, s.graphiteEventCreate)
+	r.Post("/events/", withOrg, s.graphiteEventCreate)
+	r.Get("/events/:id([0-9]+)", withOrg, s.graphiteEvent)
+	r.Delete("/events/:id([0-9]+)", withOrg, s.graphiteEventDelete)
 
 	// Prometheus endpoints
 	r.Combo("/prometheus/api/v1/query_range", cBody, withOrg, ready, form(models.PrometheusRangeQuery{})).Get(s.prometheusQueryRange).Post(s.prometheusQueryRange)
 	r.Combo("/prometheus/api/v1/query", cBody, withOrg, ready, form(models.PrometheusQueryInstant{})).Get(s.prometheusQueryInstant).Post(s.prometheusQueryInstant)
 	r.Combo("/prometheus/api/v1/series", cBody, withOrg, ready, form(models.PrometheusSeriesQuery{})).Get(s.prometheusQuerySeries).Post(s.prometheusQuerySeries)
 	r.Get("/prometheus/api/v1/label/:name/values", cBody, withOrg, ready, s.prometheusLabelValues)
+	r.Post("/prometheus/api/v1/read", cBody, withOrg, ready, s.prometheusRemoteRead)
 }
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/expr"
+	"github.com/grafana/metrictank/idx"
+	"github.com/raintank/dur"
+)
+
+const savedQueryIdChars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// newSavedQueryId returns a random id of 8 characters, that no saved query of the org has
+func (s *Server) newSavedQueryId(orgId uint32) (string, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for i, b := range buf {
+			buf[i] = savedQueryIdChars[int(b)%len(savedQueryIdChars)]
+		}
+		if _, ok := s.MetricIndex.SavedQuery(orgId, string(buf)); !ok {
+			return string(buf), nil
+		}
+	}
+}
+
+// validateSavedQuery returns an error if the query can't be executed as a render request
+func validateSavedQuery(q idx.SavedQuery) error {
+	if _, err := expr.ParseMany(q.Targets); err != nil {
+		return response.NewError(http.StatusBadRequest, err.Error())
+	}
+	if _, err := models.ParseArchiveReq(q.Archive); err != nil {
+		return response.NewError(http.StatusBadRequest, err.Error())
+	}
+	if q.XFilesFactor != "" {
+		xff, err := strconv.ParseFloat(q.XFilesFactor, 64)
+		if err != nil || xff < 0 || xff > 1 {
+			return response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid xFilesFactor %q. must be between 0 and 1", q.XFilesFactor))
+		}
+	}
+	return nil
+}
+
+func (s *Server) savedQueries(ctx *middleware.Context) {
+	response.Write(ctx, response.NewJson(200, s.MetricIndex.SavedQueries(ctx.OrgId), ""))
+}
+
+// savedQueryUpsert saves a render request of the org under an id, and saves it to the index.
+// nodes only load the saved queries from the index on startup, so the request should be propagated for the
+// peers to know the query right away.
+func (s *Server) savedQueryUpsert(ctx *middleware.Context, request models.SavedQueryUpsert) {
+	q := idx.SavedQuery{
+		OrgId:         ctx.OrgId,
+		Id:            request.Id,
+		Targets:       request.Targets,
+		From:          request.From,
+		Until:         request.Until,
+		MaxDataPoints: request.MaxDataPoints,
+		Process:       request.Process,
+		Archive:       request.Archive,
+		XFilesFactor:  request.XFilesFactor,
+	}
+	if len(q.Targets) != 0 {
+		if err := validateSavedQuery(q); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		if request.TTL != "" {
+			ttl, err := dur.ParseNDuration(request.TTL)
+			if err != nil {
+				response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid ttl %q: %s", request.TTL, err)))
+				return
+			}
+			q.Expires = time.Now().Unix() + int64(ttl)
+		}
+		if q.Id == "" {
+			id, err := s.newSavedQueryId(ctx.OrgId)
+			if err != nil {
+				response.Write(ctx, response.WrapError(err))
+				return
+			}
+			q.Id = id
+		}
+	}
+
+	created, err := s.MetricIndex.UpsertSavedQuery(q)
+	auditRecord(ctx, ctx.OrgId, "savedQueries.upsert", q.Id+" -> "+strings.Join(q.Targets, ";"), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	res := models.SavedQueryUpsertResp{
+		Id:      q.Id,
+		Created: created,
+		Expires: q.Expires,
+	}
+	if !request.Propagate {
+		response.Write(ctx, response.NewJson(200, res, ""))
+		return
+	}
+
+	data := models.IndexSavedQueryUpsert{
+		OrgId: ctx.OrgId,
+		Query: q,
+	}
+	responses, err := s.peerQuery(ctx.Req.Context(), data, "clusterSavedQueryUpsert", "/index/savedQueries/upsert", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	res.Peers = make(map[string]bool, len(responses))
+	for peer, resp := range responses {
+		var peerResp models.IndexSavedQueryUpsertResp
+		if err := json.Unmarshal(resp.buf, &peerResp); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		res.Peers[peer] = peerResp.Created
+	}
+	response.Write(ctx, response.NewJson(200, res, ""))
+}
+
+func (s *Server) indexSavedQueryUpsert(ctx *middleware.Context, request models.IndexSavedQueryUpsert) {
+	if !orgAllowed(ctx, request.OrgId) {
+		return
+	}
+	q := request.Query
+	q.OrgId = request.OrgId
+	created, err := s.MetricIndex.UpsertSavedQuery(q)
+	auditRecord(ctx, request.OrgId, "index.savedQueries.upsert", q.Id+" -> "+strings.Join(q.Targets, ";"), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, models.IndexSavedQueryUpsertResp{Created: created}, ""))
+}
+
+// savedQueryRender executes the saved query with the id of the url as a render request
+func (s *Server) savedQueryRender(ctx *middleware.Context, request models.SavedQueryRender) {
+	q, ok := s.MetricIndex.SavedQuery(ctx.OrgId, ctx.Params(":id"))
+	if !ok {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "saved query not found"))
+		return
+	}
+	render := models.GraphiteRender{
+		FromTo: models.FromTo{
+			From:  q.From,
+			Until: q.Until,
+		},
+		MaxDataPoints: q.MaxDataPoints,
+		Targets:       q.Targets,
+		Format:        request.Format,
+		Process:       q.Process,
+		Archive:       q.Archive,
+		XFilesFactor:  q.XFilesFactor,
+		Stream:        request.Stream,
+	}
+	if request.FromTo != (models.FromTo{}) {
+		render.FromTo = request.FromTo
+	}
+	if request.MaxDataPoints != 0 {
+		render.MaxDataPoints = request.MaxDataPoints
+	}
+	if render.Process == "" {
+		render.Process = "stable"
+	}
+
+	// requests with functions that we don't have are proxied to graphite, which needs to get the render request
+	// that the saved query stands for
+	body := renderForm(render).Encode()
+	ctx.Req.Request.Method = "POST"
+	ctx.Req.Request.URL.Path = "/render"
+	ctx.Req.Request.URL.RawQuery = ""
+	ctx.Req.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx.Req.Request.ContentLength = int64(len(body))
+	ctx.Body = ioutil.NopCloser(strings.NewReader(body))
+
+	s.renderMetrics(ctx, render)
+}
+
+// renderForm returns the form of the render request
+func renderForm(r models.GraphiteRender) url.Values {
+	form := url.Values{
+		"target":  r.Targets,
+		"process": {r.Process},
+	}
+	set := func(key, value string) {
+		if value != "" {
+			form.Set(key, value)
+		}
+	}
+	set("from", r.From)
+	set("until", r.Until)
+	set("to", r.To)
+	set("tz", r.Tz)
+	set("format", r.Format)
+	set("archive", r.Archive)
+	set("xFilesFactor", r.XFilesFactor)
+	if r.MaxDataPoints != 0 {
+		form.Set("maxDataPoints", strconv.FormatUint(uint64(r.MaxDataPoints), 10))
+	}
+	return form
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestSavedQueries(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetReady()
+	cluster.Manager.SetReadyOverride(cluster.OverrideReady)
+	defer cluster.Manager.SetReadyOverride(cluster.OverrideNone)
+	srv, _ := newSrv(0, 0)
+	id := test.GetMKey(1)
+	srv.MetricIndex.AddOrUpdate(id, &schema.MetricData{Id: id.String(), OrgId: 1, Name: "app.requests", Interval: 10}, 0)
+
+	ts := httptest.NewServer(srv.Macaron)
+	defer ts.Close()
+
+	upsert := func(req models.SavedQueryUpsert) (int, models.SavedQueryUpsertResp) {
+		body, _ := json.Marshal(req)
+		res, err := http.Post(ts.URL+"/savedQueries/upsert", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("There was an error in the request: %s", err)
+		}
+		defer res.Body.Close()
+		var resp models.SavedQueryUpsertResp
+		json.NewDecoder(res.Body).Decode(&resp)
+		return res.StatusCode, resp
+	}
+
+	for _, req := range []models.SavedQueryUpsert{
+		{Targets: []string{"sum(app.*"}},
+		{Targets: []string{"app.*"}, Archive: "foo"},
+		{Targets: []string{"app.*"}, XFilesFactor: "2"},
+		{Targets: []string{"app.*"}, TTL: "-1d"},
+		{Targets: []string{"app.*"}, Id: "a/b"},
+	} {
+		if code, resp := upsert(req); code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for %+v, got %d: %+v", req, code, resp)
+		}
+	}
+
+	code, resp := upsert(models.SavedQueryUpsert{Targets: []string{"app.*"}, From: "-1h", TTL: "1d"})
+	if code != 200 || !resp.Created || len(resp.Id) != 8 || resp.Expires == 0 {
+		t.Fatalf("expected the query to be saved under a new id with an expiry, got %d: %+v", code, resp)
+	}
+	code, resp = upsert(models.SavedQueryUpsert{Id: "dash-1", Targets: []string{"app.*"}})
+	if code != 200 || !resp.Created || resp.Id != "dash-1" {
+		t.Fatalf("expected the query to be saved under the given id, got %d: %+v", code, resp)
+	}
+	if q, ok := srv.MetricIndex.SavedQuery(1, "dash-1"); !ok || q.Targets[0] != "app.*" {
+		t.Fatalf("expected query dash-1 of org 1 to be in the index, got %+v", q)
+	}
+
+	res, err := http.Get(ts.URL + "/savedQueries")
+	if err != nil {
+		t.Fatalf("There was an error in the request: %s", err)
+	}
+	var queries []idx.SavedQuery
+	json.NewDecoder(res.Body).Decode(&queries)
+	res.Body.Close()
+	if len(queries) != 2 {
+		t.Fatalf("expected 2 saved queries, got %+v", queries)
+	}
+
+	for path, exp := range map[string]int{
+		"/savedQueries/dash-1/render":  200,
+		"/savedQueries/unknown/render": 404,
+	} {
+		res, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("There was an error in the request: %s", err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != exp {
+			t.Fatalf("expected status %d for %s, got %d: %s", exp, path, res.StatusCode, body)
+		}
+	}
+
+	if code, resp := upsert(models.SavedQueryUpsert{Id: "dash-1"}); code != 200 || resp.Created {
+		t.Fatalf("expected query dash-1 to be removed, got %d: %+v", code, resp)
+	}
+	if _, ok := srv.MetricIndex.SavedQuery(1, "dash-1"); ok {
+		t.Fatalf("expected query dash-1 to be removed from the index")
+	}
+}
+
+func TestRenderForm(t *testing.T) {
+	form := renderForm(models.GraphiteRender{
+		FromTo:        models.FromTo{From: "-1h"},
+		Targets:       []string{"a.*", "sum(b.*)"},
+		MaxDataPoints: 100,
+		Process:       "stable",
+	})
+	exp := "from=-1h&maxDataPoints=100&process=stable&target=a.%2A&target=sum%28b.%2A%29"
+	if got := form.Encode(); got != exp {
+		t.Fatalf("expected form %q, got %q", exp, got)
+	}
+}
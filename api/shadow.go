@@ -0,0 +1,169 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric api.request.render.shadow.match is how many sampled render requests got the same response from the shadow graphite
+	shadowMatch = stats.NewCounter32("api.request.render.shadow.match")
+	// metric api.request.render.shadow.mismatch is how many sampled render requests got a different response from the shadow graphite
+	shadowMismatch = stats.NewCounter32("api.request.render.shadow.mismatch")
+	// metric api.request.render.shadow.error is how many sampled render requests could not be compared, because the shadow graphite failed
+	shadowError = stats.NewCounter32("api.request.render.shadow.error")
+	// metric api.request.render.shadow.skipped is how many sampled render requests were not sent to the shadow graphite, because shadow-max-concurrent requests were in flight
+	shadowSkipped = stats.NewCounter32("api.request.render.shadow.skipped")
+
+	shadowURL    *url.URL
+	shadowClient *http.Client
+	shadowSem    chan struct{}
+)
+
+// shadowSeries is a series as returned by the json format of the graphite render api
+type shadowSeries struct {
+	Target     string        `json:"target"`
+	Datapoints [][2]*float64 `json:"datapoints"`
+}
+
+// shadowSample returns whether the render request should be compared against the shadow graphite.
+// requests from graphite itself are never sampled, since the shadow may well be the graphite that sent them.
+func shadowSample(request models.GraphiteRender) bool {
+	return shadowURL != nil && !request.NoProxy && rand.Float64() < shadowSampleRate
+}
+
+// shadowRender sends the render request to the shadow graphite in the background, and compares its response to ours.
+// from and to are the range of the request as we received it.
+// out is copied, since its points are recycled once the response is written.
+func shadowRender(orgId uint32, request models.GraphiteRender, from, to uint32, out []models.Series) {
+	select {
+	case shadowSem <- struct{}{}:
+	default:
+		shadowSkipped.Inc()
+		return
+	}
+	ours := make([]shadowSeries, len(out))
+	for i, s := range out {
+		ours[i] = shadowSeries{Target: s.Target, Datapoints: make([][2]*float64, len(s.Datapoints))}
+		for j, p := range s.Datapoints {
+			val, ts := p.Val, float64(p.Ts)
+			ours[i].Datapoints[j] = [2]*float64{&val, &ts}
+		}
+	}
+	go func() {
+		defer func() { <-shadowSem }()
+		theirs, err := shadowGet(orgId, request, from, to)
+		if err != nil {
+			shadowError.Inc()
+			log.Warn("API shadow: render of %v failed: %s", request.Targets, err)
+			return
+		}
+		if diff := shadowDiff(ours, theirs, shadowTolerance); diff != "" {
+			shadowMismatch.Inc()
+			log.Warn("API shadow: render of %v from %d to %d differs: %s", request.Targets, from, to, diff)
+			return
+		}
+		shadowMatch.Inc()
+	}()
+}
+
+func shadowGet(orgId uint32, request models.GraphiteRender, from, to uint32) ([]shadowSeries, error) {
+	params := url.Values{}
+	for _, target := range request.Targets {
+		params.Add("target", target)
+	}
+	params.Set("from", strconv.Itoa(int(from)))
+	params.Set("until", strconv.Itoa(int(to)))
+	params.Set("maxDataPoints", strconv.Itoa(int(request.MaxDataPoints)))
+	params.Set("format", "json")
+	u := *shadowURL
+	u.Path += "/render"
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// for when the shadow is a metrictank cluster too
+	req.Header.Set("X-Org-Id", strconv.Itoa(int(orgId)))
+	resp, err := shadowClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	var series []shadowSeries
+	err = json.NewDecoder(resp.Body).Decode(&series)
+	return series, err
+}
+
+type shadowByTarget []shadowSeries
+
+func (s shadowByTarget) Len() int           { return len(s) }
+func (s shadowByTarget) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s shadowByTarget) Less(i, j int) bool { return s[i].Target < s[j].Target }
+
+// shadowDiff describes the first difference between our series and theirs, or returns "" if they're the same.
+// the order of the series doesn't matter. values may differ by the relative tolerance, and null equals NaN.
+func shadowDiff(ours, theirs []shadowSeries, tolerance float64) string {
+	if len(ours) != len(theirs) {
+		return fmt.Sprintf("%d series vs %d", len(ours), len(theirs))
+	}
+	sort.Sort(shadowByTarget(ours))
+	sort.Sort(shadowByTarget(theirs))
+	for i := range ours {
+		o, t := ours[i], theirs[i]
+		if o.Target != t.Target {
+			return fmt.Sprintf("series %q vs %q", o.Target, t.Target)
+		}
+		if len(o.Datapoints) != len(t.Datapoints) {
+			return fmt.Sprintf("series %q: %d points vs %d", o.Target, len(o.Datapoints), len(t.Datapoints))
+		}
+		for j := range o.Datapoints {
+			op, tp := shadowPoint(o.Datapoints[j]), shadowPoint(t.Datapoints[j])
+			if op.Ts != tp.Ts {
+				return fmt.Sprintf("series %q: point %d at %d vs %d", o.Target, j, op.Ts, tp.Ts)
+			}
+			if !shadowEqual(op.Val, tp.Val, tolerance) {
+				return fmt.Sprintf("series %q: value at %d is %v vs %v", o.Target, op.Ts, op.Val, tp.Val)
+			}
+		}
+	}
+	return ""
+}
+
+func shadowPoint(p [2]*float64) schema.Point {
+	point := schema.Point{Val: math.NaN()}
+	if p[0] != nil {
+		point.Val = *p[0]
+	}
+	if p[1] != nil {
+		point.Ts = uint32(*p[1])
+	}
+	return point
+}
+
+func shadowEqual(a, b, tolerance float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestShadowRender(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/render" || r.URL.Query().Get("from") != "100" || r.URL.Query().Get("until") != "200" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("target") {
+		case "a":
+			w.Write([]byte(`[{"target": "b", "datapoints": [[null, 110], [2.0000000000001, 120]]}, {"target": "a", "datapoints": [[1, 110]]}]`))
+		case "b":
+			w.Write([]byte(`[{"target": "b", "datapoints": [[null, 110], [3, 120]]}]`))
+		default:
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	shadowURL, _ = url.Parse(ts.URL)
+	shadowClient = &http.Client{Timeout: time.Second}
+	shadowSem = make(chan struct{}, 1)
+	shadowTolerance = 1e-9
+	defer func() { shadowURL = nil }()
+
+	out := []models.Series{
+		{Target: "a", Datapoints: []schema.Point{{Val: 1, Ts: 110}}},
+		{Target: "b", Datapoints: []schema.Point{{Val: math.NaN(), Ts: 110}, {Val: 2, Ts: 120}}},
+	}
+	wait := func() {
+		shadowSem <- struct{}{}
+		<-shadowSem
+	}
+	match, mismatch, errs := shadowMatch.Peek(), shadowMismatch.Peek(), shadowError.Peek()
+
+	shadowRender(1, models.GraphiteRender{Targets: []string{"a"}}, 100, 200, out)
+	// the series are copied before we return
+	out[0].Datapoints[0].Val = 5
+	wait()
+	if shadowMatch.Peek() != match+1 {
+		t.Fatalf("expected a match")
+	}
+	shadowRender(1, models.GraphiteRender{Targets: []string{"b"}}, 100, 200, out[1:])
+	wait()
+	if shadowMismatch.Peek() != mismatch+1 {
+		t.Fatalf("expected a mismatch")
+	}
+	shadowRender(1, models.GraphiteRender{Targets: []string{"c"}}, 100, 200, out)
+	wait()
+	if shadowError.Peek() != errs+1 {
+		t.Fatalf("expected an error")
+	}
+}
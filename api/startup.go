@@ -0,0 +1,56 @@
+package api
+
+import (
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/health"
+)
+
+type namedProgressReporter struct {
+	name string
+	health.ProgressReporter
+}
+
+// BindProgressReporter adds the reporter as a subsystem of the /startup endpoint
+func (s *Server) BindProgressReporter(name string, r health.ProgressReporter) {
+	s.progressReporters = append(s.progressReporters, namedProgressReporter{name, r})
+}
+
+// startupResp is the progress of the work the node does at startup. it's done when all subsystems are done,
+// and the ETA is that of the subsystem that takes the longest, or -1 if that's unknown for any of them.
+type startupResp struct {
+	Ready      bool                       `json:"ready"`
+	Done       bool                       `json:"done"`
+	ETA        int                        `json:"eta"`
+	Subsystems map[string]health.Progress `json:"subsystems"`
+}
+
+func (s *Server) getStartup() startupResp {
+	resp := startupResp{
+		Done:       true,
+		Subsystems: make(map[string]health.Progress, len(s.progressReporters)),
+	}
+	for _, r := range s.progressReporters {
+		p := r.Progress()
+		resp.Subsystems[r.name] = p
+		if p.Done {
+			continue
+		}
+		resp.Done = false
+		if p.ETA == -1 || resp.ETA == -1 {
+			resp.ETA = -1
+		} else if p.ETA > resp.ETA {
+			resp.ETA = p.ETA
+		}
+	}
+	return resp
+}
+
+// startup reports the progress of replaying kafka, loading the index and warming up,
+// so that operators and orchestration systems can see when the node will be ready.
+func (s *Server) startup(ctx *middleware.Context) {
+	resp := s.getStartup()
+	resp.Ready = cluster.Manager.IsReady()
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
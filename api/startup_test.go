@@ -0,0 +1,36 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/health"
+)
+
+func progress(done bool, eta int) health.ProgressReporter {
+	return health.ProgressReporterFunc(func() health.Progress {
+		return health.Progress{Done: done, ETA: eta}
+	})
+}
+
+func TestGetStartup(t *testing.T) {
+	s := &Server{}
+	if resp := s.getStartup(); !resp.Done || resp.ETA != 0 {
+		t.Fatalf("expected done without subsystems, got %+v", resp)
+	}
+
+	s.BindProgressReporter("idx", progress(true, 0))
+	s.BindProgressReporter("input.kafka-mdm", progress(false, 30))
+	s.BindProgressReporter("warm-up", progress(false, 10))
+	resp := s.getStartup()
+	if resp.Done || resp.ETA != 30 {
+		t.Fatalf("expected not done with eta 30, got %+v", resp)
+	}
+	if len(resp.Subsystems) != 3 || !resp.Subsystems["idx"].Done {
+		t.Fatalf("unexpected subsystems %+v", resp.Subsystems)
+	}
+
+	s.BindProgressReporter("other", progress(false, -1))
+	if resp := s.getStartup(); resp.Done || resp.ETA != -1 {
+		t.Fatalf("expected unknown eta, got %+v", resp)
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// storageConfigResp describes the active storage-schemas and storage-aggregation configuration,
+// and how many series in the index were set up with a previous version of it
+type storageConfigResp struct {
+	mdata.ConfigStatus
+	Series         int `json:"series"`
+	SeriesOutdated int `json:"seriesOutdated"`
+}
+
+func (s *Server) storageConfig(ctx *middleware.Context) {
+	resp := storageConfigResp{
+		ConfigStatus: mdata.GetConfigStatus(),
+	}
+	resp.Series, resp.SeriesOutdated = s.MetricIndex.Count(func(a idx.Archive) bool {
+		return !mdata.IsCurrentConfig(a.SchemaId, a.AggId)
+	})
+	response.Write(ctx, response.NewJson(200, resp, ""))
+}
+
+// storageOverrides returns the storage overrides, which take precedence over the rules of the storage-schemas
+// and storage-aggregation files
+func (s *Server) storageOverrides(ctx *middleware.Context) {
+	overrides := s.MetricIndex.StorageOverrides()
+	if overrides == nil {
+		overrides = []conf.Override{}
+	}
+	response.Write(ctx, response.NewJson(200, overrides, ""))
+}
+
+// storageOverrideUpsert adds, changes or removes a storage override, and saves the overrides to the index.
+// nodes only load the overrides from the index on startup, so the request should be propagated for the
+// peers to apply them right away.
+func (s *Server) storageOverrideUpsert(ctx *middleware.Context, req models.StorageOverrideUpsert) {
+	o := conf.Override{
+		Name:              req.Name,
+		Pattern:           req.Pattern,
+		Retentions:        req.Retentions,
+		XFilesFactor:      req.XFilesFactor,
+		AggregationMethod: req.AggregationMethod,
+	}
+	created, err := s.MetricIndex.UpsertStorageOverride(o)
+	auditRecord(ctx, ctx.OrgId, "storage.override", fmt.Sprintf("%s: pattern=%q retentions=%q aggregationMethod=%q", o.Name, o.Pattern, o.Retentions, o.AggregationMethod), 1, err)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+
+	res := models.StorageOverrideUpsertResp{
+		Created: created,
+	}
+	if !req.Propagate {
+		response.Write(ctx, response.NewJson(200, res, ""))
+		return
+	}
+
+	// we never want to propagate more than once to avoid loops
+	req.Propagate = false
+	responses, err := s.peerQuery(ctx.Req.Context(), req, "storageOverrideUpsert", "/storage-config/overrides", true)
+	if err != nil {
+		response.Write(ctx, response.WrapError(err))
+		return
+	}
+	res.Peers = make(map[string]models.StorageOverrideUpsertResp, len(responses))
+	for peer, resp := range responses {
+		var peerResp models.StorageOverrideUpsertResp
+		if err := json.Unmarshal(resp.buf, &peerResp); err != nil {
+			response.Write(ctx, response.WrapError(err))
+			return
+		}
+		res.Peers[peer] = peerResp
+	}
+	response.Write(ctx, response.NewJson(200, res, ""))
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// orgAllowed checks, in strict multi-tenant mode, that the org a request asks for is the org of the request.
+// if not, it writes the error response and returns false.
+func orgAllowed(ctx *middleware.Context, org uint32) bool {
+	if !StrictMultiTenant || org == ctx.OrgId {
+		return true
+	}
+	middleware.Denied(ctx.OrgId)
+	response.Write(ctx, response.NewError(http.StatusForbidden, "access to the data of other orgs is not allowed"))
+	return false
+}
+
+// sharedWith returns whether the series of another org is shared with the org through a view
+func (s *Server) sharedWith(org uint32, key schema.MKey) bool {
+	if key.Org == org || len(idx.SharedViews) == 0 {
+		return false
+	}
+	def, ok := s.MetricIndex.Get(key)
+	return ok && idx.SharedViews.Shares(org, &def.MetricDefinition)
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/secrets"
+	"gopkg.in/macaron.v1"
+)
+
+func TestStrictTenancy(t *testing.T) {
+	token, err := secrets.New("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := macaron.New()
+	m.Use(macaron.Renderer())
+	m.Use(middleware.OrgMiddleware(true))
+	m.Use(middleware.StrictTenancy(token, 5))
+	ok := func(ctx *middleware.Context) {
+		ctx.PlainText(200, []byte("ok"))
+	}
+	m.Get("/", ok)
+	m.Get("/health", ok)
+	m.Get("/node", ok)
+	m.Get("/metrics/find", ok)
+
+	cases := []struct {
+		path   string
+		org    string
+		auth   string
+		status int
+	}{
+		{"/", "", "", 200},
+		{"/health", "", "", 200},
+		{"/metrics/find", "", "", 401},
+		{"/metrics/find", "1", "", 401},
+		{"/metrics/find", "1", "Bearer wrong", 401},
+		{"/metrics/find", "", "Bearer s3cr3t", 401},
+		{"/metrics/find", "1", "Bearer s3cr3t", 200},
+		{"/node", "1", "Bearer s3cr3t", 403},
+		{"/node", "5", "Bearer s3cr3t", 200},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", c.path, nil)
+		if c.org != "" {
+			req.Header.Set("x-org-id", c.org)
+		}
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, req)
+		if rec.Code != c.status {
+			t.Fatalf("%s org %q auth %q: expected status %d, got %d", c.path, c.org, c.auth, c.status, rec.Code)
+		}
+	}
+}
+
+func TestAddPeerHeaders(t *testing.T) {
+	StrictMultiTenant = true
+	defer func() {
+		StrictMultiTenant = false
+	}()
+	var header http.Header
+	m := macaron.New()
+	m.Use(middleware.RequestID())
+	m.Use(middleware.OrgMiddleware(true))
+	m.Get("/", func(ctx *middleware.Context) {
+		header = make(http.Header)
+		addPeerHeaders(ctx.Req.Context(), header)
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("x-org-id", "12")
+	req.Header.Set("X-Request-Id", "abc")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	if header.Get("x-org-id") != "12" {
+		t.Fatalf("expected peer request for org 12, got %q", header.Get("x-org-id"))
+	}
+	if header.Get("X-Request-Id") != "abc" {
+		t.Fatalf("expected peer request to carry request id abc, got %q", header.Get("X-Request-Id"))
+	}
+
+	header = make(http.Header)
+	addPeerHeaders(context.Background(), header)
+	if header.Get("x-org-id") != "" || header.Get("X-Request-Id") != "" {
+		t.Fatalf("expected no headers for requests not made on behalf of a request, got %v", header)
+	}
+
+	adminOrg = 1
+	defer func() {
+		adminOrg = 0
+	}()
+	header = make(http.Header)
+	addPeerHeaders(context.Background(), header)
+	if header.Get("x-org-id") != "1" {
+		t.Fatalf("expected requests not made on behalf of a request to act as the admin org, got %q", header.Get("x-org-id"))
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	var header http.Header
+	var deadline time.Time
+	m := macaron.New()
+	m.Use(middleware.Deadline(time.Minute))
+	m.Get("/", func(ctx *macaron.Context) {
+		deadline, _ = ctx.Req.Context().Deadline()
+		header = make(http.Header)
+		addPeerHeaders(ctx.Req.Context(), header)
+	})
+
+	// the configured max execution time applies, and is passed on to peers
+	req, _ := http.NewRequest("GET", "/", nil)
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	if left := time.Until(deadline); left <= 50*time.Second || left > time.Minute {
+		t.Fatalf("expected a deadline in about a minute, got %s", left)
+	}
+	if d, err := time.ParseDuration(header.Get("X-Request-Timeout")); err != nil || d <= 50*time.Second || d > time.Minute {
+		t.Fatalf("expected the peer request to carry a timeout of about a minute, got %q", header.Get("X-Request-Timeout"))
+	}
+
+	// a shorter timeout from a peer overrides it, a longer one doesn't
+	req.Header.Set("X-Request-Timeout", "5s")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	if left := time.Until(deadline); left > 5*time.Second {
+		t.Fatalf("expected a deadline in about 5s, got %s", left)
+	}
+	req.Header.Set("X-Request-Timeout", "1h")
+	m.ServeHTTP(httptest.NewRecorder(), req)
+	if left := time.Until(deadline); left > time.Minute {
+		t.Fatalf("expected a deadline in about a minute, got %s", left)
+	}
+}
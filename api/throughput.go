@@ -0,0 +1,102 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/health"
+)
+
+type namedQueueReporter struct {
+	name string
+	health.QueueReporter
+}
+
+type namedLagReporter struct {
+	name string
+	health.LagReporter
+}
+
+// BindQueueReporter adds the queues of the subsystem to the /throughput endpoint
+func (s *Server) BindQueueReporter(name string, r health.QueueReporter) {
+	s.queueReporters = append(s.queueReporters, namedQueueReporter{name, r})
+}
+
+// BindLagReporter adds the lag of the input to the /throughput endpoint
+func (s *Server) BindLagReporter(name string, r health.LagReporter) {
+	s.lagReporters = append(s.lagReporters, namedLagReporter{name, r})
+}
+
+// throughputResp tells whether the node keeps up with its reads and writes.
+// it is saturated when any queue is at least threshold full, or when it lags more than max-priority behind.
+type throughputResp struct {
+	Saturated        bool                    `json:"saturated"`
+	Reasons          []string                `json:"reasons"`
+	WriteUtilization float64                 `json:"writeUtilization"` // of the fullest write queue
+	ReadUtilization  float64                 `json:"readUtilization"`  // of the fullest read queue
+	Priority         int                     `json:"priority"`
+	Queues           map[string][]queueResp  `json:"queues"`
+	Lag              map[string][]health.Lag `json:"lag"`
+}
+
+type queueResp struct {
+	health.Queue
+	Utilization float64 `json:"utilization"`
+}
+
+func (s *Server) getThroughput(threshold float64, priority, maxPriority int) throughputResp {
+	resp := throughputResp{
+		Reasons:  make([]string, 0),
+		Priority: priority,
+		Queues:   make(map[string][]queueResp, len(s.queueReporters)),
+		Lag:      make(map[string][]health.Lag, len(s.lagReporters)),
+	}
+	for _, r := range s.queueReporters {
+		queues := r.Queues()
+		out := make([]queueResp, len(queues))
+		var full int
+		for i, q := range queues {
+			u := q.Utilization()
+			out[i] = queueResp{q, u}
+			if q.Kind == "read" && u > resp.ReadUtilization {
+				resp.ReadUtilization = u
+			} else if q.Kind == "write" && u > resp.WriteUtilization {
+				resp.WriteUtilization = u
+			}
+			if u >= threshold {
+				full++
+			}
+		}
+		if full > 0 {
+			resp.Reasons = append(resp.Reasons, fmt.Sprintf("%d of %d queues of %s are over %d%% full", full, len(queues), r.name, int(threshold*100)))
+		}
+		resp.Queues[r.name] = out
+	}
+	for _, r := range s.lagReporters {
+		resp.Lag[r.name] = r.Lag()
+	}
+	if priority > maxPriority {
+		resp.Reasons = append(resp.Reasons, fmt.Sprintf("%ds behind, more than max-priority %d", priority, maxPriority))
+	}
+	resp.Saturated = len(resp.Reasons) > 0
+	return resp
+}
+
+// throughput reports the depth of the read and write queues and the lag of the inputs, so that load balancers
+// can route queries away from saturated nodes. it returns 503 when the node is saturated.
+func (s *Server) throughput(ctx *middleware.Context, req models.Throughput) {
+	if req.Threshold <= 0 || req.Threshold > 1 {
+		response.Write(ctx, response.NewError(http.StatusBadRequest, "threshold must be more than 0 and at most 1"))
+		return
+	}
+	resp := s.getThroughput(req.Threshold, cluster.Manager.ThisNode().GetPriority(), cluster.MaxPriority())
+	code := 200
+	if resp.Saturated {
+		code = http.StatusServiceUnavailable
+	}
+	response.Write(ctx, response.NewJson(code, resp, ""))
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/health"
+)
+
+type queues []health.Queue
+
+func (q queues) Queues() []health.Queue { return q }
+
+type lags []health.Lag
+
+func (l lags) Lag() []health.Lag { return l }
+
+func TestGetThroughput(t *testing.T) {
+	s := &Server{}
+	if resp := s.getThroughput(0.9, 0, 10); resp.Saturated || len(resp.Reasons) != 0 {
+		t.Fatalf("expected not saturated without subsystems, got %+v", resp)
+	}
+
+	s.BindQueueReporter("store", queues{
+		{Name: "write.0", Kind: "write", Depth: 50, Size: 100},
+		{Name: "write.1", Kind: "write", Depth: 80, Size: 100},
+		{Name: "read", Kind: "read", Depth: 10, Size: 1000},
+	})
+	s.BindLagReporter("input.kafka-mdm", lags{{Partition: 0, Messages: 100, Seconds: 2}})
+	resp := s.getThroughput(0.9, 2, 10)
+	if resp.Saturated || resp.WriteUtilization != 0.8 || resp.ReadUtilization != 0.01 {
+		t.Fatalf("expected not saturated with write utilization 0.8 and read utilization 0.01, got %+v", resp)
+	}
+	if len(resp.Queues["store"]) != 3 || resp.Queues["store"][0].Utilization != 0.5 || len(resp.Lag["input.kafka-mdm"]) != 1 {
+		t.Fatalf("unexpected queues %+v or lag %+v", resp.Queues, resp.Lag)
+	}
+
+	resp = s.getThroughput(0.75, 2, 10)
+	if !resp.Saturated || len(resp.Reasons) != 1 {
+		t.Fatalf("expected saturated by a write queue at threshold 0.75, got %+v", resp)
+	}
+	resp = s.getThroughput(0.9, 20, 10)
+	if !resp.Saturated || len(resp.Reasons) != 1 {
+		t.Fatalf("expected saturated by the priority, got %+v", resp)
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/idx"
+)
+
+// filterSeries removes the nodes that the scoped api token of the request may not access from the find results
+func filterSeries(ctx context.Context, series []Series) []Series {
+	t := middleware.TokenFromContext(ctx)
+	if !t.Restricted() {
+		return series
+	}
+	out := series[:0]
+	for _, s := range series {
+		nodes := make([]idx.Node, 0, len(s.Series))
+		for _, n := range s.Series {
+			if allowsNode(t, n) {
+				nodes = append(nodes, n)
+			}
+		}
+		if len(nodes) == 0 {
+			continue
+		}
+		s.Series = nodes
+		out = append(out, s)
+	}
+	return out
+}
+
+func allowsNode(t *middleware.Token, n idx.Node) bool {
+	if !n.Leaf {
+		return t.AllowsBranch(n.Path)
+	}
+	if len(n.Defs) != 0 {
+		return t.AllowsSeries(n.Defs[0].NameWithTags())
+	}
+	return t.AllowsSeries(n.Path)
+}
+
+// filterArchives removes the series that the scoped api token of the request may not access
+func filterArchives(ctx context.Context, defs []idx.Archive) []idx.Archive {
+	t := middleware.TokenFromContext(ctx)
+	if !t.Restricted() {
+		return defs
+	}
+	out := defs[:0]
+	for _, def := range defs {
+		if t.AllowsSeries(def.NameWithTags()) {
+			out = append(out, def)
+		}
+	}
+	return out
+}
+
+// filterNodes removes the nodes that the scoped api token of the request may not access
+func filterNodes(ctx context.Context, nodes []idx.Node) []idx.Node {
+	t := middleware.TokenFromContext(ctx)
+	if !t.Restricted() {
+		return nodes
+	}
+	out := nodes[:0]
+	for _, n := range nodes {
+		if allowsNode(t, n) {
+			out = append(out, n)
+		}
+	}
+	return out
+}
+
+// filterRendered removes the fetched series that the scoped api token of the request may not access
+func filterRendered(ctx context.Context, series []models.Series) []models.Series {
+	t := middleware.TokenFromContext(ctx)
+	if !t.Restricted() {
+		return series
+	}
+	out := series[:0]
+	for _, s := range series {
+		if t.AllowsSeries(s.Target) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/grafana/metrictank/api/middleware"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/api/response"
+	"github.com/grafana/metrictank/idx"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// getRollupVerification returns the report of the last check of the rollup verifier
+func (s *Server) getRollupVerification(ctx *middleware.Context) {
+	last := s.RollupVerifier.Last()
+	if last == nil {
+		response.Write(ctx, response.NewError(http.StatusNotFound, "the rollups have not been verified yet"))
+		return
+	}
+	response.Write(ctx, response.NewJson(200, last, ""))
+}
+
+// verifyRollups checks the rollups of the given series, or of a sample of series, right away
+func (s *Server) verifyRollups(ctx *middleware.Context, req models.VerifyRollups) {
+	var archives []idx.Archive
+	if len(req.Ids) == 0 {
+		archives = s.RollupVerifier.Sample(req.Series)
+	}
+	for _, id := range req.Ids {
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			response.Write(ctx, response.NewError(http.StatusBadRequest, fmt.Sprintf("invalid id %q: %s", id, err)))
+			return
+		}
+		a, ok := s.MetricIndex.Get(mkey)
+		if !ok {
+			response.Write(ctx, response.NewError(http.StatusNotFound, fmt.Sprintf("series %s not found", id)))
+			return
+		}
+		archives = append(archives, a)
+	}
+	response.Write(ctx, response.NewJson(200, s.RollupVerifier.Check(archives, time.Now()), ""))
+}
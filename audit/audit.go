@@ -0,0 +1,148 @@
+// Package audit keeps a durable record of the operations that delete data or change the state of the node,
+// so that operators can reconstruct who did what, e.g. when series went missing.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	// metric audit.entries is how many entries were written to the audit log
+	entriesMetric = stats.NewCounter32("audit.entries")
+	// metric audit.write_errors is how many entries could not be written to the audit log
+	writeErrors = stats.NewCounter32("audit.write_errors")
+
+	// serializes writes to the file
+	lock sync.Mutex
+)
+
+// Entry is a record of a single operation
+type Entry struct {
+	Time time.Time `json:"time"`
+	Node string    `json:"node"`
+	// who: the id of the request (see the X-Request-Id header), the org it was made for and where it came from.
+	// peers pass on the request id when they execute an operation on behalf of another node.
+	// for deletions, the org is the one whose data was deleted. 0 if the request had no org
+	RequestID  string `json:"requestId"`
+	Org        uint32 `json:"org"`
+	RemoteAddr string `json:"remoteAddr"`
+	// what: the action, e.g. metrics.delete, what it applied to, e.g. the query, and how many things it affected, e.g. deleted series
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Count  int    `json:"count"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Record writes the entry to the audit log, if enabled. the file is synced before returning,
+// and is reopened for every entry, so it can be rotated without restarting.
+func Record(e Entry) {
+	if !Enabled {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Node = node
+	buf, err := json.Marshal(e)
+	if err != nil {
+		writeErrors.Inc()
+		log.Error(3, "audit: could not encode entry %+v: %s", e, err)
+		return
+	}
+	buf = append(buf, '\n')
+
+	lock.Lock()
+	defer lock.Unlock()
+	err = appendSync(buf)
+	if err != nil {
+		writeErrors.Inc()
+		log.Error(3, "audit: could not write entry %s to %s: %s", buf[:len(buf)-1], file, err)
+		return
+	}
+	entriesMetric.Inc()
+}
+
+func appendSync(buf []byte) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Filter selects entries from the audit log. zero values match all entries
+type Filter struct {
+	Org    uint32
+	Action string // matches actions with this prefix, e.g. "metrics." or "node.maintenance"
+	Target string // matches targets containing this string
+	Since  time.Time
+	Limit  int // only return the newest entries up to this amount
+}
+
+func (f Filter) match(e Entry) bool {
+	if f.Org != 0 && e.Org != f.Org {
+		return false
+	}
+	if !strings.HasPrefix(e.Action, f.Action) {
+		return false
+	}
+	if !strings.Contains(e.Target, f.Target) {
+		return false
+	}
+	return !e.Time.Before(f.Since)
+}
+
+// Query returns the entries matching the filter, newest first
+func Query(f Filter) ([]Entry, error) {
+	entries := []Entry{}
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// e.g. a line cut short by a crash. skip it, rather than making the rest of the log inaccessible
+			continue
+		}
+		if !f.match(e) {
+			continue
+		}
+		entries = append(entries, e)
+		if f.Limit > 0 && len(entries) > 2*f.Limit {
+			entries = append(entries[:0], entries[len(entries)-f.Limit:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if f.Limit > 0 && len(entries) > f.Limit {
+		entries = entries[len(entries)-f.Limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
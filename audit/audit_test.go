@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Enabled = true
+	file = filepath.Join(dir, "audit.log")
+	node = "mt1"
+	defer func() { Enabled = false }()
+
+	// nothing recorded yet
+	entries, err := Query(Filter{})
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("expected no entries, got %v, %v", entries, err)
+	}
+
+	start := time.Unix(1500000000, 0)
+	Record(Entry{Time: start, Org: 1, Action: "metrics.delete", Target: "foo.*", Count: 10})
+	Record(Entry{Time: start.Add(time.Minute), Org: 2, Action: "metrics.delete", Target: "bar.*", Count: 3})
+	Record(Entry{Time: start.Add(2 * time.Minute), Action: "node.maintenance", Target: "true", Count: 1})
+	// a line cut short should not hide the rest of the log
+	f, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0600)
+	f.WriteString("{\"time\":\n")
+	f.Close()
+	Record(Entry{Time: start.Add(3 * time.Minute), Org: 1, Action: "index.delete", Target: "foo.bar", Count: 1})
+
+	cases := []struct {
+		f   Filter
+		exp []string // targets, newest first
+	}{
+		{Filter{}, []string{"foo.bar", "true", "bar.*", "foo.*"}},
+		{Filter{Org: 1}, []string{"foo.bar", "foo.*"}},
+		{Filter{Action: "metrics."}, []string{"bar.*", "foo.*"}},
+		{Filter{Target: "foo"}, []string{"foo.bar", "foo.*"}},
+		{Filter{Since: start.Add(time.Minute)}, []string{"foo.bar", "true", "bar.*"}},
+		{Filter{Limit: 1}, []string{"foo.bar"}},
+	}
+	for i, c := range cases {
+		entries, err := Query(c.f)
+		if err != nil {
+			t.Fatalf("case %d: %s", i, err)
+		}
+		var targets []string
+		for _, e := range entries {
+			if e.Node != "mt1" {
+				t.Fatalf("case %d: expected node mt1, got %q", i, e.Node)
+			}
+			targets = append(targets, e.Target)
+		}
+		if len(targets) != len(c.exp) {
+			t.Fatalf("case %d: expected %v, got %v", i, c.exp, targets)
+		}
+		for j := range targets {
+			if targets[j] != c.exp[j] {
+				t.Fatalf("case %d: expected %v, got %v", i, c.exp, targets)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package audit
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled bool
+	file    string
+	node    string
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "record deletions and administrative actions, queryable via the /audit endpoint")
+	fs.StringVar(&file, "file", "/var/lib/metrictank/audit.log", "file to append the audit log to, as one json document per line")
+	globalconf.Register("audit", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if Enabled && file == "" {
+		return []conf.Finding{conf.NewError("audit.file", "must be set")}
+	}
+	return nil
+}
+
+func ConfigProcess(instance string) {
+	node = instance
+	if !Enabled {
+		return
+	}
+	if file == "" {
+		log.Fatal(4, "audit: file must be set")
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		log.Fatal(4, "audit: could not create the directory for %s: %s", file, err)
+	}
+	// make sure we can write to it now, rather than finding out when someone deletes something
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Fatal(4, "audit: %s", err)
+	}
+	f.Close()
+}
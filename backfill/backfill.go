@@ -0,0 +1,347 @@
+// Package backfill generates rollups for historical data. when a rollup is added to a schema, series only
+// get it for the data they receive from then on. a backfill job reads the raw chunks from the store and
+// writes the rollup chunks that are missing, for the window in which the raw data is still retained.
+// after the aggregation settings changed, a backfill can also recompute the rollup chunks that exist already.
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/health"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric backfill.rollups.chunks is how many rollup chunks were backfilled
+	chunksWritten = stats.NewCounter32("backfill.rollups.chunks")
+	// metric backfill.rollups.errors is how many series could not be backfilled, because reading from the store failed
+	backfillErrors = stats.NewCounter32("backfill.rollups.errors")
+
+	ErrRunning    = errors.New("a backfill is already running")
+	ErrNotPrimary = errors.New("only primaries write to the store")
+)
+
+// Options describe what a backfill job writes
+type Options struct {
+	Span      uint32        // the span of the rollup to backfill. 0 for all rollups
+	From      uint32        // only chunks that start at or after From are written. 0 for as far back as the raw data is retained
+	Until     uint32        // only chunks that end before Until are written
+	Overwrite bool          // recompute the chunks that exist already, e.g. after the aggregation methods changed
+	Keys      []schema.MKey // the series to backfill. nil for all series in the index
+}
+
+// Status describes the progress of a backfill job
+type Status struct {
+	Span      uint32    `json:"span"`
+	From      uint32    `json:"from"`
+	Until     uint32    `json:"until"`
+	Overwrite bool      `json:"overwrite"`
+	Running   bool      `json:"running"`
+	Stopped   bool      `json:"stopped"` // stopped before it was done
+	Started   time.Time `json:"started"`
+	// zero while running
+	Finished time.Time `json:"finished"`
+	Series   int       `json:"series"`
+	Done     int64     `json:"done"`
+	Chunks   int64     `json:"chunks"`
+	Skipped  int64     `json:"skipped"` // chunks that already existed, and were not overwritten
+	Errors   int64     `json:"errors"`
+	// estimated seconds until done. 0 when done, -1 when unknown
+	ETA int `json:"eta"`
+}
+
+// Backfiller runs one backfill job at a time, for the series in the index
+type Backfiller struct {
+	index idx.MetricIndex
+	store mdata.Store
+
+	sync.Mutex
+	job *job
+}
+
+func New(index idx.MetricIndex, store mdata.Store) *Backfiller {
+	return &Backfiller{
+		index: index,
+		store: store,
+	}
+}
+
+type target struct {
+	key      schema.MKey
+	schemaId uint16
+	aggId    uint16
+}
+
+type job struct {
+	opts   Options
+	series []target
+	stop   chan struct{}
+
+	// read and written atomically
+	started  int64
+	finished int64
+	stopped  int32
+	done     int64
+	chunks   int64
+	skipped  int64
+	errors   int64
+}
+
+// Start starts backfilling the rollups of the selected series, of those in the index whose schema has them.
+func (b *Backfiller) Start(opts Options) (Status, error) {
+	if !cluster.Manager.IsPrimary() {
+		return Status{}, ErrNotPrimary
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.job != nil && atomic.LoadInt64(&b.job.finished) == 0 {
+		return Status{}, ErrRunning
+	}
+	j := &job{
+		opts:    opts,
+		stop:    make(chan struct{}),
+		started: time.Now().Unix(),
+	}
+	add := func(a idx.Archive) {
+		if len(rollups(mdata.GetSchema(a.SchemaId), opts.Span)) > 0 {
+			j.series = append(j.series, target{a.Id, a.SchemaId, a.AggId})
+		}
+	}
+	if opts.Keys == nil {
+		b.index.Count(func(a idx.Archive) bool {
+			add(a)
+			return false
+		})
+	} else {
+		for _, key := range opts.Keys {
+			if a, ok := b.index.Get(key); ok {
+				add(a)
+			}
+		}
+	}
+	if len(j.series) == 0 {
+		if opts.Span == 0 {
+			return Status{}, errors.New("none of the series have rollups")
+		}
+		return Status{}, fmt.Errorf("none of the series have a rollup with span %d", opts.Span)
+	}
+	b.job = j
+	log.Info("backfill: backfilling rollups with span %d (0 for all) of %d series, from %d until %d, overwrite %t", opts.Span, len(j.series), opts.From, opts.Until, opts.Overwrite)
+	go j.run(b.store, maxSeriesPerSec)
+	return j.status(time.Now()), nil
+}
+
+// Stop stops the running job, if any. it returns whether there was one
+func (b *Backfiller) Stop() bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.job == nil || atomic.LoadInt64(&b.job.finished) != 0 || !atomic.CompareAndSwapInt32(&b.job.stopped, 0, 1) {
+		return false
+	}
+	close(b.job.stop)
+	return true
+}
+
+// Status returns the status of the running or last job, and whether there is one
+func (b *Backfiller) Status() (Status, bool) {
+	b.Lock()
+	defer b.Unlock()
+	if b.job == nil {
+		return Status{}, false
+	}
+	return b.job.status(time.Now()), true
+}
+
+func (j *job) status(now time.Time) Status {
+	started := time.Unix(atomic.LoadInt64(&j.started), 0)
+	s := Status{
+		Span:      j.opts.Span,
+		From:      j.opts.From,
+		Until:     j.opts.Until,
+		Overwrite: j.opts.Overwrite,
+		Stopped:   atomic.LoadInt32(&j.stopped) == 1,
+		Started:   started,
+		Series:    len(j.series),
+		Done:      atomic.LoadInt64(&j.done),
+		Chunks:    atomic.LoadInt64(&j.chunks),
+		Skipped:   atomic.LoadInt64(&j.skipped),
+		Errors:    atomic.LoadInt64(&j.errors),
+	}
+	if finished := atomic.LoadInt64(&j.finished); finished != 0 {
+		s.Finished = time.Unix(finished, 0)
+		return s
+	}
+	s.Running = true
+	s.ETA = health.ETA(int64(s.Series)-s.Done, health.Rate(s.Done, started, now))
+	return s
+}
+
+// run backfills the series, at most maxPerSec per second. 0 for no limit
+func (j *job) run(store mdata.Store, maxPerSec int) {
+	var tick <-chan time.Time
+	if maxPerSec > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(maxPerSec))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	defer func() {
+		atomic.StoreInt64(&j.finished, time.Now().Unix())
+		log.Info("backfill: done backfilling rollups with span %d (0 for all). %d of %d series, %d chunks written, %d existed, %d errors",
+			j.opts.Span, atomic.LoadInt64(&j.done), len(j.series), atomic.LoadInt64(&j.chunks), atomic.LoadInt64(&j.skipped), atomic.LoadInt64(&j.errors))
+	}()
+	for _, t := range j.series {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-j.stop:
+				return
+			}
+		}
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+		written, skipped, err := Series(store, t.key, t.schemaId, t.aggId, j.opts, uint32(time.Now().Unix()))
+		atomic.AddInt64(&j.chunks, int64(written))
+		atomic.AddInt64(&j.skipped, int64(skipped))
+		chunksWritten.Add(written)
+		if err != nil {
+			atomic.AddInt64(&j.errors, 1)
+			backfillErrors.Inc()
+			log.Warn("backfill: could not backfill rollups of %s: %s", t.key, err)
+		}
+		atomic.AddInt64(&j.done, 1)
+	}
+}
+
+// Series writes the rollup chunks of the series, for the window in which its raw data is retained.
+// the chunks that exist already are only written when overwriting.
+// it returns how many chunks were written and how many were left alone.
+func Series(store mdata.Store, key schema.MKey, schemaId, aggId uint16, opts Options, now uint32) (int, int, error) {
+	s := mdata.GetSchema(schemaId)
+	var written, skipped int
+	for _, ret := range rollups(s, opts.Span) {
+		w, sk, err := backfillRollup(store, key, s.Retentions[0], ret, mdata.GetAgg(aggId), opts, now)
+		written += w
+		skipped += sk
+		if err != nil {
+			return written, skipped, err
+		}
+	}
+	return written, skipped, nil
+}
+
+// backfillRollup writes the chunks of the given rollup of the series
+func backfillRollup(store mdata.Store, mkey schema.MKey, raw, ret conf.Retention, agg conf.Aggregation, opts Options, now uint32) (int, int, error) {
+	span := uint32(ret.SecondsPerPoint)
+	chunkSpan := ret.ChunkSpan
+	ttl := uint32(ret.MaxRetention())
+
+	// the first chunk for which all raw data is retained, and the end of the last one to write
+	oldest := int64(now) - int64(raw.MaxRetention()) + int64(raw.ChunkSpan) + int64(span)
+	if oldest < int64(opts.From) {
+		oldest = int64(opts.From)
+	}
+	if oldest < 0 {
+		oldest = 0
+	}
+	from := uint32(oldest)
+	if from%chunkSpan != 0 {
+		from += chunkSpan - from%chunkSpan
+	}
+	to := opts.Until - opts.Until%chunkSpan
+	if from >= to {
+		return 0, 0, nil
+	}
+
+	ctx := context.Background()
+	points, err := mdata.ReadPoints(ctx, store, schema.AMKey{MKey: mkey}, uint32(raw.MaxRetention()), from-span, to-span)
+	if err != nil {
+		return 0, 0, err
+	}
+	aggs := mdata.AggregatePoints(points, span)
+	boundaries := make([]uint32, 0, len(aggs))
+	for ts := range aggs {
+		boundaries = append(boundaries, ts)
+	}
+	sort.Sort(uint32s(boundaries))
+
+	var written, skipped int
+	for _, method := range mdata.RollupMethods(agg) {
+		key := schema.AMKey{MKey: mkey, Archive: schema.NewArchive(method, span)}
+		existing := make(map[uint32]bool)
+		if !opts.Overwrite {
+			itgens, err := store.Search(ctx, key, ttl, from, to)
+			if err != nil {
+				return written, skipped, err
+			}
+			for _, itgen := range itgens {
+				existing[itgen.Ts] = true
+			}
+		}
+		var c *chunk.Chunk
+		flush := func() {
+			if c == nil {
+				return
+			}
+			c.Finish()
+			cwr := mdata.NewChunkWriteRequest(nil, key, c, ttl, chunkSpan, time.Now())
+			cwr.Codec = ret.Codec
+			store.Add(&cwr)
+			written++
+			c = nil
+		}
+		for _, ts := range boundaries {
+			if ts < from || ts >= to {
+				continue
+			}
+			t0 := ts - ts%chunkSpan
+			if c != nil && c.T0 != t0 {
+				flush()
+			}
+			if existing[t0] {
+				continue
+			}
+			if c == nil {
+				c = chunk.NewWithEncoding(t0, ret.Encoding)
+			}
+			if err := c.Push(ts, aggs[ts].Value(method)); err != nil {
+				return written, skipped, fmt.Errorf("adding point %d to chunk %d of %s: %s", ts, t0, key, err)
+			}
+		}
+		flush()
+		skipped += len(existing)
+	}
+	return written, skipped, nil
+}
+
+// rollups returns the rollup retentions of the schema with the given span, or all of them for span 0
+func rollups(s conf.Schema, span uint32) []conf.Retention {
+	var rets []conf.Retention
+	for i, ret := range s.Retentions {
+		if i > 0 && (span == 0 || uint32(ret.SecondsPerPoint) == span) {
+			rets = append(rets, ret)
+		}
+	}
+	return rets
+}
+
+type uint32s []uint32
+
+func (u uint32s) Len() int           { return len(u) }
+func (u uint32s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint32s) Less(i, j int) bool { return u[i] < u[j] }
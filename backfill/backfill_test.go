@@ -0,0 +1,96 @@
+package backfill
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestBackfill(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+
+	// the series only had raw data so far
+	raw := conf.NewRetentionMT(10, 9000, 600, 2, true)
+	mdata.SetSingleSchema(raw)
+	mdata.SetSingleAgg(conf.Avg, conf.Lst)
+	agg := mdata.GetAgg(0)
+	store := mdata.NewMockStore()
+	key := test.GetAMKey(1)
+	m := mdata.NewAggMetric(store, &cache.MockCache{}, key, conf.Retentions{raw}, 0, &agg, false)
+	for ts := uint32(100000); ts <= 107200; ts += 10 {
+		m.Add(ts, float64(ts%70))
+	}
+	m.Flush()
+
+	// now a rollup is added. the raw data is retained from 100000 on
+	rollup := conf.NewRetentionMT(60, 100000, 600, 2, true)
+	mdata.SetSingleSchema(raw, rollup)
+	now := uint32(108400)
+	opts := Options{Span: 60, Until: 106200}
+	written, skipped, err := Series(store, key.MKey, 0, 0, opts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chunks from 100200 (the first one with all of its raw data) up to 106200, for sum, cnt and lst
+	if written != 3*10 || skipped != 0 {
+		t.Fatalf("expected 30 chunks to be written, got %d written and %d skipped", written, skipped)
+	}
+
+	rawPoints, err := mdata.ReadPoints(context.Background(), store, key, 0, 100200-60, 106200-60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := mdata.AggregatePoints(rawPoints, 60)
+	for _, method := range []schema.Method{schema.Sum, schema.Cnt, schema.Lst} {
+		rollupKey := schema.AMKey{MKey: key.MKey, Archive: schema.NewArchive(method, 60)}
+		points, err := mdata.ReadPoints(context.Background(), store, rollupKey, 0, 0, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != 100 {
+			t.Fatalf("expected 100 %s points, got %d", method, len(points))
+		}
+		for _, p := range points {
+			if p.Ts < 100200 || p.Ts >= 106200 || expected[p.Ts] == nil || expected[p.Ts].Value(method) != p.Val {
+				t.Fatalf("unexpected %s point %v", method, p)
+			}
+		}
+	}
+
+	// chunks that exist are left alone
+	opts.Until = 106800
+	written, skipped, err = Series(store, key.MKey, 0, 0, opts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 3 || skipped != 30 {
+		t.Fatalf("expected 3 chunks to be written and 30 skipped, got %d written and %d skipped", written, skipped)
+	}
+
+	// unless they're recomputed, e.g. after the aggregation methods changed. here we also keep the max from 103200 on
+	mdata.SetSingleAgg(conf.Avg, conf.Lst, conf.Max)
+	opts = Options{From: 103200, Until: 106800, Overwrite: true}
+	written, skipped, err = Series(store, key.MKey, 0, 0, opts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 4*6 || skipped != 0 {
+		t.Fatalf("expected 24 chunks to be written, got %d written and %d skipped", written, skipped)
+	}
+	maxKey := schema.AMKey{MKey: key.MKey, Archive: schema.NewArchive(schema.Max, 60)}
+	points, err := mdata.ReadPoints(context.Background(), store, maxKey, 0, 0, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 60 || points[0].Ts != 103200 || points[0].Val != expected[103200].Value(schema.Max) {
+		t.Fatalf("expected 60 max points from 103200 on, got %v", points)
+	}
+}
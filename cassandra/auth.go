@@ -0,0 +1,37 @@
+package cassandra
+
+import (
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/secrets"
+)
+
+// Authenticator authenticates with a username and password which may be references to secrets.
+// they are looked up for every new connection, so rotated credentials are used without a restart.
+type Authenticator struct {
+	username *secrets.Secret
+	password *secrets.Secret
+}
+
+// NewAuthenticator resolves the username and password. see secrets.Secret for the supported references
+func NewAuthenticator(username, password string) (*Authenticator, error) {
+	u, err := secrets.New(username)
+	if err != nil {
+		return nil, err
+	}
+	p, err := secrets.New(password)
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{u, p}, nil
+}
+
+func (a *Authenticator) Challenge(req []byte) ([]byte, gocql.Authenticator, error) {
+	return gocql.PasswordAuthenticator{
+		Username: a.username.Get(),
+		Password: a.password.Get(),
+	}.Challenge(req)
+}
+
+func (a *Authenticator) Success(data []byte) error {
+	return nil
+}
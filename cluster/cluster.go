@@ -2,10 +2,15 @@ package cluster
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 	"sync/atomic"
 	"time"
 
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
 	opentracing "github.com/opentracing/opentracing-go"
 )
 
@@ -25,14 +30,54 @@ func validMode(m string) bool {
 	return false
 }
 
+// LagGating is how nodes that lag behind by more than max-priority are kept out of queries
+type LagGating int
+
+const (
+	LagGatingNode    LagGating = iota // the whole node is not ready
+	LagGatingReject                   // the node doesn't serve the partitions that lag, and queries fail if no peer can
+	LagGatingDegrade                  // the node doesn't serve the partitions that lag, unless no peer can
+)
+
+var lagGatingNames = []string{"node", "reject", "degrade"}
+
+func (g LagGating) String() string {
+	if g < LagGatingNode || g > LagGatingDegrade {
+		return fmt.Sprintf("LagGating(%d)", int(g))
+	}
+	return lagGatingNames[g]
+}
+
+// LagGatingFromString parses the name of a LagGating, as returned by its String method
+func LagGatingFromString(s string) (LagGating, error) {
+	for i, name := range lagGatingNames {
+		if name == s {
+			return LagGating(i), nil
+		}
+	}
+	return LagGatingNode, fmt.Errorf("unrecognized lag gating %q. valid values are %s", s, strings.Join(lagGatingNames, ", "))
+}
+
 var (
+	LogLevel util.LogLevel
+
 	Mode    ModeType
 	Manager ClusterManager
 	Tracer  opentracing.Tracer
 
 	InsufficientShardsAvailable = NewError(http.StatusServiceUnavailable, errors.New("Insufficient shards available."))
+
+	// metric cluster.query.cross_zone is how many partitions queries were sent to a node in another zone for, because no node in our zone could serve them
+	queryCrossZone = stats.NewCounter32("cluster.query.cross_zone")
+	// metric cluster.query.lagging is how many partitions queries were sent to a node that lags more than max-priority for, because no peer lags less. only with lag-gating degrade
+	queryLagging = stats.NewCounter32("cluster.query.lagging")
+	// metric cluster.query.lagging_rejected is how many queries were rejected because a partition lagged more than max-priority on all peers. only with lag-gating reject
+	queryLaggingRejected = stats.NewCounter32("cluster.query.lagging_rejected")
 )
 
+// zoneLabel is the label that holds the zone of a node, which queries prefer to stay within
+const zoneLabel = "zone"
+
 func Init(name, version string, started time.Time, apiScheme string, apiPort int) {
 	thisNode := HTTPNode{
 		Name:          name,
@@ -45,6 +90,7 @@ func Init(name, version string, started time.Time, apiScheme string, apiPort int
 		PrimaryChange: time.Now(),
 		StateChange:   time.Now(),
 		Updated:       time.Now(),
+		Labels:        labels,
 		local:         true,
 	}
 	if Mode == ModeMulti {
@@ -69,13 +115,33 @@ type partitionCandidates struct {
 	nodes    []Node
 }
 
+// inZone narrows the candidates down to the ones in the zone, if there are any.
+// it returns whether there were
+func (c *partitionCandidates) inZone(zone string) bool {
+	var inZone []Node
+	for _, n := range c.nodes {
+		if n.GetLabels()[zoneLabel] == zone {
+			inZone = append(inZone, n)
+		}
+	}
+	if len(inZone) == 0 {
+		return false
+	}
+	c.nodes = inZone
+	return true
+}
+
 // return the list of nodes to broadcast requests to
 // If partitions are assinged to nodes in groups
 // (a[0,1], b[0,1], c[2,3], d[2,3] as opposed to a[0,1], b[0,2], c[1,3], d[2,3]),
 // only 1 member per partition is returned.
 // The nodes are selected based on priority, preferring thisNode if it
 // has the lowest prio, otherwise using a random selection from all
-// nodes with the lowest prio.
+// nodes with the lowest prio, of which the ones in the zone of thisNode
+// are preferred over the ones in other zones.
+// Unless lag-gating is node, the priority of each partition is used rather
+// than that of the whole node, and partitions of which even the lowest
+// priority exceeds max-priority fail the query, or are served anyway.
 func MembersForQuery() ([]Node, error) {
 	thisNode := Manager.ThisNode()
 	// If we are running in single mode, just return thisNode
@@ -89,7 +155,7 @@ func MembersForQuery() ([]Node, error) {
 	if thisNode.IsReady() {
 		for _, part := range thisNode.GetPartitions() {
 			membersMap[part] = &partitionCandidates{
-				priority: thisNode.GetPriority(),
+				priority: partitionPriority(thisNode, part),
 				nodes:    []Node{thisNode},
 			}
 		}
@@ -102,12 +168,12 @@ func MembersForQuery() ([]Node, error) {
 		for _, part := range member.GetPartitions() {
 			if _, ok := membersMap[part]; !ok {
 				membersMap[part] = &partitionCandidates{
-					priority: member.GetPriority(),
+					priority: partitionPriority(member, part),
 					nodes:    []Node{member},
 				}
 				continue
 			}
-			priority := member.GetPriority()
+			priority := partitionPriority(member, part)
 			if membersMap[part].priority == priority {
 				membersMap[part].nodes = append(membersMap[part].nodes, member)
 			} else if membersMap[part].priority > priority {
@@ -123,6 +189,22 @@ func MembersForQuery() ([]Node, error) {
 	if len(membersMap) < minAvailableShards {
 		return nil, InsufficientShardsAvailable
 	}
+	if lagGating != LagGatingNode {
+		var lagging []int32
+		for part, candidates := range membersMap {
+			if candidates.priority > maxPrio {
+				lagging = append(lagging, part)
+			}
+		}
+		if len(lagging) > 0 {
+			if lagGating == LagGatingReject {
+				queryLaggingRejected.Inc()
+				sort.Sort(int32Slice(lagging))
+				return nil, NewError(http.StatusServiceUnavailable, fmt.Errorf("partitions %v lag more than max-priority %d on all peers", lagging, maxPrio))
+			}
+			queryLagging.Add(len(lagging))
+		}
+	}
 	selectedMembers := make(map[string]struct{})
 	answer := make([]Node, 0)
 	// we want to get the minimum number of nodes
@@ -130,6 +212,15 @@ func MembersForQuery() ([]Node, error) {
 
 	count := int(atomic.AddUint32(&counter, 1))
 
+	zone := thisNode.GetLabels()[zoneLabel]
+	if zone != "" {
+		for _, candidates := range membersMap {
+			if !candidates.inZone(zone) {
+				queryCrossZone.Inc()
+			}
+		}
+	}
+
 LOOP:
 	for _, candidates := range membersMap {
 		if candidates.nodes[0].GetName() == thisNode.GetName() {
@@ -155,3 +246,11 @@ LOOP:
 
 	return answer, nil
 }
+
+// partitionPriority returns the priority by which the node is selected to serve the partition
+func partitionPriority(n Node, part int32) int {
+	if lagGating == LagGatingNode {
+		return n.GetPriority()
+	}
+	return n.GetPartitionPriority(part)
+}
@@ -1,7 +1,9 @@
 package cluster
 
 import (
+	"encoding/json"
 	. "github.com/smartystreets/goconvey/convey"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -96,3 +98,263 @@ func TestPeersForQueryMulti(t *testing.T) {
 		So(selected, ShouldHaveLength, 0)
 	})
 }
+
+func TestIsPrimaryFor(t *testing.T) {
+	Mode = ModeMulti
+	Init("node2", "test", time.Now(), "http", 6060)
+	manager := Manager.(*MemberlistManager)
+	manager.SetPrimary(true)
+	manager.SetPartitions([]int32{1, 2})
+	thisNode := manager.thisNode()
+	manager.Lock()
+	manager.members = map[string]HTTPNode{
+		thisNode.GetName(): thisNode,
+		"node1": {
+			Name:       "node1",
+			Primary:    true,
+			Partitions: []int32{1},
+			State:      NodeReady,
+		},
+		"node0": {
+			Name:       "node0",
+			Primary:    false,
+			Partitions: []int32{2},
+			State:      NodeReady,
+		},
+	}
+	manager.Unlock()
+	defer func() { dedupWrites = false }()
+
+	dedupWrites = false
+	if !manager.IsPrimaryFor(1) || !manager.IsPrimaryFor(2) {
+		t.Fatalf("expected all primaries to save all partitions without dedup-writes")
+	}
+	dedupWrites = true
+	if manager.IsPrimaryFor(1) {
+		t.Fatalf("expected node1 to own partition 1")
+	}
+	if !manager.IsPrimaryFor(2) {
+		t.Fatalf("expected to own partition 2, since node0 is not a primary")
+	}
+	manager.Lock()
+	node1 := manager.members["node1"]
+	node1.State = NodeUnreachable
+	manager.members["node1"] = node1
+	manager.Unlock()
+	if !manager.IsPrimaryFor(1) {
+		t.Fatalf("expected to take over partition 1 from the unreachable node1")
+	}
+	manager.SetPrimary(false)
+	if manager.IsPrimaryFor(2) {
+		t.Fatalf("expected a secondary to own no partitions")
+	}
+}
+
+func TestIsReadyOverride(t *testing.T) {
+	maxPrio = 10
+	cases := []struct {
+		override    ReadyOverride
+		maintenance bool
+		state       NodeState
+		priority    int
+		expReady    bool
+	}{
+		{OverrideNone, false, NodeReady, 10, true},
+		{OverrideNone, false, NodeReady, 11, false},
+		{OverrideNone, false, NodeNotReady, 0, false},
+		{OverrideReady, false, NodeReady, 11, true},
+		{OverrideReady, false, NodeNotReady, 0, false},
+		{OverrideNotReady, false, NodeReady, 0, false},
+		{OverrideReady, true, NodeReady, 0, false},
+		{OverrideNone, true, NodeReady, 0, false},
+	}
+	for i, c := range cases {
+		n := HTTPNode{State: c.state, Priority: c.priority, ReadyOverride: c.override, Maintenance: c.maintenance}
+		if n.IsReady() != c.expReady {
+			t.Errorf("case %d: expected ready %t, got %t", i, c.expReady, n.IsReady())
+		}
+	}
+}
+
+func TestIsReadyLagGating(t *testing.T) {
+	maxPrio = 10
+	defer func() { lagGating = LagGatingNode }()
+	cases := []struct {
+		gating     LagGating
+		partitions []int32
+		priority   int
+		prios      map[int32]int
+		expReady   bool
+	}{
+		{LagGatingNode, []int32{1, 2}, 20, map[int32]int{1: 0, 2: 20}, false},
+		{LagGatingNode, []int32{1, 2}, 0, map[int32]int{1: 0, 2: 0}, true},
+		{LagGatingReject, []int32{1, 2}, 20, map[int32]int{1: 0, 2: 20}, true},
+		{LagGatingReject, []int32{1, 2}, 20, map[int32]int{1: 20, 2: 20}, false},
+		{LagGatingDegrade, []int32{1, 2}, 20, map[int32]int{1: 20, 2: 20}, false},
+		{LagGatingDegrade, []int32{1, 2}, 20, map[int32]int{1: 20, 2: 5}, true},
+		// without priorities per partition, the priority of the node applies to all of them
+		{LagGatingReject, []int32{1, 2}, 20, nil, false},
+		{LagGatingReject, []int32{1, 2}, 5, nil, true},
+		{LagGatingReject, nil, 20, nil, false},
+		{LagGatingReject, nil, 5, nil, true},
+	}
+	for i, c := range cases {
+		lagGating = c.gating
+		n := HTTPNode{State: NodeReady, Partitions: c.partitions, Priority: c.priority, PartitionPriority: c.prios}
+		if n.IsReady() != c.expReady {
+			t.Errorf("case %d: expected ready %t, got %t", i, c.expReady, n.IsReady())
+		}
+	}
+}
+
+func TestReadyOverrideJSON(t *testing.T) {
+	in := HTTPNode{Name: "node1", ReadyOverride: OverrideNotReady, Maintenance: true}
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out HTTPNode
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.ReadyOverride != OverrideNotReady || !out.Maintenance {
+		t.Fatalf("expected override notReady and maintenance, got %s and %t", out.ReadyOverride, out.Maintenance)
+	}
+
+	// nodes that don't know about overrides yet don't send the fields
+	out = HTTPNode{}
+	if err := json.Unmarshal([]byte(`{"name":"node2"}`), &out); err != nil || out.ReadyOverride != OverrideNone {
+		t.Fatalf("expected no override, got %s (err %v)", out.ReadyOverride, err)
+	}
+	if _, err := ReadyOverrideFromString("maybe"); err == nil {
+		t.Fatal("expected error for unknown override")
+	}
+}
+
+func TestPeersForQueryZone(t *testing.T) {
+	Mode = ModeMulti
+	labels = map[string]string{"zone": "a"}
+	defer func() { labels = nil }()
+	Init("node1", "test", time.Now(), "http", 6060)
+	manager := Manager.(*MemberlistManager)
+	manager.SetPartitions([]int32{1})
+	maxPrio = 10
+	minAvailableShards = 0
+	manager.SetPriority(10)
+	manager.SetReady()
+	thisNode := manager.thisNode()
+	node := func(name, zone string, partition int32, priority int) HTTPNode {
+		return HTTPNode{Name: name, Partitions: []int32{partition}, State: NodeReady, Priority: priority, Labels: map[string]string{"zone": zone}}
+	}
+	manager.Lock()
+	manager.members = map[string]HTTPNode{
+		thisNode.GetName(): thisNode,
+		// partition 2 has a node in our zone
+		"node2": node("node2", "a", 2, 10),
+		"node3": node("node3", "b", 2, 10),
+		// partition 3 has no node in our zone
+		"node4": node("node4", "b", 3, 10),
+		// partition 4 only has a node in our zone with a higher priority
+		"node5": node("node5", "a", 4, 20),
+		"node6": node("node6", "b", 4, 10),
+	}
+	manager.Unlock()
+
+	crossZone := queryCrossZone.Peek()
+	for i := 0; i < 10; i++ {
+		selected, err := MembersForQuery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, n := range selected {
+			names[n.GetName()] = true
+		}
+		exp := map[string]bool{"node1": true, "node2": true, "node4": true, "node6": true}
+		if !reflect.DeepEqual(names, exp) {
+			t.Fatalf("expected nodes %v, got %v", exp, names)
+		}
+	}
+	if queryCrossZone.Peek() != crossZone+20 {
+		t.Fatalf("expected 2 cross zone partitions per query, got %d over 10 queries", queryCrossZone.Peek()-crossZone)
+	}
+}
+
+func TestPeersForQueryLagGating(t *testing.T) {
+	Mode = ModeMulti
+	defer func() { lagGating = LagGatingNode }()
+	Init("node1", "test", time.Now(), "http", 6060)
+	manager := Manager.(*MemberlistManager)
+	manager.SetPartitions([]int32{1, 2})
+	maxPrio = 10
+	minAvailableShards = 0
+	manager.SetPriority(20)
+	manager.SetPartitionPriority(map[int32]int{1: 0, 2: 20})
+	manager.SetReady()
+	thisNode := manager.thisNode()
+	manager.Lock()
+	manager.members = map[string]HTTPNode{
+		thisNode.GetName(): thisNode,
+		// lags on partition 1 instead of 2
+		"node2": {Name: "node2", Partitions: []int32{1, 2}, State: NodeReady, Priority: 20, PartitionPriority: map[int32]int{1: 20, 2: 5}},
+		// lags on partition 3, of which it is the only peer
+		"node3": {Name: "node3", Partitions: []int32{3, 4}, State: NodeReady, Priority: 30, PartitionPriority: map[int32]int{3: 30, 4: 0}},
+		// lags on all its partitions, so it's not ready
+		"node4": {Name: "node4", Partitions: []int32{5}, State: NodeReady, Priority: 30, PartitionPriority: map[int32]int{5: 30}},
+	}
+	manager.Unlock()
+
+	names := func() map[string]bool {
+		selected, err := MembersForQuery()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]bool)
+		for _, n := range selected {
+			names[n.GetName()] = true
+		}
+		return names
+	}
+
+	lagGating = LagGatingNode
+	if got := names(); len(got) != 0 {
+		t.Fatalf("expected lagging nodes not to be queried, got %v", got)
+	}
+
+	lagGating = LagGatingDegrade
+	lagging := queryLagging.Peek()
+	exp := map[string]bool{"node1": true, "node2": true, "node3": true}
+	if got := names(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected nodes %v, got %v", exp, got)
+	}
+	if queryLagging.Peek() != lagging+1 {
+		t.Fatalf("expected 1 lagging partition, got %d", queryLagging.Peek()-lagging)
+	}
+
+	lagGating = LagGatingReject
+	if _, err := MembersForQuery(); err == nil {
+		t.Fatalf("expected the query to be rejected because partition 3 lags")
+	}
+	manager.Lock()
+	delete(manager.members, "node3")
+	manager.Unlock()
+	exp = map[string]bool{"node1": true, "node2": true}
+	if got := names(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected nodes %v, got %v", exp, got)
+	}
+}
+
+func TestParseLabels(t *testing.T) {
+	got, err := parseLabels("zone=eu-west-1a, shard-group = a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := map[string]string{"zone": "eu-west-1a", "shard-group": "a"}; !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected labels %v, got %v", exp, got)
+	}
+	for _, s := range []string{"zone", "zone=", "=a", "zone=a,zone=b"} {
+		if _, err := parseLabels(s); err == nil {
+			t.Fatalf("expected an error for %q", s)
+		}
+	}
+}
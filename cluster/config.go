@@ -1,12 +1,16 @@
 package cluster
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/grafana/metrictank/conf"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 )
@@ -14,11 +18,16 @@ import (
 var (
 	ClusterName        string
 	primary            bool
+	dedupWrites        bool
 	peersStr           string
 	mode               string
 	maxPrio            int
 	httpTimeout        time.Duration
 	minAvailableShards int
+	labelsStr          string
+	labels             map[string]string
+	lagGatingStr       string
+	lagGating          LagGating
 
 	swimUseConfig               = "default-lan"
 	swimBindAddrStr             string
@@ -41,17 +50,24 @@ var (
 
 	client    http.Client
 	transport *http.Transport
+
+	// AddPeerHeaders, if set, adds headers to requests to peers, based on the context they are made in.
+	// e.g. to authenticate them with peers that run in strict multi-tenant mode
+	AddPeerHeaders func(ctx context.Context, header http.Header)
 )
 
 func ConfigSetup() {
 	clusterCfg := flag.NewFlagSet("cluster", flag.ExitOnError)
 	clusterCfg.StringVar(&ClusterName, "name", "metrictank", "Unique name of the cluster.")
 	clusterCfg.BoolVar(&primary, "primary-node", false, "the primary node writes data to cassandra. There should only be 1 primary node per shardGroup.")
+	clusterCfg.BoolVar(&dedupWrites, "dedup-writes", false, "of the primaries that consume a partition, only the owner saves the chunks of its series: the reachable one with the lowest name. lets you run all replicas as primaries, so that when one fails another takes over without promotion, while each chunk is only saved once")
 	clusterCfg.StringVar(&peersStr, "peers", "", "TCP addresses of other nodes, comma separated. use this if you shard your data and want to query other instances")
 	clusterCfg.StringVar(&mode, "mode", "single", "Operating mode of cluster. (single|multi)")
 	clusterCfg.DurationVar(&httpTimeout, "http-timeout", time.Second*60, "How long to wait before aborting http requests to cluster peers and returning a http 503 service unavailable")
 	clusterCfg.IntVar(&maxPrio, "max-priority", 10, "maximum priority before a node should be considered not-ready.")
 	clusterCfg.IntVar(&minAvailableShards, "min-available-shards", 0, "minimum number of shards that must be available for a query to be handled.")
+	clusterCfg.StringVar(&lagGatingStr, "lag-gating", "node", "how nodes that lag behind kafka by more than max-priority are kept out of queries. node: the whole node becomes not-ready when any of its partitions lags. reject: a node only stops serving the partitions that lag, unless all of them do, and queries fail when a partition has no peer within max-priority. degrade: like reject, but the least lagging peer serves such partitions anyway (node|reject|degrade)")
+	clusterCfg.StringVar(&labelsStr, "labels", "", "labels of this node, advertised to its peers, as a comma separated list of key=value, e.g. zone=eu-west-1a,shard-group=a. of the peers with the lowest priority for a partition, queries prefer the ones with the same zone label as this node")
 	globalconf.Register("cluster", clusterCfg)
 
 	swimCfg := flag.NewFlagSet("swim", flag.ExitOnError)
@@ -75,6 +91,50 @@ func ConfigSetup() {
 	globalconf.Register("swim", swimCfg)
 }
 
+// ConfigValidate checks the settings without setting up the cluster, for the validate-config mode.
+// notifiers is whether any notifier is enabled, which nodes need to learn about the chunks saved by the primary.
+func ConfigValidate(notifiers bool) []conf.Finding {
+	var findings []conf.Finding
+	if !validMode(mode) {
+		findings = append(findings, conf.NewError("cluster.mode", "invalid cluster operating mode %q. must be single or multi", mode))
+	}
+	if _, err := LagGatingFromString(lagGatingStr); err != nil {
+		findings = append(findings, conf.NewError("cluster.lag-gating", "%s", err))
+	}
+	if !primary && !notifiers {
+		findings = append(findings, conf.NewWarning("cluster.primary-node", "this secondary has no notifier enabled, so it won't learn which chunks the primary saved. when promoted, it saves all chunks it has in memory again"))
+	}
+	if mode != ModeMulti {
+		if peersStr != "" {
+			findings = append(findings, conf.NewWarning("cluster.peers", "peers are only used in multi mode"))
+		}
+		return findings
+	}
+
+	if primary && !notifiers {
+		findings = append(findings, conf.NewWarning("cluster.primary-node", "no notifier enabled, so secondaries won't learn which chunks this primary saved"))
+	}
+	if _, err := parseLabels(labelsStr); err != nil {
+		findings = append(findings, conf.NewError("cluster.labels", "%s", err))
+	}
+	if peersStr == "" {
+		findings = append(findings, conf.NewWarning("cluster.peers", "no peers set. this node can only join the cluster when other nodes connect to it"))
+	}
+	if httpTimeout == 0 {
+		findings = append(findings, conf.NewError("cluster.http-timeout", "must be a non-zero duration string like 60s"))
+	}
+	switch swimUseConfig {
+	case "manual":
+		if _, err := net.ResolveTCPAddr("tcp", swimBindAddrStr); err != nil {
+			findings = append(findings, conf.NewError("swim.bind-addr", "not a valid TCP address: %s", err))
+		}
+	case "default-lan", "default-local", "default-wan":
+	default:
+		findings = append(findings, conf.NewError("swim.use-config", "invalid setting %q", swimUseConfig))
+	}
+	return findings
+}
+
 func ConfigProcess() {
 
 	// check settings in cluster section
@@ -84,6 +144,12 @@ func ConfigProcess() {
 
 	Mode = ModeType(mode)
 
+	var err error
+	lagGating, err = LagGatingFromString(lagGatingStr)
+	if err != nil {
+		log.Fatal(4, "CLU Config: lag-gating: %s", err)
+	}
+
 	// all further stuff is only relevant in multi mode
 	if mode != ModeMulti {
 		return
@@ -93,6 +159,11 @@ func ConfigProcess() {
 		log.Fatal(4, "CLU Config: http-timeout must be a non-zero duration string like 60s")
 	}
 
+	labels, err = parseLabels(labelsStr)
+	if err != nil {
+		log.Fatal(4, "CLU Config: labels: %s", err)
+	}
+
 	transport = &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		Proxy:           http.ProxyFromEnvironment,
@@ -113,10 +184,32 @@ func ConfigProcess() {
 	}
 
 	if swimUseConfig == "manual" {
-		var err error
 		swimBindAddr, err = net.ResolveTCPAddr("tcp", swimBindAddrStr)
 		if err != nil {
 			log.Fatal(4, "CLU Config: swim-bind-addr is not a valid TCP address: %s", err.Error())
 		}
 	}
 }
+
+// parseLabels parses a comma separated list of key=value labels
+func parseLabels(s string) (map[string]string, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	labels := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q: must be key=value", l)
+		}
+		key, val := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if key == "" || val == "" {
+			return nil, fmt.Errorf("invalid label %q: key and value must not be empty", l)
+		}
+		if _, ok := labels[key]; ok {
+			return nil, fmt.Errorf("label %q is given more than once", key)
+		}
+		labels[key] = val
+	}
+	return labels, nil
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"sort"
+
+	"github.com/grafana/metrictank/health"
+)
+
+// MaxPriority returns the priority above which a node is considered not ready
+func MaxPriority() int {
+	return maxPrio
+}
+
+type clusterHealth struct {
+	Mode           ModeType      `json:"mode"`
+	ReadyOverride  ReadyOverride `json:"readyOverride"`  // of this node
+	Maintenance    bool          `json:"maintenance"`    // of this node
+	Peers          int           `json:"peers"`          // all members we know of, including this node
+	PeersReady     int           `json:"peersReady"`     // members that are ready to serve queries
+	Partitions     int           `json:"partitions"`     // partitions owned by any of the members
+	PartitionsDown []int32       `json:"partitionsDown"` // partitions without any ready member
+	// partitions of which all ready members lag more than max-priority. only unless lag-gating is node, otherwise such members are not ready
+	PartitionsLagging []int32 `json:"partitionsLagging"`
+}
+
+// Health reports how many peers are reachable and ready, and whether every partition can be queried.
+// peers that are unreachable are removed from the member list by the gossip protocol.
+func Health() health.Status {
+	detail := clusterHealth{
+		Mode:              Mode,
+		PartitionsDown:    []int32{},
+		PartitionsLagging: []int32{},
+	}
+	if n, ok := Manager.ThisNode().(HTTPNode); ok {
+		detail.ReadyOverride = n.ReadyOverride
+		detail.Maintenance = n.Maintenance
+	}
+	ready := make(map[int32]bool)
+	inSync := make(map[int32]bool)
+	for _, n := range Manager.MemberList() {
+		detail.Peers++
+		if n.IsReady() {
+			detail.PeersReady++
+		}
+		for _, p := range n.GetPartitions() {
+			ready[p] = ready[p] || n.IsReady()
+			inSync[p] = inSync[p] || n.IsReady() && partitionPriority(n, p) <= maxPrio
+		}
+	}
+	for p, ok := range ready {
+		if !ok {
+			detail.PartitionsDown = append(detail.PartitionsDown, p)
+		} else if !inSync[p] {
+			detail.PartitionsLagging = append(detail.PartitionsLagging, p)
+		}
+	}
+	detail.Partitions = len(ready)
+	sort.Sort(int32Slice(detail.PartitionsDown))
+	sort.Sort(int32Slice(detail.PartitionsLagging))
+
+	status := health.Status{State: health.OK, Detail: detail}
+	if detail.Maintenance {
+		status.Worsen(health.Degraded, "this node is in maintenance mode")
+	}
+	if len(detail.PartitionsDown) > 0 {
+		status.Worsen(health.Degraded, "no ready peer for partitions %v", detail.PartitionsDown)
+	}
+	if len(detail.PartitionsLagging) > 0 {
+		status.Worsen(health.Degraded, "all ready peers lag more than max-priority %d for partitions %v", maxPrio, detail.PartitionsLagging)
+	}
+	return status
+}
+
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
@@ -9,6 +9,8 @@ type Node interface {
 	IsReady() bool
 	GetPartitions() []int32
 	GetPriority() int
+	GetPartitionPriority(int32) int
+	GetLabels() map[string]string
 	Post(context.Context, string, string, Traceable) ([]byte, error)
 	GetName() string
 }
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/grafana/metrictank/crash"
 	"github.com/grafana/metrictank/stats"
 	"github.com/hashicorp/memberlist"
 	"github.com/raintank/worldping-api/pkg/log"
@@ -25,6 +26,8 @@ var (
 	nodeReady = stats.NewBool("cluster.self.state.ready")
 	// metric cluster.self.state.primary is whether this instance is a primary
 	nodePrimary = stats.NewBool("cluster.self.state.primary")
+	// metric cluster.self.state.maintenance is whether this instance is in maintenance mode, in which it ingests data but refuses queries
+	nodeMaintenance = stats.NewBool("cluster.self.state.maintenance")
 	// metric cluster.self.partitions is the number of partitions this instance consumes
 	nodePartitions = stats.NewGauge32("cluster.self.partitions")
 	// metric cluster.self.priority is the priority of the node. A lower number gives higher priority
@@ -49,16 +52,21 @@ var (
 
 type ClusterManager interface {
 	IsPrimary() bool
+	IsPrimaryFor(partition int32) bool
 	SetPrimary(bool)
 	IsReady() bool
 	SetReady()
 	SetState(NodeState)
+	SetReadyOverride(ReadyOverride)
+	IsMaintenance() bool
+	SetMaintenance(bool)
 	ThisNode() Node
 	MemberList() []Node
 	Join([]string) (int, error)
 	GetPartitions() []int32
 	SetPartitions([]int32)
 	SetPriority(int)
+	SetPartitionPriority(map[int32]int)
 	Stop()
 	Start()
 }
@@ -208,6 +216,7 @@ func (c *MemberlistManager) clusterStats() {
 }
 
 func (c *MemberlistManager) NotifyJoin(node *memberlist.Node) {
+	defer crash.Recover("cluster", gossipState(node))
 	eventsJoin.Inc()
 	c.Lock()
 	defer c.Unlock()
@@ -231,6 +240,7 @@ func (c *MemberlistManager) NotifyJoin(node *memberlist.Node) {
 }
 
 func (c *MemberlistManager) NotifyLeave(node *memberlist.Node) {
+	defer crash.Recover("cluster", gossipState(node))
 	eventsLeave.Inc()
 	c.Lock()
 	defer c.Unlock()
@@ -240,6 +250,7 @@ func (c *MemberlistManager) NotifyLeave(node *memberlist.Node) {
 }
 
 func (c *MemberlistManager) NotifyUpdate(node *memberlist.Node) {
+	defer crash.Recover("cluster", gossipState(node))
 	eventsUpdate.Inc()
 	c.Lock()
 	defer c.Unlock()
@@ -270,6 +281,13 @@ func (c *MemberlistManager) NotifyUpdate(node *memberlist.Node) {
 	c.clusterStats()
 }
 
+// gossipState is what we save if handling a membership event panics
+func gossipState(node *memberlist.Node) crash.State {
+	return func() interface{} {
+		return map[string]string{"node": node.Name, "addr": node.Addr.String(), "meta": string(node.Meta)}
+	}
+}
+
 func (c *MemberlistManager) BroadcastUpdate() {
 	if c.list != nil {
 		//notify our peers immediately of the change. If this fails, which will only happen if all peers
@@ -354,6 +372,46 @@ func (c *MemberlistManager) SetState(state NodeState) {
 	c.BroadcastUpdate()
 }
 
+// SetReadyOverride forces the readiness of this node, or makes it follow its state and priority again
+func (c *MemberlistManager) SetReadyOverride(o ReadyOverride) {
+	c.Lock()
+	if c.members[c.nodeName].ReadyOverride == o {
+		c.Unlock()
+		return
+	}
+	node := c.members[c.nodeName]
+	node.ReadyOverride = o
+	node.Updated = time.Now()
+	c.members[c.nodeName] = node
+	c.Unlock()
+	log.Info("CLU manager: readiness override set to %s", o)
+	c.BroadcastUpdate()
+}
+
+// Returns true if this node is in maintenance mode, in which it ingests data but refuses queries
+func (c *MemberlistManager) IsMaintenance() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.members[c.nodeName].Maintenance
+}
+
+// SetMaintenance sets the maintenance mode of this node
+func (c *MemberlistManager) SetMaintenance(m bool) {
+	c.Lock()
+	if c.members[c.nodeName].Maintenance == m {
+		c.Unlock()
+		return
+	}
+	node := c.members[c.nodeName]
+	node.Maintenance = m
+	node.Updated = time.Now()
+	c.members[c.nodeName] = node
+	c.Unlock()
+	nodeMaintenance.Set(m)
+	log.Info("CLU manager: maintenance mode set to %t", m)
+	c.BroadcastUpdate()
+}
+
 // Returns true if the this node is a set as a primary node that should write data to cassandra.
 func (c *MemberlistManager) IsPrimary() bool {
 	c.RLock()
@@ -361,6 +419,35 @@ func (c *MemberlistManager) IsPrimary() bool {
 	return c.members[c.nodeName].Primary
 }
 
+// IsPrimaryFor returns whether this node should write the data of the partition to cassandra:
+// whether it is a primary and, with dedup-writes enabled, whether it owns the partition.
+// the owner of a partition is the primary with the lowest name among the reachable primaries that consume it.
+func (c *MemberlistManager) IsPrimaryFor(partition int32) bool {
+	c.RLock()
+	defer c.RUnlock()
+	if !c.members[c.nodeName].Primary {
+		return false
+	}
+	if !dedupWrites {
+		return true
+	}
+	for name, node := range c.members {
+		if name < c.nodeName && node.Primary && node.State != NodeUnreachable && hasPartition(node.Partitions, partition) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasPartition(partitions []int32, partition int32) bool {
+	for _, p := range partitions {
+		if p == partition {
+			return true
+		}
+	}
+	return false
+}
+
 // SetPrimary sets the primary status of this node
 func (c *MemberlistManager) SetPrimary(p bool) {
 	c.Lock()
@@ -414,6 +501,22 @@ func (c *MemberlistManager) SetPriority(prio int) {
 	c.BroadcastUpdate()
 }
 
+// set the priority of each partition of this node.
+// lower values == higher priority
+func (c *MemberlistManager) SetPartitionPriority(prios map[int32]int) {
+	c.Lock()
+	if equalPriorities(c.members[c.nodeName].PartitionPriority, prios) {
+		c.Unlock()
+		return
+	}
+	node := c.members[c.nodeName]
+	node.PartitionPriority = prios
+	node.Updated = time.Now()
+	c.members[c.nodeName] = node
+	c.Unlock()
+	c.BroadcastUpdate()
+}
+
 func (c *MemberlistManager) Stop() {
 	c.list.Leave(time.Second)
 }
@@ -439,6 +542,11 @@ func (m *SingleNodeManager) IsPrimary() bool {
 	return m.node.Primary
 }
 
+// IsPrimaryFor returns whether this node is a primary: without peers, it owns all partitions
+func (m *SingleNodeManager) IsPrimaryFor(partition int32) bool {
+	return m.IsPrimary()
+}
+
 func (m *SingleNodeManager) SetPrimary(primary bool) {
 	m.Lock()
 	defer m.Unlock()
@@ -472,6 +580,35 @@ func (m *SingleNodeManager) SetState(state NodeState) {
 	nodeReady.Set(state == NodeReady)
 }
 
+func (m *SingleNodeManager) SetReadyOverride(o ReadyOverride) {
+	m.Lock()
+	defer m.Unlock()
+	if m.node.ReadyOverride == o {
+		return
+	}
+	m.node.ReadyOverride = o
+	m.node.Updated = time.Now()
+	log.Info("CLU manager: readiness override set to %s", o)
+}
+
+func (m *SingleNodeManager) IsMaintenance() bool {
+	m.RLock()
+	defer m.RUnlock()
+	return m.node.Maintenance
+}
+
+func (m *SingleNodeManager) SetMaintenance(maintenance bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.node.Maintenance == maintenance {
+		return
+	}
+	m.node.Maintenance = maintenance
+	m.node.Updated = time.Now()
+	nodeMaintenance.Set(maintenance)
+	log.Info("CLU manager: maintenance mode set to %t", maintenance)
+}
+
 func (m *SingleNodeManager) ThisNode() Node {
 	m.RLock()
 	defer m.RUnlock()
@@ -522,10 +659,34 @@ func (m *SingleNodeManager) SetPriority(prio int) {
 	nodePriority.Set(prio)
 }
 
+// set the priority of each partition of this node.
+// lower values == higher priority
+func (m *SingleNodeManager) SetPartitionPriority(prios map[int32]int) {
+	m.Lock()
+	defer m.Unlock()
+	if equalPriorities(m.node.PartitionPriority, prios) {
+		return
+	}
+	m.node.PartitionPriority = prios
+	m.node.Updated = time.Now()
+}
+
 func (m *SingleNodeManager) Stop() {
 	return
 }
 
+func equalPriorities(a, b map[int32]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for part, prio := range a {
+		if other, ok := b[part]; !ok || other != prio {
+			return false
+		}
+	}
+	return true
+}
+
 func toIf(in []HTTPNode) []Node {
 	out := make([]Node, len(in))
 	for i, m := range in {
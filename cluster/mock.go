@@ -12,6 +12,7 @@ type MockNode struct {
 	postResponse []byte
 	partitions   []int32
 	priority     int
+	labels       map[string]string
 }
 
 func (n *MockNode) IsLocal() bool {
@@ -30,6 +31,14 @@ func (n *MockNode) GetPriority() int {
 	return n.priority
 }
 
+func (n *MockNode) GetPartitionPriority(part int32) int {
+	return n.priority
+}
+
+func (n *MockNode) GetLabels() map[string]string {
+	return n.labels
+}
+
 func (n MockNode) Post(ctx context.Context, name, path string, body Traceable) ([]byte, error) {
 	return n.postResponse, nil
 }
@@ -52,6 +61,7 @@ type MockClusterManager struct {
 	thisNode        int
 	isPrimary       bool
 	isReady         bool
+	isMaintenance   bool
 	partitions      []int32
 }
 
@@ -71,10 +81,26 @@ func (c *MockClusterManager) SetReady()                  {}
 func (c *MockClusterManager) SetReadyIn(t time.Duration) {}
 func (c *MockClusterManager) SetState(NodeState)         {}
 
+func (c *MockClusterManager) SetReadyOverride(ReadyOverride) {}
+
+func (c *MockClusterManager) SetPartitionPriority(map[int32]int) {}
+
+func (c *MockClusterManager) IsMaintenance() bool {
+	return c.isMaintenance
+}
+
+func (c *MockClusterManager) SetMaintenance(maintenance bool) {
+	c.isMaintenance = maintenance
+}
+
 func (c *MockClusterManager) IsPrimary() bool {
 	return c.isPrimary
 }
 
+func (c *MockClusterManager) IsPrimaryFor(partition int32) bool {
+	return c.isPrimary
+}
+
 func (c *MockClusterManager) IsReady() bool {
 	return c.isReady
 }
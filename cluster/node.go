@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/grafana/metrictank/tracing"
@@ -66,6 +67,51 @@ func (n NodeState) MarshalJSON() ([]byte, error) {
 	return nil, fmt.Errorf("impossible nodestate %v", n)
 }
 
+// ReadyOverride lets an operator force the readiness of a node, regardless of its priority
+type ReadyOverride int
+
+const (
+	OverrideNone     ReadyOverride = iota // readiness follows the state and priority of the node
+	OverrideReady                         // ready once started, even if the priority is too high, e.g. because we lag behind
+	OverrideNotReady                      // never ready, so that peers stop sending queries to it. used to drain a node
+)
+
+var readyOverrideNames = []string{"none", "ready", "notReady"}
+
+func (o ReadyOverride) String() string {
+	if o < OverrideNone || o > OverrideNotReady {
+		return fmt.Sprintf("ReadyOverride(%d)", int(o))
+	}
+	return readyOverrideNames[o]
+}
+
+// ReadyOverrideFromString parses the name of a ReadyOverride, as returned by its String method
+func ReadyOverrideFromString(s string) (ReadyOverride, error) {
+	for i, name := range readyOverrideNames {
+		if name == s {
+			return ReadyOverride(i), nil
+		}
+	}
+	return OverrideNone, fmt.Errorf("unrecognized ReadyOverride %q. valid values are %s", s, strings.Join(readyOverrideNames, ", "))
+}
+
+func (o *ReadyOverride) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	override, err := ReadyOverrideFromString(s)
+	if err != nil {
+		return err
+	}
+	*o = override
+	return nil
+}
+
+func (o ReadyOverride) MarshalJSON() ([]byte, error) {
+	return json.Marshal(o.String())
+}
+
 type Error struct {
 	code int
 	err  error
@@ -102,25 +148,69 @@ type HTTPNode struct {
 	ApiScheme     string    `json:"apiScheme"`
 	Updated       time.Time `json:"updated"`
 	RemoteAddr    string    `json:"remoteAddr"`
-	local         bool
+	// set by operators. older nodes don't send these, which results in the defaults: no override and no maintenance
+	ReadyOverride ReadyOverride `json:"readyOverride"`
+	Maintenance   bool          `json:"maintenance"`
+	// set with the labels setting, such as the zone of the node. older nodes don't send these
+	Labels map[string]string `json:"labels,omitempty"`
+	// the priority of each partition, of which Priority is the max. older nodes and inputs without lag don't send these
+	PartitionPriority map[int32]int `json:"partitionPriority,omitempty"`
+	local             bool
 }
 
 func (n HTTPNode) RemoteURL() string {
 	return fmt.Sprintf("%s://%s:%d", n.ApiScheme, n.RemoteAddr, n.ApiPort)
 }
 
+// IsReady returns whether the node can serve queries.
+// a node in maintenance never is: it keeps ingesting, but refuses queries.
+// unless lag-gating is node, its priority is taken into account per partition instead,
+// and it's only not ready when all of its partitions lag more than max-priority.
 func (n HTTPNode) IsReady() bool {
-	return n.State == NodeReady && n.Priority <= maxPrio
+	if n.Maintenance {
+		return false
+	}
+	switch n.ReadyOverride {
+	case OverrideReady:
+		return n.State == NodeReady
+	case OverrideNotReady:
+		return false
+	}
+	if n.State != NodeReady {
+		return false
+	}
+	if lagGating == LagGatingNode || len(n.Partitions) == 0 {
+		return n.Priority <= maxPrio
+	}
+	for _, part := range n.Partitions {
+		if n.GetPartitionPriority(part) <= maxPrio {
+			return true
+		}
+	}
+	return false
 }
 
 func (n HTTPNode) GetPriority() int {
 	return n.Priority
 }
 
+// GetPartitionPriority returns the priority of the node for the partition,
+// or the priority of the whole node if it doesn't report one per partition
+func (n HTTPNode) GetPartitionPriority(part int32) int {
+	if prio, ok := n.PartitionPriority[part]; ok {
+		return prio
+	}
+	return n.Priority
+}
+
 func (n HTTPNode) GetPartitions() []int32 {
 	return n.Partitions
 }
 
+func (n HTTPNode) GetLabels() map[string]string {
+	return n.Labels
+}
+
 func (n HTTPNode) IsLocal() bool {
 	return n.local
 }
@@ -159,6 +249,9 @@ func (n HTTPNode) Post(ctx context.Context, name, path string, body Traceable) (
 		log.Error(3, "CLU failed to inject span into headers: %s", err)
 	}
 	req.Header.Add("Content-Type", "application/json")
+	if AddPeerHeaders != nil {
+		AddPeerHeaders(ctx, req.Header)
+	}
 
 	c := make(chan struct {
 		r   *http.Response
@@ -177,9 +270,12 @@ func (n HTTPNode) Post(ctx context.Context, name, path string, body Traceable) (
 	// then abort the http request.
 	select {
 	case <-ctx.Done():
-		log.Debug("CLU HTTPNode: context canceled. terminating request to peer %s", n.Name)
+		if LogLevel.Get() < 2 {
+			log.Debug("CLU HTTPNode: context canceled. terminating request to peer %s", n.Name)
+		}
 		transport.CancelRequest(req)
 		<-c // Wait for client.Do but ignore result
+		return nil, ctx.Err()
 	case resp := <-c:
 		err := resp.err
 		rsp := resp.r
@@ -190,8 +286,6 @@ func (n HTTPNode) Post(ctx context.Context, name, path string, body Traceable) (
 		}
 		return handleResp(rsp)
 	}
-
-	return nil, nil
 }
 
 func (n HTTPNode) GetName() string {
@@ -18,44 +18,77 @@ import (
 	"github.com/Dieterbe/profiletrigger/heap"
 	"github.com/Shopify/sarama"
 	"github.com/grafana/metrictank/api"
+	"github.com/grafana/metrictank/audit"
+	"github.com/grafana/metrictank/backfill"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/compact"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/encryption"
+	"github.com/grafana/metrictank/events"
+	"github.com/grafana/metrictank/features"
+	"github.com/grafana/metrictank/governor"
+	"github.com/grafana/metrictank/health"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/idx/cassandra"
+	"github.com/grafana/metrictank/idx/elasticsearch"
 	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/idx/postgres"
 	"github.com/grafana/metrictank/input"
 	inCarbon "github.com/grafana/metrictank/input/carbon"
+	"github.com/grafana/metrictank/input/enrich"
 	inKafkaMdm "github.com/grafana/metrictank/input/kafkamdm"
+	inOTLP "github.com/grafana/metrictank/input/otlp"
 	inPrometheus "github.com/grafana/metrictank/input/prometheus"
+	"github.com/grafana/metrictank/input/quota"
+	"github.com/grafana/metrictank/input/validation"
+	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/cache"
 	"github.com/grafana/metrictank/mdata/notifierKafka"
 	"github.com/grafana/metrictank/mdata/notifierNsq"
+	"github.com/grafana/metrictank/mdata/pin"
+	"github.com/grafana/metrictank/mdata/wal"
+	"github.com/grafana/metrictank/recording"
+	"github.com/grafana/metrictank/secrets"
+	"github.com/grafana/metrictank/standby"
 	"github.com/grafana/metrictank/stats"
 	statsConfig "github.com/grafana/metrictank/stats/config"
+	bigtableStore "github.com/grafana/metrictank/store/bigtable"
 	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	s3Store "github.com/grafana/metrictank/store/s3"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/verify"
 	"github.com/raintank/dur"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
+	schema "gopkg.in/raintank/schema.v1"
 )
 
 var (
-	logLevel     int
-	warmupPeriod time.Duration
-	startupTime  time.Time
-	gitHash      = "(none)"
+	logLevel        int
+	logFormat       string
+	warmupPeriod    time.Duration
+	shutdownTimeout time.Duration
+	startupTime     time.Time
+	gitHash         = "(none)"
 
 	metrics     *mdata.AggMetrics
 	metricIndex idx.MetricIndex
 	apiServer   *api.Server
 	inputs      []input.Plugin
 	store       mdata.Store
+	writeLog    *wal.WAL
+	recorder    *recording.Recorder
+	forwarder   *standby.Forwarder
 
 	// Misc:
 	instance    = flag.String("instance", "default", "instance identifier. must be unique. used in clustering messages, for naming queue consumers and emitted metrics")
 	showVersion = flag.Bool("version", false, "print version string")
 	confFile    = flag.String("config", "/etc/metrictank/metrictank.ini", "configuration file path")
 
+	validateConfigMode = flag.Bool("validate-config", false, "validate the configuration, including settings that depend on each other, print the findings as json and exit. exits with status 1 if there are errors. does not connect to any services")
+
 	// Data:
 	dropFirstChunk    = flag.Bool("drop-first-chunk", false, "forego persisting of first received (and typically incomplete) chunk")
 	chunkMaxStaleStr  = flag.String("chunk-max-stale", "1h", "max age for a chunk before to be considered stale and to be persisted to Cassandra.")
@@ -63,6 +96,11 @@ var (
 	gcIntervalStr     = flag.String("gc-interval", "1h", "Interval to run garbage collection job.")
 	warmUpPeriodStr   = flag.String("warm-up-period", "1h", "duration before secondary nodes start serving requests")
 	publicOrg         = flag.Int("public-org", 0, "org Id for publically (any org) accessible data. leave 0 to disable")
+	viewsFile         = flag.String("views-file", "", "path to a file defining views, which share selected series of one org read-only with other orgs. empty to disable")
+
+	// Shutdown:
+	shutdownTimeoutStr    = flag.String("shutdown-timeout", "2m", "max duration of the shutdown: stopping inputs, persisting open chunks, draining the write queues and closing the index")
+	shutdownPersistChunks = flag.Bool("shutdown-persist-chunks", true, "primaries persist open (incomplete) chunks when shutting down. disable if a secondary will always be promoted to take over")
 
 	// Profiling, instrumentation and logging:
 	blockProfileRate = flag.Int("block-profile-rate", 0, "see https://golang.org/pkg/runtime/#SetBlockProfileRate")
@@ -76,10 +114,17 @@ var (
 	tracingEnabled = flag.Bool("tracing-enabled", false, "enable/disable distributed opentracing via jaeger")
 	tracingAddr    = flag.String("tracing-addr", "localhost:6831", "address of the jaeger agent to send data to")
 	tracingAddTags = flag.String("tracing-add-tags", "", "tracer/process-level tags to include, specified as comma-separated key:value pairs")
+
+	tracingSampleRates     = flag.String("tracing-sample-rates", "*=1", "fraction of requests to trace, per endpoint, as comma-separated endpoint=rate pairs. * for all other endpoints. e.g. /render=0.1,/metrics/find=0.01,*=1")
+	tracingSlowThresholds  = flag.String("tracing-slow-thresholds", "", "trace requests that take longer than this, regardless of the sampling rate, per endpoint, as comma-separated endpoint=duration pairs. e.g. /render=5s")
+	tracingAdaptive        = flag.Bool("tracing-adaptive", false, "trace all requests to an endpoint while its error rate over the last minute is above tracing-adaptive-error-rate")
+	tracingAdaptiveErrRate = flag.Float64("tracing-adaptive-error-rate", 0.05, "error rate (fraction of requests that return a 5xx status) above which the adaptive mode traces all requests to an endpoint")
+	tracingMaxForced       = flag.Float64("tracing-max-forced", 10, "max traces per second of requests that were not sampled but were slow or failed. 0 for no limit")
 )
 
 func init() {
 	flag.IntVar(&logLevel, "log-level", 2, "log level. 0=TRACE|1=DEBUG|2=INFO|3=WARN|4=ERROR|5=CRITICAL|6=FATAL")
+	flag.StringVar(&logFormat, "log-format", "text", "log format. text or json. json messages also have the ids of the request (and trace) or the kafka message they relate to as separate fields")
 }
 
 func main() {
@@ -88,7 +133,8 @@ func main() {
 	/***********************************
 		Initialize Logger
 	***********************************/
-	log.NewLogger(0, "console", fmt.Sprintf(`{"level": %d, "formatting":false}`, logLevel))
+	// the format is applied once the configuration is loaded
+	log.NewLogger(0, "metrictank", "")
 
 	/***********************************
 		Initialize Configuration
@@ -118,6 +164,10 @@ func main() {
 	inCarbon.ConfigSetup()
 	inKafkaMdm.ConfigSetup()
 	inPrometheus.ConfigSetup()
+	inOTLP.ConfigSetup()
+	quota.ConfigSetup()
+	enrich.ConfigSetup()
+	validation.ConfigSetup()
 
 	// load config for cluster handlers
 	notifierNsq.ConfigSetup()
@@ -125,6 +175,8 @@ func main() {
 	// load config for metricIndexers
 	memory.ConfigSetup()
 	cassandra.ConfigSetup()
+	elasticsearch.ConfigSetup()
+	postgres.ConfigSetup()
 
 	// load config for API
 	api.ConfigSetup()
@@ -138,35 +190,74 @@ func main() {
 	// storage-schemas, storage-aggregation files
 	mdata.ConfigSetup()
 
+	// write-ahead log
+	wal.ConfigSetup()
+
 	// cassandra Store
 	cassandraStore.ConfigSetup()
 
+	// bigtable Store
+	bigtableStore.ConfigSetup()
+
+	// s3 cold store
+	s3Store.ConfigSetup()
+
+	// credentials from env, files or vault
+	secrets.ConfigSetup()
+
+	// encryption of the chunks of selected orgs
+	encryption.ConfigSetup()
+
+	// feature flags
+	features.ConfigSetup()
+
+	// memory governor
+	governor.ConfigSetup()
+
+	// audit log
+	audit.ConfigSetup()
+
+	// panic recovery
+	crash.ConfigSetup()
+
+	// events
+	events.ConfigSetup()
+
+	// rollup verifier
+	verify.ConfigSetup()
+
+	// rollup backfill
+	backfill.ConfigSetup()
+
+	// chunk compaction
+	compact.ConfigSetup()
+
+	// standby replication
+	standby.ConfigSetup()
+
+	// recording rules
+	recording.ConfigSetup()
+
 	config.ParseAll()
 
+	if *validateConfigMode {
+		os.Exit(validateConfig())
+	}
+
 	/***********************************
-		Set logging levels
+		Set logging format and levels
 	***********************************/
-	mdata.LogLevel = logLevel
-	memory.LogLevel = logLevel
-	inKafkaMdm.LogLevel = logLevel
-	api.LogLevel = logLevel
-	// workaround for https://github.com/grafana/grafana/issues/4055
-	switch logLevel {
-	case 0:
-		log.Level(log.TRACE)
-	case 1:
-		log.Level(log.DEBUG)
-	case 2:
-		log.Level(log.INFO)
-	case 3:
-		log.Level(log.WARN)
-	case 4:
-		log.Level(log.ERROR)
-	case 5:
-		log.Level(log.CRITICAL)
-	case 6:
-		log.Level(log.FATAL)
+	if err := logger.SetFormat(logFormat); err != nil {
+		log.Fatal(4, "%s", err)
 	}
+	// the log level of these modules can be changed at runtime via the /loglevel endpoint
+	api.SetLogLevel(logLevel)
+	api.RegisterLogModule("store", &mdata.LogLevel, &cache.LogLevel, &cassandraStore.LogLevel, &bigtableStore.LogLevel, &s3Store.LogLevel)
+	api.RegisterLogModule("idx", &memory.LogLevel, &cassandra.LogLevel, &elasticsearch.LogLevel, &postgres.LogLevel)
+	api.RegisterLogModule("cluster", &cluster.LogLevel)
+	api.RegisterLogModule("input", &input.LogLevel, &inKafkaMdm.LogLevel)
+	api.RegisterLogModule("api", &api.LogLevel)
+	api.RegisterLogModule("governor", &governor.LogLevel)
 
 	/***********************************
 		Validate  settings needed for clustering
@@ -177,6 +268,13 @@ func main() {
 
 	log.Info("Metrictank starting. Built from %s - Go version %s", gitHash, runtime.Version())
 
+	// must come before any of the settings holding credentials are processed
+	secrets.ConfigProcess()
+	encryption.ConfigProcess()
+	features.ConfigProcess()
+	governor.ConfigProcess()
+	crash.ConfigProcess()
+
 	/***********************************
 		Initialize our Cluster
 	***********************************/
@@ -199,18 +297,38 @@ func main() {
 	inCarbon.ConfigProcess()
 	inKafkaMdm.ConfigProcess(*instance)
 	inPrometheus.ConfigProcess()
+	inOTLP.ConfigProcess()
+	quota.ConfigProcess()
+	enrich.ConfigProcess()
+	validation.ConfigProcess()
+	memory.ConfigProcess()
+	elasticsearch.ConfigProcess()
+	postgres.ConfigProcess()
 	notifierNsq.ConfigProcess()
 	notifierKafka.ConfigProcess(*instance)
 	statsConfig.ConfigProcess(*instance)
 	mdata.ConfigProcess()
-
-	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inPrometheus.Enabled {
+	cache.ConfigProcess()
+	audit.ConfigProcess(*instance)
+	events.ConfigProcess()
+	verify.ConfigProcess()
+	backfill.ConfigProcess()
+	compact.ConfigProcess()
+	standby.ConfigProcess()
+	recording.ConfigProcess(inKafkaMdm.Enabled)
+	s3Store.ConfigProcess()
+	wal.ConfigProcess()
+
+	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inPrometheus.Enabled && !inOTLP.Enabled {
 		log.Fatal(4, "you should enable at least 1 input plugin")
 	}
 
 	sec := dur.MustParseNDuration("warm-up-period", *warmUpPeriodStr)
 	warmupPeriod = time.Duration(sec) * time.Second
 
+	sec = dur.MustParseNDuration("shutdown-timeout", *shutdownTimeoutStr)
+	shutdownTimeout = time.Duration(sec) * time.Second
+
 	chunkMaxStale := dur.MustParseNDuration("chunk-max-stale", *chunkMaxStaleStr)
 	metricMaxStale := dur.MustParseNDuration("metric-max-stale", *metricMaxStaleStr)
 	gcInterval := time.Duration(dur.MustParseNDuration("gc-interval", *gcIntervalStr)) * time.Second
@@ -266,15 +384,62 @@ func main() {
 		log.Fatal(4, "Could not initialize jaeger tracer: %s", err.Error())
 	}
 	defer traceCloser.Close()
+	traceSampling, err := tracing.ParseSampling(*tracingSampleRates, *tracingSlowThresholds, *tracingAdaptive, *tracingAdaptiveErrRate, *tracingMaxForced)
+	if err != nil {
+		log.Fatal(4, "invalid tracing sampling settings: %s", err)
+	}
 
 	/***********************************
 		Initialize our backendStore
 	***********************************/
-	store, err = cassandraStore.NewCassandraStore(cassandraStore.CliConfig, mdata.TTLs())
-	if err != nil {
-		log.Fatal(4, "failed to initialize cassandra. %s", err)
+	// the store used for chunks must also be able to create the storage for new ttls and report its health
+	var chunkStore interface {
+		mdata.Store
+		health.Reporter
+		EnsureTTLs(ttls []uint32) error
+	}
+	// with the cold store, the hot store only keeps the chunks of long retentions for hot-ttl
+	ttls := mdata.TTLs()
+	if s3Store.CliConfig.Enabled {
+		ttls = s3Store.HotTTLs(s3Store.CliConfig, ttls)
+	}
+	var casStore *cassandraStore.CassandraStore
+	if bigtableStore.CliConfig.Enabled {
+		btStore, err := bigtableStore.NewStore(bigtableStore.CliConfig, ttls)
+		if err != nil {
+			log.Fatal(4, "failed to initialize bigtable. %s", err)
+		}
+		chunkStore = btStore
+	} else {
+		casStore, err = cassandraStore.NewCassandraStore(cassandraStore.CliConfig, ttls)
+		if err != nil {
+			log.Fatal(4, "failed to initialize cassandra. %s", err)
+		}
+		chunkStore = casStore
+	}
+	var coldStore *s3Store.Store
+	if s3Store.CliConfig.Enabled {
+		coldStore, err = s3Store.NewStore(s3Store.CliConfig, chunkStore)
+		if err != nil {
+			log.Fatal(4, "failed to initialize the s3 store. %s", err)
+		}
+		chunkStore = coldStore
+	}
+	chunkStore.SetTracer(tracer)
+	store = chunkStore
+	// the index loads the storage overrides, which may use TTLs the store isn't prepared for yet
+	mdata.EnsureTTLs = chunkStore.EnsureTTLs
+
+	var eventStore events.Store
+	if events.Enabled {
+		if casStore == nil {
+			log.Fatal(4, "the event store requires the cassandra store, which is not used when the bigtable store is enabled")
+		}
+		eventStore, err = cassandraStore.NewEventStore(casStore, events.TTL)
+		if err != nil {
+			log.Fatal(4, "failed to initialize the event store. %s", err)
+		}
 	}
-	store.SetTracer(tracer)
 
 	/***********************************
 		Initialize the Chunk Cache
@@ -282,10 +447,14 @@ func main() {
 	ccache := cache.NewCCache()
 	ccache.SetTracer(tracer)
 
+	// series pinned through the api are kept in memory by the chunk cache and the memory store
+	pins := pin.New()
+	ccache.SetPins(pins)
+
 	/***********************************
 		Initialize our MemoryStore
 	***********************************/
-	metrics = mdata.NewAggMetrics(store, ccache, *dropFirstChunk, chunkMaxStale, metricMaxStale, gcInterval)
+	metrics = mdata.NewAggMetrics(store, ccache, *dropFirstChunk, chunkMaxStale, metricMaxStale, gcInterval, pins)
 
 	/***********************************
 		Initialize our Inputs
@@ -299,6 +468,10 @@ func main() {
 		inputs = append(inputs, inPrometheus.New())
 	}
 
+	if inOTLP.Enabled {
+		inputs = append(inputs, inOTLP.New())
+	}
+
 	if inKafkaMdm.Enabled {
 		sarama.Logger = l.New(os.Stdout, "[Sarama] ", l.LstdFlags)
 		inputs = append(inputs, inKafkaMdm.New())
@@ -321,9 +494,20 @@ func main() {
 	if *publicOrg < 0 {
 		log.Fatal(4, "public-org cannot be <0")
 	}
+	if api.StrictMultiTenant && *publicOrg != 0 {
+		log.Fatal(4, "public-org must be 0 in strict multi-tenant mode")
+	}
 
 	idx.OrgIdPublic = uint32(*publicOrg)
 
+	if *viewsFile != "" {
+		views, err := idx.ReadViews(*viewsFile)
+		if err != nil {
+			log.Fatal(4, "Cannot read views-file %q: %s", *viewsFile, err)
+		}
+		idx.SharedViews = views
+	}
+
 	if memory.Enabled {
 		if metricIndex != nil {
 			log.Fatal(4, "Only 1 metricIndex handler can be enabled.")
@@ -336,6 +520,18 @@ func main() {
 		}
 		metricIndex = cassandra.New()
 	}
+	if elasticsearch.Enabled {
+		if metricIndex != nil {
+			log.Fatal(4, "Only 1 metricIndex handler can be enabled.")
+		}
+		metricIndex = elasticsearch.New()
+	}
+	if postgres.Enabled {
+		if metricIndex != nil {
+			log.Fatal(4, "Only 1 metricIndex handler can be enabled.")
+		}
+		metricIndex = postgres.New()
+	}
 
 	if metricIndex == nil {
 		log.Fatal(4, "No metricIndex handlers enabled.")
@@ -353,8 +549,22 @@ func main() {
 	apiServer.BindMemoryStore(metrics)
 	apiServer.BindBackendStore(store)
 	apiServer.BindCache(ccache)
+	apiServer.BindPins(pins)
 	apiServer.BindTracer(tracer)
+	apiServer.BindTraceSampling(traceSampling)
+	apiServer.BindEventStore(eventStore)
 	apiServer.BindPromQueryEngine()
+	apiServer.BindHealthReporter("store", chunkStore)
+	if r, ok := chunkStore.(health.QueueReporter); ok {
+		apiServer.BindQueueReporter("store", r)
+	}
+	apiServer.BindHealthReporter("cluster", health.ReporterFunc(cluster.Health))
+	if r, ok := metricIndex.(health.Reporter); ok {
+		apiServer.BindHealthReporter("idx", r)
+	}
+	if r, ok := metricIndex.(health.ProgressReporter); ok {
+		apiServer.BindProgressReporter("idx", r)
+	}
 	cluster.Tracer = tracer
 	go apiServer.Run()
 
@@ -367,6 +577,21 @@ func main() {
 	}
 	log.Info("metricIndex initialized in %s. starting data consumption", time.Now().Sub(pre))
 
+	/***********************************
+		Replay the write-ahead log
+	***********************************/
+	writeLog, err = wal.New()
+	if err != nil {
+		log.Fatal(4, "failed to open the write-ahead log: %s", err)
+	}
+	err = writeLog.Replay(metrics, func(key schema.MKey) (uint16, uint16, bool) {
+		archive, ok := metricIndex.Get(key)
+		return archive.SchemaId, archive.AggId, ok
+	})
+	if err != nil {
+		log.Fatal(4, "failed to replay the write-ahead log: %s", err)
+	}
+
 	/***********************************
 		Initialize MetricPersist notifiers
 	***********************************/
@@ -383,21 +608,86 @@ func main() {
 
 	mdata.InitPersistNotifier(handlers...)
 
+	if standby.Enabled {
+		forwarder = standby.New(metrics)
+		forwarder.Start()
+	}
+
 	/***********************************
 		Start our inputs
 	***********************************/
+	ingestQuota := quota.New(metricIndex)
+	enricher := enrich.New()
+	validator := validation.New()
 	pluginFatal := make(chan struct{})
 	for _, plugin := range inputs {
 		if carbonPlugin, ok := plugin.(*inCarbon.Carbon); ok {
 			carbonPlugin.IntervalGetter(inCarbon.NewIndexIntervalGetter(metricIndex))
 		}
-		err = plugin.Start(input.NewDefaultHandler(metrics, metricIndex, plugin.Name()), pluginFatal)
+		if promPlugin, ok := plugin.(*inPrometheus.Prometheus); ok {
+			promPlugin.IntervalGetter(inPrometheus.NewIndexIntervalGetter(metricIndex))
+		}
+		if otlpPlugin, ok := plugin.(*inOTLP.OTLP); ok {
+			otlpPlugin.IntervalGetter(inOTLP.NewIndexIntervalGetter(metricIndex))
+		}
+		err = plugin.Start(input.NewDefaultHandler(metrics, metricIndex, writeLog, ingestQuota, enricher, validator, plugin.Name()), pluginFatal)
 		if err != nil {
 			shutdown()
 			return
 		}
 		plugin.MaintainPriority()
 		apiServer.BindPrioritySetter(plugin)
+		if r, ok := plugin.(health.Reporter); ok {
+			apiServer.BindHealthReporter("input."+plugin.Name(), r)
+		}
+		if r, ok := plugin.(health.ProgressReporter); ok {
+			apiServer.BindProgressReporter("input."+plugin.Name(), r)
+		}
+		if r, ok := plugin.(health.LagReporter); ok {
+			apiServer.BindLagReporter("input."+plugin.Name(), r)
+		}
+	}
+
+	/***********************************
+		Start the rollup verifier
+	***********************************/
+	rollupVerifier := verify.New(metricIndex, store)
+	apiServer.BindRollupVerifier(rollupVerifier)
+	if verify.Enabled {
+		go rollupVerifier.Run()
+	}
+	apiServer.BindRollupBackfiller(backfill.New(metricIndex, store))
+	apiServer.BindCompactor(compact.New(metricIndex, store))
+
+	/***********************************
+		Start the recording rules
+	***********************************/
+	// the points of the recorded series are not subject to the ingestion quota, nor validated or enriched
+	recorder, err = recording.New(apiServer, input.NewDefaultHandler(metrics, metricIndex, writeLog, nil, nil, nil, "recording"), tracer)
+	if err != nil {
+		log.Fatal(4, "failed to initialize recording rules: %s", err)
+	}
+	recorder.Start()
+
+	/***********************************
+		Start moving old chunks to the cold store
+	***********************************/
+	if coldStore != nil {
+		go s3Store.NewMover(coldStore, metricIndex, *instance).Run()
+	}
+
+	/***********************************
+		Start the memory governor
+	***********************************/
+	if governor.Enabled {
+		// only kafka can be paused: other inputs would lose the data sent in the meantime
+		var pausers []governor.Pauser
+		for _, plugin := range inputs {
+			if p, ok := plugin.(*inKafkaMdm.KafkaMdm); ok {
+				pausers = append(pausers, p)
+			}
+		}
+		go governor.New(ccache, pausers).Run()
 	}
 
 	// metric cluster.self.promotion_wait is how long a candidate (secondary node) has to wait until it can become a primary
@@ -414,9 +704,34 @@ func main() {
 	if cluster.Manager.IsPrimary() {
 		cluster.Manager.SetReady()
 	} else {
+		warmedUp := time.Now().Add(warmupPeriod)
 		time.AfterFunc(warmupPeriod, cluster.Manager.SetReady)
+		apiServer.BindProgressReporter("warm-up", health.ProgressReporterFunc(func() health.Progress {
+			remaining := int(time.Until(warmedUp).Seconds() + 0.5)
+			if remaining <= 0 {
+				return health.Progress{Done: true}
+			}
+			return health.Progress{ETA: remaining}
+		}))
 	}
 
+	/***********************************
+		Reload storage-schemas and storage-aggregation on SIGHUP
+	***********************************/
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			log.Info("Received SIGHUP. Reloading storage-schemas and storage-aggregation config")
+			err := mdata.ReloadConfig(chunkStore.EnsureTTLs)
+			if err != nil {
+				log.Error(3, "Failed to reload storage config, keeping the current one: %s", err)
+				continue
+			}
+			log.Info("Storage config reloaded. now at version %d. new settings apply to new series", mdata.GetConfigStatus().Version)
+		}
+	}()
+
 	/***********************************
 		Wait for Shutdown
 	***********************************/
@@ -429,7 +744,15 @@ func main() {
 	shutdown()
 }
 
+// metric tank.shutdown.chunks_not_persisted is the number of chunks that were not saved to the store when shutting down
+var chunksNotPersisted = stats.NewGauge32("tank.shutdown.chunks_not_persisted")
+
+// shutdown stops consuming data and makes sure that everything we consumed is saved, in order:
+// stop the inputs, persist the open chunks (if we're a primary), wait for the store to save them and close the index.
+// everything must complete within shutdownTimeout, after which we give up and report what was not saved.
 func shutdown() {
+	deadline := time.Now().Add(shutdownTimeout)
+
 	// Leave the cluster. All other nodes will be notified we have left
 	// and so will stop sending us requests.
 	cluster.Stop()
@@ -437,34 +760,84 @@ func shutdown() {
 	// stop API
 	apiServer.Stop()
 
+	// stop the recording rules, which would otherwise keep writing data
+	recorder.Stop()
+
 	// shutdown our input plugins.  These may take a while as we allow them
 	// to finish processing any metrics that have already been ingested.
-	timer := time.NewTimer(time.Second * 10)
-	var wg sync.WaitGroup
-	for _, plugin := range inputs {
-		wg.Add(1)
-		go func(plugin input.Plugin) {
-			log.Info("Shutting down %s consumer", plugin.Name())
-			plugin.Stop()
-			log.Info("%s consumer finished shutdown", plugin.Name())
-			wg.Done()
-		}(plugin)
-	}
-	pluginsStopped := make(chan struct{})
-	go func() {
+	stopped := runUntil(deadline, func() {
+		var wg sync.WaitGroup
+		for _, plugin := range inputs {
+			wg.Add(1)
+			go func(plugin input.Plugin) {
+				log.Info("Shutting down %s consumer", plugin.Name())
+				plugin.Stop()
+				log.Info("%s consumer finished shutdown", plugin.Name())
+				wg.Done()
+			}(plugin)
+		}
 		wg.Wait()
-		close(pluginsStopped)
-	}()
-	select {
-	case <-timer.C:
+	})
+	if !stopped {
 		log.Warn("Plugins taking too long to shutdown, not waiting any longer.")
-	case <-pluginsStopped:
-		timer.Stop()
+	}
+	writeLog.Close()
+
+	// send the secondaries the chunks that are still queued
+	if forwarder != nil {
+		forwarder.Stop()
+	}
+
+	// without persisting them, the data of the open chunks is lost, unless a secondary gets promoted.
+	// we don't notify our peers about the chunks persisted here, so that such a secondary saves its complete version.
+	if !cluster.Manager.IsPrimary() {
+		log.Info("not a primary. not persisting open chunks")
+	} else if !*shutdownPersistChunks {
+		log.Info("shutdown-persist-chunks disabled. not persisting open chunks")
+	} else {
+		log.Info("persisting open chunks")
+		var flushed int
+		if runUntil(deadline, func() { flushed = metrics.Flush() }) {
+			log.Info("sent %d open chunks to the store", flushed)
+		} else {
+			log.Error(3, "timed out sending open chunks to the store. the chunks of some series will not be persisted")
+		}
+	}
+
+	if cs, ok := store.(interface{ Drain(time.Duration) int }); ok {
+		log.Info("waiting for the store to save pending chunks")
+		notPersisted := cs.Drain(time.Until(deadline))
+		chunksNotPersisted.Set(notPersisted)
+		if notPersisted > 0 {
+			log.Error(3, "shutdown-timeout reached. %d chunks were not persisted", notPersisted)
+		} else {
+			log.Info("all chunks persisted")
+		}
 	}
 
 	log.Info("closing store")
 	store.Stop()
-	metricIndex.Stop()
+	if !runUntil(deadline, metricIndex.Stop) {
+		log.Error(3, "shutdown-timeout reached while closing the index. index updates may not have been saved")
+	}
 	log.Info("terminating.")
 	log.Close()
 }
+
+// runUntil runs fn and waits until it returns or the deadline passes.
+// it returns whether fn completed.
+func runUntil(deadline time.Time, fn func()) bool {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
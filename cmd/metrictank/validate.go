@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/grafana/metrictank/api"
+	"github.com/grafana/metrictank/audit"
+	"github.com/grafana/metrictank/backfill"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/compact"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/encryption"
+	"github.com/grafana/metrictank/events"
+	"github.com/grafana/metrictank/features"
+	"github.com/grafana/metrictank/governor"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/elasticsearch"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/idx/postgres"
+	inCarbon "github.com/grafana/metrictank/input/carbon"
+	"github.com/grafana/metrictank/input/enrich"
+	inKafkaMdm "github.com/grafana/metrictank/input/kafkamdm"
+	inOTLP "github.com/grafana/metrictank/input/otlp"
+	inPrometheus "github.com/grafana/metrictank/input/prometheus"
+	"github.com/grafana/metrictank/input/quota"
+	"github.com/grafana/metrictank/input/validation"
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/notifierKafka"
+	"github.com/grafana/metrictank/mdata/notifierNsq"
+	"github.com/grafana/metrictank/mdata/wal"
+	"github.com/grafana/metrictank/recording"
+	"github.com/grafana/metrictank/standby"
+	bigtableStore "github.com/grafana/metrictank/store/bigtable"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	s3Store "github.com/grafana/metrictank/store/s3"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/verify"
+	"github.com/raintank/dur"
+)
+
+type validationResult struct {
+	Valid    bool           `json:"valid"`
+	Findings []conf.Finding `json:"findings"`
+}
+
+// validateConfig checks the loaded configuration, including the settings that depend on each other,
+// without connecting to any of the services metrictank uses. it prints the findings as json
+// and returns the exit code: 1 if there are any errors, 0 otherwise.
+func validateConfig() int {
+	findings := validate()
+	res := validationResult{
+		Valid:    true,
+		Findings: findings,
+	}
+	if res.Findings == nil {
+		res.Findings = []conf.Finding{}
+	}
+	for _, f := range findings {
+		if f.Error {
+			res.Valid = false
+		}
+	}
+	out, err := json.MarshalIndent(res, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode findings: %s\n", err)
+		return 1
+	}
+	fmt.Println(string(out))
+	if !res.Valid {
+		return 1
+	}
+	return 0
+}
+
+func validate() []conf.Finding {
+	var findings []conf.Finding
+
+	if *instance == "" {
+		findings = append(findings, conf.NewError("instance", "can't be empty"))
+	}
+	if err := logger.SetFormat(logFormat); err != nil {
+		findings = append(findings, conf.NewError("log-format", "%s", err))
+	}
+	if !inCarbon.Enabled && !inKafkaMdm.Enabled && !inPrometheus.Enabled && !inOTLP.Enabled {
+		findings = append(findings, conf.NewError("inputs", "you should enable at least 1 input plugin"))
+	}
+
+	durations := []struct {
+		setting string
+		str     *string
+	}{
+		{"chunk-max-stale", chunkMaxStaleStr},
+		{"metric-max-stale", metricMaxStaleStr},
+		{"gc-interval", gcIntervalStr},
+		{"warm-up-period", warmUpPeriodStr},
+		{"shutdown-timeout", shutdownTimeoutStr},
+	}
+	parsed := make(map[string]uint32)
+	for _, d := range durations {
+		sec, err := dur.ParseNDuration(*d.str)
+		if err != nil {
+			findings = append(findings, conf.NewError(d.setting, "invalid duration %q: %s", *d.str, err))
+			continue
+		}
+		parsed[d.setting] = sec
+	}
+	chunkMaxStale, ok1 := parsed["chunk-max-stale"]
+	metricMaxStale, ok2 := parsed["metric-max-stale"]
+	if ok1 && ok2 && metricMaxStale < chunkMaxStale {
+		findings = append(findings, conf.NewWarning("metric-max-stale", "metric-max-stale %ds is shorter than chunk-max-stale %ds. series are only purged after their chunks are stale", metricMaxStale, chunkMaxStale))
+	}
+
+	var maxChunkSpan uint32
+	schemas, _, err := mdata.ReadConfig()
+	if err != nil {
+		findings = append(findings, conf.NewError("retention", "%s", err))
+	} else {
+		list, def := schemas.List()
+		list = append(list, def)
+		if bigtableStore.CliConfig.Enabled {
+			findings = append(findings, bigtableStore.ValidateSchemas(list, bigtableStore.CliConfig.MaxChunkSpan)...)
+		} else {
+			findings = append(findings, cassandraStore.ValidateSchemas(list, cassandraStore.CliConfig.WindowFactor)...)
+		}
+		for _, s := range list {
+			for i, ret := range s.Retentions {
+				if ret.ChunkSpan > maxChunkSpan {
+					maxChunkSpan = ret.ChunkSpan
+				}
+				// see docs/memory-server.md
+				if ret.NumChunks < 2 {
+					findings = append(findings, conf.NewWarning(s.Name, "retention %d: numchunks %d leaves no complete chunk in memory. queries hit cassandra as soon as a new chunk starts, and while the primary is saving the previous one", i, ret.NumChunks))
+				}
+			}
+		}
+	}
+
+	if bigtableStore.CliConfig.Enabled {
+		findings = append(findings, bigtableStore.ValidateConfig(bigtableStore.CliConfig)...)
+		if events.Enabled {
+			findings = append(findings, conf.NewError("events.enabled", "the event store requires the cassandra store, which is not used when the bigtable store is enabled"))
+		}
+	} else {
+		findings = append(findings, cassandraStore.ValidateConfig(cassandraStore.CliConfig)...)
+	}
+	if s3Store.CliConfig.Enabled {
+		findings = append(findings, s3Store.ValidateConfig(s3Store.CliConfig)...)
+	}
+
+	if _, err := tracing.ParseSampling(*tracingSampleRates, *tracingSlowThresholds, *tracingAdaptive, *tracingAdaptiveErrRate, *tracingMaxForced); err != nil {
+		findings = append(findings, conf.NewError("tracing-sample-rates", "%s", err))
+	}
+
+	if *viewsFile != "" {
+		if _, err := idx.ReadViews(*viewsFile); err != nil {
+			findings = append(findings, conf.NewError("views-file", "%s", err))
+		}
+	}
+	findings = append(findings, api.ConfigValidate(*publicOrg)...)
+	if err := features.ConfigValidate(); err != nil {
+		findings = append(findings, conf.NewError("features.flags", "%s", err))
+	}
+	findings = append(findings, governor.ConfigValidate()...)
+	findings = append(findings, audit.ConfigValidate()...)
+	findings = append(findings, events.ConfigValidate()...)
+	findings = append(findings, verify.ConfigValidate()...)
+	findings = append(findings, backfill.ConfigValidate()...)
+	findings = append(findings, compact.ConfigValidate()...)
+	findings = append(findings, standby.ConfigValidate()...)
+	findings = append(findings, cache.ConfigValidate()...)
+	findings = append(findings, wal.ConfigValidate()...)
+	findings = append(findings, quota.ConfigValidate()...)
+	findings = append(findings, enrich.ConfigValidate()...)
+	findings = append(findings, validation.ConfigValidate()...)
+	findings = append(findings, memory.ConfigValidate()...)
+	findings = append(findings, elasticsearch.ConfigValidate()...)
+	findings = append(findings, postgres.ConfigValidate()...)
+	findings = append(findings, recording.ConfigValidate(inKafkaMdm.Enabled)...)
+	findings = append(findings, encryption.ConfigValidate()...)
+	findings = append(findings, inKafkaMdm.ConfigValidate(maxChunkSpan)...)
+	findings = append(findings, inCarbon.ConfigValidate()...)
+	findings = append(findings, inPrometheus.ConfigValidate()...)
+	findings = append(findings, inOTLP.ConfigValidate()...)
+	findings = append(findings, cluster.ConfigValidate(notifierKafka.Enabled || notifierNsq.Enabled)...)
+	return findings
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/backfill"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	"github.com/raintank/dur"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	gitHash = "(none)"
+
+	showVersion = flag.Bool("version", false, "print version string")
+
+	schemasFile  = flag.String("schemas-file", "/etc/metrictank/storage-schemas.conf", "path to storage-schemas.conf file. should match the config of your metrictank cluster")
+	aggFile      = flag.String("aggregations-file", "/etc/metrictank/storage-aggregation.conf", "path to storage-aggregation.conf file. should match the config of your metrictank cluster")
+	span         = flag.Uint("span", 0, "the interval in seconds of the rollup to backfill. 0 for all rollups of the schema of each series")
+	from         = flag.String("from", "", "only write chunks that start at or after this time. defaults to as far back as the raw data is retained")
+	to           = flag.String("to", "now", "only write chunks that end before this time")
+	timeZoneStr  = flag.String("time-zone", "local", "time-zone to use for interpreting from/to when needed. (check your config)")
+	overwrite    = flag.Bool("overwrite", false, "recompute the rollup chunks that exist already, e.g. after the aggregation methods changed. otherwise only missing chunks are written")
+	numThreads   = flag.Int("threads", 10, "number of series to backfill concurrently")
+	drainTimeout = flag.Duration("drain-timeout", time.Minute, "how long to wait for the last chunks to be saved, once all series are done")
+	verbose      = flag.Bool("verbose", false, "More detailed logging")
+
+	numSeries  uint64
+	numChunks  uint64
+	numSkipped uint64
+	numErrors  uint64
+)
+
+// def is the part of a metric definition we need to find the schema and aggregation of a series
+type def struct {
+	nameWithTags string
+	interval     int
+}
+
+func main() {
+	storeConfig := cassandraStore.NewStoreConfig()
+	// the tables must exist already, since metrictank writes the raw data to them
+	storeConfig.CreateKeyspace = false
+
+	flag.StringVar(&storeConfig.Addrs, "cassandra-addrs", storeConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
+	flag.StringVar(&storeConfig.Keyspace, "cassandra-keyspace", storeConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
+	flag.StringVar(&storeConfig.Consistency, "cassandra-consistency", storeConfig.Consistency, "read and write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	flag.StringVar(&storeConfig.HostSelectionPolicy, "cassandra-host-selection-policy", storeConfig.HostSelectionPolicy, "")
+	flag.IntVar(&storeConfig.Timeout, "cassandra-timeout", storeConfig.Timeout, "cassandra timeout in milliseconds")
+	flag.IntVar(&storeConfig.ReadConcurrency, "cassandra-read-concurrency", storeConfig.ReadConcurrency, "max number of concurrent reads from cassandra.")
+	flag.IntVar(&storeConfig.WriteConcurrency, "cassandra-write-concurrency", storeConfig.WriteConcurrency, "max number of concurrent writes to cassandra.")
+	flag.IntVar(&storeConfig.Retries, "cassandra-retries", storeConfig.Retries, "how many times to retry a query before failing it")
+	flag.IntVar(&storeConfig.WindowFactor, "cassandra-window-factor", storeConfig.WindowFactor, "size of compaction window relative to TTL")
+	flag.IntVar(&storeConfig.CqlProtocolVersion, "cql-protocol-version", storeConfig.CqlProtocolVersion, "cql protocol version to use")
+	flag.BoolVar(&storeConfig.DisableInitialHostLookup, "cassandra-disable-initial-host-lookup", storeConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+	flag.BoolVar(&storeConfig.SSL, "cassandra-ssl", storeConfig.SSL, "enable SSL connection to cassandra")
+	flag.StringVar(&storeConfig.CaPath, "cassandra-ca-path", storeConfig.CaPath, "cassandra CA certificate path when using SSL")
+	flag.BoolVar(&storeConfig.HostVerification, "cassandra-host-verification", storeConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
+	flag.BoolVar(&storeConfig.Auth, "cassandra-auth", storeConfig.Auth, "enable cassandra authentication")
+	flag.StringVar(&storeConfig.Username, "cassandra-username", storeConfig.Username, "username for authentication")
+	flag.StringVar(&storeConfig.Password, "cassandra-password", storeConfig.Password, "password for authentication")
+
+	flag.Usage = func() {
+		fmt.Println("mt-aggregate-backfill")
+		fmt.Println()
+		fmt.Println("Reads the raw chunks of the selected series from the store, recomputes their rollups (min/max/sum/cnt/lst, as configured")
+		fmt.Println("in storage-aggregation.conf) and writes the rollup chunks to the tables of their TTLs. Use it after adding rollups to")
+		fmt.Println("storage-schemas.conf, or after changing the aggregation methods in storage-aggregation.conf.")
+		fmt.Println("Only the window in which the raw data is still retained can be backfilled.")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-aggregate-backfill [flags] <metric-selector>\n")
+		fmt.Printf("	                      metric-selector: an id, prefix:<prefix> (looked up in the index) or '-' to read ids from stdin\n")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-aggregate-backfill -cassandra-addrs cass -span 3600 'prefix:some.service.'")
+		fmt.Println("mt-aggregate-backfill -from='-30d' -overwrite 1.37cf8e3731ee4c79063c1d55280d1bbe")
+		fmt.Println("mt-index-cat cass -hosts cass:9042 '{{.Id}}\\n' | mt-aggregate-backfill -overwrite -")
+		fmt.Println()
+		fmt.Println("Notes:")
+		fmt.Println(" * only the raw data that is saved is used: the most recent raw data is only in the memory of metrictank.")
+		fmt.Println("   with -overwrite, set -to to before the start of the raw chunks that are still open, so that the rollup chunks")
+		fmt.Println("   metrictank saved are not replaced by incomplete ones.")
+		fmt.Println(" * the /backfill/rollups endpoint of metrictank does the same for the series in its index")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-aggregate-backfill (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	metricSelector := flag.Arg(0)
+	if metricSelector == "prefix:" {
+		log.Fatal("prefix cannot be empty")
+	}
+	if *span != 0 && !schema.IsSpanValid(uint32(*span)) {
+		log.Fatalf("invalid span %d", *span)
+	}
+
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	var loc *time.Location
+	switch *timeZoneStr {
+	case "local":
+		loc = time.Local
+	default:
+		var err error
+		loc, err = time.LoadLocation(*timeZoneStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	now := time.Now()
+	fromUnix, err := dur.ParseDateTime(*from, loc, now, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	toUnix, err := dur.ParseDateTime(*to, loc, now, uint32(now.Unix()))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fromUnix >= toUnix {
+		log.Fatal("from must be before to")
+	}
+
+	mdata.Schemas, err = conf.ReadSchemas(*schemasFile)
+	if err != nil {
+		log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+	}
+	mdata.Aggregations, err = conf.ReadAggregations(*aggFile)
+	if err != nil {
+		log.Fatalf("can't read aggregations file %q: %s", *aggFile, err)
+	}
+
+	store, err := cassandraStore.NewCassandraStore(storeConfig, mdata.TTLs())
+	if err != nil {
+		log.Fatalf("failed to initialize cassandra: %s", err)
+	}
+	defer store.Stop()
+
+	defs, err := getDefs(store.Session)
+	if err != nil {
+		log.Fatalf("failed to query index: %s", err)
+	}
+
+	opts := backfill.Options{
+		Span:      uint32(*span),
+		From:      fromUnix,
+		Until:     toUnix,
+		Overwrite: *overwrite,
+	}
+	keys := make(chan schema.MKey, *numThreads)
+	var wg sync.WaitGroup
+	wg.Add(*numThreads)
+	for i := 0; i < *numThreads; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				backfillSeries(store, key, defs[key], opts, uint32(now.Unix()))
+			}
+		}()
+	}
+
+	push := func(key schema.MKey) {
+		if _, ok := defs[key]; !ok {
+			log.Warnf("%s is not in the index. skipping", key)
+			atomic.AddUint64(&numErrors, 1)
+			return
+		}
+		keys <- key
+	}
+
+	switch {
+	case metricSelector == "-":
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			key, err := schema.MKeyFromString(line)
+			if err != nil {
+				log.Fatalf("can't parse %q as MKey: %s", line, err)
+			}
+			push(key)
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("failed to read from stdin: %s", err)
+		}
+	case strings.HasPrefix(metricSelector, "prefix:"):
+		prefix := strings.TrimPrefix(metricSelector, "prefix:")
+		for key, d := range defs {
+			if strings.HasPrefix(d.nameWithTags, prefix) {
+				push(key)
+			}
+		}
+	default:
+		key, err := schema.MKeyFromString(metricSelector)
+		if err != nil {
+			log.Fatalf("can't parse metric selector as MKey: %s", err)
+		}
+		push(key)
+	}
+	close(keys)
+	wg.Wait()
+
+	if pending := store.Drain(*drainTimeout); pending > 0 {
+		log.Errorf("%d chunks were not saved within %s", pending, *drainTimeout)
+		atomic.AddUint64(&numErrors, uint64(pending))
+	}
+	log.Infof("DONE. %d series, %d chunks written, %d left alone, %d errors", numSeries, numChunks, numSkipped, numErrors)
+	if numErrors > 0 {
+		os.Exit(2)
+	}
+}
+
+// backfillSeries writes the rollup chunks of the series
+func backfillSeries(store mdata.Store, key schema.MKey, d def, opts backfill.Options, now uint32) {
+	schemaId, _ := mdata.MatchSchema(d.nameWithTags, d.interval)
+	aggId, _ := mdata.MatchAgg(d.nameWithTags)
+	written, skipped, err := backfill.Series(store, key, schemaId, aggId, opts, now)
+	atomic.AddUint64(&numChunks, uint64(written))
+	atomic.AddUint64(&numSkipped, uint64(skipped))
+	if err != nil {
+		log.Errorf("failed to backfill %s: %s", key, err)
+		atomic.AddUint64(&numErrors, 1)
+		return
+	}
+	log.Debugf("backfilled %s: %d chunks written, %d left alone", key, written, skipped)
+	if n := atomic.AddUint64(&numSeries, 1); n%1000 == 0 {
+		log.Infof("processed %d series, %d chunks written", n, atomic.LoadUint64(&numChunks))
+	}
+}
+
+// getDefs returns the definitions of all series in the index
+func getDefs(session *gocql.Session) (map[schema.MKey]def, error) {
+	defs := make(map[schema.MKey]def)
+	iter := session.Query("select id, name, tags, interval from metric_idx").Iter()
+	var id, name string
+	var tags []string
+	var interval int
+	for iter.Scan(&id, &name, &tags, &interval) {
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			log.Errorf("invalid id %q in index: %s", id, err)
+			continue
+		}
+		md := schema.MetricDefinition{Name: name, Tags: tags}
+		defs[mkey] = def{md.NameWithTags(), interval}
+	}
+	return defs, iter.Close()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/grafana/metrictank/input/carbon"
+	"github.com/metrics20/go-metrics20/carbon20"
+)
+
+// addFunc is called for every point read from the input
+type addFunc func(key string, ts uint32, val float64)
+
+// readPlain reads carbon plaintext protocol lines ("key value timestamp") from r
+// invalid lines are reported to errFn and skipped
+func readPlain(r io.Reader, add addFunc, errFn func(error)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, val, ts, err := carbon20.ValidatePacket(line, carbon20.MediumLegacy, carbon20.NoneM20)
+		if err != nil {
+			errFn(err)
+			continue
+		}
+		add(string(key), ts, val)
+	}
+	return scanner.Err()
+}
+
+// readPickle reads graphite pickle protocol frames from r.
+// each frame is a 4 byte big endian length header, followed by a pickled list of (path, (timestamp, value)) tuples.
+// points that can't be interpreted are reported to errFn and skipped.
+func readPickle(r io.Reader, add addFunc, errFn func(error)) error {
+	br := bufio.NewReader(r)
+	var items []interface{}
+	var buf []byte
+	var err error
+	for {
+		items, buf, err = carbon.ReadPickleFrame(br, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			key, val, ts, err := carbon.ParsePickleItem(item)
+			if err != nil {
+				errFn(err)
+				continue
+			}
+			add(key, ts, val)
+		}
+	}
+}
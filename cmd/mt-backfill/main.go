@@ -0,0 +1,327 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/cassandra"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	globalFlags = flag.NewFlagSet("global config flags", flag.ExitOnError)
+
+	format = globalFlags.String(
+		"format",
+		"plain",
+		"format of the input files: plain (carbon plaintext protocol) or pickle (graphite pickle protocol frames)",
+	)
+	orgId = globalFlags.Int(
+		"orgid",
+		1,
+		"Organization ID the data belongs to",
+	)
+	schemasFile = globalFlags.String(
+		"schemas-file",
+		"/etc/metrictank/storage-schemas.conf",
+		"path to storage-schemas.conf file. should match the config of your metrictank cluster",
+	)
+	aggFile = globalFlags.String(
+		"aggregations-file",
+		"/etc/metrictank/storage-aggregation.conf",
+		"path to storage-aggregation.conf file. should match the config of your metrictank cluster",
+	)
+	threads = globalFlags.Int(
+		"threads",
+		10,
+		"Number of workers to encode and write series concurrently",
+	)
+	partitionScheme = globalFlags.String(
+		"partition-scheme",
+		"bySeries",
+		"method used for partitioning metrics. This should match the settings of tsdb-gw. (byOrg|bySeries)",
+	)
+	numPartitions = globalFlags.Int(
+		"num-partitions",
+		1,
+		"Number of Partitions",
+	)
+	verbose = globalFlags.Bool(
+		"verbose",
+		false,
+		"More detailed logging",
+	)
+
+	gitHash = "(none)"
+
+	invalidCount uint64
+)
+
+func main() {
+	storeConfig := cassandraStore.NewStoreConfig()
+	// we don't use the cassandraStore's writeQueue, so we hard code this to 0.
+	storeConfig.WriteQueueSize = 0
+
+	// flags from cassandra/config.go, Cassandra
+	globalFlags.StringVar(&storeConfig.Addrs, "cassandra-addrs", storeConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
+	globalFlags.StringVar(&storeConfig.Keyspace, "cassandra-keyspace", storeConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
+	globalFlags.StringVar(&storeConfig.Consistency, "cassandra-consistency", storeConfig.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	globalFlags.StringVar(&storeConfig.HostSelectionPolicy, "cassandra-host-selection-policy", storeConfig.HostSelectionPolicy, "")
+	globalFlags.IntVar(&storeConfig.Timeout, "cassandra-timeout", storeConfig.Timeout, "cassandra timeout in milliseconds")
+	globalFlags.IntVar(&storeConfig.WriteConcurrency, "cassandra-write-concurrency", storeConfig.WriteConcurrency, "max number of concurrent writes to cassandra.")
+	globalFlags.IntVar(&storeConfig.Retries, "cassandra-retries", storeConfig.Retries, "how many times to retry a query before failing it")
+	globalFlags.IntVar(&storeConfig.WindowFactor, "cassandra-window-factor", storeConfig.WindowFactor, "size of compaction window relative to TTL")
+	globalFlags.IntVar(&storeConfig.CqlProtocolVersion, "cql-protocol-version", storeConfig.CqlProtocolVersion, "cql protocol version to use")
+	globalFlags.BoolVar(&storeConfig.CreateKeyspace, "cassandra-create-keyspace", storeConfig.CreateKeyspace, "enable the creation of the mdata keyspace and tables, only one node needs this")
+	globalFlags.BoolVar(&storeConfig.DisableInitialHostLookup, "cassandra-disable-initial-host-lookup", storeConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+	globalFlags.BoolVar(&storeConfig.SSL, "cassandra-ssl", storeConfig.SSL, "enable SSL connection to cassandra")
+	globalFlags.StringVar(&storeConfig.CaPath, "cassandra-ca-path", storeConfig.CaPath, "cassandra CA certificate path when using SSL")
+	globalFlags.BoolVar(&storeConfig.HostVerification, "cassandra-host-verification", storeConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
+	globalFlags.BoolVar(&storeConfig.Auth, "cassandra-auth", storeConfig.Auth, "enable cassandra authentication")
+	globalFlags.StringVar(&storeConfig.Username, "cassandra-username", storeConfig.Username, "username for authentication")
+	globalFlags.StringVar(&storeConfig.Password, "cassandra-password", storeConfig.Password, "password for authentication")
+	globalFlags.StringVar(&storeConfig.SchemaFile, "cassandra-schema-file", storeConfig.SchemaFile, "File containing the needed schemas in case database needs initializing")
+
+	cassFlags := cassandra.ConfigSetup()
+
+	flag.Usage = func() {
+		fmt.Println("mt-backfill")
+		fmt.Println()
+		fmt.Println("Reads carbon plaintext or pickle archives, encodes the data into chunks (raw and rollups) according to")
+		fmt.Println("the storage-schemas and storage-aggregation config, and writes them directly to the store and index.")
+		fmt.Println("This bypasses the regular ingestion path (kafka/carbon inputs) entirely.")
+		fmt.Println()
+		fmt.Printf("Usage:\n\n")
+		fmt.Printf("  mt-backfill [global config flags] <idxtype> [idx config flags] <file>... \n\n")
+		fmt.Printf("global config flags:\n\n")
+		globalFlags.PrintDefaults()
+		fmt.Println()
+		fmt.Printf("idxtype: only 'cass' supported for now\n\n")
+		fmt.Printf("cass config flags:\n\n")
+		cassFlags.PrintDefaults()
+		fmt.Println()
+		fmt.Println("file: one or more files to read. use '-' to read from stdin")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-backfill -cassandra-addrs=192.168.0.1 -cassandra-keyspace=metrictank -schemas-file=storage-schemas.conf -aggregations-file=storage-aggregation.conf cass -hosts=192.168.0.1:9042 archive-1.txt archive-2.txt")
+		fmt.Println("zcat dump.pickle.gz | mt-backfill -format pickle -num-partitions=8 cass -hosts=192.168.0.1:9042 -")
+		fmt.Println()
+		fmt.Println("Notes:")
+		fmt.Println(" * all points are held in memory, grouped per series, before being written")
+		fmt.Println(" * chunks are written unconditionally, so any existing chunks with the same key and t0 are overwritten. This includes")
+		fmt.Println("   the most recent chunk of each series, which may be incomplete. Don't backfill into chunks still being written by metrictank")
+		fmt.Println(" * running metrictank instances will only see newly added series after they reload their index (e.g. on restart)")
+	}
+
+	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	var cassI int
+	for i, v := range os.Args {
+		if v == "cass" {
+			cassI = i
+			break
+		}
+	}
+	if cassI == 0 {
+		fmt.Println("only indextype 'cass' supported")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	globalFlags.Parse(os.Args[1:cassI])
+	cassFlags.Parse(os.Args[cassI+1:])
+	cassandra.Enabled = true
+
+	files := cassFlags.Args()
+	if len(files) == 0 {
+		fmt.Println("no input files given")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var read func(r io.Reader, add addFunc, errFn func(error)) error
+	switch *format {
+	case "plain":
+		read = readPlain
+	case "pickle":
+		read = readPickle
+	default:
+		fmt.Printf("invalid format %q\n", *format)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	var err error
+	mdata.Schemas, err = conf.ReadSchemas(*schemasFile)
+	if err != nil {
+		log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+	}
+	mdata.Aggregations, err = conf.ReadAggregations(*aggFile)
+	if err != nil {
+		log.Fatalf("can't read aggregations file %q: %s", *aggFile, err)
+	}
+
+	p, err := partitioner.NewKafka(*partitionScheme)
+	if err != nil {
+		log.Fatalf("failed to instantiate partitioner: %s", err)
+	}
+
+	series := make(map[string][]schema.Point)
+	var points int
+	add := func(key string, ts uint32, val float64) {
+		series[key] = append(series[key], schema.Point{Val: val, Ts: ts})
+		points++
+	}
+	errFn := func(err error) {
+		atomic.AddUint64(&invalidCount, 1)
+		log.Debugf("skipping invalid input: %s", err)
+	}
+	for _, file := range files {
+		err := readFile(file, read, add, errFn)
+		if err != nil {
+			log.Fatalf("failed to read %q: %s", file, err)
+		}
+	}
+	log.Infof("read %d points for %d series. skipped %d invalid entries", points, len(series), invalidCount)
+
+	cs, err := cassandraStore.NewCassandraStore(storeConfig, mdata.TTLs())
+	if err != nil {
+		log.Fatalf("failed to initialize cassandra: %s", err)
+	}
+	store := newDirectStore(cs.Session, mdata.TTLs(), storeConfig.WindowFactor)
+	defer store.Stop()
+
+	index := cassandra.New()
+	err = index.Init()
+	if err != nil {
+		log.Fatalf("failed to initialize cassandra index: %s", err)
+	}
+	defer index.Stop()
+
+	// AggMetric only persists chunks when we're primary
+	cluster.Init("mt-backfill", gitHash, time.Now(), "http", int(80))
+	cluster.Manager.SetPrimary(true)
+
+	keys := make(chan string, *threads)
+	var done uint64
+	var wg sync.WaitGroup
+	wg.Add(*threads)
+	for i := 0; i < *threads; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				backfill(key, series[key], store, index, p)
+				if n := atomic.AddUint64(&done, 1); n%1000 == 0 {
+					log.Infof("processed %d/%d series, %d chunks written", n, len(series), atomic.LoadUint64(&store.chunks))
+				}
+			}
+		}()
+	}
+	for key := range series {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+
+	log.Infof("DONE. processed %d series, %d chunks written", done, atomic.LoadUint64(&store.chunks))
+}
+
+func readFile(file string, read func(r io.Reader, add addFunc, errFn func(error)) error, add addFunc, errFn func(error)) error {
+	if file == "-" {
+		return read(os.Stdin, add, errFn)
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return read(fd, add, errFn)
+}
+
+// backfill adds the series to the index, and pushes all its points through an AggMetric
+// to generate the raw and rollup chunks, which then get written to the store.
+func backfill(key string, points []schema.Point, store mdata.Store, index idx.MetricIndex, p partitioner.Partitioner) {
+	points = sortAndDedupe(points)
+	if len(points) == 0 {
+		return
+	}
+
+	nameSplits := strings.Split(key, ";")
+	name := nameSplits[0]
+	_, s := mdata.MatchSchema(name, 0)
+	md := &schema.MetricData{
+		Name:     name,
+		Interval: s.Retentions[0].SecondsPerPoint,
+		Value:    0,
+		Unit:     "unknown",
+		Time:     int64(points[len(points)-1].Ts),
+		Mtype:    "gauge",
+		Tags:     nameSplits[1:],
+		OrgId:    *orgId,
+	}
+	md.SetId()
+	mkey, err := schema.MKeyFromString(md.Id)
+	if err != nil {
+		panic(err)
+	}
+
+	partition, err := p.Partition(md, int32(*numPartitions))
+	if err != nil {
+		log.Errorf("failed to partition %s: %s", key, err)
+		return
+	}
+	archive, _, _ := index.AddOrUpdate(mkey, md, partition)
+
+	schem := mdata.Schemas.Get(archive.SchemaId)
+	agg := mdata.Aggregations.Get(archive.AggId)
+	am := mdata.NewAggMetric(store, cache.NewMockCache(), schema.AMKey{MKey: mkey}, schem.Retentions, 0, &agg, false)
+	for _, point := range points {
+		am.Add(point.Ts, point.Val)
+	}
+
+	// close and persist the last chunks of the raw series first, then those of the rollups
+	am.GC(^uint32(0), ^uint32(0), ^uint32(0))
+	am.GC(^uint32(0), ^uint32(0), ^uint32(0))
+}
+
+// sortAndDedupe sorts the points by timestamp, and if there's multiple points for the
+// same timestamp, only retains the one that was read last. points without timestamp are dropped.
+func sortAndDedupe(points []schema.Point) []schema.Point {
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Ts < points[j].Ts })
+	out := points[:0]
+	for _, p := range points {
+		if p.Ts == 0 {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1].Ts == p.Ts {
+			out[len(out)-1] = p
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
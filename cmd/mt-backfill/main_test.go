@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/mdata"
+	pickle "github.com/kisielk/og-rek"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+type point struct {
+	key string
+	ts  uint32
+	val float64
+}
+
+func collect(t *testing.T, read func(addFunc, func(error)) error) ([]point, int) {
+	var got []point
+	var invalid int
+	err := read(func(key string, ts uint32, val float64) {
+		got = append(got, point{key, ts, val})
+	}, func(err error) {
+		invalid++
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return got, invalid
+}
+
+func comparePoints(t *testing.T, exp, got []point) {
+	if len(got) != len(exp) {
+		t.Fatalf("expected %d points, got %d: %v", len(exp), len(got), got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("point %d: expected %v, got %v", i, exp[i], got[i])
+		}
+	}
+}
+
+func TestReadPlain(t *testing.T) {
+	in := `a.b.c 1.5 1500000000
+# comment
+
+a.b.c;dc=us 2 1500000010
+invalid line
+a.b.d NaN-ish 1500000020
+`
+	got, invalid := collect(t, func(add addFunc, errFn func(error)) error {
+		return readPlain(strings.NewReader(in), add, errFn)
+	})
+	comparePoints(t, []point{
+		{"a.b.c", 1500000000, 1.5},
+		{"a.b.c;dc=us", 1500000010, 2},
+	}, got)
+	if invalid != 2 {
+		t.Errorf("expected 2 invalid lines, got %d", invalid)
+	}
+}
+
+func TestReadPickle(t *testing.T) {
+	frames := [][]interface{}{
+		{
+			pickle.Tuple{"a.b.c", pickle.Tuple{int64(1500000000), 1.5}},
+			pickle.Tuple{"a.b.c", pickle.Tuple{1500000010.0, int64(2)}},
+		},
+		{
+			pickle.Tuple{"a.b.d", pickle.Tuple{"1500000020", "3.25"}},
+			pickle.Tuple{"a.b.e", pickle.Tuple{int64(0), 1.0}},
+			pickle.Tuple{"a.b.f"},
+		},
+	}
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		var payload bytes.Buffer
+		err := pickle.NewEncoder(&payload).Encode(frame)
+		if err != nil {
+			t.Fatalf("failed to encode pickle: %s", err)
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(payload.Len()))
+		buf.Write(header[:])
+		buf.Write(payload.Bytes())
+	}
+
+	got, invalid := collect(t, func(add addFunc, errFn func(error)) error {
+		return readPickle(&buf, add, errFn)
+	})
+	comparePoints(t, []point{
+		{"a.b.c", 1500000000, 1.5},
+		{"a.b.c", 1500000010, 2},
+		{"a.b.d", 1500000020, 3.25},
+	}, got)
+	if invalid != 2 {
+		t.Errorf("expected 2 invalid items, got %d", invalid)
+	}
+}
+
+func TestSortAndDedupe(t *testing.T) {
+	in := []schema.Point{{Val: 3, Ts: 30}, {Val: 1, Ts: 10}, {Val: 0, Ts: 0}, {Val: 2, Ts: 20}, {Val: 4, Ts: 10}}
+	exp := []schema.Point{{Val: 4, Ts: 10}, {Val: 2, Ts: 20}, {Val: 3, Ts: 30}}
+	got := sortAndDedupe(in)
+	if len(got) != len(exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+	for i := range exp {
+		if got[i] != exp[i] {
+			t.Errorf("point %d: expected %v, got %v", i, exp[i], got[i])
+		}
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	mdata.SetSingleSchema(
+		conf.NewRetentionMT(10, 86400, 600, 2, true),
+		conf.NewRetentionMT(60, 86400, 3600, 2, true),
+	)
+	mdata.SetSingleAgg(conf.Avg)
+	cluster.Init("mt-backfill-test", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+
+	store := mdata.NewMockStore()
+	index := memory.New()
+	p, err := partitioner.NewKafka("bySeries")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one hour of data, in reverse order to verify sorting
+	var points []schema.Point
+	for ts := uint32(3600 + 3590); ts >= 3600; ts -= 10 {
+		points = append(points, schema.Point{Val: float64(ts), Ts: ts})
+	}
+	backfill("a.b.c", points, store, index, p)
+
+	defs := index.List(1)
+	if len(defs) != 1 || defs[0].Name != "a.b.c" || defs[0].Interval != 10 || defs[0].LastUpdate != 3600+3590 {
+		t.Fatalf("unexpected index contents %v", defs)
+	}
+	mkey := defs[0].Id
+
+	// raw: 6 chunks of 600s, with 60 points each
+	raw := getPoints(t, store, schema.AMKey{MKey: mkey})
+	if len(raw) != 360 {
+		t.Fatalf("expected 360 raw points, got %d", len(raw))
+	}
+	if store.Items() < 6 {
+		t.Fatalf("expected at least 6 chunks, got %d", store.Items())
+	}
+
+	// rollups: the 10s points are aggregated in 60s buckets, each point at ts aggregates the data of (ts-60, ts]
+	cnt := getPoints(t, store, schema.AMKey{MKey: mkey, Archive: schema.NewArchive(schema.Cnt, 60)})
+	sum := getPoints(t, store, schema.AMKey{MKey: mkey, Archive: schema.NewArchive(schema.Sum, 60)})
+	if len(cnt) != 61 || len(sum) != 61 {
+		t.Fatalf("expected 61 cnt and sum points, got %d and %d", len(cnt), len(sum))
+	}
+	var total float64
+	for _, p := range cnt {
+		total += p.Val
+	}
+	if total != 360 {
+		t.Fatalf("expected the cnt rollup to add up to 360, got %f", total)
+	}
+	if sum[1].Ts != 3660 || sum[1].Val != 3610+3620+3630+3640+3650+3660 {
+		t.Fatalf("unexpected sum rollup point %v", sum[1])
+	}
+}
+
+func getPoints(t *testing.T, store *mdata.MockStore, key schema.AMKey) []schema.Point {
+	itgens, err := store.Search(context.Background(), key, 0, 0, math.MaxUint32)
+	if err != nil {
+		t.Fatalf("search for %s failed: %s", key, err)
+	}
+	var out []schema.Point
+	for _, itgen := range itgens {
+		iter, err := itgen.Get()
+		if err != nil {
+			t.Fatalf("failed to get iterator: %s", err)
+		}
+		for iter.Next() {
+			ts, val := iter.Values()
+			out = append(out, schema.Point{Val: val, Ts: ts})
+		}
+	}
+	return out
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	opentracing "github.com/opentracing/opentracing-go"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var errNotSupported = errors.New("not supported by the backfill store")
+
+// directStore is a mdata.Store that writes chunks to cassandra synchronously,
+// so that once AggMetric.GC() returns, we know all its data has been saved.
+type directStore struct {
+	session   *gocql.Session
+	ttlTables cassandraStore.TTLTables
+	chunks    uint64
+}
+
+func newDirectStore(session *gocql.Session, ttls []uint32, windowFactor int) *directStore {
+	return &directStore{
+		session:   session,
+		ttlTables: cassandraStore.GetTTLTables(ttls, windowFactor, cassandraStore.Table_name_format),
+	}
+}
+
+func (s *directStore) Add(cwr *mdata.ChunkWriteRequest) {
+	entry, ok := s.ttlTables[cwr.TTL]
+	if !ok {
+		// this would mean the schemas changed after we created the store, which can't happen
+		panic(fmt.Sprintf("no table found for ttl %d", cwr.TTL))
+	}
+	query := fmt.Sprintf("INSERT INTO %s (key, ts, data) values (?,?,?) USING TTL %d", entry.Table, cwr.TTL)
+	rowKey := fmt.Sprintf("%s_%d", cwr.Key.String(), cwr.Chunk.T0/cassandraStore.Month_sec)
+	data, err := cassandraStore.PrepareChunkData(cwr.Key.MKey.Org, cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, cwr.Chunk.Bytes())
+	if err != nil {
+		// we don't encrypt, so this can't happen
+		panic(fmt.Sprintf("could not prepare chunk %s:%d: %s", cwr.Key, cwr.Chunk.T0, err))
+	}
+
+	attempts := 0
+	for {
+		err := s.session.Query(query, rowKey, cwr.Chunk.T0, data).Exec()
+		if err == nil {
+			break
+		}
+		if (attempts % 20) == 0 {
+			log.Warnf("failed to save chunk %s:%d to cassandra after %d attempts. %s", cwr.Key, cwr.Chunk.T0, attempts+1, err)
+		}
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+		attempts++
+	}
+	log.Debugf("saved chunk %s:%d to %s", cwr.Key, cwr.Chunk.T0, entry.Table)
+	atomic.AddUint64(&s.chunks, 1)
+	cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
+}
+
+func (s *directStore) Search(ctx context.Context, key schema.AMKey, ttl, from, to uint32) ([]chunk.IterGen, error) {
+	return nil, errNotSupported
+}
+
+func (s *directStore) Stop() {
+	s.session.Close()
+}
+
+func (s *directStore) SetTracer(t opentracing.Tracer) {
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/clock"
+	"github.com/grafana/metrictank/stacktest/fakemetrics/out"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// tagSpec describes how the values of a tag are distributed over the series
+type tagSpec struct {
+	key         string
+	cardinality int
+	zipf        bool // if false, values are distributed uniformly
+}
+
+// parseTagSpecs parses a comma-separated list of key:cardinality[:uniform|zipf] specifications
+func parseTagSpecs(s string) ([]tagSpec, error) {
+	var specs []tagSpec
+	if s == "" {
+		return specs, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid tag spec %q: expected key:cardinality[:distribution]", part)
+		}
+		if fields[0] == "" || fields[0] == "name" || strings.ContainsAny(fields[0], ";!^=") {
+			return nil, fmt.Errorf("invalid tag spec %q: invalid key", part)
+		}
+		card, err := strconv.Atoi(fields[1])
+		if err != nil || card < 1 {
+			return nil, fmt.Errorf("invalid tag spec %q: cardinality must be a positive integer", part)
+		}
+		spec := tagSpec{key: fields[0], cardinality: card}
+		if len(fields) == 3 {
+			switch fields[2] {
+			case "uniform":
+			case "zipf":
+				spec.zipf = true
+			default:
+				return nil, fmt.Errorf("invalid tag spec %q: distribution must be uniform or zipf", part)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// generator maintains a set of orgs*series series.
+// each series slot has a generation, which gets bumped when the slot churns,
+// resulting in a new series (with a new id) replacing the old one.
+type generator struct {
+	prefix   string
+	orgs     int
+	series   int // per org
+	interval int
+	tags     []tagSpec
+	carbon   bool // whether to encode the tags in the name, carbon style
+
+	rnd     *rand.Rand
+	zipfs   []*rand.Zipf
+	gens    []int // generation of each slot
+	cursor  int   // next slot to churn
+	metrics []*schema.MetricData
+}
+
+func newGenerator(prefix string, orgs, series, interval int, tags []tagSpec, carbon bool, seed int64) *generator {
+	g := &generator{
+		prefix:   prefix,
+		orgs:     orgs,
+		series:   series,
+		interval: interval,
+		tags:     tags,
+		carbon:   carbon,
+		rnd:      rand.New(rand.NewSource(seed)),
+		zipfs:    make([]*rand.Zipf, len(tags)),
+		gens:     make([]int, orgs*series),
+		metrics:  make([]*schema.MetricData, orgs*series),
+	}
+	for i, t := range tags {
+		if t.zipf && t.cardinality > 1 {
+			g.zipfs[i] = rand.NewZipf(g.rnd, 1.1, 1, uint64(t.cardinality-1))
+		}
+	}
+	for slot := range g.metrics {
+		g.metrics[slot] = g.build(slot)
+	}
+	return g
+}
+
+// build creates the series for the given slot, at its current generation
+func (g *generator) build(slot int) *schema.MetricData {
+	idx := slot % g.series
+	name := fmt.Sprintf("%s.s%d.g%d", g.prefix, idx, g.gens[slot])
+	var tags []string
+	for i, t := range g.tags {
+		var val int
+		if g.zipfs[i] != nil {
+			val = int(g.zipfs[i].Uint64())
+		} else {
+			val = idx % t.cardinality
+		}
+		tags = append(tags, fmt.Sprintf("%s=%s%d", t.key, t.key, val))
+	}
+	sort.Strings(tags)
+	m := &schema.MetricData{
+		OrgId:    slot/g.series + 1,
+		Name:     name,
+		Interval: g.interval,
+		Unit:     "unknown",
+		Mtype:    "gauge",
+		Tags:     tags,
+	}
+	if g.carbon && len(tags) > 0 {
+		// carbon input parses the tags out of the name
+		m.Name = name + ";" + strings.Join(tags, ";")
+		m.Tags = nil
+	}
+	m.SetId()
+	return m
+}
+
+// churn replaces n series with new ones, round-robin across all slots
+func (g *generator) churn(n int) {
+	for i := 0; i < n; i++ {
+		g.gens[g.cursor]++
+		g.metrics[g.cursor] = g.build(g.cursor)
+		g.cursor = (g.cursor + 1) % len(g.metrics)
+	}
+}
+
+// tick sets the timestamp and a new value for all series
+func (g *generator) tick(ts int64) []*schema.MetricData {
+	for _, m := range g.metrics {
+		m.Time = ts
+		m.Value = g.rnd.Float64() * 100
+	}
+	return g.metrics
+}
+
+// feed sends data for all series of the generator each interval, until duration has passed (0 means forever)
+func feed(g *generator, o out.Out, batchSize int, churnRate float64, churnPeriod, duration time.Duration) {
+	var deadline <-chan time.Time
+	if duration > 0 {
+		deadline = time.After(duration)
+	}
+	start := time.Now()
+	lastChurn := start
+	var published, churned int
+	ticker := clock.AlignedTick(time.Duration(g.interval) * time.Second)
+	for {
+		select {
+		case <-deadline:
+			log.Infof("DONE. published %d points and churned %d series in %s", published, churned, time.Since(start).Truncate(time.Second))
+			return
+		case t := <-ticker:
+			if churnRate > 0 && time.Since(lastChurn) >= churnPeriod {
+				n := int(churnRate * float64(len(g.metrics)))
+				g.churn(n)
+				churned += n
+				lastChurn = time.Now()
+				log.Debugf("churned %d series", n)
+			}
+			pre := time.Now()
+			metrics := g.tick(t.Unix())
+			for len(metrics) > 0 {
+				n := batchSize
+				if n > len(metrics) {
+					n = len(metrics)
+				}
+				err := o.Flush(metrics[:n])
+				if err != nil {
+					log.Fatalf("failed to send data to output: %s", err)
+				}
+				metrics = metrics[n:]
+			}
+			published += len(g.metrics)
+			took := time.Since(pre)
+			log.Debugf("published %d points for ts %d in %s", len(g.metrics), t.Unix(), took)
+			if took > time.Duration(g.interval)*time.Second {
+				log.Warnf("publishing %d points took %s, which is longer than the interval. output can't keep up", len(g.metrics), took)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/stacktest/fakemetrics/out"
+	"github.com/grafana/metrictank/stacktest/fakemetrics/out/carbon"
+	"github.com/grafana/metrictank/stacktest/fakemetrics/out/kafkamdm"
+	"github.com/raintank/met/helper"
+)
+
+var (
+	gitHash = "(none)"
+
+	showVersion = flag.Bool("version", false, "print version string")
+	verbose     = flag.Bool("verbose", false, "print details for each flush or failed request")
+)
+
+func main() {
+	feedFlags := flag.NewFlagSet("feed", flag.ExitOnError)
+	output := feedFlags.String("output", "kafka-mdm", "where to publish the data to: kafka-mdm or carbon")
+	kafkaBrokers := feedFlags.String("kafka-mdm-brokers", "localhost:9092", "comma separated list of kafka brokers")
+	kafkaTopic := feedFlags.String("kafka-mdm-topic", "mdm", "kafka topic to publish to")
+	kafkaCodec := feedFlags.String("kafka-mdm-codec", "snappy", "compression codec: none, gzip or snappy")
+	partitionScheme := feedFlags.String("partition-scheme", "bySeries", "method used for partitioning metrics: byOrg or bySeries")
+	carbonAddr := feedFlags.String("carbon-addr", "localhost:2003", "carbon address to publish to")
+	prefix := feedFlags.String("prefix", "mt-bench", "prefix for the names of the generated series")
+	orgs := feedFlags.Int("orgs", 1, "number of orgs")
+	series := feedFlags.Int("series", 1000, "number of series per org")
+	interval := feedFlags.Int("interval", 10, "interval of the series in seconds")
+	tags := feedFlags.String("tags", "", "comma-separated list of tags to add, as key:cardinality[:uniform|zipf]. e.g. 'dc:3,host:100:zipf'")
+	churn := feedFlags.Float64("churn", 0, "fraction of the series to replace by new ones every churn-period. e.g. 0.01")
+	churnPeriod := feedFlags.Duration("churn-period", time.Hour, "how often to churn series")
+	batchSize := feedFlags.Int("batch-size", 10000, "max number of points to publish in one flush")
+	feedDuration := feedFlags.Duration("duration", 0, "how long to run for. 0 means forever")
+	seed := feedFlags.Int64("seed", 1, "random seed, for reproducible tag values")
+
+	queryFlags := flag.NewFlagSet("query", flag.ExitOnError)
+	addr := queryFlags.String("addr", "http://localhost:6060", "graphite/metrictank address, for targets that are only a query string")
+	orgId := queryFlags.Int("org-id", 1, "org id to use for requests that don't specify an X-Org-Id header")
+	rate := queryFlags.Int("rate", 10, "number of requests per second. 0 means as fast as the concurrency allows")
+	concurrency := queryFlags.Int("concurrency", 10, "max number of concurrent requests")
+	queryDuration := queryFlags.Duration("duration", time.Minute, "how long to run for")
+	timeout := queryFlags.Duration("timeout", 10*time.Second, "timeout for each request")
+
+	flag.Usage = func() {
+		fmt.Println("mt-bench")
+		fmt.Println()
+		fmt.Println("Generates synthetic ingest and query load, for capacity testing")
+		fmt.Println()
+		fmt.Printf("Usage:\n\n")
+		fmt.Printf("  mt-bench [global flags] feed [feed flags]\n")
+		fmt.Printf("  mt-bench [global flags] query [query flags] <targets-file|->\n\n")
+		fmt.Printf("global flags:\n\n")
+		flag.PrintDefaults()
+		fmt.Println()
+		fmt.Printf("feed: publishes a point for each of orgs*series series every interval\n\n")
+		feedFlags.PrintDefaults()
+		fmt.Println()
+		fmt.Println("churn: every churn-period, the given fraction of series is replaced by new series (with a new name and id)")
+		fmt.Println()
+		fmt.Printf("query: replays the render requests in the targets file round-robin, and reports latencies and status codes\n\n")
+		queryFlags.PrintDefaults()
+		fmt.Println()
+		fmt.Println("targets: one or more of the following:")
+		fmt.Println("     vegeta style requests: 'GET <url>' lines, optionally followed by headers and terminated by an empty line")
+		fmt.Println("     full urls, one per line")
+		fmt.Println("     render query strings, one per line, like 'target=sumSeries(foo.*)&from=-1h'")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-bench feed -orgs 10 -series 10000 -tags 'dc:3,host:500:zipf' -churn 0.05 -churn-period 10m")
+		fmt.Println("mt-bench feed -output carbon -carbon-addr localhost:2003 -series 100000 -interval 1 -duration 1h")
+		fmt.Println("mt-index-cat -from 6h cass -hosts cassandra:9042 vegeta-render-patterns | mt-bench query -rate 50 -duration 5m -")
+	}
+
+	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
+		flag.Usage()
+		os.Exit(0)
+	}
+
+	var modeI int
+	for i, v := range os.Args {
+		if v == "feed" || v == "query" {
+			modeI = i
+			break
+		}
+	}
+	if modeI == 0 {
+		flag.CommandLine.Parse(os.Args[1:])
+	} else {
+		flag.CommandLine.Parse(os.Args[1:modeI])
+	}
+
+	if *showVersion {
+		fmt.Printf("mt-bench (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if modeI == 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+
+	switch os.Args[modeI] {
+	case "feed":
+		feedFlags.Parse(os.Args[modeI+1:])
+		if *orgs < 1 || *series < 1 || *interval < 1 || *batchSize < 1 {
+			log.Fatal("orgs, series, interval and batch-size must be positive")
+		}
+		if *churn < 0 || *churn > 1 {
+			log.Fatal("churn must be between 0 and 1")
+		}
+		specs, err := parseTagSpecs(*tags)
+		if err != nil {
+			log.Fatal(err)
+		}
+		stats, _ := helper.New(false, "", "standard", "", "")
+		var o out.Out
+		switch *output {
+		case "kafka-mdm":
+			o, err = kafkamdm.New(*kafkaTopic, strings.Split(*kafkaBrokers, ","), *kafkaCodec, stats, *partitionScheme)
+		case "carbon":
+			o, err = carbon.New(*carbonAddr, stats)
+		default:
+			log.Fatalf("invalid output %q", *output)
+		}
+		if err != nil {
+			log.Fatalf("failed to create %s output: %s", *output, err)
+		}
+		defer o.Close()
+		g := newGenerator(*prefix, *orgs, *series, *interval, specs, *output == "carbon", *seed)
+		log.Infof("publishing %d series every %ds to %s", *orgs**series, *interval, *output)
+		feed(g, o, *batchSize, *churn, *churnPeriod, *feedDuration)
+	case "query":
+		queryFlags.Parse(os.Args[modeI+1:])
+		if queryFlags.NArg() != 1 {
+			flag.Usage()
+			os.Exit(-1)
+		}
+		if *concurrency < 1 {
+			log.Fatal("concurrency must be positive")
+		}
+		var in io.Reader = os.Stdin
+		if queryFlags.Arg(0) != "-" {
+			f, err := os.Open(queryFlags.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			in = f
+		}
+		targets, err := parseTargets(in, strings.TrimSuffix(*addr, "/"))
+		if err != nil {
+			log.Fatalf("failed to read targets: %s", err)
+		}
+		if len(targets) == 0 {
+			log.Fatal("no targets to replay")
+		}
+		replay(targets, *orgId, *rate, *concurrency, *queryDuration, *timeout)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTagSpecs(t *testing.T) {
+	specs, err := parseTagSpecs("dc:3,host:100:zipf,rack:10:uniform")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := []tagSpec{{"dc", 3, false}, {"host", 100, true}, {"rack", 10, false}}
+	if len(specs) != len(exp) {
+		t.Fatalf("expected %v, got %v", exp, specs)
+	}
+	for i := range exp {
+		if specs[i] != exp[i] {
+			t.Fatalf("spec %d: expected %v, got %v", i, exp[i], specs[i])
+		}
+	}
+	for _, in := range []string{"dc", "dc:0", "dc:x", "dc:3:normal", ":3", "name:3"} {
+		if _, err := parseTagSpecs(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestGenerator(t *testing.T) {
+	g := newGenerator("bench", 2, 5, 10, []tagSpec{{"dc", 2, false}, {"host", 50, true}}, false, 1)
+	if len(g.metrics) != 10 {
+		t.Fatalf("expected 10 series, got %d", len(g.metrics))
+	}
+	ids := make(map[string]struct{})
+	for slot, m := range g.metrics {
+		if m.OrgId != slot/5+1 {
+			t.Fatalf("slot %d: expected org %d, got %d", slot, slot/5+1, m.OrgId)
+		}
+		if len(m.Tags) != 2 {
+			t.Fatalf("slot %d: expected 2 tags, got %v", slot, m.Tags)
+		}
+		ids[m.Id] = struct{}{}
+	}
+	if len(ids) != 10 {
+		t.Fatalf("expected 10 unique ids, got %d", len(ids))
+	}
+
+	g.churn(3)
+	for slot, m := range g.metrics {
+		_, existed := ids[m.Id]
+		if existed != (slot >= 3) {
+			t.Fatalf("slot %d: churned=%t, expected churned=%t", slot, !existed, slot < 3)
+		}
+	}
+
+	metrics := g.tick(1234)
+	for _, m := range metrics {
+		if m.Time != 1234 {
+			t.Fatalf("expected time 1234, got %d", m.Time)
+		}
+	}
+
+	g = newGenerator("bench", 1, 1, 10, []tagSpec{{"dc", 2, false}}, true, 1)
+	if g.metrics[0].Name != "bench.s0.g0;dc=dc0" || len(g.metrics[0].Tags) != 0 {
+		t.Fatalf("expected tags encoded in name for carbon, got name %q tags %v", g.metrics[0].Name, g.metrics[0].Tags)
+	}
+}
+
+func TestParseTargets(t *testing.T) {
+	in := `GET http://mt:6060/render?target=a.*&from=-1h
+X-Org-Id: 3
+
+# comment
+http://mt:6060/render?target=b
+target=sumSeries(c.*)&from=-6h
+`
+	targets, err := parseTargets(strings.NewReader(in), "http://localhost:6060")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := []string{
+		"http://mt:6060/render?target=a.*&from=-1h",
+		"http://mt:6060/render?target=b",
+		"http://localhost:6060/render?target=sumSeries(c.*)&from=-6h",
+	}
+	if len(targets) != len(exp) {
+		t.Fatalf("expected %d targets, got %d", len(exp), len(targets))
+	}
+	for i := range exp {
+		if targets[i].url != exp[i] {
+			t.Fatalf("target %d: expected %q, got %q", i, exp[i], targets[i].url)
+		}
+	}
+	if targets[0].headers.Get("X-Org-Id") != "3" {
+		t.Fatalf("expected X-Org-Id header 3, got %q", targets[0].headers.Get("X-Org-Id"))
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	cases := []struct {
+		p   float64
+		exp time.Duration
+	}{
+		{50, 50},
+		{90, 90},
+		{99, 99},
+		{100, 100},
+		{0.1, 1},
+	}
+	for _, c := range cases {
+		if got := percentile(sorted, c.p); got != c.exp {
+			t.Fatalf("p%v: expected %d, got %d", c.p, c.exp, got)
+		}
+	}
+	if got := percentile(nil, 50); got != 0 {
+		t.Fatalf("expected 0 for empty input, got %d", got)
+	}
+}
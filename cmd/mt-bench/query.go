@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// target is a request to replay
+type target struct {
+	url     string
+	headers http.Header
+}
+
+// parseTargets reads the requests to replay.
+// it supports the vegeta target format, as produced by mt-index-cat's vegeta outputs:
+// "GET <url>" lines, optionally followed by header lines, terminated by an empty line.
+// as well as lines that are a full url, or just the render query string (e.g. "target=foo.*&from=-1h"),
+// which will be requested against addr's render endpoint.
+func parseTargets(r io.Reader, addr string) ([]target, error) {
+	var targets []target
+	var cur *target
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			cur = nil
+		case strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "GET "):
+			targets = append(targets, target{
+				url:     strings.TrimSpace(strings.TrimPrefix(line, "GET ")),
+				headers: make(http.Header),
+			})
+			cur = &targets[len(targets)-1]
+		case cur != nil:
+			pos := strings.Index(line, ":")
+			if pos < 1 {
+				return nil, fmt.Errorf("invalid header line %q", line)
+			}
+			cur.headers.Add(strings.TrimSpace(line[:pos]), strings.TrimSpace(line[pos+1:]))
+		case strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://"):
+			targets = append(targets, target{url: line, headers: make(http.Header)})
+		default:
+			targets = append(targets, target{url: addr + "/render?" + line, headers: make(http.Header)})
+		}
+	}
+	return targets, scanner.Err()
+}
+
+// queryStats tracks the outcome of the executed queries
+type queryStats struct {
+	sync.Mutex
+	latencies []time.Duration
+	codes     map[int]int
+	errors    int
+}
+
+func (s *queryStats) add(code int, latency time.Duration, err error) {
+	s.Lock()
+	if err != nil {
+		s.errors++
+	} else {
+		s.codes[code]++
+	}
+	s.latencies = append(s.latencies, latency)
+	s.Unlock()
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of the sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func (s *queryStats) report(elapsed time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	num := len(s.latencies)
+	fmt.Printf("requests:  %d in %s (%.1f req/s)\n", num, elapsed.Truncate(time.Millisecond), float64(num)/elapsed.Seconds())
+	if num == 0 {
+		return
+	}
+	var sum time.Duration
+	for _, l := range s.latencies {
+		sum += l
+	}
+	fmt.Printf("latencies: min %s, mean %s, p50 %s, p90 %s, p99 %s, max %s\n",
+		s.latencies[0], sum/time.Duration(num), percentile(s.latencies, 50), percentile(s.latencies, 90), percentile(s.latencies, 99), s.latencies[num-1])
+	var codes []int
+	for code := range s.codes {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	fmt.Print("status codes:")
+	for _, code := range codes {
+		fmt.Printf(" %d:%d", code, s.codes[code])
+	}
+	fmt.Printf(" errors:%d\n", s.errors)
+}
+
+// replay executes the targets round-robin, at the given rate (0 means as fast as possible), using the given
+// number of concurrent workers, until duration has passed.
+func replay(targets []target, orgId int, rate, concurrency int, duration, timeout time.Duration) {
+	client := &http.Client{Timeout: timeout}
+	stats := &queryStats{codes: make(map[int]int)}
+	jobs := make(chan target)
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for t := range jobs {
+				code, latency, err := execute(client, t, orgId)
+				if err != nil {
+					log.Debugf("request %s failed: %s", t.url, err)
+				}
+				stats.add(code, latency, err)
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	start := time.Now()
+	deadline := time.After(duration)
+	var i int
+loop:
+	for {
+		if tick != nil {
+			select {
+			case <-deadline:
+				break loop
+			case <-tick:
+			}
+		}
+		select {
+		case <-deadline:
+			break loop
+		case jobs <- targets[i]:
+			i = (i + 1) % len(targets)
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	stats.report(time.Since(start))
+}
+
+func execute(client *http.Client, t target, orgId int) (int, time.Duration, error) {
+	req, err := http.NewRequest("GET", t.url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for k, v := range t.headers {
+		req.Header[k] = v
+	}
+	if req.Header.Get("X-Org-Id") == "" {
+		req.Header.Set("X-Org-Id", fmt.Sprintf("%d", orgId))
+	}
+	pre := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, time.Since(pre), err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(pre), err
+}
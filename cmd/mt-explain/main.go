@@ -5,10 +5,22 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"runtime"
 	"time"
 
+	"github.com/grafana/metrictank/api"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/expr"
+	"github.com/grafana/metrictank/mdata"
 	"github.com/raintank/dur"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	gitHash     = "(none)"
+	showVersion = flag.Bool("version", false, "print version string")
 )
 
 func main() {
@@ -17,19 +29,36 @@ func main() {
 	to := flag.String("to", "now", "get data until (exclusive)")
 	mdp := flag.Int("mdp", 800, "max data points to return")
 	timeZoneStr := flag.String("time-zone", "local", "time-zone to use for interpreting from/to when needed. (check your config)")
+	schemasFile := flag.String("schemas-file", "", "path to storage-schemas.conf file, to explain the fetches. if not set, only the plan is shown")
+	aggFile := flag.String("aggregations-file", "", "path to storage-aggregation.conf file. if not set, the metrictank defaults are used")
+	interval := flag.Int("interval", 0, "raw interval of the queried series. if 0, the interval of the first retention of the matching schema is used")
+	maxPointsPerReqSoft := flag.Int("max-points-per-req-soft", 1000000, "lower resolution rollups will be used to try and keep requests below this number of datapoints. (0 disables limit)")
+	archive := flag.String("archive", "auto", "archive to read, like the archive parameter of the render api: raw, the interval of a rollup (e.g. 1h) or auto")
+	maxPointsPerReqHard := flag.Int("max-points-per-req-hard", 20000000, "limit of number of datapoints a request can return. Requests that exceed this limit will be rejected. (0 disables limit)")
 
 	flag.Usage = func() {
 		fmt.Println("mt-explain")
 		fmt.Println("Explains the execution plan for a given query / set of targets")
+		fmt.Println("Shows the expression tree, which functions metrictank executes natively, and the requests for data that will be made.")
+		fmt.Println("If a schemas file is given, it also shows, for each request, which archive would be read and what normalization")
+		fmt.Println("and consolidation would be applied. Queries are matched against the schemas and aggregations as if they were")
+		fmt.Println("metric names, and each of them is assumed to resolve to a single series.")
 		fmt.Println()
 		fmt.Printf("Usage:\n\n")
-		fmt.Printf("  mt-explain\n")
+		fmt.Printf("  mt-explain [flags] <target> [target...]\n")
 		fmt.Println()
 		fmt.Printf("Example:\n\n")
-		fmt.Printf("  mt-explain -from -24h -to now -mdp 1000 \"movingAverage(sumSeries(foo.bar), '2min')\" \"alias(averageSeries(foo.*), 'foo-avg')\"\n\n")
+		fmt.Printf("  mt-explain -from -24h -to now -mdp 1000 \"movingAverage(sumSeries(foo.bar), '2min')\" \"alias(averageSeries(foo.*), 'foo-avg')\"\n")
+		fmt.Printf("  mt-explain -from -30d -schemas-file /etc/metrictank/storage-schemas.conf -aggregations-file /etc/metrictank/storage-aggregation.conf \"sumSeries(foo.*)\"\n\n")
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
 	}
 
 	flag.Parse()
+	if *showVersion {
+		fmt.Printf("mt-explain (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
 	if flag.NArg() == 0 {
 		log.Fatal("no target specified")
 		os.Exit(-1)
@@ -68,6 +97,12 @@ func main() {
 		return
 	}
 
+	fmt.Println("Expression tree:")
+	for _, e := range exps {
+		fmt.Println(e.Explain(2))
+	}
+	fmt.Println()
+
 	plan, err := expr.NewPlan(exps, fromUnix, toUnix, uint32(*mdp), *stable, nil)
 	if err != nil {
 		if fun, ok := err.(expr.ErrUnknownFunction); ok {
@@ -79,4 +114,96 @@ func main() {
 		return
 	}
 	plan.Dump(os.Stdout)
+
+	if *schemasFile == "" {
+		return
+	}
+	mdata.Schemas, err = conf.ReadSchemas(*schemasFile)
+	if err != nil {
+		log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+	}
+	mdata.Aggregations = conf.NewAggregations()
+	if *aggFile != "" {
+		mdata.Aggregations, err = conf.ReadAggregations(*aggFile)
+		if err != nil {
+			log.Fatalf("can't read aggregations file %q: %s", *aggFile, err)
+		}
+	}
+
+	archReq, err := models.ParseArchiveReq(*archive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println()
+	explainFetches(plan, uint32(now.Unix()), *interval, archReq, *maxPointsPerReqSoft, *maxPointsPerReqHard)
+}
+
+// explainFetches shows how each of the requests of the plan would be fetched,
+// mimicking what the render handler does after resolving the queries to series
+func explainFetches(plan expr.Plan, now uint32, interval int, archReq models.ArchiveReq, maxPointsPerReqSoft, maxPointsPerReqHard int) {
+	var reqs []models.Req
+	minFrom := ^uint32(0)
+	var maxTo uint32
+	for _, r := range plan.Reqs {
+		rawInterval := interval
+		schemaId, s := mdata.MatchSchema(r.Query, rawInterval)
+		if rawInterval == 0 {
+			rawInterval = s.Retentions[0].SecondsPerPoint
+		}
+		aggId, agg := mdata.MatchAgg(r.Query)
+		cons := r.Cons
+		if cons == 0 {
+			cons = consolidation.Consolidator(agg.AggregationMethod[0])
+		}
+		reqs = append(reqs, models.NewReq(schema.MKey{}, r.Query, r.Query, r.From, r.To, plan.MaxDataPoints, uint32(rawInterval), cons, r.Cons, nil, schemaId, aggId))
+		if r.From < minFrom {
+			minFrom = r.From
+		}
+		if r.To > maxTo {
+			maxTo = r.To
+		}
+	}
+	if len(reqs) == 0 {
+		return
+	}
+
+	reqs, pointsFetch, pointsReturn, err := api.AlignRequests(now, minFrom, maxTo, reqs, archReq, maxPointsPerReqSoft, maxPointsPerReqHard)
+	if err != nil {
+		fmt.Println("Fetches: request can't be satisfied:", err)
+		return
+	}
+	fmt.Println("Fetches:")
+	for _, req := range reqs {
+		s := mdata.Schemas.Get(req.SchemaId)
+		agg := mdata.Aggregations.Get(req.AggId)
+		fmt.Printf("  %s\n", req.Target)
+		fmt.Printf("    schema %q, aggregation %q, raw interval %ds\n", s.Name, agg.Name, req.RawInterval)
+		archive := "raw"
+		if req.Archive > 0 {
+			archive = fmt.Sprintf("rollup %d (%s)", req.Archive, rollups(req.Consolidator))
+		}
+		fmt.Printf("    archive %s, interval %ds, ttl %ds\n", archive, req.ArchInterval, req.TTL)
+		if req.AggNum > 1 {
+			fmt.Printf("    pre-normalization: consolidate every %d points using %s to interval %ds\n", req.AggNum, req.Consolidator, req.OutInterval)
+		} else {
+			fmt.Printf("    pre-normalization: none, output interval %ds\n", req.OutInterval)
+		}
+		points := (req.To - req.From) / req.OutInterval
+		if plan.MaxDataPoints != 0 && points > plan.MaxDataPoints {
+			aggNum := consolidation.AggEvery(points, plan.MaxDataPoints)
+			fmt.Printf("    post-normalization (max-data-points): consolidate every %d points using %s to interval %ds\n", aggNum, req.Consolidator, req.OutInterval*aggNum)
+		} else {
+			fmt.Printf("    post-normalization (max-data-points): none\n")
+		}
+	}
+	fmt.Printf("points to fetch: %d, points to return: %d\n", pointsFetch, pointsReturn)
+}
+
+// rollups returns the name of the rollup(s) read for the given consolidator
+func rollups(c consolidation.Consolidator) string {
+	if c == consolidation.Avg {
+		return "sum and cnt"
+	}
+	return c.Archive().String()
 }
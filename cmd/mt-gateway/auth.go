@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// user is what an api key maps to
+type user struct {
+	orgId int
+	admin bool // admins may submit data for any org, by setting the OrgId field of the metrics
+}
+
+// keys maps api keys to users
+type keys map[string]user
+
+// readKeys reads api keys, one per line, as "<key> <orgId> [admin]".
+// empty lines and lines starting with # are ignored.
+func readKeys(r io.Reader) (keys, error) {
+	k := make(keys)
+	scanner := bufio.NewScanner(r)
+	var lineNum int
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && fields[2] != "admin") {
+			return nil, fmt.Errorf("line %d: expected '<key> <orgId> [admin]'", lineNum)
+		}
+		orgId, err := strconv.Atoi(fields[1])
+		if err != nil || orgId < 1 {
+			return nil, fmt.Errorf("line %d: invalid org id %q", lineNum, fields[1])
+		}
+		if _, ok := k[fields[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key", lineNum)
+		}
+		k[fields[0]] = user{orgId: orgId, admin: len(fields) == 3}
+	}
+	return k, scanner.Err()
+}
+
+// authenticate returns the user for the api key in the request,
+// which may be given as the password of basic auth (with any username) or as a bearer token.
+func (k keys) authenticate(r *http.Request) (user, bool) {
+	var key string
+	if _, pass, ok := r.BasicAuth(); ok {
+		key = pass
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key == "" {
+		return user{}, false
+	}
+	u, ok := k[key]
+	return u, ok
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/metrics20/go-metrics20/carbon20"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// carbonListener accepts the carbon plaintext protocol.
+// the protocol has no notion of authentication, so all data is assigned to a single, configured org.
+type carbonListener struct {
+	orgId    int
+	pub      publisher
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newCarbonListener(addr string, orgId int, pub publisher) (*carbonListener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &carbonListener{
+		orgId:    orgId,
+		pub:      pub,
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+	}
+	c.wg.Add(1)
+	go c.accept()
+	return c, nil
+}
+
+func (c *carbonListener) accept() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "use of closed network connection") {
+				return
+			}
+			log.Errorf("carbon: accept error: %s", err)
+			continue
+		}
+		c.Lock()
+		c.conns[conn] = struct{}{}
+		c.Unlock()
+		c.wg.Add(1)
+		go c.handle(conn)
+	}
+}
+
+func (c *carbonListener) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		c.Lock()
+		delete(c.conns, conn)
+		c.Unlock()
+		c.wg.Done()
+	}()
+	r := bufio.NewReaderSize(conn, 4096)
+	for {
+		// like metrictank's carbon input, we don't support lines longer than 4096B
+		buf, _, err := r.ReadLine()
+		if err != nil {
+			if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+				log.Errorf("carbon: recv error: %s", err)
+			}
+			return
+		}
+		md, err := parseCarbonLine(buf, c.orgId)
+		if err != nil {
+			log.Debugf("carbon: invalid metric from %s: %s", conn.RemoteAddr(), err)
+			continue
+		}
+		c.pub.Publish([]*schema.MetricData{md})
+	}
+}
+
+// parseCarbonLine parses a carbon plaintext line (optionally with tags, as name;tag=value) into a MetricData.
+// the interval is taken from the matching storage-schema.
+func parseCarbonLine(line []byte, orgId int) (*schema.MetricData, error) {
+	key, val, ts, err := carbon20.ValidatePacket(line, carbon20.MediumLegacy, carbon20.NoneM20)
+	if err != nil {
+		return nil, err
+	}
+	nameSplits := strings.Split(string(key), ";")
+	_, s := mdata.MatchSchema(nameSplits[0], 0)
+	md := &schema.MetricData{
+		Name:     nameSplits[0],
+		Interval: s.Retentions[0].SecondsPerPoint,
+		Value:    val,
+		Unit:     "unknown",
+		Time:     int64(ts),
+		Mtype:    "gauge",
+		Tags:     nameSplits[1:],
+		OrgId:    orgId,
+	}
+	md.SetId()
+	return md, md.Validate()
+}
+
+// Close stops accepting new connections, closes the existing ones and waits for their handlers to finish.
+func (c *carbonListener) Close() error {
+	err := c.listener.Close()
+	c.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.Unlock()
+	c.wg.Wait()
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// maxBodySize is the largest request body we accept on the metrics endpoint
+const maxBodySize = 32 << 20
+
+type server struct {
+	keys keys
+	pub  publisher
+}
+
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.metrics)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	return mux
+}
+
+// metrics accepts an array of MetricData, either as json (Content-Type application/json)
+// or msgp encoded (Content-Type rt-metric-binary).
+func (s *server) metrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	u, ok := s.keys.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mt-gateway"`)
+		http.Error(w, "invalid or missing api key", http.StatusUnauthorized)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var metrics []*schema.MetricData
+	switch r.Header.Get("Content-Type") {
+	case "rt-metric-binary":
+		var arr schema.MetricDataArray
+		_, err = arr.UnmarshalMsg(body)
+		metrics = []*schema.MetricData(arr)
+	case "application/json", "":
+		err = json.Unmarshal(body, &metrics)
+	default:
+		http.Error(w, "unsupported Content-Type. use application/json or rt-metric-binary", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode metrics: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	for i, m := range metrics {
+		if m == nil {
+			http.Error(w, fmt.Sprintf("metric %d: null", i), http.StatusBadRequest)
+			return
+		}
+		err := prepare(m, u)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("metric %d (%q): %s", i, m.Name, err), http.StatusBadRequest)
+			return
+		}
+	}
+	s.pub.Publish(metrics)
+	log.Debugf("accepted %d metrics for org %d", len(metrics), u.orgId)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// prepare applies the org mapping of the user to the metric, then sets its id and validates it.
+// only admins may submit metrics for other orgs than their own.
+func prepare(m *schema.MetricData, u user) error {
+	if !u.admin || m.OrgId == 0 {
+		m.OrgId = u.orgId
+	}
+	m.SetId()
+	return m.Validate()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// publisher accepts validated metrics for delivery
+type publisher interface {
+	Publish(metrics []*schema.MetricData)
+}
+
+// kafkaPublisher batches metrics and produces them to kafka, in the MetricData msgp format,
+// into the partition determined by the partition scheme, like the kafka-mdm input of metrictank expects.
+type kafkaPublisher struct {
+	topic         string
+	client        sarama.Client
+	producer      sarama.SyncProducer
+	part          *partitioner.Kafka
+	numPartitions int32
+	batchSize     int
+	flushInterval time.Duration
+
+	in       chan *schema.MetricData
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newKafkaPublisher(brokers []string, topic, codec, partitionScheme string, batchSize int, flushInterval time.Duration, bufferSize int) (*kafkaPublisher, error) {
+	part, err := partitioner.NewKafka(partitionScheme)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	switch codec {
+	case "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to get partitions of topic %q: %s", topic, err)
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	k := &kafkaPublisher{
+		topic:         topic,
+		client:        client,
+		producer:      producer,
+		part:          part,
+		numPartitions: int32(len(partitions)),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		in:            make(chan *schema.MetricData, bufferSize),
+		shutdown:      make(chan struct{}),
+	}
+	k.wg.Add(1)
+	go k.run()
+	return k, nil
+}
+
+// Publish queues the metrics for delivery. it blocks when the buffer is full, to apply backpressure to the clients.
+func (k *kafkaPublisher) Publish(metrics []*schema.MetricData) {
+	for _, m := range metrics {
+		k.in <- m
+	}
+}
+
+func (k *kafkaPublisher) run() {
+	defer k.wg.Done()
+	ticker := time.NewTicker(k.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*schema.MetricData, 0, k.batchSize)
+	for {
+		select {
+		case m := <-k.in:
+			batch = append(batch, m)
+			if len(batch) >= k.batchSize {
+				k.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			k.flush(batch)
+			batch = batch[:0]
+		case <-k.shutdown:
+			// drain whatever is still queued
+			for {
+				select {
+				case m := <-k.in:
+					batch = append(batch, m)
+				default:
+					k.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (k *kafkaPublisher) flush(batch []*schema.MetricData) {
+	if len(batch) == 0 {
+		return
+	}
+	payload := make([]*sarama.ProducerMessage, 0, len(batch))
+	for _, m := range batch {
+		data, err := m.MarshalMsg(nil)
+		if err != nil {
+			log.Errorf("failed to marshal metric %s: %s", m.Id, err)
+			continue
+		}
+		partition, err := k.part.Partition(m, k.numPartitions)
+		if err != nil {
+			log.Errorf("failed to get partition for metric %s: %s", m.Id, err)
+			continue
+		}
+		payload = append(payload, &sarama.ProducerMessage{
+			Topic:     k.topic,
+			Partition: partition,
+			Value:     sarama.ByteEncoder(data),
+		})
+	}
+	pre := time.Now()
+	// the producer already retries, so if it fails, there's not much more we can do
+	err := k.producer.SendMessages(payload)
+	if err != nil {
+		if errors, ok := err.(sarama.ProducerErrors); ok {
+			log.Errorf("failed to publish %d out of %d metrics to kafka. first error: %s", len(errors), len(payload), errors[0].Err)
+		} else {
+			log.Errorf("failed to publish %d metrics to kafka: %s", len(payload), err)
+		}
+		return
+	}
+	log.Debugf("published %d metrics to kafka in %s", len(payload), time.Since(pre))
+}
+
+// Close flushes all queued metrics and closes the producer.
+func (k *kafkaPublisher) Close() error {
+	close(k.shutdown)
+	k.wg.Wait()
+	err := k.producer.Close()
+	k.client.Close()
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+var (
+	gitHash     = "(none)"
+	showVersion = flag.Bool("version", false, "print version string")
+
+	httpAddr    = flag.String("http-addr", ":8081", "address to listen on for the http metrics endpoint")
+	carbonAddr  = flag.String("carbon-addr", "", "address to listen on for the carbon plaintext protocol. empty disables carbon ingestion")
+	carbonOrgId = flag.Int("carbon-org-id", 1, "org to assign the data received over carbon to")
+	keysFile    = flag.String("keys-file", "/etc/metrictank/gateway-keys.txt", "file with api keys, one per line, as '<key> <orgId> [admin]'")
+	schemasFile = flag.String("schemas-file", "", "path to storage-schemas.conf file, used to determine the interval of data received over carbon. if not set, the metrictank defaults are used")
+
+	kafkaBrokers    = flag.String("kafka-brokers", "kafka:9092", "tcp address for kafka (may be given as a comma-separated list)")
+	kafkaTopic      = flag.String("kafka-topic", "mdm", "kafka topic to produce to")
+	kafkaCodec      = flag.String("kafka-codec", "snappy", "compression codec: none, gzip or snappy")
+	partitionScheme = flag.String("partition-scheme", "bySeries", "method used for partitioning metrics: byOrg or bySeries. must match what your metrictank instances expect")
+	batchSize       = flag.Int("batch-size", 10000, "max number of metrics to produce to kafka in one batch")
+	flushInterval   = flag.Duration("flush-interval", time.Second, "max time to wait before producing a partial batch")
+	bufferSize      = flag.Int("buffer-size", 100000, "number of metrics that can be queued for producing. when full, clients are slowed down")
+
+	verbose = flag.Bool("verbose", false, "log each batch and request")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println("mt-gateway")
+		fmt.Println()
+		fmt.Println("Ingest gateway that authenticates clients, maps them to their org, validates and batches their MetricData")
+		fmt.Println("and produces it to kafka, for consumption by metrictank's kafka-mdm input.")
+		fmt.Println()
+		fmt.Println("Endpoints:")
+		fmt.Println()
+		fmt.Println("	POST /metrics: array of MetricData, as json (Content-Type: application/json) or msgp (Content-Type: rt-metric-binary)")
+		fmt.Println("	               authenticate with the api key as basic auth password (any username) or as bearer token.")
+		fmt.Println("	               the org of the api key is applied to all metrics, unless the key is an admin key and the metric specifies an org")
+		fmt.Println("	GET /healthz:  returns ok")
+		fmt.Println("	carbon:        plaintext protocol, if enabled. carbon has no authentication: all data goes to carbon-org-id,")
+		fmt.Println("	               so only expose it to trusted networks")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-gateway [flags]\n")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-gateway -keys-file keys.txt -kafka-brokers kafka:9092 -carbon-addr :2003 -schemas-file /etc/metrictank/storage-schemas.conf")
+		fmt.Println("curl -u api_key:secret -H 'Content-Type: application/json' -d '[{\"name\":\"foo\",\"interval\":10,\"value\":1,\"time\":1514764800,\"mtype\":\"gauge\"}]' http://localhost:8081/metrics")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-gateway (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	if *batchSize < 1 || *bufferSize < 1 || *flushInterval <= 0 {
+		log.Fatal("batch-size, buffer-size and flush-interval must be positive")
+	}
+
+	f, err := os.Open(*keysFile)
+	if err != nil {
+		log.Fatalf("can't open keys file: %s", err)
+	}
+	keys, err := readKeys(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("can't read keys file %q: %s", *keysFile, err)
+	}
+	log.Infof("loaded %d api keys", len(keys))
+
+	mdata.Schemas = conf.NewSchemas(nil)
+	if *schemasFile != "" {
+		mdata.Schemas, err = conf.ReadSchemas(*schemasFile)
+		if err != nil {
+			log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+		}
+	}
+
+	pub, err := newKafkaPublisher(strings.Split(*kafkaBrokers, ","), *kafkaTopic, *kafkaCodec, *partitionScheme, *batchSize, *flushInterval, *bufferSize)
+	if err != nil {
+		log.Fatalf("failed to create kafka producer: %s", err)
+	}
+	log.Infof("producing to topic %s with %d partitions", *kafkaTopic, pub.numPartitions)
+
+	var carbon *carbonListener
+	if *carbonAddr != "" {
+		carbon, err = newCarbonListener(*carbonAddr, *carbonOrgId, pub)
+		if err != nil {
+			log.Fatalf("failed to listen for carbon on %s: %s", *carbonAddr, err)
+		}
+		log.Infof("listening for carbon on %s", *carbonAddr)
+	}
+
+	s := &server{keys: keys, pub: pub}
+	srv := &http.Server{Addr: *httpAddr, Handler: s.routes()}
+	go func() {
+		log.Infof("listening for http on %s", *httpAddr)
+		err := srv.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("http server failed: %s", err)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+	log.Infof("received signal %q. shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	srv.Shutdown(ctx)
+	cancel()
+	if carbon != nil {
+		carbon.Close()
+	}
+	pub.Close()
+}
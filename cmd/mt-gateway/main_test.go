@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
+)
+
+type mockPublisher struct {
+	sync.Mutex
+	metrics []*schema.MetricData
+}
+
+func (m *mockPublisher) Publish(metrics []*schema.MetricData) {
+	m.Lock()
+	m.metrics = append(m.metrics, metrics...)
+	m.Unlock()
+}
+
+func TestReadKeys(t *testing.T) {
+	in := `
+# comment
+abc 1
+def 2 admin
+`
+	k, err := readKeys(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(k) != 2 || k["abc"] != (user{1, false}) || k["def"] != (user{2, true}) {
+		t.Fatalf("unexpected keys %v", k)
+	}
+	for _, in := range []string{"abc", "abc x", "abc 0", "abc 1 root", "abc 1\nabc 2"} {
+		if _, err := readKeys(strings.NewReader(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	pub := &mockPublisher{}
+	s := &server{
+		keys: keys{"user": {orgId: 3}, "admin": {orgId: 1, admin: true}},
+		pub:  pub,
+	}
+	handler := s.routes()
+	body := `[{"name":"a","interval":10,"value":1,"time":100,"mtype":"gauge"},{"name":"b","org_id":5,"interval":10,"value":2,"time":100,"mtype":"gauge"}]`
+
+	cases := []struct {
+		key     string
+		body    string
+		expCode int
+		expOrgs []int
+	}{
+		{"", body, http.StatusUnauthorized, nil},
+		{"wrong", body, http.StatusUnauthorized, nil},
+		{"user", body, http.StatusOK, []int{3, 3}},
+		{"admin", body, http.StatusOK, []int{1, 5}},
+		{"user", `[{"name":"a","interval":0,"value":1,"time":100,"mtype":"gauge"}]`, http.StatusBadRequest, nil},
+		{"user", `not json`, http.StatusBadRequest, nil},
+	}
+	for i, c := range cases {
+		pub.metrics = nil
+		req := httptest.NewRequest("POST", "/metrics", strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		if c.key != "" {
+			req.SetBasicAuth("api_key", c.key)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.expCode {
+			t.Fatalf("case %d: expected code %d, got %d (%s)", i, c.expCode, rec.Code, rec.Body.String())
+		}
+		if len(pub.metrics) != len(c.expOrgs) {
+			t.Fatalf("case %d: expected %d published metrics, got %d", i, len(c.expOrgs), len(pub.metrics))
+		}
+		for j, m := range pub.metrics {
+			if m.OrgId != c.expOrgs[j] {
+				t.Fatalf("case %d: metric %d: expected org %d, got %d", i, j, c.expOrgs[j], m.OrgId)
+			}
+			if m.Id == "" {
+				t.Fatalf("case %d: metric %d: id not set", i, j)
+			}
+		}
+	}
+
+	// bearer tokens are accepted too
+	req := httptest.NewRequest("POST", "/metrics", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer user")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected code 200 for bearer token, got %d", rec.Code)
+	}
+}
+
+func TestParseCarbonLine(t *testing.T) {
+	mdata.Schemas = conf.NewSchemas(nil)
+	md, err := parseCarbonLine([]byte("foo.bar;dc=us 1.5 1514764800"), 7)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if md.Name != "foo.bar" || md.OrgId != 7 || md.Value != 1.5 || md.Time != 1514764800 || len(md.Tags) != 1 || md.Tags[0] != "dc=us" {
+		t.Fatalf("unexpected metric %v", md)
+	}
+	if md.Interval != mdata.Schemas.DefaultSchema.Retentions[0].SecondsPerPoint {
+		t.Fatalf("expected interval of the default schema, got %d", md.Interval)
+	}
+	if _, err := parseCarbonLine([]byte("foo.bar"), 7); err == nil {
+		t.Fatalf("expected error for invalid line")
+	}
+}
@@ -11,6 +11,7 @@ import (
 
 	"github.com/grafana/metrictank/cmd/mt-index-cat/out"
 	"github.com/grafana/metrictank/idx/cassandra"
+	"github.com/grafana/metrictank/idx/memory"
 	"github.com/raintank/dur"
 	"gopkg.in/raintank/schema.v1"
 )
@@ -31,12 +32,14 @@ func main() {
 	var maxAge string
 	var verbose bool
 	var limit int
+	var tagQuery tagExprs
 
 	globalFlags := flag.NewFlagSet("global config flags", flag.ExitOnError)
 	globalFlags.StringVar(&addr, "addr", "http://localhost:6060", "graphite/metrictank address")
 	globalFlags.StringVar(&prefix, "prefix", "", "only show metrics that have this prefix")
 	globalFlags.StringVar(&substr, "substr", "", "only show metrics that have this substring")
 	globalFlags.StringVar(&tags, "tags", "", "tag filter. empty (default), 'some', 'none', 'valid', or 'invalid'")
+	globalFlags.Var(&tagQuery, "tag-expr", "only show metrics matching this seriesByTag-style expression, like 'dc=us-east' or 'name=~^foo'. may be given multiple times, in which case all of them must match")
 	globalFlags.StringVar(&from, "from", "30min", "for vegeta outputs, will generate requests for data starting from now minus... eg '30min', '5h', '14d', etc. or a unix timestamp")
 	globalFlags.StringVar(&maxAge, "max-age", "6h30min", "max age (last update diff with now) of metricdefs.  use 0 to disable")
 	globalFlags.IntVar(&limit, "limit", 0, "only show this many metrics.  use 0 to disable")
@@ -44,7 +47,7 @@ func main() {
 
 	cassFlags := cassandra.ConfigSetup()
 
-	outputs := []string{"dump", "list", "vegeta-render", "vegeta-render-patterns"}
+	outputs := []string{"dump", "list", "json", "ndjson", "csv", "count-by-org", "count-by-tag", "vegeta-render", "vegeta-render-patterns"}
 
 	flag.Usage = func() {
 		fmt.Println("mt-index-cat")
@@ -64,11 +67,18 @@ func main() {
 		fmt.Println("     'valid'   only show metrics whose tags (if any) are valid")
 		fmt.Println("     'invalid' only show metrics that have one or more invalid tags")
 		fmt.Println()
+		fmt.Println("tag-expr filter:")
+		fmt.Println("     the same expressions as supported by seriesByTag(): tag=value, tag!=value, tag=~regex, tag!=~regex and tag^=prefix")
+		fmt.Println("     at least one expression must be of the form tag=value, tag=~regex or tag^=prefix")
+		fmt.Println()
 		fmt.Printf("idxtype: only 'cass' supported for now\n\n")
 		fmt.Printf("cass config flags:\n\n")
 		cassFlags.PrintDefaults()
 		fmt.Println()
 		fmt.Printf("output: either presets like %v\n", strings.Join(outputs, "|"))
+		fmt.Println("output: json prints the full definitions as a json array, ndjson prints them as one json object per line")
+		fmt.Println("output: csv prints the definitions as csv with a header, with the tags of a definition joined by ';'")
+		fmt.Println("output: count-by-org and count-by-tag print aggregate reports of how many metrics each org has, and how many metrics have each tag key")
 		fmt.Printf("output: or custom templates like '{{.Id}} {{.OrgId}} {{.Name}} {{.Metric}} {{.Interval}} {{.Unit}} {{.Mtype}} {{.Tags}} {{.LastUpdate}} {{.Partition}}'\n\n\n")
 		fmt.Println("You may also use processing functions in templates:")
 		fmt.Println("pattern: transforms a graphite.style.metric.name into a pattern with wildcards inserted")
@@ -79,6 +89,9 @@ func main() {
 		fmt.Println("mt-index-cat -from 60min cass -hosts cassandra:9042 'sumSeries({{.Name | pattern}})'")
 		fmt.Println("mt-index-cat -from 60min cass -hosts cassandra:9042 'GET http://localhost:6060/render?target=sumSeries({{.Name | pattern}})&from=-6h\\nX-Org-Id: 1\\n\\n'")
 		fmt.Println("mt-index-cat cass -hosts cassandra:9042 -timeout 60s '{{.LastUpdate | age | roundDuration}}\\n' | sort | uniq -c")
+		fmt.Println("mt-index-cat -tag-expr 'dc=us-east' -tag-expr 'name=~^cpu\\.' cass -hosts cassandra:9042 json")
+		fmt.Println("mt-index-cat -max-age 0 cass -hosts cassandra:9042 count-by-tag")
+		fmt.Println("mt-index-cat -tag-expr 'env=prod' cass -hosts cassandra:9042 ndjson | jq -r .name")
 	}
 
 	if len(os.Args) == 2 && (os.Args[1] == "-h" || os.Args[1] == "--help") {
@@ -130,13 +143,32 @@ func main() {
 	cassFlags.Parse(os.Args[cassI+1 : len(os.Args)-1])
 	cassandra.Enabled = true
 
+	if len(tagQuery) > 0 {
+		// validate the expressions before we go through the trouble of loading the index
+		_, err := memory.NewTagQuery(tagQuery, 0)
+		if err != nil {
+			log.Fatalf("invalid tag-expr: %s", err)
+		}
+	}
+
 	var show func(d schema.MetricDefinition)
+	var done func()
 
 	switch format {
 	case "dump":
 		show = out.Dump
 	case "list":
 		show = out.List
+	case "json":
+		show, done = out.GetJSON()
+	case "ndjson":
+		show = out.NDJSON
+	case "csv":
+		show, done = out.GetCSV()
+	case "count-by-org":
+		show, done = out.GetCountByOrg()
+	case "count-by-tag":
+		show, done = out.GetCountByTag()
 	case "vegeta-render":
 		show = out.GetVegetaRender(addr, from)
 	case "vegeta-render-patterns":
@@ -169,6 +201,12 @@ func main() {
 	total := len(defs)
 	shown := 0
 
+	var matched map[schema.MKey]struct{}
+	if len(tagQuery) > 0 {
+		matched, err = matchTagQuery(defs, tagQuery)
+		perror(err)
+	}
+
 	for _, d := range defs {
 		// note that prefix and substr can be "", meaning filter disabled.
 		// the conditions handle this fine as well.
@@ -192,6 +230,11 @@ func main() {
 				continue
 			}
 		}
+		if matched != nil {
+			if _, ok := matched[d.Id]; !ok {
+				continue
+			}
+		}
 		show(d)
 		shown += 1
 		if shown == limit {
@@ -199,6 +242,10 @@ func main() {
 		}
 	}
 
+	if done != nil {
+		done()
+	}
+
 	if verbose {
 		fmt.Fprintf(os.Stderr, "total: %d\n", total)
 		fmt.Fprintf(os.Stderr, "shown: %d\n", shown)
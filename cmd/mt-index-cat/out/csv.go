@@ -0,0 +1,45 @@
+package out
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+var csvHeader = []string{"mkey", "org_id", "name", "interval", "unit", "mtype", "tags", "lastUpdate", "partition"}
+
+// GetCSV returns a function that prints definitions as csv records, after a header,
+// and a function that flushes the output after the last definition was shown.
+// the tags of a definition are joined with ';' into one field.
+func GetCSV() (func(d schema.MetricDefinition), func()) {
+	w := csv.NewWriter(os.Stdout)
+	write := func(record []string) {
+		if err := w.Write(record); err != nil {
+			panic(err)
+		}
+	}
+	write(csvHeader)
+	show := func(d schema.MetricDefinition) {
+		write([]string{
+			d.Id.String(),
+			strconv.FormatUint(uint64(d.OrgId), 10),
+			d.Name,
+			strconv.Itoa(d.Interval),
+			d.Unit,
+			d.Mtype,
+			strings.Join(d.Tags, ";"),
+			strconv.FormatInt(d.LastUpdate, 10),
+			strconv.FormatInt(int64(d.Partition), 10),
+		})
+	}
+	done := func() {
+		w.Flush()
+		if err := w.Error(); err != nil {
+			panic(err)
+		}
+	}
+	return show, done
+}
@@ -0,0 +1,51 @@
+package out
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+// jsonDef is a MetricDefinition with its id rendered as a string, rather than as the raw MKey structure
+type jsonDef struct {
+	schema.MetricDefinition
+	Id string `json:"mkey"`
+}
+
+// GetJSON returns a function that prints definitions as elements of a json array,
+// and a function that terminates the array after the last definition was shown.
+func GetJSON() (func(d schema.MetricDefinition), func()) {
+	first := true
+	show := func(d schema.MetricDefinition) {
+		buf, err := json.Marshal(jsonDef{d, d.Id.String()})
+		if err != nil {
+			panic(err)
+		}
+		if first {
+			fmt.Print("[\n")
+			first = false
+		} else {
+			fmt.Print(",\n")
+		}
+		os.Stdout.Write(buf)
+	}
+	done := func() {
+		if first {
+			fmt.Println("[]")
+			return
+		}
+		fmt.Print("\n]\n")
+	}
+	return show, done
+}
+
+// NDJSON prints the definition as json on a line of its own, so that the output can be streamed into other tools
+func NDJSON(d schema.MetricDefinition) {
+	buf, err := json.Marshal(jsonDef{d, d.Id.String()})
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(append(buf, '\n'))
+}
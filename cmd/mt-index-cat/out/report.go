@@ -0,0 +1,60 @@
+package out
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+// GetCountByOrg returns a function to tally definitions per org,
+// and a function that prints the tally, sorted by org.
+func GetCountByOrg() (func(d schema.MetricDefinition), func()) {
+	counts := make(map[uint32]int)
+	show := func(d schema.MetricDefinition) {
+		counts[d.OrgId]++
+	}
+	done := func() {
+		orgs := make([]int, 0, len(counts))
+		for org := range counts {
+			orgs = append(orgs, int(org))
+		}
+		sort.Ints(orgs)
+		for _, org := range orgs {
+			fmt.Println(org, counts[uint32(org)])
+		}
+	}
+	return show, done
+}
+
+// GetCountByTag returns a function to tally, for each tag key, how many definitions have it,
+// and a function that prints the tally, sorted by count (descending).
+func GetCountByTag() (func(d schema.MetricDefinition), func()) {
+	counts := make(map[string]int)
+	show := func(d schema.MetricDefinition) {
+		for _, tag := range d.Tags {
+			key := tag
+			if pos := strings.Index(tag, "="); pos >= 0 {
+				key = tag[:pos]
+			}
+			counts[key]++
+		}
+	}
+	done := func() {
+		keys := make([]string, 0, len(counts))
+		for key := range counts {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if counts[keys[i]] == counts[keys[j]] {
+				return keys[i] < keys[j]
+			}
+			return counts[keys[i]] > counts[keys[j]]
+		})
+		for _, key := range keys {
+			fmt.Println(counts[key], key)
+		}
+	}
+	return show, done
+}
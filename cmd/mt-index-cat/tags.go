@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/grafana/metrictank/idx/memory"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// tagExprs is a flag.Value that may be given multiple times
+type tagExprs []string
+
+func (t *tagExprs) String() string {
+	return strings.Join(*t, " ")
+}
+
+func (t *tagExprs) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+// matchTagQuery returns the ids of the definitions that satisfy all given tag expressions
+// it does so by loading the definitions into a memory index, so that we use the exact
+// same logic as seriesByTag() queries do.
+func matchTagQuery(defs []schema.MetricDefinition, expressions []string) (map[schema.MKey]struct{}, error) {
+	memory.TagSupport = true
+	memory.TagQueryWorkers = 20
+
+	idx := memory.New()
+	idx.Load(defs)
+
+	orgs := make(map[uint32]struct{})
+	for _, d := range defs {
+		orgs[d.OrgId] = struct{}{}
+	}
+
+	matched := make(map[schema.MKey]struct{})
+	for org := range orgs {
+		nodes, err := idx.FindByTag(org, expressions, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			for _, d := range n.Defs {
+				matched[d.Id] = struct{}{}
+			}
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/util"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	gitHash     = "(none)"
+	showVersion = flag.Bool("version", false, "print version string")
+
+	srcCassAddr = flag.String("src-cass-addr", "localhost", "address of cassandra host to read the index from. ignored if src-api-addr is set")
+	srcKeyspace = flag.String("src-keyspace", "raintank", "cassandra keyspace of the source index")
+	srcTable    = flag.String("src-table", "metric_idx", "cassandra table of the source index")
+	srcAPIAddr  = flag.String("src-api-addr", "", "base url(s) of running metrictank node(s) to read the index from, instead of cassandra (comma separated). a node only has the definitions of the partitions it consumes, so include a node for each shard")
+
+	dstCassAddr = flag.String("dst-cass-addr", "localhost", "address of cassandra host to write the index to")
+	dstKeyspace = flag.String("dst-keyspace", "raintank", "cassandra keyspace of the destination index")
+	dstTable    = flag.String("dst-table", "metric_idx", "cassandra table of the destination index")
+	schemaFile  = flag.String("schema-file", "/etc/metrictank/schema-idx-cassandra.toml", "file containing the needed schemas in case the destination table needs initializing")
+
+	partitionScheme = flag.String("partition-scheme", "bySeries", "method used for partitioning metrics: byOrg or bySeries. must match what your metrictank instances expect")
+	numPartitions   = flag.Int("num-partitions", 1, "number of partitions to assign the definitions to")
+	orgs            = flag.String("orgs", "", "only copy the definitions of these orgs (comma separated). required when reading from the api")
+	orgMapStr       = flag.String("org-map", "", "rewrite org ids, as a comma separated list of <src>:<dst> pairs. e.g. 1:5,2:6")
+
+	threads = flag.Int("threads", 10, "number of workers writing to the destination")
+	dryRun  = flag.Bool("dry-run", true, "only print the resulting definitions, don't write them")
+	verbose = flag.Bool("verbose", false, "log each written definition")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println("mt-index-copy")
+		fmt.Println()
+		fmt.Println("Copies metric definitions from a source index to a destination index, assigning them to partitions")
+		fmt.Println("according to the new partition count, and optionally rewriting their org ids.")
+		fmt.Println("This is needed when you change the number of partitions of your kafka topic, or move orgs around.")
+		fmt.Println("The source can be a cassandra index table, or the index of running metrictank nodes. The destination is a cassandra index table.")
+		fmt.Println("Note that partition is part of the primary key of the index table: if source and destination are the same table,")
+		fmt.Println("the definitions under their old partitions are not removed. Prefer copying to a new table or keyspace.")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-index-copy [flags]\n")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-index-copy -src-cass-addr cassandra -dst-cass-addr cassandra -dst-keyspace metrictank2 -num-partitions 16 -dry-run=false")
+		fmt.Println("mt-index-copy -src-api-addr http://mt-0:6060,http://mt-1:6060 -orgs 1,2 -org-map 2:3 -dst-cass-addr cassandra -num-partitions 16")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-index-copy (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if *verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	if *numPartitions < 1 || *threads < 1 {
+		log.Fatal("num-partitions and threads must be at least 1")
+	}
+
+	orgFilter, err := parseOrgs(*orgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *srcAPIAddr != "" && len(orgFilter) == 0 {
+		log.Fatal("orgs must be set when reading from the api")
+	}
+	orgMap, err := parseOrgMap(*orgMapStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := partitioner.NewKafka(*partitionScheme)
+	if err != nil {
+		log.Fatalf("failed to initialize partitioner: %s", err)
+	}
+	r := &rewriter{
+		partitioner:   p,
+		numPartitions: int32(*numPartitions),
+		orgMap:        orgMap,
+	}
+
+	var dstSession *gocql.Session
+	if !*dryRun {
+		dstSession, err = newSession(*dstCassAddr, *dstKeyspace)
+		if err != nil {
+			log.Fatalf("failed to create cql session for destination cassandra: %s", err)
+		}
+		defer dstSession.Close()
+		schemaTable := strings.Replace(util.ReadEntry(*schemaFile, "schema_table").(string), ".metric_idx", "."+*dstTable, 1)
+		err = dstSession.Query(fmt.Sprintf(schemaTable, *dstKeyspace)).Exec()
+		if err != nil {
+			log.Fatalf("failed to initialize destination table: %s", err)
+		}
+	}
+
+	in := make(chan schema.MetricDefinition, 1000)
+	go func() {
+		defer close(in)
+		var err error
+		if *srcAPIAddr != "" {
+			client := &http.Client{Timeout: 5 * time.Minute}
+			seen := make(map[schema.MKey]struct{})
+			orgList := make([]uint32, 0, len(orgFilter))
+			for org := range orgFilter {
+				orgList = append(orgList, org)
+			}
+			for _, addr := range strings.Split(*srcAPIAddr, ",") {
+				err = readAPI(client, strings.TrimSuffix(addr, "/"), orgList, seen, in)
+				if err != nil {
+					break
+				}
+			}
+		} else {
+			var srcSession *gocql.Session
+			srcSession, err = newSession(*srcCassAddr, *srcKeyspace)
+			if err != nil {
+				log.Fatalf("failed to create cql session for source cassandra: %s", err)
+			}
+			err = readCassandra(srcSession, *srcTable, in)
+			srcSession.Close()
+		}
+		if err != nil {
+			log.Fatalf("failed to read source index: %s", err)
+		}
+	}()
+
+	var read, written, failed uint64
+	pre := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for def := range in {
+				atomic.AddUint64(&read, 1)
+				if len(orgFilter) > 0 {
+					if _, ok := orgFilter[def.OrgId]; !ok {
+						continue
+					}
+				}
+				err := r.rewrite(&def)
+				if err != nil {
+					log.Errorf("failed to rewrite %s: %s -> skipping", def.Id, err)
+					atomic.AddUint64(&failed, 1)
+					continue
+				}
+				if *dryRun {
+					fmt.Printf("%s %d %d %s %d %s %s %v %d\n", def.Id, def.OrgId, def.Partition, def.Name, def.Interval, def.Unit, def.Mtype, def.Tags, def.LastUpdate)
+				} else {
+					write(dstSession, *dstTable, def)
+				}
+				atomic.AddUint64(&written, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	log.Infof("read %d definitions, wrote %d, failed %d, in %s", read, written, failed, time.Since(pre))
+}
+
+// write saves the definition to the destination table, retrying until it succeeds
+func write(session *gocql.Session, table string, def schema.MetricDefinition) {
+	qry := fmt.Sprintf("INSERT INTO %s (id, orgid, partition, name, interval, unit, mtype, tags, lastupdate) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)", table)
+	attempts := 0
+	for {
+		err := session.Query(qry, def.Id.String(), def.OrgId, def.Partition, def.Name, def.Interval, def.Unit, def.Mtype, def.Tags, def.LastUpdate).Exec()
+		if err == nil {
+			log.Debugf("saved %s to partition %d", def.Id, def.Partition)
+			return
+		}
+		if (attempts % 20) == 0 {
+			log.Warnf("failed to write %s. it will be retried. %s", def.Id, err)
+		}
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+		attempts++
+	}
+}
+
+func parseOrgs(s string) (map[uint32]struct{}, error) {
+	orgs := make(map[uint32]struct{})
+	if s == "" {
+		return orgs, nil
+	}
+	for _, o := range strings.Split(s, ",") {
+		org, err := strconv.ParseUint(strings.TrimSpace(o), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org %q: %s", o, err)
+		}
+		orgs[uint32(org)] = struct{}{}
+	}
+	return orgs, nil
+}
+
+func newSession(addr, keyspace string) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(strings.Split(addr, ",")...)
+	cluster.Consistency = gocql.ParseConsistency("one")
+	cluster.Timeout = 10 * time.Second
+	cluster.NumConns = 2
+	cluster.ProtoVersion = 4
+	cluster.Keyspace = keyspace
+	return cluster.CreateSession()
+}
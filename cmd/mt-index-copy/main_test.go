@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/idx"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func testDef(org uint32, name string) schema.MetricDefinition {
+	def := schema.MetricDefinition{
+		OrgId:    org,
+		Name:     name,
+		Interval: 10,
+		Unit:     "unknown",
+		Mtype:    "gauge",
+	}
+	def.SetId()
+	return def
+}
+
+func TestParseOrgMap(t *testing.T) {
+	m, err := parseOrgMap("1:5, 2:6")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(m) != 2 || m[1] != 5 || m[2] != 6 {
+		t.Fatalf("unexpected org map %v", m)
+	}
+	for _, in := range []string{"1", "1:a", "1:2:3", "1:2,1:3", "-1:2"} {
+		if _, err := parseOrgMap(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	p, _ := partitioner.NewKafka("bySeries")
+	r := &rewriter{partitioner: p, numPartitions: 8, orgMap: map[uint32]uint32{1: 5}}
+
+	def := testDef(1, "foo.bar")
+	def.Partition = 3
+	err := r.rewrite(&def)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := testDef(5, "foo.bar")
+	if def.Id != exp.Id || def.OrgId != 5 {
+		t.Fatalf("expected org to be rewritten to 5 with id %s, got org %d id %s", exp.Id, def.OrgId, def.Id)
+	}
+	expPart, _ := p.Partition(&exp, 8)
+	if def.Partition != expPart {
+		t.Fatalf("expected partition %d, got %d", expPart, def.Partition)
+	}
+
+	other := testDef(2, "foo.bar")
+	id := other.Id
+	r.numPartitions = 1
+	r.rewrite(&other)
+	if other.Id != id || other.OrgId != 2 || other.Partition != 0 {
+		t.Fatalf("expected unmapped org to keep its id and get partition 0, got %+v", other)
+	}
+}
+
+func TestReadAPI(t *testing.T) {
+	public := testDef(idx.OrgIdPublic, "public")
+	defs := map[string][]schema.MetricDefinition{
+		"1": {testDef(1, "a"), public},
+		"2": {testDef(2, "b"), public},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		for _, def := range defs[r.FormValue("orgId")] {
+			buf, _ = (&idx.Archive{MetricDefinition: def}).MarshalMsg(buf)
+		}
+		w.Write(buf)
+	}))
+	defer server.Close()
+
+	out := make(chan schema.MetricDefinition, 10)
+	err := readAPI(server.Client(), server.URL, []uint32{1, 2}, make(map[schema.MKey]struct{}), out)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	close(out)
+	var names []string
+	for def := range out {
+		names = append(names, def.Name)
+	}
+	if len(names) != 3 || names[0] != "a" || names[1] != "public" || names[2] != "b" {
+		t.Fatalf("expected definitions a, public and b, got %v", names)
+	}
+}
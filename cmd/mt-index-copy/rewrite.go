@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// parseOrgMap parses a comma separated list of src:dst org id pairs
+func parseOrgMap(s string) (map[uint32]uint32, error) {
+	m := make(map[uint32]uint32)
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(pair), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid org mapping %q: expected <src>:<dst>", pair)
+		}
+		src, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org mapping %q: %s", pair, err)
+		}
+		dst, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org mapping %q: %s", pair, err)
+		}
+		if _, ok := m[uint32(src)]; ok {
+			return nil, fmt.Errorf("org %d mapped more than once", src)
+		}
+		m[uint32(src)] = uint32(dst)
+	}
+	return m, nil
+}
+
+// rewriter assigns definitions their new org and partition
+type rewriter struct {
+	partitioner   *partitioner.Kafka
+	numPartitions int32
+	orgMap        map[uint32]uint32
+}
+
+// rewrite applies the org mapping (which also changes the id, as the org is part of it)
+// and then computes the partition based on the new partition count.
+func (r *rewriter) rewrite(def *schema.MetricDefinition) error {
+	if org, ok := r.orgMap[def.OrgId]; ok {
+		def.OrgId = org
+		def.Id.Org = org
+	}
+	if r.numPartitions == 1 {
+		def.Partition = 0
+		return nil
+	}
+	p, err := r.partitioner.Partition(def, r.numPartitions)
+	if err != nil {
+		return err
+	}
+	def.Partition = p
+	return nil
+}
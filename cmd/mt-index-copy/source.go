@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/idx"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// readCassandra reads all definitions from the metric_idx table of the given session and sends them into out
+func readCassandra(session *gocql.Session, table string, out chan<- schema.MetricDefinition) error {
+	iter := session.Query(fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate from %s", table)).Iter()
+
+	var id, name, unit, mtype string
+	var orgId, interval int
+	var partition int32
+	var lastupdate int64
+	var tags []string
+	for iter.Scan(&id, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate) {
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			log.Errorf("could not parse ID %q: %s -> skipping", id, err)
+			continue
+		}
+		if orgId < 0 {
+			orgId = int(idx.OrgIdPublic)
+		}
+		out <- schema.MetricDefinition{
+			Id:         mkey,
+			OrgId:      uint32(orgId),
+			Partition:  partition,
+			Name:       name,
+			Interval:   interval,
+			Unit:       unit,
+			Mtype:      mtype,
+			Tags:       tags,
+			LastUpdate: lastupdate,
+		}
+	}
+	return iter.Close()
+}
+
+// readAPI reads the definitions of the given orgs from the /index/list endpoint of a running metrictank node,
+// and sends them into out.
+// note that a node only has the definitions of the partitions it consumes, and that the public org
+// is included in every listing. seen is used to only emit each definition once, across orgs and nodes.
+func readAPI(client *http.Client, addr string, orgs []uint32, seen map[schema.MKey]struct{}, out chan<- schema.MetricDefinition) error {
+	for _, org := range orgs {
+		resp, err := client.PostForm(addr+"/index/list", url.Values{"orgId": []string{strconv.Itoa(int(org))}})
+		if err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s/index/list for org %d returned status %d: %s", addr, org, resp.StatusCode, buf)
+		}
+		for len(buf) > 0 {
+			var a idx.Archive
+			buf, err = a.UnmarshalMsg(buf)
+			if err != nil {
+				return fmt.Errorf("failed to decode response of %s/index/list for org %d: %s", addr, org, err)
+			}
+			if _, ok := seen[a.Id]; ok {
+				continue
+			}
+			seen[a.Id] = struct{}{}
+			out <- a.MetricDefinition
+		}
+	}
+	return nil
+}
@@ -112,7 +112,7 @@ func (ip *inputOOOFinder) ProcessMetricData(metric *schema.MetricData, partition
 	ip.lock.Unlock()
 }
 
-func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.Format, partition int32) {
+func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.Format, partition int32) bool {
 	now := Msg{
 		Part: partition,
 		Seen: time.Now(),
@@ -122,7 +122,8 @@ func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.F
 	tracker, ok := ip.data[mp.MKey]
 	if !ok {
 		if !*doUnknownMP {
-			return
+			ip.lock.Unlock()
+			return false
 		}
 		ip.data[mp.MKey] = Tracker{
 			Head: now,
@@ -146,6 +147,7 @@ func (ip *inputOOOFinder) ProcessMetricPoint(mp schema.MetricPoint, format msg.F
 		}
 	}
 	ip.lock.Unlock()
+	return true
 }
 
 func main() {
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,6 +31,17 @@ var (
 	substr   = flag.String("substr", "", "only show metrics that have this substring")
 	invalid  = flag.Bool("invalid", false, "only show metrics that are invalid")
 
+	org        = flag.Int("org", 0, "only show metrics of this org. 0 means all orgs")
+	nameRegex  = flag.String("name-regex", "", "only show metrics whose name matches this regular expression")
+	partitions = flag.String("partitions", "", "only show metrics from these partitions (comma-separated list). empty means all consumed partitions")
+	asJSON     = flag.Bool("json", false, "print messages as json objects, one per line, rather than using the format templates")
+
+	statsInterval = flag.Duration("stats-interval", 0, "if non-zero, print the rates of the shown messages per org and per partition to stderr at this interval")
+
+	republishTopic   = flag.String("republish-topic", "", "if set, re-publish the shown messages to this kafka topic, into the same partition they were read from")
+	republishBrokers = flag.String("republish-brokers", "kafka:9092", "tcp address for kafka to re-publish to (may be given as a comma-separated list)")
+	republishCodec   = flag.String("republish-codec", "snappy", "compression codec for re-publishing: none, gzip or snappy")
+
 	stdoutLock = sync.Mutex{}
 )
 
@@ -45,6 +58,30 @@ type DataP struct {
 type inputPrinter struct {
 	tplMd template.Template
 	tplP  template.Template
+
+	nameRe *regexp.Regexp
+	parts  map[int32]struct{} // if non-nil, only these partitions are shown
+	stats  *rateStats         // may be nil
+	repub  *republisher       // may be nil
+
+	// MetricPoint messages don't have a name, so when filtering by name,
+	// we only show points of series we have seen a matching MetricData for.
+	sync.RWMutex
+	seen map[schema.MKey]struct{}
+}
+
+// jsonMsg is how messages are printed in json mode
+type jsonMsg struct {
+	Partition int32       `json:"partition"`
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+}
+
+type jsonPoint struct {
+	Id    string  `json:"id"`
+	OrgId uint32  `json:"orgId"`
+	Value float64 `json:"value"`
+	Time  uint32  `json:"time"`
 }
 
 func dateInt64(ts int64) string {
@@ -55,7 +92,7 @@ func dateUint32(ts uint32) string {
 	return dateInt64(int64(ts))
 }
 
-func newInputPrinter(formatMd, formatP string) inputPrinter {
+func newInputPrinter(formatMd, formatP string) *inputPrinter {
 	funcsMd := map[string]interface{}{
 		"date": dateInt64,
 	}
@@ -65,52 +102,127 @@ func newInputPrinter(formatMd, formatP string) inputPrinter {
 
 	tplMd := template.Must(template.New("format").Funcs(funcsMd).Parse(formatMd + "\n"))
 	tplP := template.Must(template.New("format").Funcs(funcsP).Parse(formatP + "\n"))
-	return inputPrinter{
-		*tplMd,
-		*tplP,
+	return &inputPrinter{
+		tplMd: *tplMd,
+		tplP:  *tplP,
+		seen:  make(map[schema.MKey]struct{}),
+	}
+}
+
+func (ip *inputPrinter) nameFiltering() bool {
+	return *prefix != "" || *substr != "" || ip.nameRe != nil
+}
+
+func (ip *inputPrinter) partitionOk(partition int32) bool {
+	if ip.parts == nil {
+		return true
 	}
+	_, ok := ip.parts[partition]
+	return ok
 }
 
-func (ip inputPrinter) ProcessMetricData(metric *schema.MetricData, partition int32) {
+func (ip *inputPrinter) print(data interface{}, tpl *template.Template, typ string, partition int32) {
+	var err error
+	stdoutLock.Lock()
+	if *asJSON {
+		var buf []byte
+		buf, err = json.Marshal(jsonMsg{partition, typ, data})
+		if err == nil {
+			buf = append(buf, '\n')
+			_, err = os.Stdout.Write(buf)
+		}
+	} else {
+		err = tpl.Execute(os.Stdout, data)
+	}
+	stdoutLock.Unlock()
+	if err != nil {
+		log.Error(0, "printing message: %s", err)
+	}
+}
+
+func (ip *inputPrinter) ProcessMetricData(metric *schema.MetricData, partition int32) {
+	if !ip.partitionOk(partition) {
+		return
+	}
+	if *org != 0 && metric.OrgId != *org {
+		return
+	}
 	if *prefix != "" && !strings.HasPrefix(metric.Name, *prefix) {
 		return
 	}
 	if *substr != "" && !strings.Contains(metric.Name, *substr) {
 		return
 	}
+	if ip.nameRe != nil && !ip.nameRe.MatchString(metric.Name) {
+		return
+	}
+	if ip.nameFiltering() {
+		mkey, err := schema.MKeyFromString(metric.Id)
+		if err == nil {
+			ip.Lock()
+			ip.seen[mkey] = struct{}{}
+			ip.Unlock()
+		}
+	}
 	if *invalid {
 		err := metric.Validate()
 		if err == nil && metric.Time != 0 {
 			return
 		}
 	}
-	stdoutLock.Lock()
-	err := ip.tplMd.Execute(os.Stdout, DataMd{
-		partition,
-		*metric,
-	})
-
-	stdoutLock.Unlock()
-	if err != nil {
-		log.Error(0, "executing template: %s", err)
+	if ip.stats != nil {
+		ip.stats.add(uint32(metric.OrgId), partition, false)
+	}
+	if *asJSON {
+		ip.print(metric, nil, "MetricData", partition)
+	} else {
+		ip.print(DataMd{partition, *metric}, &ip.tplMd, "", partition)
+	}
+	if ip.repub != nil {
+		err := ip.repub.sendMetricData(metric, partition)
+		if err != nil {
+			log.Error(0, "re-publishing MetricData %s: %s", metric.Id, err)
+		}
 	}
 }
 
-func (ip inputPrinter) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) {
-
+func (ip *inputPrinter) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	if !ip.partitionOk(partition) {
+		return true
+	}
+	if *org != 0 && point.MKey.Org != uint32(*org) {
+		return true
+	}
+	if ip.nameFiltering() {
+		ip.RLock()
+		_, ok := ip.seen[point.MKey]
+		ip.RUnlock()
+		if !ok {
+			return true
+		}
+	}
 	if *invalid && point.Valid() {
-		return
+		return true
 	}
-
-	stdoutLock.Lock()
-	err := ip.tplP.Execute(os.Stdout, DataP{
-		partition,
-		point,
-	})
-	stdoutLock.Unlock()
-	if err != nil {
-		log.Error(0, "executing template: %s", err)
+	if ip.stats != nil {
+		ip.stats.add(point.MKey.Org, partition, true)
+	}
+	if *asJSON {
+		typ := "MetricPoint"
+		if format == msg.FormatMetricPointWithoutOrg {
+			typ = "MetricPointWithoutOrg"
+		}
+		ip.print(jsonPoint{point.MKey.String(), point.MKey.Org, point.Value, point.Time}, nil, typ, partition)
+	} else {
+		ip.print(DataP{partition, point}, &ip.tplP, "", partition)
+	}
+	if ip.repub != nil {
+		err := ip.repub.sendMetricPoint(point, format, partition)
+		if err != nil {
+			log.Error(0, "re-publishing MetricPoint %s: %s", point.MKey, err)
+		}
 	}
+	return true
 }
 
 func main() {
@@ -118,11 +230,16 @@ func main() {
 		fmt.Fprintln(os.Stderr, "mt-kafka-mdm-sniff")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Inspects what's flowing through kafka (in mdm format) and reports it to you")
+		fmt.Fprintln(os.Stderr, "Messages can be filtered, printed using templates or as json, and re-published to another topic.")
+		fmt.Fprintln(os.Stderr, "Note: MetricPoint messages carry no name, so when filtering by name (prefix, substr or name-regex),")
+		fmt.Fprintln(os.Stderr, "points are only shown for series for which a matching MetricData message was seen first.")
 		fmt.Fprintf(os.Stderr, "\nFlags:\n\n")
 		flag.PrintDefaults()
 		fmt.Fprintln(os.Stderr, "you can also use functions in templates:")
 		fmt.Fprintln(os.Stderr, "date: formats a unix timestamp as a date")
 		fmt.Fprintln(os.Stderr, "example: mt-kafka-mdm-sniff -format-point '{{.Time | date}}'")
+		fmt.Fprintln(os.Stderr, "example: mt-kafka-mdm-sniff -org 12 -name-regex '^collectd\\.' -json")
+		fmt.Fprintln(os.Stderr, "example: mt-kafka-mdm-sniff -partitions 0,1 -stats-interval 10s -republish-topic mdm-debug -republish-brokers kafka:9092 > /dev/null")
 	}
 	flag.Parse()
 	log.NewLogger(0, "console", fmt.Sprintf(`{"level": %d, "formatting":false}`, 2))
@@ -153,9 +270,42 @@ func main() {
 
 	stats.NewDevnull() // make sure metrics don't pile up without getting discarded
 
+	printer := newInputPrinter(*formatMd, *formatP)
+	if *nameRegex != "" {
+		printer.nameRe, err = regexp.Compile(*nameRegex)
+		if err != nil {
+			log.Fatal(4, "invalid name-regex: %s", err)
+		}
+	}
+	if *partitions != "" {
+		printer.parts = make(map[int32]struct{})
+		for _, p := range strings.Split(*partitions, ",") {
+			part, err := strconv.ParseInt(strings.TrimSpace(p), 10, 32)
+			if err != nil {
+				log.Fatal(4, "invalid partition %q: %s", p, err)
+			}
+			printer.parts[int32(part)] = struct{}{}
+		}
+	}
+	if *republishTopic != "" {
+		printer.repub, err = newRepublisher(*republishBrokers, *republishTopic, *republishCodec)
+		if err != nil {
+			log.Fatal(4, "failed to create kafka producer for re-publishing: %s", err)
+		}
+		defer printer.repub.Close()
+	}
+	if *statsInterval != 0 {
+		printer.stats = newRateStats()
+		go func() {
+			for now := range time.Tick(*statsInterval) {
+				printer.stats.report(os.Stderr, now)
+			}
+		}()
+	}
+
 	mdm := inKafkaMdm.New()
 	pluginFatal := make(chan struct{})
-	mdm.Start(newInputPrinter(*formatMd, *formatP), pluginFatal)
+	mdm.Start(printer, pluginFatal)
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	select {
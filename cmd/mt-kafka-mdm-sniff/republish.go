@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+// republisher publishes messages to another topic, into the same partition they were read from
+type republisher struct {
+	topic    string
+	producer sarama.SyncProducer
+}
+
+func newRepublisher(brokers, topic, codec string) (*republisher, error) {
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	config.Net.DialTimeout = 5 * time.Second
+	switch codec {
+	case "none":
+		config.Producer.Compression = sarama.CompressionNone
+	case "gzip":
+		config.Producer.Compression = sarama.CompressionGZIP
+	case "snappy":
+		config.Producer.Compression = sarama.CompressionSnappy
+	default:
+		return nil, fmt.Errorf("unknown compression codec %q", codec)
+	}
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducer(strings.Split(brokers, ","), config)
+	if err != nil {
+		return nil, err
+	}
+	return &republisher{
+		topic:    topic,
+		producer: producer,
+	}, nil
+}
+
+func (r *republisher) send(data []byte, partition int32) error {
+	_, _, err := r.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:     r.topic,
+		Partition: partition,
+		Value:     sarama.ByteEncoder(data),
+	})
+	return err
+}
+
+func (r *republisher) sendMetricData(md *schema.MetricData, partition int32) error {
+	data, err := md.MarshalMsg(nil)
+	if err != nil {
+		return err
+	}
+	return r.send(data, partition)
+}
+
+func (r *republisher) sendMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) error {
+	data, err := msg.WritePointMsg(point, make([]byte, 0, 33), format)
+	if err != nil {
+		return err
+	}
+	return r.send(data, partition)
+}
+
+func (r *republisher) Close() error {
+	return r.producer.Close()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rateStats counts the messages received per org and per partition.
+// (the mdm format carries no information about the producer, so the org is the closest we have)
+type rateStats struct {
+	sync.Mutex
+	since  time.Time
+	orgs   map[uint32]uint64
+	parts  map[int32]uint64
+	total  uint64
+	points uint64 // how many of total are MetricPoint messages
+}
+
+func newRateStats() *rateStats {
+	return &rateStats{
+		since: time.Now(),
+		orgs:  make(map[uint32]uint64),
+		parts: make(map[int32]uint64),
+	}
+}
+
+func (s *rateStats) add(org uint32, partition int32, point bool) {
+	s.Lock()
+	s.orgs[org]++
+	s.parts[partition]++
+	s.total++
+	if point {
+		s.points++
+	}
+	s.Unlock()
+}
+
+// report writes the rates since the previous report (or creation) to w, and resets the counters.
+func (s *rateStats) report(w io.Writer, now time.Time) {
+	s.Lock()
+	elapsed := now.Sub(s.since).Seconds()
+	orgs, parts, total, points := s.orgs, s.parts, s.total, s.points
+	s.since = now
+	s.orgs = make(map[uint32]uint64)
+	s.parts = make(map[int32]uint64)
+	s.total = 0
+	s.points = 0
+	s.Unlock()
+
+	if elapsed <= 0 {
+		return
+	}
+	fmt.Fprintf(w, "## %s: %d messages (%d MetricData, %d MetricPoint), %.1f/s\n", now.Format(time.RFC3339), total, total-points, points, float64(total)/elapsed)
+
+	orgIds := make([]uint32, 0, len(orgs))
+	for org := range orgs {
+		orgIds = append(orgIds, org)
+	}
+	sort.Slice(orgIds, func(i, j int) bool { return orgIds[i] < orgIds[j] })
+	for _, org := range orgIds {
+		fmt.Fprintf(w, "org %d: %d messages, %.1f/s\n", org, orgs[org], float64(orgs[org])/elapsed)
+	}
+
+	partIds := make([]int32, 0, len(parts))
+	for part := range parts {
+		partIds = append(partIds, part)
+	}
+	sort.Slice(partIds, func(i, j int) bool { return partIds[i] < partIds[j] })
+	for _, part := range partIds {
+		fmt.Fprintf(w, "partition %d: %d messages, %.1f/s\n", part, parts[part], float64(parts[part])/elapsed)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/clock"
+	"github.com/grafana/metrictank/stacktest/fakemetrics/out/kafkamdm"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/met/helper"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	gitHash     = "(none)"
+	showVersion = flag.Bool("version", false, "print version string")
+
+	kafkaBrokers   = flag.String("kafka-brokers", "kafka:9092", "tcp address for kafka (may be given as a comma-separated list)")
+	kafkaTopic     = flag.String("kafka-topic", "mdm", "kafka topic to produce to")
+	kafkaCodec     = flag.String("kafka-codec", "snappy", "compression codec: none, gzip or snappy")
+	partitionCount = flag.Int("partition-count", 0, "number of partitions of the topic, i.e. number of test series. 0 means look it up in kafka")
+
+	queryAddr  = flag.String("query-addr", "http://localhost:6060", "base url of the render api to query the test series from (metrictank or graphite in front of it)")
+	orgId      = flag.Int("org-id", 1, "org to publish and query the test series as")
+	namePrefix = flag.String("name-prefix", "parrot.testdata", "prefix of the test series. they are named <prefix>.<partition>")
+	interval   = flag.Duration("interval", 10*time.Second, "interval at which to publish points, and of the test series")
+	lookback   = flag.Duration("lookback-period", 5*time.Minute, "window of data to verify on each run")
+	maxLatency = flag.Duration("max-latency", time.Minute, "how long to wait for a published point to become queryable, before it is considered missing")
+
+	statsAddr     = flag.String("stats-addr", "localhost:2003", "graphite address to send the monitoring metrics to. empty disables reporting")
+	statsPrefix   = flag.String("stats-prefix", "parrot.stats.default", "prefix for the monitoring metrics")
+	statsInterval = flag.Int("stats-interval", 10, "interval in seconds to send the monitoring metrics")
+	statsTimeout  = flag.Duration("stats-timeout", 10*time.Second, "timeout for writing monitoring metrics to graphite")
+	statsBuffer   = flag.Int("stats-buffer-size", 20000, "how many messages (holding all measurements from one interval) to buffer up in case graphite endpoint is unavailable")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println("mt-parrot")
+		fmt.Println()
+		fmt.Println("End-to-end canary: continuously publishes a known test series per kafka partition through the ingest path")
+		fmt.Println("and queries them back through the render api. The value of each point is its timestamp, so that the")
+		fmt.Println("returned data can be verified. Reports, per partition, how long it took for points to become queryable,")
+		fmt.Println("how many points are missing or incorrect, and how far behind the data is. These metrics are sent to graphite,")
+		fmt.Println("so you can alert on them.")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-parrot [flags]\n")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-parrot -kafka-brokers kafka:9092 -query-addr http://metrictank:6060 -stats-addr graphite:2003")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-parrot (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	if *interval < time.Second || *lookback < *interval || *maxLatency < *interval {
+		log.Fatal("interval must be at least 1s, and lookback-period and max-latency must be at least one interval")
+	}
+
+	brokers := strings.Split(*kafkaBrokers, ",")
+	if *partitionCount == 0 {
+		n, err := getPartitionCount(brokers, *kafkaTopic)
+		if err != nil {
+			log.Fatalf("failed to get partition count of topic %s: %s", *kafkaTopic, err)
+		}
+		*partitionCount = n
+	}
+	if *partitionCount < 1 {
+		log.Fatal("partition-count must be at least 1")
+	}
+
+	if *statsAddr != "" {
+		stats.NewGraphite(*statsPrefix, *statsAddr, *statsInterval, *statsBuffer, *statsTimeout)
+	} else {
+		stats.NewDevnull()
+	}
+
+	metStats, _ := helper.New(false, "", "standard", "", "")
+	out, err := kafkamdm.New(*kafkaTopic, brokers, *kafkaCodec, metStats, "lastNum")
+	if err != nil {
+		log.Fatalf("failed to create kafka producer: %s", err)
+	}
+
+	m := &monitor{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		addr:       strings.TrimSuffix(*queryAddr, "/"),
+		target:     *namePrefix + ".*",
+		orgId:      *orgId,
+		lookback:   *lookback,
+		maxLatency: *maxLatency,
+	}
+	metrics := make([]*schema.MetricData, *partitionCount)
+	for p := range metrics {
+		metrics[p] = &schema.MetricData{
+			Name:     fmt.Sprintf("%s.%d", *namePrefix, p),
+			OrgId:    *orgId,
+			Interval: int(interval.Seconds()),
+			Unit:     "unknown",
+			Mtype:    "gauge",
+		}
+		metrics[p].SetId()
+		m.metrics = append(m.metrics, newPartitionMetrics(p))
+	}
+	log.Infof("publishing %d test series to topic %s every %s", len(metrics), *kafkaTopic, *interval)
+
+	// verifications run concurrently with publishing, but one at a time, so they don't pile up
+	// when the render api is slow: in that case we just skip verifying some points.
+	busy := make(chan struct{}, 1)
+	for tick := range clock.AlignedTick(*interval) {
+		ts := tick.Unix()
+		for _, md := range metrics {
+			md.Time = ts
+			md.Value = float64(ts)
+		}
+		published := time.Now()
+		err := out.Flush(metrics)
+		if err != nil {
+			log.Errorf("failed to publish test series: %s", err)
+			continue
+		}
+		select {
+		case busy <- struct{}{}:
+			go func() {
+				m.verify(uint32(ts), published)
+				<-busy
+			}()
+		default:
+			log.Warnf("previous verification still running. not verifying ts %d", ts)
+		}
+	}
+}
+
+func getPartitionCount(brokers []string, topic string) (int, error) {
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return 0, err
+	}
+	return len(partitions), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/grafana/metrictank/stacktest/graphite"
+)
+
+func TestCheckSeries(t *testing.T) {
+	points := []graphite.Point{
+		{Val: 10, Ts: 10},
+		{Val: math.NaN(), Ts: 20},
+		{Val: 31, Ts: 30},
+		{Val: 40, Ts: 40},
+		{Val: math.NaN(), Ts: 50},
+	}
+	cases := []struct {
+		cutoff uint32
+		exp    seriesCheck
+	}{
+		{0, seriesCheck{lastTs: 40, nans: 0, incorrect: 1}},
+		{50, seriesCheck{lastTs: 40, nans: 1, incorrect: 1}},
+		{60, seriesCheck{lastTs: 40, nans: 2, incorrect: 1}},
+	}
+	for i, c := range cases {
+		got := checkSeries(points, c.cutoff)
+		if got != c.exp {
+			t.Fatalf("case %d: expected %+v, got %+v", i, c.exp, got)
+		}
+	}
+	if got := checkSeries(nil, 60); got != (seriesCheck{}) {
+		t.Fatalf("expected empty check for no points, got %+v", got)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/stacktest/graphite"
+	"github.com/grafana/metrictank/stats"
+)
+
+// partitionMetrics are the stats we report for each partition (series)
+type partitionMetrics struct {
+	// metric parrot.monitoring.latency.partition.N is how long it took (in ms) for the last published point to become queryable
+	latency *stats.Gauge32
+	// metric parrot.monitoring.nans.partition.N is the number of points in the lookback period that are missing (null)
+	nans *stats.Gauge32
+	// metric parrot.monitoring.incorrect.partition.N is the number of points in the lookback period that have an incorrect value
+	incorrect *stats.Gauge32
+	// metric parrot.monitoring.lag.partition.N is how far behind (in seconds) the most recent point returned is, compared to the last published one
+	lag *stats.Gauge32
+}
+
+func newPartitionMetrics(partition int) partitionMetrics {
+	return partitionMetrics{
+		latency:   stats.NewGauge32(fmt.Sprintf("parrot.monitoring.latency.partition.%d", partition)),
+		nans:      stats.NewGauge32(fmt.Sprintf("parrot.monitoring.nans.partition.%d", partition)),
+		incorrect: stats.NewGauge32(fmt.Sprintf("parrot.monitoring.incorrect.partition.%d", partition)),
+		lag:       stats.NewGauge32(fmt.Sprintf("parrot.monitoring.lag.partition.%d", partition)),
+	}
+}
+
+var (
+	// metric parrot.monitoring.error is the number of failed render requests
+	queryErrors = stats.NewCounter32("parrot.monitoring.error")
+	// metric parrot.monitoring.missing is the number of series that did not return at all
+	missingSeries = stats.NewGauge32("parrot.monitoring.missing")
+)
+
+// seriesCheck is the outcome of verifying a series
+type seriesCheck struct {
+	lastTs    uint32 // most recent non-null point
+	nans      int    // null points, excluding the ones too recent to be expected yet
+	incorrect int    // points whose value is not their timestamp
+}
+
+// checkSeries verifies the points of a series: each point should have its timestamp as value.
+// nulls are only counted as missing if they are for a timestamp before the cutoff, as more recent points
+// may legitimately not be queryable yet.
+func checkSeries(points []graphite.Point, cutoff uint32) seriesCheck {
+	var c seriesCheck
+	for _, p := range points {
+		if math.IsNaN(p.Val) {
+			if p.Ts < cutoff {
+				c.nans++
+			}
+			continue
+		}
+		if p.Val != float64(p.Ts) {
+			c.incorrect++
+		}
+		if p.Ts > c.lastTs {
+			c.lastTs = p.Ts
+		}
+	}
+	return c
+}
+
+type monitor struct {
+	client     *http.Client
+	addr       string
+	target     string
+	orgId      int
+	lookback   time.Duration
+	maxLatency time.Duration
+	metrics    []partitionMetrics
+}
+
+// query fetches the parrot series from the render api, and returns them per partition
+func (m *monitor) query(from, to uint32) (map[int][]graphite.Point, error) {
+	params := url.Values{}
+	params.Set("target", m.target)
+	params.Set("from", strconv.Itoa(int(from)))
+	params.Set("until", strconv.Itoa(int(to)))
+	params.Set("format", "json")
+	params.Set("maxDataPoints", strconv.Itoa(int(to-from)+1)) // avoid any runtime consolidation
+	req, err := http.NewRequest("GET", m.addr+"/render?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Org-Id", strconv.Itoa(m.orgId))
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("render request returned status %d", resp.StatusCode)
+	}
+	var data graphite.Data
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int][]graphite.Point)
+	for _, s := range data {
+		partition, err := strconv.Atoi(s.Target[strings.LastIndex(s.Target, ".")+1:])
+		if err != nil || partition < 0 || partition >= len(m.metrics) {
+			log.Warnf("ignoring unexpected series %q", s.Target)
+			continue
+		}
+		out[partition] = s.Datapoints
+	}
+	return out, nil
+}
+
+// verify waits for the points published at ts to become queryable, and then checks the lookback window of all series
+func (m *monitor) verify(ts uint32, published time.Time) {
+	from := ts - uint32(m.lookback.Seconds())
+	pending := make(map[int]struct{})
+	for p := range m.metrics {
+		pending[p] = struct{}{}
+	}
+
+	var series map[int][]graphite.Point
+	for {
+		var err error
+		series, err = m.query(from, ts+1)
+		if err != nil {
+			queryErrors.Inc()
+			log.Errorf("query failed: %s", err)
+		} else {
+			for p := range pending {
+				if c := checkSeries(series[p], 0); c.lastTs >= ts {
+					m.metrics[p].latency.Set(int(time.Since(published) / time.Millisecond))
+					delete(pending, p)
+				}
+			}
+		}
+		if len(pending) == 0 || time.Since(published) >= m.maxLatency {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	cutoff := ts - uint32(m.maxLatency.Seconds())
+	var missing, nans, incorrect int
+	for p, metrics := range m.metrics {
+		if _, ok := pending[p]; ok {
+			metrics.latency.Set(int(m.maxLatency / time.Millisecond))
+		}
+		points, ok := series[p]
+		if !ok {
+			missing++
+		}
+		c := checkSeries(points, cutoff)
+		metrics.nans.Set(c.nans)
+		metrics.incorrect.Set(c.incorrect)
+		if c.lastTs > 0 {
+			metrics.lag.Set(int(ts - c.lastTs))
+		} else {
+			metrics.lag.Set(int(m.lookback.Seconds()))
+		}
+		nans += c.nans
+		incorrect += c.incorrect
+	}
+	missingSeries.Set(missing)
+	log.Infof("ts %d: %d/%d series queryable in time, %d missing series, %d nans, %d incorrect values", ts, len(m.metrics)-len(pending), len(m.metrics), missing, nans, incorrect)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+)
+
+// row is a single chunk as stored in a metric table
+type row struct {
+	ts   uint32
+	data []byte
+	ttl  int // remaining ttl in seconds, as reported by cassandra
+}
+
+type diffKind int
+
+const (
+	missing   diffKind = iota // chunk is in source, but not in destination
+	differing                 // chunk is in both, but the data doesn't match
+	extra                     // chunk is in destination, but not in source
+)
+
+func (d diffKind) String() string {
+	switch d {
+	case missing:
+		return "missing"
+	case differing:
+		return "differing"
+	case extra:
+		return "extra"
+	}
+	return "unknown"
+}
+
+// diff describes a discrepancy for a chunk at a given ts
+type diff struct {
+	kind diffKind
+	ts   uint32
+	src  *row // nil if kind is extra
+	dst  *row // nil if kind is missing
+}
+
+// compareRows compares the chunks of a row key in the source and destination,
+// and returns all discrepancies, ordered by ts.
+func compareRows(src, dst []row) []diff {
+	dstByTs := make(map[uint32]*row, len(dst))
+	for i := range dst {
+		dstByTs[dst[i].ts] = &dst[i]
+	}
+	var diffs []diff
+	for i := range src {
+		s := &src[i]
+		d, ok := dstByTs[s.ts]
+		if !ok {
+			diffs = append(diffs, diff{missing, s.ts, s, nil})
+			continue
+		}
+		delete(dstByTs, s.ts)
+		if !bytes.Equal(s.data, d.data) {
+			diffs = append(diffs, diff{differing, s.ts, s, d})
+		}
+	}
+	for ts, d := range dstByTs {
+		diffs = append(diffs, diff{extra, ts, nil, d})
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].ts < diffs[j].ts })
+	return diffs
+}
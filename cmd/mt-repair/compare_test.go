@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestCompareRows(t *testing.T) {
+	src := []row{
+		{ts: 10, data: []byte{1, 2, 3}},
+		{ts: 20, data: []byte{4, 5, 6}},
+		{ts: 30, data: []byte{7, 8, 9}},
+		{ts: 50, data: []byte{1}},
+	}
+	dst := []row{
+		{ts: 10, data: []byte{1, 2, 3}},
+		{ts: 30, data: []byte{7, 8}},
+		{ts: 40, data: []byte{0}},
+		{ts: 50, data: []byte{1}},
+	}
+	exp := []struct {
+		kind diffKind
+		ts   uint32
+	}{
+		{missing, 20},
+		{differing, 30},
+		{extra, 40},
+	}
+	diffs := compareRows(src, dst)
+	if len(diffs) != len(exp) {
+		t.Fatalf("expected %d diffs, got %d: %v", len(exp), len(diffs), diffs)
+	}
+	for i, e := range exp {
+		if diffs[i].kind != e.kind || diffs[i].ts != e.ts {
+			t.Errorf("diff %d: expected %s at %d, got %s at %d", i, e.kind, e.ts, diffs[i].kind, diffs[i].ts)
+		}
+		if (diffs[i].src == nil) != (e.kind == extra) {
+			t.Errorf("diff %d: src row should only be nil for extra chunks", i)
+		}
+		if (diffs[i].dst == nil) != (e.kind == missing) {
+			t.Errorf("diff %d: dst row should only be nil for missing chunks", i)
+		}
+	}
+
+	if diffs := compareRows(src, src); len(diffs) != 0 {
+		t.Errorf("expected no diffs when comparing identical rows, got %v", diffs)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/store/cassandra"
+	hostpool "github.com/hailocab/go-hostpool"
+	"github.com/raintank/dur"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	gitHash = "(none)"
+
+	showVersion = flag.Bool("version", false, "print version string")
+
+	srcAddrs    = flag.String("src-cassandra-addrs", "localhost", "cassandra host(s) of the source (authoritative) cluster (comma-separated list)")
+	srcKeyspace = flag.String("src-cassandra-keyspace", "metrictank", "cassandra keyspace of the source")
+	dstAddrs    = flag.String("dst-cassandra-addrs", "", "cassandra host(s) of the destination cluster (comma-separated list). defaults to the source addrs")
+	dstKeyspace = flag.String("dst-cassandra-keyspace", "", "cassandra keyspace of the destination. defaults to the source keyspace")
+
+	cassandraConsistency              = flag.String("cassandra-consistency", "one", "read and write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	cassandraHostSelectionPolicy      = flag.String("cassandra-host-selection-policy", "tokenaware,hostpool-epsilon-greedy", "")
+	cassandraTimeout                  = flag.Int("cassandra-timeout", 1000, "cassandra timeout in milliseconds")
+	cassandraConcurrency              = flag.Int("cassandra-concurrency", 20, "max number of concurrent connections to each cassandra cluster.")
+	cassandraRetries                  = flag.Int("cassandra-retries", 0, "how many times to retry a query before failing it")
+	cqlProtocolVersion                = flag.Int("cql-protocol-version", 4, "cql protocol version to use")
+	cassandraSSL                      = flag.Bool("cassandra-ssl", false, "enable SSL connection to cassandra")
+	cassandraCaPath                   = flag.String("cassandra-ca-path", "/etc/metrictank/ca.pem", "cassandra CA certificate path when using SSL")
+	cassandraHostVerification         = flag.Bool("cassandra-host-verification", true, "host (hostname and server cert) verification when using SSL")
+	cassandraAuth                     = flag.Bool("cassandra-auth", false, "enable cassandra authentication")
+	cassandraUsername                 = flag.String("cassandra-username", "cassandra", "username for authentication")
+	cassandraPassword                 = flag.String("cassandra-password", "cassandra", "password for authentication")
+	cassandraDisableInitialHostLookup = flag.Bool("cassandra-disable-initial-host-lookup", false, "instruct the driver to not attempt to get host info from the system.peers table")
+
+	from        = flag.String("from", "-24h", "check chunks with a t0 from (inclusive)")
+	to          = flag.String("to", "now", "check chunks with a t0 until (exclusive)")
+	timeZoneStr = flag.String("time-zone", "local", "time-zone to use for interpreting from/to when needed. (check your config)")
+	archives    = flag.String("archives", "", "comma-separated list of rollup archives (e.g. 'sum_600,cnt_600') to check in addition to the raw series of each selected metric")
+	fix         = flag.Bool("fix", false, "copy missing and differing chunks from the source to the destination")
+	ttl         = flag.String("ttl", "", "ttl to use for chunks written to the destination. defaults to the remaining ttl of the chunk in the source")
+	numThreads  = flag.Int("threads", 10, "number of metrics to check concurrently")
+	verbose     = flag.Bool("verbose", false, "also report metrics that are consistent")
+
+	numMissing   uint64
+	numDiffering uint64
+	numExtra     uint64
+	numFixed     uint64
+	numErrors    uint64
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Println("mt-repair")
+		fmt.Println()
+		fmt.Println("Compares the chunks stored in two metric tables, typically in different clusters or keyspaces, for the given metrics and time range.")
+		fmt.Println("Reports chunks that are missing from, differ in, or only exist in the destination, and optionally copies the")
+		fmt.Println("authoritative version from the source to the destination.")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-repair [flags] <src-table> <dst-table> <metric-selector>\n")
+		fmt.Printf("	                  src-table, dst-table: name of a table. e.g. 'metric_512'\n")
+		fmt.Printf("	                  metric-selector: an id (of raw or aggregated series), prefix:<prefix> (looked up in the source index) or '-' to read ids from stdin\n")
+		fmt.Println()
+		fmt.Println("Output:")
+		fmt.Println()
+		fmt.Println("	one line per discrepancy: <missing|differing|extra> <key> <t0> <src bytes> <dst bytes>")
+		fmt.Println("	missing: in source, but not in destination. differing: data doesn't match. extra: only in destination (never fixed)")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-repair -src-cassandra-addrs cass-a -dst-cassandra-addrs cass-b -from='-7d' metric_512 metric_512 'prefix:some.service.'")
+		fmt.Println("mt-repair -src-cassandra-keyspace old -dst-cassandra-keyspace new -archives sum_600,cnt_600 -fix metric_512 metric_512 1.37cf8e3731ee4c79063c1d55280d1bbe")
+		fmt.Println("mt-index-cat cass -hosts cass-a:9042 '{{.Id}}\\n' | mt-repair -src-cassandra-addrs cass-a -dst-cassandra-addrs cass-b metric_512 metric_512 -")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-repair (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 3 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+	srcTable, dstTable, metricSelector := flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	if metricSelector == "prefix:" {
+		log.Fatal("prefix cannot be empty")
+	}
+	if *dstAddrs == "" {
+		*dstAddrs = *srcAddrs
+	}
+	if *dstKeyspace == "" {
+		*dstKeyspace = *srcKeyspace
+	}
+	if *srcAddrs == *dstAddrs && *srcKeyspace == *dstKeyspace && srcTable == dstTable {
+		log.Fatal("source and destination are the same")
+	}
+
+	var fixedTTL int
+	if *ttl != "" {
+		fixedTTL = int(dur.MustParseNDuration("ttl", *ttl))
+	}
+
+	var loc *time.Location
+	switch *timeZoneStr {
+	case "local":
+		loc = time.Local
+	default:
+		var err error
+		loc, err = time.LoadLocation(*timeZoneStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	now := time.Now()
+	defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
+	defaultTo := uint32(now.Add(time.Duration(1) * time.Second).Unix())
+	fromUnix, err := dur.ParseDateTime(*from, loc, now, defaultFrom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	toUnix, err := dur.ParseDateTime(*to, loc, now, defaultTo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fromUnix >= toUnix {
+		log.Fatal("from must be before to")
+	}
+
+	var suffixes []schema.Archive
+	if *archives != "" {
+		for _, a := range strings.Split(*archives, ",") {
+			archive, err := parseArchive(a)
+			if err != nil {
+				log.Fatalf("invalid archive %q: %s", a, err)
+			}
+			suffixes = append(suffixes, archive)
+		}
+	}
+
+	src, err := newSession(*srcAddrs, *srcKeyspace)
+	if err != nil {
+		log.Fatalf("failed to connect to source cassandra: %s", err)
+	}
+	defer src.Close()
+	dst, err := newSession(*dstAddrs, *dstKeyspace)
+	if err != nil {
+		log.Fatalf("failed to connect to destination cassandra: %s", err)
+	}
+	defer dst.Close()
+
+	keys := make(chan schema.AMKey, *numThreads)
+	var wg sync.WaitGroup
+	wg.Add(*numThreads)
+	for i := 0; i < *numThreads; i++ {
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				check(src, dst, srcTable, dstTable, key, fromUnix, toUnix, fixedTTL)
+			}
+		}()
+	}
+
+	push := func(mkey schema.MKey) {
+		keys <- schema.AMKey{MKey: mkey}
+		for _, archive := range suffixes {
+			keys <- schema.AMKey{MKey: mkey, Archive: archive}
+		}
+	}
+
+	switch {
+	case metricSelector == "-":
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			amkey, err := parseAMKey(line)
+			if err != nil {
+				log.Fatalf("can't parse %q as AMKey: %s", line, err)
+			}
+			if amkey.Archive != 0 {
+				keys <- amkey
+				continue
+			}
+			push(amkey.MKey)
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("failed to read from stdin: %s", err)
+		}
+	case strings.HasPrefix(metricSelector, "prefix:"):
+		err := getMetrics(src, strings.TrimPrefix(metricSelector, "prefix:"), push)
+		if err != nil {
+			log.Fatalf("failed to query source index: %s", err)
+		}
+	default:
+		amkey, err := parseAMKey(metricSelector)
+		if err != nil {
+			log.Fatalf("can't parse metric selector as AMKey: %s", err)
+		}
+		if amkey.Archive != 0 {
+			keys <- amkey
+		} else {
+			push(amkey.MKey)
+		}
+	}
+	close(keys)
+	wg.Wait()
+
+	fmt.Printf("# missing: %d, differing: %d, extra: %d, fixed: %d, errors: %d\n", numMissing, numDiffering, numExtra, numFixed, numErrors)
+	if numErrors > 0 {
+		os.Exit(2)
+	}
+	if !*fix && numMissing+numDiffering+numExtra > 0 {
+		os.Exit(1)
+	}
+}
+
+// parseArchive parses a rollup archive suffix such as "sum_600"
+func parseArchive(s string) (schema.Archive, error) {
+	pos := strings.Index(s, "_")
+	if pos == -1 {
+		return 0, fmt.Errorf("expected <method>_<span>")
+	}
+	method, err := schema.MethodFromString(s[:pos])
+	if err != nil {
+		return 0, err
+	}
+	span, err := strconv.ParseUint(s[pos+1:], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if !schema.IsSpanValid(uint32(span)) {
+		return 0, fmt.Errorf("invalid span %d", span)
+	}
+	return schema.NewArchive(method, uint32(span)), nil
+}
+
+// parseAMKey parses an id with an optional archive suffix, such as "1.37cf8e3731ee4c79063c1d55280d1bbe_sum_600"
+func parseAMKey(s string) (schema.AMKey, error) {
+	var amkey schema.AMKey
+	id := s
+	pos := strings.Index(s, "_")
+	if pos != -1 {
+		id = s[:pos]
+		archive, err := parseArchive(s[pos+1:])
+		if err != nil {
+			return amkey, err
+		}
+		amkey.Archive = archive
+	}
+	mkey, err := schema.MKeyFromString(id)
+	if err != nil {
+		return amkey, err
+	}
+	amkey.MKey = mkey
+	return amkey, nil
+}
+
+// getMetrics calls fn for all metrics in the index whose name starts with the given prefix
+func getMetrics(session *gocql.Session, prefix string, fn func(schema.MKey)) error {
+	iter := session.Query("select id, name from metric_idx").Iter()
+	var id, name string
+	for iter.Scan(&id, &name) {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			log.Errorf("invalid id %q in index: %s", id, err)
+			continue
+		}
+		fn(mkey)
+	}
+	return iter.Close()
+}
+
+// getRows returns all chunks of the given key with a t0 in the given range
+func getRows(session *gocql.Session, table string, key schema.AMKey, fromUnix, toUnix uint32) ([]row, error) {
+	var rows []row
+	query := fmt.Sprintf("SELECT ts, data, ttl(data) FROM %s WHERE key = ? AND ts >= ? AND ts < ?", table)
+	startMonth := fromUnix / cassandra.Month_sec
+	endMonth := (toUnix - 1) / cassandra.Month_sec
+	for month := startMonth; month <= endMonth; month++ {
+		rowKey := fmt.Sprintf("%s_%d", key.String(), month)
+		iter := session.Query(query, rowKey, fromUnix, toUnix).Iter()
+		var r row
+		for iter.Scan(&r.ts, &r.data, &r.ttl) {
+			rows = append(rows, r)
+			r = row{}
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return rows, nil
+}
+
+func check(src, dst *gocql.Session, srcTable, dstTable string, key schema.AMKey, fromUnix, toUnix uint32, fixedTTL int) {
+	srcRows, err := getRows(src, srcTable, key, fromUnix, toUnix)
+	if err != nil {
+		atomic.AddUint64(&numErrors, 1)
+		log.Errorf("failed to query source for %s: %s", key, err)
+		return
+	}
+	dstRows, err := getRows(dst, dstTable, key, fromUnix, toUnix)
+	if err != nil {
+		atomic.AddUint64(&numErrors, 1)
+		log.Errorf("failed to query destination for %s: %s", key, err)
+		return
+	}
+	diffs := compareRows(srcRows, dstRows)
+	if len(diffs) == 0 {
+		if *verbose {
+			fmt.Printf("ok %s (%d chunks)\n", key, len(srcRows))
+		}
+		return
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (key, ts, data) values (?,?,?) USING TTL ?", dstTable)
+	for _, d := range diffs {
+		var srcLen, dstLen int
+		if d.src != nil {
+			srcLen = len(d.src.data)
+		}
+		if d.dst != nil {
+			dstLen = len(d.dst.data)
+		}
+		fmt.Printf("%s %s %d %d %d\n", d.kind, key, d.ts, srcLen, dstLen)
+
+		switch d.kind {
+		case missing:
+			atomic.AddUint64(&numMissing, 1)
+		case differing:
+			atomic.AddUint64(&numDiffering, 1)
+		case extra:
+			atomic.AddUint64(&numExtra, 1)
+			continue
+		}
+		if !*fix {
+			continue
+		}
+		newTTL := d.src.ttl
+		if fixedTTL != 0 {
+			newTTL = fixedTTL
+		}
+		rowKey := fmt.Sprintf("%s_%d", key.String(), d.ts/cassandra.Month_sec)
+		err := dst.Query(insert, rowKey, d.ts, d.src.data, newTTL).Exec()
+		if err != nil {
+			atomic.AddUint64(&numErrors, 1)
+			log.Errorf("failed to copy chunk %s:%d to destination: %s", key, d.ts, err)
+			continue
+		}
+		atomic.AddUint64(&numFixed, 1)
+	}
+}
+
+func newSession(addrs, keyspace string) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(strings.Split(addrs, ",")...)
+	if *cassandraSSL {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 *cassandraCaPath,
+			EnableHostVerification: *cassandraHostVerification,
+		}
+	}
+	if *cassandraAuth {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: *cassandraUsername,
+			Password: *cassandraPassword,
+		}
+	}
+	cluster.Consistency = gocql.ParseConsistency(*cassandraConsistency)
+	cluster.Timeout = time.Duration(*cassandraTimeout) * time.Millisecond
+	cluster.NumConns = *cassandraConcurrency
+	cluster.ProtoVersion = *cqlProtocolVersion
+	cluster.Keyspace = keyspace
+	cluster.RetryPolicy = &gocql.SimpleRetryPolicy{NumRetries: *cassandraRetries}
+	cluster.DisableInitialHostLookup = *cassandraDisableInitialHostLookup
+
+	switch *cassandraHostSelectionPolicy {
+	case "roundrobin":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.RoundRobinHostPolicy()
+	case "hostpool-simple":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(hostpool.New(nil))
+	case "hostpool-epsilon-greedy":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.HostPoolHostPolicy(
+			hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
+		)
+	case "tokenaware,roundrobin":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.RoundRobinHostPolicy(),
+		)
+	case "tokenaware,hostpool-simple":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.HostPoolHostPolicy(hostpool.New(nil)),
+		)
+	case "tokenaware,hostpool-epsilon-greedy":
+		cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(
+			gocql.HostPoolHostPolicy(
+				hostpool.NewEpsilonGreedy(nil, 0, &hostpool.LinearEpsilonValueCalculator{}),
+			),
+		)
+	default:
+		return nil, fmt.Errorf("unknown HostSelectionPolicy '%q'", *cassandraHostSelectionPolicy)
+	}
+
+	return cluster.CreateSession()
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/store/cassandra"
+)
+
+// tokenRange is a range of murmur3 tokens, exclusive of start and inclusive of end
+type tokenRange struct {
+	start int64
+	end   int64
+}
+
+// splitTokenRanges splits the full murmur3 token ring into n contiguous ranges
+func splitTokenRanges(n int) []tokenRange {
+	ranges := make([]tokenRange, n)
+	step := math.MaxUint64 / uint64(n)
+	start := int64(math.MinInt64)
+	for i := range ranges {
+		end := int64(uint64(start) + step)
+		if i == n-1 {
+			end = math.MaxInt64
+		}
+		ranges[i] = tokenRange{start, end}
+		start = end
+	}
+	return ranges
+}
+
+// tableForTTL returns the table that data with the given remaining ttl belongs in:
+// the one of the smallest configured ttl that is at least as large. ttls must be sorted ascending.
+func tableForTTL(ttl uint32, ttls []uint32, tables cassandra.TTLTables) (string, bool) {
+	i := sort.Search(len(ttls), func(i int) bool { return ttls[i] >= ttl })
+	if i == len(ttls) {
+		return "", false
+	}
+	return tables[ttls[i]].Table, true
+}
+
+// state tracks which token ranges have been processed, optionally persisting them to a file so that
+// an interrupted run can be resumed.
+// the file has a header line with the number of token ranges, followed by the index of each completed range.
+type state struct {
+	sync.Mutex
+	done map[int]struct{}
+	f    *os.File
+}
+
+func openState(path string, numRanges int) (*state, error) {
+	s := &state{done: make(map[int]struct{})}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(f)
+	header := fmt.Sprintf("ranges %d", numRanges)
+	if scanner.Scan() {
+		if scanner.Text() != header {
+			f.Close()
+			return nil, fmt.Errorf("state file %s was created with %q, but we use %q. use the same token-ranges setting to resume", path, scanner.Text(), header)
+		}
+		for scanner.Scan() {
+			i, err := strconv.Atoi(strings.TrimSpace(scanner.Text()))
+			if err != nil || i < 0 || i >= numRanges {
+				f.Close()
+				return nil, fmt.Errorf("state file %s has invalid entry %q", path, scanner.Text())
+			}
+			s.done[i] = struct{}{}
+		}
+	} else {
+		_, err = fmt.Fprintln(f, header)
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.f = f
+	return s, nil
+}
+
+func (s *state) isDone(i int) bool {
+	s.Lock()
+	_, ok := s.done[i]
+	s.Unlock()
+	return ok
+}
+
+func (s *state) markDone(i int) error {
+	s.Lock()
+	defer s.Unlock()
+	s.done[i] = struct{}{}
+	if s.f == nil {
+		return nil
+	}
+	_, err := fmt.Fprintln(s.f, i)
+	return err
+}
+
+func (s *state) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// counters tracks the rows seen per destination table
+type counters struct {
+	sync.Mutex
+	rows      map[string]uint64
+	unmatched uint64 // rows without ttl, or with a ttl larger than any of the configured ones
+}
+
+func (c *counters) add(table string) {
+	c.Lock()
+	if table == "" {
+		c.unmatched++
+	} else {
+		c.rows[table]++
+	}
+	c.Unlock()
+}
+
+func (c *counters) String() string {
+	c.Lock()
+	defer c.Unlock()
+	tables := make([]string, 0, len(c.rows))
+	for t := range c.rows {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	var parts []string
+	for _, t := range tables {
+		parts = append(parts, fmt.Sprintf("%s: %d", t, c.rows[t]))
+	}
+	parts = append(parts, fmt.Sprintf("unmatched: %d", c.unmatched))
+	return strings.Join(parts, ", ")
+}
+
+type copier struct {
+	session  *gocql.Session
+	srcTable string
+	ttls     []uint32
+	tables   cassandra.TTLTables
+	dryRun   bool
+	counts   *counters
+}
+
+// copyRange copies all rows in the token range of the source table to the table matching their ttl.
+// rows keep their remaining ttl.
+func (c *copier) copyRange(r tokenRange) error {
+	iter := c.session.Query(fmt.Sprintf("SELECT key, ts, data, TTL(data) FROM %s WHERE token(key) > ? AND token(key) <= ?", c.srcTable), r.start, r.end).Iter()
+	var key string
+	var ts int
+	var data []byte
+	var ttl int
+	for iter.Scan(&key, &ts, &data, &ttl) {
+		table, ok := "", false
+		if ttl > 0 {
+			table, ok = tableForTTL(uint32(ttl), c.ttls, c.tables)
+		}
+		c.counts.add(table)
+		if !ok || c.dryRun {
+			continue
+		}
+		err := c.session.Query(fmt.Sprintf("INSERT INTO %s (key, ts, data) values(?,?,?) USING TTL %d", table, ttl), key, ts, data).Exec()
+		if err != nil {
+			iter.Close()
+			return fmt.Errorf("failed to insert row %s/%d into %s: %s", key, ts, table, err)
+		}
+	}
+	return iter.Close()
+}
+
+// run processes all token ranges that are not done yet, using the given number of workers,
+// reporting progress and an ETA at the given interval
+func (c *copier) run(ranges []tokenRange, st *state, workers int, progressInterval time.Duration) error {
+	todo := make(chan int)
+	var pending []int
+	for i := range ranges {
+		if !st.isDone(i) {
+			pending = append(pending, i)
+		}
+	}
+	if len(pending) < len(ranges) {
+		fmt.Printf("resuming: %d of %d token ranges already done\n", len(ranges)-len(pending), len(ranges))
+	}
+
+	var completed int64
+	var firstErr error
+	var errOnce sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range todo {
+				err := c.copyRange(ranges[i])
+				if err == nil {
+					err = st.markDone(i)
+				}
+				if err != nil {
+					errOnce.Do(func() { firstErr = err })
+					continue
+				}
+				atomic.AddInt64(&completed, 1)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		pre := time.Now()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				n := atomic.LoadInt64(&completed)
+				eta := "unknown"
+				if n > 0 {
+					remaining := time.Duration(float64(time.Since(pre)) / float64(n) * float64(int64(len(pending))-n))
+					eta = remaining.Round(time.Second).String()
+				}
+				fmt.Printf("progress: %d/%d token ranges (%.1f%%), ETA %s. rows: %s\n", n, len(pending), 100*float64(n)/float64(len(pending)), eta, c.counts)
+			}
+		}
+	}()
+
+	for _, i := range pending {
+		todo <- i
+	}
+	close(todo)
+	wg.Wait()
+	close(done)
+	return firstErr
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/metrictank/store/cassandra"
+)
+
+func TestSplitTokenRanges(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 1024} {
+		ranges := splitTokenRanges(n)
+		if len(ranges) != n {
+			t.Fatalf("n=%d: expected %d ranges, got %d", n, n, len(ranges))
+		}
+		if ranges[0].start != math.MinInt64 || ranges[n-1].end != math.MaxInt64 {
+			t.Fatalf("n=%d: ranges don't cover the full ring: %v ... %v", n, ranges[0], ranges[n-1])
+		}
+		for i, r := range ranges {
+			if r.end <= r.start {
+				t.Fatalf("n=%d: range %d is empty or inverted: %v", n, i, r)
+			}
+			if i > 0 && ranges[i-1].end != r.start {
+				t.Fatalf("n=%d: gap or overlap between range %d and %d", n, i-1, i)
+			}
+		}
+	}
+}
+
+func TestTableForTTL(t *testing.T) {
+	ttls := []uint32{3600 * 24, 3600 * 24 * 60}
+	tables := cassandra.GetTTLTables(ttls, 20, cassandra.Table_name_format)
+	cases := []struct {
+		ttl      uint32
+		expTable string
+		expOk    bool
+	}{
+		{1, "metric_16", true},
+		{3600 * 24, "metric_16", true},
+		{3600*24 + 1, "metric_1024", true},
+		{3600 * 24 * 60, "metric_1024", true},
+		{3600*24*60 + 1, "", false},
+	}
+	for _, c := range cases {
+		table, ok := tableForTTL(c.ttl, ttls, tables)
+		if table != c.expTable || ok != c.expOk {
+			t.Fatalf("ttl %d: expected %q %t, got %q %t", c.ttl, c.expTable, c.expOk, table, ok)
+		}
+	}
+}
+
+func TestState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state")
+
+	st, err := openState(path, 4)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	st.markDone(1)
+	st.markDone(3)
+	st.Close()
+
+	st, err = openState(path, 4)
+	if err != nil {
+		t.Fatalf("unexpected error on resume: %s", err)
+	}
+	for i, exp := range []bool{false, true, false, true} {
+		if st.isDone(i) != exp {
+			t.Fatalf("range %d: expected done=%t", i, exp)
+		}
+	}
+	st.Close()
+
+	if _, err := openState(path, 8); err == nil {
+		t.Fatalf("expected error when resuming with a different number of ranges")
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"time"
 
+	"github.com/gocql/gocql"
 	"github.com/grafana/metrictank/store/cassandra"
 	"github.com/raintank/dur"
 )
@@ -33,12 +36,31 @@ func main() {
 	flag.BoolVar(&storeConfig.Auth, "cassandra-auth", storeConfig.Auth, "enable cassandra authentication")
 	flag.StringVar(&storeConfig.Username, "cassandra-username", storeConfig.Username, "username for authentication")
 	flag.StringVar(&storeConfig.Password, "cassandra-password", storeConfig.Password, "password for authentication")
+	flag.IntVar(&storeConfig.WindowFactor, "cassandra-window-factor", storeConfig.WindowFactor, "size of compaction window relative to TTL")
+	flag.StringVar(&storeConfig.SchemaFile, "cassandra-schema-file", storeConfig.SchemaFile, "file containing the needed schemas in case database needs initializing")
+
+	doCopy := flag.Bool("copy", false, "copy the data into the new tables with cql, instead of printing instructions to do it with sstableloader")
+	dryRun := flag.Bool("dry-run", false, "with -copy: only count the rows per destination table, don't create tables or write anything")
+	srcTable := flag.String("src-table", "metric", "with -copy: table to read the data from")
+	tokenRanges := flag.Int("token-ranges", 1024, "with -copy: number of token ranges to split the source table in. ranges are the unit of parallelism and of resuming")
+	threads := flag.Int("threads", 10, "with -copy: number of token ranges to process concurrently")
+	stateFile := flag.String("state-file", "", "with -copy: file to record completed token ranges in. rerun with the same file to resume an interrupted copy")
+	progressInterval := flag.Duration("progress-interval", 10*time.Second, "with -copy: interval at which to print progress")
 
 	flag.Usage = func() {
 		fmt.Fprintln(os.Stderr, "mt-split-metrics-by-ttl [flags] ttl [ttl...]")
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "Creates schema of metric tables split by TTLs and")
 		fmt.Fprintln(os.Stderr, "assists in migrating the data to new tables.")
+		fmt.Fprintln(os.Stderr, "By default it prepares a directory structure to load a snapshot of the metric table with sstableloader.")
+		fmt.Fprintln(os.Stderr, "With -copy, it instead reads the metric table by token ranges, in parallel, and writes each row")
+		fmt.Fprintln(os.Stderr, "to the table matching its remaining TTL, reporting progress and an ETA. Use -dry-run to only count")
+		fmt.Fprintln(os.Stderr, "the rows per destination table, and -state-file to be able to resume an interrupted copy.")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "EXAMPLES:")
+		fmt.Fprintln(os.Stderr, "mt-split-metrics-by-ttl -cassandra-addrs cassandra 1d 60d 1y")
+		fmt.Fprintln(os.Stderr, "mt-split-metrics-by-ttl -cassandra-addrs cassandra -copy -dry-run 1d 60d 1y")
+		fmt.Fprintln(os.Stderr, "mt-split-metrics-by-ttl -cassandra-addrs cassandra -copy -threads 20 -state-file split.state 1d 60d 1y")
 		fmt.Println("Flags:")
 		flag.PrintDefaults()
 		os.Exit(-1)
@@ -54,6 +76,19 @@ func main() {
 		ttls = append(ttls, uint32(dur.MustParseNDuration("ttl", flag.Arg(i))))
 	}
 
+	if *doCopy {
+		if *tokenRanges < 1 || *threads < 1 {
+			fmt.Fprintln(os.Stderr, "token-ranges and threads must be at least 1")
+			os.Exit(-1)
+		}
+		err := copyData(storeConfig, ttls, *srcTable, *dryRun, *tokenRanges, *threads, *stateFile, *progressInterval)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "copy failed: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	tmpDir, err := ioutil.TempDir(os.TempDir(), storeConfig.Keyspace)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to get temp dir: %s", tmpDir))
@@ -98,3 +133,72 @@ func main() {
 		fmt.Println(fmt.Sprintf("  sstableloader -d %s %s", storeConfig.Addrs, dir))
 	}
 }
+
+func copyData(storeConfig *cassandra.StoreConfig, ttls []uint32, srcTable string, dryRun bool, numRanges, threads int, stateFile string, progressInterval time.Duration) error {
+	sort.Slice(ttls, func(i, j int) bool { return ttls[i] < ttls[j] })
+
+	var session *gocql.Session
+	if dryRun {
+		var err error
+		session, err = newSession(storeConfig)
+		if err != nil {
+			return err
+		}
+	} else {
+		storeConfig.WriteConcurrency = 1
+		store, err := cassandra.NewCassandraStore(storeConfig, ttls)
+		if err != nil {
+			return fmt.Errorf("failed to instantiate cassandra: %s", err)
+		}
+		session = store.Session
+		fmt.Printf("The following tables have been created: %s\n", strings.Join(store.GetTableNames(), ", "))
+	}
+	defer session.Close()
+
+	ranges := splitTokenRanges(numRanges)
+	st, err := openState(stateFile, numRanges)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	c := &copier{
+		session:  session,
+		srcTable: srcTable,
+		ttls:     ttls,
+		tables:   cassandra.GetTTLTables(ttls, storeConfig.WindowFactor, cassandra.Table_name_format),
+		dryRun:   dryRun,
+		counts:   &counters{rows: make(map[string]uint64)},
+	}
+	pre := time.Now()
+	err = c.run(ranges, st, threads, progressInterval)
+	if dryRun {
+		fmt.Printf("rows per destination table: %s\n", c.counts)
+	} else {
+		fmt.Printf("rows copied per destination table: %s\n", c.counts)
+	}
+	fmt.Printf("took %s\n", time.Since(pre))
+	return err
+}
+
+func newSession(storeConfig *cassandra.StoreConfig) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(strings.Split(storeConfig.Addrs, ",")...)
+	if storeConfig.SSL {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 storeConfig.CaPath,
+			EnableHostVerification: storeConfig.HostVerification,
+		}
+	}
+	if storeConfig.Auth {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: storeConfig.Username,
+			Password: storeConfig.Password,
+		}
+	}
+	cluster.Consistency = gocql.ParseConsistency(storeConfig.Consistency)
+	cluster.Timeout = time.Duration(storeConfig.Timeout) * time.Millisecond
+	cluster.ProtoVersion = storeConfig.CqlProtocolVersion
+	cluster.DisableInitialHostLookup = storeConfig.DisableInitialHostLookup
+	cluster.Keyspace = storeConfig.Keyspace
+	return cluster.CreateSession()
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/store/cassandra"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// getPoints decodes all chunks for the given metric in the given table and
+// returns the points within from <= ts < to.
+// if fix is not 0, the points are quantized and filled like metrictank would.
+func getPoints(ctx context.Context, store *cassandra.CassandraStore, table string, amkey schema.AMKey, fromUnix, toUnix, fix uint32) []schema.Point {
+	if fix != 0 {
+		return getSeries(ctx, store, table, amkey, fromUnix, toUnix, fix)
+	}
+	var points []schema.Point
+	igens, err := store.SearchTable(ctx, amkey, table, fromUnix, toUnix)
+	if err != nil {
+		panic(err)
+	}
+	for i, ig := range igens {
+		iter, err := ig.Get()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chunk %d itergen.Get: %s\n", i, err)
+			continue
+		}
+		for iter.Next() {
+			ts, val := iter.Values()
+			if ts >= fromUnix && ts < toUnix {
+				points = append(points, schema.Point{Val: val, Ts: ts})
+			}
+		}
+	}
+	return points
+}
+
+// pointsCSV prints all points as csv records of key,name,table,ts,value
+func pointsCSV(ctx context.Context, store *cassandra.CassandraStore, tables []string, metrics []Metric, fromUnix, toUnix, fix uint32) {
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"key", "name", "table", "ts", "value"})
+	for _, metric := range metrics {
+		for _, table := range tables {
+			points := getPoints(ctx, store, table, metric.AMKey, fromUnix, toUnix, fix)
+			for _, p := range points {
+				w.Write([]string{
+					metric.AMKey.String(),
+					metric.name,
+					table,
+					strconv.FormatUint(uint64(p.Ts), 10),
+					strconv.FormatFloat(p.Val, 'f', -1, 64),
+				})
+			}
+			w.Flush()
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write csv: %s\n", err)
+	}
+}
+
+// jsonPoint marshals like a graphite datapoint: [value, ts], with NaN as null
+type jsonPoint schema.Point
+
+func (p jsonPoint) MarshalJSON() ([]byte, error) {
+	b := []byte{'['}
+	if math.IsNaN(p.Val) {
+		b = append(b, "null"...)
+	} else {
+		b = strconv.AppendFloat(b, p.Val, 'f', -1, 64)
+	}
+	b = append(b, ',')
+	b = strconv.AppendUint(b, uint64(p.Ts), 10)
+	return append(b, ']'), nil
+}
+
+type jsonSeries struct {
+	Key        string      `json:"key"`
+	Name       string      `json:"name"`
+	Table      string      `json:"table"`
+	Datapoints []jsonPoint `json:"datapoints"`
+}
+
+// pointsJSON prints one json document per metric and table, each on its own line
+func pointsJSON(ctx context.Context, store *cassandra.CassandraStore, tables []string, metrics []Metric, fromUnix, toUnix, fix uint32) {
+	enc := json.NewEncoder(os.Stdout)
+	for _, metric := range metrics {
+		for _, table := range tables {
+			points := getPoints(ctx, store, table, metric.AMKey, fromUnix, toUnix, fix)
+			series := jsonSeries{
+				Key:        metric.AMKey.String(),
+				Name:       metric.name,
+				Table:      table,
+				Datapoints: make([]jsonPoint, len(points)),
+			}
+			for i, p := range points {
+				series.Datapoints[i] = jsonPoint(p)
+			}
+			if err := enc.Encode(series); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to encode json: %s\n", err)
+			}
+		}
+	}
+}
+
+// chunkSizes shows, for each chunk overlapping the requested range, its t0, span, size and point count
+// as well as totals per table
+func chunkSizes(ctx context.Context, store *cassandra.CassandraStore, tables []string, metrics []Metric, fromUnix, toUnix uint32) {
+	for _, metric := range metrics {
+		fmt.Println("## Metric", metric)
+		for _, table := range tables {
+			fmt.Println("### Table", table)
+			igens, err := store.SearchTable(ctx, metric.AMKey, table, fromUnix, toUnix)
+			if err != nil {
+				panic(err)
+			}
+			printChunkSizes(igens)
+		}
+	}
+}
+
+func printChunkSizes(igens []chunk.IterGen) {
+	var totalBytes uint64
+	var totalPoints int
+	fmt.Println("number of chunks:", len(igens))
+	for i, ig := range igens {
+		var points int
+		var first, last uint32
+		iter, err := ig.Get()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chunk %d itergen.Get: %s\n", i, err)
+			continue
+		}
+		for iter.Next() {
+			ts, _ := iter.Values()
+			if points == 0 {
+				first = ts
+			}
+			last = ts
+			points++
+		}
+		totalBytes += ig.Size()
+		totalPoints += points
+		if points == 0 {
+			fmt.Printf("t0 %s span %d bytes %d points 0\n", printTime(ig.Ts), ig.Span, ig.Size())
+			continue
+		}
+		fmt.Printf("t0 %s span %d bytes %d points %d first %s last %s\n", printTime(ig.Ts), ig.Span, ig.Size(), points, printTime(first), printTime(last))
+	}
+	if totalPoints > 0 {
+		fmt.Printf("total bytes %d points %d bytes/point %.2f\n", totalBytes, totalPoints, float64(totalBytes)/float64(totalPoints))
+	} else {
+		fmt.Printf("total bytes %d points 0\n", totalBytes)
+	}
+}
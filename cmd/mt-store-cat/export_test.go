@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestJSONPointMarshal(t *testing.T) {
+	cases := []struct {
+		p   jsonPoint
+		exp string
+	}{
+		{jsonPoint{Val: 1.5, Ts: 60}, "[1.5,60]"},
+		{jsonPoint{Val: 0, Ts: 0}, "[0,0]"},
+		{jsonPoint{Val: -123456789.25, Ts: 1500000000}, "[-123456789.25,1500000000]"},
+		{jsonPoint{Val: math.NaN(), Ts: 120}, "[null,120]"},
+	}
+	for i, c := range cases {
+		got, err := json.Marshal(c.p)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error %s", i, err)
+		}
+		if string(got) != c.exp {
+			t.Errorf("case %d: expected %s got %s", i, c.exp, got)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"strings"
@@ -30,12 +31,15 @@ var (
 	confFile    = flag.String("config", "/etc/metrictank/metrictank.ini", "configuration file path")
 
 	// our own flags
-	from        = flag.String("from", "-24h", "get data from (inclusive). only for points and points-summary format")
-	to          = flag.String("to", "now", "get data until (exclusive). only for points and points-summary format")
-	fix         = flag.Int("fix", 0, "fix data to this interval like metrictank does quantization. only for points and points-summary format")
-	printTs     = flag.Bool("print-ts", false, "print time stamps instead of formatted dates. only for points and poins-summary format")
+	from        = flag.String("from", "-24h", "get data from (inclusive). only for points, point-summary, csv, json, chunk-sizes and verify format")
+	to          = flag.String("to", "now", "get data until (exclusive). only for points, point-summary, csv, json, chunk-sizes and verify format")
+	fix         = flag.Int("fix", 0, "fix data to this interval like metrictank does quantization. only for points, point-summary, csv and json format")
+	printTs     = flag.Bool("print-ts", false, "print time stamps instead of formatted dates. only for points, point-summary, chunk-sizes and verify format")
 	groupTTL    = flag.String("groupTTL", "d", "group chunks in TTL buckets based on s (second. means unbucketed), m (minute), h (hour) or d (day). only for chunk-summary format")
 	timeZoneStr = flag.String("time-zone", "local", "time-zone to use for interpreting from/to when needed. (check your config)")
+
+	// where to write informational output that is not the actual requested data
+	info io.Writer = os.Stdout
 )
 
 func main() {
@@ -80,12 +84,19 @@ func main() {
 		fmt.Printf("	                            - points\n")
 		fmt.Printf("	                            - point-summary\n")
 		fmt.Printf("	                            - chunk-summary (shows TTL's, optionally bucketed. See groupTTL flag)\n")
+		fmt.Printf("	                            - chunk-sizes (shows t0, span, size and number of points of each chunk)\n")
+		fmt.Printf("	                            - csv (all points in range, as key,name,table,ts,value records)\n")
+		fmt.Printf("	                            - json (all points in range, one json document per metric and table)\n")
+		fmt.Printf("	                            - verify (decodes the chunks that start in range, and reports the corrupt ones with their row key)\n")
 		fmt.Println()
 		fmt.Println("EXAMPLES:")
 		fmt.Println("mt-store-cat -cassandra-keyspace metrictank -from='-1min' '*' '1.77c8c77afa22b67ef5b700c2a2b88d5f' points")
 		fmt.Println("mt-store-cat -cassandra-keyspace metrictank -from='-1month' '*' 'prefix:fake' point-summary")
 		fmt.Println("mt-store-cat -cassandra-keyspace metrictank '*' 'prefix:fake' chunk-summary")
 		fmt.Println("mt-store-cat -groupTTL h -cassandra-keyspace metrictank 'metric_512' '1.37cf8e3731ee4c79063c1d55280d1bbe' chunk-summary")
+		fmt.Println("mt-store-cat -cassandra-keyspace metrictank -from='-6h' 'metric_512' '1.37cf8e3731ee4c79063c1d55280d1bbe' chunk-sizes")
+		fmt.Println("mt-store-cat -cassandra-keyspace metrictank -from='-6h' '*' 'prefix:fake' csv > points.csv")
+		fmt.Println("mt-store-cat -cassandra-keyspace metrictank -from='-7d' 'metric_512' 'prefix:fake' verify")
 		fmt.Println("Flags:")
 		flag.PrintDefaults()
 		fmt.Println("Notes:")
@@ -95,6 +106,9 @@ func main() {
 		fmt.Println(" * When using chunk-summary, if there's data that should have been expired by cassandra, but for some reason didn't, we won't see or report it")
 		fmt.Println(" * Doesn't automatically return data for aggregated series. It's up to you to query for an AMKey (id_<rollup>_<span>) when appropriate")
 		fmt.Println(" * (rollup is one of sum, cnt, lst, max, min and span is a number in seconds)")
+		fmt.Println(" * For csv and json formats, only points in the `from <= ts < to` range are returned, and informational output is written to stderr")
+		fmt.Println(" * verify checks that the timestamps of each chunk increase and lie within its span, and that it doesn't have more points than fit in its span.")
+		fmt.Println("   it exits with status 1 if any chunk is corrupt. encrypted chunks are not verified")
 	}
 	flag.Parse()
 
@@ -115,7 +129,12 @@ func main() {
 		}
 		metricSelector = flag.Arg(1)
 		format = flag.Arg(2)
-		if format != "points" && format != "point-summary" && format != "chunk-summary" {
+		switch format {
+		case "points", "point-summary", "chunk-summary", "chunk-sizes", "verify":
+		case "csv", "json":
+			// keep stdout clean for the machine readable output
+			info = os.Stderr
+		default:
 			flag.Usage()
 			os.Exit(-1)
 		}
@@ -191,7 +210,7 @@ func main() {
 
 	var fromUnix, toUnix uint32
 
-	if format == "points" || format == "point-summary" {
+	if format != "chunk-summary" {
 		now := time.Now()
 		defaultFrom := uint32(now.Add(-time.Duration(24) * time.Hour).Unix())
 		defaultTo := uint32(now.Add(time.Duration(1) * time.Second).Unix())
@@ -208,10 +227,10 @@ func main() {
 	}
 	var metrics []Metric
 	if metricSelector == "*" {
-		fmt.Println("# Looking for ALL metrics")
+		fmt.Fprintln(info, "# Looking for ALL metrics")
 		// chunk-summary doesn't need an explicit listing. it knows if metrics is empty, to query all
-		// but the other two do need an explicit listing.
-		if format == "points" || format == "point-summary" {
+		// but the others do need an explicit listing.
+		if format != "chunk-summary" {
 			metrics, err = getMetrics(store, "")
 			if err != nil {
 				log.Error(3, "cassandra query error. %s", err)
@@ -219,14 +238,14 @@ func main() {
 			}
 		}
 	} else if strings.HasPrefix(metricSelector, "prefix:") {
-		fmt.Println("# Looking for these metrics:")
+		fmt.Fprintln(info, "# Looking for these metrics:")
 		metrics, err = getMetrics(store, strings.Replace(metricSelector, "prefix:", "", 1))
 		if err != nil {
 			log.Error(3, "cassandra query error. %s", err)
 			return
 		}
 		for _, m := range metrics {
-			fmt.Println(m)
+			fmt.Fprintln(info, m)
 		}
 	} else {
 		amkey, err := schema.AMKeyFromString(metricSelector)
@@ -235,7 +254,7 @@ func main() {
 			return
 		}
 
-		fmt.Println("# Looking for this metric:")
+		fmt.Fprintln(info, "# Looking for this metric:")
 
 		metrics, err = getMetric(store, amkey)
 		if err != nil {
@@ -243,15 +262,15 @@ func main() {
 			return
 		}
 		if len(metrics) == 0 {
-			fmt.Printf("metric id %v not found", amkey.MKey)
+			fmt.Fprintf(info, "metric id %v not found", amkey.MKey)
 			return
 		}
 		for _, m := range metrics {
-			fmt.Println(m)
+			fmt.Fprintln(info, m)
 		}
 	}
 
-	fmt.Printf("# Keyspace %q:\n", storeConfig.Keyspace)
+	fmt.Fprintf(info, "# Keyspace %q:\n", storeConfig.Keyspace)
 
 	span := tracer.StartSpan("mt-store-cat " + format)
 	ctx := opentracing.ContextWithSpan(context.Background(), span)
@@ -263,5 +282,15 @@ func main() {
 		pointSummary(ctx, store, tables, metrics, fromUnix, toUnix, uint32(*fix))
 	case "chunk-summary":
 		chunkSummary(ctx, store, tables, metrics, storeConfig.Keyspace, *groupTTL)
+	case "chunk-sizes":
+		chunkSizes(ctx, store, tables, metrics, fromUnix, toUnix)
+	case "csv":
+		pointsCSV(ctx, store, tables, metrics, fromUnix, toUnix, uint32(*fix))
+	case "json":
+		pointsJSON(ctx, store, tables, metrics, fromUnix, toUnix, uint32(*fix))
+	case "verify":
+		if verify(store, tables, metrics, fromUnix, toUnix) > 0 {
+			os.Exit(1)
+		}
 	}
 }
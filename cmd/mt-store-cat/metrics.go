@@ -11,8 +11,9 @@ import (
 )
 
 type Metric struct {
-	AMKey schema.AMKey
-	name  string
+	AMKey    schema.AMKey
+	name     string
+	interval uint32
 }
 
 func (m Metric) String() string {
@@ -28,10 +29,12 @@ func (m MetricsByName) Less(i, j int) bool { return m[i].name < m[j].name }
 // prefix is optional
 func getMetrics(store *cassandra.CassandraStore, prefix string) ([]Metric, error) {
 	var metrics []Metric
-	iter := store.Session.Query("select id, metric from metric_idx").Iter()
+	iter := store.Session.Query("select id, metric, interval from metric_idx").Iter()
 	var m Metric
 	var idString string
-	for iter.Scan(&idString, &m.name) {
+	var interval int
+	for iter.Scan(&idString, &m.name, &interval) {
+		m.interval = uint32(interval)
 		if strings.HasPrefix(m.name, prefix) {
 			mkey, err := schema.MKeyFromString(idString)
 			if err != nil {
@@ -54,10 +57,12 @@ func getMetrics(store *cassandra.CassandraStore, prefix string) ([]Metric, error
 func getMetric(store *cassandra.CassandraStore, amkey schema.AMKey) ([]Metric, error) {
 	var metrics []Metric
 	// index only stores MKey's, not AMKey's.
-	iter := store.Session.Query("select id, metric from metric_idx where id=? ALLOW FILTERING", amkey.MKey).Iter()
+	iter := store.Session.Query("select id, metric, interval from metric_idx where id=? ALLOW FILTERING", amkey.MKey).Iter()
 	var m Metric
 	var idString string
-	for iter.Scan(idString, &m.name) {
+	var interval int
+	for iter.Scan(&idString, &m.name, &interval) {
+		m.interval = uint32(interval)
 		mkey, err := schema.MKeyFromString(idString)
 		if err != nil {
 			panic(err)
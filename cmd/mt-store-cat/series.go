@@ -97,14 +97,14 @@ func printPointsNormal(points []schema.Point, from, to uint32) {
 	}
 }
 
-func printRecord(ts uint32, val float64, in, nan bool) {
-	printTime := func(ts uint32) string {
-		if *printTs {
-			return fmt.Sprintf("%d", ts)
-		} else {
-			return time.Unix(int64(ts), 0).Format(tsFormat)
-		}
+func printTime(ts uint32) string {
+	if *printTs {
+		return fmt.Sprintf("%d", ts)
 	}
+	return time.Unix(int64(ts), 0).Format(tsFormat)
+}
+
+func printRecord(ts uint32, val float64, in, nan bool) {
 	if in {
 		if nan {
 			fmt.Println("> ", printTime(ts), "NAN")
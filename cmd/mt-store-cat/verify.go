@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/store/cassandra"
+)
+
+var errEncrypted = errors.New("chunk is encrypted")
+
+// rawChunk is a chunk as it is stored, before decoding
+type rawChunk struct {
+	key  string // row key
+	t0   uint32
+	data []byte
+}
+
+// verify decodes all chunks of the metrics that start in the from-to range, and reports the ones that are corrupt.
+// it returns the number of corrupt chunks
+func verify(store *cassandra.CassandraStore, tables []string, metrics []Metric, fromUnix, toUnix uint32) int {
+	var total, corrupt, encrypted int
+	startMonth := fromUnix - (fromUnix % cassandra.Month_sec)
+	endMonth := (toUnix - 1) - ((toUnix - 1) % cassandra.Month_sec)
+	for _, metric := range metrics {
+		interval := metric.interval
+		if metric.AMKey.Archive != 0 {
+			interval = metric.AMKey.Archive.Span()
+		}
+		for _, table := range tables {
+			// we only know where a chunk without span ends once we read the next one
+			var pending *rawChunk
+			check := func(nextT0 uint32) {
+				total++
+				err := verifyChunk(pending.t0, pending.data, interval, nextT0)
+				if err == errEncrypted {
+					encrypted++
+				} else if err != nil {
+					corrupt++
+					fmt.Printf("corrupt chunk: table %s key %s t0 %s: %s\n", table, pending.key, printTime(pending.t0), err)
+				}
+			}
+			query := fmt.Sprintf("SELECT ts, data FROM %s WHERE key = ? AND ts >= ? AND ts < ? ORDER BY ts ASC", table)
+			for month := startMonth; month <= endMonth; month += cassandra.Month_sec {
+				rowKey := fmt.Sprintf("%s_%d", metric.AMKey.String(), month/cassandra.Month_sec)
+				iter := store.Session.Query(query, rowKey, fromUnix, toUnix).Iter()
+				var ts int
+				var data []byte
+				for iter.Scan(&ts, &data) {
+					if pending != nil {
+						check(uint32(ts))
+					}
+					pending = &rawChunk{rowKey, uint32(ts), data}
+					data = nil
+				}
+				if err := iter.Close(); err != nil {
+					panic(err)
+				}
+			}
+			if pending != nil {
+				check(0)
+			}
+		}
+	}
+	fmt.Printf("## verified %d chunks of %d metrics: %d corrupt, %d encrypted and not verified\n", total, len(metrics), corrupt, encrypted)
+	return corrupt
+}
+
+// verifyChunk decodes the chunk, and checks that its timestamps increase and lie within its span,
+// and that it doesn't have more points than fit in its span at the given interval.
+// when the chunk doesn't know its span, it must end before the next chunk, unless nextT0 is 0.
+// interval may be 0 if it is unknown.
+func verifyChunk(t0 uint32, data []byte, interval, nextT0 uint32) error {
+	if len(data) < 2 {
+		return fmt.Errorf("too small: %d bytes", len(data))
+	}
+	if chunk.Format(data[0]) == chunk.FormatEncrypted {
+		return errEncrypted
+	}
+	ig, err := chunk.NewGen(data, t0)
+	if err != nil {
+		return fmt.Errorf("can't decode: %s", err)
+	}
+	iter, err := ig.Get()
+	if err != nil {
+		return fmt.Errorf("can't read: %s", err)
+	}
+	end := nextT0
+	if ig.Span > 0 {
+		end = t0 + ig.Span
+	}
+	var points int
+	var prev uint32
+	for iter.Next() {
+		ts, _ := iter.Values()
+		if ts < t0 {
+			return fmt.Errorf("point at %s is before the start of the chunk", printTime(ts))
+		}
+		if points > 0 && ts <= prev {
+			return fmt.Errorf("point at %s does not come after the previous point at %s", printTime(ts), printTime(prev))
+		}
+		if end > 0 && ts >= end {
+			return fmt.Errorf("point at %s is after the end of the chunk at %s", printTime(ts), printTime(end))
+		}
+		prev = ts
+		points++
+	}
+	if err := iter.Err(); err != nil {
+		return fmt.Errorf("corrupt data after %d points: %s", points, err)
+	}
+	if points == 0 {
+		return errors.New("no points")
+	}
+	if ig.Span > 0 && interval > 0 && uint32(points) > ig.Span/interval {
+		return fmt.Errorf("%d points, but a span of %d only fits %d at interval %d", points, ig.Span, ig.Span/interval, interval)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/dgryski/go-tsz"
+	"github.com/grafana/metrictank/mdata/chunk"
+)
+
+// encodeChunk returns a persisted chunk with the given points, pushed as is
+func encodeChunk(t0, span uint32, ts ...uint32) []byte {
+	s := tsz.New(t0)
+	for _, t := range ts {
+		s.Push(t, 1)
+	}
+	s.Finish()
+	if span == 0 {
+		return append([]byte{byte(chunk.FormatStandardGoTsz)}, s.Bytes()...)
+	}
+	return chunk.Encode(span, chunk.EncodingFloat, chunk.CodecNone, s.Bytes())
+}
+
+func TestVerifyChunk(t *testing.T) {
+	valid := encodeChunk(600, 600, 600, 660, 1140)
+	cases := []struct {
+		name     string
+		data     []byte
+		interval uint32
+		nextT0   uint32
+		err      bool
+	}{
+		{name: "valid", data: valid, interval: 60},
+		{name: "unknown interval", data: valid},
+		{name: "too small", data: []byte{1}, err: true},
+		{name: "unknown format", data: []byte{200, 0, 0}, err: true},
+		{name: "truncated", data: valid[:len(valid)-3], err: true},
+		{name: "not increasing", data: encodeChunk(600, 600, 660, 660), err: true},
+		{name: "before t0", data: encodeChunk(600, 600, 540, 660), err: true},
+		{name: "after span", data: encodeChunk(600, 600, 660, 1200), err: true},
+		{name: "too many points", data: encodeChunk(600, 600, 600, 610, 620), interval: 300, err: true},
+		{name: "no span, before next chunk", data: encodeChunk(600, 0, 600, 1140), nextT0: 1200},
+		{name: "no span, overlaps next chunk", data: encodeChunk(600, 0, 600, 1200), nextT0: 1200, err: true},
+		{name: "no span, last chunk", data: encodeChunk(600, 0, 600, 1200)},
+		{name: "no points", data: encodeChunk(600, 600), err: true},
+	}
+	for _, c := range cases {
+		err := verifyChunk(600, c.data, c.interval, c.nextT0)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error %t, got %v", c.name, c.err, err)
+		}
+	}
+
+	if err := verifyChunk(600, []byte{byte(chunk.FormatEncrypted), 0, 0}, 60, 0); err != errEncrypted {
+		t.Errorf("expected encrypted chunks not to be verified, got %v", err)
+	}
+}
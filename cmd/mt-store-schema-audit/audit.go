@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/store/cassandra"
+)
+
+// tableInfo describes the relevant settings of an existing table, as found in system_schema.tables
+type tableInfo struct {
+	name           string
+	compaction     map[string]string
+	gcGraceSeconds int
+}
+
+// finding is a discrepancy between the existing schema and what metrictank would create,
+// along with the statement that would resolve it, if any.
+type finding struct {
+	table  string
+	msg    string
+	action string
+}
+
+var metricTableRe = regexp.MustCompile(`^metric_[0-9]+$`)
+
+const twcs = "org.apache.cassandra.db.compaction.TimeWindowCompactionStrategy"
+
+// audit compares the existing tables against the expected ones.
+// createTpl is the schema_table template from the schema file, used to suggest how to create missing tables.
+// if it's empty, no create statements are suggested.
+func audit(keyspace string, expected cassandra.TTLTables, existing map[string]tableInfo, createTpl string) []finding {
+	var findings []finding
+	wanted := make(map[string]uint32) // table -> window size
+	for _, t := range expected {
+		wanted[t.Table] = t.WindowSize
+	}
+
+	for table, windowSize := range wanted {
+		info, ok := existing[table]
+		if !ok {
+			f := finding{table: table, msg: "table is missing"}
+			if createTpl != "" {
+				f.action = strings.TrimSpace(fmt.Sprintf(createTpl, keyspace, table, windowSize, windowSize*60*60)) + ";"
+			}
+			findings = append(findings, f)
+			continue
+		}
+		findings = append(findings, checkTable(keyspace, info, windowSize)...)
+	}
+
+	for table := range existing {
+		if _, ok := wanted[table]; ok || !metricTableRe.MatchString(table) {
+			continue
+		}
+		findings = append(findings, finding{
+			table: table,
+			msg:   "table is not used by the current storage-schemas. it can be dropped once all its data has expired, or holds data from an old configuration",
+		})
+	}
+
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].table != findings[j].table {
+			return tableNum(findings[i].table) < tableNum(findings[j].table)
+		}
+		return findings[i].msg < findings[j].msg
+	})
+	return findings
+}
+
+// checkTable checks the compaction settings and gc_grace_seconds of an existing table
+func checkTable(keyspace string, info tableInfo, windowSize uint32) []finding {
+	var findings []finding
+	class := info.compaction["class"]
+	unit := info.compaction["compaction_window_unit"]
+	size := info.compaction["compaction_window_size"]
+	var problems []string
+	if class != twcs && class != "TimeWindowCompactionStrategy" {
+		problems = append(problems, fmt.Sprintf("compaction class is %q, expected TimeWindowCompactionStrategy", class))
+	}
+	if unit != "HOURS" {
+		problems = append(problems, fmt.Sprintf("compaction window unit is %q, expected HOURS", unit))
+	}
+	if size != strconv.Itoa(int(windowSize)) {
+		problems = append(problems, fmt.Sprintf("compaction window size is %q, expected %d", size, windowSize))
+	}
+	if len(problems) > 0 {
+		findings = append(findings, finding{
+			table:  info.name,
+			msg:    strings.Join(problems, ", "),
+			action: fmt.Sprintf("ALTER TABLE %s.%s WITH compaction = { 'class': 'TimeWindowCompactionStrategy', 'compaction_window_unit': 'HOURS', 'compaction_window_size': '%d', 'tombstone_threshold': '0.2', 'tombstone_compaction_interval': '86400'};", keyspace, info.name, windowSize),
+		})
+	}
+	expGcGrace := int(windowSize) * 60 * 60
+	if info.gcGraceSeconds != expGcGrace {
+		findings = append(findings, finding{
+			table:  info.name,
+			msg:    fmt.Sprintf("gc_grace_seconds is %d, expected %d", info.gcGraceSeconds, expGcGrace),
+			action: fmt.Sprintf("ALTER TABLE %s.%s WITH gc_grace_seconds = %d;", keyspace, info.name, expGcGrace),
+		})
+	}
+	return findings
+}
+
+// tableNum returns the number in a metric_N table name, for sorting purposes
+func tableNum(table string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(table, "metric_"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
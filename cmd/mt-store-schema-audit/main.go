@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/store/cassandra"
+	"github.com/grafana/metrictank/util"
+)
+
+var (
+	gitHash     = "(none)"
+	showVersion = flag.Bool("version", false, "print version string")
+
+	schemasFile = flag.String("schemas-file", "/etc/metrictank/storage-schemas.conf", "path to storage-schemas.conf file")
+)
+
+func main() {
+	storeConfig := cassandra.NewStoreConfig()
+
+	// flags from cassandra/config.go
+	flag.StringVar(&storeConfig.Addrs, "cassandra-addrs", storeConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
+	flag.StringVar(&storeConfig.Keyspace, "cassandra-keyspace", storeConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
+	flag.StringVar(&storeConfig.Consistency, "cassandra-consistency", storeConfig.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	flag.IntVar(&storeConfig.Timeout, "cassandra-timeout", storeConfig.Timeout, "cassandra timeout in milliseconds")
+	flag.IntVar(&storeConfig.CqlProtocolVersion, "cql-protocol-version", storeConfig.CqlProtocolVersion, "cql protocol version to use")
+	flag.BoolVar(&storeConfig.DisableInitialHostLookup, "cassandra-disable-initial-host-lookup", storeConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+	flag.BoolVar(&storeConfig.SSL, "cassandra-ssl", storeConfig.SSL, "enable SSL connection to cassandra")
+	flag.StringVar(&storeConfig.CaPath, "cassandra-ca-path", storeConfig.CaPath, "cassandra CA certificate path when using SSL")
+	flag.BoolVar(&storeConfig.HostVerification, "cassandra-host-verification", storeConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
+	flag.BoolVar(&storeConfig.Auth, "cassandra-auth", storeConfig.Auth, "enable cassandra authentication")
+	flag.StringVar(&storeConfig.Username, "cassandra-username", storeConfig.Username, "username for authentication")
+	flag.StringVar(&storeConfig.Password, "cassandra-password", storeConfig.Password, "password for authentication")
+	flag.IntVar(&storeConfig.WindowFactor, "window-factor", storeConfig.WindowFactor, "size of compaction window relative to TTL")
+	flag.StringVar(&storeConfig.SchemaFile, "schema-file", storeConfig.SchemaFile, "File containing the cassandra schemas. used to suggest create statements for missing tables")
+
+	flag.Usage = func() {
+		fmt.Println("mt-store-schema-audit")
+		fmt.Println()
+		fmt.Println("Compares the metric tables in a cassandra keyspace against the tables that metrictank would create for the given")
+		fmt.Println("storage-schemas and window-factor: missing tables, tables that are no longer used, and tables whose compaction settings")
+		fmt.Println("(TimeWindowCompactionStrategy window size and unit) or gc_grace_seconds have drifted.")
+		fmt.Println("For each discrepancy, the CQL statement to resolve it is suggested, if applicable. Nothing is changed.")
+		fmt.Println("Requires cassandra 3.0 or later (system_schema keyspace)")
+		fmt.Println()
+		fmt.Println("Usage:")
+		fmt.Println()
+		fmt.Printf("	mt-store-schema-audit [flags]\n")
+		fmt.Println()
+		fmt.Println("Exit status is 0 if no discrepancies were found, 1 otherwise.")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-store-schema-audit -cassandra-addrs=192.168.0.1 -cassandra-keyspace=metrictank -schemas-file=/etc/metrictank/storage-schemas.conf")
+		fmt.Println()
+		fmt.Println("Flags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("mt-store-schema-audit (built with %s, git hash %s)\n", runtime.Version(), gitHash)
+		return
+	}
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	schemas, err := conf.ReadSchemas(*schemasFile)
+	if err != nil {
+		log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+	}
+	expected := cassandra.GetTTLTables(schemas.TTLs(), storeConfig.WindowFactor, cassandra.Table_name_format)
+
+	var createTpl string
+	if _, err := os.Stat(storeConfig.SchemaFile); err == nil {
+		createTpl = util.ReadEntry(storeConfig.SchemaFile, "schema_table").(string)
+	} else {
+		log.Warnf("can't read schema file %q: %s. will not suggest create statements", storeConfig.SchemaFile, err)
+	}
+
+	session, err := newSession(storeConfig)
+	if err != nil {
+		log.Fatalf("failed to connect to cassandra: %s", err)
+	}
+	defer session.Close()
+
+	existing, err := getTables(session, storeConfig.Keyspace)
+	if err != nil {
+		log.Fatalf("failed to read table metadata for keyspace %q: %s", storeConfig.Keyspace, err)
+	}
+
+	findings := audit(storeConfig.Keyspace, expected, existing, createTpl)
+	for _, f := range findings {
+		fmt.Printf("## %s: %s\n", f.table, f.msg)
+		if f.action != "" {
+			fmt.Println(f.action)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("# %d tables expected, %d metric tables found, %d discrepancies\n", len(expected), countMetricTables(existing), len(findings))
+	if len(findings) > 0 {
+		session.Close()
+		os.Exit(1)
+	}
+}
+
+func newSession(config *cassandra.StoreConfig) (*gocql.Session, error) {
+	cluster := gocql.NewCluster(strings.Split(config.Addrs, ",")...)
+	if config.SSL {
+		cluster.SslOpts = &gocql.SslOptions{
+			CaPath:                 config.CaPath,
+			EnableHostVerification: config.HostVerification,
+		}
+	}
+	if config.Auth {
+		cluster.Authenticator = gocql.PasswordAuthenticator{
+			Username: config.Username,
+			Password: config.Password,
+		}
+	}
+	cluster.Consistency = gocql.ParseConsistency(config.Consistency)
+	cluster.Timeout = time.Duration(config.Timeout) * time.Millisecond
+	cluster.ConnectTimeout = cluster.Timeout
+	cluster.ProtoVersion = config.CqlProtocolVersion
+	cluster.DisableInitialHostLookup = config.DisableInitialHostLookup
+	return cluster.CreateSession()
+}
+
+// getTables returns the compaction settings and gc_grace_seconds of all tables in the keyspace
+func getTables(session *gocql.Session, keyspace string) (map[string]tableInfo, error) {
+	tables := make(map[string]tableInfo)
+	iter := session.Query("SELECT table_name, compaction, gc_grace_seconds FROM system_schema.tables WHERE keyspace_name = ?", keyspace).Iter()
+	var info tableInfo
+	for iter.Scan(&info.name, &info.compaction, &info.gcGraceSeconds) {
+		tables[info.name] = info
+		info = tableInfo{}
+	}
+	return tables, iter.Close()
+}
+
+func countMetricTables(tables map[string]tableInfo) int {
+	var n int
+	for name := range tables {
+		if metricTableRe.MatchString(name) {
+			n++
+		}
+	}
+	return n
+}
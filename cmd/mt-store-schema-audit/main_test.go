@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/store/cassandra"
+)
+
+func TestAudit(t *testing.T) {
+	// 1d -> metric_16 with window 1, 30d -> metric_512 with window 26, 1y -> metric_8192 with window 410
+	expected := cassandra.GetTTLTables([]uint32{86400, 30 * 86400, 365 * 86400}, 20, cassandra.Table_name_format)
+	existing := map[string]tableInfo{
+		"metric_16": {
+			name:           "metric_16",
+			compaction:     map[string]string{"class": twcs, "compaction_window_unit": "HOURS", "compaction_window_size": "1"},
+			gcGraceSeconds: 3600,
+		},
+		"metric_512": {
+			name:           "metric_512",
+			compaction:     map[string]string{"class": twcs, "compaction_window_unit": "DAYS", "compaction_window_size": "1"},
+			gcGraceSeconds: 864000,
+		},
+		"metric_2048": {
+			name:           "metric_2048",
+			compaction:     map[string]string{"class": twcs, "compaction_window_unit": "HOURS", "compaction_window_size": "103"},
+			gcGraceSeconds: 103 * 3600,
+		},
+		"metric_idx": {
+			name: "metric_idx",
+		},
+	}
+	findings := audit("metrictank", expected, existing, "CREATE TABLE %s.%s window %d gc %d")
+
+	exp := []struct {
+		table  string
+		msg    string
+		action string
+	}{
+		{"metric_512", "compaction window unit is \"DAYS\", expected HOURS, compaction window size is \"1\", expected 26", "ALTER TABLE metrictank.metric_512 WITH compaction"},
+		{"metric_512", "gc_grace_seconds is 864000, expected 93600", "ALTER TABLE metrictank.metric_512 WITH gc_grace_seconds = 93600;"},
+		{"metric_2048", "table is not used by the current storage-schemas", ""},
+		{"metric_8192", "table is missing", "CREATE TABLE metrictank.metric_8192 window 410 gc 1476000;"},
+	}
+	if len(findings) != len(exp) {
+		t.Fatalf("expected %d findings, got %d: %v", len(exp), len(findings), findings)
+	}
+	for i, e := range exp {
+		f := findings[i]
+		if f.table != e.table || !strings.HasPrefix(f.msg, e.msg) || !strings.HasPrefix(f.action, e.action) {
+			t.Fatalf("finding %d: expected %v, got %v", i, e, f)
+		}
+	}
+}
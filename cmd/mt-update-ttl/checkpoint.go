@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// checkpoint is the progress of a run in token-ranges mode, saved so that an interrupted run can be resumed
+type checkpoint struct {
+	TableIn  string            `json:"tableIn"`
+	TableOut string            `json:"tableOut"`
+	TTL      int               `json:"ttl"`
+	StartTs  int               `json:"startTs"`
+	EndTs    int               `json:"endTs"`
+	Ranges   []rangeCheckpoint `json:"ranges"`
+}
+
+type rangeCheckpoint struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	Next  int64 `json:"next"` // all keys with a lower token are processed
+	Done  bool  `json:"done"`
+}
+
+// loadCheckpoint reads the checkpoint from the file. it returns nil if the file doesn't exist
+func loadCheckpoint(path string) (*checkpoint, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var c checkpoint
+	if err := json.Unmarshal(buf, &c); err != nil {
+		return nil, fmt.Errorf("can't parse checkpoint %s: %s", path, err)
+	}
+	return &c, nil
+}
+
+// save writes the checkpoint to the file. it writes a temporary file first, and renames it,
+// so that we never leave a partial checkpoint behind when we're interrupted
+func (c checkpoint) save(path string) error {
+	buf, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// resumes returns an error if the checkpoint is not of a run with the given settings
+func (c checkpoint) resumes(run checkpoint) error {
+	if c.TableIn != run.TableIn || c.TableOut != run.TableOut || c.TTL != run.TTL || c.StartTs != run.StartTs || c.EndTs != run.EndTs {
+		return fmt.Errorf("checkpoint is of a run from %s to %s with ttl %d and timestamps %d - %d, not from %s to %s with ttl %d and timestamps %d - %d",
+			c.TableIn, c.TableOut, c.TTL, c.StartTs, c.EndTs, run.TableIn, run.TableOut, run.TTL, run.StartTs, run.EndTs)
+	}
+	if len(c.Ranges) != len(run.Ranges) {
+		return fmt.Errorf("checkpoint is of a run with %d token ranges, not %d", len(c.Ranges), len(run.Ranges))
+	}
+	for i, r := range c.Ranges {
+		if r.Start != run.Ranges[i].Start || r.End != run.Ranges[i].End || r.Next < r.Start || r.Next > r.End {
+			return fmt.Errorf("checkpoint has an invalid token range %d: %d - %d, next %d", i, r.Start, r.End, r.Next)
+		}
+	}
+	return nil
+}
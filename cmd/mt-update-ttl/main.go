@@ -42,10 +42,18 @@ var (
 	endTs      = flag.Int("end-timestamp", math.MaxInt32, "timestamp at which to stop, defaults to int max")
 	numThreads = flag.Int("threads", 1, "number of workers to use to process data")
 
+	numTokenRanges   = flag.Int("token-ranges", 0, "if > 0, scan the input table by splitting the token ring in this many ranges, rather than listing all distinct keys up front. allows progress and ETA reporting")
+	maxRowsPerSecond = flag.Int("max-rows-per-second", 0, "max number of rows to process per second, across all workers. use 0 to disable")
+	progressInterval = flag.Duration("progress-interval", 10*time.Second, "how often to report progress and ETA (token-ranges mode only)")
+	checkpointFile   = flag.String("checkpoint-file", "", "file to save the progress to at every progress-interval, and to resume an interrupted run from if it exists. the run must have the same ttl, tables, timestamps and token-ranges (token-ranges mode only)")
+
 	verbose = flag.Bool("verbose", false, "show every record being processed")
 
 	doneKeys uint64
 	doneRows uint64
+
+	// if not nil, every row to process needs to be taken from here first
+	throttle <-chan struct{}
 )
 
 func main() {
@@ -56,6 +64,13 @@ func main() {
 		fmt.Fprintln(os.Stderr, "If table-out not specified or same as table-in, will update in place. Otherwise will not touch input table and store results in table-out")
 		fmt.Fprintln(os.Stderr, "In that case, it is up to you to assure table-out exists before running this tool")
 		fmt.Fprintln(os.Stderr, "Not supported yet: for the per-ttl tables as of 0.7, automatically putting data in the right table")
+		fmt.Fprintln(os.Stderr, "When using -token-ranges, the ranges are distributed over the workers and scanned using paging, which is friendlier on large tables")
+		fmt.Fprintln(os.Stderr, "Use -max-rows-per-second to limit the load on your cluster")
+		fmt.Fprintln(os.Stderr, "Use -checkpoint-file with -token-ranges to be able to resume the run where it left off when it's interrupted, or when some token ranges failed")
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "EXAMPLES:")
+		fmt.Fprintln(os.Stderr, "mt-update-ttl -threads 10 -token-ranges 1000 -max-rows-per-second 5000 35d metric_512 metric_1024")
+		fmt.Fprintln(os.Stderr, "mt-update-ttl -threads 10 -token-ranges 1000 -checkpoint-file /var/tmp/update-ttl.json 35d metric_512 metric_1024")
 		fmt.Println("Flags:")
 		flag.PrintDefaults()
 		os.Exit(-1)
@@ -79,6 +94,16 @@ func main() {
 		panic(fmt.Sprintf("Failed to instantiate cassandra: %s", err))
 	}
 
+	if *checkpointFile != "" && *numTokenRanges == 0 {
+		log.Fatal("ERROR: -checkpoint-file requires -token-ranges")
+	}
+
+	throttle = newThrottle(*maxRowsPerSecond)
+
+	if *numTokenRanges > 0 {
+		updateByTokenRanges(session, ttl, tableIn, tableOut, *numTokenRanges)
+		return
+	}
 	update(session, ttl, tableIn, tableOut)
 }
 
@@ -155,33 +180,42 @@ func completenessEstimate(token int64) float64 {
 	return ((float64(token) / float64(maxToken)) + 1) / 2
 }
 
+// processRow writes the given row to tableOut with the TTL recalculated relative to its timestamp
+// it returns the total number of rows processed so far
+func processRow(id int, session *gocql.Session, ttl int, tableIn, tableOut, key string, ts int, data []byte) uint64 {
+	if throttle != nil {
+		<-throttle
+	}
+	var query string
+	newTTL := getTTL(int(time.Now().Unix()), ts, ttl)
+	if tableIn == tableOut {
+		query = fmt.Sprintf("UPDATE %s USING TTL %d SET data = ? WHERE key = ? AND ts = ?", tableIn, newTTL)
+	} else {
+		query = fmt.Sprintf("INSERT INTO %s (data, key, ts) values(?,?,?) USING TTL %d", tableOut, newTTL)
+	}
+	if *verbose {
+		log.Printf("id=%d processing rownum=%d table=%q key=%q ts=%d query=%q data='%x'\n", id, atomic.LoadUint64(&doneRows)+1, tableIn, key, ts, query, data)
+	}
+
+	err := session.Query(query, data, key, ts).Exec()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: id=%d failed updating %s %s %d: %q", id, tableOut, key, ts, err)
+	}
+
+	return atomic.AddUint64(&doneRows, 1)
+}
+
 func worker(id int, jobs <-chan string, wg *sync.WaitGroup, session *gocql.Session, startTime, endTime, ttl int, tableIn, tableOut string) {
 	defer wg.Done()
 	var token int64
 	var ts int
 	var data []byte
-	var query string
 	queryTpl := fmt.Sprintf("SELECT token(key), ts, data FROM %s where key=? AND ts>=? AND ts<?", tableIn)
 
 	for key := range jobs {
 		iter := session.Query(queryTpl, key, startTime, endTime).Iter()
 		for iter.Scan(&token, &ts, &data) {
-			newTTL := getTTL(int(time.Now().Unix()), ts, ttl)
-			if tableIn == tableOut {
-				query = fmt.Sprintf("UPDATE %s USING TTL %d SET data = ? WHERE key = ? AND ts = ?", tableIn, newTTL)
-			} else {
-				query = fmt.Sprintf("INSERT INTO %s (data, key, ts) values(?,?,?) USING TTL %d", tableOut, newTTL)
-			}
-			if *verbose {
-				log.Printf("id=%d processing rownum=%d table=%q key=%q ts=%d query=%q data='%x'\n", id, atomic.LoadUint64(&doneRows)+1, tableIn, key, ts, query, data)
-			}
-
-			err := session.Query(query, data, key, ts).Exec()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "ERROR: id=%d failed updating %s %s %d: %q", id, tableOut, key, ts, err)
-			}
-
-			doneRowsSnap := atomic.AddUint64(&doneRows, 1)
+			doneRowsSnap := processRow(id, session, ttl, tableIn, tableOut, key, ts, data)
 			if doneRowsSnap%10000 == 0 {
 				doneKeysSnap := atomic.LoadUint64(&doneKeys)
 				completeness := completenessEstimate(token)
@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
 
 type testCase struct {
 	now    int
@@ -46,3 +52,93 @@ func TestCompleteness(t *testing.T) {
 	}
 
 }
+
+func TestGetTokenRanges(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 7, 1000} {
+		ranges := getTokenRanges(n)
+		if len(ranges) != n {
+			t.Fatalf("n=%d: expected %d ranges, got %d", n, n, len(ranges))
+		}
+		if ranges[0].start != minToken {
+			t.Errorf("n=%d: expected first range to start at %d, got %d", n, int64(minToken), ranges[0].start)
+		}
+		if ranges[n-1].end != maxToken {
+			t.Errorf("n=%d: expected last range to end at %d, got %d", n, int64(maxToken), ranges[n-1].end)
+		}
+		for i := 1; i < n; i++ {
+			if ranges[i].start != ranges[i-1].end+1 {
+				t.Errorf("n=%d: range %d starts at %d, but previous range ended at %d", n, i, ranges[i].start, ranges[i-1].end)
+			}
+		}
+	}
+}
+
+type etaCase struct {
+	completeness float64
+	elapsed      time.Duration
+	remaining    time.Duration
+	ok           bool
+}
+
+func TestETA(t *testing.T) {
+	cases := []etaCase{
+		{0, time.Minute, 0, false},
+		{0.25, time.Minute, 3 * time.Minute, true},
+		{0.5, time.Minute, time.Minute, true},
+		{1, time.Minute, 0, true},
+	}
+	for i, c := range cases {
+		remaining, ok := eta(c.completeness, c.elapsed)
+		if remaining != c.remaining || ok != c.ok {
+			t.Errorf("case %d: expected %s,%t got %s,%t", i, c.remaining, c.ok, remaining, ok)
+		}
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mt-update-ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+	if c, err := loadCheckpoint(path); c != nil || err != nil {
+		t.Fatalf("expected no checkpoint yet, got %v (err %v)", c, err)
+	}
+
+	p := newProgress(getTokenRanges(4))
+	run := p.checkpoint(checkpoint{TableIn: "metric_512", TableOut: "metric_1024", TTL: 3600, EndTs: 100})
+	p.finish(0)
+	p.set(2, p.ranges[2].start+10)
+	if err := p.checkpoint(run).save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.resumes(run); err != nil {
+		t.Fatalf("expected the checkpoint to resume the run, got %s", err)
+	}
+	other := run
+	other.TTL = 7200
+	if err := c.resumes(other); err == nil {
+		t.Fatalf("expected the checkpoint not to resume a run with another ttl")
+	}
+	if err := c.resumes(newProgress(getTokenRanges(5)).checkpoint(run)); err == nil {
+		t.Fatalf("expected the checkpoint not to resume a run with other token ranges")
+	}
+
+	resumed := newProgress(getTokenRanges(4))
+	resumed.resume(*c)
+	if !resumed.isDone(0) || resumed.isDone(1) || resumed.isDone(2) {
+		t.Fatalf("expected only range 0 to be done, got %v", resumed.done)
+	}
+	if resumed.current[1] != resumed.ranges[1].start || resumed.current[2] != resumed.ranges[2].start+10 {
+		t.Fatalf("expected to resume ranges from where they left off, got %v", resumed.current)
+	}
+	if resumed.initial < 0.25 || resumed.initial > 0.26 {
+		t.Fatalf("expected an initial completeness of 25%%, got %f", resumed.initial)
+	}
+}
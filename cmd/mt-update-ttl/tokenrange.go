@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+const minToken = math.MinInt64 // -9223372036854775808
+
+// tokenRange is a range of cassandra tokens, both ends inclusive
+type tokenRange struct {
+	start int64
+	end   int64
+}
+
+// getTokenRanges splits the full token ring in n contiguous ranges of (near) equal size
+func getTokenRanges(n int) []tokenRange {
+	ranges := make([]tokenRange, n)
+	// the ring spans 2^64 tokens, which doesn't fit in a uint64, but we compute the step
+	// based on 2^64-1 and let the last range absorb the remainder.
+	step := uint64(math.MaxUint64) / uint64(n)
+	var first int64 = minToken
+	for i := 0; i < n; i++ {
+		start := int64(uint64(first) + uint64(i)*step)
+		end := int64(uint64(start) + step - 1)
+		if i == n-1 {
+			end = maxToken
+		}
+		ranges[i] = tokenRange{start, end}
+	}
+	return ranges
+}
+
+// progress tracks how far along we are in each of the token ranges
+type progress struct {
+	ranges  []tokenRange
+	current []int64 // last token processed, per range
+	done    []int32 // per range, 1 if it was fully processed
+	started time.Time
+	initial float64 // completeness when we started, if we resumed a previous run
+}
+
+func newProgress(ranges []tokenRange) *progress {
+	p := &progress{
+		ranges:  ranges,
+		current: make([]int64, len(ranges)),
+		done:    make([]int32, len(ranges)),
+		started: time.Now(),
+	}
+	for i, r := range ranges {
+		p.current[i] = r.start
+	}
+	return p
+}
+
+func (p *progress) set(i int, token int64) {
+	atomic.StoreInt64(&p.current[i], token)
+}
+
+// finish marks the range as fully processed
+func (p *progress) finish(i int) {
+	atomic.StoreInt64(&p.current[i], p.ranges[i].end)
+	atomic.StoreInt32(&p.done[i], 1)
+}
+
+func (p *progress) isDone(i int) bool {
+	return atomic.LoadInt32(&p.done[i]) == 1
+}
+
+// resume continues from where the checkpoint left off. the checkpoint must be of the same ranges
+func (p *progress) resume(c checkpoint) {
+	for i, r := range c.Ranges {
+		p.current[i] = r.Next
+		if r.Done {
+			p.finish(i)
+		}
+	}
+	p.initial = p.completeness()
+}
+
+// checkpoint returns the checkpoint of the run, with the current progress
+func (p *progress) checkpoint(run checkpoint) checkpoint {
+	run.Ranges = make([]rangeCheckpoint, len(p.ranges))
+	for i, r := range p.ranges {
+		run.Ranges[i] = rangeCheckpoint{
+			Start: r.start,
+			End:   r.end,
+			Next:  atomic.LoadInt64(&p.current[i]),
+			Done:  p.isDone(i),
+		}
+	}
+	return run
+}
+
+// completeness returns the estimated completeness of the whole process as a number between 0 and 1
+func (p *progress) completeness() float64 {
+	var done float64
+	for i, r := range p.ranges {
+		cur := atomic.LoadInt64(&p.current[i])
+		done += (float64(cur) - float64(r.start)) / (float64(r.end) - float64(r.start))
+	}
+	return done / float64(len(p.ranges))
+}
+
+// eta returns the estimated remaining time, based on the completeness and the time elapsed so far
+// if we can't make an estimate yet, ok will be false
+func eta(completeness float64, elapsed time.Duration) (remaining time.Duration, ok bool) {
+	if completeness <= 0 {
+		return 0, false
+	}
+	return time.Duration(float64(elapsed) * (1 - completeness) / completeness), true
+}
+
+func (p *progress) report() {
+	elapsed := time.Since(p.started)
+	completeness := p.completeness()
+	doneKeysSnap := atomic.LoadUint64(&doneKeys)
+	doneRowsSnap := atomic.LoadUint64(&doneRows)
+	rate := float64(doneRowsSnap) / elapsed.Seconds()
+	// when we resumed, the time elapsed only covers the work done since
+	var remaining time.Duration
+	var ok bool
+	if p.initial < 1 {
+		remaining, ok = eta((completeness-p.initial)/(1-p.initial), elapsed)
+	}
+	etaStr := "unknown"
+	if ok {
+		etaStr = remaining.Truncate(time.Second).String()
+	}
+	log.Printf("PROGRESS: processed %d keys, %d rows in %s (%.1f rows/s). completeness estimate %.1f%%, ETA %s", doneKeysSnap, doneRowsSnap, elapsed.Truncate(time.Second), rate, completeness*100, etaStr)
+}
+
+// rangeWorker scans each of the token ranges it receives (identified by index into p.ranges),
+// from where a previous run left off, and processes all rows with startTime <= ts < endTime
+func rangeWorker(id int, jobs <-chan int, wg *sync.WaitGroup, session *gocql.Session, p *progress, startTime, endTime, ttl int, tableIn, tableOut string) {
+	defer wg.Done()
+	var token int64
+	var key, prevKey string
+	var ts int
+	var data []byte
+	queryTpl := fmt.Sprintf("SELECT token(key), key, ts, data FROM %s where token(key) >= ? AND token(key) <= ?", tableIn)
+
+	for i := range jobs {
+		r := p.ranges[i]
+		prevKey = ""
+		iter := session.Query(queryTpl, atomic.LoadInt64(&p.current[i]), r.end).Iter()
+		for iter.Scan(&token, &key, &ts, &data) {
+			if key != prevKey {
+				if prevKey != "" {
+					atomic.AddUint64(&doneKeys, 1)
+				}
+				prevKey = key
+				p.set(i, token)
+			}
+			if ts < startTime || ts >= endTime {
+				continue
+			}
+			processRow(id, session, ttl, tableIn, tableOut, key, ts, data)
+		}
+		if prevKey != "" {
+			atomic.AddUint64(&doneKeys, 1)
+		}
+		err := iter.Close()
+		if err != nil {
+			doneKeysSnap := atomic.LoadUint64(&doneKeys)
+			doneRowsSnap := atomic.LoadUint64(&doneRows)
+			fmt.Fprintf(os.Stderr, "ERROR: id=%d failed querying %s for token range %d - %d: %q. processed %d keys, %d rows", id, tableIn, r.start, r.end, err, doneKeysSnap, doneRowsSnap)
+			// a resumed run will retry the rest of the range
+			continue
+		}
+		p.finish(i)
+	}
+}
+
+func updateByTokenRanges(session *gocql.Session, ttl int, tableIn, tableOut string, numRanges int) {
+	p := newProgress(getTokenRanges(numRanges))
+
+	run := p.checkpoint(checkpoint{TableIn: tableIn, TableOut: tableOut, TTL: ttl, StartTs: *startTs, EndTs: *endTs})
+	if *checkpointFile != "" {
+		c, err := loadCheckpoint(*checkpointFile)
+		if err != nil {
+			log.Fatalf("ERROR: %s", err)
+		}
+		if c != nil {
+			if err := c.resumes(run); err != nil {
+				log.Fatalf("ERROR: can't resume from %s: %s", *checkpointFile, err)
+			}
+			p.resume(*c)
+			log.Printf("RESUMING: from checkpoint %s, completeness estimate %.1f%%", *checkpointFile, p.initial*100)
+		}
+	}
+	saveCheckpoint := func() {
+		if *checkpointFile == "" {
+			return
+		}
+		if err := p.checkpoint(run).save(*checkpointFile); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: failed saving checkpoint %s: %q", *checkpointFile, err)
+		}
+	}
+
+	jobs := make(chan int, numRanges)
+	for i := range p.ranges {
+		if !p.isDone(i) {
+			jobs <- i
+		}
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	wg.Add(*numThreads)
+	for i := 0; i < *numThreads; i++ {
+		go rangeWorker(i, jobs, &wg, session, p, *startTs, *endTs, ttl, tableIn, tableOut)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+
+	ticker := time.NewTicker(*progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.report()
+			saveCheckpoint()
+		case sig := <-sigs:
+			saveCheckpoint()
+			log.Printf("INTERRUPTED by %s.  Processed %d keys, %d rows in %s", sig, atomic.LoadUint64(&doneKeys), atomic.LoadUint64(&doneRows), time.Since(p.started).Truncate(time.Second))
+			os.Exit(1)
+		case <-done:
+			saveCheckpoint()
+			var failed int
+			for i := range p.ranges {
+				if !p.isDone(i) {
+					failed++
+				}
+			}
+			log.Printf("DONE.  Processed %d keys, %d rows in %s", doneKeys, doneRows, time.Since(p.started).Truncate(time.Second))
+			if failed > 0 {
+				log.Printf("ERROR: %d token ranges failed. run again with the same -checkpoint-file to retry them", failed)
+				os.Exit(2)
+			}
+			return
+		}
+	}
+}
+
+// newThrottle returns a channel that yields at most rate values per second.
+// if rate is 0, it returns nil, meaning no throttling.
+func newThrottle(rate int) <-chan struct{} {
+	if rate <= 0 {
+		return nil
+	}
+	c := make(chan struct{}, rate)
+	go func() {
+		// spread the tokens over the second in small batches rather than
+		// releasing all of them at once
+		perTick := float64(rate) / 100
+		var allowance float64
+		for range time.Tick(10 * time.Millisecond) {
+			allowance += perTick
+			for ; allowance >= 1; allowance-- {
+				select {
+				case c <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return c
+}
@@ -4,9 +4,12 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/store/cassandra"
 	"github.com/raintank/dur"
@@ -18,6 +21,10 @@ var (
 	spanStr     = flag.String("span", "", "see boundaries for chunks of this span")
 	now         = time.Now()
 	nowUnix     = now.Unix()
+
+	schemasFile      = flag.String("schemas-file", "", "path to storage-schemas.conf file. if set, shows and validates the boundaries of all its retentions")
+	aggregationsFile = flag.String("aggregations-file", "", "path to storage-aggregation.conf file. if set, shows the rollup series each aggregation creates")
+	windowFactor     = flag.Int("window-factor", 20, "size of compaction window relative to TTL")
 )
 
 func format(t time.Time) string {
@@ -44,6 +51,12 @@ func main() {
 		fmt.Println()
 		fmt.Println("Shows boundaries of rows in cassandra and of spans of specified size.")
 		fmt.Println("to see UTC times, just prefix command with TZ=UTC")
+		fmt.Println("given a schemas file, shows for each retention how its chunks and points line up with the cassandra rows,")
+		fmt.Println("which table it is stored in, and flags invalid combinations. exits with status 1 if any errors are found")
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-view-boundaries -span 2h")
+		fmt.Println("mt-view-boundaries -schemas-file /etc/metrictank/storage-schemas.conf -aggregations-file /etc/metrictank/storage-aggregation.conf")
 		fmt.Println()
 		flag.PrintDefaults()
 	}
@@ -65,4 +78,101 @@ func main() {
 		fmt.Println()
 		display(int64(span), "specified span")
 	}
+
+	if *aggregationsFile != "" {
+		aggs, err := conf.ReadAggregations(*aggregationsFile)
+		if err != nil {
+			log.Fatalf("can't read aggregations file %q: %s", *aggregationsFile, err)
+		}
+		fmt.Println()
+		displayAggregations(aggs)
+	}
+
+	if *schemasFile != "" {
+		schemas, err := conf.ReadSchemas(*schemasFile)
+		if err != nil {
+			log.Fatalf("can't read schemas file %q: %s", *schemasFile, err)
+		}
+		list, def := schemas.List()
+		list = append(list, def)
+		for _, s := range list {
+			fmt.Println()
+			displaySchema(s)
+		}
+
+		findings := cassandra.ValidateSchemas(list, *windowFactor)
+		fmt.Println()
+		if len(findings) == 0 {
+			fmt.Println("no problems found")
+			return
+		}
+		var errors int
+		for _, f := range findings {
+			fmt.Println(f)
+			if f.Error {
+				errors++
+			}
+		}
+		if errors > 0 {
+			os.Exit(1)
+		}
+	}
+}
+
+// displaySchema shows, for each retention, the chunk boundaries around now and how they relate to the cassandra rows
+func displaySchema(s conf.Schema) {
+	fmt.Printf("# schema %s (pattern %s)\n", s.Name, s.Pattern)
+	fmt.Println()
+	fmt.Printf("%10s %10s %10s %12s %10s %15s %20s %20s\n", "interval", "ttl", "chunkspan", "chunks/row", "row-align", "tablename", "prev chunk", "next chunk")
+	for _, ret := range s.Retentions {
+		table := cassandra.GetTTLTable(uint32(ret.MaxRetention()), *windowFactor, cassandra.Table_name_format)
+		chunksPerRow := "-"
+		aligned := "-"
+		prev, next := "-", "-"
+		if ret.ChunkSpan > 0 {
+			chunksPerRow = fmt.Sprintf("%.2f", float64(cassandra.Month_sec)/float64(ret.ChunkSpan))
+			aligned = fmt.Sprintf("%t", cassandra.Month_sec%ret.ChunkSpan == 0)
+			span := int64(ret.ChunkSpan)
+			prev = fmt.Sprintf("%d", nowUnix-(nowUnix%span))
+			next = fmt.Sprintf("%d", nowUnix-(nowUnix%span)+span)
+		}
+		fmt.Printf("%10d %10d %10d %12s %10s %15s %20s %20s\n", ret.SecondsPerPoint, ret.MaxRetention(), ret.ChunkSpan, chunksPerRow, aligned, table.Table, prev, next)
+	}
+}
+
+// displayAggregations shows the rollup series each aggregation creates for every rollup retention
+func displayAggregations(aggs conf.Aggregations) {
+	fmt.Println("aggregations:")
+	fmt.Println()
+	all := append([]conf.Aggregation{}, aggs.Data...)
+	for _, a := range append(all, aggs.DefaultAggregation) {
+		var series []string
+		for _, m := range a.AggregationMethod {
+			switch m {
+			case conf.Avg:
+				series = append(series, "sum", "cnt")
+			case conf.Lst:
+				series = append(series, "lst")
+			case conf.Max:
+				series = append(series, "max")
+			case conf.Min:
+				series = append(series, "min")
+			case conf.Sum:
+				series = append(series, "sum")
+			}
+		}
+		fmt.Printf("%-20s pattern %-30s xFilesFactor %.2f rollup series per retention: %s\n", a.Name, a.Pattern, a.XFilesFactor, strings.Join(dedup(series), ","))
+	}
+}
+
+func dedup(in []string) []string {
+	seen := make(map[string]struct{})
+	var out []string
+	for _, s := range in {
+		if _, ok := seen[s]; !ok {
+			seen[s] = struct{}{}
+			out = append(out, s)
+		}
+	}
+	return out
 }
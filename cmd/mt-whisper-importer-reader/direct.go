@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/chunk/archive"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// directWriter writes metrics straight to the store and index, like mt-whisper-importer-writer
+// does with the metrics that get posted to it, but without the round trip over http.
+type directWriter struct {
+	session       *gocql.Session
+	ttlTables     cassandraStore.TTLTables
+	partitioner   partitioner.Partitioner
+	numPartitions int32
+	index         idx.MetricIndex
+	overwrite     bool
+}
+
+func newDirectWriter(session *gocql.Session, ttls []uint32, windowFactor int, p partitioner.Partitioner, numPartitions int, index idx.MetricIndex, overwrite bool) *directWriter {
+	return &directWriter{
+		session:       session,
+		ttlTables:     cassandraStore.GetTTLTables(ttls, windowFactor, cassandraStore.Table_name_format),
+		partitioner:   p,
+		numPartitions: int32(numPartitions),
+		index:         index,
+		overwrite:     overwrite,
+	}
+}
+
+// write adds the metric to the index, and saves the chunks of all its archives
+func (w *directWriter) write(met archive.Metric) error {
+	if len(met.Archives) == 0 {
+		return fmt.Errorf("metric %s has no archives", met.MetricData.Name)
+	}
+	mkey, err := schema.MKeyFromString(met.MetricData.Id)
+	if err != nil {
+		return fmt.Errorf("invalid MetricData.Id: %s", err)
+	}
+	partition, err := w.partitioner.Partition(&met.MetricData, w.numPartitions)
+	if err != nil {
+		return fmt.Errorf("error partitioning: %s", err)
+	}
+
+	// look up all tables before we write anything, so we don't leave a metric half-imported
+	tables := make([]string, len(met.Archives))
+	for i, a := range met.Archives {
+		entry, ok := w.ttlTables[a.SecondsPerPoint*a.Points]
+		if !ok {
+			return fmt.Errorf("no table found for ttl %d of archive %d", a.SecondsPerPoint*a.Points, i)
+		}
+		tables[i] = entry.Table
+	}
+
+	w.index.AddOrUpdate(mkey, &met.MetricData, partition)
+	for i, a := range met.Archives {
+		ttl := a.SecondsPerPoint * a.Points
+		log.Debugf("inserting %d chunks of archive %d into table %s with ttl %d and key %s", len(a.Chunks), i, tables[i], ttl, a.RowKey)
+		w.insertChunks(tables[i], a.RowKey, mkey.Org, ttl, a.Chunks)
+	}
+	return nil
+}
+
+func (w *directWriter) insertChunks(table, id string, orgId, ttl uint32, itergens []chunk.IterGen) {
+	var query string
+	if w.overwrite {
+		query = fmt.Sprintf("INSERT INTO %s (key, ts, data) values (?,?,?) USING TTL %d", table, ttl)
+	} else {
+		query = fmt.Sprintf("INSERT INTO %s (key, ts, data) values (?,?,?) IF NOT EXISTS USING TTL %d", table, ttl)
+	}
+	for _, ig := range itergens {
+		rowKey := fmt.Sprintf("%s_%d", id, ig.Ts/cassandraStore.Month_sec)
+		data, err := cassandraStore.PrepareChunkData(orgId, ig.Span, ig.Encoding, chunk.CodecNone, ig.Bytes())
+		if err != nil {
+			// we don't encrypt, so this can't happen
+			panic(fmt.Sprintf("could not prepare chunk %s:%d: %s", id, ig.Ts, err))
+		}
+		attempts := 0
+		for {
+			err := w.session.Query(query, rowKey, ig.Ts, data).Exec()
+			if err == nil {
+				break
+			}
+			if (attempts % 20) == 0 {
+				log.Warnf("failed to save chunk %s:%d to cassandra after %d attempts. %s", id, ig.Ts, attempts+1, err)
+			}
+			sleepTime := 100 * attempts
+			if sleepTime > 2000 {
+				sleepTime = 2000
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+			attempts++
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/mdata/chunk/archive"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestDirectWriterRejectsUnknownTTL(t *testing.T) {
+	p, err := partitioner.NewKafka("bySeries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// session and index are nil: the metric must be rejected before we touch them
+	w := newDirectWriter(nil, []uint32{3600}, 20, p, 1, nil, true)
+
+	md := schema.MetricData{Name: "a.b", Interval: 10, Mtype: "gauge", OrgId: 1}
+	md.SetId()
+	cases := []struct {
+		name     string
+		archives []archive.Archive
+	}{
+		{"no archives", nil},
+		{"unknown ttl", []archive.Archive{
+			{SecondsPerPoint: 10, Points: 360},
+			{SecondsPerPoint: 60, Points: 1440},
+		}},
+	}
+	for _, c := range cases {
+		err := w.write(archive.Metric{MetricData: md, Archives: c.archives})
+		if err == nil {
+			t.Fatalf("%s: expected an error", c.name)
+		}
+	}
+}
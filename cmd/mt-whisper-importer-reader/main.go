@@ -19,9 +19,13 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/cluster/partitioner"
 	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx/cassandra"
 	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/mdata/chunk/archive"
+	cassandraStore "github.com/grafana/metrictank/store/cassandra"
 	"github.com/kisielk/whisper-go/whisper"
 	"gopkg.in/raintank/schema.v1"
 )
@@ -97,15 +101,98 @@ var (
 		false,
 		"More detailed logging",
 	)
+	partitionScheme = flag.String(
+		"partition-scheme",
+		"bySeries",
+		"method used for partitioning metrics, when writing directly to the store. This should match the settings of tsdb-gw. (byOrg|bySeries)",
+	)
+	numPartitions = flag.Int(
+		"num-partitions",
+		1,
+		"Number of Partitions, when writing directly to the store",
+	)
+	overwriteChunks = flag.Bool(
+		"overwrite-chunks",
+		true,
+		"If true existing chunks may be overwritten, when writing directly to the store",
+	)
 	schemas        conf.Schemas
 	nameFilter     *regexp.Regexp
 	processedCount uint32
 	skippedCount   uint32
+
+	gitHash = "(none)"
 )
 
 func main() {
+	storeConfig := cassandraStore.NewStoreConfig()
+	// we don't use the cassandraStore's writeQueue, so we hard code this to 0.
+	storeConfig.WriteQueueSize = 0
+
+	// flags from cassandra/config.go, Cassandra. only used when writing directly to the store
+	flag.StringVar(&storeConfig.Addrs, "cassandra-addrs", storeConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
+	flag.StringVar(&storeConfig.Keyspace, "cassandra-keyspace", storeConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
+	flag.StringVar(&storeConfig.Consistency, "cassandra-consistency", storeConfig.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	flag.StringVar(&storeConfig.HostSelectionPolicy, "cassandra-host-selection-policy", storeConfig.HostSelectionPolicy, "")
+	flag.IntVar(&storeConfig.Timeout, "cassandra-timeout", storeConfig.Timeout, "cassandra timeout in milliseconds")
+	flag.IntVar(&storeConfig.WriteConcurrency, "cassandra-write-concurrency", storeConfig.WriteConcurrency, "max number of concurrent writes to cassandra.")
+	flag.IntVar(&storeConfig.Retries, "cassandra-retries", storeConfig.Retries, "how many times to retry a query before failing it")
+	flag.IntVar(&storeConfig.WindowFactor, "cassandra-window-factor", storeConfig.WindowFactor, "size of compaction window relative to TTL")
+	flag.IntVar(&storeConfig.CqlProtocolVersion, "cql-protocol-version", storeConfig.CqlProtocolVersion, "cql protocol version to use")
+	flag.BoolVar(&storeConfig.CreateKeyspace, "cassandra-create-keyspace", storeConfig.CreateKeyspace, "enable the creation of the mdata keyspace and tables, only one node needs this")
+	flag.BoolVar(&storeConfig.DisableInitialHostLookup, "cassandra-disable-initial-host-lookup", storeConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
+	flag.BoolVar(&storeConfig.SSL, "cassandra-ssl", storeConfig.SSL, "enable SSL connection to cassandra")
+	flag.StringVar(&storeConfig.CaPath, "cassandra-ca-path", storeConfig.CaPath, "cassandra CA certificate path when using SSL")
+	flag.BoolVar(&storeConfig.HostVerification, "cassandra-host-verification", storeConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
+	flag.BoolVar(&storeConfig.Auth, "cassandra-auth", storeConfig.Auth, "enable cassandra authentication")
+	flag.StringVar(&storeConfig.Username, "cassandra-username", storeConfig.Username, "username for authentication")
+	flag.StringVar(&storeConfig.Password, "cassandra-password", storeConfig.Password, "password for authentication")
+	flag.StringVar(&storeConfig.SchemaFile, "cassandra-schema-file", storeConfig.SchemaFile, "File containing the needed schemas in case database needs initializing")
+
+	cassFlags := cassandra.ConfigSetup()
+
+	flag.Usage = func() {
+		fmt.Println("mt-whisper-importer-reader")
+		fmt.Println()
+		fmt.Println("Reads whisper files, converts them to the retentions of the destination schemas, and sends the chunks to")
+		fmt.Println("mt-whisper-importer-writer. When given an index type, it writes the chunks and index entries directly to the")
+		fmt.Println("store and index instead, which is much faster for bulk migrations.")
+		fmt.Println()
+		fmt.Printf("Usage:\n\n")
+		fmt.Printf("  mt-whisper-importer-reader [global config flags] [<idxtype> [idx config flags]] \n\n")
+		fmt.Printf("global config flags:\n\n")
+		flag.PrintDefaults()
+		fmt.Println()
+		fmt.Printf("idxtype: only 'cass' supported for now\n\n")
+		fmt.Printf("cass config flags:\n\n")
+		cassFlags.PrintDefaults()
+		fmt.Println()
+		fmt.Println("EXAMPLES:")
+		fmt.Println("mt-whisper-importer-reader -dst-schemas=storage-schemas.conf -http-endpoint=http://192.168.0.1:8080/chunks -threads=20")
+		fmt.Println("mt-whisper-importer-reader -dst-schemas=storage-schemas.conf -cassandra-addrs=192.168.0.1 -cassandra-keyspace=metrictank -num-partitions=8 -threads=20 cass -hosts=192.168.0.1:9042")
+		fmt.Println()
+		fmt.Println("Notes:")
+		fmt.Println(" * when writing directly, -cassandra-keyspace, -cassandra-window-factor and -dst-schemas must match the config of your")
+		fmt.Println("   metrictank cluster, so that the chunks end up in the tables that metrictank reads from")
+		fmt.Println(" * running metrictank instances will only see newly added series after they reload their index (e.g. on restart)")
+	}
+
+	var cassI int
+	for i, v := range os.Args {
+		if v == "cass" {
+			cassI = i
+			break
+		}
+	}
+	if cassI == 0 {
+		flag.Parse()
+	} else {
+		flag.CommandLine.Parse(os.Args[1:cassI])
+		cassFlags.Parse(os.Args[cassI+1:])
+		cassandra.Enabled = true
+	}
+
 	var err error
-	flag.Parse()
 	if *verbose {
 		log.SetLevel(log.DebugLevel)
 	} else {
@@ -127,19 +214,47 @@ func main() {
 		defer pos.Close()
 	}
 
+	var direct *directWriter
+	if cassI != 0 {
+		direct = newDirectStoreWriter(storeConfig)
+		defer direct.index.Stop()
+	}
+
 	fileChan := make(chan string)
 
 	wg := &sync.WaitGroup{}
 	wg.Add(*threads)
 	for i := 0; i < *threads; i++ {
-		go processFromChan(pos, fileChan, wg)
+		go processFromChan(pos, direct, fileChan, wg)
 	}
 
 	getFileListIntoChan(pos, fileChan)
 	wg.Wait()
 }
 
-func processFromChan(pos *posTracker, files chan string, wg *sync.WaitGroup) {
+// newDirectStoreWriter sets up the store, index and partitioner to write directly to, or exits if it can't
+func newDirectStoreWriter(storeConfig *cassandraStore.StoreConfig) *directWriter {
+	ttls := schemas.TTLs()
+	store, err := cassandraStore.NewCassandraStore(storeConfig, ttls)
+	if err != nil {
+		log.Fatalf("Failed to initialize cassandra: %s", err)
+	}
+	p, err := partitioner.NewKafka(*partitionScheme)
+	if err != nil {
+		log.Fatalf("Failed to instantiate partitioner: %s", err)
+	}
+
+	cluster.Init("mt-whisper-importer-reader", gitHash, time.Now(), "http", int(80))
+
+	index := cassandra.New()
+	err = index.Init()
+	if err != nil {
+		log.Fatalf("Failed to initialize cassandra index: %s", err)
+	}
+	return newDirectWriter(store.Session, ttls, storeConfig.WindowFactor, p, *numPartitions, index, *overwriteChunks)
+}
+
+func processFromChan(pos *posTracker, direct *directWriter, files chan string, wg *sync.WaitGroup) {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: *insecureSSL},
 	}
@@ -165,46 +280,14 @@ func processFromChan(pos *posTracker, files chan string, wg *sync.WaitGroup) {
 			continue
 		}
 
-		success := false
-		attempts := 0
-		for !success {
-			b, err := met.MarshalCompressed()
+		if direct != nil {
+			err = direct.write(met)
 			if err != nil {
-				log.Errorf("Failed to encode metric: %q", err)
+				log.Errorf("Failed to write metric %s: %s", name, err)
 				continue
 			}
-			size := b.Len()
-
-			req, err := http.NewRequest("POST", *httpEndpoint, io.Reader(b))
-			if err != nil {
-				log.Fatal(fmt.Sprintf("Cannot construct request to http endpoint %q: %q", *httpEndpoint, err))
-			}
-
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Content-Encoding", "gzip")
-
-			if len(*httpAuth) > 0 {
-				req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(*httpAuth)))
-			}
-
-			pre := time.Now()
-			resp, err := client.Do(req)
-			passed := time.Now().Sub(pre).Seconds()
-			if err != nil || resp.StatusCode >= 300 {
-				if err != nil {
-					log.Warningf("Error posting %s (%d bytes), to endpoint %q (attempt %d/%fs, retrying): %s", name, size, *httpEndpoint, attempts, passed, err)
-					attempts++
-					continue
-				} else {
-					log.Warningf("Error posting %s (%d bytes) to endpoint %q status %d (attempt %d/%fs, retrying)", name, size, *httpEndpoint, resp.StatusCode, attempts, passed)
-				}
-				attempts++
-			} else {
-				log.Debugf("Posted %s (%d bytes) to endpoint %q in %f seconds", name, size, *httpEndpoint, passed)
-				success = true
-			}
-			io.Copy(ioutil.Discard, resp.Body)
-			resp.Body.Close()
+		} else {
+			postMetric(client, met, name)
 		}
 
 		if pos != nil {
@@ -219,6 +302,51 @@ func processFromChan(pos *posTracker, files chan string, wg *sync.WaitGroup) {
 	wg.Done()
 }
 
+// postMetric posts the metric to the http endpoint, and retries until it succeeds
+func postMetric(client *http.Client, met archive.Metric, name string) {
+	success := false
+	attempts := 0
+	for !success {
+		b, err := met.MarshalCompressed()
+		if err != nil {
+			log.Errorf("Failed to encode metric: %q", err)
+			continue
+		}
+		size := b.Len()
+
+		req, err := http.NewRequest("POST", *httpEndpoint, io.Reader(b))
+		if err != nil {
+			log.Fatal(fmt.Sprintf("Cannot construct request to http endpoint %q: %q", *httpEndpoint, err))
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+
+		if len(*httpAuth) > 0 {
+			req.Header.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(*httpAuth)))
+		}
+
+		pre := time.Now()
+		resp, err := client.Do(req)
+		passed := time.Now().Sub(pre).Seconds()
+		if err != nil || resp.StatusCode >= 300 {
+			if err != nil {
+				log.Warningf("Error posting %s (%d bytes), to endpoint %q (attempt %d/%fs, retrying): %s", name, size, *httpEndpoint, attempts, passed, err)
+				attempts++
+				continue
+			} else {
+				log.Warningf("Error posting %s (%d bytes) to endpoint %q status %d (attempt %d/%fs, retrying)", name, size, *httpEndpoint, resp.StatusCode, attempts, passed)
+			}
+			attempts++
+		} else {
+			log.Debugf("Posted %s (%d bytes) to endpoint %q in %f seconds", name, size, *httpEndpoint, passed)
+			success = true
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+}
+
 // generate the metric name based on the file name and given prefix
 func getMetricName(file string) string {
 	// remove all leading '/' from file name
@@ -255,11 +255,11 @@ func (s *Server) chunksHandler(w http.ResponseWriter, req *http.Request) {
 			"inserting %d chunks of archive %d with ttl %d into table %s with ttl %d and key %s",
 			len(a.Chunks), archiveIdx, archiveTTL, tableName, tableTTL, a.RowKey,
 		)
-		s.insertChunks(tableName, a.RowKey, tableTTL, a.Chunks)
+		s.insertChunks(tableName, a.RowKey, mkey.Org, tableTTL, a.Chunks)
 	}
 }
 
-func (s *Server) insertChunks(table, id string, ttl uint32, itergens []chunk.IterGen) {
+func (s *Server) insertChunks(table, id string, orgId, ttl uint32, itergens []chunk.IterGen) {
 	var query string
 	if *overwriteChunks {
 		query = fmt.Sprintf("INSERT INTO %s (key, ts, data) values (?,?,?) USING TTL %d", table, ttl)
@@ -272,7 +272,10 @@ func (s *Server) insertChunks(table, id string, ttl uint32, itergens []chunk.Ite
 		success := false
 		attempts := 0
 		for !success {
-			err := s.Session.Query(query, rowKey, ig.Ts, cassandraStore.PrepareChunkData(ig.Span, ig.Bytes())).Exec()
+			data, err := cassandraStore.PrepareChunkData(orgId, ig.Span, ig.Encoding, chunk.CodecNone, ig.Bytes())
+			if err == nil {
+				err = s.Session.Query(query, rowKey, ig.Ts, data).Exec()
+			}
 			if err != nil {
 				if (attempts % 20) == 0 {
 					log.Warnf("CS: failed to save chunk to cassandra after %d attempts. %s", attempts+1, err)
@@ -0,0 +1,378 @@
+// Package compact rewrites short chunks in the store into chunks of the current chunkspan.
+// when the chunkspan of a retention is increased, the data that was saved before is still in chunks of the old span,
+// so reading it takes more, smaller chunks. a compaction job reads the stored chunks of each series, and replaces
+// the chunks that share the window of a chunk of the current span by one chunk with all of their points.
+package compact
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/health"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric compaction.chunks.written is how many chunks were written by compactions
+	chunksWritten = stats.NewCounter32("compaction.chunks.written")
+	// metric compaction.chunks.replaced is how many short chunks were replaced by the written chunks
+	chunksReplaced = stats.NewCounter32("compaction.chunks.replaced")
+	// metric compaction.errors is how many series could not be compacted, because reading from or writing to the store failed
+	compactErrors = stats.NewCounter32("compaction.errors")
+	// metric compaction.series.remaining is how many series the running compaction still has to do
+	seriesRemaining = stats.NewGauge32("compaction.series.remaining")
+
+	ErrRunning      = errors.New("a compaction is already running")
+	ErrNotPrimary   = errors.New("only primaries write to the store")
+	ErrNotSupported = errors.New("the store does not support replacing chunks")
+)
+
+// Status describes the progress of a compaction job
+type Status struct {
+	Until   uint32    `json:"until"`
+	Running bool      `json:"running"`
+	Stopped bool      `json:"stopped"` // stopped before it was done
+	Started time.Time `json:"started"`
+	// zero while running
+	Finished time.Time `json:"finished"`
+	Series   int       `json:"series"`
+	Done     int64     `json:"done"`
+	Written  int64     `json:"written"`
+	Replaced int64     `json:"replaced"`
+	Errors   int64     `json:"errors"`
+	// estimated seconds until done. 0 when done, -1 when unknown
+	ETA int `json:"eta"`
+}
+
+// Compactor runs one compaction job at a time, for the series in the index
+type Compactor struct {
+	index idx.MetricIndex
+	store mdata.Store
+
+	sync.Mutex
+	job *job
+}
+
+func New(index idx.MetricIndex, store mdata.Store) *Compactor {
+	return &Compactor{
+		index: index,
+		store: store,
+	}
+}
+
+type target struct {
+	key      schema.MKey
+	schemaId uint16
+	aggId    uint16
+}
+
+type job struct {
+	until  uint32
+	series []target
+	stop   chan struct{}
+
+	// read and written atomically
+	started  int64
+	finished int64
+	stopped  int32
+	done     int64
+	written  int64
+	replaced int64
+	errors   int64
+}
+
+// Start starts compacting the chunks of all series in the index.
+// only chunks that end before until are written.
+func (c *Compactor) Start(until uint32) (Status, error) {
+	replacer, ok := c.store.(mdata.ChunkReplacer)
+	if !ok {
+		return Status{}, ErrNotSupported
+	}
+	if !cluster.Manager.IsPrimary() {
+		return Status{}, ErrNotPrimary
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.job != nil && atomic.LoadInt64(&c.job.finished) == 0 {
+		return Status{}, ErrRunning
+	}
+	j := &job{
+		until:   until,
+		stop:    make(chan struct{}),
+		started: time.Now().Unix(),
+	}
+	c.index.Count(func(a idx.Archive) bool {
+		j.series = append(j.series, target{a.Id, a.SchemaId, a.AggId})
+		return false
+	})
+	if len(j.series) == 0 {
+		return Status{}, errors.New("there are no series to compact")
+	}
+	c.job = j
+	log.Info("compact: compacting the chunks of %d series, until %d", len(j.series), until)
+	go j.run(c.store, replacer, maxSeriesPerSec)
+	return j.status(time.Now()), nil
+}
+
+// Stop stops the running job, if any. it returns whether there was one
+func (c *Compactor) Stop() bool {
+	c.Lock()
+	defer c.Unlock()
+	if c.job == nil || atomic.LoadInt64(&c.job.finished) != 0 || !atomic.CompareAndSwapInt32(&c.job.stopped, 0, 1) {
+		return false
+	}
+	close(c.job.stop)
+	return true
+}
+
+// Status returns the status of the running or last job, and whether there is one
+func (c *Compactor) Status() (Status, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.job == nil {
+		return Status{}, false
+	}
+	return c.job.status(time.Now()), true
+}
+
+func (j *job) status(now time.Time) Status {
+	started := time.Unix(atomic.LoadInt64(&j.started), 0)
+	s := Status{
+		Until:    j.until,
+		Stopped:  atomic.LoadInt32(&j.stopped) == 1,
+		Started:  started,
+		Series:   len(j.series),
+		Done:     atomic.LoadInt64(&j.done),
+		Written:  atomic.LoadInt64(&j.written),
+		Replaced: atomic.LoadInt64(&j.replaced),
+		Errors:   atomic.LoadInt64(&j.errors),
+	}
+	if finished := atomic.LoadInt64(&j.finished); finished != 0 {
+		s.Finished = time.Unix(finished, 0)
+		return s
+	}
+	s.Running = true
+	s.ETA = health.ETA(int64(s.Series)-s.Done, health.Rate(s.Done, started, now))
+	return s
+}
+
+// run compacts the series, at most maxPerSec per second. 0 for no limit
+func (j *job) run(store mdata.Store, replacer mdata.ChunkReplacer, maxPerSec int) {
+	var tick <-chan time.Time
+	if maxPerSec > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(maxPerSec))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	seriesRemaining.Set(len(j.series))
+	defer func() {
+		atomic.StoreInt64(&j.finished, time.Now().Unix())
+		seriesRemaining.Set(0)
+		log.Info("compact: done compacting chunks. %d of %d series, %d chunks written, %d replaced, %d errors",
+			atomic.LoadInt64(&j.done), len(j.series), atomic.LoadInt64(&j.written), atomic.LoadInt64(&j.replaced), atomic.LoadInt64(&j.errors))
+	}()
+	for i, t := range j.series {
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-j.stop:
+				return
+			}
+		}
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+		written, replaced, err := j.compact(store, replacer, t, uint32(time.Now().Unix()))
+		atomic.AddInt64(&j.written, int64(written))
+		atomic.AddInt64(&j.replaced, int64(replaced))
+		chunksWritten.Add(written)
+		chunksReplaced.Add(replaced)
+		if err != nil {
+			atomic.AddInt64(&j.errors, 1)
+			compactErrors.Inc()
+			log.Warn("compact: could not compact the chunks of %s: %s", t.key, err)
+		}
+		atomic.AddInt64(&j.done, 1)
+		seriesRemaining.Set(len(j.series) - i - 1)
+	}
+}
+
+// compact compacts the chunks of the raw data and of all rollups of the series.
+// it returns how many chunks were written, and how many they replaced
+func (j *job) compact(store mdata.Store, replacer mdata.ChunkReplacer, t target, now uint32) (int, int, error) {
+	var written, replaced int
+	for i, ret := range mdata.GetSchema(t.schemaId).Retentions {
+		keys := []schema.AMKey{{MKey: t.key}}
+		if i > 0 {
+			keys = keys[:0]
+			for _, method := range mdata.RollupMethods(mdata.GetAgg(t.aggId)) {
+				keys = append(keys, schema.AMKey{MKey: t.key, Archive: schema.NewArchive(method, uint32(ret.SecondsPerPoint))})
+			}
+		}
+		for _, key := range keys {
+			w, r, err := j.compactArchive(store, replacer, key, ret, now)
+			written += w
+			replaced += r
+			if err != nil {
+				return written, replaced, err
+			}
+		}
+	}
+	return written, replaced, nil
+}
+
+// compactArchive rewrites the stored chunks of the archive into chunks of the chunkspan of its retention.
+//
+// the points of the stored chunks are grouped by the window of the chunk of the current span they belong in.
+// windows with points from more than one stored chunk are rewritten. so are the windows that share a stored chunk
+// with a window that is rewritten, because that chunk is deleted. windows that end after until are never written,
+// so neither are those that share a stored chunk with them.
+func (j *job) compactArchive(store mdata.Store, replacer mdata.ChunkReplacer, key schema.AMKey, ret conf.Retention, now uint32) (int, int, error) {
+	span := ret.ChunkSpan
+	ttl := uint32(ret.MaxRetention())
+	var from uint32
+	if now > ttl {
+		from = now - ttl
+	}
+	to := j.until - j.until%span
+	if from >= to {
+		return 0, 0, nil
+	}
+
+	ctx := context.Background()
+	itgens, err := store.Search(ctx, key, ttl, from, to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(itgens) < 2 {
+		return 0, 0, nil
+	}
+
+	// the points of each window, and which stored chunks they came from
+	type window struct {
+		points  []schema.Point
+		sources []int
+	}
+	windows := make(map[uint32]*window)
+	windowsOf := make([][]uint32, len(itgens))
+	for i, itgen := range itgens {
+		iter, err := itgen.Get()
+		if err != nil {
+			return 0, 0, fmt.Errorf("decoding chunk %d of %s: %s", itgen.Ts, key, err)
+		}
+		for iter.Next() {
+			ts, val := iter.Values()
+			t0 := ts - ts%span
+			w, ok := windows[t0]
+			if !ok {
+				w = &window{}
+				windows[t0] = w
+			}
+			if len(w.sources) == 0 || w.sources[len(w.sources)-1] != i {
+				w.sources = append(w.sources, i)
+				windowsOf[i] = append(windowsOf[i], t0)
+			}
+			w.points = append(w.points, schema.Point{Val: val, Ts: ts})
+		}
+	}
+
+	// windows that are linked through the stored chunks they share must be rewritten together
+	var written, replaced int
+	seen := make(map[uint32]bool)
+	t0s := make([]uint32, 0, len(windows))
+	for t0 := range windows {
+		t0s = append(t0s, t0)
+	}
+	sort.Sort(uint32s(t0s))
+	for _, start := range t0s {
+		if seen[start] {
+			continue
+		}
+		group := []uint32{start}
+		sources := make(map[int]bool)
+		seen[start] = true
+		for k := 0; k < len(group); k++ {
+			for _, i := range windows[group[k]].sources {
+				if sources[i] {
+					continue
+				}
+				sources[i] = true
+				for _, t0 := range windowsOf[i] {
+					if !seen[t0] {
+						seen[t0] = true
+						group = append(group, t0)
+					}
+				}
+			}
+		}
+		short := false
+		late := false
+		for _, t0 := range group {
+			short = short || len(windows[t0].sources) > 1
+			late = late || t0+span > to
+		}
+		if !short || late {
+			continue
+		}
+
+		sort.Sort(uint32s(group))
+		cwrs := make([]*mdata.ChunkWriteRequest, 0, len(group))
+		for _, t0 := range group {
+			c, err := newChunk(t0, ret.Encoding, windows[t0].points)
+			if err != nil {
+				return written, replaced, fmt.Errorf("writing chunk %d of %s: %s", t0, key, err)
+			}
+			cwr := mdata.NewChunkWriteRequest(nil, key, c, ttl, span, time.Now())
+			cwr.Codec = ret.Codec
+			cwrs = append(cwrs, &cwr)
+		}
+		old := make([]uint32, 0, len(sources))
+		for i := range sources {
+			old = append(old, itgens[i].Ts)
+		}
+		sort.Sort(uint32s(old))
+		if err := replacer.ReplaceChunks(ctx, cwrs, old); err != nil {
+			return written, replaced, err
+		}
+		written += len(cwrs)
+		replaced += len(old)
+	}
+	return written, replaced, nil
+}
+
+// newChunk returns a finished chunk with the points, which are sorted by timestamp.
+// of points with the same timestamp, only the last one is kept, which is the one of the latest stored chunk.
+func newChunk(t0 uint32, encoding chunk.Encoding, points []schema.Point) (*chunk.Chunk, error) {
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Ts < points[j].Ts })
+	c := chunk.NewWithEncoding(t0, encoding)
+	for i, p := range points {
+		if i+1 < len(points) && points[i+1].Ts == p.Ts {
+			continue
+		}
+		if err := c.Push(p.Ts, p.Val); err != nil {
+			return nil, err
+		}
+	}
+	c.Finish()
+	return c, nil
+}
+
+type uint32s []uint32
+
+func (u uint32s) Len() int           { return len(u) }
+func (u uint32s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint32s) Less(i, j int) bool { return u[i] < u[j] }
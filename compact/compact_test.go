@@ -0,0 +1,120 @@
+package compact
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// addChunks adds chunks of the given span to the store, from start until end, with a point every 10 seconds
+func addChunks(t *testing.T, store *mdata.MockStore, key schema.AMKey, span, start, end uint32) {
+	for t0 := start; t0 < end; t0 += span {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+span; ts += 10 {
+			if err := c.Push(ts, float64(ts%70)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, key, c, 86400, span, time.Now())
+		store.Add(&cwr)
+	}
+}
+
+func chunkStarts(t *testing.T, store *mdata.MockStore, key schema.AMKey) []uint32 {
+	itgens, err := store.Search(context.Background(), key, 86400, 0, 20000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var t0s []uint32
+	for _, itgen := range itgens {
+		t0s = append(t0s, itgen.Ts)
+	}
+	return t0s
+}
+
+func TestCompactArchive(t *testing.T) {
+	// the chunkspan used to be shorter
+	ret := conf.NewRetentionMT(10, 86400, 1800, 2, true)
+	key := test.GetAMKey(1)
+	now := uint32(20000)
+
+	cases := []struct {
+		name     string
+		oldSpan  uint32
+		until    uint32
+		written  int
+		replaced int
+		t0s      []uint32
+	}{
+		// 3 chunks per window of the current span
+		{"aligned", 600, 9000, 2, 6, []uint32{3600, 5400, 7200}},
+		// the chunk at 4800 straddles the windows at 3600 and 5400, so both are rewritten together
+		{"straddling", 1200, 9000, 2, 3, []uint32{3600, 5400, 7200}},
+		// the window at 5400 ends after until, so it's left alone
+		{"until", 600, 7000, 1, 3, []uint32{3600, 5400, 6000, 6600, 7200}},
+	}
+	for _, tc := range cases {
+		store := mdata.NewMockStore()
+		addChunks(t, store, key, tc.oldSpan, 3600, 7200)
+		// the chunk of the current span
+		addChunks(t, store, key, 1800, 7200, 9000)
+		before, err := mdata.ReadPoints(context.Background(), store, key, 86400, 0, 20000)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		j := &job{until: tc.until}
+		written, replaced, err := j.compactArchive(store, store, key, ret, now)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		if written != tc.written || replaced != tc.replaced {
+			t.Fatalf("%s: expected %d chunks written and %d replaced, got %d and %d", tc.name, tc.written, tc.replaced, written, replaced)
+		}
+		if t0s := chunkStarts(t, store, key); !reflect.DeepEqual(t0s, tc.t0s) {
+			t.Fatalf("%s: expected chunks %v, got %v", tc.name, tc.t0s, t0s)
+		}
+		after, err := mdata.ReadPoints(context.Background(), store, key, 86400, 0, 20000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Fatalf("%s: expected the data to be preserved exactly. had %d points, got %d", tc.name, len(before), len(after))
+		}
+
+		// a second run has nothing to do
+		written, replaced, err = j.compactArchive(store, store, key, ret, now)
+		if err != nil || written != 0 || replaced != 0 {
+			t.Fatalf("%s: expected the second run to do nothing, got %d written, %d replaced, error %v", tc.name, written, replaced, err)
+		}
+	}
+}
+
+func TestNewChunk(t *testing.T) {
+	points := []schema.Point{{Val: 1, Ts: 20}, {Val: 2, Ts: 10}, {Val: 3, Ts: 20}}
+	c, err := newChunk(0, chunk.EncodingFloat, points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := c.IterGen(600).Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []schema.Point
+	for iter.Next() {
+		ts, val := iter.Values()
+		got = append(got, schema.Point{Val: val, Ts: ts})
+	}
+	exp := []schema.Point{{Val: 2, Ts: 10}, {Val: 3, Ts: 20}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected points %v, got %v", exp, got)
+	}
+}
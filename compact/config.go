@@ -0,0 +1,33 @@
+package compact
+
+import (
+	"flag"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var maxSeriesPerSec int
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("chunk-compaction", flag.ExitOnError)
+	fs.IntVar(&maxSeriesPerSec, "max-series-per-sec", 20, "how many series per second to compact the chunks of, when a compaction is started via the /compact/chunks endpoint. 0 for no limit")
+	globalconf.Register("chunk-compaction", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if maxSeriesPerSec < 0 {
+		return []conf.Finding{conf.NewError("chunk-compaction.max-series-per-sec", "can't be negative")}
+	}
+	return nil
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 type Aggregations struct {
 	Data               []Aggregation
 	DefaultAggregation Aggregation
+	ids                []uint16 // after Extend: the ids of the current aggregations, followed by the id of the default. Data may hold entries of previous configurations
 }
 
 type Aggregation struct {
@@ -22,6 +23,19 @@ type Aggregation struct {
 	AggregationMethod []Method
 }
 
+// equal returns whether both aggregations have the same name and settings
+func (a Aggregation) equal(o Aggregation) bool {
+	if a.Name != o.Name || a.Pattern.String() != o.Pattern.String() || a.XFilesFactor != o.XFilesFactor || len(a.AggregationMethod) != len(o.AggregationMethod) {
+		return false
+	}
+	for i := range a.AggregationMethod {
+		if a.AggregationMethod[i] != o.AggregationMethod[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // NewAggregations create instance of Aggregations
 func NewAggregations() Aggregations {
 	return Aggregations{
@@ -66,23 +80,9 @@ func ReadAggregations(file string) (Aggregations, error) {
 			return Aggregations{}, fmt.Errorf("[%s]: failed to parse xFilesFactor %q: %s", item.Name, s.ValueOf("xFilesFactor"), err.Error())
 		}
 
-		aggregationMethodStr := s.ValueOf("aggregationMethod")
-		methodStrs := strings.Split(aggregationMethodStr, ",")
-		for _, methodStr := range methodStrs {
-			switch methodStr {
-			case "average", "avg":
-				item.AggregationMethod = append(item.AggregationMethod, Avg)
-			case "sum":
-				item.AggregationMethod = append(item.AggregationMethod, Sum)
-			case "last":
-				item.AggregationMethod = append(item.AggregationMethod, Lst)
-			case "max":
-				item.AggregationMethod = append(item.AggregationMethod, Max)
-			case "min":
-				item.AggregationMethod = append(item.AggregationMethod, Min)
-			default:
-				return result, fmt.Errorf("[%s]: unknown aggregation method %q", item.Name, methodStr)
-			}
+		item.AggregationMethod, err = ParseAggregationMethods(s.ValueOf("aggregationMethod"))
+		if err != nil {
+			return result, fmt.Errorf("[%s]: %s", item.Name, err)
 		}
 
 		result.Data = append(result.Data, item)
@@ -91,16 +91,118 @@ func ReadAggregations(file string) (Aggregations, error) {
 	return result, nil
 }
 
+// ParseAggregationMethods parses a comma separated list of aggregation methods, like "avg,max"
+func ParseAggregationMethods(str string) ([]Method, error) {
+	var methods []Method
+	for _, methodStr := range strings.Split(str, ",") {
+		switch methodStr {
+		case "average", "avg":
+			methods = append(methods, Avg)
+		case "sum":
+			methods = append(methods, Sum)
+		case "last":
+			methods = append(methods, Lst)
+		case "max":
+			methods = append(methods, Max)
+		case "min":
+			methods = append(methods, Min)
+		default:
+			return nil, fmt.Errorf("unknown aggregation method %q", methodStr)
+		}
+	}
+	return methods, nil
+}
+
 // Match returns the correct aggregation setting for the given metric
 // it can always find a valid setting, because there's a default catch all
 // also returns the index of the setting, to efficiently reference it
 func (a Aggregations) Match(metric string) (uint16, Aggregation) {
-	for i, s := range a.Data {
-		if s.Pattern.MatchString(metric) {
-			return uint16(i), s
+	if a.ids == nil {
+		for i, s := range a.Data {
+			if s.Pattern.MatchString(metric) {
+				return uint16(i), s
+			}
 		}
+		return uint16(len(a.Data)), a.DefaultAggregation
+	}
+	for _, id := range a.ids[:len(a.ids)-1] {
+		if a.Data[id].Pattern.MatchString(metric) {
+			return id, a.Data[id]
+		}
+	}
+	return a.ids[len(a.ids)-1], a.DefaultAggregation
+}
+
+// Extend returns aggregations that match metrics against the rules of newer, while the ids handed out by
+// the receiver remain valid. This allows to replace the configuration at runtime, without affecting
+// the series that were set up with the previous configuration.
+// Aggregations of newer that the receiver already has, with the same name and settings, keep their ids,
+// so that reloading an unchanged configuration doesn't grow Data, and all nodes agree on the ids.
+func (a Aggregations) Extend(newer Aggregations) Aggregations {
+	ext := Aggregations{
+		Data:               a.Data[:len(a.Data):len(a.Data)],
+		DefaultAggregation: newer.DefaultAggregation,
+	}
+	if a.ids == nil {
+		// the id of our default is len(a.Data), so it must keep resolving to it
+		ext.Data = append(ext.Data, a.DefaultAggregation)
+	}
+	for _, agg := range newer.List() {
+		ext.ids = append(ext.ids, ext.add(agg))
+	}
+	ext.ids = append(ext.ids, ext.add(newer.DefaultAggregation))
+	return ext
+}
+
+// add adds the aggregation to Data, unless it has it already, and returns its id
+func (a *Aggregations) add(agg Aggregation) uint16 {
+	for i, known := range a.Data {
+		if known.equal(agg) {
+			return uint16(i)
+		}
+	}
+	a.Data = append(a.Data, agg)
+	return uint16(len(a.Data) - 1)
+}
+
+// Equal returns whether both have the same aggregations, in the same order
+func (a Aggregations) Equal(o Aggregations) bool {
+	list, oList := a.List(), o.List()
+	if len(list) != len(oList) || !a.DefaultAggregation.equal(o.DefaultAggregation) {
+		return false
+	}
+	for i := range list {
+		if !list[i].equal(oList[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Current returns whether the given index is used by the current configuration,
+// as opposed to a configuration that was replaced via Extend
+func (a Aggregations) Current(i uint16) bool {
+	if a.ids == nil {
+		return true
+	}
+	for _, id := range a.ids {
+		if id == i {
+			return true
+		}
+	}
+	return false
+}
+
+// List returns the aggregations of the current configuration, excluding the default
+func (a Aggregations) List() []Aggregation {
+	if a.ids == nil {
+		return a.Data
+	}
+	list := make([]Aggregation, 0, len(a.ids)-1)
+	for _, id := range a.ids[:len(a.ids)-1] {
+		list = append(list, a.Data[id])
 	}
-	return uint16(len(a.Data)), a.DefaultAggregation
+	return list
 }
 
 // Get returns the aggregation setting corresponding to the given index
@@ -0,0 +1,62 @@
+package conf
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestAggregationsExtend(t *testing.T) {
+	old := NewAggregations()
+	old.Data = append(old.Data, Aggregation{
+		Name:              "sum",
+		Pattern:           regexp.MustCompile("^sum\\."),
+		AggregationMethod: []Method{Sum},
+	})
+	sumId, _ := old.Match("sum.foo")
+	defId, _ := old.Match("other")
+
+	newer := NewAggregations()
+	newer.Data = append(newer.Data, Aggregation{
+		Name:              "max",
+		Pattern:           regexp.MustCompile("^sum\\."),
+		AggregationMethod: []Method{Max},
+	})
+	newer.DefaultAggregation.AggregationMethod = []Method{Lst}
+	ext := old.Extend(newer)
+
+	if ext.Get(sumId).Name != "sum" || ext.Current(sumId) {
+		t.Fatalf("expected old id %d to resolve to the old, non-current, sum aggregation", sumId)
+	}
+	if m := ext.Get(defId).AggregationMethod; len(m) != 1 || m[0] != Avg || ext.Current(defId) {
+		t.Fatalf("expected old default id %d to resolve to the old, non-current, default aggregation, got %v", defId, m)
+	}
+	id, agg := ext.Match("sum.foo")
+	if agg.Name != "max" || ext.Get(id).Name != "max" || !ext.Current(id) {
+		t.Fatalf("expected sum.foo to match the new max aggregation, got %q (id %d)", agg.Name, id)
+	}
+	id, agg = ext.Match("other")
+	if agg.AggregationMethod[0] != Lst || ext.Get(id).AggregationMethod[0] != Lst || !ext.Current(id) {
+		t.Fatalf("expected other to match the new default aggregation, got %v (id %d)", agg.AggregationMethod, id)
+	}
+	if l := ext.List(); len(l) != 1 || l[0].Name != "max" {
+		t.Fatalf("expected List to return the new aggregations, got %v", l)
+	}
+
+	// extending with an unchanged configuration keeps all ids and doesn't grow Data
+	ext2 := ext.Extend(newer)
+	if len(ext2.Data) != len(ext.Data) || !ext2.Equal(ext) {
+		t.Fatalf("expected an unchanged configuration to not grow Data, got %v", ext2.Data)
+	}
+	if id2, _ := ext2.Match("other"); id2 != id || !ext2.Current(id) {
+		t.Fatalf("expected the unchanged default to keep id %d, got %d", id, id2)
+	}
+	// and bringing back a previous aggregation reuses its id
+	maxId, _ := ext2.Match("sum.foo")
+	ext3 := ext2.Extend(old)
+	if id3, agg := ext3.Match("sum.foo"); id3 != sumId || agg.Name != "sum" || !ext3.Current(sumId) {
+		t.Fatalf("expected the sum aggregation to get its previous id %d back, got %d", sumId, id3)
+	}
+	if ext3.Current(maxId) {
+		t.Fatalf("expected id %d of the removed max aggregation to not be current", maxId)
+	}
+}
@@ -0,0 +1,29 @@
+package conf
+
+import (
+	"fmt"
+)
+
+// Finding is a problem with the configuration. errors are combinations that metrictank can't handle correctly,
+// warnings are combinations that work but are probably not intended.
+type Finding struct {
+	Error   bool   `json:"error"`
+	Subject string `json:"subject"` // the setting or schema the finding is about
+	Msg     string `json:"message"`
+}
+
+func NewError(subject, format string, args ...interface{}) Finding {
+	return Finding{true, subject, fmt.Sprintf(format, args...)}
+}
+
+func NewWarning(subject, format string, args ...interface{}) Finding {
+	return Finding{false, subject, fmt.Sprintf(format, args...)}
+}
+
+func (f Finding) String() string {
+	level := "WARN "
+	if f.Error {
+		level = "ERROR"
+	}
+	return fmt.Sprintf("%s [%s] %s", level, f.Subject, f.Msg)
+}
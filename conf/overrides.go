@@ -0,0 +1,106 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// Override is a storage schema and/or aggregation rule that is set at runtime rather than in the config files,
+// e.g. to tune the retention of a new namespace without a restart. Overrides take precedence over the rules
+// of the files. An empty Retentions or AggregationMethod leaves that part to the files.
+type Override struct {
+	Name              string  `json:"name"`
+	Pattern           string  `json:"pattern"`
+	Retentions        string  `json:"retentions,omitempty"`
+	XFilesFactor      float64 `json:"xFilesFactor,omitempty"`
+	AggregationMethod string  `json:"aggregationMethod,omitempty"`
+}
+
+// Empty returns whether the override neither sets retentions nor aggregation methods
+func (o Override) Empty() bool {
+	return o.Retentions == "" && o.AggregationMethod == ""
+}
+
+// Validate returns an error if the override can't be applied
+func (o Override) Validate() error {
+	_, _, _, _, err := o.parse()
+	return err
+}
+
+// parse returns the schema and aggregation of the override. ok is false for the parts it doesn't set.
+func (o Override) parse() (schema Schema, schemaOk bool, agg Aggregation, aggOk bool, err error) {
+	if o.Name == "" {
+		return schema, false, agg, false, errors.New("override without name")
+	}
+	if o.Pattern == "" {
+		return schema, false, agg, false, fmt.Errorf("override %q: empty pattern", o.Name)
+	}
+	if o.Empty() {
+		return schema, false, agg, false, fmt.Errorf("override %q: neither retentions nor aggregationMethod set", o.Name)
+	}
+	pattern, err := regexp.Compile(o.Pattern)
+	if err != nil {
+		return schema, false, agg, false, fmt.Errorf("override %q: failed to parse pattern %q: %s", o.Name, o.Pattern, err)
+	}
+	if o.Retentions != "" {
+		schema = Schema{
+			Name:    o.Name,
+			Pattern: pattern,
+		}
+		schema.Retentions, err = ParseRetentions(o.Retentions)
+		if err != nil {
+			return schema, false, agg, false, fmt.Errorf("override %q: failed to parse retentions %q: %s", o.Name, o.Retentions, err)
+		}
+		schemaOk = true
+	}
+	if o.AggregationMethod != "" {
+		agg = Aggregation{
+			Name:         o.Name,
+			Pattern:      pattern,
+			XFilesFactor: o.XFilesFactor,
+		}
+		agg.AggregationMethod, err = ParseAggregationMethods(o.AggregationMethod)
+		if err != nil {
+			return schema, false, agg, false, fmt.Errorf("override %q: %s", o.Name, err)
+		}
+		aggOk = true
+	}
+	return schema, schemaOk, agg, aggOk, nil
+}
+
+// ApplyOverrides returns the given schemas and aggregations, as read from the config files, with the overrides
+// taking precedence over their rules, in the order given.
+func ApplyOverrides(schemas Schemas, aggregations Aggregations, overrides []Override) (Schemas, Aggregations, error) {
+	var overrideSchemas []Schema
+	var overrideAggs []Aggregation
+	names := make(map[string]struct{})
+	for _, o := range overrides {
+		if _, ok := names[o.Name]; ok {
+			return schemas, aggregations, fmt.Errorf("override %q: duplicate name", o.Name)
+		}
+		names[o.Name] = struct{}{}
+		schema, schemaOk, agg, aggOk, err := o.parse()
+		if err != nil {
+			return schemas, aggregations, err
+		}
+		if schemaOk {
+			overrideSchemas = append(overrideSchemas, schema)
+		}
+		if aggOk {
+			overrideAggs = append(overrideAggs, agg)
+		}
+	}
+
+	raw, def := schemas.List()
+	newSchemas := Schemas{
+		raw:           append(overrideSchemas, raw...),
+		DefaultSchema: def,
+	}
+	newSchemas.BuildIndex()
+	newAggs := Aggregations{
+		Data:               append(overrideAggs, aggregations.List()...),
+		DefaultAggregation: aggregations.DefaultAggregation,
+	}
+	return newSchemas, newAggs, nil
+}
@@ -0,0 +1,57 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyOverrides(t *testing.T) {
+	schemas := schemasForTest()
+	aggs := NewAggregations()
+
+	overrides := []Override{
+		{Name: "new", Pattern: "^a\\.new\\.", Retentions: "1s:1d:10min:2,1m:30d:6h:2"},
+		{Name: "sums", Pattern: "^b\\.", XFilesFactor: 0.1, AggregationMethod: "sum,max"},
+	}
+	s, a, err := ApplyOverrides(schemas, aggs, overrides)
+	if err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if _, schema := s.Match("a.new.foo", 1); schema.Name != "new" || len(schema.Retentions) != 2 {
+		t.Fatalf("expected a.new.foo to match the override, got %q", schema.Name)
+	}
+	if _, schema := s.Match("a.foo", 10); schema.Name != "a" {
+		t.Fatalf("expected a.foo to match schema a, got %q", schema.Name)
+	}
+	if _, schema := s.Match("b.foo", 1); schema.Name != "b" {
+		t.Fatalf("expected the aggregation override to not affect the schema of b.foo, got %q", schema.Name)
+	}
+	_, agg := a.Match("b.foo")
+	if agg.Name != "sums" || agg.XFilesFactor != 0.1 || !reflect.DeepEqual(agg.AggregationMethod, []Method{Sum, Max}) {
+		t.Fatalf("expected b.foo to match the aggregation override, got %+v", agg)
+	}
+	if _, agg := a.Match("a.new.foo"); agg.Name != "default" {
+		t.Fatalf("expected the schema override to not affect the aggregation of a.new.foo, got %q", agg.Name)
+	}
+	// the input is not modified
+	if _, schema := schemas.Match("a.new.foo", 1); schema.Name != "a" {
+		t.Fatalf("expected the original schemas to be unchanged, got %q", schema.Name)
+	}
+
+	invalid := []Override{
+		{Pattern: "^a", Retentions: "1s:1d"},
+		{Name: "x", Retentions: "1s:1d"},
+		{Name: "x", Pattern: "^a"},
+		{Name: "x", Pattern: "(", Retentions: "1s:1d"},
+		{Name: "x", Pattern: "^a", Retentions: "1x:1d"},
+		{Name: "x", Pattern: "^a", AggregationMethod: "median"},
+	}
+	for _, o := range invalid {
+		if _, _, err := ApplyOverrides(schemas, aggs, []Override{o}); err == nil {
+			t.Fatalf("expected an error for invalid override %+v", o)
+		}
+	}
+	if _, _, err := ApplyOverrides(schemas, aggs, []Override{overrides[0], overrides[0]}); err == nil {
+		t.Fatalf("expected an error for overrides with the same name")
+	}
+}
@@ -57,11 +57,13 @@ func (rets Retentions) Validate() error {
   it records.
 */
 type Retention struct {
-	SecondsPerPoint int    // interval in seconds
-	NumberOfPoints  int    // ~ttl
-	ChunkSpan       uint32 // duration of chunk of aggregated metric for storage, controls how many aggregated points go into 1 chunk
-	NumChunks       uint32 // number of chunks to keep in memory. remember, for a query from now until 3 months ago, we will end up querying the memory server as well.
-	Ready           bool   // ready for reads?
+	SecondsPerPoint int            // interval in seconds
+	NumberOfPoints  int            // ~ttl
+	ChunkSpan       uint32         // duration of chunk of aggregated metric for storage, controls how many aggregated points go into 1 chunk
+	NumChunks       uint32         // number of chunks to keep in memory. remember, for a query from now until 3 months ago, we will end up querying the memory server as well.
+	Ready           bool           // ready for reads?
+	Codec           chunk.Codec    // compression of the chunks when persisting them
+	Encoding        chunk.Encoding // how the points of the chunks are encoded
 }
 
 func (r Retention) MaxRetention() int {
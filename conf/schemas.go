@@ -8,13 +8,15 @@ import (
 	"strings"
 
 	"github.com/alyu/configparser"
+	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/util"
 )
 
 // Schemas contains schema settings
 type Schemas struct {
 	raw           []Schema
-	index         []Schema
+	index         []Schema // by id. may hold entries of previous configurations, as series may still refer to them
+	start         []int    // for each raw schema, followed by the default schema, the id of its first retention
 	DefaultSchema Schema
 }
 
@@ -33,6 +35,35 @@ type Schema struct {
 	ReorderWindow uint32
 }
 
+// equal returns whether both schemas have the same name and settings.
+// the priority is not compared, as it only determines the order in which schemas are matched
+func (s Schema) equal(o Schema) bool {
+	if s.Name != o.Name || s.Pattern.String() != o.Pattern.String() || s.ReorderWindow != o.ReorderWindow || len(s.Retentions) != len(o.Retentions) {
+		return false
+	}
+	for i := range s.Retentions {
+		if s.Retentions[i] != o.Retentions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// expand returns the index entries of the schema: one for each sublist of its retentions
+func (s Schema) expand() []Schema {
+	entries := make([]Schema, 0, len(s.Retentions))
+	for pos := range s.Retentions {
+		entries = append(entries, Schema{
+			Name:          s.Name,
+			Pattern:       s.Pattern,
+			Retentions:    s.Retentions[pos:],
+			Priority:      s.Priority,
+			ReorderWindow: s.ReorderWindow,
+		})
+	}
+	return entries
+}
+
 func NewSchemas(schemas []Schema) Schemas {
 	s := Schemas{
 		raw: schemas,
@@ -52,26 +83,33 @@ func (s Schemas) List() ([]Schema, Schema) {
 
 func (s *Schemas) BuildIndex() {
 	s.index = make([]Schema, 0)
-	for _, schema := range s.raw {
-		for pos := range schema.Retentions {
-			s.index = append(s.index, Schema{
-				Name:          schema.Name,
-				Pattern:       schema.Pattern,
-				Retentions:    schema.Retentions[pos:],
-				Priority:      schema.Priority,
-				ReorderWindow: schema.ReorderWindow,
-			})
-		}
-	}
-	// add the default schema
-	for pos := range s.DefaultSchema.Retentions {
-		s.index = append(s.index, Schema{
-			Name:       s.DefaultSchema.Name,
-			Pattern:    s.DefaultSchema.Pattern,
-			Retentions: s.DefaultSchema.Retentions[pos:],
-			Priority:   s.DefaultSchema.Priority,
-		})
+	s.start = make([]int, 0, len(s.raw)+1)
+	// the default schema goes last
+	for k := 0; k <= len(s.raw); k++ {
+		s.start = append(s.start, len(s.index))
+		s.index = append(s.index, s.schema(k).expand()...)
+	}
+}
+
+// schema returns the raw schema at position k, or the default schema if k is past the raw schemas
+func (s Schemas) schema(k int) Schema {
+	if k < len(s.raw) {
+		return s.raw[k]
 	}
+	return s.DefaultSchema
+}
+
+// Equal returns whether both have the same schemas, in the same order
+func (s Schemas) Equal(o Schemas) bool {
+	if len(s.raw) != len(o.raw) || !s.DefaultSchema.equal(o.DefaultSchema) {
+		return false
+	}
+	for i := range s.raw {
+		if !s.raw[i].equal(o.raw[i]) {
+			return false
+		}
+	}
+	return true
 }
 
 // ReadSchemas reads and parses a storage-schemas.conf file and returns a sorted schemas structure
@@ -118,6 +156,26 @@ func ReadSchemas(file string) (Schemas, error) {
 		}
 		schema.Priority = int64(p)<<32 - int64(i) // to sort records with same priority by position in file
 
+		if sec.ValueOf("compression") != "" {
+			codec, err := chunk.ParseCodec(sec.ValueOf("compression"))
+			if err != nil {
+				return Schemas{}, fmt.Errorf("[%s]: %s", schema.Name, err)
+			}
+			for j := range schema.Retentions {
+				schema.Retentions[j].Codec = codec
+			}
+		}
+
+		if sec.ValueOf("encoding") != "" {
+			encoding, err := chunk.ParseEncoding(sec.ValueOf("encoding"))
+			if err != nil {
+				return Schemas{}, fmt.Errorf("[%s]: %s", schema.Name, err)
+			}
+			for j := range schema.Retentions {
+				schema.Retentions[j].Encoding = encoding
+			}
+		}
+
 		reorderBufferStr := sec.ValueOf("reorderBuffer")
 		if len(reorderBufferStr) > 0 {
 			reorderWindow, err := strconv.ParseUint(reorderBufferStr, 10, 32)
@@ -169,9 +227,15 @@ func ReadSchemas(file string) (Schemas, error) {
 //     (pattern1), if it doesnt match we will then compare the pattern of
 //     schema2 (pattern2) and if that doesnt match we would try schema5
 //     (pattern3).
+//
+// After Extend, the index also holds the schemas of previous configurations,
+// and the schemas of the current one are no longer adjacent. s.start tells
+// where in the index each of them starts.
 func (s Schemas) Match(metric string, interval int) (uint16, Schema) {
-	i := 0
-	for i < len(s.index) {
+	for _, i := range s.start {
+		if i >= len(s.index) {
+			break
+		}
 		schema := s.index[i]
 		if schema.Pattern.MatchString(metric) {
 			// no interval passed,use the raw retentions.
@@ -201,9 +265,6 @@ func (s Schemas) Match(metric string, interval int) (uint16, Schema) {
 			pos := i + len(schema.Retentions) - 1
 			return uint16(pos), s.index[pos]
 		}
-		// the next len(schema.Retentions) schemas in the index all have the
-		// same schema pattern, so we can skip over them.
-		i = i + len(schema.Retentions)
 	}
 
 	// as the DefaultSchema is in the schemas.index, this should typically never be reached.
@@ -219,10 +280,57 @@ func (s Schemas) Get(i uint16) Schema {
 	return s.index[i]
 }
 
+// Extend returns schemas that match metrics against the rules of newer, while the ids handed out by
+// the receiver remain valid. This allows to replace the configuration at runtime, without affecting
+// the series that were set up with the previous configuration.
+// Schemas of newer that the receiver already has, with the same name and settings, keep their ids,
+// so that reloading an unchanged configuration doesn't grow the index, and all nodes agree on the ids.
+func (s Schemas) Extend(newer Schemas) Schemas {
+	ext := Schemas{
+		raw:           newer.raw,
+		index:         s.index[:len(s.index):len(s.index)],
+		start:         make([]int, 0, len(newer.raw)+1),
+		DefaultSchema: newer.DefaultSchema,
+	}
+	for k := 0; k <= len(newer.raw); k++ {
+		ext.start = append(ext.start, ext.add(newer.schema(k)))
+	}
+	return ext
+}
+
+// add adds the index entries of the schema, unless the index has them already,
+// and returns the id of the first one
+func (s *Schemas) add(schema Schema) int {
+	entries := schema.expand()
+	for i := 0; i+len(entries) <= len(s.index); i++ {
+		j := 0
+		for j < len(entries) && s.index[i+j].equal(entries[j]) {
+			j++
+		}
+		if j == len(entries) {
+			return i
+		}
+	}
+	s.index = append(s.index, entries...)
+	return len(s.index) - len(entries)
+}
+
+// Current returns whether the given index is used by the current configuration,
+// as opposed to a configuration that was replaced via Extend
+func (s Schemas) Current(i uint16) bool {
+	for _, start := range s.start {
+		if int(i) >= start && int(i) < len(s.index) && int(i) < start+len(s.index[start].Retentions) {
+			return true
+		}
+	}
+	return false
+}
+
 // TTLs returns a slice of all TTL's seen amongst all archives of all schemas
+// (including those of previous configurations, as they may still be in use)
 func (schemas Schemas) TTLs() []uint32 {
 	ttls := make(map[uint32]struct{})
-	for _, s := range schemas.raw {
+	for _, s := range schemas.index {
 		for _, r := range s.Retentions {
 			ttls[uint32(r.MaxRetention())] = struct{}{}
 		}
@@ -238,9 +346,10 @@ func (schemas Schemas) TTLs() []uint32 {
 }
 
 // MaxChunkSpan returns the largest chunkspan seen amongst all archives of all schemas
+// (including those of previous configurations, as they may still be in use)
 func (schemas Schemas) MaxChunkSpan() uint32 {
 	max := uint32(0)
-	for _, s := range schemas.raw {
+	for _, s := range schemas.index {
 		for _, r := range s.Retentions {
 			max = util.Max(max, r.ChunkSpan)
 		}
@@ -1,9 +1,14 @@
 package conf
 
 import (
-	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"reflect"
 	"regexp"
 	"testing"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	. "github.com/smartystreets/goconvey/convey"
 )
 
 func schemasForTest() Schemas {
@@ -164,3 +169,139 @@ func TestMaxChunkSpan(t *testing.T) {
 		So(max, ShouldEqual, 60*60*6)
 	})
 }
+
+func TestSchemasExtend(t *testing.T) {
+	old := schemasForTest()
+	oldId, oldSchema := old.Match("a.foo", 10)
+
+	newer := NewSchemas([]Schema{
+		{
+			Name:    "a2",
+			Pattern: regexp.MustCompile("^a\\..*"),
+			Retentions: []Retention{
+				NewRetentionMT(60, 86400*30, 60*60*6, 0, true),
+			},
+		},
+	})
+	ext := old.Extend(newer)
+
+	if got := ext.Get(oldId); got.Name != oldSchema.Name || got.Retentions[0] != oldSchema.Retentions[0] {
+		t.Fatalf("expected id %d to keep resolving to schema %q, got %q", oldId, oldSchema.Name, got.Name)
+	}
+	if ext.Current(oldId) {
+		t.Fatalf("expected id %d of the old configuration to not be current", oldId)
+	}
+	id, schema := ext.Match("a.foo", 60)
+	if schema.Name != "a2" || ext.Get(id).Name != "a2" || !ext.Current(id) {
+		t.Fatalf("expected a.foo to match the new schema a2 with a current id, got %q (id %d)", schema.Name, id)
+	}
+	id, schema = ext.Match("b.foo", 1)
+	if schema.Name != "default" || ext.Get(id).Name != "default" || !ext.Current(id) {
+		t.Fatalf("expected b.foo to match the new default schema, got %q (id %d)", schema.Name, id)
+	}
+	raw, _ := ext.List()
+	if len(raw) != 1 || raw[0].Name != "a2" {
+		t.Fatalf("expected List to return the new schemas, got %v", raw)
+	}
+	// the ttls of the old configuration are still in use
+	if len(ext.TTLs()) != 6 {
+		t.Fatalf("expected 6 ttls, got %v", ext.TTLs())
+	}
+
+	// extending again keeps all previously handed out ids valid
+	ext2 := ext.Extend(NewSchemas(nil))
+	if ext2.Get(oldId).Name != oldSchema.Name || ext2.Get(id).Name != "default" {
+		t.Fatalf("expected ids to remain valid after a second extension")
+	}
+	// the default schema didn't change, so it keeps its id
+	if id2, _ := ext2.Match("b.foo", 1); id2 != id || !ext2.Current(id) {
+		t.Fatalf("expected the unchanged default schema to keep id %d, got %d", id, id2)
+	}
+	aId, _ := ext.Match("a.foo", 60)
+	if ext2.Current(aId) {
+		t.Fatalf("expected id %d of the removed schema a2 to not be current", aId)
+	}
+
+	// extending with an unchanged configuration keeps all ids and doesn't grow the index
+	ext3 := ext2.Extend(NewSchemas(nil))
+	if len(ext3.index) != len(ext2.index) || !reflect.DeepEqual(ext3.start, ext2.start) {
+		t.Fatalf("expected an unchanged configuration to not grow the index")
+	}
+	// and bringing back a previous schema reuses its ids
+	ext4 := ext3.Extend(newer)
+	if id4, _ := ext4.Match("a.foo", 60); id4 != aId || len(ext4.index) != len(ext3.index) {
+		t.Fatalf("expected schema a2 to get its previous id %d back, got %d", aId, id4)
+	}
+}
+
+func TestReadSchemasCompression(t *testing.T) {
+	f, err := ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[compressed]
+pattern = ^a
+retentions = 1s:1d:10min:2,1m:30d:6h:1
+compression = snappy
+encoding = int
+
+[plain]
+pattern = .*
+retentions = 1s:1d
+`)
+	f.Close()
+
+	schemas, err := ReadSchemas(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := schemas.List()
+	for _, ret := range list[0].Retentions {
+		if ret.Codec != chunk.CodecSnappy {
+			t.Fatalf("expected all retentions of %q to use snappy, got %s", list[0].Name, ret.Codec)
+		}
+		if ret.Encoding != chunk.EncodingInt {
+			t.Fatalf("expected all retentions of %q to use int encoding, got %s", list[0].Name, ret.Encoding)
+		}
+	}
+	if list[1].Retentions[0].Codec != chunk.CodecNone {
+		t.Fatalf("expected %q to use no compression, got %s", list[1].Name, list[1].Retentions[0].Codec)
+	}
+	if list[1].Retentions[0].Encoding != chunk.EncodingFloat {
+		t.Fatalf("expected %q to use float encoding, got %s", list[1].Name, list[1].Retentions[0].Encoding)
+	}
+
+	f, err = ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[bad]
+pattern = .*
+retentions = 1s:1d
+compression = lz4
+`)
+	f.Close()
+	if _, err := ReadSchemas(f.Name()); err == nil {
+		t.Fatalf("expected error for unknown compression")
+	}
+
+	f, err = ioutil.TempFile("", "storage-schemas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[bad]
+pattern = .*
+retentions = 1s:1d
+encoding = decimal
+`)
+	f.Close()
+	if _, err := ReadSchemas(f.Name()); err == nil {
+		t.Fatalf("expected error for unknown encoding")
+	}
+}
@@ -2,26 +2,38 @@ package consolidation
 
 import (
 	"context"
+	"math"
 
+	"github.com/grafana/metrictank/batch"
 	"gopkg.in/raintank/schema.v1"
 )
 
 // ConsolidateContext wraps a Consolidate() call with a context.Context condition
-func ConsolidateContext(ctx context.Context, in []schema.Point, aggNum uint32, consolidator Consolidator) []schema.Point {
+func ConsolidateContext(ctx context.Context, in []schema.Point, aggNum uint32, consolidator Consolidator, xFilesFactor float64) []schema.Point {
 	select {
 	case <-ctx.Done():
 		//request canceled
 		return nil
 	default:
 	}
-	return Consolidate(in, aggNum, consolidator)
+	return ConsolidateXFF(in, aggNum, consolidator, xFilesFactor)
 }
 
 // Consolidate consolidates `in`, aggNum points at a time via the given function
 // note: the returned slice repurposes in's backing array.
 func Consolidate(in []schema.Point, aggNum uint32, consolidator Consolidator) []schema.Point {
+	return ConsolidateXFF(in, aggNum, consolidator, 0)
+}
+
+// ConsolidateXFF is like Consolidate, but a group of points only consolidates into a non-null value
+// if at least the fraction xFilesFactor of its points is non-null, like graphite does.
+// note: the returned slice repurposes in's backing array.
+func ConsolidateXFF(in []schema.Point, aggNum uint32, consolidator Consolidator, xFilesFactor float64) []schema.Point {
 	num := int(aggNum)
 	aggFunc := GetAggFunc(consolidator)
+	if xFilesFactor > 0 {
+		aggFunc = xff(aggFunc, xFilesFactor)
+	}
 
 	// let's see if the input data is a perfect fit for the requested aggNum
 	// (e.g. no remainder). This case is the easiest to handle
@@ -64,6 +76,23 @@ func Consolidate(in []schema.Point, aggNum uint32, consolidator Consolidator) []
 	return out
 }
 
+// xff wraps the aggregation function so that it returns null for groups of points
+// of which less than the fraction xFilesFactor is non-null
+func xff(aggFunc batch.AggFunc, xFilesFactor float64) batch.AggFunc {
+	return func(in []schema.Point) float64 {
+		var nonNull int
+		for _, p := range in {
+			if !math.IsNaN(p.Val) {
+				nonNull++
+			}
+		}
+		if float64(nonNull)/float64(len(in)) < xFilesFactor {
+			return math.NaN()
+		}
+		return aggFunc(in)
+	}
+}
+
 // returns how many points should be aggregated together so that you end up with as many points as possible,
 // but never more than maxPoints
 func AggEvery(numPoints, maxPoints uint32) uint32 {
@@ -75,8 +104,8 @@ func AggEvery(numPoints, maxPoints uint32) uint32 {
 
 // ConsolidateStable consolidates points in a "stable" way, meaning if you run the same function again so that the input
 // receives new points at the end and old points get removed at the beginning, we keep picking the same points to consolidate together
-// interval is the interval between the input points
-func ConsolidateStable(points []schema.Point, interval, maxDataPoints uint32, consolidator Consolidator) ([]schema.Point, uint32) {
+// interval is the interval between the input points. see ConsolidateXFF for xFilesFactor
+func ConsolidateStable(points []schema.Point, interval, maxDataPoints uint32, consolidator Consolidator, xFilesFactor float64) ([]schema.Point, uint32) {
 	aggNum := AggEvery(uint32(len(points)), maxDataPoints)
 	// note that the amount of points to strip is always < 1 postAggInterval's worth.
 	// there's 2 important considerations here:
@@ -102,7 +131,7 @@ func ConsolidateStable(points []schema.Point, interval, maxDataPoints uint32, co
 		_, num := nudge(points[0].Ts, interval, aggNum)
 		points = points[num:]
 	}
-	points = Consolidate(points, aggNum, consolidator)
+	points = ConsolidateXFF(points, aggNum, consolidator, xFilesFactor)
 	interval *= aggNum
 	return points, interval
 }
@@ -1,6 +1,7 @@
 package consolidation
 
 import (
+	"math"
 	"testing"
 
 	"github.com/grafana/metrictank/test"
@@ -30,6 +31,23 @@ func validate(cases []testCase, t *testing.T) {
 	}
 }
 
+func TestConsolidateXFF(t *testing.T) {
+	in := []schema.Point{
+		{Val: 1, Ts: 10},
+		{Val: math.NaN(), Ts: 20},
+		{Val: 3, Ts: 30},
+		{Val: math.NaN(), Ts: 40},
+		{Val: math.NaN(), Ts: 50},
+		{Val: 6, Ts: 60},
+		{Val: 7, Ts: 70},
+	}
+	// 2/3, 1/3 and 1/1 of the points are non-null
+	out := ConsolidateXFF(in, 3, Sum, 0.5)
+	if len(out) != 3 || out[0] != (schema.Point{Val: 4, Ts: 30}) || !math.IsNaN(out[1].Val) || out[1].Ts != 60 || out[2] != (schema.Point{Val: 7, Ts: 90}) {
+		t.Fatalf("unexpected output %v", out)
+	}
+}
+
 func TestOddConsolidationAlignments(t *testing.T) {
 	cases := []testCase{
 		{
@@ -338,7 +356,7 @@ func TestConsolidateStableABitMoreDataEven(t *testing.T) {
 		t)
 }
 func testConsolidateStable(in []schema.Point, inInt uint32, mdp uint32, expOut []schema.Point, expOutInt uint32, t *testing.T) {
-	out, outInt := ConsolidateStable(in, inInt, mdp, Sum)
+	out, outInt := ConsolidateStable(in, inInt, mdp, Sum, 0)
 	if outInt != expOutInt {
 		t.Fatalf("output interval mismatch: expected: %v, got: %v", expOutInt, outInt)
 	}
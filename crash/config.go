@@ -0,0 +1,35 @@
+package crash
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	restart      = true
+	restartDelay = time.Second
+	dir          string
+	maxFiles     int
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("crash", flag.ExitOnError)
+	fs.BoolVar(&restart, "restart", true, "recover from panics in inputs, store and index writers, index pruning and http handlers, rather than crashing the node. the goroutine is restarted, or the message or request is skipped")
+	fs.DurationVar(&restartDelay, "restart-delay", time.Second, "how long to wait before restarting a goroutine that panicked")
+	fs.StringVar(&dir, "dir", "/var/lib/metrictank/crash", "directory to save the stack and state of recovered panics to. empty to only log them")
+	fs.IntVar(&maxFiles, "max-files", 100, "how many crash files to keep in dir. the oldest are removed. 0 to keep all")
+	globalconf.Register("crash", fs)
+}
+
+func ConfigProcess() {
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(4, "crash: could not create dir %s: %s", dir, err)
+	}
+}
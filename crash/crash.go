@@ -0,0 +1,149 @@
+// Package crash isolates panics to the subsystem they happen in. Instead of taking down the whole node,
+// a panic is recovered, the stack and the state of the subsystem are written to disk for later analysis,
+// and the goroutine is restarted, or the work it was doing is skipped.
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// counters tracks, per subsystem:
+// metric crash.%s.panics is how many panics were recovered from in the given subsystem
+// metric crash.%s.restarts is how many times a goroutine of the given subsystem was restarted after a panic
+type counters struct {
+	sync.Mutex
+	panics   map[string]*stats.Counter32
+	restarts map[string]*stats.Counter32
+}
+
+var subsystems = counters{
+	panics:   make(map[string]*stats.Counter32),
+	restarts: make(map[string]*stats.Counter32),
+}
+
+func (c *counters) inc(m map[string]*stats.Counter32, name, subsystem string) {
+	c.Lock()
+	counter, ok := m[subsystem]
+	if !ok {
+		counter = stats.NewCounter32(fmt.Sprintf("crash.%s.%s", subsystem, name))
+		m[subsystem] = counter
+	}
+	c.Unlock()
+	counter.Inc()
+}
+
+// State returns the state of a subsystem to save along with a crash. it should be cheap, and safe to call
+// from a goroutine that just panicked: e.g. not take locks the goroutine may hold.
+type State func() interface{}
+
+// Recover recovers from a panic, records it and lets the function it is deferred in return normally.
+// it must be deferred directly, e.g.:
+//
+//	defer crash.Recover("input.carbon", state)
+//
+// if restarting after panics is disabled, it panics again after recording the crash.
+func Recover(subsystem string, state State) {
+	if r := recover(); r != nil {
+		handle(subsystem, r, state)
+	}
+}
+
+// Run runs fn, and returns whether it panicked. see Recover
+func Run(subsystem string, state State, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			handle(subsystem, r, state)
+		}
+	}()
+	fn()
+	return false
+}
+
+// Go runs fn until it returns without panicking, restarting it after every panic.
+// it blocks, so it's typically used as go crash.Go(...).
+// it must only be used for functions that leave everything in a consistent state when they panic,
+// e.g. loops that only hold locks in functions that release them with defer.
+func Go(subsystem string, state State, fn func()) {
+	for Run(subsystem, state, fn) {
+		subsystems.inc(subsystems.restarts, "restarts", subsystem)
+		log.Warn("crash: restarting %s in %s", subsystem, restartDelay)
+		time.Sleep(restartDelay)
+	}
+}
+
+func handle(subsystem string, r interface{}, state State) {
+	stack := debug.Stack()
+	subsystems.inc(subsystems.panics, "panics", subsystem)
+	log.Error(3, "crash: recovered from panic in %s: %v", subsystem, r)
+
+	var st interface{}
+	if state != nil {
+		// the state may be inconsistent, in which case getting it may panic too
+		Run(subsystem+".state", nil, func() { st = state() })
+	}
+	if dir != "" {
+		path, err := write(subsystem, r, st, stack, time.Now())
+		if err != nil {
+			log.Error(3, "crash: could not save crash of %s: %s", subsystem, err)
+		} else {
+			log.Error(3, "crash: saved stack and state of %s to %s", subsystem, path)
+		}
+	}
+	if !restart {
+		panic(r)
+	}
+}
+
+// write saves the crash to a file in dir, and removes the oldest files so that at most maxFiles remain
+func write(subsystem string, r, state interface{}, stack []byte, now time.Time) (string, error) {
+	stateJSON, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		stateJSON = []byte(fmt.Sprintf("could not encode state: %s", err))
+	}
+	content := fmt.Sprintf("subsystem: %s\ntime: %s\npanic: %v\n\nstate:\n%s\n\nstack:\n%s", subsystem, now.Format(time.RFC3339Nano), r, stateJSON, stack)
+	name := fmt.Sprintf("%s-%s.txt", now.UTC().Format("20060102T150405.000000000"), subsystem)
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		return "", err
+	}
+	cleanup()
+	return path, nil
+}
+
+func cleanup() {
+	if maxFiles <= 0 {
+		return
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Error(3, "crash: could not list %s: %s", dir, err)
+		return
+	}
+	var names []string
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".txt") {
+			names = append(names, info.Name())
+		}
+	}
+	// the names start with the time, so they sort oldest first
+	sort.Strings(names)
+	for len(names) > maxFiles {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			log.Error(3, "crash: could not remove %s: %s", names[0], err)
+		}
+		names = names[1:]
+	}
+}
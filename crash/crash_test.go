@@ -0,0 +1,96 @@
+package crash
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	if Run("test", nil, func() {}) {
+		t.Fatal("expected no panic")
+	}
+	state := func() interface{} { return map[string]int{"queue": 3} }
+	if !Run("test", state, func() { panic("boom") }) {
+		t.Fatal("expected panic to be recovered")
+	}
+	// a state function that panics too must not take the node down
+	if !Run("test", func() interface{} { panic("state") }, func() { panic("boom") }) {
+		t.Fatal("expected panic to be recovered")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	ret := func() (ret int) {
+		defer Recover("test", nil)
+		ret = 1
+		panic("boom")
+	}()
+	if ret != 1 {
+		t.Fatalf("expected the function to return normally, got %d", ret)
+	}
+}
+
+func TestGo(t *testing.T) {
+	restartDelay = time.Millisecond
+	runs := 0
+	Go("test", nil, func() {
+		runs++
+		if runs < 3 {
+			panic("boom")
+		}
+	})
+	if runs != 3 {
+		t.Fatalf("expected 3 runs, got %d", runs)
+	}
+}
+
+func TestNoRestart(t *testing.T) {
+	restart = false
+	defer func() {
+		restart = true
+		if r := recover(); r != "boom" {
+			t.Fatalf("expected the panic to be propagated, got %v", r)
+		}
+	}()
+	Run("test", nil, func() { panic("boom") })
+}
+
+func TestWrite(t *testing.T) {
+	var err error
+	dir, err = ioutil.TempDir("", "crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		os.RemoveAll(dir)
+		dir = ""
+	}()
+	maxFiles = 2
+
+	now := time.Unix(1500000000, 0)
+	for i := 0; i < 3; i++ {
+		path, err := write("store.write", "boom", map[string]int{"queue": i}, []byte("goroutine 1 [running]:"), now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, exp := range []string{"subsystem: store.write", "panic: boom", "\"queue\": ", "goroutine 1 [running]:"} {
+			if !strings.Contains(string(content), exp) {
+				t.Fatalf("expected %q in crash file, got %s", exp, content)
+			}
+		}
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || !strings.HasPrefix(infos[0].Name(), "20170714T024001") {
+		t.Fatalf("expected the 2 newest files to remain, got %v", infos)
+	}
+}
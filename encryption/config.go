@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/secrets"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+// the local KMS derives the org master keys from the master key with HMAC-SHA256, which should have at least as much entropy
+const minMasterKeyLen = 32
+
+var (
+	Enabled      bool
+	orgsStr      string
+	masterKeyRef string
+	dataKeyTTL   time.Duration
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("chunk-encryption", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "encrypt the chunks of the given orgs in the store. the data of all orgs that have encrypted chunks can only be read while enabled")
+	fs.StringVar(&orgsStr, "orgs", "", "comma separated list of the orgs whose chunks are encrypted, e.g. 3,12")
+	fs.StringVar(&masterKeyRef, "master-key", "", "secret from which the master key of each org is derived. at least 32 characters. may be an env:, file: or vault: reference, see the secrets section. it can't be changed without losing access to the encrypted data")
+	fs.DurationVar(&dataKeyTTL, "data-key-ttl", time.Hour, "how long a data key is used to encrypt the chunks of an org, before a new one is generated")
+	globalconf.Register("chunk-encryption", fs)
+}
+
+func parseOrgs(s string) ([]uint32, error) {
+	var orgs []uint32
+	for _, org := range strings.Split(s, ",") {
+		org = strings.TrimSpace(org)
+		if org == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(org, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org %q: %s", org, err)
+		}
+		orgs = append(orgs, uint32(id))
+	}
+	return orgs, nil
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	orgs, err := parseOrgs(orgsStr)
+	if err != nil {
+		findings = append(findings, conf.NewError("chunk-encryption.orgs", "%s", err))
+	} else if len(orgs) == 0 {
+		findings = append(findings, conf.NewWarning("chunk-encryption.orgs", "no orgs are given: chunks are only decrypted, not encrypted"))
+	}
+	if masterKeyRef == "" {
+		findings = append(findings, conf.NewError("chunk-encryption.master-key", "must be set"))
+	}
+	if dataKeyTTL <= 0 {
+		findings = append(findings, conf.NewError("chunk-encryption.data-key-ttl", "must be positive"))
+	}
+	return findings
+}
+
+// ConfigProcess must be called after secrets.ConfigProcess, and before the stores are created
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+		log.Warn("%s: %s", f.Subject, f.Msg)
+	}
+	if !Enabled {
+		return
+	}
+	masterKey, err := secrets.New(masterKeyRef)
+	if err != nil {
+		log.Fatal(4, "chunk-encryption.master-key: %s", err)
+	}
+	if len(masterKey.Get()) < minMasterKeyLen {
+		log.Fatal(4, "chunk-encryption.master-key: must be at least %d characters", minMasterKeyLen)
+	}
+	orgs, _ := parseOrgs(orgsStr)
+	enc = New(newLocalKMS(masterKey), orgs, dataKeyTTL)
+}
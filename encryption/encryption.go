@@ -0,0 +1,241 @@
+// Package encryption encrypts the stored chunks of selected orgs, so that the data of regulated tenants
+// is protected at rest, even in a store that is shared with other tenants.
+// It uses envelope encryption: data is encrypted with AES-GCM under a data key, which is stored next to it,
+// wrapped with the master key of the org. Master keys never leave the KMS, and a data key is only used
+// for a limited time, after which a new one is generated.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// max number of unwrapped data keys that are kept for decrypting
+const maxCachedKeys = 10000
+
+var (
+	// metric encryption.data_keys_generated is the number of data keys that were generated for encrypting data
+	dataKeysGenerated = stats.NewCounter32("encryption.data_keys_generated")
+
+	// metric encryption.errors is the number of chunks or blocks that could not be encrypted or decrypted
+	encryptionErrors = stats.NewCounter32("encryption.errors")
+
+	errEnvelopeTooShort = errors.New("corrupt data, encryption envelope is too short")
+	errNotConfigured    = errors.New("data is encrypted, but chunk-encryption is not enabled")
+
+	// the encryptor used by Wrap and Unwrap. nil when encryption is disabled
+	enc *Encryptor
+)
+
+type dataKey struct {
+	aead    cipher.AEAD
+	wrapped []byte
+	created time.Time
+}
+
+// Encryptor encrypts and decrypts the data of the orgs that have encryption enabled.
+// the zero value is not usable, use New. a nil Encryptor encrypts nothing.
+type Encryptor struct {
+	kms    KMS
+	orgs   map[uint32]struct{}
+	keyTTL time.Duration
+
+	sync.Mutex
+	current map[uint32]*dataKey    // per org, the data key to encrypt with
+	cache   map[string]cipher.AEAD // unwrapped data keys, by org and wrapped key
+}
+
+func New(kms KMS, orgs []uint32, keyTTL time.Duration) *Encryptor {
+	e := &Encryptor{
+		kms:     kms,
+		orgs:    make(map[uint32]struct{}, len(orgs)),
+		keyTTL:  keyTTL,
+		current: make(map[uint32]*dataKey),
+		cache:   make(map[string]cipher.AEAD),
+	}
+	for _, org := range orgs {
+		e.orgs[org] = struct{}{}
+	}
+	return e
+}
+
+// Enabled returns whether the data of the org is encrypted
+func (e *Encryptor) Enabled(orgId uint32) bool {
+	if e == nil {
+		return false
+	}
+	_, ok := e.orgs[orgId]
+	return ok
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func cacheKey(orgId uint32, wrapped []byte) string {
+	var org [4]byte
+	binary.BigEndian.PutUint32(org[:], orgId)
+	return string(org[:]) + string(wrapped)
+}
+
+// dataKey returns the data key to encrypt the data of the org with, generating a new one when the current one expired
+func (e *Encryptor) dataKey(orgId uint32) (*dataKey, error) {
+	e.Lock()
+	defer e.Unlock()
+	key, ok := e.current[orgId]
+	if ok && time.Since(key.created) < e.keyTTL {
+		return key, nil
+	}
+	plain, wrapped, err := e.kms.GenerateDataKey(orgId)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate data key for org %d: %s", orgId, err)
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	dataKeysGenerated.Inc()
+	key = &dataKey{aead, wrapped, time.Now()}
+	e.current[orgId] = key
+	e.cacheAEAD(cacheKey(orgId, wrapped), aead)
+	return key, nil
+}
+
+// cacheAEAD must be called while holding the lock
+func (e *Encryptor) cacheAEAD(key string, aead cipher.AEAD) {
+	if len(e.cache) >= maxCachedKeys {
+		// old data keys are rarely needed once their data has been read, so we just start over
+		e.cache = make(map[string]cipher.AEAD)
+	}
+	e.cache[key] = aead
+}
+
+// unwrapKey returns the cipher for the wrapped data key of the org
+func (e *Encryptor) unwrapKey(orgId uint32, wrapped []byte) (cipher.AEAD, error) {
+	key := cacheKey(orgId, wrapped)
+	e.Lock()
+	aead, ok := e.cache[key]
+	e.Unlock()
+	if ok {
+		return aead, nil
+	}
+	plain, err := e.kms.DecryptDataKey(orgId, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt data key for org %d: %s", orgId, err)
+	}
+	aead, err = newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	e.Lock()
+	e.cacheAEAD(key, aead)
+	e.Unlock()
+	return aead, nil
+}
+
+// additionalData binds the ciphertext to the org, so that data can't be passed off as belonging to another org
+func additionalData(orgId uint32) []byte {
+	var ad [4]byte
+	binary.BigEndian.PutUint32(ad[:], orgId)
+	return ad[:]
+}
+
+// Seal encrypts the data of the org into an envelope:
+// the length of the wrapped data key (big endian uint16), the wrapped data key, the nonce and the ciphertext.
+func (e *Encryptor) Seal(orgId uint32, data []byte) ([]byte, error) {
+	return e.seal(nil, orgId, data)
+}
+
+// seal appends the envelope to dst
+func (e *Encryptor) seal(dst []byte, orgId uint32, data []byte) ([]byte, error) {
+	key, err := e.dataKey(orgId)
+	if err != nil {
+		return nil, err
+	}
+	var size [2]byte
+	binary.BigEndian.PutUint16(size[:], uint16(len(key.wrapped)))
+	dst = append(dst, size[:]...)
+	dst = append(dst, key.wrapped...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	return key.aead.Seal(dst, nonce, data, additionalData(orgId)), nil
+}
+
+// Open decrypts an envelope created by Seal
+func (e *Encryptor) Open(orgId uint32, envelope []byte) ([]byte, error) {
+	if len(envelope) < 2 {
+		return nil, errEnvelopeTooShort
+	}
+	size := int(binary.BigEndian.Uint16(envelope))
+	envelope = envelope[2:]
+	if len(envelope) < size {
+		return nil, errEnvelopeTooShort
+	}
+	aead, err := e.unwrapKey(orgId, envelope[:size])
+	if err != nil {
+		return nil, err
+	}
+	envelope = envelope[size:]
+	if len(envelope) < aead.NonceSize() {
+		return nil, errEnvelopeTooShort
+	}
+	return aead.Open(nil, envelope[:aead.NonceSize()], envelope[aead.NonceSize():], additionalData(orgId))
+}
+
+// Wrap encrypts the data if the org has encryption enabled, and prefixes the envelope with the given format byte.
+// data of other orgs is returned as-is.
+func (e *Encryptor) Wrap(orgId uint32, format byte, data []byte) ([]byte, error) {
+	if !e.Enabled(orgId) {
+		return data, nil
+	}
+	buf, err := e.seal([]byte{format}, orgId, data)
+	if err != nil {
+		encryptionErrors.Inc()
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Unwrap decrypts the data if it starts with the given format byte. other data is returned as-is.
+// encrypted data is decrypted even if the org no longer has encryption enabled, as long as its keys are available.
+func (e *Encryptor) Unwrap(orgId uint32, format byte, data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != format {
+		return data, nil
+	}
+	if e == nil {
+		encryptionErrors.Inc()
+		return nil, errNotConfigured
+	}
+	out, err := e.Open(orgId, data[1:])
+	if err != nil {
+		encryptionErrors.Inc()
+		return nil, err
+	}
+	return out, nil
+}
+
+// Wrap encrypts the data of the org, if it has encryption enabled. see Encryptor.Wrap
+func Wrap(orgId uint32, format byte, data []byte) ([]byte, error) {
+	return enc.Wrap(orgId, format, data)
+}
+
+// Unwrap decrypts data that was encrypted by Wrap. see Encryptor.Unwrap
+func Unwrap(orgId uint32, format byte, data []byte) ([]byte, error) {
+	return enc.Unwrap(orgId, format, data)
+}
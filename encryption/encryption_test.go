@@ -0,0 +1,137 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/secrets"
+)
+
+const testFormat = 0xff
+
+func testKMS(t *testing.T) *localKMS {
+	secret, err := secrets.New("0123456789abcdef0123456789abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newLocalKMS(secret)
+}
+
+// countingKMS counts the calls to the KMS, to verify data keys are reused
+type countingKMS struct {
+	KMS
+	generated int
+	decrypted int
+}
+
+func (k *countingKMS) GenerateDataKey(orgId uint32) ([]byte, []byte, error) {
+	k.generated++
+	return k.KMS.GenerateDataKey(orgId)
+}
+
+func (k *countingKMS) DecryptDataKey(orgId uint32, wrapped []byte) ([]byte, error) {
+	k.decrypted++
+	return k.KMS.DecryptDataKey(orgId, wrapped)
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	e := New(testKMS(t), []uint32{2}, time.Hour)
+	data := []byte("some chunk data")
+
+	// org 1 has no encryption
+	out, err := e.Wrap(1, testFormat, data)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("expected data of org 1 to be returned as-is, got %v, %v", out, err)
+	}
+	out, err = e.Unwrap(1, testFormat, data)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("expected unencrypted data to be returned as-is, got %v, %v", out, err)
+	}
+
+	wrapped, err := e.Wrap(2, testFormat, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wrapped[0] != testFormat || bytes.Contains(wrapped, data) {
+		t.Fatalf("expected encrypted data prefixed with the format, got %v", wrapped)
+	}
+	out, err = e.Unwrap(2, testFormat, wrapped)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Fatalf("expected to decrypt the data, got %q, %v", out, err)
+	}
+
+	// the data can't be read as another org's
+	if _, err := e.Unwrap(3, testFormat, wrapped); err == nil {
+		t.Fatalf("expected error when decrypting data as another org")
+	}
+	// nor without the keys
+	var disabled *Encryptor
+	if _, err := disabled.Unwrap(2, testFormat, wrapped); err != errNotConfigured {
+		t.Fatalf("expected errNotConfigured, got %v", err)
+	}
+	// and tampering is detected
+	wrapped[len(wrapped)-1] ^= 1
+	if _, err := e.Unwrap(2, testFormat, wrapped); err == nil {
+		t.Fatalf("expected error when decrypting modified data")
+	}
+	if _, err := e.Unwrap(2, testFormat, []byte{testFormat, 0, 200, 1}); err != errEnvelopeTooShort {
+		t.Fatalf("expected errEnvelopeTooShort, got %v", err)
+	}
+}
+
+func TestDataKeyReuse(t *testing.T) {
+	kms := &countingKMS{KMS: testKMS(t)}
+	e := New(kms, []uint32{2}, time.Hour)
+	var wrapped [][]byte
+	for i := 0; i < 3; i++ {
+		w, err := e.Wrap(2, testFormat, []byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		wrapped = append(wrapped, w)
+	}
+	if kms.generated != 1 {
+		t.Fatalf("expected 1 data key to be generated, got %d", kms.generated)
+	}
+
+	// a new instance must unwrap the data key, but only once
+	kms2 := &countingKMS{KMS: testKMS(t)}
+	e2 := New(kms2, nil, time.Hour)
+	for i, w := range wrapped {
+		out, err := e2.Unwrap(2, testFormat, w)
+		if err != nil || !bytes.Equal(out, []byte{byte(i)}) {
+			t.Fatalf("expected to decrypt %d, got %v, %v", i, out, err)
+		}
+	}
+	if kms2.decrypted != 1 {
+		t.Fatalf("expected the data key to be decrypted once, got %d", kms2.decrypted)
+	}
+
+	// expired data keys are replaced
+	e.keyTTL = 0
+	if _, err := e.Wrap(2, testFormat, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	if kms.generated != 2 {
+		t.Fatalf("expected a new data key after expiry, got %d generated", kms.generated)
+	}
+}
+
+type failingKMS struct{}
+
+func (failingKMS) GenerateDataKey(orgId uint32) ([]byte, []byte, error) {
+	return nil, nil, errors.New("kms unavailable")
+}
+
+func (failingKMS) DecryptDataKey(orgId uint32, wrapped []byte) ([]byte, error) {
+	return nil, errors.New("kms unavailable")
+}
+
+func TestKMSFailure(t *testing.T) {
+	e := New(failingKMS{}, []uint32{2}, time.Hour)
+	if _, err := e.Wrap(2, testFormat, []byte{1}); err == nil {
+		t.Fatalf("expected error when the kms fails")
+	}
+}
@@ -0,0 +1,77 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/grafana/metrictank/secrets"
+)
+
+const dataKeySize = 32 // AES-256
+
+var errWrappedKeyTooShort = errors.New("wrapped data key is too short")
+
+// KMS manages the per-org master keys. It never hands them out: it generates data keys that are
+// wrapped (encrypted) with the master key of an org, and unwraps them again.
+// The wrapped data keys are stored alongside the data they encrypt.
+type KMS interface {
+	// GenerateDataKey returns a new random data key for the org, in plain and wrapped with the master key of the org
+	GenerateDataKey(orgId uint32) (plain, wrapped []byte, err error)
+	// DecryptDataKey unwraps a data key that was generated for the org
+	DecryptDataKey(orgId uint32, wrapped []byte) ([]byte, error)
+}
+
+// localKMS derives the master key of each org from a single secret, so that they don't need to be
+// provisioned per org. the secret can't be changed without losing access to the data encrypted under it.
+type localKMS struct {
+	secret *secrets.Secret
+}
+
+func newLocalKMS(secret *secrets.Secret) *localKMS {
+	return &localKMS{secret}
+}
+
+// masterKey returns the AES-GCM cipher for the master key of the org
+func (k *localKMS) masterKey(orgId uint32) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(k.secret.Get()))
+	mac.Write([]byte("metrictank-org-" + strconv.FormatUint(uint64(orgId), 10)))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateDataKey returns a random data key and its wrapped form: a nonce followed by the sealed key
+func (k *localKMS) GenerateDataKey(orgId uint32) ([]byte, []byte, error) {
+	aead, err := k.masterKey(orgId)
+	if err != nil {
+		return nil, nil, err
+	}
+	plain := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, plain); err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+dataKeySize+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	return plain, aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (k *localKMS) DecryptDataKey(orgId uint32, wrapped []byte) ([]byte, error) {
+	aead, err := k.masterKey(orgId)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errWrappedKeyTooShort
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+}
@@ -0,0 +1,41 @@
+package events
+
+import (
+	"flag"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled bool
+	ttlStr  string
+
+	// TTL is how long events are kept, in seconds. 0 to keep them forever
+	TTL uint32
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "enable the /events api to store and query events such as deploys, compatible with graphite-web. stored in the events and events_by_tag tables of the cassandra store")
+	fs.StringVar(&ttlStr, "ttl", "1y", "how long to keep events. 0 to keep them forever")
+	globalconf.Register("events", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if _, err := dur.ParseDuration(ttlStr); err != nil {
+		return []conf.Finding{conf.NewError("events.ttl", "invalid duration %q: %s", ttlStr, err)}
+	}
+	return nil
+}
+
+func ConfigProcess() {
+	var err error
+	TTL, err = dur.ParseDuration(ttlStr)
+	if err != nil {
+		log.Fatal(4, "events: invalid ttl %q: %s", ttlStr, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Package events stores events, such as deploys or incidents, so they can be shown alongside the metrics,
+// e.g. as annotations in grafana. the api is compatible with the events api of graphite-web.
+package events
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+var ErrNotFound = errors.New("event not found")
+
+// Event is something that happened at a point in time
+type Event struct {
+	ID   int64    `json:"id"`
+	When int64    `json:"when"` // unix timestamp
+	What string   `json:"what"`
+	Tags []string `json:"tags"`
+	Data string   `json:"data"`
+}
+
+// HasTags returns whether the event has all of the given tags
+func (e Event) HasTags(tags []string) bool {
+	for _, want := range tags {
+		found := false
+		for _, tag := range e.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Store persists the events of each org
+type Store interface {
+	Add(org uint32, e Event) error
+	// Get returns the events between from and until (inclusive) that have all of the given tags, newest first
+	Get(org uint32, from, until int64, tags []string) ([]Event, error)
+	// GetByID returns the event with the given id, or ErrNotFound
+	GetByID(org uint32, id int64) (Event, error)
+	// Delete deletes the event with the given id, or returns ErrNotFound
+	Delete(org uint32, id int64) error
+}
+
+// the ids embed the time of the event, so that stores can find the event by id without an extra lookup
+const idRandomBits = 20
+
+// NewID returns a new id for an event at the given time
+func NewID(when int64) int64 {
+	return when<<idRandomBits | rand.Int63n(1<<idRandomBits)
+}
+
+// When returns the time of the event with the given id
+func When(id int64) int64 {
+	return id >> idRandomBits
+}
+
+// IDRange returns the lowest and highest possible ids of events between from and until (inclusive)
+func IDRange(from, until int64) (int64, int64) {
+	return from << idRandomBits, (until+1)<<idRandomBits - 1
+}
+
+// ParseTags parses tags given as a space or comma separated list, like graphite-web does.
+// duplicates are removed and the tags are sorted
+func ParseTags(list ...string) []string {
+	seen := make(map[string]struct{})
+	tags := []string{}
+	for _, l := range list {
+		for _, tag := range strings.FieldsFunc(l, func(r rune) bool { return r == ' ' || r == ',' }) {
+			if _, ok := seen[tag]; ok {
+				continue
+			}
+			seen[tag] = struct{}{}
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// newestFirst sorts events by time, newest first
+type newestFirst []Event
+
+func (n newestFirst) Len() int      { return len(n) }
+func (n newestFirst) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n newestFirst) Less(i, j int) bool {
+	if n[i].When == n[j].When {
+		return n[i].ID > n[j].ID
+	}
+	return n[i].When > n[j].When
+}
+
+// SortNewestFirst sorts the events by time, newest first
+func SortNewestFirst(events []Event) {
+	sort.Sort(newestFirst(events))
+}
@@ -0,0 +1,30 @@
+package events
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestID(t *testing.T) {
+	for _, when := range []int64{0, 1, 1500000000, 4000000000} {
+		id := NewID(when)
+		if When(id) != when {
+			t.Fatalf("expected id %d to be at %d, got %d", id, when, When(id))
+		}
+		min, max := IDRange(when, when)
+		if id < min || id > max {
+			t.Fatalf("expected id %d to be within %d - %d", id, min, max)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags("deploy api", "web,api", "")
+	if !reflect.DeepEqual(tags, []string{"api", "deploy", "web"}) {
+		t.Fatalf("unexpected tags %v", tags)
+	}
+	e := Event{Tags: tags}
+	if !e.HasTags([]string{"web", "api"}) || e.HasTags([]string{"db"}) {
+		t.Fatalf("unexpected HasTags result for %v", tags)
+	}
+}
@@ -0,0 +1,59 @@
+package events
+
+import "sync"
+
+// Memory is a store that keeps the events in memory. it is meant for testing and development:
+// events are lost on restart and are not shared between instances.
+type Memory struct {
+	sync.RWMutex
+	events map[uint32]map[int64]Event
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		events: make(map[uint32]map[int64]Event),
+	}
+}
+
+func (m *Memory) Add(org uint32, e Event) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.events[org]; !ok {
+		m.events[org] = make(map[int64]Event)
+	}
+	m.events[org][e.ID] = e
+	return nil
+}
+
+func (m *Memory) Get(org uint32, from, until int64, tags []string) ([]Event, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var out []Event
+	for _, e := range m.events[org] {
+		if e.When >= from && e.When <= until && e.HasTags(tags) {
+			out = append(out, e)
+		}
+	}
+	SortNewestFirst(out)
+	return out, nil
+}
+
+func (m *Memory) GetByID(org uint32, id int64) (Event, error) {
+	m.RLock()
+	defer m.RUnlock()
+	e, ok := m.events[org][id]
+	if !ok {
+		return Event{}, ErrNotFound
+	}
+	return e, nil
+}
+
+func (m *Memory) Delete(org uint32, id int64) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.events[org][id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.events[org], id)
+	return nil
+}
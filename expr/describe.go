@@ -0,0 +1,193 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// FuncDescription describes a function, in the format graphite-web uses for its /functions endpoint
+type FuncDescription struct {
+	Name     string             `json:"name"`
+	Function string             `json:"function"`
+	Group    string             `json:"group"`
+	Params   []ParamDescription `json:"params"`
+}
+
+// ParamDescription describes an input argument of a function, in the format graphite-web uses for its /functions endpoint
+type ParamDescription struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required,omitempty"`
+	Multiple bool        `json:"multiple,omitempty"`
+	Default  interface{} `json:"default,omitempty"`
+}
+
+// funcGroups categorizes the functions like graphite-web does
+var funcGroups = map[string]string{
+	"alias":                      "Alias",
+	"aliasByTags":                "Alias",
+	"aliasByNode":                "Alias",
+	"aliasSub":                   "Alias",
+	"asPercent":                  "Combine",
+	"avg":                        "Combine",
+	"averageSeries":              "Combine",
+	"consolidateBy":              "Special",
+	"diffSeries":                 "Combine",
+	"divideSeries":               "Combine",
+	"divideSeriesLists":          "Combine",
+	"exclude":                    "Filter Series",
+	"grep":                       "Filter Series",
+	"groupByTags":                "Combine",
+	"holtWintersAberration":      "Calculate",
+	"holtWintersConfidenceBands": "Calculate",
+	"holtWintersForecast":        "Calculate",
+	"max":                        "Combine",
+	"maxSeries":                  "Combine",
+	"min":                        "Combine",
+	"minSeries":                  "Combine",
+	"multiplySeries":             "Combine",
+	"movingAverage":              "Calculate",
+	"perSecond":                  "Transform",
+	"rangeOfSeries":              "Combine",
+	"scale":                      "Transform",
+	"smartSummarize":             "Transform",
+	"sortByName":                 "Sorting",
+	"stddevSeries":               "Combine",
+	"sum":                        "Combine",
+	"sumSeries":                  "Combine",
+	"summarize":                  "Transform",
+	"timeShift":                  "Transform",
+	"timeStack":                  "Transform",
+	"transformNull":              "Transform",
+}
+
+// Describe returns the descriptions of all functions that can be executed natively, by name.
+// if stable is set, only the stable functions are included (see NewPlan)
+func Describe(stable bool) map[string]FuncDescription {
+	out := make(map[string]FuncDescription, len(funcs))
+	for name, fdef := range funcs {
+		if stable && !fdef.stable {
+			continue
+		}
+		fn := fdef.constr()
+		argsExp, _ := fn.Signature()
+		_, multiContext := fn.(MultiContextFunc)
+		desc := FuncDescription{
+			Name:   name,
+			Group:  funcGroups[name],
+			Params: make([]ParamDescription, 0, len(argsExp)),
+		}
+		var sig []string
+		for _, arg := range argsExp {
+			param := describeArg(arg)
+			if _, ok := arg.(ArgSeriesLists); ok && multiContext {
+				// the lists are the same input, set up for different contexts. see MultiContextFunc
+				param.Type = "seriesList"
+				param.Multiple = false
+				if arg.Key() == "" {
+					param.Name = param.Type
+				}
+			}
+			desc.Params = append(desc.Params, param)
+			switch {
+			case param.Multiple:
+				sig = append(sig, "*"+param.Name)
+			case param.Required:
+				sig = append(sig, param.Name)
+			case param.Default == nil:
+				sig = append(sig, param.Name+"=None")
+			default:
+				sig = append(sig, param.Name+"="+pythonRepr(param.Default))
+			}
+		}
+		desc.Function = fmt.Sprintf("%s(%s)", name, strings.Join(sig, ", "))
+		out[name] = desc
+	}
+	return out
+}
+
+// describeArg describes the given arg. the defaults are the values the arg points to,
+// as set up by the function constructor.
+func describeArg(arg Arg) ParamDescription {
+	param := ParamDescription{
+		Name:     arg.Key(),
+		Required: !arg.Optional(),
+	}
+	switch v := arg.(type) {
+	case ArgSeries:
+		param.Type = "series"
+	case ArgSeriesList:
+		param.Type = "seriesList"
+	case ArgSeriesLists:
+		param.Type = "seriesLists"
+		param.Multiple = true
+	case ArgInt:
+		param.Type = "integer"
+		param.Default = *v.val
+	case ArgInts:
+		param.Type = "integer"
+		param.Multiple = true
+	case ArgFloat:
+		param.Type = "float"
+		if !math.IsNaN(*v.val) {
+			param.Default = *v.val
+		}
+	case ArgString:
+		param.Type = stringType(v.validator)
+		if *v.val != "" {
+			param.Default = *v.val
+		}
+	case ArgStrings:
+		param.Type = "string"
+		param.Multiple = true
+	case ArgRegex:
+		param.Type = "string"
+	case ArgBool:
+		param.Type = "boolean"
+		param.Default = *v.val
+	case ArgStringsOrInts:
+		param.Type = "nodeOrTag"
+		param.Multiple = true
+	case ArgIn:
+		param.Type = "any"
+	}
+	if param.Name == "" {
+		param.Name = param.Type
+	}
+	if param.Required {
+		param.Default = nil
+	}
+	return param
+}
+
+// stringType returns the graphite type of a string arg, based on its validators
+func stringType(validators []Validator) string {
+	is := func(a, b Validator) bool {
+		return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+	}
+	for _, va := range validators {
+		switch {
+		case is(va, IsIntervalString), is(va, IsSignedIntervalString):
+			return "interval"
+		case is(va, IsAggFunc), is(va, IsConsolFunc):
+			return "aggFunc"
+		}
+	}
+	return "string"
+}
+
+// pythonRepr formats the value like python would, as graphite-web shows defaults in its signatures
+func pythonRepr(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return "'" + v + "'"
+	case bool:
+		if v {
+			return "True"
+		}
+		return "False"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,77 @@
+package expr
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDescribeAll(t *testing.T) {
+	all := Describe(false)
+	if len(all) != len(funcs) {
+		t.Fatalf("expected %d functions, got %d", len(funcs), len(all))
+	}
+	for name, desc := range all {
+		if desc.Name != name {
+			t.Fatalf("function %q has name %q", name, desc.Name)
+		}
+		if desc.Group == "" {
+			t.Fatalf("function %q has no group", name)
+		}
+		for i, p := range desc.Params {
+			if p.Name == "" || p.Type == "" {
+				t.Fatalf("function %q: param %d has no name or type: %v", name, i, p)
+			}
+		}
+	}
+
+	stable := Describe(true)
+	if _, ok := stable["movingAverage"]; ok {
+		t.Fatalf("expected unstable function movingAverage to not be described when stable")
+	}
+	if _, ok := all["movingAverage"]; !ok {
+		t.Fatalf("expected unstable function movingAverage to be described when not stable")
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	cases := []struct {
+		name     string
+		function string
+		json     string
+	}{
+		{
+			"summarize",
+			"summarize(seriesList, intervalString, func='sum', alignToFrom=False)",
+			`{"name":"summarize","function":"summarize(seriesList, intervalString, func='sum', alignToFrom=False)","group":"Transform","params":[{"name":"seriesList","type":"seriesList","required":true},{"name":"intervalString","type":"interval","required":true},{"name":"func","type":"aggFunc","default":"sum"},{"name":"alignToFrom","type":"boolean","default":false}]}`,
+		},
+		{
+			"sumSeries",
+			"sumSeries(*seriesLists)",
+			`{"name":"sumSeries","function":"sumSeries(*seriesLists)","group":"Combine","params":[{"name":"seriesLists","type":"seriesLists","required":true,"multiple":true}]}`,
+		},
+		{
+			"timeStack",
+			"timeStack(seriesList, timeShiftUnit='1d', timeShiftStart=0, timeShiftEnd=7)",
+			`{"name":"timeStack","function":"timeStack(seriesList, timeShiftUnit='1d', timeShiftStart=0, timeShiftEnd=7)","group":"Transform","params":[{"name":"seriesList","type":"seriesList","required":true},{"name":"timeShiftUnit","type":"interval","default":"1d"},{"name":"timeShiftStart","type":"integer","default":0},{"name":"timeShiftEnd","type":"integer","default":7}]}`,
+		},
+		{
+			"transformNull",
+			"transformNull(seriesList, default=None)",
+			`{"name":"transformNull","function":"transformNull(seriesList, default=None)","group":"Transform","params":[{"name":"seriesList","type":"seriesList","required":true},{"name":"default","type":"float"}]}`,
+		},
+	}
+	descs := Describe(true)
+	for _, c := range cases {
+		desc := descs[c.name]
+		if desc.Function != c.function {
+			t.Fatalf("%s: expected function %q, got %q", c.name, c.function, desc.Function)
+		}
+		out, err := json.Marshal(desc)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if string(out) != c.json {
+			t.Fatalf("%s: expected json\n%s\ngot\n%s", c.name, c.json, out)
+		}
+	}
+}
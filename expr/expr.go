@@ -3,6 +3,7 @@ package expr
 import (
 	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -55,6 +56,45 @@ func (e expr) Print(indent int) string {
 	return "HUH-SHOULD-NEVER-HAPPEN"
 }
 
+// Explain is like Print, but more compact, and it marks each function call with how it would be executed:
+// "native" (by metrictank), "unstable" (by metrictank, but only when non-stable functions are allowed)
+// or "graphite" (unknown to metrictank, so the query must be proxied to graphite).
+// series that will need to be fetched are marked with "fetch"
+func (e expr) Explain(indent int) string {
+	space := strings.Repeat(" ", indent)
+	switch e.etype {
+	case etName:
+		return fmt.Sprintf("%s%s (fetch)", space, e.str)
+	case etFunc:
+		if e.str == "seriesByTag" {
+			return fmt.Sprintf("%sseriesByTag(%s) (fetch)", space, e.argsStr)
+		}
+		kind := "graphite"
+		if fdef, ok := funcs[e.str]; ok {
+			kind = "native"
+			if !fdef.stable {
+				kind = "unstable"
+			}
+		}
+		out := fmt.Sprintf("%s%s (%s)", space, e.str, kind)
+		for _, a := range e.args {
+			out += "\n" + a.Explain(indent+2)
+		}
+		keys := make([]string, 0, len(e.namedArgs))
+		for k := range e.namedArgs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			out += "\n" + space + "  " + k + "=" + e.namedArgs[k].Explain(0)
+		}
+		return out
+	case etString:
+		return fmt.Sprintf("%s%q", space, e.str)
+	}
+	return space + e.str
+}
+
 // consumeBasicArg verifies that the argument at given pos matches the expected arg
 // it's up to the caller to assure that given pos is valid before calling.
 // if arg allows for multiple arguments, pos is advanced to cover all accepted arguments.
@@ -171,6 +211,23 @@ func (e expr) consumeBasicArg(pos int, exp Arg) (int, error) {
 			*v.val = append(*v.val, *e.args[pos])
 		}
 		return pos, nil
+	case ArgIn:
+		if v.opt && got.etype == etName && got.str == "None" {
+			// explicitly not given, e.g. to be able to specify subsequent args
+			break
+		}
+		for _, a := range v.args {
+			// note: series args are only validated here. they are set up by consumeSeriesArg
+			next, err := e.consumeBasicArg(pos, a)
+			if err == nil {
+				return next, nil
+			}
+		}
+		expected := make([]string, len(v.args))
+		for i, a := range v.args {
+			expected[i] = strings.TrimPrefix(fmt.Sprintf("%T", a), "expr.Arg")
+		}
+		return 0, ErrBadArgumentStr{strings.Join(expected, " or "), got.etype.String()}
 	default:
 		return 0, fmt.Errorf("unsupported type %T for consumeBasicArg", exp)
 	}
@@ -233,6 +290,19 @@ func (e expr) consumeSeriesArg(pos int, exp Arg, context Context, stable bool, r
 			}
 			*v.val = append(*v.val, fn)
 		}
+	case ArgIn:
+		if v.opt && got.etype == etName && got.str == "None" {
+			break
+		}
+		for _, a := range v.args {
+			switch a.(type) {
+			case ArgSeries, ArgSeriesList, ArgSeriesLists:
+				if got.etype == etName || got.etype == etFunc {
+					return e.consumeSeriesArg(pos, a, context, stable, reqs)
+				}
+			}
+		}
+		// the arg is not a series, so consumeBasicArg already consumed it
 	default:
 		return 0, nil, fmt.Errorf("unsupported type %T for consumeSeriesArg", exp)
 	}
@@ -289,6 +359,18 @@ func (e expr) consumeKwarg(key string, optArgs []Arg) error {
 			}
 		}
 		return ErrBadKwarg{key, exp, got.etype}
+	case ArgIn:
+		for _, a := range v.args {
+			switch a.(type) {
+			case ArgSeries, ArgSeriesList, ArgSeriesLists:
+				// series can't be given as keyword arguments
+				continue
+			}
+			if err := e.consumeKwarg(key, []Arg{a}); err == nil {
+				return nil
+			}
+		}
+		return ErrBadKwarg{key, exp, got.etype}
 	default:
 		return fmt.Errorf("unsupported type %T for consumeKwarg", exp)
 	}
@@ -16,7 +16,7 @@ func NewAlias() GraphiteFunc {
 func (s *FuncAlias) Signature() ([]Arg, []Arg) {
 	return []Arg{
 		ArgSeriesList{val: &s.in},
-		ArgString{val: &s.alias},
+		ArgString{key: "newName", val: &s.alias},
 	}, []Arg{ArgSeriesList{}}
 }
 
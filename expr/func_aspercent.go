@@ -0,0 +1,207 @@
+package expr
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/raintank/schema.v1"
+)
+
+type FuncAsPercent struct {
+	in          GraphiteFunc
+	totalFloat  float64
+	totalSeries GraphiteFunc
+	nodes       []expr
+}
+
+func NewAsPercent() GraphiteFunc {
+	return &FuncAsPercent{totalFloat: math.NaN()}
+}
+
+func (s *FuncAsPercent) Signature() ([]Arg, []Arg) {
+	return []Arg{
+		ArgSeriesList{val: &s.in},
+		ArgIn{key: "total", opt: true, args: []Arg{
+			ArgFloat{key: "total", val: &s.totalFloat},
+			ArgSeriesList{key: "total", val: &s.totalSeries},
+		}},
+		ArgStringsOrInts{key: "nodes", opt: true, val: &s.nodes},
+	}, []Arg{ArgSeriesList{}}
+}
+
+func (s *FuncAsPercent) Context(context Context) Context {
+	return context
+}
+
+func (s *FuncAsPercent) Exec(cache map[Req][]models.Series) ([]models.Series, error) {
+	series, err := s.in.Exec(cache)
+	if err != nil {
+		return nil, err
+	}
+	var totals []models.Series
+	if s.totalSeries != nil {
+		totals, err = s.totalSeries.Exec(cache)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(s.nodes) > 0 {
+		if !math.IsNaN(s.totalFloat) {
+			return nil, errors.New("total must be None or a seriesList when nodes are given")
+		}
+		return s.execNodes(cache, series, totals), nil
+	}
+
+	var outputs []models.Series
+	switch {
+	case s.totalSeries != nil && len(totals) == len(series) && len(totals) != 1:
+		// each series is matched with the total of the same name
+		sort.Sort(models.SeriesByTarget(series))
+		sort.Sort(models.SeriesByTarget(totals))
+		for i, serie := range series {
+			outputs = append(outputs, asPercent(cache, serie, totals[i].Datapoints, totals[i].Target))
+		}
+	case s.totalSeries != nil:
+		if len(totals) != 1 {
+			return nil, errors.New("asPercent second argument must be missing, a single digit, reference exactly 1 series or reference the same number of series as the first argument")
+		}
+		for _, serie := range series {
+			outputs = append(outputs, asPercent(cache, serie, totals[0].Datapoints, totals[0].Target))
+		}
+	case !math.IsNaN(s.totalFloat):
+		name := strconv.FormatFloat(s.totalFloat, 'f', -1, 64)
+		for _, serie := range series {
+			total := make([]schema.Point, len(serie.Datapoints))
+			for i, p := range serie.Datapoints {
+				total[i] = schema.Point{Val: s.totalFloat, Ts: p.Ts}
+			}
+			outputs = append(outputs, asPercent(cache, serie, total, name))
+		}
+	default:
+		if len(series) == 0 {
+			return nil, nil
+		}
+		total := sumSeries(cache, series)
+		for _, serie := range series {
+			outputs = append(outputs, asPercent(cache, serie, total.Datapoints, total.Target))
+		}
+	}
+	return outputs, nil
+}
+
+// execNodes groups the series and totals by the nodes, and returns each series as a percentage of the sum of the totals of its group,
+// or of the sum of the series of its group if there are no totals
+func (s *FuncAsPercent) execNodes(cache map[Req][]models.Series, series, totals []models.Series) []models.Series {
+	groups := make(map[string][]models.Series)
+	for _, serie := range series {
+		key := aggKey(serie, s.nodes)
+		groups[key] = append(groups[key], serie)
+	}
+	totalGroups := groups
+	if s.totalSeries != nil {
+		totalGroups = make(map[string][]models.Series)
+		for _, serie := range totals {
+			key := aggKey(serie, s.nodes)
+			totalGroups[key] = append(totalGroups[key], serie)
+		}
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	for key := range totalGroups {
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var outputs []models.Series
+	for _, key := range keys {
+		totalGroup, ok := totalGroups[key]
+		if !ok {
+			// no total for these series: all their percentages are unknown
+			for _, serie := range groups[key] {
+				outputs = append(outputs, asPercent(cache, serie, nil, "MISSING"))
+			}
+			continue
+		}
+		// like graphite, the total of a group is named after its key
+		total := sumSeries(cache, totalGroup)
+		group, ok := groups[key]
+		if !ok {
+			// a total without series
+			missing := models.Series{
+				Target:       "MISSING",
+				Interval:     total.Interval,
+				Consolidator: total.Consolidator,
+				QueryCons:    total.QueryCons,
+			}
+			outputs = append(outputs, asPercent(cache, missing, total.Datapoints, key))
+			continue
+		}
+		for _, serie := range group {
+			outputs = append(outputs, asPercent(cache, serie, total.Datapoints, key))
+		}
+	}
+	return outputs
+}
+
+// sumSeries returns the sum of the series, named like sumSeries would name it
+func sumSeries(cache map[Req][]models.Series, in []models.Series) models.Series {
+	var queryPatts []string
+	seen := make(map[string]struct{})
+	for _, serie := range in {
+		if _, ok := seen[serie.QueryPatt]; !ok {
+			seen[serie.QueryPatt] = struct{}{}
+			queryPatts = append(queryPatts, serie.QueryPatt)
+		}
+	}
+	cons, queryCons := summarizeCons(in)
+	name := "sumSeries(" + strings.Join(queryPatts, ",") + ")"
+	out := models.Series{
+		Target:       name,
+		QueryPatt:    name,
+		Interval:     in[0].Interval,
+		Consolidator: cons,
+		QueryCons:    queryCons,
+		Datapoints:   pointSlicePool.Get().([]schema.Point),
+	}
+	crossSeriesSum(in, &out.Datapoints)
+	cache[Req{}] = append(cache[Req{}], out)
+	return out
+}
+
+// asPercent returns the series as a percentage of the total. where the total is missing, null or 0, the percentage is null.
+// if the series is missing (it has no datapoints), the points of the total are used as timestamps, with null values
+func asPercent(cache map[Req][]models.Series, serie models.Series, total []schema.Point, totalName string) models.Series {
+	points := serie.Datapoints
+	if points == nil {
+		points = total
+	}
+	out := pointSlicePool.Get().([]schema.Point)
+	for i, p := range points {
+		p := schema.Point{Val: math.NaN(), Ts: p.Ts}
+		if serie.Datapoints != nil && i < len(total) && total[i].Val != 0 && !math.IsNaN(total[i].Val) {
+			p.Val = serie.Datapoints[i].Val / total[i].Val * 100
+		}
+		out = append(out, p)
+	}
+	name := fmt.Sprintf("asPercent(%s,%s)", serie.Target, totalName)
+	output := models.Series{
+		Target:       name,
+		QueryPatt:    name,
+		Tags:         map[string]string{"name": name},
+		Datapoints:   out,
+		Interval:     serie.Interval,
+		Consolidator: serie.Consolidator,
+		QueryCons:    serie.QueryCons,
+	}
+	cache[Req{}] = append(cache[Req{}], output)
+	return output
+}
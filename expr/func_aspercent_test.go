@@ -0,0 +1,168 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestAsPercentArgs(t *testing.T) {
+	from := uint32(1000)
+	to := uint32(2000)
+	cases := []struct {
+		in     string
+		expReq []Req
+		expErr bool
+	}{
+		{"asPercent(a.*)", []Req{NewReq("a.*", from, to, 0)}, false},
+		{"asPercent(a.*, 50)", []Req{NewReq("a.*", from, to, 0)}, false},
+		{"asPercent(a.*, 12.5)", []Req{NewReq("a.*", from, to, 0)}, false},
+		{"asPercent(a.*, total=50)", []Req{NewReq("a.*", from, to, 0)}, false},
+		{"asPercent(a.*, b.*)", []Req{NewReq("a.*", from, to, 0), NewReq("b.*", from, to, 0)}, false},
+		{"asPercent(a.*, sumSeries(b.*), 1)", []Req{NewReq("a.*", from, to, 0), NewReq("b.*", from, to, 0)}, false},
+		{"asPercent(a.*, None, 1, 'dc')", []Req{NewReq("a.*", from, to, 0)}, false},
+		{"asPercent(a.*, 'b')", nil, true},
+		{"asPercent(a.*, total='b')", nil, true},
+	}
+	for _, c := range cases {
+		exprs, err := ParseMany([]string{c.in})
+		if err != nil {
+			t.Fatalf("%q: %s", c.in, err)
+		}
+		plan, err := NewPlan(exprs, from, to, 800, true, nil)
+		if (err != nil) != c.expErr {
+			t.Fatalf("%q: expected error %t, got %v", c.in, c.expErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(plan.Reqs, c.expReq) {
+			t.Fatalf("%q: expected reqs %v, got %v", c.in, c.expReq, plan.Reqs)
+		}
+	}
+}
+
+func asPercentInput(name string, vals ...float64) models.Series {
+	s := models.Series{Target: name, QueryPatt: name, Interval: 10}
+	for i, v := range vals {
+		s.Datapoints = append(s.Datapoints, schema.Point{Val: v, Ts: uint32(10 * (i + 1))})
+	}
+	return s
+}
+
+func TestAsPercent(t *testing.T) {
+	nan := math.NaN()
+	cases := []struct {
+		name   string
+		in     []models.Series
+		fn     func(f *FuncAsPercent)
+		expErr bool
+		exp    []models.Series
+	}{
+		{
+			name: "no total",
+			in:   []models.Series{asPercentInput("a.x", 1, 0, nan), asPercentInput("a.y", 3, 0, 2)},
+			fn:   func(f *FuncAsPercent) {},
+			exp: []models.Series{
+				asPercentInput("asPercent(a.x,sumSeries(a.x,a.y))", 25, nan, nan),
+				asPercentInput("asPercent(a.y,sumSeries(a.x,a.y))", 75, nan, 100),
+			},
+		},
+		{
+			name: "number",
+			in:   []models.Series{asPercentInput("a.x", 1, nan)},
+			fn:   func(f *FuncAsPercent) { f.totalFloat = 4 },
+			exp:  []models.Series{asPercentInput("asPercent(a.x,4)", 25, nan)},
+		},
+		{
+			name: "zero",
+			in:   []models.Series{asPercentInput("a.x", 1)},
+			fn:   func(f *FuncAsPercent) { f.totalFloat = 0 },
+			exp:  []models.Series{asPercentInput("asPercent(a.x,0)", nan)},
+		},
+		{
+			name: "single total series",
+			in:   []models.Series{asPercentInput("a.x", 1, 2), asPercentInput("a.y", 3, 4)},
+			fn:   func(f *FuncAsPercent) { f.totalSeries = NewMock([]models.Series{asPercentInput("b", 4, 0)}) },
+			exp: []models.Series{
+				asPercentInput("asPercent(a.x,b)", 25, nan),
+				asPercentInput("asPercent(a.y,b)", 75, nan),
+			},
+		},
+		{
+			name: "total series matched by name",
+			in:   []models.Series{asPercentInput("a.y", 1), asPercentInput("a.x", 1)},
+			fn: func(f *FuncAsPercent) {
+				f.totalSeries = NewMock([]models.Series{asPercentInput("b.x", 2), asPercentInput("b.y", 4)})
+			},
+			exp: []models.Series{
+				asPercentInput("asPercent(a.x,b.x)", 50),
+				asPercentInput("asPercent(a.y,b.y)", 25),
+			},
+		},
+		{
+			name: "different number of totals",
+			in:   []models.Series{asPercentInput("a.x", 1), asPercentInput("a.y", 1), asPercentInput("a.z", 1)},
+			fn: func(f *FuncAsPercent) {
+				f.totalSeries = NewMock([]models.Series{asPercentInput("b.x", 2), asPercentInput("b.y", 4)})
+			},
+			expErr: true,
+		},
+		{
+			name: "nodes without total",
+			in:   []models.Series{asPercentInput("a.x.in", 1), asPercentInput("a.x.out", 3), asPercentInput("a.y.in", 5)},
+			fn:   func(f *FuncAsPercent) { f.nodes = []expr{{etype: etInt, int: 1}} },
+			exp: []models.Series{
+				asPercentInput("asPercent(a.x.in,x)", 25),
+				asPercentInput("asPercent(a.x.out,x)", 75),
+				asPercentInput("asPercent(a.y.in,y)", 100),
+			},
+		},
+		{
+			name: "nodes with totals",
+			in:   []models.Series{asPercentInput("a.x.in", 1), asPercentInput("a.y.in", 5)},
+			fn: func(f *FuncAsPercent) {
+				f.nodes = []expr{{etype: etInt, int: 1}}
+				f.totalSeries = NewMock([]models.Series{asPercentInput("b.x.total", 2), asPercentInput("b.x.other", 2), asPercentInput("b.z.total", 8)})
+			},
+			exp: []models.Series{
+				asPercentInput("asPercent(a.x.in,x)", 25),
+				asPercentInput("asPercent(a.y.in,MISSING)", nan),
+				asPercentInput("asPercent(MISSING,z)", nan),
+			},
+		},
+		{
+			name:   "nodes with number",
+			in:     []models.Series{asPercentInput("a.x.in", 1)},
+			fn:     func(f *FuncAsPercent) { f.nodes = []expr{{etype: etInt, int: 1}}; f.totalFloat = 2 },
+			expErr: true,
+		},
+	}
+	for _, c := range cases {
+		f := NewAsPercent().(*FuncAsPercent)
+		f.in = NewMock(c.in)
+		c.fn(f)
+		got, err := f.Exec(make(map[Req][]models.Series))
+		if (err != nil) != c.expErr {
+			t.Fatalf("case %q: expected error %t, got %v", c.name, c.expErr, err)
+		}
+		if len(got) != len(c.exp) {
+			t.Fatalf("case %q: expected %d series, got %d", c.name, len(c.exp), len(got))
+		}
+		for i, g := range got {
+			exp := c.exp[i]
+			if g.Target != exp.Target {
+				t.Fatalf("case %q: expected series %d to be %q, got %q", c.name, i, exp.Target, g.Target)
+			}
+			if len(g.Datapoints) != len(exp.Datapoints) {
+				t.Fatalf("case %q: series %q: expected %d points, got %d", c.name, g.Target, len(exp.Datapoints), len(g.Datapoints))
+			}
+			for j, p := range g.Datapoints {
+				e := exp.Datapoints[j]
+				if p.Ts != e.Ts || !(p.Val == e.Val || math.IsNaN(p.Val) && math.IsNaN(e.Val)) {
+					t.Fatalf("case %q: series %q: expected point %d to be %v, got %v", c.name, g.Target, j, e, p)
+				}
+			}
+		}
+	}
+}
@@ -19,7 +19,7 @@ func NewConsolidateBy() GraphiteFunc {
 func (s *FuncConsolidateBy) Signature() ([]Arg, []Arg) {
 	return []Arg{
 		ArgSeriesList{val: &s.in},
-		ArgString{val: &s.by, validator: []Validator{IsConsolFunc}},
+		ArgString{key: "consolidationFunc", val: &s.by, validator: []Validator{IsConsolFunc}},
 	}, []Arg{ArgSeriesList{}}
 }
 
@@ -20,8 +20,8 @@ func NewDivideSeries() GraphiteFunc {
 
 func (s *FuncDivideSeries) Signature() ([]Arg, []Arg) {
 	return []Arg{
-		ArgSeriesList{val: &s.dividend},
-		ArgSeries{val: &s.divisor},
+		ArgSeriesList{key: "dividendSeriesList", val: &s.dividend},
+		ArgSeries{key: "divisorSeries", val: &s.divisor},
 	}, []Arg{ArgSeries{}}
 }
 
@@ -20,8 +20,8 @@ func NewDivideSeriesLists() GraphiteFunc {
 
 func (s *FuncDivideSeriesLists) Signature() ([]Arg, []Arg) {
 	return []Arg{
-		ArgSeriesList{val: &s.dividends},
-		ArgSeriesList{val: &s.divisors},
+		ArgSeriesList{key: "dividendSeriesList", val: &s.dividends},
+		ArgSeriesList{key: "divisorSeriesList", val: &s.divisors},
 	}, []Arg{ArgSeries{}}
 }
 
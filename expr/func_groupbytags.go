@@ -24,7 +24,7 @@ func (s *FuncGroupByTags) Signature() ([]Arg, []Arg) {
 	return []Arg{
 		ArgSeriesList{val: &s.in},
 		ArgString{val: &s.aggregator, validator: []Validator{IsAggFunc}},
-		ArgStrings{val: &s.tags},
+		ArgStrings{key: "tags", val: &s.tags},
 	}, []Arg{ArgSeries{}}
 }
 
@@ -43,16 +43,18 @@ func (s *FuncGroupByTags) Exec(cache map[Req][]models.Series) ([]models.Series,
 	}
 
 	groups := make(map[string][]models.Series)
+	var keys []string // in order of appearance, like graphite
 	useName := false
 
-	groupTags := s.tags
-	for i, tag := range groupTags {
+	// copy the tags, so we don't modify our arguments
+	groupTags := make([]string, 0, len(s.tags))
+	for _, tag := range s.tags {
 		if tag == "name" {
 			// We handle name explicitly, remove it from tags
 			useName = true
-			groupTags = append(groupTags[:i], groupTags[i+1:]...)
-			break
+			continue
 		}
+		groupTags = append(groupTags, tag)
 	}
 
 	nameReplace := ""
@@ -98,6 +100,9 @@ func (s *FuncGroupByTags) Exec(cache map[Req][]models.Series) ([]models.Series,
 
 		key := buffer.String()
 
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
 		groups[key] = append(groups[key], serie)
 	}
 
@@ -105,12 +110,13 @@ func (s *FuncGroupByTags) Exec(cache map[Req][]models.Series) ([]models.Series,
 	aggFunc := getCrossSeriesAggFunc(s.aggregator)
 
 	// Now, for each key perform the requested aggregation
-	for name, groupSeries := range groups {
-		cons, queryCons := summarizeCons(series)
+	for _, name := range keys {
+		groupSeries := groups[name]
+		cons, queryCons := summarizeCons(groupSeries)
 		newSeries := models.Series{
 			Target:       name,
 			QueryPatt:    name,
-			Interval:     series[0].Interval,
+			Interval:     groupSeries[0].Interval,
 			Consolidator: cons,
 			QueryCons:    queryCons,
 		}
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/consolidation"
 	"github.com/grafana/metrictank/test"
 	schema "gopkg.in/raintank/schema.v1"
 )
@@ -199,6 +200,41 @@ func TestGroupByTagsAllAggregators(t *testing.T) {
 	}
 }
 
+func TestGroupByTagsOrderAndConsolidator(t *testing.T) {
+	in := []models.Series{
+		getModel("name1;dc=b;tag1=val1", a),
+		getModel("name1;dc=a;tag1=val1", b),
+		getModel("name1;dc=b;tag1=val2", c),
+	}
+	in[1].Consolidator, in[1].QueryCons = consolidation.Max, consolidation.Max
+	tags := []string{"name", "dc"}
+
+	f := NewGroupByTags()
+	gby := f.(*FuncGroupByTags)
+	gby.in = NewMock(in)
+	gby.aggregator = "sum"
+	gby.tags = tags
+
+	// run it twice, to make sure we don't change our arguments
+	for run := 0; run < 2; run++ {
+		got, err := f.Exec(make(map[Req][]models.Series))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// groups are returned in the order in which they first appear, like graphite does
+		if len(got) != 2 || got[0].Target != "name1;dc=b" || got[1].Target != "name1;dc=a" {
+			t.Fatalf("run %d: expected groups name1;dc=b and name1;dc=a, got %v", run, got)
+		}
+		// the consolidator of a group only depends on its own series
+		if got[0].QueryCons != 0 || got[1].QueryCons != consolidation.Max {
+			t.Fatalf("run %d: expected query consolidators 0 and max, got %s and %s", run, got[0].QueryCons, got[1].QueryCons)
+		}
+		if tags[0] != "name" || tags[1] != "dc" {
+			t.Fatalf("run %d: expected the tags argument not to change, got %v", run, tags)
+		}
+	}
+}
+
 func testGroupByTags(name string, in []models.Series, out []models.Series, agg string, tags []string, expectedErr error, t *testing.T) {
 	f := NewGroupByTags()
 	gby := f.(*FuncGroupByTags)
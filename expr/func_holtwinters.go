@@ -0,0 +1,214 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/raintank/dur"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// FuncHoltWinters implements holtWintersForecast, holtWintersConfidenceBands and holtWintersAberration.
+// they all analyze their input starting bootstrapInterval before the requested timeframe,
+// so that the predictions in the requested timeframe are based on enough history.
+type FuncHoltWinters struct {
+	in                GraphiteFunc
+	fn                string
+	delta             float64
+	bootstrapInterval string
+	seasonality       string
+}
+
+func NewHoltWintersConstructor(fn string) func() GraphiteFunc {
+	return func() GraphiteFunc {
+		return &FuncHoltWinters{fn: fn, delta: 3, bootstrapInterval: "7d", seasonality: "1d"}
+	}
+}
+
+func (s *FuncHoltWinters) Signature() ([]Arg, []Arg) {
+	args := []Arg{
+		ArgSeriesList{val: &s.in},
+		ArgFloat{key: "delta", opt: true, val: &s.delta},
+		ArgString{key: "bootstrapInterval", opt: true, val: &s.bootstrapInterval, validator: []Validator{IsIntervalString}},
+		ArgString{key: "seasonality", opt: true, val: &s.seasonality, validator: []Validator{IsIntervalString}},
+	}
+	if s.fn == "holtWintersForecast" {
+		// the forecast itself doesn't need a delta
+		args = append(args[:1], args[2:]...)
+	}
+	return args, []Arg{ArgSeriesList{}}
+}
+
+func (s *FuncHoltWinters) Context(context Context) Context {
+	bootstrap, _ := dur.ParseDuration(s.bootstrapInterval)
+	if bootstrap > context.from {
+		context.from = 0
+	} else {
+		context.from -= bootstrap
+	}
+	return context
+}
+
+func (s *FuncHoltWinters) Exec(cache map[Req][]models.Series) ([]models.Series, error) {
+	series, err := s.in.Exec(cache)
+	if err != nil {
+		return nil, err
+	}
+	bootstrap, _ := dur.ParseDuration(s.bootstrapInterval)
+	seasonality, _ := dur.ParseDuration(s.seasonality)
+
+	var outputs []models.Series
+	for _, serie := range series {
+		numOutputs := len(outputs)
+		predictions, deviations := holtWintersAnalysis(serie, seasonality)
+		// skip the bootstrap points, we only needed them for the analysis.
+		// the series starts bootstrapInterval before the timeframe it was requested for, whichever context that was
+		start := len(serie.Datapoints)
+		for i, p := range serie.Datapoints {
+			if p.Ts >= serie.Datapoints[0].Ts+bootstrap {
+				start = i
+				break
+			}
+		}
+
+		switch s.fn {
+		case "holtWintersForecast":
+			outputs = append(outputs, s.newSeries(serie, "holtWintersForecast", predictions[start:]))
+		case "holtWintersConfidenceBands":
+			lower, upper := s.bands(predictions[start:], deviations[start:])
+			outputs = append(outputs, s.newSeries(serie, "holtWintersConfidenceLower", lower))
+			outputs = append(outputs, s.newSeries(serie, "holtWintersConfidenceUpper", upper))
+		case "holtWintersAberration":
+			lower, upper := s.bands(predictions[start:], deviations[start:])
+			aberration := make([]float64, len(lower))
+			for i, p := range serie.Datapoints[start:] {
+				switch {
+				case math.IsNaN(p.Val):
+					aberration[i] = 0
+				case !math.IsNaN(upper[i]) && p.Val > upper[i]:
+					aberration[i] = p.Val - upper[i]
+				case !math.IsNaN(lower[i]) && p.Val < lower[i]:
+					aberration[i] = p.Val - lower[i]
+				}
+			}
+			outputs = append(outputs, s.newSeries(serie, "holtWintersAberration", aberration))
+		}
+		for _, o := range outputs[numOutputs:] {
+			cache[Req{}] = append(cache[Req{}], o)
+		}
+	}
+	return outputs, nil
+}
+
+// bands returns the lower and upper confidence bands: the predictions minus/plus delta times the deviations
+func (s *FuncHoltWinters) bands(predictions, deviations []float64) ([]float64, []float64) {
+	lower := make([]float64, len(predictions))
+	upper := make([]float64, len(predictions))
+	for i := range predictions {
+		// NaN predictions or deviations result in NaN bands
+		lower[i] = predictions[i] - s.delta*deviations[i]
+		upper[i] = predictions[i] + s.delta*deviations[i]
+	}
+	return lower, upper
+}
+
+// newSeries returns the given values as a new series named fn(<input>), with the timestamps of the input series
+// starting at the requested from
+func (s *FuncHoltWinters) newSeries(in models.Series, fn string, vals []float64) models.Series {
+	out := pointSlicePool.Get().([]schema.Point)
+	points := in.Datapoints[len(in.Datapoints)-len(vals):]
+	for i, v := range vals {
+		out = append(out, schema.Point{Val: v, Ts: points[i].Ts})
+	}
+	tags := make(map[string]string, len(in.Tags)+1)
+	for k, v := range in.Tags {
+		tags[k] = v
+	}
+	tags[fn] = "1"
+	return models.Series{
+		Target:       fmt.Sprintf("%s(%s)", fn, in.Target),
+		QueryPatt:    fmt.Sprintf("%s(%s)", fn, in.QueryPatt),
+		Tags:         tags,
+		Datapoints:   out,
+		Interval:     in.Interval,
+		Consolidator: in.Consolidator,
+		QueryCons:    in.QueryCons,
+	}
+}
+
+// holtWintersAnalysis performs a triple exponential smoothing of the series, like graphite does,
+// and returns the predictions and the deviations for each of its points.
+// missing values and unknown predictions are NaN.
+func holtWintersAnalysis(serie models.Series, seasonality uint32) ([]float64, []float64) {
+	const alpha, beta, gamma = 0.1, 0.0035, 0.1
+
+	seasonLength := 1
+	if serie.Interval > 0 && serie.Interval <= seasonality {
+		seasonLength = int(seasonality / serie.Interval)
+	}
+
+	n := len(serie.Datapoints)
+	intercepts := make([]float64, n)
+	slopes := make([]float64, n)
+	seasonals := make([]float64, n)
+	predictions := make([]float64, n)
+	deviations := make([]float64, n)
+
+	// lastSeason returns the value of the previous season for point i, if there is one
+	lastSeason := func(vals []float64, i int) float64 {
+		if j := i - seasonLength; j >= 0 {
+			return vals[j]
+		}
+		return 0
+	}
+
+	nextPred := math.NaN()
+	for i, p := range serie.Datapoints {
+		actual := p.Val
+		if math.IsNaN(actual) {
+			// missing input values break all the math
+			// do the best we can and move on
+			intercepts[i] = math.NaN()
+			predictions[i] = nextPred
+			nextPred = math.NaN()
+			continue
+		}
+
+		var lastIntercept, lastSlope, prediction float64
+		if i == 0 {
+			lastIntercept = actual
+			// seed the first prediction as the first actual
+			prediction = actual
+		} else {
+			lastIntercept = intercepts[i-1]
+			lastSlope = slopes[i-1]
+			if math.IsNaN(lastIntercept) {
+				lastIntercept = actual
+			}
+			prediction = nextPred
+		}
+
+		lastSeasonal := lastSeason(seasonals, i)
+		nextLastSeasonal := lastSeason(seasonals, i+1)
+		lastSeasonalDev := lastSeason(deviations, i)
+
+		intercept := alpha*(actual-lastSeasonal) + (1-alpha)*(lastIntercept+lastSlope)
+		slope := beta*(intercept-lastIntercept) + (1-beta)*lastSlope
+		seasonal := gamma*(actual-intercept) + (1-gamma)*lastSeasonal
+		nextPred = intercept + slope + nextLastSeasonal
+
+		predictionOrZero := prediction
+		if math.IsNaN(predictionOrZero) {
+			predictionOrZero = 0
+		}
+		deviation := gamma*math.Abs(actual-predictionOrZero) + (1-gamma)*lastSeasonalDev
+
+		intercepts[i] = intercept
+		slopes[i] = slope
+		seasonals[i] = seasonal
+		predictions[i] = prediction
+		deviations[i] = deviation
+	}
+	return predictions, deviations
+}
@@ -0,0 +1,193 @@
+package expr
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// the values as computed by graphite's holtWintersAnalysis, for the input below and a season of 4 points
+var hwInput = []float64{1, 4, 2, 5, math.NaN(), 3, 6, 2, math.NaN(), math.NaN(), 4, 7}
+var hwPredictions = []float64{1, 1.0, 1.30105, 1.3722396325000001, 1.7375800178786251, math.NaN(), 3.0358110000000003, 3.5967657992250004, 3.1109748843477716, math.NaN(), math.NaN(), 4.14970587126625}
+var hwDeviations = []float64{0.0, 0.30000000000000004, 0.069895, 0.36277603675, 0, 0.5700000000000001, 0.3593244, 0.48617501299750004, 0, 0, 0.7233919600000001, 0.7225869245711249}
+
+func hwSeries(from uint32) models.Series {
+	serie := models.Series{
+		Target:    "a",
+		QueryPatt: "a",
+		Interval:  10,
+		Tags:      map[string]string{"name": "a"},
+	}
+	for i, v := range hwInput {
+		serie.Datapoints = append(serie.Datapoints, schema.Point{Val: v, Ts: from + uint32(10*i)})
+	}
+	return serie
+}
+
+func hwEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestHoltWintersAnalysis(t *testing.T) {
+	predictions, deviations := holtWintersAnalysis(hwSeries(10), 40)
+	for i := range hwInput {
+		if !hwEqual(predictions[i], hwPredictions[i]) {
+			t.Fatalf("point %d: expected prediction %v, got %v", i, hwPredictions[i], predictions[i])
+		}
+		if !hwEqual(deviations[i], hwDeviations[i]) {
+			t.Fatalf("point %d: expected deviation %v, got %v", i, hwDeviations[i], deviations[i])
+		}
+	}
+}
+
+func TestHoltWintersArgs(t *testing.T) {
+	from := uint32(1000000)
+	to := uint32(1003600)
+	week := uint32(7 * 24 * 3600)
+	cases := []struct {
+		in     string
+		expReq []Req
+		expErr bool
+	}{
+		{`holtWintersForecast(a)`, []Req{NewReq("a", from-week, to, 0)}, false},
+		{`holtWintersForecast(a, "1h")`, []Req{NewReq("a", from-3600, to, 0)}, false},
+		{`holtWintersForecast(a, "1h", "10min")`, []Req{NewReq("a", from-3600, to, 0)}, false},
+		{`holtWintersForecast(a, 3)`, nil, true},
+		{`holtWintersConfidenceBands(a)`, []Req{NewReq("a", from-week, to, 0)}, false},
+		{`holtWintersConfidenceBands(a, 2.5, "1h")`, []Req{NewReq("a", from-3600, to, 0)}, false},
+		{`holtWintersAberration(a, bootstrapInterval="2d")`, []Req{NewReq("a", from-2*24*3600, to, 0)}, false},
+		{`holtWintersAberration(a, 3, "foo")`, nil, true},
+	}
+	for _, c := range cases {
+		exprs, err := ParseMany([]string{c.in})
+		if err != nil {
+			t.Fatalf("%q: %s", c.in, err)
+		}
+		plan, err := NewPlan(exprs, from, to, 800, true, nil)
+		if (err != nil) != c.expErr {
+			t.Fatalf("%q: expected error %t, got %v", c.in, c.expErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(plan.Reqs, c.expReq) {
+			t.Fatalf("%q: expected reqs %v, got %v", c.in, c.expReq, plan.Reqs)
+		}
+	}
+}
+
+func TestHoltWinters(t *testing.T) {
+	// the first 4 points are the bootstrap
+	from := uint32(1040)
+	to := uint32(1120)
+	bands := func(sign float64) []float64 {
+		var out []float64
+		for i := range hwPredictions {
+			out = append(out, hwPredictions[i]+sign*3*hwDeviations[i])
+		}
+		return out
+	}
+	lower, upper := bands(-1), bands(1)
+	aberration := make([]float64, len(hwInput))
+	for i, v := range hwInput {
+		if v > upper[i] {
+			aberration[i] = v - upper[i]
+		} else if v < lower[i] {
+			aberration[i] = v - lower[i]
+		}
+	}
+
+	cases := []struct {
+		target string
+		exp    map[string][]float64
+	}{
+		{`holtWintersForecast(a, "40s", "40s")`, map[string][]float64{
+			"holtWintersForecast(a)": hwPredictions,
+		}},
+		{`holtWintersConfidenceBands(a, 3, "40s", "40s")`, map[string][]float64{
+			"holtWintersConfidenceLower(a)": lower,
+			"holtWintersConfidenceUpper(a)": upper,
+		}},
+		{`holtWintersAberration(a, 3, "40s", "40s")`, map[string][]float64{
+			"holtWintersAberration(a)": aberration,
+		}},
+	}
+	for _, c := range cases {
+		exprs, err := ParseMany([]string{c.target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := NewPlan(exprs, from, to, 800, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := map[Req][]models.Series{
+			plan.Reqs[0]: {hwSeries(plan.Reqs[0].From)},
+		}
+		out, err := plan.Run(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(c.exp) {
+			t.Fatalf("%q: expected %d series, got %d", c.target, len(c.exp), len(out))
+		}
+		for _, o := range out {
+			exp, ok := c.exp[o.Target]
+			if !ok {
+				t.Fatalf("%q: unexpected output %q", c.target, o.Target)
+			}
+			if len(o.Datapoints) != 8 {
+				t.Fatalf("%q: %q: expected 8 points, got %d", c.target, o.Target, len(o.Datapoints))
+			}
+			for i, p := range o.Datapoints {
+				if p.Ts != from+uint32(10*i) || !hwEqual(p.Val, exp[i+4]) {
+					t.Fatalf("%q: %q: expected point %d to be %v@%d, got %v@%d", c.target, o.Target, i, exp[i+4], from+uint32(10*i), p.Val, p.Ts)
+				}
+			}
+		}
+	}
+}
+
+func TestHoltWintersShifted(t *testing.T) {
+	from := uint32(100040)
+	to := uint32(100120)
+	targets := []string{
+		`timeShift(holtWintersForecast(a, "40s", "40s"), "1000s")`,
+		`timeStack(holtWintersForecast(a, "40s", "40s"), "1000s", 0, 3)`,
+	}
+	for _, target := range targets {
+		exprs, err := ParseMany([]string{target})
+		if err != nil {
+			t.Fatal(err)
+		}
+		plan, err := NewPlan(exprs, from, to, 800, true, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		input := make(map[Req][]models.Series)
+		for _, req := range plan.Reqs {
+			input[req] = []models.Series{hwSeries(req.From)}
+		}
+		out, err := plan.Run(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(plan.Reqs) {
+			t.Fatalf("%q: expected %d series, got %d", target, len(plan.Reqs), len(out))
+		}
+		// every shift analyzes its own bootstrap window, and is shifted back into the requested timeframe
+		for _, o := range out {
+			if len(o.Datapoints) != 8 {
+				t.Fatalf("%q: %q: expected 8 points, got %d", target, o.Target, len(o.Datapoints))
+			}
+			for i, p := range o.Datapoints {
+				if p.Ts != from+uint32(10*i) || !hwEqual(p.Val, hwPredictions[i+4]) {
+					t.Fatalf("%q: %q: expected point %d to be %v@%d, got %v@%d", target, o.Target, i, hwPredictions[i+4], from+uint32(10*i), p.Val, p.Ts)
+				}
+			}
+		}
+	}
+}
@@ -23,7 +23,7 @@ func (s *FuncMovingAverage) Signature() ([]Arg, []Arg) {
 		// and request from -= interval * points
 		// interestingly the from adjustment might mean the archive TTL is no longer sufficient and push the request into a different rollup archive, which we should probably
 		// account for. let's solve all of this later.
-		ArgInt{val: &s.window},
+		ArgInt{key: "windowSize", val: &s.window},
 	}, []Arg{ArgSeriesList{}}
 }
 
@@ -0,0 +1,107 @@
+package expr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/raintank/dur"
+	"gopkg.in/raintank/schema.v1"
+)
+
+type FuncTimeShift struct {
+	in        GraphiteFunc
+	timeShift string
+	resetEnd  bool
+	alignDST  bool
+	shift     int64
+}
+
+func NewTimeShift() GraphiteFunc {
+	return &FuncTimeShift{resetEnd: true}
+}
+
+func (s *FuncTimeShift) Signature() ([]Arg, []Arg) {
+	return []Arg{
+		ArgSeriesList{val: &s.in},
+		ArgString{key: "timeShift", val: &s.timeShift, validator: []Validator{IsSignedIntervalString}},
+		// we always fetch exactly the shifted range, so the output never extends past the end of the request
+		ArgBool{key: "resetEnd", opt: true, val: &s.resetEnd},
+		// we shift by absolute amounts of time, so daylight saving time is never accounted for
+		ArgBool{key: "alignDST", opt: true, val: &s.alignDST},
+	}, []Arg{ArgSeriesList{}}
+}
+
+func (s *FuncTimeShift) Context(context Context) Context {
+	s.shift, _ = parseSignedInterval(s.timeShift)
+	return shiftContext(context, s.shift)
+}
+
+func (s *FuncTimeShift) Exec(cache map[Req][]models.Series) ([]models.Series, error) {
+	series, err := s.in.Exec(cache)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []models.Series
+	for _, serie := range series {
+		target := fmt.Sprintf("timeShift(%s, \"%s\")", serie.Target, s.timeShift)
+		queryPatt := fmt.Sprintf("timeShift(%s, \"%s\")", serie.QueryPatt, s.timeShift)
+		output := shiftSeries(serie, s.shift, target, queryPatt)
+		output.Tags["timeShift"] = s.timeShift
+		outputs = append(outputs, output)
+		cache[Req{}] = append(cache[Req{}], output)
+	}
+	return outputs, nil
+}
+
+// parseSignedInterval parses an interval such as "1d", "+1h" or "-5min" into a number of seconds.
+// like in graphite, intervals without sign are in the past, so they are negative.
+func parseSignedInterval(str string) (int64, error) {
+	sign := int64(-1)
+	if strings.HasPrefix(str, "+") {
+		sign = 1
+		str = str[1:]
+	} else if strings.HasPrefix(str, "-") {
+		str = str[1:]
+	}
+	interval, err := dur.ParseDuration(str)
+	if err != nil {
+		return 0, err
+	}
+	return sign * int64(interval), nil
+}
+
+// shiftContext moves the timeframe of the context by the given amount of seconds
+func shiftContext(context Context, shift int64) Context {
+	shiftTs := func(ts uint32) uint32 {
+		if shift < 0 && uint32(-shift) > ts {
+			return 0
+		}
+		return uint32(int64(ts) + shift)
+	}
+	context.from = shiftTs(context.from)
+	context.to = shiftTs(context.to)
+	return context
+}
+
+// shiftSeries returns a copy of the series, moved back by the given shift,
+// such that data fetched for a shifted context lines up with the original timeframe.
+func shiftSeries(serie models.Series, shift int64, target, queryPatt string) models.Series {
+	out := pointSlicePool.Get().([]schema.Point)
+	for _, p := range serie.Datapoints {
+		out = append(out, schema.Point{Val: p.Val, Ts: uint32(int64(p.Ts) - shift)})
+	}
+	tags := make(map[string]string, len(serie.Tags)+1)
+	for k, v := range serie.Tags {
+		tags[k] = v
+	}
+	return models.Series{
+		Target:       target,
+		QueryPatt:    queryPatt,
+		Tags:         tags,
+		Datapoints:   out,
+		Interval:     serie.Interval,
+		Consolidator: serie.Consolidator,
+		QueryCons:    serie.QueryCons,
+	}
+}
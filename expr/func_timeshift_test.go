@@ -0,0 +1,118 @@
+package expr
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestTimeShiftArgs(t *testing.T) {
+	from := uint32(1000000)
+	to := uint32(1003600)
+	day := uint32(24 * 3600)
+	cases := []struct {
+		in     string
+		expReq []Req
+		expErr bool
+	}{
+		{`timeShift(a, "1d")`, []Req{NewReq("a", from-day, to-day, 0)}, false},
+		{`timeShift(a, "-1d")`, []Req{NewReq("a", from-day, to-day, 0)}, false},
+		{`timeShift(a, "+1h")`, []Req{NewReq("a", from+3600, to+3600, 0)}, false},
+		{`timeShift(a, "1d", false)`, []Req{NewReq("a", from-day, to-day, 0)}, false},
+		{`timeShift(a, "1d", alignDST=true)`, []Req{NewReq("a", from-day, to-day, 0)}, false},
+		{`sumSeries(a, timeShift(a, "1d"))`, []Req{NewReq("a", from, to, 0), NewReq("a", from-day, to-day, 0)}, false},
+		{`timeShift(a, "foo")`, nil, true},
+		{`timeStack(a, "1d", 0, 3)`, []Req{NewReq("a", from, to, 0), NewReq("a", from-day, to-day, 0), NewReq("a", from-2*day, to-2*day, 0)}, false},
+		{`timeStack(a, "+1h", 1, 2)`, []Req{NewReq("a", from+3600, to+3600, 0)}, false},
+		{`timeStack(a, timeShiftStart=2, timeShiftEnd=3)`, []Req{NewReq("a", from-2*day, to-2*day, 0)}, false},
+		{`timeStack(a, "1d", 3, 3)`, nil, false},
+		{`timeStack(a, "foo")`, nil, true},
+	}
+	for _, c := range cases {
+		exprs, err := ParseMany([]string{c.in})
+		if err != nil {
+			t.Fatalf("%q: %s", c.in, err)
+		}
+		plan, err := NewPlan(exprs, from, to, 800, true, nil)
+		if (err != nil) != c.expErr {
+			t.Fatalf("%q: expected error %t, got %v", c.in, c.expErr, err)
+		}
+		if err == nil && !reflect.DeepEqual(plan.Reqs, c.expReq) {
+			t.Fatalf("%q: expected reqs %v, got %v", c.in, c.expReq, plan.Reqs)
+		}
+	}
+}
+
+func TestTimeShiftExec(t *testing.T) {
+	from := uint32(100000)
+	to := uint32(100030)
+	exprs, err := ParseMany([]string{`timeShift(a, "1min")`, `timeStack(a, "+10s", 0, 2)`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := NewPlan(exprs, from, to, 800, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := make(map[Req][]models.Series)
+	for _, r := range plan.Reqs {
+		serie := models.Series{
+			Target:    "a",
+			QueryPatt: "a",
+			Interval:  10,
+			Tags:      map[string]string{"name": "a"},
+		}
+		for ts := r.From; ts < r.To; ts += 10 {
+			serie.Datapoints = append(serie.Datapoints, schema.Point{Val: float64(ts), Ts: ts})
+		}
+		input[r] = append(input[r], serie)
+	}
+	out, err := plan.Run(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []struct {
+		target string
+		shift  int
+		tags   map[string]string
+	}{
+		{`timeShift(a, "1min")`, -60, map[string]string{"name": "a", "timeShift": "1min"}},
+		{`timeShift(a, +10s, 0)`, 0, map[string]string{"name": "a", "timeShiftUnit": "+10s", "timeShift": "0"}},
+		{`timeShift(a, +10s, 1)`, 10, map[string]string{"name": "a", "timeShiftUnit": "+10s", "timeShift": "1"}},
+	}
+	if len(out) != len(exp) {
+		t.Fatalf("expected %d series, got %d", len(exp), len(out))
+	}
+	for i, e := range exp {
+		o := out[i]
+		if o.Target != e.target {
+			t.Fatalf("series %d: expected target %q, got %q", i, e.target, o.Target)
+		}
+		if !reflect.DeepEqual(o.Tags, e.tags) {
+			t.Fatalf("series %d: expected tags %v, got %v", i, e.tags, o.Tags)
+		}
+		if len(o.Datapoints) != 3 {
+			t.Fatalf("series %d: expected 3 points, got %d", i, len(o.Datapoints))
+		}
+		for j, p := range o.Datapoints {
+			// the values are the original timestamps, so they reveal where the data came from
+			expTs := from + uint32(10*j)
+			expVal := float64(int(expTs) + e.shift)
+			if p.Ts != expTs || p.Val != expVal {
+				t.Fatalf("series %d: expected point %d to be %v@%d, got %v@%d", i, j, expVal, expTs, p.Val, p.Ts)
+			}
+		}
+	}
+	// the input must not have been modified
+	for r, series := range input {
+		if r == (Req{}) {
+			continue // the outputs, which are added to the cache
+		}
+		if series[0].Datapoints[0].Ts != r.From || len(series[0].Tags) != 1 {
+			t.Fatalf("input for %v was modified: %v", r, series[0])
+		}
+	}
+}
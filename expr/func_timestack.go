@@ -0,0 +1,69 @@
+package expr
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/grafana/metrictank/api/models"
+)
+
+type FuncTimeStack struct {
+	in             []GraphiteFunc
+	timeShiftUnit  string
+	timeShiftStart int64
+	timeShiftEnd   int64
+	unit           int64
+}
+
+func NewTimeStack() GraphiteFunc {
+	return &FuncTimeStack{timeShiftUnit: "1d", timeShiftStart: 0, timeShiftEnd: 7}
+}
+
+func (s *FuncTimeStack) Signature() ([]Arg, []Arg) {
+	return []Arg{
+		// a list of lists, because the input is set up once for every shift. see MultiContextFunc
+		ArgSeriesLists{val: &s.in},
+		ArgString{key: "timeShiftUnit", opt: true, val: &s.timeShiftUnit, validator: []Validator{IsSignedIntervalString}},
+		ArgInt{key: "timeShiftStart", opt: true, val: &s.timeShiftStart},
+		ArgInt{key: "timeShiftEnd", opt: true, val: &s.timeShiftEnd},
+	}, []Arg{ArgSeriesList{}}
+}
+
+func (s *FuncTimeStack) Context(context Context) Context {
+	return context
+}
+
+// Contexts returns the context for every shift, from timeShiftStart up to (excluding) timeShiftEnd
+func (s *FuncTimeStack) Contexts(context Context) []Context {
+	s.unit, _ = parseSignedInterval(s.timeShiftUnit)
+	var contexts []Context
+	for shift := s.timeShiftStart; shift < s.timeShiftEnd; shift++ {
+		contexts = append(contexts, shiftContext(context, shift*s.unit))
+	}
+	return contexts
+}
+
+func (s *FuncTimeStack) Exec(cache map[Req][]models.Series) ([]models.Series, error) {
+	if len(s.in) == 0 {
+		return nil, nil
+	}
+	// the inputs of each shift are adjacent
+	perShift := len(s.in) / int(s.timeShiftEnd-s.timeShiftStart)
+	var outputs []models.Series
+	for i, in := range s.in {
+		series, err := in.Exec(cache)
+		if err != nil {
+			return nil, err
+		}
+		shift := s.timeShiftStart + int64(i/perShift)
+		for _, serie := range series {
+			target := fmt.Sprintf("timeShift(%s, %s, %d)", serie.Target, s.timeShiftUnit, shift)
+			output := shiftSeries(serie, shift*s.unit, target, target)
+			output.Tags["timeShiftUnit"] = s.timeShiftUnit
+			output.Tags["timeShift"] = strconv.FormatInt(shift, 10)
+			outputs = append(outputs, output)
+			cache[Req{}] = append(cache[Req{}], output)
+		}
+	}
+	return outputs, nil
+}
@@ -36,6 +36,14 @@ type GraphiteFunc interface {
 	Exec(map[Req][]models.Series) ([]models.Series, error)
 }
 
+// MultiContextFunc is implemented by functions that need the data of their series inputs for several contexts,
+// rather than for the single one returned by Context. e.g. timeStack(foo, "1d", 0, 7) needs foo for 7 different time ranges.
+// the series inputs are set up for each of the returned contexts in turn, so they should be declared as ArgSeriesLists,
+// which get appended to, rather than overwritten.
+type MultiContextFunc interface {
+	Contexts(c Context) []Context
+}
+
 type funcConstructor func() GraphiteFunc
 
 type funcDef struct {
@@ -48,35 +56,41 @@ var funcs map[string]funcDef
 func init() {
 	// keys must be sorted alphabetically. but functions with aliases can go together, in which case they are sorted by the first of their aliases
 	funcs = map[string]funcDef{
-		"alias":             {NewAlias, true},
-		"aliasByTags":       {NewAliasByNode, true},
-		"aliasByNode":       {NewAliasByNode, true},
-		"aliasSub":          {NewAliasSub, true},
-		"avg":               {NewAggregateConstructor("average", crossSeriesAvg), true},
-		"averageSeries":     {NewAggregateConstructor("average", crossSeriesAvg), true},
-		"consolidateBy":     {NewConsolidateBy, true},
-		"diffSeries":        {NewAggregateConstructor("diff", crossSeriesDiff), true},
-		"divideSeries":      {NewDivideSeries, true},
-		"divideSeriesLists": {NewDivideSeriesLists, true},
-		"exclude":           {NewExclude, true},
-		"grep":              {NewGrep, true},
-		"groupByTags":       {NewGroupByTags, true},
-		"max":               {NewAggregateConstructor("max", crossSeriesMax), true},
-		"maxSeries":         {NewAggregateConstructor("max", crossSeriesMax), true},
-		"min":               {NewAggregateConstructor("min", crossSeriesMin), true},
-		"minSeries":         {NewAggregateConstructor("min", crossSeriesMin), true},
-		"multiplySeries":    {NewAggregateConstructor("multiply", crossSeriesMultiply), true},
-		"movingAverage":     {NewMovingAverage, false},
-		"perSecond":         {NewPerSecond, true},
-		"rangeOfSeries":     {NewAggregateConstructor("rangeOf", crossSeriesRange), true},
-		"scale":             {NewScale, true},
-		"smartSummarize":    {NewSmartSummarize, false},
-		"sortByName":        {NewSortByName, true},
-		"stddevSeries":      {NewAggregateConstructor("stddev", crossSeriesStddev), true},
-		"sum":               {NewAggregateConstructor("sum", crossSeriesSum), true},
-		"sumSeries":         {NewAggregateConstructor("sum", crossSeriesSum), true},
-		"summarize":         {NewSummarize, true},
-		"transformNull":     {NewTransformNull, true},
+		"alias":                      {NewAlias, true},
+		"aliasByTags":                {NewAliasByNode, true},
+		"aliasByNode":                {NewAliasByNode, true},
+		"aliasSub":                   {NewAliasSub, true},
+		"asPercent":                  {NewAsPercent, true},
+		"avg":                        {NewAggregateConstructor("average", crossSeriesAvg), true},
+		"averageSeries":              {NewAggregateConstructor("average", crossSeriesAvg), true},
+		"consolidateBy":              {NewConsolidateBy, true},
+		"diffSeries":                 {NewAggregateConstructor("diff", crossSeriesDiff), true},
+		"divideSeries":               {NewDivideSeries, true},
+		"divideSeriesLists":          {NewDivideSeriesLists, true},
+		"exclude":                    {NewExclude, true},
+		"grep":                       {NewGrep, true},
+		"groupByTags":                {NewGroupByTags, true},
+		"holtWintersAberration":      {NewHoltWintersConstructor("holtWintersAberration"), true},
+		"holtWintersConfidenceBands": {NewHoltWintersConstructor("holtWintersConfidenceBands"), true},
+		"holtWintersForecast":        {NewHoltWintersConstructor("holtWintersForecast"), true},
+		"max":                        {NewAggregateConstructor("max", crossSeriesMax), true},
+		"maxSeries":                  {NewAggregateConstructor("max", crossSeriesMax), true},
+		"min":                        {NewAggregateConstructor("min", crossSeriesMin), true},
+		"minSeries":                  {NewAggregateConstructor("min", crossSeriesMin), true},
+		"multiplySeries":             {NewAggregateConstructor("multiply", crossSeriesMultiply), true},
+		"movingAverage":              {NewMovingAverage, false},
+		"perSecond":                  {NewPerSecond, true},
+		"rangeOfSeries":              {NewAggregateConstructor("rangeOf", crossSeriesRange), true},
+		"scale":                      {NewScale, true},
+		"smartSummarize":             {NewSmartSummarize, false},
+		"sortByName":                 {NewSortByName, true},
+		"stddevSeries":               {NewAggregateConstructor("stddev", crossSeriesStddev), true},
+		"sum":                        {NewAggregateConstructor("sum", crossSeriesSum), true},
+		"sumSeries":                  {NewAggregateConstructor("sum", crossSeriesSum), true},
+		"summarize":                  {NewSummarize, true},
+		"timeShift":                  {NewTimeShift, true},
+		"timeStack":                  {NewTimeStack, true},
+		"transformNull":              {NewTransformNull, true},
 	}
 }
 
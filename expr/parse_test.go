@@ -476,3 +476,29 @@ func TestExtractMetric(t *testing.T) {
 		}
 	}
 }
+
+func TestExplain(t *testing.T) {
+	e, _, err := Parse("movingAverage(sumSeries(foo.*, seriesByTag('dc=us')), '2min', xFilesFactor=0.5)")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp := `movingAverage (unstable)
+  sumSeries (native)
+    foo.* (fetch)
+    seriesByTag('dc=us') (fetch)
+  "2min"
+  xFilesFactor=0.5`
+	if got := e.Explain(0); got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+
+	e, _, err = Parse("someGraphiteOnlyFunc(foo)")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	exp = `someGraphiteOnlyFunc (graphite)
+  foo (fetch)`
+	if got := e.Explain(0); got != exp {
+		t.Fatalf("expected:\n%s\ngot:\n%s", exp, got)
+	}
+}
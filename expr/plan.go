@@ -1,6 +1,7 @@
 package expr
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -35,6 +36,7 @@ type Plan struct {
 	MaxDataPoints uint32
 	From          uint32                  // global request scoped from
 	To            uint32                  // global request scoped to
+	XFilesFactor  float64                 // xFilesFactor for the consolidation to MaxDataPoints. see consolidation.ConsolidateXFF
 	data          map[Req][]models.Series // input data to work with. set via Run(), as well as
 	// new data generated by processing funcs. useful for two reasons:
 	// 1) reuse partial calculations e.g. queries like target=movingAvg(sum(foo), 10)&target=sum(foo) (TODO)
@@ -193,14 +195,30 @@ func newplanFunc(e *expr, fn GraphiteFunc, context Context, stable bool, reqs []
 
 	// functions now have their non-series input args set,
 	// so they should now be able to specify any context alterations
-	context = fn.Context(context)
-	// now that we know the needed context for the data coming into
-	// this function, we can set up the input arguments for the function
-	// that are series
-	pos = 0
-	for _, argExp = range argsExp[:cutoff] {
+	if mc, ok := fn.(MultiContextFunc); ok {
+		for _, c := range mc.Contexts(context) {
+			reqs, err = e.consumeSeriesArgs(argsExp, c, stable, reqs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return reqs, nil
+	}
+	return e.consumeSeriesArgs(argsExp, fn.Context(context), stable, reqs)
+}
+
+// consumeSeriesArgs sets up the input arguments for the function that are series,
+// including optional ones that were given by position, now that we know the needed
+// context for the data coming into the function
+func (e expr) consumeSeriesArgs(argsExp []Arg, context Context, stable bool, reqs []Req) ([]Req, error) {
+	var err error
+	pos := 0
+	for _, argExp := range argsExp {
+		if pos >= len(e.args) {
+			break
+		}
 		switch argExp.(type) {
-		case ArgSeries, ArgSeriesList, ArgSeriesLists:
+		case ArgSeries, ArgSeriesList, ArgSeriesLists, ArgIn:
 			pos, reqs, err = e.consumeSeriesArg(pos, argExp, context, stable, reqs)
 			if err != nil {
 				return nil, err
@@ -214,15 +232,27 @@ func newplanFunc(e *expr, fn GraphiteFunc, context Context, stable bool, reqs []
 
 // Run invokes all processing as specified in the plan (expressions, from/to) with the input as input
 func (p Plan) Run(input map[Req][]models.Series) ([]models.Series, error) {
+	return p.RunContext(context.Background(), input)
+}
+
+// RunContext is like Run, but stops with the error of the context
+// as soon as it is done, in between the functions of the plan
+func (p Plan) RunContext(ctx context.Context, input map[Req][]models.Series) ([]models.Series, error) {
 	var out []models.Series
 	p.data = input
 	for _, fn := range p.funcs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 		series, err := fn.Exec(p.data)
 		if err != nil {
 			return nil, err
 		}
 		out = append(out, series...)
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	for i, o := range out {
 		if p.MaxDataPoints != 0 && len(o.Datapoints) > int(p.MaxDataPoints) {
 			// series may have been created by a function that didn't know which consolidation function to default to.
@@ -230,7 +260,7 @@ func (p Plan) Run(input map[Req][]models.Series) ([]models.Series, error) {
 			if o.Consolidator == 0 {
 				o.Consolidator = consolidation.Avg
 			}
-			out[i].Datapoints, out[i].Interval = consolidation.ConsolidateStable(o.Datapoints, o.Interval, p.MaxDataPoints, o.Consolidator)
+			out[i].Datapoints, out[i].Interval = consolidation.ConsolidateStable(o.Datapoints, o.Interval, p.MaxDataPoints, o.Consolidator, p.XFilesFactor)
 		}
 	}
 	return out, nil
@@ -133,3 +133,15 @@ type ArgStringsOrInts struct {
 
 func (a ArgStringsOrInts) Key() string    { return a.key }
 func (a ArgStringsOrInts) Optional() bool { return a.opt }
+
+// ArgIn is an argument that can be any one of the given args,
+// e.g. a number or a seriesList. the first one that matches the given argument is used.
+// when given as a keyword argument, only the args that are not series can be used.
+type ArgIn struct {
+	key  string
+	opt  bool
+	args []Arg
+}
+
+func (a ArgIn) Key() string    { return a.key }
+func (a ArgIn) Optional() bool { return a.opt }
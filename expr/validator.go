@@ -36,3 +36,9 @@ func IsIntervalString(e *expr) error {
 	_, err := dur.ParseDuration(e.str)
 	return err
 }
+
+// IsSignedIntervalString validates whether a string is an interval, optionally prefixed with + or -
+func IsSignedIntervalString(e *expr) error {
+	_, err := parseSignedInterval(e.str)
+	return err
+}
@@ -0,0 +1,66 @@
+package features
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var flagsStr string
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("features", flag.ExitOnError)
+	fs.StringVar(&flagsStr, "flags", "", "semicolon separated list of flag=state. state is on, off, a percentage of orgs like 25%, or a list of orgs like orgs:1,2,5. see the /features endpoint for the available flags")
+	globalconf.Register("features", fs)
+}
+
+// parse parses the flags setting into the state per flag
+func parse(str string) (map[string]State, error) {
+	states := make(map[string]State)
+	for _, item := range strings.Split(str, ";") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid flag %q. expected flag=state", item)
+		}
+		state, err := ParseState(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("flag %s: %s", strings.TrimSpace(kv[0]), err)
+		}
+		states[strings.TrimSpace(kv[0])] = state
+	}
+	return states, nil
+}
+
+// ConfigValidate checks the flags setting, without applying it
+func ConfigValidate() error {
+	states, err := parse(flagsStr)
+	if err != nil {
+		return err
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	for name := range states {
+		if _, ok := registry.flags[name]; !ok {
+			return fmt.Errorf("unknown feature flag %q", name)
+		}
+	}
+	return nil
+}
+
+func ConfigProcess() {
+	if err := ConfigValidate(); err != nil {
+		log.Fatal(4, "features: %s", err)
+	}
+	states, _ := parse(flagsStr)
+	for name, state := range states {
+		Set(name, state)
+		log.Info("features: %s is %s", name, state)
+	}
+}
@@ -0,0 +1,169 @@
+// Package features provides flags to enable risky new behaviors gradually: for all orgs, for a percentage of orgs,
+// or for a list of orgs. flags are set in the config, and can be changed at runtime via the /features endpoint,
+// so a behavior can be rolled out and rolled back without redeploying.
+package features
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// State is the state of a flag, e.g. "on", "off", "25%" or "orgs:1,2,5"
+type State struct {
+	on      bool
+	percent int
+	orgs    map[uint32]struct{}
+}
+
+// ParseState parses on, off, a percentage of orgs like 25% or a list of orgs like orgs:1,2,5
+func ParseState(s string) (State, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "on":
+		return State{on: true}, nil
+	case s == "off":
+		return State{}, nil
+	case strings.HasSuffix(s, "%"):
+		percent, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return State{}, fmt.Errorf("invalid percentage %q. must be 0-100%%", s)
+		}
+		return State{percent: percent}, nil
+	case strings.HasPrefix(s, "orgs:"):
+		orgs := make(map[uint32]struct{})
+		for _, str := range strings.Split(strings.TrimPrefix(s, "orgs:"), ",") {
+			org, err := strconv.ParseUint(strings.TrimSpace(str), 10, 32)
+			if err != nil || org == 0 {
+				return State{}, fmt.Errorf("invalid org %q in %q", str, s)
+			}
+			orgs[uint32(org)] = struct{}{}
+		}
+		return State{orgs: orgs}, nil
+	}
+	return State{}, fmt.Errorf("invalid state %q. must be on, off, a percentage like 25%% or a list of orgs like orgs:1,2", s)
+}
+
+func (s State) String() string {
+	switch {
+	case s.on:
+		return "on"
+	case s.percent > 0:
+		return strconv.Itoa(s.percent) + "%"
+	case len(s.orgs) > 0:
+		orgs := make([]int, 0, len(s.orgs))
+		for org := range s.orgs {
+			orgs = append(orgs, int(org))
+		}
+		sort.Ints(orgs)
+		strs := make([]string, len(orgs))
+		for i, org := range orgs {
+			strs[i] = strconv.Itoa(org)
+		}
+		return "orgs:" + strings.Join(strs, ",")
+	}
+	return "off"
+}
+
+// Flag is a behavior that can be enabled per org
+type Flag struct {
+	name        string
+	description string
+
+	sync.RWMutex
+	state State
+}
+
+// Enabled returns whether the behavior is enabled for the given org.
+// with a percentage, the same orgs are always selected, and raising the percentage only adds orgs.
+func (f *Flag) Enabled(org uint32) bool {
+	f.RLock()
+	state := f.state
+	f.RUnlock()
+	if state.on {
+		return true
+	}
+	if state.percent > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(f.name))
+		h.Write([]byte(strconv.FormatUint(uint64(org), 10)))
+		return int(h.Sum32()%100) < state.percent
+	}
+	_, ok := state.orgs[org]
+	return ok
+}
+
+func (f *Flag) set(state State) {
+	f.Lock()
+	f.state = state
+	f.Unlock()
+}
+
+// Info describes a flag and its current state
+type Info struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	State       string `json:"state"`
+}
+
+func (f *Flag) info() Info {
+	f.RLock()
+	defer f.RUnlock()
+	return Info{
+		Name:        f.name,
+		Description: f.description,
+		State:       f.state.String(),
+	}
+}
+
+var registry = struct {
+	sync.Mutex
+	flags map[string]*Flag
+}{
+	flags: make(map[string]*Flag),
+}
+
+// Register adds a flag, which is off until enabled in the config or via the api.
+// it is meant to be called when initializing package variables.
+func Register(name, description string) *Flag {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, ok := registry.flags[name]; ok {
+		panic(fmt.Sprintf("feature flag %q registered twice", name))
+	}
+	f := &Flag{
+		name:        name,
+		description: description,
+	}
+	registry.flags[name] = f
+	return f
+}
+
+// Set changes the state of the named flag
+func Set(name string, state State) error {
+	registry.Lock()
+	f, ok := registry.flags[name]
+	registry.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+	f.set(state)
+	return nil
+}
+
+// List returns all flags, sorted by name
+func List() []Info {
+	registry.Lock()
+	list := make([]Info, 0, len(registry.flags))
+	for _, f := range registry.flags {
+		list = append(list, f.info())
+	}
+	registry.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
@@ -0,0 +1,82 @@
+package features
+
+import (
+	"testing"
+)
+
+func TestParseState(t *testing.T) {
+	cases := []struct {
+		in    string
+		exp   string
+		valid bool
+	}{
+		{"on", "on", true},
+		{"off", "off", true},
+		{"25%", "25%", true},
+		{"0%", "off", true},
+		{"101%", "", false},
+		{"orgs:5,1, 2", "orgs:1,2,5", true},
+		{"orgs:1,x", "", false},
+		{"orgs:0", "", false},
+		{"yes", "", false},
+	}
+	for _, c := range cases {
+		state, err := ParseState(c.in)
+		if (err == nil) != c.valid {
+			t.Fatalf("%q: expected valid %t, got error %v", c.in, c.valid, err)
+		}
+		if err == nil && state.String() != c.exp {
+			t.Fatalf("%q: expected %q, got %q", c.in, c.exp, state.String())
+		}
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	f := Register("test-enabled", "")
+	if f.Enabled(1) {
+		t.Fatalf("expected flag to be off after registering")
+	}
+
+	Set("test-enabled", State{orgs: map[uint32]struct{}{3: {}}})
+	if f.Enabled(1) || !f.Enabled(3) {
+		t.Fatalf("expected flag to be enabled only for org 3")
+	}
+
+	// raising the percentage only adds orgs
+	var prev map[uint32]bool
+	for _, percent := range []int{10, 50, 100} {
+		Set("test-enabled", State{percent: percent})
+		enabled := make(map[uint32]bool)
+		for org := uint32(1); org <= 1000; org++ {
+			if f.Enabled(org) {
+				enabled[org] = true
+			}
+		}
+		for org := range prev {
+			if !enabled[org] {
+				t.Fatalf("org %d was enabled before, but not at %d%%", org, percent)
+			}
+		}
+		if n := len(enabled); n < percent*10-60 || n > percent*10+60 {
+			t.Fatalf("expected about %d%% of orgs to be enabled, got %d of 1000", percent, n)
+		}
+		prev = enabled
+	}
+
+	if err := Set("test-unknown", State{on: true}); err == nil {
+		t.Fatalf("expected error for unknown flag")
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	states, err := parse("a=on; b=orgs:1,2 ;c=10%;")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if len(states) != 3 || states["a"].String() != "on" || states["b"].String() != "orgs:1,2" || states["c"].String() != "10%" {
+		t.Fatalf("unexpected states %v", states)
+	}
+	if _, err := parse("a"); err == nil {
+		t.Fatalf("expected error for flag without state")
+	}
+}
@@ -0,0 +1,79 @@
+package governor
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+// the load shedding stops once the heap is this far below the level at which it started, so that it doesn't flap
+const hysteresis = 0.1
+
+var (
+	LogLevel            util.LogLevel
+	Enabled             bool
+	heapLimit           uint64
+	interval            time.Duration
+	minGOGC             int
+	shrinkCacheAt       float64
+	cacheShrinkFraction float64
+	pauseIngestAt       float64
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("memory-governor", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "")
+	fs.Uint64Var(&heapLimit, "heap-limit", 0, "heap size in bytes to stay below. leave some headroom below the memory limit of the container or host, as the process also uses memory outside the heap")
+	fs.DurationVar(&interval, "interval", 2*time.Second, "how often to check the heap size")
+	fs.IntVar(&minGOGC, "min-gogc", 20, "lowest GOGC to set as the heap approaches the limit. lower values make the garbage collector use more cpu")
+	fs.Float64Var(&shrinkCacheAt, "shrink-cache-at", 0.9, "shrink the chunk cache when the heap reaches this fraction of heap-limit. 0 to disable")
+	fs.Float64Var(&cacheShrinkFraction, "cache-shrink-fraction", 0.5, "fraction of its max-size to shrink the chunk cache to")
+	fs.Float64Var(&pauseIngestAt, "pause-ingest-at", 0, "pause consuming from kafka when the heap reaches this fraction of heap-limit. the node will lag behind, and may become not ready. 0 to disable")
+	globalconf.Register("memory-governor", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if heapLimit == 0 {
+		findings = append(findings, conf.NewError("memory-governor.heap-limit", "must be set"))
+	}
+	if interval <= 0 {
+		findings = append(findings, conf.NewError("memory-governor.interval", "must be greater than 0"))
+	}
+	if minGOGC < 1 {
+		findings = append(findings, conf.NewError("memory-governor.min-gogc", "must be at least 1"))
+	}
+	if shrinkCacheAt < 0 || cacheShrinkFraction <= 0 || cacheShrinkFraction >= 1 {
+		findings = append(findings, conf.NewError("memory-governor.cache-shrink-fraction", "shrink-cache-at must be >= 0 and cache-shrink-fraction between 0 and 1"))
+	}
+	if pauseIngestAt < 0 {
+		findings = append(findings, conf.NewError("memory-governor.pause-ingest-at", "must be >= 0"))
+	}
+	if pauseIngestAt > 0 && shrinkCacheAt > 0 && pauseIngestAt < shrinkCacheAt {
+		findings = append(findings, conf.NewWarning("memory-governor.pause-ingest-at", "ingestion is paused before the chunk cache is shrunk. shrinking the cache is usually the cheaper way to shed load"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	// disabled thresholds are never reached
+	if shrinkCacheAt == 0 {
+		shrinkCacheAt = 1e9
+	}
+	if pauseIngestAt == 0 {
+		pauseIngestAt = 1e9
+	}
+}
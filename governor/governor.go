@@ -0,0 +1,139 @@
+// Package governor keeps the heap below a configured limit, to avoid getting OOM killed under bursty query load.
+// as the heap approaches the limit, it lowers GOGC so that the garbage collector runs more often.
+// if that's not enough, it sheds load: it shrinks the chunk cache and pauses ingestion.
+package governor
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	// metric memory.governor.gogc is the GOGC value set by the memory governor
+	gogcMetric = stats.NewGauge32("memory.governor.gogc")
+	// metric memory.governor.pressure is the heap size as a percentage of the memory governor's heap-limit
+	pressureMetric = stats.NewGauge32("memory.governor.pressure")
+	// metric memory.governor.cache_shrunk is 1 while the memory governor has shrunk the chunk cache, 0 otherwise
+	cacheShrunkMetric = stats.NewBool("memory.governor.cache_shrunk")
+	// metric memory.governor.ingest_paused is 1 while the memory governor has paused ingestion, 0 otherwise
+	ingestPausedMetric = stats.NewBool("memory.governor.ingest_paused")
+)
+
+// Shrinker is a cache that can be limited to a fraction of its configured size
+type Shrinker interface {
+	Shrink(fraction float64)
+}
+
+// Pauser is an input that can pause consuming
+type Pauser interface {
+	SetPaused(paused bool)
+}
+
+// Governor periodically checks the heap size and adjusts GOGC and sheds load accordingly
+type Governor struct {
+	limit    uint64
+	baseGOGC int
+	minGOGC  int
+
+	cache   Shrinker
+	pausers []Pauser
+
+	gogc         int
+	cacheShrunk  bool
+	ingestPaused bool
+}
+
+// New creates a governor using the configured settings. cache may be nil.
+func New(cache Shrinker, pausers []Pauser) *Governor {
+	// the GOGC the process was started with, e.g. via the GOGC environment variable
+	base := debug.SetGCPercent(100)
+	debug.SetGCPercent(base)
+	return &Governor{
+		limit:    heapLimit,
+		baseGOGC: base,
+		minGOGC:  minGOGC,
+		cache:    cache,
+		pausers:  pausers,
+		gogc:     base,
+	}
+}
+
+// Run checks the heap every interval
+func (g *Governor) Run() {
+	var ms runtime.MemStats
+	for range time.Tick(interval) {
+		runtime.ReadMemStats(&ms)
+		g.adjust(ms.HeapAlloc, ms.NextGC)
+	}
+}
+
+// gogcFor returns the GOGC at which the next garbage collection runs before the heap reaches the limit.
+// live is the estimated size of the live heap.
+func (g *Governor) gogcFor(live uint64) int {
+	if live == 0 || live >= g.limit {
+		return g.minGOGC
+	}
+	gogc := int((g.limit - live) * 100 / live)
+	if gogc > g.baseGOGC {
+		gogc = g.baseGOGC
+	}
+	if gogc < g.minGOGC {
+		gogc = g.minGOGC
+	}
+	return gogc
+}
+
+// adjust applies GOGC and load shedding based on the current heap size, and the heap size at which the next GC will run
+func (g *Governor) adjust(heap, nextGC uint64) {
+	pressure := float64(heap) / float64(g.limit)
+	pressureMetric.Set(int(pressure * 100))
+
+	// the heap will grow to nextGC, which is the live heap after the previous GC plus GOGC percent
+	live := nextGC * 100 / uint64(100+g.gogc)
+	gogc := g.gogcFor(live)
+	if gogc != g.gogc {
+		debug.SetGCPercent(gogc)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-governor: heap %d bytes, live heap about %d bytes. GOGC %d -> %d", heap, live, g.gogc, gogc)
+		}
+		g.gogc = gogc
+	}
+	gogcMetric.Set(gogc)
+
+	if g.cache != nil {
+		switch {
+		case !g.cacheShrunk && pressure >= shrinkCacheAt:
+			log.Warn("memory-governor: heap at %.0f%% of the limit. shrinking the chunk cache to %.0f%% of its max-size", pressure*100, cacheShrinkFraction*100)
+			g.cache.Shrink(cacheShrinkFraction)
+			g.cacheShrunk = true
+		case g.cacheShrunk && pressure < shrinkCacheAt-hysteresis:
+			log.Info("memory-governor: heap at %.0f%% of the limit. restoring the chunk cache", pressure*100)
+			g.cache.Shrink(1)
+			g.cacheShrunk = false
+		}
+		cacheShrunkMetric.Set(g.cacheShrunk)
+	}
+
+	if len(g.pausers) > 0 {
+		switch {
+		case !g.ingestPaused && pressure >= pauseIngestAt:
+			log.Warn("memory-governor: heap at %.0f%% of the limit. pausing ingestion", pressure*100)
+			g.setPaused(true)
+		case g.ingestPaused && pressure < pauseIngestAt-hysteresis:
+			log.Info("memory-governor: heap at %.0f%% of the limit. resuming ingestion", pressure*100)
+			g.setPaused(false)
+		}
+		ingestPausedMetric.Set(g.ingestPaused)
+	}
+}
+
+func (g *Governor) setPaused(paused bool) {
+	for _, p := range g.pausers {
+		p.SetPaused(paused)
+	}
+	g.ingestPaused = paused
+}
@@ -0,0 +1,92 @@
+package governor
+
+import (
+	"runtime/debug"
+	"testing"
+)
+
+type mockCache struct {
+	fraction float64
+}
+
+func (m *mockCache) Shrink(fraction float64) {
+	m.fraction = fraction
+}
+
+type mockPauser struct {
+	paused bool
+}
+
+func (m *mockPauser) SetPaused(paused bool) {
+	m.paused = paused
+}
+
+func TestGOGCFor(t *testing.T) {
+	g := &Governor{
+		limit:    1000,
+		baseGOGC: 100,
+		minGOGC:  20,
+	}
+	cases := []struct {
+		live uint64
+		exp  int
+	}{
+		{100, 100}, // plenty of room: don't go above the base
+		{500, 100},
+		{600, 66},
+		{800, 25},
+		{900, 20}, // never below the min
+		{1200, 20},
+		{0, 20},
+	}
+	for _, c := range cases {
+		if got := g.gogcFor(c.live); got != c.exp {
+			t.Fatalf("live %d: expected GOGC %d, got %d", c.live, c.exp, got)
+		}
+	}
+}
+
+func TestAdjust(t *testing.T) {
+	defer debug.SetGCPercent(debug.SetGCPercent(100))
+	shrinkCacheAt = 0.8
+	cacheShrinkFraction = 0.5
+	pauseIngestAt = 0.95
+	cache := &mockCache{}
+	pauser := &mockPauser{}
+	g := &Governor{
+		limit:    1000,
+		baseGOGC: 100,
+		minGOGC:  20,
+		gogc:     100,
+		cache:    cache,
+		pausers:  []Pauser{pauser},
+	}
+
+	steps := []struct {
+		heap   uint64
+		nextGC uint64
+		shrunk bool
+		paused bool
+		gogc   int
+	}{
+		{300, 600, false, false, 100},
+		{850, 1400, true, false, 42}, // live heap 700
+		{960, 1207, true, true, 20},  // live heap 850
+		{900, 1000, true, true, 20},  // still above the thresholds minus hysteresis
+		{800, 1000, true, false, 20},
+		{500, 1000, false, false, 20}, // live heap 833
+		{500, 600, false, false, 100}, // live heap 500
+	}
+	for i, s := range steps {
+		g.adjust(s.heap, s.nextGC)
+		if g.cacheShrunk != s.shrunk || (cache.fraction == 0.5) != s.shrunk {
+			t.Fatalf("step %d: expected cache shrunk %t, got %t (fraction %f)", i, s.shrunk, g.cacheShrunk, cache.fraction)
+		}
+		if pauser.paused != s.paused {
+			t.Fatalf("step %d: expected ingestion paused %t, got %t", i, s.paused, pauser.paused)
+		}
+		if g.gogc != s.gogc {
+			t.Fatalf("step %d: expected GOGC %d, got %d", i, s.gogc, g.gogc)
+		}
+	}
+}
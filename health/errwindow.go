@@ -0,0 +1,49 @@
+package health
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrWindow tracks the number of queries and errors over the last minute, in buckets of 10 seconds.
+// stores use it to derive their health from the error rate of recent queries
+type ErrWindow struct {
+	sync.Mutex
+	buckets [6]errBucket
+}
+
+type errBucket struct {
+	ts      int64 // start of the 10s period the bucket covers
+	queries uint32
+	errors  uint32
+}
+
+// Add records a query that completed at the given time, with the given error, if any
+func (w *ErrWindow) Add(now time.Time, err error) {
+	ts := now.Unix() - now.Unix()%10
+	w.Lock()
+	b := &w.buckets[(ts/10)%int64(len(w.buckets))]
+	if b.ts != ts {
+		*b = errBucket{ts: ts}
+	}
+	b.queries++
+	if err != nil {
+		b.errors++
+	}
+	w.Unlock()
+}
+
+// Get returns the number of queries and errors seen within the window
+func (w *ErrWindow) Get(now time.Time) (uint32, uint32) {
+	cutoff := now.Unix() - int64(len(w.buckets))*10
+	var queries, errors uint32
+	w.Lock()
+	for _, b := range w.buckets {
+		if b.ts > cutoff {
+			queries += b.queries
+			errors += b.errors
+		}
+	}
+	w.Unlock()
+	return queries, errors
+}
@@ -0,0 +1,77 @@
+// Package health provides the types subsystems use to report their health,
+// which the api aggregates into the /health endpoint
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// State is the health state of a subsystem. higher values are worse
+type State int
+
+const (
+	OK       State = iota // fully functional
+	Degraded              // functional, but needs attention. e.g. lagging, loading or seeing errors
+	Failed                // not functional
+)
+
+var stateNames = []string{"ok", "degraded", "failed"}
+
+func (s State) String() string {
+	if s < OK || s > Failed {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+	return stateNames[s]
+}
+
+func (s State) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *State) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	for i, name := range stateNames {
+		if name == str {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown health state %q", str)
+}
+
+// Status describes the health of a subsystem.
+// Message explains the state if it's not OK, Detail holds subsystem specific, machine readable data.
+type Status struct {
+	State   State       `json:"state"`
+	Message string      `json:"message,omitempty"`
+	Detail  interface{} `json:"detail,omitempty"`
+}
+
+// Worsen raises the state to the given one, if it's worse, and records why
+func (s *Status) Worsen(state State, format string, args ...interface{}) {
+	if state > s.State {
+		s.State = state
+	}
+	msg := fmt.Sprintf(format, args...)
+	if s.Message == "" {
+		s.Message = msg
+	} else {
+		s.Message += "; " + msg
+	}
+}
+
+// Reporter is implemented by subsystems that can report their health
+type Reporter interface {
+	Health() Status
+}
+
+// ReporterFunc adapts a function to a Reporter
+type ReporterFunc func() Status
+
+func (f ReporterFunc) Health() Status {
+	return f()
+}
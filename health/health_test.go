@@ -0,0 +1,51 @@
+package health
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWorsen(t *testing.T) {
+	var s Status
+	s.Worsen(Degraded, "lag %d", 10)
+	s.Worsen(OK, "still fine")
+	if s.State != Degraded {
+		t.Fatalf("expected state to stay degraded, got %s", s.State)
+	}
+	s.Worsen(Failed, "down")
+	if s.State != Failed || s.Message != "lag 10; still fine; down" {
+		t.Fatalf("unexpected status %+v", s)
+	}
+}
+
+func TestStateJSON(t *testing.T) {
+	data, err := json.Marshal(Status{State: Degraded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"state":"degraded"}` {
+		t.Fatalf("unexpected json %s", data)
+	}
+	var s Status
+	if err := json.Unmarshal(data, &s); err != nil || s.State != Degraded {
+		t.Fatalf("expected to decode degraded, got %s (err %v)", s.State, err)
+	}
+}
+
+func TestETA(t *testing.T) {
+	cases := []struct {
+		remaining int64
+		rate      float64
+		exp       int
+	}{
+		{0, 0, 0},
+		{100, 0, -1},
+		{100, 10, 10},
+		{5, 2, 3},
+	}
+	for _, c := range cases {
+		if eta := ETA(c.remaining, c.rate); eta != c.exp {
+			t.Errorf("ETA(%d, %f): expected %d, got %d", c.remaining, c.rate, c.exp, eta)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package health
+
+import "time"
+
+// Progress describes how far along a subsystem is with the work it has to do before the node can be ready,
+// like replaying kafka or loading the index. Detail holds subsystem specific, machine readable data.
+type Progress struct {
+	Done bool `json:"done"`
+	// estimated seconds until done. 0 when done, -1 when unknown, e.g. because it has not started yet
+	ETA    int         `json:"eta"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// ETA estimates how long it takes to do the remaining work at the given rate per second.
+// it returns -1 if there is no rate to go by.
+func ETA(remaining int64, rate float64) int {
+	if remaining <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return int(float64(remaining)/rate + 0.5)
+}
+
+// Rate returns how many units per second were done since start
+func Rate(done int64, start, now time.Time) float64 {
+	elapsed := now.Sub(start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(done) / elapsed
+}
+
+// ProgressReporter is implemented by subsystems that have work to do at startup
+type ProgressReporter interface {
+	Progress() Progress
+}
+
+// ProgressReporterFunc adapts a function to a ProgressReporter
+type ProgressReporterFunc func() Progress
+
+func (f ProgressReporterFunc) Progress() Progress {
+	return f()
+}
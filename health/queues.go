@@ -0,0 +1,34 @@
+package health
+
+// Queue describes how full a queue is. queues that fill up mean the subsystem can't keep up with its load
+type Queue struct {
+	Name  string `json:"name"` // e.g. write.3
+	Kind  string `json:"kind"` // read or write
+	Depth int    `json:"depth"`
+	Size  int    `json:"size"`
+}
+
+// Utilization returns how full the queue is, between 0 and 1
+func (q Queue) Utilization() float64 {
+	if q.Size <= 0 {
+		return 0
+	}
+	return float64(q.Depth) / float64(q.Size)
+}
+
+// QueueReporter is implemented by subsystems that queue their work, such as the stores
+type QueueReporter interface {
+	Queues() []Queue
+}
+
+// Lag describes how far behind an input is in consuming a partition
+type Lag struct {
+	Partition int32 `json:"partition"`
+	Messages  int   `json:"messages"`
+	Seconds   int   `json:"seconds"` // estimated time it takes to catch up
+}
+
+// LagReporter is implemented by inputs that consume partitions, and know how far behind they are
+type LagReporter interface {
+	Lag() []Lag
+}
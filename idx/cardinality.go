@@ -0,0 +1,23 @@
+package idx
+
+// Cardinality is the number of series of an org, and how they are spread over the top-level nodes of their names
+// and over their tag keys, to find out what causes the cardinality of an org to explode.
+type Cardinality struct {
+	OrgId  uint32 `json:"orgId"`
+	Series int    `json:"series"`
+	// the top-level nodes with the most series, e.g. "servers" for servers.web1.cpu
+	TopLevelNodes []NodeCardinality `json:"topLevelNodes"`
+	// the tag keys with the most values
+	TagKeys []TagKeyCardinality `json:"tagKeys"`
+}
+
+type NodeCardinality struct {
+	Node   string `json:"node"`
+	Series int    `json:"series"`
+}
+
+type TagKeyCardinality struct {
+	Key    string `json:"key"`
+	Series int    `json:"series"` // number of series that have the tag
+	Values int    `json:"values"` // number of distinct values
+}
@@ -1,16 +1,20 @@
 package cassandra
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gocql/gocql"
 	"github.com/grafana/metrictank/cassandra"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/idx/memory"
 	"github.com/grafana/metrictank/stats"
@@ -21,6 +25,8 @@ import (
 )
 
 var (
+	LogLevel util.LogLevel
+
 	// metric idx.cassadra.query-insert.ok is how many insert queries for a metric completed successfully (triggered by an add or an update)
 	statQueryInsertOk = stats.NewCounter32("idx.cassandra.query-insert.ok")
 	// metric idx.cassandra.query-insert.fail is how many insert queries for a metric failed (triggered by an add or an update)
@@ -96,8 +102,8 @@ func ConfigSetup() *flag.FlagSet {
 	casIdx.BoolVar(&hostverification, "host-verification", true, "host (hostname and server cert) verification when using SSL")
 
 	casIdx.BoolVar(&auth, "auth", false, "enable cassandra user authentication")
-	casIdx.StringVar(&username, "username", "cassandra", "username for authentication")
-	casIdx.StringVar(&password, "password", "cassandra", "password for authentication")
+	casIdx.StringVar(&username, "username", "cassandra", "username for authentication. may be an env:, file: or vault: reference, see the secrets section")
+	casIdx.StringVar(&password, "password", "cassandra", "password for authentication. may be an env:, file: or vault: reference, see the secrets section")
 
 	globalconf.Register("cassandra-idx", casIdx)
 	return casIdx
@@ -116,6 +122,12 @@ type CasIdx struct {
 	writeQueue chan writeReq
 	shutdown   chan struct{}
 	wg         sync.WaitGroup
+
+	// progress of loading the index from cassandra, for health and progress reporting. accessed atomically
+	loadPhase int32
+	defsRead  int64
+	loadStart int64 // unix nanos
+	loadEnd   int64 // unix nanos
 }
 
 type cqlIterator interface {
@@ -138,10 +150,11 @@ func New() *CasIdx {
 		}
 	}
 	if auth {
-		cluster.Authenticator = gocql.PasswordAuthenticator{
-			Username: username,
-			Password: password,
+		authenticator, err := cassandra.NewAuthenticator(username, password)
+		if err != nil {
+			log.Fatal(4, "cassandra-idx: %s", err)
 		}
+		cluster.Authenticator = authenticator
 	}
 
 	idx := &CasIdx{
@@ -167,6 +180,10 @@ func (c *CasIdx) InitBare() error {
 	// read templates
 	schemaKeyspace := util.ReadEntry(schemaFile, "schema_keyspace").(string)
 	schemaTable := util.ReadEntry(schemaFile, "schema_table").(string)
+	schemaMetaTagTable := util.ReadEntry(schemaFile, "schema_meta_tag_table").(string)
+	schemaStorageOverridesTable := util.ReadEntry(schemaFile, "schema_storage_overrides_table").(string)
+	schemaOrgPoliciesTable := util.ReadEntry(schemaFile, "schema_org_policies_table").(string)
+	schemaSavedQueriesTable := util.ReadEntry(schemaFile, "schema_saved_queries_table").(string)
 
 	// create the keyspace or ensure it exists
 	if createKeyspace {
@@ -180,6 +197,26 @@ func (c *CasIdx) InitBare() error {
 		if err != nil {
 			return fmt.Errorf("failed to initialize cassandra table: %s", err)
 		}
+		log.Info("cassandra-idx: ensuring that table meta_tag_rules exist.")
+		err = tmpSession.Query(fmt.Sprintf(schemaMetaTagTable, keyspace)).Exec()
+		if err != nil {
+			return fmt.Errorf("failed to initialize cassandra table: %s", err)
+		}
+		log.Info("cassandra-idx: ensuring that table storage_overrides exist.")
+		err = tmpSession.Query(fmt.Sprintf(schemaStorageOverridesTable, keyspace)).Exec()
+		if err != nil {
+			return fmt.Errorf("failed to initialize cassandra table: %s", err)
+		}
+		log.Info("cassandra-idx: ensuring that table org_policies exist.")
+		err = tmpSession.Query(fmt.Sprintf(schemaOrgPoliciesTable, keyspace)).Exec()
+		if err != nil {
+			return fmt.Errorf("failed to initialize cassandra table: %s", err)
+		}
+		log.Info("cassandra-idx: ensuring that table saved_queries exist.")
+		err = tmpSession.Query(fmt.Sprintf(schemaSavedQueriesTable, keyspace)).Exec()
+		if err != nil {
+			return fmt.Errorf("failed to initialize cassandra table: %s", err)
+		}
 	} else {
 		var keyspaceMetadata *gocql.KeyspaceMetadata
 		for attempt := 1; attempt > 0; attempt++ {
@@ -231,12 +268,23 @@ func (c *CasIdx) Init() error {
 
 	if updateCassIdx {
 		c.wg.Add(numConns)
+		writeState := func() interface{} {
+			return map[string]int{"writeQueue": len(c.writeQueue)}
+		}
 		for i := 0; i < numConns; i++ {
-			go c.processWriteQueue()
+			go crash.Go("idx.write", writeState, c.processWriteQueue)
 		}
 		log.Info("cassandra-idx started %d writeQueue handlers", numConns)
 	}
 
+	// load the storage overrides and meta tag rules first, so they get applied to the series as they are loaded
+	c.loadStorageOverrides()
+	if memory.TagSupport {
+		c.loadMetaTagRules()
+	}
+	c.loadOrgPolicies()
+	c.loadSavedQueries()
+
 	//Rebuild the in-memory index.
 	c.rebuildIndex()
 
@@ -244,7 +292,7 @@ func (c *CasIdx) Init() error {
 		if pruneInterval == 0 {
 			return fmt.Errorf("pruneInterval must be greater then 0")
 		}
-		go c.prune()
+		go crash.Go("idx.prune", nil, c.prune)
 	}
 	return nil
 }
@@ -333,7 +381,9 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 	// if the entry has not been saved for 1.5x updateInterval
 	// then perform a blocking save.
 	if archive.LastSave < (now - updateInterval32 - updateInterval32/2) {
-		log.Debug("cassandra-idx updating def in index.")
+		if LogLevel.Get() < 2 {
+			log.Debug("cassandra-idx updating def in index.")
+		}
 		c.writeQueue <- writeReq{recvTime: time.Now(), def: &archive.MetricDefinition}
 		archive.LastSave = now
 		c.MemoryIdx.UpdateArchive(archive)
@@ -350,7 +400,9 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 			c.MemoryIdx.UpdateArchive(archive)
 		default:
 			statSaveSkipped.Inc()
-			log.Debug("writeQueue is full, update not saved.")
+			if LogLevel.Get() < 2 {
+				log.Debug("writeQueue is full, update not saved.")
+			}
 		}
 	}
 
@@ -360,15 +412,37 @@ func (c *CasIdx) updateCassandra(now uint32, inMemory bool, archive idx.Archive,
 func (c *CasIdx) rebuildIndex() {
 	log.Info("cassandra-idx Rebuilding Memory Index from metricDefinitions in Cassandra")
 	pre := time.Now()
+	atomic.StoreInt64(&c.loadStart, pre.UnixNano())
+	atomic.StoreInt32(&c.loadPhase, loadReading)
 	var defs []schema.MetricDefinition
 	var staleTs uint32
 	if maxStale != 0 {
 		staleTs = uint32(time.Now().Add(maxStale * -1).Unix())
 	}
-	defs = c.LoadPartitions(cluster.Manager.GetPartitions(), defs, staleTs)
+	partitions := cluster.Manager.GetPartitions()
+
+	// restoring a snapshot is much faster than reading all definitions from cassandra, which we then do in the background
+	if restored, ok := c.MemoryIdx.RestoreSnapshot(partitions); ok {
+		atomic.StoreInt32(&c.loadPhase, loadReconciling)
+		go crash.Go("idx.reconcile", nil, func() {
+			defs = c.LoadPartitions(partitions, defs[:0], staleTs)
+			added, updated, removed := c.MemoryIdx.Reconcile(defs, restored)
+			atomic.StoreInt64(&c.loadEnd, time.Now().UnixNano())
+			atomic.StoreInt32(&c.loadPhase, loadDone)
+			log.Info("cassandra-idx Reconciling Memory Index with Cassandra Complete. Added %d, updated %d, removed %d. Took %s", added, updated, removed, time.Since(pre))
+			c.MemoryIdx.StartSnapshots(partitions)
+		})
+		return
+	}
 
+	defs = c.LoadPartitions(partitions, defs, staleTs)
+
+	atomic.StoreInt32(&c.loadPhase, loadIndexing)
 	num := c.MemoryIdx.Load(defs)
+	atomic.StoreInt64(&c.loadEnd, time.Now().UnixNano())
+	atomic.StoreInt32(&c.loadPhase, loadDone)
 	log.Info("cassandra-idx Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
+	c.MemoryIdx.StartSnapshots(partitions)
 }
 
 func (c *CasIdx) Load(defs []schema.MetricDefinition, cutoff uint32) []schema.MetricDefinition {
@@ -417,6 +491,7 @@ func (c *CasIdx) load(defs []schema.MetricDefinition, iter cqlIterator, cutoff u
 		}
 		nameWithTags := mdef.NameWithTags()
 		defsByNames[nameWithTags] = append(defsByNames[nameWithTags], mdef)
+		atomic.AddInt64(&c.defsRead, 1)
 	}
 	if err := iter.Close(); err != nil {
 		log.Fatal(4, "Could not close iterator: %s", err.Error())
@@ -483,7 +558,9 @@ func (c *CasIdx) processWriteQueue() {
 				success = true
 				statQueryInsertExecDuration.Value(time.Since(pre))
 				statQueryInsertOk.Inc()
-				log.Debug("cassandra-idx metricDef saved to cassandra. %s", req.def.Id)
+				if LogLevel.Get() < 2 {
+					log.Debug("cassandra-idx metricDef saved to cassandra. %s", req.def.Id)
+				}
 			}
 		}
 	}
@@ -538,6 +615,178 @@ func (c *CasIdx) deleteDefAsync(key schema.MKey, part int32) {
 	}()
 }
 
+// UpsertMetaTagRule upserts the meta tag rule in the memory index, and saves it to cassandra
+func (c *CasIdx) UpsertMetaTagRule(orgId uint32, rule idx.MetaTagRule) (bool, error) {
+	created, err := c.MemoryIdx.UpsertMetaTagRule(orgId, rule)
+	if err != nil || !updateCassIdx {
+		return created, err
+	}
+	if len(rule.MetaTags) == 0 {
+		err = c.session.Query("DELETE FROM meta_tag_rules WHERE orgid=? AND expressions=?", orgId, rule.Expressions).Exec()
+	} else {
+		err = c.session.Query("INSERT INTO meta_tag_rules (orgid, expressions, metatags) VALUES (?, ?, ?)", orgId, rule.Expressions, rule.MetaTags).Exec()
+	}
+	if err != nil {
+		errmetrics.Inc(err)
+		log.Error(3, "cassandra-idx: failed to save meta tag rule %v of org %d: %s", rule.Expressions, orgId, err)
+		return created, fmt.Errorf("failed to save meta tag rule: %s", err)
+	}
+	return created, nil
+}
+
+// loadMetaTagRules loads the meta tag rules of all orgs into the memory index
+func (c *CasIdx) loadMetaTagRules() {
+	iter := c.session.Query("SELECT orgid, expressions, metatags FROM meta_tag_rules").Iter()
+	var orgId int
+	var expressions, metaTags []string
+	var num int
+	for iter.Scan(&orgId, &expressions, &metaTags) {
+		rule := idx.MetaTagRule{
+			Expressions: expressions,
+			MetaTags:    metaTags,
+		}
+		expressions, metaTags = nil, nil
+		if _, err := c.MemoryIdx.UpsertMetaTagRule(uint32(orgId), rule); err != nil {
+			log.Error(3, "cassandra-idx: skipping invalid meta tag rule %v of org %d: %s", rule.Expressions, orgId, err)
+			continue
+		}
+		num++
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(3, "cassandra-idx: failed to load meta tag rules: %s", err)
+		return
+	}
+	log.Info("cassandra-idx: loaded %d meta tag rules", num)
+}
+
+// UpsertStorageOverride upserts the storage override in the memory index, and saves all overrides to cassandra.
+// the overrides are stored as a json array in a single row, since their order matters
+func (c *CasIdx) UpsertStorageOverride(o conf.Override) (bool, error) {
+	created, err := c.MemoryIdx.UpsertStorageOverride(o)
+	if err != nil || !updateCassIdx {
+		return created, err
+	}
+	overrides, _ := json.Marshal(c.MemoryIdx.StorageOverrides())
+	err = c.session.Query("INSERT INTO storage_overrides (id, overrides) VALUES (?, ?)", 0, string(overrides)).Exec()
+	if err != nil {
+		errmetrics.Inc(err)
+		log.Error(3, "cassandra-idx: failed to save storage override %q: %s", o.Name, err)
+		return created, fmt.Errorf("failed to save storage override: %s", err)
+	}
+	return created, nil
+}
+
+// loadStorageOverrides activates the saved storage overrides
+func (c *CasIdx) loadStorageOverrides() {
+	var data string
+	err := c.session.Query("SELECT overrides FROM storage_overrides WHERE id = ?", 0).Scan(&data)
+	if err == gocql.ErrNotFound {
+		return
+	}
+	if err != nil {
+		log.Error(3, "cassandra-idx: failed to load storage overrides: %s", err)
+		return
+	}
+	var overrides []conf.Override
+	if err := json.Unmarshal([]byte(data), &overrides); err != nil {
+		log.Error(3, "cassandra-idx: skipping invalid storage overrides %q: %s", data, err)
+		return
+	}
+	if err := c.MemoryIdx.LoadStorageOverrides(overrides); err != nil {
+		log.Error(3, "cassandra-idx: failed to activate storage overrides: %s", err)
+		return
+	}
+	log.Info("cassandra-idx: loaded %d storage overrides", len(overrides))
+}
+
+// UpsertOrgPolicy sets the org policy in the memory index, and saves it to cassandra
+func (c *CasIdx) UpsertOrgPolicy(p idx.OrgPolicy) (bool, error) {
+	created, err := c.MemoryIdx.UpsertOrgPolicy(p)
+	if err != nil || !updateCassIdx {
+		return created, err
+	}
+	if p.Empty() {
+		err = c.session.Query("DELETE FROM org_policies WHERE orgid = ?", p.OrgId).Exec()
+	} else {
+		policy, _ := json.Marshal(p)
+		err = c.session.Query("INSERT INTO org_policies (orgid, policy) VALUES (?, ?)", p.OrgId, string(policy)).Exec()
+	}
+	if err != nil {
+		errmetrics.Inc(err)
+		log.Error(3, "cassandra-idx: failed to save policy of org %d: %s", p.OrgId, err)
+		return created, fmt.Errorf("failed to save org policy: %s", err)
+	}
+	return created, nil
+}
+
+// loadOrgPolicies loads the policies of all orgs into the memory index
+func (c *CasIdx) loadOrgPolicies() {
+	iter := c.session.Query("SELECT policy FROM org_policies").Iter()
+	var data string
+	var policies []idx.OrgPolicy
+	for iter.Scan(&data) {
+		var p idx.OrgPolicy
+		if err := json.Unmarshal([]byte(data), &p); err != nil {
+			log.Error(3, "cassandra-idx: skipping invalid org policy %q: %s", data, err)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(3, "cassandra-idx: failed to load org policies: %s", err)
+		return
+	}
+	log.Info("cassandra-idx: loaded %d org policies", c.MemoryIdx.LoadOrgPolicies(policies))
+}
+
+// UpsertSavedQuery saves the query in the memory index, and in cassandra.
+// cassandra removes the query when it expires.
+func (c *CasIdx) UpsertSavedQuery(q idx.SavedQuery) (bool, error) {
+	created, err := c.MemoryIdx.UpsertSavedQuery(q)
+	if err != nil || !updateCassIdx {
+		return created, err
+	}
+	if len(q.Targets) == 0 {
+		err = c.session.Query("DELETE FROM saved_queries WHERE orgid = ? AND id = ?", q.OrgId, q.Id).Exec()
+	} else {
+		var ttl int64
+		if q.Expires != 0 {
+			ttl = q.Expires - time.Now().Unix()
+			if ttl < 1 {
+				ttl = 1
+			}
+		}
+		query, _ := json.Marshal(q)
+		err = c.session.Query("INSERT INTO saved_queries (orgid, id, query) VALUES (?, ?, ?) USING TTL ?", q.OrgId, q.Id, string(query), ttl).Exec()
+	}
+	if err != nil {
+		errmetrics.Inc(err)
+		log.Error(3, "cassandra-idx: failed to save query %q of org %d: %s", q.Id, q.OrgId, err)
+		return created, fmt.Errorf("failed to save query: %s", err)
+	}
+	return created, nil
+}
+
+// loadSavedQueries loads the saved queries of all orgs into the memory index
+func (c *CasIdx) loadSavedQueries() {
+	iter := c.session.Query("SELECT query FROM saved_queries").Iter()
+	var data string
+	var queries []idx.SavedQuery
+	for iter.Scan(&data) {
+		var q idx.SavedQuery
+		if err := json.Unmarshal([]byte(data), &q); err != nil {
+			log.Error(3, "cassandra-idx: skipping invalid saved query %q: %s", data, err)
+			continue
+		}
+		queries = append(queries, q)
+	}
+	if err := iter.Close(); err != nil {
+		log.Error(3, "cassandra-idx: failed to load saved queries: %s", err)
+		return
+	}
+	log.Info("cassandra-idx: loaded %d saved queries", c.MemoryIdx.LoadSavedQueries(queries))
+}
+
 func (c *CasIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
 	pre := time.Now()
 	pruned, err := c.MemoryIdx.Prune(oldest)
@@ -548,7 +797,9 @@ func (c *CasIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
 func (c *CasIdx) prune() {
 	ticker := time.NewTicker(pruneInterval)
 	for range ticker.C {
-		log.Debug("cassandra-idx: pruning items from index that have not been seen for %s", maxStale.String())
+		if LogLevel.Get() < 2 {
+			log.Debug("cassandra-idx: pruning items from index that have not been seen for %s", maxStale.String())
+		}
 		staleTs := time.Now().Add(maxStale * -1)
 		_, err := c.Prune(staleTs)
 		if err != nil {
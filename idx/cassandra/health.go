@@ -0,0 +1,78 @@
+package cassandra
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+)
+
+const (
+	loadPending     int32 = iota // Init has not started loading yet
+	loadReading                  // reading the definitions from cassandra
+	loadIndexing                 // adding the definitions to the memory index
+	loadReconciling              // reconciling the series restored from a snapshot with the definitions from cassandra
+	loadDone
+)
+
+var loadPhases = []string{"pending", "reading", "indexing", "reconciling", "done"}
+
+type indexHealth struct {
+	Series   int    `json:"series"`
+	Load     string `json:"load"`
+	DefsRead int64  `json:"defsRead"` // definitions read from cassandra so far
+	Session  string `json:"session"`
+}
+
+// Health reports how far along loading the index from cassandra is, and the state of the cassandra session.
+// the index is degraded until it's fully loaded, because until then queries will miss series.
+func (c *CasIdx) Health() health.Status {
+	phase := atomic.LoadInt32(&c.loadPhase)
+	detail := indexHealth{
+		Series:   c.MemoryIdx.Len(),
+		Load:     loadPhases[phase],
+		DefsRead: atomic.LoadInt64(&c.defsRead),
+		Session:  "open",
+	}
+	status := health.Status{State: health.OK, Detail: detail}
+	if phase != loadDone {
+		status.Worsen(health.Degraded, "index is still loading (%s, %d definitions read)", detail.Load, detail.DefsRead)
+	}
+	if c.session != nil && c.session.Closed() {
+		detail.Session = "closed"
+		status.Detail = detail
+		status.Worsen(health.Failed, "cassandra session is closed")
+	}
+	return status
+}
+
+type indexProgress struct {
+	Load        string  `json:"load"`
+	DefsRead    int64   `json:"defsRead"`
+	DefsPerSec  float64 `json:"defsPerSec"`
+	ElapsedSecs int     `json:"elapsedSecs"`
+}
+
+// Progress reports how far along loading the index from cassandra is.
+// we don't know how many definitions there are to read, so there is no ETA until we're done.
+func (c *CasIdx) Progress() health.Progress {
+	phase := atomic.LoadInt32(&c.loadPhase)
+	detail := indexProgress{
+		Load:     loadPhases[phase],
+		DefsRead: atomic.LoadInt64(&c.defsRead),
+	}
+	p := health.Progress{ETA: -1, Detail: &detail}
+	if phase == loadPending {
+		return p
+	}
+	start := time.Unix(0, atomic.LoadInt64(&c.loadStart))
+	end := time.Now()
+	if phase == loadDone {
+		end = time.Unix(0, atomic.LoadInt64(&c.loadEnd))
+		p.Done = true
+		p.ETA = 0
+	}
+	detail.DefsPerSec = health.Rate(detail.DefsRead, start, end)
+	detail.ElapsedSecs = int(end.Sub(start).Seconds())
+	return p
+}
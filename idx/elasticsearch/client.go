@@ -0,0 +1,123 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/secrets"
+)
+
+var errNotFound = errors.New("not found")
+
+// client does the few requests we need on an elasticsearch cluster, over its REST api.
+// requests go to the hosts round robin, and are retried on the next host if one can't be reached.
+type client struct {
+	hosts    []string        // base urls, without trailing /
+	username *secrets.Secret // nil for no authentication
+	password *secrets.Secret
+	http     *http.Client
+	next     uint32 // index of the host for the next request. accessed atomically
+}
+
+func newClient(hosts []string, username, password string, timeout time.Duration) (*client, error) {
+	c := &client{
+		http: &http.Client{Timeout: timeout},
+	}
+	for _, h := range hosts {
+		c.hosts = append(c.hosts, strings.TrimRight(h, "/"))
+	}
+	if username != "" {
+		var err error
+		c.username, err = secrets.New(username)
+		if err != nil {
+			return nil, err
+		}
+		c.password, err = secrets.New(password)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends the request, and returns the body of the response if its status is 2xx, or errNotFound for a 404.
+// body is encoded as json, unless it's a []byte, which is sent as is, as newline delimited json.
+func (c *client) do(ctx context.Context, method, path string, body interface{}) ([]byte, error) {
+	var data []byte
+	contentType := "application/json"
+	switch b := body.(type) {
+	case nil:
+	case []byte:
+		data = b
+		contentType = "application/x-ndjson"
+	default:
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	for i := 0; i < len(c.hosts); i++ {
+		host := c.hosts[int(atomic.AddUint32(&c.next, 1))%len(c.hosts)]
+		var resp *http.Response
+		resp, err = c.send(ctx, method, host+path, contentType, data)
+		if err != nil {
+			// try the next host
+			continue
+		}
+		respBody, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return nil, errNotFound
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			return nil, fmt.Errorf("elasticsearch returned %s for %s %s: %s", resp.Status, method, path, truncate(respBody, 200))
+		}
+		return respBody, nil
+	}
+	return nil, err
+}
+
+func (c *client) send(ctx context.Context, method, url, contentType string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if data != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.username != nil {
+		req.SetBasicAuth(c.username.Get(), c.password.Get())
+	}
+	return c.http.Do(req)
+}
+
+// doJson is do, with the response decoded into out
+func (c *client) doJson(ctx context.Context, method, path string, body, out interface{}) error {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp, out)
+}
+
+func truncate(b []byte, n int) string {
+	if len(b) > n {
+		return string(b[:n]) + "..."
+	}
+	return string(b)
+}
@@ -0,0 +1,791 @@
+// Package elasticsearch is a metric index that keeps the index in memory, like the cassandra index,
+// and persists it in an elasticsearch cluster, where the definitions are also searchable by other tools.
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	LogLevel util.LogLevel
+
+	// metric idx.elasticsearch.bulk.ok is how many definitions were saved to or deleted from elasticsearch successfully
+	statBulkOk = stats.NewCounter32("idx.elasticsearch.bulk.ok")
+	// metric idx.elasticsearch.bulk.fail is how many definitions elasticsearch refused to save or delete. they are not retried
+	statBulkFail = stats.NewCounter32("idx.elasticsearch.bulk.fail")
+	// metric idx.elasticsearch.bulk.retry is how many bulk requests failed and were retried
+	statBulkRetry = stats.NewCounter32("idx.elasticsearch.bulk.retry")
+	// metric idx.elasticsearch.bulk.exec is time spent executing bulk requests (possibly repeatedly until success)
+	statBulkExecDuration = stats.NewLatencyHistogram15s32("idx.elasticsearch.bulk.exec")
+	// metric idx.elasticsearch.write.wait is time saves and deletes spent in queue before being sent in a bulk request
+	statWriteWaitDuration = stats.NewLatencyHistogram12h32("idx.elasticsearch.write.wait")
+
+	// metric idx.elasticsearch.add is the duration of an add of one metric to the elasticsearch idx, including the add to the in-memory index, excluding the bulk request
+	statAddDuration = stats.NewLatencyHistogram15s32("idx.elasticsearch.add")
+	// metric idx.elasticsearch.update is the duration of an update of one metric to the elasticsearch idx, including the update to the in-memory index, excluding the bulk request
+	statUpdateDuration = stats.NewLatencyHistogram15s32("idx.elasticsearch.update")
+	// metric idx.elasticsearch.prune is the duration of a prune of the elasticsearch idx, including the prune of the in-memory index
+	statPruneDuration = stats.NewLatencyHistogram15s32("idx.elasticsearch.prune")
+	// metric idx.elasticsearch.delete is the duration of a delete of one or more metrics from the elasticsearch idx, including the delete from the in-memory index, excluding the bulk request
+	statDeleteDuration = stats.NewLatencyHistogram15s32("idx.elasticsearch.delete")
+	// metric idx.elasticsearch.save.skipped is how many saves have been skipped due to the writeQueue being full
+	statSaveSkipped = stats.NewCounter32("idx.elasticsearch.save.skipped")
+
+	Enabled          bool
+	hosts            string
+	index            string
+	username         string
+	password         string
+	timeout          time.Duration
+	createIndex      bool
+	numShards        int
+	numReplicas      int
+	refreshInterval  time.Duration
+	bulkSize         int
+	bulkMaxWait      time.Duration
+	writeQueueSize   int
+	updateEsIdx      bool
+	updateInterval   time.Duration
+	updateInterval32 uint32
+	maxStale         time.Duration
+	pruneInterval    time.Duration
+	scrollSize       int
+)
+
+const (
+	// how long elasticsearch keeps the context of a scroll between requests, while loading the index
+	scrollKeepAlive = "5m"
+	// max number of meta tag rules that are loaded
+	metaTagRulesLimit = 10000
+)
+
+func ConfigSetup() *flag.FlagSet {
+	esIdx := flag.NewFlagSet("elasticsearch-idx", flag.ExitOnError)
+
+	esIdx.BoolVar(&Enabled, "enabled", false, "")
+	esIdx.StringVar(&hosts, "hosts", "http://localhost:9200", "comma separated list of elasticsearch urls")
+	esIdx.StringVar(&index, "index", "metrictank", "name of the elasticsearch index to store metricDefinitions in. the meta tag rules are stored in <index>-meta-tag-rules")
+	esIdx.StringVar(&username, "username", "", "username for basic authentication. empty for no authentication. may be an env:, file: or vault: reference, see the secrets section")
+	esIdx.StringVar(&password, "password", "", "password for basic authentication. may be an env:, file: or vault: reference, see the secrets section")
+	esIdx.DurationVar(&timeout, "timeout", 10*time.Second, "elasticsearch request timeout")
+	esIdx.BoolVar(&createIndex, "create-index", true, "enable the creation of the indices and their mappings, only one node needs this")
+	esIdx.IntVar(&numShards, "num-shards", 5, "number of shards of the index, when it is created")
+	esIdx.IntVar(&numReplicas, "num-replicas", 1, "number of replicas of each shard of the index")
+	esIdx.DurationVar(&refreshInterval, "refresh-interval", 30*time.Second, "how often elasticsearch makes the changes to the index searchable. longer intervals make bulk indexing cheaper. metrictank serves queries from memory, so it doesn't depend on this")
+	esIdx.IntVar(&bulkSize, "bulk-size", 1000, "max number of metricDefs to save or delete in one bulk request")
+	esIdx.DurationVar(&bulkMaxWait, "bulk-max-wait", time.Second, "max time a metricDef waits for a bulk request to fill up before it is sent")
+	esIdx.IntVar(&writeQueueSize, "write-queue-size", 100000, "Max number of metricDefs allowed to be unwritten to elasticsearch")
+	esIdx.BoolVar(&updateEsIdx, "update-elasticsearch-index", true, "synchronize index changes to elasticsearch. not all your nodes need to do this.")
+	esIdx.DurationVar(&updateInterval, "update-interval", time.Hour*3, "frequency at which we should update the metricDef lastUpdate field, use 0s for instant updates")
+	esIdx.DurationVar(&maxStale, "max-stale", 0, "clear series from the index if they have not been seen for this much time.")
+	esIdx.DurationVar(&pruneInterval, "prune-interval", time.Hour*3, "Interval at which the index should be checked for stale series.")
+	esIdx.IntVar(&scrollSize, "scroll-size", 5000, "number of metricDefs to read per request when loading the index at startup")
+
+	globalconf.Register("elasticsearch-idx", esIdx)
+	return esIdx
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	for _, h := range strings.Split(hosts, ",") {
+		u, err := url.Parse(strings.TrimSpace(h))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			findings = append(findings, conf.NewError("elasticsearch-idx.hosts", "invalid url %q", h))
+		}
+	}
+	if index == "" || index != strings.ToLower(index) || strings.ContainsAny(index, `\/*?"<>| ,#`) {
+		findings = append(findings, conf.NewError("elasticsearch-idx.index", "invalid index name %q. must be lowercase, without \\, /, *, ?, \", <, >, |, space, comma or #", index))
+	}
+	if timeout <= 0 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.timeout", "must be positive"))
+	}
+	if numShards < 1 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.num-shards", "must be at least 1"))
+	}
+	if numReplicas < 0 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.num-replicas", "can't be negative"))
+	}
+	if refreshInterval < time.Second {
+		findings = append(findings, conf.NewError("elasticsearch-idx.refresh-interval", "must be at least 1s"))
+	}
+	if bulkSize < 1 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.bulk-size", "must be at least 1"))
+	}
+	if bulkMaxWait <= 0 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.bulk-max-wait", "must be positive"))
+	}
+	if scrollSize < 1 || scrollSize > 10000 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.scroll-size", "must be between 1 and 10000"))
+	}
+	if maxStale > 0 && pruneInterval <= 0 {
+		findings = append(findings, conf.NewError("elasticsearch-idx.prune-interval", "must be positive when max-stale is set"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
+
+// writeReq is a save of the definition, or a delete of the definition with the id if def is nil
+type writeReq struct {
+	def      *schema.MetricDefinition
+	id       schema.MKey
+	recvTime time.Time
+}
+
+// esDef is a metricDefinition as stored in elasticsearch
+type esDef struct {
+	Id         string   `json:"id"`
+	OrgId      uint32   `json:"orgid"`
+	Partition  int32    `json:"partition"`
+	Name       string   `json:"name"`
+	Interval   int      `json:"interval"`
+	Unit       string   `json:"unit"`
+	Mtype      string   `json:"mtype"`
+	Tags       []string `json:"tags"`
+	LastUpdate int64    `json:"lastupdate"`
+}
+
+// esMetaTagRule is a meta tag rule as stored in elasticsearch
+type esMetaTagRule struct {
+	OrgId       uint32   `json:"orgid"`
+	Expressions []string `json:"expressions"`
+	MetaTags    []string `json:"metatags"`
+}
+
+// Implements the the "MetricIndex" interface
+type EsIdx struct {
+	memory.MemoryIdx
+	client     *client
+	index      string
+	rulesIndex string
+	writeQueue chan writeReq
+	wg         sync.WaitGroup
+
+	// progress of loading the index from elasticsearch, for health and progress reporting. accessed atomically
+	loadPhase int32
+	defsRead  int64
+	loadStart int64 // unix nanos
+	loadEnd   int64 // unix nanos
+}
+
+func New() *EsIdx {
+	var hostList []string
+	for _, h := range strings.Split(hosts, ",") {
+		hostList = append(hostList, strings.TrimSpace(h))
+	}
+	c, err := newClient(hostList, username, password, timeout)
+	if err != nil {
+		log.Fatal(4, "elasticsearch-idx: %s", err)
+	}
+	idx := &EsIdx{
+		MemoryIdx:  *memory.New(),
+		client:     c,
+		index:      index,
+		rulesIndex: index + "-meta-tag-rules",
+	}
+	if updateEsIdx {
+		idx.writeQueue = make(chan writeReq, writeQueueSize)
+	}
+	updateInterval32 = uint32(updateInterval.Nanoseconds() / int64(time.Second))
+	return idx
+}
+
+var defsMapping = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"id":         map[string]string{"type": "keyword"},
+		"orgid":      map[string]string{"type": "long"},
+		"partition":  map[string]string{"type": "integer"},
+		"name":       map[string]string{"type": "keyword"},
+		"interval":   map[string]string{"type": "integer"},
+		"unit":       map[string]string{"type": "keyword"},
+		"mtype":      map[string]string{"type": "keyword"},
+		"tags":       map[string]string{"type": "keyword"},
+		"lastupdate": map[string]string{"type": "long"},
+	},
+}
+
+var rulesMapping = map[string]interface{}{
+	"properties": map[string]interface{}{
+		"orgid":       map[string]string{"type": "long"},
+		"expressions": map[string]string{"type": "keyword"},
+		"metatags":    map[string]string{"type": "keyword"},
+	},
+}
+
+// InitBare makes sure the indices exist in elasticsearch, with the configured settings
+func (e *EsIdx) InitBare() error {
+	ctx := context.Background()
+	indices := []struct {
+		name    string
+		mapping map[string]interface{}
+		shards  int
+	}{
+		{e.index, defsMapping, numShards},
+		{e.rulesIndex, rulesMapping, 1},
+	}
+	for _, i := range indices {
+		if createIndex {
+			log.Info("elasticsearch-idx: ensuring that index %s exists.", i.name)
+			_, err := e.client.do(ctx, "HEAD", "/"+i.name, nil)
+			if err == errNotFound {
+				_, err = e.client.do(ctx, "PUT", "/"+i.name, map[string]interface{}{
+					"settings": map[string]interface{}{
+						"number_of_shards":   i.shards,
+						"number_of_replicas": numReplicas,
+						"refresh_interval":   fmt.Sprintf("%ds", int(refreshInterval.Seconds())),
+					},
+					"mappings": i.mapping,
+				})
+			}
+			if err != nil {
+				return fmt.Errorf("failed to initialize elasticsearch index %s: %s", i.name, err)
+			}
+			continue
+		}
+		for attempt := 1; ; attempt++ {
+			_, err := e.client.do(ctx, "HEAD", "/"+i.name, nil)
+			if err == nil {
+				break
+			}
+			if attempt >= 5 {
+				return fmt.Errorf("elasticsearch index %s not found. %d attempts: %s", i.name, attempt, err)
+			}
+			log.Warn("elasticsearch-idx: index %s not found. retrying in 5s. attempt: %d", i.name, attempt)
+			time.Sleep(5 * time.Second)
+		}
+	}
+
+	// apply the settings that can change to the existing index
+	if createIndex {
+		_, err := e.client.do(ctx, "PUT", "/"+e.index+"/_settings", map[string]interface{}{
+			"index": map[string]interface{}{
+				"number_of_replicas": numReplicas,
+				"refresh_interval":   fmt.Sprintf("%ds", int(refreshInterval.Seconds())),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update settings of elasticsearch index %s: %s", e.index, err)
+		}
+	}
+	return nil
+}
+
+// Init makes sure the needed indices in elasticsearch exist, rebuilds the in-memory index,
+// sets up the bulk writer, metrics and pruning routines
+func (e *EsIdx) Init() error {
+	log.Info("initializing elasticsearch-idx. Hosts=%s", hosts)
+	if err := e.MemoryIdx.Init(); err != nil {
+		return err
+	}
+
+	if err := e.InitBare(); err != nil {
+		return err
+	}
+
+	if updateEsIdx {
+		e.wg.Add(1)
+		writeState := func() interface{} {
+			return map[string]int{"writeQueue": len(e.writeQueue)}
+		}
+		go crash.Go("idx.write", writeState, e.processWriteQueue)
+		log.Info("elasticsearch-idx started the bulk writer")
+	}
+
+	// load the meta tag rules first, so they get applied to the series as they are loaded
+	if memory.TagSupport {
+		e.loadMetaTagRules()
+	}
+
+	e.rebuildIndex()
+
+	if maxStale > 0 {
+		if pruneInterval == 0 {
+			return fmt.Errorf("pruneInterval must be greater then 0")
+		}
+		go crash.Go("idx.prune", nil, e.prune)
+	}
+	return nil
+}
+
+func (e *EsIdx) Stop() {
+	log.Info("elasticsearch-idx stopping")
+	e.MemoryIdx.Stop()
+
+	// if updateEsIdx is disabled then writeQueue should never have been initialized
+	if updateEsIdx {
+		close(e.writeQueue)
+	}
+	e.wg.Wait()
+}
+
+// Update updates an existing archive, if found.
+// It returns whether it was found, and - if so - the (updated) existing archive and its old partition
+func (e *EsIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
+	pre := time.Now()
+
+	archive, oldPartition, inMemory := e.MemoryIdx.Update(point, partition)
+
+	if !updateEsIdx {
+		statUpdateDuration.Value(time.Since(pre))
+		return archive, oldPartition, inMemory
+	}
+
+	if inMemory {
+		// definitions are stored by id, so a new partition just needs a save
+		now := uint32(time.Now().Unix())
+		if archive.LastSave < (now-updateInterval32) || oldPartition != partition {
+			archive = e.updateElasticsearch(now, archive)
+		}
+	}
+
+	statUpdateDuration.Value(time.Since(pre))
+	return archive, oldPartition, inMemory
+}
+
+func (e *EsIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
+	pre := time.Now()
+
+	archive, oldPartition, inMemory := e.MemoryIdx.AddOrUpdate(mkey, data, partition)
+
+	stat := statUpdateDuration
+	if !inMemory {
+		stat = statAddDuration
+	}
+
+	if !updateEsIdx {
+		stat.Value(time.Since(pre))
+		return archive, oldPartition, inMemory
+	}
+
+	// check if we need to save to elasticsearch.
+	now := uint32(time.Now().Unix())
+	if archive.LastSave < (now-updateInterval32) || (inMemory && oldPartition != partition) {
+		archive = e.updateElasticsearch(now, archive)
+	}
+
+	stat.Value(time.Since(pre))
+	return archive, oldPartition, inMemory
+}
+
+// updateElasticsearch queues the archive to be saved to elasticsearch and
+// updates the memory index with the updated fields. like the cassandra index,
+// it only blocks on a full queue if the archive has not been saved for 1.5x updateInterval.
+func (e *EsIdx) updateElasticsearch(now uint32, archive idx.Archive) idx.Archive {
+	req := writeReq{recvTime: time.Now(), def: &archive.MetricDefinition, id: archive.Id}
+	if archive.LastSave < (now - updateInterval32 - updateInterval32/2) {
+		e.writeQueue <- req
+	} else {
+		select {
+		case e.writeQueue <- req:
+		default:
+			statSaveSkipped.Inc()
+			if LogLevel.Get() < 2 {
+				log.Debug("elasticsearch-idx: writeQueue is full, update not saved.")
+			}
+			return archive
+		}
+	}
+	archive.LastSave = now
+	e.MemoryIdx.UpdateArchive(archive)
+	return archive
+}
+
+func (e *EsIdx) rebuildIndex() {
+	log.Info("elasticsearch-idx Rebuilding Memory Index from metricDefinitions in Elasticsearch")
+	pre := time.Now()
+	atomic.StoreInt64(&e.loadStart, pre.UnixNano())
+	atomic.StoreInt32(&e.loadPhase, loadReading)
+	var staleTs uint32
+	if maxStale != 0 {
+		staleTs = uint32(time.Now().Add(maxStale * -1).Unix())
+	}
+	partitions := cluster.Manager.GetPartitions()
+
+	// restoring a snapshot is much faster than reading all definitions from elasticsearch, which we then do in the background
+	if restored, ok := e.MemoryIdx.RestoreSnapshot(partitions); ok {
+		atomic.StoreInt32(&e.loadPhase, loadReconciling)
+		go crash.Go("idx.reconcile", nil, func() {
+			defs, err := e.LoadPartitions(partitions, nil, staleTs)
+			if err != nil {
+				log.Fatal(4, "elasticsearch-idx: failed to load the index: %s", err)
+			}
+			added, updated, removed := e.MemoryIdx.Reconcile(defs, restored)
+			atomic.StoreInt64(&e.loadEnd, time.Now().UnixNano())
+			atomic.StoreInt32(&e.loadPhase, loadDone)
+			log.Info("elasticsearch-idx Reconciling Memory Index with Elasticsearch Complete. Added %d, updated %d, removed %d. Took %s", added, updated, removed, time.Since(pre))
+			e.MemoryIdx.StartSnapshots(partitions)
+		})
+		return
+	}
+
+	defs, err := e.LoadPartitions(partitions, nil, staleTs)
+	if err != nil {
+		log.Fatal(4, "elasticsearch-idx: failed to load the index: %s", err)
+	}
+
+	atomic.StoreInt32(&e.loadPhase, loadIndexing)
+	num := e.MemoryIdx.Load(defs)
+	atomic.StoreInt64(&e.loadEnd, time.Now().UnixNano())
+	atomic.StoreInt32(&e.loadPhase, loadDone)
+	log.Info("elasticsearch-idx Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
+	e.MemoryIdx.StartSnapshots(partitions)
+}
+
+// LoadPartitions appends the definitions of the given partitions to defs. like the cassandra index,
+// it skips the definitions of which all definitions with the same name and tags were last updated before cutoff.
+func (e *EsIdx) LoadPartitions(partitions []int32, defs []schema.MetricDefinition, cutoff uint32) ([]schema.MetricDefinition, error) {
+	query := map[string]interface{}{
+		"size": scrollSize,
+		"sort": []string{"_doc"},
+		"query": map[string]interface{}{
+			"terms": map[string]interface{}{
+				"partition": partitions,
+			},
+		},
+	}
+	ctx := context.Background()
+	var resp searchResponse
+	if err := e.client.doJson(ctx, "POST", "/"+e.index+"/_search?scroll="+scrollKeepAlive, query, &resp); err != nil {
+		return defs, err
+	}
+
+	defsByNames := make(map[string][]*schema.MetricDefinition)
+	for len(resp.Hits.Hits) > 0 {
+		for _, hit := range resp.Hits.Hits {
+			var d esDef
+			if err := json.Unmarshal(hit.Source, &d); err != nil {
+				log.Error(3, "elasticsearch-idx: load() could not decode definition %s: %s -> skipping", hit.Id, err)
+				continue
+			}
+			mkey, err := schema.MKeyFromString(d.Id)
+			if err != nil {
+				log.Error(3, "elasticsearch-idx: load() could not parse ID %q: %s -> skipping", d.Id, err)
+				continue
+			}
+			mdef := &schema.MetricDefinition{
+				Id:         mkey,
+				OrgId:      d.OrgId,
+				Partition:  d.Partition,
+				Name:       d.Name,
+				Interval:   d.Interval,
+				Unit:       d.Unit,
+				Mtype:      d.Mtype,
+				Tags:       d.Tags,
+				LastUpdate: d.LastUpdate,
+			}
+			nameWithTags := mdef.NameWithTags()
+			defsByNames[nameWithTags] = append(defsByNames[nameWithTags], mdef)
+			atomic.AddInt64(&e.defsRead, 1)
+		}
+		scrollId := resp.ScrollId
+		resp = searchResponse{}
+		err := e.client.doJson(ctx, "POST", "/_search/scroll", map[string]string{"scroll": scrollKeepAlive, "scroll_id": scrollId}, &resp)
+		if err != nil {
+			return defs, err
+		}
+	}
+	if resp.ScrollId != "" {
+		if _, err := e.client.do(ctx, "DELETE", "/_search/scroll", map[string][]string{"scroll_id": {resp.ScrollId}}); err != nil && err != errNotFound {
+			log.Warn("elasticsearch-idx: failed to clear scroll: %s", err)
+		}
+	}
+
+	cutoff64 := int64(cutoff)
+NAMES:
+	for name, defsByName := range defsByNames {
+		for _, def := range defsByName {
+			if def.LastUpdate >= cutoff64 {
+				// if one of the defs in a name is not stale, then we'll need to add
+				// all the associated MDs to the defs slice
+				for _, defToAdd := range defsByNames[name] {
+					defs = append(defs, *defToAdd)
+				}
+				continue NAMES
+			}
+		}
+	}
+	return defs, nil
+}
+
+type searchResponse struct {
+	ScrollId string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			Id     string          `json:"_id"`
+			Source json.RawMessage `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Id     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// processWriteQueue sends the saves and deletes from the writeQueue in bulk requests, of up to bulkSize
+// definitions, or what came in within bulkMaxWait
+func (e *EsIdx) processWriteQueue() {
+	defer e.wg.Done()
+	batch := make([]writeReq, 0, bulkSize)
+	timer := time.NewTimer(bulkMaxWait)
+	timer.Stop()
+	for {
+		select {
+		case req, ok := <-e.writeQueue:
+			if !ok {
+				e.flush(batch)
+				log.Info("elasticsearch-idx writeQueue handler ended.")
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(bulkMaxWait)
+			}
+			batch = append(batch, req)
+			if len(batch) < bulkSize {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		e.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush sends the batch in a bulk request. the request is retried until it succeeds, as are the items that
+// elasticsearch rejected because it was overloaded. items that are refused for other reasons are dropped.
+func (e *EsIdx) flush(batch []writeReq) {
+	if len(batch) == 0 {
+		return
+	}
+	pre := time.Now()
+	for _, req := range batch {
+		statWriteWaitDuration.Value(pre.Sub(req.recvTime))
+	}
+	var attempts int
+	for len(batch) > 0 {
+		if attempts > 0 {
+			statBulkRetry.Inc()
+			sleepTime := 100 * attempts
+			if sleepTime > 2000 {
+				sleepTime = 2000
+			}
+			time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+		}
+		attempts++
+
+		var resp bulkResponse
+		err := e.client.doJson(context.Background(), "POST", "/_bulk", e.bulkBody(batch), &resp)
+		if err != nil {
+			if (attempts % 20) == 1 {
+				log.Warn("elasticsearch-idx Failed to write defs to elasticsearch. it will be retried. %s", err)
+			}
+			continue
+		}
+		if len(resp.Items) != len(batch) {
+			log.Error(3, "elasticsearch-idx: bulk response has %d items for a request of %d. assuming all were saved", len(resp.Items), len(batch))
+			statBulkOk.Add(len(batch))
+			break
+		}
+		var retry []writeReq
+		for i, item := range resp.Items {
+			for _, res := range item {
+				switch {
+				case res.Status < 300 || (batch[i].def == nil && res.Status == 404):
+					statBulkOk.Inc()
+				case res.Status == 429 || res.Status >= 500:
+					retry = append(retry, batch[i])
+				default:
+					statBulkFail.Inc()
+					log.Error(3, "elasticsearch-idx: elasticsearch refused definition %s: %d %s", res.Id, res.Status, res.Error)
+				}
+			}
+		}
+		batch = retry
+	}
+	statBulkExecDuration.Value(time.Since(pre))
+	if LogLevel.Get() < 2 {
+		log.Debug("elasticsearch-idx: bulk request done after %d attempts", attempts)
+	}
+}
+
+// bulkBody returns the body of a bulk request for the saves and deletes
+func (e *EsIdx) bulkBody(batch []writeReq) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, req := range batch {
+		action := "index"
+		if req.def == nil {
+			action = "delete"
+		}
+		enc.Encode(map[string]map[string]string{action: {"_index": e.index, "_id": req.id.String()}})
+		if req.def != nil {
+			enc.Encode(esDef{
+				Id:         req.def.Id.String(),
+				OrgId:      req.def.OrgId,
+				Partition:  req.def.Partition,
+				Name:       req.def.Name,
+				Interval:   req.def.Interval,
+				Unit:       req.def.Unit,
+				Mtype:      req.def.Mtype,
+				Tags:       req.def.Tags,
+				LastUpdate: req.def.LastUpdate,
+			})
+		}
+	}
+	return buf.Bytes()
+}
+
+// deleteDefs queues the deletes of the archives, which are sent in order with the saves
+func (e *EsIdx) deleteDefs(archives []idx.Archive) {
+	if !updateEsIdx {
+		return
+	}
+	for _, a := range archives {
+		e.writeQueue <- writeReq{id: a.Id, recvTime: time.Now()}
+	}
+}
+
+func (e *EsIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := e.MemoryIdx.Delete(orgId, pattern)
+	if err != nil {
+		return defs, err
+	}
+	e.deleteDefs(defs)
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+func (e *EsIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := e.MemoryIdx.DeleteTagged(orgId, paths)
+	if err != nil {
+		return defs, err
+	}
+	e.deleteDefs(defs)
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+// metaTagRuleId returns the id of the document of a meta tag rule, which is unique per org and expressions
+func metaTagRuleId(orgId uint32, expressions []string) string {
+	sorted := append([]string(nil), expressions...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%d.%x", orgId, md5.Sum([]byte(strings.Join(sorted, ";"))))
+}
+
+// UpsertMetaTagRule upserts the meta tag rule in the memory index, and saves it to elasticsearch
+func (e *EsIdx) UpsertMetaTagRule(orgId uint32, rule idx.MetaTagRule) (bool, error) {
+	created, err := e.MemoryIdx.UpsertMetaTagRule(orgId, rule)
+	if err != nil || !updateEsIdx {
+		return created, err
+	}
+	path := "/" + e.rulesIndex + "/_doc/" + metaTagRuleId(orgId, rule.Expressions)
+	if len(rule.MetaTags) == 0 {
+		_, err = e.client.do(context.Background(), "DELETE", path, nil)
+		if err == errNotFound {
+			err = nil
+		}
+	} else {
+		_, err = e.client.do(context.Background(), "PUT", path, esMetaTagRule{
+			OrgId:       orgId,
+			Expressions: rule.Expressions,
+			MetaTags:    rule.MetaTags,
+		})
+	}
+	if err != nil {
+		log.Error(3, "elasticsearch-idx: failed to save meta tag rule %v of org %d: %s", rule.Expressions, orgId, err)
+		return created, fmt.Errorf("failed to save meta tag rule: %s", err)
+	}
+	return created, nil
+}
+
+// loadMetaTagRules loads the meta tag rules of all orgs into the memory index
+func (e *EsIdx) loadMetaTagRules() {
+	var resp searchResponse
+	err := e.client.doJson(context.Background(), "POST", "/"+e.rulesIndex+"/_search", map[string]int{"size": metaTagRulesLimit}, &resp)
+	if err != nil {
+		log.Error(3, "elasticsearch-idx: failed to load meta tag rules: %s", err)
+		return
+	}
+	var num int
+	for _, hit := range resp.Hits.Hits {
+		var r esMetaTagRule
+		if err := json.Unmarshal(hit.Source, &r); err != nil {
+			log.Error(3, "elasticsearch-idx: skipping meta tag rule %s that could not be decoded: %s", hit.Id, err)
+			continue
+		}
+		rule := idx.MetaTagRule{
+			Expressions: r.Expressions,
+			MetaTags:    r.MetaTags,
+		}
+		if _, err := e.MemoryIdx.UpsertMetaTagRule(r.OrgId, rule); err != nil {
+			log.Error(3, "elasticsearch-idx: skipping invalid meta tag rule %v of org %d: %s", rule.Expressions, r.OrgId, err)
+			continue
+		}
+		num++
+	}
+	log.Info("elasticsearch-idx: loaded %d meta tag rules", num)
+}
+
+func (e *EsIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
+	pre := time.Now()
+	pruned, err := e.MemoryIdx.Prune(oldest)
+	statPruneDuration.Value(time.Since(pre))
+	return pruned, err
+}
+
+func (e *EsIdx) prune() {
+	ticker := time.NewTicker(pruneInterval)
+	for range ticker.C {
+		if LogLevel.Get() < 2 {
+			log.Debug("elasticsearch-idx: pruning items from index that have not been seen for %s", maxStale.String())
+		}
+		staleTs := time.Now().Add(maxStale * -1)
+		_, err := e.Prune(staleTs)
+		if err != nil {
+			log.Error(3, "elasticsearch-idx: prune error. %s", err)
+		}
+	}
+}
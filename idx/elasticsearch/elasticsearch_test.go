@@ -0,0 +1,221 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/idx/memory"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// fakeES records the requests it gets, and responds with the responses of the handler
+type fakeES struct {
+	sync.Mutex
+	requests []string // method path body
+	handler  func(method, path string, body []byte) (int, string)
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	f.Lock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+	f.Unlock()
+	status, resp := f.handler(r.Method, r.URL.RequestURI(), body)
+	w.WriteHeader(status)
+	w.Write([]byte(resp))
+}
+
+func testIdx(t *testing.T, f *fakeES) (*EsIdx, func()) {
+	server := httptest.NewServer(f)
+	c, err := newClient([]string{server.URL + "/"}, "", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &EsIdx{
+		MemoryIdx:  *memory.New(),
+		client:     c,
+		index:      "mt",
+		rulesIndex: "mt-meta-tag-rules",
+	}
+	return e, server.Close
+}
+
+func testDef(name string, partition int32, lastUpdate int64, tags ...string) schema.MetricDefinition {
+	md := schema.MetricData{OrgId: 1, Name: name, Interval: 10, Mtype: "gauge", Tags: tags}
+	md.SetId()
+	mkey, _ := schema.MKeyFromString(md.Id)
+	return schema.MetricDefinition{
+		Id:         mkey,
+		OrgId:      1,
+		Partition:  partition,
+		Name:       name,
+		Interval:   10,
+		Mtype:      "gauge",
+		Tags:       tags,
+		LastUpdate: lastUpdate,
+	}
+}
+
+func TestFlush(t *testing.T) {
+	a := testDef("a", 1, 100, "env=prod")
+	b := testDef("b", 2, 200)
+	c := testDef("c", 3, 300)
+
+	var attempt int
+	f := &fakeES{}
+	f.handler = func(method, path string, body []byte) (int, string) {
+		attempt++
+		switch attempt {
+		case 1:
+			return 503, "unavailable"
+		case 2:
+			// a is rejected and must be retried, c is refused for good, the delete of b is fine
+			return 200, `{"errors":true,"items":[{"index":{"_id":"a","status":429}},{"delete":{"_id":"b","status":404}},{"index":{"_id":"c","status":400,"error":{"type":"mapper_parsing_exception"}}}]}`
+		}
+		return 200, `{"errors":false,"items":[{"index":{"_id":"a","status":200}}]}`
+	}
+	e, stop := testIdx(t, f)
+	defer stop()
+
+	now := time.Now()
+	e.flush([]writeReq{
+		{def: &a, id: a.Id, recvTime: now},
+		{id: b.Id, recvTime: now},
+		{def: &c, id: c.Id, recvTime: now},
+	})
+
+	if len(f.requests) != 3 {
+		t.Fatalf("expected 3 bulk requests, got %d: %v", len(f.requests), f.requests)
+	}
+	for _, r := range f.requests {
+		if !strings.HasPrefix(r, "POST /_bulk ") {
+			t.Fatalf("expected bulk requests, got %q", r)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(strings.TrimPrefix(f.requests[1], "POST /_bulk ")), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("expected 5 lines in the bulk request, got %d: %v", len(lines), lines)
+	}
+	expAction := `{"index":{"_id":"` + a.Id.String() + `","_index":"mt"}}`
+	if lines[0] != expAction {
+		t.Errorf("expected action %s, got %s", expAction, lines[0])
+	}
+	var doc esDef
+	if err := json.Unmarshal([]byte(lines[1]), &doc); err != nil {
+		t.Fatal(err)
+	}
+	expDoc := esDef{Id: a.Id.String(), OrgId: 1, Partition: 1, Name: "a", Interval: 10, Mtype: "gauge", Tags: []string{"env=prod"}, LastUpdate: 100}
+	if !reflect.DeepEqual(doc, expDoc) {
+		t.Errorf("expected document %+v, got %+v", expDoc, doc)
+	}
+	expAction = `{"delete":{"_id":"` + b.Id.String() + `","_index":"mt"}}`
+	if lines[2] != expAction {
+		t.Errorf("expected action %s, got %s", expAction, lines[2])
+	}
+	retried := strings.Split(strings.TrimSpace(strings.TrimPrefix(f.requests[2], "POST /_bulk ")), "\n")
+	if len(retried) != 2 || !strings.Contains(retried[0], a.Id.String()) {
+		t.Errorf("expected only the rejected save to be retried, got %v", retried)
+	}
+}
+
+func TestLoadPartitions(t *testing.T) {
+	defs := []schema.MetricDefinition{
+		testDef("fresh", 1, 1000),
+		testDef("stale", 1, 10),
+		// same name and tags as fresh, but another interval. loaded because fresh is not stale
+		testDef("fresh", 2, 10),
+	}
+	defs[2].Interval = 60
+	defs[2].Id = schema.MKey{Org: 1, Key: [16]byte{1}}
+	hits := func(defs ...schema.MetricDefinition) string {
+		var out []map[string]interface{}
+		for _, d := range defs {
+			out = append(out, map[string]interface{}{
+				"_id": d.Id.String(),
+				"_source": esDef{
+					Id:         d.Id.String(),
+					OrgId:      d.OrgId,
+					Partition:  d.Partition,
+					Name:       d.Name,
+					Interval:   d.Interval,
+					Mtype:      d.Mtype,
+					Tags:       d.Tags,
+					LastUpdate: d.LastUpdate,
+				},
+			})
+		}
+		buf, _ := json.Marshal(map[string]interface{}{"_scroll_id": "s1", "hits": map[string]interface{}{"hits": out}})
+		return string(buf)
+	}
+
+	var scrolls int
+	f := &fakeES{}
+	f.handler = func(method, path string, body []byte) (int, string) {
+		switch {
+		case method == "POST" && path == "/mt/_search?scroll="+scrollKeepAlive:
+			return 200, hits(defs[0], defs[1])
+		case method == "POST" && path == "/_search/scroll":
+			scrolls++
+			if scrolls == 1 {
+				return 200, hits(defs[2])
+			}
+			return 200, hits()
+		case method == "DELETE" && path == "/_search/scroll":
+			return 200, `{"succeeded":true}`
+		}
+		return 400, "unexpected request"
+	}
+	e, stop := testIdx(t, f)
+	defer stop()
+
+	scrollSize = 2
+	loaded, err := e.LoadPartitions([]int32{1, 2}, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range loaded {
+		got = append(got, d.Id.String())
+	}
+	sort.Strings(got)
+	exp := []string{defs[0].Id.String(), defs[2].Id.String()}
+	sort.Strings(exp)
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected defs %v, got %v", exp, got)
+	}
+
+	var query struct {
+		Size  int `json:"size"`
+		Query struct {
+			Terms struct {
+				Partition []int32 `json:"partition"`
+			} `json:"terms"`
+		} `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(strings.SplitN(f.requests[0], " ", 3)[2]), &query); err != nil {
+		t.Fatal(err)
+	}
+	if query.Size != 2 || !reflect.DeepEqual(query.Query.Terms.Partition, []int32{1, 2}) {
+		t.Errorf("unexpected search request %s", f.requests[0])
+	}
+	if last := f.requests[len(f.requests)-1]; !strings.HasPrefix(last, "DELETE /_search/scroll") {
+		t.Errorf("expected the scroll to be cleared, got %s", last)
+	}
+}
+
+func TestMetaTagRuleId(t *testing.T) {
+	if metaTagRuleId(1, []string{"a=b", "c=d"}) != metaTagRuleId(1, []string{"c=d", "a=b"}) {
+		t.Errorf("expected the id to not depend on the order of the expressions")
+	}
+	if metaTagRuleId(1, []string{"a=b"}) == metaTagRuleId(2, []string{"a=b"}) {
+		t.Errorf("expected the id to depend on the org")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/grafana/metrictank/conf"
 	schema "gopkg.in/raintank/schema.v1"
 )
 
@@ -17,6 +18,8 @@ var (
 )
 
 //go:generate msgp
+//msgp:ignore MetaTagRule
+
 type Node struct {
 	Path        string
 	Leaf        bool
@@ -40,6 +43,13 @@ func NewArchiveBare(name string) Archive {
 	}
 }
 
+// MetaTagRule adds its meta tags to all series that match its tag expressions.
+// The meta tags can be queried like the tags of the series.
+type MetaTagRule struct {
+	Expressions []string `json:"expressions"`
+	MetaTags    []string `json:"metaTags"`
+}
+
 // The MetricIndex interface supports Graphite style queries.
 // Note:
 // * metrictank is a multi-tenant system where different orgs cannot see each
@@ -87,6 +97,10 @@ type MetricIndex interface {
 	// List returns all Archives for the passed OrgId and the public orgId
 	List(orgId uint32) []Archive
 
+	// Count returns the number of Archives in the index, across all orgs,
+	// and how many of them are matched by the filter.
+	Count(filter func(Archive) bool) (int, int)
+
 	// Prune deletes all metrics that haven't been seen since the given timestamp.
 	// It returns all Archives deleted and any error encountered.
 	Prune(oldest time.Time) ([]Archive, error)
@@ -109,14 +123,16 @@ type MetricIndex interface {
 
 	// FindTags generates a list of possible tags that could complete a
 	// given prefix. It also accepts additional tag conditions to further narrow
-	// down the result set in the format of graphite's tag queries
-	FindTags(orgId uint32, prefix string, expressions []string, from int64, limit uint) ([]string, error)
+	// down the result set in the format of graphite's tag queries.
+	// The results are sorted, and only those that sort after the given one are returned, to page through them.
+	FindTags(orgId uint32, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error)
 
 	// FindTagValues generates a list of possible values that could
 	// complete a given value prefix. It requires a tag to be specified and only values
 	// of the given tag will be returned. It also accepts additional conditions to
-	// further narrow down the result set in the format of graphite's tag queries
-	FindTagValues(orgId uint32, tag string, prefix string, expressions []string, from int64, limit uint) ([]string, error)
+	// further narrow down the result set in the format of graphite's tag queries.
+	// The results are sorted, and only those that sort after the given one are returned, to page through them.
+	FindTagValues(orgId uint32, tag string, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error)
 
 	// TagDetails returns a list of all values associated with a given tag key in the
 	// given org. The occurrences of each value is counted and the count is referred to by
@@ -130,4 +146,46 @@ type MetricIndex interface {
 	// DeleteTagged deletes the specified series from the tag index and also the
 	// DefById index.
 	DeleteTagged(orgId uint32, paths []string) ([]Archive, error)
+
+	// MetaTagRules returns the meta tag rules of the given org.
+	MetaTagRules(orgId uint32) []MetaTagRule
+
+	// UpsertMetaTagRule adds the meta tag rule to the given org, or replaces its rule with the same expressions.
+	// A rule without meta tags removes the rule with the same expressions. The meta tags of all series of the
+	// org are updated accordingly. It returns whether a new rule was added.
+	UpsertMetaTagRule(orgId uint32, rule MetaTagRule) (bool, error)
+
+	// StorageOverrides returns the storage overrides, which take precedence over the storage-schemas
+	// and storage-aggregation files.
+	StorageOverrides() []conf.Override
+
+	// UpsertStorageOverride activates the storage override, or replaces the override with the same name.
+	// An override that neither sets retentions nor aggregation methods removes the override with the same name.
+	// It returns whether a new override was added.
+	UpsertStorageOverride(o conf.Override) (bool, error)
+
+	// OrgPolicy returns the policy of the given org, and whether it has one.
+	OrgPolicy(orgId uint32) (OrgPolicy, bool)
+
+	// OrgPolicies returns the policies of all orgs, sorted by org.
+	OrgPolicies() []OrgPolicy
+
+	// UpsertOrgPolicy sets the policy of the org of the given policy, replacing its previous one.
+	// An empty policy removes the policy of the org. It returns whether the org did not have a policy yet.
+	UpsertOrgPolicy(p OrgPolicy) (bool, error)
+
+	// SavedQuery returns the saved query of the org with the given id, and whether it exists and did not expire.
+	SavedQuery(orgId uint32, id string) (SavedQuery, bool)
+
+	// SavedQueries returns the saved queries of the org that did not expire, sorted by id.
+	SavedQueries(orgId uint32) []SavedQuery
+
+	// UpsertSavedQuery saves the query under its id, replacing the query of its org with the same id.
+	// A query without targets removes the query with the same id. It returns whether a new query was saved.
+	UpsertSavedQuery(q SavedQuery) (bool, error)
+
+	// Cardinality returns the number of series of each org that the filter accepts, sorted by org, with the
+	// limit top-level nodes with the most series, and the limit tag keys with the most values.
+	// If from is > 0, only the series of which the LastUpdate time is >= from are counted.
+	Cardinality(filter func(orgId uint32) bool, from int64, limit int) []Cardinality
 }
@@ -0,0 +1,113 @@
+package memory
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/grafana/metrictank/idx"
+)
+
+// orgCardinality collects the cardinality of an org while walking the index
+type orgCardinality struct {
+	series int
+	nodes  map[string]int
+	keys   map[string]*tagKeyCardinality
+}
+
+type tagKeyCardinality struct {
+	series int
+	values map[string]struct{}
+}
+
+// Cardinality returns the number of series of each org that the filter accepts, sorted by org, with the
+// limit top-level nodes with the most series, and the limit tag keys with the most values.
+// If from is > 0, only the series of which the LastUpdate time is >= from are counted.
+// a limit of 0 returns all nodes and tag keys
+func (m *MemoryIdx) Cardinality(filter func(orgId uint32) bool, from int64, limit int) []idx.Cardinality {
+	orgs := make(map[uint32]*orgCardinality)
+	m.RLock()
+	for _, def := range m.defById {
+		if !filter(def.OrgId) || (from > 0 && def.LastUpdate < from) {
+			continue
+		}
+		org, ok := orgs[def.OrgId]
+		if !ok {
+			org = &orgCardinality{
+				nodes: make(map[string]int),
+				keys:  make(map[string]*tagKeyCardinality),
+			}
+			orgs[def.OrgId] = org
+		}
+		org.series++
+		node := def.Name
+		if i := strings.IndexByte(node, '.'); i >= 0 {
+			node = node[:i]
+		}
+		org.nodes[node]++
+		for _, tag := range def.Tags {
+			i := strings.IndexByte(tag, '=')
+			if i < 0 {
+				continue
+			}
+			key, ok := org.keys[tag[:i]]
+			if !ok {
+				key = &tagKeyCardinality{values: make(map[string]struct{})}
+				org.keys[tag[:i]] = key
+			}
+			key.series++
+			key.values[tag[i+1:]] = struct{}{}
+		}
+	}
+	m.RUnlock()
+
+	out := make([]idx.Cardinality, 0, len(orgs))
+	for orgId, org := range orgs {
+		out = append(out, idx.Cardinality{
+			OrgId:         orgId,
+			Series:        org.series,
+			TopLevelNodes: topNodes(org.nodes, limit),
+			TagKeys:       topTagKeys(org.keys, limit),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].OrgId < out[j].OrgId })
+	return out
+}
+
+// topNodes returns the limit nodes with the most series, by node for equal counts
+func topNodes(series map[string]int, limit int) []idx.NodeCardinality {
+	nodes := make([]idx.NodeCardinality, 0, len(series))
+	for node, n := range series {
+		nodes = append(nodes, idx.NodeCardinality{Node: node, Series: n})
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Series != nodes[j].Series {
+			return nodes[i].Series > nodes[j].Series
+		}
+		return nodes[i].Node < nodes[j].Node
+	})
+	if limit > 0 && len(nodes) > limit {
+		nodes = nodes[:limit]
+	}
+	return nodes
+}
+
+// topTagKeys returns the limit tag keys with the most values, then with the most series, by key for equal counts
+func topTagKeys(keys map[string]*tagKeyCardinality, limit int) []idx.TagKeyCardinality {
+	out := make([]idx.TagKeyCardinality, 0, len(keys))
+	for key, k := range keys {
+		out = append(out, idx.TagKeyCardinality{Key: key, Series: k.series, Values: len(k.values)})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Values != out[j].Values {
+			return out[i].Values > out[j].Values
+		}
+		if out[i].Series != out[j].Series {
+			return out[i].Series > out[j].Series
+		}
+		return out[i].Key < out[j].Key
+	})
+	if limit > 0 && len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestCardinality(t *testing.T) {
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 2, true))
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+	add := func(org uint32, name string, lastUpdate int64, tags ...string) {
+		md := &schema.MetricData{Name: name, OrgId: int(org), Interval: 10, Time: lastUpdate, Tags: tags}
+		md.SetId()
+		mkey, err := schema.MKeyFromString(md.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+	add(1, "servers.web1.cpu", 100, "dc=eu", "host=web1")
+	add(1, "servers.web2.cpu", 100, "dc=eu", "host=web2")
+	add(1, "servers.web3.cpu", 10, "dc=us", "host=web3")
+	add(1, "apps.shop.requests", 100, "dc=eu")
+	add(1, "cpu", 100)
+	add(2, "servers.db1.cpu", 100)
+
+	exp := []idx.Cardinality{
+		{
+			OrgId:         1,
+			Series:        5,
+			TopLevelNodes: []idx.NodeCardinality{{Node: "servers", Series: 3}, {Node: "apps", Series: 1}},
+			TagKeys:       []idx.TagKeyCardinality{{Key: "host", Series: 3, Values: 3}, {Key: "dc", Series: 4, Values: 2}},
+		},
+		{
+			OrgId:         2,
+			Series:        1,
+			TopLevelNodes: []idx.NodeCardinality{{Node: "servers", Series: 1}},
+			TagKeys:       []idx.TagKeyCardinality{},
+		},
+	}
+	if got := ix.Cardinality(func(uint32) bool { return true }, 0, 2); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+
+	// series not updated since from are not active
+	exp = []idx.Cardinality{
+		{
+			OrgId:         1,
+			Series:        4,
+			TopLevelNodes: []idx.NodeCardinality{{Node: "servers", Series: 2}, {Node: "apps", Series: 1}, {Node: "cpu", Series: 1}},
+			TagKeys:       []idx.TagKeyCardinality{{Key: "host", Series: 2, Values: 2}, {Key: "dc", Series: 3, Values: 1}},
+		},
+	}
+	if got := ix.Cardinality(func(org uint32) bool { return org == 1 }, 50, 0); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %v, got %v", exp, got)
+	}
+}
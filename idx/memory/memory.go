@@ -3,23 +3,27 @@ package memory
 import (
 	"flag"
 	"fmt"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/health"
 	"github.com/grafana/metrictank/idx"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 	"gopkg.in/raintank/schema.v1"
 )
 
 var (
-	LogLevel int
+	LogLevel util.LogLevel
 
 	// metric idx.memory.update is the number of updates to the memory idx
 	statUpdate = stats.NewCounter32("idx.memory.ops.update")
@@ -50,6 +54,10 @@ var (
 	matchCacheSize  int
 	TagSupport      bool
 	TagQueryWorkers int // number of workers to spin up when evaluation tag expressions
+
+	snapshotDir      string
+	snapshotInterval time.Duration
+	snapshotMaxAge   time.Duration
 )
 
 func ConfigSetup() {
@@ -58,9 +66,38 @@ func ConfigSetup() {
 	memoryIdx.BoolVar(&TagSupport, "tag-support", false, "enables/disables querying based on tags")
 	memoryIdx.IntVar(&TagQueryWorkers, "tag-query-workers", 50, "number of workers to spin up to evaluate tag queries")
 	memoryIdx.IntVar(&matchCacheSize, "match-cache-size", 1000, "size of regular expression cache in tag query evaluation")
+	memoryIdx.StringVar(&snapshotDir, "snapshot-dir", "", "directory to write snapshots of the index to, to restore the index from on startup rather than loading all series from the persistent index (cassandra-idx, postgres-idx or elasticsearch-idx). the restored series are reconciled with the persistent index in the background. empty to disable")
+	memoryIdx.DurationVar(&snapshotInterval, "snapshot-interval", time.Hour, "how often to write a snapshot of the index. one is also written on shutdown")
+	memoryIdx.DurationVar(&snapshotMaxAge, "snapshot-max-age", 24*time.Hour, "snapshots older than this are not restored, and the index is loaded from the persistent index instead")
 	globalconf.Register("memory-idx", memoryIdx)
 }
 
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if snapshotDir == "" {
+		return nil
+	}
+	var findings []conf.Finding
+	if snapshotInterval <= 0 {
+		findings = append(findings, conf.NewError("memory-idx.snapshot-interval", "must be positive"))
+	}
+	if snapshotMaxAge <= 0 {
+		findings = append(findings, conf.NewError("memory-idx.snapshot-max-age", "must be positive"))
+	}
+	if fi, err := os.Stat(snapshotDir); err != nil || !fi.IsDir() {
+		findings = append(findings, conf.NewError("memory-idx.snapshot-dir", "%q is not a directory", snapshotDir))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
+
 type Tree struct {
 	Items map[string]*Node // key is the full path of the node.
 }
@@ -189,14 +226,33 @@ type MemoryIdx struct {
 	// used by tag index
 	defByTagSet defByTagSet
 	tags        map[uint32]TagIndex // by orgId
+
+	// used by meta tags, which are also in the tag index
+	metaTagRules map[uint32][]metaTagRule            // by orgId
+	metaTags     map[uint32]map[schema.MKey][]string // by orgId, the meta tags of each series
+
+	// not part of the index itself, so they have their own lock
+	orgPoliciesLock sync.RWMutex
+	orgPolicies     map[uint32]idx.OrgPolicy // by orgId
+
+	savedQueriesLock sync.RWMutex
+	savedQueries     map[uint32]map[string]idx.SavedQuery // by orgId and id
+
+	// only set when snapshots are written, see StartSnapshots
+	snapshotShutdown chan struct{}
+	snapshotDone     chan struct{}
 }
 
 func New() *MemoryIdx {
 	return &MemoryIdx{
-		defById:     make(map[schema.MKey]*idx.Archive),
-		defByTagSet: make(defByTagSet),
-		tree:        make(map[uint32]*Tree),
-		tags:        make(map[uint32]TagIndex),
+		defById:      make(map[schema.MKey]*idx.Archive),
+		defByTagSet:  make(defByTagSet),
+		tree:         make(map[uint32]*Tree),
+		tags:         make(map[uint32]TagIndex),
+		metaTagRules: make(map[uint32][]metaTagRule),
+		metaTags:     make(map[uint32]map[schema.MKey][]string),
+		orgPolicies:  make(map[uint32]idx.OrgPolicy),
+		savedQueries: make(map[uint32]map[string]idx.SavedQuery),
 	}
 }
 
@@ -205,7 +261,10 @@ func (m *MemoryIdx) Init() error {
 }
 
 func (m *MemoryIdx) Stop() {
-	return
+	if m.snapshotShutdown != nil {
+		close(m.snapshotShutdown)
+		<-m.snapshotDone
+	}
 }
 
 // Update updates an existing archive, if found.
@@ -219,7 +278,7 @@ func (m *MemoryIdx) Update(point schema.MetricPoint, partition int32) (idx.Archi
 	existing, ok := m.defById[point.MKey]
 	if ok {
 		oldPart := existing.Partition
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("metricDef with id %v already in index", point.MKey)
 		}
 
@@ -246,7 +305,9 @@ func (m *MemoryIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, parti
 	existing, ok := m.defById[mkey]
 	if ok {
 		oldPart := existing.Partition
-		log.Debug("metricDef with id %s already in index.", mkey)
+		if LogLevel.Get() < 2 {
+			log.Debug("metricDef with id %s already in index.", mkey)
+		}
 		if existing.LastUpdate < int64(data.Time) {
 			existing.LastUpdate = int64(data.Time)
 		}
@@ -306,6 +367,7 @@ func (m *MemoryIdx) indexTags(def *schema.MetricDefinition) {
 	tags.addTagId("name", def.Name, def.Id)
 
 	m.defByTagSet.add(def)
+	m.applyMetaTags(def)
 }
 
 // deindexTags takes a given metric definition and removes all references
@@ -314,6 +376,8 @@ func (m *MemoryIdx) indexTags(def *schema.MetricDefinition) {
 // unsuccessful, "true" means the indexing was at least partially or completely
 // successful
 func (m *MemoryIdx) deindexTags(tags TagIndex, def *schema.MetricDefinition) bool {
+	m.removeMetaTags(tags, def.OrgId, def.Id)
+
 	for _, tag := range def.Tags {
 		tagSplits := strings.SplitN(tag, "=", 2)
 		if len(tagSplits) < 2 {
@@ -384,7 +448,9 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 		if _, ok := m.defById[def.Id]; !ok {
 			m.defById[def.Id] = archive
 			statAdd.Inc()
-			log.Debug("memory-idx: adding %s to DefById", path)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: adding %s to DefById", path)
+			}
 		}
 		return *archive
 	}
@@ -392,7 +458,9 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 	//first check to see if a tree has been created for this OrgId
 	tree, ok := m.tree[def.OrgId]
 	if !ok || len(tree.Items) == 0 {
-		log.Debug("memory-idx: first metricDef seen for orgId %d", def.OrgId)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: first metricDef seen for orgId %d", def.OrgId)
+		}
 		root := &Node{
 			Path:     "",
 			Children: make([]string, 0),
@@ -407,7 +475,9 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 		// An existing leaf is possible if there are multiple metricDefs for the same path due
 		// to different tags or interval
 		if node, ok := tree.Items[path]; ok {
-			log.Debug("memory-idx: existing index entry for %s. Adding %s to Defs list", path, def.Id)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: existing index entry for %s. Adding %s to Defs list", path, def.Id)
+			}
 			node.Defs = append(node.Defs, def.Id)
 			m.defById[def.Id] = archive
 			statAdd.Inc()
@@ -424,12 +494,16 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 		branch := path[:pos]
 		prevNode := path[pos+1 : prevPos]
 		if n, ok := tree.Items[branch]; ok {
-			log.Debug("memory-idx: adding %s as child of %s", prevNode, n.Path)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: adding %s as child of %s", prevNode, n.Path)
+			}
 			n.Children = append(n.Children, prevNode)
 			break
 		}
 
-		log.Debug("memory-idx: creating branch %s with child %s", branch, prevNode)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: creating branch %s with child %s", branch, prevNode)
+		}
 		tree.Items[branch] = &Node{
 			Path:     branch,
 			Children: []string{prevNode},
@@ -443,13 +517,17 @@ func (m *MemoryIdx) add(def *schema.MetricDefinition) idx.Archive {
 	if pos == -1 {
 		// need to add to the root node.
 		branch := path[:prevPos]
-		log.Debug("memory-idx: no existing branches found for %s.  Adding to the root node.", branch)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: no existing branches found for %s.  Adding to the root node.", branch)
+		}
 		n := tree.Items[""]
 		n.Children = append(n.Children, branch)
 	}
 
 	// Add leaf node
-	log.Debug("memory-idx: creating leaf %s", path)
+	if LogLevel.Get() < 2 {
+		log.Debug("memory-idx: creating leaf %s", path)
+	}
 	tree.Items[path] = &Node{
 		Path:     path,
 		Children: []string{},
@@ -563,10 +641,11 @@ func (m *MemoryIdx) TagDetails(orgId uint32, key, filter string, from int64) (ma
 // prefix:      prefix match
 // expressions: tagdb expressions in the same format as graphite
 // from:        tags must have at least one metric with LastUpdate >= from
+// after:       only tags that sort after this one are returned, to page through the results
 // limit:       the maximum number of results to return
 //
 // the results will always be sorted alphabetically for consistency
-func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -595,9 +674,12 @@ func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string,
 			return nil, nil
 		}
 
+		query.metaTags = m.metaTags[orgId]
 		resMap := query.RunGetTags(tags, m.defById)
 		for tag := range resMap {
-			res = append(res, tag)
+			if tag > after {
+				res = append(res, tag)
+			}
 		}
 
 		sort.Strings(res)
@@ -615,7 +697,7 @@ func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string,
 
 		tagsSorted := make([]string, 0, len(tags))
 		for tag := range tags {
-			if !strings.HasPrefix(tag, prefix) {
+			if !strings.HasPrefix(tag, prefix) || tag <= after {
 				continue
 			}
 
@@ -646,10 +728,11 @@ func (m *MemoryIdx) FindTags(orgId uint32, prefix string, expressions []string,
 // prefix:      value prefix match
 // expressions: tagdb expressions in the same format as graphite
 // from:        tags must have at least one metric with LastUpdate >= from
+// after:       only values that sort after this one are returned, to page through the results
 // limit:       the maximum number of results to return
 //
 // the results will always be sorted alphabetically for consistency
-func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions []string, from int64, limit uint) ([]string, error) {
+func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions []string, from int64, after string, limit uint) ([]string, error) {
 	if !TagSupport {
 		log.Warn("memory-idx: received tag query, but tag support is disabled")
 		return nil, nil
@@ -683,6 +766,7 @@ func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions
 			return nil, nil
 		}
 
+		query.metaTags = m.metaTags[orgId]
 		ids := query.Run(tags, m.defById)
 		valueMap := make(map[string]struct{})
 		prefix := tag + "="
@@ -701,7 +785,7 @@ func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions
 			if tag == "name" {
 				valueMap[def.Name] = struct{}{}
 			} else {
-				for _, t := range def.Tags {
+				for _, t := range query.tags(def) {
 					if !strings.HasPrefix(t, prefix) {
 						continue
 					}
@@ -714,7 +798,9 @@ func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions
 
 		res = make([]string, 0, len(valueMap))
 		for v := range valueMap {
-			res = append(res, v)
+			if v > after {
+				res = append(res, v)
+			}
 		}
 	} else {
 		m.RLock()
@@ -732,7 +818,7 @@ func (m *MemoryIdx) FindTagValues(orgId uint32, tag, prefix string, expressions
 
 		res = make([]string, 0, len(vals))
 		for val := range vals {
-			if !strings.HasPrefix(val, prefix) {
+			if !strings.HasPrefix(val, prefix) || val <= after {
 				continue
 			}
 
@@ -837,8 +923,30 @@ func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([
 	defer m.RUnlock()
 
 	// construct the output slice of idx.Node's such that there is only 1 idx.Node for each path
-	ids := m.idsByTagQuery(orgId, query)
 	byPath := make(map[string]*idx.Node)
+	m.addByPath(byPath, m.idsByTagQuery(orgId, query), nil)
+	// series shared through views are excluded if the org has its own series with the same path
+	for _, v := range idx.SharedViews.For(orgId) {
+		shared := make(map[string]*idx.Node)
+		m.addByPath(shared, m.idsByTagQuery(v.SourceOrg, query), v)
+		for path, n := range shared {
+			if _, ok := byPath[path]; !ok {
+				byPath[path] = n
+			}
+		}
+	}
+
+	results := make([]idx.Node, 0, len(byPath))
+
+	for _, v := range byPath {
+		results = append(results, *v)
+	}
+
+	return results, nil
+}
+
+// addByPath adds the defs with the given ids to the nodes by path. if a view is given, only the defs it allows
+func (m *MemoryIdx) addByPath(byPath map[string]*idx.Node, ids IdSet, v *idx.View) {
 	for id := range ids {
 		def, ok := m.defById[id]
 		if !ok {
@@ -846,6 +954,9 @@ func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([
 			log.Error(3, "memory-idx: corrupt. ID %q has been given, but it is not in the byId lookup table", id)
 			continue
 		}
+		if v != nil && !v.Allows(&def.MetricDefinition) {
+			continue
+		}
 
 		if existing, ok := byPath[def.NameWithTags()]; !ok {
 			byPath[def.NameWithTags()] = &idx.Node{
@@ -858,14 +969,6 @@ func (m *MemoryIdx) FindByTag(orgId uint32, expressions []string, from int64) ([
 			existing.Defs = append(existing.Defs, *def)
 		}
 	}
-
-	results := make([]idx.Node, 0, len(byPath))
-
-	for _, v := range byPath {
-		results = append(results, *v)
-	}
-
-	return results, nil
 }
 
 func (m *MemoryIdx) idsByTagQuery(orgId uint32, query TagQuery) IdSet {
@@ -874,6 +977,7 @@ func (m *MemoryIdx) idsByTagQuery(orgId uint32, query TagQuery) IdSet {
 		return nil
 	}
 
+	query.metaTags = m.metaTags[orgId]
 	return query.Run(tags, m.defById)
 }
 
@@ -885,6 +989,13 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 	if err != nil {
 		return nil, err
 	}
+	for _, v := range idx.SharedViews.For(orgId) {
+		viewNodes, err := m.find(v.SourceOrg, pattern)
+		if err != nil {
+			return nil, err
+		}
+		matchedNodes = append(matchedNodes, m.viewNodes(v, viewNodes)...)
+	}
 	if orgId != idx.OrgIdPublic && idx.OrgIdPublic > 0 {
 		publicNodes, err := m.find(idx.OrgIdPublic, pattern)
 		if err != nil {
@@ -892,13 +1003,15 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 		}
 		matchedNodes = append(matchedNodes, publicNodes...)
 	}
-	log.Debug("memory-idx: %d nodes matching pattern %s found", len(matchedNodes), pattern)
+	if LogLevel.Get() < 2 {
+		log.Debug("memory-idx: %d nodes matching pattern %s found", len(matchedNodes), pattern)
+	}
 	results := make([]idx.Node, 0)
 	byPath := make(map[string]struct{})
 	// construct the output slice of idx.Node's such that there is only 1 idx.Node
 	// for each path, and it holds all defs that the Node refers too.
-	// if there are public (orgId OrgIdPublic) and private leaf nodes with the same series
-	// path, then the public metricDefs will be excluded.
+	// if there are public (orgId OrgIdPublic) or shared (through a view) and private leaf nodes
+	// with the same series path, then the public and shared metricDefs will be excluded.
 	for _, n := range matchedNodes {
 		if _, ok := byPath[n.Path]; !ok {
 			idxNode := idx.Node{
@@ -912,10 +1025,14 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 					def := m.defById[id]
 					if from != 0 && def.LastUpdate < from {
 						statFiltered.Inc()
-						log.Debug("memory-idx: from is %d, so skipping %s which has LastUpdate %d", from, def.Id, def.LastUpdate)
+						if LogLevel.Get() < 2 {
+							log.Debug("memory-idx: from is %d, so skipping %s which has LastUpdate %d", from, def.Id, def.LastUpdate)
+						}
 						continue
 					}
-					log.Debug("memory-idx Find: adding to path %s archive id=%s name=%s int=%d schemaId=%d aggId=%d lastSave=%d", n.Path, def.Id, def.Name, def.Interval, def.SchemaId, def.AggId, def.LastSave)
+					if LogLevel.Get() < 2 {
+						log.Debug("memory-idx Find: adding to path %s archive id=%s name=%s int=%d schemaId=%d aggId=%d lastSave=%d", n.Path, def.Id, def.Name, def.Interval, def.SchemaId, def.AggId, def.LastSave)
+					}
 					idxNode.Defs = append(idxNode.Defs, *def)
 				}
 				if len(idxNode.Defs) == 0 {
@@ -925,19 +1042,52 @@ func (m *MemoryIdx) Find(orgId uint32, pattern string, from int64) ([]idx.Node,
 			results = append(results, idxNode)
 			byPath[n.Path] = struct{}{}
 		} else {
-			log.Debug("memory-idx: path %s already seen", n.Path)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: path %s already seen", n.Path)
+			}
 		}
 	}
-	log.Debug("memory-idx: %d nodes has %d unique paths.", len(matchedNodes), len(results))
+	if LogLevel.Get() < 2 {
+		log.Debug("memory-idx: %d nodes has %d unique paths.", len(matchedNodes), len(results))
+	}
 	statFindDuration.Value(time.Since(pre))
 	return results, nil
 }
 
+// viewNodes returns the parts of the nodes of the source org of the view that the view shares:
+// the defs it allows, and the children if it allows the branch. nodes it shares nothing of are left out.
+func (m *MemoryIdx) viewNodes(v *idx.View, nodes []*Node) []*Node {
+	var out []*Node
+	for _, n := range nodes {
+		var defs []schema.MKey
+		for _, id := range n.Defs {
+			if def, ok := m.defById[id]; ok && v.Allows(&def.MetricDefinition) {
+				defs = append(defs, id)
+			}
+		}
+		var children []string
+		if n.HasChildren() && v.AllowsBranch(n.Path) {
+			children = n.Children
+		}
+		if len(defs) == 0 && len(children) == 0 {
+			continue
+		}
+		out = append(out, &Node{
+			Path:     n.Path,
+			Children: children,
+			Defs:     defs,
+		})
+	}
+	return out
+}
+
 // find returns all Nodes matching the pattern for the given orgId
 func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 	tree, ok := m.tree[orgId]
 	if !ok {
-		log.Debug("memory-idx: orgId %d has no metrics indexed.", orgId)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: orgId %d has no metrics indexed.", orgId)
+		}
 		return nil, nil
 	}
 
@@ -958,7 +1108,9 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 	pos := len(nodes)
 	for i := 0; i < len(nodes); i++ {
 		if strings.ContainsAny(nodes[i], "*{}[]?") {
-			log.Debug("memory-idx: found first pattern sequence at node %s pos %d", nodes[i], i)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: found first pattern sequence at node %s pos %d", nodes[i], i)
+			}
 			pos = i
 			break
 		}
@@ -967,11 +1119,15 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 	if pos != 0 {
 		branch = strings.Join(nodes[:pos], ".")
 	}
-	log.Debug("memory-idx: starting search at orgId %d, node %q", orgId, branch)
+	if LogLevel.Get() < 2 {
+		log.Debug("memory-idx: starting search at orgId %d, node %q", orgId, branch)
+	}
 	startNode, ok := tree.Items[branch]
 
 	if !ok {
-		log.Debug("memory-idx: branch %q does not exist in the index for orgId %d", branch, orgId)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: branch %q does not exist in the index for orgId %d", branch, orgId)
+		}
 		return nil, nil
 	}
 
@@ -994,11 +1150,15 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 		var grandChildren []*Node
 		for _, c := range children {
 			if !c.HasChildren() {
-				log.Debug("memory-idx: end of branch reached at %s with no match found for %s", c.Path, pattern)
+				if LogLevel.Get() < 2 {
+					log.Debug("memory-idx: end of branch reached at %s with no match found for %s", c.Path, pattern)
+				}
 				// expecting a branch
 				continue
 			}
-			log.Debug("memory-idx: searching %d children of %s that match %s", len(c.Children), c.Path, nodes[i])
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: searching %d children of %s that match %s", len(c.Children), c.Path, nodes[i])
+			}
 			matches := matcher(c.Children)
 			for _, m := range matches {
 				newBranch := c.Path + "." + m
@@ -1017,23 +1177,41 @@ func (m *MemoryIdx) find(orgId uint32, pattern string) ([]*Node, error) {
 		}
 		children = grandChildren
 		if len(children) == 0 {
-			log.Debug("memory-idx: pattern does not match any series.")
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: pattern does not match any series.")
+			}
 			break
 		}
 	}
 
-	log.Debug("memory-idx: reached pattern length. %d nodes matched", len(children))
+	if LogLevel.Get() < 2 {
+		log.Debug("memory-idx: reached pattern length. %d nodes matched", len(children))
+	}
 	return children, nil
 }
 
+func (m *MemoryIdx) Count(filter func(idx.Archive) bool) (int, int) {
+	m.RLock()
+	defer m.RUnlock()
+
+	matched := 0
+	for _, def := range m.defById {
+		if filter(*def) {
+			matched++
+		}
+	}
+	return len(m.defById), matched
+}
+
 func (m *MemoryIdx) List(orgId uint32) []idx.Archive {
 	pre := time.Now()
 	m.RLock()
 	defer m.RUnlock()
 
+	views := idx.SharedViews.For(orgId)
 	defs := make([]idx.Archive, 0)
 	for _, def := range m.defById {
-		if def.OrgId == orgId || def.OrgId == idx.OrgIdPublic {
+		if def.OrgId == orgId || def.OrgId == idx.OrgIdPublic || views.Shares(orgId, &def.MetricDefinition) {
 			defs = append(defs, *def)
 		}
 	}
@@ -1135,7 +1313,9 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 	tree := m.tree[orgId]
 	deletedDefs := make([]idx.Archive, 0)
 	if deleteChildren && n.HasChildren() {
-		log.Debug("memory-idx: deleting branch %s", n.Path)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: deleting branch %s", n.Path)
+		}
 		// walk up the tree to find all leaf nodes and delete them.
 		for _, child := range n.Children {
 			node, ok := tree.Items[n.Path+"."+child]
@@ -1144,7 +1324,9 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 				log.Error(3, "memory-idx: node %q missing. Index is corrupt.", n.Path+"."+child)
 				continue
 			}
-			log.Debug("memory-idx: deleting child %s from branch %s", node.Path, n.Path)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: deleting child %s from branch %s", node.Path, n.Path)
+			}
 			deleted := m.delete(orgId, node, false, true)
 			deletedDefs = append(deletedDefs, deleted...)
 		}
@@ -1153,7 +1335,9 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 
 	// delete the metricDefs
 	for _, id := range n.Defs {
-		log.Debug("memory-idx: deleting %s from index", id)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: deleting %s from index", id)
+		}
 		deletedDefs = append(deletedDefs, *m.defById[id])
 		delete(m.defById, id)
 	}
@@ -1179,7 +1363,9 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 	nodes := strings.Split(n.Path, ".")
 	for i := len(nodes) - 1; i >= 0; i-- {
 		branch := strings.Join(nodes[:i], ".")
-		log.Debug("memory-idx: removing %s from branch %s", nodes[i], branch)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: removing %s from branch %s", nodes[i], branch)
+		}
 		bNode, ok := tree.Items[branch]
 		if !ok {
 			corruptIndex.Inc()
@@ -1192,11 +1378,15 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 				if child != nodes[i] {
 					newChildren = append(newChildren, child)
 				} else {
-					log.Debug("memory-idx: %s removed from children list of branch %s", child, bNode.Path)
+					if LogLevel.Get() < 2 {
+						log.Debug("memory-idx: %s removed from children list of branch %s", child, bNode.Path)
+					}
 				}
 			}
 			bNode.Children = newChildren
-			log.Debug("memory-idx: branch %s has other children. Leaving it in place", bNode.Path)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: branch %s has other children. Leaving it in place", bNode.Path)
+			}
 			// no need to delete any parents as they are needed by this node and its
 			// remaining children
 			break
@@ -1215,10 +1405,14 @@ func (m *MemoryIdx) delete(orgId uint32, n *Node, deleteEmptyParents, deleteChil
 		}
 		bNode.Children = nil
 		if bNode.Leaf() {
-			log.Debug("memory-idx: branch %s is also a leaf node, keeping it.", branch)
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: branch %s is also a leaf node, keeping it.", branch)
+			}
 			break
 		}
-		log.Debug("memory-idx: branch %s has no children and is not a leaf node, deleting it.", branch)
+		if LogLevel.Get() < 2 {
+			log.Debug("memory-idx: branch %s has no children and is not a leaf node, deleting it.", branch)
+		}
 		delete(tree.Items, branch)
 	}
 
@@ -1250,7 +1444,35 @@ func (m *MemoryIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
 	}
 	pre := time.Now()
 
+	m.findPrunable(oldestUnix, toPruneUntagged, toPruneTagged)
+
+	for org, ids := range toPruneTagged {
+		if len(ids) == 0 {
+			continue
+		}
+		pruned = append(pruned, m.pruneTagged(org, ids)...)
+	}
+
+	for org, paths := range toPruneUntagged {
+		if len(paths) == 0 {
+			continue
+		}
+		pruned = append(pruned, m.pruneUntagged(org, paths)...)
+	}
+
+	statMetricsActive.Add(-1 * len(pruned))
+
+	log.Info("memory-idx: pruning stale metricDefs from memory for all orgs took %s", time.Since(pre).String())
+
+	statPruneDuration.Value(time.Since(pre))
+	return pruned, nil
+}
+
+// findPrunable adds the series of which all definitions were last updated before oldestUnix to toPruneUntagged and toPruneTagged.
+// the locking in this and the other prune functions is deferred, so that a panic while pruning doesn't leave the index locked.
+func (m *MemoryIdx) findPrunable(oldestUnix int64, toPruneUntagged map[uint32]map[string]struct{}, toPruneTagged map[uint32]IdSet) {
 	m.RLock()
+	defer m.RUnlock()
 DEFS:
 	for _, def := range m.defById {
 		if def.LastUpdate >= oldestUnix {
@@ -1290,58 +1512,47 @@ DEFS:
 			}
 		}
 	}
-	m.RUnlock()
+}
 
-	for org, ids := range toPruneTagged {
-		if len(ids) == 0 {
-			continue
-		}
-		m.Lock()
-		defs := m.deleteTaggedByIdSet(org, ids)
-		m.Unlock()
-		pruned = append(pruned, defs...)
-	}
+func (m *MemoryIdx) pruneTagged(org uint32, ids IdSet) []idx.Archive {
+	m.Lock()
+	defer m.Unlock()
+	return m.deleteTaggedByIdSet(org, ids)
+}
 
-	for org, paths := range toPruneUntagged {
-		if len(paths) == 0 {
-			continue
-		}
+func (m *MemoryIdx) pruneUntagged(org uint32, paths map[string]struct{}) []idx.Archive {
+	m.Lock()
+	defer m.Unlock()
+	tree, ok := m.tree[org]
+	if !ok {
+		return nil
+	}
 
-		m.Lock()
-		tree, ok := m.tree[org]
+	var pruned []idx.Archive
+	for path := range paths {
+		n, ok := tree.Items[path]
 		if !ok {
-			m.Unlock()
-			continue
-		}
-
-		for path := range paths {
-			n, ok := tree.Items[path]
-			if !ok {
-				m.Unlock()
+			if LogLevel.Get() < 2 {
 				log.Debug("memory-idx: series %s for orgId:%d was identified for pruning but cannot be found.", path, org)
-				continue
 			}
+			continue
+		}
 
+		if LogLevel.Get() < 2 {
 			log.Debug("memory-idx: series %s for orgId:%d is stale. pruning it.", n.Path, org)
-			defs := m.delete(org, n, true, false)
-			pruned = append(pruned, defs...)
 		}
-		m.Unlock()
+		pruned = append(pruned, m.delete(org, n, true, false)...)
 	}
-
-	statMetricsActive.Add(-1 * len(pruned))
-
-	log.Info("memory-idx: pruning stale metricDefs from memory for all orgs took %s", time.Since(pre).String())
-
-	statPruneDuration.Value(time.Since(pre))
-	return pruned, nil
+	return pruned
 }
 
 func getMatcher(path string) (func([]string) []string, error) {
 	// Matches everything
 	if path == "*" {
 		return func(children []string) []string {
-			log.Debug("memory-idx: Matching all children")
+			if LogLevel.Get() < 2 {
+				log.Debug("memory-idx: Matching all children")
+			}
 			return children
 		}, nil
 	}
@@ -1359,7 +1570,9 @@ func getMatcher(path string) (func([]string) []string, error) {
 		for _, p := range patterns {
 			r, err := regexp.Compile(toRegexp(p))
 			if err != nil {
-				log.Debug("memory-idx: regexp failed to compile. %s - %s", p, err)
+				if LogLevel.Get() < 2 {
+					log.Debug("memory-idx: regexp failed to compile. %s - %s", p, err)
+				}
 				return nil, errors.NewBadRequest(err.Error())
 			}
 			regexes = append(regexes, r)
@@ -1370,7 +1583,9 @@ func getMatcher(path string) (func([]string) []string, error) {
 			for _, r := range regexes {
 				for _, c := range children {
 					if r.MatchString(c) {
-						log.Debug("memory-idx: %s =~ %s", c, r.String())
+						if LogLevel.Get() < 2 {
+							log.Debug("memory-idx: %s =~ %s", c, r.String())
+						}
 						matches = append(matches, c)
 					}
 				}
@@ -1385,7 +1600,9 @@ func getMatcher(path string) (func([]string) []string, error) {
 		for _, p := range patterns {
 			for _, c := range children {
 				if c == p {
-					log.Debug("memory-idx: %s matches %s", c, p)
+					if LogLevel.Get() < 2 {
+						log.Debug("memory-idx: %s matches %s", c, p)
+					}
 					results = append(results, c)
 					break
 				}
@@ -1442,3 +1659,19 @@ func toRegexp(pattern string) string {
 	p = "^" + p + "$"
 	return p
 }
+
+type indexHealth struct {
+	Series int `json:"series"`
+}
+
+// Len returns the number of series in the index
+func (m *MemoryIdx) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.defById)
+}
+
+// Health reports the number of series in the index. the memory index has nothing to load, so it's always healthy
+func (m *MemoryIdx) Health() health.Status {
+	return health.Status{State: health.OK, Detail: indexHealth{Series: m.Len()}}
+}
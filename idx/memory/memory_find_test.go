@@ -532,7 +532,7 @@ func TestAutoCompleteTag(t *testing.T) {
 func autoCompleteTagValuesAndCompare(t testing.TB, tag, prefix string, expr []string, from int64, limit uint, expRes []string, expErr bool) {
 	t.Helper()
 
-	res, err := ix.FindTagValues(1, tag, prefix, expr, from, limit)
+	res, err := ix.FindTagValues(1, tag, prefix, expr, from, "", limit)
 	if (err != nil) != expErr {
 		if expErr {
 			t.Fatalf("Expected an error, but did not get one")
@@ -624,6 +624,45 @@ func TestAutoCompleteTagValues(t *testing.T) {
 	}
 }
 
+func TestAutoCompletePaging(t *testing.T) {
+	InitSmallIndex()
+
+	// pages through the results, limit at a time, and returns all of them
+	page := func(find func(after string, limit uint) ([]string, error)) []string {
+		var all []string
+		var after string
+		for {
+			res, err := find(after, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) == 0 {
+				return all
+			}
+			all = append(all, res...)
+			after = res[len(res)-1]
+		}
+	}
+
+	for _, expr := range [][]string{nil, {"direction=write"}} {
+		got := page(func(after string, limit uint) ([]string, error) {
+			return ix.FindTagValues(1, "host", "host9", expr, 100, after, limit)
+		})
+		exp, _ := ix.FindTagValues(1, "host", "host9", expr, 100, "", 100)
+		if len(exp) != 11 || !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expr %v: paging through the values gave %v, expected %v", expr, got, exp)
+		}
+
+		got = page(func(after string, limit uint) ([]string, error) {
+			return ix.FindTags(1, "d", expr, 100, after, limit)
+		})
+		exp, _ = ix.FindTags(1, "d", expr, 100, "", 100)
+		if len(exp) == 0 || !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expr %v: paging through the tags gave %v, expected %v", expr, got, exp)
+		}
+	}
+}
+
 func BenchmarkTagDetailsWithoutFromNorFilter(b *testing.B) {
 	InitLargeIndex()
 
@@ -952,7 +991,7 @@ func BenchmarkTagQueryKeysByPrefixExpressions(b *testing.B) {
 func autoCompleteTagsAndCompare(t testing.TB, prefix string, expr []string, from int64, limit uint, expRes []string, expErr bool) {
 	t.Helper()
 
-	res, err := ix.FindTags(1, prefix, expr, from, limit)
+	res, err := ix.FindTags(1, prefix, expr, from, "", limit)
 	if expErr && err == nil {
 		t.Fatalf("Expected an error, but did not get one")
 	} else if !expErr && err != nil {
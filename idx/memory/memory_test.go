@@ -3,6 +3,7 @@ package memory
 import (
 	"crypto/rand"
 	"fmt"
+	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
@@ -367,6 +368,98 @@ func TestDeleteTagged(t *testing.T) {
 	})
 }
 
+func TestViews(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+	idx.SharedViews = idx.Views{
+		{Name: "infra", SourceOrg: 10, TargetOrgs: []uint32{1}, Prefixes: []string{"infra.cpu."}},
+		{Name: "prod", SourceOrg: 10, Tags: []string{"env=prod"}},
+	}
+	defer func() { idx.SharedViews = nil }()
+
+	ix := New()
+	ix.Init()
+	add := func(org int, name string, tags ...string) {
+		md := &schema.MetricData{Name: name, OrgId: org, Interval: 10, Tags: tags}
+		md.SetId()
+		mkey, err := schema.MKeyFromString(md.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+	add(10, "infra.cpu.a")
+	add(10, "infra.cpu.b")
+	add(10, "infra.mem.a")
+	add(10, "secret.a")
+	add(10, "requests", "env=prod")
+	add(10, "requests", "env=dev")
+	add(1, "infra.cpu.b")
+	add(1, "requests", "env=prod")
+
+	find := func(org uint32, pattern string) map[string]uint32 {
+		t.Helper()
+		nodes, err := ix.Find(org, pattern, 0)
+		if err != nil {
+			t.Fatalf("Find(%d, %q): %s", org, pattern, err)
+		}
+		return nodeOrgs(nodes)
+	}
+	findByTag := func(org uint32, expressions ...string) map[string]uint32 {
+		t.Helper()
+		nodes, err := ix.FindByTag(org, expressions, 0)
+		if err != nil {
+			t.Fatalf("FindByTag(%d, %v): %s", org, expressions, err)
+		}
+		return nodeOrgs(nodes)
+	}
+	cases := []struct {
+		name string
+		got  map[string]uint32
+		exp  map[string]uint32
+	}{
+		{"root of target org", find(1, "*"), map[string]uint32{"infra": 0}},
+		{"shared branch", find(1, "infra.*"), map[string]uint32{"infra.cpu": 0}},
+		{"shared leaves, own series first", find(1, "infra.cpu.*"), map[string]uint32{"infra.cpu.a": 10, "infra.cpu.b": 1}},
+		{"not targeted org", find(2, "infra.cpu.*"), map[string]uint32{}},
+		{"tagged, shared with all orgs", findByTag(2, "name=requests"), map[string]uint32{"requests;env=prod": 10}},
+		{"tagged, own series first", findByTag(1, "name=requests"), map[string]uint32{"requests;env=prod": 1}},
+		{"source org", find(10, "infra.*"), map[string]uint32{"infra.cpu": 0, "infra.mem": 0}},
+	}
+	for _, c := range cases {
+		if !reflect.DeepEqual(c.got, c.exp) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.exp, c.got)
+		}
+	}
+
+	for org, exp := range map[uint32]int{1: 5, 2: 1, 10: 6} {
+		if got := len(ix.List(org)); got != exp {
+			t.Errorf("List(%d): expected %d series, got %d", org, exp, got)
+		}
+	}
+
+	defs, err := ix.Delete(1, "infra.cpu.a")
+	if err != nil || len(defs) != 0 {
+		t.Fatalf("deleting a shared series should not delete anything. got %v, %v", defs, err)
+	}
+	if got := find(10, "infra.cpu.a"); len(got) != 1 {
+		t.Fatalf("the shared series should still be in the source org, got %v", got)
+	}
+}
+
+// nodeOrgs returns the org of the first def of the nodes by path, 0 for branches
+func nodeOrgs(nodes []idx.Node) map[string]uint32 {
+	out := make(map[string]uint32)
+	for _, n := range nodes {
+		out[n.Path] = 0
+		if n.Leaf {
+			out[n.Path] = n.Defs[0].OrgId
+		}
+	}
+	return out
+}
+
 func TestDeleteNodeWith100kChildren(t *testing.T) {
 	testWithAndWithoutTagSupport(t, testDeleteNodeWith100kChildren)
 }
@@ -0,0 +1,212 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric idx.memory.meta-tags.apply is the duration of applying the meta tag rules of an org to all its series, after a rule changed
+	statMetaTagsApplyDuration = stats.NewLatencyHistogram15s32("idx.memory.meta-tags.apply")
+)
+
+// metaTagRule is a meta tag rule with its parsed expressions
+type metaTagRule struct {
+	idx.MetaTagRule
+	query TagQuery
+}
+
+// MetaTagRules returns the meta tag rules of the given org, sorted by their expressions
+func (m *MemoryIdx) MetaTagRules(orgId uint32) []idx.MetaTagRule {
+	m.RLock()
+	defer m.RUnlock()
+	rules := make([]idx.MetaTagRule, 0, len(m.metaTagRules[orgId]))
+	for _, r := range m.metaTagRules[orgId] {
+		rules = append(rules, r.MetaTagRule)
+	}
+	return rules
+}
+
+// UpsertMetaTagRule adds the meta tag rule to the given org, or replaces its rule with the same expressions.
+// A rule without meta tags removes the rule with the same expressions. The meta tags of all series of the
+// org are updated accordingly. It returns whether a new rule was added.
+func (m *MemoryIdx) UpsertMetaTagRule(orgId uint32, rule idx.MetaTagRule) (bool, error) {
+	if !TagSupport {
+		return false, errors.NewBadRequest("meta tags require tag support")
+	}
+	r, err := newMetaTagRule(rule)
+	if err != nil {
+		return false, errors.NewBadRequest(err.Error())
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	rules := m.metaTagRules[orgId]
+	pos := -1
+	for i, existing := range rules {
+		if equalStrings(existing.Expressions, r.Expressions) {
+			pos = i
+			break
+		}
+	}
+	switch {
+	case len(r.MetaTags) == 0 && pos < 0:
+		return false, nil
+	case len(r.MetaTags) == 0:
+		rules = append(rules[:pos:pos], rules[pos+1:]...)
+	case pos < 0:
+		rules = append(rules, r)
+		sort.Slice(rules, func(i, j int) bool {
+			return lessStrings(rules[i].Expressions, rules[j].Expressions)
+		})
+	default:
+		rules[pos] = r
+	}
+	if len(rules) == 0 {
+		delete(m.metaTagRules, orgId)
+	} else {
+		m.metaTagRules[orgId] = rules
+	}
+
+	pre := time.Now()
+	m.reapplyMetaTags(orgId)
+	statMetaTagsApplyDuration.Value(time.Since(pre))
+	return pos < 0 && len(r.MetaTags) > 0, nil
+}
+
+// newMetaTagRule validates and parses a meta tag rule, with its expressions and meta tags sorted
+func newMetaTagRule(rule idx.MetaTagRule) (metaTagRule, error) {
+	r := metaTagRule{
+		MetaTagRule: idx.MetaTagRule{
+			Expressions: append([]string(nil), rule.Expressions...),
+			MetaTags:    append([]string(nil), rule.MetaTags...),
+		},
+	}
+	var err error
+	r.query, err = NewTagQuery(r.Expressions, 0)
+	if err != nil {
+		return r, fmt.Errorf("invalid expressions %q: %s", rule.Expressions, err)
+	}
+	if !schema.ValidateTags(r.MetaTags) {
+		return r, fmt.Errorf("invalid meta tags %q. must be key=value pairs", rule.MetaTags)
+	}
+	for _, tag := range r.MetaTags {
+		if strings.HasPrefix(tag, "name=") {
+			return r, fmt.Errorf("meta tags can't set the name")
+		}
+	}
+	sort.Strings(r.MetaTags)
+	return r, nil
+}
+
+// applyMetaTags adds the meta tags of the rules of its org that match the
+// given metric definition to the tag index. if several rules set the same tag,
+// the rule of which the expressions sort first wins. tags that the metric has
+// itself are never overridden.
+// It assumes a lock is already held.
+func (m *MemoryIdx) applyMetaTags(def *schema.MetricDefinition) {
+	rules := m.metaTagRules[def.OrgId]
+	if len(rules) == 0 {
+		return
+	}
+
+	archive := &idx.Archive{MetricDefinition: *def}
+	var metaTags []string
+	for _, r := range rules {
+		if !r.query.matches(archive) {
+			continue
+		}
+	TAGS:
+		for _, tag := range r.MetaTags {
+			key := tag[:strings.Index(tag, "=")+1]
+			for _, t := range def.Tags {
+				if strings.HasPrefix(t, key) {
+					continue TAGS
+				}
+			}
+			for _, t := range metaTags {
+				if strings.HasPrefix(t, key) {
+					continue TAGS
+				}
+			}
+			metaTags = append(metaTags, tag)
+		}
+	}
+	if len(metaTags) == 0 {
+		return
+	}
+	sort.Strings(metaTags)
+
+	tags := m.tags[def.OrgId]
+	for _, tag := range metaTags {
+		tagSplits := strings.SplitN(tag, "=", 2)
+		tags.addTagId(tagSplits[0], tagSplits[1], def.Id)
+	}
+	byId, ok := m.metaTags[def.OrgId]
+	if !ok {
+		byId = make(map[schema.MKey][]string)
+		m.metaTags[def.OrgId] = byId
+	}
+	byId[def.Id] = metaTags
+}
+
+// removeMetaTags removes the meta tags of the given metric from the tag index.
+// It assumes a lock is already held.
+func (m *MemoryIdx) removeMetaTags(tags TagIndex, orgId uint32, id schema.MKey) {
+	byId := m.metaTags[orgId]
+	for _, tag := range byId[id] {
+		tagSplits := strings.SplitN(tag, "=", 2)
+		tags.delTagId(tagSplits[0], tagSplits[1], id)
+	}
+	delete(byId, id)
+	if len(byId) == 0 {
+		delete(m.metaTags, orgId)
+	}
+}
+
+// reapplyMetaTags replaces the meta tags of all series of the given org with
+// those of its current rules. It assumes a lock is already held.
+func (m *MemoryIdx) reapplyMetaTags(orgId uint32) {
+	tags, ok := m.tags[orgId]
+	if !ok {
+		return
+	}
+	for id := range m.metaTags[orgId] {
+		m.removeMetaTags(tags, orgId, id)
+	}
+	for _, defs := range m.defByTagSet[orgId] {
+		for def := range defs {
+			m.applyMetaTags(def)
+		}
+	}
+}
+
+// lessStrings returns whether a sorts before b, element by element
+func lessStrings(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
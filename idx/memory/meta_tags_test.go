@@ -0,0 +1,120 @@
+package memory
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/grafana/metrictank/idx"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestMetaTags(t *testing.T) {
+	_tagSupport := TagSupport
+	defer func() { TagSupport = _tagSupport }()
+	TagSupport = true
+
+	ix := New()
+	ix.Init()
+	add := func(name string, tags ...string) {
+		md := &schema.MetricData{Name: name, OrgId: 1, Interval: 10, Tags: tags}
+		md.SetId()
+		mkey, err := schema.MKeyFromString(md.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ix.AddOrUpdate(mkey, md, 1)
+	}
+	upsert := func(expressions, metaTags []string, expCreated bool) {
+		t.Helper()
+		created, err := ix.UpsertMetaTagRule(1, idx.MetaTagRule{Expressions: expressions, MetaTags: metaTags})
+		if err != nil {
+			t.Fatalf("upsert of %v -> %v failed: %s", expressions, metaTags, err)
+		}
+		if created != expCreated {
+			t.Fatalf("upsert of %v -> %v: expected created %t, got %t", expressions, metaTags, expCreated, created)
+		}
+	}
+	find := func(expressions ...string) []string {
+		t.Helper()
+		nodes, err := ix.FindByTag(1, expressions, 0)
+		if err != nil {
+			t.Fatalf("FindByTag(%v): %s", expressions, err)
+		}
+		var paths []string
+		for _, n := range nodes {
+			paths = append(paths, n.Path)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+	expect := func(desc string, got, exp []string) {
+		t.Helper()
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected %v, got %v", desc, exp, got)
+		}
+	}
+
+	add("cpu", "dc=eu-west", "host=a")
+	add("cpu", "dc=eu-central", "host=b")
+	add("cpu", "dc=us-east", "host=c", "region=us")
+
+	upsert([]string{"dc=~eu-.*"}, []string{"region=eu"}, true)
+	upsert([]string{"dc=~us-.*"}, []string{"region=america", "continent=america"}, true)
+
+	expect("series by meta tag", find("region=eu"), []string{"cpu;dc=eu-central;host=b", "cpu;dc=eu-west;host=a"})
+	expect("own tags are not overridden", find("region=america"), nil)
+	expect("other meta tags of the same rule still apply", find("continent=america"), []string{"cpu;dc=us-east;host=c;region=us"})
+	expect("meta tags combined with tags", find("region=eu", "host!=a"), []string{"cpu;dc=eu-central;host=b"})
+	expect("meta tags in regular expressions", find("name=cpu", "region=~e.*"), []string{"cpu;dc=eu-central;host=b", "cpu;dc=eu-west;host=a"})
+
+	values, err := ix.FindTagValues(1, "region", "", nil, 0, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("tag values include meta tags", values, []string{"eu", "us"})
+	tags, err := ix.FindTags(1, "", []string{"host=a"}, 0, "", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("tags of series include meta tags", tags, []string{"dc", "host", "name", "region"})
+
+	add("cpu", "dc=eu-north", "host=d")
+	expect("rules apply to new series", find("region=eu"), []string{"cpu;dc=eu-central;host=b", "cpu;dc=eu-north;host=d", "cpu;dc=eu-west;host=a"})
+
+	upsert([]string{"dc=~eu-.*"}, []string{"region=europe"}, false)
+	expect("changed rule, old meta tag", find("region=eu"), nil)
+	expect("changed rule, new meta tag", find("region=europe"), []string{"cpu;dc=eu-central;host=b", "cpu;dc=eu-north;host=d", "cpu;dc=eu-west;host=a"})
+
+	deleted, err := ix.DeleteTagged(1, []string{"cpu;dc=eu-north;host=d"})
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("expected to delete 1 series, got %v, %v", deleted, err)
+	}
+	expect("deleted series", find("region=europe"), []string{"cpu;dc=eu-central;host=b", "cpu;dc=eu-west;host=a"})
+
+	rules := ix.MetaTagRules(1)
+	if len(rules) != 2 || rules[0].Expressions[0] != "dc=~eu-.*" || rules[1].Expressions[0] != "dc=~us-.*" {
+		t.Fatalf("unexpected rules %v", rules)
+	}
+
+	upsert([]string{"dc=~eu-.*"}, nil, false)
+	upsert([]string{"dc=~us-.*"}, nil, false)
+	expect("removed rule", find("region=europe"), nil)
+	expect("removed rule", find("continent=america"), nil)
+	if len(ix.MetaTagRules(1)) != 0 || len(ix.metaTags) != 0 {
+		t.Fatalf("expected no rules and meta tags left, got %v and %v", ix.MetaTagRules(1), ix.metaTags)
+	}
+	if _, ok := ix.tags[1]["continent"]; ok {
+		t.Fatalf("expected meta tags to be removed from the tag index")
+	}
+
+	for _, rule := range []idx.MetaTagRule{
+		{Expressions: []string{"dc!=x"}, MetaTags: []string{"a=b"}},
+		{Expressions: []string{"dc=x"}, MetaTags: []string{"a"}},
+		{Expressions: []string{"dc=x"}, MetaTags: []string{"name=b"}},
+	} {
+		if _, err := ix.UpsertMetaTagRule(1, rule); err == nil {
+			t.Errorf("expected invalid rule %v to be refused", rule)
+		}
+	}
+}
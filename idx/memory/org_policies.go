@@ -0,0 +1,73 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// OrgPolicy returns the policy of the given org, and whether it has one
+func (m *MemoryIdx) OrgPolicy(orgId uint32) (idx.OrgPolicy, bool) {
+	m.orgPoliciesLock.RLock()
+	defer m.orgPoliciesLock.RUnlock()
+	p, ok := m.orgPolicies[orgId]
+	return p, ok
+}
+
+// OrgPolicies returns the policies of all orgs, sorted by org
+func (m *MemoryIdx) OrgPolicies() []idx.OrgPolicy {
+	m.orgPoliciesLock.RLock()
+	policies := make([]idx.OrgPolicy, 0, len(m.orgPolicies))
+	for _, p := range m.orgPolicies {
+		policies = append(policies, p)
+	}
+	m.orgPoliciesLock.RUnlock()
+	sort.Slice(policies, func(i, j int) bool { return policies[i].OrgId < policies[j].OrgId })
+	return policies
+}
+
+// UpsertOrgPolicy sets the policy of the org of the given policy, replacing its previous one.
+// An empty policy removes the policy of the org. It returns whether the org did not have a policy yet.
+func (m *MemoryIdx) UpsertOrgPolicy(p idx.OrgPolicy) (bool, error) {
+	if !p.Empty() {
+		if err := p.Validate(); err != nil {
+			return false, errors.NewBadRequest(err.Error())
+		}
+		if p.RetentionClass != "" {
+			if _, ok := mdata.SchemaTTL(p.RetentionClass); !ok {
+				return false, errors.NewBadRequest(fmt.Sprintf("org %d: retentionClass %q is not a storage schema", p.OrgId, p.RetentionClass))
+			}
+		}
+	}
+
+	m.orgPoliciesLock.Lock()
+	defer m.orgPoliciesLock.Unlock()
+	_, ok := m.orgPolicies[p.OrgId]
+	if p.Empty() {
+		delete(m.orgPolicies, p.OrgId)
+		return false, nil
+	}
+	m.orgPolicies[p.OrgId] = p
+	return !ok, nil
+}
+
+// LoadOrgPolicies sets the given org policies, as persisted by an index. Invalid policies are skipped.
+// Unlike UpsertOrgPolicy, it accepts retention classes that are not a storage schema (anymore): they are ignored by queries.
+func (m *MemoryIdx) LoadOrgPolicies(policies []idx.OrgPolicy) int {
+	m.orgPoliciesLock.Lock()
+	defer m.orgPoliciesLock.Unlock()
+	var num int
+	for _, p := range policies {
+		if err := p.Validate(); err != nil {
+			log.Error(3, "memory-idx: skipping invalid policy: %s", err)
+			continue
+		}
+		m.orgPolicies[p.OrgId] = p
+		num++
+	}
+	return num
+}
@@ -0,0 +1,50 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+func TestUpsertOrgPolicy(t *testing.T) {
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 2, true))
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	for _, p := range []idx.OrgPolicy{
+		{OrgId: 1, ConsolidateBy: "foo"},
+		{OrgId: 1, MaxQueryRange: "-1d"},
+		{OrgId: 1, RetentionClass: "gold"},
+	} {
+		if _, err := ix.UpsertOrgPolicy(p); err == nil {
+			t.Errorf("expected invalid policy %v to be refused", p)
+		}
+	}
+
+	p2 := idx.OrgPolicy{OrgId: 2, ConsolidateBy: "max", MaxQueryRange: "30d", MaxDataPoints: 400, RetentionClass: "default"}
+	if created, err := ix.UpsertOrgPolicy(p2); !created || err != nil {
+		t.Fatalf("expected the policy of org 2 to be created, got %t, %v", created, err)
+	}
+	p1 := idx.OrgPolicy{OrgId: 1, MaxDataPoints: 100}
+	ix.UpsertOrgPolicy(p1)
+	p1.MaxDataPoints = 200
+	if created, err := ix.UpsertOrgPolicy(p1); created || err != nil {
+		t.Fatalf("expected the policy of org 1 to be replaced, got %t, %v", created, err)
+	}
+	if got := ix.OrgPolicies(); !reflect.DeepEqual(got, []idx.OrgPolicy{p1, p2}) {
+		t.Fatalf("expected policies %v, got %v", []idx.OrgPolicy{p1, p2}, got)
+	}
+	if p, _ := ix.OrgPolicy(2); p.QueryRange() != 30*86400 {
+		t.Fatalf("expected a query range of 30d, got %d", p.QueryRange())
+	}
+
+	ix.UpsertOrgPolicy(idx.OrgPolicy{OrgId: 1})
+	if _, ok := ix.OrgPolicy(1); ok {
+		t.Fatalf("expected an empty policy to remove the policy of org 1")
+	}
+}
@@ -0,0 +1,89 @@
+package memory
+
+import (
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/idx"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// SavedQuery returns the saved query of the org with the given id, and whether it exists and did not expire
+func (m *MemoryIdx) SavedQuery(orgId uint32, id string) (idx.SavedQuery, bool) {
+	m.savedQueriesLock.RLock()
+	defer m.savedQueriesLock.RUnlock()
+	q, ok := m.savedQueries[orgId][id]
+	if !ok || q.Expired(time.Now()) {
+		return idx.SavedQuery{}, false
+	}
+	return q, true
+}
+
+// SavedQueries returns the saved queries of the org that did not expire, sorted by id
+func (m *MemoryIdx) SavedQueries(orgId uint32) []idx.SavedQuery {
+	now := time.Now()
+	m.savedQueriesLock.RLock()
+	queries := make([]idx.SavedQuery, 0, len(m.savedQueries[orgId]))
+	for _, q := range m.savedQueries[orgId] {
+		if !q.Expired(now) {
+			queries = append(queries, q)
+		}
+	}
+	m.savedQueriesLock.RUnlock()
+	sort.Slice(queries, func(i, j int) bool { return queries[i].Id < queries[j].Id })
+	return queries
+}
+
+// UpsertSavedQuery saves the query under its id, replacing the query of its org with the same id.
+// A query without targets removes the query with the same id. It returns whether a new query was saved.
+// The expired queries of the org are removed along the way.
+func (m *MemoryIdx) UpsertSavedQuery(q idx.SavedQuery) (bool, error) {
+	if err := q.Validate(); err != nil {
+		return false, errors.NewBadRequest(err.Error())
+	}
+
+	now := time.Now()
+	m.savedQueriesLock.Lock()
+	defer m.savedQueriesLock.Unlock()
+	queries, ok := m.savedQueries[q.OrgId]
+	if !ok {
+		queries = make(map[string]idx.SavedQuery)
+		m.savedQueries[q.OrgId] = queries
+	}
+	for id, old := range queries {
+		if old.Expired(now) {
+			delete(queries, id)
+		}
+	}
+	_, ok = queries[q.Id]
+	if len(q.Targets) == 0 {
+		delete(queries, q.Id)
+		return false, nil
+	}
+	queries[q.Id] = q
+	return !ok, nil
+}
+
+// LoadSavedQueries adds the given saved queries, as persisted by an index. Invalid and expired queries are skipped.
+func (m *MemoryIdx) LoadSavedQueries(queries []idx.SavedQuery) int {
+	now := time.Now()
+	m.savedQueriesLock.Lock()
+	defer m.savedQueriesLock.Unlock()
+	var num int
+	for _, q := range queries {
+		if err := q.Validate(); err != nil || len(q.Targets) == 0 {
+			log.Error(3, "memory-idx: skipping invalid saved query %q of org %d: %v", q.Id, q.OrgId, err)
+			continue
+		}
+		if q.Expired(now) {
+			continue
+		}
+		if _, ok := m.savedQueries[q.OrgId]; !ok {
+			m.savedQueries[q.OrgId] = make(map[string]idx.SavedQuery)
+		}
+		m.savedQueries[q.OrgId][q.Id] = q
+		num++
+	}
+	return num
+}
@@ -0,0 +1,64 @@
+package memory
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+)
+
+func TestUpsertSavedQuery(t *testing.T) {
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	for _, q := range []idx.SavedQuery{
+		{OrgId: 1, Id: "", Targets: []string{"a.*"}},
+		{OrgId: 1, Id: "a/b", Targets: []string{"a.*"}},
+		{OrgId: 1, Id: "ab", Targets: []string{"a.*", ""}},
+	} {
+		if _, err := ix.UpsertSavedQuery(q); err == nil {
+			t.Errorf("expected invalid query %v to be refused", q)
+		}
+	}
+
+	b := idx.SavedQuery{OrgId: 1, Id: "b", Targets: []string{"sum(b.*)"}, From: "-1h"}
+	if created, err := ix.UpsertSavedQuery(b); !created || err != nil {
+		t.Fatalf("expected query b to be created, got %t, %v", created, err)
+	}
+	a := idx.SavedQuery{OrgId: 1, Id: "a", Targets: []string{"a.*"}}
+	ix.UpsertSavedQuery(a)
+	a.Targets = []string{"a.b.*"}
+	if created, err := ix.UpsertSavedQuery(a); created || err != nil {
+		t.Fatalf("expected query a to be replaced, got %t, %v", created, err)
+	}
+	if got := ix.SavedQueries(1); !reflect.DeepEqual(got, []idx.SavedQuery{a, b}) {
+		t.Fatalf("expected queries %v, got %v", []idx.SavedQuery{a, b}, got)
+	}
+
+	// queries are scoped to their org
+	if _, ok := ix.SavedQuery(2, "a"); ok {
+		t.Fatalf("expected query a not to be visible to org 2")
+	}
+	if got := ix.SavedQueries(2); len(got) != 0 {
+		t.Fatalf("expected no queries of org 2, got %v", got)
+	}
+
+	expired := idx.SavedQuery{OrgId: 1, Id: "c", Targets: []string{"c"}, Expires: time.Now().Unix() - 1}
+	ix.UpsertSavedQuery(expired)
+	if _, ok := ix.SavedQuery(1, "c"); ok {
+		t.Fatalf("expected expired query c not to be returned")
+	}
+	if got := ix.SavedQueries(1); len(got) != 2 {
+		t.Fatalf("expected expired query c not to be listed, got %v", got)
+	}
+
+	ix.UpsertSavedQuery(idx.SavedQuery{OrgId: 1, Id: "b"})
+	if _, ok := ix.SavedQuery(1, "b"); ok {
+		t.Fatalf("expected a query without targets to remove query b")
+	}
+	if _, ok := ix.savedQueries[1]["c"]; ok {
+		t.Fatalf("expected expired query c to be removed on upsert")
+	}
+}
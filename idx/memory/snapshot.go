@@ -0,0 +1,345 @@
+package memory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/tinylib/msgp/msgp"
+	"gopkg.in/raintank/schema.v1"
+)
+
+const (
+	snapshotFile    = "memory-idx.snapshot"
+	snapshotVersion = 1
+
+	// how many series are reconciled at once, so that ingestion isn't blocked for the whole reconciliation
+	reconcileBatchSize = 10000
+)
+
+var (
+	// metric idx.memory.snapshot is the duration of (successful) writes of a snapshot of the memory idx to disk
+	statSnapshotDuration = stats.NewLatencyHistogram15s32("idx.memory.snapshot")
+	// metric idx.memory.snapshot.failed is how many snapshots of the memory idx could not be written to disk
+	statSnapshotFailed = stats.NewCounter32("idx.memory.snapshot.failed")
+	// metric idx.memory.snapshot.restored is how many series were restored from the snapshot on startup
+	statSnapshotRestored = stats.NewGauge32("idx.memory.snapshot.restored")
+)
+
+// Restored describes the series that were restored from a snapshot, for Reconcile to reconcile against the persistent index
+type Restored struct {
+	Time       time.Time             // when the snapshot was written
+	lastUpdate map[schema.MKey]int64 // the lastUpdate of the restored series, as they were in the snapshot
+}
+
+// WriteSnapshot writes the definitions of all series in the index to path, along with the partitions the index holds.
+// The snapshot is written to a temporary file first, so that a crash while writing doesn't leave a partial snapshot.
+func (m *MemoryIdx) WriteSnapshot(path string, partitions []int32) error {
+	now := time.Now()
+	m.RLock()
+	defs := make([]schema.MetricDefinition, 0, len(m.defById))
+	for _, def := range m.defById {
+		defs = append(defs, def.MetricDefinition)
+	}
+	m.RUnlock()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = writeSnapshot(tmp, now, partitions, defs)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeSnapshot encodes the snapshot as the version, the time, the partitions and the definitions, with msgp
+func writeSnapshot(f *os.File, now time.Time, partitions []int32, defs []schema.MetricDefinition) error {
+	w := msgp.NewWriter(f)
+	if err := w.WriteUint8(snapshotVersion); err != nil {
+		return err
+	}
+	if err := w.WriteInt64(now.Unix()); err != nil {
+		return err
+	}
+	if err := w.WriteArrayHeader(uint32(len(partitions))); err != nil {
+		return err
+	}
+	for _, p := range partitions {
+		if err := w.WriteInt32(p); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteArrayHeader(uint32(len(defs))); err != nil {
+		return err
+	}
+	for i := range defs {
+		if err := defs[i].EncodeMsg(w); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// ReadSnapshot reads the snapshot at path. It returns the time it was written, the partitions and the definitions in it.
+func ReadSnapshot(path string) (time.Time, []int32, []schema.MetricDefinition, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	defer f.Close()
+	r := msgp.NewReader(f)
+	version, err := r.ReadUint8()
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	if version != snapshotVersion {
+		return time.Time{}, nil, nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	ts, err := r.ReadInt64()
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	num, err := r.ReadArrayHeader()
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	partitions := make([]int32, num)
+	for i := range partitions {
+		if partitions[i], err = r.ReadInt32(); err != nil {
+			return time.Time{}, nil, nil, err
+		}
+	}
+	num, err = r.ReadArrayHeader()
+	if err != nil {
+		return time.Time{}, nil, nil, err
+	}
+	defs := make([]schema.MetricDefinition, num)
+	for i := range defs {
+		if err := defs[i].DecodeMsg(r); err != nil {
+			return time.Time{}, nil, nil, err
+		}
+	}
+	return time.Unix(ts, 0), partitions, defs, nil
+}
+
+// RestoreSnapshot loads the series of the given partitions from the snapshot in snapshot-dir, if there is one that is
+// recent enough and has all the partitions. It returns what was restored and whether a snapshot was restored at all.
+// The persistent indexes call it rather than loading all their series, which can take a long time, and then reconcile
+// the restored series against theirs, see Reconcile.
+func (m *MemoryIdx) RestoreSnapshot(partitions []int32) (Restored, bool) {
+	if snapshotDir == "" {
+		return Restored{}, false
+	}
+	path := filepath.Join(snapshotDir, snapshotFile)
+	pre := time.Now()
+	snapTime, snapPartitions, defs, err := ReadSnapshot(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Info("memory-idx: no snapshot found at %s. loading the index from the persistent index", path)
+		} else {
+			log.Error(3, "memory-idx: could not read snapshot %s: %s. loading the index from the persistent index", path, err)
+		}
+		return Restored{}, false
+	}
+	if age := time.Since(snapTime); age > snapshotMaxAge {
+		log.Info("memory-idx: snapshot %s is %s old, more than snapshot-max-age. loading the index from the persistent index", path, age)
+		return Restored{}, false
+	}
+	inSnapshot := make(map[int32]bool, len(snapPartitions))
+	for _, p := range snapPartitions {
+		inSnapshot[p] = true
+	}
+	wanted := make(map[int32]bool, len(partitions))
+	for _, p := range partitions {
+		if !inSnapshot[p] {
+			log.Info("memory-idx: snapshot %s does not have partition %d. loading the index from the persistent index", path, p)
+			return Restored{}, false
+		}
+		wanted[p] = true
+	}
+
+	restored := Restored{
+		Time:       snapTime,
+		lastUpdate: make(map[schema.MKey]int64, len(defs)),
+	}
+	n := 0
+	for _, def := range defs {
+		if wanted[def.Partition] {
+			defs[n] = def
+			restored.lastUpdate[def.Id] = def.LastUpdate
+			n++
+		}
+	}
+	num := m.Load(defs[:n])
+	statSnapshotRestored.Set(num)
+	log.Info("memory-idx: restored %d series from snapshot %s written at %s. Took %s", num, path, snapTime, time.Since(pre))
+	return restored, true
+}
+
+// Reconcile reconciles the series that were restored from a snapshot with the given definitions, which are all the
+// definitions of the persistent index, so that the index ends up as if it had been loaded from the persistent index:
+// series that were added since the snapshot are added, the lastUpdate of series that were updated since is bumped,
+// and restored series that were deleted since are removed, unless they received data since they were restored.
+// It returns how many series were added, updated and removed.
+func (m *MemoryIdx) Reconcile(defs []schema.MetricDefinition, restored Restored) (int, int, int) {
+	var added, updated int
+	for start := 0; start < len(defs); start += reconcileBatchSize {
+		end := start + reconcileBatchSize
+		if end > len(defs) {
+			end = len(defs)
+		}
+		a, u := m.reconcileBatch(defs[start:end], restored)
+		added += a
+		updated += u
+	}
+
+	// what's left of the restored series are the ones that are no longer in the persistent index
+	toRemoveUntagged := make(map[uint32]map[string]struct{})
+	toRemoveTagged := make(map[uint32]IdSet)
+	m.findRemoved(restored, toRemoveUntagged, toRemoveTagged)
+	var removed []idx.Archive
+	for org, ids := range toRemoveTagged {
+		removed = append(removed, m.pruneTagged(org, ids)...)
+	}
+	for org, paths := range toRemoveUntagged {
+		removed = append(removed, m.pruneUntagged(org, paths)...)
+	}
+	statMetricsActive.Add(-1 * len(removed))
+	return added, updated, len(removed)
+}
+
+// reconcileBatch adds the definitions that are not in the index, bumps the lastUpdate of the ones that are,
+// and marks the restored series among them as still existing, by removing them from restored.
+func (m *MemoryIdx) reconcileBatch(defs []schema.MetricDefinition, restored Restored) (int, int) {
+	m.Lock()
+	defer m.Unlock()
+	var added, updated int
+	for i := range defs {
+		def := &defs[i]
+		delete(restored.lastUpdate, def.Id)
+		existing, ok := m.defById[def.Id]
+		if ok {
+			if existing.LastUpdate < def.LastUpdate {
+				existing.LastUpdate = def.LastUpdate
+				updated++
+			}
+			continue
+		}
+		pre := time.Now()
+		m.add(def)
+		if TagSupport {
+			m.indexTags(def)
+		}
+		// like in Load, the lastSave is close enough to the lastUpdate
+		m.defById[def.Id].LastSave = uint32(def.LastUpdate)
+		added++
+		statMetricsActive.Inc()
+		statAddDuration.Value(time.Since(pre))
+	}
+	return added, updated
+}
+
+// findRemoved adds the restored series that did not receive data since they were restored to toRemoveUntagged and toRemoveTagged.
+// like with pruning, series are only removed if all the definitions with the same name (and tags) are to be removed.
+func (m *MemoryIdx) findRemoved(restored Restored, toRemoveUntagged map[uint32]map[string]struct{}, toRemoveTagged map[uint32]IdSet) {
+	m.RLock()
+	defer m.RUnlock()
+	removable := func(id schema.MKey) bool {
+		lastUpdate, ok := restored.lastUpdate[id]
+		return ok && m.defById[id].LastUpdate == lastUpdate
+	}
+DEFS:
+	for id := range restored.lastUpdate {
+		def, ok := m.defById[id]
+		if !ok || !removable(id) {
+			continue
+		}
+		if len(def.Tags) == 0 {
+			tree, ok := m.tree[def.OrgId]
+			if !ok {
+				continue
+			}
+			n, ok := tree.Items[def.Name]
+			if !ok || !n.Leaf() {
+				continue
+			}
+			for _, id := range n.Defs {
+				if !removable(id) {
+					continue DEFS
+				}
+			}
+			if _, ok := toRemoveUntagged[def.OrgId]; !ok {
+				toRemoveUntagged[def.OrgId] = make(map[string]struct{})
+			}
+			toRemoveUntagged[def.OrgId][n.Path] = struct{}{}
+		} else {
+			defs := m.defByTagSet.defs(def.OrgId, def.NameWithTags())
+			for other := range defs {
+				if !removable(other.Id) {
+					continue DEFS
+				}
+			}
+			if _, ok := toRemoveTagged[def.OrgId]; !ok {
+				toRemoveTagged[def.OrgId] = make(IdSet)
+			}
+			for other := range defs {
+				toRemoveTagged[def.OrgId][other.Id] = struct{}{}
+			}
+		}
+	}
+}
+
+// StartSnapshots starts writing a snapshot of the series of the given partitions to snapshot-dir every snapshot-interval,
+// and when the index is stopped. The persistent indexes call it once the index is loaded.
+func (m *MemoryIdx) StartSnapshots(partitions []int32) {
+	if snapshotDir == "" {
+		return
+	}
+	partitions = append([]int32(nil), partitions...)
+	sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	m.snapshotShutdown = make(chan struct{})
+	m.snapshotDone = make(chan struct{})
+	go m.snapshotLoop(partitions)
+}
+
+func (m *MemoryIdx) snapshotLoop(partitions []int32) {
+	defer close(m.snapshotDone)
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.snapshot(partitions)
+		case <-m.snapshotShutdown:
+			m.snapshot(partitions)
+			return
+		}
+	}
+}
+
+func (m *MemoryIdx) snapshot(partitions []int32) {
+	pre := time.Now()
+	path := filepath.Join(snapshotDir, snapshotFile)
+	if err := m.WriteSnapshot(path, partitions); err != nil {
+		statSnapshotFailed.Inc()
+		log.Error(3, "memory-idx: could not write snapshot %s: %s", path, err)
+		return
+	}
+	statSnapshotDuration.Value(time.Since(pre))
+	log.Info("memory-idx: wrote snapshot %s. Took %s", path, time.Since(pre))
+}
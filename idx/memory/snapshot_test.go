@@ -0,0 +1,75 @@
+package memory
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/test"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestSnapshotRestoreReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshotDir, snapshotInterval, snapshotMaxAge = dir, time.Hour, time.Hour
+	defer func() { snapshotDir, snapshotInterval, snapshotMaxAge = "", 0, 0 }()
+
+	def := func(i int, name string, partition int32, lastUpdate int64) schema.MetricDefinition {
+		return schema.MetricDefinition{Id: test.GetMKey(i), OrgId: 1, Name: name, Interval: 10, Partition: partition, LastUpdate: lastUpdate}
+	}
+	ix := New()
+	ix.Init()
+	ix.Load([]schema.MetricDefinition{
+		def(1, "x.a", 0, 100),
+		def(2, "x.b", 0, 100),
+		def(3, "x.c", 0, 100),
+		def(4, "y.z", 1, 100),
+	})
+	ix.StartSnapshots([]int32{1, 0})
+	ix.Stop()
+
+	snapTime, partitions, defs, err := ReadSnapshot(filepath.Join(dir, snapshotFile))
+	if err != nil {
+		t.Fatalf("could not read the snapshot written on stop: %s", err)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	if time.Since(snapTime) > time.Minute || !reflect.DeepEqual(partitions, []int32{0, 1}) || len(defs) != 4 || defs[3].Name != "y.z" {
+		t.Fatalf("expected a snapshot of 4 series in partitions 0 and 1, got %s %v %v", snapTime, partitions, defs)
+	}
+
+	ix = New()
+	if _, ok := ix.RestoreSnapshot([]int32{2}); ok {
+		t.Fatalf("expected a snapshot without partition 2 not to be restored")
+	}
+	restored, ok := ix.RestoreSnapshot([]int32{0})
+	if !ok || ix.Len() != 3 {
+		t.Fatalf("expected the 3 series of partition 0 to be restored, got %d", ix.Len())
+	}
+
+	// x.c receives data after the restore, x.a was updated and x.d was added by another node,
+	// and x.b and x.c were deleted from the persistent index
+	ix.Update(schema.MetricPoint{MKey: test.GetMKey(3), Time: 200}, 0)
+	added, updated, removed := ix.Reconcile([]schema.MetricDefinition{
+		def(1, "x.a", 0, 150),
+		def(5, "x.d", 0, 100),
+	}, restored)
+	if added != 1 || updated != 1 || removed != 1 {
+		t.Fatalf("expected 1 series added, updated and removed, got %d, %d and %d", added, updated, removed)
+	}
+	if a, ok := ix.Get(test.GetMKey(1)); !ok || a.LastUpdate != 150 {
+		t.Fatalf("expected the lastUpdate of x.a to be bumped to 150, got %+v", a)
+	}
+	for i, exp := range map[int]bool{2: false, 3: true, 5: true} {
+		if _, ok := ix.Get(test.GetMKey(i)); ok != exp {
+			t.Fatalf("expected series %d to be in the index: %t, got %t", i, exp, ok)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package memory
+
+import (
+	"sync"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/errors"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// storageOverridesLock serializes changes to the storage overrides, which are read, modified and written back
+var storageOverridesLock sync.Mutex
+
+// StorageOverrides returns the active storage overrides
+func (m *MemoryIdx) StorageOverrides() []conf.Override {
+	return mdata.StorageOverrides()
+}
+
+// UpsertStorageOverride activates the storage override, or replaces the override with the same name.
+// An override that neither sets retentions nor aggregation methods removes the override with the same name.
+// New overrides take precedence over the existing ones. It returns whether a new override was added.
+func (m *MemoryIdx) UpsertStorageOverride(o conf.Override) (bool, error) {
+	if !o.Empty() {
+		if err := o.Validate(); err != nil {
+			return false, errors.NewBadRequest(err.Error())
+		}
+	}
+
+	storageOverridesLock.Lock()
+	defer storageOverridesLock.Unlock()
+
+	current := mdata.StorageOverrides()
+	pos := -1
+	for i, existing := range current {
+		if existing.Name == o.Name {
+			pos = i
+			break
+		}
+	}
+	overrides := make([]conf.Override, 0, len(current)+1)
+	switch {
+	case o.Empty() && pos < 0:
+		return false, nil
+	case o.Empty():
+		overrides = append(overrides, current[:pos]...)
+		overrides = append(overrides, current[pos+1:]...)
+	case pos < 0:
+		overrides = append(overrides, o)
+		overrides = append(overrides, current...)
+	default:
+		overrides = append(overrides, current...)
+		overrides[pos] = o
+	}
+	if err := mdata.SetStorageOverrides(overrides); err != nil {
+		return false, err
+	}
+	return pos < 0 && !o.Empty(), nil
+}
+
+// LoadStorageOverrides activates the given storage overrides, as persisted by an index, replacing the current ones.
+// Like meta tag rules, they should be loaded before the series, so the series get set up with them.
+func (m *MemoryIdx) LoadStorageOverrides(overrides []conf.Override) error {
+	storageOverridesLock.Lock()
+	defer storageOverridesLock.Unlock()
+	return mdata.SetStorageOverrides(overrides)
+}
@@ -0,0 +1,53 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata"
+)
+
+func TestUpsertStorageOverride(t *testing.T) {
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 86400, 600, 2, true))
+	mdata.SetSingleAgg(conf.Avg)
+	defer mdata.SetStorageOverrides(nil)
+
+	ix := New()
+	ix.Init()
+	defer ix.Stop()
+
+	a := conf.Override{Name: "a", Pattern: "^a\\.", Retentions: "1s:1d:10min:2"}
+	created, err := ix.UpsertStorageOverride(a)
+	if !created || err != nil {
+		t.Fatalf("expected override a to be created, got %t, %v", created, err)
+	}
+	b := conf.Override{Name: "b", Pattern: "^a\\.b\\.", AggregationMethod: "max"}
+	ix.UpsertStorageOverride(b)
+	if _, schema := mdata.MatchSchema("a.b.c", 1); schema.Name != "a" {
+		t.Fatalf("expected a.b.c to match the schema of override a, got %q", schema.Name)
+	}
+	if _, agg := mdata.MatchAgg("a.b.c"); agg.Name != "b" {
+		t.Fatalf("expected a.b.c to match the aggregation of override b, got %q", agg.Name)
+	}
+
+	a.Retentions = "1s:2d:10min:2"
+	created, err = ix.UpsertStorageOverride(a)
+	if created || err != nil {
+		t.Fatalf("expected override a to be replaced, got %t, %v", created, err)
+	}
+	overrides := ix.StorageOverrides()
+	if len(overrides) != 2 || overrides[0].Name != "b" || overrides[1] != a {
+		t.Fatalf("expected overrides b and the new a, got %v", overrides)
+	}
+
+	if _, err := ix.UpsertStorageOverride(conf.Override{Name: "c", Pattern: "(", Retentions: "1s:1d"}); err == nil {
+		t.Fatalf("expected an error for an invalid override")
+	}
+	created, err = ix.UpsertStorageOverride(conf.Override{Name: "a"})
+	if created || err != nil || len(ix.StorageOverrides()) != 1 {
+		t.Fatalf("expected override a to be removed, got %t, %v, %v", created, err, ix.StorageOverrides())
+	}
+	if _, schema := mdata.MatchSchema("a.b.c", 1); schema.Name != "default" {
+		t.Fatalf("expected a.b.c to match the default schema, got %q", schema.Name)
+	}
+}
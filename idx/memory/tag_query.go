@@ -99,8 +99,9 @@ type TagQuery struct {
 
 	startWith match // choses the first clause to generate the initial result set (one of EQUAL PREFIX MATCH MATCH_TAG PREFIX_TAG)
 
-	index TagIndex                     // the tag index, hierarchy of tags & values, set by Run()/RunGetTags()
-	byId  map[schema.MKey]*idx.Archive // the metric index by ID, set by Run()/RunGetTags()
+	index    TagIndex                     // the tag index, hierarchy of tags & values, set by Run()/RunGetTags()
+	byId     map[schema.MKey]*idx.Archive // the metric index by ID, set by Run()/RunGetTags()
+	metaTags map[schema.MKey][]string     // the meta tags by ID, set by the index before Run()/RunGetTags()
 
 	wg *sync.WaitGroup
 }
@@ -534,6 +535,77 @@ func (q *TagQuery) testByAllExpressions(id schema.MKey, def *idx.Archive, omitTa
 	return true
 }
 
+// tags returns the tags of a given metric, including its meta tags
+func (q *TagQuery) tags(def *idx.Archive) []string {
+	metaTags := q.metaTags[def.Id]
+	if len(metaTags) == 0 {
+		return def.Tags
+	}
+	tags := make([]string, 0, len(def.Tags)+len(metaTags))
+	return append(append(tags, def.Tags...), metaTags...)
+}
+
+// matches decides whether a given metric satisfies all expressions, by its own
+// tags only and without the index. it is used to evaluate meta tag rules
+func (q *TagQuery) matches(def *idx.Archive) bool {
+	if !q.testByFrom(def) {
+		return false
+	}
+
+	if !q.testByTags(def, q.equal, false) || !q.testByTags(def, q.notEqual, true) {
+		return false
+	}
+
+	if q.tagClause == PREFIX_TAG && !q.testByTagPrefix(def) {
+		return false
+	}
+
+	if !q.testByPrefix(def, q.prefix) {
+		return false
+	}
+
+	if q.tagClause == MATCH_TAG && !q.testByTagMatch(def) {
+		return false
+	}
+
+	if len(q.match) > 0 && !q.testByMatch(def, q.match, false) {
+		return false
+	}
+
+	if len(q.notMatch) > 0 && !q.testByMatch(def, q.notMatch, true) {
+		return false
+	}
+
+	return true
+}
+
+// testByTags filters a given metric by the defined "=" expressions, like
+// testByEqual but by the tags of the metric instead of the index
+func (q *TagQuery) testByTags(def *idx.Archive, exprs []kv, not bool) bool {
+EXPRS:
+	for _, e := range exprs {
+		if e.key == "name" {
+			if (def.Name == e.value) == not {
+				return false
+			}
+			continue
+		}
+		tag := e.key + "=" + e.value
+		for _, t := range q.tags(def) {
+			if t == tag {
+				if not {
+					return false
+				}
+				continue EXPRS
+			}
+		}
+		if !not {
+			return false
+		}
+	}
+	return true
+}
+
 // testByMatch filters a given metric by matching a regular expression against
 // the values of specific associated tags
 func (q *TagQuery) testByMatch(def *idx.Archive, exprs []kvRe, not bool) bool {
@@ -556,7 +628,7 @@ EXPRS:
 		}
 
 		prefix := e.key + "="
-		for _, tag := range def.Tags {
+		for _, tag := range q.tags(def) {
 			if !strings.HasPrefix(tag, prefix) {
 				continue
 			}
@@ -622,7 +694,7 @@ func (q *TagQuery) testByTagMatch(def *idx.Archive) bool {
 		}
 	}
 
-	for _, tag := range def.Tags {
+	for _, tag := range q.tags(def) {
 		equal := strings.Index(tag, "=")
 		if equal < 0 {
 			corruptIndex.Inc()
@@ -670,7 +742,7 @@ EXPRS:
 		}
 
 		prefix := e.key + "=" + e.value
-		for _, tag := range def.Tags {
+		for _, tag := range q.tags(def) {
 			if !strings.HasPrefix(tag, prefix) {
 				continue
 			}
@@ -687,7 +759,7 @@ func (q *TagQuery) testByTagPrefix(def *idx.Archive) bool {
 		return true
 	}
 
-	for _, tag := range def.Tags {
+	for _, tag := range q.tags(def) {
 		if strings.HasPrefix(tag, q.tagPrefix) {
 			return true
 		}
@@ -859,7 +931,7 @@ IDS:
 		// generate a set of all tags of the current metric that satisfy the
 		// tag filter condition
 		metricTags := make(map[string]struct{}, 0)
-		for _, tag := range def.Tags {
+		for _, tag := range q.tags(def) {
 			equal := strings.Index(tag, "=")
 			if equal < 0 {
 				corruptIndex.Inc()
@@ -0,0 +1,56 @@
+package idx
+
+import (
+	"fmt"
+
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/raintank/dur"
+)
+
+// OrgPolicy sets the query defaults and limits of an org, so that orgs can get different service levels.
+// Settings that are not set leave it to the request, or to the defaults of the config.
+type OrgPolicy struct {
+	OrgId uint32 `json:"orgId"`
+	// consolidation of the series that are not given one via consolidateBy
+	ConsolidateBy string `json:"consolidateBy,omitempty"`
+	// longest time range a query may span, e.g. 30d
+	MaxQueryRange string `json:"maxQueryRange,omitempty"`
+	// maxDataPoints of the requests that don't specify it
+	MaxDataPoints uint32 `json:"maxDataPoints,omitempty"`
+	// name of a storage schema. queries don't reach further back than its longest retention
+	RetentionClass string `json:"retentionClass,omitempty"`
+}
+
+// Empty returns whether the policy doesn't set anything
+func (p OrgPolicy) Empty() bool {
+	return p.ConsolidateBy == "" && p.MaxQueryRange == "" && p.MaxDataPoints == 0 && p.RetentionClass == ""
+}
+
+// Validate returns an error if the settings of the policy are invalid.
+// Whether the retention class exists depends on the storage schemas, and is not checked.
+func (p OrgPolicy) Validate() error {
+	if p.ConsolidateBy != "" && consolidation.FromConsolidateBy(p.ConsolidateBy) == consolidation.None {
+		return fmt.Errorf("org %d: invalid consolidateBy %q", p.OrgId, p.ConsolidateBy)
+	}
+	if p.MaxQueryRange != "" {
+		if _, err := dur.ParseNDuration(p.MaxQueryRange); err != nil {
+			return fmt.Errorf("org %d: invalid maxQueryRange %q: %s", p.OrgId, p.MaxQueryRange, err)
+		}
+	}
+	return nil
+}
+
+// Consolidator returns the consolidator of ConsolidateBy, consolidation.None if not set
+func (p OrgPolicy) Consolidator() consolidation.Consolidator {
+	return consolidation.FromConsolidateBy(p.ConsolidateBy)
+}
+
+// QueryRange returns MaxQueryRange in seconds, 0 if not set
+func (p OrgPolicy) QueryRange() uint32 {
+	if p.MaxQueryRange == "" {
+		return 0
+	}
+	// validated on upsert
+	s, _ := dur.ParseNDuration(p.MaxQueryRange)
+	return s
+}
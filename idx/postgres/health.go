@@ -0,0 +1,77 @@
+package postgres
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+)
+
+const (
+	loadPending     int32 = iota // Init has not started loading yet
+	loadReading                  // reading the definitions from postgres
+	loadIndexing                 // adding the definitions to the memory index
+	loadReconciling              // reconciling the series restored from a snapshot with the definitions from postgres
+	loadDone
+)
+
+var loadPhases = []string{"pending", "reading", "indexing", "reconciling", "done"}
+
+type indexHealth struct {
+	Series     int    `json:"series"`
+	Load       string `json:"load"`
+	DefsRead   int64  `json:"defsRead"`   // definitions read from postgres so far
+	WriteQueue int    `json:"writeQueue"` // saves and deletes waiting for a bulk request
+}
+
+// Health reports how far along loading the index from postgres is, and how full the write queue is.
+// the index is degraded until it's fully loaded, because until then queries will miss series, and while the
+// write queue is full, because then saves are skipped.
+func (p *PgIdx) Health() health.Status {
+	phase := atomic.LoadInt32(&p.loadPhase)
+	detail := indexHealth{
+		Series:     p.MemoryIdx.Len(),
+		Load:       loadPhases[phase],
+		DefsRead:   atomic.LoadInt64(&p.defsRead),
+		WriteQueue: len(p.writeQueue),
+	}
+	status := health.Status{State: health.OK, Detail: detail}
+	if phase != loadDone {
+		status.Worsen(health.Degraded, "index is still loading (%s, %d definitions read)", detail.Load, detail.DefsRead)
+	}
+	if p.writeQueue != nil && len(p.writeQueue) == cap(p.writeQueue) {
+		status.Worsen(health.Degraded, "write queue is full (%d). saves to postgres are skipped", detail.WriteQueue)
+	}
+	return status
+}
+
+type indexProgress struct {
+	Load        string  `json:"load"`
+	DefsRead    int64   `json:"defsRead"`
+	DefsPerSec  float64 `json:"defsPerSec"`
+	ElapsedSecs int     `json:"elapsedSecs"`
+}
+
+// Progress reports how far along loading the index from postgres is.
+// we don't know how many definitions there are to read, so there is no ETA until we're done.
+func (p *PgIdx) Progress() health.Progress {
+	phase := atomic.LoadInt32(&p.loadPhase)
+	detail := indexProgress{
+		Load:     loadPhases[phase],
+		DefsRead: atomic.LoadInt64(&p.defsRead),
+	}
+	prog := health.Progress{ETA: -1, Detail: &detail}
+	if phase == loadPending {
+		return prog
+	}
+	start := time.Unix(0, atomic.LoadInt64(&p.loadStart))
+	end := time.Now()
+	if phase == loadDone {
+		end = time.Unix(0, atomic.LoadInt64(&p.loadEnd))
+		prog.Done = true
+		prog.ETA = 0
+	}
+	detail.DefsPerSec = health.Rate(detail.DefsRead, start, end)
+	detail.ElapsedSecs = int(end.Sub(start).Seconds())
+	return prog
+}
@@ -0,0 +1,883 @@
+// Package postgres is a metric index that keeps the index in memory, like the cassandra index,
+// and persists it in a Postgres compatible database, such as Postgres or CockroachDB.
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/secrets"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// columns of a row in the metric_idx table, per upserted definition
+const numColumns = 9
+
+var (
+	LogLevel util.LogLevel
+
+	// metric idx.postgres.query-upsert.ok is how many definitions were saved to postgres successfully, in batched upserts
+	statQueryUpsertOk = stats.NewCounter32("idx.postgres.query-upsert.ok")
+	// metric idx.postgres.query-upsert.fail is how many batched upserts failed, and were retried
+	statQueryUpsertFail = stats.NewCounter32("idx.postgres.query-upsert.fail")
+	// metric idx.postgres.query-delete.ok is how many definitions were deleted from postgres successfully
+	statQueryDeleteOk = stats.NewCounter32("idx.postgres.query-delete.ok")
+	// metric idx.postgres.query-delete.fail is how many batched deletes failed, and were retried
+	statQueryDeleteFail = stats.NewCounter32("idx.postgres.query-delete.fail")
+	// metric idx.postgres.query-upsert.exec is time spent executing a batch of upserts and deletes (possibly repeatedly until success)
+	statQueryExecDuration = stats.NewLatencyHistogram15s32("idx.postgres.query-upsert.exec")
+	// metric idx.postgres.query-upsert.wait is time saves and deletes spent in queue before being executed
+	statQueryWaitDuration = stats.NewLatencyHistogram12h32("idx.postgres.query-upsert.wait")
+
+	// metric idx.postgres.add is the duration of an add of one metric to the postgres idx, including the add to the in-memory index, excluding the upsert query
+	statAddDuration = stats.NewLatencyHistogram15s32("idx.postgres.add")
+	// metric idx.postgres.update is the duration of an update of one metric to the postgres idx, including the update to the in-memory index, excluding the upsert query
+	statUpdateDuration = stats.NewLatencyHistogram15s32("idx.postgres.update")
+	// metric idx.postgres.prune is the duration of a prune of the postgres idx, including the prune of the in-memory index
+	statPruneDuration = stats.NewLatencyHistogram15s32("idx.postgres.prune")
+	// metric idx.postgres.delete is the duration of a delete of one or more metrics from the postgres idx, including the delete from the in-memory index, excluding the delete query
+	statDeleteDuration = stats.NewLatencyHistogram15s32("idx.postgres.delete")
+	// metric idx.postgres.save.skipped is how many saves have been skipped due to the writeQueue being full
+	statSaveSkipped = stats.NewCounter32("idx.postgres.save.skipped")
+
+	Enabled          bool
+	driverName       string
+	dsn              string
+	schemaFile       string
+	createTables     bool
+	timeout          time.Duration
+	maxOpenConns     int
+	batchSize        int
+	batchMaxWait     time.Duration
+	writeQueueSize   int
+	updatePgIdx      bool
+	updateInterval   time.Duration
+	updateInterval32 uint32
+	maxStale         time.Duration
+	pruneInterval    time.Duration
+)
+
+func ConfigSetup() *flag.FlagSet {
+	pgIdx := flag.NewFlagSet("postgres-idx", flag.ExitOnError)
+
+	pgIdx.BoolVar(&Enabled, "enabled", false, "")
+	pgIdx.StringVar(&driverName, "driver", "postgres", "name of the database/sql driver to use. it must be linked into the binary")
+	pgIdx.StringVar(&dsn, "dsn", "postgres://metrictank@localhost:5432/metrictank?sslmode=disable", "data source name of the database, as the driver expects it. may be an env:, file: or vault: reference, see the secrets section")
+	pgIdx.StringVar(&schemaFile, "schema-file", "/etc/metrictank/schema-idx-postgres.toml", "File containing the needed schemas in case database needs initializing")
+	pgIdx.BoolVar(&createTables, "create-tables", true, "enable the creation of the index tables, only one node needs this")
+	pgIdx.DurationVar(&timeout, "timeout", 10*time.Second, "timeout of queries, except loading the index")
+	pgIdx.IntVar(&maxOpenConns, "max-open-conns", 10, "max number of open connections to the database")
+	pgIdx.IntVar(&batchSize, "batch-size", 500, "max number of metricDefs to save or delete in one query. saves and deletes are batched per partition")
+	pgIdx.DurationVar(&batchMaxWait, "batch-max-wait", time.Second, "max time a metricDef waits for a batch to fill up before it is written")
+	pgIdx.IntVar(&writeQueueSize, "write-queue-size", 100000, "Max number of metricDefs allowed to be unwritten to postgres")
+	pgIdx.BoolVar(&updatePgIdx, "update-postgres-index", true, "synchronize index changes to postgres. not all your nodes need to do this.")
+	pgIdx.DurationVar(&updateInterval, "update-interval", time.Hour*3, "frequency at which we should update the metricDef lastUpdate field, use 0s for instant updates")
+	pgIdx.DurationVar(&maxStale, "max-stale", 0, "clear series from the index if they have not been seen for this much time.")
+	pgIdx.DurationVar(&pruneInterval, "prune-interval", time.Hour*3, "Interval at which the index should be checked for stale series.")
+
+	globalconf.Register("postgres-idx", pgIdx)
+	return pgIdx
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	var registered bool
+	for _, d := range sql.Drivers() {
+		if d == driverName {
+			registered = true
+		}
+	}
+	if !registered {
+		findings = append(findings, conf.NewError("postgres-idx.driver", "no database/sql driver %q is linked into this binary. available: %v", driverName, sql.Drivers()))
+	}
+	if dsn == "" {
+		findings = append(findings, conf.NewError("postgres-idx.dsn", "can't be empty"))
+	}
+	if timeout <= 0 {
+		findings = append(findings, conf.NewError("postgres-idx.timeout", "must be positive"))
+	}
+	if maxOpenConns < 1 {
+		findings = append(findings, conf.NewError("postgres-idx.max-open-conns", "must be at least 1"))
+	}
+	// postgres allows at most 65535 parameters per query
+	if batchSize < 1 || batchSize*numColumns > 65535 {
+		findings = append(findings, conf.NewError("postgres-idx.batch-size", "must be between 1 and %d", 65535/numColumns))
+	}
+	if batchMaxWait <= 0 {
+		findings = append(findings, conf.NewError("postgres-idx.batch-max-wait", "must be positive"))
+	}
+	if maxStale > 0 && pruneInterval <= 0 {
+		findings = append(findings, conf.NewError("postgres-idx.prune-interval", "must be positive when max-stale is set"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
+
+// writeReq is a save of the definition, or a delete of the row of the id in the partition if def is nil
+type writeReq struct {
+	def       *schema.MetricDefinition
+	id        schema.MKey
+	partition int32
+	recvTime  time.Time
+}
+
+// rowKey is the primary key of a row in the metric_idx table
+type rowKey struct {
+	partition int32
+	id        schema.MKey
+}
+
+// Implements the the "MetricIndex" interface
+type PgIdx struct {
+	memory.MemoryIdx
+	db         *sql.DB
+	writeQueue chan writeReq
+	wg         sync.WaitGroup
+
+	// progress of loading the index from postgres, for health and progress reporting. accessed atomically
+	loadPhase int32
+	defsRead  int64
+	loadStart int64 // unix nanos
+	loadEnd   int64 // unix nanos
+}
+
+func New() *PgIdx {
+	idx := &PgIdx{
+		MemoryIdx: *memory.New(),
+	}
+	if updatePgIdx {
+		idx.writeQueue = make(chan writeReq, writeQueueSize)
+	}
+	updateInterval32 = uint32(updateInterval.Nanoseconds() / int64(time.Second))
+	return idx
+}
+
+// InitBare connects to the database and makes sure the tables exist
+func (p *PgIdx) InitBare() error {
+	secret, err := secrets.New(dsn)
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open(driverName, secret.Get())
+	if err != nil {
+		return fmt.Errorf("failed to open postgres database: %s", err)
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		err = db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		if attempt >= 5 {
+			return fmt.Errorf("failed to connect to postgres. %d attempts: %s", attempt, err)
+		}
+		log.Warn("postgres-idx: failed to connect to postgres. retrying in 5s. attempt: %d: %s", attempt, err)
+		time.Sleep(5 * time.Second)
+	}
+
+	if createTables {
+		for _, entry := range []string{"schema_table", "schema_meta_tag_table", "schema_storage_overrides_table", "schema_org_policies_table", "schema_saved_queries_table"} {
+			log.Info("postgres-idx: ensuring that %s exists.", entry)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			_, err = db.ExecContext(ctx, util.ReadEntry(schemaFile, entry).(string))
+			cancel()
+			if err != nil {
+				return fmt.Errorf("failed to initialize postgres table: %s", err)
+			}
+		}
+	}
+	p.db = db
+	return nil
+}
+
+// Init makes sure the needed tables exist, rebuilds the in-memory index,
+// sets up the write queue, metrics and pruning routines
+func (p *PgIdx) Init() error {
+	log.Info("initializing postgres-idx. driver=%s", driverName)
+	if err := p.MemoryIdx.Init(); err != nil {
+		return err
+	}
+
+	if err := p.InitBare(); err != nil {
+		return err
+	}
+
+	if updatePgIdx {
+		p.wg.Add(1)
+		writeState := func() interface{} {
+			return map[string]int{"writeQueue": len(p.writeQueue)}
+		}
+		go crash.Go("idx.write", writeState, p.processWriteQueue)
+		log.Info("postgres-idx started the writeQueue handler")
+	}
+
+	// load the storage overrides and meta tag rules first, so they get applied to the series as they are loaded
+	p.loadStorageOverrides()
+	if memory.TagSupport {
+		p.loadMetaTagRules()
+	}
+	p.loadOrgPolicies()
+	p.loadSavedQueries()
+
+	p.rebuildIndex()
+
+	if maxStale > 0 {
+		if pruneInterval == 0 {
+			return fmt.Errorf("pruneInterval must be greater then 0")
+		}
+		go crash.Go("idx.prune", nil, p.prune)
+	}
+	return nil
+}
+
+func (p *PgIdx) Stop() {
+	log.Info("postgres-idx stopping")
+	p.MemoryIdx.Stop()
+
+	// if updatePgIdx is disabled then writeQueue should never have been initialized
+	if updatePgIdx {
+		close(p.writeQueue)
+	}
+	p.wg.Wait()
+	p.db.Close()
+}
+
+// Update updates an existing archive, if found.
+// It returns whether it was found, and - if so - the (updated) existing archive and its old partition
+func (p *PgIdx) Update(point schema.MetricPoint, partition int32) (idx.Archive, int32, bool) {
+	pre := time.Now()
+
+	archive, oldPartition, inMemory := p.MemoryIdx.Update(point, partition)
+
+	if !updatePgIdx {
+		statUpdateDuration.Value(time.Since(pre))
+		return archive, oldPartition, inMemory
+	}
+
+	if inMemory {
+		now := uint32(time.Now().Unix())
+		if oldPartition != partition {
+			// the partition is part of the primary key, so the row in the old partition must be deleted,
+			// and the definition saved in the new one
+			p.writeQueue <- writeReq{id: archive.Id, partition: oldPartition, recvTime: time.Now()}
+			archive.LastSave = 0
+		}
+		if archive.LastSave < (now - updateInterval32) {
+			archive = p.updatePostgres(now, archive)
+		}
+	}
+
+	statUpdateDuration.Value(time.Since(pre))
+	return archive, oldPartition, inMemory
+}
+
+func (p *PgIdx) AddOrUpdate(mkey schema.MKey, data *schema.MetricData, partition int32) (idx.Archive, int32, bool) {
+	pre := time.Now()
+
+	archive, oldPartition, inMemory := p.MemoryIdx.AddOrUpdate(mkey, data, partition)
+
+	stat := statUpdateDuration
+	if !inMemory {
+		stat = statAddDuration
+	}
+
+	if !updatePgIdx {
+		stat.Value(time.Since(pre))
+		return archive, oldPartition, inMemory
+	}
+
+	if inMemory && oldPartition != partition {
+		// the partition is part of the primary key, so the row in the old partition must be deleted,
+		// and the definition saved in the new one
+		p.writeQueue <- writeReq{id: mkey, partition: oldPartition, recvTime: time.Now()}
+		archive.LastSave = 0
+	}
+
+	// check if we need to save to postgres.
+	now := uint32(time.Now().Unix())
+	if archive.LastSave < (now - updateInterval32) {
+		archive = p.updatePostgres(now, archive)
+	}
+
+	stat.Value(time.Since(pre))
+	return archive, oldPartition, inMemory
+}
+
+// updatePostgres queues the archive to be saved to postgres and
+// updates the memory index with the updated fields. like the cassandra index,
+// it only blocks on a full queue if the archive has not been saved for 1.5x updateInterval.
+func (p *PgIdx) updatePostgres(now uint32, archive idx.Archive) idx.Archive {
+	req := writeReq{recvTime: time.Now(), def: &archive.MetricDefinition, id: archive.Id, partition: archive.Partition}
+	if archive.LastSave < (now - updateInterval32 - updateInterval32/2) {
+		p.writeQueue <- req
+	} else {
+		select {
+		case p.writeQueue <- req:
+		default:
+			statSaveSkipped.Inc()
+			if LogLevel.Get() < 2 {
+				log.Debug("postgres-idx: writeQueue is full, update not saved.")
+			}
+			return archive
+		}
+	}
+	archive.LastSave = now
+	p.MemoryIdx.UpdateArchive(archive)
+	return archive
+}
+
+func (p *PgIdx) rebuildIndex() {
+	log.Info("postgres-idx Rebuilding Memory Index from metricDefinitions in Postgres")
+	pre := time.Now()
+	atomic.StoreInt64(&p.loadStart, pre.UnixNano())
+	atomic.StoreInt32(&p.loadPhase, loadReading)
+	var staleTs uint32
+	if maxStale != 0 {
+		staleTs = uint32(time.Now().Add(maxStale * -1).Unix())
+	}
+	partitions := cluster.Manager.GetPartitions()
+
+	// restoring a snapshot is much faster than reading all definitions from postgres, which we then do in the background
+	if restored, ok := p.MemoryIdx.RestoreSnapshot(partitions); ok {
+		atomic.StoreInt32(&p.loadPhase, loadReconciling)
+		go crash.Go("idx.reconcile", nil, func() {
+			defs, err := p.LoadPartitions(partitions, nil, staleTs)
+			if err != nil {
+				log.Fatal(4, "postgres-idx: failed to load the index: %s", err)
+			}
+			added, updated, removed := p.MemoryIdx.Reconcile(defs, restored)
+			atomic.StoreInt64(&p.loadEnd, time.Now().UnixNano())
+			atomic.StoreInt32(&p.loadPhase, loadDone)
+			log.Info("postgres-idx Reconciling Memory Index with Postgres Complete. Added %d, updated %d, removed %d. Took %s", added, updated, removed, time.Since(pre))
+			p.MemoryIdx.StartSnapshots(partitions)
+		})
+		return
+	}
+
+	defs, err := p.LoadPartitions(partitions, nil, staleTs)
+	if err != nil {
+		log.Fatal(4, "postgres-idx: failed to load the index: %s", err)
+	}
+
+	atomic.StoreInt32(&p.loadPhase, loadIndexing)
+	num := p.MemoryIdx.Load(defs)
+	atomic.StoreInt64(&p.loadEnd, time.Now().UnixNano())
+	atomic.StoreInt32(&p.loadPhase, loadDone)
+	log.Info("postgres-idx Rebuilding Memory Index Complete. Imported %d. Took %s", num, time.Since(pre))
+	p.MemoryIdx.StartSnapshots(partitions)
+}
+
+// LoadPartitions appends the definitions of the given partitions to defs. like the cassandra index,
+// it skips the definitions of which all definitions with the same name and tags were last updated before cutoff.
+func (p *PgIdx) LoadPartitions(partitions []int32, defs []schema.MetricDefinition, cutoff uint32) ([]schema.MetricDefinition, error) {
+	placeholders := make([]string, len(partitions))
+	for i, part := range partitions {
+		placeholders[i] = strconv.Itoa(int(part))
+	}
+	q := fmt.Sprintf("SELECT id, orgid, partition, name, interval, unit, mtype, tags, lastupdate FROM metric_idx WHERE partition IN (%s)", strings.Join(placeholders, ","))
+	rows, err := p.db.QueryContext(context.Background(), q)
+	if err != nil {
+		return defs, err
+	}
+	defer rows.Close()
+
+	defsByNames := make(map[string][]*schema.MetricDefinition)
+	var id, name, unit, mtype, tags string
+	var orgId int64
+	var interval int
+	var partition int32
+	var lastupdate int64
+	for rows.Next() {
+		if err := rows.Scan(&id, &orgId, &partition, &name, &interval, &unit, &mtype, &tags, &lastupdate); err != nil {
+			return defs, err
+		}
+		mkey, err := schema.MKeyFromString(id)
+		if err != nil {
+			log.Error(3, "postgres-idx: load() could not parse ID %q: %s -> skipping", id, err)
+			continue
+		}
+		mdef := &schema.MetricDefinition{
+			Id:         mkey,
+			OrgId:      uint32(orgId),
+			Partition:  partition,
+			Name:       name,
+			Interval:   interval,
+			Unit:       unit,
+			Mtype:      mtype,
+			Tags:       splitTags(tags),
+			LastUpdate: lastupdate,
+		}
+		nameWithTags := mdef.NameWithTags()
+		defsByNames[nameWithTags] = append(defsByNames[nameWithTags], mdef)
+		atomic.AddInt64(&p.defsRead, 1)
+	}
+	if err := rows.Err(); err != nil {
+		return defs, err
+	}
+
+	cutoff64 := int64(cutoff)
+NAMES:
+	for name, defsByName := range defsByNames {
+		for _, def := range defsByName {
+			if def.LastUpdate >= cutoff64 {
+				// if one of the defs in a name is not stale, then we'll need to add
+				// all the associated MDs to the defs slice
+				for _, defToAdd := range defsByNames[name] {
+					defs = append(defs, *defToAdd)
+				}
+				continue NAMES
+			}
+		}
+	}
+	return defs, nil
+}
+
+// tags are stored separated by ';', which they can't contain
+func joinTags(tags []string) string {
+	return strings.Join(tags, ";")
+}
+
+func splitTags(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ";")
+}
+
+// processWriteQueue writes the saves and deletes from the writeQueue in batches, of up to batchSize
+// definitions, or what came in within batchMaxWait
+func (p *PgIdx) processWriteQueue() {
+	defer p.wg.Done()
+	batch := make([]writeReq, 0, batchSize)
+	timer := time.NewTimer(batchMaxWait)
+	timer.Stop()
+	for {
+		select {
+		case req, ok := <-p.writeQueue:
+			if !ok {
+				p.flush(batch)
+				log.Info("postgres-idx writeQueue handler ended.")
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(batchMaxWait)
+			}
+			batch = append(batch, req)
+			if len(batch) < batchSize {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+		p.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush writes the batch. per row, only the last save or delete matters, which are executed
+// in a delete and an upsert query per partition. queries are retried until they succeed.
+func (p *PgIdx) flush(batch []writeReq) {
+	if len(batch) == 0 {
+		return
+	}
+	pre := time.Now()
+	last := make(map[rowKey]writeReq, len(batch))
+	var partitions []int32
+	for _, req := range batch {
+		statQueryWaitDuration.Value(pre.Sub(req.recvTime))
+		key := rowKey{req.partition, req.id}
+		if _, ok := last[key]; !ok {
+			partitions = appendPartition(partitions, req.partition)
+		}
+		last[key] = req
+	}
+	for _, part := range partitions {
+		var deletes []interface{}
+		var upserts []interface{}
+		for key, req := range last {
+			if key.partition != part {
+				continue
+			}
+			if req.def == nil {
+				deletes = append(deletes, req.id.String())
+				continue
+			}
+			d := req.def
+			upserts = append(upserts, d.Partition, d.Id.String(), int64(d.OrgId), d.Name, d.Interval, d.Unit, d.Mtype, joinTags(d.Tags), d.LastUpdate)
+		}
+		if len(deletes) > 0 {
+			p.exec(deleteQuery(len(deletes)), append([]interface{}{part}, deletes...), statQueryDeleteOk, statQueryDeleteFail, len(deletes))
+		}
+		if len(upserts) > 0 {
+			p.exec(upsertQuery(len(upserts)/numColumns), upserts, statQueryUpsertOk, statQueryUpsertFail, len(upserts)/numColumns)
+		}
+	}
+	statQueryExecDuration.Value(time.Since(pre))
+}
+
+func appendPartition(partitions []int32, part int32) []int32 {
+	for _, p := range partitions {
+		if p == part {
+			return partitions
+		}
+	}
+	return append(partitions, part)
+}
+
+// exec executes the query until it succeeds
+func (p *PgIdx) exec(query string, args []interface{}, ok, fail *stats.Counter32, rows int) {
+	for attempts := 0; ; attempts++ {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := p.db.ExecContext(ctx, query, args...)
+		cancel()
+		if err == nil {
+			ok.Add(rows)
+			return
+		}
+		fail.Inc()
+		if (attempts % 20) == 0 {
+			log.Warn("postgres-idx Failed to write %d defs to postgres. it will be retried. %s", rows, err)
+		}
+		sleepTime := 100 * (attempts + 1)
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+	}
+}
+
+// upsertQuery returns the query that saves n definitions, with numColumns parameters each
+func upsertQuery(n int) string {
+	var b strings.Builder
+	b.WriteString("INSERT INTO metric_idx (partition, id, orgid, name, interval, unit, mtype, tags, lastupdate) VALUES ")
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString("(")
+		for j := 1; j <= numColumns; j++ {
+			if j > 1 {
+				b.WriteString(",")
+			}
+			b.WriteString("$" + strconv.Itoa(i*numColumns+j))
+		}
+		b.WriteString(")")
+	}
+	b.WriteString(" ON CONFLICT (partition, id) DO UPDATE SET orgid = excluded.orgid, name = excluded.name, interval = excluded.interval, unit = excluded.unit, mtype = excluded.mtype, tags = excluded.tags, lastupdate = excluded.lastupdate")
+	return b.String()
+}
+
+// deleteQuery returns the query that deletes n definitions of a partition, which is the first parameter
+func deleteQuery(n int) string {
+	placeholders := make([]string, n)
+	for i := range placeholders {
+		placeholders[i] = "$" + strconv.Itoa(i+2)
+	}
+	return "DELETE FROM metric_idx WHERE partition = $1 AND id IN (" + strings.Join(placeholders, ",") + ")"
+}
+
+// deleteDefs queues the deletes of the archives, which are executed in order with the saves
+func (p *PgIdx) deleteDefs(archives []idx.Archive) {
+	if !updatePgIdx {
+		return
+	}
+	for _, a := range archives {
+		p.writeQueue <- writeReq{id: a.Id, partition: a.Partition, recvTime: time.Now()}
+	}
+}
+
+func (p *PgIdx) Delete(orgId uint32, pattern string) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := p.MemoryIdx.Delete(orgId, pattern)
+	if err != nil {
+		return defs, err
+	}
+	p.deleteDefs(defs)
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+func (p *PgIdx) DeleteTagged(orgId uint32, paths []string) ([]idx.Archive, error) {
+	pre := time.Now()
+	defs, err := p.MemoryIdx.DeleteTagged(orgId, paths)
+	if err != nil {
+		return defs, err
+	}
+	p.deleteDefs(defs)
+	statDeleteDuration.Value(time.Since(pre))
+	return defs, err
+}
+
+// UpsertMetaTagRule upserts the meta tag rule in the memory index, and saves it to postgres.
+// the expressions and meta tags are stored as json arrays
+func (p *PgIdx) UpsertMetaTagRule(orgId uint32, rule idx.MetaTagRule) (bool, error) {
+	created, err := p.MemoryIdx.UpsertMetaTagRule(orgId, rule)
+	if err != nil || !updatePgIdx {
+		return created, err
+	}
+	// rules are identified by their expressions, regardless of their order
+	expressions, _ := json.Marshal(sortedCopy(rule.Expressions))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if len(rule.MetaTags) == 0 {
+		_, err = p.db.ExecContext(ctx, "DELETE FROM meta_tag_rules WHERE orgid = $1 AND expressions = $2", int64(orgId), string(expressions))
+	} else {
+		metaTags, _ := json.Marshal(sortedCopy(rule.MetaTags))
+		_, err = p.db.ExecContext(ctx, "INSERT INTO meta_tag_rules (orgid, expressions, metatags) VALUES ($1, $2, $3) ON CONFLICT (orgid, expressions) DO UPDATE SET metatags = excluded.metatags", int64(orgId), string(expressions), string(metaTags))
+	}
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to save meta tag rule %v of org %d: %s", rule.Expressions, orgId, err)
+		return created, fmt.Errorf("failed to save meta tag rule: %s", err)
+	}
+	return created, nil
+}
+
+// loadMetaTagRules loads the meta tag rules of all orgs into the memory index
+func (p *PgIdx) loadMetaTagRules() {
+	rows, err := p.db.QueryContext(context.Background(), "SELECT orgid, expressions, metatags FROM meta_tag_rules")
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to load meta tag rules: %s", err)
+		return
+	}
+	defer rows.Close()
+	var num int
+	for rows.Next() {
+		var orgId int64
+		var expressions, metaTags string
+		if err := rows.Scan(&orgId, &expressions, &metaTags); err != nil {
+			log.Error(3, "postgres-idx: failed to load meta tag rules: %s", err)
+			return
+		}
+		var rule idx.MetaTagRule
+		if err := json.Unmarshal([]byte(expressions), &rule.Expressions); err != nil {
+			log.Error(3, "postgres-idx: skipping meta tag rule of org %d with invalid expressions %q: %s", orgId, expressions, err)
+			continue
+		}
+		if err := json.Unmarshal([]byte(metaTags), &rule.MetaTags); err != nil {
+			log.Error(3, "postgres-idx: skipping meta tag rule of org %d with invalid meta tags %q: %s", orgId, metaTags, err)
+			continue
+		}
+		if _, err := p.MemoryIdx.UpsertMetaTagRule(uint32(orgId), rule); err != nil {
+			log.Error(3, "postgres-idx: skipping invalid meta tag rule %v of org %d: %s", rule.Expressions, orgId, err)
+			continue
+		}
+		num++
+	}
+	if err := rows.Err(); err != nil {
+		log.Error(3, "postgres-idx: failed to load meta tag rules: %s", err)
+		return
+	}
+	log.Info("postgres-idx: loaded %d meta tag rules", num)
+}
+
+// UpsertStorageOverride upserts the storage override in the memory index, and saves all overrides to postgres.
+// the overrides are stored as a json array in a single row, since their order matters
+func (p *PgIdx) UpsertStorageOverride(o conf.Override) (bool, error) {
+	created, err := p.MemoryIdx.UpsertStorageOverride(o)
+	if err != nil || !updatePgIdx {
+		return created, err
+	}
+	overrides, _ := json.Marshal(p.MemoryIdx.StorageOverrides())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = p.db.ExecContext(ctx, "INSERT INTO storage_overrides (id, overrides) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET overrides = excluded.overrides", 0, string(overrides))
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to save storage override %q: %s", o.Name, err)
+		return created, fmt.Errorf("failed to save storage override: %s", err)
+	}
+	return created, nil
+}
+
+// loadStorageOverrides activates the saved storage overrides
+func (p *PgIdx) loadStorageOverrides() {
+	var data string
+	err := p.db.QueryRowContext(context.Background(), "SELECT overrides FROM storage_overrides WHERE id = $1", 0).Scan(&data)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to load storage overrides: %s", err)
+		return
+	}
+	var overrides []conf.Override
+	if err := json.Unmarshal([]byte(data), &overrides); err != nil {
+		log.Error(3, "postgres-idx: skipping invalid storage overrides %q: %s", data, err)
+		return
+	}
+	if err := p.MemoryIdx.LoadStorageOverrides(overrides); err != nil {
+		log.Error(3, "postgres-idx: failed to activate storage overrides: %s", err)
+		return
+	}
+	log.Info("postgres-idx: loaded %d storage overrides", len(overrides))
+}
+
+// UpsertOrgPolicy sets the org policy in the memory index, and saves it to postgres
+func (p *PgIdx) UpsertOrgPolicy(policy idx.OrgPolicy) (bool, error) {
+	created, err := p.MemoryIdx.UpsertOrgPolicy(policy)
+	if err != nil || !updatePgIdx {
+		return created, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if policy.Empty() {
+		_, err = p.db.ExecContext(ctx, "DELETE FROM org_policies WHERE orgid = $1", policy.OrgId)
+	} else {
+		data, _ := json.Marshal(policy)
+		_, err = p.db.ExecContext(ctx, "INSERT INTO org_policies (orgid, policy) VALUES ($1, $2) ON CONFLICT (orgid) DO UPDATE SET policy = excluded.policy", policy.OrgId, string(data))
+	}
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to save policy of org %d: %s", policy.OrgId, err)
+		return created, fmt.Errorf("failed to save org policy: %s", err)
+	}
+	return created, nil
+}
+
+// loadOrgPolicies loads the policies of all orgs into the memory index
+func (p *PgIdx) loadOrgPolicies() {
+	rows, err := p.db.QueryContext(context.Background(), "SELECT policy FROM org_policies")
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to load org policies: %s", err)
+		return
+	}
+	defer rows.Close()
+	var policies []idx.OrgPolicy
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			log.Error(3, "postgres-idx: failed to load org policies: %s", err)
+			return
+		}
+		var policy idx.OrgPolicy
+		if err := json.Unmarshal([]byte(data), &policy); err != nil {
+			log.Error(3, "postgres-idx: skipping invalid org policy %q: %s", data, err)
+			continue
+		}
+		policies = append(policies, policy)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error(3, "postgres-idx: failed to load org policies: %s", err)
+		return
+	}
+	log.Info("postgres-idx: loaded %d org policies", p.MemoryIdx.LoadOrgPolicies(policies))
+}
+
+// UpsertSavedQuery saves the query in the memory index, and in postgres
+func (p *PgIdx) UpsertSavedQuery(q idx.SavedQuery) (bool, error) {
+	created, err := p.MemoryIdx.UpsertSavedQuery(q)
+	if err != nil || !updatePgIdx {
+		return created, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if len(q.Targets) == 0 {
+		_, err = p.db.ExecContext(ctx, "DELETE FROM saved_queries WHERE orgid = $1 AND id = $2", q.OrgId, q.Id)
+	} else {
+		data, _ := json.Marshal(q)
+		_, err = p.db.ExecContext(ctx, "INSERT INTO saved_queries (orgid, id, query, expires) VALUES ($1, $2, $3, $4) ON CONFLICT (orgid, id) DO UPDATE SET query = excluded.query, expires = excluded.expires", q.OrgId, q.Id, string(data), q.Expires)
+	}
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to save query %q of org %d: %s", q.Id, q.OrgId, err)
+		return created, fmt.Errorf("failed to save query: %s", err)
+	}
+	return created, nil
+}
+
+// loadSavedQueries loads the saved queries of all orgs into the memory index, and removes the expired ones from postgres
+func (p *PgIdx) loadSavedQueries() {
+	now := time.Now().Unix()
+	if updatePgIdx {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := p.db.ExecContext(ctx, "DELETE FROM saved_queries WHERE expires != 0 AND expires <= $1", now)
+		cancel()
+		if err != nil {
+			log.Error(3, "postgres-idx: failed to remove expired saved queries: %s", err)
+		}
+	}
+	rows, err := p.db.QueryContext(context.Background(), "SELECT query FROM saved_queries WHERE expires = 0 OR expires > $1", now)
+	if err != nil {
+		log.Error(3, "postgres-idx: failed to load saved queries: %s", err)
+		return
+	}
+	defer rows.Close()
+	var queries []idx.SavedQuery
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			log.Error(3, "postgres-idx: failed to load saved queries: %s", err)
+			return
+		}
+		var q idx.SavedQuery
+		if err := json.Unmarshal([]byte(data), &q); err != nil {
+			log.Error(3, "postgres-idx: skipping invalid saved query %q: %s", data, err)
+			continue
+		}
+		queries = append(queries, q)
+	}
+	if err := rows.Err(); err != nil {
+		log.Error(3, "postgres-idx: failed to load saved queries: %s", err)
+		return
+	}
+	log.Info("postgres-idx: loaded %d saved queries", p.MemoryIdx.LoadSavedQueries(queries))
+}
+
+func sortedCopy(s []string) []string {
+	out := append([]string(nil), s...)
+	sort.Strings(out)
+	return out
+}
+
+func (p *PgIdx) Prune(oldest time.Time) ([]idx.Archive, error) {
+	pre := time.Now()
+	pruned, err := p.MemoryIdx.Prune(oldest)
+	statPruneDuration.Value(time.Since(pre))
+	return pruned, err
+}
+
+func (p *PgIdx) prune() {
+	ticker := time.NewTicker(pruneInterval)
+	for range ticker.C {
+		if LogLevel.Get() < 2 {
+			log.Debug("postgres-idx: pruning items from index that have not been seen for %s", maxStale.String())
+		}
+		staleTs := time.Now().Add(maxStale * -1)
+		_, err := p.Prune(staleTs)
+		if err != nil {
+			log.Error(3, "postgres-idx: prune error. %s", err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package postgres
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/idx/memory"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// fakeDriver records the statements it executes, fails the first failExecs of them,
+// and returns rows for queries
+type fakeDriver struct {
+	sync.Mutex
+	execs     []fakeExec
+	failExecs int
+	columns   []string
+	rows      [][]driver.Value
+}
+
+type fakeExec struct {
+	query string
+	args  []driver.Value
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) { return &fakeConn{d}, nil }
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.d, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	if s.d.failExecs > 0 {
+		s.d.failExecs--
+		return nil, errors.New("connection refused")
+	}
+	s.d.execs = append(s.d.execs, fakeExec{s.query, args})
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.d.Lock()
+	defer s.d.Unlock()
+	s.d.execs = append(s.d.execs, fakeExec{s.query, args})
+	return &fakeRows{columns: s.d.columns, rows: s.d.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+var fake = &fakeDriver{}
+
+func init() {
+	sql.Register("pgfake", fake)
+}
+
+func testIdx(t *testing.T) *PgIdx {
+	fake.Lock()
+	fake.execs = nil
+	fake.failExecs = 0
+	fake.Unlock()
+	db, err := sql.Open("pgfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout = time.Second
+	return &PgIdx{
+		MemoryIdx: *memory.New(),
+		db:        db,
+	}
+}
+
+func testDef(name string, partition int32, lastUpdate int64, tags ...string) schema.MetricDefinition {
+	md := schema.MetricData{OrgId: 1, Name: name, Interval: 10, Mtype: "gauge", Tags: tags}
+	md.SetId()
+	mkey, _ := schema.MKeyFromString(md.Id)
+	return schema.MetricDefinition{
+		Id:         mkey,
+		OrgId:      1,
+		Partition:  partition,
+		Name:       name,
+		Interval:   10,
+		Mtype:      "gauge",
+		Tags:       tags,
+		LastUpdate: lastUpdate,
+	}
+}
+
+func TestQueries(t *testing.T) {
+	exp := "INSERT INTO metric_idx (partition, id, orgid, name, interval, unit, mtype, tags, lastupdate) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9),($10,$11,$12,$13,$14,$15,$16,$17,$18) ON CONFLICT"
+	if q := upsertQuery(2); !strings.HasPrefix(q, exp) {
+		t.Errorf("expected upsert query to start with %q, got %q", exp, q)
+	}
+	exp = "DELETE FROM metric_idx WHERE partition = $1 AND id IN ($2,$3)"
+	if q := deleteQuery(2); q != exp {
+		t.Errorf("expected delete query %q, got %q", exp, q)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	p := testIdx(t)
+	fake.failExecs = 1
+
+	a := testDef("a", 1, 100, "dc=x", "env=prod")
+	a2 := a
+	a2.LastUpdate = 200
+	b := testDef("b", 1, 100)
+	c := testDef("c", 2, 100)
+	now := time.Now()
+	p.flush([]writeReq{
+		{def: &a, id: a.Id, partition: 1, recvTime: now},
+		{def: &b, id: b.Id, partition: 1, recvTime: now},
+		{def: &c, id: c.Id, partition: 2, recvTime: now},
+		// a moved from partition 0 to 1, and was saved again
+		{id: a.Id, partition: 0, recvTime: now},
+		{def: &a2, id: a.Id, partition: 1, recvTime: now},
+		// b was deleted after it was saved
+		{id: b.Id, partition: 1, recvTime: now},
+	})
+
+	type stmt struct {
+		query string
+		ids   []string
+	}
+	var got []stmt
+	for _, e := range fake.execs {
+		s := stmt{query: strings.SplitN(e.query, " (", 2)[0]}
+		if strings.HasPrefix(e.query, "INSERT") {
+			if len(e.args)%numColumns != 0 {
+				t.Fatalf("expected a multiple of %d args, got %d", numColumns, len(e.args))
+			}
+			for i := 0; i < len(e.args); i += numColumns {
+				s.ids = append(s.ids, e.args[i+1].(string))
+				if e.args[i+1].(string) == a.Id.String() {
+					if e.args[i+7] != "dc=x;env=prod" || e.args[i+8] != int64(200) {
+						t.Errorf("expected the last save of a, with joined tags, got %v", e.args[i:i+numColumns])
+					}
+				}
+			}
+		} else {
+			s.query = e.query[:strings.Index(e.query, " IN")]
+			for _, arg := range e.args[1:] {
+				s.ids = append(s.ids, arg.(string))
+			}
+			s.ids = append(s.ids, fmt.Sprintf("partition %d", e.args[0]))
+		}
+		sort.Strings(s.ids)
+		got = append(got, s)
+	}
+	ids := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+	exp := []stmt{
+		{"DELETE FROM metric_idx WHERE partition = $1 AND id", ids(b.Id.String(), "partition 1")},
+		{"INSERT INTO metric_idx", ids(a.Id.String())},
+		{"INSERT INTO metric_idx", ids(c.Id.String())},
+		{"DELETE FROM metric_idx WHERE partition = $1 AND id", ids(a.Id.String(), "partition 0")},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected statements\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func TestLoadPartitions(t *testing.T) {
+	p := testIdx(t)
+	fresh := testDef("fresh", 1, 1000, "a=b")
+	stale := testDef("stale", 1, 10)
+	row := func(d schema.MetricDefinition) []driver.Value {
+		return []driver.Value{d.Id.String(), int64(d.OrgId), int64(d.Partition), d.Name, int64(d.Interval), d.Unit, d.Mtype, joinTags(d.Tags), d.LastUpdate}
+	}
+	fake.columns = []string{"id", "orgid", "partition", "name", "interval", "unit", "mtype", "tags", "lastupdate"}
+	fake.rows = [][]driver.Value{row(fresh), row(stale)}
+
+	defs, err := p.LoadPartitions([]int32{1, 2}, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// loading sets the cached name with tags
+	fresh.NameWithTags()
+	if len(defs) != 1 || !reflect.DeepEqual(defs[0], fresh) {
+		t.Fatalf("expected only the fresh def %v, got %v", fresh, defs)
+	}
+	if q := fake.execs[0].query; !strings.HasSuffix(q, "WHERE partition IN (1,2)") {
+		t.Errorf("unexpected load query %q", q)
+	}
+}
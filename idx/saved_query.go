@@ -0,0 +1,45 @@
+package idx
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var savedQueryId = regexp.MustCompile("^[0-9a-zA-Z_-]{1,64}$")
+
+// SavedQuery is a render request saved under an id, so that alerting and dashboards can refer to
+// the query by its id, while its targets can be changed in one place.
+type SavedQuery struct {
+	OrgId   uint32   `json:"orgId"`
+	Id      string   `json:"id"`
+	Targets []string `json:"targets"`
+	// the parameters of the render request. empty for the default of the render api
+	From          string `json:"from,omitempty"`
+	Until         string `json:"until,omitempty"`
+	MaxDataPoints uint32 `json:"maxDataPoints,omitempty"`
+	Process       string `json:"process,omitempty"`
+	Archive       string `json:"archive,omitempty"`
+	XFilesFactor  string `json:"xFilesFactor,omitempty"`
+	// unix timestamp after which the query is removed, 0 to keep it
+	Expires int64 `json:"expires,omitempty"`
+}
+
+// Expired returns whether the query expired at the given time
+func (q SavedQuery) Expired(now time.Time) bool {
+	return q.Expires != 0 && q.Expires <= now.Unix()
+}
+
+// Validate returns an error if the id of the query is invalid, or it has an empty target.
+// Whether the targets and parameters make a valid render request is up to the render api.
+func (q SavedQuery) Validate() error {
+	if !savedQueryId.MatchString(q.Id) {
+		return fmt.Errorf("org %d: invalid id %q: must be 1 to 64 letters, digits, '_' or '-'", q.OrgId, q.Id)
+	}
+	for _, t := range q.Targets {
+		if t == "" {
+			return fmt.Errorf("org %d: query %q has an empty target", q.OrgId, q.Id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package idx
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alyu/configparser"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// SharedViews are the views through which orgs can see series of other orgs
+var SharedViews Views
+
+// View shares the series of the source org of which the name starts with one of the prefixes,
+// and that have all the tags, read-only with the target orgs, or with all orgs if it has no targets.
+type View struct {
+	Name       string
+	SourceOrg  uint32
+	TargetOrgs []uint32
+	Prefixes   []string
+	Tags       []string // key=value
+}
+
+// Targets returns whether the view shares series with the org
+func (v *View) Targets(org uint32) bool {
+	if org == v.SourceOrg {
+		return false
+	}
+	if len(v.TargetOrgs) == 0 {
+		return true
+	}
+	for _, t := range v.TargetOrgs {
+		if t == org {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns whether the series is shared by the view
+func (v *View) Allows(def *schema.MetricDefinition) bool {
+	if def.OrgId != v.SourceOrg {
+		return false
+	}
+	if len(v.Prefixes) != 0 {
+		var ok bool
+		for _, p := range v.Prefixes {
+			if strings.HasPrefix(def.Name, p) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+TAGS:
+	for _, tag := range v.Tags {
+		for _, have := range def.Tags {
+			if have == tag {
+				continue TAGS
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// AllowsBranch returns whether the branch of the metrics tree with the given path is shared by the view,
+// which is the case if it leads to series with a name the view shares. Branches can't be checked against tags,
+// so views with tags but without prefixes share no branches.
+func (v *View) AllowsBranch(path string) bool {
+	if len(v.Prefixes) == 0 {
+		return len(v.Tags) == 0
+	}
+	for _, p := range v.Prefixes {
+		if strings.HasPrefix(path, p) || strings.HasPrefix(p, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Views are the views that share series across orgs
+type Views []*View
+
+// For returns the views that share series with the org
+func (vs Views) For(org uint32) Views {
+	var out Views
+	for _, v := range vs {
+		if v.Targets(org) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// Shares returns whether the series is shared with the org by any of the views
+func (vs Views) Shares(org uint32, def *schema.MetricDefinition) bool {
+	for _, v := range vs {
+		if v.Targets(org) && v.Allows(def) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadViews reads and parses a views file, in the same format as storage-schemas.conf:
+//
+//	[name]
+//	source-org = 10
+//	target-orgs = 1,2
+//	prefixes = infra.,k8s.
+//	tags = env=prod
+func ReadViews(file string) (Views, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+	var views Views
+	for _, sec := range sections {
+		name := strings.Trim(strings.SplitN(sec.String(), "\n", 2)[0], " []")
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		v, err := parseView(name, sec.ValueOf)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %s", name, err)
+		}
+		views = append(views, v)
+	}
+	return views, nil
+}
+
+// parseView parses the settings of a view, which are looked up with get. unset settings are ""
+func parseView(name string, get func(string) string) (*View, error) {
+	v := &View{
+		Name: name,
+	}
+	org, err := strconv.ParseUint(strings.TrimSpace(get("source-org")), 10, 32)
+	if err != nil || org == 0 {
+		return nil, fmt.Errorf("invalid source-org %q", get("source-org"))
+	}
+	v.SourceOrg = uint32(org)
+
+	targets := strings.TrimSpace(get("target-orgs"))
+	if targets == "" {
+		return nil, fmt.Errorf("no target-orgs. use * to share with all orgs")
+	}
+	if targets != "*" {
+		for _, s := range strings.Split(targets, ",") {
+			org, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+			if err != nil || org == 0 {
+				return nil, fmt.Errorf("invalid target org %q", s)
+			}
+			if uint32(org) == v.SourceOrg {
+				return nil, fmt.Errorf("target org %d is the source org", org)
+			}
+			v.TargetOrgs = append(v.TargetOrgs, uint32(org))
+		}
+	}
+
+	if s := strings.TrimSpace(get("prefixes")); s != "" {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				v.Prefixes = append(v.Prefixes, p)
+			}
+		}
+	}
+	if s := strings.TrimSpace(get("tags")); s != "" {
+		for _, tag := range strings.Split(s, ";") {
+			v.Tags = append(v.Tags, strings.TrimSpace(tag))
+		}
+		if !schema.ValidateTags(v.Tags) {
+			return nil, fmt.Errorf("invalid tags %q. must be key=value pairs, separated by ';'", s)
+		}
+		sort.Strings(v.Tags)
+	}
+	return v, nil
+}
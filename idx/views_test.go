@@ -0,0 +1,52 @@
+package idx
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseView(t *testing.T) {
+	cases := []struct {
+		settings map[string]string
+		exp      *View
+		err      bool
+	}{
+		{
+			settings: map[string]string{"source-org": "10", "target-orgs": "1, 2", "prefixes": "infra.,k8s.", "tags": "team=platform;env=prod"},
+			exp:      &View{Name: "v", SourceOrg: 10, TargetOrgs: []uint32{1, 2}, Prefixes: []string{"infra.", "k8s."}, Tags: []string{"env=prod", "team=platform"}},
+		},
+		{
+			settings: map[string]string{"source-org": "10", "target-orgs": "*"},
+			exp:      &View{Name: "v", SourceOrg: 10},
+		},
+		{settings: map[string]string{"target-orgs": "*"}, err: true},
+		{settings: map[string]string{"source-org": "10"}, err: true},
+		{settings: map[string]string{"source-org": "10", "target-orgs": "1,10"}, err: true},
+		{settings: map[string]string{"source-org": "10", "target-orgs": "1,x"}, err: true},
+		{settings: map[string]string{"source-org": "10", "target-orgs": "1", "tags": "env"}, err: true},
+	}
+	for i, c := range cases {
+		v, err := parseView("v", func(key string) string { return c.settings[key] })
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error %t, got %v", i, c.err, err)
+			continue
+		}
+		if !c.err && !reflect.DeepEqual(v, c.exp) {
+			t.Errorf("case %d: expected %+v, got %+v", i, c.exp, v)
+		}
+	}
+}
+
+func TestViewTargets(t *testing.T) {
+	all := &View{SourceOrg: 10}
+	some := &View{SourceOrg: 10, TargetOrgs: []uint32{1}}
+	if !all.Targets(2) || all.Targets(10) {
+		t.Errorf("view without target orgs should target all orgs but the source org")
+	}
+	if !some.Targets(1) || some.Targets(2) {
+		t.Errorf("view with target orgs should only target those")
+	}
+	if len(Views{all, some}.For(1)) != 2 || len(Views{all, some}.For(2)) != 1 {
+		t.Errorf("unexpected views for orgs")
+	}
+}
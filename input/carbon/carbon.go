@@ -5,35 +5,52 @@ package carbon
 import (
 	"bufio"
 	"flag"
+	"fmt"
 	"io"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
 	"github.com/grafana/metrictank/input"
 	"github.com/grafana/metrictank/stats"
 	"github.com/metrics20/go-metrics20/carbon20"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 	"gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
 )
 
-// metric input.carbon.metrics_per_message is how many metrics per message were seen. in carbon's case this is always 1.
+// metric input.carbon.metrics_per_message is how many metrics per message were seen. for the plaintext protocol this is always 1, for the pickle protocol it's the number of points in the frame.
 var metricsPerMessage = stats.NewMeter32("input.carbon.metrics_per_message", false)
 
-// metric input.carbon.metrics_decode_err is a count of times an input message (MetricData, MetricDataArray or carbon line) failed to parse
+// metric input.carbon.metrics_decode_err is a count of times an input message (MetricData, MetricDataArray, carbon line or point of a pickle frame) failed to parse
 var metricsDecodeErr = stats.NewCounterRate32("input.carbon.metrics_decode_err")
 
+// metric input.carbon.connections is the number of open connections
+var connections = stats.NewGauge32("input.carbon.connections")
+
+// metric input.carbon.connections_rejected is a count of connections that were closed right away, because there were max-connections already
+var connectionsRejected = stats.NewCounter32("input.carbon.connections_rejected")
+
+// metric input.carbon.points_shed is a count of points that were dropped, because their connection exceeded connection-rate-limit
+var pointsShed = stats.NewCounter32("input.carbon.points_shed")
+
 type Carbon struct {
 	input.Handler
 	addrStr          string
 	addr             *net.TCPAddr
 	listener         *net.TCPListener
+	pickleAddr       *net.TCPAddr
+	pickleListener   *net.TCPListener
 	handlerWaitGroup sync.WaitGroup
 	quit             chan struct{}
 	connTrack        *ConnTrack
 	intervalGetter   IntervalGetter
+	ids              *input.IDCache
 }
 
 type ConnTrack struct {
@@ -53,6 +70,18 @@ func (c *ConnTrack) Add(conn net.Conn) {
 	c.Unlock()
 }
 
+// AddLimit adds the connection, unless there are max connections already. 0 means no limit.
+// it returns whether the connection was added.
+func (c *ConnTrack) AddLimit(conn net.Conn, max int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if max > 0 && len(c.conns) >= max {
+		return false
+	}
+	c.conns[conn.RemoteAddr().String()] = conn
+	return true
+}
+
 func (c *ConnTrack) Remove(conn net.Conn) {
 	c.Lock()
 	delete(c.conns, conn.RemoteAddr().String())
@@ -73,20 +102,51 @@ func (c *Carbon) Name() string {
 
 var Enabled bool
 var addr string
+var pickleAddr string
 var partitionId int
+var idCacheSize int
+var maxConnections int
+var connectionRateLimit int
 
 func ConfigSetup() {
 	inCarbon := flag.NewFlagSet("carbon-in", flag.ExitOnError)
 	inCarbon.BoolVar(&Enabled, "enabled", false, "")
 	inCarbon.StringVar(&addr, "addr", ":2003", "tcp listen address")
+	inCarbon.StringVar(&pickleAddr, "pickle-addr", "", "tcp listen address for the pickle protocol, e.g. :2004. empty to disable")
 	inCarbon.IntVar(&partitionId, "partition", 0, "partition Id.")
+	inCarbon.IntVar(&idCacheSize, "id-cache-size", 100000, "max number of series to remember the id of, so that their subsequent points skip generating it. 0 disables")
+	inCarbon.IntVar(&maxConnections, "max-connections", 0, "max number of open connections, of the plaintext and pickle protocols together. further connections are closed right away. 0 disables")
+	inCarbon.IntVar(&connectionRateLimit, "connection-rate-limit", 0, "max number of points per second that a connection may send. further points in the same second are dropped. 0 disables")
 	globalconf.Register("carbon-in", inCarbon)
 }
 
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if maxConnections < 0 {
+		findings = append(findings, conf.NewError("carbon-in.max-connections", "can't be negative"))
+	}
+	if connectionRateLimit < 0 {
+		findings = append(findings, conf.NewError("carbon-in.connection-rate-limit", "can't be negative"))
+	}
+	if pickleAddr == addr {
+		findings = append(findings, conf.NewError("carbon-in.pickle-addr", "can't be the same as addr"))
+	}
+	return findings
+}
+
 func ConfigProcess() {
 	if !Enabled {
 		return
 	}
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
 	cluster.Manager.SetPartitions([]int32{int32(partitionId)})
 }
 
@@ -95,11 +155,19 @@ func New() *Carbon {
 	if err != nil {
 		log.Fatal(4, "carbon-in: %s", err.Error())
 	}
-	return &Carbon{
+	c := &Carbon{
 		addrStr:   addr,
 		addr:      addrT,
 		connTrack: NewConnTrack(),
+		ids:       input.NewIDCache("carbon", idCacheSize),
+	}
+	if pickleAddr != "" {
+		c.pickleAddr, err = net.ResolveTCPAddr("tcp", pickleAddr)
+		if err != nil {
+			log.Fatal(4, "carbon-in: %s", err.Error())
+		}
 	}
+	return c
 }
 
 func (c *Carbon) IntervalGetter(i IntervalGetter) {
@@ -115,8 +183,21 @@ func (c *Carbon) Start(handler input.Handler, fatal chan struct{}) error {
 	}
 	c.listener = l
 	log.Info("carbon-in: listening on %v/tcp", c.addr)
+	if c.pickleAddr != nil {
+		pl, err := net.ListenTCP("tcp", c.pickleAddr)
+		if nil != err {
+			l.Close()
+			log.Error(4, "carbon-in: %s", err.Error())
+			return err
+		}
+		c.pickleListener = pl
+		log.Info("carbon-in: listening for pickle on %v/tcp", c.pickleAddr)
+	}
 	c.quit = make(chan struct{})
-	go c.accept()
+	go c.accept(c.listener, c.handle)
+	if c.pickleListener != nil {
+		go c.accept(c.pickleListener, c.handlePickle)
+	}
 	return nil
 }
 
@@ -130,9 +211,9 @@ func (c *Carbon) ExplainPriority() interface{} {
 	return "carbon-in: priority=0 (always in sync)"
 }
 
-func (c *Carbon) accept() {
+func (c *Carbon) accept(listener *net.TCPListener, handle func(net.Conn)) {
 	for {
-		conn, err := c.listener.AcceptTCP()
+		conn, err := listener.AcceptTCP()
 		if nil != err {
 			select {
 			case <-c.quit:
@@ -143,9 +224,15 @@ func (c *Carbon) accept() {
 			log.Error(4, "carbon-in: Accept Error: %s", err.Error())
 			return
 		}
+		if !c.connTrack.AddLimit(conn, maxConnections) {
+			connectionsRejected.Inc()
+			log.Debug("carbon-in: rejecting connection from %s: max-connections reached", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		connections.Inc()
 		c.handlerWaitGroup.Add(1)
-		c.connTrack.Add(conn)
-		go c.handle(conn)
+		go handle(conn)
 	}
 }
 
@@ -153,6 +240,9 @@ func (c *Carbon) Stop() {
 	log.Info("carbon-in: shutting down.")
 	close(c.quit)
 	c.listener.Close()
+	if c.pickleListener != nil {
+		c.pickleListener.Close()
+	}
 	c.connTrack.CloseAll()
 	c.handlerWaitGroup.Wait()
 }
@@ -161,12 +251,21 @@ func (c *Carbon) handle(conn net.Conn) {
 	defer func() {
 		conn.Close()
 		c.connTrack.Remove(conn)
+		connections.Dec()
+		c.handlerWaitGroup.Done()
 	}()
+	// if handling a line panics, we drop the connection. the client will reconnect
+	var line []byte
+	defer crash.Recover("input.carbon", func() interface{} {
+		return map[string]string{"remoteAddr": conn.RemoteAddr().String(), "line": string(line)}
+	})
 	// TODO c.SetTimeout(60e9)
+	limit := newRateLimiter(connectionRateLimit)
 	r := bufio.NewReaderSize(conn, 4096)
 	for {
 		// note that we don't support lines longer than 4096B. that seems very reasonable..
 		buf, _, err := r.ReadLine()
+		line = buf
 
 		if nil != err {
 			select {
@@ -181,6 +280,12 @@ func (c *Carbon) handle(conn net.Conn) {
 			break
 		}
 
+		// shed the line before we spend time on it
+		if limit != nil && !limit.allow(time.Now().Unix()) {
+			pointsShed.Inc()
+			continue
+		}
+
 		// no validation for m2.0 to provide a grace period in adopting new clients
 		key, val, ts, err := carbon20.ValidatePacket(buf, carbon20.MediumLegacy, carbon20.NoneM20)
 		if err != nil {
@@ -188,20 +293,120 @@ func (c *Carbon) handle(conn net.Conn) {
 			log.Error(4, "carbon-in: invalid metric: %s", err.Error())
 			continue
 		}
-		nameSplits := strings.Split(string(key), ";")
-		md := &schema.MetricData{
-			Name:     nameSplits[0],
-			Interval: c.intervalGetter.GetInterval(nameSplits[0]),
-			Value:    val,
-			Unit:     "unknown",
-			Time:     int64(ts),
-			Mtype:    "gauge",
-			Tags:     nameSplits[1:],
-			OrgId:    1, // admin org
-		}
-		md.SetId()
 		metricsPerMessage.ValueUint32(1)
-		c.Handler.ProcessMetricData(md, int32(partitionId))
+		c.processPoint(string(key), val, ts)
+	}
+}
+
+// handlePickle handles a connection of the pickle protocol, which sends frames of a 4 byte big endian length header,
+// followed by a pickled list of (path, (timestamp, value)) tuples.
+func (c *Carbon) handlePickle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		c.connTrack.Remove(conn)
+		connections.Dec()
+		c.handlerWaitGroup.Done()
+	}()
+	// if handling a frame panics, we drop the connection. the client will reconnect
+	var item interface{}
+	defer crash.Recover("input.carbon", func() interface{} {
+		return map[string]string{"remoteAddr": conn.RemoteAddr().String(), "item": fmt.Sprint(item)}
+	})
+	limit := newRateLimiter(connectionRateLimit)
+	r := bufio.NewReaderSize(conn, 4096)
+	var buf []byte
+	for {
+		var items []interface{}
+		var err error
+		items, buf, err = ReadPickleFrame(r, buf)
+		if err != nil {
+			select {
+			case <-c.quit:
+				// we are shutting down.
+				return
+			default:
+			}
+			if io.EOF != err {
+				// we can't tell where the next frame starts, so we drop the connection
+				metricsDecodeErr.Inc()
+				log.Error(4, "carbon-in: pickle error: %s", err.Error())
+			}
+			return
+		}
+		metricsPerMessage.ValueUint32(uint32(len(items)))
+		now := time.Now().Unix()
+		for _, item = range items {
+			if !limit.allow(now) {
+				pointsShed.Inc()
+				continue
+			}
+			key, val, ts, err := ParsePickleItem(item)
+			if err != nil {
+				metricsDecodeErr.Inc()
+				log.Error(4, "carbon-in: invalid metric: %s", err.Error())
+				continue
+			}
+			c.processPoint(key, val, ts)
+		}
+	}
+}
+
+// rateLimiter limits the points of a connection to limit per second: it allows the first ones of every second.
+// it's not concurrency-safe, as a connection is handled by a single goroutine. a nil rateLimiter allows all points.
+type rateLimiter struct {
+	limit    int
+	second   int64
+	accepted int
+}
+
+// newRateLimiter returns a rateLimiter that allows limit points per second, or nil if limit is 0
+func newRateLimiter(limit int) *rateLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: limit}
+}
+
+func (r *rateLimiter) allow(now int64) bool {
+	if r == nil {
+		return true
+	}
+	if now != r.second {
+		r.second, r.accepted = now, 0
+	}
+	if r.accepted >= r.limit {
+		return false
+	}
+	r.accepted++
+	return true
+}
+
+// processPoint processes a point of the series with the given key, which is the name, optionally followed by tags
+func (c *Carbon) processPoint(keyStr string, val float64, ts uint32) {
+	// for series we've seen before, we know the id, so we don't need a MetricData
+	if id, ok := c.ids.Get(keyStr); ok {
+		point := schema.MetricPoint{MKey: id, Value: val, Time: ts}
+		if c.Handler.ProcessMetricPoint(point, msg.FormatMetricPoint, int32(partitionId)) {
+			return
+		}
+		// the series is no longer in the index
+		c.ids.Del(keyStr)
+	}
+
+	nameSplits := strings.Split(keyStr, ";")
+	md := &schema.MetricData{
+		Name:     nameSplits[0],
+		Interval: c.intervalGetter.GetInterval(nameSplits[0]),
+		Value:    val,
+		Unit:     "unknown",
+		Time:     int64(ts),
+		Mtype:    "gauge",
+		Tags:     nameSplits[1:],
+		OrgId:    1, // admin org
+	}
+	md.SetId()
+	if id, err := schema.MKeyFromString(md.Id); err == nil {
+		c.ids.Add(keyStr, id)
 	}
-	c.handlerWaitGroup.Done()
+	c.Handler.ProcessMetricData(md, int32(partitionId))
 }
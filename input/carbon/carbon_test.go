@@ -0,0 +1,71 @@
+package carbon
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if l := newRateLimiter(0); l != nil || !l.allow(1) {
+		t.Fatalf("expected no limit for 0")
+	}
+	l := newRateLimiter(2)
+	for i, exp := range []struct {
+		now   int64
+		allow bool
+	}{
+		{10, true},
+		{10, true},
+		{10, false},
+		{10, false},
+		{11, true},
+		{13, true},
+		{13, true},
+		{13, false},
+	} {
+		if got := l.allow(exp.now); got != exp.allow {
+			t.Fatalf("case %d: expected allow %t at %d, got %t", i, exp.allow, exp.now, got)
+		}
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	addr, pickleAddr, maxConnections = "127.0.0.1:0", "", 1
+	defer func() { addr, maxConnections = ":2003", 0 }()
+	c := New()
+	if err := c.Start(&fakeHandler{}, make(chan struct{})); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	first, err := net.Dial("tcp", c.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for i := 0; ; i++ {
+		c.connTrack.Lock()
+		n := len(c.connTrack.conns)
+		c.connTrack.Unlock()
+		if n == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("expected the first connection to be accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", c.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the second connection to be closed")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("expected the second connection to be closed, but it's still open")
+	}
+}
@@ -0,0 +1,111 @@
+package carbon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+
+	pickle "github.com/kisielk/og-rek"
+	"github.com/metrics20/go-metrics20/carbon20"
+)
+
+// maxPickleFrame is the largest pickle frame we accept. carbon's own limit is 1MB
+const maxPickleFrame = 1 << 20
+
+var errInvalidPickle = errors.New("pickle frame does not contain a list of (path, (timestamp, value)) tuples")
+
+// ReadPickleFrame reads a frame of the pickle protocol: a 4 byte big endian length header, followed by the pickled data,
+// and returns the items of the pickled list. buf is used to read the frame into, if it is large enough.
+// io.EOF is returned if r ends before the header of a new frame.
+func ReadPickleFrame(r io.Reader, buf []byte) ([]interface{}, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, buf, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxPickleFrame {
+		return nil, buf, fmt.Errorf("pickle frame of %d bytes exceeds max of %d bytes", size, maxPickleFrame)
+	}
+	if uint32(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, buf, err
+	}
+	obj, err := pickle.NewDecoder(bytes.NewReader(buf)).Decode()
+	if err != nil {
+		return nil, buf, err
+	}
+	list, ok := obj.([]interface{})
+	if !ok {
+		return nil, buf, errInvalidPickle
+	}
+	return list, buf, nil
+}
+
+// ParsePickleItem interprets a (path, (timestamp, value)) tuple, and validates the path like the plaintext protocol does
+func ParsePickleItem(item interface{}) (string, float64, uint32, error) {
+	outer, ok := item.(pickle.Tuple)
+	if !ok || len(outer) != 2 {
+		return "", 0, 0, errInvalidPickle
+	}
+	key, ok := outer[0].(string)
+	if !ok || key == "" {
+		return "", 0, 0, errInvalidPickle
+	}
+	// like graphite, we ignore a leading dot
+	if key[0] == '.' {
+		key = key[1:]
+	}
+	if err := validateKey(key); err != nil {
+		return key, 0, 0, err
+	}
+	inner, ok := outer[1].(pickle.Tuple)
+	if !ok || len(inner) != 2 {
+		return key, 0, 0, errInvalidPickle
+	}
+	ts, err := toFloat(inner[0])
+	if err != nil {
+		return key, 0, 0, fmt.Errorf("invalid timestamp for %q: %s", key, err)
+	}
+	if ts <= 0 || ts > float64(^uint32(0)) {
+		return key, 0, 0, fmt.Errorf("invalid timestamp for %q: %f", key, ts)
+	}
+	val, err := toFloat(inner[1])
+	if err != nil {
+		return key, 0, 0, fmt.Errorf("invalid value for %q: %s", key, err)
+	}
+	return key, val, uint32(ts), nil
+}
+
+// validateKey validates the key at the same levels as carbon20.ValidatePacket does for the plaintext protocol
+func validateKey(key string) error {
+	switch carbon20.GetVersion(key) {
+	case carbon20.Legacy:
+		return carbon20.ValidateKeyLegacy(key, carbon20.MediumLegacy)
+	case carbon20.M20:
+		return carbon20.ValidateKeyM20(key, carbon20.NoneM20)
+	}
+	return carbon20.ValidateKeyM20NoEquals(key, carbon20.NoneM20)
+}
+
+// toFloat converts the numeric types the pickle decoder may produce to a float64
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case int64:
+		return float64(n), nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f, nil
+	case string:
+		return strconv.ParseFloat(n, 64)
+	}
+	return 0, fmt.Errorf("unsupported type %T", v)
+}
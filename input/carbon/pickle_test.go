@@ -0,0 +1,97 @@
+package carbon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	pickle "github.com/kisielk/og-rek"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+type fakeHandler struct {
+	md     []*schema.MetricData
+	points []schema.MetricPoint
+}
+
+func (h *fakeHandler) ProcessMetricData(md *schema.MetricData, partition int32) {
+	h.md = append(h.md, md)
+}
+
+func (h *fakeHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	h.points = append(h.points, point)
+	return true
+}
+
+type fakeIntervalGetter struct{}
+
+func (f fakeIntervalGetter) GetInterval(name string) int {
+	return 10
+}
+
+func pickleFrame(t *testing.T, items ...interface{}) []byte {
+	var payload bytes.Buffer
+	if err := pickle.NewEncoder(&payload).Encode(items); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 4, 4+payload.Len())
+	binary.BigEndian.PutUint32(frame, uint32(payload.Len()))
+	return append(frame, payload.Bytes()...)
+}
+
+func TestHandlePickle(t *testing.T) {
+	h := &fakeHandler{}
+	idCacheSize = 100
+	c := New()
+	c.Handler = h
+	c.IntervalGetter(fakeIntervalGetter{})
+	c.quit = make(chan struct{})
+
+	client, server := net.Pipe()
+	c.handlerWaitGroup.Add(1)
+	c.connTrack.Add(server)
+	done := make(chan struct{})
+	go func() {
+		c.handlePickle(server)
+		close(done)
+	}()
+
+	client.Write(pickleFrame(t,
+		pickle.Tuple{"a.b", pickle.Tuple{int64(1500000000), 1.5}},
+		pickle.Tuple{".c;dc=east", pickle.Tuple{1500000010.0, int64(2)}},
+		pickle.Tuple{"d", pickle.Tuple{"1500000020", "3.25"}},
+		pickle.Tuple{"a\x00b", pickle.Tuple{int64(1500000000), 1.0}},
+		pickle.Tuple{"e", pickle.Tuple{int64(0), 1.0}},
+		pickle.Tuple{"f"},
+	))
+	client.Write(pickleFrame(t, pickle.Tuple{"a.b", pickle.Tuple{int64(1500000010), 2.5}}))
+	client.Close()
+	<-done
+
+	var got []schema.MetricData
+	for _, md := range h.md {
+		got = append(got, schema.MetricData{Name: md.Name, Tags: md.Tags, Time: md.Time, Value: md.Value})
+	}
+	exp := []schema.MetricData{
+		{Name: "a.b", Tags: []string{}, Time: 1500000000, Value: 1.5},
+		{Name: "c", Tags: []string{"dc=east"}, Time: 1500000010, Value: 2},
+		{Name: "d", Tags: []string{}, Time: 1500000020, Value: 3.25},
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected MetricData %v, got %v", exp, got)
+	}
+	// the id of a.b is known by the second frame
+	if len(h.points) != 1 || h.points[0].Value != 2.5 || h.points[0].Time != 1500000010 {
+		t.Fatalf("expected 1 MetricPoint for a.b, got %v", h.points)
+	}
+}
+
+func TestReadPickleFrameTooLarge(t *testing.T) {
+	frame := []byte{0xff, 0xff, 0xff, 0xff}
+	if _, _, err := ReadPickleFrame(bytes.NewReader(frame), nil); err == nil {
+		t.Fatalf("expected an error for a frame that exceeds the max size")
+	}
+}
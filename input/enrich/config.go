@@ -0,0 +1,79 @@
+package enrich
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled       bool
+	rulesFile     string
+	lookupUrl     string
+	lookupTag     string
+	lookupTimeout time.Duration
+	lookupTTL     time.Duration
+
+	rules []*Rule
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("enrich", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "add and normalize tags of incoming series before they are indexed. note that this changes the id of the series, so changing the rules or lookup results creates new series")
+	fs.StringVar(&rulesFile, "rules-file", "/etc/metrictank/enrich-rules.conf", "path to the file with the enrichment rules. empty for no rules")
+	fs.StringVar(&lookupUrl, "lookup-url", "", "url of a service that returns the tags to add to series, as a json object, for the value of lookup-tag. {value} in the url is replaced by the value. empty to disable lookups")
+	fs.StringVar(&lookupTag, "lookup-tag", "host", "tag of which the value is looked up")
+	fs.DurationVar(&lookupTimeout, "lookup-timeout", time.Second, "timeout of lookups. ingestion of series with a value that is not cached waits for the lookup")
+	fs.DurationVar(&lookupTTL, "lookup-cache-ttl", 10*time.Minute, "how long the result of a lookup is cached. if a lookup fails, the previous result is used")
+	globalconf.Register("enrich", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if rulesFile != "" {
+		if _, err := ReadRules(rulesFile); err != nil {
+			findings = append(findings, conf.NewError("enrich.rules-file", "%s", err))
+		}
+	}
+	if lookupUrl != "" {
+		u, err := url.Parse(lookupUrl)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			findings = append(findings, conf.NewError("enrich.lookup-url", "invalid url %q", lookupUrl))
+		} else if !strings.Contains(lookupUrl, "{value}") {
+			findings = append(findings, conf.NewError("enrich.lookup-url", "must contain {value}"))
+		}
+		if lookupTag == "" || strings.ContainsAny(lookupTag, ";!^=") {
+			findings = append(findings, conf.NewError("enrich.lookup-tag", "invalid tag %q", lookupTag))
+		}
+		if lookupTimeout <= 0 {
+			findings = append(findings, conf.NewError("enrich.lookup-timeout", "must be positive"))
+		}
+		if lookupTTL <= 0 {
+			findings = append(findings, conf.NewError("enrich.lookup-cache-ttl", "must be positive"))
+		}
+	}
+	if rulesFile == "" && lookupUrl == "" {
+		findings = append(findings, conf.NewWarning("enrich.enabled", "no rules-file and no lookup-url, so nothing is enriched"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	if Enabled && rulesFile != "" {
+		rules, _ = ReadRules(rulesFile)
+	}
+}
@@ -0,0 +1,244 @@
+// Package enrich adds and normalizes tags of incoming series before they are indexed, based on rules
+// and lookups of tag values in an external service, so series can be queried by business dimensions
+// that the agents don't send.
+package enrich
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// failed lookups of values that have no previous result are retried after this long
+const lookupRetryInterval = 30 * time.Second
+
+var (
+	// metric input.enrich.enriched is a count of metricdata of which the tags were changed by enrichment
+	enrichedMD = stats.NewCounter32("input.enrich.enriched")
+	// metric input.enrich.lookup is the duration of lookups of tag values in the external service
+	lookupDuration = stats.NewLatencyHistogram15s32("input.enrich.lookup")
+	// metric input.enrich.lookup_errors is a count of failed lookups of tag values in the external service
+	lookupErrors = stats.NewCounter32("input.enrich.lookup_errors")
+	// metric input.enrich.aliases is the number of series of which the id was changed by enrichment
+	aliasesGauge = stats.NewGauge32("input.enrich.aliases")
+)
+
+// Enricher changes the tags of incoming series. As the id of a series is generated from its tags,
+// the enriched series gets a new id. The enricher remembers the id that each enriched series was sent
+// with, so that subsequent MetricPoints, which only carry that id, can be routed to the enriched series.
+// all methods are nil-safe: a nil Enricher changes nothing.
+type Enricher struct {
+	rules  []*Rule
+	lookup *lookup
+
+	sync.RWMutex // protects aliases
+	aliases      map[schema.MKey]schema.MKey
+}
+
+// New returns the enricher as configured, or nil if it's disabled
+func New() *Enricher {
+	if !Enabled {
+		return nil
+	}
+	var l *lookup
+	if lookupUrl != "" {
+		l = newLookup(lookupUrl, lookupTag, lookupTimeout, lookupTTL)
+	}
+	return newEnricher(rules, l)
+}
+
+func newEnricher(rules []*Rule, l *lookup) *Enricher {
+	return &Enricher{
+		rules:   rules,
+		lookup:  l,
+		aliases: make(map[schema.MKey]schema.MKey),
+	}
+}
+
+// Enrich applies the rules and the lookup to the metricdata. if its tags change, its id is regenerated.
+// the metricdata must be valid.
+func (e *Enricher) Enrich(md *schema.MetricData) {
+	if e == nil {
+		return
+	}
+	t := tags(append([]string(nil), md.Tags...))
+	var changed bool
+	for _, r := range e.rules {
+		if r.apply(uint32(md.OrgId), md.Name, &t) {
+			changed = true
+		}
+	}
+	if e.lookup.apply(&t) {
+		changed = true
+	}
+	if !changed {
+		return
+	}
+
+	orig, err := schema.MKeyFromString(md.Id)
+	if err != nil {
+		// the caller will complain about the id
+		return
+	}
+	md.Tags = t
+	md.SetId()
+	mkey, err := schema.MKeyFromString(md.Id)
+	if err != nil {
+		return
+	}
+	enrichedMD.Inc()
+	if mkey == orig {
+		return
+	}
+
+	e.RLock()
+	alias, ok := e.aliases[orig]
+	e.RUnlock()
+	if ok && alias == mkey {
+		return
+	}
+	e.Lock()
+	e.aliases[orig] = mkey
+	aliasesGauge.Set(len(e.aliases))
+	e.Unlock()
+}
+
+// Key returns the id of the enriched series for the id that a series is sent with
+func (e *Enricher) Key(mkey schema.MKey) schema.MKey {
+	if e == nil {
+		return mkey
+	}
+	e.RLock()
+	alias, ok := e.aliases[mkey]
+	e.RUnlock()
+	if ok {
+		return alias
+	}
+	return mkey
+}
+
+// lookup adds the tags that an external service returns for the value of a tag, which are cached.
+// tags that the series already has are not overridden.
+type lookup struct {
+	url    string // with {value}
+	tag    string
+	ttl    time.Duration
+	client *http.Client
+	now    func() time.Time
+
+	sync.RWMutex // protects cache
+	cache        map[string]*lookupResult
+}
+
+type lookupResult struct {
+	tags    []string
+	expires time.Time
+}
+
+func newLookup(url, tag string, timeout, ttl time.Duration) *lookup {
+	return &lookup{
+		url:    url,
+		tag:    tag,
+		ttl:    ttl,
+		client: &http.Client{Timeout: timeout},
+		now:    time.Now,
+		cache:  make(map[string]*lookupResult),
+	}
+}
+
+// apply adds the tags that are looked up for the series, and returns whether it did
+func (l *lookup) apply(t *tags) bool {
+	if l == nil {
+		return false
+	}
+	value, ok := t.get(l.tag)
+	if !ok {
+		return false
+	}
+	var changed bool
+	for _, tag := range l.get(value) {
+		kv := strings.SplitN(tag, "=", 2)
+		if _, ok := t.get(kv[0]); !ok {
+			t.set(kv[0], kv[1])
+			changed = true
+		}
+	}
+	return changed
+}
+
+// get returns the tags for the value, from the cache if they're not expired.
+// if the lookup fails, the expired tags are used, if any.
+func (l *lookup) get(value string) []string {
+	now := l.now()
+	l.RLock()
+	res, ok := l.cache[value]
+	l.RUnlock()
+	if ok && now.Before(res.expires) {
+		return res.tags
+	}
+
+	pre := time.Now()
+	tags, err := l.fetch(value)
+	lookupDuration.Value(time.Since(pre))
+	if err != nil {
+		lookupErrors.Inc()
+		log.Warn("enrich: lookup of %s=%s failed: %s", l.tag, value, err)
+		prev := res
+		res = &lookupResult{
+			expires: now.Add(lookupRetryInterval),
+		}
+		if ok {
+			res.tags = prev.tags
+		}
+	} else {
+		res = &lookupResult{
+			tags:    tags,
+			expires: now.Add(l.ttl),
+		}
+	}
+	l.Lock()
+	l.cache[value] = res
+	l.Unlock()
+	return res.tags
+}
+
+// fetch requests the tags for the value from the service, which returns them as a json object of keys and values.
+// a 404 means there are no tags for the value.
+func (l *lookup) fetch(value string) ([]string, error) {
+	resp, err := l.client.Get(strings.Replace(l.url, "{value}", url.PathEscape(value), -1))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http status %s", resp.Status)
+	}
+	var kv map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&kv); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err)
+	}
+	tags := make([]string, 0, len(kv))
+	for k, v := range kv {
+		if k == "name" {
+			continue
+		}
+		tags = append(tags, k+"="+v)
+	}
+	if !schema.ValidateTags(tags) {
+		return nil, fmt.Errorf("invalid tags %q", tags)
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,153 @@
+package enrich
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		settings map[string]string
+		err      bool
+	}{
+		{settings: map[string]string{"conditions": "host=~web-.*;env!=dev", "set": "team=web"}},
+		{settings: map[string]string{"org": "2", "rename": "hostname:host, dc:datacenter", "lowercase": "host"}},
+		{settings: map[string]string{"conditions": "host=a"}, err: true},
+		{settings: map[string]string{"conditions": "host", "set": "a=b"}, err: true},
+		{settings: map[string]string{"conditions": "host=~(", "set": "a=b"}, err: true},
+		{settings: map[string]string{"set": "a"}, err: true},
+		{settings: map[string]string{"set": "name=b"}, err: true},
+		{settings: map[string]string{"rename": "name:host"}, err: true},
+		{settings: map[string]string{"rename": "a"}, err: true},
+		{settings: map[string]string{"org": "x", "set": "a=b"}, err: true},
+	}
+	for i, c := range cases {
+		_, err := parseRule("r", func(key string) string { return c.settings[key] })
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error %t, got %v", i, c.err, err)
+		}
+	}
+}
+
+func mustRule(t *testing.T, settings map[string]string) *Rule {
+	r, err := parseRule("r", func(key string) string { return settings[key] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testMD(org int, name string, tags ...string) *schema.MetricData {
+	md := &schema.MetricData{OrgId: org, Name: name, Interval: 10, Value: 1, Time: 1, Mtype: "gauge", Tags: tags}
+	md.SetId()
+	return md
+}
+
+func TestEnrichRules(t *testing.T) {
+	e := newEnricher([]*Rule{
+		mustRule(t, map[string]string{"rename": "hostname:host", "lowercase": "host"}),
+		mustRule(t, map[string]string{"conditions": "host=~web-eu-.*", "set": "region=eu;team=web"}),
+		mustRule(t, map[string]string{"org": "2", "conditions": "name=cpu;env!=dev", "set": "env=prod"}),
+	}, nil)
+
+	cases := []struct {
+		md  *schema.MetricData
+		exp []string
+	}{
+		{testMD(1, "cpu", "hostname=WEB-EU-1"), []string{"host=web-eu-1", "region=eu", "team=web"}},
+		{testMD(1, "cpu", "host=web-us-1"), []string{"host=web-us-1"}},
+		{testMD(1, "cpu", "host=web-eu-1", "team=db"), []string{"host=web-eu-1", "region=eu", "team=web"}},
+		{testMD(2, "cpu", "host=db-1", "env=production"), []string{"env=prod", "host=db-1"}},
+		{testMD(2, "cpu", "host=db-1", "env=dev"), []string{"env=dev", "host=db-1"}},
+		{testMD(2, "mem", "host=db-1"), []string{"host=db-1"}},
+	}
+	for i, c := range cases {
+		orig := c.md.Id
+		e.Enrich(c.md)
+		if !reflect.DeepEqual(c.md.Tags, c.exp) {
+			t.Errorf("case %d: expected tags %v, got %v", i, c.exp, c.md.Tags)
+		}
+		if exp := testMD(c.md.OrgId, c.md.Name, c.exp...).Id; c.md.Id != exp {
+			t.Errorf("case %d: expected id %s, got %s", i, exp, c.md.Id)
+		}
+		origKey, _ := schema.MKeyFromString(orig)
+		key, _ := schema.MKeyFromString(c.md.Id)
+		if e.Key(origKey) != key {
+			t.Errorf("case %d: expected the original id to map to the enriched id", i)
+		}
+	}
+}
+
+func TestEnrichLookup(t *testing.T) {
+	var requests, fail int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		switch r.URL.Path {
+		case "/hosts/web-1":
+			w.Write([]byte(`{"region":"eu","team":"web"}`))
+		case "/hosts/bad":
+			w.Write([]byte(`{"region":""}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	now := time.Unix(1000, 0)
+	l := newLookup(server.URL+"/hosts/{value}", "host", time.Second, time.Minute)
+	l.now = func() time.Time { return now }
+	e := newEnricher(nil, l)
+
+	enrich := func(tags ...string) []string {
+		md := testMD(1, "cpu", tags...)
+		e.Enrich(md)
+		return md.Tags
+	}
+	expect := func(desc string, got, exp []string, expRequests int32) {
+		t.Helper()
+		if !reflect.DeepEqual(got, exp) {
+			t.Errorf("%s: expected tags %v, got %v", desc, exp, got)
+		}
+		if r := atomic.LoadInt32(&requests); r != expRequests {
+			t.Errorf("%s: expected %d requests, got %d", desc, expRequests, r)
+		}
+	}
+
+	expect("lookup", enrich("host=web-1"), []string{"host=web-1", "region=eu", "team=web"}, 1)
+	expect("cached", enrich("host=web-1", "team=ops"), []string{"host=web-1", "region=eu", "team=ops"}, 1)
+	expect("unknown value", enrich("host=db-1"), []string{"host=db-1"}, 2)
+	expect("invalid response", enrich("host=bad"), []string{"host=bad"}, 3)
+	expect("no lookup tag", enrich("dc=x"), []string{"dc=x"}, 3)
+
+	now = now.Add(2 * time.Minute)
+	atomic.StoreInt32(&fail, 1)
+	expect("failed refresh uses previous result", enrich("host=web-1"), []string{"host=web-1", "region=eu", "team=web"}, 4)
+	expect("failed refresh is retried later", enrich("host=web-1"), []string{"host=web-1", "region=eu", "team=web"}, 4)
+	now = now.Add(lookupRetryInterval)
+	atomic.StoreInt32(&fail, 0)
+	expect("retried", enrich("host=web-1"), []string{"host=web-1", "region=eu", "team=web"}, 5)
+}
+
+func TestNilEnricher(t *testing.T) {
+	var e *Enricher
+	md := testMD(1, "cpu", "host=a")
+	id := md.Id
+	e.Enrich(md)
+	if md.Id != id {
+		t.Fatalf("nil enricher changed the id")
+	}
+	mkey, _ := schema.MKeyFromString(id)
+	if e.Key(mkey) != mkey {
+		t.Fatalf("nil enricher changed the key")
+	}
+}
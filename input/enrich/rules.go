@@ -0,0 +1,239 @@
+package enrich
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/alyu/configparser"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// Rule changes the tags of the series of its org that match all its conditions.
+// tags are first renamed, then lowercased, then set.
+type Rule struct {
+	Name       string // the name of the section in the rules file
+	Org        uint32 // 0 for all orgs
+	Conditions []condition
+	Rename     [][2]string // pairs of old and new key
+	Lowercase  []string    // keys of which the values are lowercased
+	Set        []string    // key=value pairs, that replace the values of existing tags
+}
+
+// condition is a tag expression like key=value, key!=value, key=~regex or key!=~regex.
+// the name of a series is matched with the key "name".
+type condition struct {
+	key   string
+	value string
+	re    *regexp.Regexp
+	not   bool
+}
+
+func parseCondition(s string) (condition, error) {
+	var c condition
+	pos := strings.Index(s, "=")
+	if pos < 1 {
+		return c, fmt.Errorf("invalid condition %q", s)
+	}
+	c.key = s[:pos]
+	if strings.HasSuffix(c.key, "!") {
+		c.not = true
+		c.key = c.key[:len(c.key)-1]
+	}
+	c.value = s[pos+1:]
+	if strings.HasPrefix(c.value, "~") {
+		var err error
+		c.value = c.value[1:]
+		c.re, err = regexp.Compile("^(?:" + c.value + ")$")
+		if err != nil {
+			return c, fmt.Errorf("invalid regular expression in condition %q: %s", s, err)
+		}
+	}
+	if c.key == "" || strings.ContainsAny(c.key, ";!^=") {
+		return c, fmt.Errorf("invalid key in condition %q", s)
+	}
+	return c, nil
+}
+
+// matches returns whether the value of the tag, which is "" if the series doesn't have it, matches
+func (c condition) matches(value string) bool {
+	if c.re != nil {
+		return c.re.MatchString(value) != c.not
+	}
+	return (value == c.value) != c.not
+}
+
+// ReadRules reads and parses an enrichment rules file, in the same format as storage-schemas.conf.
+// the rules are applied in the order of the file:
+//
+//	[name]
+//	org = 1
+//	conditions = host=~web-eu-.*;env!=dev
+//	rename = hostname:host,dc:datacenter
+//	lowercase = host
+//	set = region=eu;team=web
+func ReadRules(file string) ([]*Rule, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*Rule
+	names := make(map[string]struct{})
+	for _, sec := range sections {
+		name := strings.Trim(strings.SplitN(sec.String(), "\n", 2)[0], " []")
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("[%s]: defined more than once", name)
+		}
+		names[name] = struct{}{}
+		rule, err := parseRule(name, sec.ValueOf)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %s", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRule parses the settings of a rule, which are looked up with get. unset settings are ""
+func parseRule(name string, get func(string) string) (*Rule, error) {
+	rule := &Rule{
+		Name: name,
+	}
+	if s := strings.TrimSpace(get("org")); s != "" {
+		org, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org %q", s)
+		}
+		rule.Org = uint32(org)
+	}
+	if s := strings.TrimSpace(get("conditions")); s != "" {
+		for _, expr := range strings.Split(s, ";") {
+			c, err := parseCondition(strings.TrimSpace(expr))
+			if err != nil {
+				return nil, err
+			}
+			rule.Conditions = append(rule.Conditions, c)
+		}
+	}
+	if s := strings.TrimSpace(get("rename")); s != "" {
+		for _, pair := range strings.Split(s, ",") {
+			keys := strings.Split(strings.TrimSpace(pair), ":")
+			if len(keys) != 2 || !validKey(keys[0]) || !validKey(keys[1]) {
+				return nil, fmt.Errorf("invalid rename %q. must be old:new", pair)
+			}
+			rule.Rename = append(rule.Rename, [2]string{keys[0], keys[1]})
+		}
+	}
+	if s := strings.TrimSpace(get("lowercase")); s != "" {
+		for _, key := range strings.Split(s, ",") {
+			key = strings.TrimSpace(key)
+			if !validKey(key) {
+				return nil, fmt.Errorf("invalid lowercase key %q", key)
+			}
+			rule.Lowercase = append(rule.Lowercase, key)
+		}
+	}
+	if s := strings.TrimSpace(get("set")); s != "" {
+		for _, tag := range strings.Split(s, ";") {
+			rule.Set = append(rule.Set, strings.TrimSpace(tag))
+		}
+		if !schema.ValidateTags(rule.Set) {
+			return nil, fmt.Errorf("invalid set %q. must be key=value pairs, separated by ';'", s)
+		}
+		for _, tag := range rule.Set {
+			if strings.HasPrefix(tag, "name=") {
+				return nil, fmt.Errorf("can't set the name")
+			}
+		}
+	}
+	if len(rule.Rename) == 0 && len(rule.Lowercase) == 0 && len(rule.Set) == 0 {
+		return nil, fmt.Errorf("rule has no rename, lowercase or set")
+	}
+	return rule, nil
+}
+
+// validKey returns whether the key can be changed by a rule
+func validKey(key string) bool {
+	return key != "" && key != "name" && !strings.ContainsAny(key, ";!^=")
+}
+
+// apply changes the tags if the rule matches the series, and returns whether it did
+func (r *Rule) apply(orgId uint32, name string, t *tags) bool {
+	if r.Org != 0 && r.Org != orgId {
+		return false
+	}
+	for _, c := range r.Conditions {
+		value := name
+		if c.key != "name" {
+			value, _ = t.get(c.key)
+		}
+		if !c.matches(value) {
+			return false
+		}
+	}
+	var changed bool
+	for _, keys := range r.Rename {
+		if value, ok := t.get(keys[0]); ok {
+			t.del(keys[0])
+			t.set(keys[1], value)
+			changed = true
+		}
+	}
+	for _, key := range r.Lowercase {
+		if value, ok := t.get(key); ok && strings.ToLower(value) != value {
+			t.set(key, strings.ToLower(value))
+			changed = true
+		}
+	}
+	for _, tag := range r.Set {
+		kv := strings.SplitN(tag, "=", 2)
+		if value, ok := t.get(kv[0]); !ok || value != kv[1] {
+			t.set(kv[0], kv[1])
+			changed = true
+		}
+	}
+	return changed
+}
+
+// tags are the key=value tags of a series, while they are enriched
+type tags []string
+
+func (t tags) index(key string) int {
+	for i, tag := range t {
+		if len(tag) > len(key) && tag[len(key)] == '=' && strings.HasPrefix(tag, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t tags) get(key string) (string, bool) {
+	i := t.index(key)
+	if i < 0 {
+		return "", false
+	}
+	return t[i][len(key)+1:], true
+}
+
+func (t *tags) set(key, value string) {
+	if i := t.index(key); i >= 0 {
+		(*t)[i] = key + "=" + value
+		return
+	}
+	*t = append(*t, key+"="+value)
+}
+
+func (t *tags) del(key string) {
+	if i := t.index(key); i >= 0 {
+		*t = append((*t)[:i], (*t)[i+1:]...)
+	}
+}
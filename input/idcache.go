@@ -0,0 +1,80 @@
+package input
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/raintank/schema.v1"
+)
+
+// IDCache remembers the ids of the series that a plaintext input has seen, by the name they were sent with.
+// for a known name, the input can process a MetricPoint, instead of constructing a MetricData and generating its id.
+// once it holds size entries, it is reset. that's cheaper than tracking which entries were used least recently,
+// and the entries of active series are quickly added again.
+// concurrency-safe.
+type IDCache struct {
+	sync.RWMutex
+	ids  map[string]schema.MKey
+	size int
+
+	hit   *stats.Counter32
+	miss  *stats.Counter32
+	reset *stats.Counter32
+}
+
+// NewIDCache returns a cache for the given input, that holds up to size entries.
+// it returns nil if size is 0, which disables the cache. a nil cache never has any ids.
+func NewIDCache(input string, size int) *IDCache {
+	if size <= 0 {
+		return nil
+	}
+	return &IDCache{
+		ids:   make(map[string]schema.MKey),
+		size:  size,
+		hit:   stats.NewCounter32(fmt.Sprintf("input.%s.id_cache.hit", input)),
+		miss:  stats.NewCounter32(fmt.Sprintf("input.%s.id_cache.miss", input)),
+		reset: stats.NewCounter32(fmt.Sprintf("input.%s.id_cache.reset", input)),
+	}
+}
+
+// Get returns the id of the series sent with the given name, if known
+func (c *IDCache) Get(name string) (schema.MKey, bool) {
+	if c == nil {
+		return schema.MKey{}, false
+	}
+	c.RLock()
+	id, ok := c.ids[name]
+	c.RUnlock()
+	if ok {
+		c.hit.Inc()
+	} else {
+		c.miss.Inc()
+	}
+	return id, ok
+}
+
+// Add records the id of the series sent with the given name
+func (c *IDCache) Add(name string, id schema.MKey) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	if len(c.ids) >= c.size {
+		c.ids = make(map[string]schema.MKey)
+		c.reset.Inc()
+	}
+	c.ids[name] = id
+	c.Unlock()
+}
+
+// Del forgets the given name. inputs call it when the series is no longer in the index, e.g. because it was pruned,
+// so that its next point is processed as a MetricData, which adds it again.
+func (c *IDCache) Del(name string) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	delete(c.ids, name)
+	c.Unlock()
+}
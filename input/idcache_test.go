@@ -0,0 +1,47 @@
+package input
+
+import (
+	"testing"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestIDCache(t *testing.T) {
+	c := NewIDCache("TestIDCache", 2)
+	a := schema.MKey{Org: 1, Key: schema.Key{1}}
+	b := schema.MKey{Org: 1, Key: schema.Key{2}}
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("expected empty cache to not have a")
+	}
+	c.Add("a", a)
+	c.Add("b", b)
+	if id, ok := c.Get("a"); !ok || id != a {
+		t.Fatalf("expected id %s for a, got %s (ok %t)", a, id, ok)
+	}
+	c.Del("a")
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("expected a to be deleted")
+	}
+
+	// the cache is full once a is added again, so it's reset
+	c.Add("a", a)
+	c.Add("c", b)
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("expected b to be dropped when the full cache was reset")
+	}
+	if _, ok := c.Get("c"); !ok {
+		t.Fatalf("expected c to be added after the reset")
+	}
+}
+
+func TestIDCacheDisabled(t *testing.T) {
+	c := NewIDCache("TestIDCacheDisabled", 0)
+	if c != nil {
+		t.Fatalf("expected no cache for size 0")
+	}
+	c.Add("a", schema.MKey{Org: 1})
+	if _, ok := c.Get("a"); ok {
+		t.Fatalf("expected a disabled cache to never have ids")
+	}
+}
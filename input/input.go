@@ -9,14 +9,39 @@ import (
 	"gopkg.in/raintank/schema.v1/msg"
 
 	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/input/enrich"
+	"github.com/grafana/metrictank/input/quota"
+	"github.com/grafana/metrictank/input/validation"
+	"github.com/grafana/metrictank/logger"
 	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/wal"
 	"github.com/grafana/metrictank/stats"
-	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/grafana/metrictank/util"
 )
 
+var LogLevel util.LogLevel
+
 type Handler interface {
 	ProcessMetricData(md *schema.MetricData, partition int32)
-	ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32)
+	// ProcessMetricPoint returns whether the series of the point was known.
+	// unknown points are dropped, because we need their MetricData to add them to the index
+	ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool
+}
+
+// BatchHandler is a Handler that can also process many points at once, which saves the per point overhead
+type BatchHandler interface {
+	Handler
+	// ProcessMetricPoints processes points that all have the same format, like ProcessMetricPoint.
+	// the slice may be reused once it returns. it returns how many points were of unknown series, and dropped.
+	ProcessMetricPoints(points []schema.MetricPoint, format msg.Format, partition int32) int
+}
+
+// SyncHandler is a Handler that can make the points it processed durable, so that an input that can consume points again,
+// like kafka, can commit the offset up to which it consumed them without losing points on a crash
+type SyncHandler interface {
+	Handler
+	// Sync makes the points of the partition that were processed so far durable
+	Sync(partition int32)
 }
 
 // TODO: clever way to document all metrics for all different inputs
@@ -32,9 +57,16 @@ type DefaultHandler struct {
 
 	metrics     mdata.Metrics
 	metricIndex idx.MetricIndex
+	wal         *wal.WAL
+	quota       *quota.Quota
+	enricher    *enrich.Enricher
+	validator   *validation.Validator
 }
 
-func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input string) DefaultHandler {
+// NewDefaultHandler creates a DefaultHandler. points are recorded in the given write-ahead log and checked against
+// the given quota, series are checked by the given validator, and the tags of series are enriched by the given enricher,
+// all of which may be nil
+func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, w *wal.WAL, q *quota.Quota, e *enrich.Enricher, v *validation.Validator, input string) DefaultHandler {
 	return DefaultHandler{
 		receivedMD:   stats.NewCounter32(fmt.Sprintf("input.%s.metricdata.received", input)),
 		receivedMP:   stats.NewCounter32(fmt.Sprintf("input.%s.metricpoint.received", input)),
@@ -45,32 +77,75 @@ func NewDefaultHandler(metrics mdata.Metrics, metricIndex idx.MetricIndex, input
 
 		metrics:     metrics,
 		metricIndex: metricIndex,
+		wal:         w,
+		quota:       q,
+		enricher:    e,
+		validator:   v,
 	}
 }
 
-// ProcessMetricPoint updates the index if possible, and stores the data if we have an index entry
+// ProcessMetricPoint updates the index if possible, and stores the data if we have an index entry.
+// it returns whether we have one.
 // concurrency-safe.
-func (in DefaultHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) {
+func (in DefaultHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
 	if format == msg.FormatMetricPoint {
 		in.receivedMP.Inc()
 	} else {
 		in.receivedMPNO.Inc()
 	}
+	return in.processMetricPoint(&point, partition)
+}
+
+// ProcessMetricPoints processes the points like ProcessMetricPoint, and returns how many were unknown.
+// concurrency-safe.
+func (in DefaultHandler) ProcessMetricPoints(points []schema.MetricPoint, format msg.Format, partition int32) int {
+	if format == msg.FormatMetricPoint {
+		in.receivedMP.Add(len(points))
+	} else {
+		in.receivedMPNO.Add(len(points))
+	}
+	var unknown int
+	for i := range points {
+		if !in.processMetricPoint(&points[i], partition) {
+			unknown++
+		}
+	}
+	return unknown
+}
+
+// processMetricPoint is ProcessMetricPoint without counting the point as received
+func (in DefaultHandler) processMetricPoint(point *schema.MetricPoint, partition int32) bool {
 	if !point.Valid() {
 		in.invalidMP.Inc()
-		log.Debug("in: Invalid metric %v", point)
-		return
+		if LogLevel.Get() < 2 {
+			logger.Debug(logger.Fields{}.With("partition", partition), "in: Invalid metric %v", *point)
+		}
+		// the series is known, the point is just not valid
+		return true
 	}
+	if !in.quota.AllowPoint(point.MKey.Org) {
+		// the org exceeds its quota. we don't know whether the series is known, but it doesn't matter
+		return true
+	}
+	point.MKey = in.enricher.Key(in.validator.Key(point.MKey))
 
-	archive, _, ok := in.metricIndex.Update(point, partition)
+	archive, _, ok := in.metricIndex.Update(*point, partition)
 
 	if !ok {
 		in.unknownMP.Inc()
-		return
+		return false
 	}
 
-	m := in.metrics.GetOrCreate(point.MKey, archive.SchemaId, archive.AggId)
+	in.wal.Add(partition, point.MKey, point.Time, point.Value)
+	m := in.metrics.GetOrCreate(point.MKey, archive.SchemaId, archive.AggId, partition)
 	m.Add(point.Time, point.Value)
+	return true
+}
+
+// Sync syncs the points of the partition that were recorded in the write-ahead log to disk.
+// without a write-ahead log, the points only live in the chunks in memory, and there is nothing to sync.
+func (in DefaultHandler) Sync(partition int32) {
+	in.wal.SyncPartition(partition)
 }
 
 // ProcessMetricData assures the data is stored and the metadata is in the index
@@ -80,23 +155,38 @@ func (in DefaultHandler) ProcessMetricData(md *schema.MetricData, partition int3
 	err := md.Validate()
 	if err != nil {
 		in.invalidMD.Inc()
-		log.Debug("in: Invalid metric %v: %s", md, err)
+		if LogLevel.Get() < 2 {
+			logger.Debug(logger.Fields{}.With("partition", partition), "in: Invalid metric %v: %s", md, err)
+		}
 		return
 	}
 	if md.Time == 0 {
 		in.invalidMD.Inc()
-		log.Warn("in: invalid metric. metric.Time is 0. %s", md.Id)
+		logger.Warn(logger.Fields{}.With("partition", partition), "in: invalid metric. metric.Time is 0. %s", md.Id)
 		return
 	}
 
+	if !in.validator.Validate(md) {
+		return
+	}
+	in.enricher.Enrich(md)
+
 	mkey, err := schema.MKeyFromString(md.Id)
 	if err != nil {
-		log.Error(3, "in: Invalid metric %v: could not parse ID: %s", md, err)
+		logger.Error(logger.Fields{}.With("partition", partition), 3, "in: Invalid metric %v: could not parse ID: %s", md, err)
+		return
+	}
+
+	if !in.quota.AllowPoint(mkey.Org) || !in.quota.AllowSeries(mkey) {
 		return
 	}
 
-	archive, _, _ := in.metricIndex.AddOrUpdate(mkey, md, partition)
+	archive, _, inIndex := in.metricIndex.AddOrUpdate(mkey, md, partition)
+	if !inIndex {
+		in.quota.SeriesAdded(mkey.Org)
+	}
 
-	m := in.metrics.GetOrCreate(mkey, archive.SchemaId, archive.AggId)
+	in.wal.Add(partition, mkey, uint32(md.Time), md.Value)
+	m := in.metrics.GetOrCreate(mkey, archive.SchemaId, archive.AggId, partition)
 	m.Add(uint32(md.Time), md.Value)
 }
@@ -22,10 +22,10 @@ func BenchmarkProcessMetricDataUniqueMetrics(b *testing.B) {
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, true))
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 
-	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0)
+	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0, nil)
 	metricIndex := memory.New()
 	metricIndex.Init()
-	in := NewDefaultHandler(aggmetrics, metricIndex, "BenchmarkProcess")
+	in := NewDefaultHandler(aggmetrics, metricIndex, nil, nil, nil, nil, "BenchmarkProcess")
 
 	// timestamps start at 10 and go up from there. (we can't use 0, see AggMetric.Add())
 	datas := make([]*schema.MetricData, b.N)
@@ -59,10 +59,10 @@ func BenchmarkProcessMetricDataSameMetric(b *testing.B) {
 	mdata.SetSingleSchema(conf.NewRetentionMT(10, 10000, 600, 10, true))
 	mdata.SetSingleAgg(conf.Avg, conf.Min, conf.Max)
 
-	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0)
+	aggmetrics := mdata.NewAggMetrics(store, &cache.MockCache{}, false, 800, 8000, 0, nil)
 	metricIndex := memory.New()
 	metricIndex.Init()
-	in := NewDefaultHandler(aggmetrics, metricIndex, "BenchmarkProcess")
+	in := NewDefaultHandler(aggmetrics, metricIndex, nil, nil, nil, nil, "BenchmarkProcess")
 
 	// timestamps start at 10 and go up from there. (we can't use 0, see AggMetric.Add())
 	datas := make([]*schema.MetricData, b.N)
@@ -0,0 +1,59 @@
+package kafkamdm
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/logger"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+// pointBatch holds the points of consecutive MetricPoint messages of the same format
+type pointBatch struct {
+	points []schema.MetricPoint
+	format msg.Format
+	offset int64 // of the last message added
+}
+
+func newPointBatch() *pointBatch {
+	return &pointBatch{
+		points: make([]schema.MetricPoint, 0, maxPointBatch),
+	}
+}
+
+// add decodes the message into the batch, if it's a MetricPoint message of the same format as the ones in the batch.
+// it returns whether the message was consumed, which it also is when it fails to decode.
+func (b *pointBatch) add(m *sarama.ConsumerMessage) bool {
+	format, ok := msg.IsPointMsg(m.Value)
+	if !ok || (len(b.points) > 0 && format != b.format) {
+		return false
+	}
+	if LogLevel.Get() < 2 {
+		log.Debug("kafka-mdm received message: Topic %s, Partition: %d, Offset: %d, Key: %x", m.Topic, m.Partition, m.Offset, m.Key)
+	}
+	b.format = format
+	b.offset = m.Offset
+	b.points = b.points[:len(b.points)+1]
+	if err := decodePoint(m.Value, format, uint32(orgId), &b.points[len(b.points)-1]); err != nil {
+		b.points = b.points[:len(b.points)-1]
+		metricsDecodeErr.Inc()
+		logger.Error(logger.Fields{}.With("partition", m.Partition).With("offset", m.Offset), 3, "kafka-mdm decode error, skipping message. %s", err)
+	}
+	return true
+}
+
+func (b *pointBatch) reset() {
+	b.points = b.points[:0]
+}
+
+// decodePoint decodes the MetricPoint message of the given format straight into point, without intermediate copies.
+// messages without an org get the default org.
+func decodePoint(data []byte, format msg.Format, defaultOrg uint32, point *schema.MetricPoint) error {
+	if format == msg.FormatMetricPointWithoutOrg {
+		_, err := point.UnmarshalWithoutOrg(data[1:])
+		point.MKey.Org = defaultOrg
+		return err
+	}
+	_, err := point.Unmarshal(data[1:])
+	return err
+}
@@ -3,9 +3,11 @@ package kafkamdm
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	schema "gopkg.in/raintank/schema.v1"
@@ -16,9 +18,15 @@ import (
 	"github.com/rakyll/globalconf"
 
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/health"
 	"github.com/grafana/metrictank/input"
 	"github.com/grafana/metrictank/kafka"
+	"github.com/grafana/metrictank/logger"
+	"github.com/grafana/metrictank/mdata/wal"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
 )
 
 // metric input.kafka-mdm.metrics_per_message is how many metrics per message were seen.
@@ -27,24 +35,44 @@ var metricsPerMessage = stats.NewMeter32("input.kafka-mdm.metrics_per_message",
 // metric input.kafka-mdm.metrics_decode_err is a count of times an input message failed to parse
 var metricsDecodeErr = stats.NewCounterRate32("input.kafka-mdm.metrics_decode_err")
 
+// metric input.kafka-mdm.points_per_batch is how many MetricPoint messages were handed off to the index and tank at once
+var pointsPerBatch = stats.NewMeter32("input.kafka-mdm.points_per_batch", false)
+
+// metric input.kafka-mdm.offset_commit_sync is how long it takes to sync the points of a partition to the write-ahead log before saving its offset
+var offsetCommitSyncDuration = stats.NewLatencyHistogram15s32("input.kafka-mdm.offset_commit_sync")
+
+// maxPointBatch is the max number of MetricPoint messages that are decoded and handed off at once.
+// batches are only as large as the number of messages that are available without waiting.
+const maxPointBatch = 256
+
 type KafkaMdm struct {
 	input.Handler
-	consumer   sarama.Consumer
-	client     sarama.Client
-	lagMonitor *LagMonitor
-	wg         sync.WaitGroup
+	// set if the Handler can process batches of points
+	batchHandler input.BatchHandler
+	// set if the Handler can make the points it processed durable, see offset-commit-sync
+	syncHandler input.SyncHandler
+	consumer    sarama.Consumer
+	client      sarama.Client
+	lagMonitor  *LagMonitor
+	wg          sync.WaitGroup
 
 	// signal to PartitionConsumers to shutdown
 	stopConsuming chan struct{}
 	// signal to caller that it should shutdown
 	fatal chan struct{}
+
+	// 1 while consumption is paused, see SetPaused
+	paused int32
+
+	// one for every topic and partition we consume, see Progress
+	replays []*replay
 }
 
 func (k *KafkaMdm) Name() string {
 	return "kafka-mdm"
 }
 
-var LogLevel int
+var LogLevel util.LogLevel
 var Enabled bool
 var orgId uint
 var brokerStr string
@@ -62,9 +90,13 @@ var consumerFetchDefault int
 var consumerMaxWaitTime time.Duration
 var consumerMaxProcessingTime time.Duration
 var netMaxOpenRequests int
+var saslEnabled bool
+var saslUsername string
+var saslPassword string
 var offsetMgr *kafka.OffsetMgr
 var offsetDuration time.Duration
 var offsetCommitInterval time.Duration
+var offsetCommitSync bool
 var partitionOffset map[int32]*stats.Gauge64
 var partitionLogSize map[int32]*stats.Gauge64
 var partitionLag map[int32]*stats.Gauge64
@@ -78,6 +110,7 @@ func ConfigSetup() {
 	inKafkaMdm.StringVar(&offsetStr, "offset", "last", "Set the offset to start consuming from. Can be one of newest, oldest,last or a time duration")
 	inKafkaMdm.StringVar(&partitionStr, "partitions", "*", "kafka partitions to consume. use '*' or a comma separated list of id's")
 	inKafkaMdm.DurationVar(&offsetCommitInterval, "offset-commit-interval", time.Second*5, "Interval at which offsets should be saved.")
+	inKafkaMdm.BoolVar(&offsetCommitSync, "offset-commit-sync", false, "sync the points consumed from a partition to the write-ahead log before saving its offset, so that a crash can't lose points that are neither in the log nor consumed again when resuming from the last offset. only has an effect with the wal enabled")
 	inKafkaMdm.StringVar(&DataDir, "data-dir", "", "Directory to store partition offsets index")
 	inKafkaMdm.IntVar(&channelBufferSize, "channel-buffer-size", 1000, "The number of metrics to buffer in internal and external channels")
 	inKafkaMdm.IntVar(&consumerFetchMin, "consumer-fetch-min", 1, "The minimum number of message bytes to fetch in a request")
@@ -85,9 +118,54 @@ func ConfigSetup() {
 	inKafkaMdm.DurationVar(&consumerMaxWaitTime, "consumer-max-wait-time", time.Second, "The maximum amount of time the broker will wait for Consumer.Fetch.Min bytes to become available before it returns fewer than that anyway")
 	inKafkaMdm.DurationVar(&consumerMaxProcessingTime, "consumer-max-processing-time", time.Second, "The maximum amount of time the consumer expects a message takes to process")
 	inKafkaMdm.IntVar(&netMaxOpenRequests, "net-max-open-requests", 100, "How many outstanding requests a connection is allowed to have before sending on it blocks")
+	inKafkaMdm.BoolVar(&saslEnabled, "sasl-enabled", false, "use SASL/PLAIN authentication with the brokers")
+	inKafkaMdm.StringVar(&saslUsername, "sasl-username", "", "username for SASL authentication. may be an env:, file: or vault: reference, see the secrets section")
+	inKafkaMdm.StringVar(&saslPassword, "sasl-password", "", "password for SASL authentication. may be an env:, file: or vault: reference, see the secrets section")
 	globalconf.Register("kafka-mdm-in", inKafkaMdm)
 }
 
+// ConfigValidate checks the settings without connecting to kafka, for the validate-config mode.
+// maxChunkSpan is the largest chunkspan of all schemas: when consuming from the newest offset, or from a duration
+// shorter than it, restarted nodes can't rebuild the chunks they were working on.
+func ConfigValidate(maxChunkSpan uint32) []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if offsetCommitInterval == 0 {
+		findings = append(findings, conf.NewError("kafka-mdm-in.offset-commit-interval", "must be greater then 0"))
+	}
+	if consumerMaxWaitTime == 0 {
+		findings = append(findings, conf.NewError("kafka-mdm-in.consumer-max-wait-time", "must be greater then 0"))
+	}
+	if consumerMaxProcessingTime == 0 {
+		findings = append(findings, conf.NewError("kafka-mdm-in.consumer-max-processing-time", "must be greater then 0"))
+	}
+	if partitionStr != "*" {
+		for _, part := range strings.Split(partitionStr, ",") {
+			if _, err := strconv.ParseInt(strings.TrimSpace(part), 10, 32); err != nil {
+				findings = append(findings, conf.NewError("kafka-mdm-in.partitions", "could not parse partition %q. partitions must be '*' or a comma separated list of id's", part))
+			}
+		}
+	}
+	if offsetCommitSync && !wal.Enabled {
+		findings = append(findings, conf.NewWarning("kafka-mdm-in.offset-commit-sync", "has no effect without the wal. offsets are saved once the points were added to the chunks in memory"))
+	}
+	switch offsetStr {
+	case "last", "oldest":
+	case "newest":
+		findings = append(findings, conf.NewWarning("kafka-mdm-in.offset", "when consuming from the newest offset, restarted nodes lose the data of the chunks they were working on. consider drop-first-chunk"))
+	default:
+		d, err := time.ParseDuration(offsetStr)
+		if err != nil {
+			findings = append(findings, conf.NewError("kafka-mdm-in.offset", "invalid offset format. %s", err))
+		} else if d < time.Duration(maxChunkSpan)*time.Second {
+			findings = append(findings, conf.NewWarning("kafka-mdm-in.offset", "offset %s is shorter than the largest chunkspan of %ds. restarted nodes can't rebuild the chunks they were working on, and the topic retention must be at least as long as the offset", d, maxChunkSpan))
+		}
+	}
+	return findings
+}
+
 func ConfigProcess(instance string) {
 	if !Enabled {
 		return
@@ -131,6 +209,12 @@ func ConfigProcess(instance string) {
 	config.Consumer.MaxProcessingTime = consumerMaxProcessingTime
 	config.Net.MaxOpenRequests = netMaxOpenRequests
 	config.Version = sarama.V0_10_0_0
+	if saslEnabled {
+		err = kafka.SetSASL(config, saslUsername, saslPassword)
+		if err != nil {
+			log.Fatal(4, "kafka-mdm: %s", err)
+		}
+	}
 	err = config.Validate()
 	if err != nil {
 		log.Fatal(2, "kafka-mdm invalid config: %s", err)
@@ -202,6 +286,8 @@ func New() *KafkaMdm {
 
 func (k *KafkaMdm) Start(handler input.Handler, fatal chan struct{}) error {
 	k.Handler = handler
+	k.batchHandler, _ = handler.(input.BatchHandler)
+	k.syncHandler, _ = handler.(input.SyncHandler)
 	k.fatal = fatal
 	var err error
 	for _, topic := range topics {
@@ -225,8 +311,10 @@ func (k *KafkaMdm) Start(handler input.Handler, fatal chan struct{}) error {
 					log.Warn("kafka-mdm failed to get offset %s: %s -> will use oldest instead", offsetDuration, err)
 				}
 			}
+			r := newReplay(topic, partition)
+			k.replays = append(k.replays, r)
 			k.wg.Add(1)
-			go k.consumePartition(topic, partition, offset)
+			go k.consumePartition(topic, partition, offset, r)
 		}
 	}
 	return nil
@@ -268,7 +356,7 @@ func (k *KafkaMdm) tryGetOffset(topic string, partition int32, offset int64, att
 }
 
 // this will continually consume from the topic until k.stopConsuming is triggered.
-func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset int64) {
+func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset int64, replay *replay) {
 	defer k.wg.Done()
 
 	partitionOffsetMetric := partitionOffset[partition]
@@ -296,6 +384,7 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 	partitionOffsetMetric.Set(int(currentOffset))
 	partitionLogSizeMetric.Set(int(newest))
 	partitionLagMetric.Set(int(newest - currentOffset))
+	replay.init(currentOffset, newest, time.Now())
 
 	log.Info("kafka-mdm: consuming from %s:%d from offset %d", topic, partition, currentOffset)
 	pc, err := k.consumer.ConsumePartition(topic, partition, currentOffset)
@@ -306,27 +395,42 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 	}
 	messages := pc.Messages()
 	ticker := time.NewTicker(offsetCommitInterval)
+	// if handling a message panics, we skip it. the replay tells which one it was
+	crashState := func() interface{} {
+		return replay.status(time.Now())
+	}
+	// MetricPoint messages are decoded straight into this batch, which is reused for every batch
+	var batch *pointBatch
+	if k.batchHandler != nil {
+		batch = newPointBatch()
+	}
 	for {
+		in := messages
+		if atomic.LoadInt32(&k.paused) == 1 {
+			in = nil
+		}
 		select {
-		case msg, ok := <-messages:
+		case msg, ok := <-in:
 			// https://github.com/Shopify/sarama/wiki/Frequently-Asked-Questions#why-am-i-getting-a-nil-message-from-the-sarama-consumer
 			if !ok {
 				log.Error(3, "kafka-mdm: kafka consumer for %s:%d has shutdown. stop consuming", topic, partition)
-				if err := offsetMgr.Commit(topic, partition, currentOffset); err != nil {
-					log.Error(3, "kafka-mdm failed to commit offset for %s:%d, %s", topic, partition, err)
-				}
+				k.commitOffset(topic, partition, currentOffset)
 				close(k.fatal)
 				return
 			}
-			if LogLevel < 2 {
+			if batch != nil && batch.add(msg) {
+				currentOffset = k.handleBatch(batch, messages, partition, crashState)
+				replay.consumed(currentOffset)
+				continue
+			}
+			if LogLevel.Get() < 2 {
 				log.Debug("kafka-mdm received message: Topic %s, Partition: %d, Offset: %d, Key: %x", msg.Topic, msg.Partition, msg.Offset, msg.Key)
 			}
-			k.handleMsg(msg.Value, partition)
+			k.handleMsg(msg.Value, partition, msg.Offset, crashState)
 			currentOffset = msg.Offset
+			replay.consumed(msg.Offset)
 		case ts := <-ticker.C:
-			if err := offsetMgr.Commit(topic, partition, currentOffset); err != nil {
-				log.Error(3, "kafka-mdm failed to commit offset for %s:%d, %s", topic, partition, err)
-			}
+			k.commitOffset(topic, partition, currentOffset)
 			k.lagMonitor.StoreOffset(partition, currentOffset, ts)
 			newest, err := k.tryGetOffset(topic, partition, sarama.OffsetNewest, 1, 0)
 			if err != nil {
@@ -343,39 +447,117 @@ func (k *KafkaMdm) consumePartition(topic string, partition int32, currentOffset
 			}
 		case <-k.stopConsuming:
 			pc.Close()
-			if err := offsetMgr.Commit(topic, partition, currentOffset); err != nil {
-				log.Error(3, "kafka-mdm failed to commit offset for %s:%d, %s", topic, partition, err)
-			}
+			k.commitOffset(topic, partition, currentOffset)
 			log.Info("kafka-mdm consumer for %s:%d ended.", topic, partition)
 			return
 		}
 	}
 }
 
-func (k *KafkaMdm) handleMsg(data []byte, partition int32) {
+// commitOffset saves the offset of the last message of the partition that was handled.
+// messages are handled synchronously, so their points were added to the chunks in memory already.
+// with offset-commit-sync, they are also synced to the write-ahead log first.
+func (k *KafkaMdm) commitOffset(topic string, partition int32, offset int64) {
+	if offsetCommitSync && k.syncHandler != nil {
+		pre := time.Now()
+		k.syncHandler.Sync(partition)
+		offsetCommitSyncDuration.Value(time.Since(pre))
+	}
+	if err := offsetMgr.Commit(topic, partition, offset); err != nil {
+		log.Error(3, "kafka-mdm failed to commit offset for %s:%d, %s", topic, partition, err)
+	}
+}
+
+func (k *KafkaMdm) handleMsg(data []byte, partition int32, offset int64, crashState crash.State) {
+	defer crash.Recover("input.kafka-mdm", crashState)
 	format, isPointMsg := msg.IsPointMsg(data)
 	if isPointMsg {
 		_, point, err := msg.ReadPointMsg(data, uint32(orgId))
 		if err != nil {
 			metricsDecodeErr.Inc()
-			log.Error(3, "kafka-mdm decode error, skipping message. %s", err)
+			logger.Error(logger.Fields{}.With("partition", partition).With("offset", offset), 3, "kafka-mdm decode error, skipping message. %s", err)
 			return
 		}
 		k.Handler.ProcessMetricPoint(point, format, partition)
 		return
 	}
 
+	if IsProtobufBatchMsg(data) {
+		mds, err := ReadProtobufBatchMsg(data, nil)
+		if err != nil {
+			metricsDecodeErr.Inc()
+			logger.Error(logger.Fields{}.With("partition", partition).With("offset", offset), 3, "kafka-mdm decode error, skipping message. %s", err)
+			return
+		}
+		metricsPerMessage.ValueUint32(uint32(len(mds)))
+		for i := range mds {
+			k.Handler.ProcessMetricData(&mds[i], partition)
+		}
+		return
+	}
+
 	md := schema.MetricData{}
 	_, err := md.UnmarshalMsg(data)
 	if err != nil {
 		metricsDecodeErr.Inc()
-		log.Error(3, "kafka-mdm decode error, skipping message. %s", err)
+		logger.Error(logger.Fields{}.With("partition", partition).With("offset", offset), 3, "kafka-mdm decode error, skipping message. %s", err)
 		return
 	}
 	metricsPerMessage.ValueUint32(1)
 	k.Handler.ProcessMetricData(&md, partition)
 }
 
+// handleBatch adds the messages that are available without waiting to the batch, as long as they are MetricPoint messages
+// of the same format, and hands the batch off to the handler. a message that can't be added is handled on its own.
+// it returns the offset of the last handled message.
+func (k *KafkaMdm) handleBatch(batch *pointBatch, messages <-chan *sarama.ConsumerMessage, partition int32, crashState crash.State) int64 {
+	var next *sarama.ConsumerMessage
+fill:
+	for len(batch.points) < maxPointBatch {
+		select {
+		case m, ok := <-messages:
+			// a closed channel is noticed by the caller
+			if !ok {
+				break fill
+			}
+			if !batch.add(m) {
+				next = m
+				break fill
+			}
+		default:
+			break fill
+		}
+	}
+	if len(batch.points) > 0 {
+		k.processBatch(batch, partition, crashState)
+	}
+	offset := batch.offset
+	batch.reset()
+	if next != nil {
+		k.handleMsg(next.Value, partition, next.Offset, crashState)
+		offset = next.Offset
+	}
+	return offset
+}
+
+func (k *KafkaMdm) processBatch(batch *pointBatch, partition int32, crashState crash.State) {
+	// if a point panics, the rest of the batch is skipped
+	defer crash.Recover("input.kafka-mdm", crashState)
+	pointsPerBatch.ValueUint32(uint32(len(batch.points)))
+	k.batchHandler.ProcessMetricPoints(batch.points, batch.format, partition)
+}
+
+// SetPaused pauses or resumes consuming, e.g. to shed load under memory pressure.
+// while paused, offsets are still committed and lag is still tracked. consumers notice a resume
+// the next time they commit their offset, so within offset-commit-interval.
+func (k *KafkaMdm) SetPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&k.paused, 1)
+	} else {
+		atomic.StoreInt32(&k.paused, 0)
+	}
+}
+
 // Stop will initiate a graceful stop of the Consumer (permanent)
 // and block until it stopped.
 func (k *KafkaMdm) Stop() {
@@ -394,7 +576,9 @@ func (k *KafkaMdm) MaintainPriority() {
 			case <-k.stopConsuming:
 				return
 			case <-ticker.C:
-				cluster.Manager.SetPriority(k.lagMonitor.Metric())
+				prio := k.lagMonitor.Metric()
+				cluster.Manager.SetPartitionPriority(k.lagMonitor.PartitionPriority())
+				cluster.Manager.SetPriority(prio)
 			}
 		}
 	}()
@@ -409,3 +593,46 @@ func (k *KafkaMdm) ExplainPriority() interface{} {
 		k.lagMonitor.Explain(),
 	}
 }
+
+// Health reports the consumer lag per partition, as last computed for the priority.
+// it is degraded while we have no lag measurements, or when we're too far behind to be considered ready.
+func (k *KafkaMdm) Health() health.Status {
+	exp := k.lagMonitor.Latest()
+	status := health.Status{State: health.OK, Detail: exp}
+	if exp.Updated.IsZero() {
+		status.Worsen(health.Degraded, "no lag measurements yet")
+		return status
+	}
+	var unknown []int
+	for p, s := range exp.Status {
+		if s.Lag == -1 {
+			unknown = append(unknown, int(p))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Ints(unknown)
+		status.Worsen(health.Degraded, "lag of partitions %v unknown", unknown)
+	}
+	if exp.Priority > cluster.MaxPriority() {
+		status.Worsen(health.Degraded, "%ds behind kafka, more than max-priority %d", exp.Priority, cluster.MaxPriority())
+	}
+	return status
+}
+
+// Lag reports the consumer lag per partition, as last computed for the priority, ordered by partition.
+// the lag of partitions that is unknown is -1.
+func (k *KafkaMdm) Lag() []health.Lag {
+	exp := k.lagMonitor.Latest()
+	lags := make([]health.Lag, 0, len(exp.Status))
+	for p, s := range exp.Status {
+		lags = append(lags, health.Lag{Partition: p, Messages: s.Lag, Seconds: s.Priority})
+	}
+	sort.Sort(byPartition(lags))
+	return lags
+}
+
+type byPartition []health.Lag
+
+func (l byPartition) Len() int           { return len(l) }
+func (l byPartition) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l byPartition) Less(i, j int) bool { return l[i].Partition < l[j].Partition }
@@ -0,0 +1,251 @@
+package kafkamdm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/kafka"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+func TestConfigValidate(t *testing.T) {
+	Enabled = true
+	offsetCommitInterval = time.Second * 5
+	consumerMaxWaitTime = time.Second
+	consumerMaxProcessingTime = time.Second
+	partitionStr = "*"
+	defer func() { Enabled = false }()
+
+	cases := []struct {
+		offset   string
+		parts    string
+		errors   int
+		warnings int
+	}{
+		{"last", "*", 0, 0},
+		{"oldest", "0,1, 2", 0, 0},
+		{"newest", "*", 0, 1},
+		{"2h", "*", 0, 0},
+		{"30m", "*", 0, 1},
+		{"yesterday", "1,a", 2, 0},
+	}
+	for _, c := range cases {
+		offsetStr = c.offset
+		partitionStr = c.parts
+		var errors, warnings int
+		for _, f := range ConfigValidate(3600) {
+			if f.Error {
+				errors++
+			} else {
+				warnings++
+			}
+		}
+		if errors != c.errors || warnings != c.warnings {
+			t.Errorf("offset %q partitions %q: expected %d errors and %d warnings, got %d and %d", c.offset, c.parts, c.errors, c.warnings, errors, warnings)
+		}
+	}
+}
+
+type fakeHandler struct {
+	points  []schema.MetricPoint
+	formats []msg.Format
+	batches int
+	md      int
+}
+
+func (h *fakeHandler) ProcessMetricData(md *schema.MetricData, partition int32) {
+	h.md++
+}
+
+func (h *fakeHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	h.points = append(h.points, point)
+	h.formats = append(h.formats, format)
+	return true
+}
+
+func (h *fakeHandler) ProcessMetricPoints(points []schema.MetricPoint, format msg.Format, partition int32) int {
+	h.batches++
+	for _, point := range points {
+		h.ProcessMetricPoint(point, format, partition)
+	}
+	return 0
+}
+
+// noopHandler only counts, so the benchmarks measure the decoding and handoff
+type noopHandler struct {
+	points int
+}
+
+func (h *noopHandler) ProcessMetricData(md *schema.MetricData, partition int32) {}
+
+func (h *noopHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	h.points++
+	return true
+}
+
+func (h *noopHandler) ProcessMetricPoints(points []schema.MetricPoint, format msg.Format, partition int32) int {
+	h.points += len(points)
+	return 0
+}
+
+func pointMsg(t testing.TB, point schema.MetricPoint, format msg.Format, offset int64) *sarama.ConsumerMessage {
+	data, err := msg.WritePointMsg(point, make([]byte, 0, 33), format)
+	if err != nil {
+		t.Fatalf("failed to encode point: %s", err)
+	}
+	return &sarama.ConsumerMessage{Value: data, Offset: offset}
+}
+
+func testPoint(i int) schema.MetricPoint {
+	var key schema.MKey
+	key.Org = 1
+	key.Key[0] = byte(i)
+	return schema.MetricPoint{MKey: key, Time: uint32(10 * (i + 1)), Value: float64(i)}
+}
+
+func TestHandleBatch(t *testing.T) {
+	orgId = 5
+	defer func() { orgId = 0 }()
+	handler := &fakeHandler{}
+	k := &KafkaMdm{Handler: handler, batchHandler: handler}
+	state := func() interface{} { return nil }
+
+	md := schema.MetricData{OrgId: 1, Name: "a", Interval: 10, Value: 1, Time: 10, Mtype: "gauge"}
+	md.SetId()
+	mdData, err := md.MarshalMsg(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan *sarama.ConsumerMessage, 10)
+	messages <- pointMsg(t, testPoint(1), msg.FormatMetricPoint, 1)
+	messages <- pointMsg(t, testPoint(2), msg.FormatMetricPointWithoutOrg, 2)
+	messages <- pointMsg(t, testPoint(3), msg.FormatMetricPointWithoutOrg, 3)
+	messages <- &sarama.ConsumerMessage{Value: mdData, Offset: 4}
+
+	batch := newPointBatch()
+	if !batch.add(pointMsg(t, testPoint(0), msg.FormatMetricPoint, 0)) {
+		t.Fatal("expected MetricPoint message to be added to the batch")
+	}
+	// the message of the other format ends the batch and is handled on its own
+	if offset := k.handleBatch(batch, messages, 0, state); offset != 2 {
+		t.Fatalf("expected offset 2, got %d", offset)
+	}
+	if handler.batches != 1 || len(handler.points) != 3 {
+		t.Fatalf("expected 1 batch and 3 points, got %d batches and %d points", handler.batches, len(handler.points))
+	}
+	if handler.points[1] != testPoint(1) || handler.formats[1] != msg.FormatMetricPoint {
+		t.Fatalf("unexpected point %v with format %s", handler.points[1], handler.formats[1])
+	}
+	expected := testPoint(2)
+	expected.MKey.Org = 5
+	if handler.points[2] != expected || handler.formats[2] != msg.FormatMetricPointWithoutOrg {
+		t.Fatalf("expected point without org to get the default org, got %v with format %s", handler.points[2], handler.formats[2])
+	}
+
+	// the MetricData message ends the batch
+	m := <-messages
+	if !batch.add(m) {
+		t.Fatal("expected MetricPoint message to be added to the batch")
+	}
+	if offset := k.handleBatch(batch, messages, 0, state); offset != 4 {
+		t.Fatalf("expected offset 4, got %d", offset)
+	}
+	if handler.batches != 2 || len(handler.points) != 4 || handler.md != 1 {
+		t.Fatalf("expected 2 batches, 4 points and 1 MetricData, got %d, %d and %d", handler.batches, len(handler.points), handler.md)
+	}
+	if batch.add(&sarama.ConsumerMessage{Value: mdData}) {
+		t.Fatal("expected MetricData message not to be added to the batch")
+	}
+}
+
+// syncHandler records the offset that was saved when it was asked to sync
+type syncHandler struct {
+	fakeHandler
+	synced []int64
+}
+
+func (h *syncHandler) Sync(partition int32) {
+	offset, _ := offsetMgr.Last("mdm", partition)
+	h.synced = append(h.synced, offset)
+}
+
+func TestCommitOffsetSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	offsetMgr, err = kafka.NewOffsetMgr(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetMgr.Close()
+	defer func() { offsetCommitSync = false }()
+
+	handler := &syncHandler{}
+	k := &KafkaMdm{Handler: handler, syncHandler: handler}
+	k.commitOffset("mdm", 3, 10)
+	if len(handler.synced) != 0 {
+		t.Fatalf("expected no sync without offset-commit-sync, got %v", handler.synced)
+	}
+	offsetCommitSync = true
+	k.commitOffset("mdm", 3, 20)
+	if offset, _ := offsetMgr.Last("mdm", 3); offset != 20 {
+		t.Fatalf("expected offset 20 to be saved, got %d", offset)
+	}
+	// the points up to offset 20 are synced while offset 10 is still the saved one
+	if len(handler.synced) != 1 || handler.synced[0] != 10 {
+		t.Fatalf("expected a sync before offset 20 was saved, got %v", handler.synced)
+	}
+}
+
+func benchmarkMessages(b *testing.B) []*sarama.ConsumerMessage {
+	messages := make([]*sarama.ConsumerMessage, maxPointBatch)
+	for i := range messages {
+		messages[i] = pointMsg(b, testPoint(i), msg.FormatMetricPoint, int64(i))
+	}
+	return messages
+}
+
+// both benchmarks receive the messages from a channel, like the partition consumers do. ns/op and allocs/op are per point
+
+func BenchmarkHandleMsgMetricPoint(b *testing.B) {
+	handler := &noopHandler{}
+	k := &KafkaMdm{Handler: handler}
+	state := func() interface{} { return nil }
+	messages := benchmarkMessages(b)
+	in := make(chan *sarama.ConsumerMessage, len(messages))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(messages) {
+		for _, m := range messages {
+			in <- m
+		}
+		for range messages {
+			m := <-in
+			k.handleMsg(m.Value, 0, m.Offset, state)
+		}
+	}
+}
+
+func BenchmarkHandleBatchMetricPoint(b *testing.B) {
+	handler := &noopHandler{}
+	k := &KafkaMdm{Handler: handler, batchHandler: handler}
+	state := func() interface{} { return nil }
+	messages := benchmarkMessages(b)
+	in := make(chan *sarama.ConsumerMessage, len(messages))
+	batch := newPointBatch()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(messages) {
+		for _, m := range messages {
+			in <- m
+		}
+		batch.add(<-in)
+		k.handleBatch(batch, in, 0, state)
+	}
+}
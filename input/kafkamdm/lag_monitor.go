@@ -218,6 +218,24 @@ func (l *LagMonitor) Explain() interface{} {
 	}
 }
 
+// Latest returns the explanation of the last computed score
+func (l *LagMonitor) Latest() Explanation {
+	l.Lock()
+	defer l.Unlock()
+	return l.explanation
+}
+
+// PartitionPriority returns the score of each partition, as last computed by Metric
+func (l *LagMonitor) PartitionPriority() map[int32]int {
+	l.Lock()
+	defer l.Unlock()
+	prios := make(map[int32]int, len(l.explanation.Status))
+	for p, status := range l.explanation.Status {
+		prios[p] = status.Priority
+	}
+	return prios
+}
+
 func (l *LagMonitor) StoreLag(partition int32, val int) {
 	l.Lock()
 	l.lag[partition].Store(val)
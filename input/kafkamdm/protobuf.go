@@ -0,0 +1,233 @@
+package kafkamdm
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+// FormatMetricDataBatchProtobuf is the format byte of messages that hold a batch of MetricData, encoded with protobuf
+// as the MetricDataBatch of metricdata.proto. MessagePack encoded MetricData messages start with a map header,
+// and MetricPoint messages with their own format byte, so the first byte tells the formats apart.
+const FormatMetricDataBatchProtobuf msg.Format = 4
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("protobuf message is truncated")
+
+// IsProtobufBatchMsg returns whether the message holds a protobuf encoded batch of MetricData
+func IsProtobufBatchMsg(data []byte) bool {
+	return len(data) > 0 && msg.Format(data[0]) == FormatMetricDataBatchProtobuf
+}
+
+// WriteProtobufBatchMsg appends the message of the format byte and the protobuf encoded batch of MetricData to b.
+// It's the counterpart of ReadProtobufBatchMsg, for producers written in Go.
+func WriteProtobufBatchMsg(b []byte, mds []*schema.MetricData) []byte {
+	b = append(b, byte(FormatMetricDataBatchProtobuf))
+	var md []byte
+	for _, m := range mds {
+		md = appendMetricData(md[:0], m)
+		b = appendTag(b, 1, wireBytes)
+		b = appendVarint(b, uint64(len(md)))
+		b = append(b, md...)
+	}
+	return b
+}
+
+func appendMetricData(b []byte, md *schema.MetricData) []byte {
+	b = appendString(b, 1, md.Id)
+	b = appendVarintField(b, 2, uint64(int64(md.OrgId)))
+	b = appendString(b, 3, md.Name)
+	b = appendVarintField(b, 4, uint64(int64(md.Interval)))
+	if md.Value != 0 {
+		b = appendTag(b, 5, wireFixed64)
+		var buf [8]byte
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(md.Value))
+		b = append(b, buf[:]...)
+	}
+	b = appendString(b, 6, md.Unit)
+	b = appendVarintField(b, 7, uint64(md.Time))
+	b = appendString(b, 8, md.Mtype)
+	for _, tag := range md.Tags {
+		b = appendTag(b, 9, wireBytes)
+		b = appendVarint(b, uint64(len(tag)))
+		b = append(b, tag...)
+	}
+	return b
+}
+
+func appendTag(b []byte, field, wire uint64) []byte {
+	return appendVarint(b, field<<3|wire)
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendVarintField appends the field, unless it has the default value, like proto3 does
+func appendVarintField(b []byte, field, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return appendVarint(appendTag(b, field, wireVarint), v)
+}
+
+func appendString(b []byte, field uint64, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// ReadProtobufBatchMsg decodes the MetricData of the protobuf batch message and appends them to mds.
+// Unknown fields are skipped, so that producers can use newer versions of metricdata.proto.
+func ReadProtobufBatchMsg(data []byte, mds []schema.MetricData) ([]schema.MetricData, error) {
+	if !IsProtobufBatchMsg(data) {
+		return mds, fmt.Errorf("not a protobuf batch message")
+	}
+	data = data[1:]
+	for len(data) > 0 {
+		field, wire, n := readTag(data)
+		if n == 0 {
+			return mds, errTruncated
+		}
+		data = data[n:]
+		if field != 1 || wire != wireBytes {
+			if n = skipField(data, wire); n < 0 {
+				return mds, errTruncated
+			}
+			data = data[n:]
+			continue
+		}
+		md, n := readBytes(data)
+		if n == 0 {
+			return mds, errTruncated
+		}
+		data = data[n:]
+		mds = append(mds, schema.MetricData{})
+		if err := readMetricData(md, &mds[len(mds)-1]); err != nil {
+			return mds[:len(mds)-1], err
+		}
+	}
+	return mds, nil
+}
+
+func readMetricData(data []byte, md *schema.MetricData) error {
+	for len(data) > 0 {
+		field, wire, n := readTag(data)
+		if n == 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		switch {
+		case wire == wireBytes && (field == 1 || field == 3 || field == 6 || field == 8 || field == 9):
+			b, n := readBytes(data)
+			if n == 0 {
+				return errTruncated
+			}
+			data = data[n:]
+			switch field {
+			case 1:
+				md.Id = string(b)
+			case 3:
+				md.Name = string(b)
+			case 6:
+				md.Unit = string(b)
+			case 8:
+				md.Mtype = string(b)
+			case 9:
+				md.Tags = append(md.Tags, string(b))
+			}
+		case wire == wireVarint && (field == 2 || field == 4 || field == 7):
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+			switch field {
+			case 2:
+				md.OrgId = int(int32(v))
+			case 4:
+				md.Interval = int(int64(v))
+			case 7:
+				md.Time = int64(v)
+			}
+		case wire == wireFixed64 && field == 5:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			md.Value = math.Float64frombits(binary.LittleEndian.Uint64(data))
+			data = data[8:]
+		default:
+			n := skipField(data, wire)
+			if n < 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		}
+	}
+	return nil
+}
+
+// readTag returns the field number and wire type of the field that data starts with, and the length of the tag.
+// the length is 0 if data is truncated.
+func readTag(data []byte) (uint64, uint64, int) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, 0, 0
+	}
+	return v >> 3, v & 7, n
+}
+
+// readBytes returns the length-delimited value that data starts with, and the length it takes up.
+// the length is 0 if data is truncated.
+func readBytes(data []byte) ([]byte, int) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, 0
+	}
+	return data[n : n+int(l)], n + int(l)
+}
+
+// skipField returns the length of the value of the given wire type that data starts with, or -1 if it can't be skipped
+func skipField(data []byte, wire uint64) int {
+	switch wire {
+	case wireVarint:
+		_, n := binary.Uvarint(data)
+		if n <= 0 {
+			return -1
+		}
+		return n
+	case wireFixed64:
+		if len(data) < 8 {
+			return -1
+		}
+		return 8
+	case wireBytes:
+		_, n := readBytes(data)
+		if n == 0 {
+			return -1
+		}
+		return n
+	case wireFixed32:
+		if len(data) < 4 {
+			return -1
+		}
+		return 4
+	}
+	return -1
+}
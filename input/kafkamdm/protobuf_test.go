@@ -0,0 +1,127 @@
+package kafkamdm
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// pbMetricData and pbMetricDataBatch are the messages of metricdata.proto, for the protobuf library to encode
+type pbMetricData struct {
+	Id       string   `protobuf:"bytes,1,opt,name=id,proto3"`
+	OrgId    int32    `protobuf:"varint,2,opt,name=org_id,proto3"`
+	Name     string   `protobuf:"bytes,3,opt,name=name,proto3"`
+	Interval int64    `protobuf:"varint,4,opt,name=interval,proto3"`
+	Value    float64  `protobuf:"fixed64,5,opt,name=value,proto3"`
+	Unit     string   `protobuf:"bytes,6,opt,name=unit,proto3"`
+	Time     int64    `protobuf:"varint,7,opt,name=time,proto3"`
+	Mtype    string   `protobuf:"bytes,8,opt,name=mtype,proto3"`
+	Tags     []string `protobuf:"bytes,9,rep,name=tags"`
+	// not in metricdata.proto, to check that unknown fields are skipped
+	Extra uint32 `protobuf:"fixed32,15,opt,name=extra,proto3"`
+}
+
+func (m *pbMetricData) Reset()         { *m = pbMetricData{} }
+func (m *pbMetricData) String() string { return proto.CompactTextString(m) }
+func (*pbMetricData) ProtoMessage()    {}
+
+type pbMetricDataBatch struct {
+	Metrics []*pbMetricData `protobuf:"bytes,1,rep,name=metrics"`
+}
+
+func (m *pbMetricDataBatch) Reset()         { *m = pbMetricDataBatch{} }
+func (m *pbMetricDataBatch) String() string { return proto.CompactTextString(m) }
+func (*pbMetricDataBatch) ProtoMessage()    {}
+
+func testMetricData() []*schema.MetricData {
+	mds := []*schema.MetricData{
+		{OrgId: 1, Name: "a.b", Interval: 10, Value: 1.5, Unit: "ms", Time: 1500000000, Mtype: "gauge", Tags: []string{"dc=east", "host=a"}},
+		{OrgId: 2, Name: "c", Interval: 60, Value: -3, Time: 1500000060, Mtype: "counter"},
+	}
+	for _, md := range mds {
+		md.SetId()
+	}
+	return mds
+}
+
+func TestProtobufBatchMsg(t *testing.T) {
+	mds := testMetricData()
+	data := WriteProtobufBatchMsg(nil, mds)
+
+	// the protobuf library must decode what we encode
+	var batch pbMetricDataBatch
+	if err := proto.Unmarshal(data[1:], &batch); err != nil {
+		t.Fatalf("protobuf library could not decode the batch: %s", err)
+	}
+	if len(batch.Metrics) != 2 || batch.Metrics[0].Name != "a.b" || batch.Metrics[0].Value != 1.5 || batch.Metrics[1].OrgId != 2 {
+		t.Fatalf("protobuf library decoded an unexpected batch: %v", batch.Metrics)
+	}
+
+	// and we must decode what the protobuf library encodes, skipping unknown fields
+	batch.Metrics[1].Extra = 42
+	encoded, err := proto.Marshal(&batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range [][]byte{data, append([]byte{byte(FormatMetricDataBatchProtobuf)}, encoded...)} {
+		got, err := ReadProtobufBatchMsg(data, nil)
+		if err != nil {
+			t.Fatalf("could not decode batch: %s", err)
+		}
+		if len(got) != 2 || !reflect.DeepEqual(&got[0], mds[0]) || !reflect.DeepEqual(&got[1], mds[1]) {
+			t.Fatalf("expected %v, got %v", mds, got)
+		}
+	}
+
+	if _, err := ReadProtobufBatchMsg(data[:len(data)-3], nil); err == nil {
+		t.Fatalf("expected an error for a truncated message")
+	}
+	if IsProtobufBatchMsg(pointMsg(t, testPoint(1), 2, 0).Value) {
+		t.Fatalf("expected a MetricPoint message not to be a protobuf batch message")
+	}
+	msgp, _ := mds[0].MarshalMsg(nil)
+	if IsProtobufBatchMsg(msgp) {
+		t.Fatalf("expected a MessagePack MetricData message not to be a protobuf batch message")
+	}
+}
+
+func TestHandleProtobufBatchMsg(t *testing.T) {
+	handler := &fakeHandler{}
+	k := &KafkaMdm{Handler: handler}
+	state := func() interface{} { return nil }
+	k.handleMsg(WriteProtobufBatchMsg(nil, testMetricData()), 0, 1, state)
+	if handler.md != 2 {
+		t.Fatalf("expected 2 MetricData to be processed, got %d", handler.md)
+	}
+}
+
+// ns/op is per MetricData
+
+func BenchmarkDecodeMetricDataMsgp(b *testing.B) {
+	mds := testMetricData()
+	data, _ := mds[0].MarshalMsg(nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var md schema.MetricData
+		if _, err := md.UnmarshalMsg(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMetricDataProtobuf(b *testing.B) {
+	mds := testMetricData()
+	data := WriteProtobufBatchMsg(nil, mds[:1])
+	out := make([]schema.MetricData, 0, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if out, err = ReadProtobufBatchMsg(data, out[:0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
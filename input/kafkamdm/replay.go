@@ -0,0 +1,114 @@
+package kafkamdm
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// replay tracks how far along we are consuming the backlog of a partition: the messages
+// between the offset we started from and the newest offset at the time we started.
+type replay struct {
+	topic     string
+	partition int32
+
+	// all of these are accessed atomically. start and end are -1 until the offsets are resolved
+	start    int64 // first offset to consume
+	end      int64 // newest offset when we started. we've caught up once we get here
+	pos      int64 // next offset to consume
+	begin    int64 // unix nanos when we started consuming
+	caughtUp int64 // unix nanos when we reached end, 0 until then
+}
+
+func newReplay(topic string, partition int32) *replay {
+	return &replay{
+		topic:     topic,
+		partition: partition,
+		start:     -1,
+		end:       -1,
+	}
+}
+
+// init records the offset range to replay
+func (r *replay) init(start, end int64, now time.Time) {
+	atomic.StoreInt64(&r.pos, start)
+	atomic.StoreInt64(&r.end, end)
+	atomic.StoreInt64(&r.begin, now.UnixNano())
+	atomic.StoreInt64(&r.start, start)
+	if start >= end {
+		atomic.StoreInt64(&r.caughtUp, now.UnixNano())
+	}
+}
+
+// consumed records that we've consumed the message at the given offset
+func (r *replay) consumed(offset int64) {
+	atomic.StoreInt64(&r.pos, offset+1)
+	end := atomic.LoadInt64(&r.end)
+	if offset+1 >= end && atomic.LoadInt64(&r.caughtUp) == 0 {
+		now := time.Now()
+		atomic.StoreInt64(&r.caughtUp, now.UnixNano())
+		begin := time.Unix(0, atomic.LoadInt64(&r.begin))
+		log.Info("kafka-mdm: %s:%d caught up with its backlog of %d messages in %s", r.topic, r.partition, end-atomic.LoadInt64(&r.start), now.Sub(begin))
+	}
+}
+
+type replayStatus struct {
+	Topic        string  `json:"topic"`
+	Partition    int32   `json:"partition"`
+	Start        int64   `json:"startOffset"`
+	End          int64   `json:"endOffset"`
+	Offset       int64   `json:"offset"`
+	Done         bool    `json:"done"`
+	PointsPerSec float64 `json:"pointsPerSec"` // every message holds a single point
+	ETA          int     `json:"eta"`
+}
+
+func (r *replay) status(now time.Time) replayStatus {
+	s := replayStatus{
+		Topic:     r.topic,
+		Partition: r.partition,
+		Start:     atomic.LoadInt64(&r.start),
+		End:       atomic.LoadInt64(&r.end),
+		Offset:    atomic.LoadInt64(&r.pos),
+		ETA:       -1,
+	}
+	if s.Start == -1 {
+		return s
+	}
+	begin := time.Unix(0, atomic.LoadInt64(&r.begin))
+	if caughtUp := atomic.LoadInt64(&r.caughtUp); caughtUp != 0 {
+		s.Done = true
+		now = time.Unix(0, caughtUp)
+	}
+	s.PointsPerSec = health.Rate(s.Offset-s.Start, begin, now)
+	s.ETA = health.ETA(s.End-s.Offset, s.PointsPerSec)
+	return s
+}
+
+// Progress reports how far along replaying the backlog of each partition is.
+// once all partitions caught up, we're done, even if we're lagging again later: that's what the lag in the health is for.
+func (k *KafkaMdm) Progress() health.Progress {
+	now := time.Now()
+	if len(k.replays) == 0 {
+		return health.Progress{ETA: -1}
+	}
+	p := health.Progress{Done: true}
+	statuses := make([]replayStatus, 0, len(k.replays))
+	for _, r := range k.replays {
+		s := r.status(now)
+		statuses = append(statuses, s)
+		if s.Done {
+			continue
+		}
+		p.Done = false
+		if s.ETA == -1 || p.ETA == -1 {
+			p.ETA = -1
+		} else if s.ETA > p.ETA {
+			p.ETA = s.ETA
+		}
+	}
+	p.Detail = statuses
+	return p
+}
@@ -0,0 +1,39 @@
+package kafkamdm
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayStatus(t *testing.T) {
+	r := newReplay("mdm", 3)
+	now := time.Now()
+	if s := r.status(now); s.Done || s.ETA != -1 || s.Start != -1 {
+		t.Fatalf("expected unknown progress before init, got %+v", s)
+	}
+
+	r.init(1000, 2000, now.Add(-10*time.Second))
+	for o := int64(1000); o < 1400; o++ {
+		r.consumed(o)
+	}
+	s := r.status(now)
+	if s.Done || s.Offset != 1400 || s.PointsPerSec != 40 || s.ETA != 15 {
+		t.Fatalf("expected 40 points/s with 15s to go, got %+v", s)
+	}
+
+	for o := int64(1400); o < 2000; o++ {
+		r.consumed(o)
+	}
+	s = r.status(now.Add(time.Hour))
+	if !s.Done || s.ETA != 0 {
+		t.Fatalf("expected done, got %+v", s)
+	}
+}
+
+func TestReplayNothingToDo(t *testing.T) {
+	r := newReplay("mdm", 0)
+	r.init(500, 500, time.Now())
+	if s := r.status(time.Now()); !s.Done || s.ETA != 0 {
+		t.Fatalf("expected done when there is no backlog, got %+v", s)
+	}
+}
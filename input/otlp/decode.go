@@ -0,0 +1,349 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// the OTLP messages are decoded by hand, like the protobuf batches of the kafka-mdm input, so that we don't need
+// to vendor the generated code of the opentelemetry protos. only the fields we use are decoded, the others are skipped.
+// see https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+// protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// data point flag that marks a point without a value, e.g. because the series disappeared from its source
+const flagNoRecordedValue = 1
+
+var errTruncated = errors.New("protobuf message is truncated")
+
+type metricKind int
+
+const (
+	kindUnsupported metricKind = iota
+	kindGauge
+	kindSum
+	kindHistogram
+)
+
+// aggregation temporalities
+const (
+	temporalityDelta      = 1
+	temporalityCumulative = 2
+)
+
+// resourceMetrics are the metrics of a resource, such as a service, with its attributes as tags
+type resourceMetrics struct {
+	tags    []string
+	metrics []metric
+}
+
+type metric struct {
+	name        string
+	unit        string
+	kind        metricKind
+	temporality uint64
+	monotonic   bool
+	numbers     []numberPoint
+	histograms  []histogramPoint
+}
+
+type numberPoint struct {
+	tags  []string
+	time  uint64 // unix nanoseconds
+	value float64
+	flags uint64
+}
+
+type histogramPoint struct {
+	tags    []string
+	time    uint64 // unix nanoseconds
+	count   uint64
+	sum     float64
+	hasSum  bool
+	buckets []uint64
+	bounds  []float64
+	flags   uint64
+}
+
+// decodeExportRequest decodes an ExportMetricsServiceRequest
+func decodeExportRequest(data []byte) ([]resourceMetrics, error) {
+	var rms []resourceMetrics
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		if field != 1 || wire != wireBytes {
+			return nil
+		}
+		rm, err := decodeResourceMetrics(b)
+		if err != nil {
+			return err
+		}
+		rms = append(rms, rm)
+		return nil
+	})
+	return rms, err
+}
+
+func decodeResourceMetrics(data []byte) (resourceMetrics, error) {
+	var rm resourceMetrics
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch field {
+		case 1: // resource
+			return readMessage(b, func(field, wire uint64, b []byte, v uint64) error {
+				if field != 1 || wire != wireBytes {
+					return nil
+				}
+				tag, err := decodeAttribute(b)
+				if tag != "" {
+					rm.tags = append(rm.tags, tag)
+				}
+				return err
+			})
+		case 2: // scope_metrics. the scope is the library that recorded the metrics, which we don't need
+			return readMessage(b, func(field, wire uint64, b []byte, v uint64) error {
+				if field != 2 || wire != wireBytes {
+					return nil
+				}
+				m, err := decodeMetric(b)
+				if err != nil {
+					return err
+				}
+				rm.metrics = append(rm.metrics, m)
+				return nil
+			})
+		}
+		return nil
+	})
+	return rm, err
+}
+
+func decodeMetric(data []byte) (metric, error) {
+	var m metric
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch field {
+		case 1:
+			m.name = string(b)
+		case 3:
+			m.unit = string(b)
+		case 5:
+			m.kind = kindGauge
+			return decodeNumberPoints(b, &m)
+		case 7:
+			m.kind = kindSum
+			return decodeNumberPoints(b, &m)
+		case 9:
+			m.kind = kindHistogram
+			return decodeHistogramPoints(b, &m)
+		case 10, 11:
+			// exponential histograms and summaries
+			m.kind = kindUnsupported
+		}
+		return nil
+	})
+	return m, err
+}
+
+// decodeNumberPoints decodes a Gauge or a Sum
+func decodeNumberPoints(data []byte, m *metric) error {
+	return readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			p, err := decodeNumberPoint(b)
+			if err != nil {
+				return err
+			}
+			m.numbers = append(m.numbers, p)
+		case field == 2 && wire == wireVarint:
+			m.temporality = v
+		case field == 3 && wire == wireVarint:
+			m.monotonic = v != 0
+		}
+		return nil
+	})
+}
+
+func decodeNumberPoint(data []byte) (numberPoint, error) {
+	var p numberPoint
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		switch {
+		case field == 3 && wire == wireFixed64:
+			p.time = v
+		case field == 4 && wire == wireFixed64:
+			p.value = math.Float64frombits(v)
+		case field == 6 && wire == wireFixed64:
+			p.value = float64(int64(v))
+		case field == 7 && wire == wireBytes:
+			tag, err := decodeAttribute(b)
+			if tag != "" {
+				p.tags = append(p.tags, tag)
+			}
+			return err
+		case field == 8 && wire == wireVarint:
+			p.flags = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+func decodeHistogramPoints(data []byte, m *metric) error {
+	return readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			p, err := decodeHistogramPoint(b)
+			if err != nil {
+				return err
+			}
+			m.histograms = append(m.histograms, p)
+		case field == 2 && wire == wireVarint:
+			m.temporality = v
+		}
+		return nil
+	})
+}
+
+func decodeHistogramPoint(data []byte) (histogramPoint, error) {
+	var p histogramPoint
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		switch {
+		case field == 3 && wire == wireFixed64:
+			p.time = v
+		case field == 4 && wire == wireFixed64:
+			p.count = v
+		case field == 5 && wire == wireFixed64:
+			p.sum = math.Float64frombits(v)
+			p.hasSum = true
+		case field == 6:
+			return readFixed64s(wire, b, v, func(v uint64) { p.buckets = append(p.buckets, v) })
+		case field == 7:
+			return readFixed64s(wire, b, v, func(v uint64) { p.bounds = append(p.bounds, math.Float64frombits(v)) })
+		case field == 9 && wire == wireBytes:
+			tag, err := decodeAttribute(b)
+			if tag != "" {
+				p.tags = append(p.tags, tag)
+			}
+			return err
+		case field == 10 && wire == wireVarint:
+			p.flags = v
+		}
+		return nil
+	})
+	return p, err
+}
+
+// decodeAttribute decodes a KeyValue into a tag. it returns an empty tag for values that are
+// empty or can't be a tag value, such as arrays.
+func decodeAttribute(data []byte) (string, error) {
+	var key, value string
+	err := readMessage(data, func(field, wire uint64, b []byte, v uint64) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			key = string(b)
+		case field == 2 && wire == wireBytes:
+			return readMessage(b, func(field, wire uint64, b []byte, v uint64) error {
+				switch {
+				case field == 1 && wire == wireBytes:
+					value = string(b)
+				case field == 2 && wire == wireVarint:
+					value = strconv.FormatBool(v != 0)
+				case field == 3 && wire == wireVarint:
+					value = strconv.FormatInt(int64(v), 10)
+				case field == 4 && wire == wireFixed64:
+					value = strconv.FormatFloat(math.Float64frombits(v), 'f', -1, 64)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil || key == "" || value == "" {
+		return "", err
+	}
+	return sanitizeTagKey(key) + "=" + sanitizeTagValue(value), nil
+}
+
+// tag keys can't contain ; ! and =, and tag values can't contain ;
+var tagKeyReplacer = strings.NewReplacer(";", "_", "!", "_", "=", "_")
+var tagValueReplacer = strings.NewReplacer(";", "_")
+
+func sanitizeTagKey(key string) string {
+	return tagKeyReplacer.Replace(key)
+}
+
+func sanitizeTagValue(value string) string {
+	return tagValueReplacer.Replace(value)
+}
+
+// readMessage calls fn for each field of the message, with the value of length-delimited fields in b,
+// and the value of the other fields in v.
+func readMessage(data []byte, fn func(field, wire uint64, b []byte, v uint64) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field, wire := key>>3, key&7
+		var b []byte
+		var v uint64
+		switch wire {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			v, n = binary.LittleEndian.Uint64(data), 8
+		case wireBytes:
+			l, m := binary.Uvarint(data)
+			if m <= 0 || uint64(len(data)-m) < l {
+				return errTruncated
+			}
+			b, n = data[m:m+int(l)], m+int(l)
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			v, n = uint64(binary.LittleEndian.Uint32(data)), 4
+		default:
+			return errors.New("protobuf message has an unsupported wire type")
+		}
+		data = data[n:]
+		if err := fn(field, wire, b, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFixed64s reads a repeated fixed64 or double field, which is usually packed, but may also be given value by value
+func readFixed64s(wire uint64, b []byte, v uint64, fn func(uint64)) error {
+	switch wire {
+	case wireFixed64:
+		fn(v)
+	case wireBytes:
+		if len(b)%8 != 0 {
+			return errTruncated
+		}
+		for ; len(b) > 0; b = b[8:] {
+			fn(binary.LittleEndian.Uint64(b))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,551 @@
+// package otlp provides an input for metrics exported with the OpenTelemetry protocol (OTLP), over gRPC and http
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+// metric input.otlp.metrics_decode_err is a count of times an export request failed to decode
+var metricsDecodeErr = stats.NewCounterRate32("input.otlp.metrics_decode_err")
+
+// metric input.otlp.unsupported is a count of metrics received of a type that is not supported, such as exponential histograms and summaries, which are dropped
+var unsupportedMetrics = stats.NewCounter32("input.otlp.unsupported")
+
+// metric input.otlp.no_recorded_value is a count of data points received that are flagged as not having a value, which are dropped
+var noRecordedValue = stats.NewCounter32("input.otlp.no_recorded_value")
+
+var (
+	addr        string
+	grpcAddr    string
+	Enabled     bool
+	partitionID int
+	idCacheSize int
+	orgId       int
+	orgHeader   bool
+	intervalStr string
+
+	// interval of all series, in seconds. 0 to derive it per series
+	interval int
+)
+
+type OTLP struct {
+	input.Handler
+	server         *http.Server
+	grpcServer     *grpc.Server
+	intervalGetter IntervalGetter
+	ids            *input.IDCache
+	fatalOnce      sync.Once
+}
+
+func New() *OTLP {
+	return &OTLP{
+		ids: input.NewIDCache("otlp", idCacheSize),
+	}
+}
+
+func (o *OTLP) Name() string {
+	return "otlp"
+}
+
+func (o *OTLP) IntervalGetter(i IntervalGetter) {
+	o.intervalGetter = i
+}
+
+func (o *OTLP) Start(handler input.Handler, fatal chan struct{}) error {
+	o.Handler = handler
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error(4, "otlp-in: %s", err.Error())
+		return err
+	}
+	var gl net.Listener
+	if grpcAddr != "" {
+		gl, err = net.Listen("tcp", grpcAddr)
+		if err != nil {
+			l.Close()
+			log.Error(4, "otlp-in: %s", err.Error())
+			return err
+		}
+	}
+
+	log.Info("otlp-in: listening on %v/v1/metrics", addr)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", o.handle)
+	o.server = &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		err := o.server.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Error(4, "otlp-in: %s", err.Error())
+			o.fatalOnce.Do(func() { close(fatal) })
+		}
+	}()
+
+	if gl != nil {
+		log.Info("otlp-in: listening for gRPC on %v", grpcAddr)
+		o.grpcServer = o.newGRPCServer()
+		go func() {
+			err := o.grpcServer.Serve(gl)
+			if err != nil {
+				log.Error(4, "otlp-in: %s", err.Error())
+				o.fatalOnce.Do(func() { close(fatal) })
+			}
+		}()
+	}
+	return nil
+}
+
+func (o *OTLP) MaintainPriority() {
+	cluster.Manager.SetPriority(0)
+}
+
+func (o *OTLP) ExplainPriority() interface{} {
+	return "otlp-in: priority=0 (always in sync)"
+}
+
+func (o *OTLP) Stop() {
+	log.Info("otlp-in: shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	o.server.Shutdown(ctx)
+	if o.grpcServer == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		o.grpcServer.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		o.grpcServer.Stop()
+	}
+}
+
+func (o *OTLP) handle(w http.ResponseWriter, req *http.Request) {
+	state := func() interface{} {
+		return map[string]interface{}{"remoteAddr": req.RemoteAddr, "contentLength": req.ContentLength}
+	}
+	if crash.Run("input.otlp", state, func() { o.export(w, req) }) {
+		w.WriteHeader(500)
+		w.Write([]byte("internal error"))
+	}
+}
+
+// export handles an OTLP/http export request. only the binary protobuf encoding is supported, not JSON
+func (o *OTLP) export(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(405)
+		w.Write([]byte("only POST is supported"))
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+		w.WriteHeader(415)
+		w.Write([]byte("only application/x-protobuf is supported"))
+		return
+	}
+	if req.Body == nil {
+		w.WriteHeader(400)
+		w.Write([]byte("no data"))
+		return
+	}
+	defer req.Body.Close()
+
+	org := uint32(orgId)
+	if orgHeader {
+		if s := req.Header.Get("x-org-id"); s != "" {
+			var err error
+			org, err = parseOrg(s)
+			if err != nil {
+				w.WriteHeader(400)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+	}
+
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			metricsDecodeErr.Inc()
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("Decode Error, %v", err)))
+			log.Error(3, "otlp-in: Decode Error, %v", err)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Read Error, %v", err)))
+		log.Error(3, "otlp-in: Read Error, %v", err)
+		return
+	}
+	if err := o.process(org, data); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	// an empty ExportMetricsServiceResponse, which means all data was accepted
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(200)
+}
+
+// exportGRPC handles an OTLP/gRPC export request
+func (o *OTLP) exportGRPC(ctx context.Context, data []byte) error {
+	org := uint32(orgId)
+	if orgHeader {
+		md, _ := metadata.FromIncomingContext(ctx)
+		if s := md.Get("x-org-id"); len(s) > 0 && s[0] != "" {
+			var err error
+			org, err = parseOrg(s[0])
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+	}
+	var err error
+	state := func() interface{} {
+		return map[string]interface{}{"contentLength": len(data)}
+	}
+	if crash.Run("input.otlp", state, func() { err = o.process(org, data) }) {
+		return status.Error(codes.Internal, "internal error")
+	}
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+func parseOrg(s string) (uint32, error) {
+	o, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || o == 0 {
+		return 0, fmt.Errorf("bad org-id")
+	}
+	return uint32(o), nil
+}
+
+// process decodes the ExportMetricsServiceRequest and processes its data points.
+// the request is checked before we process any of it, so that a bad request is refused as a whole
+func (o *OTLP) process(org uint32, data []byte) error {
+	rms, err := decodeExportRequest(data)
+	if err != nil {
+		metricsDecodeErr.Inc()
+		log.Error(3, "otlp-in: Decode Error, %v", err)
+		return fmt.Errorf("Decode Error, %v", err)
+	}
+	for _, rm := range rms {
+		for _, m := range rm.metrics {
+			if m.name == "" {
+				log.Warn("otlp-in: metric received with empty name")
+				return fmt.Errorf("invalid metric received: name can not equal \"\"")
+			}
+		}
+	}
+	for _, rm := range rms {
+		for _, m := range rm.metrics {
+			o.processMetric(org, rm.tags, m)
+		}
+	}
+	return nil
+}
+
+// processMetric maps the data points of the metric to metrictank series:
+// gauges and sums become a series named after the metric, and histograms become a .count and a .sum series,
+// and a .bucket series per bucket, with the upper bound of the bucket in the le tag, like prometheus does.
+// bucket counts are cumulative, so each bucket includes the counts of the buckets below it.
+// the attributes of the resource and of the data point become the tags of the series.
+func (o *OTLP) processMetric(org uint32, resourceTags []string, m metric) {
+	name := strings.Replace(m.name, ";", "_", -1)
+	unit := m.unit
+	if unit == "" {
+		unit = "unknown"
+	}
+	switch m.kind {
+	case kindGauge, kindSum:
+		mtype := "gauge"
+		if m.kind == kindSum && m.monotonic {
+			mtype = counterMtype(m.temporality)
+		}
+		for _, p := range m.numbers {
+			if p.flags&flagNoRecordedValue != 0 {
+				noRecordedValue.Inc()
+				continue
+			}
+			o.processPoint(org, name, unit, mtype, mergeTags(resourceTags, p.tags), p.time, p.value)
+		}
+	case kindHistogram:
+		mtype := counterMtype(m.temporality)
+		for _, p := range m.histograms {
+			if p.flags&flagNoRecordedValue != 0 {
+				noRecordedValue.Inc()
+				continue
+			}
+			tags := mergeTags(resourceTags, p.tags)
+			o.processPoint(org, name+".count", unit, mtype, tags, p.time, float64(p.count))
+			if p.hasSum {
+				o.processPoint(org, name+".sum", unit, mtype, tags, p.time, p.sum)
+			}
+			var cumulative uint64
+			for i, c := range p.buckets {
+				cumulative += c
+				le := "+Inf"
+				if i < len(p.bounds) {
+					le = strconv.FormatFloat(p.bounds[i], 'f', -1, 64)
+				} else if i > len(p.bounds) {
+					// more buckets than bounds: the histogram is malformed
+					break
+				}
+				o.processPoint(org, name+".bucket", unit, mtype, addTag(tags, "le="+le), p.time, float64(cumulative))
+			}
+		}
+	default:
+		unsupportedMetrics.Inc()
+	}
+}
+
+// counterMtype returns the mtype of a monotonic series of the given aggregation temporality.
+// cumulative series hold a running total, delta series the increase since the previous point
+func counterMtype(temporality uint64) string {
+	if temporality == temporalityDelta {
+		return "count"
+	}
+	return "counter"
+}
+
+// mergeTags returns the sorted tags of a data point, and those tags of its resource of which the point doesn't have the key
+func mergeTags(resourceTags, pointTags []string) []string {
+	tags := make([]string, 0, len(resourceTags)+len(pointTags))
+	tags = append(tags, pointTags...)
+	for _, rt := range resourceTags {
+		if !hasTagKey(tags, rt[:strings.Index(rt, "=")+1]) {
+			tags = append(tags, rt)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// addTag returns a sorted copy of the sorted tags, with tag added or replacing the tag with the same key
+func addTag(tags []string, tag string) []string {
+	prefix := tag[:strings.Index(tag, "=")+1]
+	out := make([]string, 0, len(tags)+1)
+	for _, t := range tags {
+		if !strings.HasPrefix(t, prefix) {
+			out = append(out, t)
+		}
+	}
+	out = append(out, tag)
+	sort.Strings(out)
+	return out
+}
+
+// hasTagKey returns whether one of the tags starts with the prefix, which is a key followed by =
+func hasTagKey(tags []string, prefix string) bool {
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// processPoint processes a point of the series with the given name and sorted tags
+func (o *OTLP) processPoint(org uint32, name, unit, mtype string, tags []string, ts uint64, value float64) {
+	nameWithTags := name
+	if len(tags) > 0 {
+		nameWithTags += ";" + strings.Join(tags, ";")
+	}
+	key := strconv.FormatUint(uint64(org), 10) + ":" + nameWithTags
+	secs := int64(ts / 1e9)
+
+	// for series we've seen before, we know the id, so we don't need a MetricData
+	if id, ok := o.ids.Get(key); ok {
+		point := schema.MetricPoint{MKey: id, Value: value, Time: uint32(secs)}
+		if o.ProcessMetricPoint(point, msg.FormatMetricPoint, int32(partitionID)) {
+			return
+		}
+		// the series is no longer in the index
+		o.ids.Del(key)
+	}
+	md := &schema.MetricData{
+		Name:     name,
+		Interval: o.getInterval(org, name, nameWithTags, tags),
+		Value:    value,
+		Unit:     unit,
+		Time:     secs,
+		Mtype:    mtype,
+		Tags:     tags,
+		OrgId:    int(org),
+	}
+	md.SetId()
+	if id, err := schema.MKeyFromString(md.Id); err == nil {
+		o.ids.Add(key, id)
+	}
+	o.ProcessMetricData(md, int32(partitionID))
+}
+
+// getInterval returns the interval of a series that we don't know the id of.
+// as the interval is part of the id, it must be the same for all points of the series, so in auto mode,
+// we prefer the interval of the series in the index. new series get the raw interval of their storage schema.
+func (o *OTLP) getInterval(org uint32, name, nameWithTags string, tags []string) int {
+	if interval != 0 {
+		return interval
+	}
+	if o.intervalGetter == nil {
+		return 60
+	}
+	if i := o.intervalGetter.GetInterval(org, name, nameWithTags, tags); i != 0 {
+		return i
+	}
+	return o.intervalGetter.DefaultInterval(name)
+}
+
+// newGRPCServer returns a gRPC server that serves the MetricsService of OTLP/gRPC, accepting gzip compressed requests
+func (o *OTLP) newGRPCServer() *grpc.Server {
+	s := grpc.NewServer(grpc.CustomCodec(rawCodec{}), grpc.RPCDecompressor(grpc.NewGZIPDecompressor()))
+	s.RegisterService(&metricsServiceDesc, o)
+	return s
+}
+
+// metricsServer is what serves the MetricsService of OTLP/gRPC
+type metricsServer interface {
+	exportGRPC(ctx context.Context, data []byte) error
+}
+
+// metricsServiceDesc describes the MetricsService of opentelemetry/proto/collector/metrics/v1/metrics_service.proto.
+// the messages are passed as raw bytes by rawCodec, for us to decode.
+var metricsServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.metrics.v1.MetricsService",
+	HandlerType: (*metricsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+				var data []byte
+				if err := dec(&data); err != nil {
+					return nil, err
+				}
+				if err := srv.(metricsServer).exportGRPC(ctx, data); err != nil {
+					return nil, err
+				}
+				// an empty ExportMetricsServiceResponse, which means all data was accepted
+				return []byte{}, nil
+			},
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "opentelemetry/proto/collector/metrics/v1/metrics_service.proto",
+}
+
+// rawCodec passes messages as raw bytes
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec can't marshal %T", v)
+	}
+	return b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec can't unmarshal into %T", v)
+	}
+	*b = data
+	return nil
+}
+
+func (rawCodec) String() string {
+	return "raw"
+}
+
+func ConfigSetup() {
+	inOTLP := flag.NewFlagSet("otlp-in", flag.ExitOnError)
+	inOTLP.BoolVar(&Enabled, "enabled", false, "")
+	inOTLP.StringVar(&addr, "addr", ":4318", "http listen address for OTLP/http")
+	inOTLP.StringVar(&grpcAddr, "grpc-addr", ":4317", "listen address for OTLP/gRPC. empty to disable")
+	inOTLP.IntVar(&partitionID, "partition", 0, "partition Id.")
+	inOTLP.IntVar(&idCacheSize, "id-cache-size", 100000, "max number of series to remember the id of, so that their subsequent points skip generating it. 0 disables")
+	inOTLP.IntVar(&orgId, "org", 1, "org that the data is stored under")
+	inOTLP.BoolVar(&orgHeader, "org-header", false, "take the org from the x-org-id header or gRPC metadata of the request, if it has one, e.g. when an authenticating proxy sets it. otherwise org is used")
+	inOTLP.StringVar(&intervalStr, "interval", "auto", "interval of the series. auto to use the interval of the series in the index, or for new series, the raw interval of their storage schema")
+	globalconf.Register("otlp-in", inOTLP)
+}
+
+func parseInterval(s string) (int, error) {
+	if s == "auto" {
+		return 0, nil
+	}
+	i, err := dur.ParseNDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return int(i), nil
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if orgId < 1 {
+		findings = append(findings, conf.NewError("otlp-in.org", "must be at least 1"))
+	}
+	if _, err := parseInterval(intervalStr); err != nil {
+		findings = append(findings, conf.NewError("otlp-in.interval", "must be auto or a duration: %s", err))
+	}
+	if grpcAddr == addr {
+		findings = append(findings, conf.NewError("otlp-in.grpc-addr", "can't be the same as addr"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	if !Enabled {
+		return
+	}
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	interval, _ = parseInterval(intervalStr)
+	cluster.Manager.SetPartitions([]int32{int32(partitionID)})
+}
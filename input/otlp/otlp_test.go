@@ -0,0 +1,369 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+// the pb types are the messages of the OTLP metrics protos that we use, for the protobuf library to encode.
+// oneof fields are given as optional fields, which encode the same.
+
+type pbExportRequest struct {
+	ResourceMetrics []*pbResourceMetrics `protobuf:"bytes,1,rep,name=resource_metrics"`
+}
+
+type pbResourceMetrics struct {
+	Resource     *pbResource       `protobuf:"bytes,1,opt,name=resource"`
+	ScopeMetrics []*pbScopeMetrics `protobuf:"bytes,2,rep,name=scope_metrics"`
+}
+
+type pbResource struct {
+	Attributes []*pbKeyValue `protobuf:"bytes,1,rep,name=attributes"`
+}
+
+type pbScopeMetrics struct {
+	Scope   *pbScope    `protobuf:"bytes,1,opt,name=scope"`
+	Metrics []*pbMetric `protobuf:"bytes,2,rep,name=metrics"`
+}
+
+type pbScope struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+}
+
+type pbMetric struct {
+	Name                 string       `protobuf:"bytes,1,opt,name=name,proto3"`
+	Description          string       `protobuf:"bytes,2,opt,name=description,proto3"`
+	Unit                 string       `protobuf:"bytes,3,opt,name=unit,proto3"`
+	Gauge                *pbSum       `protobuf:"bytes,5,opt,name=gauge"`
+	Sum                  *pbSum       `protobuf:"bytes,7,opt,name=sum"`
+	Histogram            *pbHistogram `protobuf:"bytes,9,opt,name=histogram"`
+	ExponentialHistogram *pbScope     `protobuf:"bytes,10,opt,name=exponential_histogram"`
+}
+
+type pbSum struct {
+	DataPoints             []*pbNumberDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+	AggregationTemporality int32                `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+	IsMonotonic            bool                 `protobuf:"varint,3,opt,name=is_monotonic,proto3"`
+}
+
+type pbNumberDataPoint struct {
+	StartTimeUnixNano uint64        `protobuf:"fixed64,2,opt,name=start_time_unix_nano,proto3"`
+	TimeUnixNano      uint64        `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	AsDouble          *float64      `protobuf:"fixed64,4,opt,name=as_double"`
+	AsInt             *int64        `protobuf:"fixed64,6,opt,name=as_int"`
+	Attributes        []*pbKeyValue `protobuf:"bytes,7,rep,name=attributes"`
+	Flags             uint32        `protobuf:"varint,8,opt,name=flags,proto3"`
+}
+
+type pbHistogram struct {
+	DataPoints             []*pbHistogramDataPoint `protobuf:"bytes,1,rep,name=data_points"`
+	AggregationTemporality int32                   `protobuf:"varint,2,opt,name=aggregation_temporality,proto3"`
+}
+
+type pbHistogramDataPoint struct {
+	TimeUnixNano   uint64        `protobuf:"fixed64,3,opt,name=time_unix_nano,proto3"`
+	Count          uint64        `protobuf:"fixed64,4,opt,name=count,proto3"`
+	Sum            *float64      `protobuf:"fixed64,5,opt,name=sum"`
+	BucketCounts   []uint64      `protobuf:"fixed64,6,rep,packed,name=bucket_counts"`
+	ExplicitBounds []float64     `protobuf:"fixed64,7,rep,packed,name=explicit_bounds"`
+	Attributes     []*pbKeyValue `protobuf:"bytes,9,rep,name=attributes"`
+}
+
+type pbKeyValue struct {
+	Key   string      `protobuf:"bytes,1,opt,name=key,proto3"`
+	Value *pbAnyValue `protobuf:"bytes,2,opt,name=value"`
+}
+
+type pbAnyValue struct {
+	StringValue *string  `protobuf:"bytes,1,opt,name=string_value"`
+	BoolValue   *bool    `protobuf:"varint,2,opt,name=bool_value"`
+	IntValue    *int64   `protobuf:"varint,3,opt,name=int_value"`
+	DoubleValue *float64 `protobuf:"fixed64,4,opt,name=double_value"`
+}
+
+func (m *pbExportRequest) Reset()         { *m = pbExportRequest{} }
+func (m *pbExportRequest) String() string { return proto.CompactTextString(m) }
+func (*pbExportRequest) ProtoMessage()    {}
+
+func (m *pbResourceMetrics) Reset()         { *m = pbResourceMetrics{} }
+func (m *pbResourceMetrics) String() string { return proto.CompactTextString(m) }
+func (*pbResourceMetrics) ProtoMessage()    {}
+
+func (m *pbResource) Reset()         { *m = pbResource{} }
+func (m *pbResource) String() string { return proto.CompactTextString(m) }
+func (*pbResource) ProtoMessage()    {}
+
+func (m *pbScopeMetrics) Reset()         { *m = pbScopeMetrics{} }
+func (m *pbScopeMetrics) String() string { return proto.CompactTextString(m) }
+func (*pbScopeMetrics) ProtoMessage()    {}
+
+func (m *pbScope) Reset()         { *m = pbScope{} }
+func (m *pbScope) String() string { return proto.CompactTextString(m) }
+func (*pbScope) ProtoMessage()    {}
+
+func (m *pbMetric) Reset()         { *m = pbMetric{} }
+func (m *pbMetric) String() string { return proto.CompactTextString(m) }
+func (*pbMetric) ProtoMessage()    {}
+
+func (m *pbSum) Reset()         { *m = pbSum{} }
+func (m *pbSum) String() string { return proto.CompactTextString(m) }
+func (*pbSum) ProtoMessage()    {}
+
+func (m *pbNumberDataPoint) Reset()         { *m = pbNumberDataPoint{} }
+func (m *pbNumberDataPoint) String() string { return proto.CompactTextString(m) }
+func (*pbNumberDataPoint) ProtoMessage()    {}
+
+func (m *pbHistogram) Reset()         { *m = pbHistogram{} }
+func (m *pbHistogram) String() string { return proto.CompactTextString(m) }
+func (*pbHistogram) ProtoMessage()    {}
+
+func (m *pbHistogramDataPoint) Reset()         { *m = pbHistogramDataPoint{} }
+func (m *pbHistogramDataPoint) String() string { return proto.CompactTextString(m) }
+func (*pbHistogramDataPoint) ProtoMessage()    {}
+
+func (m *pbKeyValue) Reset()         { *m = pbKeyValue{} }
+func (m *pbKeyValue) String() string { return proto.CompactTextString(m) }
+func (*pbKeyValue) ProtoMessage()    {}
+
+func (m *pbAnyValue) Reset()         { *m = pbAnyValue{} }
+func (m *pbAnyValue) String() string { return proto.CompactTextString(m) }
+func (*pbAnyValue) ProtoMessage()    {}
+
+type fakeHandler struct {
+	md     []*schema.MetricData
+	points []schema.MetricPoint
+}
+
+func (h *fakeHandler) ProcessMetricData(md *schema.MetricData, partition int32) {
+	h.md = append(h.md, md)
+}
+
+func (h *fakeHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	h.points = append(h.points, point)
+	return true
+}
+
+// fakeIntervalGetter gives all series 10s
+type fakeIntervalGetter struct{}
+
+func (f fakeIntervalGetter) GetInterval(orgId uint32, name, nameWithTags string, tags []string) int {
+	return 0
+}
+
+func (f fakeIntervalGetter) DefaultInterval(name string) int {
+	return 10
+}
+
+func newTestOTLP() (*OTLP, *fakeHandler) {
+	orgId = 1
+	idCacheSize = 100
+	h := &fakeHandler{}
+	o := New()
+	o.Handler = h
+	o.IntervalGetter(fakeIntervalGetter{})
+	return o, h
+}
+
+func attr(key string, value interface{}) *pbKeyValue {
+	v := &pbAnyValue{}
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		i := int64(value)
+		v.IntValue = &i
+	case float64:
+		v.DoubleValue = &value
+	}
+	return &pbKeyValue{Key: key, Value: v}
+}
+
+func float(f float64) *float64 { return &f }
+func integer(i int64) *int64   { return &i }
+
+const testTime = 1500000000 * 1e9
+
+func testRequest(t *testing.T) []byte {
+	req := &pbExportRequest{
+		ResourceMetrics: []*pbResourceMetrics{{
+			Resource: &pbResource{Attributes: []*pbKeyValue{attr("service.name", "shop"), attr("host", "a"), attr("empty", "")}},
+			ScopeMetrics: []*pbScopeMetrics{{
+				Scope: &pbScope{Name: "lib"},
+				Metrics: []*pbMetric{
+					{Name: "temp", Unit: "Cel", Gauge: &pbSum{DataPoints: []*pbNumberDataPoint{
+						{TimeUnixNano: testTime, AsDouble: float(21.5), Attributes: []*pbKeyValue{attr("host", "b"), attr("room;1", "x;y")}},
+						{TimeUnixNano: testTime, AsDouble: float(1), Flags: flagNoRecordedValue},
+					}}},
+					{Name: "requests", Sum: &pbSum{AggregationTemporality: temporalityCumulative, IsMonotonic: true, DataPoints: []*pbNumberDataPoint{
+						{TimeUnixNano: testTime, AsInt: integer(42), Attributes: []*pbKeyValue{attr("ok", true), attr("code", 200), attr("ratio", 0.5)}},
+					}}},
+					{Name: "sent", Sum: &pbSum{AggregationTemporality: temporalityDelta, IsMonotonic: true, DataPoints: []*pbNumberDataPoint{
+						{TimeUnixNano: testTime, AsInt: integer(3)},
+					}}},
+					{Name: "queue", Sum: &pbSum{AggregationTemporality: temporalityCumulative, DataPoints: []*pbNumberDataPoint{
+						{TimeUnixNano: testTime, AsInt: integer(-2)},
+					}}},
+					{Name: "latency", Unit: "ms", Histogram: &pbHistogram{AggregationTemporality: temporalityCumulative, DataPoints: []*pbHistogramDataPoint{
+						{TimeUnixNano: testTime, Count: 6, Sum: float(80), BucketCounts: []uint64{1, 2, 3}, ExplicitBounds: []float64{5, 12.5}},
+					}}},
+					{Name: "sizes", ExponentialHistogram: &pbScope{}},
+				},
+			}},
+		}},
+	}
+	data, err := proto.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+type series struct {
+	name  string
+	tags  []string
+	unit  string
+	mtype string
+	value float64
+}
+
+func expectedSeries() []series {
+	res := []string{"host=a", "service.name=shop"}
+	return []series{
+		{"latency.bucket", []string{"host=a", "le=+Inf", "service.name=shop"}, "ms", "counter", 6},
+		{"latency.bucket", []string{"host=a", "le=12.5", "service.name=shop"}, "ms", "counter", 3},
+		{"latency.bucket", []string{"host=a", "le=5", "service.name=shop"}, "ms", "counter", 1},
+		{"latency.count", res, "ms", "counter", 6},
+		{"latency.sum", res, "ms", "counter", 80},
+		{"queue", res, "unknown", "gauge", -2},
+		{"requests", []string{"code=200", "host=a", "ok=true", "ratio=0.5", "service.name=shop"}, "unknown", "counter", 42},
+		{"sent", res, "unknown", "count", 3},
+		{"temp", []string{"host=b", "room_1=x_y", "service.name=shop"}, "Cel", "gauge", 21.5},
+	}
+}
+
+func checkSeries(t *testing.T, h *fakeHandler) {
+	t.Helper()
+	var got []series
+	for _, md := range h.md {
+		if md.OrgId != 1 || md.Time != 1500000000 || md.Interval != 10 {
+			t.Fatalf("unexpected org, time or interval: %v", md)
+		}
+		if err := md.Validate(); err != nil {
+			t.Fatalf("invalid metric %v: %s", md, err)
+		}
+		got = append(got, series{md.Name, md.Tags, md.Unit, md.Mtype, md.Value})
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].name != got[j].name {
+			return got[i].name < got[j].name
+		}
+		return got[i].tags[1] < got[j].tags[1]
+	})
+	if exp := expectedSeries(); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected series\n%v\ngot\n%v", exp, got)
+	}
+}
+
+func httpRequest(o *OTLP, body []byte, header ...string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/v1/metrics", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for i := 0; i < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	o.handle(w, req)
+	return w
+}
+
+func TestExportHTTP(t *testing.T) {
+	o, h := newTestOTLP()
+	data := testRequest(t)
+	if w := httpRequest(o, data); w.Code != 200 {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	checkSeries(t, h)
+
+	// now that the ids are known, the points are processed as MetricPoint
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(data)
+	zw.Close()
+	if w := httpRequest(o, gz.Bytes(), "Content-Encoding", "gzip"); w.Code != 200 {
+		t.Fatalf("expected status 200 for a gzip compressed request, got %d: %s", w.Code, w.Body.String())
+	}
+	if len(h.md) != 9 || len(h.points) != 9 {
+		t.Fatalf("expected 9 MetricData and 9 MetricPoint, got %d and %d", len(h.md), len(h.points))
+	}
+
+	if w := httpRequest(o, data, "Content-Type", "application/json"); w.Code != 415 {
+		t.Fatalf("expected status 415 for a JSON request, got %d", w.Code)
+	}
+	if w := httpRequest(o, data[:len(data)-3]); w.Code != 400 {
+		t.Fatalf("expected status 400 for a truncated request, got %d", w.Code)
+	}
+	unnamed, _ := proto.Marshal(&pbExportRequest{ResourceMetrics: []*pbResourceMetrics{{ScopeMetrics: []*pbScopeMetrics{{Metrics: []*pbMetric{
+		{Name: "a", Gauge: &pbSum{DataPoints: []*pbNumberDataPoint{{TimeUnixNano: testTime, AsDouble: float(1)}}}},
+		{Gauge: &pbSum{DataPoints: []*pbNumberDataPoint{{TimeUnixNano: testTime, AsDouble: float(1)}}}},
+	}}}}}})
+	if w := httpRequest(o, unnamed); w.Code != 400 || len(h.md)+len(h.points) != 18 {
+		t.Fatalf("expected a request with an unnamed metric to be refused as a whole, got %d", w.Code)
+	}
+
+	orgHeader = true
+	defer func() { orgHeader = false }()
+	if w := httpRequest(o, data, "x-org-id", "2"); w.Code != 200 || h.md[len(h.md)-1].OrgId != 2 {
+		t.Fatalf("expected the data to be stored under org 2, got %d", w.Code)
+	}
+}
+
+func TestExportGRPC(t *testing.T) {
+	o, h := newTestOTLP()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := o.newGRPCServer()
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure(), grpc.WithCompressor(grpc.NewGZIPCompressor()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	export := func(ctx context.Context, data []byte) error {
+		var resp []byte
+		return conn.Invoke(ctx, "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export", data, &resp, grpc.CallCustomCodec(rawCodec{}))
+	}
+
+	data := testRequest(t)
+	if err := export(context.Background(), data); err != nil {
+		t.Fatalf("export failed: %s", err)
+	}
+	checkSeries(t, h)
+	if err := export(context.Background(), data[:len(data)-3]); err == nil {
+		t.Fatalf("expected an error for a truncated request")
+	}
+
+	orgHeader = true
+	defer func() { orgHeader = false }()
+	o.ids = nil
+	if err := export(metadata.AppendToOutgoingContext(context.Background(), "x-org-id", "3"), data); err != nil || h.md[len(h.md)-1].OrgId != 3 {
+		t.Fatalf("expected the data to be stored under org 3, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package prometheus
+
+import (
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+)
+
+// IntervalGetter is anything that can return the interval for a new series, in seconds.
+// like for the carbon input, the index is hidden behind it, to keep the plugin decoupled and testable.
+type IntervalGetter interface {
+	// GetInterval returns the interval of the series if it is known, 0 otherwise
+	GetInterval(orgId uint32, name, nameWithTags string, tags []string) int
+	// DefaultInterval returns the interval for a series we know nothing about
+	DefaultInterval(name string) int
+}
+
+type IndexIntervalGetter struct {
+	idx idx.MetricIndex
+}
+
+func NewIndexIntervalGetter(idx idx.MetricIndex) IntervalGetter {
+	return IndexIntervalGetter{idx}
+}
+
+func (i IndexIntervalGetter) GetInterval(orgId uint32, name, nameWithTags string, tags []string) int {
+	if len(tags) == 0 {
+		for _, a := range i.idx.GetPath(orgId, name) {
+			return a.Interval
+		}
+		return 0
+	}
+	// tagged series are only in the tag index. the expressions also match series with more tags, so look for ours
+	expressions := make([]string, 0, len(tags)+1)
+	expressions = append(expressions, "name="+name)
+	expressions = append(expressions, tags...)
+	nodes, err := i.idx.FindByTag(orgId, expressions, 0)
+	if err != nil {
+		return 0
+	}
+	for _, n := range nodes {
+		if n.Path == nameWithTags && len(n.Defs) > 0 {
+			return n.Defs[0].Interval
+		}
+	}
+	return 0
+}
+
+// DefaultInterval returns the raw interval of the storage schema that matches the name
+func (i IndexIntervalGetter) DefaultInterval(name string) int {
+	_, schema := mdata.MatchSchema(name, 0)
+	return schema.Retentions[0].SecondsPerPoint
+}
@@ -1,138 +1,293 @@
+// package prometheus provides an input for the prometheus remote_write protocol
 package prometheus
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
 	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/crash"
 	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/stats"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/raintank/dur"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
 )
 
+// metric input.prometheus.stale_markers is a count of stale markers received, which are dropped
+var staleMarkers = stats.NewCounter32("input.prometheus.stale_markers")
+
+// metric input.prometheus.metrics_decode_err is a count of times a remote_write request failed to decode
+var metricsDecodeErr = stats.NewCounterRate32("input.prometheus.metrics_decode_err")
+
 var (
-	addr        string
-	Enabled     bool
-	partitionID int
+	addr            string
+	Enabled         bool
+	partitionID     int
+	idCacheSize     int
+	orgId           int
+	orgHeader       bool
+	intervalStr     string
+	orgIntervalsStr string
+
+	// interval of all series, in seconds. 0 to derive it per series
+	interval int
+	// interval of the series of specific orgs, in seconds
+	orgIntervals map[uint32]int
 )
 
-type prometheusWriteHandler struct {
+type Prometheus struct {
 	input.Handler
-	quit chan struct{}
+	server         *http.Server
+	intervalGetter IntervalGetter
+	ids            *input.IDCache
 }
 
-func New() *prometheusWriteHandler {
-	return &prometheusWriteHandler{}
+func New() *Prometheus {
+	return &Prometheus{
+		ids: input.NewIDCache("prometheus", idCacheSize),
+	}
 }
 
-func (p *prometheusWriteHandler) Name() string {
+func (p *Prometheus) Name() string {
 	return "prometheus"
 }
 
-func (p *prometheusWriteHandler) Start(handler input.Handler, fatal chan struct{}) error {
+func (p *Prometheus) IntervalGetter(i IntervalGetter) {
+	p.intervalGetter = i
+}
+
+func (p *Prometheus) Start(handler input.Handler, fatal chan struct{}) error {
 	p.Handler = handler
-	p.quit = fatal
-	ConfigSetup()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Error(4, "prometheus-in: %s", err.Error())
+		return err
+	}
+	log.Info("prometheus-in: listening on %v/write", addr)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/write", p.handle)
-	server := http.Server{
-		Addr:    addr,
+	p.server = &http.Server{
 		Handler: mux,
 	}
-	go server.ListenAndServe()
+	go func() {
+		err := p.server.Serve(l)
+		if err != http.ErrServerClosed {
+			log.Error(4, "prometheus-in: %s", err.Error())
+			close(fatal)
+		}
+	}()
 	return nil
 }
 
-func (p *prometheusWriteHandler) MaintainPriority() {
+func (p *Prometheus) MaintainPriority() {
 	cluster.Manager.SetPriority(0)
 }
 
-func (p *prometheusWriteHandler) ExplainPriority() interface{} {
+func (p *Prometheus) ExplainPriority() interface{} {
 	return "prometheus-in: priority=0 (always in sync)"
 }
 
-func (p *prometheusWriteHandler) Stop() {
+func (p *Prometheus) Stop() {
 	log.Info("prometheus-in: shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.server.Shutdown(ctx)
+}
+
+func (p *Prometheus) handle(w http.ResponseWriter, req *http.Request) {
+	state := func() interface{} {
+		return map[string]interface{}{"remoteAddr": req.RemoteAddr, "contentLength": req.ContentLength}
+	}
+	if crash.Run("input.prometheus", state, func() { p.write(w, req) }) {
+		w.WriteHeader(500)
+		w.Write([]byte("internal error"))
+	}
 }
 
-func (p *prometheusWriteHandler) handle(w http.ResponseWriter, req *http.Request) {
-	if req.Body != nil {
-		defer req.Body.Close()
-		compressed, err := ioutil.ReadAll(req.Body)
+func (p *Prometheus) write(w http.ResponseWriter, req *http.Request) {
+	if req.Body == nil {
+		w.WriteHeader(400)
+		w.Write([]byte("no data"))
+		return
+	}
+	defer req.Body.Close()
 
-		if err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte(fmt.Sprintf("Read Error, %v", err)))
-			log.Error(3, "Read Error, %v", err)
-			return
+	org := uint32(orgId)
+	if orgHeader {
+		if s := req.Header.Get("x-org-id"); s != "" {
+			o, err := strconv.ParseUint(s, 10, 32)
+			if err != nil || o == 0 {
+				w.WriteHeader(400)
+				w.Write([]byte("bad org-id"))
+				return
+			}
+			org = uint32(o)
 		}
-		reqBuf, err := snappy.Decode(nil, compressed)
-		if err != nil {
+	}
+
+	compressed, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Read Error, %v", err)))
+		log.Error(3, "prometheus-in: Read Error, %v", err)
+		return
+	}
+	reqBuf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		metricsDecodeErr.Inc()
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Decode Error, %v", err)))
+		log.Error(3, "prometheus-in: Decode Error, %v", err)
+		return
+	}
+	var wr prompb.WriteRequest
+	if err := proto.Unmarshal(reqBuf, &wr); err != nil {
+		metricsDecodeErr.Inc()
+		w.WriteHeader(400)
+		w.Write([]byte(fmt.Sprintf("Unmarshal Error, %v", err)))
+		log.Error(3, "prometheus-in: Unmarshal Error, %v", err)
+		return
+	}
+
+	// check all series before we process any, so that a bad request is refused as a whole
+	for _, ts := range wr.Timeseries {
+		if seriesName(ts) == "" {
 			w.WriteHeader(400)
-			w.Write([]byte(fmt.Sprintf("Decode Error, %v", err)))
-			log.Error(3, "Decode Error, %v", err)
+			w.Write([]byte("invalid metric received: __name__ label can not equal \"\""))
+			log.Warn("prometheus-in: metric received with empty name: %v", ts.String())
 			return
 		}
+	}
+	for _, ts := range wr.Timeseries {
+		p.processSeries(org, ts)
+	}
+	w.Write([]byte("ok"))
+}
 
-		var req prompb.WriteRequest
-		if err := proto.Unmarshal(reqBuf, &req); err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte(fmt.Sprintf("Unmarshal Error, %v", err)))
-			log.Error(3, "Unmarshal Error, %v", err)
-			return
+func seriesName(ts *prompb.TimeSeries) string {
+	for _, l := range ts.Labels {
+		if l.Name == model.MetricNameLabel {
+			return l.Value
 		}
+	}
+	return ""
+}
 
-		for _, ts := range req.Timeseries {
-			var name string
-			var tagSet []string
+// processSeries maps the series to a metrictank series with tags, and processes its samples
+func (p *Prometheus) processSeries(org uint32, ts *prompb.TimeSeries) {
+	var name string
+	tags := make([]string, 0, len(ts.Labels))
+	for _, l := range ts.Labels {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+		} else {
+			tags = append(tags, l.Name+"="+l.Value)
+		}
+	}
+	// so that the key is the name with tags, as the index has it
+	sort.Strings(tags)
+	nameWithTags := name
+	if len(tags) > 0 {
+		nameWithTags += ";" + strings.Join(tags, ";")
+	}
+	key := strconv.FormatUint(uint64(org), 10) + ":" + nameWithTags
 
-			for _, l := range ts.Labels {
-				if l.Name == model.MetricNameLabel {
-					name = l.Value
-				} else {
-					tagSet = append(tagSet, l.Name+"="+l.Value)
-				}
-			}
-			if name != "" {
-				for _, sample := range ts.Samples {
-					md := &schema.MetricData{
-						Name:     name,
-						Interval: 15,
-						Value:    sample.Value,
-						Unit:     "unknown",
-						Time:     (sample.Timestamp / 1000),
-						Mtype:    "gauge",
-						Tags:     tagSet,
-						OrgId:    1,
-					}
-					md.SetId()
-					p.ProcessMetricData(md, int32(partitionID))
-				}
-			} else {
-				w.WriteHeader(400)
-				w.Write([]byte("invalid metric received: __name__ label can not equal \"\""))
-				log.Warn("prometheus metric received with empty name: %v", ts.String())
-				return
+	var mdInterval int
+	for _, sample := range ts.Samples {
+		if value.IsStaleNaN(sample.Value) {
+			// prometheus marks series that disappeared from their target. we don't need them to know that
+			staleMarkers.Inc()
+			continue
+		}
+		// for series we've seen before, we know the id, so we don't need a MetricData
+		if id, ok := p.ids.Get(key); ok {
+			point := schema.MetricPoint{MKey: id, Value: sample.Value, Time: uint32(sample.Timestamp / 1000)}
+			if p.ProcessMetricPoint(point, msg.FormatMetricPoint, int32(partitionID)) {
+				continue
 			}
+			// the series is no longer in the index
+			p.ids.Del(key)
 		}
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-			return
+		if mdInterval == 0 {
+			mdInterval = p.getInterval(org, name, nameWithTags, tags, ts.Samples)
 		}
-		w.Write([]byte("ok"))
-		return
+		md := &schema.MetricData{
+			Name:     name,
+			Interval: mdInterval,
+			Value:    sample.Value,
+			Unit:     "unknown",
+			Time:     sample.Timestamp / 1000,
+			Mtype:    "gauge",
+			Tags:     tags,
+			OrgId:    int(org),
+		}
+		md.SetId()
+		if id, err := schema.MKeyFromString(md.Id); err == nil {
+			p.ids.Add(key, id)
+		}
+		p.ProcessMetricData(md, int32(partitionID))
+	}
+}
+
+// getInterval returns the interval of a series that we don't know the id of.
+// as the interval is part of the id, it must be the same for all points of the series, so in auto mode,
+// we prefer the interval of the series in the index. new series get the interval their samples are spaced at,
+// or if there are not enough of them in the request, the raw interval of their storage schema
+func (p *Prometheus) getInterval(org uint32, name, nameWithTags string, tags []string, samples []*prompb.Sample) int {
+	if i, ok := orgIntervals[org]; ok {
+		return i
+	}
+	if interval != 0 {
+		return interval
 	}
-	w.WriteHeader(400)
-	w.Write([]byte("no data"))
+	if p.intervalGetter == nil {
+		return 15
+	}
+	if i := p.intervalGetter.GetInterval(org, name, nameWithTags, tags); i != 0 {
+		return i
+	}
+	if i := sampleInterval(samples); i != 0 {
+		return i
+	}
+	return p.intervalGetter.DefaultInterval(name)
+}
+
+// sampleInterval returns the smallest spacing of the samples in seconds, 0 if there are less than 2 samples
+func sampleInterval(samples []*prompb.Sample) int {
+	var min int64
+	for i := 1; i < len(samples); i++ {
+		delta := samples[i].Timestamp - samples[i-1].Timestamp
+		if delta > 0 && (min == 0 || delta < min) {
+			min = delta
+		}
+	}
+	if min == 0 {
+		return 0
+	}
+	// scrapes are not exactly on time, so round to whole seconds
+	if secs := int((min + 500) / 1000); secs > 0 {
+		return secs
+	}
+	return 1
 }
 
 func ConfigSetup() {
@@ -140,12 +295,85 @@ func ConfigSetup() {
 	inPrometheus.BoolVar(&Enabled, "enabled", false, "")
 	inPrometheus.StringVar(&addr, "addr", ":8000", "http listen address")
 	inPrometheus.IntVar(&partitionID, "partition", 0, "partition Id.")
+	inPrometheus.IntVar(&idCacheSize, "id-cache-size", 100000, "max number of series to remember the id of, so that their subsequent points skip generating it. 0 disables")
+	inPrometheus.IntVar(&orgId, "org", 1, "org that the data is stored under")
+	inPrometheus.BoolVar(&orgHeader, "org-header", false, "take the org from the x-org-id header of the request, if it has one, e.g. when an authenticating proxy sets it. otherwise org is used")
+	inPrometheus.StringVar(&intervalStr, "interval", "auto", "interval of the series. auto to use the interval of the series in the index, or for new series, the spacing of their samples or the raw interval of their storage schema")
+	inPrometheus.StringVar(&orgIntervalsStr, "org-intervals", "", "interval of the series of specific orgs, as a comma separated list of org:interval, e.g. 1:15s,2:1min. overrides interval")
 	globalconf.Register("prometheus-in", inPrometheus)
 }
 
+func parseInterval(s string) (int, error) {
+	if s == "auto" {
+		return 0, nil
+	}
+	i, err := dur.ParseNDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return int(i), nil
+}
+
+func parseOrgIntervals(s string) (map[uint32]int, error) {
+	intervals := make(map[uint32]int)
+	for _, oi := range strings.Split(s, ",") {
+		oi = strings.TrimSpace(oi)
+		if oi == "" {
+			continue
+		}
+		parts := strings.Split(oi, ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid org interval %q: must be org:interval", oi)
+		}
+		org, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || org == 0 {
+			return nil, fmt.Errorf("invalid org in %q", oi)
+		}
+		i, err := dur.ParseNDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval in %q: %s", oi, err)
+		}
+		if _, ok := intervals[uint32(org)]; ok {
+			return nil, fmt.Errorf("org %d is given more than once", org)
+		}
+		intervals[uint32(org)] = int(i)
+	}
+	return intervals, nil
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if orgId < 1 {
+		findings = append(findings, conf.NewError("prometheus-in.org", "must be at least 1"))
+	}
+	if _, err := parseInterval(intervalStr); err != nil {
+		findings = append(findings, conf.NewError("prometheus-in.interval", "must be auto or a duration: %s", err))
+	}
+	if _, err := parseOrgIntervals(orgIntervalsStr); err != nil {
+		findings = append(findings, conf.NewError("prometheus-in.org-intervals", "%s", err))
+	}
+	return findings
+}
+
 func ConfigProcess() {
 	if !Enabled {
 		return
 	}
+	if orgId < 1 {
+		log.Fatal(4, "prometheus-in: org must be at least 1")
+	}
+	var err error
+	interval, err = parseInterval(intervalStr)
+	if err != nil {
+		log.Fatal(4, "prometheus-in: interval must be auto or a duration: %s", err)
+	}
+	orgIntervals, err = parseOrgIntervals(orgIntervalsStr)
+	if err != nil {
+		log.Fatal(4, "prometheus-in: org-intervals: %s", err)
+	}
 	cluster.Manager.SetPartitions([]int32{int32(partitionID)})
 }
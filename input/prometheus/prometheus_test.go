@@ -0,0 +1,195 @@
+package prometheus
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/pkg/value"
+	"github.com/prometheus/prometheus/prompb"
+	schema "gopkg.in/raintank/schema.v1"
+	"gopkg.in/raintank/schema.v1/msg"
+)
+
+type fakeHandler struct {
+	md     []*schema.MetricData
+	points []schema.MetricPoint
+}
+
+func (h *fakeHandler) ProcessMetricData(md *schema.MetricData, partition int32) {
+	h.md = append(h.md, md)
+}
+
+func (h *fakeHandler) ProcessMetricPoint(point schema.MetricPoint, format msg.Format, partition int32) bool {
+	h.points = append(h.points, point)
+	return true
+}
+
+// fakeIntervalGetter knows the series in known, and gives all others 60s
+type fakeIntervalGetter struct {
+	known map[string]int
+}
+
+func (f fakeIntervalGetter) GetInterval(orgId uint32, name, nameWithTags string, tags []string) int {
+	return f.known[nameWithTags]
+}
+
+func (f fakeIntervalGetter) DefaultInterval(name string) int {
+	return 60
+}
+
+func writeRequest(t *testing.T, p *Prometheus, org string, series ...*prompb.TimeSeries) *httptest.ResponseRecorder {
+	buf, err := proto.Marshal(&prompb.WriteRequest{Timeseries: series})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, buf)))
+	if org != "" {
+		req.Header.Set("x-org-id", org)
+	}
+	w := httptest.NewRecorder()
+	p.handle(w, req)
+	return w
+}
+
+func series(samples []int64, labels ...string) *prompb.TimeSeries {
+	ts := &prompb.TimeSeries{}
+	for i := 0; i < len(labels); i += 2 {
+		ts.Labels = append(ts.Labels, &prompb.Label{Name: labels[i], Value: labels[i+1]})
+	}
+	for _, s := range samples {
+		ts.Samples = append(ts.Samples, &prompb.Sample{Timestamp: s, Value: 1})
+	}
+	return ts
+}
+
+func newTestPrometheus() (*Prometheus, *fakeHandler) {
+	orgId = 1
+	idCacheSize = 100
+	h := &fakeHandler{}
+	p := New()
+	p.Handler = h
+	p.IntervalGetter(fakeIntervalGetter{map[string]int{"known;job=a": 30}})
+	return p, h
+}
+
+func TestWrite(t *testing.T) {
+	p, h := newTestPrometheus()
+	w := writeRequest(t, p, "",
+		series([]int64{10000, 20000}, "job", "a", "__name__", "up", "instance", "x"),
+		series([]int64{10000}, "__name__", "known", "job", "a"),
+		series([]int64{10000}, "__name__", "new"),
+	)
+	if w.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	// the first point of each series is a MetricData, subsequent ones use the cached id
+	if len(h.md) != 3 || len(h.points) != 1 {
+		t.Fatalf("expected 3 MetricData and 1 MetricPoint, got %d and %d", len(h.md), len(h.points))
+	}
+	exp := []struct {
+		name     string
+		tags     []string
+		interval int
+	}{
+		{"up", []string{"instance=x", "job=a"}, 10},
+		{"known", []string{"job=a"}, 30},
+		{"new", []string{}, 60},
+	}
+	for i, e := range exp {
+		md := h.md[i]
+		if md.Name != e.name || md.OrgId != 1 || md.Interval != e.interval || len(md.Tags) != len(e.tags) {
+			t.Fatalf("series %d: expected %s %v interval %d, got %+v", i, e.name, e.tags, e.interval, md)
+		}
+		for j := range e.tags {
+			if md.Tags[j] != e.tags[j] {
+				t.Fatalf("series %d: expected tags %v, got %v", i, e.tags, md.Tags)
+			}
+		}
+	}
+	if h.points[0].MKey.String() != h.md[0].Id || h.points[0].Time != 20 {
+		t.Fatalf("bad point %+v", h.points[0])
+	}
+}
+
+func TestWriteOrg(t *testing.T) {
+	p, h := newTestPrometheus()
+	orgHeader = true
+	orgIntervals = map[uint32]int{3: 15}
+	defer func() {
+		orgHeader = false
+		orgIntervals = nil
+	}()
+
+	writeRequest(t, p, "", series([]int64{10000}, "__name__", "up"))
+	writeRequest(t, p, "3", series([]int64{10000}, "__name__", "up"))
+	if len(h.md) != 2 || h.md[0].OrgId != 1 || h.md[1].OrgId != 3 || h.md[1].Interval != 15 {
+		t.Fatalf("expected the series for org 1 and org 3 with interval 15, got %+v %+v", h.md[0], h.md[1])
+	}
+	if h.md[0].Id == h.md[1].Id {
+		t.Fatalf("series of different orgs must have different ids")
+	}
+	if w := writeRequest(t, p, "abc", series([]int64{10000}, "__name__", "up")); w.Code != 400 {
+		t.Fatalf("expected 400 for bad org, got %d", w.Code)
+	}
+}
+
+func TestWriteInvalid(t *testing.T) {
+	p, h := newTestPrometheus()
+	w := writeRequest(t, p, "",
+		series([]int64{10000}, "__name__", "up"),
+		series([]int64{10000}, "job", "a"),
+	)
+	if w.Code != 400 || len(h.md) != 0 {
+		t.Fatalf("expected 400 and no data processed, got %d and %d", w.Code, len(h.md))
+	}
+}
+
+func TestWriteStaleMarkers(t *testing.T) {
+	p, h := newTestPrometheus()
+	ts := series([]int64{10000, 20000}, "__name__", "up")
+	ts.Samples[1].Value = math.Float64frombits(value.StaleNaN)
+	writeRequest(t, p, "", ts)
+	if len(h.md) != 1 || len(h.points) != 0 {
+		t.Fatalf("expected the stale marker to be dropped, got %d MetricData and %d MetricPoints", len(h.md), len(h.points))
+	}
+}
+
+func TestSampleInterval(t *testing.T) {
+	cases := []struct {
+		ts  []int64
+		exp int
+	}{
+		{nil, 0},
+		{[]int64{1000}, 0},
+		{[]int64{1000, 1000}, 0},
+		{[]int64{1000, 16020}, 15},
+		{[]int64{0, 59700, 119800, 134900}, 15},
+		{[]int64{0, 200}, 1},
+	}
+	for _, c := range cases {
+		var samples []*prompb.Sample
+		for _, ts := range c.ts {
+			samples = append(samples, &prompb.Sample{Timestamp: ts})
+		}
+		if got := sampleInterval(samples); got != c.exp {
+			t.Errorf("sampleInterval(%v): expected %d, got %d", c.ts, c.exp, got)
+		}
+	}
+}
+
+func TestParseOrgIntervals(t *testing.T) {
+	got, err := parseOrgIntervals("1:15s, 2:1min")
+	if err != nil || len(got) != 2 || got[1] != 15 || got[2] != 60 {
+		t.Fatalf("unexpected result %v %v", got, err)
+	}
+	for _, s := range []string{"1", "0:10s", "a:10s", "1:abc", "1:10s,1:20s"} {
+		if _, err := parseOrgIntervals(s); err == nil {
+			t.Errorf("expected error for %q", s)
+		}
+	}
+}
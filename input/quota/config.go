@@ -0,0 +1,104 @@
+package quota
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+const (
+	actionReject = "reject"
+	actionSample = "sample"
+)
+
+var (
+	Enabled         bool
+	pointsPerSecond int
+	maxSeries       int
+	action          string
+	overridesStr    string
+	overrides       map[uint32]limits
+)
+
+// limits of an org. 0 means no limit
+type limits struct {
+	pointsPerSecond int
+	maxSeries       int
+}
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "enforce per org limits on the points and series that are ingested. limits apply per instance, to the partitions it consumes")
+	fs.IntVar(&pointsPerSecond, "points-per-second", 0, "max points per second that an org may send. 0 for no limit")
+	fs.IntVar(&maxSeries, "max-series", 0, "max number of series that an org may have in the index. points of new series are rejected once it's reached. 0 for no limit")
+	fs.StringVar(&action, "action", actionReject, "what to do with points when an org exceeds points-per-second. reject: drop the points that exceed the limit within every second. sample: keep a random sample of all points of the org, so all of its series keep getting some data")
+	fs.StringVar(&overridesStr, "overrides", "", "limits of specific orgs, as a comma separated list of org:points-per-second:max-series, e.g. 1:100000:500000,2:0:1000")
+	globalconf.Register("quota", fs)
+}
+
+func parseOverrides(s string) (map[uint32]limits, error) {
+	overrides := make(map[uint32]limits)
+	for _, override := range strings.Split(s, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		parts := strings.Split(override, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid override %q: must be org:points-per-second:max-series", override)
+		}
+		org, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid org in override %q: %s", override, err)
+		}
+		var l limits
+		if l.pointsPerSecond, err = strconv.Atoi(parts[1]); err != nil || l.pointsPerSecond < 0 {
+			return nil, fmt.Errorf("invalid points-per-second in override %q", override)
+		}
+		if l.maxSeries, err = strconv.Atoi(parts[2]); err != nil || l.maxSeries < 0 {
+			return nil, fmt.Errorf("invalid max-series in override %q", override)
+		}
+		if _, ok := overrides[uint32(org)]; ok {
+			return nil, fmt.Errorf("org %d is given more than once", org)
+		}
+		overrides[uint32(org)] = l
+	}
+	return overrides, nil
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if pointsPerSecond < 0 {
+		findings = append(findings, conf.NewError("quota.points-per-second", "can't be negative"))
+	}
+	if maxSeries < 0 {
+		findings = append(findings, conf.NewError("quota.max-series", "can't be negative"))
+	}
+	if action != actionReject && action != actionSample {
+		findings = append(findings, conf.NewError("quota.action", "must be %s or %s, not %q", actionReject, actionSample, action))
+	}
+	if _, err := parseOverrides(overridesStr); err != nil {
+		findings = append(findings, conf.NewError("quota.overrides", "%s", err))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	if Enabled {
+		overrides, _ = parseOverrides(overridesStr)
+	}
+}
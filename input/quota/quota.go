@@ -0,0 +1,206 @@
+// Package quota enforces per org limits on ingestion, to protect multi-tenant clusters from orgs that send
+// far more points or series than expected.
+package quota
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/stats"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// the series of the orgs are counted in the index this often. in between, the added series are counted as they come in
+const refreshInterval = 30 * time.Second
+
+// Quota tracks the points and series that orgs send, and tells which ones exceed their limits.
+// all methods are nil-safe: a nil Quota allows everything.
+type Quota struct {
+	index     idx.MetricIndex
+	defaults  limits
+	overrides map[uint32]limits
+	sample    bool
+	now       func() time.Time
+
+	sync.RWMutex // protects orgs
+	orgs         map[uint32]*org
+}
+
+// org tracks the ingestion of an org with limits
+type org struct {
+	limits
+	series int32 // in the index. accessed with atomics
+
+	sync.Mutex // protects the fields below
+	second     int64
+	received   int // in the current second
+	accepted   int // in the current second
+	prev       int // received in the previous second
+	rand       *rand.Rand
+
+	pointsRejected *stats.Counter32
+	seriesRejected *stats.Counter32
+	seriesGauge    *stats.Gauge32
+}
+
+// New returns the quota as configured, which counts the series in the given index. or nil if it's disabled
+func New(index idx.MetricIndex) *Quota {
+	if !Enabled {
+		return nil
+	}
+	q := newQuota(index, limits{pointsPerSecond, maxSeries}, overrides, action == actionSample)
+	q.refresh()
+	go q.run()
+	return q
+}
+
+func newQuota(index idx.MetricIndex, defaults limits, overrides map[uint32]limits, sample bool) *Quota {
+	return &Quota{
+		index:     index,
+		defaults:  defaults,
+		overrides: overrides,
+		sample:    sample,
+		now:       time.Now,
+		orgs:      make(map[uint32]*org),
+	}
+}
+
+func newOrg(id uint32, l limits) *org {
+	return &org{
+		limits: l,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano() + int64(id))),
+		// metric input.quota.%d.points_rejected is how many points of the org were rejected because it exceeded its points per second
+		pointsRejected: stats.NewCounter32(fmt.Sprintf("input.quota.%d.points_rejected", id)),
+		// metric input.quota.%d.series_rejected is how many points of new series of the org were rejected because it reached its max series
+		seriesRejected: stats.NewCounter32(fmt.Sprintf("input.quota.%d.series_rejected", id)),
+		// metric input.quota.%d.series is how many series the org has in the index, for orgs with limits
+		seriesGauge: stats.NewGauge32(fmt.Sprintf("input.quota.%d.series", id)),
+	}
+}
+
+// org returns the tracker of the org, or nil if it has no limits
+func (q *Quota) org(id uint32) *org {
+	q.RLock()
+	o, ok := q.orgs[id]
+	q.RUnlock()
+	if ok {
+		return o
+	}
+	l, ok := q.overrides[id]
+	if !ok {
+		l = q.defaults
+	}
+	q.Lock()
+	defer q.Unlock()
+	if o, ok := q.orgs[id]; ok {
+		return o
+	}
+	// also remember the orgs without limits, so we don't need to look them up again
+	if l.pointsPerSecond != 0 || l.maxSeries != 0 {
+		o = newOrg(id, l)
+	}
+	q.orgs[id] = o
+	return o
+}
+
+// AllowPoint returns whether a point of the org may be ingested, given its points per second.
+// rejected points are counted.
+func (q *Quota) AllowPoint(orgId uint32) bool {
+	if q == nil {
+		return true
+	}
+	o := q.org(orgId)
+	if o == nil || o.pointsPerSecond == 0 {
+		return true
+	}
+	return o.allowPoint(q.now().Unix(), q.sample)
+}
+
+func (o *org) allowPoint(now int64, sample bool) bool {
+	o.Lock()
+	if now != o.second {
+		if now == o.second+1 {
+			o.prev = o.received
+		} else {
+			o.prev = 0
+		}
+		o.second, o.received, o.accepted = now, 0, 0
+	}
+	o.received++
+	ok := o.accepted < o.pointsPerSecond
+	// while the org sends more than its limit, keep a random sample of all of its points, rather than the first ones of every second
+	if ok && sample && o.prev > o.pointsPerSecond {
+		ok = o.rand.Intn(o.prev) < o.pointsPerSecond
+	}
+	if ok {
+		o.accepted++
+	}
+	o.Unlock()
+	if !ok {
+		o.pointsRejected.Inc()
+	}
+	return ok
+}
+
+// AllowSeries returns whether a point of the series may be ingested, given the max series of its org:
+// once the org has reached it, only points of series that are in the index are. rejected points are counted.
+// concurrent new series may exceed the max by a little.
+func (q *Quota) AllowSeries(key schema.MKey) bool {
+	if q == nil {
+		return true
+	}
+	o := q.org(key.Org)
+	if o == nil || o.maxSeries == 0 || int(atomic.LoadInt32(&o.series)) < o.maxSeries {
+		return true
+	}
+	if _, ok := q.index.Get(key); ok {
+		return true
+	}
+	o.seriesRejected.Inc()
+	return false
+}
+
+// SeriesAdded records that a series of the org was added to the index
+func (q *Quota) SeriesAdded(orgId uint32) {
+	if q == nil {
+		return
+	}
+	if o := q.org(orgId); o != nil {
+		o.seriesGauge.SetUint32(uint32(atomic.AddInt32(&o.series, 1)))
+	}
+}
+
+func (q *Quota) run() {
+	ticker := time.NewTicker(refreshInterval)
+	for range ticker.C {
+		q.refresh()
+	}
+}
+
+// refresh counts the series of the orgs in the index, which also accounts for the series that were pruned or deleted
+func (q *Quota) refresh() {
+	counts := make(map[uint32]int32)
+	q.index.Count(func(a idx.Archive) bool {
+		counts[a.OrgId]++
+		return false
+	})
+	for id, count := range counts {
+		if o := q.org(id); o != nil {
+			atomic.StoreInt32(&o.series, count)
+			o.seriesGauge.SetUint32(uint32(count))
+		}
+	}
+	// orgs that don't have any series anymore
+	q.RLock()
+	for id, o := range q.orgs {
+		if _, ok := counts[id]; !ok && o != nil {
+			atomic.StoreInt32(&o.series, 0)
+			o.seriesGauge.SetUint32(0)
+		}
+	}
+	q.RUnlock()
+}
@@ -0,0 +1,118 @@
+package quota
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx/memory"
+	"github.com/grafana/metrictank/mdata"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestParseOverrides(t *testing.T) {
+	o, err := parseOverrides(" 1:100:0, 2:0:1000,")
+	if err != nil {
+		t.Fatalf("failed to parse overrides: %s", err)
+	}
+	if len(o) != 2 || o[1] != (limits{100, 0}) || o[2] != (limits{0, 1000}) {
+		t.Fatalf("unexpected overrides %v", o)
+	}
+	for _, s := range []string{"1:100", "a:1:1", "1:-1:0", "1:1:1,1:2:2"} {
+		if _, err := parseOverrides(s); err == nil {
+			t.Fatalf("expected error for overrides %q", s)
+		}
+	}
+}
+
+func testQuota(defaults limits, overrides map[uint32]limits, sample bool, now *int64) *Quota {
+	mdata.SetSingleSchema(conf.NewRetentionMT(10, 100, 600, 10, true))
+	mdata.SetSingleAgg(conf.Avg)
+	q := newQuota(memory.New(), defaults, overrides, sample)
+	q.now = func() time.Time { return time.Unix(*now, 0) }
+	return q
+}
+
+func allowed(q *Quota, org uint32, points int) []int {
+	var ok []int
+	for i := 0; i < points; i++ {
+		if q.AllowPoint(org) {
+			ok = append(ok, i)
+		}
+	}
+	return ok
+}
+
+func TestAllowPointReject(t *testing.T) {
+	now := int64(1000)
+	q := testQuota(limits{pointsPerSecond: 10}, map[uint32]limits{2: {}}, false, &now)
+
+	if ok := allowed(q, 1, 15); len(ok) != 10 || ok[9] != 9 {
+		t.Fatalf("expected the first 10 points to be allowed, got %v", ok)
+	}
+	now++
+	if ok := allowed(q, 1, 15); len(ok) != 10 {
+		t.Fatalf("expected 10 points to be allowed in the next second, got %v", ok)
+	}
+	// org 2 has no limits
+	if ok := allowed(q, 2, 15); len(ok) != 15 {
+		t.Fatalf("expected all points of an org without limit to be allowed, got %v", ok)
+	}
+	var nilQuota *Quota
+	if !nilQuota.AllowPoint(1) {
+		t.Fatal("expected nil quota to allow all points")
+	}
+}
+
+func TestAllowPointSample(t *testing.T) {
+	now := int64(1000)
+	q := testQuota(limits{pointsPerSecond: 10}, nil, true, &now)
+
+	allowed(q, 1, 100)
+	now++
+	// the previous second had 10 times the limit, so about 1 in 10 points are kept
+	ok := allowed(q, 1, 100)
+	if len(ok) == 0 || len(ok) > 10 {
+		t.Fatalf("expected up to 10 points to be allowed, got %v", ok)
+	}
+	if ok[len(ok)-1] < 10 {
+		t.Fatalf("expected a sample of all points, not the first ones, got %v", ok)
+	}
+}
+
+func TestAllowSeries(t *testing.T) {
+	now := int64(1000)
+	q := testQuota(limits{maxSeries: 2}, map[uint32]limits{2: {maxSeries: 3}}, false, &now)
+	add := func(org int, name string) schema.MKey {
+		md := schema.MetricData{OrgId: org, Name: name, Interval: 10, Value: 1, Time: 100, Mtype: "gauge"}
+		md.SetId()
+		mkey, _ := schema.MKeyFromString(md.Id)
+		if q.AllowSeries(mkey) {
+			q.index.AddOrUpdate(mkey, &md, 0)
+			q.SeriesAdded(mkey.Org)
+		}
+		return mkey
+	}
+	a := add(1, "a")
+	add(1, "b")
+	c := add(1, "c")
+	add(2, "a")
+	add(2, "b")
+	d := add(2, "c")
+	if !q.AllowSeries(a) {
+		t.Fatal("expected series in the index to be allowed")
+	}
+	if q.AllowSeries(c) {
+		t.Fatal("expected new series of org 1 to be rejected at 2 series")
+	}
+	if !q.AllowSeries(d) {
+		t.Fatal("expected series of org 2 to be allowed up to 3 series")
+	}
+
+	// series that are deleted from the index are accounted for at the next refresh
+	q.index.Delete(1, "a")
+	q.refresh()
+	if q.org(1).series != 1 || !q.AllowSeries(c) {
+		t.Fatalf("expected org 1 to have 1 series after the refresh, and allow new ones. got %d", q.org(1).series)
+	}
+}
@@ -0,0 +1,101 @@
+package validation
+
+import (
+	"flag"
+	"regexp"
+	"strings"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+const (
+	actionReject   = "reject"
+	actionSanitize = "sanitize"
+)
+
+var (
+	Enabled             bool
+	nameCharset         string
+	maxTags             int
+	maxTagValueLength   int
+	forbiddenTagKeysStr string
+	action              string
+
+	disallowedName   *regexp.Regexp
+	forbiddenTagKeys []string
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("validation", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "check the names and tags of incoming series against the rules below before they are indexed")
+	fs.StringVar(&nameCharset, "name-charset", "", "characters allowed in metric names, as the contents of a regexp character class, e.g. a-zA-Z0-9_.:-. empty to allow all")
+	fs.IntVar(&maxTags, "max-tags", 0, "max number of tags of a series. 0 for no limit")
+	fs.IntVar(&maxTagValueLength, "max-tag-value-length", 0, "max length in bytes of tag values. 0 for no limit")
+	fs.StringVar(&forbiddenTagKeysStr, "forbidden-tag-keys", "", "comma separated list of tag keys that series may not have")
+	fs.StringVar(&action, "action", actionReject, "what to do with series that break a rule. reject: drop them. sanitize: fix them by replacing disallowed characters in the name with _, dropping forbidden and excess tags, and truncating tag values. note that sanitizing changes the id of the series")
+	globalconf.Register("validation", fs)
+}
+
+// disallowedNamePattern returns the pattern that matches a character that is not in the charset
+func disallowedNamePattern(charset string) (*regexp.Regexp, error) {
+	return regexp.Compile("[^" + charset + "]")
+}
+
+func parseTagKeys(s string) []string {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if nameCharset != "" {
+		if _, err := disallowedNamePattern(nameCharset); err != nil {
+			findings = append(findings, conf.NewError("validation.name-charset", "not a valid character class: %s", err))
+		}
+	}
+	if maxTags < 0 {
+		findings = append(findings, conf.NewError("validation.max-tags", "can't be negative"))
+	}
+	if maxTagValueLength < 0 {
+		findings = append(findings, conf.NewError("validation.max-tag-value-length", "can't be negative"))
+	}
+	for _, k := range parseTagKeys(forbiddenTagKeysStr) {
+		if k == "name" {
+			findings = append(findings, conf.NewError("validation.forbidden-tag-keys", "name is not a tag"))
+		}
+	}
+	if action != actionReject && action != actionSanitize {
+		findings = append(findings, conf.NewError("validation.action", "must be %s or %s, not %q", actionReject, actionSanitize, action))
+	}
+	if nameCharset == "" && maxTags == 0 && maxTagValueLength == 0 && forbiddenTagKeysStr == "" {
+		findings = append(findings, conf.NewWarning("validation.enabled", "no rules are set, so nothing is validated"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	if !Enabled {
+		return
+	}
+	if nameCharset != "" {
+		disallowedName, _ = disallowedNamePattern(nameCharset)
+	}
+	forbiddenTagKeys = parseTagKeys(forbiddenTagKeysStr)
+}
@@ -0,0 +1,184 @@
+// Package validation checks the names and tags of incoming series against rules before they are indexed,
+// such as the characters allowed in names and the number of tags, and rejects or sanitizes the series that break them.
+package validation
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/grafana/metrictank/stats"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric input.validation.rejected.name_charset is a count of metricdata rejected because their name has characters that are not allowed
+	rejectedNameCharset = stats.NewCounter32("input.validation.rejected.name_charset")
+	// metric input.validation.rejected.max_tags is a count of metricdata rejected because they have too many tags
+	rejectedMaxTags = stats.NewCounter32("input.validation.rejected.max_tags")
+	// metric input.validation.rejected.tag_value_length is a count of metricdata rejected because they have a tag value that is too long
+	rejectedTagValueLength = stats.NewCounter32("input.validation.rejected.tag_value_length")
+	// metric input.validation.rejected.forbidden_tag_key is a count of metricdata rejected because they have a forbidden tag
+	rejectedForbiddenTagKey = stats.NewCounter32("input.validation.rejected.forbidden_tag_key")
+	// metric input.validation.sanitized is a count of metricdata that broke a rule, and were sanitized
+	sanitizedMD = stats.NewCounter32("input.validation.sanitized")
+	// metric input.validation.aliases is the number of series of which the id was changed by sanitizing
+	aliasesGauge = stats.NewGauge32("input.validation.aliases")
+)
+
+// Validator checks incoming series against the rules, and rejects or sanitizes them.
+// Like enrichment, sanitizing gives a series a new id, so the validator remembers the id that each sanitized series
+// was sent with, so that subsequent MetricPoints, which only carry that id, can be routed to the sanitized series.
+// all methods are nil-safe: a nil Validator accepts everything.
+type Validator struct {
+	disallowedName    *regexp.Regexp // matches a character that is not allowed in names. nil to allow all
+	maxTags           int
+	maxTagValueLength int
+	forbiddenTagKeys  map[string]struct{}
+	sanitize          bool
+
+	sync.RWMutex // protects aliases
+	aliases      map[schema.MKey]schema.MKey
+}
+
+// New returns the validator as configured, or nil if it's disabled
+func New() *Validator {
+	if !Enabled {
+		return nil
+	}
+	return newValidator(disallowedName, maxTags, maxTagValueLength, forbiddenTagKeys, action == actionSanitize)
+}
+
+func newValidator(disallowedName *regexp.Regexp, maxTags, maxTagValueLength int, forbiddenTagKeys []string, sanitize bool) *Validator {
+	v := &Validator{
+		disallowedName:    disallowedName,
+		maxTags:           maxTags,
+		maxTagValueLength: maxTagValueLength,
+		forbiddenTagKeys:  make(map[string]struct{}),
+		sanitize:          sanitize,
+		aliases:           make(map[schema.MKey]schema.MKey),
+	}
+	for _, k := range forbiddenTagKeys {
+		v.forbiddenTagKeys[k] = struct{}{}
+	}
+	return v
+}
+
+// violation returns the counter of the first rule that the metricdata breaks, or nil if it breaks none
+func (v *Validator) violation(md *schema.MetricData) *stats.Counter32 {
+	if v.disallowedName != nil && v.disallowedName.MatchString(md.Name) {
+		return rejectedNameCharset
+	}
+	if v.maxTags > 0 && len(md.Tags) > v.maxTags {
+		return rejectedMaxTags
+	}
+	for _, tag := range md.Tags {
+		key, value := splitTag(tag)
+		if _, ok := v.forbiddenTagKeys[key]; ok {
+			return rejectedForbiddenTagKey
+		}
+		if v.maxTagValueLength > 0 && len(value) > v.maxTagValueLength {
+			return rejectedTagValueLength
+		}
+	}
+	return nil
+}
+
+// Validate checks the metricdata against the rules, and returns whether it may be ingested.
+// When sanitizing, it fixes a metricdata that breaks a rule instead of rejecting it, and regenerates its id.
+// the metricdata must be valid.
+func (v *Validator) Validate(md *schema.MetricData) bool {
+	if v == nil {
+		return true
+	}
+	violation := v.violation(md)
+	if violation == nil {
+		return true
+	}
+	if !v.sanitize {
+		violation.Inc()
+		return false
+	}
+
+	orig, err := schema.MKeyFromString(md.Id)
+	if err != nil {
+		// the caller will complain about the id
+		return true
+	}
+	if v.disallowedName != nil {
+		md.Name = v.disallowedName.ReplaceAllString(md.Name, "_")
+	}
+	md.Tags = v.sanitizeTags(md.Tags)
+	md.SetId()
+	sanitizedMD.Inc()
+	mkey, err := schema.MKeyFromString(md.Id)
+	if err != nil || mkey == orig {
+		return true
+	}
+
+	v.RLock()
+	alias, ok := v.aliases[orig]
+	v.RUnlock()
+	if ok && alias == mkey {
+		return true
+	}
+	v.Lock()
+	v.aliases[orig] = mkey
+	aliasesGauge.Set(len(v.aliases))
+	v.Unlock()
+	return true
+}
+
+// sanitizeTags returns the tags without the forbidden ones, with their values truncated, and at most maxTags of them
+func (v *Validator) sanitizeTags(in []string) []string {
+	var out []string
+	for _, tag := range in {
+		if v.maxTags > 0 && len(out) == v.maxTags {
+			break
+		}
+		key, value := splitTag(tag)
+		if _, ok := v.forbiddenTagKeys[key]; ok {
+			continue
+		}
+		if v.maxTagValueLength > 0 && len(value) > v.maxTagValueLength {
+			value = truncate(value, v.maxTagValueLength)
+			if value == "" {
+				continue
+			}
+			tag = key + "=" + value
+		}
+		out = append(out, tag)
+	}
+	return out
+}
+
+// Key returns the id of the sanitized series for the id that a series is sent with
+func (v *Validator) Key(mkey schema.MKey) schema.MKey {
+	if v == nil {
+		return mkey
+	}
+	v.RLock()
+	alias, ok := v.aliases[mkey]
+	v.RUnlock()
+	if ok {
+		return alias
+	}
+	return mkey
+}
+
+func splitTag(tag string) (string, string) {
+	i := strings.IndexByte(tag, '=')
+	if i < 0 {
+		return tag, ""
+	}
+	return tag[:i], tag[i+1:]
+}
+
+// truncate truncates s to at most max bytes, without splitting a multi-byte character
+func truncate(s string, max int) string {
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
@@ -0,0 +1,92 @@
+package validation
+
+import (
+	"reflect"
+	"testing"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func testMD(name string, tags ...string) *schema.MetricData {
+	md := &schema.MetricData{OrgId: 1, Name: name, Interval: 10, Value: 1, Time: 1, Mtype: "gauge", Tags: tags}
+	md.SetId()
+	return md
+}
+
+func testValidator(t *testing.T, sanitize bool) *Validator {
+	disallowed, err := disallowedNamePattern("a-z0-9_.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newValidator(disallowed, 2, 4, []string{"secret"}, sanitize)
+}
+
+func TestValidateReject(t *testing.T) {
+	v := testValidator(t, false)
+	cases := []struct {
+		md      *schema.MetricData
+		counter func() uint32
+	}{
+		{md: testMD("a.b", "host=web", "dc=eu")},
+		{md: testMD("a b"), counter: rejectedNameCharset.Peek},
+		{md: testMD("a.b", "a=1", "b=2", "c=3"), counter: rejectedMaxTags.Peek},
+		{md: testMD("a.b", "host=webserver"), counter: rejectedTagValueLength.Peek},
+		{md: testMD("a.b", "secret=x"), counter: rejectedForbiddenTagKey.Peek},
+	}
+	for i, c := range cases {
+		id := c.md.Id
+		var before uint32
+		if c.counter != nil {
+			before = c.counter()
+		}
+		if ok := v.Validate(c.md); ok != (c.counter == nil) {
+			t.Fatalf("case %d: expected accepted %t, got %t", i, c.counter == nil, ok)
+		}
+		if c.counter != nil && c.counter() != before+1 {
+			t.Fatalf("case %d: expected the rejection to be counted", i)
+		}
+		if c.md.Id != id {
+			t.Fatalf("case %d: expected the id not to change", i)
+		}
+	}
+}
+
+func TestValidateSanitize(t *testing.T) {
+	v := testValidator(t, true)
+	cases := []struct {
+		in  *schema.MetricData
+		exp *schema.MetricData
+	}{
+		{in: testMD("a.b", "host=web"), exp: testMD("a.b", "host=web")},
+		{in: testMD("a b/c"), exp: testMD("a_b_c")},
+		{in: testMD("a.b", "secret=x", "a=1", "b=2", "c=3"), exp: testMD("a.b", "a=1", "b=2")},
+		{in: testMD("a.b", "host=webserver"), exp: testMD("a.b", "host=webs")},
+		// multi-byte characters are not split
+		{in: testMD("a.b", "city=zürich", "mood=ok\U0001F600"), exp: testMD("a.b", "city=zür", "mood=ok")},
+	}
+	for i, c := range cases {
+		orig, _ := schema.MKeyFromString(c.in.Id)
+		if !v.Validate(c.in) {
+			t.Fatalf("case %d: expected the metricdata to be sanitized, not rejected", i)
+		}
+		if c.in.Name != c.exp.Name || !reflect.DeepEqual(c.in.Tags, c.exp.Tags) || c.in.Id != c.exp.Id {
+			t.Fatalf("case %d: expected %s %v (%s), got %s %v (%s)", i, c.exp.Name, c.exp.Tags, c.exp.Id, c.in.Name, c.in.Tags, c.in.Id)
+		}
+		exp, _ := schema.MKeyFromString(c.exp.Id)
+		if key := v.Key(orig); key != exp {
+			t.Fatalf("case %d: expected the original id to map to %s, got %s", i, exp, key)
+		}
+	}
+}
+
+func TestNilValidator(t *testing.T) {
+	var v *Validator
+	md := testMD("a b")
+	if !v.Validate(md) {
+		t.Fatalf("expected a nil validator to accept everything")
+	}
+	mkey, _ := schema.MKeyFromString(md.Id)
+	if v.Key(mkey) != mkey {
+		t.Fatalf("expected a nil validator not to change ids")
+	}
+}
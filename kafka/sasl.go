@@ -0,0 +1,24 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/secrets"
+)
+
+// SetSASL enables SASL/PLAIN authentication on the config.
+// the username and password may be secret references. they are resolved once: sarama only
+// uses them when connecting, so rotated credentials are picked up on restart.
+func SetSASL(config *sarama.Config, username, password string) error {
+	user, err := secrets.New(username)
+	if err != nil {
+		return err
+	}
+	pass, err := secrets.New(password)
+	if err != nil {
+		return err
+	}
+	config.Net.SASL.Enable = true
+	config.Net.SASL.User = user.Get()
+	config.Net.SASL.Password = pass.Get()
+	return nil
+}
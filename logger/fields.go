@@ -0,0 +1,99 @@
+// Package logger adds structured logging on top of the global logger: messages can carry fields
+// that identify what they are about, e.g. the request or kafka message being processed,
+// and can be written as json objects, so they can be correlated with traces and processed by log systems.
+package logger
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/raintank/worldping-api/pkg/log"
+	jaeger "github.com/uber/jaeger-client-go"
+)
+
+// Field is a key/value pair describing what a message is about
+type Field struct {
+	Key   string
+	Value string
+}
+
+// Fields are written in front of the message as "[key=value key2=value2] ",
+// from which the json writer extracts them again
+type Fields []Field
+
+// With returns the fields with the given field added
+func (f Fields) With(key string, value interface{}) Fields {
+	out := make(Fields, len(f), len(f)+1)
+	copy(out, f)
+	return append(out, Field{key, sanitize(fmt.Sprint(value))})
+}
+
+func (f Fields) String() string {
+	if len(f) == 0 {
+		return ""
+	}
+	parts := make([]string, len(f))
+	for i, field := range f {
+		parts[i] = field.Key + "=" + field.Value
+	}
+	return "[" + strings.Join(parts, " ") + "] "
+}
+
+// sanitize makes sure values can be parsed back out of the message
+func sanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == ']' || r == '=' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+type fieldsKey struct{}
+
+// WithFields returns a context that carries the given fields
+func WithFields(ctx context.Context, f Fields) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, f)
+}
+
+// FromContext returns the fields the context carries,
+// plus the id of the trace the context belongs to, if tracing is enabled
+func FromContext(ctx context.Context) Fields {
+	f, _ := ctx.Value(fieldsKey{}).(Fields)
+	if span := opentracing.SpanFromContext(ctx); span != nil {
+		if spanCtx, ok := span.Context().(jaeger.SpanContext); ok {
+			f = f.With("trace_id", spanCtx.TraceID().String())
+		}
+	}
+	return f
+}
+
+// RequestID returns the id of the request the context belongs to, if any
+func RequestID(ctx context.Context) string {
+	f, _ := ctx.Value(fieldsKey{}).(Fields)
+	for _, field := range f {
+		if field.Key == "request_id" {
+			return field.Value
+		}
+	}
+	return ""
+}
+
+func Debug(f Fields, format string, v ...interface{}) {
+	log.Debug("%s"+format, append([]interface{}{f}, v...)...)
+}
+
+func Info(f Fields, format string, v ...interface{}) {
+	log.Info("%s"+format, append([]interface{}{f}, v...)...)
+}
+
+func Warn(f Fields, format string, v ...interface{}) {
+	log.Warn("%s"+format, append([]interface{}{f}, v...)...)
+}
+
+// Error logs an error. like log.Error, skip is the number of stack frames to skip to find the caller.
+func Error(f Fields, skip int, format string, v ...interface{}) {
+	log.Error(skip+1, "%s"+format, append([]interface{}{f}, v...)...)
+}
@@ -0,0 +1,125 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+const (
+	formatText int32 = iota
+	formatJSON
+)
+
+var format = formatText
+
+func init() {
+	log.Register("metrictank", func() log.LoggerInterface {
+		return &Writer{
+			lg: stdlog.New(os.Stdout, "", 0),
+		}
+	})
+}
+
+// SetFormat sets the format of the messages written by the "metrictank" log adapter: text or json
+func SetFormat(f string) error {
+	switch f {
+	case "text":
+		atomic.StoreInt32(&format, formatText)
+	case "json":
+		atomic.StoreInt32(&format, formatJSON)
+	default:
+		return fmt.Errorf("invalid log format %q. must be text or json", f)
+	}
+	return nil
+}
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "critical", "fatal"}
+
+// Writer is a log adapter that writes messages to stdout, either as-is, like the console adapter,
+// or as json objects. the logger itself filters messages by level.
+type Writer struct {
+	lg *stdlog.Logger
+}
+
+func (w *Writer) Init(config string) error {
+	return nil
+}
+
+func (w *Writer) WriteMsg(msg string, skip int, level log.LogLevel) error {
+	if atomic.LoadInt32(&format) == formatText {
+		w.lg.Println(msg)
+		return nil
+	}
+	out, err := json.Marshal(parse(msg, level, time.Now()))
+	if err != nil {
+		return err
+	}
+	w.lg.Println(string(out))
+	return nil
+}
+
+func (w *Writer) Destroy() {}
+
+func (w *Writer) Flush() {}
+
+// parse turns a message as formatted by the logger into an object:
+// "[E] [file.go:12 func()] [key=value] message" has the level, caller (only for errors and worse),
+// fields and the actual message.
+func parse(msg string, level log.LogLevel, ts time.Time) map[string]string {
+	obj := map[string]string{
+		"time": ts.UTC().Format(time.RFC3339Nano),
+	}
+	if int(level) >= 0 && int(level) < len(levelNames) {
+		obj["level"] = levelNames[level]
+	}
+	if len(msg) >= 4 && msg[0] == '[' && msg[2] == ']' && msg[3] == ' ' {
+		msg = msg[4:]
+	}
+	if level >= log.ERROR {
+		if group, rest, ok := leadingGroup(msg); ok && strings.Contains(group, ".go:") {
+			obj["caller"] = group
+			msg = rest
+		}
+	}
+	if group, rest, ok := leadingGroup(msg); ok {
+		var fields [][2]string
+		for _, part := range strings.Split(group, " ") {
+			kv := strings.SplitN(part, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				fields = nil
+				break
+			}
+			fields = append(fields, [2]string{kv[0], kv[1]})
+		}
+		if fields != nil {
+			for _, kv := range fields {
+				// the fixed keys take precedence
+				if _, ok := obj[kv[0]]; !ok {
+					obj[kv[0]] = kv[1]
+				}
+			}
+			msg = rest
+		}
+	}
+	obj["msg"] = msg
+	return obj
+}
+
+// leadingGroup splits "[group] rest" into group and rest
+func leadingGroup(msg string) (string, string, bool) {
+	if !strings.HasPrefix(msg, "[") {
+		return "", "", false
+	}
+	end := strings.Index(msg, "] ")
+	if end == -1 {
+		return "", "", false
+	}
+	return msg[1:end], msg[end+2:], true
+}
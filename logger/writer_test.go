@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+func TestParse(t *testing.T) {
+	ts := time.Unix(1500000000, 0)
+	fields := Fields{}.With("request_id", "abc").With("partition", 3)
+	cases := []struct {
+		msg   string
+		level log.LogLevel
+		exp   map[string]string
+	}{
+		{
+			"[I] kafka-mdm: consuming",
+			log.INFO,
+			map[string]string{"level": "info", "msg": "kafka-mdm: consuming"},
+		},
+		{
+			fmt.Sprintf("[W] %sin: invalid metric", fields),
+			log.WARN,
+			map[string]string{"level": "warn", "msg": "in: invalid metric", "request_id": "abc", "partition": "3"},
+		},
+		{
+			fmt.Sprintf("[E] [graphite.go:12 renderMetrics()] %sHTTP Render failed", fields),
+			log.ERROR,
+			map[string]string{"level": "error", "caller": "graphite.go:12 renderMetrics()", "msg": "HTTP Render failed", "request_id": "abc", "partition": "3"},
+		},
+		{
+			// brackets that don't hold fields are part of the message
+			"[I] [foo bar] baz",
+			log.INFO,
+			map[string]string{"level": "info", "msg": "[foo bar] baz"},
+		},
+	}
+	for i, c := range cases {
+		c.exp["time"] = ts.UTC().Format(time.RFC3339Nano)
+		got := parse(c.msg, c.level, ts)
+		if len(got) != len(c.exp) {
+			t.Fatalf("case %d: expected %v, got %v", i, c.exp, got)
+		}
+		for k, v := range c.exp {
+			if got[k] != v {
+				t.Fatalf("case %d: expected %s=%q, got %q", i, k, v, got[k])
+			}
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	f := Fields{}.With("request_id", "a b]c=d")
+	if f.String() != "[request_id=a_b_c_d] " {
+		t.Fatalf("expected sanitized value, got %q", f.String())
+	}
+	if Fields(nil).String() != "" {
+		t.Fatalf("expected no prefix without fields")
+	}
+	ctx := WithFields(context.Background(), f)
+	if RequestID(ctx) != "a_b_c_d" {
+		t.Fatalf("expected request id from context, got %q", RequestID(ctx))
+	}
+	if RequestID(context.Background()) != "" {
+		t.Fatalf("expected no request id")
+	}
+}
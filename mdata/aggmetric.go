@@ -32,9 +32,11 @@ type AggMetric struct {
 	sync.RWMutex
 	Key             schema.AMKey
 	rob             *ReorderBuffer
-	CurrentChunkPos int    // element in []Chunks that is active. All others are either finished or nil.
-	NumChunks       uint32 // max size of the circular buffer
-	ChunkSpan       uint32 // span of individual chunks in seconds
+	CurrentChunkPos int            // element in []Chunks that is active. All others are either finished or nil.
+	NumChunks       uint32         // max size of the circular buffer
+	ChunkSpan       uint32         // span of individual chunks in seconds
+	Codec           chunk.Codec    // compression of the chunks when persisting them
+	Encoding        chunk.Encoding // how the points of the chunks are encoded
 	Chunks          []*chunk.Chunk
 	aggregators     []*Aggregator
 	dropFirstChunk  bool
@@ -43,6 +45,11 @@ type AggMetric struct {
 	lastSaveStart   uint32 // last chunk T0 that was added to the write Queue.
 	lastSaveFinish  uint32 // last chunk T0 successfully written to Cassandra.
 	lastWrite       uint32
+	partition       int32 // decides whether we save the chunks, see cluster.ClusterManager.IsPrimaryFor
+	// the current chunk may have points of a primary beyond the ones we consumed ourselves, see mergeStandby.
+	// points in between consumedTs and mergedTs are still passed on to the aggregators when they come in.
+	consumedTs uint32
+	mergedTs   uint32
 }
 
 // NewAggMetric creates a metric with given key, it retains the given number of chunks each chunkSpan seconds long
@@ -59,6 +66,8 @@ func NewAggMetric(store Store, cachePusher cache.CachePusher, key schema.AMKey,
 		store:          store,
 		Key:            key,
 		ChunkSpan:      ret.ChunkSpan,
+		Codec:          ret.Codec,
+		Encoding:       ret.Encoding,
 		NumChunks:      ret.NumChunks,
 		Chunks:         make([]*chunk.Chunk, 0, ret.NumChunks),
 		dropFirstChunk: dropFirstChunk,
@@ -78,6 +87,19 @@ func NewAggMetric(store Store, cachePusher cache.CachePusher, key schema.AMKey,
 	return &m
 }
 
+// setPartition sets the partition of the metric and of its rollups.
+// it must be called before the metric is in use.
+func (a *AggMetric) setPartition(partition int32) {
+	a.partition = partition
+	for _, agg := range a.aggregators {
+		for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+			if m != nil {
+				m.setPartition(partition)
+			}
+		}
+	}
+}
+
 // Sync the saved state of a chunk by its T0.
 func (a *AggMetric) SyncChunkSaveState(ts uint32) {
 	a.Lock()
@@ -88,7 +110,7 @@ func (a *AggMetric) SyncChunkSaveState(ts uint32) {
 	if ts > a.lastSaveStart {
 		a.lastSaveStart = ts
 	}
-	if LogLevel < 2 {
+	if LogLevel.Get() < 2 {
 		log.Debug("AM metric %s at chunk T0=%d has been saved.", a.Key, ts)
 	}
 }
@@ -135,6 +157,23 @@ func (a *AggMetric) SyncAggregatedChunkSaveState(ts uint32, consolidator consoli
 	}
 }
 
+// SyncSaveStateBefore marks the chunks that start before ts as saved, for the raw data as well as for the rollups,
+// so that they don't get saved. used when rebuilding chunks from data that may only cover the later part of them.
+func (a *AggMetric) SyncSaveStateBefore(ts uint32) {
+	if ts == 0 {
+		return
+	}
+	a.SyncChunkSaveState((ts - 1) - (ts-1)%a.ChunkSpan)
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+			if m != nil {
+				m.SyncSaveStateBefore(ts)
+			}
+		}
+	}
+}
+
 func (a *AggMetric) getChunk(pos int) *chunk.Chunk {
 	if pos < 0 || pos >= len(a.Chunks) {
 		panic(fmt.Sprintf("aggmetric %s queried for chunk %d out of %d chunks", a.Key, pos, len(a.Chunks)))
@@ -194,7 +233,7 @@ func (a *AggMetric) GetAggregated(consolidator consolidation.Consolidator, aggSp
 // * oldest point we have, so that if your query needs data before it, the caller knows when to query the store
 func (a *AggMetric) Get(from, to uint32) (Result, error) {
 	pre := time.Now()
-	if LogLevel < 2 {
+	if LogLevel.Get() < 2 {
 		log.Debug("AM %s Get(): %d - %d (%s - %s) span:%ds", a.Key, from, to, TS(from), TS(to), to-from-1)
 	}
 	if from >= to {
@@ -219,7 +258,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 
 	if len(a.Chunks) == 0 {
 		// we dont have any data yet.
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM %s Get(): no data for requested range.", a.Key)
 		}
 		return result, nil
@@ -239,7 +278,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 		//   only aware of older data and not the newer data in cassandra. this is unlikely
 		//   and it's better to not serve this scenario well in favor of the above case.
 		//   seems like a fair tradeoff anyway that you have to refill all the way first.
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM %s Get(): no data for requested range.", a.Key)
 		}
 		result.Oldest = from
@@ -271,7 +310,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 	// The first chunk is likely only a partial chunk. If we are not the primary node
 	// we should not serve data from this chunk, and should instead get the chunk from cassandra.
 	// if we are the primary node, then there is likely no data in Cassandra anyway.
-	if !cluster.Manager.IsPrimary() && oldestChunk.T0 == a.firstChunkT0 {
+	if !cluster.Manager.IsPrimaryFor(a.partition) && oldestChunk.T0 == a.firstChunkT0 {
 		oldestPos++
 		if oldestPos >= len(a.Chunks) {
 			oldestPos = 0
@@ -285,7 +324,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 
 	if to <= oldestChunk.T0 {
 		// the requested time range ends before any data we have.
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM %s Get(): no data for requested range", a.Key)
 		}
 		result.Oldest = oldestChunk.T0
@@ -330,7 +369,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 	// now just start at oldestPos and move through the Chunks circular Buffer to newestPos
 	for {
 		c := a.getChunk(oldestPos)
-		result.Iters = append(result.Iters, chunk.NewIter(c.Iter()))
+		result.Iters = append(result.Iters, c.Iter())
 
 		if oldestPos == newestPos {
 			break
@@ -350,7 +389,7 @@ func (a *AggMetric) Get(from, to uint32) (Result, error) {
 // this function must only be called while holding the lock
 func (a *AggMetric) addAggregators(ts uint32, val float64) {
 	for _, agg := range a.aggregators {
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM %s pushing %d,%f to aggregator %d", a.Key, ts, val, agg.span)
 		}
 		agg.Add(ts, val)
@@ -362,16 +401,13 @@ func (a *AggMetric) pushToCache(c *chunk.Chunk) {
 	go a.cachePusher.CacheIfHot(
 		a.Key,
 		0,
-		*chunk.NewBareIterGen(
-			c.Bytes(),
-			c.T0,
-			a.ChunkSpan,
-		),
+		*c.IterGen(a.ChunkSpan),
 	)
 }
 
 // write a chunk to persistent storage. This should only be called while holding a.Lock()
-func (a *AggMetric) persist(pos int) {
+// partial marks the chunk as not complete yet, see ChunkWriteRequest
+func (a *AggMetric) persist(pos int, partial bool) {
 	chunk := a.Chunks[pos]
 	pre := time.Now()
 
@@ -381,7 +417,9 @@ func (a *AggMetric) persist(pos int) {
 		// b) a primary failed and this node was promoted to be primary but metric consuming is lagging.
 		// c) chunk was persisted by GC (stale) and then new data triggered another persist call
 		// d) dropFirstChunk is enabled and this is the first chunk
-		log.Debug("AM persist(): duplicate persist call for chunk.")
+		if LogLevel.Get() < 2 {
+			log.Debug("AM persist(): duplicate persist call for chunk.")
+		}
 		return
 	}
 
@@ -395,6 +433,8 @@ func (a *AggMetric) persist(pos int) {
 		TTL:       a.ttl,
 		Chunk:     chunk,
 		Timestamp: time.Now(),
+		Partial:   partial,
+		Codec:     a.Codec,
 	}
 
 	// if we recently became the primary, there may be older chunks
@@ -406,7 +446,7 @@ func (a *AggMetric) persist(pos int) {
 	}
 	previousChunk := a.Chunks[previousPos]
 	for (previousChunk.T0 < chunk.T0) && (a.lastSaveStart < previousChunk.T0) {
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM persist(): old chunk needs saving. Adding %s:%d to writeQueue", a.Key, previousChunk.T0)
 		}
 		pending = append(pending, &ChunkWriteRequest{
@@ -416,6 +456,7 @@ func (a *AggMetric) persist(pos int) {
 			TTL:       a.ttl,
 			Chunk:     previousChunk,
 			Timestamp: time.Now(),
+			Codec:     a.Codec,
 		})
 		previousPos--
 		if previousPos < 0 {
@@ -427,7 +468,7 @@ func (a *AggMetric) persist(pos int) {
 	// Every chunk with a T0 <= this chunks' T0 is now either saved, or in the writeQueue.
 	a.lastSaveStart = chunk.T0
 
-	if LogLevel < 2 {
+	if LogLevel.Get() < 2 {
 		log.Debug("AM persist(): sending %d chunks to write queue", len(pending))
 	}
 
@@ -441,7 +482,7 @@ func (a *AggMetric) persist(pos int) {
 	// last-to-first ensuring that older data is added to the store
 	// before newer data.
 	for pendingChunk >= 0 {
-		if LogLevel < 2 {
+		if LogLevel.Get() < 2 {
 			log.Debug("AM persist(): sealing chunk %d/%d (%s:%d) and adding to write queue.", pendingChunk, len(pending), a.Key, chunk.T0)
 		}
 		a.store.Add(pending[pendingChunk])
@@ -481,7 +522,7 @@ func (a *AggMetric) add(ts uint32, val float64) {
 	if len(a.Chunks) == 0 {
 		chunkCreate.Inc()
 		// no data has been added to this metric at all.
-		a.Chunks = append(a.Chunks, chunk.New(t0))
+		a.Chunks = append(a.Chunks, chunk.NewWithEncoding(t0, a.Encoding))
 
 		// The first chunk is typically going to be a partial chunk
 		// so we keep a record of it.
@@ -491,7 +532,9 @@ func (a *AggMetric) add(ts uint32, val float64) {
 			panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos 0 failed: %q", ts, val, err))
 		}
 
-		log.Debug("AM %s Add(): created first chunk with first point: %v", a.Key, a.Chunks[0])
+		if LogLevel.Get() < 2 {
+			log.Debug("AM %s Add(): created first chunk with first point: %v", a.Key, a.Chunks[0])
+		}
 		a.lastWrite = uint32(time.Now().Unix())
 		if a.dropFirstChunk {
 			a.lastSaveStart = t0
@@ -513,14 +556,27 @@ func (a *AggMetric) add(ts uint32, val float64) {
 		}
 
 		if err := currentChunk.Push(ts, val); err != nil {
-			log.Debug("AM failed to add metric to chunk for %s. %s", a.Key, err)
+			if ts > a.consumedTs && ts <= a.mergedTs {
+				// a primary sent us this point already, but our rollups still need it
+				a.consumedTs = ts
+				a.lastWrite = uint32(time.Now().Unix())
+				a.addAggregators(ts, val)
+				return
+			}
+			if LogLevel.Get() < 2 {
+				log.Debug("AM failed to add metric to chunk for %s. %s", a.Key, err)
+			}
 			metricsTooOld.Inc()
 			return
 		}
 		a.lastWrite = uint32(time.Now().Unix())
-		log.Debug("AM %s Add(): pushed new value to last chunk: %v", a.Key, a.Chunks[0])
+		if LogLevel.Get() < 2 {
+			log.Debug("AM %s Add(): pushed new value to last chunk: %v", a.Key, a.Chunks[0])
+		}
 	} else if t0 < currentChunk.T0 {
-		log.Debug("AM Point at %d has t0 %d, goes back into previous chunk. CurrentChunk t0: %d, LastTs: %d", ts, t0, currentChunk.T0, currentChunk.LastTs)
+		if LogLevel.Get() < 2 {
+			log.Debug("AM Point at %d has t0 %d, goes back into previous chunk. CurrentChunk t0: %d, LastTs: %d", ts, t0, currentChunk.T0, currentChunk.LastTs)
+		}
 		metricsTooOld.Inc()
 		return
 	} else {
@@ -533,12 +589,13 @@ func (a *AggMetric) add(ts uint32, val float64) {
 
 		a.pushToCache(currentChunk)
 		// If we are a primary node, then add the chunk to the write queue to be saved to Cassandra
-		if cluster.Manager.IsPrimary() {
-			if LogLevel < 2 {
+		if cluster.Manager.IsPrimaryFor(a.partition) {
+			if LogLevel.Get() < 2 {
 				log.Debug("AM persist(): node is primary, saving chunk. %s T0: %d", a.Key, currentChunk.T0)
 			}
 			// persist the chunk. If the writeQueue is full, then this will block.
-			a.persist(a.CurrentChunkPos)
+			a.persist(a.CurrentChunkPos, false)
+			a.forwardStandby(currentChunk)
 		}
 
 		a.CurrentChunkPos++
@@ -548,19 +605,23 @@ func (a *AggMetric) add(ts uint32, val float64) {
 
 		chunkCreate.Inc()
 		if len(a.Chunks) < int(a.NumChunks) {
-			a.Chunks = append(a.Chunks, chunk.New(t0))
+			a.Chunks = append(a.Chunks, chunk.NewWithEncoding(t0, a.Encoding))
 			if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
 				panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
 			}
-			log.Debug("AM %s Add(): added new chunk to buffer. now %d chunks. and added the new point: %s", a.Key, a.CurrentChunkPos+1, a.Chunks[a.CurrentChunkPos])
+			if LogLevel.Get() < 2 {
+				log.Debug("AM %s Add(): added new chunk to buffer. now %d chunks. and added the new point: %s", a.Key, a.CurrentChunkPos+1, a.Chunks[a.CurrentChunkPos])
+			}
 		} else {
 			chunkClear.Inc()
 			a.Chunks[a.CurrentChunkPos].Clear()
-			a.Chunks[a.CurrentChunkPos] = chunk.New(t0)
+			a.Chunks[a.CurrentChunkPos] = chunk.NewWithEncoding(t0, a.Encoding)
 			if err := a.Chunks[a.CurrentChunkPos].Push(ts, val); err != nil {
 				panic(fmt.Sprintf("FATAL ERROR: this should never happen. Pushing initial value <%d,%f> to new chunk at pos %d failed: %q", ts, val, a.CurrentChunkPos, err))
 			}
-			log.Debug("AM %s Add(): cleared chunk at %d of %d and replaced with new. and added the new point: %s", a.Key, a.CurrentChunkPos, len(a.Chunks), a.Chunks[a.CurrentChunkPos])
+			if LogLevel.Get() < 2 {
+				log.Debug("AM %s Add(): cleared chunk at %d of %d and replaced with new. and added the new point: %s", a.Key, a.CurrentChunkPos, len(a.Chunks), a.Chunks[a.CurrentChunkPos])
+			}
 		}
 		a.lastWrite = uint32(time.Now().Unix())
 
@@ -647,19 +708,102 @@ func (a *AggMetric) GC(now, chunkMinTs, metricMinTs uint32) bool {
 	} else {
 		// chunk hasn't been written to in a while, and is not yet closed. Let's close it and persist it if
 		// we are a primary
-		log.Debug("Found stale Chunk, adding end-of-stream bytes. key: %v T0: %d", a.Key, currentChunk.T0)
+		if LogLevel.Get() < 2 {
+			log.Debug("Found stale Chunk, adding end-of-stream bytes. key: %v T0: %d", a.Key, currentChunk.T0)
+		}
 		currentChunk.Finish()
-		if cluster.Manager.IsPrimary() {
-			if LogLevel < 2 {
+		if cluster.Manager.IsPrimaryFor(a.partition) {
+			if LogLevel.Get() < 2 {
 				log.Debug("AM persist(): node is primary, saving chunk. %v T0: %d", a.Key, currentChunk.T0)
 			}
 			// persist the chunk. If the writeQueue is full, then this will block.
-			a.persist(a.CurrentChunkPos)
+			a.persist(a.CurrentChunkPos, false)
+			a.forwardStandby(currentChunk)
 		}
 	}
 	return false
 }
 
+// Flush closes the current chunk and, if we are a primary, persists it, so that its data survives a shutdown.
+// the reorder buffer and the aggregators are flushed first, so that their data is included.
+// this is only to be used when shutting down: the metric must not receive any more data afterwards.
+// returns the number of chunks that were sent to the store.
+func (a *AggMetric) Flush() int {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.rob != nil {
+		for _, p := range a.rob.Flush() {
+			a.add(p.Ts, p.Val)
+		}
+	}
+
+	var flushed int
+	for _, agg := range a.aggregators {
+		flushed += agg.Flush()
+	}
+
+	if len(a.Chunks) == 0 {
+		return flushed
+	}
+	currentChunk := a.getChunk(a.CurrentChunkPos)
+	if currentChunk == nil || currentChunk.Closed {
+		return flushed
+	}
+	currentChunk.Finish()
+	if cluster.Manager.IsPrimaryFor(a.partition) && a.lastSaveStart < currentChunk.T0 {
+		a.persist(a.CurrentChunkPos, true)
+		flushed++
+	}
+	return flushed
+}
+
+// PersistCurrent saves a copy of the current chunk with the points it has so far, for the raw data as well as for the rollups,
+// e.g. to get the data into the store before a risky operation. the current chunk itself stays open, and is saved once it's complete.
+// the copies are saved as partial chunks without metric, so that neither our save state nor our peers are affected.
+// returns the number of chunks that were sent to the store.
+func (a *AggMetric) PersistCurrent() int {
+	var persisted int
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+			if m != nil {
+				persisted += m.PersistCurrent()
+			}
+		}
+	}
+
+	a.RLock()
+	if len(a.Chunks) == 0 {
+		a.RUnlock()
+		return persisted
+	}
+	current := a.getChunk(a.CurrentChunkPos)
+	if current == nil || current.Closed {
+		// closed chunks are saved already
+		a.RUnlock()
+		return persisted
+	}
+	c := chunk.NewWithEncoding(current.T0, current.Encoding())
+	it := current.Iter()
+	for it.Next() {
+		c.Push(it.Values())
+	}
+	a.RUnlock()
+
+	// the copy is not part of our ringbuffer
+	c.Clear()
+	if c.NumPoints == 0 {
+		return persisted
+	}
+	c.Finish()
+	cwr := NewChunkWriteRequest(nil, a.Key, c, a.ttl, a.ChunkSpan, time.Now())
+	cwr.Partial = true
+	cwr.Codec = a.Codec
+	a.store.Add(&cwr)
+	return persisted + 1
+}
+
 func (a *AggMetric) gcAggregators(now, chunkMinTs, metricMinTs uint32) bool {
 	ret := true
 	for _, agg := range a.aggregators {
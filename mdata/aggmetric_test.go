@@ -304,6 +304,43 @@ func TestAggMetricDropFirstChunk(t *testing.T) {
 	}
 }
 
+func TestAggMetricFlush(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	mockstore.Reset()
+	ret := []conf.Retention{conf.NewRetentionMT(1, 1, 10, 5, true)}
+	m := NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(42), ret, 0, nil, false)
+	m.Add(10, 10)
+	m.Add(11, 11)
+	m.Add(20, 20)
+	m.Add(21, 21)
+	if mockstore.Items() != 1 {
+		t.Fatalf("expected only the first chunk to be persisted before flushing. got %d", mockstore.Items())
+	}
+	if flushed := m.Flush(); flushed != 1 {
+		t.Fatalf("expected the open chunk to be flushed, got %d flushed chunks", flushed)
+	}
+	if flushed := m.Flush(); flushed != 0 {
+		t.Fatalf("expected nothing to flush the second time, got %d flushed chunks", flushed)
+	}
+	itgens, err := mockstore.Search(test.NewContext(), test.GetAMKey(42), 0, 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 2 || itgens[0].Ts != 10 || itgens[1].Ts != 20 {
+		t.Fatalf("expected itgens for chunks 10 and 20. Got %v", itgens)
+	}
+
+	// secondaries close their chunks, but don't persist them
+	cluster.Manager.SetPrimary(false)
+	mockstore.Reset()
+	m = NewAggMetric(mockstore, &cache.MockCache{}, test.GetAMKey(43), ret, 0, nil, false)
+	m.Add(10, 10)
+	if flushed := m.Flush(); flushed != 0 || mockstore.Items() != 0 {
+		t.Fatalf("expected a secondary not to persist chunks. got %d flushed chunks", flushed)
+	}
+}
+
 // basic expected RAM usage for 1 iteration (= 1 days)
 // 1000 metrics * (3600 * 24 / 10 ) points per metric * 1.3 B/point = 11 MB
 // 1000 metrics * 5 agg metrics per metric * (3600 * 24 / 300) points per aggmetric * 1.3B/point = 1.9 MB
@@ -334,13 +371,13 @@ func BenchmarkAggMetrics1000Metrics1Day(b *testing.B) {
 		keys[i] = test.GetMKey(i)
 	}
 
-	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0)
+	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0, nil)
 
 	maxT := 3600 * 24 * uint32(b.N) // b.N in days
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 1000; metricI++ {
 			k := keys[metricI]
-			m := metrics.GetOrCreate(k, 0, 0)
+			m := metrics.GetOrCreate(k, 0, 0, 0)
 			m.Add(t, float64(t))
 		}
 	}
@@ -367,13 +404,13 @@ func BenchmarkAggMetrics1kSeries2Chunks1kQueueSize(b *testing.B) {
 		keys[i] = test.GetMKey(i)
 	}
 
-	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0)
+	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 1000; metricI++ {
 			k := keys[metricI]
-			m := metrics.GetOrCreate(k, 0, 0)
+			m := metrics.GetOrCreate(k, 0, 0, 0)
 			m.Add(t, float64(t))
 		}
 	}
@@ -400,13 +437,13 @@ func BenchmarkAggMetrics10kSeries2Chunks10kQueueSize(b *testing.B) {
 		keys[i] = test.GetMKey(i)
 	}
 
-	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0)
+	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 10000; metricI++ {
 			k := keys[metricI]
-			m := metrics.GetOrCreate(k, 0, 0)
+			m := metrics.GetOrCreate(k, 0, 0, 0)
 			m.Add(t, float64(t))
 		}
 	}
@@ -433,13 +470,13 @@ func BenchmarkAggMetrics100kSeries2Chunks100kQueueSize(b *testing.B) {
 		keys[i] = test.GetMKey(i)
 	}
 
-	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0)
+	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, chunkMaxStale, metricMaxStale, 0, nil)
 
 	maxT := uint32(1200)
 	for t := uint32(1); t < maxT; t += 10 {
 		for metricI := 0; metricI < 100000; metricI++ {
 			k := keys[metricI]
-			m := metrics.GetOrCreate(k, 0, 0)
+			m := metrics.GetOrCreate(k, 0, 0, 0)
 			m.Add(t, float64(t))
 		}
 	}
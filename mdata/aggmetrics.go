@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/pin"
 	"github.com/raintank/worldping-api/pkg/log"
 	"gopkg.in/raintank/schema.v1"
 )
@@ -22,9 +23,10 @@ type AggMetrics struct {
 	chunkMaxStale  uint32
 	metricMaxStale uint32
 	gcInterval     time.Duration
+	pins           *pin.Pins // series that must not be removed by the GC. may be nil
 }
 
-func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bool, chunkMaxStale, metricMaxStale uint32, gcInterval time.Duration) *AggMetrics {
+func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bool, chunkMaxStale, metricMaxStale uint32, gcInterval time.Duration, pins *pin.Pins) *AggMetrics {
 	ms := AggMetrics{
 		store:          store,
 		cachePusher:    cachePusher,
@@ -33,6 +35,7 @@ func NewAggMetrics(store Store, cachePusher cache.CachePusher, dropFirstChunk bo
 		chunkMaxStale:  chunkMaxStale,
 		metricMaxStale: metricMaxStale,
 		gcInterval:     gcInterval,
+		pins:           pins,
 	}
 
 	// gcInterval = 0 can be useful in tests
@@ -53,9 +56,9 @@ func (ms *AggMetrics) GC() {
 		chunkMinTs := now - uint32(ms.chunkMaxStale)
 		metricMinTs := now - uint32(ms.metricMaxStale)
 
-		// as this is the only goroutine that can delete from ms.Metrics
 		// we only need to lock long enough to get the list of actives metrics.
-		// it doesn't matter if new metrics are added while we iterate this list.
+		// it doesn't matter if new metrics are added while we iterate this list,
+		// but metrics may be dropped via Drop in the meantime.
 		ms.RLock()
 		keys := make([]schema.MKey, 0, len(ms.Metrics))
 		for k := range ms.Metrics {
@@ -65,10 +68,16 @@ func (ms *AggMetrics) GC() {
 		for _, key := range keys {
 			gcMetric.Inc()
 			ms.RLock()
-			a := ms.Metrics[key]
+			a, ok := ms.Metrics[key]
 			ms.RUnlock()
-			if a.GC(now, chunkMinTs, metricMinTs) {
-				log.Debug("metric %s is stale. Purging data from memory.", key)
+			if !ok {
+				continue
+			}
+			// pinned metrics still get their stale chunks closed and persisted, but stay in memory
+			if a.GC(now, chunkMinTs, metricMinTs) && !ms.pins.Pinned(key) {
+				if LogLevel.Get() < 2 {
+					log.Debug("metric %s is stale. Purging data from memory.", key)
+				}
 				ms.Lock()
 				delete(ms.Metrics, key)
 				metricsActive.Set(len(ms.Metrics))
@@ -86,7 +95,10 @@ func (ms *AggMetrics) Get(key schema.MKey) (Metric, bool) {
 	return m, ok
 }
 
-func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metric {
+// GetOrCreate returns the metric, and creates it if it doesn't exist yet.
+// the partition of a metric is set when it's created: it only moves to another one when our partitions are reassigned,
+// which requires a restart.
+func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16, partition int32) Metric {
 
 	// in the most common case, it's already there and an Rlock is all we need
 	ms.RLock()
@@ -100,8 +112,8 @@ func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metri
 		MKey: key,
 	}
 
-	agg := Aggregations.Get(aggId)
-	schema := Schemas.Get(schemaId)
+	agg := GetAgg(aggId)
+	schema := GetSchema(schemaId)
 
 	// if it wasn't there, get the write lock and prepare to add it
 	// but first we need to check again if someone has added it in
@@ -113,9 +125,55 @@ func (ms *AggMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metri
 		return m
 	}
 	m = NewAggMetric(ms.store, ms.cachePusher, k, schema.Retentions, schema.ReorderWindow, &agg, ms.dropFirstChunk)
+	m.setPartition(partition)
 	ms.Metrics[key] = m
 	active := len(ms.Metrics)
 	ms.Unlock()
 	metricsActive.Set(active)
 	return m
 }
+
+// Flush flushes all metrics, so that the data of their open chunks gets persisted
+// if we are a primary. see AggMetric.Flush
+// returns the number of chunks that were sent to the store.
+func (ms *AggMetrics) Flush() int {
+	ms.RLock()
+	metrics := make([]*AggMetric, 0, len(ms.Metrics))
+	for _, m := range ms.Metrics {
+		metrics = append(metrics, m)
+	}
+	ms.RUnlock()
+
+	var flushed int
+	for _, m := range metrics {
+		flushed += m.Flush()
+	}
+	return flushed
+}
+
+// PersistCurrent saves a copy of the current chunks of the metric. see AggMetric.PersistCurrent
+// returns the number of chunks that were sent to the store, and whether the metric is in memory.
+func (ms *AggMetrics) PersistCurrent(key schema.MKey) (int, bool) {
+	ms.RLock()
+	m, ok := ms.Metrics[key]
+	ms.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return m.PersistCurrent(), true
+}
+
+// Drop removes the metric from memory, including the data that was not saved yet,
+// so that it's read from the store instead, e.g. when the data in memory is corrupt.
+// the metric is recreated when it receives new data. returns whether the metric was in memory.
+func (ms *AggMetrics) Drop(key schema.MKey) bool {
+	ms.Lock()
+	_, ok := ms.Metrics[key]
+	delete(ms.Metrics, key)
+	active := len(ms.Metrics)
+	ms.Unlock()
+	if ok {
+		metricsActive.Set(active)
+	}
+	return ok
+}
@@ -1,6 +1,11 @@
 package mdata
 
-import "math"
+import (
+	"fmt"
+	"math"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
 
 // Aggregation is a container for all summary statistics / aggregated data for 1 metric, in 1 time frame
 // if the Cnt is 0, the numbers don't necessarily make sense.
@@ -34,3 +39,20 @@ func (a *Aggregation) Reset() {
 	a.Cnt = 0
 	// no need to set a.Lst, for a to be valid (Cnt > 1), a.Lst will always be set properly
 }
+
+// Value returns the value of the rollup series with the given method
+func (a *Aggregation) Value(method schema.Method) float64 {
+	switch method {
+	case schema.Min:
+		return a.Min
+	case schema.Max:
+		return a.Max
+	case schema.Sum:
+		return a.Sum
+	case schema.Cnt:
+		return a.Cnt
+	case schema.Lst:
+		return a.Lst
+	}
+	panic(fmt.Sprintf("Aggregation.Value(): unexpected method %s", method))
+}
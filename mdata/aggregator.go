@@ -147,3 +147,18 @@ func (agg *Aggregator) GC(now, chunkMinTs, metricMinTs, lastWriteTime uint32) bo
 
 	return ret
 }
+
+// Flush adds the pending aggregation, if any, to the aggregation-series and flushes them.
+// see AggMetric.Flush
+func (agg *Aggregator) Flush() int {
+	if agg.agg.Cnt != 0 {
+		agg.flush()
+	}
+	var flushed int
+	for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+		if m != nil {
+			flushed += m.Flush()
+		}
+	}
+	return flushed
+}
@@ -0,0 +1,154 @@
+package accnt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// AdmissionPolicies are the names of the admission policies that NewAdmissionPolicy supports
+var AdmissionPolicies = []string{"lru", "tinylfu"}
+
+// AdmissionPolicy decides whether a chunk that gets added to a full cache is kept, at the expense of
+// the least recently used chunk, which has to be evicted to make room for it
+type AdmissionPolicy interface {
+	Name() string
+	// Record records an access of the chunk: its addition to the cache, or a hit
+	Record(chunk EvictTarget)
+	// Admit returns whether the candidate chunk, which was just added, should be kept rather than the victim
+	Admit(candidate, victim EvictTarget) bool
+}
+
+// NewAdmissionPolicy returns the admission policy with the given name:
+// lru admits all chunks, tinylfu only admits chunks that have been accessed at least as often as the chunk they replace,
+// counting in a sketch of the given number of counters per row.
+func NewAdmissionPolicy(name string, tinyLFUCounters int) (AdmissionPolicy, error) {
+	switch name {
+	case "lru":
+		return admitAll{}, nil
+	case "tinylfu":
+		if tinyLFUCounters < 1 {
+			return nil, fmt.Errorf("tinylfu needs at least 1 counter")
+		}
+		return newTinyLFU(tinyLFUCounters), nil
+	}
+	return nil, fmt.Errorf("unknown admission policy %q. valid policies are %v", name, AdmissionPolicies)
+}
+
+// PolicyStats are the stats of an admission policy, named after it, so that the hit ratios of the policies
+// used by different nodes, or over time, can be compared.
+type PolicyStats struct {
+	// metric cache.admission.%s.admitted is how many chunks that were added to the full cache were kept by the admission policy, at the expense of the least recently used ones
+	Admitted *stats.Counter32
+	// metric cache.admission.%s.rejected is how many chunks that were added to the full cache were evicted right away by the admission policy
+	Rejected *stats.Counter32
+	// metric cache.admission.%s.hit is how many metrics were hit fully or partially while using the admission policy
+	Hit *stats.CounterRate32
+	// metric cache.admission.%s.miss is how many metrics were missed fully while using the admission policy
+	Miss *stats.CounterRate32
+}
+
+// NewPolicyStats returns the stats of the admission policy with the given name
+func NewPolicyStats(name string) *PolicyStats {
+	return &PolicyStats{
+		Admitted: stats.NewCounter32("cache.admission." + name + ".admitted"),
+		Rejected: stats.NewCounter32("cache.admission." + name + ".rejected"),
+		Hit:      stats.NewCounterRate32("cache.admission." + name + ".hit"),
+		Miss:     stats.NewCounterRate32("cache.admission." + name + ".miss"),
+	}
+}
+
+// admitAll admits all chunks, which makes the cache purely LRU
+type admitAll struct{}
+
+func (admitAll) Name() string {
+	return "lru"
+}
+
+func (admitAll) Record(chunk EvictTarget) {}
+
+func (admitAll) Admit(candidate, victim EvictTarget) bool {
+	return true
+}
+
+const tinyLFURows = 4
+
+// tinyLFU estimates how often chunks were accessed recently with a count-min sketch, and only admits chunks that
+// were accessed at least as often as the victim. Chunks that are read once, such as those of a big backfill query,
+// thus can't evict the chunks that are read over and over, such as those of dashboards.
+// To favor recent accesses, all counts are halved after 10 accesses per counter.
+type tinyLFU struct {
+	counters [tinyLFURows][]uint8
+	samples  int
+	resetAt  int
+}
+
+func newTinyLFU(counters int) *tinyLFU {
+	t := &tinyLFU{
+		resetAt: 10 * counters,
+	}
+	for i := range t.counters {
+		t.counters[i] = make([]uint8, counters)
+	}
+	return t
+}
+
+func (t *tinyLFU) Name() string {
+	return "tinylfu"
+}
+
+// hashes returns the 2 hashes of the chunk, from which the position in each row is derived
+func (t *tinyLFU) hashes(chunk EvictTarget) (uint32, uint32) {
+	var buf [25]byte
+	binary.LittleEndian.PutUint32(buf[0:], chunk.Metric.MKey.Org)
+	copy(buf[4:], chunk.Metric.MKey.Key[:])
+	buf[20] = byte(chunk.Metric.Archive)
+	binary.LittleEndian.PutUint32(buf[21:], chunk.Ts)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (t *tinyLFU) Record(chunk EvictTarget) {
+	h1, h2 := t.hashes(chunk)
+	for i := range t.counters {
+		pos := (h1 + uint32(i)*h2) % uint32(len(t.counters[i]))
+		if t.counters[i][pos] < 255 {
+			t.counters[i][pos]++
+		}
+	}
+	t.samples++
+	if t.samples >= t.resetAt {
+		t.age()
+	}
+}
+
+// age halves all counts
+func (t *tinyLFU) age() {
+	for i := range t.counters {
+		for j := range t.counters[i] {
+			t.counters[i][j] /= 2
+		}
+	}
+	t.samples /= 2
+}
+
+// estimate returns how often the chunk was accessed, which may be overestimated due to collisions
+func (t *tinyLFU) estimate(chunk EvictTarget) uint8 {
+	h1, h2 := t.hashes(chunk)
+	min := uint8(255)
+	for i := range t.counters {
+		pos := (h1 + uint32(i)*h2) % uint32(len(t.counters[i]))
+		if t.counters[i][pos] < min {
+			min = t.counters[i][pos]
+		}
+	}
+	return min
+}
+
+func (t *tinyLFU) Admit(candidate, victim EvictTarget) bool {
+	return t.estimate(candidate) >= t.estimate(victim)
+}
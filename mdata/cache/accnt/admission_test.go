@@ -0,0 +1,53 @@
+package accnt
+
+import (
+	"testing"
+
+	"github.com/grafana/metrictank/test"
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestTinyLFU(t *testing.T) {
+	hot := EvictTarget{Metric: schema.GetAMKey(test.GetMKey(1), schema.Cnt, 600), Ts: 600}
+	cold := EvictTarget{Metric: schema.GetAMKey(test.GetMKey(2), schema.Cnt, 600), Ts: 600}
+	p := newTinyLFU(100)
+
+	for i := 0; i < 5; i++ {
+		p.Record(hot)
+	}
+	p.Record(cold)
+	if got := p.estimate(hot); got != 5 {
+		t.Fatalf("expected an estimate of 5 for the hot chunk, got %d", got)
+	}
+	if p.Admit(cold, hot) {
+		t.Fatalf("expected the cold chunk not to replace the hot one")
+	}
+	if !p.Admit(hot, cold) {
+		t.Fatalf("expected the hot chunk to replace the cold one")
+	}
+	other := EvictTarget{Metric: cold.Metric, Ts: 1200}
+	p.Record(other)
+	if !p.Admit(other, cold) {
+		t.Fatalf("expected chunks that were accessed as often to replace each other")
+	}
+
+	// counts are halved after 10 accesses per counter
+	for i := 0; i < 993; i++ {
+		p.Record(other)
+	}
+	if got := p.estimate(hot); got != 2 {
+		t.Fatalf("expected the estimate of the hot chunk to be halved to 2, got %d", got)
+	}
+}
+
+func TestNewAdmissionPolicy(t *testing.T) {
+	for _, name := range AdmissionPolicies {
+		p, err := NewAdmissionPolicy(name, 10)
+		if err != nil || p.Name() != name {
+			t.Fatalf("expected policy %q, got %v, %v", name, p, err)
+		}
+	}
+	if _, err := NewAdmissionPolicy("lfu", 10); err == nil {
+		t.Fatalf("expected an unknown policy to be refused")
+	}
+}
@@ -3,6 +3,7 @@ package accnt
 import (
 	"sort"
 
+	"github.com/grafana/metrictank/mdata/pin"
 	"github.com/raintank/worldping-api/pkg/log"
 	"gopkg.in/raintank/schema.v1"
 )
@@ -40,6 +41,13 @@ type FlatAccnt struct {
 	// each add means data got added to the cache, each hit means data
 	// has been accessed and hence the LRU needs to be updated.
 	eventQ chan FlatAccntEvent
+
+	// the chunks of pinned series are never evicted. may be nil
+	pins *pin.Pins
+
+	// decides whether chunks that get added to the full cache are kept
+	policy AdmissionPolicy
+	stats  *PolicyStats
 }
 
 type FlatAccntMet struct {
@@ -54,6 +62,8 @@ const evnt_del_met uint8 = 6
 const evnt_get_total uint8 = 7
 const evnt_stop uint8 = 100
 const evnt_reset uint8 = 101
+const evnt_set_max uint8 = 102
+const evnt_set_pins uint8 = 103
 
 type FlatAccntEvent struct {
 	t  uint8       // event type
@@ -83,13 +93,16 @@ type GetTotalPayload struct {
 	res_chan chan uint64
 }
 
-func NewFlatAccnt(maxSize uint64) *FlatAccnt {
+// NewFlatAccnt returns the accounting of a cache of maxSize bytes, using the given admission policy
+func NewFlatAccnt(maxSize uint64, policy AdmissionPolicy) *FlatAccnt {
 	accnt := FlatAccnt{
 		metrics: make(map[schema.AMKey]*FlatAccntMet),
 		maxSize: maxSize,
 		lru:     NewLRU(),
 		evictQ:  make(chan *EvictTarget, evictQSize),
 		eventQ:  make(chan FlatAccntEvent, EventQSize),
+		policy:  policy,
+		stats:   NewPolicyStats(policy.Name()),
 	}
 	cacheSizeMax.SetUint64(maxSize)
 
@@ -123,6 +136,16 @@ func (a *FlatAccnt) Reset() {
 	a.act(evnt_reset, nil)
 }
 
+// SetMaxSize changes the size limit. when lowered, data is evicted until the cache is within the new limit
+func (a *FlatAccnt) SetMaxSize(size uint64) {
+	a.act(evnt_set_max, size)
+}
+
+// SetPins sets the pinned series, of which the chunks must not be evicted
+func (a *FlatAccnt) SetPins(pins *pin.Pins) {
+	a.act(evnt_set_pins, pins)
+}
+
 func (a *FlatAccnt) act(t uint8, payload interface{}) {
 	event := FlatAccntEvent{
 		t:  t,
@@ -144,22 +167,26 @@ func (a *FlatAccnt) eventLoop() {
 			switch event.t {
 			case evnt_add_chnk:
 				payload := event.pl.(*AddPayload)
-				a.add(payload.metric, payload.ts, payload.size)
+				target := EvictTarget{
+					Metric: payload.metric,
+					Ts:     payload.ts,
+				}
+				a.policy.Record(target)
+				added := a.add(payload.metric, payload.ts, payload.size)
 				cacheChunkAdd.Inc()
-				a.lru.touch(
-					EvictTarget{
-						Metric: payload.metric,
-						Ts:     payload.ts,
-					},
-				)
+				if added && !a.admit(target) {
+					a.reject(target)
+					break
+				}
+				a.lru.touch(target)
 			case evnt_hit_chnk:
 				payload := event.pl.(*HitPayload)
-				a.lru.touch(
-					EvictTarget{
-						Metric: payload.metric,
-						Ts:     payload.ts,
-					},
-				)
+				target := EvictTarget{
+					Metric: payload.metric,
+					Ts:     payload.ts,
+				}
+				a.policy.Record(target)
+				a.lru.touch(target)
 			case evnt_del_met:
 				payload := event.pl.(*DelMetPayload)
 				a.delMet(payload.metric)
@@ -172,11 +199,28 @@ func (a *FlatAccnt) eventLoop() {
 				a.metrics = make(map[schema.AMKey]*FlatAccntMet)
 				a.lru.reset()
 				cacheSizeUsed.SetUint64(0)
+			case evnt_set_max:
+				a.maxSize = event.pl.(uint64)
+				cacheSizeMax.SetUint64(a.maxSize)
+			case evnt_set_pins:
+				a.pins = event.pl.(*pin.Pins)
 			}
 
-			// evict until we're below the max
+			// evict until we're below the max, or only chunks of pinned series are left.
+			// those are put back afterwards, in the same order, so that they get evicted
+			// first once their series are no longer pinned.
+			var skipped []EvictTarget
 			for cacheSizeUsed.Peek() > a.maxSize {
-				a.evict()
+				target, ok := a.evict()
+				if !ok {
+					break
+				}
+				if target != nil {
+					skipped = append(skipped, *target)
+				}
+			}
+			for i := len(skipped) - 1; i >= 0; i-- {
+				a.lru.pushBack(skipped[i])
 			}
 		}
 	}
@@ -205,7 +249,8 @@ func (a *FlatAccnt) delMet(metric schema.AMKey) {
 	delete(a.metrics, metric)
 }
 
-func (a *FlatAccnt) add(metric schema.AMKey, ts uint32, size uint64) {
+// add accounts for the chunk, and returns whether it was not accounted for yet
+func (a *FlatAccnt) add(metric schema.AMKey, ts uint32, size uint64) bool {
 	var met *FlatAccntMet
 	var ok bool
 
@@ -220,15 +265,54 @@ func (a *FlatAccnt) add(metric schema.AMKey, ts uint32, size uint64) {
 
 	if _, ok = met.chunks[ts]; ok {
 		// we already have that chunk
-		return
+		return false
 	}
 
 	met.chunks[ts] = size
 	met.total = met.total + size
 	cacheSizeUsed.AddUint64(size)
+	return true
+}
+
+// admit returns whether the chunk that was just added may stay. When it made the cache exceed its max size,
+// the admission policy decides whether it is worth evicting the least recently used chunk for it.
+// Chunks of pinned series are always admitted, and never count as the victim.
+func (a *FlatAccnt) admit(target EvictTarget) bool {
+	if cacheSizeUsed.Peek() <= a.maxSize || a.pins.Pinned(target.Metric.MKey) {
+		return true
+	}
+	e := a.lru.back()
+	if e == nil {
+		return true
+	}
+	victim := e.(EvictTarget)
+	if victim.Metric == target.Metric || a.pins.Pinned(victim.Metric.MKey) || a.policy.Admit(target, victim) {
+		a.stats.Admitted.Inc()
+		return true
+	}
+	a.stats.Rejected.Inc()
+	return false
+}
+
+// reject evicts the chunk that was just added, without touching the other chunks of its metric
+func (a *FlatAccnt) reject(target EvictTarget) {
+	met := a.metrics[target.Metric]
+	size := met.chunks[target.Ts]
+	delete(met.chunks, target.Ts)
+	met.total = met.total - size
+	cacheSizeUsed.DecUint64(size)
+	cacheChunkEvict.Inc()
+	a.evictQ <- &target
+	if len(met.chunks) == 0 {
+		cacheMetricEvict.Inc()
+		delete(a.metrics, target.Metric)
+	}
 }
 
-func (a *FlatAccnt) evict() {
+// evict evicts the least recently used chunk, along with the older chunks of its metric.
+// it returns false if there was nothing to evict, and the least recently used chunk
+// if it was not evicted because its series is pinned.
+func (a *FlatAccnt) evict() (*EvictTarget, bool) {
 	var met *FlatAccntMet
 	var targets []uint32
 	var ts uint32
@@ -241,14 +325,18 @@ func (a *FlatAccnt) evict() {
 
 	// got nothing to evict
 	if e == nil {
-		return
+		return nil, false
 	}
 
 	// convert to EvictTarget otherwise
 	target = e.(EvictTarget)
 
+	if a.pins.Pinned(target.Metric.MKey) {
+		return &target, true
+	}
+
 	if met, ok = a.metrics[target.Metric]; !ok {
-		return
+		return nil, true
 	}
 
 	for ts = range met.chunks {
@@ -277,7 +365,7 @@ func (a *FlatAccnt) evict() {
 		cacheMetricEvict.Inc()
 		delete(a.metrics, target.Metric)
 	}
-
+	return nil, true
 }
 
 func (a *FlatAccnt) GetEvictQ() chan *EvictTarget {
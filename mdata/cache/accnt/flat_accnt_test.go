@@ -2,7 +2,9 @@ package accnt
 
 import (
 	"testing"
+	"time"
 
+	"github.com/grafana/metrictank/mdata/pin"
 	"github.com/grafana/metrictank/test"
 
 	"gopkg.in/raintank/schema.v1"
@@ -16,7 +18,7 @@ func resetCounters() {
 
 func TestAddingEvicting(t *testing.T) {
 	resetCounters()
-	a := NewFlatAccnt(10)
+	a := NewFlatAccnt(10, admitAll{})
 	evictQ := a.GetEvictQ()
 
 	// some test data
@@ -82,9 +84,61 @@ func TestAddingEvicting(t *testing.T) {
 	a.Stop()
 }
 
+func TestEvictingPinned(t *testing.T) {
+	resetCounters()
+	a := NewFlatAccnt(6, admitAll{})
+	evictQ := a.GetEvictQ()
+
+	var et *EvictTarget
+	metric1 := schema.GetAMKey(test.GetMKey(1), schema.Cnt, 600)
+	metric2 := schema.GetAMKey(test.GetMKey(2), schema.Cnt, 600)
+	metric3 := schema.GetAMKey(test.GetMKey(3), schema.Cnt, 600)
+	var ts1 uint32 = 1
+
+	pins := pin.New()
+	pins.Add(pin.Pin{Id: "incident", Expires: time.Now().Add(time.Hour).Unix()}, []schema.MKey{metric1.MKey})
+	a.SetPins(pins)
+
+	a.AddChunk(metric1, ts1, 3) // total size now 3
+	a.AddChunk(metric2, ts1, 3) // total size now 6
+	a.AddChunk(metric3, ts1, 3) // total size now 9
+
+	// metric1 is the least recently used, but pinned
+	et = <-evictQ // total size now 6
+	if et.Metric != metric2 || et.Ts != ts1 {
+		t.Fatalf("Returned evict target is not as expected, got %+v", et)
+	}
+
+	// all that's left to evict is pinned, so we go over the max size
+	a.SetMaxSize(2)
+	et = <-evictQ // total size now 3
+	if et.Metric != metric3 || et.Ts != ts1 {
+		t.Fatalf("Returned evict target is not as expected, got %+v", et)
+	}
+	if total := a.GetTotal(); total != 3 {
+		t.Fatalf("Expected the pinned chunk to stay, with a total size of 3, got %d", total)
+	}
+
+	// once unpinned, it's evicted first
+	pins.Del("incident")
+	a.AddChunk(metric2, ts1, 1) // total size now 4
+	et = <-evictQ               // total size now 1
+	if et.Metric != metric1 || et.Ts != ts1 {
+		t.Fatalf("Returned evict target is not as expected, got %+v", et)
+	}
+
+	select {
+	case et := <-evictQ:
+		t.Fatalf("Expected the EvictQ to be empty, got %+v", et)
+	default:
+	}
+
+	a.Stop()
+}
+
 func TestLRUOrdering(t *testing.T) {
 	resetCounters()
-	a := NewFlatAccnt(6)
+	a := NewFlatAccnt(6, admitAll{})
 	evictQ := a.GetEvictQ()
 
 	// some test data
@@ -119,7 +173,7 @@ func TestLRUOrdering(t *testing.T) {
 
 func TestMetricDeleting(t *testing.T) {
 	resetCounters()
-	a := NewFlatAccnt(12)
+	a := NewFlatAccnt(12, admitAll{})
 
 	metric1 := schema.GetAMKey(test.GetMKey(1), schema.Cnt, 600)
 	metric2 := schema.GetAMKey(test.GetMKey(2), schema.Cnt, 600)
@@ -165,3 +219,43 @@ func TestMetricDeleting(t *testing.T) {
 
 	a.Stop()
 }
+
+func TestAdmission(t *testing.T) {
+	metric1 := schema.GetAMKey(test.GetMKey(1), schema.Cnt, 600)
+	metric2 := schema.GetAMKey(test.GetMKey(2), schema.Cnt, 600)
+	backfill := schema.GetAMKey(test.GetMKey(3), schema.Cnt, 600)
+
+	for _, c := range []struct {
+		policy AdmissionPolicy
+		exp    EvictTarget
+	}{
+		// the least recently used chunk makes room, however often it was used
+		{admitAll{}, EvictTarget{Metric: metric1, Ts: 1}},
+		// a chunk that was used once can't replace one that is used over and over
+		{newTinyLFU(1024), EvictTarget{Metric: backfill, Ts: 1}},
+	} {
+		resetCounters()
+		a := NewFlatAccnt(10, c.policy)
+		evictQ := a.GetEvictQ()
+
+		a.AddChunk(metric1, 1, 5)
+		a.HitChunk(metric1, 1)
+		a.HitChunk(metric1, 1)
+		a.AddChunk(metric2, 1, 5)
+		a.AddChunk(backfill, 1, 5)
+
+		et := <-evictQ
+		if *et != c.exp {
+			t.Fatalf("%s: expected %+v to be evicted, got %+v", c.policy.Name(), c.exp, *et)
+		}
+		if total := a.GetTotal(); total != 10 {
+			t.Fatalf("%s: expected a total size of 10, got %d", c.policy.Name(), total)
+		}
+		select {
+		case et := <-evictQ:
+			t.Fatalf("%s: expected the EvictQ to be empty, got %+v", c.policy.Name(), et)
+		default:
+		}
+		a.Stop()
+	}
+}
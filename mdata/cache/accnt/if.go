@@ -1,6 +1,9 @@
 package accnt
 
-import "gopkg.in/raintank/schema.v1"
+import (
+	"github.com/grafana/metrictank/mdata/pin"
+	"gopkg.in/raintank/schema.v1"
+)
 
 // Accnt represents an instance of cache accounting.
 // Currently there is only one implementation called `FlatAccnt`,
@@ -13,6 +16,8 @@ type Accnt interface {
 	DelMetric(metric schema.AMKey)
 	Stop()
 	Reset()
+	SetMaxSize(size uint64)
+	SetPins(pins *pin.Pins)
 }
 
 // EvictTarget is the definition of a chunk that should be evicted.
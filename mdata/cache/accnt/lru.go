@@ -24,6 +24,15 @@ func (l *LRU) touch(key interface{}) {
 	}
 }
 
+// pushBack adds the key as the least recently used one
+func (l *LRU) pushBack(key interface{}) {
+	if ent, ok := l.items[key]; ok {
+		l.list.MoveToBack(ent)
+	} else {
+		l.items[key] = l.list.PushBack(key)
+	}
+}
+
 func (l *LRU) del(key interface{}) {
 	if ent, ok := l.items[key]; ok {
 		l.list.Remove(ent)
@@ -31,6 +40,15 @@ func (l *LRU) del(key interface{}) {
 	}
 }
 
+// back returns the least recently used key, without removing it
+func (l *LRU) back() interface{} {
+	ent := l.list.Back()
+	if ent == nil {
+		return nil
+	}
+	return ent.Value
+}
+
 func (l *LRU) pop() interface{} {
 	ent := l.list.Back()
 	if ent == nil {
@@ -7,10 +7,13 @@ import (
 	"runtime"
 	"sync"
 
+	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/mdata/cache/accnt"
 	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/mdata/pin"
 	"github.com/grafana/metrictank/stats"
 	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/util"
 	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
@@ -18,7 +21,10 @@ import (
 )
 
 var (
+	LogLevel        util.LogLevel
 	maxSize         uint64
+	admissionPolicy string
+	tinyLFUCounters int
 	searchFwdBug    = stats.NewCounter32("recovered_errors.cache.metric.searchForwardBug")
 	ErrInvalidRange = errors.New("CCache: invalid range: from must be less than to")
 )
@@ -27,9 +33,31 @@ func init() {
 	flags := flag.NewFlagSet("chunk-cache", flag.ExitOnError)
 	// (1024 ^ 3) * 4 = 4294967296 = 4G
 	flags.Uint64Var(&maxSize, "max-size", 4294967296, "Maximum size of chunk cache in bytes")
+	flags.StringVar(&admissionPolicy, "admission-policy", "lru", "which chunks to keep when the cache is full: lru to always replace the least recently used chunks, or tinylfu to only replace them with chunks that were accessed at least as often recently, so that one big query can't flush the chunks that are read over and over")
+	flags.IntVar(&tinyLFUCounters, "tinylfu-counters", 1048576, "number of counters per row of the frequency sketch of the tinylfu admission policy. each takes 1 byte in each of the 4 rows. should be well above the number of chunks in the cache")
 	globalconf.Register("chunk-cache", flags)
 }
 
+// ConfigValidate checks the settings without side effects, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	var findings []conf.Finding
+	if _, err := accnt.NewAdmissionPolicy(admissionPolicy, 1); err != nil {
+		findings = append(findings, conf.NewError("chunk-cache.admission-policy", "%s", err))
+	}
+	if admissionPolicy == "tinylfu" && tinyLFUCounters < 1 {
+		findings = append(findings, conf.NewError("chunk-cache.tinylfu-counters", "must be at least 1"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
+
 type CCache struct {
 	sync.RWMutex
 
@@ -43,6 +71,9 @@ type CCache struct {
 	// and what should be evicted
 	accnt accnt.Accnt
 
+	// the stats of the admission policy of the accounting
+	policyStats *accnt.PolicyStats
+
 	// channel that's only used to signal go routines to stop
 	stop chan interface{}
 
@@ -50,10 +81,16 @@ type CCache struct {
 }
 
 func NewCCache() *CCache {
+	// validated by ConfigProcess
+	policy, err := accnt.NewAdmissionPolicy(admissionPolicy, tinyLFUCounters)
+	if err != nil {
+		log.Fatal(4, "chunk-cache: %s", err)
+	}
 	cc := &CCache{
 		metricCache:   make(map[schema.AMKey]*CCacheMetric),
 		metricRawKeys: make(map[schema.MKey]map[schema.Archive]struct{}),
-		accnt:         accnt.NewFlatAccnt(maxSize),
+		accnt:         accnt.NewFlatAccnt(maxSize, policy),
+		policyStats:   accnt.NewPolicyStats(policy.Name()),
 		stop:          make(chan interface{}),
 		tracer:        opentracing.NoopTracer{},
 	}
@@ -65,6 +102,11 @@ func (c *CCache) SetTracer(t opentracing.Tracer) {
 	c.tracer = t
 }
 
+// SetPins makes the cache keep the chunks of the pinned series, even when it is over its max-size
+func (c *CCache) SetPins(pins *pin.Pins) {
+	c.accnt.SetPins(pins)
+}
+
 func (c *CCache) evictLoop() {
 	evictQ := c.accnt.GetEvictQ()
 	for {
@@ -168,6 +210,12 @@ func (cc *CCache) Reset() (int, int) {
 	return series, archives
 }
 
+// Shrink limits the cache to the given fraction of its configured max-size, e.g. under memory pressure.
+// a fraction of 1 restores the configured size.
+func (c *CCache) Shrink(fraction float64) {
+	c.accnt.SetMaxSize(uint64(float64(maxSize) * fraction))
+}
+
 func (c *CCache) Stop() {
 	c.accnt.Stop()
 	c.stop <- nil
@@ -186,7 +234,9 @@ func (c *CCache) evict(target *accnt.EvictTarget) {
 		return
 	}
 
-	log.Debug("CCache evict: evicting chunk %d on metric %s\n", target.Ts, target.Metric)
+	if LogLevel.Get() < 2 {
+		log.Debug("CCache evict: evicting chunk %d on metric %s\n", target.Ts, target.Metric)
+	}
 	length := c.metricCache[target.Metric].Del(target.Ts)
 	if length == 0 {
 		delete(c.metricCache, target.Metric)
@@ -221,6 +271,7 @@ func (c *CCache) Search(ctx context.Context, metric schema.AMKey, from, until ui
 	if !ok {
 		span.SetTag("cache", "miss")
 		accnt.CacheMetricMiss.Inc()
+		c.policyStats.Miss.Inc()
 		return res, nil
 	}
 
@@ -228,9 +279,11 @@ func (c *CCache) Search(ctx context.Context, metric schema.AMKey, from, until ui
 	if len(res.Start) == 0 && len(res.End) == 0 {
 		span.SetTag("cache", "miss")
 		accnt.CacheMetricMiss.Inc()
+		c.policyStats.Miss.Inc()
 	} else {
 
 		accnt.CacheChunkHit.Add(len(res.Start) + len(res.End))
+		c.policyStats.Hit.Inc()
 		go func() {
 			for _, hit := range res.Start {
 				c.accnt.HitChunk(metric, hit.Ts)
@@ -89,7 +89,9 @@ func (mc *CCacheMetric) Add(prev uint32, itergen chunk.IterGen) {
 
 	nextTs := mc.nextTs(ts)
 
-	log.Debug("CCacheMetric Add: caching chunk ts %d, nextTs %d", ts, nextTs)
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric Add: caching chunk ts %d, nextTs %d", ts, nextTs)
+	}
 
 	// if previous chunk has not been passed we try to be smart and figure it out.
 	// this is common in a scenario where a metric continuously gets queried
@@ -169,16 +171,22 @@ func (mc *CCacheMetric) lastTs() uint32 {
 // if not found or can't be sure returns 0, false
 // assumes we already have at least a read lock
 func (mc *CCacheMetric) seekAsc(ts uint32) (uint32, bool) {
-	log.Debug("CCacheMetric seekAsc: seeking for %d in the keys %+d", ts, mc.keys)
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric seekAsc: seeking for %d in the keys %+d", ts, mc.keys)
+	}
 
 	for i := 0; i < len(mc.keys) && mc.keys[i] <= ts; i++ {
 		if mc.nextTs(mc.keys[i]) > ts {
-			log.Debug("CCacheMetric seekAsc: seek found ts %d is between %d and %d", ts, mc.keys[i], mc.nextTs(mc.keys[i]))
+			if LogLevel.Get() < 2 {
+				log.Debug("CCacheMetric seekAsc: seek found ts %d is between %d and %d", ts, mc.keys[i], mc.nextTs(mc.keys[i]))
+			}
 			return mc.keys[i], true
 		}
 	}
 
-	log.Debug("CCacheMetric seekAsc: seekAsc unsuccessful")
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric seekAsc: seekAsc unsuccessful")
+	}
 	return 0, false
 }
 
@@ -186,16 +194,22 @@ func (mc *CCacheMetric) seekAsc(ts uint32) (uint32, bool) {
 // if not found or can't be sure returns 0, false
 // assumes we already have at least a read lock
 func (mc *CCacheMetric) seekDesc(ts uint32) (uint32, bool) {
-	log.Debug("CCacheMetric seekDesc: seeking for %d in the keys %+d", ts, mc.keys)
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric seekDesc: seeking for %d in the keys %+d", ts, mc.keys)
+	}
 
 	for i := len(mc.keys) - 1; i >= 0 && mc.nextTs(mc.keys[i]) > ts; i-- {
 		if mc.keys[i] <= ts {
-			log.Debug("CCacheMetric seekDesc: seek found ts %d is between %d and %d", ts, mc.keys[i], mc.nextTs(mc.keys[i]))
+			if LogLevel.Get() < 2 {
+				log.Debug("CCacheMetric seekDesc: seek found ts %d is between %d and %d", ts, mc.keys[i], mc.nextTs(mc.keys[i]))
+			}
 			return mc.keys[i], true
 		}
 	}
 
-	log.Debug("CCacheMetric seekDesc: seekDesc unsuccessful")
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric seekDesc: seekDesc unsuccessful")
+	}
 	return 0, false
 }
 
@@ -207,7 +221,9 @@ func (mc *CCacheMetric) searchForward(ctx context.Context, metric schema.AMKey,
 
 	// add all consecutive chunks to search results, starting at the one containing "from"
 	for ; ts != 0; ts = mc.chunks[ts].Next {
-		log.Debug("CCacheMetric searchForward: forward search adds chunk ts %d to start", ts)
+		if LogLevel.Get() < 2 {
+			log.Debug("CCacheMetric searchForward: forward search adds chunk ts %d to start", ts)
+		}
 		res.Start = append(res.Start, mc.chunks[ts].Itgen)
 		nextTs := mc.nextTs(ts)
 		res.From = nextTs
@@ -237,7 +253,9 @@ func (mc *CCacheMetric) searchBackward(from, until uint32, res *CCSearchResult)
 			break
 		}
 
-		log.Debug("CCacheMetric searchBackward: backward search adds chunk ts %d to end", ts)
+		if LogLevel.Get() < 2 {
+			log.Debug("CCacheMetric searchBackward: backward search adds chunk ts %d to end", ts)
+		}
 		res.End = append(res.End, mc.chunks[ts].Itgen)
 		res.Until = ts
 	}
@@ -272,15 +290,23 @@ func (mc *CCacheMetric) Search(ctx context.Context, metric schema.AMKey, res *CC
 	}
 
 	if !res.Complete && res.From > res.Until {
-		log.Debug("CCacheMetric Search: Found from > until (%d/%d), printing chunks\n", res.From, res.Until)
+		if LogLevel.Get() < 2 {
+			log.Debug("CCacheMetric Search: Found from > until (%d/%d), printing chunks\n", res.From, res.Until)
+		}
 		mc.debugMetric()
 	}
 }
 
 func (mc *CCacheMetric) debugMetric() {
-	log.Debug("CCacheMetric debugMetric: --- debugging metric ---\n")
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric debugMetric: --- debugging metric ---\n")
+	}
 	for _, key := range mc.keys {
-		log.Debug("CCacheMetric debugMetric: ts %d; prev %d; next %d\n", key, mc.chunks[key].Prev, mc.chunks[key].Next)
+		if LogLevel.Get() < 2 {
+			log.Debug("CCacheMetric debugMetric: ts %d; prev %d; next %d\n", key, mc.chunks[key].Prev, mc.chunks[key].Next)
+		}
+	}
+	if LogLevel.Get() < 2 {
+		log.Debug("CCacheMetric debugMetric: ------------------------\n")
 	}
-	log.Debug("CCacheMetric debugMetric: ------------------------\n")
 }
@@ -0,0 +1,72 @@
+package chunk
+
+import "io"
+
+// bstream is a stream of bits, written and read most significant bit first
+type bstream struct {
+	stream []byte
+	count  uint8 // how many bits are free in the last byte when writing, or left in the first byte when reading
+}
+
+func newBReader(b []byte) *bstream {
+	return &bstream{stream: b, count: 8}
+}
+
+func (b *bstream) clone() *bstream {
+	stream := make([]byte, len(b.stream))
+	copy(stream, b.stream)
+	return &bstream{stream: stream, count: b.count}
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+// writeBits writes the nbits least significant bits of u
+func (b *bstream) writeBits(u uint64, nbits int) {
+	for nbits > 0 {
+		nbits--
+		b.writeBit((u>>uint(nbits))&1 == 1)
+	}
+}
+
+func (b *bstream) readBit() (bool, error) {
+	if len(b.stream) == 0 {
+		return false, io.EOF
+	}
+	if b.count == 0 {
+		b.stream = b.stream[1:]
+		if len(b.stream) == 0 {
+			return false, io.EOF
+		}
+		b.count = 8
+	}
+	b.count--
+	return (b.stream[0]>>b.count)&1 == 1, nil
+}
+
+func (b *bstream) readBits(nbits int) (uint64, error) {
+	var u uint64
+	for ; nbits > 0; nbits-- {
+		bit, err := b.readBit()
+		if err != nil {
+			return 0, err
+		}
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+	}
+	return u, nil
+}
@@ -7,12 +7,20 @@ import (
 	"github.com/grafana/metrictank/stats"
 )
 
-// metric tank.total_points is the number of points currently held in the in-memory ringbuffer
-var totalPoints = stats.NewGauge64("tank.total_points")
+var (
+	// metric tank.total_points is the number of points currently held in the in-memory ringbuffer
+	totalPoints = stats.NewGauge64("tank.total_points")
+
+	// metric tank.int_chunk_fallbacks is the number of chunks that were switched from the int to the float encoding, because they got a non-integer value
+	intChunkFallbacks = stats.NewCounter32("tank.int_chunk_fallbacks")
+)
 
 // Chunk is a chunk of data. not concurrency safe.
+// by default the points are encoded with tsz.Series. chunks with the int encoding use an IntSeries
+// instead, until they get a value that is not an integer: then they switch to tsz.Series.
 type Chunk struct {
 	tsz.Series
+	ints      *IntSeries
 	LastTs    uint32 // last TS seen, not computed or anything
 	NumPoints uint32
 	Closed    bool
@@ -27,15 +35,73 @@ func New(t0 uint32) *Chunk {
 	}
 }
 
+// NewWithEncoding creates a chunk that encodes its points with the given encoding
+func NewWithEncoding(t0 uint32, encoding Encoding) *Chunk {
+	c := New(t0)
+	if encoding == EncodingInt {
+		c.ints = NewIntSeries(t0)
+	}
+	return c
+}
+
 func (c *Chunk) String() string {
-	return fmt.Sprintf("<chunk T0=%d, LastTs=%d, NumPoints=%d, Closed=%t>", c.T0, c.LastTs, c.NumPoints, c.Closed)
+	return fmt.Sprintf("<chunk T0=%d, LastTs=%d, NumPoints=%d, Closed=%t, Encoding=%s>", c.T0, c.LastTs, c.NumPoints, c.Closed, c.Encoding())
+
+}
+
+// Encoding returns the encoding of the points of the chunk
+func (c *Chunk) Encoding() Encoding {
+	if c.ints != nil {
+		return EncodingInt
+	}
+	return EncodingFloat
+}
 
+// Bytes returns the encoded points
+func (c *Chunk) Bytes() []byte {
+	if c.ints != nil {
+		return c.ints.Bytes()
+	}
+	return c.Series.Bytes()
 }
+
+// Iter returns an iterator over the points pushed so far
+func (c *Chunk) Iter() Iter {
+	if c.ints != nil {
+		return NewIntIter(c.ints.Iter())
+	}
+	return NewIter(c.Series.Iter())
+}
+
+// IterGen returns an IterGen of the chunk, with the given span
+func (c *Chunk) IterGen(span uint32) *IterGen {
+	itgen := NewBareIterGen(c.Bytes(), c.T0, span)
+	itgen.Encoding = c.Encoding()
+	return itgen
+}
+
+// toFloat switches the chunk from the int to the float encoding
+func (c *Chunk) toFloat() {
+	it := c.ints.Iter()
+	for it.Next() {
+		c.Series.Push(it.Values())
+	}
+	c.ints = nil
+	intChunkFallbacks.Inc()
+}
+
 func (c *Chunk) Push(t uint32, v float64) error {
 	if t <= c.LastTs {
 		return fmt.Errorf("Point must be newer than already added points. t:%d lastTs: %d", t, c.LastTs)
 	}
-	c.Series.Push(t, v)
+	if c.ints != nil && !IsInt(v) {
+		c.toFloat()
+	}
+	if c.ints != nil {
+		c.ints.Push(t, v)
+	} else {
+		c.Series.Push(t, v)
+	}
 	c.NumPoints += 1
 	c.LastTs = t
 	totalPoints.Inc()
@@ -48,5 +114,9 @@ func (c *Chunk) Clear() {
 
 func (c *Chunk) Finish() {
 	c.Closed = true
+	if c.ints != nil {
+		c.ints.Finish()
+		return
+	}
 	c.Series.Finish()
 }
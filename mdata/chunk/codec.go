@@ -0,0 +1,105 @@
+package chunk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/flate"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the compression that is applied on top of the tsz encoding of a chunk when persisting it.
+// tsz already compresses well, so the gain of a codec depends a lot on the data: it's mostly worth it
+// for series with few distinct values or with long repetitions.
+type Codec uint8
+
+const (
+	CodecNone   Codec = iota // plain tsz, persisted as FormatStandardGoTszWithSpan
+	CodecSnappy              // fast, modest size reduction
+	CodecFlate               // slower, better size reduction
+	CodecZstd                // similar size reduction and cost as flate
+)
+
+var errUnknownCodec = errors.New("corrupt data, chunk codec is not known")
+
+var codecNames = []string{"none", "snappy", "flate", "zstd"}
+
+func (c Codec) String() string {
+	if int(c) >= len(codecNames) {
+		return fmt.Sprintf("Codec(%d)", c)
+	}
+	return codecNames[c]
+}
+
+// ParseCodec returns the codec by its name, as used in storage-schemas.conf
+func ParseCodec(name string) (Codec, error) {
+	for i, n := range codecNames {
+		if n == name {
+			return Codec(i), nil
+		}
+	}
+	return CodecNone, fmt.Errorf("unknown chunk compression %q. valid options are none, snappy, flate and zstd", name)
+}
+
+// flate writers and readers allocate large buffers, so we reuse them
+var flateWriters = sync.Pool{
+	New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(nil)
+	},
+}
+
+// zstd encoders and decoders are safe for concurrent use through EncodeAll and DecodeAll.
+// chunks are small, so a small window does, and the stores checksum their data already, so we leave out the frame checksum.
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<15), zstd.WithEncoderCRC(false))
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderLowmem(true))
+
+// compress appends the compressed data to buf
+func (c Codec) compress(buf, data []byte) []byte {
+	switch c {
+	case CodecSnappy:
+		return append(buf, snappy.Encode(nil, data)...)
+	case CodecFlate:
+		out := bytes.NewBuffer(buf)
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(out)
+		// writes to a bytes.Buffer can't fail
+		w.Write(data)
+		w.Close()
+		flateWriters.Put(w)
+		return out.Bytes()
+	case CodecZstd:
+		return zstdEncoder.EncodeAll(data, buf)
+	}
+	return append(buf, data...)
+}
+
+func (c Codec) decompress(data []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		return snappy.Decode(nil, data)
+	case CodecFlate:
+		r := flateReaders.Get().(io.ReadCloser)
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+		out, err := ioutil.ReadAll(r)
+		r.Close()
+		flateReaders.Put(r)
+		return out, err
+	case CodecZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	}
+	return nil, errUnknownCodec
+}
@@ -0,0 +1,102 @@
+package chunk
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+var codecs = []Codec{CodecNone, CodecSnappy, CodecFlate, CodecZstd}
+
+// testChunks returns 2h chunks of 10s points, with data that compresses differently
+func testChunks() map[string][]byte {
+	gens := map[string]func(i int) float64{
+		"constant": func(i int) float64 { return 42 },
+		"counter":  func(i int) float64 { return float64(i * 3) },
+		"steps":    func(i int) float64 { return float64(i / 60) },
+		"random":   func(i int) float64 { return rand.Float64() * 1000 },
+	}
+	chunks := make(map[string][]byte, len(gens))
+	for name, gen := range gens {
+		c := New(7200)
+		for i := 0; i < 720; i++ {
+			c.Push(uint32(7200+i*10), gen(i))
+		}
+		c.Finish()
+		chunks[name] = c.Series.Bytes()
+	}
+	return chunks
+}
+
+func TestParseCodec(t *testing.T) {
+	for _, c := range codecs {
+		parsed, err := ParseCodec(c.String())
+		if err != nil || parsed != c {
+			t.Fatalf("expected to parse %q into %d, got %d, %v", c.String(), c, parsed, err)
+		}
+	}
+	if _, err := ParseCodec("lz4"); err == nil {
+		t.Fatalf("expected error for unknown codec")
+	}
+}
+
+func TestEncodeWithCodec(t *testing.T) {
+	for name, data := range testChunks() {
+		for _, c := range codecs {
+			buf := Encode(7200, EncodingFloat, c, data)
+			expFormat := FormatGoTszWithSpanAndCodec
+			if c == CodecNone {
+				expFormat = FormatStandardGoTszWithSpan
+			}
+			if Format(buf[0]) != expFormat {
+				t.Fatalf("%s/%s: expected format %s, got %s", name, c, expFormat, Format(buf[0]))
+			}
+			itgen, err := NewGen(buf, 7200)
+			if err != nil {
+				t.Fatalf("%s/%s: failed to decode encoded chunk: %s", name, c, err)
+			}
+			if itgen.Span != 7200 || itgen.Ts != 7200 || !bytes.Equal(itgen.B, data) {
+				t.Fatalf("%s/%s: decoded chunk does not match the original", name, c)
+			}
+		}
+	}
+}
+
+func TestNewGenUnknownCodec(t *testing.T) {
+	buf := []byte{byte(FormatGoTszWithSpanAndCodec), byte(RevChunkSpans[600]), 100, 1, 2, 3}
+	if _, err := NewGen(buf, 600); err != errUnknownCodec {
+		t.Fatalf("expected errUnknownCodec, got %v", err)
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for name, data := range testChunks() {
+		for _, c := range codecs {
+			b.Run(fmt.Sprintf("%s/%s", name, c), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				var buf []byte
+				for i := 0; i < b.N; i++ {
+					buf = Encode(7200, EncodingFloat, c, data)
+				}
+				b.Logf("%d bytes -> %d bytes", len(data), len(buf))
+			})
+		}
+	}
+}
+
+func BenchmarkNewGen(b *testing.B) {
+	for name, data := range testChunks() {
+		for _, c := range codecs {
+			buf := Encode(7200, EncodingFloat, c, data)
+			b.Run(fmt.Sprintf("%s/%s", name, c), func(b *testing.B) {
+				b.SetBytes(int64(len(data)))
+				for i := 0; i < b.N; i++ {
+					if _, err := NewGen(buf, 7200); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
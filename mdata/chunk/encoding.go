@@ -0,0 +1,30 @@
+package chunk
+
+import "fmt"
+
+// Encoding is how the points of a chunk are encoded
+type Encoding uint8
+
+const (
+	EncodingFloat Encoding = iota // gorilla (tsz): delta-of-delta timestamps and xor'ed float64 values
+	EncodingInt                   // delta-of-delta timestamps and integer values, see IntSeries
+)
+
+var encodingNames = []string{"float", "int"}
+
+func (e Encoding) String() string {
+	if int(e) >= len(encodingNames) {
+		return fmt.Sprintf("Encoding(%d)", e)
+	}
+	return encodingNames[e]
+}
+
+// ParseEncoding returns the encoding by its name, as used in storage-schemas.conf
+func ParseEncoding(name string) (Encoding, error) {
+	for i, n := range encodingNames {
+		if n == name {
+			return Encoding(i), nil
+		}
+	}
+	return EncodingFloat, fmt.Errorf("unknown chunk encoding %q. valid options are float and int", name)
+}
@@ -1,5 +1,7 @@
 package chunk
 
+import "fmt"
+
 // this exists so that we can later add more formats, perhaps for int/uint/float32/bool specific optimisations, or other encoding/decoding/compression algorithms
 // and have an easy time distinguishing the binary blobs
 
@@ -11,4 +13,29 @@ type Format uint8
 const (
 	FormatStandardGoTsz Format = iota
 	FormatStandardGoTszWithSpan
+	FormatGoTszWithSpanAndCodec // the tsz data is compressed with the codec, whose code follows the span code
+	FormatEncrypted             // an encrypted chunk of another format. it must be decrypted before decoding, see package encryption
+	FormatIntWithSpanAndCodec   // like FormatGoTszWithSpanAndCodec, but the data is an IntSeries
 )
+
+// Encode prefixes the data of a chunk with the format and the code of its span, and compresses it with the codec,
+// for persisting it. float chunks without codec use FormatStandardGoTszWithSpan, so that they stay readable by older versions.
+// it's the counterpart of NewGen
+func Encode(span uint32, encoding Encoding, codec Codec, data []byte) []byte {
+	spanCode, ok := RevChunkSpans[span]
+	if !ok {
+		// it's probably better to panic than to persist the chunk with a wrong length
+		panic(fmt.Sprintf("Chunk span invalid: %d", span))
+	}
+	format := FormatGoTszWithSpanAndCodec
+	if encoding == EncodingInt {
+		format = FormatIntWithSpanAndCodec
+	} else if codec == CodecNone {
+		buf := make([]byte, 0, len(data)+2)
+		buf = append(buf, byte(FormatStandardGoTszWithSpan), byte(spanCode))
+		return append(buf, data...)
+	}
+	buf := make([]byte, 0, len(data)+3)
+	buf = append(buf, byte(format), byte(spanCode), byte(codec))
+	return codec.compress(buf, data)
+}
@@ -0,0 +1,23 @@
+package chunk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	data := []byte{1, 2, 3}
+	itgen, err := NewGen(Encode(600, EncodingFloat, CodecNone, data), 1200)
+	if err != nil {
+		t.Fatalf("failed to decode encoded chunk: %s", err)
+	}
+	if itgen.Span != 600 || itgen.Ts != 1200 || !bytes.Equal(itgen.B, data) {
+		t.Fatalf("unexpected itergen %+v", itgen)
+	}
+}
+
+func TestNewGenEncrypted(t *testing.T) {
+	if _, err := NewGen([]byte{byte(FormatEncrypted), 0, 1, 2}, 1200); err != errEncryptedChunk {
+		t.Fatalf("expected errEncryptedChunk, got %v", err)
+	}
+}
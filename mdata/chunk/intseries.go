@@ -0,0 +1,234 @@
+package chunk
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// IntSeries is an alternative to the gorilla (tsz) float encoding, for series that only hold integers, like counters.
+// like tsz, it encodes timestamps as delta-of-delta, but it encodes the values as the delta-of-delta of the integers,
+// using the same variable length buckets as the timestamps. a counter that increases at a steady rate needs only
+// 2 bits per point, where tsz needs the xor of the floats.
+//
+// the stream is: t0 (32 bits), the delta of the first point to t0 (32 bits) and its value (64 bits),
+// followed by the timestamp and value delta-of-delta of every next point, and an end marker.
+type IntSeries struct {
+	sync.Mutex
+
+	T0     uint32
+	t      uint32
+	tDelta uint32
+	val    int64
+	vDelta int64
+	bw     bstream
+	// whether the first point was written
+	started  bool
+	finished bool
+}
+
+// the largest integer that can be converted to a float64 and back without losing precision
+const maxExactInt = 1 << 53
+
+var errIntSeriesCorrupt = errors.New("corrupt data, can't decode integer chunk")
+
+// IsInt returns whether the value can be stored in an IntSeries without loss
+func IsInt(v float64) bool {
+	return v == math.Trunc(v) && v <= maxExactInt && v >= -maxExactInt && !(v == 0 && math.Signbit(v))
+}
+
+func NewIntSeries(t0 uint32) *IntSeries {
+	s := &IntSeries{T0: t0}
+	s.bw.writeBits(uint64(t0), 32)
+	return s
+}
+
+func (s *IntSeries) Bytes() []byte {
+	s.Lock()
+	defer s.Unlock()
+	return s.bw.bytes()
+}
+
+// zigzag maps signed integers to unsigned ones, so that small magnitudes have few significant bits
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(u uint64) int64 {
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+// the buckets for the delta-of-delta of the timestamps, as in tsz, and of the values.
+// each bucket is identified by a prefix of 1's terminated by a 0, except for the last one.
+var (
+	tsBuckets  = []int{7, 9, 12, 32}
+	valBuckets = []int{8, 16, 32, 64}
+)
+
+// the end of the stream is marked by the largest delta-of-delta of the timestamps,
+// which can't occur within a chunk
+const endMarker = math.MaxUint32
+
+func writeDod(bw *bstream, z uint64, buckets []int) {
+	if z == 0 {
+		bw.writeBit(false)
+		return
+	}
+	for i, nbits := range buckets {
+		bw.writeBit(true)
+		if i == len(buckets)-1 {
+			bw.writeBits(z, nbits)
+			return
+		}
+		if z < 1<<uint(nbits) {
+			bw.writeBit(false)
+			bw.writeBits(z, nbits)
+			return
+		}
+	}
+}
+
+func readDod(br *bstream, buckets []int) (uint64, error) {
+	bit, err := br.readBit()
+	if err != nil || !bit {
+		return 0, err
+	}
+	for _, nbits := range buckets[:len(buckets)-1] {
+		bit, err := br.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if !bit {
+			return br.readBits(nbits)
+		}
+	}
+	return br.readBits(buckets[len(buckets)-1])
+}
+
+// Push adds a point. the value must be an integer, see IsInt
+func (s *IntSeries) Push(t uint32, v float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	val := int64(v)
+	if !s.started {
+		s.started = true
+		s.t, s.tDelta, s.val = t, t-s.T0, val
+		s.bw.writeBits(uint64(s.tDelta), 32)
+		s.bw.writeBits(uint64(val), 64)
+		return
+	}
+	tDelta := t - s.t
+	writeDod(&s.bw, zigzag(int64(tDelta)-int64(s.tDelta)), tsBuckets)
+	vDelta := val - s.val
+	writeDod(&s.bw, zigzag(vDelta-s.vDelta), valBuckets)
+	s.t, s.tDelta, s.val, s.vDelta = t, tDelta, val, vDelta
+}
+
+func finishInts(bw *bstream) {
+	// a bucket prefix that is not followed by a 0 is the last bucket
+	for range tsBuckets {
+		bw.writeBit(true)
+	}
+	bw.writeBits(endMarker, tsBuckets[len(tsBuckets)-1])
+}
+
+func (s *IntSeries) Finish() {
+	s.Lock()
+	if !s.finished {
+		finishInts(&s.bw)
+		s.finished = true
+	}
+	s.Unlock()
+}
+
+// Iter returns an iterator over the points pushed so far
+func (s *IntSeries) Iter() *IntIter {
+	s.Lock()
+	w := s.bw.clone()
+	finished := s.finished
+	s.Unlock()
+	if !finished {
+		finishInts(w)
+	}
+	it, _ := NewIntIterator(w.bytes())
+	return it
+}
+
+// IntIter iterates over the points of an IntSeries
+type IntIter struct {
+	T0     uint32
+	br     *bstream
+	t      uint32
+	tDelta uint32
+	val    int64
+	vDelta int64
+	first  bool
+	done   bool
+	err    error
+}
+
+func NewIntIterator(b []byte) (*IntIter, error) {
+	br := newBReader(b)
+	t0, err := br.readBits(32)
+	if err != nil {
+		return nil, err
+	}
+	return &IntIter{T0: uint32(t0), br: br, first: true}, nil
+}
+
+func (it *IntIter) fail(err error) bool {
+	if err != nil {
+		it.err = errIntSeriesCorrupt
+	}
+	it.done = true
+	return false
+}
+
+func (it *IntIter) Next() bool {
+	if it.done || it.err != nil {
+		return false
+	}
+	if it.first {
+		it.first = false
+		// an empty series has the end marker right after t0
+		peek := *it.br
+		if z, err := readDod(&peek, tsBuckets); err == nil && z == endMarker {
+			return it.fail(nil)
+		}
+		tDelta, err := it.br.readBits(32)
+		if err != nil {
+			return it.fail(err)
+		}
+		val, err := it.br.readBits(64)
+		if err != nil {
+			return it.fail(err)
+		}
+		it.tDelta, it.t, it.val = uint32(tDelta), it.T0+uint32(tDelta), int64(val)
+		return true
+	}
+	z, err := readDod(it.br, tsBuckets)
+	if err != nil {
+		return it.fail(err)
+	}
+	if z == endMarker {
+		return it.fail(nil)
+	}
+	it.tDelta = uint32(int64(it.tDelta) + unzigzag(z))
+	it.t += it.tDelta
+	z, err = readDod(it.br, valBuckets)
+	if err != nil {
+		return it.fail(err)
+	}
+	it.vDelta += unzigzag(z)
+	it.val += it.vDelta
+	return true
+}
+
+func (it *IntIter) Values() (uint32, float64) {
+	return it.t, float64(it.val)
+}
+
+func (it *IntIter) Err() error {
+	return it.err
+}
@@ -0,0 +1,208 @@
+package chunk
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/dgryski/go-tsz"
+)
+
+type point struct {
+	ts  uint32
+	val float64
+}
+
+func testPoints(n int, val func(i int) float64) []point {
+	points := make([]point, n)
+	ts := uint32(7200)
+	for i := range points {
+		ts += 10
+		if i%50 == 49 {
+			// an irregular interval now and then
+			ts += uint32(rand.Intn(1000))
+		}
+		points[i] = point{ts, val(i)}
+	}
+	return points
+}
+
+func checkIter(t *testing.T, name string, it Iter, exp []point) {
+	var i int
+	for it.Next() {
+		ts, val := it.Values()
+		if i >= len(exp) || ts != exp[i].ts || val != exp[i].val {
+			t.Fatalf("%s: point %d: expected %v, got %d %f", name, i, exp[i], ts, val)
+		}
+		i++
+	}
+	if it.Err() != nil {
+		t.Fatalf("%s: unexpected error %s", name, it.Err())
+	}
+	if i != len(exp) {
+		t.Fatalf("%s: expected %d points, got %d", name, len(exp), i)
+	}
+}
+
+func TestIntSeries(t *testing.T) {
+	cases := map[string]func(i int) float64{
+		"constant": func(i int) float64 { return 42 },
+		"counter":  func(i int) float64 { return float64(i * 3) },
+		"negative": func(i int) float64 { return float64(-i * i) },
+		"random":   func(i int) float64 { return float64(rand.Int63n(1<<53) - 1<<52) },
+		"extremes": func(i int) float64 {
+			if i%2 == 0 {
+				return maxExactInt
+			}
+			return -maxExactInt
+		},
+	}
+	for name, val := range cases {
+		for _, n := range []int{0, 1, 2, 720} {
+			points := testPoints(n, val)
+			s := NewIntSeries(7200)
+			for _, p := range points {
+				s.Push(p.ts, p.val)
+			}
+			// before and after finishing
+			checkIter(t, name, NewIntIter(s.Iter()), points)
+			s.Finish()
+			checkIter(t, name, NewIntIter(s.Iter()), points)
+			it, err := NewIntIterator(s.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkIter(t, name, NewIntIter(it), points)
+		}
+	}
+}
+
+func TestIsInt(t *testing.T) {
+	cases := []struct {
+		val float64
+		exp bool
+	}{
+		{0, true},
+		{-12, true},
+		{maxExactInt, true},
+		{maxExactInt * 2, false},
+		{1.5, false},
+		{math.NaN(), false},
+		{math.Inf(1), false},
+		{math.Copysign(0, -1), false},
+	}
+	for _, c := range cases {
+		if IsInt(c.val) != c.exp {
+			t.Fatalf("expected IsInt(%f) to be %t", c.val, c.exp)
+		}
+	}
+}
+
+func TestChunkIntFallback(t *testing.T) {
+	points := testPoints(100, func(i int) float64 { return float64(i) })
+	points[60].val = 60.5
+	c := NewWithEncoding(7200, EncodingInt)
+	for i, p := range points {
+		c.Push(p.ts, p.val)
+		exp := EncodingInt
+		if i >= 60 {
+			exp = EncodingFloat
+		}
+		if c.Encoding() != exp {
+			t.Fatalf("after point %d: expected encoding %s, got %s", i, exp, c.Encoding())
+		}
+	}
+	checkIter(t, "in memory", c.Iter(), points)
+	c.Finish()
+
+	itgen, err := NewGen(Encode(7200, c.Encoding(), CodecNone, c.Bytes()), 7200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := itgen.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIter(t, "persisted", *it, points)
+}
+
+func TestEncodeInt(t *testing.T) {
+	points := testPoints(100, func(i int) float64 { return float64(i) })
+	c := NewWithEncoding(7200, EncodingInt)
+	for _, p := range points {
+		c.Push(p.ts, p.val)
+	}
+	c.Finish()
+	for _, codec := range codecs {
+		buf := Encode(7200, EncodingInt, codec, c.Bytes())
+		if Format(buf[0]) != FormatIntWithSpanAndCodec {
+			t.Fatalf("expected format %s, got %s", FormatIntWithSpanAndCodec, Format(buf[0]))
+		}
+		itgen, err := NewGen(buf, 7200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if itgen.Encoding != EncodingInt || itgen.Span != 7200 {
+			t.Fatalf("unexpected itgen %+v", itgen)
+		}
+		it, err := itgen.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkIter(t, codec.String(), *it, points)
+	}
+}
+
+func BenchmarkPushInt(b *testing.B) {
+	benchmarkPush(b, EncodingInt)
+}
+
+func BenchmarkPushFloat(b *testing.B) {
+	benchmarkPush(b, EncodingFloat)
+}
+
+func benchmarkPush(b *testing.B, encoding Encoding) {
+	points := testPoints(720, func(i int) float64 { return float64(i * 3) })
+	var size int
+	for i := 0; i < b.N; i++ {
+		c := NewWithEncoding(7200, encoding)
+		for _, p := range points {
+			c.Push(p.ts, p.val)
+		}
+		c.Finish()
+		size = len(c.Bytes())
+	}
+	b.Logf("%d points of a counter: %d bytes", len(points), size)
+}
+
+func BenchmarkIterInt(b *testing.B) {
+	points := testPoints(720, func(i int) float64 { return float64(i * 3) })
+	s := NewIntSeries(7200)
+	for _, p := range points {
+		s.Push(p.ts, p.val)
+	}
+	s.Finish()
+	data := s.Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, _ := NewIntIterator(data)
+		for it.Next() {
+		}
+	}
+}
+
+func BenchmarkIterFloat(b *testing.B) {
+	points := testPoints(720, func(i int) float64 { return float64(i * 3) })
+	s := tsz.New(7200)
+	for _, p := range points {
+		s.Push(p.ts, p.val)
+	}
+	s.Finish()
+	data := s.Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, _ := tsz.NewIterator(data)
+		for it.Next() {
+		}
+	}
+}
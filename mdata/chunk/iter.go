@@ -4,12 +4,28 @@ import (
 	"github.com/dgryski/go-tsz"
 )
 
+// iterator is implemented by the iterators of the chunk encodings
+type iterator interface {
+	Next() bool
+	Values() (uint32, float64)
+	Err() error
+}
+
 type Iter struct {
-	*tsz.Iter
+	iterator
+	T0 uint32
 }
 
 func NewIter(i *tsz.Iter) Iter {
 	return Iter{
 		i,
+		i.T0,
+	}
+}
+
+func NewIntIter(i *IntIter) Iter {
+	return Iter{
+		i,
+		i.T0,
 	}
 }
@@ -9,17 +9,22 @@ import (
 var (
 	errUnknownChunkFormat = errors.New("unrecognized chunk format in cassandra")
 	errUnknownSpanCode    = errors.New("corrupt data, chunk span code is not known")
+	errEncryptedChunk     = errors.New("chunk is encrypted, it must be decrypted first")
 )
 
 //go:generate msgp
 type IterGen struct {
-	B    []byte
-	Ts   uint32
-	Span uint32
+	B        []byte
+	Ts       uint32
+	Span     uint32
+	Encoding Encoding
 }
 
+// NewGen decodes a persisted chunk into an IterGen, decompressing its data if needed.
+// it's the counterpart of Encode
 func NewGen(b []byte, ts uint32) (*IterGen, error) {
 	var span uint32 = 0
+	encoding := EncodingFloat
 
 	switch Format(b[0]) {
 	case FormatStandardGoTsz:
@@ -30,6 +35,24 @@ func NewGen(b []byte, ts uint32) (*IterGen, error) {
 		}
 		span = ChunkSpans[SpanCode(b[1])]
 		b = b[2:]
+	case FormatGoTszWithSpanAndCodec, FormatIntWithSpanAndCodec:
+		if len(b) < 3 {
+			return nil, errUnknownChunkFormat
+		}
+		if int(b[1]) >= len(ChunkSpans) {
+			return nil, errUnknownSpanCode
+		}
+		span = ChunkSpans[SpanCode(b[1])]
+		if Format(b[0]) == FormatIntWithSpanAndCodec {
+			encoding = EncodingInt
+		}
+		var err error
+		b, err = Codec(b[2]).decompress(b[3:])
+		if err != nil {
+			return nil, err
+		}
+	case FormatEncrypted:
+		return nil, errEncryptedChunk
 	default:
 		return nil, errUnknownChunkFormat
 	}
@@ -38,22 +61,33 @@ func NewGen(b []byte, ts uint32) (*IterGen, error) {
 		b,
 		ts,
 		span,
+		encoding,
 	}, nil
 }
 
+// NewBareIterGen creates an IterGen of float encoded data, see Chunk.IterGen for chunks of any encoding
 func NewBareIterGen(b []byte, ts uint32, span uint32) *IterGen {
-	return &IterGen{b, ts, span}
+	return &IterGen{b, ts, span, EncodingFloat}
 }
 
 func (ig *IterGen) Get() (*Iter, error) {
 	b := make([]byte, len(ig.B), len(ig.B))
 	copy(b, ig.B)
+	if ig.Encoding == EncodingInt {
+		it, err := NewIntIterator(b)
+		if err != nil {
+			return nil, err
+		}
+		iter := NewIntIter(it)
+		return &iter, nil
+	}
 	it, err := tsz.NewIterator(b)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Iter{it}, nil
+	iter := NewIter(it)
+	return &iter, nil
 }
 
 func (ig *IterGen) Size() uint64 {
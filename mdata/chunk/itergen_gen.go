@@ -39,6 +39,15 @@ func (z *IterGen) DecodeMsg(dc *msgp.Reader) (err error) {
 			if err != nil {
 				return
 			}
+		case "Encoding":
+			{
+				var zb0002 uint8
+				zb0002, err = dc.ReadUint8()
+				if err != nil {
+					return
+				}
+				z.Encoding = Encoding(zb0002)
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -51,9 +60,9 @@ func (z *IterGen) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *IterGen) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 3
+	// map header, size 4
 	// write "B"
-	err = en.Append(0x83, 0xa1, 0x42)
+	err = en.Append(0x84, 0xa1, 0x42)
 	if err != nil {
 		return
 	}
@@ -79,15 +88,24 @@ func (z *IterGen) EncodeMsg(en *msgp.Writer) (err error) {
 	if err != nil {
 		return
 	}
+	// write "Encoding"
+	err = en.Append(0xa8, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(uint8(z.Encoding))
+	if err != nil {
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *IterGen) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 3
+	// map header, size 4
 	// string "B"
-	o = append(o, 0x83, 0xa1, 0x42)
+	o = append(o, 0x84, 0xa1, 0x42)
 	o = msgp.AppendBytes(o, z.B)
 	// string "Ts"
 	o = append(o, 0xa2, 0x54, 0x73)
@@ -95,6 +113,9 @@ func (z *IterGen) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "Span"
 	o = append(o, 0xa4, 0x53, 0x70, 0x61, 0x6e)
 	o = msgp.AppendUint32(o, z.Span)
+	// string "Encoding"
+	o = append(o, 0xa8, 0x45, 0x6e, 0x63, 0x6f, 0x64, 0x69, 0x6e, 0x67)
+	o = msgp.AppendUint8(o, uint8(z.Encoding))
 	return
 }
 
@@ -129,6 +150,15 @@ func (z *IterGen) UnmarshalMsg(bts []byte) (o []byte, err error) {
 			if err != nil {
 				return
 			}
+		case "Encoding":
+			{
+				var zb0002 uint8
+				zb0002, bts, err = msgp.ReadUint8Bytes(bts)
+				if err != nil {
+					return
+				}
+				z.Encoding = Encoding(zb0002)
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -142,6 +172,6 @@ func (z *IterGen) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *IterGen) Msgsize() (s int) {
-	s = 1 + 2 + msgp.BytesPrefixSize + len(z.B) + 3 + msgp.Uint32Size + 5 + msgp.Uint32Size
+	s = 1 + 2 + msgp.BytesPrefixSize + len(z.B) + 3 + msgp.Uint32Size + 5 + msgp.Uint32Size + 9 + msgp.Uint8Size
 	return
 }
@@ -9,15 +9,28 @@ import (
 
 // ChunkWriteRequest is a request to write a chunk into a store
 type ChunkWriteRequest struct {
+	// the metric the chunk belongs to. nil for chunks that were not created in memory, e.g. backfilled rollups
 	Metric    *AggMetric
 	Key       schema.AMKey
 	Chunk     *chunk.Chunk
 	TTL       uint32
 	Timestamp time.Time
 	Span      uint32
+	// Partial is set for chunks that are persisted before they are complete, because we shut down.
+	// peers are not notified about them, so that a peer promoted to primary saves its complete version.
+	Partial bool
+	// Codec is the compression the chunk is persisted with, see storage-schemas.conf
+	Codec chunk.Codec
 }
 
 // NewChunkWriteRequest creates a new ChunkWriteRequest
 func NewChunkWriteRequest(metric *AggMetric, key schema.AMKey, chunk *chunk.Chunk, ttl, span uint32, ts time.Time) ChunkWriteRequest {
-	return ChunkWriteRequest{metric, key, chunk, ttl, ts, span}
+	return ChunkWriteRequest{
+		Metric:    metric,
+		Key:       key,
+		Chunk:     chunk,
+		TTL:       ttl,
+		Timestamp: ts,
+		Span:      span,
+	}
 }
@@ -1,8 +1,12 @@
 package mdata
 
 import (
+	"context"
 	"fmt"
 	"time"
+
+	"github.com/grafana/metrictank/conf"
+	schema "gopkg.in/raintank/schema.v1"
 )
 
 func TS(ts interface{}) string {
@@ -15,3 +19,69 @@ func TS(ts interface{}) string {
 		return fmt.Sprintf("unexpected type %T\n", ts)
 	}
 }
+
+// ReadPoints reads the points of the given series with timestamps in (from, to] from the store
+func ReadPoints(ctx context.Context, store Store, key schema.AMKey, ttl, from, to uint32) ([]schema.Point, error) {
+	itgens, err := store.Search(ctx, key, ttl, from+1, to+1)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", key, err)
+	}
+	var points []schema.Point
+	for _, itgen := range itgens {
+		iter, err := itgen.Get()
+		if err != nil {
+			return nil, fmt.Errorf("decoding chunk %d of %s: %s", itgen.Ts, key, err)
+		}
+		for iter.Next() {
+			ts, val := iter.Values()
+			if ts > from && ts <= to {
+				points = append(points, schema.Point{Val: val, Ts: ts})
+			}
+		}
+	}
+	return points, nil
+}
+
+// AggregatePoints computes the rollup of the points with the given span, like the Aggregator does.
+// the aggregations are keyed by the timestamp of their rollup point
+func AggregatePoints(points []schema.Point, span uint32) map[uint32]*Aggregation {
+	aggs := make(map[uint32]*Aggregation)
+	for _, p := range points {
+		boundary := AggBoundary(p.Ts, span)
+		agg, ok := aggs[boundary]
+		if !ok {
+			agg = NewAggregation()
+			aggs[boundary] = agg
+		}
+		agg.Add(p.Val)
+	}
+	return aggs
+}
+
+// RollupMethods returns the methods of the rollup series that are stored for the aggregation. see NewAggregator
+func RollupMethods(agg conf.Aggregation) []schema.Method {
+	seen := make(map[schema.Method]bool)
+	var methods []schema.Method
+	add := func(m schema.Method) {
+		if !seen[m] {
+			seen[m] = true
+			methods = append(methods, m)
+		}
+	}
+	for _, m := range agg.AggregationMethod {
+		switch m {
+		case conf.Avg:
+			add(schema.Sum)
+			add(schema.Cnt)
+		case conf.Sum:
+			add(schema.Sum)
+		case conf.Lst:
+			add(schema.Lst)
+		case conf.Max:
+			add(schema.Max)
+		case conf.Min:
+			add(schema.Min)
+		}
+	}
+	return methods
+}
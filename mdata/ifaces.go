@@ -12,7 +12,7 @@ import (
 
 type Metrics interface {
 	Get(key schema.MKey) (Metric, bool)
-	GetOrCreate(key schema.MKey, schemaId, aggId uint16) Metric
+	GetOrCreate(key schema.MKey, schemaId, aggId uint16, partition int32) Metric
 }
 
 type Metric interface {
@@ -27,3 +27,17 @@ type Store interface {
 	Stop()
 	SetTracer(t opentracing.Tracer)
 }
+
+// MetricsRecovery is implemented by Metrics that can save or drop the in-memory data of specific series on demand,
+// for recovery during incidents
+type MetricsRecovery interface {
+	PersistCurrent(key schema.MKey) (int, bool)
+	Drop(key schema.MKey) bool
+}
+
+// ChunkReplacer is implemented by stores that can replace chunks with others, e.g. to compact them
+type ChunkReplacer interface {
+	// ReplaceChunks saves the chunks, which all belong to the same series, and once they are saved,
+	// deletes the chunks of that series with the given t0s, except for the ones that were overwritten.
+	ReplaceChunks(ctx context.Context, cwrs []*ChunkWriteRequest, old []uint32) error
+}
@@ -9,12 +9,13 @@ import (
 
 	"github.com/grafana/metrictank/conf"
 	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/util"
 	"github.com/raintank/worldping-api/pkg/log"
 	"github.com/rakyll/globalconf"
 )
 
 var (
-	LogLevel int
+	LogLevel util.LogLevel
 
 	// metric tank.chunk_operations.create is a counter of how many chunks are created
 	chunkCreate = stats.NewCounter32("tank.chunk_operations.create")
@@ -59,7 +60,8 @@ var (
 	// with an incorrect aggspan specified
 	badAggSpan = stats.NewCounter32("recovered_errors.aggmetric.getaggregated.bad-aggspan")
 
-	// set either via ConfigProcess or from the unit tests. other code should not touch
+	// set either via ConfigProcess, ReloadConfig or from the unit tests. other code should not touch,
+	// but use the accessor functions in schema.go, which are safe against concurrent reloads
 	Schemas      conf.Schemas
 	Aggregations conf.Aggregations
 
@@ -106,4 +108,5 @@ func ConfigProcess() {
 		log.Info("Could not read %s: %s: using defaults", aggFile, err)
 		Aggregations = conf.NewAggregations()
 	}
+	fileSchemas, fileAggregations = Schemas, Aggregations
 }
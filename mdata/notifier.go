@@ -2,6 +2,8 @@ package mdata
 
 import (
 	"encoding/json"
+	"errors"
+	"time"
 
 	schema "gopkg.in/raintank/schema.v1"
 
@@ -13,6 +15,7 @@ import (
 
 var (
 	notifierHandlers []NotifierHandler
+	persistHooks     []func(amkey schema.AMKey, t0 uint32)
 
 	// metric cluster.notifier.all.messages-received is a counter of messages received from cluster notifiers
 	messagesReceived = stats.NewCounter32("cluster.notifier.all.messages-received")
@@ -42,6 +45,84 @@ func SendPersistMessage(key string, t0 uint32) {
 	for _, h := range notifierHandlers {
 		h.Send(sc)
 	}
+	if len(persistHooks) != 0 {
+		amkey, err := schema.AMKeyFromString(key)
+		if err != nil {
+			log.Error(3, "notifier: failed to convert %q to AMKey: %s", key, err)
+			return
+		}
+		callPersistHooks(amkey, t0)
+	}
+}
+
+// AddPersistHook registers fn to be called for every chunk that gets persisted, by us or, as learned
+// from the persist messages, by a peer. It must be called on startup, and fn must not block.
+func AddPersistHook(fn func(amkey schema.AMKey, t0 uint32)) {
+	persistHooks = append(persistHooks, fn)
+}
+
+func callPersistHooks(amkey schema.AMKey, t0 uint32) {
+	for _, fn := range persistHooks {
+		fn(amkey, t0)
+	}
+}
+
+// ErrNotifierCantSync is returned when a notifier can't tell whether the persist messages were sent and processed
+var ErrNotifierCantSync = errors.New("the enabled notifiers can't tell whether persist messages were sent and processed by peers. only kafka-cluster can")
+
+// notifierSyncer is implemented by notifiers that can make sure the persist messages they were given are sent,
+// and tell how many persist messages of any node we have yet to process
+type notifierSyncer interface {
+	Flush(timeout time.Duration) bool
+	Lag() (int, error)
+}
+
+func notifierSyncers() ([]notifierSyncer, error) {
+	if len(notifierHandlers) == 0 {
+		return nil, ErrNotifierCantSync
+	}
+	syncers := make([]notifierSyncer, len(notifierHandlers))
+	for i, h := range notifierHandlers {
+		s, ok := h.(notifierSyncer)
+		if !ok {
+			return nil, ErrNotifierCantSync
+		}
+		syncers[i] = s
+	}
+	return syncers, nil
+}
+
+// FlushPersistNotifiers sends the persist messages of the chunks saved so far to our peers,
+// and waits until they are sent, or until the timeout expires
+func FlushPersistNotifiers(timeout time.Duration) error {
+	syncers, err := notifierSyncers()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for _, s := range syncers {
+		if !s.Flush(time.Until(deadline)) {
+			return errors.New("timed out sending persist messages")
+		}
+	}
+	return nil
+}
+
+// PersistNotifierLag returns how many persist messages, sent by any node up until now, we have yet to process
+func PersistNotifierLag() (int, error) {
+	syncers, err := notifierSyncers()
+	if err != nil {
+		return 0, err
+	}
+	var lag int
+	for _, s := range syncers {
+		l, err := s.Lag()
+		if err != nil {
+			return 0, err
+		}
+		lag += l
+	}
+	return lag, nil
 }
 
 func InitPersistNotifier(handlers ...NotifierHandler) {
@@ -64,14 +145,17 @@ func Handle(metrics Metrics, data []byte, idx idx.MetricIndex) {
 				log.Error(3, "notifier: failed to convert %q to AMKey: %s -- skipping", c.Key, err)
 				continue
 			}
+			callPersistHooks(amkey, c.T0)
 			// we only need to handle saves for series that we know about.
 			// if the series is not in the index, then we dont need to worry about it.
 			def, ok := idx.Get(amkey.MKey)
 			if !ok {
-				log.Debug("notifier: skipping metric with MKey %s as it is not in the index", amkey.MKey)
+				if LogLevel.Get() < 2 {
+					log.Debug("notifier: skipping metric with MKey %s as it is not in the index", amkey.MKey)
+				}
 				continue
 			}
-			agg := metrics.GetOrCreate(amkey.MKey, def.SchemaId, def.AggId)
+			agg := metrics.GetOrCreate(amkey.MKey, def.SchemaId, def.AggId, def.Partition)
 			if amkey.Archive != 0 {
 				consolidator := consolidation.FromArchive(amkey.Archive.Method())
 				aggSpan := amkey.Archive.Span()
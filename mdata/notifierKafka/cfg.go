@@ -34,6 +34,9 @@ var backlogProcessTimeoutStr string
 var partitionOffset map[int32]*stats.Gauge64
 var partitionLogSize map[int32]*stats.Gauge64
 var partitionLag map[int32]*stats.Gauge64
+var saslEnabled bool
+var saslUsername string
+var saslPassword string
 
 // metric cluster.notifier.kafka.messages-published is a counter of messages published to the kafka cluster notifier
 var messagesPublished = stats.NewCounter32("cluster.notifier.kafka.messages-published")
@@ -52,6 +55,9 @@ func init() {
 	fs.StringVar(&dataDir, "data-dir", "", "Directory to store partition offsets index")
 	fs.DurationVar(&offsetCommitInterval, "offset-commit-interval", time.Second*5, "Interval at which offsets should be saved.")
 	fs.StringVar(&backlogProcessTimeoutStr, "backlog-process-timeout", "60s", "Maximum time backlog processing can block during metrictank startup.")
+	fs.BoolVar(&saslEnabled, "sasl-enabled", false, "use SASL/PLAIN authentication with the brokers")
+	fs.StringVar(&saslUsername, "sasl-username", "", "username for SASL authentication. may be an env:, file: or vault: reference, see the secrets section")
+	fs.StringVar(&saslPassword, "sasl-password", "", "password for SASL authentication. may be an env:, file: or vault: reference, see the secrets section")
 	globalconf.Register("kafka-cluster", fs)
 }
 
@@ -79,6 +85,12 @@ func ConfigProcess(instance string) {
 	config.Producer.Retry.Max = 10                   // Retry up to 10 times to produce the message
 	config.Producer.Compression = sarama.CompressionSnappy
 	config.Producer.Return.Successes = true
+	if saslEnabled {
+		err = kafka.SetSASL(config, saslUsername, saslPassword)
+		if err != nil {
+			log.Fatal(4, "kafka-cluster: %s", err)
+		}
+	}
 	err = config.Validate()
 	if err != nil {
 		log.Fatal(2, "kafka-cluster invalid consumer config: %s", err)
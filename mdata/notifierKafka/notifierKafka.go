@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	schema "gopkg.in/raintank/schema.v1"
@@ -31,6 +32,13 @@ type NotifierKafka struct {
 	offsetMgr *kafka.OffsetMgr
 	StopChan  chan int
 
+	// the offset of the next message to process, per partition. accessed atomically
+	next map[int32]*int64
+	// flushes asks produce to send the buffered messages
+	flushes chan chan struct{}
+	// the number of batches that are being sent. accessed atomically
+	sending int64
+
 	// signal to PartitionConsumers to shutdown
 	stopConsuming chan struct{}
 }
@@ -66,6 +74,8 @@ func New(instance string, metrics mdata.Metrics, idx idx.MetricIndex) *NotifierK
 		consumer:  consumer,
 		producer:  producer,
 		offsetMgr: offsetMgr,
+		next:      make(map[int32]*int64),
+		flushes:   make(chan chan struct{}),
 
 		StopChan:      make(chan int),
 		stopConsuming: make(chan struct{}),
@@ -100,6 +110,14 @@ func (c *NotifierKafka) start() {
 			}
 		}
 		partitionLogSize[partition].Set(int(bootTimeOffsets[partition]))
+		next := offset
+		if next < 0 {
+			next, err = c.client.GetOffset(topic, partition, offset)
+			if err != nil {
+				log.Fatal(4, "kafka-cluster: Failed to resolve offset %d for %s:%d. %q", offset, topic, partition, err)
+			}
+		}
+		c.next[partition] = &next
 		if offset >= 0 {
 			partitionOffset[partition].Set(int(offset))
 			partitionLag[partition].Set(int(bootTimeOffsets[partition] - offset))
@@ -146,14 +164,16 @@ func (c *NotifierKafka) consumePartition(topic string, partition int32, currentO
 	partitionOffsetMetric := partitionOffset[partition]
 	partitionLogSizeMetric := partitionLogSize[partition]
 	partitionLagMetric := partitionLag[partition]
+	next := c.next[partition]
 	for {
 		select {
 		case msg := <-messages:
-			if mdata.LogLevel < 2 {
+			if mdata.LogLevel.Get() < 2 {
 				log.Debug("kafka-cluster received message: Topic %s, Partition: %d, Offset: %d, Key: %x", msg.Topic, msg.Partition, msg.Offset, msg.Key)
 			}
 			mdata.Handle(c.metrics, msg.Value, c.idx)
 			currentOffset = msg.Offset
+			atomic.StoreInt64(next, msg.Offset+1)
 		case <-ticker.C:
 			if err := c.offsetMgr.Commit(topic, partition, currentOffset); err != nil {
 				log.Error(3, "kafka-cluster failed to commit offset for %s:%d, %s", topic, partition, err)
@@ -218,10 +238,50 @@ func (c *NotifierKafka) produce() {
 			}
 		case <-ticker.C:
 			c.flush()
+		case done := <-c.flushes:
+			c.flush()
+			close(done)
 		}
 	}
 }
 
+// Flush sends the buffered persist messages, and waits until all messages given to us so far are sent,
+// or until the timeout expires. It returns whether they were sent.
+func (c *NotifierKafka) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	done := make(chan struct{})
+	select {
+	case c.flushes <- done:
+	case <-time.After(timeout):
+		return false
+	}
+	<-done
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for atomic.LoadInt64(&c.sending) != 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		<-tick.C
+	}
+	return true
+}
+
+// Lag returns how many persist messages, sent by us or our peers up until now, we have yet to process
+func (c *NotifierKafka) Lag() (int, error) {
+	var lag int64
+	for _, partition := range partitions {
+		newest, err := c.client.GetOffset(topic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return 0, err
+		}
+		if behind := newest - atomic.LoadInt64(c.next[partition]); behind > 0 {
+			lag += behind
+		}
+	}
+	return int(lag), nil
+}
+
 // flush makes sure the batch gets sent, asynchronously.
 func (c *NotifierKafka) flush() {
 	if len(c.buf) == 0 {
@@ -268,8 +328,12 @@ func (c *NotifierKafka) flush() {
 
 	c.buf = nil
 
+	atomic.AddInt64(&c.sending, 1)
 	go func() {
-		log.Debug("kafka-cluster sending %d batch metricPersist messages", len(payload))
+		defer atomic.AddInt64(&c.sending, -1)
+		if mdata.LogLevel.Get() < 2 {
+			log.Debug("kafka-cluster sending %d batch metricPersist messages", len(payload))
+		}
 		sent := false
 		for !sent {
 			err := c.producer.SendMessages(payload)
@@ -107,7 +107,9 @@ func (c *NotifierNSQ) flush() {
 	c.buf = nil
 
 	go func() {
-		log.Debug("CLU nsq-cluster sending %d batch metricPersist messages", len(msg.SavedChunks))
+		if mdata.LogLevel.Get() < 2 {
+			log.Debug("CLU nsq-cluster sending %d batch metricPersist messages", len(msg.SavedChunks))
+		}
 
 		data, err := json.Marshal(&msg)
 		if err != nil {
@@ -0,0 +1,127 @@
+// Package pin keeps track of the series that must stay in memory, e.g. those of
+// SLO-critical dashboards during an incident.
+// the AggMetrics of pinned series are not removed by the GC, even when they are stale,
+// and their chunks are not evicted from the chunk cache, not even when it is shrunk
+// by the memory governor.
+package pin
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric tank.pins is the number of pins that have not expired yet
+	numPins = stats.NewGauge32("tank.pins")
+
+	// metric tank.pinned_series is the number of series kept in memory because they are pinned
+	pinnedSeries = stats.NewGauge32("tank.pinned_series")
+)
+
+// Pin pins the series that matched its patterns and tag expressions when it was added,
+// until it expires
+type Pin struct {
+	Id       string   `json:"id"`
+	OrgId    uint32   `json:"orgId"`
+	Patterns []string `json:"patterns"`
+	Expr     []string `json:"expr"`
+	Created  int64    `json:"created"`
+	Expires  int64    `json:"expires"`
+	Series   int      `json:"series"`
+
+	keys []schema.MKey
+}
+
+// Pins is the set of pins of a node.
+// a nil *Pins has no pins, and pins nothing
+type Pins struct {
+	sync.RWMutex
+	pins map[string]*Pin
+	keys map[schema.MKey]int64 // for each pinned series, the latest expiry of its pins
+}
+
+func New() *Pins {
+	return &Pins{
+		pins: make(map[string]*Pin),
+		keys: make(map[schema.MKey]int64),
+	}
+}
+
+// Add adds the pin, pinning the given series. it replaces the pin with the same id, if any.
+func (p *Pins) Add(pin Pin, keys []schema.MKey) Pin {
+	pin.keys = keys
+	pin.Series = len(keys)
+	p.Lock()
+	p.pins[pin.Id] = &pin
+	p.update(time.Now().Unix())
+	p.Unlock()
+	return pin
+}
+
+// Get returns the pin with the given id, if it exists and has not expired
+func (p *Pins) Get(id string) (Pin, bool) {
+	p.RLock()
+	defer p.RUnlock()
+	pin, ok := p.pins[id]
+	if !ok || pin.Expires <= time.Now().Unix() {
+		return Pin{}, false
+	}
+	return *pin, true
+}
+
+// Del removes the pin with the given id, and returns whether it existed
+func (p *Pins) Del(id string) bool {
+	p.Lock()
+	defer p.Unlock()
+	_, ok := p.pins[id]
+	delete(p.pins, id)
+	p.update(time.Now().Unix())
+	return ok
+}
+
+// List returns the pins that have not expired, sorted by id
+func (p *Pins) List() []Pin {
+	p.Lock()
+	p.update(time.Now().Unix())
+	pins := make([]Pin, 0, len(p.pins))
+	for _, pin := range p.pins {
+		pins = append(pins, *pin)
+	}
+	p.Unlock()
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Id < pins[j].Id })
+	return pins
+}
+
+// Pinned returns whether the series is pinned
+func (p *Pins) Pinned(key schema.MKey) bool {
+	if p == nil {
+		return false
+	}
+	p.RLock()
+	expires, ok := p.keys[key]
+	p.RUnlock()
+	return ok && expires > time.Now().Unix()
+}
+
+// update removes the expired pins and rebuilds the set of pinned series.
+// caller must hold the write lock
+func (p *Pins) update(now int64) {
+	p.keys = make(map[schema.MKey]int64)
+	for id, pin := range p.pins {
+		if pin.Expires <= now {
+			delete(p.pins, id)
+			continue
+		}
+		for _, key := range pin.keys {
+			if pin.Expires > p.keys[key] {
+				p.keys[key] = pin.Expires
+			}
+		}
+	}
+	numPins.Set(len(p.pins))
+	pinnedSeries.Set(len(p.keys))
+}
@@ -0,0 +1,56 @@
+package pin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/raintank/schema.v1"
+)
+
+func TestPins(t *testing.T) {
+	a := schema.MKey{Org: 1, Key: [16]byte{1}}
+	b := schema.MKey{Org: 1, Key: [16]byte{2}}
+	c := schema.MKey{Org: 1, Key: [16]byte{3}}
+	now := time.Now().Unix()
+
+	var nilPins *Pins
+	if nilPins.Pinned(a) {
+		t.Fatalf("expected a nil Pins to pin nothing")
+	}
+
+	p := New()
+	p.Add(Pin{Id: "incident", OrgId: 1, Expires: now + 3600}, []schema.MKey{a, b})
+	p.Add(Pin{Id: "expired", OrgId: 1, Expires: now - 1}, []schema.MKey{c})
+	p.Add(Pin{Id: "slo", OrgId: 1, Expires: now + 60}, []schema.MKey{b})
+
+	for _, tc := range []struct {
+		key    schema.MKey
+		pinned bool
+	}{{a, true}, {b, true}, {c, false}} {
+		if got := p.Pinned(tc.key); got != tc.pinned {
+			t.Errorf("expected Pinned(%s) to be %t, got %t", tc.key, tc.pinned, got)
+		}
+	}
+
+	var ids []string
+	for _, pin := range p.List() {
+		ids = append(ids, pin.Id)
+	}
+	if !reflect.DeepEqual(ids, []string{"incident", "slo"}) {
+		t.Fatalf("expected the pins that have not expired, got %v", ids)
+	}
+	if pin, ok := p.Get("slo"); !ok || pin.Series != 1 {
+		t.Fatalf("expected pin slo with 1 series, got %v %t", pin, ok)
+	}
+
+	if !p.Del("incident") {
+		t.Fatalf("expected pin incident to be deleted")
+	}
+	if p.Pinned(a) || !p.Pinned(b) {
+		t.Errorf("expected only b to still be pinned, by pin slo")
+	}
+	if p.Del("incident") {
+		t.Errorf("expected a pin to be deleted only once")
+	}
+}
@@ -1,36 +1,219 @@
 package mdata
 
 import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
 	"github.com/grafana/metrictank/conf"
 )
 
+var (
+	// configLock protects Schemas and Aggregations against concurrent reloads
+	configLock    sync.RWMutex
+	configVersion = 1
+	configLoaded  = time.Now()
+
+	// the configuration as read from the files, and the overrides set at runtime.
+	// together they make up Schemas and Aggregations
+	fileSchemas      conf.Schemas
+	fileAggregations conf.Aggregations
+	overrides        []conf.Override
+
+	// EnsureTTLs is called with all TTLs in use before storage overrides are applied, so that the store
+	// can prepare for the new ones. metrictank sets it to the EnsureTTLs of its store
+	EnsureTTLs = func(ttls []uint32) error { return nil }
+)
+
 func MaxChunkSpan() uint32 {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return Schemas.MaxChunkSpan()
 }
 
 func TTLs() []uint32 {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return Schemas.TTLs()
 }
 
 // MatchSchema returns the schema for the given metric key, and the index of the schema (to efficiently reference it)
 // it will always find the schema because Schemas has a catchall default
 func MatchSchema(key string, interval int) (uint16, conf.Schema) {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return Schemas.Match(key, interval)
 }
 
 // MatchAgg returns the aggregation definition for the given metric key, and the index of it (to efficiently reference it)
 // it will always find the aggregation definition because Aggregations has a catchall default
 func MatchAgg(key string) (uint16, conf.Aggregation) {
+	configLock.RLock()
+	defer configLock.RUnlock()
 	return Aggregations.Match(key)
 }
 
+// GetSchema returns the schema for the given index, as returned by MatchSchema
+func GetSchema(i uint16) conf.Schema {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Schemas.Get(i)
+}
+
+// GetAgg returns the aggregation definition for the given index, as returned by MatchAgg
+func GetAgg(i uint16) conf.Aggregation {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Aggregations.Get(i)
+}
+
+// ConfigStatus describes the active storage-schemas and storage-aggregation configuration
+type ConfigStatus struct {
+	Version          int             `json:"version"`
+	Loaded           time.Time       `json:"loaded"`
+	SchemasFile      string          `json:"schemasFile"`
+	AggregationsFile string          `json:"aggregationsFile"`
+	Schemas          []string        `json:"schemas"`
+	Aggregations     []string        `json:"aggregations"`
+	Overrides        []conf.Override `json:"overrides"`
+}
+
+// GetConfigStatus returns the status of the active configuration
+func GetConfigStatus() ConfigStatus {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	status := ConfigStatus{
+		Version:          configVersion,
+		Loaded:           configLoaded,
+		SchemasFile:      schemasFile,
+		AggregationsFile: aggFile,
+		Overrides:        overrides,
+	}
+	schemas, def := Schemas.List()
+	for _, s := range schemas {
+		status.Schemas = append(status.Schemas, s.Name)
+	}
+	status.Schemas = append(status.Schemas, def.Name)
+	for _, a := range Aggregations.List() {
+		status.Aggregations = append(status.Aggregations, a.Name)
+	}
+	status.Aggregations = append(status.Aggregations, Aggregations.DefaultAggregation.Name)
+	return status
+}
+
+// IsCurrentConfig returns whether the given schema and aggregation indices belong to the active configuration.
+// series created before the last reload keep using the settings they were created with.
+func IsCurrentConfig(schemaId, aggId uint16) bool {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return Schemas.Current(schemaId) && Aggregations.Current(aggId)
+}
+
+// ReloadConfig re-reads the schemas and aggregations files. The new rules apply to series that are created
+// from now on, existing series keep their settings. The storage overrides remain in effect.
+// ensureTTLs is called with all TTLs in use, before the new rules are applied, so that the store
+// can prepare for the new ones. If it, or reading the files, fails, the active configuration is retained.
+// If the files didn't change, nothing happens.
+// Schemas and aggregations that didn't change keep their ids, so nodes can keep referring to them (see models.Req)
+func ReloadConfig(ensureTTLs func(ttls []uint32) error) error {
+	schemas, aggregations, err := ReadConfig()
+	if err != nil {
+		return err
+	}
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	if schemas.Equal(fileSchemas) && aggregations.Equal(fileAggregations) {
+		return nil
+	}
+	err = apply(schemas, aggregations, overrides, ensureTTLs)
+	if err != nil {
+		return err
+	}
+	fileSchemas, fileAggregations = schemas, aggregations
+	return nil
+}
+
+// StorageOverrides returns the active storage overrides
+func StorageOverrides() []conf.Override {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return overrides
+}
+
+// SetStorageOverrides replaces the storage overrides, which take precedence over the rules of the files.
+// Like with ReloadConfig, the new rules apply to series that are created from now on, and if the overrides
+// are invalid, or EnsureTTLs fails, the active configuration is retained.
+func SetStorageOverrides(o []conf.Override) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+	err := apply(fileSchemas, fileAggregations, o, EnsureTTLs)
+	if err != nil {
+		return err
+	}
+	overrides = o
+	return nil
+}
+
+// apply activates the given file configuration with the overrides applied. callers must hold the configLock.
+func apply(schemas conf.Schemas, aggregations conf.Aggregations, o []conf.Override, ensureTTLs func(ttls []uint32) error) error {
+	schemas, aggregations, err := conf.ApplyOverrides(schemas, aggregations, o)
+	if err != nil {
+		return err
+	}
+	newSchemas := Schemas.Extend(schemas)
+	err = ensureTTLs(newSchemas.TTLs())
+	if err != nil {
+		return err
+	}
+	Schemas = newSchemas
+	Aggregations = Aggregations.Extend(aggregations)
+	configVersion++
+	configLoaded = time.Now()
+	return nil
+}
+
+// ReadConfig reads the storage-schemas and storage-aggregation files, without activating them.
+// like on startup, a missing storage-aggregation file results in the default aggregations.
+func ReadConfig() (conf.Schemas, conf.Aggregations, error) {
+	schemas, err := conf.ReadSchemas(schemasFile)
+	if err != nil {
+		return schemas, conf.Aggregations{}, fmt.Errorf("can't read schemas file %q: %s", schemasFile, err)
+	}
+	aggregations := conf.NewAggregations()
+	if _, err := ioutil.ReadFile(aggFile); err == nil {
+		aggregations, err = conf.ReadAggregations(aggFile)
+		if err != nil {
+			return schemas, aggregations, fmt.Errorf("can't read storage-aggregation file %q: %s", aggFile, err)
+		}
+	}
+	return schemas, aggregations, nil
+}
+
 func SetSingleSchema(ret ...conf.Retention) {
 	Schemas = conf.NewSchemas(nil)
 	Schemas.DefaultSchema.Retentions = conf.Retentions(ret)
 	Schemas.BuildIndex()
+	fileSchemas = Schemas
 }
 
 func SetSingleAgg(met ...conf.Method) {
 	Aggregations = conf.NewAggregations()
 	Aggregations.DefaultAggregation.AggregationMethod = met
+	fileAggregations = Aggregations
+}
+
+// SchemaTTL returns the longest retention, in seconds, of the storage schema with the given name,
+// and whether there is such a schema
+func SchemaTTL(name string) (uint32, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	raw, def := Schemas.List()
+	for _, s := range append(append([]conf.Schema{}, raw...), def) {
+		if s.Name == name && len(s.Retentions) > 0 {
+			return uint32(s.Retentions[len(s.Retentions)-1].MaxRetention()), true
+		}
+	}
+	return 0, false
 }
@@ -0,0 +1,98 @@
+package mdata
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdata-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_schemasFile, _aggFile, _schemas, _aggs := schemasFile, aggFile, Schemas, Aggregations
+	defer func() { schemasFile, aggFile, Schemas, Aggregations = _schemasFile, _aggFile, _schemas, _aggs }()
+	schemasFile = filepath.Join(dir, "storage-schemas.conf")
+	aggFile = filepath.Join(dir, "storage-aggregation.conf")
+
+	SetSingleSchema(conf.NewRetentionMT(10, 3600*24, 600, 2, true))
+	SetSingleAgg(conf.Avg)
+	oldSchemaId, _ := MatchSchema("foo", 10)
+	oldAggId, _ := MatchAgg("foo")
+	version := GetConfigStatus().Version
+
+	// a missing schemas file is an error, and keeps the config as is
+	err = ReloadConfig(func([]uint32) error { return nil })
+	if err == nil || GetConfigStatus().Version != version {
+		t.Fatalf("expected reload without schemas file to fail and keep the config")
+	}
+
+	schemas := "[foo]\npattern = ^foo\nretentions = 10s:30d:1h:2\n"
+	if err := ioutil.WriteFile(schemasFile, []byte(schemas), 0644); err != nil {
+		t.Fatal(err)
+	}
+	aggs := "[foo]\npattern = ^foo\nxFilesFactor = 0.5\naggregationMethod = max\n"
+	if err := ioutil.WriteFile(aggFile, []byte(aggs), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// if the store can't handle the ttls, the config is kept as is
+	err = ReloadConfig(func([]uint32) error { return errors.New("no") })
+	if err == nil || GetConfigStatus().Version != version {
+		t.Fatalf("expected reload to fail when the store can't ensure the ttls")
+	}
+
+	var ttls []uint32
+	err = ReloadConfig(func(in []uint32) error { ttls = in; return nil })
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(ttls) != 2 {
+		t.Fatalf("expected the old and new ttl to be ensured, got %v", ttls)
+	}
+	status := GetConfigStatus()
+	if status.Version != version+1 || status.Schemas[0] != "foo" || status.Aggregations[0] != "foo" {
+		t.Fatalf("unexpected config status after reload %+v", status)
+	}
+
+	schemaId, schema := MatchSchema("foo", 10)
+	aggId, agg := MatchAgg("foo")
+	if schema.Name != "foo" || agg.Name != "foo" || !IsCurrentConfig(schemaId, aggId) {
+		t.Fatalf("expected new series to use the new config, got schema %q agg %q", schema.Name, agg.Name)
+	}
+	if GetSchema(oldSchemaId).Retentions[0].MaxRetention() != 3600*24 || GetAgg(oldAggId).AggregationMethod[0] != conf.Avg {
+		t.Fatalf("expected the old ids to keep resolving to the old settings")
+	}
+	if IsCurrentConfig(oldSchemaId, oldAggId) {
+		t.Fatalf("expected the old ids to not be current")
+	}
+
+	// reloading unchanged files does nothing
+	err = ReloadConfig(func([]uint32) error { return nil })
+	if err != nil || GetConfigStatus().Version != version+1 {
+		t.Fatalf("expected reload of unchanged files to keep the config, got err %v", err)
+	}
+
+	// when only the aggregations change, the schemas keep their ids
+	aggs = "[foo]\npattern = ^foo\nxFilesFactor = 0.5\naggregationMethod = sum\n"
+	if err := ioutil.WriteFile(aggFile, []byte(aggs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = ReloadConfig(func([]uint32) error { return nil })
+	if err != nil || GetConfigStatus().Version != version+2 {
+		t.Fatalf("expected reload to succeed, got err %v", err)
+	}
+	if id, _ := MatchSchema("foo", 10); id != schemaId {
+		t.Fatalf("expected the unchanged schema to keep id %d, got %d", schemaId, id)
+	}
+	if id, agg := MatchAgg("foo"); id == aggId || agg.AggregationMethod[0] != conf.Sum || IsCurrentConfig(schemaId, aggId) {
+		t.Fatalf("expected the changed aggregation to get a new id, got %d", id)
+	}
+}
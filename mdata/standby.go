@@ -0,0 +1,251 @@
+package mdata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// StandbyForwarder, when set, receives the chunks that a primary closes, so that they can be sent to the
+	// secondaries of the partition. it's called with the lock of the metric held, so it must not block.
+	StandbyForwarder func(StandbyChunk)
+
+	// metric tank.standby.chunks-received is how many chunks were received from primaries, via the standby replication
+	standbyChunksReceived = stats.NewCounter32("tank.standby.chunks-received")
+	// metric tank.standby.chunks-merged is how many received standby chunks added points to the chunks in memory
+	standbyChunksMerged = stats.NewCounter32("tank.standby.chunks-merged")
+	// metric tank.standby.points-merged is how many points were added to the chunks in memory by standby chunks
+	standbyPointsMerged = stats.NewCounter32("tank.standby.points-merged")
+)
+
+// StandbyChunk is a chunk of a primary, sent to the secondaries of its partition so that they have its data
+// before they consume it from kafka. it's either a closed chunk or a snapshot of an open chunk.
+// Key is a stringified schema.AMKey
+type StandbyChunk struct {
+	Key       string         `json:"key"`
+	Partition int32          `json:"partition"`
+	T0        uint32         `json:"t0"`
+	Encoding  chunk.Encoding `json:"encoding"`
+	Data      []byte         `json:"data"`
+}
+
+func (a *AggMetric) standbyChunk(c *chunk.Chunk) StandbyChunk {
+	return StandbyChunk{
+		Key:       a.Key.String(),
+		Partition: a.partition,
+		T0:        c.T0,
+		Encoding:  c.Encoding(),
+		Data:      c.Bytes(),
+	}
+}
+
+// forwardStandby hands the closed chunk to the StandbyForwarder, if there is one
+func (a *AggMetric) forwardStandby(c *chunk.Chunk) {
+	if StandbyForwarder != nil {
+		StandbyForwarder(a.standbyChunk(c))
+	}
+}
+
+// SnapshotCurrent returns a copy of the current chunk with the points it has so far, for the raw data as well as for the rollups,
+// if the metric was written to at or after since. closed chunks are not included: they are forwarded when they get closed.
+func (a *AggMetric) SnapshotCurrent(since uint32) []StandbyChunk {
+	var snapshots []StandbyChunk
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		for _, m := range []*AggMetric{agg.minMetric, agg.maxMetric, agg.sumMetric, agg.cntMetric, agg.lstMetric} {
+			if m != nil {
+				snapshots = append(snapshots, m.SnapshotCurrent(since)...)
+			}
+		}
+	}
+
+	a.RLock()
+	defer a.RUnlock()
+	if len(a.Chunks) == 0 || a.lastWrite < since {
+		return snapshots
+	}
+	current := a.getChunk(a.CurrentChunkPos)
+	if current == nil || current.Closed || current.NumPoints == 0 {
+		return snapshots
+	}
+	c := chunk.NewWithEncoding(current.T0, current.Encoding())
+	it := current.Iter()
+	for it.Next() {
+		c.Push(it.Values())
+	}
+	// the copy is not part of our ringbuffer
+	c.Clear()
+	c.Finish()
+	return append(snapshots, a.standbyChunk(c))
+}
+
+// SnapshotCurrent returns snapshots of the current chunks of the metrics of the partitions we are primary for,
+// that were written to at or after since. see AggMetric.SnapshotCurrent
+func (ms *AggMetrics) SnapshotCurrent(since uint32) []StandbyChunk {
+	ms.RLock()
+	metrics := make([]*AggMetric, 0, len(ms.Metrics))
+	for _, m := range ms.Metrics {
+		metrics = append(metrics, m)
+	}
+	ms.RUnlock()
+
+	var snapshots []StandbyChunk
+	for _, m := range metrics {
+		if cluster.Manager.IsPrimaryFor(m.partition) {
+			snapshots = append(snapshots, m.SnapshotCurrent(since)...)
+		}
+	}
+	return snapshots
+}
+
+// archiveMetric returns the metric that holds the data of the given archive: the metric itself for the raw data,
+// or the one of the matching rollup. nil if we don't have the archive.
+func (a *AggMetric) archiveMetric(archive schema.Archive) *AggMetric {
+	if archive == 0 {
+		return a
+	}
+	// no lock needed cause aggregators don't change at runtime
+	for _, agg := range a.aggregators {
+		if agg.span != archive.Span() {
+			continue
+		}
+		switch consolidation.FromArchive(archive.Method()) {
+		case consolidation.Min:
+			return agg.minMetric
+		case consolidation.Max:
+			return agg.maxMetric
+		case consolidation.Sum:
+			return agg.sumMetric
+		case consolidation.Cnt:
+			return agg.cntMetric
+		case consolidation.Lst:
+			return agg.lstMetric
+		}
+		return nil
+	}
+	return nil
+}
+
+// mergeStandby adds the points of the iterator to our chunk with the given t0, if we have it.
+// the points we have ourselves take precedence. the chunk keeps its closed state.
+// when the points go beyond the ones we consumed, we remember up to where we consumed, so that add doesn't reject
+// those points as too old when they come in from kafka, and still feeds them to the aggregators.
+// returns the number of points that were added.
+func (a *AggMetric) mergeStandby(t0 uint32, theirs chunk.Iter) int {
+	a.Lock()
+	defer a.Unlock()
+	for i, c := range a.Chunks {
+		if c.T0 != t0 {
+			continue
+		}
+		merged := chunk.NewWithEncoding(t0, c.Encoding())
+		ours := c.Iter()
+		okO, okT := ours.Next(), theirs.Next()
+		var added int
+		for okO || okT {
+			var tsO, tsT uint32
+			var valO, valT float64
+			if okO {
+				tsO, valO = ours.Values()
+			}
+			if okT {
+				tsT, valT = theirs.Values()
+			}
+			switch {
+			case okT && (!okO || tsT < tsO):
+				merged.Push(tsT, valT)
+				added++
+				okT = theirs.Next()
+			case okT && tsT == tsO:
+				okT = theirs.Next()
+			default:
+				merged.Push(tsO, valO)
+				okO = ours.Next()
+			}
+		}
+		if added == 0 {
+			merged.Clear()
+			return 0
+		}
+		if c.Closed {
+			merged.Finish()
+		}
+		if i == a.CurrentChunkPos && merged.LastTs > c.LastTs {
+			// unless a previous merge is still ahead of what we consumed, we consumed up to our last point
+			if c.LastTs > a.mergedTs || a.mergedTs <= a.consumedTs {
+				a.consumedTs = c.LastTs
+			}
+			a.mergedTs = merged.LastTs
+		}
+		c.Clear()
+		a.Chunks[i] = merged
+		return added
+	}
+	return 0
+}
+
+// standbyKey parses the key of a standby chunk.
+// schema.AMKeyFromString leaves out the archive of rollup keys such as <mkey>_sum_600, so we set it ourselves
+func standbyKey(s string) (schema.AMKey, error) {
+	amkey, err := schema.AMKeyFromString(s)
+	if err != nil {
+		return amkey, err
+	}
+	splits := strings.Split(s, "_")
+	if len(splits) != 3 {
+		return amkey, nil
+	}
+	method, err := schema.MethodFromString(splits[1])
+	if err != nil {
+		return amkey, err
+	}
+	span, err := strconv.ParseUint(splits[2], 10, 32)
+	if err != nil || !schema.IsSpanValid(uint32(span)) {
+		return amkey, fmt.Errorf("invalid span %q", splits[2])
+	}
+	amkey.Archive = schema.NewArchive(method, uint32(span))
+	return amkey, nil
+}
+
+// MergeStandbyChunks adds the points of chunks sent by a primary to the chunks we have in memory.
+// only metrics and chunks we have are affected: what we don't have yet, we still get from kafka.
+// returns the number of chunks that added points.
+func MergeStandbyChunks(metrics Metrics, chunks []StandbyChunk) int {
+	standbyChunksReceived.Add(len(chunks))
+	var merged int
+	for _, c := range chunks {
+		amkey, err := standbyKey(c.Key)
+		if err != nil {
+			log.Error(3, "standby: failed to convert %q to AMKey: %s -- skipping", c.Key, err)
+			continue
+		}
+		m, ok := metrics.Get(amkey.MKey)
+		if !ok {
+			continue
+		}
+		am := m.(*AggMetric).archiveMetric(amkey.Archive)
+		if am == nil {
+			continue
+		}
+		itgen := chunk.IterGen{B: c.Data, Ts: c.T0, Encoding: c.Encoding}
+		it, err := itgen.Get()
+		if err != nil {
+			log.Error(3, "standby: failed to decode chunk %s T0: %d: %s -- skipping", c.Key, c.T0, err)
+			continue
+		}
+		if added := am.mergeStandby(c.T0, *it); added > 0 {
+			standbyPointsMerged.Add(added)
+			merged++
+		}
+	}
+	standbyChunksMerged.Add(merged)
+	return merged
+}
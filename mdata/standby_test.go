@@ -0,0 +1,158 @@
+package mdata
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// standbyPoints returns the points of the chunks of the metric. it assumes the ringbuffer didn't wrap around yet
+func standbyPoints(m *AggMetric) []point {
+	var points []point
+	for _, c := range m.Chunks {
+		it := c.Iter()
+		for it.Next() {
+			ts, val := it.Values()
+			points = append(points, point{ts, val})
+		}
+	}
+	return points
+}
+
+func TestStandbyChunks(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	mockstore.Reset()
+	ret := conf.NewRetentionMT(1, 1, 10, 5, true)
+	SetSingleSchema(ret)
+	SetSingleAgg(conf.Avg)
+
+	var forwarded []StandbyChunk
+	StandbyForwarder = func(c StandbyChunk) {
+		forwarded = append(forwarded, c)
+	}
+	defer func() {
+		StandbyForwarder = nil
+	}()
+
+	key := test.GetAMKey(42)
+
+	// the secondary is behind, and has some points of its own
+	cluster.Manager.SetPrimary(false)
+	secondary := NewAggMetrics(mockstore, &cache.MockCache{}, false, 3600, 21600, 0, nil)
+	sm := secondary.GetOrCreate(key.MKey, 0, 0, 0).(*AggMetric)
+	sm.Add(10, 10)
+	sm.Add(12, 100)
+	sm.Add(20, 20)
+	if len(forwarded) != 0 {
+		t.Fatalf("expected a secondary not to forward chunks, got %v", forwarded)
+	}
+
+	cluster.Manager.SetPrimary(true)
+	primary := NewAggMetric(mockstore, &cache.MockCache{}, key, conf.Retentions{ret}, 0, nil, false)
+	for _, ts := range []uint32{10, 11, 12, 13, 20, 21} {
+		primary.Add(ts, float64(ts))
+	}
+	if len(forwarded) != 1 || forwarded[0].T0 != 10 {
+		t.Fatalf("expected the closed chunk 10 to be forwarded, got %v", forwarded)
+	}
+	snapshots := primary.SnapshotCurrent(0)
+	if len(snapshots) != 1 || snapshots[0].T0 != 20 {
+		t.Fatalf("expected a snapshot of the open chunk 20, got %v", snapshots)
+	}
+	if snapshots := primary.SnapshotCurrent(uint32(time.Now().Unix()) + 10); len(snapshots) != 0 {
+		t.Fatalf("expected no snapshots of a metric that wasn't written to since, got %v", snapshots)
+	}
+
+	cluster.Manager.SetPrimary(false)
+	if merged := MergeStandbyChunks(secondary, append(forwarded, snapshots...)); merged != 2 {
+		t.Fatalf("expected both chunks to be merged, got %d", merged)
+	}
+	// our own points take precedence
+	exp := []point{{10, 10}, {11, 11}, {12, 100}, {13, 13}, {20, 20}, {21, 21}}
+	if got := standbyPoints(sm); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected points %v, got %v", exp, got)
+	}
+	// merging again doesn't add anything
+	if merged := MergeStandbyChunks(secondary, append(forwarded, snapshots...)); merged != 0 {
+		t.Fatalf("expected nothing to merge the second time, got %d", merged)
+	}
+
+	// the open chunk stays open, the closed one closed
+	sm.Add(22, 22)
+	if c := sm.getChunk(sm.CurrentChunkPos); c.Closed || c.NumPoints != 3 {
+		t.Fatalf("expected the current chunk to stay open and take new points, got %s", c)
+	}
+	if c := sm.Chunks[0]; c.T0 != 10 || !c.Closed {
+		t.Fatalf("expected chunk 10 to stay closed, got %s", c)
+	}
+
+	// chunks of series we don't have are ignored
+	other := StandbyChunk{Key: test.GetAMKey(43).String(), T0: 10, Data: forwarded[0].Data}
+	if merged := MergeStandbyChunks(secondary, []StandbyChunk{other}); merged != 0 {
+		t.Fatalf("expected chunks of unknown series to be ignored, got %d merged", merged)
+	}
+}
+
+func TestStandbyRollups(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	mockstore.Reset()
+	raw := conf.NewRetentionMT(1, 3600, 100, 5, true)
+	rollup := conf.NewRetentionMT(10, 3600, 100, 5, true)
+	SetSingleSchema(raw, rollup)
+	SetSingleAgg(conf.Sum, conf.Max)
+	agg := GetAgg(0)
+	key := test.GetAMKey(42)
+
+	cluster.Manager.SetPrimary(true)
+	primary := NewAggMetric(mockstore, &cache.MockCache{}, key, conf.Retentions{raw, rollup}, 0, &agg, false)
+	for ts := uint32(100); ts <= 135; ts++ {
+		primary.Add(ts, float64(ts))
+	}
+	snapshots := primary.SnapshotCurrent(0)
+
+	// the secondary lags behind: it consumed up to 115, so its sum rollup has the point of 110 only
+	cluster.Manager.SetPrimary(false)
+	secondary := NewAggMetric(mockstore, &cache.MockCache{}, key, conf.Retentions{raw, rollup}, 0, &agg, false)
+	for ts := uint32(100); ts <= 115; ts++ {
+		secondary.Add(ts, float64(ts))
+	}
+	metrics := NewAggMetrics(mockstore, &cache.MockCache{}, false, 3600, 21600, 0, nil)
+	metrics.Metrics[key.MKey] = secondary
+	if merged := MergeStandbyChunks(metrics, snapshots); merged != 3 {
+		t.Fatalf("expected the raw, sum and max chunks to be merged, got %d", merged)
+	}
+
+	// the points it merged still come in from kafka: they're not too old, and they make it into the rollups
+	tooOld := metricsTooOld.Peek()
+	for ts := uint32(116); ts <= 135; ts++ {
+		secondary.Add(ts, float64(ts))
+	}
+	if metricsTooOld.Peek() != tooOld {
+		t.Fatalf("expected no points to be too old, got %d", metricsTooOld.Peek()-tooOld)
+	}
+	for _, method := range []schema.Method{schema.Sum, schema.Max} {
+		archive := schema.NewArchive(method, 10)
+		exp := standbyPoints(primary.archiveMetric(archive))
+		if got := standbyPoints(secondary.archiveMetric(archive)); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("%s: expected points %v, got %v", archive, exp, got)
+		}
+	}
+	if exp, got := standbyPoints(primary), standbyPoints(secondary); !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected raw points %v, got %v", exp, got)
+	}
+
+	// the aggregators of the secondary carry on like those of the primary
+	primary.Add(141, 141)
+	secondary.Add(141, 141)
+	archive := schema.NewArchive(schema.Sum, 10)
+	exp := standbyPoints(primary.archiveMetric(archive))
+	if got := standbyPoints(secondary.archiveMetric(archive)); !reflect.DeepEqual(got, exp) || len(got) != 5 {
+		t.Fatalf("expected sum points %v, got %v", exp, got)
+	}
+}
@@ -2,7 +2,7 @@ package mdata
 
 import (
 	"context"
-	"errors"
+	"sort"
 
 	schema "gopkg.in/raintank/schema.v1"
 
@@ -39,7 +39,7 @@ func (c *MockStore) Items() int {
 // Add adds a chunk to the store
 func (c *MockStore) Add(cwr *ChunkWriteRequest) {
 	if !c.Drop {
-		itgen := chunk.NewBareIterGen(cwr.Chunk.Series.Bytes(), cwr.Chunk.Series.T0, cwr.Span)
+		itgen := cwr.Chunk.IterGen(cwr.Span)
 		c.results[cwr.Key] = append(c.results[cwr.Key], *itgen)
 		c.items++
 	}
@@ -47,15 +47,10 @@ func (c *MockStore) Add(cwr *ChunkWriteRequest) {
 
 // searches through the mock results and returns the right ones according to start / end
 func (c *MockStore) Search(ctx context.Context, metric schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
-	var itgens []chunk.IterGen
-	var ok bool
 	res := make([]chunk.IterGen, 0)
 
-	if itgens, ok = c.results[metric]; !ok {
-		return res, errors.New("metric not found")
-	}
-
-	for _, itgen := range itgens {
+	// like the cassandra store, we return no chunks for unknown metrics
+	for _, itgen := range c.results[metric] {
 		// start is inclusive, end is exclusive
 		if itgen.Ts < end && itgen.EndTs() > start && start < end {
 			res = append(res, itgen)
@@ -65,6 +60,36 @@ func (c *MockStore) Search(ctx context.Context, metric schema.AMKey, ttl, start,
 	return res, nil
 }
 
+// ReplaceChunks saves the chunks, and deletes the ones of the same series with the given t0s.
+// chunks with the same t0 as a saved one are overwritten
+func (c *MockStore) ReplaceChunks(ctx context.Context, cwrs []*ChunkWriteRequest, old []uint32) error {
+	if len(cwrs) == 0 {
+		return nil
+	}
+	key := cwrs[0].Key
+	del := make(map[uint32]bool)
+	for _, t0 := range old {
+		del[t0] = true
+	}
+	for _, cwr := range cwrs {
+		del[cwr.Chunk.T0] = true
+	}
+	var kept []chunk.IterGen
+	for _, itgen := range c.results[key] {
+		if del[itgen.Ts] {
+			c.items--
+			continue
+		}
+		kept = append(kept, itgen)
+	}
+	c.results[key] = kept
+	for _, cwr := range cwrs {
+		c.Add(cwr)
+	}
+	sort.Slice(c.results[key], func(i, j int) bool { return c.results[key][i].Ts < c.results[key][j].Ts })
+	return nil
+}
+
 func (c *MockStore) Stop() {
 }
 
@@ -0,0 +1,62 @@
+package wal
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled          bool
+	dir              string
+	fsyncIntervalStr string
+	fsyncInterval    time.Duration
+	segmentSize      int64
+	maxSize          int64
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("wal", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "record incoming points in a write-ahead log on local disk, and replay it on startup, so the data that was not saved to the store yet survives a restart or crash")
+	fs.StringVar(&dir, "dir", "/var/lib/metrictank/wal", "directory for the segment files of the write-ahead log. every partition gets its own subdirectory")
+	fs.StringVar(&fsyncIntervalStr, "fsync-interval", "1s", "how often written points are synced to disk. on a crash, the points of the last interval may be lost. 0 to sync after every point, which is slow")
+	fs.Int64Var(&segmentSize, "segment-size", 64*1024*1024, "size in bytes after which a new segment file is started. segments are removed once all of their data is older than twice the largest chunkspan")
+	fs.Int64Var(&maxSize, "max-size", 1024*1024*1024, "max total size in bytes of all segment files. when exceeded, the oldest segments are removed even if their data may still be needed")
+	globalconf.Register("wal", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if dir == "" {
+		findings = append(findings, conf.NewError("wal.dir", "can't be empty"))
+	}
+	if _, err := dur.ParseDuration(fsyncIntervalStr); err != nil {
+		findings = append(findings, conf.NewError("wal.fsync-interval", "invalid duration %q: %s", fsyncIntervalStr, err))
+	}
+	if segmentSize < recordSize {
+		findings = append(findings, conf.NewError("wal.segment-size", "must be at least %d", recordSize))
+	}
+	if maxSize < 2*segmentSize {
+		findings = append(findings, conf.NewError("wal.max-size", "must be at least twice the segment-size"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+	if Enabled {
+		fsyncInterval = time.Duration(dur.MustParseDuration("fsync-interval", fsyncIntervalStr)) * time.Second
+	}
+}
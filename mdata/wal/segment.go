@@ -0,0 +1,158 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// every partition has its own directory of segment files, named after their sequence number.
+// a segment starts with a header of the format byte and the time at which the segment was created.
+// it's followed by fixed size records: the org, the key, the timestamp and the value of a point,
+// and a crc32 of these fields. all numbers are little endian.
+
+const (
+	segmentFormatV1 = 1
+	headerSize      = 5
+	recordSize      = 4 + 16 + 4 + 8 + 4
+	segmentSuffix   = ".wal"
+)
+
+var (
+	errCorruptRecord = errors.New("checksum mismatch")
+	errBadHeader     = errors.New("invalid segment header")
+)
+
+type record struct {
+	key schema.MKey
+	ts  uint32
+	val float64
+}
+
+func encodeRecord(buf []byte, r record) {
+	binary.LittleEndian.PutUint32(buf[0:4], r.key.Org)
+	copy(buf[4:20], r.key.Key[:])
+	binary.LittleEndian.PutUint32(buf[20:24], r.ts)
+	binary.LittleEndian.PutUint64(buf[24:32], math.Float64bits(r.val))
+	binary.LittleEndian.PutUint32(buf[32:36], crc32.ChecksumIEEE(buf[:32]))
+}
+
+func decodeRecord(buf []byte) (record, error) {
+	if crc32.ChecksumIEEE(buf[:32]) != binary.LittleEndian.Uint32(buf[32:36]) {
+		return record{}, errCorruptRecord
+	}
+	var r record
+	r.key.Org = binary.LittleEndian.Uint32(buf[0:4])
+	copy(r.key.Key[:], buf[4:20])
+	r.ts = binary.LittleEndian.Uint32(buf[20:24])
+	r.val = math.Float64frombits(binary.LittleEndian.Uint64(buf[24:32]))
+	return r, nil
+}
+
+func encodeHeader(created uint32) []byte {
+	buf := make([]byte, headerSize)
+	buf[0] = segmentFormatV1
+	binary.LittleEndian.PutUint32(buf[1:5], created)
+	return buf
+}
+
+// segment describes a segment file
+type segment struct {
+	seq      uint32
+	created  uint32 // unix timestamp. all points received since then are in this segment or later ones
+	modified uint32 // unix timestamp of the last write. only set for the segments that existed on startup
+	size     int64
+}
+
+func segmentPath(dir string, seq uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%010d%s", seq, segmentSuffix))
+}
+
+type segmentsBySeq []segment
+
+func (s segmentsBySeq) Len() int           { return len(s) }
+func (s segmentsBySeq) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s segmentsBySeq) Less(i, j int) bool { return s[i].seq < s[j].seq }
+
+// listSegments returns the segments in the directory, oldest first
+func listSegments(dir string) ([]segment, error) {
+	entries, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, path := range entries {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), segmentSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		s := segment{seq: uint32(seq)}
+		s.created, s.modified, s.size, err = readHeader(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		segments = append(segments, s)
+	}
+	sort.Sort(segmentsBySeq(segments))
+	return segments, nil
+}
+
+// readHeader returns the creation time, modification time and size of the segment file
+func readHeader(path string) (uint32, uint32, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	buf := make([]byte, headerSize)
+	if _, err := io.ReadFull(f, buf); err != nil || buf[0] != segmentFormatV1 {
+		return 0, 0, 0, errBadHeader
+	}
+	return binary.LittleEndian.Uint32(buf[1:5]), uint32(info.ModTime().Unix()), info.Size(), nil
+}
+
+// readSegment calls fn for every record in the segment file.
+// it returns the number of corrupt records, which are skipped. a partially written record at the end is ignored.
+func readSegment(path string, fn func(record)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	if _, err := r.Discard(headerSize); err != nil {
+		return 0, errBadHeader
+	}
+	buf := make([]byte, recordSize)
+	var corrupt int
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return corrupt, nil
+		}
+		if err != nil {
+			return corrupt, err
+		}
+		rec, err := decodeRecord(buf)
+		if err != nil {
+			corrupt++
+			continue
+		}
+		fn(rec)
+	}
+}
@@ -0,0 +1,424 @@
+// Package wal implements a write-ahead log for the points that metrictank receives.
+// points are only persisted once the chunk they belong to is saved to the store, so on a restart or crash
+// the data of the chunks in memory is lost, unless it can be consumed again (e.g. from kafka).
+// the write-ahead log records the points in segment files on local disk, and replays them on startup.
+package wal
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric wal.points is how many points were written to the write-ahead log
+	pointsWritten = stats.NewCounter32("wal.points")
+	// metric wal.errors is how many points could not be written to the write-ahead log
+	writeErrors = stats.NewCounter32("wal.errors")
+	// metric wal.fsync is how long it takes to sync a segment to disk
+	fsyncDuration = stats.NewLatencyHistogram15s32("wal.fsync")
+	// metric wal.size is the total size in bytes of all segments
+	walSize = stats.NewGauge64("wal.size")
+	// metric wal.segments is the number of segments
+	walSegments = stats.NewGauge32("wal.segments")
+	// metric wal.segments_dropped is how many segments were removed because max-size was exceeded, while their data may still have been needed
+	segmentsDropped = stats.NewCounter32("wal.segments_dropped")
+	// metric wal.replay.points is how many points were replayed on startup
+	replayedPoints = stats.NewCounter32("wal.replay.points")
+	// metric wal.replay.unknown is how many points were not replayed because their series is not in the index
+	replayedUnknown = stats.NewCounter32("wal.replay.unknown")
+	// metric wal.replay.corrupt is how many records were skipped during the replay because their checksum didn't match
+	replayedCorrupt = stats.NewCounter32("wal.replay.corrupt")
+)
+
+// WAL is a write-ahead log with a directory of segment files per partition.
+// all methods are nil-safe, a nil WAL doesn't record anything
+type WAL struct {
+	dir           string
+	segmentSize   int64
+	maxSize       int64
+	fsyncInterval time.Duration
+	retain        func() uint32 // how long the data of a segment may be needed to rebuild the chunks in memory
+	now           func() time.Time
+
+	sync.RWMutex // protects partitions
+	partitions   map[int32]*partitionLog
+
+	shutdown chan struct{}  // closed by Close to stop run
+	wg       sync.WaitGroup // run
+}
+
+// partitionLog is the part of the write-ahead log of one partition
+type partitionLog struct {
+	sync.Mutex
+	dir      string
+	segments []segment // oldest first. the last one is the active one, if file is set
+	file     *os.File
+	buf      *bufio.Writer
+	dirty    bool // written to since the last sync
+	rec      [recordSize]byte
+}
+
+// New returns the write-ahead log as configured, with the segments that exist already. or nil if it's disabled
+func New() (*WAL, error) {
+	if !Enabled {
+		return nil, nil
+	}
+	w, err := open(dir, segmentSize, maxSize, fsyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func open(dir string, segmentSize, maxSize int64, fsyncInterval time.Duration) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &WAL{
+		dir:           dir,
+		segmentSize:   segmentSize,
+		maxSize:       maxSize,
+		fsyncInterval: fsyncInterval,
+		retain: func() uint32 {
+			// a chunk is saved at the latest at the end of the next one
+			return 2 * mdata.MaxChunkSpan()
+		},
+		now:        time.Now,
+		partitions: make(map[int32]*partitionLog),
+		shutdown:   make(chan struct{}),
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		partition, err := strconv.ParseInt(e.Name(), 10, 32)
+		if !e.IsDir() || err != nil {
+			continue
+		}
+		p := &partitionLog{dir: filepath.Join(dir, e.Name())}
+		p.segments, err = listSegments(p.dir)
+		if err != nil {
+			return nil, err
+		}
+		w.partitions[int32(partition)] = p
+	}
+	w.report()
+	return w, nil
+}
+
+// Replay adds the points in the log to the metrics. the schema and aggregation of a series are looked up with the given function.
+// it must be called before any points are added.
+//
+// the first segment of a partition may start in the middle of a chunk. as the rest of such a chunk was likely saved before,
+// the chunks that start before the first segment was created are not saved again, to avoid overwriting them with partial ones.
+func (w *WAL) Replay(metrics mdata.Metrics, lookup func(key schema.MKey) (schemaId, aggId uint16, ok bool)) error {
+	if w == nil {
+		return nil
+	}
+	pre := time.Now()
+	var points, unknown, corrupt int
+	seen := make(map[schema.MKey]mdata.Metric)
+	for _, partition := range w.partitionIds() {
+		p := w.partitions[partition]
+		if len(p.segments) == 0 {
+			continue
+		}
+		since := p.segments[0].created
+		for _, s := range p.segments {
+			c, err := readSegment(segmentPath(p.dir, s.seq), func(r record) {
+				m, ok := seen[r.key]
+				if !ok {
+					schemaId, aggId, known := lookup(r.key)
+					if known {
+						m = metrics.GetOrCreate(r.key, schemaId, aggId, partition)
+						if am, ok := m.(interface{ SyncSaveStateBefore(uint32) }); ok {
+							am.SyncSaveStateBefore(since)
+						}
+					}
+					seen[r.key] = m
+				}
+				if m == nil {
+					unknown++
+					return
+				}
+				m.Add(r.ts, r.val)
+				points++
+			})
+			corrupt += c
+			if err != nil {
+				return fmt.Errorf("replaying %s: %s", segmentPath(p.dir, s.seq), err)
+			}
+		}
+	}
+	replayedPoints.Add(points)
+	replayedUnknown.Add(unknown)
+	replayedCorrupt.Add(corrupt)
+	log.Info("wal: replayed %d points of %d series in %s. %d points of unknown series and %d corrupt records were skipped", points, len(seen), time.Since(pre), unknown, corrupt)
+	return nil
+}
+
+func (w *WAL) partitionIds() []int32 {
+	w.RLock()
+	defer w.RUnlock()
+	ids := make([]int32, 0, len(w.partitions))
+	for id := range w.partitions {
+		ids = append(ids, id)
+	}
+	sort.Sort(int32s(ids))
+	return ids
+}
+
+type int32s []int32
+
+func (s int32s) Len() int           { return len(s) }
+func (s int32s) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s int32s) Less(i, j int) bool { return s[i] < s[j] }
+
+func (w *WAL) partition(partition int32) *partitionLog {
+	w.RLock()
+	p, ok := w.partitions[partition]
+	w.RUnlock()
+	if ok {
+		return p
+	}
+	w.Lock()
+	defer w.Unlock()
+	p, ok = w.partitions[partition]
+	if !ok {
+		p = &partitionLog{dir: filepath.Join(w.dir, strconv.Itoa(int(partition)))}
+		w.partitions[partition] = p
+	}
+	return p
+}
+
+// Add records the point of the series in the log of the partition.
+// failures to write are logged and counted, but don't hold up the ingestion.
+func (w *WAL) Add(partition int32, key schema.MKey, ts uint32, val float64) {
+	if w == nil {
+		return
+	}
+	p := w.partition(partition)
+	p.Lock()
+	defer p.Unlock()
+	if p.file == nil || p.segments[len(p.segments)-1].size+recordSize > w.segmentSize {
+		if err := p.rotate(w.now()); err != nil {
+			writeErrors.Inc()
+			log.Error(3, "wal: could not start a new segment in %s: %s", p.dir, err)
+			return
+		}
+	}
+	encodeRecord(p.rec[:], record{key, ts, val})
+	if _, err := p.buf.Write(p.rec[:]); err != nil {
+		writeErrors.Inc()
+		log.Error(3, "wal: could not write to %s: %s", p.dir, err)
+		return
+	}
+	p.segments[len(p.segments)-1].size += recordSize
+	p.dirty = true
+	pointsWritten.Inc()
+	if w.fsyncInterval == 0 {
+		p.sync()
+	}
+}
+
+// rotate closes the active segment, if any, and starts a new one. must be called while holding the lock
+func (p *partitionLog) rotate(now time.Time) error {
+	if p.file != nil {
+		p.sync()
+		p.file.Close()
+		p.file = nil
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return err
+	}
+	var seq uint32
+	if len(p.segments) > 0 {
+		seq = p.segments[len(p.segments)-1].seq + 1
+	}
+	s := segment{seq: seq, created: uint32(now.Unix()), size: headerSize}
+	f, err := os.OpenFile(segmentPath(p.dir, seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encodeHeader(s.created)); err != nil {
+		f.Close()
+		return err
+	}
+	p.file = f
+	p.buf = bufio.NewWriterSize(f, 64*1024)
+	p.segments = append(p.segments, s)
+	return nil
+}
+
+// sync flushes the buffered records of the active segment and syncs it to disk. must be called while holding the lock
+func (p *partitionLog) sync() {
+	if p.file == nil || !p.dirty {
+		return
+	}
+	pre := time.Now()
+	err := p.buf.Flush()
+	if err == nil {
+		err = p.file.Sync()
+	}
+	fsyncDuration.Value(time.Since(pre))
+	if err != nil {
+		writeErrors.Inc()
+		log.Error(3, "wal: could not sync %s: %s", p.file.Name(), err)
+		return
+	}
+	p.dirty = false
+}
+
+// run syncs all partitions every fsync-interval, unless every point is synced already,
+// and removes the segments that are not needed anymore every minute, until Close is called
+func (w *WAL) run() {
+	defer w.wg.Done()
+	var syncC <-chan time.Time
+	if w.fsyncInterval > 0 {
+		syncTick := time.NewTicker(w.fsyncInterval)
+		defer syncTick.Stop()
+		syncC = syncTick.C
+	}
+	cleanTick := time.NewTicker(time.Minute)
+	defer cleanTick.Stop()
+	for {
+		select {
+		case <-syncC:
+			w.Sync()
+		case <-cleanTick.C:
+			w.clean()
+		case <-w.shutdown:
+			return
+		}
+	}
+}
+
+// Sync syncs the buffered records of all partitions to disk
+func (w *WAL) Sync() {
+	if w == nil {
+		return
+	}
+	for _, id := range w.partitionIds() {
+		w.SyncPartition(id)
+	}
+}
+
+// SyncPartition syncs the buffered records of the partition to disk
+func (w *WAL) SyncPartition(partition int32) {
+	if w == nil {
+		return
+	}
+	p := w.partition(partition)
+	p.Lock()
+	p.sync()
+	p.Unlock()
+}
+
+// clean removes the segments whose data is not needed anymore: a segment is needed until the segment after it
+// was created more than retain ago, or if it's the last one and not active, until it was last written more than retain ago. then, while the total size exceeds max-size, it removes the oldest segments that are not active.
+func (w *WAL) clean() {
+	var cutoff uint32
+	if now, retain := uint32(w.now().Unix()), w.retain(); now > retain {
+		cutoff = now - retain
+	}
+	for _, id := range w.partitionIds() {
+		p := w.partition(id)
+		p.Lock()
+		for len(p.segments) > 1 && p.segments[1].created <= cutoff {
+			p.remove()
+		}
+		// partitions that we don't receive data for anymore don't have an active segment
+		if p.file == nil && len(p.segments) == 1 && p.segments[0].modified <= cutoff {
+			p.remove()
+		}
+		p.Unlock()
+	}
+
+	for {
+		var total int64
+		var oldest *partitionLog
+		for _, id := range w.partitionIds() {
+			p := w.partition(id)
+			p.Lock()
+			for _, s := range p.segments {
+				total += s.size
+			}
+			// the active segment can't be removed
+			if len(p.segments) > 1 && (oldest == nil || p.segments[0].created < oldest.segments[0].created) {
+				oldest = p
+			}
+			p.Unlock()
+		}
+		if total <= w.maxSize || oldest == nil {
+			break
+		}
+		oldest.Lock()
+		if len(oldest.segments) > 1 {
+			log.Warn("wal: total size %d exceeds max-size %d. removing segment %d of %s, whose data may still be needed", total, w.maxSize, oldest.segments[0].seq, oldest.dir)
+			oldest.remove()
+			segmentsDropped.Inc()
+		}
+		oldest.Unlock()
+	}
+	w.report()
+}
+
+// remove removes the oldest segment. must be called while holding the lock
+func (p *partitionLog) remove() {
+	path := segmentPath(p.dir, p.segments[0].seq)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Error(3, "wal: could not remove %s: %s", path, err)
+	}
+	p.segments = p.segments[1:]
+}
+
+// report updates the size metrics
+func (w *WAL) report() {
+	var size int64
+	var segments int
+	for _, id := range w.partitionIds() {
+		p := w.partition(id)
+		p.Lock()
+		for _, s := range p.segments {
+			size += s.size
+		}
+		segments += len(p.segments)
+		p.Unlock()
+	}
+	walSize.Set(int(size))
+	walSegments.Set(segments)
+}
+
+// Close stops the background syncing and cleaning, and then syncs and closes the active segments
+func (w *WAL) Close() {
+	if w == nil {
+		return
+	}
+	close(w.shutdown)
+	w.wg.Wait()
+	for _, id := range w.partitionIds() {
+		p := w.partition(id)
+		p.Lock()
+		if p.file != nil {
+			p.sync()
+			p.file.Close()
+			p.file = nil
+		}
+		p.Unlock()
+	}
+}
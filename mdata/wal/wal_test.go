@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/mdata"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+type point struct {
+	ts  uint32
+	val float64
+}
+
+type fakeMetric struct {
+	points []point
+	before uint32
+}
+
+func (m *fakeMetric) Add(ts uint32, val float64) {
+	m.points = append(m.points, point{ts, val})
+}
+
+func (m *fakeMetric) Get(from, to uint32) (mdata.Result, error) {
+	return mdata.Result{}, nil
+}
+
+func (m *fakeMetric) GetAggregated(consolidator consolidation.Consolidator, aggSpan, from, to uint32) (mdata.Result, error) {
+	return mdata.Result{}, nil
+}
+
+func (m *fakeMetric) SyncSaveStateBefore(ts uint32) {
+	m.before = ts
+}
+
+type fakeMetrics map[schema.MKey]*fakeMetric
+
+func (f fakeMetrics) Get(key schema.MKey) (mdata.Metric, bool) {
+	m, ok := f[key]
+	return m, ok
+}
+
+func (f fakeMetrics) GetOrCreate(key schema.MKey, schemaId, aggId uint16, partition int32) mdata.Metric {
+	m, ok := f[key]
+	if !ok {
+		m = &fakeMetric{}
+		f[key] = m
+	}
+	return m
+}
+
+func mkey(org uint32, b byte) schema.MKey {
+	var key schema.MKey
+	key.Org = org
+	key.Key[0] = b
+	return key
+}
+
+func testWAL(t *testing.T, dir string, segmentSize, maxSize int64, now *time.Time) *WAL {
+	w, err := open(dir, segmentSize, maxSize, 0)
+	if err != nil {
+		t.Fatalf("failed to open wal: %s", err)
+	}
+	w.now = func() time.Time { return *now }
+	w.retain = func() uint32 { return 100 }
+	return w
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestRecord(t *testing.T) {
+	in := record{mkey(5, 42), 1234, 5.5}
+	buf := make([]byte, recordSize)
+	encodeRecord(buf, in)
+	out, err := decodeRecord(buf)
+	if err != nil {
+		t.Fatalf("failed to decode record: %s", err)
+	}
+	if out != in {
+		t.Fatalf("expected record %v, got %v", in, out)
+	}
+	buf[10] ^= 1
+	if _, err := decodeRecord(buf); err != errCorruptRecord {
+		t.Fatalf("expected errCorruptRecord for modified record, got %v", err)
+	}
+}
+
+func TestAddReplay(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	w := testWAL(t, dir, 1024, 4096, &now)
+	w.Add(0, mkey(1, 1), 10, 1)
+	w.Add(1, mkey(1, 2), 10, 2)
+	w.Add(0, mkey(1, 1), 20, 3)
+	w.Add(0, mkey(1, 3), 20, 4)
+	w.Close()
+
+	// a partially written record must be ignored
+	f, err := os.OpenFile(segmentPath(w.partition(0).dir, 0), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	w = testWAL(t, dir, 1024, 4096, &now)
+	metrics := make(fakeMetrics)
+	err = w.Replay(metrics, func(key schema.MKey) (uint16, uint16, bool) {
+		return 0, 0, key != mkey(1, 3)
+	})
+	if err != nil {
+		t.Fatalf("failed to replay: %s", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 series to be replayed, got %d", len(metrics))
+	}
+	m := metrics[mkey(1, 1)]
+	if len(m.points) != 2 || m.points[0] != (point{10, 1}) || m.points[1] != (point{20, 3}) {
+		t.Fatalf("unexpected points for series 1: %v", m.points)
+	}
+	if m.before != 1000 {
+		t.Fatalf("expected chunks before 1000 to be marked as saved, got %d", m.before)
+	}
+	m = metrics[mkey(1, 2)]
+	if len(m.points) != 1 || m.points[0] != (point{10, 2}) {
+		t.Fatalf("unexpected points for series 2: %v", m.points)
+	}
+}
+
+func TestRotateAndClean(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0)
+
+	// room for 2 records per segment
+	w := testWAL(t, dir, headerSize+2*recordSize, 100*recordSize, &now)
+	for i := 0; i < 5; i++ {
+		w.Add(0, mkey(1, 1), uint32(i+1), float64(i))
+		now = now.Add(30 * time.Second)
+	}
+	p := w.partition(0)
+	if len(p.segments) != 3 {
+		t.Fatalf("expected 3 segments, got %d", len(p.segments))
+	}
+	// segments were created at 1000, 1060 and 1120
+	now = time.Unix(1170, 0)
+	w.clean()
+	if len(p.segments) != 2 || p.segments[0].seq != 1 {
+		t.Fatalf("expected segments 1 and 2 to remain, got %v", p.segments)
+	}
+
+	// once it exceeds max-size, the oldest segments are removed, but never the active one
+	w.maxSize = headerSize + 2*recordSize
+	w.clean()
+	if len(p.segments) != 1 || p.segments[0].seq != 2 {
+		t.Fatalf("expected only the active segment to remain, got %v", p.segments)
+	}
+	if _, err := os.Stat(segmentPath(p.dir, 1)); !os.IsNotExist(err) {
+		t.Fatalf("expected segment file 1 to be removed, got %v", err)
+	}
+	w.Close()
+}
+
+func TestClose(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	w, err := open(dir, 1024, 4096, time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to open wal: %s", err)
+	}
+	w.wg.Add(1)
+	go w.run()
+	for i := 0; i < 10; i++ {
+		w.Add(0, mkey(1, 1), uint32(i+1), float64(i))
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close waits for run to exit before it closes the segments
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Close")
+	}
+	if p := w.partition(0); p.file != nil {
+		t.Fatalf("expected the active segment to be closed")
+	}
+}
@@ -0,0 +1,81 @@
+package recording
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+const (
+	outputLocal = "local"
+	outputKafka = "kafka"
+)
+
+var (
+	Enabled         bool
+	rulesFile       string
+	output          string
+	kafkaBrokers    string
+	kafkaTopic      string
+	partitionScheme string
+
+	rules []Rule
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("recording-rules", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "periodically evaluate the recording rules, and write their results back as new series. enable this on one instance of the cluster only, or the points are written several times")
+	fs.StringVar(&rulesFile, "rules-file", "/etc/metrictank/recording-rules.conf", "path to the recording rules file")
+	fs.StringVar(&output, "output", outputLocal, "how to write the results. local: ingest them into this instance only, which suits single instance setups. kafka: produce them to the kafka-mdm topic, so they are consumed by all instances of their partition")
+	fs.StringVar(&kafkaBrokers, "kafka-brokers", "kafka:9092", "tcp address for kafka (may be given as a comma-separated list), for the kafka output")
+	fs.StringVar(&kafkaTopic, "kafka-topic", "mdm", "kafka topic to produce to, for the kafka output")
+	fs.StringVar(&partitionScheme, "partition-scheme", "bySeries", "method used for partitioning metrics, for the kafka output. must match how the other data is partitioned. (byOrg|bySeries)")
+	globalconf.Register("recording-rules", fs)
+}
+
+// ConfigValidate checks the settings and the rules file, for the validate-config mode.
+// kafkaInput is whether the kafka-mdm input is enabled
+func ConfigValidate(kafkaInput bool) []conf.Finding {
+	if !Enabled {
+		return nil
+	}
+	var findings []conf.Finding
+	if _, err := ReadRules(rulesFile); err != nil {
+		findings = append(findings, conf.NewError("recording-rules.rules-file", "can't read rules file %q: %s", rulesFile, err))
+	}
+	switch output {
+	case outputLocal:
+		if kafkaInput {
+			findings = append(findings, conf.NewWarning("recording-rules.output", "with the local output, the recorded series are only on this instance, not on the other instances of the partition. use the kafka output"))
+		}
+	case outputKafka:
+		if strings.TrimSpace(kafkaBrokers) == "" {
+			findings = append(findings, conf.NewError("recording-rules.kafka-brokers", "must be set for the kafka output"))
+		}
+		if kafkaTopic == "" {
+			findings = append(findings, conf.NewError("recording-rules.kafka-topic", "must be set for the kafka output"))
+		}
+		if _, err := partitioner.NewKafka(partitionScheme); err != nil {
+			findings = append(findings, conf.NewError("recording-rules.partition-scheme", "%s", err))
+		}
+	default:
+		findings = append(findings, conf.NewError("recording-rules.output", "must be %s or %s, not %q", outputLocal, outputKafka, output))
+	}
+	return findings
+}
+
+func ConfigProcess(kafkaInput bool) {
+	for _, f := range ConfigValidate(kafkaInput) {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+		log.Warn("%s: %s", f.Subject, f.Msg)
+	}
+	if Enabled {
+		rules, _ = ReadRules(rulesFile)
+	}
+}
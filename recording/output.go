@@ -0,0 +1,109 @@
+package recording
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	"github.com/grafana/metrictank/cluster/partitioner"
+	"github.com/grafana/metrictank/input"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// Publisher writes the points of the recorded series
+type Publisher interface {
+	Publish(metrics []*schema.MetricData) error
+	Close()
+}
+
+// localPublisher ingests the points into this instance, like an input plugin would
+type localPublisher struct {
+	handler   input.Handler
+	partition int32
+}
+
+func (l *localPublisher) Publish(metrics []*schema.MetricData) error {
+	for _, md := range metrics {
+		l.handler.ProcessMetricData(md, l.partition)
+	}
+	return nil
+}
+
+func (l *localPublisher) Close() {}
+
+// kafkaPublisher produces the points to the kafka-mdm topic, in the MetricData format, into the partition
+// determined by the partition scheme. that way they're consumed by all instances of the partition, like any other data.
+type kafkaPublisher struct {
+	topic         string
+	client        sarama.Client
+	producer      sarama.SyncProducer
+	part          *partitioner.Kafka
+	numPartitions int32
+}
+
+func newKafkaPublisher(brokers []string, topic, partitionScheme string) (*kafkaPublisher, error) {
+	part, err := partitioner.NewKafka(partitionScheme)
+	if err != nil {
+		return nil, err
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Retry.Max = 10
+	config.Producer.Partitioner = sarama.NewManualPartitioner
+	config.Producer.Compression = sarama.CompressionSnappy
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to get partitions of topic %q: %s", topic, err)
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &kafkaPublisher{
+		topic:         topic,
+		client:        client,
+		producer:      producer,
+		part:          part,
+		numPartitions: int32(len(partitions)),
+	}, nil
+}
+
+func (k *kafkaPublisher) Publish(metrics []*schema.MetricData) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	payload := make([]*sarama.ProducerMessage, 0, len(metrics))
+	for _, m := range metrics {
+		data, err := m.MarshalMsg(nil)
+		if err != nil {
+			return fmt.Errorf("failed to marshal metric %s: %s", m.Id, err)
+		}
+		partition, err := k.part.Partition(m, k.numPartitions)
+		if err != nil {
+			return fmt.Errorf("failed to get partition for metric %s: %s", m.Id, err)
+		}
+		payload = append(payload, &sarama.ProducerMessage{
+			Topic:     k.topic,
+			Partition: partition,
+			Value:     sarama.ByteEncoder(data),
+		})
+	}
+	return k.producer.SendMessages(payload)
+}
+
+func (k *kafkaPublisher) Close() {
+	k.producer.Close()
+	k.client.Close()
+}
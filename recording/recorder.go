@@ -0,0 +1,184 @@
+// Package recording evaluates recording rules: render expressions that are evaluated periodically, and whose results
+// are written back as new series. this way, expensive expressions of dashboards can be precomputed, and queried cheaply.
+package recording
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/input"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric recording.evaluations is how many times recording rules were evaluated
+	evaluations = stats.NewCounter32("recording.evaluations")
+	// metric recording.errors is how many evaluations of recording rules failed, or could not be written
+	evalErrors = stats.NewCounter32("recording.errors")
+	// metric recording.skipped is how many evaluations of recording rules were skipped, because the instance was not ready
+	evalSkipped = stats.NewCounter32("recording.skipped")
+	// metric recording.points is how many points the recording rules wrote
+	pointsWritten = stats.NewCounter32("recording.points")
+	// metric recording.evaluation is how long it takes to evaluate a recording rule and write its points
+	evalDuration = stats.NewLatencyHistogram15s32("recording.evaluation")
+)
+
+// Evaluator evaluates render expressions. from is exclusive and to inclusive, like for render requests
+type Evaluator interface {
+	Evaluate(ctx context.Context, orgId uint32, target string, from, to uint32) ([]models.Series, error)
+}
+
+// Recorder evaluates the recording rules on their schedule
+type Recorder struct {
+	rules  []Rule
+	eval   Evaluator
+	out    Publisher
+	tracer opentracing.Tracer
+	ready  func() bool
+	now    func() time.Time
+
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+// New returns a recorder for the configured rules, that writes its results to the configured output.
+// the local output ingests them with the given handler. returns nil if recording rules are disabled.
+func New(eval Evaluator, handler input.Handler, tracer opentracing.Tracer) (*Recorder, error) {
+	if !Enabled {
+		return nil, nil
+	}
+	var out Publisher
+	switch output {
+	case outputLocal:
+		var partition int32
+		if partitions := cluster.Manager.GetPartitions(); len(partitions) > 0 {
+			partition = partitions[0]
+		}
+		out = &localPublisher{handler, partition}
+	case outputKafka:
+		var err error
+		out, err = newKafkaPublisher(strings.Split(kafkaBrokers, ","), kafkaTopic, partitionScheme)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rule := range rules {
+		if strings.Contains(rule.Series, namePlaceholder) {
+			continue
+		}
+		if _, s := mdata.MatchSchema(rule.Series, int(rule.Interval)); s.Name == "default" {
+			log.Warn("recording rule %s: no storage-schemas rule matches series %q, so it gets the default retention", rule.Name, rule.Series)
+		}
+	}
+	return newRecorder(rules, eval, out, tracer, cluster.Manager.IsReady), nil
+}
+
+func newRecorder(rules []Rule, eval Evaluator, out Publisher, tracer opentracing.Tracer, ready func() bool) *Recorder {
+	return &Recorder{
+		rules:    rules,
+		eval:     eval,
+		out:      out,
+		tracer:   tracer,
+		ready:    ready,
+		now:      time.Now,
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start starts evaluating all rules, each on its own schedule
+func (r *Recorder) Start() {
+	if r == nil {
+		return
+	}
+	log.Info("recording rules: starting %d rules", len(r.rules))
+	for _, rule := range r.rules {
+		r.wg.Add(1)
+		go r.run(rule)
+	}
+}
+
+// Stop stops evaluating the rules. it waits for the running evaluations to complete
+func (r *Recorder) Stop() {
+	if r == nil {
+		return
+	}
+	close(r.shutdown)
+	r.wg.Wait()
+	r.out.Close()
+}
+
+func (r *Recorder) run(rule Rule) {
+	defer r.wg.Done()
+	for {
+		ts := next(rule, r.now())
+		wait := time.Unix(int64(ts+rule.Delay), 0).Sub(r.now())
+		select {
+		case <-time.After(wait):
+		case <-r.shutdown:
+			return
+		}
+		if !r.ready() {
+			evalSkipped.Inc()
+			log.Debug("recording rule %s: instance not ready. skipping the evaluation for %d", rule.Name, ts)
+			continue
+		}
+		if err := r.evaluate(rule, ts); err != nil {
+			evalErrors.Inc()
+			log.Error(3, "recording rule %s: evaluation for %d failed: %s", rule.Name, ts, err)
+		}
+	}
+}
+
+// next returns the end of the next interval of the rule to evaluate, which is the current one,
+// unless its evaluation is still due given the delay.
+func next(rule Rule, now time.Time) uint32 {
+	ts := uint32(now.Unix()) - rule.Delay
+	return ts - ts%rule.Interval + rule.Interval
+}
+
+// evaluate evaluates the rule for the interval ending at ts, and writes the results
+func (r *Recorder) evaluate(rule Rule, ts uint32) error {
+	pre := time.Now()
+	evaluations.Inc()
+
+	span := r.tracer.StartSpan("recordingRule")
+	defer span.Finish()
+	span.SetTag("rule", rule.Name)
+	span.SetTag("expr", rule.Expr)
+	span.SetTag("org", rule.Org)
+	span.SetTag("ts", ts)
+	ctx := opentracing.ContextWithSpan(context.Background(), span)
+	// don't let slow evaluations pile up
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rule.Interval)*time.Second)
+	defer cancel()
+
+	series, err := r.eval.Evaluate(ctx, rule.Org, rule.Expr, ts-rule.Interval, ts)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	var metrics []*schema.MetricData
+	if err == nil {
+		metrics, err = rule.record(series, ts)
+	}
+	if err == nil {
+		err = r.out.Publish(metrics)
+	}
+	if err != nil {
+		tracing.Failure(span)
+		tracing.Error(span, err)
+		return err
+	}
+	span.SetTag("points", len(metrics))
+	pointsWritten.Add(len(metrics))
+	evalDuration.Value(time.Since(pre))
+	return nil
+}
@@ -0,0 +1,82 @@
+package recording
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	opentracing "github.com/opentracing/opentracing-go"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+type fakeEvaluator struct {
+	from, to uint32
+	series   []models.Series
+	err      error
+}
+
+func (f *fakeEvaluator) Evaluate(ctx context.Context, orgId uint32, target string, from, to uint32) ([]models.Series, error) {
+	if opentracing.SpanFromContext(ctx) == nil {
+		return nil, errors.New("no span in the context")
+	}
+	f.from, f.to = from, to
+	return f.series, f.err
+}
+
+type fakePublisher struct {
+	metrics []*schema.MetricData
+}
+
+func (f *fakePublisher) Publish(metrics []*schema.MetricData) error {
+	f.metrics = append(f.metrics, metrics...)
+	return nil
+}
+
+func (f *fakePublisher) Close() {}
+
+func TestNext(t *testing.T) {
+	rule := Rule{Interval: 60, Delay: 30}
+	cases := []struct {
+		now, exp uint32
+	}{
+		{1000, 1020}, // 1020 is evaluated at 1050
+		{1049, 1020},
+		{1050, 1080},
+		{1079, 1080},
+	}
+	for _, c := range cases {
+		if got := next(rule, time.Unix(int64(c.now), 0)); got != c.exp {
+			t.Errorf("at %d: expected next interval to end at %d, got %d", c.now, c.exp, got)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	rule, err := parseRule("test", getter(map[string]string{"expr": "sumSeries(a.*)", "series": "recorded.a", "interval": "10s"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval := &fakeEvaluator{series: []models.Series{{Target: "sumSeries(a.*)", Datapoints: []schema.Point{{Val: 1, Ts: 100}, {Val: 3, Ts: 110}}}}}
+	out := &fakePublisher{}
+	r := newRecorder([]Rule{rule}, eval, out, opentracing.NoopTracer{}, func() bool { return true })
+
+	if err := r.evaluate(rule, 110); err != nil {
+		t.Fatalf("failed to evaluate: %s", err)
+	}
+	if eval.from != 100 || eval.to != 110 {
+		t.Fatalf("expected evaluation of (100, 110], got (%d, %d]", eval.from, eval.to)
+	}
+	if len(out.metrics) != 1 || out.metrics[0].Name != "recorded.a" || out.metrics[0].Value != 2 || out.metrics[0].Time != 110 {
+		t.Fatalf("expected recorded.a = 2 at 110, got %v", out.metrics)
+	}
+
+	eval.err = errors.New("boom")
+	if err := r.evaluate(rule, 120); err == nil {
+		t.Fatal("expected evaluation error")
+	}
+	if len(out.metrics) != 1 {
+		t.Fatalf("expected nothing to be written after the error, got %v", out.metrics)
+	}
+}
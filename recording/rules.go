@@ -0,0 +1,179 @@
+package recording
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alyu/configparser"
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/batch"
+	"github.com/grafana/metrictank/consolidation"
+	"github.com/grafana/metrictank/expr"
+	"github.com/raintank/dur"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// placeholder in the name of a rule for the name of each series that the expression returns
+const namePlaceholder = "{name}"
+
+// Rule is a render expression that is evaluated every interval, and whose result is written back as new series
+type Rule struct {
+	Name        string   // the name of the section in the rules file
+	Expr        string   // graphite expression, as for the target of a render request
+	Series      string   // name of the resulting series. may contain {name}
+	Tags        []string // tags of the resulting series, sorted
+	Org         uint32
+	Interval    uint32 // seconds between evaluations, and interval of the resulting series
+	Delay       uint32 // seconds to wait after the end of an interval, for its data to come in
+	Aggregation string // how the points of the interval are aggregated into one
+
+	aggFunc batch.AggFunc
+}
+
+// ReadRules reads and parses a recording rules file, in the same format as storage-schemas.conf:
+//
+//	[name]
+//	expr = sumSeries(some.*.metric)
+//	series = recorded.some.metric
+//	tags = env=prod;dc=x
+//	org = 1
+//	interval = 1min
+//	delay = 30s
+//	aggregation = avg
+func ReadRules(file string) ([]Rule, error) {
+	config, err := configparser.Read(file)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	names := make(map[string]struct{})
+	for _, sec := range sections {
+		name := strings.Trim(strings.SplitN(sec.String(), "\n", 2)[0], " []")
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("[%s]: defined more than once", name)
+		}
+		names[name] = struct{}{}
+		rule, err := parseRule(name, sec.ValueOf)
+		if err != nil {
+			return nil, fmt.Errorf("[%s]: %s", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseRule parses the settings of a rule, which are looked up with get. unset settings are ""
+func parseRule(name string, get func(string) string) (Rule, error) {
+	rule := Rule{
+		Name:        name,
+		Expr:        strings.TrimSpace(get("expr")),
+		Series:      strings.TrimSpace(get("series")),
+		Org:         1,
+		Interval:    60,
+		Aggregation: "avg",
+	}
+	if rule.Expr == "" {
+		return rule, fmt.Errorf("empty expr")
+	}
+	exprs, err := expr.ParseMany([]string{rule.Expr})
+	if err != nil {
+		return rule, fmt.Errorf("failed to parse expr %q: %s", rule.Expr, err)
+	}
+	// the plan tells us about functions that we can't run ourselves, and invalid arguments
+	now := uint32(time.Now().Unix())
+	if _, err := expr.NewPlan(exprs, now-3600, now, 0, true, nil); err != nil {
+		return rule, fmt.Errorf("can't evaluate expr %q: %s", rule.Expr, err)
+	}
+
+	if rule.Series == "" {
+		return rule, fmt.Errorf("empty series")
+	}
+	if strings.Contains(rule.Series, ";") {
+		return rule, fmt.Errorf("series %q can't contain ';'. use tags to set tags", rule.Series)
+	}
+
+	if s := strings.TrimSpace(get("tags")); s != "" {
+		rule.Tags = strings.Split(s, ";")
+		for i := range rule.Tags {
+			rule.Tags[i] = strings.TrimSpace(rule.Tags[i])
+		}
+		if !schema.ValidateTags(rule.Tags) {
+			return rule, fmt.Errorf("invalid tags %q. must be key=value pairs, separated by ';'", s)
+		}
+		sort.Strings(rule.Tags)
+	}
+
+	if s := strings.TrimSpace(get("org")); s != "" {
+		org, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || org == 0 {
+			return rule, fmt.Errorf("invalid org %q", s)
+		}
+		rule.Org = uint32(org)
+	}
+	if s := strings.TrimSpace(get("interval")); s != "" {
+		rule.Interval, err = dur.ParseNDuration(s)
+		if err != nil {
+			return rule, fmt.Errorf("invalid interval %q: %s", s, err)
+		}
+	}
+	if s := strings.TrimSpace(get("delay")); s != "" {
+		rule.Delay, err = dur.ParseDuration(s)
+		if err != nil {
+			return rule, fmt.Errorf("invalid delay %q: %s", s, err)
+		}
+	}
+	if s := strings.TrimSpace(get("aggregation")); s != "" {
+		rule.Aggregation = s
+	}
+	consolidator := consolidation.FromConsolidateBy(rule.Aggregation)
+	if consolidator == consolidation.None {
+		return rule, fmt.Errorf("invalid aggregation %q", rule.Aggregation)
+	}
+	rule.aggFunc = consolidation.GetAggFunc(consolidator)
+	return rule, nil
+}
+
+// record returns the points to write for the series that the expression returned for the interval ending at ts.
+// the points of each series are aggregated into one. series without any non-null points are skipped.
+func (r Rule) record(series []models.Series, ts uint32) ([]*schema.MetricData, error) {
+	if len(series) > 1 && !strings.Contains(r.Series, namePlaceholder) {
+		return nil, fmt.Errorf("expression returned %d series, but series has no %s to tell them apart", len(series), namePlaceholder)
+	}
+	var out []*schema.MetricData
+	for _, s := range series {
+		val := r.aggFunc(s.Datapoints)
+		if math.IsNaN(val) {
+			continue
+		}
+		// tagged series have their tags in the target, but only the name is used
+		name := strings.SplitN(s.Target, ";", 2)[0]
+		md := &schema.MetricData{
+			OrgId:    int(r.Org),
+			Name:     strings.Replace(r.Series, namePlaceholder, name, -1),
+			Interval: int(r.Interval),
+			Value:    val,
+			Unit:     "unknown",
+			Time:     int64(ts),
+			Mtype:    "gauge",
+			Tags:     r.Tags,
+		}
+		if err := md.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid series %q: %s", md.Name, err)
+		}
+		md.SetId()
+		out = append(out, md)
+	}
+	return out, nil
+}
@@ -0,0 +1,125 @@
+package recording
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/api/models"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func getter(settings map[string]string) func(string) string {
+	return func(key string) string { return settings[key] }
+}
+
+func TestReadRules(t *testing.T) {
+	f, err := ioutil.TempFile("", "recording-rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+[cpu]
+expr = sumSeries(servers.*.cpu)
+series = recorded.cpu
+tags = env=prod;dc=x
+org = 2
+interval = 5min
+delay = 30s
+aggregation = max
+
+[disks]
+expr = aliasByNode(servers.*.disk, 1)
+series = recorded.{name}.disk
+`)
+	f.Close()
+
+	rules, err := ReadRules(f.Name())
+	if err != nil {
+		t.Fatalf("failed to read rules: %s", err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %v", rules)
+	}
+	cpu := rules[0]
+	if cpu.Name != "cpu" || cpu.Series != "recorded.cpu" || cpu.Org != 2 || cpu.Interval != 300 || cpu.Delay != 30 || cpu.Aggregation != "max" {
+		t.Fatalf("unexpected rule %+v", cpu)
+	}
+	if len(cpu.Tags) != 2 || cpu.Tags[0] != "dc=x" || cpu.Tags[1] != "env=prod" {
+		t.Fatalf("expected sorted tags, got %v", cpu.Tags)
+	}
+	disks := rules[1]
+	if disks.Org != 1 || disks.Interval != 60 || disks.Delay != 0 || disks.Aggregation != "avg" {
+		t.Fatalf("expected defaults, got %+v", disks)
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	valid := map[string]string{"expr": "sumSeries(a.*)", "series": "b"}
+	cases := []struct {
+		key, val string
+		err      string
+	}{
+		{"expr", "", "empty expr"},
+		{"expr", "sumSeries(a.*", "failed to parse"},
+		{"expr", "noSuchFunction(a.*)", "can't evaluate"},
+		{"series", "", "empty series"},
+		{"series", "b;c=d", "can't contain"},
+		{"tags", "foo", "invalid tags"},
+		{"org", "0", "invalid org"},
+		{"interval", "0", "invalid interval"},
+		{"delay", "x", "invalid delay"},
+		{"aggregation", "foo", "invalid aggregation"},
+	}
+	for _, c := range cases {
+		settings := make(map[string]string)
+		for k, v := range valid {
+			settings[k] = v
+		}
+		settings[c.key] = c.val
+		_, err := parseRule("test", getter(settings))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s=%q: expected error %q, got %v", c.key, c.val, c.err, err)
+		}
+	}
+	if _, err := parseRule("test", getter(valid)); err != nil {
+		t.Fatalf("expected valid rule, got %s", err)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	rule, err := parseRule("test", getter(map[string]string{"expr": "aliasByNode(a.*.b, 1)", "series": "recorded.{name}", "tags": "k=v", "aggregation": "sum"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := []models.Series{
+		{Target: "x", Datapoints: []schema.Point{{Val: 1, Ts: 10}, {Val: math.NaN(), Ts: 20}, {Val: 2, Ts: 30}}},
+		{Target: "y;k=other", Datapoints: []schema.Point{{Val: 4, Ts: 30}}},
+		{Target: "z", Datapoints: []schema.Point{{Val: math.NaN(), Ts: 30}}},
+	}
+	metrics, err := rule.record(series, 60)
+	if err != nil {
+		t.Fatalf("failed to record: %s", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 points, as z has no data. got %v", metrics)
+	}
+	exp := []struct {
+		name string
+		val  float64
+	}{{"recorded.x", 3}, {"recorded.y", 4}}
+	for i, md := range metrics {
+		if md.Name != exp[i].name || md.Value != exp[i].val || md.Time != 60 || md.Interval != 60 || md.OrgId != 1 || len(md.Tags) != 1 || md.Id == "" {
+			t.Fatalf("point %d: expected %s = %f, got %+v", i, exp[i].name, exp[i].val, md)
+		}
+	}
+
+	// without {name}, several series would all end up in the same series
+	rule.Series = "recorded"
+	if _, err := rule.record(series, 60); err == nil {
+		t.Fatal("expected error for several series without " + namePlaceholder)
+	}
+}
@@ -26,6 +26,7 @@ mkdir -p ${PKG}
 cp ${BASE}/config/metrictank-package.ini ${BUILD}/etc/metrictank/metrictank.ini
 cp ${BASE}/config/schema-store-cassandra.toml ${BUILD}/etc/metrictank/schema-store-cassandra.toml
 cp ${BASE}/config/schema-idx-cassandra.toml ${BUILD}/etc/metrictank/schema-idx-cassandra.toml
+cp ${BASE}/config/schema-idx-postgres.toml ${BUILD}/etc/metrictank/schema-idx-postgres.toml
 cp ${BASE}/config/schema-store-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-store-scylladb.toml
 cp ${BASE}/config/schema-idx-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-idx-scylladb.toml
 cp ${BASE}/config/storage-schemas.conf ${BUILD}/etc/metrictank/
@@ -56,6 +57,7 @@ mkdir -p ${PKG}
 cp ${BASE}/config/metrictank-package.ini ${BUILD}/etc/metrictank/metrictank.ini
 cp ${BASE}/config/schema-store-cassandra.toml ${BUILD}/etc/metrictank/schema-store-cassandra.toml
 cp ${BASE}/config/schema-idx-cassandra.toml ${BUILD}/etc/metrictank/schema-idx-cassandra.toml
+cp ${BASE}/config/schema-idx-postgres.toml ${BUILD}/etc/metrictank/schema-idx-postgres.toml
 cp ${BASE}/config/schema-store-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-store-scylladb.toml
 cp ${BASE}/config/schema-idx-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-idx-scylladb.toml
 cp ${BASE}/config/storage-schemas.conf ${BUILD}/etc/metrictank/
@@ -86,6 +88,7 @@ mkdir -p ${PKG}
 cp ${BASE}/config/metrictank-package.ini ${BUILD}/etc/metrictank/metrictank.ini
 cp ${BASE}/config/schema-store-cassandra.toml ${BUILD}/etc/metrictank/schema-store-cassandra.toml
 cp ${BASE}/config/schema-idx-cassandra.toml ${BUILD}/etc/metrictank/schema-idx-cassandra.toml
+cp ${BASE}/config/schema-idx-postgres.toml ${BUILD}/etc/metrictank/schema-idx-postgres.toml
 cp ${BASE}/config/schema-store-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-store-scylladb.toml
 cp ${BASE}/config/schema-idx-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-idx-scylladb.toml
 cp ${BASE}/config/storage-schemas.conf ${BUILD}/etc/metrictank/
@@ -115,6 +118,7 @@ mkdir -p ${PKG}
 cp ${BASE}/config/metrictank-package.ini ${BUILD}/etc/metrictank/metrictank.ini
 cp ${BASE}/config/schema-store-cassandra.toml ${BUILD}/etc/metrictank/schema-store-cassandra.toml
 cp ${BASE}/config/schema-idx-cassandra.toml ${BUILD}/etc/metrictank/schema-idx-cassandra.toml
+cp ${BASE}/config/schema-idx-postgres.toml ${BUILD}/etc/metrictank/schema-idx-postgres.toml
 cp ${BASE}/config/schema-store-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-store-scylladb.toml
 cp ${BASE}/config/schema-idx-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-idx-scylladb.toml
 cp ${BASE}/config/storage-schemas.conf ${BUILD}/etc/metrictank/
@@ -143,6 +147,7 @@ mkdir -p ${PKG}
 cp ${BASE}/config/metrictank-package.ini ${BUILD}/etc/metrictank/metrictank.ini
 cp ${BASE}/config/schema-store-cassandra.toml ${BUILD}/etc/metrictank/schema-store-cassandra.toml
 cp ${BASE}/config/schema-idx-cassandra.toml ${BUILD}/etc/metrictank/schema-idx-cassandra.toml
+cp ${BASE}/config/schema-idx-postgres.toml ${BUILD}/etc/metrictank/schema-idx-postgres.toml
 cp ${BASE}/config/schema-store-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-store-scylladb.toml
 cp ${BASE}/config/schema-idx-scylladb.toml ${BUILD}/usr/share/metrictank/examples/schema-idx-scylladb.toml
 cp ${BASE}/config/storage-schemas.conf ${BUILD}/etc/metrictank/
@@ -74,6 +74,27 @@ MT_CASSANDRA_WRITE_CONCURRENCY: 10        # MT_<setting_name>
 MT_KAFKA_MDM_IN_DATA_DIR: /your/data/dir  # MT_<section_title>_<setting_name>
 \`\`\`
 
+## Validating the configuration
+
+\`metrictank -config /etc/metrictank/metrictank.ini -validate-config\` loads all config files and checks them,
+including settings that depend on each other, such as chunkspans vs cassandra tables and the kafka offset,
+or the cluster mode vs the notifiers. It does not connect to any services, so you can run it in CI for config changes.
+It prints the findings as json and exits with status 1 if any of them is an error. Warnings are combinations
+that work but are probably not intended.
+
+\`\`\`
+{
+    "valid": true,
+    "findings": [
+        {
+            "error": false,
+            "subject": "kafka-mdm-in.offset",
+            "message": "offset 5m0s is shorter than the largest chunkspan of 600s. ..."
+        }
+    ]
+}
+\`\`\`
+
 ---
 
 
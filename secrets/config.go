@@ -0,0 +1,40 @@
+package secrets
+
+import (
+	"flag"
+	"time"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	vaultAddr       string
+	vaultTokenRef   string
+	vaultTimeout    time.Duration
+	refreshInterval = time.Minute
+
+	vaultToken *Secret
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("secrets", flag.ExitOnError)
+	fs.StringVar(&vaultAddr, "vault-addr", "", "address of vault, e.g. https://vault:8200. required for vault:path#key references")
+	fs.StringVar(&vaultTokenRef, "vault-token", "env:VAULT_TOKEN", "token to authenticate with vault. may be an env: or file: reference")
+	fs.DurationVar(&vaultTimeout, "vault-timeout", 5*time.Second, "timeout for requests to vault")
+	fs.DurationVar(&refreshInterval, "refresh-interval", time.Minute, "interval at which file: and vault: references are reloaded. 0 to disable")
+	globalconf.Register("secrets", fs)
+}
+
+// ConfigProcess must be called before any secrets are resolved
+func ConfigProcess() {
+	vaultClient.Timeout = vaultTimeout
+	if vaultAddr == "" {
+		return
+	}
+	var err error
+	vaultToken, err = New(vaultTokenRef)
+	if err != nil {
+		log.Fatal(4, "secrets: vault-token: %s", err)
+	}
+}
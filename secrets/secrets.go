@@ -0,0 +1,147 @@
+// Package secrets resolves settings that hold credentials. Instead of a plain value, such settings
+// may reference an environment variable, a file or a vault secret. files and vault secrets are
+// reloaded periodically, so that credentials can be rotated without a restart.
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	// metric secrets.refresh_errors is how many times a secret could not be reloaded from its file or vault
+	refreshErrors = stats.NewCounter32("secrets.refresh_errors")
+
+	// all secrets that need to be reloaded periodically
+	registry     []*Secret
+	registryLock sync.Mutex
+	refreshOnce  sync.Once
+)
+
+// Secret is the value of a setting, which is either given as-is, or is loaded from the referenced source:
+//
+//	env:NAME          the environment variable NAME
+//	file:/path        the contents of the file, without trailing newlines
+//	vault:path#key    the given key of the secret at path in vault, e.g. vault:secret/data/metrictank#password
+//	plain:value       the value as-is. only needed for values that start with one of these prefixes
+type Secret struct {
+	ref  string
+	load func() (string, error)
+
+	sync.RWMutex
+	value string
+}
+
+// New resolves the given value or reference
+func New(ref string) (*Secret, error) {
+	s := &Secret{ref: ref}
+	refreshable := true
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := strings.TrimPrefix(ref, "env:")
+		s.load = func() (string, error) {
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable %q is not set", name)
+			}
+			return val, nil
+		}
+		refreshable = false
+	case strings.HasPrefix(ref, "file:"):
+		path := strings.TrimPrefix(ref, "file:")
+		s.load = func() (string, error) {
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			return strings.TrimRight(string(data), "\r\n"), nil
+		}
+	case strings.HasPrefix(ref, "vault:"):
+		pos := strings.LastIndex(ref, "#")
+		if pos == -1 {
+			return nil, fmt.Errorf("invalid vault reference %q. expected vault:path#key", ref)
+		}
+		path, key := strings.TrimPrefix(ref[:pos], "vault:"), ref[pos+1:]
+		s.load = func() (string, error) {
+			return readVault(path, key)
+		}
+	default:
+		val := strings.TrimPrefix(ref, "plain:")
+		s.load = func() (string, error) {
+			return val, nil
+		}
+		refreshable = false
+	}
+
+	val, err := s.load()
+	if err != nil {
+		return nil, fmt.Errorf("could not load secret %s: %s", s.Source(), err)
+	}
+	s.value = val
+	if refreshable {
+		register(s)
+	}
+	return s, nil
+}
+
+// Get returns the current value
+func (s *Secret) Get() string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.value
+}
+
+// Source describes where the value comes from, without revealing it
+func (s *Secret) Source() string {
+	if strings.HasPrefix(s.ref, "env:") || strings.HasPrefix(s.ref, "file:") || strings.HasPrefix(s.ref, "vault:") {
+		return s.ref
+	}
+	return "(plain value)"
+}
+
+// refresh reloads the value. if that fails, we keep the current one
+func (s *Secret) refresh() {
+	val, err := s.load()
+	if err != nil {
+		refreshErrors.Inc()
+		log.Error(3, "secrets: could not reload %s, keeping the current value: %s", s.Source(), err)
+		return
+	}
+	s.Lock()
+	changed := val != s.value
+	s.value = val
+	s.Unlock()
+	if changed {
+		log.Info("secrets: %s changed", s.Source())
+	}
+}
+
+func register(s *Secret) {
+	registryLock.Lock()
+	registry = append(registry, s)
+	registryLock.Unlock()
+	if refreshInterval > 0 {
+		refreshOnce.Do(func() {
+			go refreshLoop()
+		})
+	}
+}
+
+func refreshLoop() {
+	for range time.Tick(refreshInterval) {
+		registryLock.Lock()
+		secrets := make([]*Secret, len(registry))
+		copy(secrets, registry)
+		registryLock.Unlock()
+		for _, s := range secrets {
+			s.refresh()
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func init() {
+	// tests call refresh() themselves
+	refreshInterval = 0
+}
+
+func TestPlain(t *testing.T) {
+	cases := []struct {
+		ref string
+		exp string
+	}{
+		{"cassandra", "cassandra"},
+		{"", ""},
+		{"plain:env:FOO", "env:FOO"},
+	}
+	for _, c := range cases {
+		s, err := New(c.ref)
+		if err != nil {
+			t.Fatalf("ref %q: unexpected error %s", c.ref, err)
+		}
+		if s.Get() != c.exp {
+			t.Fatalf("ref %q: expected %q, got %q", c.ref, c.exp, s.Get())
+		}
+		if s.Source() != "(plain value)" {
+			t.Fatalf("ref %q: source reveals the value: %q", c.ref, s.Source())
+		}
+	}
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("MT_TEST_SECRET", "hunter2")
+	defer os.Unsetenv("MT_TEST_SECRET")
+	s, err := New("env:MT_TEST_SECRET")
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if s.Get() != "hunter2" {
+		t.Fatalf("expected %q, got %q", "hunter2", s.Get())
+	}
+	_, err = New("env:MT_TEST_SECRET_UNSET")
+	if err == nil {
+		t.Fatalf("expected error for unset environment variable")
+	}
+}
+
+func TestFileRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte("first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := New("file:" + path)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if s.Get() != "first" {
+		t.Fatalf("expected %q, got %q", "first", s.Get())
+	}
+
+	if err := ioutil.WriteFile(path, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.refresh()
+	if s.Get() != "second" {
+		t.Fatalf("after refresh: expected %q, got %q", "second", s.Get())
+	}
+
+	// when the file disappears, e.g. while it is being replaced, we keep the current value
+	os.Remove(path)
+	s.refresh()
+	if s.Get() != "second" {
+		t.Fatalf("after failed refresh: expected %q, got %q", "second", s.Get())
+	}
+}
+
+func TestVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/metrictank":
+			fmt.Fprint(w, `{"data": {"password": "v1pass"}}`)
+		case "/v1/secret/data/metrictank":
+			fmt.Fprint(w, `{"data": {"data": {"password": "v2pass"}, "metadata": {"version": 3}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	vaultAddr = server.URL
+	defer func() {
+		vaultAddr = ""
+		vaultToken = nil
+	}()
+	var err error
+	vaultToken, err = New("root")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ref   string
+		exp   string
+		valid bool
+	}{
+		{"vault:secret/metrictank#password", "v1pass", true},
+		{"vault:secret/data/metrictank#password", "v2pass", true},
+		{"vault:secret/data/metrictank#username", "", false},
+		{"vault:secret/other#password", "", false},
+		{"vault:secret/metrictank", "", false},
+	}
+	for _, c := range cases {
+		s, err := New(c.ref)
+		if !c.valid {
+			if err == nil {
+				t.Fatalf("ref %q: expected error", c.ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ref %q: unexpected error %s", c.ref, err)
+		}
+		if s.Get() != c.exp {
+			t.Fatalf("ref %q: expected %q, got %q", c.ref, c.exp, s.Get())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package secrets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+var vaultClient = &http.Client{}
+
+// readVault reads the key of the secret at the given path, using the kv secrets engine.
+// both version 1 and 2 of the engine are supported: version 2 nests the key/value pairs in another data field.
+func readVault(path, key string) (string, error) {
+	if vaultAddr == "" {
+		return "", errors.New("vault-addr is not set")
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(vaultAddr, "/")+"/v1/"+strings.TrimLeft(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	if vaultToken != nil {
+		req.Header.Set("X-Vault-Token", vaultToken.Get())
+	}
+	resp, err := vaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", fmt.Errorf("could not decode vault response for %s: %s", path, err)
+	}
+	val, ok := secret.Data[key]
+	if !ok {
+		if nested, isMap := secret.Data["data"].(map[string]interface{}); isMap {
+			val, ok = nested[key]
+		}
+	}
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", path, key)
+	}
+	str, ok := val.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q of secret %s is not a string", key, path)
+	}
+	return str, nil
+}
@@ -0,0 +1,59 @@
+package standby
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled          bool
+	queueSize        int
+	batchSize        int
+	flushInterval    time.Duration
+	snapshotInterval time.Duration
+	timeout          time.Duration
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("standby", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "primaries send the chunks they close, and snapshots of their open chunks, to the secondaries of their partitions, so that a promoted secondary has the data without replaying it from kafka")
+	fs.IntVar(&queueSize, "queue-size", 100000, "max number of chunks waiting to be sent. when full, chunks are dropped and the secondaries rely on kafka for them")
+	fs.IntVar(&batchSize, "batch-size", 1000, "max number of chunks to send to a peer in one request")
+	fs.DurationVar(&flushInterval, "flush-interval", time.Second, "max time a chunk waits before it's sent")
+	fs.DurationVar(&snapshotInterval, "snapshot-interval", 10*time.Second, "interval to send snapshots of the open chunks of the series that received data since the previous one. 0 to only send closed chunks")
+	fs.DurationVar(&timeout, "timeout", 5*time.Second, "timeout of the requests to the secondaries")
+	globalconf.Register("standby", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	var findings []conf.Finding
+	if queueSize < 1 {
+		findings = append(findings, conf.NewError("standby.queue-size", "must be at least 1"))
+	}
+	if batchSize < 1 {
+		findings = append(findings, conf.NewError("standby.batch-size", "must be at least 1"))
+	}
+	if flushInterval <= 0 {
+		findings = append(findings, conf.NewError("standby.flush-interval", "must be positive"))
+	}
+	if snapshotInterval < 0 {
+		findings = append(findings, conf.NewError("standby.snapshot-interval", "can't be negative"))
+	}
+	if timeout <= 0 {
+		findings = append(findings, conf.NewError("standby.timeout", "must be positive"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
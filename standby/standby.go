@@ -0,0 +1,165 @@
+// Package standby keeps secondaries warm: a primary sends the chunks it closes, as well as periodic snapshots
+// of its open chunks, to the secondaries of its partitions, which merge them into their chunks in memory.
+// when a secondary gets promoted, it then misses at most the last seconds of data, rather than all the data
+// it had yet to consume from kafka. kafka stays the source of truth: chunks that can't be sent are dropped.
+package standby
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/api/models"
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+var (
+	// metric cluster.standby.chunks-sent is how many chunks were sent to secondaries, counted once per secondary
+	chunksSent = stats.NewCounter32("cluster.standby.chunks-sent")
+	// metric cluster.standby.chunks-dropped is how many chunks were not sent to the secondaries because the queue was full
+	chunksDropped = stats.NewCounter32("cluster.standby.chunks-dropped")
+	// metric cluster.standby.errors is how many requests to secondaries failed
+	sendErrors = stats.NewCounter32("cluster.standby.errors")
+)
+
+// Forwarder sends the chunks of the partitions we are primary for to the secondaries of those partitions
+type Forwarder struct {
+	metrics  *mdata.AggMetrics
+	queue    chan mdata.StandbyChunk
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+}
+
+func New(metrics *mdata.AggMetrics) *Forwarder {
+	return &Forwarder{
+		metrics:  metrics,
+		queue:    make(chan mdata.StandbyChunk, queueSize),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// Start starts sending the chunks that get closed, and the snapshots of the open chunks
+func (f *Forwarder) Start() {
+	mdata.StandbyForwarder = f.Forward
+	f.wg.Add(1)
+	go f.run()
+	if snapshotInterval > 0 {
+		f.wg.Add(1)
+		go f.snapshots()
+	}
+}
+
+// Stop stops taking snapshots, and sends the chunks that are still queued
+func (f *Forwarder) Stop() {
+	close(f.shutdown)
+	f.wg.Wait()
+}
+
+// Forward queues the chunk to be sent. it doesn't block: when the queue is full, the chunk is dropped.
+func (f *Forwarder) Forward(c mdata.StandbyChunk) {
+	select {
+	case f.queue <- c:
+	default:
+		chunksDropped.Inc()
+	}
+}
+
+func (f *Forwarder) snapshots() {
+	defer f.wg.Done()
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+	last := uint32(time.Now().Unix())
+	for {
+		select {
+		case <-f.shutdown:
+			return
+		case <-ticker.C:
+			now := uint32(time.Now().Unix())
+			for _, c := range f.metrics.SnapshotCurrent(last) {
+				f.Forward(c)
+			}
+			last = now
+		}
+	}
+}
+
+func (f *Forwarder) run() {
+	defer f.wg.Done()
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]mdata.StandbyChunk, 0, batchSize)
+	for {
+		select {
+		case c := <-f.queue:
+			batch = append(batch, c)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-f.shutdown:
+			for {
+				select {
+				case c := <-f.queue:
+					batch = append(batch, c)
+					if len(batch) >= batchSize {
+						f.send(batch)
+						batch = batch[:0]
+					}
+				default:
+					f.send(batch)
+					return
+				}
+			}
+		}
+		f.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// send sends each peer the chunks of the partitions it has
+func (f *Forwarder) send(batch []mdata.StandbyChunk) {
+	if len(batch) == 0 {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range cluster.Manager.MemberList() {
+		if peer.IsLocal() {
+			continue
+		}
+		partitions := make(map[int32]struct{})
+		for _, p := range peer.GetPartitions() {
+			partitions[p] = struct{}{}
+		}
+		var chunks []mdata.StandbyChunk
+		for _, c := range batch {
+			if _, ok := partitions[c.Partition]; ok {
+				chunks = append(chunks, c)
+			}
+		}
+		if len(chunks) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(peer cluster.Node, chunks []mdata.StandbyChunk) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			buf, err := peer.Post(ctx, "standbyChunks", "/standby/chunks", models.StandbyChunks{Chunks: chunks})
+			if err == nil {
+				var resp models.StandbyChunksResp
+				err = json.Unmarshal(buf, &resp)
+			}
+			if err != nil {
+				sendErrors.Inc()
+				log.Error(3, "standby: failed to send %d chunks to %s: %s", len(chunks), peer.GetName(), err)
+				return
+			}
+			chunksSent.Add(len(chunks))
+		}(peer, chunks)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,54 @@
+package bigtable
+
+import (
+	"flag"
+
+	"github.com/rakyll/globalconf"
+)
+
+type StoreConfig struct {
+	Enabled           bool
+	GcpProject        string
+	BigtableInstance  string
+	TableName         string
+	WriteQueueSize    int
+	WriteMaxFlushSize int
+	WriteConcurrency  int
+	ReadConcurrency   int
+	MaxChunkSpan      string
+	CreateCF          bool
+}
+
+// return StoreConfig with default values set.
+func NewStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Enabled:           false,
+		GcpProject:        "default",
+		BigtableInstance:  "default",
+		TableName:         "metrics",
+		WriteQueueSize:    100000,
+		WriteMaxFlushSize: 10000,
+		WriteConcurrency:  10,
+		ReadConcurrency:   20,
+		MaxChunkSpan:      "6h",
+		CreateCF:          true,
+	}
+}
+
+var CliConfig = NewStoreConfig()
+
+func ConfigSetup() *flag.FlagSet {
+	btStore := flag.NewFlagSet("bigtable-store", flag.ExitOnError)
+	btStore.BoolVar(&CliConfig.Enabled, "enabled", CliConfig.Enabled, "enable the bigtable backend store plugin. replaces the cassandra store")
+	btStore.StringVar(&CliConfig.GcpProject, "gcp-project", CliConfig.GcpProject, "Name of GCP project the bigtable cluster resides in")
+	btStore.StringVar(&CliConfig.BigtableInstance, "bigtable-instance", CliConfig.BigtableInstance, "Name of bigtable instance")
+	btStore.StringVar(&CliConfig.TableName, "table-name", CliConfig.TableName, "Name of bigtable table used for chunks")
+	btStore.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "Max number of chunks, per write thread, allowed to be unwritten to bigtable. Must be at least write-max-flush-size")
+	btStore.IntVar(&CliConfig.WriteMaxFlushSize, "write-max-flush-size", CliConfig.WriteMaxFlushSize, "Max number of chunks in each batch write to bigtable")
+	btStore.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "Number of writer threads to use")
+	btStore.IntVar(&CliConfig.ReadConcurrency, "read-concurrency", CliConfig.ReadConcurrency, "Number of concurrent reads that can be processed")
+	btStore.StringVar(&CliConfig.MaxChunkSpan, "max-chunkspan", CliConfig.MaxChunkSpan, "Maximum chunkspan size used. reads look back this far to find the chunk that covers the start of the requested range")
+	btStore.BoolVar(&CliConfig.CreateCF, "create-cf", CliConfig.CreateCF, "enable the creation of the table and column families")
+	globalconf.Register("bigtable-store", btStore)
+	return btStore
+}
@@ -0,0 +1,66 @@
+package bigtable
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+)
+
+const (
+	// queries that fail more often than this, within the window, degrade the health of the store
+	healthErrRatio = 0.05
+	// write queues that are fuller than this degrade the health of the store
+	healthQueueRatio = 0.9
+)
+
+type storeHealth struct {
+	Queries        uint32    `json:"queries"` // queries in the last minute
+	Errors         uint32    `json:"errors"`  // failed queries in the last minute
+	WriteQueueSize int       `json:"writeQueueSize"`
+	WriteQueues    []int     `json:"writeQueues"` // number of items in each write queue
+	Updated        time.Time `json:"updated"`
+}
+
+// Health reports the error rate of recent queries to bigtable and how full the write queues are
+func (s *Store) Health() health.Status {
+	now := time.Now()
+	detail := storeHealth{
+		WriteQueueSize: s.config.WriteQueueSize,
+		WriteQueues:    make([]int, len(s.writeQueues)),
+		Updated:        now,
+	}
+	status := health.Status{State: health.OK}
+
+	detail.Queries, detail.Errors = s.errWindow.Get(now)
+	if detail.Queries > 0 {
+		ratio := float64(detail.Errors) / float64(detail.Queries)
+		if detail.Errors == detail.Queries {
+			status.Worsen(health.Failed, "all %d queries in the last minute failed", detail.Queries)
+		} else if ratio > healthErrRatio {
+			status.Worsen(health.Degraded, "%.1f%% of queries in the last minute failed", ratio*100)
+		}
+	}
+
+	var full int
+	for i, q := range s.writeQueues {
+		detail.WriteQueues[i] = len(q)
+		if float64(len(q)) >= healthQueueRatio*float64(cap(q)) {
+			full++
+		}
+	}
+	if full > 0 {
+		status.Worsen(health.Degraded, "%d of %d write queues are over %d%% full", full, len(s.writeQueues), int(healthQueueRatio*100))
+	}
+	status.Detail = detail
+	return status
+}
+
+// Queues reports how full the write queues are, and how many of the allowed concurrent reads are in flight
+func (s *Store) Queues() []health.Queue {
+	queues := make([]health.Queue, 0, len(s.writeQueues)+1)
+	for i, q := range s.writeQueues {
+		queues = append(queues, health.Queue{Name: fmt.Sprintf("write.%d", i), Kind: "write", Depth: len(q), Size: cap(q)})
+	}
+	return append(queues, health.Queue{Name: "read", Kind: "read", Depth: len(s.readLimiter), Size: cap(s.readLimiter)})
+}
@@ -0,0 +1,514 @@
+package bigtable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bt "cloud.google.com/go/bigtable"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/encryption"
+	"github.com/grafana/metrictank/health"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/util"
+	opentracing "github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// write aggregated data to bigtable.
+//
+// all chunks go into a single table. each row holds one chunk, under the key <series key>_<t0>,
+// with t0 zero-padded so that the rows of a series sort by time.
+// every ttl has its own column family, with a GC policy that drops the chunks once they are older than the ttl.
+
+const (
+	// column that holds the chunk data
+	columnName = "data"
+	// how long a write to bigtable may take before we give up on it and retry
+	writeTimeout = 30 * time.Second
+)
+
+var (
+	LogLevel util.LogLevel
+
+	errChunkTooSmall = errors.New("impossibly small chunk in bigtable")
+	errInvalidRange  = errors.New("BigtableStore: invalid range: from must be less than to")
+	errCFNotFound    = errors.New("column family for given TTL not found")
+
+	// metric store.bigtable.get.exec is the duration of getting from bigtable store
+	btGetExecDuration = stats.NewLatencyHistogram15s32("store.bigtable.get.exec")
+	// metric store.bigtable.get.wait is the duration of the get spent waiting for a free read slot
+	btGetWaitDuration = stats.NewLatencyHistogram12h32("store.bigtable.get.wait")
+	// metric store.bigtable.put.exec is the duration of putting in bigtable store
+	btPutExecDuration = stats.NewLatencyHistogram15s32("store.bigtable.put.exec")
+	// metric store.bigtable.put.wait is the duration of a put in the wait queue
+	btPutWaitDuration = stats.NewLatencyHistogram12h32("store.bigtable.put.wait")
+	// metric store.bigtable.put.batch_size is how many chunks are saved per bulk write
+	btPutBatchSize = stats.NewMeter32("store.bigtable.put.batch_size", false)
+	// metric store.bigtable.chunks_per_response is how many chunks are retrieved per get query
+	btChunksPerResponse = stats.NewMeter32("store.bigtable.chunks_per_response", false)
+
+	// metric store.bigtable.chunk_operations.save_ok is counter of successful saves
+	chunkSaveOk = stats.NewCounter32("store.bigtable.chunk_operations.save_ok")
+	// metric store.bigtable.chunk_operations.save_fail is counter of failed saves
+	chunkSaveFail = stats.NewCounter32("store.bigtable.chunk_operations.save_fail")
+	// metric store.bigtable.chunk_size.at_save is the sizes of chunks seen when saving them
+	chunkSizeAtSave = stats.NewMeter32("store.bigtable.chunk_size.at_save", true)
+	// metric store.bigtable.chunk_size.at_load is the sizes of chunks seen when loading them
+	chunkSizeAtLoad = stats.NewMeter32("store.bigtable.chunk_size.at_load", true)
+)
+
+// familyName returns the name of the column family that holds the chunks with the given ttl
+func familyName(ttl uint32) string {
+	return fmt.Sprintf("ttl_%d", ttl)
+}
+
+func formatRowKey(key string, t0 uint32) string {
+	return fmt.Sprintf("%s_%010d", key, t0)
+}
+
+// parseRowKey returns the t0 of the chunk stored under the given row key
+func parseRowKey(rowKey string) (uint32, error) {
+	pos := strings.LastIndex(rowKey, "_")
+	if pos == -1 {
+		return 0, fmt.Errorf("invalid row key %q", rowKey)
+	}
+	t0, err := strconv.ParseUint(rowKey[pos+1:], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid row key %q: %s", rowKey, err)
+	}
+	return uint32(t0), nil
+}
+
+// searchRange returns the rows that may hold data for the series between start (inclusive) and end (exclusive):
+// all chunks with a t0 before end, going back far enough to include the chunk that covers start.
+func searchRange(key string, start, end, maxChunkSpan uint32) bt.RowRange {
+	from := uint32(0)
+	if start > maxChunkSpan {
+		from = start - maxChunkSpan
+	}
+	return bt.NewRange(formatRowKey(key, from), formatRowKey(key, end))
+}
+
+type Store struct {
+	client           *bt.Client
+	tbl              *bt.Table
+	writeQueues      []chan *mdata.ChunkWriteRequest
+	writeQueueMeters []*stats.Range32
+	readLimiter      chan struct{}
+	cfs              map[uint32]string // column family per ttl
+	cfLock           sync.RWMutex      // protects cfs, which may grow at runtime
+	config           *StoreConfig
+	maxChunkSpan     uint32
+	errWindow        health.ErrWindow // recent queries and errors, for health reporting
+	pending          int64            // chunks added but not saved yet. accessed atomically
+	tracer           opentracing.Tracer
+}
+
+func NewStore(config *StoreConfig, ttls []uint32) (*Store, error) {
+	if findings := ValidateConfig(config); len(findings) > 0 {
+		return nil, fmt.Errorf("%s: %s", findings[0].Subject, findings[0].Msg)
+	}
+	maxChunkSpan := dur.MustParseNDuration("max-chunkspan", config.MaxChunkSpan)
+	stats.NewGauge32("store.bigtable.write_queue.size").Set(config.WriteQueueSize)
+	stats.NewGauge32("store.bigtable.num_writers").Set(config.WriteConcurrency)
+
+	ctx := context.Background()
+	if err := ensureSchema(ctx, config, ttls); err != nil {
+		log.Error(3, "bigtable_store: failed to ensure the table and column families exist. %s", err)
+		return nil, err
+	}
+	client, err := bt.NewClient(ctx, config.GcpProject, config.BigtableInstance)
+	if err != nil {
+		log.Error(3, "bigtable_store: failed to create bigtable client. %s", err)
+		return nil, err
+	}
+
+	s := &Store{
+		client:           client,
+		tbl:              client.Open(config.TableName),
+		writeQueues:      make([]chan *mdata.ChunkWriteRequest, config.WriteConcurrency),
+		writeQueueMeters: make([]*stats.Range32, config.WriteConcurrency),
+		readLimiter:      make(chan struct{}, config.ReadConcurrency),
+		cfs:              make(map[uint32]string),
+		config:           config,
+		maxChunkSpan:     maxChunkSpan,
+		tracer:           opentracing.NoopTracer{},
+	}
+	for _, ttl := range ttls {
+		s.cfs[ttl] = familyName(ttl)
+	}
+
+	for i := 0; i < config.WriteConcurrency; i++ {
+		s.writeQueues[i] = make(chan *mdata.ChunkWriteRequest, config.WriteQueueSize)
+		s.writeQueueMeters[i] = stats.NewRange32(fmt.Sprintf("store.bigtable.write_queue.%d.items", i+1))
+		queue, meter := s.writeQueues[i], s.writeQueueMeters[i]
+		state := func() interface{} {
+			return map[string]int{"writeQueue": len(queue), "pending": int(atomic.LoadInt64(&s.pending))}
+		}
+		go crash.Go("store.write", state, func() { s.processWriteQueue(queue, meter) })
+	}
+	return s, nil
+}
+
+// ensureSchema makes sure the table and the column families for the given ttls exist, with the right GC policies.
+// if creation is disabled, they must exist already.
+func ensureSchema(ctx context.Context, config *StoreConfig, ttls []uint32) error {
+	adminClient, err := bt.NewAdminClient(ctx, config.GcpProject, config.BigtableInstance)
+	if err != nil {
+		return err
+	}
+	defer adminClient.Close()
+
+	tables, err := adminClient.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t := range tables {
+		if t == config.TableName {
+			found = true
+			break
+		}
+	}
+	if !found {
+		if !config.CreateCF {
+			return fmt.Errorf("bigtable table %s not found, and creation of tables is disabled", config.TableName)
+		}
+		log.Info("bigtable_store: creating table %s.", config.TableName)
+		if err := adminClient.CreateTable(ctx, config.TableName); err != nil {
+			return err
+		}
+	}
+
+	info, err := adminClient.TableInfo(ctx, config.TableName)
+	if err != nil {
+		return err
+	}
+	policies := make(map[string]string)
+	for _, f := range info.FamilyInfos {
+		policies[f.Name] = f.GCPolicy
+	}
+	for _, ttl := range ttls {
+		cf := familyName(ttl)
+		policy := bt.MaxAgePolicy(time.Duration(ttl) * time.Second)
+		current, ok := policies[cf]
+		if ok && current == policy.String() {
+			continue
+		}
+		if !config.CreateCF {
+			if !ok {
+				return fmt.Errorf("bigtable column family %s not found, and creation of column families is disabled", cf)
+			}
+			log.Warn("bigtable_store: column family %s has GC policy %q, expected %q", cf, current, policy)
+			continue
+		}
+		if !ok {
+			log.Info("bigtable_store: creating column family %s.", cf)
+			if err := adminClient.CreateColumnFamily(ctx, config.TableName, cf); err != nil {
+				return err
+			}
+		}
+		log.Info("bigtable_store: setting GC policy of column family %s to %s.", cf, policy)
+		if err := adminClient.SetGCPolicy(ctx, config.TableName, cf, policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) SetTracer(t opentracing.Tracer) {
+	s.tracer = t
+}
+
+func (s *Store) Add(cwr *mdata.ChunkWriteRequest) {
+	sum := int(cwr.Key.MKey.Org)
+	for _, b := range cwr.Key.MKey.Key {
+		sum += int(b)
+	}
+	which := sum % len(s.writeQueues)
+	s.writeQueueMeters[which].Value(len(s.writeQueues[which]))
+	atomic.AddInt64(&s.pending, 1)
+	s.writeQueues[which] <- cwr
+}
+
+// Drain waits until all chunks that were added have been saved, or until the timeout expires.
+// it returns the number of chunks that were not saved.
+func (s *Store) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		pending := int(atomic.LoadInt64(&s.pending))
+		if pending == 0 || !time.Now().Before(deadline) {
+			return pending
+		}
+		<-tick.C
+	}
+}
+
+// processWriteQueue saves the chunks in bulk writes of up to write-max-flush-size chunks.
+// a bulk write is done when it is full, or when there is nothing else in the queue.
+func (s *Store) processWriteQueue(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+	tick := time.Tick(time.Duration(1) * time.Second)
+	buf := make([]*mdata.ChunkWriteRequest, 0, s.config.WriteMaxFlushSize)
+	for {
+		select {
+		case <-tick:
+			meter.Value(len(queue))
+		case cwr := <-queue:
+			meter.Value(len(queue))
+			if LogLevel.Get() < 2 {
+				log.Debug("BT: starting to save %s:%d %v", cwr.Key, cwr.Chunk.T0, cwr.Chunk)
+			}
+			//log how long the chunk waited in the queue before we attempted to save to bigtable
+			btPutWaitDuration.Value(time.Now().Sub(cwr.Timestamp))
+			buf = append(buf, cwr)
+			if len(buf) >= s.config.WriteMaxFlushSize || len(queue) == 0 {
+				s.flush(buf)
+				buf = buf[:0]
+			}
+		}
+	}
+}
+
+// flush saves the chunks, retrying the ones that failed until they succeed, backing off up to 2s between attempts.
+func (s *Store) flush(cwrs []*mdata.ChunkWriteRequest) {
+	btPutBatchSize.Value(len(cwrs))
+	attempts := 0
+	for {
+		failed, err := s.write(cwrs)
+		if len(failed) == 0 {
+			return
+		}
+		if (attempts % 20) == 0 {
+			log.Warn("BT: failed to save %d of %d chunks to bigtable after %d attempts. %s", len(failed), len(cwrs), attempts+1, err)
+		}
+		chunkSaveFail.Add(len(failed))
+		cwrs = failed
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+		attempts++
+	}
+}
+
+// write saves the chunks in a single bulk write.
+// it returns the chunks that could not be saved, along with the first error seen.
+func (s *Store) write(cwrs []*mdata.ChunkWriteRequest) ([]*mdata.ChunkWriteRequest, error) {
+	var failed []*mdata.ChunkWriteRequest
+	var firstErr error
+	todo := make([]*mdata.ChunkWriteRequest, 0, len(cwrs))
+	rowKeys := make([]string, 0, len(cwrs))
+	muts := make([]*bt.Mutation, 0, len(cwrs))
+	for _, cwr := range cwrs {
+		cf, err := s.getCF(cwr.TTL)
+		if err != nil {
+			failed = append(failed, cwr)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		data := cwr.Chunk.Bytes()
+		chunkSizeAtSave.Value(len(data))
+		buf, err := encryption.Wrap(cwr.Key.MKey.Org, byte(chunk.FormatEncrypted), chunk.Encode(cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, data))
+		if err != nil {
+			failed = append(failed, cwr)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		mut := bt.NewMutation()
+		// the GC policy of the column family counts the ttl from the end of the chunk, like a write of the chunk to cassandra would
+		mut.Set(cf, columnName, bt.Time(time.Unix(int64(cwr.Chunk.T0+cwr.Span), 0)), buf)
+		todo = append(todo, cwr)
+		rowKeys = append(rowKeys, formatRowKey(cwr.Key.String(), cwr.Chunk.T0))
+		muts = append(muts, mut)
+	}
+	if len(todo) == 0 {
+		return failed, firstErr
+	}
+
+	// for unit tests
+	var errs []error
+	var err error
+	if s.tbl != nil {
+		pre := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+		errs, err = s.tbl.ApplyBulk(ctx, rowKeys, muts)
+		cancel()
+		btPutExecDuration.Value(time.Now().Sub(pre))
+	}
+	s.errWindow.Add(time.Now(), err)
+	if err != nil {
+		return append(failed, todo...), err
+	}
+	for i, cwr := range todo {
+		if errs != nil && errs[i] != nil {
+			failed = append(failed, cwr)
+			if firstErr == nil {
+				firstErr = errs[i]
+			}
+			continue
+		}
+		s.saved(cwr, rowKeys[i])
+	}
+	return failed, firstErr
+}
+
+// saved does the bookkeeping for a chunk that was saved
+func (s *Store) saved(cwr *mdata.ChunkWriteRequest, rowKey string) {
+	atomic.AddInt64(&s.pending, -1)
+	// backfilled chunks have no metric: they are not in memory here, nor on our peers
+	if cwr.Metric != nil {
+		cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
+		if !cwr.Partial {
+			mdata.SendPersistMessage(cwr.Key.String(), cwr.Chunk.T0)
+		}
+	}
+	if LogLevel.Get() < 2 {
+		log.Debug("BT: save complete. %s %v", rowKey, cwr.Chunk)
+	}
+	chunkSaveOk.Inc()
+}
+
+// EnsureTTLs makes sure there is a column family for each of the given TTLs, so data with these TTLs can be saved and read.
+// if the creation of column families is enabled, missing ones are created. otherwise they must exist already.
+func (s *Store) EnsureTTLs(ttls []uint32) error {
+	s.cfLock.Lock()
+	defer s.cfLock.Unlock()
+	var missing []uint32
+	for _, ttl := range ttls {
+		if _, ok := s.cfs[ttl]; !ok {
+			missing = append(missing, ttl)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	// for unit tests
+	if s.client != nil {
+		if err := ensureSchema(context.Background(), s.config, missing); err != nil {
+			return err
+		}
+	}
+
+	for _, ttl := range missing {
+		s.cfs[ttl] = familyName(ttl)
+	}
+	return nil
+}
+
+func (s *Store) getCF(ttl uint32) (string, error) {
+	s.cfLock.RLock()
+	cf, ok := s.cfs[ttl]
+	s.cfLock.RUnlock()
+	if !ok {
+		return "", errCFNotFound
+	}
+	return cf, nil
+}
+
+// Basic search of bigtable in the column family for given ttl
+// start inclusive, end exclusive
+func (s *Store) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	_, span := tracing.NewSpan(ctx, s.tracer, "BigtableStore.Search")
+	defer span.Finish()
+	tags.SpanKindRPCClient.Set(span)
+	tags.PeerService.Set(span, "bigtable")
+
+	itgens := make([]chunk.IterGen, 0)
+	if start >= end {
+		tracing.Failure(span)
+		tracing.Error(span, errInvalidRange)
+		return itgens, errInvalidRange
+	}
+	cf, err := s.getCF(ttl)
+	if err != nil {
+		tracing.Failure(span)
+		tracing.Error(span, err)
+		return nil, err
+	}
+
+	pre := time.Now()
+	select {
+	case <-ctx.Done():
+		// request has been canceled, so no need to execute the read
+		return nil, nil
+	case s.readLimiter <- struct{}{}:
+	}
+	defer func() { <-s.readLimiter }()
+	btGetWaitDuration.Value(time.Since(pre))
+
+	// like in cassandra, we have only the t0's of the chunks. we need all chunks with a t0 < end,
+	// as well as the last chunk with a t0 <= start, which is at most max-chunkspan before start.
+	pre = time.Now()
+	var loadErr error
+	err = s.tbl.ReadRows(ctx, searchRange(key.String(), start, end, s.maxChunkSpan), func(row bt.Row) bool {
+		t0, err := parseRowKey(row.Key())
+		if err != nil {
+			loadErr = err
+			return false
+		}
+		for _, item := range row[cf] {
+			chunkSizeAtLoad.Value(len(item.Value))
+			if len(item.Value) < 2 {
+				loadErr = errChunkTooSmall
+				return false
+			}
+			data, err := encryption.Unwrap(key.MKey.Org, byte(chunk.FormatEncrypted), item.Value)
+			if err != nil {
+				loadErr = err
+				return false
+			}
+			itgen, err := chunk.NewGen(data, t0)
+			if err != nil {
+				loadErr = err
+				return false
+			}
+			// rows come in order of t0. an earlier chunk that starts at or before start is superseded by this one
+			if t0 <= start {
+				itgens = itgens[:0]
+			}
+			itgens = append(itgens, *itgen)
+		}
+		return true
+	}, bt.RowFilter(bt.ChainFilters(bt.FamilyFilter(cf), bt.LatestNFilter(1))))
+	btGetExecDuration.Value(time.Since(pre))
+	if err != nil && ctx.Err() != nil {
+		// query was aborted.
+		return nil, nil
+	}
+	s.errWindow.Add(time.Now(), err)
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil {
+		tracing.Failure(span)
+		tracing.Error(span, err)
+		return nil, err
+	}
+	btChunksPerResponse.Value(len(itgens))
+	span.SetTag("itgens", len(itgens))
+	return itgens, nil
+}
+
+func (s *Store) Stop() {
+	s.client.Close()
+}
@@ -0,0 +1,101 @@
+package bigtable
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"gopkg.in/raintank/schema.v1"
+)
+
+const oneDay = 24 * 60 * 60
+const oneYear = oneDay * 365
+
+func TestRowKey(t *testing.T) {
+	key := schema.AMKey{MKey: schema.MKey{Org: 1}, Archive: schema.NewArchive(schema.Sum, 600)}.String()
+	for _, t0 := range []uint32{0, 600, 1500000000, 4294967295} {
+		rowKey := formatRowKey(key, t0)
+		got, err := parseRowKey(rowKey)
+		if err != nil {
+			t.Fatalf("failed to parse row key %q: %s", rowKey, err)
+		}
+		if got != t0 {
+			t.Fatalf("expected t0 %d from row key %q, got %d", t0, rowKey, got)
+		}
+	}
+	// rows of a series must sort by t0
+	if formatRowKey(key, 999) >= formatRowKey(key, 1000) {
+		t.Fatalf("expected row key for t0 999 to sort before the one for t0 1000")
+	}
+	if _, err := parseRowKey("no-timestamp"); err == nil {
+		t.Fatalf("expected error for row key without t0")
+	}
+}
+
+func TestSearchRange(t *testing.T) {
+	raw := schema.AMKey{MKey: schema.MKey{Org: 1}}.String()
+	rollup := schema.AMKey{MKey: schema.MKey{Org: 1}, Archive: schema.NewArchive(schema.Sum, 600)}.String()
+
+	rr := searchRange(raw, 10000, 20000, 3600)
+	cases := []struct {
+		row      string
+		expected bool
+	}{
+		{formatRowKey(raw, 6399), false},
+		{formatRowKey(raw, 6400), true},
+		{formatRowKey(raw, 10000), true},
+		{formatRowKey(raw, 19999), true},
+		{formatRowKey(raw, 20000), false},
+		// the rollups of the series have a different key, that starts with the one of the raw data
+		{formatRowKey(rollup, 15000), false},
+	}
+	for _, c := range cases {
+		if rr.Contains(c.row) != c.expected {
+			t.Errorf("expected range %s to contain %q: %t", rr, c.row, c.expected)
+		}
+	}
+
+	// the look back can't go before 0
+	rr = searchRange(raw, 600, 1200, 3600)
+	if !rr.Contains(formatRowKey(raw, 0)) {
+		t.Fatalf("expected range %s to contain the row for t0 0", rr)
+	}
+}
+
+func TestEnsureTTLs(t *testing.T) {
+	s := &Store{
+		cfs:    map[uint32]string{oneDay: familyName(oneDay)},
+		config: NewStoreConfig(),
+	}
+	if _, err := s.getCF(oneYear); err != errCFNotFound {
+		t.Fatalf("expected no column family for ttl %d before EnsureTTLs, got %v", oneYear, err)
+	}
+	if err := s.EnsureTTLs([]uint32{oneDay, oneYear}); err != nil {
+		t.Fatalf("EnsureTTLs failed: %s", err)
+	}
+	cf, err := s.getCF(oneYear)
+	if err != nil || cf != "ttl_31536000" {
+		t.Fatalf("expected column family ttl_31536000 for ttl %d, got %q (err %v)", oneYear, cf, err)
+	}
+}
+
+func TestWriteUnknownTTL(t *testing.T) {
+	s := &Store{
+		cfs:    map[uint32]string{oneDay: familyName(oneDay)},
+		config: NewStoreConfig(),
+	}
+	var cwrs []*mdata.ChunkWriteRequest
+	for i, ttl := range []uint32{oneDay, oneYear, oneDay} {
+		cwr := mdata.NewChunkWriteRequest(nil, schema.AMKey{MKey: schema.MKey{Org: 1}}, chunk.New(uint32(i*600)), ttl, 600, time.Now())
+		cwrs = append(cwrs, &cwr)
+	}
+	s.pending = int64(len(cwrs))
+	failed, err := s.write(cwrs)
+	if err != errCFNotFound || len(failed) != 1 || failed[0].TTL != oneYear {
+		t.Fatalf("expected only the chunk with the unknown ttl to fail, got %d failed (err %v)", len(failed), err)
+	}
+	if s.pending != 1 {
+		t.Fatalf("expected 1 pending chunk, got %d", s.pending)
+	}
+}
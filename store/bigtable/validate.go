@@ -0,0 +1,61 @@
+package bigtable
+
+import (
+	"fmt"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/dur"
+)
+
+// bigtable accepts at most this many mutations per bulk write
+const maxMutationsPerRequest = 100000
+
+// ValidateSchemas checks that the chunks of all retentions fit within max-chunkspan,
+// which is how far reads look back for the chunk that covers the start of the requested range.
+func ValidateSchemas(schemas []conf.Schema, maxChunkSpan string) []conf.Finding {
+	var findings []conf.Finding
+	max, err := dur.ParseNDuration(maxChunkSpan)
+	if err != nil {
+		// reported by ValidateConfig
+		return nil
+	}
+	for _, s := range schemas {
+		for i, ret := range s.Retentions {
+			desc := fmt.Sprintf("retention %d (%ds:%ds)", i, ret.SecondsPerPoint, ret.MaxRetention())
+			if ret.ChunkSpan > max {
+				findings = append(findings, conf.NewError(s.Name, "%s: chunkspan %d is larger than the bigtable-store max-chunkspan of %d. reads would miss the start of the requested range", desc, ret.ChunkSpan, max))
+			}
+		}
+	}
+	return findings
+}
+
+// ValidateConfig checks the settings that can't be validated by their flags alone
+func ValidateConfig(config *StoreConfig) []conf.Finding {
+	var findings []conf.Finding
+	if config.GcpProject == "" {
+		findings = append(findings, conf.NewError("bigtable-store.gcp-project", "can't be empty"))
+	}
+	if config.BigtableInstance == "" {
+		findings = append(findings, conf.NewError("bigtable-store.bigtable-instance", "can't be empty"))
+	}
+	if config.TableName == "" {
+		findings = append(findings, conf.NewError("bigtable-store.table-name", "can't be empty"))
+	}
+	if config.WriteConcurrency < 1 {
+		findings = append(findings, conf.NewError("bigtable-store.write-concurrency", "must be 1 or more"))
+	}
+	if config.ReadConcurrency < 1 {
+		findings = append(findings, conf.NewError("bigtable-store.read-concurrency", "must be 1 or more"))
+	}
+	if config.WriteMaxFlushSize < 1 || config.WriteMaxFlushSize > maxMutationsPerRequest {
+		findings = append(findings, conf.NewError("bigtable-store.write-max-flush-size", "must be between 1 and %d", maxMutationsPerRequest))
+	}
+	if config.WriteQueueSize < config.WriteMaxFlushSize {
+		findings = append(findings, conf.NewError("bigtable-store.write-queue-size", "must be at least write-max-flush-size (%d)", config.WriteMaxFlushSize))
+	}
+	if _, err := dur.ParseNDuration(config.MaxChunkSpan); err != nil {
+		findings = append(findings, conf.NewError("bigtable-store.max-chunkspan", "invalid duration %q: %s", config.MaxChunkSpan, err))
+	}
+	return findings
+}
@@ -0,0 +1,38 @@
+package bigtable
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+)
+
+func TestValidateSchemas(t *testing.T) {
+	schemas := []conf.Schema{{
+		Name: "default",
+		Retentions: conf.Retentions{
+			conf.NewRetentionMT(10, oneDay, 3600, 2, true),
+			conf.NewRetentionMT(600, oneYear, 12*3600, 2, true),
+		},
+	}}
+	if findings := ValidateSchemas(schemas, "12h"); len(findings) != 0 {
+		t.Fatalf("expected no findings, got %v", findings)
+	}
+	findings := ValidateSchemas(schemas, "6h")
+	if len(findings) != 1 || !findings[0].Error || !strings.Contains(findings[0].Msg, "chunkspan 43200 is larger") {
+		t.Fatalf("expected an error about the chunkspan, got %v", findings)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := NewStoreConfig()
+	if findings := ValidateConfig(config); len(findings) != 0 {
+		t.Fatalf("expected no findings for the default config, got %v", findings)
+	}
+	config.WriteQueueSize = 100
+	config.MaxChunkSpan = "6x"
+	findings := ValidateConfig(config)
+	if len(findings) != 2 || findings[0].Subject != "bigtable-store.write-queue-size" || findings[1].Subject != "bigtable-store.max-chunkspan" {
+		t.Fatalf("expected errors for write-queue-size and max-chunkspan, got %v", findings)
+	}
+}
@@ -1,7 +1,11 @@
 package cassandra
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/rakyll/globalconf"
 )
@@ -10,15 +14,23 @@ type StoreConfig struct {
 	Addrs                    string
 	Keyspace                 string
 	Consistency              string
+	ReadConsistency          string
+	WriteConsistency         string
 	HostSelectionPolicy      string
+	SessionMode              string
 	Timeout                  int
 	ReadConcurrency          int
 	WriteConcurrency         int
 	ReadQueueSize            int
 	WriteQueueSize           int
+	WriteBatchSize           int
+	WriteBatchInterval       int
+	WriteBatchMaxKB          int
 	Retries                  int
 	WindowFactor             int
 	OmitReadTimeout          int
+	ReadQueues               string
+	MaxParallelRowReads      int
 	CqlProtocolVersion       int
 	CreateKeyspace           bool
 	DisableInitialHostLookup bool
@@ -29,6 +41,9 @@ type StoreConfig struct {
 	Username                 string
 	Password                 string
 	SchemaFile               string
+	SpillDir                 string
+	SpillSegmentSize         int64
+	SpillMaxSize             int64
 }
 
 // return StoreConfig with default values set.
@@ -37,15 +52,23 @@ func NewStoreConfig() *StoreConfig {
 		Addrs:                    "localhost",
 		Keyspace:                 "metrictank",
 		Consistency:              "one",
+		ReadConsistency:          "",
+		WriteConsistency:         "",
 		HostSelectionPolicy:      "tokenaware,hostpool-epsilon-greedy",
+		SessionMode:              "default",
 		Timeout:                  1000,
 		ReadConcurrency:          20,
 		WriteConcurrency:         10,
 		ReadQueueSize:            200000,
 		WriteQueueSize:           100000,
+		WriteBatchSize:           0,
+		WriteBatchInterval:       100,
+		WriteBatchMaxKB:          40,
 		Retries:                  0,
 		WindowFactor:             20,
 		OmitReadTimeout:          60,
+		ReadQueues:               "",
+		MaxParallelRowReads:      4,
 		CqlProtocolVersion:       4,
 		CreateKeyspace:           true,
 		DisableInitialHostLookup: false,
@@ -56,6 +79,9 @@ func NewStoreConfig() *StoreConfig {
 		Username:         "cassandra",
 		Password:         "cassandra",
 		SchemaFile:       "/etc/metrictank/schema-store-cassandra.toml",
+		SpillDir:         "",
+		SpillSegmentSize: 64 * 1024 * 1024,
+		SpillMaxSize:     10 * 1024 * 1024 * 1024,
 	}
 }
 
@@ -65,16 +91,27 @@ func ConfigSetup() *flag.FlagSet {
 	cas := flag.NewFlagSet("cassandra", flag.ExitOnError)
 	cas.StringVar(&CliConfig.Addrs, "addrs", CliConfig.Addrs, "cassandra host (may be given multiple times as comma-separated list)")
 	cas.StringVar(&CliConfig.Keyspace, "keyspace", CliConfig.Keyspace, "cassandra keyspace to use for storing the metric data table")
-	cas.StringVar(&CliConfig.Consistency, "consistency", CliConfig.Consistency, "write consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one")
+	cas.StringVar(&CliConfig.Consistency, "consistency", CliConfig.Consistency, "consistency of reads and writes, unless overridden by read-consistency and write-consistency (any|one|two|three|quorum|all|local_quorum|each_quorum|local_one)")
+	cas.StringVar(&CliConfig.ReadConsistency, "read-consistency", CliConfig.ReadConsistency, "consistency of reads of chunks. empty to use consistency")
+	cas.StringVar(&CliConfig.WriteConsistency, "write-consistency", CliConfig.WriteConsistency, "consistency of writes of chunks. empty to use consistency")
 	cas.StringVar(&CliConfig.HostSelectionPolicy, "host-selection-policy", CliConfig.HostSelectionPolicy, "")
+	cas.StringVar(&CliConfig.SessionMode, "session-mode", CliConfig.SessionMode, "how connections to scylla are set up (default|shard-aware). shard-aware connects through scylla's shard-aware port, so that every shard gets its own connection and queries are sent straight to the shard that owns their partition. it needs a tokenaware host-selection-policy, and a build with the scylla tag (see docs/cassandra.md). default only uses the regular cql port")
 	cas.IntVar(&CliConfig.Timeout, "timeout", CliConfig.Timeout, "cassandra timeout in milliseconds")
 	cas.IntVar(&CliConfig.ReadConcurrency, "read-concurrency", CliConfig.ReadConcurrency, "max number of concurrent reads to cassandra.")
 	cas.IntVar(&CliConfig.WriteConcurrency, "write-concurrency", CliConfig.WriteConcurrency, "max number of concurrent writes to cassandra.")
 	cas.IntVar(&CliConfig.ReadQueueSize, "read-queue-size", CliConfig.ReadQueueSize, "max number of outstanding reads before reads will be dropped. This is important if you run queries that result in many reads in parallel.")
 	cas.IntVar(&CliConfig.WriteQueueSize, "write-queue-size", CliConfig.WriteQueueSize, "write queue size per cassandra worker. should be large engough to hold all at least the total number of series expected, divided by how many workers you have")
+	cas.IntVar(&CliConfig.WriteBatchSize, "write-batch-size", CliConfig.WriteBatchSize, "max number of chunks a write worker collects before saving them, with one unlogged batch per replica that owns their partitions. 0 or 1 disables batching")
+	cas.IntVar(&CliConfig.WriteBatchInterval, "write-batch-interval", CliConfig.WriteBatchInterval, "max time in milliseconds a chunk waits for its batch to fill up, when batching is enabled")
+	cas.IntVar(&CliConfig.WriteBatchMaxKB, "write-batch-max-kb", CliConfig.WriteBatchMaxKB, "max size in kB of the chunk data in a batch. keep it below batch_size_fail_threshold_in_kb of cassandra, which is 50 by default")
+	cas.StringVar(&CliConfig.SpillDir, "spill-dir", CliConfig.SpillDir, "directory to spill chunks to when their write queue is full, e.g. because cassandra is down. they are saved once the write queues have room again, also after a restart. empty to disable spilling, in which case full write queues block the ingestion")
+	cas.Int64Var(&CliConfig.SpillSegmentSize, "spill-segment-size", CliConfig.SpillSegmentSize, "size in bytes after which a new spill segment file is started. segments are removed once all of their chunks are saved")
+	cas.Int64Var(&CliConfig.SpillMaxSize, "spill-max-size", CliConfig.SpillMaxSize, "max total size in bytes of the spill segment files. when exceeded, full write queues block the ingestion again")
 	cas.IntVar(&CliConfig.Retries, "retries", CliConfig.Retries, "how many times to retry a query before failing it")
 	cas.IntVar(&CliConfig.WindowFactor, "window-factor", CliConfig.WindowFactor, "size of compaction window relative to TTL")
 	cas.IntVar(&CliConfig.OmitReadTimeout, "omit-read-timeout", CliConfig.OmitReadTimeout, "if a read is older than this (in seconds), it will be omitted,  not executed")
+	cas.StringVar(&CliConfig.ReadQueues, "read-queues", CliConfig.ReadQueues, "dedicated read queues for tables, so that slow reads of one table don't hold up the reads of others. comma separated list of table:concurrency:queue-size:omit-read-timeout, e.g. metric_1024:5:10000:120. reads of other tables use the queue of read-concurrency, read-queue-size and omit-read-timeout")
+	cas.IntVar(&CliConfig.MaxParallelRowReads, "max-parallel-row-reads", CliConfig.MaxParallelRowReads, "max number of rows of a single read that are read in parallel. reads over long time ranges span many rows, and would otherwise occupy many readers at once. 0 for no limit")
 	cas.IntVar(&CliConfig.CqlProtocolVersion, "cql-protocol-version", CliConfig.CqlProtocolVersion, "cql protocol version to use")
 	cas.BoolVar(&CliConfig.CreateKeyspace, "create-keyspace", CliConfig.CreateKeyspace, "enable the creation of the mdata keyspace and tables, only one node needs this")
 	cas.BoolVar(&CliConfig.DisableInitialHostLookup, "disable-initial-host-lookup", CliConfig.DisableInitialHostLookup, "instruct the driver to not attempt to get host info from the system.peers table")
@@ -82,9 +119,60 @@ func ConfigSetup() *flag.FlagSet {
 	cas.StringVar(&CliConfig.CaPath, "ca-path", CliConfig.CaPath, "cassandra CA certificate path when using SSL")
 	cas.BoolVar(&CliConfig.HostVerification, "host-verification", CliConfig.HostVerification, "host (hostname and server cert) verification when using SSL")
 	cas.BoolVar(&CliConfig.Auth, "auth", CliConfig.Auth, "enable cassandra authentication")
-	cas.StringVar(&CliConfig.Username, "username", CliConfig.Username, "username for authentication")
-	cas.StringVar(&CliConfig.Password, "password", CliConfig.Password, "password for authentication")
+	cas.StringVar(&CliConfig.Username, "username", CliConfig.Username, "username for authentication. may be an env:, file: or vault: reference, see the secrets section")
+	cas.StringVar(&CliConfig.Password, "password", CliConfig.Password, "password for authentication. may be an env:, file: or vault: reference, see the secrets section")
 	cas.StringVar(&CliConfig.SchemaFile, "schema-file", CliConfig.SchemaFile, "File containing the needed schemas in case database needs initializing")
 	globalconf.Register("cassandra", cas)
 	return cas
 }
+
+// consistencies returns the consistency levels of reads and writes of chunks,
+// which default to the consistency setting
+func (c *StoreConfig) consistencies() (read, write string) {
+	read, write = c.ReadConsistency, c.WriteConsistency
+	if read == "" {
+		read = c.Consistency
+	}
+	if write == "" {
+		write = c.Consistency
+	}
+	return read, write
+}
+
+// readQueueConfig is the config of a dedicated read queue for the reads of a table
+type readQueueConfig struct {
+	table       string
+	concurrency int
+	size        int
+	omitTimeout int // in seconds
+}
+
+// parseReadQueues parses the read-queues setting
+func parseReadQueues(s string) ([]readQueueConfig, error) {
+	var queues []readQueueConfig
+	seen := make(map[string]bool)
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		fields := strings.Split(spec, ":")
+		if len(fields) != 4 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid read queue %q: expected table:concurrency:queue-size:omit-read-timeout", spec)
+		}
+		var nums [3]int
+		for i, field := range fields[1:] {
+			num, err := strconv.Atoi(field)
+			if err != nil || num <= 0 {
+				return nil, fmt.Errorf("invalid read queue %q: %q is not a number above 0", spec, field)
+			}
+			nums[i] = num
+		}
+		if seen[fields[0]] {
+			return nil, errors.New("duplicate read queue for table " + fields[0])
+		}
+		seen[fields[0]] = true
+		queues = append(queues, readQueueConfig{fields[0], nums[0], nums[1], nums[2]})
+	}
+	return queues, nil
+}
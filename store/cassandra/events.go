@@ -0,0 +1,161 @@
+package cassandra
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/events"
+	"github.com/grafana/metrictank/util"
+	"github.com/raintank/worldping-api/pkg/log"
+)
+
+// events are partitioned by org and week. the ids embed the time of the event, so that we can
+// find the partition of an event from its id, and range queries are queries on the id.
+const eventsBucketSec = 7 * 24 * 3600
+
+// EventStore stores events in the events table. the events_by_tag table
+// is the index used to find events by tag, without scanning all events in the range
+type EventStore struct {
+	c   *CassandraStore
+	ttl uint32
+}
+
+// NewEventStore creates an event store using the session of the given store.
+// events expire after ttl seconds. 0 to keep them forever.
+func NewEventStore(c *CassandraStore, ttl uint32) (*EventStore, error) {
+	if c.config.CreateKeyspace {
+		for _, entry := range []string{"schema_events", "schema_events_by_tag"} {
+			schema := util.ReadEntry(c.config.SchemaFile, entry).(string)
+			log.Info("cassandra_store: ensuring that table for %s exists.", entry)
+			if err := c.Session.Query(fmt.Sprintf(schema, c.config.Keyspace)).Exec(); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		keyspaceMetadata, err := c.Session.KeyspaceMetadata(c.config.Keyspace)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range []string{"events", "events_by_tag"} {
+			if _, ok := keyspaceMetadata.Tables[table]; !ok {
+				return nil, fmt.Errorf("cassandra table %s not found, and creation of tables is disabled", table)
+			}
+		}
+	}
+	return &EventStore{
+		c:   c,
+		ttl: ttl,
+	}, nil
+}
+
+func (s *EventStore) query(stmt string, values ...interface{}) (*gocql.Query, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.c.timeout)
+	return s.c.Session.Query(stmt, values...).WithContext(ctx), cancel
+}
+
+func (s *EventStore) Add(org uint32, e events.Event) error {
+	bucket := e.When / eventsBucketSec
+	q, cancel := s.query("INSERT INTO events (orgid, bucket, id, what, tags, data) VALUES (?, ?, ?, ?, ?, ?) USING TTL ?", org, bucket, e.ID, e.What, e.Tags, e.Data, s.ttl)
+	err := q.Exec()
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, tag := range e.Tags {
+		q, cancel := s.query("INSERT INTO events_by_tag (orgid, tag, id) VALUES (?, ?, ?) USING TTL ?", org, tag, e.ID, s.ttl)
+		err := q.Exec()
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *EventStore) Get(org uint32, from, until int64, tags []string) ([]events.Event, error) {
+	minID, maxID := events.IDRange(from, until)
+	if len(tags) > 0 {
+		return s.getByTag(org, minID, maxID, tags)
+	}
+	var out []events.Event
+	for bucket := until / eventsBucketSec; bucket >= from/eventsBucketSec; bucket-- {
+		q, cancel := s.query("SELECT id, what, tags, data FROM events WHERE orgid = ? AND bucket = ? AND id >= ? AND id <= ?", org, bucket, minID, maxID)
+		iter := q.Iter()
+		var e events.Event
+		for iter.Scan(&e.ID, &e.What, &e.Tags, &e.Data) {
+			e.When = events.When(e.ID)
+			out = append(out, e)
+			e = events.Event{}
+		}
+		err := iter.Close()
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// getByTag looks up the events with the first tag in the index, and filters them on the others
+func (s *EventStore) getByTag(org uint32, minID, maxID int64, tags []string) ([]events.Event, error) {
+	q, cancel := s.query("SELECT id FROM events_by_tag WHERE orgid = ? AND tag = ? AND id >= ? AND id <= ?", org, tags[0], minID, maxID)
+	iter := q.Iter()
+	var ids []int64
+	var id int64
+	for iter.Scan(&id) {
+		ids = append(ids, id)
+	}
+	err := iter.Close()
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var out []events.Event
+	for _, id := range ids {
+		e, err := s.GetByID(org, id)
+		if err == events.ErrNotFound {
+			// deleted, but the index entry is still there
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.HasTags(tags[1:]) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (s *EventStore) GetByID(org uint32, id int64) (events.Event, error) {
+	e := events.Event{
+		ID:   id,
+		When: events.When(id),
+	}
+	q, cancel := s.query("SELECT what, tags, data FROM events WHERE orgid = ? AND bucket = ? AND id = ?", org, e.When/eventsBucketSec, id)
+	err := q.Scan(&e.What, &e.Tags, &e.Data)
+	cancel()
+	if err == gocql.ErrNotFound {
+		return e, events.ErrNotFound
+	}
+	return e, err
+}
+
+func (s *EventStore) Delete(org uint32, id int64) error {
+	e, err := s.GetByID(org, id)
+	if err != nil {
+		return err
+	}
+	for _, tag := range e.Tags {
+		q, cancel := s.query("DELETE FROM events_by_tag WHERE orgid = ? AND tag = ? AND id = ?", org, tag, id)
+		err := q.Exec()
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	q, cancel := s.query("DELETE FROM events WHERE orgid = ? AND bucket = ? AND id = ?", org, e.When/eventsBucketSec, id)
+	defer cancel()
+	return q.Exec()
+}
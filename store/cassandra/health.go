@@ -0,0 +1,84 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+)
+
+const (
+	// queries that fail more often than this, within the window, degrade the health of the store
+	healthErrRatio = 0.05
+	// write queues that are fuller than this degrade the health of the store
+	healthQueueRatio = 0.9
+)
+
+type storeHealth struct {
+	Session        string    `json:"session"`
+	Queries        uint32    `json:"queries"` // queries in the last minute
+	Errors         uint32    `json:"errors"`  // failed queries in the last minute
+	WriteQueueSize int       `json:"writeQueueSize"`
+	WriteQueues    []int     `json:"writeQueues"` // number of items in each write queue
+	Updated        time.Time `json:"updated"`
+}
+
+// Health reports the state of the cassandra session, the error rate of recent queries
+// and how full the write queues are
+func (c *CassandraStore) Health() health.Status {
+	now := time.Now()
+	detail := storeHealth{
+		Session:        "open",
+		WriteQueueSize: c.config.WriteQueueSize,
+		WriteQueues:    make([]int, len(c.writeQueues)),
+		Updated:        now,
+	}
+	status := health.Status{State: health.OK}
+	if c.Session != nil && c.Session.Closed() {
+		detail.Session = "closed"
+		status.Worsen(health.Failed, "cassandra session is closed")
+	}
+
+	detail.Queries, detail.Errors = c.errWindow.Get(now)
+	if detail.Queries > 0 {
+		ratio := float64(detail.Errors) / float64(detail.Queries)
+		if detail.Errors == detail.Queries {
+			status.Worsen(health.Failed, "all %d queries in the last minute failed", detail.Queries)
+		} else if ratio > healthErrRatio {
+			status.Worsen(health.Degraded, "%.1f%% of queries in the last minute failed", ratio*100)
+		}
+	}
+
+	var full int
+	for i, q := range c.writeQueues {
+		detail.WriteQueues[i] = len(q)
+		if float64(len(q)) >= healthQueueRatio*float64(cap(q)) {
+			full++
+		}
+	}
+	if full > 0 {
+		status.Worsen(health.Degraded, "%d of %d write queues are over %d%% full", full, len(c.writeQueues), int(healthQueueRatio*100))
+	}
+	status.Detail = detail
+	return status
+}
+
+// Queues reports how full the write queues and the read queues are
+func (c *CassandraStore) Queues() []health.Queue {
+	queues := make([]health.Queue, 0, len(c.writeQueues)+1+len(c.tableReadQueues))
+	for i, q := range c.writeQueues {
+		queues = append(queues, health.Queue{Name: fmt.Sprintf("write.%d", i), Kind: "write", Depth: len(q), Size: cap(q)})
+	}
+	queues = append(queues, health.Queue{Name: c.readQueue.name, Kind: "read", Depth: len(c.readQueue.queue), Size: cap(c.readQueue.queue)})
+	tables := make([]string, 0, len(c.tableReadQueues))
+	for table := range c.tableReadQueues {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		q := c.tableReadQueues[table]
+		queues = append(queues, health.Queue{Name: q.name, Kind: "read", Depth: len(q.queue), Size: cap(q.queue)})
+	}
+	return queues
+}
@@ -0,0 +1,211 @@
+package cassandra
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+// replicaPolicy wraps a host selection policy, and keeps track of the token ring, so that chunk writes can be grouped
+// into batches by the replica that owns their partition, and each batch is sent to that replica.
+// gocql's tokenaware policy doesn't route batches, and it doesn't expose its ring.
+// everything but the batches is left to the wrapped policy.
+type replicaPolicy struct {
+	gocql.HostSelectionPolicy
+
+	sync.RWMutex
+	murmur3 bool                       // whether the cluster uses the Murmur3Partitioner, the only one we can compute tokens for
+	hosts   map[string]*gocql.HostInfo // by connect address
+	ring    []ringToken                // sorted by token
+}
+
+type ringToken struct {
+	token int64
+	addr  string
+}
+
+func newReplicaPolicy(policy gocql.HostSelectionPolicy) *replicaPolicy {
+	return &replicaPolicy{
+		HostSelectionPolicy: policy,
+		hosts:               make(map[string]*gocql.HostInfo),
+	}
+}
+
+func (p *replicaPolicy) SetPartitioner(partitioner string) {
+	p.HostSelectionPolicy.SetPartitioner(partitioner)
+	p.Lock()
+	p.murmur3 = strings.HasSuffix(partitioner, "Murmur3Partitioner")
+	p.Unlock()
+}
+
+func (p *replicaPolicy) AddHost(host *gocql.HostInfo) {
+	p.HostSelectionPolicy.AddHost(host)
+	p.Lock()
+	p.hosts[host.ConnectAddress().String()] = host
+	p.resetRing()
+	p.Unlock()
+}
+
+func (p *replicaPolicy) RemoveHost(host *gocql.HostInfo) {
+	p.HostSelectionPolicy.RemoveHost(host)
+	p.Lock()
+	delete(p.hosts, host.ConnectAddress().String())
+	p.resetRing()
+	p.Unlock()
+}
+
+// resetRing rebuilds the ring from the tokens of the hosts. callers must hold the write lock
+func (p *replicaPolicy) resetRing() {
+	p.ring = p.ring[:0]
+	for addr, host := range p.hosts {
+		for _, t := range host.Tokens() {
+			token, err := strconv.ParseInt(t, 10, 64)
+			if err != nil {
+				continue
+			}
+			p.ring = append(p.ring, ringToken{token, addr})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].token < p.ring[j].token })
+}
+
+// replica returns the address of the host that owns the partition with the given row key: the first one on the ring
+// at or after the token of the partition. it returns "" if it doesn't know the ring.
+func (p *replicaPolicy) replica(rowKey string) string {
+	p.RLock()
+	defer p.RUnlock()
+	if !p.murmur3 || len(p.ring) == 0 {
+		return ""
+	}
+	token := int64(murmur3H1([]byte(rowKey)))
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].token >= token })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].addr
+}
+
+// Pick sends batches to the replica of the partition of their first statement, and falls back to the wrapped policy.
+// all batches of the store insert chunks, the row key of which is their first bind value.
+func (p *replicaPolicy) Pick(qry gocql.ExecutableQuery) gocql.NextHost {
+	batch, ok := qry.(*gocql.Batch)
+	if !ok || len(batch.Entries) == 0 || len(batch.Entries[0].Args) == 0 {
+		return p.HostSelectionPolicy.Pick(qry)
+	}
+	rowKey, ok := batch.Entries[0].Args[0].(string)
+	if !ok {
+		return p.HostSelectionPolicy.Pick(qry)
+	}
+	addr := p.replica(rowKey)
+	p.RLock()
+	host := p.hosts[addr]
+	p.RUnlock()
+	if host == nil || !host.IsUp() {
+		return p.HostSelectionPolicy.Pick(qry)
+	}
+	var picked bool
+	var fallback gocql.NextHost
+	return func() gocql.SelectedHost {
+		if !picked {
+			picked = true
+			return selectedReplica{host}
+		}
+		if fallback == nil {
+			fallback = p.HostSelectionPolicy.Pick(qry)
+		}
+		for {
+			h := fallback()
+			if h == nil || h.Info() != host {
+				return h
+			}
+		}
+	}
+}
+
+type selectedReplica struct {
+	host *gocql.HostInfo
+}
+
+func (s selectedReplica) Info() *gocql.HostInfo {
+	return s.host
+}
+
+func (s selectedReplica) Mark(err error) {}
+
+// murmur3H1 returns the first half of the 128 bit murmur3 hash of the data, which cassandra's Murmur3Partitioner uses as token.
+// like gocql's, it treats the bytes of the tail as unsigned, where cassandra treats them as signed,
+// which doesn't matter for our row keys: they are ascii.
+func murmur3H1(data []byte) uint64 {
+	const (
+		c1 = 0x87c37b91114253d5
+		c2 = 0x4cf5ad432745937f
+	)
+	length := len(data)
+	var h1, h2, k1, k2 uint64
+
+	nBlocks := length / 16
+	for i := 0; i < nBlocks; i++ {
+		k1 = binary.LittleEndian.Uint64(data[i*16:])
+		k2 = binary.LittleEndian.Uint64(data[i*16+8:])
+
+		k1 *= c1
+		k1 = (k1 << 31) | (k1 >> 33)
+		k1 *= c2
+		h1 ^= k1
+
+		h1 = (h1 << 27) | (h1 >> 37)
+		h1 += h2
+		h1 = h1*5 + 0x52dce729
+
+		k2 *= c2
+		k2 = (k2 << 33) | (k2 >> 31)
+		k2 *= c1
+		h2 ^= k2
+
+		h2 = (h2 << 31) | (h2 >> 33)
+		h2 += h1
+		h2 = h2*5 + 0x38495ab5
+	}
+
+	tail := data[nBlocks*16:]
+	k1, k2 = 0, 0
+	for i := 8; i < len(tail); i++ {
+		k2 ^= uint64(tail[i]) << (uint(i-8) * 8)
+	}
+	if len(tail) > 8 {
+		k2 *= c2
+		k2 = (k2 << 33) | (k2 >> 31)
+		k2 *= c1
+		h2 ^= k2
+	}
+	for i := 0; i < len(tail) && i < 8; i++ {
+		k1 ^= uint64(tail[i]) << (uint(i) * 8)
+	}
+	if len(tail) > 0 {
+		k1 *= c1
+		k1 = (k1 << 31) | (k1 >> 33)
+		k1 *= c2
+		h1 ^= k1
+	}
+
+	h1 ^= uint64(length)
+	h2 ^= uint64(length)
+	h1 += h2
+	h2 += h1
+	h1 = fmix64(h1)
+	h2 = fmix64(h2)
+	return h1 + h2
+}
+
+func fmix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
@@ -0,0 +1,45 @@
+package cassandra
+
+import (
+	"testing"
+)
+
+func TestMurmur3H1(t *testing.T) {
+	// the same vectors as gocql's murmur3 tests
+	tcs := []struct {
+		data string
+		exp  uint64
+	}{
+		{"hello", 0xcbd8a7b341bd9b02},
+		{"hello, world", 0x342fac623a5ebc8e},
+		{"19 Jan 2038 at 3:14:07 AM", 0xb89e5988b737affc},
+		{"The quick brown fox jumps over the lazy dog.", 0xcd99481f9ee902c9},
+	}
+	for _, tc := range tcs {
+		if got := murmur3H1([]byte(tc.data)); got != tc.exp {
+			t.Fatalf("%q: expected hash %x, got %x", tc.data, tc.exp, got)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	p := newReplicaPolicy(nil)
+	if addr := p.replica("1.foo_1"); addr != "" {
+		t.Fatalf("expected no replica without a ring, got %q", addr)
+	}
+	p.murmur3 = true
+	p.ring = []ringToken{{-100, "a"}, {0, "b"}, {100, "c"}}
+	token := int64(murmur3H1([]byte("1.foo_1")))
+	exp := "a"
+	switch {
+	case token > 100:
+		exp = "a" // wraps around
+	case token > 0:
+		exp = "c"
+	case token > -100:
+		exp = "b"
+	}
+	if addr := p.replica("1.foo_1"); addr != exp {
+		t.Fatalf("token %d: expected replica %q, got %q", token, exp, addr)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build scylla
+// +build scylla
+
+package cassandra
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkInsertChunkSessionMode compares the chunk write throughput of the session modes, against the
+// cluster in MT_BENCH_CASSANDRA_ADDRS, which should be a scylla cluster: against cassandra, both modes are the same.
+// both use the tokenaware host selection policy, the default mode just doesn't use scylla's shard-aware port.
+func BenchmarkInsertChunkSessionMode(b *testing.B) {
+	addrs := os.Getenv("MT_BENCH_CASSANDRA_ADDRS")
+	if addrs == "" {
+		b.Skip("MT_BENCH_CASSANDRA_ADDRS not set")
+	}
+	// only the size of the chunk data matters for the throughput. this is about the size of a chunk of a few dozen points
+	data := make([]byte, 200)
+
+	for _, mode := range []string{"default", "shard-aware"} {
+		b.Run(mode, func(b *testing.B) {
+			config := NewStoreConfig()
+			config.Addrs = addrs
+			config.Keyspace = "metrictank_bench"
+			config.SessionMode = mode
+			config.HostSelectionPolicy = "tokenaware,roundrobin"
+			config.SchemaFile = "../../scripts/config/schema-store-scylladb.toml"
+			store, err := NewCassandraStore(config, []uint32{oneDay})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer store.Stop()
+			var seq uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddUint32(&seq, 1)
+					key := fmt.Sprintf("1.%032d", i%10000)
+					if err := store.insertChunk(key, i/10000*600, oneDay, data); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package cassandra
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// native protocol v4 opcodes
+const (
+	opError     = 0x00
+	opStartup   = 0x01
+	opReady     = 0x02
+	opOptions   = 0x05
+	opSupported = 0x06
+	opQuery     = 0x07
+	opResult    = 0x08
+	opPrepare   = 0x09
+	opExecute   = 0x0A
+	opRegister  = 0x0B
+)
+
+// native protocol v4 type ids
+const (
+	typeUUID    = 0x000C
+	typeVarchar = 0x000D
+	typeInet    = 0x0010
+	typeSet     = 0x0022
+)
+
+// fakeNode emulates just enough of the native protocol of a single cassandra or scylla node,
+// to set up sessions and run queries without bind values against it.
+// like scylla, a fake scylla node assigns connections to its regular port to its shards in turns,
+// and connections to its shard-aware port to the shard given by their source port.
+type fakeNode struct {
+	nrShards   int // 0 for cassandra
+	regular    net.Listener
+	shardAware net.Listener
+
+	sync.Mutex
+	nextShard       int
+	regularConns    int
+	shardAwareConns int
+	queries         []string
+	prepared        []string
+	conns           []net.Conn
+}
+
+func newFakeNode(t *testing.T, nrShards int) *fakeNode {
+	n := &fakeNode{nrShards: nrShards}
+	var err error
+	n.regular, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	go n.accept(n.regular, false)
+	if nrShards > 0 {
+		n.shardAware, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("failed to listen: %s", err)
+		}
+		go n.accept(n.shardAware, true)
+	}
+	return n
+}
+
+func (n *fakeNode) addr() string {
+	return n.regular.Addr().String()
+}
+
+func (n *fakeNode) close() {
+	n.regular.Close()
+	if n.shardAware != nil {
+		n.shardAware.Close()
+	}
+	n.Lock()
+	for _, conn := range n.conns {
+		conn.Close()
+	}
+	n.Unlock()
+}
+
+func (n *fakeNode) accept(l net.Listener, shardAware bool) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		n.Lock()
+		n.conns = append(n.conns, conn)
+		var shard int
+		if shardAware {
+			n.shardAwareConns++
+			shard = conn.RemoteAddr().(*net.TCPAddr).Port % n.nrShards
+		} else {
+			n.regularConns++
+			if n.nrShards > 0 {
+				shard = n.nextShard
+				n.nextShard = (n.nextShard + 1) % n.nrShards
+			}
+		}
+		n.Unlock()
+		go n.serve(conn, shard)
+	}
+}
+
+func (n *fakeNode) stats() (regularConns, shardAwareConns int, queries []string) {
+	n.Lock()
+	defer n.Unlock()
+	return n.regularConns, n.shardAwareConns, append([]string(nil), n.queries...)
+}
+
+func (n *fakeNode) serve(conn net.Conn, shard int) {
+	defer conn.Close()
+	header := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(header[5:9]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		var op byte
+		var body bytes.Buffer
+		switch header[4] {
+		case opOptions:
+			op = opSupported
+			n.writeSupported(&body, shard)
+		case opStartup, opRegister:
+			op = opReady
+		case opPrepare:
+			// the id of a prepared query is its index in prepared
+			op = opResult
+			query := string(req[4 : 4+binary.BigEndian.Uint32(req[0:4])])
+			n.Lock()
+			n.prepared = append(n.prepared, query)
+			id := len(n.prepared) - 1
+			n.Unlock()
+			writeInt(&body, 4) // prepared
+			writeShort(&body, 4)
+			writeInt(&body, int32(id))
+			writeInt(&body, 0x0001) // global tables spec
+			writeInt(&body, 0)      // no bind values
+			writeInt(&body, 0)      // no partition key bind values
+			writeString(&body, "system")
+			writeString(&body, "local")
+			// like cassandra, we describe the result: drivers may skip the metadata of the rows, and use this instead
+			cols, _, _ := n.rows(query)
+			writeMetadata(&body, cols)
+		case opQuery, opExecute:
+			op = opResult
+			var query string
+			if header[4] == opQuery {
+				query = string(req[4 : 4+binary.BigEndian.Uint32(req[0:4])])
+			} else {
+				id := binary.BigEndian.Uint32(req[2:6])
+				n.Lock()
+				query = n.prepared[id]
+				n.Unlock()
+			}
+			n.Lock()
+			n.queries = append(n.queries, query)
+			n.Unlock()
+			if !n.writeResult(&body, query) {
+				op = opError
+				body.Reset()
+				writeInt(&body, 0x2200) // invalid
+				writeString(&body, "unconfigured table")
+			}
+		default:
+			op = opError
+			writeInt(&body, 0x000A) // protocol error
+			writeString(&body, fmt.Sprintf("unsupported opcode %d", header[4]))
+		}
+		resp := []byte{header[0] | 0x80, 0, header[2], header[3], op, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(resp[5:9], uint32(body.Len()))
+		if _, err := conn.Write(append(resp, body.Bytes()...)); err != nil {
+			return
+		}
+	}
+}
+
+func (n *fakeNode) writeSupported(b *bytes.Buffer, shard int) {
+	options := map[string]string{
+		"CQL_VERSION": "3.4.4",
+	}
+	if n.nrShards > 0 {
+		options["SCYLLA_SHARD"] = strconv.Itoa(shard)
+		options["SCYLLA_NR_SHARDS"] = strconv.Itoa(n.nrShards)
+		options["SCYLLA_PARTITIONER"] = "org.apache.cassandra.dht.Murmur3Partitioner"
+		options["SCYLLA_SHARDING_ALGORITHM"] = "biased-token-round-robin"
+		options["SCYLLA_SHARDING_IGNORE_MSB"] = "12"
+		options["SCYLLA_SHARD_AWARE_PORT"] = strconv.Itoa(n.shardAware.Addr().(*net.TCPAddr).Port)
+	}
+	writeShort(b, uint16(len(options)))
+	for k, v := range options {
+		writeString(b, k)
+		writeShort(b, 1)
+		writeString(b, v)
+	}
+}
+
+// writeResult writes the result of the query, and returns whether the query is supported
+func (n *fakeNode) writeResult(b *bytes.Buffer, query string) bool {
+	q := strings.ToLower(strings.TrimSpace(query))
+	switch {
+	case strings.HasPrefix(q, "use "):
+		writeInt(b, 3) // set keyspace
+		writeString(b, strings.Trim(strings.TrimSpace(query[4:]), `"`))
+	case strings.HasPrefix(q, "select"):
+		cols, rows, ok := n.rows(query)
+		if !ok {
+			return false
+		}
+		writeInt(b, 2) // rows
+		writeMetadata(b, cols)
+		writeInt(b, int32(len(rows)))
+		for _, row := range rows {
+			for _, v := range row {
+				writeInt(b, int32(len(v)))
+				b.Write(v)
+			}
+		}
+	default:
+		writeInt(b, 1) // void
+	}
+	return true
+}
+
+// rows returns the columns and rows selected by the query, and whether the query is supported
+func (n *fakeNode) rows(query string) ([]column, [][][]byte, bool) {
+	q := strings.ToLower(strings.TrimSpace(query))
+	switch {
+	case strings.HasPrefix(q, "select schema_version from system.local"):
+		return []column{{"schema_version", typeUUID, 0}}, [][][]byte{{hostID}}, true
+	case strings.HasPrefix(q, "select * from system.local"):
+		ip := net.ParseIP("127.0.0.1").To4()
+		release := "3.11.4"
+		if n.nrShards > 0 {
+			release = "3.0.8"
+		}
+		return []column{
+			{"key", typeVarchar, 0},
+			{"broadcast_address", typeInet, 0},
+			{"data_center", typeVarchar, 0},
+			{"host_id", typeUUID, 0},
+			{"listen_address", typeInet, 0},
+			{"partitioner", typeVarchar, 0},
+			{"rack", typeVarchar, 0},
+			{"release_version", typeVarchar, 0},
+			{"rpc_address", typeInet, 0},
+			{"schema_version", typeUUID, 0},
+			{"tokens", typeSet, typeVarchar},
+		}, [][][]byte{{
+			[]byte("local"),
+			ip,
+			[]byte("datacenter1"),
+			hostID,
+			ip,
+			[]byte("org.apache.cassandra.dht.Murmur3Partitioner"),
+			[]byte("rack1"),
+			[]byte(release),
+			ip,
+			hostID,
+			encodeSet("0"),
+		}}, true
+	case strings.HasPrefix(q, "select * from system.peers_v2"):
+		// neither cassandra 3 nor scylla have it
+		return nil, nil, false
+	}
+	return nil, nil, true
+}
+
+var hostID = []byte{0x5d, 0x6e, 0x3a, 0x42, 0x1b, 0x2c, 0x4d, 0x5e, 0x8f, 0x70, 0x81, 0x92, 0xa3, 0xb4, 0xc5, 0xd6}
+
+type column struct {
+	name string
+	typ  uint16
+	elem uint16
+}
+
+func writeMetadata(b *bytes.Buffer, cols []column) {
+	writeInt(b, 0x0001) // global tables spec
+	writeInt(b, int32(len(cols)))
+	writeString(b, "system")
+	writeString(b, "local")
+	for _, col := range cols {
+		writeString(b, col.name)
+		writeShort(b, col.typ)
+		if col.typ == typeSet {
+			writeShort(b, col.elem)
+		}
+	}
+}
+
+func encodeSet(vals ...string) []byte {
+	var b bytes.Buffer
+	writeInt(&b, int32(len(vals)))
+	for _, v := range vals {
+		writeInt(&b, int32(len(v)))
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+func writeInt(b *bytes.Buffer, v int32) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func writeShort(b *bytes.Buffer, v uint16) {
+	binary.Write(b, binary.BigEndian, v)
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	writeShort(b, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// TestSessionMode sets up the store against plain cassandra and scylla nodes, and checks that only the
+// shard-aware session mode uses scylla's shard-aware port, and that the default mode works with both.
+// without the scylla build tag, the shard-aware mode must be rejected.
+func TestSessionMode(t *testing.T) {
+	type testCase struct {
+		name                string
+		nrShards            int
+		sessionMode         string
+		hostSelectionPolicy string
+		expShardAware       bool
+	}
+	tcs := []testCase{
+		{"cassandra-default", 0, "default", "tokenaware,hostpool-epsilon-greedy", false},
+		{"cassandra-default-roundrobin", 0, "default", "roundrobin", false},
+		{"cassandra-shard-aware", 0, "shard-aware", "tokenaware,hostpool-epsilon-greedy", false},
+		{"scylla-default", 2, "default", "tokenaware,hostpool-epsilon-greedy", false},
+		{"scylla-shard-aware", 2, "shard-aware", "tokenaware,hostpool-epsilon-greedy", true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newFakeNode(t, tc.nrShards)
+			defer node.close()
+
+			config := NewStoreConfig()
+			config.Addrs = node.addr()
+			config.SessionMode = tc.sessionMode
+			config.HostSelectionPolicy = tc.hostSelectionPolicy
+			config.SchemaFile = "../../scripts/config/schema-store-cassandra.toml"
+			config.Timeout = 5000
+			config.WriteConcurrency = 4
+			store, err := NewCassandraStore(config, []uint32{3600})
+			if tc.sessionMode == "shard-aware" && !shardAwareSupported {
+				if err == nil {
+					store.Stop()
+					t.Fatalf("expected the shard-aware mode to be rejected without the scylla build tag")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create store: %s", err)
+			}
+			defer store.Stop()
+			err = store.Session.Query("SELECT key FROM system.local").Exec()
+			if err != nil {
+				t.Fatalf("failed to query: %s", err)
+			}
+
+			// connections are made in the background: give the pool some time to fill up
+			time.Sleep(200 * time.Millisecond)
+			regularConns, shardAwareConns, queries := node.stats()
+			if regularConns == 0 {
+				t.Fatalf("expected connections to the regular port")
+			}
+			if tc.expShardAware != (shardAwareConns > 0) {
+				t.Fatalf("expected connections to the shard-aware port: %t, got %d", tc.expShardAware, shardAwareConns)
+			}
+			var createdTable bool
+			for _, q := range queries {
+				if strings.Contains(q, "CREATE TABLE IF NOT EXISTS metrictank.metric_1") {
+					createdTable = true
+				}
+			}
+			if !createdTable {
+				t.Fatalf("expected the store to create its table, got queries %q", queries)
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !scylla
+// +build !scylla
+
+package cassandra
+
+import "github.com/gocql/gocql"
+
+// shardAwareSupported is whether we are built against the scylladb/gocql fork, which can connect to the shards of scylla nodes.
+// upstream gocql can't: see the scylla build tag
+const shardAwareSupported = false
+
+func setShardAware(cluster *gocql.ClusterConfig, on bool) {}
@@ -0,0 +1,22 @@
+//go:build scylla
+// +build scylla
+
+package cassandra
+
+import "github.com/gocql/gocql"
+
+// shardAwareSupported is whether we are built against the scylladb/gocql fork, which can connect to the shards of scylla nodes.
+// builds with the scylla tag must replace the vendored gocql with the fork, see docs/cassandra.md
+const shardAwareSupported = true
+
+// setShardAware sets whether the cluster connects through scylla's shard-aware port.
+// scylla assigns connections to that port to the shard we ask for, so the driver can keep one per shard
+func setShardAware(cluster *gocql.ClusterConfig, on bool) {
+	cluster.DisableShardAwarePort = !on
+}
+
+// Token is part of gocql.SelectedHost in the fork, which uses it to pick the connection to the shard that owns the token.
+// the fork doesn't let us make a token, so batches that we route go to the least busy connection of their replica.
+func (s selectedReplica) Token() gocql.Token {
+	return nil
+}
@@ -0,0 +1,287 @@
+package cassandra
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// the spill queue keeps the chunks that don't fit in the write queues in segment files on local disk,
+// until the store has caught up. segments are named after their sequence number, and start with the format byte.
+// every record is the length and crc32 of its payload, followed by the payload: the t0, the ttl,
+// the partial flag, the length of the key, the key and the chunk data as it is saved in cassandra,
+// so chunks of orgs with encryption enabled are encrypted on disk too. all numbers are little endian.
+// chunks that were drained but not removed from disk yet when we crash are saved again after the restart,
+// which is harmless since writes of chunks are idempotent.
+
+const (
+	spillFormatV1     = 1
+	spillSuffix       = ".spill"
+	spillRecordHeader = 4 + 4
+	spillPayloadFixed = 4 + 4 + 1 + 2
+)
+
+var (
+	errSpillCorrupt = errors.New("corrupt spill record")
+
+	// metric store.cassandra.spill.size is the total size in bytes of the spill segments on disk
+	spillSize = stats.NewGauge64("store.cassandra.spill.size")
+	// metric store.cassandra.spill.spilled is how many chunks were spilled to disk because their write queue was full
+	spillSpilled = stats.NewCounter32("store.cassandra.spill.spilled")
+	// metric store.cassandra.spill.drained is how many spilled chunks were saved to cassandra
+	spillDrained = stats.NewCounter32("store.cassandra.spill.drained")
+	// metric store.cassandra.spill.corrupt is how many spilled chunks could not be read back, and were skipped
+	spillCorrupt = stats.NewCounter32("store.cassandra.spill.corrupt")
+)
+
+type spillRecord struct {
+	key     string
+	t0      uint32
+	ttl     uint32
+	partial bool
+	data    []byte
+}
+
+func (r spillRecord) String() string {
+	return fmt.Sprintf("spilled chunk %s:%d", r.key, r.t0)
+}
+
+func encodeSpillRecord(r spillRecord) []byte {
+	payloadSize := spillPayloadFixed + len(r.key) + len(r.data)
+	buf := make([]byte, spillRecordHeader+payloadSize)
+	payload := buf[spillRecordHeader:]
+	binary.LittleEndian.PutUint32(payload[0:4], r.t0)
+	binary.LittleEndian.PutUint32(payload[4:8], r.ttl)
+	if r.partial {
+		payload[8] = 1
+	}
+	binary.LittleEndian.PutUint16(payload[9:11], uint16(len(r.key)))
+	copy(payload[spillPayloadFixed:], r.key)
+	copy(payload[spillPayloadFixed+len(r.key):], r.data)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(payloadSize))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+func decodeSpillPayload(payload []byte) (spillRecord, error) {
+	if len(payload) < spillPayloadFixed {
+		return spillRecord{}, errSpillCorrupt
+	}
+	keyLen := int(binary.LittleEndian.Uint16(payload[9:11]))
+	if len(payload) < spillPayloadFixed+keyLen {
+		return spillRecord{}, errSpillCorrupt
+	}
+	return spillRecord{
+		t0:      binary.LittleEndian.Uint32(payload[0:4]),
+		ttl:     binary.LittleEndian.Uint32(payload[4:8]),
+		partial: payload[8] == 1,
+		key:     string(payload[spillPayloadFixed : spillPayloadFixed+keyLen]),
+		data:    payload[spillPayloadFixed+keyLen:],
+	}, nil
+}
+
+type spillSegment struct {
+	seq  uint32
+	size int64
+}
+
+// spill is a FIFO queue of chunks in segment files.
+// records can be pushed concurrently, but must be read by a single reader.
+type spill struct {
+	dir         string
+	segmentSize int64
+	maxSize     int64
+
+	sync.Mutex
+	segments []spillSegment // oldest first. the last one is written to
+	size     int64
+	writer   *os.File
+
+	// reader state: only accessed by the reader, except for the segment it reads, which is protected by the lock
+	reader       *os.File
+	readerSeq    uint32
+	readerOffset int64
+}
+
+func spillPath(dir string, seq uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%010d%s", seq, spillSuffix))
+}
+
+// newSpill opens the spill queue in dir, with the segments that are left over from a previous run,
+// and starts a new segment to write to.
+func newSpill(dir string, segmentSize, maxSize int64) (*spill, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if err != nil {
+		return nil, err
+	}
+	s := &spill{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxSize:     maxSize,
+	}
+	for _, path := range paths {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), spillSuffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spillSegment{uint32(seq), info.Size()})
+		s.size += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+
+	var seq uint32
+	if len(s.segments) > 0 {
+		seq = s.segments[len(s.segments)-1].seq + 1
+	}
+	if err := s.startSegment(seq); err != nil {
+		return nil, err
+	}
+	s.readerSeq = s.segments[0].seq
+	s.readerOffset = 1
+	spillSize.Set(int(s.size))
+	return s, nil
+}
+
+// startSegment creates the segment with the given sequence number and makes it the one to write to.
+// the lock must be held, or the spill not be in use yet.
+func (s *spill) startSegment(seq uint32) error {
+	f, err := os.OpenFile(spillPath(s.dir, seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte{spillFormatV1}); err != nil {
+		f.Close()
+		return err
+	}
+	if s.writer != nil {
+		s.writer.Close()
+	}
+	s.writer = f
+	s.segments = append(s.segments, spillSegment{seq, 1})
+	s.size++
+	return nil
+}
+
+// Push appends the record to the queue, and syncs it to disk: once it returns true, the chunk counts as saved.
+// it returns false if the queue is full.
+func (s *spill) Push(r spillRecord) (bool, error) {
+	buf := encodeSpillRecord(r)
+	s.Lock()
+	defer s.Unlock()
+	if s.size+int64(len(buf)) > s.maxSize {
+		return false, nil
+	}
+	cur := &s.segments[len(s.segments)-1]
+	if cur.size >= s.segmentSize {
+		if err := s.startSegment(cur.seq + 1); err != nil {
+			return false, err
+		}
+		cur = &s.segments[len(s.segments)-1]
+	}
+	n, err := s.writer.Write(buf)
+	cur.size += int64(n)
+	s.size += int64(n)
+	spillSize.Set(int(s.size))
+	if err == nil {
+		err = s.writer.Sync()
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Pending returns whether there are records that were not read yet
+func (s *spill) Pending() bool {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.segments) > 1 || s.readerOffset < s.segments[0].size
+}
+
+// Peek returns the oldest record that was not read yet, and the size to pass to Pop once it is saved.
+// it returns errSpillCorrupt, with the size to skip, for records that can't be read back.
+// the caller must check Pending first.
+func (s *spill) Peek() (spillRecord, int64, error) {
+	s.Lock()
+	end := s.segments[0].size
+	last := len(s.segments) == 1
+	s.Unlock()
+
+	if s.readerOffset >= end && !last {
+		// we read the whole segment before the writer moved on to the next one
+		if err := s.Pop(0); err != nil {
+			return spillRecord{}, 0, err
+		}
+		return s.Peek()
+	}
+	if s.reader == nil {
+		f, err := os.Open(spillPath(s.dir, s.readerSeq))
+		if err != nil {
+			return spillRecord{}, 0, err
+		}
+		s.reader = f
+	}
+	remaining := end - s.readerOffset
+	header := make([]byte, spillRecordHeader)
+	if _, err := s.reader.ReadAt(header, s.readerOffset); err != nil {
+		if err == io.EOF && !last {
+			// a record that was partially written when we crashed
+			return spillRecord{}, remaining, errSpillCorrupt
+		}
+		return spillRecord{}, 0, err
+	}
+	payloadSize := int64(binary.LittleEndian.Uint32(header[0:4]))
+	if spillRecordHeader+payloadSize > remaining {
+		// a record that was partially written when we crashed, or a corrupt length
+		return spillRecord{}, remaining, errSpillCorrupt
+	}
+	payload := make([]byte, payloadSize)
+	if _, err := s.reader.ReadAt(payload, s.readerOffset+spillRecordHeader); err != nil {
+		return spillRecord{}, 0, err
+	}
+	size := spillRecordHeader + payloadSize
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[4:8]) {
+		return spillRecord{}, size, errSpillCorrupt
+	}
+	r, err := decodeSpillPayload(payload)
+	return r, size, err
+}
+
+// Pop removes the record that was returned by Peek.
+// segments that have been read completely are removed from disk, except the one that is written to.
+func (s *spill) Pop(size int64) error {
+	s.readerOffset += size
+	s.Lock()
+	defer s.Unlock()
+	if s.readerOffset < s.segments[0].size || len(s.segments) == 1 {
+		return nil
+	}
+	done := s.segments[0]
+	s.segments = s.segments[1:]
+	s.size -= done.size
+	spillSize.Set(int(s.size))
+	if s.reader != nil {
+		s.reader.Close()
+		s.reader = nil
+	}
+	s.readerSeq = s.segments[0].seq
+	s.readerOffset = 1
+	return os.Remove(spillPath(s.dir, done.seq))
+}
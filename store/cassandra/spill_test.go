@@ -0,0 +1,93 @@
+package cassandra
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func drainSpill(t *testing.T, s *spill) ([]spillRecord, int) {
+	var records []spillRecord
+	var corrupt int
+	for s.Pending() {
+		r, size, err := s.Peek()
+		if err == errSpillCorrupt {
+			corrupt++
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			records = append(records, r)
+		}
+		if err := s.Pop(size); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return records, corrupt
+}
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var exp []spillRecord
+	for i := uint32(0); i < 10; i++ {
+		exp = append(exp, spillRecord{key: "1.0123456789abcdef0123456789abcdef", t0: i * 600, ttl: 3600, partial: i == 9, data: []byte{1, 2, 3, byte(i)}})
+	}
+
+	// every segment holds 2 records
+	s, err := newSpill(dir, 100, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range exp[:5] {
+		if ok, err := s.Push(r); !ok || err != nil {
+			t.Fatalf("expected the record to be spilled, got %t, %v", ok, err)
+		}
+	}
+	got, _ := drainSpill(t, s)
+	if !reflect.DeepEqual(got, exp[:5]) {
+		t.Fatalf("expected records %v, got %v", exp[:5], got)
+	}
+	for _, r := range exp[5:] {
+		s.Push(r)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+spillSuffix))
+	if len(segments) != 3 {
+		t.Fatalf("expected the segments that were read to be removed, got %v", segments)
+	}
+
+	// after a restart we read the leftover segments. the first one was still being written to, so it still
+	// has the record we already read. the last one ends in a partially written record
+	last := segments[len(segments)-1]
+	f, _ := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(encodeSpillRecord(exp[0])[:10])
+	f.Close()
+	s, err = newSpill(dir, 100, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, corrupt := drainSpill(t, s)
+	if !reflect.DeepEqual(got, exp[4:]) || corrupt != 1 {
+		t.Fatalf("expected records %v and 1 corrupt, got %v and %d corrupt", exp[4:], got, corrupt)
+	}
+
+	// when the spill is full, records are refused
+	s, err = newSpill(dir, 100, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spilled int
+	for _, r := range exp {
+		if ok, _ := s.Push(r); ok {
+			spilled++
+		}
+	}
+	if spilled != 3 {
+		t.Fatalf("expected 3 records to fit, got %d", spilled)
+	}
+}
@@ -1,20 +1,24 @@
 package cassandra
 
 import (
-	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	schema "gopkg.in/raintank/schema.v1"
 
 	"github.com/gocql/gocql"
 	"github.com/grafana/metrictank/cassandra"
+	"github.com/grafana/metrictank/crash"
+	"github.com/grafana/metrictank/encryption"
+	"github.com/grafana/metrictank/health"
 	"github.com/grafana/metrictank/mdata"
 	"github.com/grafana/metrictank/mdata/chunk"
 	"github.com/grafana/metrictank/stats"
@@ -33,6 +37,8 @@ const Month_sec = 60 * 60 * 24 * 28
 const Table_name_format = `metric_%d`
 
 var (
+	LogLevel util.LogLevel
+
 	errChunkTooSmall = errors.New("impossibly small chunk in cassandra")
 	errInvalidRange  = errors.New("CassandraStore: invalid range: from must be less than to")
 	errReadQueueFull = errors.New("the read queue is full")
@@ -42,12 +48,14 @@ var (
 
 	// metric store.cassandra.get.exec is the duration of getting from cassandra store
 	cassGetExecDuration = stats.NewLatencyHistogram15s32("store.cassandra.get.exec")
-	// metric store.cassandra.get.wait is the duration of the get spent in the queue
+	// metric store.cassandra.get.wait is the duration of the get spent in the read queue, for tables without a dedicated read queue
 	cassGetWaitDuration = stats.NewLatencyHistogram12h32("store.cassandra.get.wait")
 	// metric store.cassandra.put.exec is the duration of putting in cassandra store
 	cassPutExecDuration = stats.NewLatencyHistogram15s32("store.cassandra.put.exec")
 	// metric store.cassandra.put.wait is the duration of a put in the wait queue
 	cassPutWaitDuration = stats.NewLatencyHistogram12h32("store.cassandra.put.wait")
+	// metric store.cassandra.put.batch_size is how many chunks are saved per batch (one batch per replica), when batching is enabled
+	cassPutBatchSize = stats.NewMeter32("store.cassandra.put.batch_size", false)
 	// reads that were already too old to be executed
 	cassOmitOldRead = stats.NewCounter32("store.cassandra.omit_read.too_old")
 	// reads that could not be pushed into the queue because it was full
@@ -66,6 +74,8 @@ var (
 	chunkSaveOk = stats.NewCounter32("store.cassandra.chunk_operations.save_ok")
 	// metric store.cassandra.chunk_operations.save_fail is counter of failed saves
 	chunkSaveFail = stats.NewCounter32("store.cassandra.chunk_operations.save_fail")
+	// metric store.cassandra.chunk_operations.save_drop is counter of batched or spilled chunks that were dropped because they can never be saved, e.g. because they failed to encode
+	chunkSaveDrop = stats.NewCounter32("store.cassandra.chunk_operations.save_drop")
 	// metric store.cassandra.chunk_size.at_save is the sizes of chunks seen when saving them
 	chunkSizeAtSave = stats.NewMeter32("store.cassandra.chunk_size.at_save", true)
 	// metric store.cassandra.chunk_size.at_load is the sizes of chunks seen when loading them
@@ -84,6 +94,14 @@ type ChunkReadRequest struct {
 	ctx       context.Context
 }
 
+// readQueue is a queue of reads, with its own workers
+type readQueue struct {
+	name        string
+	queue       chan *ChunkReadRequest
+	omitTimeout time.Duration
+	wait        *stats.LatencyHistogram12h32
+}
+
 type TTLTables map[uint32]ttlTable
 type ttlTable struct {
 	Table      string
@@ -94,11 +112,19 @@ type CassandraStore struct {
 	Session          *gocql.Session
 	writeQueues      []chan *mdata.ChunkWriteRequest
 	writeQueueMeters []*stats.Range32
-	readQueue        chan *ChunkReadRequest
+	readQueue        *readQueue            // for the tables without a dedicated read queue
+	tableReadQueues  map[string]*readQueue // dedicated read queues by table
 	ttlTables        TTLTables
-	omitReadTimeout  time.Duration
+	ttlLock          sync.RWMutex // protects ttlTables, which may grow at runtime
+	config           *StoreConfig
+	errWindow        health.ErrWindow // recent queries and errors, for health reporting
+	pending          int64            // chunks added but not saved yet. accessed atomically
 	tracer           opentracing.Tracer
 	timeout          time.Duration
+	readConsistency  gocql.Consistency
+	writeConsistency gocql.Consistency
+	spill            *spill         // nil when spilling is disabled
+	replicas         *replicaPolicy // nil when batching is disabled
 }
 
 func ttlUnits(ttl uint32) float64 {
@@ -106,20 +132,10 @@ func ttlUnits(ttl uint32) float64 {
 	return float64(ttl) / (60 * 60)
 }
 
-func PrepareChunkData(span uint32, data []byte) []byte {
+// PrepareChunkData encodes the chunk data for persisting it, and encrypts it if the org has encryption enabled
+func PrepareChunkData(orgId, span uint32, encoding chunk.Encoding, codec chunk.Codec, data []byte) ([]byte, error) {
 	chunkSizeAtSave.Value(len(data))
-	version := chunk.FormatStandardGoTszWithSpan
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, version)
-
-	spanCode, ok := chunk.RevChunkSpans[span]
-	if !ok {
-		// it's probably better to panic than to persist the chunk with a wrong length
-		panic(fmt.Sprintf("Chunk span invalid: %d", span))
-	}
-	binary.Write(buf, binary.LittleEndian, spanCode)
-	buf.Write(data)
-	return buf.Bytes()
+	return encryption.Wrap(orgId, byte(chunk.FormatEncrypted), chunk.Encode(span, encoding, codec, data))
 }
 
 func GetTTLTables(ttls []uint32, windowFactor int, nameFormat string) TTLTables {
@@ -171,6 +187,9 @@ func GetTTLTable(ttl uint32, windowFactor int, nameFormat string) ttlTable {
 }
 
 func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, error) {
+	if findings := ValidateConfig(config); len(findings) > 0 {
+		return nil, fmt.Errorf("%s: %s", findings[0].Subject, findings[0].Msg)
+	}
 	stats.NewGauge32("store.cassandra.write_queue.size").Set(config.WriteQueueSize)
 	stats.NewGauge32("store.cassandra.num_writers").Set(config.WriteConcurrency)
 
@@ -182,10 +201,11 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 		}
 	}
 	if config.Auth {
-		cluster.Authenticator = gocql.PasswordAuthenticator{
-			Username: config.Username,
-			Password: config.Password,
+		authenticator, err := cassandra.NewAuthenticator(config.Username, config.Password)
+		if err != nil {
+			return nil, err
 		}
+		cluster.Authenticator = authenticator
 	}
 	cluster.Consistency = gocql.ParseConsistency(config.Consistency)
 	cluster.Timeout = time.Duration(config.Timeout) * time.Millisecond
@@ -193,6 +213,7 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 	cluster.NumConns = config.WriteConcurrency
 	cluster.ProtoVersion = config.CqlProtocolVersion
 	cluster.DisableInitialHostLookup = config.DisableInitialHostLookup
+	setShardAware(cluster, config.SessionMode == "shard-aware")
 	var err error
 	tmpSession, err := cluster.CreateSession()
 	if err != nil {
@@ -281,31 +302,75 @@ func NewCassandraStore(config *StoreConfig, ttls []uint32) (*CassandraStore, err
 	default:
 		return nil, fmt.Errorf("unknown HostSelectionPolicy '%q'", config.HostSelectionPolicy)
 	}
+	var replicas *replicaPolicy
+	if config.WriteBatchSize > 1 {
+		replicas = newReplicaPolicy(cluster.PoolConfig.HostSelectionPolicy)
+		cluster.PoolConfig.HostSelectionPolicy = replicas
+	}
 
 	session, err := cluster.CreateSession()
 	if err != nil {
 		return nil, err
 	}
-	log.Debug("CS: created session with config %+v", config)
+	if LogLevel.Get() < 2 {
+		log.Debug("CS: created session with config %+v", config)
+	}
 	c := &CassandraStore{
 		Session:          session,
 		writeQueues:      make([]chan *mdata.ChunkWriteRequest, config.WriteConcurrency),
 		writeQueueMeters: make([]*stats.Range32, config.WriteConcurrency),
-		readQueue:        make(chan *ChunkReadRequest, config.ReadQueueSize),
-		omitReadTimeout:  time.Duration(config.OmitReadTimeout) * time.Second,
-		ttlTables:        ttlTables,
-		tracer:           opentracing.NoopTracer{},
-		timeout:          cluster.Timeout,
+		readQueue: &readQueue{
+			name:        "read",
+			queue:       make(chan *ChunkReadRequest, config.ReadQueueSize),
+			omitTimeout: time.Duration(config.OmitReadTimeout) * time.Second,
+			wait:        cassGetWaitDuration,
+		},
+		tableReadQueues: make(map[string]*readQueue),
+		ttlTables:       ttlTables,
+		config:          config,
+		tracer:          opentracing.NoopTracer{},
+		timeout:         cluster.Timeout,
+		replicas:        replicas,
+	}
+	// validated above
+	readConsistency, writeConsistency := config.consistencies()
+	c.readConsistency = gocql.ParseConsistency(readConsistency)
+	c.writeConsistency = gocql.ParseConsistency(writeConsistency)
+
+	if config.SpillDir != "" {
+		c.spill, err = newSpill(config.SpillDir, config.SpillSegmentSize, config.SpillMaxSize)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	for i := 0; i < config.WriteConcurrency; i++ {
 		c.writeQueues[i] = make(chan *mdata.ChunkWriteRequest, config.WriteQueueSize)
 		c.writeQueueMeters[i] = stats.NewRange32(fmt.Sprintf("store.cassandra.write_queue.%d.items", i+1))
-		go c.processWriteQueue(c.writeQueues[i], c.writeQueueMeters[i])
+		queue, meter := c.writeQueues[i], c.writeQueueMeters[i]
+		state := func() interface{} {
+			return map[string]int{"writeQueue": len(queue), "pending": int(atomic.LoadInt64(&c.pending))}
+		}
+		go crash.Go("store.write", state, func() { c.processWriteQueue(queue, meter) })
+	}
+	// the spill is only drained while the write queues have room, so they must be set up first
+	if c.spill != nil {
+		go crash.Go("store.spill", nil, c.processSpill)
 	}
 
-	for i := 0; i < config.ReadConcurrency; i++ {
-		go c.processReadQueue()
+	c.startReadQueue(c.readQueue, config.ReadConcurrency)
+	// validated above
+	readQueues, _ := parseReadQueues(config.ReadQueues)
+	for _, rq := range readQueues {
+		q := &readQueue{
+			name:        "read." + rq.table,
+			queue:       make(chan *ChunkReadRequest, rq.size),
+			omitTimeout: time.Duration(rq.omitTimeout) * time.Second,
+			// metric store.cassandra.read_queue.*.wait is the duration of the get spent in the dedicated read queue of the given table
+			wait: stats.NewLatencyHistogram12h32(fmt.Sprintf("store.cassandra.read_queue.%s.wait", rq.table)),
+		}
+		c.tableReadQueues[rq.table] = q
+		c.startReadQueue(q, rq.concurrency)
 	}
 
 	return c, err
@@ -322,12 +387,122 @@ func (c *CassandraStore) Add(cwr *mdata.ChunkWriteRequest) {
 	}
 	which := sum % len(c.writeQueues)
 	c.writeQueueMeters[which].Value(len(c.writeQueues[which]))
+	atomic.AddInt64(&c.pending, 1)
+	if c.spill != nil {
+		select {
+		case c.writeQueues[which] <- cwr:
+			return
+		default:
+			if c.spillChunk(cwr) {
+				return
+			}
+		}
+	}
 	c.writeQueues[which] <- cwr
 }
 
+// spillChunk writes the chunk to the spill queue, and returns whether it did.
+// spilled chunks are no longer pending, and count as saved for their metric in memory:
+// they are saved to cassandra once the write queues have room again, also after a restart.
+func (c *CassandraStore) spillChunk(cwr *mdata.ChunkWriteRequest) bool {
+	data, err := PrepareChunkData(cwr.Key.MKey.Org, cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, cwr.Chunk.Bytes())
+	if err != nil {
+		log.Error(3, "CS: failed to prepare chunk %s:%d for spilling: %s", cwr.Key, cwr.Chunk.T0, err)
+		return false
+	}
+	ok, err := c.spill.Push(spillRecord{
+		key:     cwr.Key.String(),
+		t0:      cwr.Chunk.T0,
+		ttl:     cwr.TTL,
+		partial: cwr.Partial,
+		data:    data,
+	})
+	if err != nil {
+		log.Error(3, "CS: failed to spill chunk %s:%d: %s", cwr.Key, cwr.Chunk.T0, err)
+	}
+	if !ok {
+		return false
+	}
+	atomic.AddInt64(&c.pending, -1)
+	if cwr.Metric != nil {
+		cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
+	}
+	spillSpilled.Inc()
+	return true
+}
+
+// processSpill saves the spilled chunks, oldest first, while the write queues are at most half full,
+// so that the chunks that come in live get precedence.
+func (c *CassandraStore) processSpill() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		if !c.spill.Pending() || c.writeQueuesBusy() {
+			<-tick.C
+			continue
+		}
+		r, size, err := c.spill.Peek()
+		if err == errSpillCorrupt {
+			log.Error(3, "CS: skipping corrupt spilled chunk of %d bytes", size)
+			spillCorrupt.Inc()
+		} else if err != nil {
+			log.Error(3, "CS: failed to read spilled chunk: %s", err)
+			<-tick.C
+			continue
+		} else {
+			err := c.retry(func() error {
+				return c.insertChunk(r.key, r.t0, r.ttl, r.data)
+			}, r, permanent)
+			if err != nil {
+				log.Error(3, "CS: dropping spilled chunk %s:%d: %s", r.key, r.t0, err)
+				chunkSaveDrop.Inc()
+			} else {
+				// the metrics in memory were synced when the chunk was spilled, only our peers need to know
+				if !r.partial {
+					mdata.SendPersistMessage(r.key, r.t0)
+				}
+				chunkSaveOk.Inc()
+				spillDrained.Inc()
+			}
+		}
+		if err := c.spill.Pop(size); err != nil {
+			log.Error(3, "CS: failed to remove spill segment: %s", err)
+		}
+	}
+}
+
+// writeQueuesBusy returns whether any of the write queues is more than half full
+func (c *CassandraStore) writeQueuesBusy() bool {
+	for _, queue := range c.writeQueues {
+		if len(queue) > cap(queue)/2 {
+			return true
+		}
+	}
+	return false
+}
+
+// Drain waits until all chunks that were added have been saved, or until the timeout expires.
+// it returns the number of chunks that were not saved.
+func (c *CassandraStore) Drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		pending := int(atomic.LoadInt64(&c.pending))
+		if pending == 0 || !time.Now().Before(deadline) {
+			return pending
+		}
+		<-tick.C
+	}
+}
+
 /* process writeQueue.
  */
 func (c *CassandraStore) processWriteQueue(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+	if c.config.WriteBatchSize > 1 {
+		c.processWriteQueueBatched(queue, meter)
+		return
+	}
 	tick := time.Tick(time.Duration(1) * time.Second)
 	for {
 		select {
@@ -335,42 +510,264 @@ func (c *CassandraStore) processWriteQueue(queue chan *mdata.ChunkWriteRequest,
 			meter.Value(len(queue))
 		case cwr := <-queue:
 			meter.Value(len(queue))
-			log.Debug("CS: starting to save %s:%d %v", cwr.Key, cwr.Chunk.T0, cwr.Chunk)
+			if LogLevel.Get() < 2 {
+				log.Debug("CS: starting to save %s:%d %v", cwr.Key, cwr.Chunk.T0, cwr.Chunk)
+			}
 			//log how long the chunk waited in the queue before we attempted to save to cassandra
 			cassPutWaitDuration.Value(time.Now().Sub(cwr.Timestamp))
 
-			buf := PrepareChunkData(cwr.Span, cwr.Chunk.Series.Bytes())
-			success := false
-			attempts := 0
 			keyStr := cwr.Key.String()
-			for !success {
-				err := c.insertChunk(keyStr, cwr.Chunk.T0, cwr.TTL, buf)
-
-				if err == nil {
-					success = true
-					cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
-					mdata.SendPersistMessage(keyStr, cwr.Chunk.T0)
-					log.Debug("CS: save complete. %s:%d %v", keyStr, cwr.Chunk.T0, cwr.Chunk)
-					chunkSaveOk.Inc()
-				} else {
-					errmetrics.Inc(err)
-					if (attempts % 20) == 0 {
-						log.Warn("CS: failed to save chunk to cassandra after %d attempts. %v, %s", attempts+1, cwr.Chunk, err)
-					}
-					chunkSaveFail.Inc()
-					sleepTime := 100 * attempts
-					if sleepTime > 2000 {
-						sleepTime = 2000
+			c.retry(func() error {
+				buf, err := PrepareChunkData(cwr.Key.MKey.Org, cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, cwr.Chunk.Bytes())
+				if err != nil {
+					return err
+				}
+				return c.insertChunk(keyStr, cwr.Chunk.T0, cwr.TTL, buf)
+			}, cwr.Chunk, nil)
+			c.saved(cwr, keyStr)
+		}
+	}
+}
+
+// processWriteQueueBatched collects up to write-batch-size chunks, and saves them with one unlogged batch per replica.
+// the chunks are saved when write-batch-size is reached, or when write-batch-interval has passed since the last save.
+func (c *CassandraStore) processWriteQueueBatched(queue chan *mdata.ChunkWriteRequest, meter *stats.Range32) {
+	tick := time.Tick(time.Duration(1) * time.Second)
+	interval := time.Duration(c.config.WriteBatchInterval) * time.Millisecond
+	flush := time.NewTimer(interval)
+	batch := make([]*mdata.ChunkWriteRequest, 0, c.config.WriteBatchSize)
+	for {
+		select {
+		case <-tick:
+			meter.Value(len(queue))
+		case <-flush.C:
+			c.writeBatch(batch)
+			batch = batch[:0]
+			flush.Reset(interval)
+		case cwr := <-queue:
+			meter.Value(len(queue))
+			if LogLevel.Get() < 2 {
+				log.Debug("CS: starting to save %s:%d %v", cwr.Key, cwr.Chunk.T0, cwr.Chunk)
+			}
+			cassPutWaitDuration.Value(time.Now().Sub(cwr.Timestamp))
+			batch = append(batch, cwr)
+			if len(batch) >= c.config.WriteBatchSize {
+				c.writeBatch(batch)
+				batch = batch[:0]
+				if !flush.Stop() {
+					select {
+					case <-flush.C:
+					default:
 					}
-					time.Sleep(time.Duration(sleepTime) * time.Millisecond)
-					attempts++
 				}
+				flush.Reset(interval)
 			}
 		}
 	}
 }
 
+// chunkWrite is a chunk that is encoded and ready to be saved
+type chunkWrite struct {
+	cwr    *mdata.ChunkWriteRequest
+	key    string // the key of the series
+	rowKey string // the partition the chunk goes to: the series and the month of the chunk
+	data   []byte
+}
+
+// batchKey identifies the chunks that can be saved in the same batch: those of the same table,
+// going to the same replica, or if we don't know the replica, to the same partition.
+type batchKey struct {
+	ttl     uint32
+	replica string // the address of the replica, if known
+	rowKey  string // set if the replica is not known
+}
+
+func (k batchKey) String() string {
+	if k.replica != "" {
+		return fmt.Sprintf("batch of chunks with ttl %d for replica %s", k.ttl, k.replica)
+	}
+	return fmt.Sprintf("batch of chunks with ttl %d for partition %s", k.ttl, k.rowKey)
+}
+
+// chunkBatch is a batch of chunks that are saved together
+type chunkBatch struct {
+	key    batchKey
+	chunks []chunkWrite
+	size   int // the number of bytes of the chunks, their row keys and t0s
+}
+
+// writeBatch saves the chunks, with one unlogged batch per replica that owns their partitions.
+// the batches are sent straight to that replica, so it can apply the writes to its partitions locally,
+// the same way it would for a single insert that is routed to it. when we don't know the token ring,
+// each batch only has the chunks of a single partition.
+func (c *CassandraStore) writeBatch(cwrs []*mdata.ChunkWriteRequest) {
+	if len(cwrs) == 0 {
+		return
+	}
+	for _, b := range c.groupBatch(cwrs) {
+		chunks := b.chunks
+		err := c.retry(func() error {
+			return c.insertChunks(b.key.ttl, chunks)
+		}, b.key, permanent)
+		if err != nil && invalidRequest(err) && len(chunks) > 1 {
+			// cassandra rejected the batch, e.g. because it is too large: save the chunks one by one,
+			// so that we only drop the ones it rejects on their own.
+			log.Warn("CS: cassandra rejected %v of %d chunks, saving them one by one. %s", b.key, len(chunks), err)
+			c.writeSingle(b.key.ttl, chunks)
+			continue
+		}
+		if err != nil {
+			for _, w := range chunks {
+				c.dropped(w.cwr, w.key, err)
+			}
+			continue
+		}
+		cassPutBatchSize.Value(len(chunks))
+		for _, w := range chunks {
+			c.saved(w.cwr, w.key)
+		}
+	}
+}
+
+// writeSingle saves each of the chunks with its own batch
+func (c *CassandraStore) writeSingle(ttl uint32, chunks []chunkWrite) {
+	for _, w := range chunks {
+		w := w
+		err := c.retry(func() error {
+			return c.insertChunks(ttl, []chunkWrite{w})
+		}, w.rowKey, permanent)
+		if err != nil {
+			c.dropped(w.cwr, w.key, err)
+			continue
+		}
+		cassPutBatchSize.Value(1)
+		c.saved(w.cwr, w.key)
+	}
+}
+
+// groupBatch encodes the chunks, and groups them by the batch they can be saved in.
+// a batch holds no more than write-batch-max-kb of chunk data, unless it only has one chunk.
+// chunks that fail to encode are dropped.
+func (c *CassandraStore) groupBatch(cwrs []*mdata.ChunkWriteRequest) []chunkBatch {
+	maxSize := c.config.WriteBatchMaxKB * 1024
+	var batches []chunkBatch
+	open := make(map[batchKey]int) // the index of the batch that chunks with the key are added to
+	for _, cwr := range cwrs {
+		w := chunkWrite{cwr: cwr, key: cwr.Key.String()}
+		var err error
+		w.data, err = PrepareChunkData(cwr.Key.MKey.Org, cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, cwr.Chunk.Bytes())
+		if err != nil {
+			c.dropped(cwr, w.key, err)
+			continue
+		}
+		w.rowKey = fmt.Sprintf("%s_%d", w.key, cwr.Chunk.T0/Month_sec)
+		k := batchKey{ttl: cwr.TTL, rowKey: w.rowKey}
+		if c.replicas != nil {
+			if addr := c.replicas.replica(w.rowKey); addr != "" {
+				k = batchKey{ttl: cwr.TTL, replica: addr}
+			}
+		}
+		size := len(w.rowKey) + 8 + len(w.data)
+		i, ok := open[k]
+		if !ok || batches[i].size+size > maxSize {
+			batches = append(batches, chunkBatch{key: k})
+			i = len(batches) - 1
+			open[k] = i
+		}
+		batches[i].chunks = append(batches[i].chunks, w)
+		batches[i].size += size
+	}
+	return batches
+}
+
+// retry calls save until it succeeds, backing off up to 2s between attempts.
+// if giveUp is set, it gives up on the errors for which it returns true, and returns them.
+// what is printed with %v when we log a failure, so it should not be formatted by the caller.
+func (c *CassandraStore) retry(save func() error, what interface{}, giveUp func(error) bool) error {
+	attempts := 0
+	for {
+		err := save()
+		c.errWindow.Add(time.Now(), err)
+		if err == nil {
+			return nil
+		}
+		errmetrics.Inc(err)
+		chunkSaveFail.Inc()
+		if giveUp != nil && giveUp(err) {
+			return err
+		}
+		if (attempts % 20) == 0 {
+			log.Warn("CS: failed to save %v to cassandra after %d attempts. %s", what, attempts+1, err)
+		}
+		sleepTime := 100 * attempts
+		if sleepTime > 2000 {
+			sleepTime = 2000
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Millisecond)
+		attempts++
+	}
+}
+
+// permanent returns whether the error won't go away when we try again
+func permanent(err error) bool {
+	return !retryable(err)
+}
+
+// retryable returns whether the error may go away when we try again: errors from the driver or cassandra, and timeouts.
+// anything else, like a missing table for the ttl or a request cassandra rejects as invalid, is there to stay.
+func retryable(err error) bool {
+	if _, ok := err.(gocql.RequestError); ok {
+		return !invalidRequest(err)
+	}
+	if err == gocql.ErrUnavailable || err == context.DeadlineExceeded || err == context.Canceled {
+		return true
+	}
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return true
+	}
+	return strings.HasPrefix(err.Error(), "gocql: ")
+}
+
+// errCodeInvalid is the code of the error cassandra answers invalid requests with. gocql doesn't export it
+const errCodeInvalid = 0x2200
+
+// invalidRequest returns whether cassandra rejected the request as invalid, e.g. a batch that is too large.
+// sending it again won't help.
+func invalidRequest(err error) bool {
+	rerr, ok := err.(gocql.RequestError)
+	return ok && rerr.Code() == errCodeInvalid
+}
+
+// saved does the bookkeeping for a chunk that was saved
+func (c *CassandraStore) saved(cwr *mdata.ChunkWriteRequest, keyStr string) {
+	atomic.AddInt64(&c.pending, -1)
+	// backfilled chunks have no metric: they are not in memory here, nor on our peers
+	if cwr.Metric != nil {
+		cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
+		if !cwr.Partial {
+			mdata.SendPersistMessage(keyStr, cwr.Chunk.T0)
+		}
+	}
+	if LogLevel.Get() < 2 {
+		log.Debug("CS: save complete. %s:%d %v", keyStr, cwr.Chunk.T0, cwr.Chunk)
+	}
+	chunkSaveOk.Inc()
+}
+
+// dropped does the bookkeeping for a chunk that can never be saved.
+// our peers are not told about it, so that one of them can still save it when it gets promoted.
+func (c *CassandraStore) dropped(cwr *mdata.ChunkWriteRequest, keyStr string, err error) {
+	log.Error(3, "CS: dropping chunk %s:%d, it can't be saved: %s", keyStr, cwr.Chunk.T0, err)
+	chunkSaveDrop.Inc()
+	atomic.AddInt64(&c.pending, -1)
+	if cwr.Metric != nil {
+		cwr.Metric.SyncChunkSaveState(cwr.Chunk.T0)
+	}
+}
+
 func (c *CassandraStore) GetTableNames() []string {
+	c.ttlLock.RLock()
+	defer c.ttlLock.RUnlock()
 	names := make([]string, 0)
 	for _, table := range c.ttlTables {
 		names = append(names, table.Table)
@@ -378,8 +775,56 @@ func (c *CassandraStore) GetTableNames() []string {
 	return names
 }
 
+// EnsureTTLs makes sure there is a table for each of the given TTLs, so data with these TTLs can be saved and read.
+// if the creation of the keyspace and tables is enabled, missing tables are created. otherwise they must exist already.
+func (c *CassandraStore) EnsureTTLs(ttls []uint32) error {
+	c.ttlLock.Lock()
+	defer c.ttlLock.Unlock()
+	var missing []uint32
+	for _, ttl := range ttls {
+		if _, ok := c.ttlTables[ttl]; !ok {
+			missing = append(missing, ttl)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	tables := GetTTLTables(missing, c.config.WindowFactor, Table_name_format)
+
+	// for unit tests
+	if c.Session != nil {
+		if c.config.CreateKeyspace {
+			schemaTable := util.ReadEntry(c.config.SchemaFile, "schema_table").(string)
+			for _, result := range tables {
+				log.Info("cassandra_store: ensuring that table %s exists.", result.Table)
+				err := c.Session.Query(fmt.Sprintf(schemaTable, c.config.Keyspace, result.Table, result.WindowSize, result.WindowSize*60*60)).Exec()
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			keyspaceMetadata, err := c.Session.KeyspaceMetadata(c.config.Keyspace)
+			if err != nil {
+				return err
+			}
+			for _, result := range tables {
+				if _, ok := keyspaceMetadata.Tables[result.Table]; !ok {
+					return fmt.Errorf("cassandra table %s not found, and creation of tables is disabled", result.Table)
+				}
+			}
+		}
+	}
+
+	for ttl, result := range tables {
+		c.ttlTables[ttl] = result
+	}
+	return nil
+}
+
 func (c *CassandraStore) getTable(ttl uint32) (string, error) {
+	c.ttlLock.RLock()
 	entry, ok := c.ttlTables[ttl]
+	c.ttlLock.RUnlock()
 	if !ok {
 		return "", errTableNotFound
 	}
@@ -392,24 +837,94 @@ func (c *CassandraStore) getTable(ttl uint32) (string, error) {
 // ts: is the start of the aggregated time range.
 // data: is the payload as bytes.
 func (c *CassandraStore) insertChunk(key string, t0, ttl uint32, data []byte) error {
+	table, err := c.getTable(ttl)
+	if err != nil {
+		return err
+	}
+
 	// for unit tests
 	if c.Session == nil {
 		return nil
 	}
 
+	query := fmt.Sprintf("INSERT INTO %s (key, ts, data) values(?,?,?) USING TTL %d", table, ttl)
+	row_key := fmt.Sprintf("%s_%d", key, t0/Month_sec) // "month number" based on unix timestamp (rounded down)
+	pre := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	ret := c.Session.Query(query, row_key, t0, data).Consistency(c.writeConsistency).WithContext(ctx).Exec()
+	cancel()
+	cassPutExecDuration.Value(time.Now().Sub(pre))
+	return ret
+}
+
+// insertChunks saves the chunks, which all go to the table of the given ttl, in an unlogged batch
+func (c *CassandraStore) insertChunks(ttl uint32, chunks []chunkWrite) error {
 	table, err := c.getTable(ttl)
 	if err != nil {
 		return err
 	}
 
+	// for unit tests
+	if c.Session == nil {
+		return nil
+	}
+
 	query := fmt.Sprintf("INSERT INTO %s (key, ts, data) values(?,?,?) USING TTL %d", table, ttl)
-	row_key := fmt.Sprintf("%s_%d", key, t0/Month_sec) // "month number" based on unix timestamp (rounded down)
 	pre := time.Now()
 	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
-	ret := c.Session.Query(query, row_key, t0, data).WithContext(ctx).Exec()
-	cancel()
+	defer cancel()
+	batch := c.Session.NewBatch(gocql.UnloggedBatch).WithContext(ctx)
+	batch.Cons = c.writeConsistency
+	for _, w := range chunks {
+		// the row key must be the first bind value, replicaPolicy routes the batch by it
+		batch.Query(query, w.rowKey, w.cwr.Chunk.T0, w.data)
+	}
+	err = c.Session.ExecuteBatch(batch)
 	cassPutExecDuration.Value(time.Now().Sub(pre))
-	return ret
+	return err
+}
+
+// ReplaceChunks saves the chunks, which all belong to the same series, and once they are saved,
+// deletes the chunks of that series with the given t0s, except for the ones that were overwritten.
+// see mdata.ChunkReplacer
+func (c *CassandraStore) ReplaceChunks(ctx context.Context, cwrs []*mdata.ChunkWriteRequest, old []uint32) error {
+	// for unit tests
+	if c.Session == nil || len(cwrs) == 0 {
+		return nil
+	}
+	keyStr := cwrs[0].Key.String()
+	saved := make(map[uint32]bool, len(cwrs))
+	for _, cwr := range cwrs {
+		buf, err := PrepareChunkData(cwr.Key.MKey.Org, cwr.Span, cwr.Chunk.Encoding(), cwr.Codec, cwr.Chunk.Bytes())
+		if err != nil {
+			return err
+		}
+		err = c.insertChunk(keyStr, cwr.Chunk.T0, cwr.TTL, buf)
+		c.errWindow.Add(time.Now(), err)
+		if err != nil {
+			return err
+		}
+		saved[cwr.Chunk.T0] = true
+		chunkSaveOk.Inc()
+	}
+
+	table, err := c.getTable(cwrs[0].TTL)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("DELETE FROM %s WHERE key = ? AND ts = ?", table)
+	for _, t0 := range old {
+		if saved[t0] {
+			continue
+		}
+		rowKey := fmt.Sprintf("%s_%d", keyStr, t0/Month_sec)
+		err := c.Session.Query(query, rowKey, t0).Consistency(c.writeConsistency).WithContext(ctx).Exec()
+		c.errWindow.Add(time.Now(), err)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type outcome struct {
@@ -424,8 +939,25 @@ func (o asc) Len() int           { return len(o) }
 func (o asc) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
 func (o asc) Less(i, j int) bool { return o[i].sortKey < o[j].sortKey }
 
-func (c *CassandraStore) processReadQueue() {
-	for crr := range c.readQueue {
+func (c *CassandraStore) startReadQueue(q *readQueue, concurrency int) {
+	state := func() interface{} {
+		return map[string]int{q.name: len(q.queue)}
+	}
+	for i := 0; i < concurrency; i++ {
+		go crash.Go("store.read", state, func() { c.processReadQueue(q) })
+	}
+}
+
+// getReadQueue returns the read queue for the reads of the given table
+func (c *CassandraStore) getReadQueue(table string) *readQueue {
+	if q, ok := c.tableReadQueues[table]; ok {
+		return q
+	}
+	return c.readQueue
+}
+
+func (c *CassandraStore) processReadQueue(q *readQueue) {
+	for crr := range q.queue {
 		// check to see if the request has been canceled, if so abort now.
 		select {
 		case <-crr.ctx.Done():
@@ -435,8 +967,8 @@ func (c *CassandraStore) processReadQueue() {
 		default:
 		}
 		waitDuration := time.Since(crr.timestamp)
-		cassGetWaitDuration.Value(waitDuration)
-		if waitDuration > c.omitReadTimeout {
+		q.wait.Value(waitDuration)
+		if waitDuration > q.omitTimeout {
 			cassOmitOldRead.Inc()
 			crr.out <- outcome{err: errReadTooOld}
 			continue
@@ -446,7 +978,7 @@ func (c *CassandraStore) processReadQueue() {
 		iter := outcome{
 			month:   crr.month,
 			sortKey: crr.sortKey,
-			i:       c.Session.Query(crr.q, crr.p...).WithContext(crr.ctx).Iter(),
+			i:       c.Session.Query(crr.q, crr.p...).Consistency(c.readConsistency).WithContext(crr.ctx).Iter(),
 			err:     nil,
 		}
 		cassGetExecDuration.Value(time.Since(pre))
@@ -524,19 +1056,39 @@ func (c *CassandraStore) SearchTable(ctx context.Context, key schema.AMKey, tabl
 	}
 	numQueries := len(crrs)
 	results := make(chan outcome, numQueries)
-	for i := range crrs {
-		crrs[i].out = results
+	rq := c.getReadQueue(table)
+
+	// we queue at most max-parallel-row-reads rows at once, and queue the next row whenever one is done,
+	// so that reads over long time ranges don't occupy many readers at once
+	queued := 0
+	queue := func() error {
+		crr := crrs[queued]
+		crr.out = results
+		crr.timestamp = time.Now()
 		select {
 		case <-ctx.Done():
 			// request has been canceled, so no need to continue queuing reads.
 			// reads already queued will be aborted when read from the queue.
-			return nil, nil
-		case c.readQueue <- crrs[i]:
+			return errCtxCanceled
+		case rq.queue <- crr:
+			queued++
+			return nil
 		default:
 			cassReadQueueFull.Inc()
 			tracing.Failure(span)
 			tracing.Error(span, errReadQueueFull)
-			return nil, errReadQueueFull
+			return errReadQueueFull
+		}
+	}
+	parallel := c.config.MaxParallelRowReads
+	if parallel <= 0 || parallel > numQueries {
+		parallel = numQueries
+	}
+	for queued < parallel {
+		if err := queue(); err == errCtxCanceled {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
 		}
 	}
 	outcomes := make([]outcome, 0, numQueries)
@@ -564,6 +1116,13 @@ LOOP:
 				close(results)
 				break LOOP
 			}
+			if queued < numQueries {
+				if err := queue(); err == errCtxCanceled {
+					return nil, nil
+				} else if err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
 	cassGetChunksDuration.Value(time.Since(pre))
@@ -583,7 +1142,13 @@ LOOP:
 				tracing.Error(span, errChunkTooSmall)
 				return itgens, errChunkTooSmall
 			}
-			itgen, err := chunk.NewGen(b, uint32(ts))
+			data, err := encryption.Unwrap(key.MKey.Org, byte(chunk.FormatEncrypted), b)
+			if err != nil {
+				tracing.Failure(span)
+				tracing.Error(span, err)
+				return itgens, err
+			}
+			itgen, err := chunk.NewGen(data, uint32(ts))
 			if err != nil {
 				tracing.Failure(span)
 				tracing.Error(span, err)
@@ -600,8 +1165,10 @@ LOOP:
 			tracing.Failure(span)
 			tracing.Error(span, err)
 			errmetrics.Inc(err)
+			c.errWindow.Add(time.Now(), err)
 			return nil, err
 		} else {
+			c.errWindow.Add(time.Now(), nil)
 			cassChunksPerRow.Value(int(chunks))
 		}
 	}
@@ -1,9 +1,20 @@
 package cassandra
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"gopkg.in/raintank/schema.v1"
 )
 
 type testCase struct {
@@ -60,3 +71,163 @@ func TestGetTTLTables(t *testing.T) {
 		}
 	}
 }
+
+func TestEnsureTTLs(t *testing.T) {
+	c := &CassandraStore{
+		ttlTables: GetTTLTables([]uint32{oneDay}, 20, Table_name_format),
+		config:    NewStoreConfig(),
+	}
+	if _, err := c.getTable(oneYear); err != errTableNotFound {
+		t.Fatalf("expected no table for ttl %d before EnsureTTLs, got %v", oneYear, err)
+	}
+	err := c.EnsureTTLs([]uint32{oneDay, oneYear})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for ttl, exp := range map[uint32]string{oneDay: "metric_16", oneYear: "metric_8192"} {
+		table, err := c.getTable(ttl)
+		if err != nil || table != exp {
+			t.Fatalf("ttl %d: expected table %s, got %q (err %v)", ttl, exp, table, err)
+		}
+	}
+}
+
+func TestProcessWriteQueueBatched(t *testing.T) {
+	config := NewStoreConfig()
+	config.WriteBatchSize = 3
+	config.WriteBatchInterval = 10
+	c := &CassandraStore{
+		ttlTables: GetTTLTables([]uint32{oneDay, oneYear}, 20, Table_name_format),
+		config:    config,
+	}
+	queue := make(chan *mdata.ChunkWriteRequest, 10)
+	go c.processWriteQueue(queue, &stats.Range32{})
+
+	// the first 3 chunks fill a batch, the other 2, the last one is only saved once the interval passes
+	for i, ttl := range []uint32{oneDay, oneYear, oneDay, oneDay, oneYear} {
+		cwr := mdata.NewChunkWriteRequest(nil, schema.AMKey{MKey: schema.MKey{Org: 1}}, chunk.New(uint32(i*600)), ttl, 600, time.Now())
+		atomic.AddInt64(&c.pending, 1)
+		queue <- &cwr
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&c.pending) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all chunks to be saved, %d still pending", atomic.LoadInt64(&c.pending))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProcessWriteQueueDrop(t *testing.T) {
+	config := NewStoreConfig()
+	config.WriteBatchSize = 3
+	config.WriteBatchInterval = 10
+	c := &CassandraStore{
+		ttlTables: GetTTLTables([]uint32{oneDay}, 20, Table_name_format),
+		config:    config,
+	}
+	queue := make(chan *mdata.ChunkWriteRequest, 10)
+	go c.processWriteQueue(queue, &stats.Range32{})
+
+	// there is no table for the ttl of the second chunk: it can never be saved, and must not hold up the others
+	for i, ttl := range []uint32{oneDay, oneYear, oneDay} {
+		cwr := mdata.NewChunkWriteRequest(nil, schema.AMKey{MKey: schema.MKey{Org: 1}}, chunk.New(uint32(i*600)), ttl, 600, time.Now())
+		atomic.AddInt64(&c.pending, 1)
+		queue <- &cwr
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&c.pending) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected all chunks to be saved or dropped, %d still pending", atomic.LoadInt64(&c.pending))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	c := &CassandraStore{}
+	if err := c.retry(func() error { return errTableNotFound }, "chunk", permanent); err != errTableNotFound {
+		t.Fatalf("expected retry to give up on %q, got %v", errTableNotFound, err)
+	}
+	if retryable(errTableNotFound) {
+		t.Fatalf("expected %q not to be retryable", errTableNotFound)
+	}
+	for _, err := range []error{gocql.ErrTimeoutNoResponse, gocql.ErrNoConnections, gocql.ErrUnavailable, context.DeadlineExceeded, requestError(0x1100)} {
+		if !retryable(err) {
+			t.Fatalf("expected %q to be retryable", err)
+		}
+	}
+	// e.g. a batch larger than batch_size_fail_threshold_in_kb
+	if retryable(requestError(errCodeInvalid)) {
+		t.Fatalf("expected an invalid request not to be retryable")
+	}
+}
+
+// requestError is an error cassandra answers a request with
+type requestError int
+
+func (e requestError) Code() int       { return int(e) }
+func (e requestError) Message() string { return fmt.Sprintf("error %x", int(e)) }
+func (e requestError) Error() string   { return e.Message() }
+
+// TestGroupBatch checks how many chunks end up in each batch, when all series save a chunk at the same time,
+// like they do at the chunkspan boundaries: with a write worker per 1000 series,
+// and a cluster of 3 nodes with 256 tokens each.
+func TestGroupBatch(t *testing.T) {
+	config := NewStoreConfig()
+	config.WriteBatchSize = 100
+	c := &CassandraStore{
+		ttlTables: GetTTLTables([]uint32{oneDay}, 20, Table_name_format),
+		config:    config,
+		replicas:  newReplicaPolicy(nil),
+	}
+	c.replicas.murmur3 = true
+	r := rand.New(rand.NewSource(1))
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		for i := 0; i < 256; i++ {
+			c.replicas.ring = append(c.replicas.ring, ringToken{int64(r.Uint64()), addr})
+		}
+	}
+	sort.Slice(c.replicas.ring, func(i, j int) bool { return c.replicas.ring[i].token < c.replicas.ring[j].token })
+
+	var cwrs []*mdata.ChunkWriteRequest
+	for i := 0; i < config.WriteBatchSize; i++ {
+		key := schema.AMKey{MKey: schema.MKey{Org: 1}}
+		r.Read(key.MKey.Key[:])
+		cwr := mdata.NewChunkWriteRequest(nil, key, chunk.New(1500000000), oneDay, 600, time.Now())
+		atomic.AddInt64(&c.pending, 1)
+		cwrs = append(cwrs, &cwr)
+	}
+
+	batches := c.groupBatch(cwrs)
+	if len(batches) != 3 {
+		t.Fatalf("expected a batch per replica, got %d batches", len(batches))
+	}
+	for _, b := range batches {
+		if len(b.chunks) < 20 {
+			t.Fatalf("expected about a third of the chunks in each batch, got %d for %s", len(b.chunks), b.key)
+		}
+	}
+
+	// batches that would exceed write-batch-max-kb are split
+	c.config.WriteBatchMaxKB = 1
+	batches = c.groupBatch(cwrs)
+	chunks := 0
+	for _, b := range batches {
+		if b.size > 1024 && len(b.chunks) > 1 {
+			t.Fatalf("expected batches of at most 1kB, got %d chunks of %d bytes for %s", len(b.chunks), b.size, b.key)
+		}
+		chunks += len(b.chunks)
+	}
+	if len(batches) <= 3 || chunks != len(cwrs) {
+		t.Fatalf("expected the %d chunks to be split over more than 3 batches, got %d chunks in %d batches", len(cwrs), chunks, len(batches))
+	}
+	c.config.WriteBatchMaxKB = 40
+
+	// without knowing the ring, we can only batch per partition: every chunk gets its own batch
+	c.replicas = nil
+	batches = c.groupBatch(cwrs)
+	if len(batches) != len(cwrs) {
+		t.Fatalf("expected a batch per chunk without a ring, got %d batches for %d chunks", len(batches), len(cwrs))
+	}
+}
@@ -0,0 +1,113 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gocql/gocql"
+	"github.com/grafana/metrictank/conf"
+)
+
+// ValidateSchemas checks the retentions of the schemas for chunk spans that don't line up with the cassandra rows
+// or with the intervals of their points, and reports ttls that end up in the same table.
+func ValidateSchemas(schemas []conf.Schema, windowFactor int) []conf.Finding {
+	var findings []conf.Finding
+	type ttlUse struct {
+		ttl    uint32
+		schema string
+	}
+	tables := make(map[string][]ttlUse)
+
+	for _, s := range schemas {
+		for i, ret := range s.Retentions {
+			desc := fmt.Sprintf("retention %d (%ds:%ds)", i, ret.SecondsPerPoint, ret.MaxRetention())
+			if ret.ChunkSpan == 0 {
+				findings = append(findings, conf.NewError(s.Name, "%s: no chunkspan set", desc))
+				continue
+			}
+			if Month_sec%ret.ChunkSpan != 0 {
+				findings = append(findings, conf.NewError(s.Name, "%s: chunkspan %d does not divide the cassandra row width of %d seconds. chunks will straddle row boundaries", desc, ret.ChunkSpan, Month_sec))
+			}
+			if ret.ChunkSpan%uint32(ret.SecondsPerPoint) != 0 {
+				findings = append(findings, conf.NewError(s.Name, "%s: chunkspan %d is not a multiple of the interval %d. chunk boundaries won't line up with points", desc, ret.ChunkSpan, ret.SecondsPerPoint))
+			}
+			if uint32(ret.MaxRetention()) < ret.ChunkSpan {
+				findings = append(findings, conf.NewWarning(s.Name, "%s: ttl %d is shorter than chunkspan %d. chunks expire before they are complete", desc, ret.MaxRetention(), ret.ChunkSpan))
+			}
+			if i > 0 && ret.ChunkSpan < s.Retentions[i-1].ChunkSpan {
+				findings = append(findings, conf.NewWarning(s.Name, "%s: chunkspan %d is smaller than the one of the higher resolution retention (%d)", desc, ret.ChunkSpan, s.Retentions[i-1].ChunkSpan))
+			}
+			ttl := uint32(ret.MaxRetention())
+			table := GetTTLTable(ttl, windowFactor, Table_name_format).Table
+			tables[table] = append(tables[table], ttlUse{ttl, s.Name})
+		}
+	}
+
+	names := make([]string, 0, len(tables))
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+	for _, table := range names {
+		uses := tables[table]
+		for _, u := range uses[1:] {
+			if u.ttl != uses[0].ttl {
+				findings = append(findings, conf.NewWarning(u.schema, "ttl %d shares table %s with ttl %d of schema %s. data with different ttls in the same table delays dropping expired sstables", u.ttl, table, uses[0].ttl, uses[0].schema))
+			}
+		}
+	}
+	return findings
+}
+
+// ValidateConfig checks the settings that can't be validated by their flags alone
+func ValidateConfig(config *StoreConfig) []conf.Finding {
+	var findings []conf.Finding
+	checkConsistency := func(key, value string) {
+		if _, err := gocql.ParseConsistencyWrapper(value); err != nil {
+			findings = append(findings, conf.NewError(key, "invalid consistency %q", value))
+		}
+	}
+	checkConsistency("cassandra.consistency", config.Consistency)
+	if config.ReadConsistency != "" {
+		checkConsistency("cassandra.read-consistency", config.ReadConsistency)
+	}
+	if config.WriteConsistency != "" {
+		checkConsistency("cassandra.write-consistency", config.WriteConsistency)
+	}
+	switch config.SessionMode {
+	case "default":
+	case "shard-aware":
+		if !shardAwareSupported {
+			findings = append(findings, conf.NewError("cassandra.session-mode", "shard-aware needs a build with the scylla tag, against the scylladb/gocql fork"))
+		} else if !strings.HasPrefix(config.HostSelectionPolicy, "tokenaware,") {
+			findings = append(findings, conf.NewError("cassandra.session-mode", "shard-aware needs a tokenaware host-selection-policy, got %q", config.HostSelectionPolicy))
+		}
+	default:
+		findings = append(findings, conf.NewError("cassandra.session-mode", "unknown session mode %q", config.SessionMode))
+	}
+	if _, err := parseReadQueues(config.ReadQueues); err != nil {
+		findings = append(findings, conf.NewError("cassandra.read-queues", "%s", err))
+	}
+	if config.MaxParallelRowReads < 0 {
+		findings = append(findings, conf.NewError("cassandra.max-parallel-row-reads", "can't be negative"))
+	}
+	if config.WriteBatchSize < 0 {
+		findings = append(findings, conf.NewError("cassandra.write-batch-size", "must be 0 or more"))
+	}
+	if config.WriteBatchSize > 1 && config.WriteBatchInterval <= 0 {
+		findings = append(findings, conf.NewError("cassandra.write-batch-interval", "must be more than 0 when batching is enabled"))
+	}
+	if config.WriteBatchSize > 1 && config.WriteBatchMaxKB <= 0 {
+		findings = append(findings, conf.NewError("cassandra.write-batch-max-kb", "must be more than 0 when batching is enabled"))
+	}
+	if config.SpillDir != "" {
+		if config.SpillSegmentSize <= 0 {
+			findings = append(findings, conf.NewError("cassandra.spill-segment-size", "must be more than 0 when spilling is enabled"))
+		}
+		if config.SpillMaxSize < 2*config.SpillSegmentSize {
+			findings = append(findings, conf.NewError("cassandra.spill-max-size", "must be at least twice the spill-segment-size"))
+		}
+	}
+	return findings
+}
@@ -0,0 +1,126 @@
+package cassandra
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+)
+
+func TestValidateSchemas(t *testing.T) {
+	good := conf.Schema{
+		Name: "good",
+		Retentions: conf.Retentions{
+			conf.NewRetentionMT(10, 3600*24, 3600, 2, true),
+			conf.NewRetentionMT(600, 3600*24*60, 6*3600, 2, true),
+		},
+	}
+	if findings := ValidateSchemas([]conf.Schema{good}, 20); len(findings) != 0 {
+		t.Fatalf("expected no findings for valid schema, got %v", findings)
+	}
+
+	bad := conf.Schema{
+		Name: "bad",
+		Retentions: conf.Retentions{
+			// 5h does not divide the 28 day row width
+			conf.NewRetentionMT(1, 3600*24, 5*3600, 2, true),
+			// 7 does not divide 6h
+			conf.NewRetentionMT(7, 3600*24*60, 6*3600, 2, true),
+		},
+	}
+	findings := ValidateSchemas([]conf.Schema{bad}, 20)
+	var errs []string
+	for _, f := range findings {
+		if f.Error {
+			errs = append(errs, f.Msg)
+		}
+	}
+	if len(errs) != 2 || !strings.Contains(errs[0], "row width") || !strings.Contains(errs[1], "not a multiple of the interval") {
+		t.Fatalf("expected row width and interval errors, got %v", findings)
+	}
+
+	// 1d and 30h both end up in the metric_16 table
+	other := conf.Schema{
+		Name:       "other",
+		Retentions: conf.Retentions{conf.NewRetentionMT(10, 30*3600, 3600, 2, true)},
+	}
+	findings = ValidateSchemas([]conf.Schema{good, other}, 20)
+	if len(findings) != 1 || findings[0].Error || !strings.Contains(findings[0].Msg, "shares table metric_16") {
+		t.Fatalf("expected a warning about the shared table, got %v", findings)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := NewStoreConfig()
+	if findings := ValidateConfig(config); len(findings) != 0 {
+		t.Fatalf("expected no findings for the default config, got %v", findings)
+	}
+	config.WriteBatchSize = 100
+	config.WriteBatchInterval = 0
+	findings := ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.write-batch-interval" {
+		t.Fatalf("expected a write-batch-interval error, got %v", findings)
+	}
+
+	config = NewStoreConfig()
+	config.WriteConsistency = "quorum"
+	config.ReadConsistency = "uno"
+	findings = ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.read-consistency" {
+		t.Fatalf("expected a read-consistency error, got %v", findings)
+	}
+	config.ReadConsistency = ""
+	if read, write := config.consistencies(); read != "one" || write != "quorum" {
+		t.Fatalf("expected reads at one and writes at quorum, got %s and %s", read, write)
+	}
+
+	config = NewStoreConfig()
+	config.MaxParallelRowReads = -1
+	findings = ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.max-parallel-row-reads" {
+		t.Fatalf("expected a max-parallel-row-reads error, got %v", findings)
+	}
+
+	config = NewStoreConfig()
+	config.SessionMode = "shard-aware"
+	findings = ValidateConfig(config)
+	if shardAwareSupported && len(findings) != 0 {
+		t.Fatalf("expected no findings for shard-aware with a tokenaware policy, got %v", findings)
+	}
+	if !shardAwareSupported && (len(findings) != 1 || findings[0].Subject != "cassandra.session-mode") {
+		t.Fatalf("expected a session-mode error for shard-aware without the scylla build tag, got %v", findings)
+	}
+	config.HostSelectionPolicy = "roundrobin"
+	findings = ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.session-mode" {
+		t.Fatalf("expected a session-mode error, got %v", findings)
+	}
+
+	config = NewStoreConfig()
+	config.SessionMode = "fast"
+	findings = ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.session-mode" {
+		t.Fatalf("expected a session-mode error, got %v", findings)
+	}
+
+	config = NewStoreConfig()
+	config.ReadQueues = "metric_1024:5:10000:120,metric_1024:1:1:1"
+	findings = ValidateConfig(config)
+	if len(findings) != 1 || findings[0].Subject != "cassandra.read-queues" {
+		t.Fatalf("expected a read-queues error, got %v", findings)
+	}
+}
+
+func TestParseReadQueues(t *testing.T) {
+	queues, err := parseReadQueues(" metric_1024:5:10000:120, metric_2048:1:100:300")
+	exp := []readQueueConfig{{"metric_1024", 5, 10000, 120}, {"metric_2048", 1, 100, 300}}
+	if err != nil || !reflect.DeepEqual(queues, exp) {
+		t.Fatalf("expected %v, got %v, %v", exp, queues, err)
+	}
+	for _, bad := range []string{"metric_1024", "metric_1024:5:10000", ":5:10000:120", "metric_1024:0:10000:120", "metric_1024:5:lots:120"} {
+		if _, err := parseReadQueues(bad); err == nil {
+			t.Fatalf("expected an error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package s3
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/grafana/metrictank/mdata/chunk"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// a block holds the chunks of one series that have a t0 within the same block-span.
+// it's stored as a single object: a format byte, followed by each chunk in order of t0,
+// as its t0, span and length (big endian uint32's) followed by the chunk data.
+// blocks of orgs with encryption enabled are stored as the blockFormatEncrypted byte, followed by the
+// encryption envelope of the block.
+// blocks that have chunks that are not float encoded use blockFormatV2, where the header of each chunk
+// is followed by the encoding byte.
+
+const (
+	blockFormatV1        = 1
+	blockFormatEncrypted = 2
+	blockFormatV2        = 3
+	// size of the t0, span and length that precede each chunk
+	chunkHeaderSize = 12
+)
+
+var errCorruptBlock = errors.New("corrupt block")
+
+// objectName returns the name of the object holding the block of the series that starts at blockStart.
+// the ttl comes first, so that expiry can be set up per ttl, with lifecycle rules on the prefix
+func objectName(prefix string, key schema.AMKey, ttl, blockStart uint32) string {
+	return fmt.Sprintf("%sttl_%d/%s/%010d", prefix, ttl, key, blockStart)
+}
+
+// markerName returns the name of the object that records until when the given instance moved all blocks
+func markerName(prefix, instance string) string {
+	return fmt.Sprintf("%smarkers/%s", prefix, instance)
+}
+
+// blockStart returns the start of the block that ts falls in
+func blockStart(ts, blockSpan uint32) uint32 {
+	return ts - ts%blockSpan
+}
+
+func encodeBlock(itgens []chunk.IterGen) []byte {
+	format := byte(blockFormatV1)
+	headerSize := chunkHeaderSize
+	for _, itgen := range itgens {
+		if itgen.Encoding != chunk.EncodingFloat {
+			// only use the new format when needed, so that blocks stay readable by older versions
+			format = blockFormatV2
+			headerSize = chunkHeaderSize + 1
+			break
+		}
+	}
+	size := 1
+	for _, itgen := range itgens {
+		size += headerSize + len(itgen.B)
+	}
+	buf := make([]byte, 1, size)
+	buf[0] = format
+	header := make([]byte, headerSize)
+	for _, itgen := range itgens {
+		binary.BigEndian.PutUint32(header[0:4], itgen.Ts)
+		binary.BigEndian.PutUint32(header[4:8], itgen.Span)
+		binary.BigEndian.PutUint32(header[8:12], uint32(len(itgen.B)))
+		if format == blockFormatV2 {
+			header[12] = byte(itgen.Encoding)
+		}
+		buf = append(buf, header...)
+		buf = append(buf, itgen.B...)
+	}
+	return buf
+}
+
+func decodeBlock(data []byte) ([]chunk.IterGen, error) {
+	if len(data) == 0 {
+		return nil, errCorruptBlock
+	}
+	headerSize := chunkHeaderSize
+	switch data[0] {
+	case blockFormatV1:
+	case blockFormatV2:
+		headerSize = chunkHeaderSize + 1
+	default:
+		return nil, fmt.Errorf("unknown block format %d", data[0])
+	}
+	var itgens []chunk.IterGen
+	data = data[1:]
+	for len(data) > 0 {
+		if len(data) < headerSize {
+			return nil, errCorruptBlock
+		}
+		t0 := binary.BigEndian.Uint32(data[0:4])
+		span := binary.BigEndian.Uint32(data[4:8])
+		size := binary.BigEndian.Uint32(data[8:12])
+		itgen := chunk.NewBareIterGen(nil, t0, span)
+		if headerSize > chunkHeaderSize {
+			itgen.Encoding = chunk.Encoding(data[12])
+		}
+		data = data[headerSize:]
+		if uint32(len(data)) < size {
+			return nil, errCorruptBlock
+		}
+		itgen.B = data[:size]
+		itgens = append(itgens, *itgen)
+		data = data[size:]
+	}
+	return itgens, nil
+}
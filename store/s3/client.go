@@ -0,0 +1,184 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/grafana/metrictank/secrets"
+)
+
+var errNotFound = errors.New("object not found")
+
+// client does the few operations we need on objects of an S3 compatible service.
+// requests are signed with AWS signature version 4, unless no credentials are set.
+type client struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	pathStyle bool
+	accessKey *secrets.Secret // nil for unsigned requests
+	secretKey *secrets.Secret
+	http      *http.Client
+}
+
+func newClient(config *StoreConfig, timeout time.Duration) (*client, error) {
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	c := &client{
+		endpoint:  endpoint,
+		region:    config.Region,
+		bucket:    config.Bucket,
+		pathStyle: config.PathStyle,
+		http:      &http.Client{Timeout: timeout},
+	}
+	if config.AccessKey != "" {
+		c.accessKey, err = secrets.New(config.AccessKey)
+		if err != nil {
+			return nil, err
+		}
+		c.secretKey, err = secrets.New(config.SecretKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// url returns the url of the object with the given name
+func (c *client) url(name string) string {
+	host := c.endpoint.Host
+	path := "/" + name
+	if c.pathStyle {
+		path = "/" + c.bucket + path
+	} else {
+		host = c.bucket + "." + host
+	}
+	return c.endpoint.Scheme + "://" + host + uriEncode(path)
+}
+
+func (c *client) put(ctx context.Context, name string, data []byte) error {
+	resp, err := c.do(ctx, "PUT", name, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 returned %s for PUT of %s", resp.Status, name)
+	}
+	return nil
+}
+
+// get returns the contents of the object, or errNotFound if it doesn't exist
+func (c *client) get(ctx context.Context, name string) ([]byte, error) {
+	resp, err := c.do(ctx, "GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return body, nil
+	case http.StatusNotFound:
+		return nil, errNotFound
+	}
+	return nil, fmt.Errorf("s3 returned %s for GET of %s", resp.Status, name)
+}
+
+func (c *client) do(ctx context.Context, method, name string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.url(name), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.accessKey != nil {
+		sign(req, data, c.accessKey.Get(), c.secretKey.Get(), c.region, time.Now())
+	}
+	return c.http.Do(req)
+}
+
+// sign adds the headers of AWS signature version 4 to the request, signing the host and all headers that are set.
+// see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func sign(req *http.Request, payload []byte, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes all characters of the path, except the unreserved ones and the slashes, as signature version 4 requires
+func uriEncode(path string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(path); i++ {
+		b := path[i]
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') || b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
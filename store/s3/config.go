@@ -0,0 +1,81 @@
+package s3
+
+import (
+	"flag"
+
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+type StoreConfig struct {
+	Enabled         bool
+	Endpoint        string
+	Region          string
+	Bucket          string
+	Prefix          string
+	PathStyle       bool
+	AccessKey       string
+	SecretKey       string
+	HotTTL          string
+	MinAge          string
+	BlockSpan       string
+	MoveInterval    string
+	MoveConcurrency int
+	ReadConcurrency int
+	Timeout         string
+}
+
+// return StoreConfig with default values set.
+func NewStoreConfig() *StoreConfig {
+	return &StoreConfig{
+		Enabled:         false,
+		Endpoint:        "https://s3.amazonaws.com",
+		Region:          "us-east-1",
+		Bucket:          "metrictank",
+		Prefix:          "chunks/",
+		PathStyle:       true,
+		AccessKey:       "",
+		SecretKey:       "",
+		HotTTL:          "30d",
+		MinAge:          "7d",
+		BlockSpan:       "7d",
+		MoveInterval:    "1h",
+		MoveConcurrency: 10,
+		ReadConcurrency: 20,
+		Timeout:         "30s",
+	}
+}
+
+var CliConfig = NewStoreConfig()
+
+func ConfigSetup() *flag.FlagSet {
+	s3Store := flag.NewFlagSet("s3-store", flag.ExitOnError)
+	s3Store.BoolVar(&CliConfig.Enabled, "enabled", CliConfig.Enabled, "enable the cold store, which keeps chunks older than min-age in S3 compatible object storage. the cassandra or bigtable store only keeps them for hot-ttl")
+	s3Store.StringVar(&CliConfig.Endpoint, "endpoint", CliConfig.Endpoint, "url of the S3 compatible service")
+	s3Store.StringVar(&CliConfig.Region, "region", CliConfig.Region, "region of the bucket, used for signing requests")
+	s3Store.StringVar(&CliConfig.Bucket, "bucket", CliConfig.Bucket, "bucket to store the blocks of chunks in")
+	s3Store.StringVar(&CliConfig.Prefix, "prefix", CliConfig.Prefix, "prefix of the names of all objects metrictank writes")
+	s3Store.BoolVar(&CliConfig.PathStyle, "path-style", CliConfig.PathStyle, "put the bucket in the path of the url instead of in the hostname. needed for most S3 compatible services other than AWS")
+	s3Store.StringVar(&CliConfig.AccessKey, "access-key", CliConfig.AccessKey, "access key id. may be an env:, file: or vault: reference, see the secrets section. leave empty, along with secret-key, for unsigned requests")
+	s3Store.StringVar(&CliConfig.SecretKey, "secret-key", CliConfig.SecretKey, "secret access key. may be an env:, file: or vault: reference, see the secrets section")
+	s3Store.StringVar(&CliConfig.HotTTL, "hot-ttl", CliConfig.HotTTL, "how long the chunks of retentions with a longer ttl are kept in the cassandra or bigtable store. must be longer than min-age + block-span")
+	s3Store.StringVar(&CliConfig.MinAge, "min-age", CliConfig.MinAge, "blocks are moved to the cold store once their data is older than this. should be at least twice the largest chunkspan, so that all their chunks have been saved")
+	s3Store.StringVar(&CliConfig.BlockSpan, "block-span", CliConfig.BlockSpan, "timespan of the chunks of a series that are stored together in one object")
+	s3Store.StringVar(&CliConfig.MoveInterval, "move-interval", CliConfig.MoveInterval, "how often primaries check for blocks to move to the cold store")
+	s3Store.IntVar(&CliConfig.MoveConcurrency, "move-concurrency", CliConfig.MoveConcurrency, "number of series that are moved concurrently")
+	s3Store.IntVar(&CliConfig.ReadConcurrency, "read-concurrency", CliConfig.ReadConcurrency, "number of objects that can be read concurrently")
+	s3Store.StringVar(&CliConfig.Timeout, "timeout", CliConfig.Timeout, "timeout of requests to the S3 compatible service")
+	globalconf.Register("s3-store", s3Store)
+	return s3Store
+}
+
+func ConfigProcess() {
+	if !CliConfig.Enabled {
+		return
+	}
+	for _, f := range ValidateConfig(CliConfig) {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package s3
+
+import (
+	"time"
+
+	"github.com/grafana/metrictank/health"
+)
+
+// requests to the cold store that fail more often than this, within the window, degrade the health of the store
+const healthErrRatio = 0.05
+
+type storeHealth struct {
+	Hot      health.Status `json:"hot"`
+	Requests uint32        `json:"requests"` // requests to the cold store in the last minute
+	Errors   uint32        `json:"errors"`   // failed requests to the cold store in the last minute
+	Updated  time.Time     `json:"updated"`
+}
+
+// Health reports the health of the hot store, and the error rate of recent requests to the cold store
+func (s *Store) Health() health.Status {
+	now := time.Now()
+	hot := s.hot.Health()
+	detail := storeHealth{
+		Hot:     hot,
+		Updated: now,
+	}
+	status := health.Status{State: hot.State}
+	if hot.Message != "" {
+		status.Message = "hot store: " + hot.Message
+	}
+
+	detail.Requests, detail.Errors = s.errWindow.Get(now)
+	if detail.Requests > 0 {
+		ratio := float64(detail.Errors) / float64(detail.Requests)
+		if detail.Errors == detail.Requests {
+			status.Worsen(health.Failed, "all %d requests to the cold store in the last minute failed", detail.Requests)
+		} else if ratio > healthErrRatio {
+			status.Worsen(health.Degraded, "%.1f%% of requests to the cold store in the last minute failed", ratio*100)
+		}
+	}
+	status.Detail = detail
+	return status
+}
+
+// Queues reports the queues of the hot store, if it has any, and how many of the allowed concurrent reads
+// from the cold store are in flight
+func (s *Store) Queues() []health.Queue {
+	var queues []health.Queue
+	if r, ok := s.hot.(health.QueueReporter); ok {
+		for _, q := range r.Queues() {
+			q.Name = "hot." + q.Name
+			queues = append(queues, q)
+		}
+	}
+	return append(queues, health.Queue{Name: "cold.read", Kind: "read", Depth: len(s.readLimiter), Size: cap(s.readLimiter)})
+}
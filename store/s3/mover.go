@@ -0,0 +1,214 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	opentracing "github.com/opentracing/opentracing-go"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric store.s3.move.blocks is how many blocks were moved to the cold store
+	movedBlocks = stats.NewCounter32("store.s3.move.blocks")
+	// metric store.s3.move.chunks is how many chunks were moved to the cold store
+	movedChunks = stats.NewCounter32("store.s3.move.chunks")
+	// metric store.s3.move.errors is how many series could not be moved, because reading from the hot store or writing to the cold store failed
+	moveErrors = stats.NewCounter32("store.s3.move.errors")
+	// metric store.s3.move.until is the time until which all blocks of this instance have been moved
+	movedUntil = stats.NewGauge32("store.s3.move.until")
+)
+
+// Mover copies the blocks of the series in the index from the hot store to the cold store, once they're older than min-age
+type Mover struct {
+	store    *Store
+	index    idx.MetricIndex
+	instance string
+}
+
+func NewMover(store *Store, index idx.MetricIndex, instance string) *Mover {
+	return &Mover{
+		store:    store,
+		index:    index,
+		instance: instance,
+	}
+}
+
+// Run moves the blocks that have become old enough every move-interval, if we're a primary.
+// like saving chunks, moving blocks is up to the primaries. as the blocks are the same for every replica,
+// moving them more than once is harmless.
+func (m *Mover) Run() {
+	interval := dur.MustParseNDuration("move-interval", m.store.config.MoveInterval)
+	for range time.Tick(time.Duration(interval) * time.Second) {
+		if !cluster.Manager.IsPrimary() {
+			continue
+		}
+		// the stores trace their requests as children of the span in the context
+		span := m.store.tracer.StartSpan("S3Store.Move")
+		ctx := opentracing.ContextWithSpan(context.Background(), span)
+		if err := m.Move(ctx, m.store.now()); err != nil {
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			log.Error(3, "s3_store: %s", err)
+		}
+		span.Finish()
+	}
+}
+
+type target struct {
+	key schema.AMKey
+	ttl uint32
+}
+
+// Move copies the blocks that ended between the last move and min-age ago from the hot store to the cold store.
+// how far we got is recorded in a marker object per instance, so that blocks are retried until all series
+// could be moved. without a marker, we start at the oldest block that is complete in the hot store.
+func (m *Mover) Move(ctx context.Context, now time.Time) error {
+	s := m.store
+	ts := uint32(now.Unix())
+	if ts < s.hotTTL {
+		return nil
+	}
+	until := blockStart(ts-s.minAge, s.blockSpan)
+	oldest := blockStart(ts-s.hotTTL, s.blockSpan) + s.blockSpan
+
+	from, err := m.readMarker(ctx)
+	if err != nil {
+		return fmt.Errorf("could not read the marker of %s: %s", m.instance, err)
+	}
+	if from != 0 && from < oldest {
+		log.Warn("s3_store: blocks from %d until %d have expired from the hot store before they could be moved", from, oldest)
+	}
+	if from < oldest {
+		from = oldest
+	}
+	if from >= until {
+		return nil
+	}
+
+	targets := m.targets()
+	log.Info("s3_store: moving blocks from %d until %d of %d series", from, until, len(targets))
+	pre := time.Now()
+	blocks, chunks, failed := m.moveAll(ctx, targets, from, until)
+	log.Info("s3_store: moved %d blocks with %d chunks in %s. %d of %d series failed", blocks, chunks, time.Since(pre), failed, len(targets))
+	if failed > 0 {
+		return fmt.Errorf("%d of %d series could not be moved. retrying at the next move-interval", failed, len(targets))
+	}
+	if err := m.writeMarker(ctx, until); err != nil {
+		return fmt.Errorf("could not write the marker of %s: %s", m.instance, err)
+	}
+	movedUntil.SetUint32(until)
+	return nil
+}
+
+// targets returns the archives of all series in the index whose chunks outlive the hot store
+func (m *Mover) targets() []target {
+	var targets []target
+	m.index.Count(func(a idx.Archive) bool {
+		for i, ret := range mdata.GetSchema(a.SchemaId).Retentions {
+			ttl := uint32(ret.MaxRetention())
+			if !m.store.cold(ttl) {
+				continue
+			}
+			if i == 0 {
+				targets = append(targets, target{schema.AMKey{MKey: a.Id}, ttl})
+				continue
+			}
+			for _, method := range mdata.RollupMethods(mdata.GetAgg(a.AggId)) {
+				key := schema.AMKey{MKey: a.Id, Archive: schema.NewArchive(method, uint32(ret.SecondsPerPoint))}
+				targets = append(targets, target{key, ttl})
+			}
+		}
+		return false
+	})
+	return targets
+}
+
+// moveAll moves the blocks of the targets between from and until, move-concurrency targets at a time.
+// it returns how many blocks and chunks were moved, and for how many targets that failed
+func (m *Mover) moveAll(ctx context.Context, targets []target, from, until uint32) (int, int, int) {
+	var blocks, chunks, failed int64
+	todo := make(chan target)
+	var wg sync.WaitGroup
+	for i := 0; i < m.store.config.MoveConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range todo {
+				b, c, err := m.moveSeries(ctx, t, from, until)
+				atomic.AddInt64(&blocks, int64(b))
+				atomic.AddInt64(&chunks, int64(c))
+				movedBlocks.Add(b)
+				movedChunks.Add(c)
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					moveErrors.Inc()
+					log.Warn("s3_store: could not move blocks of %s: %s", t.key, err)
+				}
+			}
+		}()
+	}
+	for _, t := range targets {
+		todo <- t
+	}
+	close(todo)
+	wg.Wait()
+	return int(blocks), int(chunks), int(failed)
+}
+
+// moveSeries copies the blocks of the series between from and until to the cold store.
+// blocks without chunks are not written. it returns how many blocks and chunks were moved
+func (m *Mover) moveSeries(ctx context.Context, t target, from, until uint32) (int, int, error) {
+	s := m.store
+	var blocks, chunks int
+	for start := from; start < until; start += s.blockSpan {
+		itgens, err := s.hot.Search(ctx, t.key, s.hotTTL, start, start+s.blockSpan)
+		if err != nil {
+			return blocks, chunks, err
+		}
+		// the search includes the chunk that covers start, which belongs to the previous block
+		for len(itgens) > 0 && itgens[0].Ts < start {
+			itgens = itgens[1:]
+		}
+		if len(itgens) == 0 {
+			continue
+		}
+		if err := s.putBlock(ctx, t.key, t.ttl, start, itgens); err != nil {
+			return blocks, chunks, err
+		}
+		blocks++
+		chunks += len(itgens)
+	}
+	return blocks, chunks, nil
+}
+
+// readMarker returns until when all blocks of our instance have been moved, or 0 if we haven't moved any
+func (m *Mover) readMarker(ctx context.Context) (uint32, error) {
+	data, err := m.store.client.get(ctx, markerName(m.store.config.Prefix, m.instance))
+	if err == errNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	until, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid marker %q", data)
+	}
+	return uint32(until), nil
+}
+
+func (m *Mover) writeMarker(ctx context.Context, until uint32) error {
+	return m.store.client.put(ctx, markerName(m.store.config.Prefix, m.instance), []byte(strconv.FormatUint(uint64(until), 10)))
+}
@@ -0,0 +1,345 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/encryption"
+	"github.com/grafana/metrictank/health"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/stats"
+	"github.com/grafana/metrictank/tracing"
+	"github.com/grafana/metrictank/util"
+	opentracing "github.com/opentracing/opentracing-go"
+	tags "github.com/opentracing/opentracing-go/ext"
+	"github.com/raintank/dur"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// the s3 store is a cold tier in front of the cassandra or bigtable store, the hot store.
+//
+// chunks are always written to the hot store. for retentions with a ttl longer than hot-ttl,
+// the hot store keeps them for hot-ttl only, and the mover copies them to S3 compatible object storage
+// once they're older than min-age, in blocks that hold all chunks of a series within a block-span.
+// reads get the old part of the requested range from the cold store and the recent part from the hot store.
+
+var (
+	LogLevel util.LogLevel
+
+	// metric store.s3.get.exec is the duration of getting a block from the cold store
+	getExecDuration = stats.NewLatencyHistogram15s32("store.s3.get.exec")
+	// metric store.s3.get.wait is the duration of a get spent waiting for a free read slot
+	getWaitDuration = stats.NewLatencyHistogram12h32("store.s3.get.wait")
+	// metric store.s3.put.exec is the duration of putting a block in the cold store
+	putExecDuration = stats.NewLatencyHistogram15s32("store.s3.put.exec")
+	// metric store.s3.blocks_per_response is how many blocks are retrieved per search
+	blocksPerResponse = stats.NewMeter32("store.s3.blocks_per_response", false)
+	// metric store.s3.block_size.at_save is the sizes of blocks seen when saving them
+	blockSizeAtSave = stats.NewMeter32("store.s3.block_size.at_save", true)
+	// metric store.s3.block_size.at_load is the sizes of blocks seen when loading them
+	blockSizeAtLoad = stats.NewMeter32("store.s3.block_size.at_load", true)
+)
+
+// HotStore is the store that chunks are written to, and that serves the data that is not in the cold store yet
+type HotStore interface {
+	mdata.Store
+	health.Reporter
+	EnsureTTLs(ttls []uint32) error
+}
+
+type Store struct {
+	hot          HotStore
+	client       *client
+	config       *StoreConfig
+	hotTTL       uint32
+	minAge       uint32
+	blockSpan    uint32
+	readLimiter  chan struct{}
+	errWindow    health.ErrWindow // recent requests to the cold store and errors, for health reporting
+	maxChunkSpan func() uint32    // how far reads look back for the chunk that covers the start of the requested range
+	now          func() time.Time // for unit tests
+	tracer       opentracing.Tracer
+}
+
+// NewStore returns a store that moves old chunks from the given hot store to the cold store.
+// the hot store must have been created with the ttls returned by HotTTLs
+func NewStore(config *StoreConfig, hot HotStore) (*Store, error) {
+	if findings := ValidateConfig(config); len(findings) > 0 {
+		return nil, fmt.Errorf("%s: %s", findings[0].Subject, findings[0].Msg)
+	}
+	timeout := dur.MustParseNDuration("timeout", config.Timeout)
+	c, err := newClient(config, time.Duration(timeout)*time.Second)
+	if err != nil {
+		log.Error(3, "s3_store: failed to create client. %s", err)
+		return nil, err
+	}
+	return &Store{
+		hot:          hot,
+		client:       c,
+		config:       config,
+		hotTTL:       dur.MustParseNDuration("hot-ttl", config.HotTTL),
+		minAge:       dur.MustParseNDuration("min-age", config.MinAge),
+		blockSpan:    dur.MustParseNDuration("block-span", config.BlockSpan),
+		readLimiter:  make(chan struct{}, config.ReadConcurrency),
+		maxChunkSpan: mdata.MaxChunkSpan,
+		now:          time.Now,
+		tracer:       opentracing.NoopTracer{},
+	}, nil
+}
+
+// HotTTLs returns the ttls that the hot store uses for the given ones
+func HotTTLs(config *StoreConfig, ttls []uint32) []uint32 {
+	hotTTL := dur.MustParseNDuration("hot-ttl", config.HotTTL)
+	seen := make(map[uint32]bool)
+	var out []uint32
+	for _, ttl := range ttls {
+		if ttl > hotTTL {
+			ttl = hotTTL
+		}
+		if !seen[ttl] {
+			seen[ttl] = true
+			out = append(out, ttl)
+		}
+	}
+	return out
+}
+
+// cold returns whether chunks with the given ttl outlive the hot store, and are moved to the cold store
+func (s *Store) cold(ttl uint32) bool {
+	return ttl > s.hotTTL
+}
+
+func (s *Store) SetTracer(t opentracing.Tracer) {
+	s.tracer = t
+	s.hot.SetTracer(t)
+}
+
+// Add saves the chunk to the hot store. chunks that will be moved to the cold store are only kept there for hot-ttl
+func (s *Store) Add(cwr *mdata.ChunkWriteRequest) {
+	if s.cold(cwr.TTL) {
+		capped := *cwr
+		capped.TTL = s.hotTTL
+		cwr = &capped
+	}
+	s.hot.Add(cwr)
+}
+
+// EnsureTTLs makes sure the hot store can save and read data with the given TTLs
+func (s *Store) EnsureTTLs(ttls []uint32) error {
+	return s.hot.EnsureTTLs(HotTTLs(s.config, ttls))
+}
+
+// Drain waits until the hot store has saved all chunks that were added, or until the timeout expires.
+// it returns the number of chunks that were not saved.
+func (s *Store) Drain(timeout time.Duration) int {
+	if d, ok := s.hot.(interface{ Drain(time.Duration) int }); ok {
+		return d.Drain(timeout)
+	}
+	return 0
+}
+
+// Search returns the chunks of the series from the cold store for the part of the range older than min-age,
+// and from the hot store for the part of the range newer than hot-ttl. they overlap, so that the blocks
+// of a series are found in either store while the mover copies them.
+// start inclusive, end exclusive
+func (s *Store) Search(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	if !s.cold(ttl) {
+		return s.hot.Search(ctx, key, ttl, start, end)
+	}
+	ctx, span := tracing.NewSpan(ctx, s.tracer, "S3Store.Search")
+	defer span.Finish()
+
+	now := uint32(s.now().Unix())
+	var coldEnd, hotStart uint32
+	if now > s.minAge {
+		coldEnd = now - s.minAge
+	}
+	if now > s.hotTTL {
+		hotStart = now - s.hotTTL
+	}
+
+	var cold, hot []chunk.IterGen
+	var err error
+	if start < coldEnd {
+		to := end
+		if to > coldEnd {
+			to = coldEnd
+		}
+		cold, err = s.searchCold(ctx, key, ttl, start, to)
+		if err != nil && ctx.Err() != nil {
+			// query was aborted.
+			return nil, nil
+		}
+		if err != nil {
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			return nil, err
+		}
+	}
+	if end > hotStart {
+		from := start
+		if from < hotStart {
+			from = hotStart
+		}
+		hot, err = s.hot.Search(ctx, key, s.hotTTL, from, end)
+		if err != nil {
+			tracing.Failure(span)
+			tracing.Error(span, err)
+			return nil, err
+		}
+	}
+	itgens := merge(cold, hot, start, end)
+	span.SetTag("itgens", len(itgens))
+	return itgens, nil
+}
+
+// searchCold returns the chunks in the cold store with a t0 before end, and the last one with a t0 at or before start
+func (s *Store) searchCold(ctx context.Context, key schema.AMKey, ttl, start, end uint32) ([]chunk.IterGen, error) {
+	_, span := tracing.NewSpan(ctx, s.tracer, "S3Store.searchCold")
+	defer span.Finish()
+	tags.SpanKindRPCClient.Set(span)
+	tags.PeerService.Set(span, "s3")
+
+	// the chunk that covers start may be in an earlier block
+	from := uint32(0)
+	if maxChunkSpan := s.maxChunkSpan(); start > maxChunkSpan {
+		from = start - maxChunkSpan
+	}
+	var blocks []uint32
+	for b := blockStart(from, s.blockSpan); b < end; b += s.blockSpan {
+		blocks = append(blocks, b)
+	}
+
+	results := make([][]chunk.IterGen, len(blocks))
+	errs := make([]error, len(blocks))
+	var wg sync.WaitGroup
+	for i, b := range blocks {
+		wg.Add(1)
+		go func(i int, b uint32) {
+			defer wg.Done()
+			results[i], errs[i] = s.getBlock(ctx, key.MKey.Org, objectName(s.config.Prefix, key, ttl, b))
+		}(i, b)
+	}
+	wg.Wait()
+
+	var itgens []chunk.IterGen
+	var found int
+	for i := range blocks {
+		if errs[i] == errNotFound {
+			continue
+		}
+		if errs[i] != nil {
+			tracing.Failure(span)
+			tracing.Error(span, errs[i])
+			return nil, errs[i]
+		}
+		found++
+		itgens = append(itgens, results[i]...)
+	}
+	blocksPerResponse.Value(found)
+	span.SetTag("blocks", found)
+	return itgens, nil
+}
+
+func (s *Store) getBlock(ctx context.Context, orgId uint32, name string) ([]chunk.IterGen, error) {
+	pre := time.Now()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case s.readLimiter <- struct{}{}:
+	}
+	defer func() { <-s.readLimiter }()
+	getWaitDuration.Value(time.Since(pre))
+
+	pre = time.Now()
+	data, err := s.client.get(ctx, name)
+	getExecDuration.Value(time.Since(pre))
+	if ctx.Err() != nil {
+		// query was aborted
+		return nil, ctx.Err()
+	}
+	if err == errNotFound {
+		s.errWindow.Add(time.Now(), nil)
+		return nil, err
+	}
+	s.errWindow.Add(time.Now(), err)
+	if err != nil {
+		return nil, err
+	}
+	blockSizeAtLoad.Value(len(data))
+	data, err = encryption.Unwrap(orgId, blockFormatEncrypted, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	itgens, err := decodeBlock(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return itgens, nil
+}
+
+// putBlock saves the chunks as the given block
+func (s *Store) putBlock(ctx context.Context, key schema.AMKey, ttl, start uint32, itgens []chunk.IterGen) error {
+	data, err := encryption.Wrap(key.MKey.Org, blockFormatEncrypted, encodeBlock(itgens))
+	if err != nil {
+		return err
+	}
+	blockSizeAtSave.Value(len(data))
+	pre := time.Now()
+	err = s.client.put(ctx, objectName(s.config.Prefix, key, ttl, start), data)
+	putExecDuration.Value(time.Since(pre))
+	s.errWindow.Add(time.Now(), err)
+	if err == nil && LogLevel.Get() < 2 {
+		log.Debug("S3: saved block %s %d with %d chunks", key, start, len(itgens))
+	}
+	return err
+}
+
+func (s *Store) Stop() {
+	s.hot.Stop()
+}
+
+type byT0 []chunk.IterGen
+
+func (b byT0) Len() int           { return len(b) }
+func (b byT0) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byT0) Less(i, j int) bool { return b[i].Ts < b[j].Ts }
+
+// merge combines the chunks from the cold and the hot store into what a search of a single store returns:
+// the chunks with a t0 before end, starting with the last one with a t0 at or before start.
+// chunks that are in both stores are taken from the hot store.
+func merge(cold, hot []chunk.IterGen, start, end uint32) []chunk.IterGen {
+	seen := make(map[uint32]bool, len(hot))
+	all := make([]chunk.IterGen, 0, len(cold)+len(hot))
+	for _, itgen := range hot {
+		seen[itgen.Ts] = true
+		all = append(all, itgen)
+	}
+	for _, itgen := range cold {
+		if !seen[itgen.Ts] {
+			seen[itgen.Ts] = true
+			all = append(all, itgen)
+		}
+	}
+	sort.Sort(byT0(all))
+
+	first := 0
+	for i, itgen := range all {
+		if itgen.Ts <= start {
+			first = i
+		}
+	}
+	out := make([]chunk.IterGen, 0, len(all)-first)
+	for _, itgen := range all[first:] {
+		if itgen.Ts >= end {
+			break
+		}
+		out = append(out, itgen)
+	}
+	return out
+}
@@ -0,0 +1,228 @@
+package s3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/health"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+// fakeS3 keeps objects in memory
+type fakeS3 struct {
+	*httptest.Server
+	sync.Mutex
+	objects  map[string][]byte
+	lastAuth string
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{objects: make(map[string][]byte)}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.Lock()
+		defer f.Unlock()
+		f.lastAuth = r.Header.Get("Authorization")
+		switch r.Method {
+		case "PUT":
+			data, _ := ioutil.ReadAll(r.Body)
+			f.objects[r.URL.Path] = data
+		case "GET":
+			data, ok := f.objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	return f
+}
+
+func (f *fakeS3) config() *StoreConfig {
+	config := NewStoreConfig()
+	config.Endpoint = f.URL
+	config.AccessKey = "access"
+	config.SecretKey = "secret"
+	config.HotTTL = "5000"
+	config.MinAge = "2000"
+	config.BlockSpan = "1000"
+	return config
+}
+
+func (f *fakeS3) client(t *testing.T) *client {
+	c, err := newClient(f.config(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+type mockHotStore struct {
+	*mdata.MockStore
+}
+
+func (m mockHotStore) Health() health.Status {
+	return health.Status{State: health.OK}
+}
+
+func (m mockHotStore) EnsureTTLs(ttls []uint32) error {
+	return nil
+}
+
+func newTestStore(t *testing.T, f *fakeS3, hot *mdata.MockStore, now uint32) *Store {
+	s, err := NewStore(f.config(), mockHotStore{hot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.maxChunkSpan = func() uint32 { return 100 }
+	s.now = func() time.Time { return time.Unix(int64(now), 0) }
+	return s
+}
+
+// addChunks adds chunks with a span of 100 and a point every 10s, from t0 from until to, to the store
+func addChunks(t *testing.T, store mdata.Store, key schema.AMKey, from, to uint32) {
+	for t0 := from; t0 < to; t0 += 100 {
+		c := chunk.New(t0)
+		for ts := t0; ts < t0+100; ts += 10 {
+			if err := c.Push(ts, float64(ts)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		c.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, key, c, 100000, 100, time.Now())
+		store.Add(&cwr)
+	}
+}
+
+func TestBlock(t *testing.T) {
+	itgens := []chunk.IterGen{
+		*chunk.NewBareIterGen([]byte{1, 2, 3}, 1000, 100),
+		*chunk.NewBareIterGen([]byte{}, 1100, 100),
+		*chunk.NewBareIterGen([]byte{4}, 1200, 0),
+	}
+	data := encodeBlock(itgens)
+	got, err := decodeBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(itgens) {
+		t.Fatalf("expected %d chunks, got %d", len(itgens), len(got))
+	}
+	for i := range itgens {
+		if got[i].Ts != itgens[i].Ts || got[i].Span != itgens[i].Span || !bytes.Equal(got[i].B, itgens[i].B) {
+			t.Fatalf("chunk %d: expected %v, got %v", i, itgens[i], got[i])
+		}
+	}
+
+	for _, corrupt := range [][]byte{nil, {2}, data[:len(data)-1], data[:5]} {
+		if _, err := decodeBlock(corrupt); err == nil {
+			t.Fatalf("expected error decoding %v", corrupt)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	gen := func(ts uint32, b byte) chunk.IterGen {
+		return *chunk.NewBareIterGen([]byte{b}, ts, 100)
+	}
+	cold := []chunk.IterGen{gen(800, 'c'), gen(900, 'c'), gen(1000, 'c'), gen(1100, 'c')}
+	hot := []chunk.IterGen{gen(1000, 'h'), gen(1100, 'h'), gen(1200, 'h'), gen(1300, 'h')}
+
+	got := merge(cold, hot, 950, 1300)
+	expected := []chunk.IterGen{gen(900, 'c'), gen(1000, 'h'), gen(1100, 'h'), gen(1200, 'h')}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d chunks, got %v", len(expected), got)
+	}
+	for i := range expected {
+		if got[i].Ts != expected[i].Ts || got[i].B[0] != expected[i].B[0] {
+			t.Fatalf("chunk %d: expected %v, got %v", i, expected[i], got[i])
+		}
+	}
+
+	if got := merge(nil, nil, 0, 100); len(got) != 0 {
+		t.Fatalf("expected no chunks, got %v", got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	f := newFakeS3(t)
+	defer f.Close()
+	key := test.GetAMKey(1)
+	ctx := test.NewContext()
+
+	// all the chunks, as the hot store had them before they expired
+	history := mdata.NewMockStore()
+	addChunks(t, history, key, 100, 10000)
+	mover := NewMover(newTestStore(t, f, history, 10000), nil, "test")
+	if _, _, err := mover.moveSeries(ctx, target{key, 100000}, 1000, 8000); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hot store only has the chunks of the last hot-ttl
+	hot := mdata.NewMockStore()
+	addChunks(t, hot, key, 5000, 10000)
+	s := newTestStore(t, f, hot, 10000)
+
+	itgens, err := s.Search(ctx, key, 100000, 1550, 9050)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, _ := history.Search(ctx, key, 0, 1550, 9050)
+	if len(itgens) != len(expected) {
+		t.Fatalf("expected %d chunks, got %d", len(expected), len(itgens))
+	}
+	for i := range expected {
+		if itgens[i].Ts != expected[i].Ts || itgens[i].Span != expected[i].Span || !bytes.Equal(itgens[i].B, expected[i].B) {
+			t.Fatalf("chunk %d: expected t0 %d, got %d", i, expected[i].Ts, itgens[i].Ts)
+		}
+	}
+
+	// retentions that fit in the hot store don't use the cold store
+	itgens, err = s.Search(ctx, key, 4000, 1550, 9050)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(itgens) != 41 || itgens[0].Ts != 5000 {
+		t.Fatalf("expected the 41 chunks of the hot store in the range, got %d", len(itgens))
+	}
+}
+
+func TestAddCapsTTL(t *testing.T) {
+	f := newFakeS3(t)
+	defer f.Close()
+	s := newTestStore(t, f, mdata.NewMockStore(), 10000)
+	if got := HotTTLs(s.config, []uint32{100, 5000, 6000, 100000}); len(got) != 2 || got[0] != 100 || got[1] != 5000 {
+		t.Fatalf("expected hot ttls [100 5000], got %v", got)
+	}
+	if s.cold(5000) || !s.cold(5001) {
+		t.Fatalf("expected only ttls over the hot-ttl to be moved to the cold store")
+	}
+}
+
+func TestMarker(t *testing.T) {
+	f := newFakeS3(t)
+	defer f.Close()
+	ctx := test.NewContext()
+	m := NewMover(newTestStore(t, f, mdata.NewMockStore(), 10000), nil, "test")
+	until, err := m.readMarker(ctx)
+	if err != nil || until != 0 {
+		t.Fatalf("expected no marker, got %d, %v", until, err)
+	}
+	if err := m.writeMarker(ctx, 8000); err != nil {
+		t.Fatal(err)
+	}
+	until, err = m.readMarker(ctx)
+	if err != nil || until != 8000 {
+		t.Fatalf("expected marker 8000, got %d, %v", until, err)
+	}
+}
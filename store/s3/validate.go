@@ -0,0 +1,78 @@
+package s3
+
+import (
+	"net/url"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/dur"
+)
+
+// ValidateSchemas checks that min-age leaves enough time for all chunks of a block to be saved
+// to the hot store before the block is moved.
+func ValidateSchemas(schemas []conf.Schema, minAge string) []conf.Finding {
+	var findings []conf.Finding
+	age, err := dur.ParseNDuration(minAge)
+	if err != nil {
+		// reported by ValidateConfig
+		return nil
+	}
+	for _, s := range schemas {
+		for i, ret := range s.Retentions {
+			// chunks are saved once they're closed, which may be as late as the end of the next chunk
+			if age < 2*ret.ChunkSpan {
+				findings = append(findings, conf.NewWarning(s.Name, "retention %d: chunkspan %d is more than half the s3-store min-age of %d. blocks may be moved before all their chunks are saved", i, ret.ChunkSpan, age))
+			}
+		}
+	}
+	return findings
+}
+
+// ValidateConfig checks the settings that can't be validated by their flags alone
+func ValidateConfig(config *StoreConfig) []conf.Finding {
+	var findings []conf.Finding
+	if u, err := url.Parse(config.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		findings = append(findings, conf.NewError("s3-store.endpoint", "must be a url like https://s3.amazonaws.com"))
+	}
+	if config.Bucket == "" {
+		findings = append(findings, conf.NewError("s3-store.bucket", "can't be empty"))
+	}
+	if config.Region == "" {
+		findings = append(findings, conf.NewError("s3-store.region", "can't be empty"))
+	}
+	if (config.AccessKey == "") != (config.SecretKey == "") {
+		findings = append(findings, conf.NewError("s3-store.access-key", "access-key and secret-key must either both be set, or both be empty"))
+	}
+	if config.MoveConcurrency < 1 {
+		findings = append(findings, conf.NewError("s3-store.move-concurrency", "must be 1 or more"))
+	}
+	if config.ReadConcurrency < 1 {
+		findings = append(findings, conf.NewError("s3-store.read-concurrency", "must be 1 or more"))
+	}
+
+	durations := []struct {
+		setting string
+		str     string
+	}{
+		{"hot-ttl", config.HotTTL},
+		{"min-age", config.MinAge},
+		{"block-span", config.BlockSpan},
+		{"move-interval", config.MoveInterval},
+		{"timeout", config.Timeout},
+	}
+	parsed := make(map[string]uint32)
+	for _, d := range durations {
+		sec, err := dur.ParseNDuration(d.str)
+		if err != nil {
+			findings = append(findings, conf.NewError("s3-store."+d.setting, "invalid duration %q: %s", d.str, err))
+			continue
+		}
+		parsed[d.setting] = sec
+	}
+	hotTTL, ok1 := parsed["hot-ttl"]
+	minAge, ok2 := parsed["min-age"]
+	blockSpan, ok3 := parsed["block-span"]
+	if ok1 && ok2 && ok3 && hotTTL <= minAge+blockSpan {
+		findings = append(findings, conf.NewError("s3-store.hot-ttl", "hot-ttl %ds must be longer than min-age + block-span (%ds), or blocks expire from the hot store before they are moved", hotTTL, minAge+blockSpan))
+	}
+	return findings
+}
@@ -0,0 +1,39 @@
+package s3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/grafana/metrictank/conf"
+)
+
+func TestValidateSchemas(t *testing.T) {
+	schemas := []conf.Schema{{
+		Name: "default",
+		Retentions: conf.Retentions{
+			conf.NewRetentionMT(10, 24*3600, 3600, 2, true),
+			conf.NewRetentionMT(3600, 5*365*24*3600, 4*24*3600, 2, true),
+		},
+	}}
+	if findings := ValidateSchemas(schemas, "8d"); len(findings) != 0 {
+		t.Fatalf("expected no findings, got %v", findings)
+	}
+	findings := ValidateSchemas(schemas, "7d")
+	if len(findings) != 1 || findings[0].Error || !strings.Contains(findings[0].Msg, "retention 1: chunkspan 345600") {
+		t.Fatalf("expected a warning about the chunkspan of retention 1, got %v", findings)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := NewStoreConfig()
+	if findings := ValidateConfig(config); len(findings) != 0 {
+		t.Fatalf("expected no findings for the default config, got %v", findings)
+	}
+	config.Endpoint = "s3.amazonaws.com"
+	config.AccessKey = "env:AWS_ACCESS_KEY_ID"
+	config.HotTTL = "14d"
+	findings := ValidateConfig(config)
+	if len(findings) != 3 || findings[0].Subject != "s3-store.endpoint" || findings[1].Subject != "s3-store.access-key" || findings[2].Subject != "s3-store.hot-ttl" {
+		t.Fatalf("expected errors for endpoint, access-key and hot-ttl, got %v", findings)
+	}
+}
@@ -0,0 +1,242 @@
+package tracing
+
+import (
+	"fmt"
+	"math/rand"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/stats"
+)
+
+// metric tracing.forced is how many requests were traced even though they were not sampled, because they were slow or failed
+var forcedTraces = stats.NewCounter32("tracing.forced")
+
+// the window over which the error rate of an endpoint is computed, for the adaptive mode
+const errorWindow = time.Minute
+
+// the minimum number of requests in the window before we act on the error rate
+const minRequests = 10
+
+// Sampling decides which requests to trace, based on their endpoint.
+// requests are traced with the sampling rate of their endpoint, and regardless of that when they are slow or fail.
+// in the adaptive mode, all requests of an endpoint are traced while its error rate is high. endpoints that are not
+// listed in the settings share their error rate.
+// traces of requests that were not sampled only contain the span of the request, not those of the work it did.
+type Sampling struct {
+	endpoints map[string]*endpoint // by path. "*" for all others
+
+	adaptive  bool
+	errorRate float64
+
+	// limits the traces of requests that were not sampled, which can be many when things go wrong
+	sync.Mutex
+	maxForced float64
+	tokens    float64
+	last      time.Time
+}
+
+type endpoint struct {
+	rate float64
+	slow time.Duration // 0 to disable
+
+	sync.Mutex
+	start            time.Time // of the current window
+	requests, errors int
+	prevRequests     int // of the previous window
+	prevErrors       int
+}
+
+// ParseSampling creates the sampling policy from the settings. rates and slow are comma separated lists of
+// endpoint=value, where endpoint is a path like /render, or * for all endpoints that are not listed.
+// rates are between 0 and 1, slow thresholds are durations like 2s. 0 disables them.
+// maxForced limits how many traces per second are made of requests that were not sampled. 0 to disable the limit.
+func ParseSampling(rates, slow string, adaptive bool, errorRate, maxForced float64) (*Sampling, error) {
+	s := &Sampling{
+		endpoints: map[string]*endpoint{"*": {rate: 1}},
+		adaptive:  adaptive,
+		errorRate: errorRate,
+		maxForced: maxForced,
+		tokens:    maxForced,
+	}
+	if errorRate <= 0 || errorRate > 1 {
+		return nil, fmt.Errorf("invalid error rate %f. must be > 0 and <= 1", errorRate)
+	}
+	if maxForced < 0 {
+		return nil, fmt.Errorf("invalid max forced traces per second %f. must be >= 0", maxForced)
+	}
+	err := parseList(rates, func(ep *endpoint, value string) error {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid sampling rate %q. must be between 0 and 1", value)
+		}
+		ep.rate = rate
+		return nil
+	}, s.endpoints)
+	if err != nil {
+		return nil, err
+	}
+	err = parseList(slow, func(ep *endpoint, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid slow threshold %q. must be a duration like 2s", value)
+		}
+		ep.slow = d
+		return nil
+	}, s.endpoints)
+	if err != nil {
+		return nil, err
+	}
+	// endpoints that are only listed in one of the settings, use the default of the other
+	def := s.endpoints["*"]
+	rateSet := listed(rates)
+	slowSet := listed(slow)
+	for name, ep := range s.endpoints {
+		if !rateSet[name] {
+			ep.rate = def.rate
+		}
+		if !slowSet[name] {
+			ep.slow = def.slow
+		}
+	}
+	return s, nil
+}
+
+func parseList(list string, set func(*endpoint, string) error, endpoints map[string]*endpoint) error {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pos := strings.LastIndex(item, "=")
+		if pos == -1 {
+			return fmt.Errorf("invalid item %q. expected endpoint=value", item)
+		}
+		name := normalize(item[:pos])
+		ep, ok := endpoints[name]
+		if !ok {
+			ep = &endpoint{}
+			endpoints[name] = ep
+		}
+		if err := set(ep, strings.TrimSpace(item[pos+1:])); err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func listed(list string) map[string]bool {
+	names := make(map[string]bool)
+	for _, item := range strings.Split(list, ",") {
+		if pos := strings.LastIndex(item, "="); pos != -1 {
+			names[normalize(item[:pos])] = true
+		}
+	}
+	return names
+}
+
+func normalize(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "*" {
+		return name
+	}
+	return path.Clean("/" + name)
+}
+
+func (s *Sampling) endpoint(urlPath string) *endpoint {
+	if ep, ok := s.endpoints[path.Clean(urlPath)]; ok {
+		return ep
+	}
+	return s.endpoints["*"]
+}
+
+// Sample decides whether to trace a request for the given path
+func (s *Sampling) Sample(urlPath string) bool {
+	ep := s.endpoint(urlPath)
+	if s.adaptive && ep.failing(time.Now(), s.errorRate) {
+		return true
+	}
+	return ep.rate >= 1 || (ep.rate > 0 && rand.Float64() < ep.rate)
+}
+
+// Done records the outcome of a request for the given path, and whether it should be traced, even if it was not sampled:
+// it returns the reason ("slow" or "error") if so, or an empty string otherwise.
+func (s *Sampling) Done(urlPath string, sampled bool, duration time.Duration, failed bool) string {
+	ep := s.endpoint(urlPath)
+	now := time.Now()
+	ep.record(now, failed)
+	if sampled {
+		return ""
+	}
+	var reason string
+	if failed {
+		reason = "error"
+	} else if ep.slow > 0 && duration >= ep.slow {
+		reason = "slow"
+	}
+	if reason == "" || !s.allowForced(now) {
+		return ""
+	}
+	forcedTraces.Inc()
+	return reason
+}
+
+// allowForced is a token bucket allowing maxForced traces per second, with bursts of the same size
+func (s *Sampling) allowForced(now time.Time) bool {
+	if s.maxForced == 0 {
+		return true
+	}
+	s.Lock()
+	defer s.Unlock()
+	if !s.last.IsZero() {
+		s.tokens += now.Sub(s.last).Seconds() * s.maxForced
+		if s.tokens > s.maxForced {
+			s.tokens = s.maxForced
+		}
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// roll moves to a new window if the current one is over. must be called with the lock held
+func (ep *endpoint) roll(now time.Time) {
+	if now.Sub(ep.start) < errorWindow {
+		return
+	}
+	if now.Sub(ep.start) < 2*errorWindow {
+		ep.prevRequests, ep.prevErrors = ep.requests, ep.errors
+	} else {
+		ep.prevRequests, ep.prevErrors = 0, 0
+	}
+	ep.requests, ep.errors = 0, 0
+	ep.start = now
+}
+
+func (ep *endpoint) record(now time.Time, failed bool) {
+	ep.Lock()
+	ep.roll(now)
+	ep.requests++
+	if failed {
+		ep.errors++
+	}
+	ep.Unlock()
+}
+
+// failing returns whether the error rate over the current and the previous window is above the threshold
+func (ep *endpoint) failing(now time.Time, threshold float64) bool {
+	ep.Lock()
+	defer ep.Unlock()
+	ep.roll(now)
+	requests := ep.requests + ep.prevRequests
+	if requests < minRequests {
+		return false
+	}
+	return float64(ep.errors+ep.prevErrors)/float64(requests) > threshold
+}
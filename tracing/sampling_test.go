@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSampling(t *testing.T) {
+	s, err := ParseSampling("/render=0.5, metrics/find=0,*=0.1", "/render=5s", false, 0.05, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path string
+		rate float64
+		slow time.Duration
+	}{
+		{"/render", 0.5, 5 * time.Second},
+		{"/render/", 0.5, 5 * time.Second},
+		{"/metrics/find", 0, 0},
+		{"/tags", 0.1, 0},
+	}
+	for _, c := range cases {
+		ep := s.endpoint(c.path)
+		if ep.rate != c.rate || ep.slow != c.slow {
+			t.Fatalf("%s: expected rate %f and slow %s, got %f and %s", c.path, c.rate, c.slow, ep.rate, ep.slow)
+		}
+	}
+
+	invalid := [][2]string{
+		{"/render", ""},
+		{"/render=2", ""},
+		{"", "/render=fast"},
+	}
+	for _, c := range invalid {
+		if _, err := ParseSampling(c[0], c[1], false, 0.05, 10); err == nil {
+			t.Fatalf("expected error for %q %q", c[0], c[1])
+		}
+	}
+}
+
+func TestSamplingForced(t *testing.T) {
+	s, err := ParseSampling("*=0", "*=1s", false, 0.05, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Sample("/render") {
+		t.Fatal("expected request not to be sampled")
+	}
+	if reason := s.Done("/render", false, time.Millisecond, false); reason != "" {
+		t.Fatalf("expected fast request not to be traced, got %q", reason)
+	}
+	if reason := s.Done("/render", true, time.Minute, false); reason != "" {
+		t.Fatalf("expected sampled request not to be forced, got %q", reason)
+	}
+	if reason := s.Done("/render", false, time.Minute, false); reason != "slow" {
+		t.Fatalf("expected slow request to be traced, got %q", reason)
+	}
+	if reason := s.Done("/render", false, time.Millisecond, true); reason != "error" {
+		t.Fatalf("expected failed request to be traced, got %q", reason)
+	}
+	if reason := s.Done("/render", false, time.Millisecond, true); reason != "" {
+		t.Fatalf("expected forced traces to be limited, got %q", reason)
+	}
+}
+
+func TestSamplingAdaptive(t *testing.T) {
+	s, err := ParseSampling("/render=0,*=0", "", true, 0.5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < minRequests; i++ {
+		s.Done("/render", false, time.Millisecond, i%2 == 0)
+	}
+	if s.Sample("/render") {
+		t.Fatal("expected error rate of 0.5 not to trigger sampling")
+	}
+	s.Done("/render", false, time.Millisecond, true)
+	if !s.Sample("/render") {
+		t.Fatal("expected high error rate to trigger sampling")
+	}
+	if s.Sample("/metrics/find") {
+		t.Fatal("expected other endpoints not to be affected")
+	}
+}
@@ -0,0 +1,18 @@
+package util
+
+import "sync/atomic"
+
+// LogLevel is the log level of a package. It can be changed at runtime while the package reads it.
+type LogLevel struct {
+	level int32
+}
+
+// Get returns the log level
+func (l *LogLevel) Get() int {
+	return int(atomic.LoadInt32(&l.level))
+}
+
+// Set sets the log level
+func (l *LogLevel) Set(level int) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
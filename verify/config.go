@@ -0,0 +1,49 @@
+package verify
+
+import (
+	"flag"
+	"time"
+
+	"github.com/grafana/metrictank/conf"
+	"github.com/raintank/worldping-api/pkg/log"
+	"github.com/rakyll/globalconf"
+)
+
+var (
+	Enabled  bool
+	interval time.Duration
+	series   int
+	points   int
+)
+
+func ConfigSetup() {
+	fs := flag.NewFlagSet("rollup-verifier", flag.ExitOnError)
+	fs.BoolVar(&Enabled, "enabled", false, "periodically check that the rollups in the store match the raw data they were computed from, for a sample of series. checks can also be requested via the /verify/rollups endpoint")
+	fs.DurationVar(&interval, "interval", time.Hour, "how often to check a sample of series")
+	fs.IntVar(&series, "series", 10, "how many series to check each time")
+	fs.IntVar(&points, "points", 10, "how many points of each rollup to check, per series")
+	globalconf.Register("rollup-verifier", fs)
+}
+
+// ConfigValidate checks the settings, for the validate-config mode
+func ConfigValidate() []conf.Finding {
+	var findings []conf.Finding
+	if interval <= 0 {
+		findings = append(findings, conf.NewError("rollup-verifier.interval", "must be positive"))
+	}
+	if series < 1 {
+		findings = append(findings, conf.NewError("rollup-verifier.series", "must be at least 1"))
+	}
+	if points < 1 {
+		findings = append(findings, conf.NewError("rollup-verifier.points", "must be at least 1"))
+	}
+	return findings
+}
+
+func ConfigProcess() {
+	for _, f := range ConfigValidate() {
+		if f.Error {
+			log.Fatal(4, "%s: %s", f.Subject, f.Msg)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package verify checks that the rollups in the store match the raw data they were computed from.
+// for a sample of series, it recomputes the rollup points of a random window from the raw chunks,
+// and compares them against the stored rollup chunks. discrepancies point to aggregation bugs,
+// or chunks that were lost or corrupted when they were written.
+package verify
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/stats"
+	"github.com/raintank/worldping-api/pkg/log"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+var (
+	// metric verify.series is how many series the rollup verifier checked
+	seriesChecked = stats.NewCounter32("verify.series")
+	// metric verify.points is how many rollup points the rollup verifier checked
+	pointsChecked = stats.NewCounter32("verify.points")
+	// metric verify.discrepancies is how many rollup points did not match the raw data they were computed from
+	discrepancies = stats.NewCounter32("verify.discrepancies")
+	// metric verify.errors is how many series could not be checked, because reading from the store failed
+	verifyErrors = stats.NewCounter32("verify.errors")
+)
+
+// values are compared with this relative tolerance, because sums may be computed in a different order
+const tolerance = 1e-9
+
+// Discrepancy is a rollup point that does not match the raw data
+type Discrepancy struct {
+	Archive string `json:"archive"` // e.g. sum_600
+	Ts      uint32 `json:"ts"`
+	// nil if the point is missing from the rollup, or if there is no raw data for it
+	Stored   *float64 `json:"stored"`
+	Expected *float64 `json:"expected"`
+}
+
+// SeriesResult is the outcome of checking one series
+type SeriesResult struct {
+	Series        string        `json:"series"`
+	Name          string        `json:"name"`
+	Org           uint32        `json:"org"`
+	Windows       []Window      `json:"windows"`
+	Points        int           `json:"points"`
+	Discrepancies []Discrepancy `json:"discrepancies"`
+	Error         string        `json:"error,omitempty"`
+}
+
+// Window is the time range in which the rollup with the given span was checked
+type Window struct {
+	Span uint32 `json:"span"`
+	From uint32 `json:"from"` // exclusive
+	To   uint32 `json:"to"`   // inclusive
+}
+
+// Report is the outcome of checking a number of series
+type Report struct {
+	Time          time.Time      `json:"time"`
+	Series        int            `json:"series"`
+	Points        int            `json:"points"`
+	Discrepancies int            `json:"discrepancies"`
+	Errors        int            `json:"errors"`
+	Results       []SeriesResult `json:"results"` // only the series with discrepancies or errors
+}
+
+// Verifier checks a sample of the series of the index, periodically or on demand
+type Verifier struct {
+	index idx.MetricIndex
+	store mdata.Store
+
+	sync.Mutex
+	last *Report
+}
+
+func New(index idx.MetricIndex, store mdata.Store) *Verifier {
+	return &Verifier{
+		index: index,
+		store: store,
+	}
+}
+
+// Run checks a sample of the series every interval
+func (v *Verifier) Run() {
+	for range time.Tick(interval) {
+		v.Check(v.Sample(series), time.Now())
+	}
+}
+
+// Last returns the report of the last check, or nil if there was none
+func (v *Verifier) Last() *Report {
+	v.Lock()
+	defer v.Unlock()
+	return v.last
+}
+
+// Sample returns up to n random series that have rollups
+func (v *Verifier) Sample(n int) []idx.Archive {
+	sample := make([]idx.Archive, 0, n)
+	seen := 0
+	// Count is the only way to visit the series of all orgs without copying them.
+	// we use it for reservoir sampling, so this stays cheap while holding the index lock
+	v.index.Count(func(a idx.Archive) bool {
+		if len(mdata.GetSchema(a.SchemaId).Retentions) < 2 {
+			return false
+		}
+		seen++
+		if len(sample) < n {
+			sample = append(sample, a)
+		} else if i := rand.Intn(seen); i < n {
+			sample[i] = a
+		}
+		return false
+	})
+	return sample
+}
+
+// Check checks the given series and records the report as the last one
+func (v *Verifier) Check(archives []idx.Archive, now time.Time) Report {
+	report := Report{
+		Time:    now,
+		Results: []SeriesResult{},
+	}
+	for _, a := range archives {
+		res := v.Series(context.Background(), a, uint32(now.Unix()))
+		seriesChecked.Inc()
+		pointsChecked.Add(res.Points)
+		discrepancies.Add(len(res.Discrepancies))
+		report.Series++
+		report.Points += res.Points
+		report.Discrepancies += len(res.Discrepancies)
+		if res.Error != "" {
+			verifyErrors.Inc()
+			report.Errors++
+			log.Warn("verify: could not check rollups of %s (%s): %s", a.Id, a.Name, res.Error)
+		} else if len(res.Discrepancies) > 0 {
+			log.Warn("verify: %d rollup points of %s (%s) do not match the raw data", len(res.Discrepancies), a.Id, a.Name)
+		}
+		if res.Error != "" || len(res.Discrepancies) > 0 {
+			report.Results = append(report.Results, res)
+		}
+	}
+	v.Lock()
+	v.last = &report
+	v.Unlock()
+	return report
+}
+
+// Series checks the rollups of the given series, each in a random window.
+// the windows are chosen such that the raw data is still retained, and all chunks have been persisted.
+func (v *Verifier) Series(ctx context.Context, a idx.Archive, now uint32) SeriesResult {
+	res := SeriesResult{
+		Series:        a.Id.String(),
+		Name:          a.Name,
+		Org:           a.OrgId,
+		Windows:       []Window{},
+		Discrepancies: []Discrepancy{},
+	}
+	rets := mdata.GetSchema(a.SchemaId).Retentions
+	methods := mdata.RollupMethods(mdata.GetAgg(a.AggId))
+	if len(rets) < 2 || len(methods) == 0 {
+		return res
+	}
+	raw := rets[0]
+	var lag uint32
+	for _, ret := range rets {
+		if ret.ChunkSpan > lag {
+			lag = ret.ChunkSpan
+		}
+	}
+	// chunks are persisted once they're closed, which may be as late as the end of the next chunk
+	newest := int64(now) - 2*int64(lag)
+	oldest := int64(now) - int64(raw.MaxRetention()) + int64(raw.ChunkSpan)
+
+	for _, ret := range rets[1:] {
+		span := uint32(ret.SecondsPerPoint)
+		length := int64(span) * int64(points)
+		if newest-oldest < length+int64(span) {
+			continue
+		}
+		start := oldest + rand.Int63n(newest-oldest-length-int64(span)+1)
+		w := Window{
+			Span: span,
+			From: uint32(start) + span - uint32(start)%span,
+		}
+		w.To = w.From + uint32(length)
+		res.Windows = append(res.Windows, w)
+
+		rawPoints, err := mdata.ReadPoints(ctx, v.store, schema.AMKey{MKey: a.Id}, uint32(raw.MaxRetention()), w.From, w.To)
+		if err != nil {
+			res.Error = err.Error()
+			return res
+		}
+		expected := mdata.AggregatePoints(rawPoints, span)
+		for _, method := range methods {
+			archive := schema.NewArchive(method, span)
+			stored, err := mdata.ReadPoints(ctx, v.store, schema.AMKey{MKey: a.Id, Archive: archive}, uint32(ret.MaxRetention()), w.From, w.To)
+			if err != nil {
+				res.Error = err.Error()
+				return res
+			}
+			res.Discrepancies = append(res.Discrepancies, compare(archive, method, expected, stored)...)
+			res.Points += len(expected)
+		}
+	}
+	return res
+}
+
+func compare(archive schema.Archive, method schema.Method, expected map[uint32]*mdata.Aggregation, stored []schema.Point) []Discrepancy {
+	var out []Discrepancy
+	storedByTs := make(map[uint32]float64, len(stored))
+	for _, p := range stored {
+		storedByTs[p.Ts] = p.Val
+		if _, ok := expected[p.Ts]; !ok {
+			val := p.Val
+			out = append(out, Discrepancy{Archive: archive.String(), Ts: p.Ts, Stored: &val})
+		}
+	}
+	for ts, agg := range expected {
+		exp := agg.Value(method)
+		val, ok := storedByTs[ts]
+		if !ok {
+			out = append(out, Discrepancy{Archive: archive.String(), Ts: ts, Expected: &exp})
+			continue
+		}
+		if !equal(val, exp) {
+			out = append(out, Discrepancy{Archive: archive.String(), Ts: ts, Stored: &val, Expected: &exp})
+		}
+	}
+	return out
+}
+
+func equal(a, b float64) bool {
+	if math.IsNaN(a) && math.IsNaN(b) {
+		return true
+	}
+	return math.Abs(a-b) <= tolerance*math.Max(math.Abs(a), math.Abs(b))
+}
@@ -0,0 +1,96 @@
+package verify
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/metrictank/cluster"
+	"github.com/grafana/metrictank/conf"
+	"github.com/grafana/metrictank/idx"
+	"github.com/grafana/metrictank/mdata"
+	"github.com/grafana/metrictank/mdata/cache"
+	"github.com/grafana/metrictank/mdata/chunk"
+	"github.com/grafana/metrictank/test"
+	schema "gopkg.in/raintank/schema.v1"
+)
+
+func TestSeries(t *testing.T) {
+	cluster.Init("default", "test", time.Now(), "http", 6060)
+	cluster.Manager.SetPrimary(true)
+	points = 10
+
+	// the raw data is retained from 100000 on, and persisted until 107200
+	raw := conf.NewRetentionMT(10, 9000, 600, 2, true)
+	rollup := conf.NewRetentionMT(60, 100000, 600, 2, true)
+	mdata.SetSingleSchema(raw, rollup)
+	mdata.SetSingleAgg(conf.Avg, conf.Max)
+	agg := mdata.GetAgg(0)
+	now := uint32(108400)
+
+	store := mdata.NewMockStore()
+	key := test.GetAMKey(1)
+	m := mdata.NewAggMetric(store, &cache.MockCache{}, key, conf.Retentions{raw, rollup}, 0, &agg, false)
+	for ts := uint32(100000); ts <= 107200; ts += 10 {
+		m.Add(ts, float64(ts%70))
+	}
+	m.Flush()
+
+	a := idx.Archive{}
+	a.Id = key.MKey
+	v := New(nil, store)
+	res := v.Series(context.Background(), a, now)
+	if res.Error != "" || len(res.Discrepancies) != 0 {
+		t.Fatalf("expected no discrepancies, got %+v", res)
+	}
+	// 10 points of sum, cnt and max
+	if res.Points != 30 || len(res.Windows) != 1 {
+		t.Fatalf("expected 30 points in 1 window to be checked, got %+v", res)
+	}
+
+	// corrupt the max rollup in all chunks that the random window may cover: it starts after 100000 and ends at 107200 at the latest.
+	// the later chunk takes precedence
+	maxKey := schema.AMKey{MKey: key.MKey, Archive: schema.NewArchive(schema.Max, 60)}
+	for t0 := uint32(99600); t0 < 107400; t0 += 600 {
+		c := chunk.New(t0)
+		for ts := t0 + 60; ts <= t0+600; ts += 60 {
+			c.Push(ts, 1000)
+		}
+		c.Finish()
+		cwr := mdata.NewChunkWriteRequest(nil, maxKey, c, 0, 600, time.Now())
+		store.Add(&cwr)
+	}
+	res = v.Series(context.Background(), a, now)
+	if res.Error != "" || len(res.Discrepancies) != 10 {
+		t.Fatalf("expected 10 discrepancies, got %+v", res)
+	}
+	for _, d := range res.Discrepancies {
+		if d.Archive != "max_60" || d.Stored == nil || *d.Stored != 1000 || d.Expected == nil {
+			t.Fatalf("unexpected discrepancy %+v", d)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	expected := mdata.AggregatePoints([]schema.Point{{Val: 1, Ts: 55}, {Val: 3, Ts: 60}, {Val: 5, Ts: 61}}, 60)
+	stored := []schema.Point{{Val: 4, Ts: 60}, {Val: 1, Ts: 180}}
+	out := compare(schema.NewArchive(schema.Sum, 60), schema.Sum, expected, stored)
+	// 120 is missing from the stored rollup, 180 has no raw data
+	if len(out) != 2 {
+		t.Fatalf("expected 2 discrepancies, got %+v", out)
+	}
+	for _, d := range out {
+		switch d.Ts {
+		case 120:
+			if d.Stored != nil || *d.Expected != 5 {
+				t.Fatalf("unexpected discrepancy %+v", d)
+			}
+		case 180:
+			if d.Expected != nil || *d.Stored != 1 {
+				t.Fatalf("unexpected discrepancy %+v", d)
+			}
+		default:
+			t.Fatalf("unexpected discrepancy %+v", d)
+		}
+	}
+}